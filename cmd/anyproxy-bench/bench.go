@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// benchOptions are the flags of the run command
+type benchOptions struct {
+	Proxy       string
+	Target      string
+	Concurrency int
+	Requests    int
+	Duration    time.Duration
+	PayloadSize int
+	ChunkSize   int
+	Ramp        time.Duration
+	RampSteps   int
+	Timeout     time.Duration
+}
+
+// bench opens connections through a proxy and records their latencies
+type bench struct {
+	opts      benchOptions
+	proxyAddr string
+	dial      func(ctx context.Context) (net.Conn, error)
+	payload   []byte
+
+	started  atomic.Int64 // Connections claimed by workers, bounded by -n
+	mu       sync.Mutex
+	connects []time.Duration // Time until the proxy tunnel was established
+	echoes   []time.Duration // Time to send and receive back the payload
+	errors   map[string]int  // Failed connections by error
+	bytes    int64           // Payload bytes sent and received
+}
+
+// newBench validates the options and prepares the proxy dialer
+func newBench(opts benchOptions) (*bench, error) {
+	if opts.Concurrency <= 0 || opts.Requests < 0 || opts.PayloadSize < 0 || opts.ChunkSize <= 0 || opts.RampSteps < 0 {
+		return nil, errors.New("-c and -chunk must be positive, -n, -size and -ramp-steps cannot be negative")
+	}
+	if opts.Requests == 0 && opts.Duration <= 0 {
+		return nil, errors.New("either -n or -duration must be set")
+	}
+	if _, _, err := net.SplitHostPort(opts.Target); err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", opts.Target, err)
+	}
+	u, err := url.Parse(opts.Proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", opts.Proxy)
+	}
+
+	b := &bench{opts: opts, proxyAddr: u.Host, payload: bytes.Repeat([]byte("anyproxy"), opts.PayloadSize/8+1)[:opts.PayloadSize], errors: make(map[string]int)}
+	switch u.Scheme {
+	case "http":
+		b.dial = func(ctx context.Context) (net.Conn, error) { return dialConnect(ctx, u, opts.Target) }
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		b.dial = func(ctx context.Context) (net.Conn, error) {
+			return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", opts.Target)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, must be http or socks5", u.Scheme)
+	}
+	return b, nil
+}
+
+// dialConnect opens a tunnel to target with an HTTP CONNECT request
+func dialConnect(ctx context.Context, proxyURL *url.URL, target string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: target}, Host: target, Header: make(http.Header)}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy answered %s", resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		_ = conn.Close()
+		return nil, errors.New("proxy sent data before the tunnel was established")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// run drives the load until -n connections were opened, -duration elapsed or ctx is canceled
+func (b *bench) run(ctx context.Context) *report {
+	if b.opts.Requests == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.opts.Duration)
+		defer cancel()
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for worker := 0; worker < b.opts.Concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.work(ctx, worker, start)
+		}()
+	}
+	wg.Wait()
+	return b.report(time.Since(start))
+}
+
+// work opens connections one after the other while the ramp allows this worker to run
+func (b *bench) work(ctx context.Context, worker int, start time.Time) {
+	for ctx.Err() == nil {
+		if worker >= b.concurrencyAt(time.Since(start)) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(50 * time.Millisecond):
+			}
+			continue
+		}
+		if b.opts.Requests > 0 && b.started.Add(1) > int64(b.opts.Requests) {
+			return
+		}
+		b.connection(ctx)
+	}
+}
+
+// concurrencyAt returns the workers allowed to run at elapsed time into the ramp
+func (b *bench) concurrencyAt(elapsed time.Duration) int {
+	c := b.opts.Concurrency
+	if b.opts.Ramp <= 0 || elapsed >= b.opts.Ramp {
+		return c
+	}
+	progress := float64(elapsed) / float64(b.opts.Ramp)
+	if steps := b.opts.RampSteps; steps > 0 {
+		progress = float64(int(progress*float64(steps))+1) / float64(steps)
+	}
+	return max(1, int(progress*float64(c)))
+}
+
+// connection opens one tunnel and echoes the payload through it
+func (b *bench) connection(runCtx context.Context) {
+	ctx, cancel := context.WithTimeout(runCtx, b.opts.Timeout)
+	defer cancel()
+
+	begin := time.Now()
+	conn, err := b.dial(ctx)
+	if err != nil {
+		b.fail(runCtx, "connect", err)
+		return
+	}
+	defer conn.Close()
+	connected := time.Now()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if len(b.payload) > 0 {
+		errc := make(chan error, 1)
+		go func() {
+			for sent := 0; sent < len(b.payload); sent += b.opts.ChunkSize {
+				if _, err := conn.Write(b.payload[sent:min(sent+b.opts.ChunkSize, len(b.payload))]); err != nil {
+					errc <- err
+					return
+				}
+			}
+			errc <- nil
+		}()
+		received := make([]byte, len(b.payload))
+		_, err := io.ReadFull(conn, received)
+		if werr := <-errc; err == nil {
+			err = werr
+		}
+		if err == nil && !bytes.Equal(received, b.payload) {
+			err = errors.New("echoed payload differs")
+		}
+		if err != nil {
+			b.fail(runCtx, "echo", err)
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connects = append(b.connects, connected.Sub(begin))
+	if len(b.payload) > 0 {
+		b.echoes = append(b.echoes, time.Since(connected))
+		b.bytes += 2 * int64(len(b.payload))
+	}
+}
+
+// fail counts a failed connection, connections cut by the end of the run are not failures
+func (b *bench) fail(runCtx context.Context, stage string, err error) {
+	if runCtx.Err() != nil {
+		return
+	}
+	reason := err.Error()
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		reason = "timeout"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errors[stage+": "+reason]++
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Output formats
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// latencyStats are the percentiles of a latency, in milliseconds
+type latencyStats struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// report is the result of a run
+type report struct {
+	Duration          float64        `json:"duration_seconds"`
+	Succeeded         int            `json:"succeeded"`
+	Failed            int            `json:"failed"`
+	ConnectionsPerSec float64        `json:"connections_per_second"`
+	BytesPerSec       float64        `json:"bytes_per_second"` // Payload sent and echoed back
+	Connect           latencyStats   `json:"connect"`          // Until the proxy tunnel was established
+	Echo              latencyStats   `json:"echo"`             // Sending the payload and receiving it back
+	Errors            map[string]int `json:"errors,omitempty"`
+}
+
+// report summarizes the recorded connections of a run that took elapsed
+func (b *bench) report(elapsed time.Duration) *report {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := &report{
+		Duration:  elapsed.Seconds(),
+		Succeeded: len(b.connects),
+		Connect:   newLatencyStats(b.connects),
+		Echo:      newLatencyStats(b.echoes),
+		Errors:    b.errors,
+	}
+	for _, count := range b.errors {
+		r.Failed += count
+	}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		r.ConnectionsPerSec = float64(r.Succeeded) / seconds
+		r.BytesPerSec = float64(b.bytes) / seconds
+	}
+	return r
+}
+
+// newLatencyStats computes the percentiles of latencies
+func newLatencyStats(latencies []time.Duration) latencyStats {
+	if len(latencies) == 0 {
+		return latencyStats{}
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	var total time.Duration
+	for _, latency := range sorted {
+		total += latency
+	}
+	percentile := func(p float64) float64 {
+		return ms(sorted[min(len(sorted)-1, int(p*float64(len(sorted))))])
+	}
+	return latencyStats{
+		Count: len(sorted),
+		Mean:  ms(total / time.Duration(len(sorted))),
+		P50:   percentile(0.50),
+		P90:   percentile(0.90),
+		P99:   percentile(0.99),
+		Max:   ms(sorted[len(sorted)-1]),
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// printReport writes a report as a table or JSON
+func printReport(w io.Writer, format string, r *report) error {
+	if format == outputJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	}
+
+	fmt.Fprintf(w, "Duration:     %.2fs\n", r.Duration)
+	fmt.Fprintf(w, "Connections:  %d succeeded, %d failed (%.1f/s)\n", r.Succeeded, r.Failed, r.ConnectionsPerSec)
+	fmt.Fprintf(w, "Throughput:   %s/s\n\n", formatBytes(r.BytesPerSec))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LATENCY\tCOUNT\tMEAN\tP50\tP90\tP99\tMAX")
+	for _, row := range []struct {
+		name  string
+		stats latencyStats
+	}{{"connect", r.Connect}, {"echo", r.Echo}} {
+		s := row.stats
+		fmt.Fprintf(tw, "%s\t%d\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t%.1fms\n", row.name, s.Count, s.Mean, s.P50, s.P90, s.P99, s.Max)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(r.Errors) > 0 {
+		fmt.Fprintln(w, "\nErrors:")
+		reasons := make([]string, 0, len(r.Errors))
+		for reason := range r.Errors {
+			reasons = append(reasons, reason)
+		}
+		sort.Slice(reasons, func(i, j int) bool { return r.Errors[reasons[i]] > r.Errors[reasons[j]] })
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "  %6d  %s\n", r.Errors[reason], reason)
+		}
+	}
+	return nil
+}
+
+// formatBytes formats a byte count with a binary unit
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 3 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/unit, "KMGT"[exp])
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"time"
+)
+
+// apiClient talks to the gateway web admin API
+type apiClient struct {
+	baseURL  string
+	username string
+	password string
+	http     *http.Client
+	loggedIn bool
+}
+
+// newAPIClient creates an admin API client, credentials are optional when web auth is disabled
+func newAPIClient(server, username, password string) (*apiClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar: %v", err)
+	}
+
+	if !strings.HasPrefix(server, "http://") && !strings.HasPrefix(server, "https://") {
+		server = "http://" + server
+	}
+
+	return &apiClient{
+		baseURL:  strings.TrimRight(server, "/"),
+		username: username,
+		password: password,
+		http: &http.Client{
+			Jar:     jar,
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+// login obtains a session cookie from the gateway
+func (c *apiClient) login() error {
+	body, err := json.Marshal(map[string]string{
+		"username": c.username,
+		"password": c.password,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Post(c.baseURL+"/api/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("login request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login failed: %s", readError(resp))
+	}
+	c.loggedIn = true
+	return nil
+}
+
+// ensureLogin logs in once when credentials are configured
+func (c *apiClient) ensureLogin() error {
+	if c.username != "" && !c.loggedIn {
+		return c.login()
+	}
+	return nil
+}
+
+// do sends a request and decodes the JSON response into out (if not nil)
+func (c *apiClient) do(method, path string, in, out interface{}) error {
+	if err := c.ensureLogin(); err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("authentication required: use -user/-password or ANYPROXY_ADMIN_USER/ANYPROXY_ADMIN_PASSWORD")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, path, readError(resp))
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// stream sends a request without the client timeout and returns the raw response,
+// used for long running output and upgraded connections
+func (c *apiClient) stream(method, path string, header http.Header) (*http.Response, error) {
+	if err := c.ensureLogin(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	streaming := *c.http
+	streaming.Timeout = 0
+	resp, err := streaming.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	return resp, nil
+}
+
+// readError extracts the error message of a failed response
+func readError(resp *http.Response) string {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := strings.TrimSpace(string(data))
+	if msg == "" {
+		msg = resp.Status
+	}
+	return msg
+}
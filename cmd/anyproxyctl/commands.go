@@ -0,0 +1,811 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+)
+
+// auditPollInterval is how often "audit -f" polls for new entries
+const auditPollInterval = 2 * time.Second
+
+// clientMetrics mirrors the gateway /api/metrics/clients response
+type clientMetrics struct {
+	ClientID          string    `json:"client_id"`
+	ActiveConnections int64     `json:"active_connections"`
+	TotalConnections  int64     `json:"total_connections"`
+	BytesSent         int64     `json:"bytes_sent"`
+	BytesReceived     int64     `json:"bytes_received"`
+	ErrorCount        int64     `json:"error_count"`
+	LastSeen          time.Time `json:"last_seen"`
+	IsOnline          bool      `json:"is_online"`
+	Version           string    `json:"version"`
+	VersionSkew       bool      `json:"version_skew"`
+}
+
+// connectionMetrics mirrors the gateway /api/metrics/connections response
+type connectionMetrics struct {
+	ConnectionID  string    `json:"connection_id"`
+	ClientID      string    `json:"client_id"`
+	TargetHost    string    `json:"target_host"`
+	StartTime     time.Time `json:"start_time"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Status        string    `json:"status"`
+	Duration      int64     `json:"duration"`
+	SourceCountry string    `json:"source_country"`
+	TargetCountry string    `json:"target_country"`
+}
+
+// groupStatus mirrors the gateway /api/admin/groups response
+type groupStatus struct {
+	GroupID           string   `json:"group_id"`
+	Clients           []string `json:"clients"`
+	ActiveConnections int      `json:"active_connections"`
+	MaxClients        int      `json:"max_clients"`
+	MaxConnections    int      `json:"max_connections"`
+	StickySession     string   `json:"sticky_session,omitempty"`
+}
+
+// auditEntry mirrors the gateway /api/admin/audit response
+type auditEntry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target,omitempty"`
+	Success    bool      `json:"success"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// latencySummary mirrors the percentiles of a gateway latency histogram
+type latencySummary struct {
+	Count int64   `json:"count"`
+	P50Ms float64 `json:"p50_ms"`
+	P90Ms float64 `json:"p90_ms"`
+	P99Ms float64 `json:"p99_ms"`
+}
+
+// latencyStats mirrors the gateway /api/metrics/latency response
+type latencyStats struct {
+	Clients map[string]struct {
+		Dial latencySummary `json:"dial"`
+		TTFB latencySummary `json:"ttfb"`
+	} `json:"clients"`
+	Targets map[string]struct {
+		Dial latencySummary `json:"dial"`
+		TTFB latencySummary `json:"ttfb"`
+	} `json:"targets"`
+}
+
+// userStats mirrors the stats of one proxy user in the gateway /api/metrics/users responses
+type userStats struct {
+	GroupID           string `json:"group_id"`
+	Username          string `json:"username"`
+	ActiveConnections int64  `json:"active_connections"`
+	TotalConnections  int64  `json:"total_connections"`
+	FailedConnections int64  `json:"failed_connections"`
+	BytesSent         int64  `json:"bytes_sent"`
+	BytesReceived     int64  `json:"bytes_received"`
+	TopTargets        []struct {
+		Host          string `json:"host"`
+		Connections   int64  `json:"connections"`
+		BytesSent     int64  `json:"bytes_sent"`
+		BytesReceived int64  `json:"bytes_received"`
+	} `json:"top_targets,omitempty"`
+}
+
+// proxyUsers mirrors the gateway /api/metrics/users response
+type proxyUsers struct {
+	Users   []userStats `json:"users"`
+	Evicted int64       `json:"evicted"`
+}
+
+// topTargets mirrors the gateway /api/metrics/targets response
+type topTargets struct {
+	Targets []struct {
+		Host          string    `json:"host"`
+		Connections   int64     `json:"connections"`
+		BytesSent     int64     `json:"bytes_sent"`
+		BytesReceived int64     `json:"bytes_received"`
+		LastSeen      time.Time `json:"last_seen"`
+	} `json:"targets"`
+	Evicted int64 `json:"evicted"`
+}
+
+// accessOverride mirrors an override of the gateway /api/admin/schedule/overrides response
+type accessOverride struct {
+	GroupID  string    `json:"group_id"`
+	Username string    `json:"username,omitempty"`
+	Allow    bool      `json:"allow"`
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// dryRunResult mirrors the gateway /api/admin/dryrun response
+type dryRunResult struct {
+	Allowed   bool   `json:"allowed"`
+	Group     string `json:"group"`
+	Target    string `json:"target"`
+	ClientID  string `json:"client_id,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Steps     []struct {
+		Stage  string `json:"stage"`
+		Result string `json:"result"`
+		Detail string `json:"detail,omitempty"`
+	} `json:"steps"`
+}
+
+// adminResponse mirrors the gateway admin action response
+type adminResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// ctl dispatches anyproxyctl commands
+type ctl struct {
+	api     *apiClient
+	printer *printer
+}
+
+// run executes a command
+func (c *ctl) run(command string, args []string) error {
+	switch command {
+	case "clients":
+		return c.listClients()
+	case "connections":
+		return c.listConnections()
+	case "latency":
+		return c.showLatency(args)
+	case "top":
+		return c.topTargets(args)
+	case "users":
+		return c.users(args)
+	case "groups":
+		return c.showGroups(args)
+	case "topology":
+		return c.topology(args)
+	case "kick":
+		return c.kickClient(args)
+	case "audit":
+		return c.audit(args)
+	case "credentials":
+		return c.credentials(args)
+	case "ratelimit":
+		return c.rateLimit(args)
+	case "schedule":
+		return c.schedule(args)
+	case "dryrun":
+		return c.dryRun(args)
+	case "diagnose":
+		return c.diagnose(args)
+	case "metrics":
+		return c.metrics(args)
+	case "exec":
+		return c.execCommand(args)
+	case "shell":
+		return c.shell(args)
+	case "release":
+		return c.release(args)
+	case "policy":
+		return c.policy(args)
+	default:
+		return fmt.Errorf("unknown command: %s (run anyproxyctl -h for usage)", command)
+	}
+}
+
+// listClients prints all clients known to the gateway
+func (c *ctl) listClients() error {
+	var clients map[string]*clientMetrics
+	if err := c.api.do(http.MethodGet, "/api/metrics/clients", nil, &clients); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	rows := make([][]string, 0, len(ids))
+	for _, id := range ids {
+		m := clients[id]
+		status := "offline"
+		if m.IsOnline {
+			status = "online"
+		}
+		clientVersion := m.Version
+		if clientVersion == "" {
+			clientVersion = "-"
+		}
+		if m.VersionSkew {
+			clientVersion += " (skew)"
+		}
+		rows = append(rows, []string{
+			id,
+			status,
+			clientVersion,
+			strconv.FormatInt(m.ActiveConnections, 10),
+			strconv.FormatInt(m.TotalConnections, 10),
+			formatBytes(m.BytesSent),
+			formatBytes(m.BytesReceived),
+			strconv.FormatInt(m.ErrorCount, 10),
+			m.LastSeen.Format(time.RFC3339),
+		})
+	}
+	return c.printer.printTable(clients, []string{"CLIENT", "STATUS", "VERSION", "ACTIVE", "TOTAL", "SENT", "RECEIVED", "ERRORS", "LAST SEEN"}, rows)
+}
+
+// listConnections prints the proxied connections tracked by the gateway
+func (c *ctl) listConnections() error {
+	var conns map[string]*connectionMetrics
+	if err := c.api.do(http.MethodGet, "/api/metrics/connections", nil, &conns); err != nil {
+		return err
+	}
+
+	list := make([]*connectionMetrics, 0, len(conns))
+	for _, conn := range conns {
+		list = append(list, conn)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+
+	rows := make([][]string, 0, len(list))
+	for _, conn := range list {
+		rows = append(rows, []string{
+			conn.ConnectionID,
+			conn.ClientID,
+			conn.TargetHost,
+			conn.Status,
+			time.Duration(conn.Duration).Round(time.Second).String(),
+			formatBytes(conn.BytesSent),
+			formatBytes(conn.BytesReceived),
+			formatGeo(conn.SourceCountry, conn.TargetCountry),
+		})
+	}
+	return c.printer.printTable(conns, []string{"CONN", "CLIENT", "TARGET", "STATUS", "DURATION", "SENT", "RECEIVED", "GEO"}, rows)
+}
+
+// showLatency prints dial and time-to-first-byte percentiles per client, or per target with "targets"
+func (c *ctl) showLatency(args []string) error {
+	var stats latencyStats
+	if err := c.api.do(http.MethodGet, "/api/metrics/latency", nil, &stats); err != nil {
+		return err
+	}
+
+	keyHeader := "CLIENT"
+	entries := stats.Clients
+	if len(args) > 0 && args[0] == "targets" {
+		keyHeader = "TARGET"
+		entries = stats.Targets
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rows := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		e := entries[key]
+		rows = append(rows, []string{
+			key,
+			strconv.FormatInt(e.Dial.Count, 10),
+			formatMs(e.Dial.P50Ms), formatMs(e.Dial.P90Ms), formatMs(e.Dial.P99Ms),
+			formatMs(e.TTFB.P50Ms), formatMs(e.TTFB.P90Ms), formatMs(e.TTFB.P99Ms),
+		})
+	}
+	return c.printer.printTable(entries, []string{keyHeader, "DIALS", "DIAL P50", "DIAL P90", "DIAL P99", "TTFB P50", "TTFB P90", "TTFB P99"}, rows)
+}
+
+// topTargets prints the busiest target hosts of a group, or of all groups
+func (c *ctl) topTargets(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	limit := fs.Int("n", 10, "Number of target hosts to show")
+	sortBy := fs.String("sort", "bytes", "Order by bytes or connections")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{"limit": {strconv.Itoa(*limit)}, "sort": {*sortBy}}
+	if fs.NArg() > 0 {
+		query.Set("group_id", fs.Arg(0))
+	}
+	var top topTargets
+	if err := c.api.do(http.MethodGet, "/api/metrics/targets?"+query.Encode(), nil, &top); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(top.Targets))
+	for _, t := range top.Targets {
+		rows = append(rows, []string{
+			t.Host,
+			strconv.FormatInt(t.Connections, 10),
+			formatBytes(t.BytesSent),
+			formatBytes(t.BytesReceived),
+			t.LastSeen.Format(time.RFC3339),
+		})
+	}
+	if err := c.printer.printTable(top, []string{"TARGET", "CONNECTIONS", "SENT", "RECEIVED", "LAST SEEN"}, rows); err != nil {
+		return err
+	}
+	if top.Evicted > 0 && !c.printer.json() {
+		fmt.Fprintf(os.Stderr, "note: %d target stats were evicted by the cardinality cap, totals may be incomplete\n", top.Evicted)
+	}
+	return nil
+}
+
+// users prints the traffic of the proxy users of a group or of all groups, or the top target
+// hosts of one user given as group_id/username
+func (c *ctl) users(args []string) error {
+	fs := flag.NewFlagSet("users", flag.ContinueOnError)
+	limit := fs.Int("n", 10, "Number of target hosts to show for a user")
+	sortBy := fs.String("sort", "bytes", "Order by bytes or connections")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{"limit": {strconv.Itoa(*limit)}, "sort": {*sortBy}}
+	if fs.NArg() > 0 {
+		groupID, username, isUser := strings.Cut(fs.Arg(0), "/")
+		query.Set("group_id", groupID)
+		if isUser {
+			query.Set("username", username)
+			var user userStats
+			if err := c.api.do(http.MethodGet, "/api/metrics/users?"+query.Encode(), nil, &user); err != nil {
+				return err
+			}
+			rows := make([][]string, 0, len(user.TopTargets))
+			for _, t := range user.TopTargets {
+				rows = append(rows, []string{t.Host, strconv.FormatInt(t.Connections, 10), formatBytes(t.BytesSent), formatBytes(t.BytesReceived)})
+			}
+			return c.printer.printTable(user, []string{"TARGET", "CONNECTIONS", "SENT", "RECEIVED"}, rows)
+		}
+	}
+
+	var list proxyUsers
+	if err := c.api.do(http.MethodGet, "/api/metrics/users?"+query.Encode(), nil, &list); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(list.Users))
+	for _, u := range list.Users {
+		rows = append(rows, []string{
+			u.GroupID,
+			u.Username,
+			strconv.FormatInt(u.ActiveConnections, 10),
+			strconv.FormatInt(u.TotalConnections, 10),
+			strconv.FormatInt(u.FailedConnections, 10),
+			formatBytes(u.BytesSent),
+			formatBytes(u.BytesReceived),
+		})
+	}
+	if err := c.printer.printTable(list, []string{"GROUP", "USER", "ACTIVE", "CONNECTIONS", "FAILED", "SENT", "RECEIVED"}, rows); err != nil {
+		return err
+	}
+	if list.Evicted > 0 && !c.printer.json() {
+		fmt.Fprintf(os.Stderr, "note: %d user stats were evicted by the cardinality cap, totals may be incomplete\n", list.Evicted)
+	}
+	return nil
+}
+
+// showGroups prints the status of all groups or a single group
+func (c *ctl) showGroups(args []string) error {
+	var groups []groupStatus
+	if len(args) > 0 {
+		var group groupStatus
+		if err := c.api.do(http.MethodGet, "/api/admin/groups?group_id="+url.QueryEscape(args[0]), nil, &group); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+	} else if err := c.api.do(http.MethodGet, "/api/admin/groups", nil, &groups); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		sticky := g.StickySession
+		if sticky == "" {
+			sticky = "-"
+		}
+		rows = append(rows, []string{
+			g.GroupID,
+			formatLimit(len(g.Clients), g.MaxClients),
+			formatLimit(g.ActiveConnections, g.MaxConnections),
+			sticky,
+			strings.Join(g.Clients, ","),
+		})
+	}
+	return c.printer.printTable(groups, []string{"GROUP", "CLIENTS", "CONNECTIONS", "STICKY", "CLIENT IDS"}, rows)
+}
+
+// kickClient disconnects a client from the gateway
+func (c *ctl) kickClient(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: anyproxyctl kick <client_id>")
+	}
+
+	var resp adminResponse
+	if err := c.api.do(http.MethodPost, "/api/admin/clients/kick", map[string]string{"client_id": args[0]}, &resp); err != nil {
+		return err
+	}
+	return c.printer.printMessage(resp, "Client %s disconnected", args[0])
+}
+
+// dryRun prints whether a dial would be allowed and which client would serve it, stage by stage
+func (c *ctl) dryRun(args []string) error {
+	fs := flag.NewFlagSet("dryrun", flag.ContinueOnError)
+	username := fs.String("u", "", "Proxy username")
+	clientID := fs.String("client", "", "Client pinned by the user")
+	sourceIP := fs.String("source", "", "Address of the user")
+	network := fs.String("network", "tcp", "Network: tcp, udp or unix")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: anyproxyctl dryrun [-u user] [-client id] [-source ip] [-network tcp] <group> <host:port>")
+	}
+
+	req := map[string]string{
+		"group":     fs.Arg(0),
+		"username":  *username,
+		"client":    *clientID,
+		"source_ip": *sourceIP,
+		"network":   *network,
+		"target":    fs.Arg(1),
+	}
+	var result dryRunResult
+	if err := c.api.do(http.MethodPost, "/api/admin/dryrun", req, &result); err != nil {
+		return err
+	}
+	if c.printer.json() {
+		return c.printer.printJSON(result)
+	}
+
+	rows := make([][]string, 0, len(result.Steps))
+	for _, s := range result.Steps {
+		rows = append(rows, []string{s.Stage, s.Result, s.Detail})
+	}
+	if err := c.printer.printTable(result, []string{"STAGE", "RESULT", "DETAIL"}, rows); err != nil {
+		return err
+	}
+	if !result.Allowed {
+		return c.printer.printMessage(result, "\nDenied (%s): %s", result.ErrorCode, result.Error)
+	}
+	return c.printer.printMessage(result, "\nAllowed: %s via client %s of group %s", result.Target, result.ClientID, result.Group)
+}
+
+// metrics manages the gateway metrics counters
+func (c *ctl) metrics(args []string) error {
+	if len(args) != 1 || args[0] != "reset" {
+		return fmt.Errorf("usage: anyproxyctl metrics reset")
+	}
+
+	var resp adminResponse
+	if err := c.api.do(http.MethodPost, "/api/admin/metrics/reset", nil, &resp); err != nil {
+		return err
+	}
+	return c.printer.printMessage(resp, "Metrics counters reset")
+}
+
+// audit prints the audit log, optionally following new entries
+func (c *ctl) audit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "Follow new audit entries")
+	last := fs.Int("n", 20, "Number of recent entries to show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var entries []auditEntry
+	if err := c.api.do(http.MethodGet, "/api/admin/audit?limit="+strconv.Itoa(*last), nil, &entries); err != nil {
+		return err
+	}
+	if !*follow {
+		if c.printer.json() {
+			return c.printer.printJSON(entries)
+		}
+		return c.printAuditTable(entries)
+	}
+
+	var lastID int64
+	for {
+		for _, entry := range entries {
+			if err := c.printAuditLine(entry); err != nil {
+				return err
+			}
+			lastID = entry.ID
+		}
+
+		time.Sleep(auditPollInterval)
+		entries = nil
+		if err := c.api.do(http.MethodGet, "/api/admin/audit?since="+strconv.FormatInt(lastID, 10), nil, &entries); err != nil {
+			return err
+		}
+	}
+}
+
+// printAuditTable prints audit entries as a table
+func (c *ctl) printAuditTable(entries []auditEntry) error {
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, auditRow(e))
+	}
+	return c.printer.printTable(entries, []string{"ID", "TIME", "USER", "ACTION", "TARGET", "RESULT", "DETAIL"}, rows)
+}
+
+// printAuditLine prints a single followed audit entry
+func (c *ctl) printAuditLine(entry auditEntry) error {
+	if c.printer.json() {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.printer.w, string(data))
+		return err
+	}
+	_, err := fmt.Fprintln(c.printer.w, strings.Join(auditRow(entry), "  "))
+	return err
+}
+
+// auditRow formats an audit entry as table columns
+func auditRow(e auditEntry) []string {
+	result := "ok"
+	if !e.Success {
+		result = "failed"
+	}
+	return []string{
+		strconv.FormatInt(e.ID, 10),
+		e.Time.Format(time.RFC3339),
+		e.User,
+		e.Action,
+		e.Target,
+		result,
+		e.Detail,
+	}
+}
+
+// credentials manages group credentials
+func (c *ctl) credentials(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: anyproxyctl credentials set <group> <password> | delete <group>")
+	}
+
+	var resp adminResponse
+	switch args[0] {
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: anyproxyctl credentials set <group> <password>")
+		}
+		req := map[string]string{"group_id": args[1], "password": args[2]}
+		if err := c.api.do(http.MethodPost, "/api/admin/credentials", req, &resp); err != nil {
+			return err
+		}
+		return c.printer.printMessage(resp, "Credentials for group %s updated", args[1])
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: anyproxyctl credentials delete <group>")
+		}
+		if err := c.api.do(http.MethodDelete, "/api/admin/credentials?group_id="+url.QueryEscape(args[1]), nil, &resp); err != nil {
+			return err
+		}
+		return c.printer.printMessage(resp, "Credentials for group %s removed", args[1])
+	default:
+		return fmt.Errorf("unknown credentials command: %s", args[0])
+	}
+}
+
+// schedule manages access schedule overrides of groups and group users
+func (c *ctl) schedule(args []string) error {
+	const scheduleUsage = "usage: anyproxyctl schedule list | allow|deny <group>[/<user>] <duration> [reason] | clear <group>[/<user>]"
+	if len(args) == 0 {
+		return fmt.Errorf(scheduleUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		var overrides []accessOverride
+		if err := c.api.do(http.MethodGet, "/api/admin/schedule/overrides", nil, &overrides); err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(overrides))
+		for _, o := range overrides {
+			access := "deny"
+			if o.Allow {
+				access = "allow"
+			}
+			user := o.Username
+			if user == "" {
+				user = "*"
+			}
+			rows = append(rows, []string{o.GroupID, user, access, o.Until.Format(time.RFC3339), o.Reason})
+		}
+		return c.printer.printTable(overrides, []string{"GROUP", "USER", "ACCESS", "UNTIL", "REASON"}, rows)
+	case "allow", "deny":
+		if len(args) < 3 {
+			return fmt.Errorf(scheduleUsage)
+		}
+		groupID, username, _ := strings.Cut(args[1], "/")
+		req := map[string]interface{}{
+			"group_id": groupID,
+			"username": username,
+			"allow":    args[0] == "allow",
+			"duration": args[2],
+			"reason":   strings.Join(args[3:], " "),
+		}
+		var override accessOverride
+		if err := c.api.do(http.MethodPost, "/api/admin/schedule/overrides", req, &override); err != nil {
+			return err
+		}
+		access := "denied"
+		if override.Allow {
+			access = "allowed"
+		}
+		return c.printer.printMessage(override, "New connections of %s %s until %s", args[1], access, override.Until.Format(time.RFC3339))
+	case "clear":
+		if len(args) != 2 {
+			return fmt.Errorf(scheduleUsage)
+		}
+		groupID, username, _ := strings.Cut(args[1], "/")
+		var resp adminResponse
+		path := "/api/admin/schedule/overrides?group_id=" + url.QueryEscape(groupID) + "&username=" + url.QueryEscape(username)
+		if err := c.api.do(http.MethodDelete, path, nil, &resp); err != nil {
+			return err
+		}
+		return c.printer.printMessage(resp, "Override of %s removed, its schedule applies again", args[1])
+	default:
+		return fmt.Errorf("unknown schedule command: %s", args[0])
+	}
+}
+
+// rateLimit manages rate limit rules
+func (c *ctl) rateLimit(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: anyproxyctl ratelimit list | add <rule.json> | delete <rule_id>")
+	}
+
+	var cfg ratelimit.Config
+	if err := c.api.do(http.MethodGet, "/api/admin/ratelimit", nil, &cfg); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return c.printRules(&cfg)
+	case "add":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: anyproxyctl ratelimit add <rule.json>")
+		}
+		rule, err := readRule(args[1])
+		if err != nil {
+			return err
+		}
+		cfg.Rules = upsertRule(cfg.Rules, rule)
+		return c.updateRules(&cfg, "Rate limit rule %s saved", rule.ID)
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: anyproxyctl ratelimit delete <rule_id>")
+		}
+		rules, found := deleteRule(cfg.Rules, args[1])
+		if !found {
+			return fmt.Errorf("rate limit rule not found: %s", args[1])
+		}
+		cfg.Rules = rules
+		return c.updateRules(&cfg, "Rate limit rule %s deleted", args[1])
+	default:
+		return fmt.Errorf("unknown ratelimit command: %s", args[0])
+	}
+}
+
+// printRules prints rate limit rules
+func (c *ctl) printRules(cfg *ratelimit.Config) error {
+	rows := make([][]string, 0, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		rows = append(rows, []string{
+			r.ID,
+			r.Type,
+			r.Identifier,
+			strconv.FormatBool(r.Enabled),
+			formatRate(r.BandwidthLimit),
+			formatRequests(r.RequestLimit, r.RequestWindow),
+			strconv.FormatInt(r.ConcurrentLimit, 10),
+			r.Action,
+			strconv.Itoa(r.Priority),
+		})
+	}
+	return c.printer.printTable(cfg, []string{"ID", "TYPE", "IDENTIFIER", "ENABLED", "BANDWIDTH", "REQUESTS", "CONCURRENT", "ACTION", "PRIORITY"}, rows)
+}
+
+// updateRules replaces the rate limit rules on the gateway
+func (c *ctl) updateRules(cfg *ratelimit.Config, format string, args ...interface{}) error {
+	var resp adminResponse
+	if err := c.api.do(http.MethodPut, "/api/admin/ratelimit", cfg, &resp); err != nil {
+		return err
+	}
+	return c.printer.printMessage(resp, format, args...)
+}
+
+// readRule loads a rate limit rule from a JSON file ("-" reads stdin)
+func readRule(path string) (*ratelimit.Rule, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path) // nolint:gosec // Rule file path is provided by the operator
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule: %v", err)
+	}
+
+	var rule ratelimit.Rule
+	if err := json.Unmarshal(data, &rule); err != nil {
+		return nil, fmt.Errorf("invalid rule JSON: %v", err)
+	}
+	if rule.ID == "" || rule.Type == "" {
+		return nil, fmt.Errorf("rule id and type are required")
+	}
+	return &rule, nil
+}
+
+// upsertRule adds a rule or replaces the rule with the same ID
+func upsertRule(rules []*ratelimit.Rule, rule *ratelimit.Rule) []*ratelimit.Rule {
+	now := time.Now()
+	rule.UpdatedAt = now
+	for i, existing := range rules {
+		if existing.ID == rule.ID {
+			rule.CreatedAt = existing.CreatedAt
+			rules[i] = rule
+			return rules
+		}
+	}
+	rule.CreatedAt = now
+	return append(rules, rule)
+}
+
+// deleteRule removes the rule with the given ID
+func deleteRule(rules []*ratelimit.Rule, id string) ([]*ratelimit.Rule, bool) {
+	for i, rule := range rules {
+		if rule.ID == id {
+			return append(rules[:i], rules[i+1:]...), true
+		}
+	}
+	return rules, false
+}
+
+// formatLimit formats a current value against a limit (0 = unlimited)
+func formatLimit(current, limit int) string {
+	if limit <= 0 {
+		return strconv.Itoa(current)
+	}
+	return fmt.Sprintf("%d/%d", current, limit)
+}
+
+// formatRequests formats a request limit per window (0 = unlimited)
+func formatRequests(limit int64, window time.Duration) string {
+	if limit <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%s", limit, window)
+}
+
+// formatRate formats a bandwidth limit in bytes per second (0 = unlimited)
+func formatRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "-"
+	}
+	return formatBytes(bytesPerSecond) + "/s"
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// diagnosticsResult mirrors the gateway /api/admin/diagnostics response
+type diagnosticsResult struct {
+	ClientID string `json:"client_id"`
+	GroupID  string `json:"group_id"`
+	RTT      struct {
+		Sent     int     `json:"sent"`
+		Received int     `json:"received"`
+		MinMs    float64 `json:"min_ms"`
+		AvgMs    float64 `json:"avg_ms"`
+		MaxMs    float64 `json:"max_ms"`
+		JitterMs float64 `json:"jitter_ms"`
+		Error    string  `json:"error"`
+	} `json:"rtt"`
+	Upload   throughputResult `json:"upload"`
+	Download throughputResult `json:"download"`
+	MTU      struct {
+		PathMTU int    `json:"path_mtu"`
+		Target  string `json:"target"`
+		Error   string `json:"error"`
+	} `json:"mtu"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// throughputResult mirrors a throughput test of the diagnostics
+type throughputResult struct {
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	BytesPerSecond int64   `json:"bytes_per_second"`
+	Error          string  `json:"error"`
+}
+
+// row formats a throughput test for the diagnostics table
+func (t throughputResult) row(test string) []string {
+	if t.Error != "" {
+		return []string{test, "failed", t.Error}
+	}
+	return []string{test, formatRate(t.BytesPerSecond), fmt.Sprintf("%s in %.2fs", formatBytes(t.Bytes), t.Seconds)}
+}
+
+// diagnose measures the tunnel of a client: round trips, throughput both ways and path MTU
+func (c *ctl) diagnose(args []string) error {
+	fs := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	pings := fs.Int("pings", 0, "Round trips measured (gateway default 10)")
+	size := fs.Int64("bytes", 0, "Bytes sent each way by the throughput tests (gateway default 4MB)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: anyproxyctl diagnose [-pings N] [-bytes N] <client_id>")
+	}
+
+	params := url.Values{"client_id": {fs.Arg(0)}}
+	if *pings > 0 {
+		params.Set("pings", strconv.Itoa(*pings))
+	}
+	if *size > 0 {
+		params.Set("bytes", strconv.FormatInt(*size, 10))
+	}
+	// The tests can outlast the API client timeout on slow links
+	resp, err := c.api.stream(http.MethodPost, "/api/admin/diagnostics?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("diagnose %s: %s", fs.Arg(0), readError(resp))
+	}
+
+	var result diagnosticsResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	if c.printer.json() {
+		return c.printer.printJSON(result)
+	}
+
+	rtt := []string{"rtt", formatMs(result.RTT.AvgMs), fmt.Sprintf("min %s, max %s, jitter %s, %d/%d received",
+		formatMs(result.RTT.MinMs), formatMs(result.RTT.MaxMs), formatMs(result.RTT.JitterMs), result.RTT.Received, result.RTT.Sent)}
+	if result.RTT.Error != "" {
+		rtt[1], rtt[2] = "failed", result.RTT.Error
+	}
+	mtu := []string{"mtu", strconv.Itoa(result.MTU.PathMTU), "toward " + result.MTU.Target}
+	if result.MTU.Error != "" {
+		mtu[1], mtu[2] = "failed", result.MTU.Error
+	}
+	rows := [][]string{rtt, result.Upload.row("upload"), result.Download.row("download"), mtu}
+	if err := c.printer.printTable(result, []string{"TEST", "RESULT", "DETAIL"}, rows); err != nil {
+		return err
+	}
+	return c.printer.printMessage(result, "\nClient %s of group %s, tested in %.1fs", result.ClientID, result.GroupID, result.Duration)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+)
+
+// execTokenEnv holds the client remote exec token when -token is not given
+const execTokenEnv = "ANYPROXY_EXEC_TOKEN"
+
+// execCommands mirrors the client remote exec command listing
+type execCommands struct {
+	Commands []string `json:"commands"`
+	Shell    bool     `json:"shell"`
+}
+
+// parseExecArgs parses the -token flag and the positional arguments of exec and shell
+func parseExecArgs(name string, args []string) (string, []string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	token := fs.String("token", os.Getenv(execTokenEnv), "Client remote exec token (or "+execTokenEnv+")")
+	if err := fs.Parse(args); err != nil {
+		return "", nil, err
+	}
+	if *token == "" {
+		return "", nil, fmt.Errorf("remote exec token required: use -token or %s", execTokenEnv)
+	}
+	return *token, fs.Args(), nil
+}
+
+// execCommand lists a client's whitelisted commands or runs one and streams its output
+func (c *ctl) execCommand(args []string) error {
+	token, args, err := parseExecArgs("exec", args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: anyproxyctl exec [-token T] <client_id> [command]")
+	}
+
+	header := http.Header{"X-Exec-Token": {token}}
+	params := url.Values{"client_id": {args[0]}}
+	if len(args) == 1 {
+		var commands execCommands
+		if err := c.api.do(http.MethodGet, "/api/admin/exec?"+params.Encode(), nil, &commands); err != nil {
+			return err
+		}
+		if c.printer.json() {
+			return c.printer.printJSON(commands)
+		}
+		for _, name := range commands.Commands {
+			fmt.Fprintln(c.printer.w, name)
+		}
+		if commands.Shell {
+			fmt.Fprintln(c.printer.w, "(interactive shell available)")
+		}
+		return nil
+	}
+
+	params.Set("command", args[1])
+	resp, err := c.api.stream(http.MethodPost, "/api/admin/exec?"+params.Encode(), header)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("exec %s: %s", args[1], readError(resp))
+	}
+
+	if _, err := io.Copy(c.printer.w, resp.Body); err != nil {
+		return fmt.Errorf("output interrupted: %v", err)
+	}
+	if code := resp.Trailer.Get(protocol.ExecExitCodeTrailer); code != "0" {
+		return fmt.Errorf("command %s exited with code %s", args[1], code)
+	}
+	if resp.Trailer.Get(protocol.ExecTruncatedTrailer) == "true" {
+		fmt.Fprintln(os.Stderr, "warning: output was truncated by the client")
+	}
+	return nil
+}
+
+// shell opens an interactive shell on a client, stdin and stdout are attached to it
+func (c *ctl) shell(args []string) error {
+	token, args, err := parseExecArgs("shell", args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: anyproxyctl shell [-token T] <client_id>")
+	}
+
+	header := http.Header{
+		"X-Exec-Token": {token},
+		"Connection":   {"Upgrade"},
+		"Upgrade":      {protocol.ExecShellUpgrade},
+	}
+	resp, err := c.api.stream(http.MethodGet, "/api/admin/exec/shell?"+url.Values{"client_id": {args[0]}}.Encode(), header)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer func() { _ = resp.Body.Close() }()
+		return fmt.Errorf("shell: %s", strings.TrimSpace(readError(resp)))
+	}
+
+	// The body of a 101 response is the upgraded connection
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = resp.Body.Close()
+		return fmt.Errorf("shell: connection was not upgraded")
+	}
+	defer func() { _ = conn.Close() }()
+
+	// The session ends when the remote shell exits, e.g. after "exit"
+	go func() { _, _ = io.Copy(conn, os.Stdin) }()
+	_, _ = io.Copy(os.Stdout, conn)
+	return nil
+}
@@ -0,0 +1,91 @@
+// Package main implements anyproxyctl, a command line tool for operating an AnyProxy gateway
+// through its web admin API.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: anyproxyctl [flags] <command> [args]
+
+Commands:
+  clients                         List clients and their traffic
+  connections                     List active proxied connections
+  latency [targets]               Show dial/TTFB percentiles per client (or target host)
+  top [-n N] [-sort connections] [group_id]
+                                  Show the busiest target hosts of a group (or all groups)
+  users [-n N] [-sort connections] [group_id[/username]]
+                                  Show proxy user traffic, or one user's top target hosts
+  groups [group_id]               Show group status (clients, connections, limits)
+  topology [-n N] [group_id]      Show group clients, their health, the round-robin position
+                                  and the recent client selections of a group
+  kick <client_id>                Disconnect a client
+  audit [-f] [-n N]               Show (and follow) the admin audit log
+  credentials set <group> <pass>  Create or update group credentials
+  credentials delete <group>      Remove group credentials
+  ratelimit list                  List rate limit rules
+  ratelimit add <rule.json>       Add or replace a rule (matched by id)
+  ratelimit delete <rule_id>      Delete a rule
+  schedule list                   List access schedule overrides
+  schedule allow|deny <group>[/<user>] <duration> [reason]
+                                  Allow or deny new connections regardless of the schedule
+  schedule clear <group>[/<user>] Remove an override, the schedule applies again
+  dryrun [-u user] [-client id] [-source ip] [-network tcp] <group> <host:port>
+                                  Show whether a dial would be allowed and its client
+  diagnose [-pings N] [-bytes N] <client_id>
+                                  Measure a client's tunnel: RTT, throughput, path MTU
+  metrics reset                   Reset the dashboard's cumulative counters
+  exec <client_id> [command]      List or run a client's whitelisted commands (-token)
+  shell <client_id>               Open an interactive shell on a client (-token)
+  release keygen <key_file>       Create a client update signing key, prints the public key
+  release add -key <key_file> -version <v> <dir> <os/arch> <binary>
+                                  Sign a client binary into a client_updates directory
+  policy keygen <key_file>        Create a policy pack signing key, prints the public key
+  policy sign -key <key_file> -config <gateway.yaml> <group>
+                                  Sign the policy packs of a group, prints its policy_signature
+
+Flags:
+`
+
+func main() {
+	server := flag.String("server", envOr("ANYPROXY_ADMIN_SERVER", "127.0.0.1:8090"), "Gateway web admin address")
+	username := flag.String("user", os.Getenv("ANYPROXY_ADMIN_USER"), "Web admin username (when web auth is enabled)")
+	password := flag.String("password", os.Getenv("ANYPROXY_ADMIN_PASSWORD"), "Web admin password (when web auth is enabled)")
+	output := flag.String("o", "table", "Output format: table or json")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output != outputTable && *output != outputJSON {
+		fmt.Fprintf(os.Stderr, "invalid output format: %s\n", *output)
+		os.Exit(2)
+	}
+
+	api, err := newAPIClient(*server, *username, *password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctl := &ctl{api: api, printer: newPrinter(os.Stdout, *output)}
+	if err := ctl.run(flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// envOr returns the environment variable value or a default
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
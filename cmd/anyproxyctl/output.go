@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// printer renders command results as a table or JSON
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+// newPrinter creates a printer for the given format
+func newPrinter(w io.Writer, format string) *printer {
+	return &printer{w: w, format: format}
+}
+
+// json reports whether results are printed as JSON
+func (p *printer) json() bool {
+	return p.format == outputJSON
+}
+
+// printJSON writes a value as indented JSON
+func (p *printer) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(p.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printTable writes rows as an aligned table, raw is used instead for JSON output
+func (p *printer) printTable(raw interface{}, header []string, rows [][]string) error {
+	if p.json() {
+		return p.printJSON(raw)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printMessage writes a status message, or the raw response for JSON output
+func (p *printer) printMessage(raw interface{}, format string, args ...interface{}) error {
+	if p.json() {
+		return p.printJSON(raw)
+	}
+	_, err := fmt.Fprintf(p.w, format+"\n", args...)
+	return err
+}
+
+// formatBytes formats a byte count for humans
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for value := n / unit; value >= unit; value /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatGeo formats source and target countries as "SRC->DST"
+func formatGeo(source, target string) string {
+	if source == "" && target == "" {
+		return "-"
+	}
+	if source == "" {
+		source = "??"
+	}
+	if target == "" {
+		target = "??"
+	}
+	return source + "->" + target
+}
+
+// formatMs formats a millisecond value
+func formatMs(ms float64) string {
+	return strconv.FormatFloat(ms, 'f', 1, 64) + "ms"
+}
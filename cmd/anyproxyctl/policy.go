@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/buhuipao/anyproxy/pkg/common/policy"
+	"github.com/buhuipao/anyproxy/pkg/common/update"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// policy signs the policy packs of groups with the operator key, it works on local files only
+func (c *ctl) policy(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: anyproxyctl policy keygen|sign ...")
+	}
+	switch args[0] {
+	case "keygen":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: anyproxyctl policy keygen <key_file>")
+		}
+		encoded, err := writeSigningKey(args[1])
+		if err != nil {
+			return err
+		}
+		return c.printer.printMessage(map[string]string{"key_file": args[1], "public_key": encoded},
+			"Private key written to %s, keep it off the gateway.\nClient policy_public_key: %s", args[1], encoded)
+	case "sign":
+		return c.policySign(args[1:])
+	default:
+		return fmt.Errorf("unknown policy command: %s", args[0])
+	}
+}
+
+// policySign signs the packs the gateway configuration pushes to a group, the signature goes
+// into the group's policy_signature
+func (c *ctl) policySign(args []string) error {
+	fs := flag.NewFlagSet("policy sign", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "Private signing key file (from policy keygen)")
+	configFile := fs.String("config", "", "Gateway configuration file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || *configFile == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: anyproxyctl policy sign -key <key_file> -config <gateway.yaml> <group>")
+	}
+	groupID := fs.Arg(0)
+
+	keyData, err := os.ReadFile(*keyFile) //nolint:gosec // path comes from the operator
+	if err != nil {
+		return err
+	}
+	privateKey, err := update.ParsePrivateKey(string(keyData))
+	if err != nil {
+		return err
+	}
+	// Only the packs and groups matter, secrets the gateway resolves need not be reachable here
+	data, err := os.ReadFile(*configFile) //nolint:gosec // path comes from the operator
+	if err != nil {
+		return err
+	}
+	var cfg config.Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", *configFile, err)
+	}
+
+	packs := policy.ForGroup(&cfg.Gateway, groupID)
+	body, err := policy.Marshal(packs)
+	if err != nil {
+		return err
+	}
+	signature := policy.Sign(privateKey, groupID, body)
+	return c.printer.printMessage(map[string]interface{}{"group_id": groupID, "packs": len(packs), "policy_signature": signature},
+		"Signed %d policy packs of group %s.\ngroups.%s.policy_signature: %s", len(packs), groupID, groupID, signature)
+}
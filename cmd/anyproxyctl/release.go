@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/common/update"
+)
+
+// release manages signed client binaries served by the gateway, it works on local files only
+func (c *ctl) release(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: anyproxyctl release keygen|add ...")
+	}
+	switch args[0] {
+	case "keygen":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: anyproxyctl release keygen <key_file>")
+		}
+		return c.releaseKeygen(args[1])
+	case "add":
+		return c.releaseAdd(args[1:])
+	default:
+		return fmt.Errorf("unknown release command: %s", args[0])
+	}
+}
+
+// releaseKeygen writes a new private signing key and prints its public key for client auto_update.public_key
+func (c *ctl) releaseKeygen(keyFile string) error {
+	encoded, err := writeSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+	return c.printer.printMessage(map[string]string{"key_file": keyFile, "public_key": encoded},
+		"Private key written to %s, keep it offline.\nClient auto_update.public_key: %s", keyFile, encoded)
+}
+
+// writeSigningKey writes a new private ed25519 key to keyFile and returns its base64 public key
+func writeSigningKey(keyFile string) (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	// O_EXCL: never overwrite an existing key, clients pinned to it would reject what it signs
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) //nolint:gosec // path comes from the operator
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintln(f, base64.StdEncoding.EncodeToString(privateKey)); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+// releaseAdd copies a client binary into an update directory, signs it and records it in the manifest.
+// Adding a binary for a new version starts a new manifest.
+func (c *ctl) releaseAdd(args []string) error {
+	fs := flag.NewFlagSet("release add", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "Private signing key file (from release keygen)")
+	version := fs.String("version", "", "Version of the binary, e.g. v1.4.0")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || *version == "" || fs.NArg() != 3 {
+		return fmt.Errorf("usage: anyproxyctl release add -key <key_file> -version <v> <dir> <os/arch> <binary>")
+	}
+	dir, platform, binaryPath := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	if goos, goarch, ok := strings.Cut(platform, "/"); !ok || goos == "" || goarch == "" {
+		return fmt.Errorf("invalid platform %q: expected os/arch, e.g. linux/amd64", platform)
+	}
+
+	keyData, err := os.ReadFile(*keyFile) //nolint:gosec // path comes from the operator
+	if err != nil {
+		return err
+	}
+	privateKey, err := update.ParsePrivateKey(string(keyData))
+	if err != nil {
+		return err
+	}
+
+	manifest, err := update.LoadManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if manifest == nil || manifest.Version != *version {
+		manifest = &update.Manifest{Version: *version}
+	}
+	if manifest.Binaries == nil {
+		manifest.Binaries = make(map[string]update.Binary)
+	}
+
+	fileName := fmt.Sprintf("anyproxy-client-%s-%s", strings.ReplaceAll(platform, "/", "-"), *version)
+	if err := copyFile(binaryPath, filepath.Join(dir, fileName)); err != nil {
+		return err
+	}
+	digest, err := update.FileSHA256(filepath.Join(dir, fileName))
+	if err != nil {
+		return err
+	}
+
+	binary := update.Binary{
+		File:      fileName,
+		SHA256:    hex.EncodeToString(digest),
+		Signature: update.Sign(privateKey, *version, platform, digest),
+	}
+	manifest.Binaries[platform] = binary
+	if err := update.SaveManifest(dir, manifest); err != nil {
+		return err
+	}
+	return c.printer.printMessage(binary, "Added %s %s as %s (sha256 %s)", platform, *version, fileName, binary.SHA256)
+}
+
+// copyFile copies src to dst, replacing dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src) //nolint:gosec // path comes from the operator
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644) //nolint:gosec // binaries are not secret
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
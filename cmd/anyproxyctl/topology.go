@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// groupTopology mirrors the gateway /api/admin/groups/topology response
+type groupTopology struct {
+	GroupID    string `json:"group_id"`
+	Balancing  string `json:"balancing"`
+	Counter    int    `json:"counter"`
+	NextClient string `json:"next_client,omitempty"`
+	Clients    []struct {
+		ClientID    string  `json:"client_id"`
+		Index       int     `json:"index"`
+		Health      string  `json:"health"`
+		Hibernating bool    `json:"hibernating,omitempty"`
+		Connections int     `json:"connections"`
+		LoadScore   float64 `json:"load_score"`
+		Selections  int     `json:"selections"`
+	} `json:"clients"`
+	Selections []struct {
+		Time     time.Time `json:"time"`
+		ClientID string    `json:"client_id"`
+		Counter  int       `json:"counter"`
+		Strategy string    `json:"strategy"`
+	} `json:"selections"`
+}
+
+// topology prints the member clients and round-robin position of groups, and the recent client
+// selections of a single group
+func (c *ctl) topology(args []string) error {
+	fs := flag.NewFlagSet("topology", flag.ContinueOnError)
+	history := fs.Int("n", 20, "Recent selections shown for a single group (0 = none)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("usage: anyproxyctl topology [-n N] [group_id]")
+	}
+
+	var groups []groupTopology
+	if fs.NArg() == 1 {
+		var group groupTopology
+		if err := c.api.do(http.MethodGet, "/api/admin/groups/topology?group_id="+url.QueryEscape(fs.Arg(0)), nil, &group); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+	} else if err := c.api.do(http.MethodGet, "/api/admin/groups/topology", nil, &groups); err != nil {
+		return err
+	}
+	if c.printer.json() {
+		if fs.NArg() == 1 {
+			return c.printer.printJSON(groups[0])
+		}
+		return c.printer.printJSON(groups)
+	}
+
+	var rows [][]string
+	for _, g := range groups {
+		for _, client := range g.Clients {
+			next := ""
+			if client.ClientID == g.NextClient {
+				next = "*"
+			}
+			health := client.Health
+			if client.Hibernating {
+				health += " (hibernating)"
+			}
+			rows = append(rows, []string{
+				g.GroupID,
+				g.Balancing,
+				strconv.Itoa(client.Index),
+				next,
+				client.ClientID,
+				health,
+				strconv.Itoa(client.Connections),
+				strconv.FormatFloat(client.LoadScore, 'f', 2, 64),
+				strconv.Itoa(client.Selections),
+			})
+		}
+	}
+	if err := c.printer.printTable(groups, []string{"GROUP", "BALANCING", "INDEX", "NEXT", "CLIENT", "HEALTH", "CONNECTIONS", "LOAD", "RECENT PICKS"}, rows); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *history <= 0 || len(groups[0].Selections) == 0 {
+		return nil
+	}
+
+	selections := groups[0].Selections
+	selections = selections[max(0, len(selections)-*history):]
+	rows = make([][]string, 0, len(selections))
+	for _, s := range selections {
+		rows = append(rows, []string{s.Time.Format(time.RFC3339Nano), strconv.Itoa(s.Counter), s.ClientID, s.Strategy})
+	}
+	fmt.Fprintln(c.printer.w)
+	return c.printer.printTable(selections, []string{"TIME", "COUNTER", "CLIENT", "STRATEGY"}, rows)
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"sync"
@@ -11,17 +12,27 @@ import (
 
 	"github.com/buhuipao/anyproxy/pkg/client"
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/qos"
 	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	clientWeb "github.com/buhuipao/anyproxy/web/client"
+	"github.com/buhuipao/anyproxy/web/sessions"
+	"github.com/buhuipao/anyproxy/web/ui"
 )
 
 func main() {
 	// Parse command-line flags
 	configFile := flag.String("config", "configs/config.yaml", "Path to the configuration file")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("anyproxy-client %s\n", version.String())
+		return
+	}
+
 	// Load configuration
 	cfg, err := config.LoadConfig(*configFile)
 	if err != nil {
@@ -40,6 +51,7 @@ func main() {
 		logger.Error("Failed to initialize logger", "err", err)
 		os.Exit(1)
 	}
+	logger.Info("Starting anyproxy client", "version", version.Version, "commit", version.Commit, "build_time", version.BuildTime)
 
 	// 🆕 Start monitoring cleanup process
 	monitoring.StartCleanupProcess()
@@ -57,10 +69,21 @@ func main() {
 		// Configure authentication if enabled
 		if cfg.Client.Web.AuthEnabled {
 			webServer.SetAuth(cfg.Client.Web.AuthEnabled, cfg.Client.Web.AuthUsername, cfg.Client.Web.AuthPassword)
+			if err := webServer.SetAuthProviders(cfg.Client.Web.Auth); err != nil {
+				logger.Error("Failed to configure web login providers", "err", err)
+				os.Exit(1)
+			}
 		}
 
 		// Set configurations for clash profile generation
 		webServer.SetConfigurations(cfg)
+		webServer.SetUI(ui.New(cfg.Client.Web))
+		sessionStore, err := sessions.NewStore(cfg.Client.Web.SessionStore)
+		if err != nil {
+			logger.Error("Failed to create web session store", "err", err)
+			os.Exit(1)
+		}
+		webServer.SetSessionStore(sessionStore, cfg.Client.Web.SessionKey)
 
 		// Start web server in a separate goroutine
 		go func() {
@@ -72,38 +95,108 @@ func main() {
 		logger.Info("Client web server started", "listen_addr", cfg.Client.Web.ListenAddr, "auth_enabled", cfg.Client.Web.AuthEnabled)
 	}
 
-	var clients []*client.Client
-	for i := 0; i < cfg.Client.Replicas; i++ {
-		// Create and start client using the transport type from client gateway config
-		// Fix: Pass replica index i to ensure each client has unique ID
-		proxyClient, err := client.NewClient(&cfg.Client, cfg.Client.Gateway.TransportType, i)
+	// Accept signed updates pushed by the gateway, shared by all replicas
+	var updater *client.Updater
+	var updateReady <-chan struct{}
+	if cfg.Client.AutoUpdate.Enabled {
+		updater, err = client.NewUpdater(&cfg.Client.AutoUpdate)
 		if err != nil {
-			logger.Error("Failed to create client", "replica_idx", i, "err", err)
+			logger.Error("Failed to initialize auto update", "err", err)
 			os.Exit(1)
 		}
+		updater.Start()
+		updateReady = updater.Ready()
+		logger.Info("Auto update enabled", "window", cfg.Client.AutoUpdate.Window)
+	}
+
+	// Egress bandwidth is capped for the process, shared by all replicas. A watched config may
+	// set a limit later.
+	egress := qos.NewScheduler(cfg.Client.Egress)
+	if cfg.Client.WatchConfig && egress == nil {
+		egress = qos.NewAdjustableScheduler(cfg.Client.Egress)
+	}
+
+	// Peer listeners are bound once, their connections go through any connected replica
+	peers, err := client.NewPeerListeners(cfg.Client.PeerListeners)
+	if err != nil {
+		logger.Error("Failed to start peer listeners", "err", err)
+		os.Exit(1)
+	}
+
+	// The TUN interface is opened once, its packets go through the first connected replica
+	var gatewayAddrs []string
+	for _, gw := range cfg.Client.GatewayList() {
+		gatewayAddrs = append(gatewayAddrs, gw.Addr)
+	}
+	packets, err := client.NewPacketTunnel(cfg.Client.Tun, gatewayAddrs)
+	if err != nil {
+		logger.Error("Failed to open TUN interface", "err", err)
+		os.Exit(1)
+	}
 
+	// Replicas of the client for each gateway, each with a unique ID
+	clients, err := client.NewClients(&cfg.Client)
+	if err != nil {
+		logger.Error("Failed to create client", "err", err)
+		os.Exit(1)
+	}
+	for _, proxyClient := range clients {
 		// 🆕 Set web server reference in client for ID updates
 		if webServer != nil {
 			proxyClient.SetWebServer(webServer)
 		}
+		if updater != nil {
+			proxyClient.SetUpdater(updater)
+		}
+		if egress != nil {
+			proxyClient.SetEgressScheduler(egress)
+		}
+		proxyClient.SetPeerListeners(peers)
+		proxyClient.SetPacketTunnel(packets)
 
 		// Start client (non-blocking)
 		if err := proxyClient.Start(); err != nil {
-			logger.Error("Failed to start client", "err", err)
+			logger.Error("Failed to start client", "gateway_addr", proxyClient.GatewayAddr(), "err", err)
 			os.Exit(1)
 		}
+	}
+	logger.Info("Started clients", "count", len(clients), "gateway_addrs", gatewayAddrs)
 
-		clients = append(clients, proxyClient)
+	// Reapply host patterns and open ports when the config file changes
+	var configWatcher *client.ConfigWatcher
+	if cfg.Client.WatchConfig {
+		configWatcher, err = client.NewConfigWatcher(*configFile, &cfg.Client, clients)
+		if err != nil {
+			logger.Error("Failed to watch config file", "err", err)
+			os.Exit(1)
+		}
+		configWatcher.Start()
 	}
-	logger.Info("Started clients", "count", cfg.Client.Replicas, "gateway_addr", cfg.Client.Gateway.Addr)
+
+	// Open ports for Docker containers and listed services found at runtime
+	discovery := client.NewServiceDiscovery(cfg.Client.Discovery, clients)
+	discovery.Start()
 
 	// Handle signals for graceful shutdown
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	// Wait for termination signal
-	<-sigCh
-	logger.Info("Shutting down...")
+	// Wait for termination signal or a staged update inside the maintenance window
+	applyUpdate := false
+	select {
+	case <-sigCh:
+		logger.Info("Shutting down...")
+	case <-updateReady:
+		applyUpdate = true
+		logger.Info("Shutting down to apply client update...")
+	}
+	if updater != nil {
+		updater.Stop()
+	}
+	if configWatcher != nil {
+		configWatcher.Stop()
+	}
+	discovery.Stop()
 
 	// Stop web server if running
 	if webServer != nil {
@@ -126,5 +219,16 @@ func main() {
 
 	// Wait for all clients to stop
 	stopWg.Wait()
+	egress.Stop()
+	peers.Stop()
+	packets.Stop()
 	logger.Info("All clients stopped")
+
+	if applyUpdate {
+		// Apply only returns if the new binary could not be started
+		if err := updater.Apply(); err != nil {
+			logger.Error("Failed to apply client update", "err", err)
+			os.Exit(1)
+		}
+	}
 }
@@ -4,29 +4,47 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/gateway"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	gatewayWeb "github.com/buhuipao/anyproxy/web/gateway"
+	"github.com/buhuipao/anyproxy/web/sessions"
+	"github.com/buhuipao/anyproxy/web/ui"
+
+	// Registers the "sqlite" database driver for the db credential and rate limit storages
+	_ "modernc.org/sqlite"
 )
 
 func main() {
 	// Parse command-line flags
 	configFile := flag.String("config", "configs/config.yaml", "Path to the configuration file")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	dev := flag.Bool("dev", false, "Generate a self-signed CA and server certificate, like gateway.auto_tls")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("anyproxy-gateway %s\n", version.String())
+		return
+	}
+
 	// Load configuration
 	cfg, err := config.LoadConfig(*configFile)
 	if err != nil {
 		logger.Error("Failed to load configuration", "err", err)
 		os.Exit(1)
 	}
+	if *dev {
+		cfg.Gateway.AutoTLS.Enabled = true
+	}
 
 	// Validate configuration (additional validation with clear error messages)
 	if err := cfg.Validate(); err != nil {
@@ -39,6 +57,7 @@ func main() {
 		logger.Error("Failed to initialize logger", "err", err)
 		os.Exit(1)
 	}
+	logger.Info("Starting anyproxy gateway", "version", version.Version, "commit", version.Commit, "build_time", version.BuildTime)
 
 	// Create and start gateway (using WebSocket transport layer)
 	gw, err := gateway.NewGateway(cfg, cfg.Gateway.TransportType)
@@ -51,18 +70,73 @@ func main() {
 	monitoring.StartCleanupProcess()
 	logger.Info("Monitoring cleanup process started")
 
+	// Bound the connection and client records on busy gateways
+	if limits := cfg.Gateway.MetricsLimits; limits != (config.MetricsLimitsConfig{}) {
+		monitoring.SetMetricsLimits(monitoring.MetricsLimits{MaxConnections: limits.MaxConnections, MaxClients: limits.MaxClients, SampleRate: limits.SampleRate})
+	}
+
+	// Restore the counters of the previous run
+	if cfg.Gateway.MetricsSnapshot.Path != "" {
+		if err := monitoring.StartSnapshots(cfg.Gateway.MetricsSnapshot.Path, cfg.Gateway.MetricsSnapshot.Interval); err != nil {
+			logger.Error("Failed to restore metrics snapshot", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Alert on clients and groups whose traffic deviates from their baselines
+	if anomaly := cfg.Gateway.AnomalyDetection; anomaly.Enabled {
+		monitoring.StartAnomalyDetection(monitoring.AnomalyOptions{
+			Interval:          anomaly.Interval,
+			Factor:            anomaly.Factor,
+			Warmup:            anomaly.Warmup,
+			MinBytesPerMinute: anomaly.MinBytesPerMinute,
+			MinNewTargets:     anomaly.MinNewTargets,
+			Webhook:           anomaly.Webhook,
+		})
+	}
+
+	// Report the traffic of each group and proxy user per day or week
+	if reports := cfg.Gateway.UsageReports; reports.Period != "" {
+		opts := monitoring.UsageReportOptions{Period: reports.Period, Format: reports.Format, Dir: reports.Dir, Webhook: reports.Webhook}
+		if s3 := reports.S3; s3.Endpoint != "" {
+			opts.S3 = &monitoring.S3Target{Endpoint: s3.Endpoint, Region: s3.Region, Bucket: s3.Bucket, Prefix: s3.Prefix, AccessKeyID: s3.AccessKeyID, SecretAccessKey: s3.SecretAccessKey}
+		}
+		monitoring.StartUsageReports(opts)
+	}
+
+	// Initialize rate limiter, persisted when rate_limit_storage is configured. Its user and ip
+	// rules gate new proxy sessions.
+	rateLimitStorage, err := newRateLimitStorage(cfg)
+	if err != nil {
+		logger.Error("Failed to open rate limit storage", "err", err)
+		os.Exit(1)
+	}
+	rateLimiter := ratelimit.NewRateLimiter(rateLimitStorage)
+	gw.SetRateLimiter(rateLimiter)
+
 	// Initialize web services if enabled
 	var webServer *gatewayWeb.WebServer
 	if cfg.Gateway.Web.Enabled {
-		// Initialize rate limiter (without storage)
-		rateLimiter := ratelimit.NewRateLimiter(nil)
-
 		// Create web server
 		webServer = gatewayWeb.NewGatewayWebServer(cfg.Gateway.Web.ListenAddr, cfg.Gateway.Web.StaticDir, rateLimiter)
+		webServer.SetAdminBackend(gw)
+		webServer.SetUI(ui.New(cfg.Gateway.Web))
+		sessionStore, err := sessions.NewStore(cfg.Gateway.Web.SessionStore)
+		if err != nil {
+			logger.Error("Failed to create web session store", "err", err)
+			os.Exit(1)
+		}
+		webServer.SetSessionStore(sessionStore, cfg.Gateway.Web.SessionKey)
+		webServer.SetReusePort(cfg.Gateway.Upgrade.Enabled)
 
 		// Configure authentication if enabled
 		if cfg.Gateway.Web.AuthEnabled {
 			webServer.SetAuth(true, cfg.Gateway.Web.AuthUsername, cfg.Gateway.Web.AuthPassword)
+			webServer.SetUsers(cfg.Gateway.Web.Users)
+			if err := webServer.SetAuthProviders(cfg.Gateway.Web.Auth); err != nil {
+				logger.Error("Failed to configure web login providers", "err", err)
+				os.Exit(1)
+			}
 		}
 
 		// Start web server in a separate goroutine
@@ -73,11 +147,24 @@ func main() {
 		}()
 
 		logger.Info("Gateway web server started", "listen_addr", cfg.Gateway.Web.ListenAddr, "auth_enabled", cfg.Gateway.Web.AuthEnabled)
+
+		// The admin API for gRPC tooling, with the same accounts
+		if grpcCfg := cfg.Gateway.Web.GRPC; grpcCfg.ListenAddr != "" {
+			go func() {
+				if err := webServer.StartControl(grpcCfg); err != nil {
+					logger.Error("gRPC control API failed", "err", err)
+				}
+			}()
+		}
 	}
 
 	// Handle signals for graceful shutdown
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	upgradeCh := make(chan os.Signal, 1)
+	if cfg.Gateway.Upgrade.Enabled && len(upgradeSignals) > 0 {
+		signal.Notify(upgradeCh, upgradeSignals...)
+	}
 
 	// Start gateway in a separate goroutine
 	go func() {
@@ -85,12 +172,21 @@ func main() {
 			logger.Error("Gateway failed", "err", err)
 			os.Exit(1)
 		}
+		// Let the process this one replaces hand over its clients
+		gateway.NotifyUpgradeReady()
 	}()
 
 	logger.Info("Gateway started", "listen_addr", cfg.Gateway.ListenAddr)
 
-	// Wait for termination signal
-	<-sigCh
+	// Wait for termination signal, or for an upgrade handing over to a new process
+	for running := true; running; {
+		select {
+		case <-sigCh:
+			running = false
+		case <-upgradeCh:
+			running = !upgrade(cfg, gw)
+		}
+	}
 	logger.Info("Shutting down...")
 
 	// Stop web server if running
@@ -105,5 +201,75 @@ func main() {
 		logger.Error("Error shutting down gateway", "err", err)
 	}
 
+	monitoring.StopAnomalyDetection()
+	monitoring.StopUsageReports()
+
+	// Save the final counters after the gateway stopped updating them
+	if err := monitoring.StopSnapshots(); err != nil {
+		logger.Error("Error saving metrics snapshot", "err", err)
+	}
+
 	logger.Info("Gateway stopped")
 }
+
+// upgrade hands the gateway over to a new process of its binary, it returns whether this process
+// should exit. The metrics snapshot is saved first so the new process restores the final counters.
+func upgrade(cfg *config.Config, gw *gateway.Gateway) bool {
+	logger.Info("Upgrading gateway")
+	snapshots := cfg.Gateway.MetricsSnapshot.Path != ""
+	if snapshots {
+		if err := monitoring.StopSnapshots(); err != nil {
+			logger.Error("Error saving metrics snapshot", "err", err)
+		}
+	}
+
+	if err := gw.Upgrade(); err != nil {
+		logger.Error("Gateway upgrade failed, this process keeps serving", "err", err)
+		if snapshots {
+			if err := monitoring.ResumeSnapshots(cfg.Gateway.MetricsSnapshot.Path, cfg.Gateway.MetricsSnapshot.Interval); err != nil {
+				logger.Error("Failed to restart metrics snapshots", "err", err)
+			}
+		}
+		return false
+	}
+	logger.Info("Gateway handed over to the new process")
+	return true
+}
+
+// newRateLimitStorage opens the configured rate limit storage, encrypted with the storage
+// encryption key. It returns nil for memory storage.
+func newRateLimitStorage(cfg *config.Config) (ratelimit.Storage, error) {
+	storageCfg := cfg.Gateway.RateLimitStorage
+	if storageCfg.Type != config.RateLimitStorageFile && storageCfg.Type != config.RateLimitStorageDB {
+		return nil, nil
+	}
+	cipher, err := encryption.Load(cfg.Gateway.StorageEncryption.KeyEnv, cfg.Gateway.StorageEncryption.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if storageCfg.Type == config.RateLimitStorageDB {
+		storage, err := ratelimit.NewDBStorage(&ratelimit.DBConfig{
+			Driver:      storageCfg.DB.Driver,
+			DataSource:  storageCfg.DB.DataSource,
+			TablePrefix: storageCfg.DB.TablePrefix,
+			Cipher:      cipher,
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Created database rate limit storage", "driver", storageCfg.DB.Driver, "encrypted", cipher.Enabled())
+		return storage, nil
+	}
+
+	filePath := storageCfg.FilePath
+	if filePath == "" {
+		filePath = "ratelimit.json"
+	}
+	storage, err := ratelimit.NewFileStorage(filePath, cipher)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Created file-based rate limit storage", "file", filePath, "encrypted", cipher.Enabled())
+	return storage, nil
+}
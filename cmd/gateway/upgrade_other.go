@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignals ask the gateway to hand over to a new process of its binary, there is no
+// signal for it on this platform
+var upgradeSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals ask the gateway to hand over to a new process of its binary
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// capabilities returns what the client advertises to the gateway, nil when it serves every
+// kind of connection without a limit. Gateways predating capabilities drop the tunnel on the
+// unknown message, so unrestricted clients don't send one.
+func (c *Client) capabilities() *protocol.Capabilities {
+	if !c.config.DisableUDP && !c.config.DisableUnix && c.config.MaxConnections <= 0 {
+		return nil
+	}
+	return &protocol.Capabilities{
+		SupportsUDP:  !c.config.DisableUDP,
+		SupportsUnix: !c.config.DisableUnix,
+		MaxConns:     c.config.MaxConnections,
+	}
+}
+
+// supportsNetwork reports whether the client dials connections of network
+func (c *Client) supportsNetwork(network string) bool {
+	return c.capabilities().Supports(network)
+}
+
+// advertiseCapabilities tells the gateway the restrictions of the client, before it opens
+// ports or routes connections to the client
+func (c *Client) advertiseCapabilities() {
+	caps := c.capabilities()
+	if caps == nil {
+		return
+	}
+	if err := c.msgHandler.WriteCapabilitiesMessage(caps); err != nil {
+		logger.Error("Failed to advertise capabilities to gateway", "client_id", c.getClientID(), "err", err)
+		return
+	}
+	logger.Debug("Advertised capabilities to gateway", "client_id", c.getClientID(), "supports_udp", caps.SupportsUDP, "supports_unix", caps.SupportsUnix, "max_conns", caps.MaxConns)
+}
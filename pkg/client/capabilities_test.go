@@ -0,0 +1,39 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/message"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestClient_AdvertiseCapabilities(t *testing.T) {
+	// Unrestricted clients stay compatible with gateways predating capabilities
+	transportConn := &recordingConnection{messages: make(chan []byte, 4)}
+	client := &Client{
+		config:     &config.ClientConfig{ClientID: "test-client"},
+		msgHandler: message.NewClientExtendedMessageHandler(transportConn),
+	}
+	client.advertiseCapabilities()
+	if len(transportConn.messages) != 0 {
+		t.Fatal("Expected no capabilities from an unrestricted client")
+	}
+	if !client.supportsNetwork("udp") {
+		t.Error("Expected an unrestricted client to dial UDP")
+	}
+
+	client.config = &config.ClientConfig{ClientID: "test-client", DisableUDP: true, MaxConnections: 20}
+	client.advertiseCapabilities()
+	_, msgType, payload, err := protocol.UnpackBinaryHeader(<-transportConn.messages)
+	if err != nil || msgType != protocol.BinaryMsgTypeCapabilities {
+		t.Fatalf("Expected a capabilities message, got 0x%02x, %v", msgType, err)
+	}
+	caps, err := protocol.UnpackCapabilitiesMessage(payload)
+	if err != nil || caps.SupportsUDP || !caps.SupportsUnix || caps.MaxConns != 20 {
+		t.Errorf("Unexpected capabilities: %+v, %v", caps, err)
+	}
+	if client.supportsNetwork("udp") || !client.supportsNetwork("tcp") {
+		t.Error("Expected the client to refuse UDP only")
+	}
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Synthetic check defaults
+const (
+	defaultCheckInterval = 30 * time.Second
+	defaultCheckTimeout  = 5 * time.Second
+	maxCheckBodyBytes    = 64 * 1024 // Response body read by HTTP checks, the rest is dropped
+)
+
+// checkRunner keeps the latest result of each synthetic check for the heartbeats
+type checkRunner struct {
+	checks []config.SyntheticCheck
+
+	mu      sync.Mutex
+	results map[string]monitoring.CheckResult
+}
+
+// newCheckRunner creates a runner for checks, nil when there are none
+func newCheckRunner(checks []config.SyntheticCheck) *checkRunner {
+	if len(checks) == 0 {
+		return nil
+	}
+	return &checkRunner{checks: checks, results: make(map[string]monitoring.CheckResult)}
+}
+
+// latest returns the results of the checks that ran, in the order they are configured
+func (r *checkRunner) latest() []monitoring.CheckResult {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := make([]monitoring.CheckResult, 0, len(r.results))
+	for _, check := range r.checks {
+		if result, ok := r.results[check.Name]; ok {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// record stores the result of a check, logging when it starts failing or recovers
+func (r *checkRunner) record(clientID string, result monitoring.CheckResult) {
+	r.mu.Lock()
+	previous, seen := r.results[result.Name]
+	r.results[result.Name] = result
+	r.mu.Unlock()
+
+	switch {
+	case !result.OK && (!seen || previous.OK):
+		logger.Warn("Synthetic check failing", "client_id", clientID, "check", result.Name, "target", result.Target, "err", result.Error)
+	case result.OK && seen && !previous.OK:
+		logger.Info("Synthetic check recovered", "client_id", clientID, "check", result.Name, "target", result.Target, "latency_ms", result.LatencyMs)
+	}
+}
+
+// startChecks runs each synthetic check periodically while the client runs
+func (c *Client) startChecks() {
+	if c.checks == nil {
+		return
+	}
+	logger.Info("Starting synthetic checks", "client_id", c.getClientID(), "checks", len(c.checks.checks))
+
+	for _, check := range c.checks.checks {
+		interval := check.Interval
+		if interval == 0 {
+			interval = defaultCheckInterval
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				result := c.runCheck(check)
+				if c.ctx.Err() != nil {
+					return
+				}
+				c.checks.record(c.getClientID(), result)
+				select {
+				case <-c.ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+// runCheck probes the target of a check once, dialing it like proxied connections
+func (c *Client) runCheck(check config.SyntheticCheck) monitoring.CheckResult {
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = defaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+	if check.Type == config.CheckTypeHTTP {
+		err = c.httpCheck(ctx, check)
+	} else {
+		var conn net.Conn
+		if conn, err = c.dialTarget(ctx, "tcp", check.Target); err == nil {
+			_ = conn.Close()
+		}
+	}
+
+	result := monitoring.CheckResult{
+		Name:      check.Name,
+		Type:      check.Type,
+		Target:    check.Target,
+		OK:        err == nil,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// httpCheck sends a GET to the target of an HTTP check and checks the response status
+func (c *Client) httpCheck(ctx context.Context, check config.SyntheticCheck) error {
+	client := &http.Client{Transport: &http.Transport{DialContext: c.dialTarget, DisableKeepAlives: true}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.Target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "anyproxy-check")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxCheckBodyBytes))
+
+	if check.ExpectStatus != 0 && resp.StatusCode != check.ExpectStatus {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, check.ExpectStatus)
+	}
+	if check.ExpectStatus == 0 && resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
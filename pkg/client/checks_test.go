@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestRunCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	// A closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Client{config: &config.ClientConfig{}, ctx: ctx, cancel: cancel}
+
+	tests := []struct {
+		check   config.SyntheticCheck
+		wantOK  bool
+		wantErr string
+	}{
+		{config.SyntheticCheck{Name: "tcp", Type: config.CheckTypeTCP, Target: strings.TrimPrefix(server.URL, "http://")}, true, ""},
+		{config.SyntheticCheck{Name: "tcp closed", Type: config.CheckTypeTCP, Target: closedAddr}, false, "refused"},
+		{config.SyntheticCheck{Name: "http", Type: config.CheckTypeHTTP, Target: server.URL + "/health"}, true, ""},
+		{config.SyntheticCheck{Name: "http down", Type: config.CheckTypeHTTP, Target: server.URL + "/down"}, false, "status 503"},
+		{config.SyntheticCheck{Name: "http expect", Type: config.CheckTypeHTTP, Target: server.URL + "/down", ExpectStatus: http.StatusServiceUnavailable}, true, ""},
+	}
+	for _, tt := range tests {
+		result := c.runCheck(tt.check)
+		if result.OK != tt.wantOK || !strings.Contains(result.Error, tt.wantErr) || result.Name != tt.check.Name {
+			t.Errorf("runCheck(%s) = %+v, want ok=%v and error containing %q", tt.check.Name, result, tt.wantOK, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckRunner_Latest(t *testing.T) {
+	var runner *checkRunner
+	if runner.latest() != nil {
+		t.Error("Runner without checks should report no results")
+	}
+
+	runner = newCheckRunner([]config.SyntheticCheck{{Name: "db"}, {Name: "wiki"}, {Name: "git"}})
+	runner.record("client-1", monitoring.CheckResult{Name: "git", OK: true})
+	runner.record("client-1", monitoring.CheckResult{Name: "db", OK: false, Error: "timeout"})
+
+	results := runner.latest()
+	if len(results) != 2 || results[0].Name != "db" || results[1].Name != "git" {
+		t.Errorf("Results = %+v, want the checks that ran in configured order", results)
+	}
+}
@@ -3,23 +3,32 @@ package client
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"net"
 	"reflect"
 	"sync"
 	"time"
 
 	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	"github.com/buhuipao/anyproxy/pkg/common/groupkey"
+	"github.com/buhuipao/anyproxy/pkg/common/identity"
 	"github.com/buhuipao/anyproxy/pkg/common/message"
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/qos"
+	"github.com/buhuipao/anyproxy/pkg/common/update"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	"github.com/buhuipao/anyproxy/pkg/transport"
 
 	// Import gRPC transport for side effects (registration)
 	_ "github.com/buhuipao/anyproxy/pkg/transport/grpc"
+	_ "github.com/buhuipao/anyproxy/pkg/transport/kcp"
+	_ "github.com/buhuipao/anyproxy/pkg/transport/memory"
 	_ "github.com/buhuipao/anyproxy/pkg/transport/quic"
 	_ "github.com/buhuipao/anyproxy/pkg/transport/websocket"
+	_ "github.com/buhuipao/anyproxy/pkg/transport/webtransport"
 )
 
 // Client struct
@@ -28,6 +37,7 @@ type Client struct {
 	cancel     context.CancelFunc
 	config     *config.ClientConfig
 	conn       transport.Connection // 🆕 Use transport layer connection
+	connMu     sync.Mutex           // Guards conn, cleanup runs from Stop and the connection loop
 	transport  transport.Transport  // 🆕 Transport layer instance
 	connMgr    *connection.Manager  // 🆕 Use shared connection manager
 	wg         sync.WaitGroup
@@ -37,9 +47,73 @@ type Client struct {
 	// 🆕 Shared message handler
 	msgHandler message.ExtendedMessageHandler
 
-	// Enhanced host pattern matching
-	forbiddenHostPatterns []*HostPattern // Enhanced forbidden host patterns
-	allowedHostPatterns   []*HostPattern // Enhanced allowed host patterns
+	// Enhanced host pattern matching, replaced together with open ports on config reload
+	policyMu              sync.RWMutex
+	forbiddenHostPatterns []*HostPattern    // Enhanced forbidden host patterns
+	allowedHostPatterns   []*HostPattern    // Enhanced allowed host patterns
+	openPorts             []config.OpenPort // Ports requested from the gateway
+	discoveredPorts       []config.OpenPort // Ports of services found by discovery, open_ports win on conflicts
+	policyPacks           []*policyPack     // Policy packs pushed by the gateway, each checked in addition
+
+	// Idle target connections reused across connect requests (nil = disabled)
+	pool *targetPool
+
+	// Egress interface / source IP selection for target dials (nil = system routing)
+	outbound *outboundRouter
+
+	// Rejects targets resolving to non-public addresses (nil = disabled)
+	guard *dialGuard
+
+	// Connect requests accepted per second, shared by the clients of NewClients (nil = unlimited)
+	connectRate *connectLimiter
+
+	// Outage reports waiting for the next gateway connection (nil = disabled)
+	spool *spool
+
+	// Replaces network dials to targets when set, e.g. by embedding programs and tests
+	targetDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Cancel functions of target dials in progress, by connection ID
+	pendingDials sync.Map
+
+	// Peer connections waiting for the gateway's connect response, by connection ID
+	peerDials sync.Map
+
+	// How long half-closed connections stay open, zero closes connections fully on EOF
+	closeGrace time.Duration
+
+	// How long Stop waits for in-flight connections after announcing it, zero stops immediately
+	drainTimeout time.Duration
+	halfClosed   sync.Map // Connection ID to *connection.HalfClose
+
+	// Client-side services reachable through the tunnel (nil = disabled)
+	files   *fileService
+	exec    *execService
+	updater *Updater // Shared by all replicas of the process
+
+	// Caps and shares the bandwidth sent to the gateway, shared by all replicas (nil = unlimited)
+	egress *qos.Scheduler
+
+	// Classifies connections the gateway sent no priority for (nil = all normal)
+	qos *qos.Classifier
+
+	// Exchanges IP packets of the TUN interface, shared by all replicas (nil = disabled)
+	tun *PacketTunnel
+
+	// Host telemetry sent with heartbeats
+	telemetry *telemetryCollector
+
+	// Synthetic checks of targets, their results are sent with heartbeats (nil = none)
+	checks *checkRunner
+
+	// Proves the client ID to gateways pinning client identities (nil = no proof)
+	identityKey ed25519.PrivateKey
+
+	// Signs port forward requests and verifies policy pushes, derived from the group password (nil = none)
+	controlKey []byte
+
+	// Operator key policy pushes must be signed with, the gateway never has its private key (nil = none)
+	policyKey ed25519.PublicKey
 
 	// 🆕 Added for web server integration
 	webServer interface{}
@@ -78,6 +152,8 @@ func NewClient(cfg *config.ClientConfig, transportType string, replicaIdx int) (
 	transport := transport.CreateTransport(transportType, &transport.AuthConfig{
 		Username: cfg.Gateway.AuthUsername,
 		Password: cfg.Gateway.AuthPassword,
+		KCP:      cfg.Gateway.KCP,
+		GRPC:     cfg.Gateway.GRPC,
 	})
 	if transport == nil {
 		return nil, fmt.Errorf("failed to create transport: %s", transportType)
@@ -86,20 +162,122 @@ func NewClient(cfg *config.ClientConfig, transportType string, replicaIdx int) (
 	ctx, cancel := context.WithCancel(context.Background())
 
 	client := &Client{
-		config:     cfg,
-		actualID:   generateClientID(cfg.ClientID, replicaIdx), // Generate unique client ID
-		transport:  transport,
-		replicaIdx: replicaIdx,
-		connMgr:    connection.NewManager(cfg.ClientID),
-		ctx:        ctx,
-		cancel:     cancel,
+		config:       cfg,
+		actualID:     generateClientID(cfg.ClientID, replicaIdx), // Generate unique client ID
+		transport:    transport,
+		replicaIdx:   replicaIdx,
+		connMgr:      connection.NewManager(cfg.ClientID),
+		openPorts:    cfg.OpenPorts,
+		closeGrace:   connection.CloseGracePeriod(cfg.CloseGracePeriod),
+		drainTimeout: drainTimeout(cfg.DrainTimeout),
+		controlKey:   groupkey.Derive(cfg.GroupID, cfg.GroupPassword),
+		ctx:          ctx,
+		cancel:       cancel,
 		// Regular expressions will be initialized in compileHostPatterns
 	}
 
 	// Compile host patterns
 	if err := client.compileHostPatterns(); err != nil {
 		cancel()
-		return nil, fmt.Errorf("failed to compile host patterns: %v", err)
+		return nil, fmt.Errorf("failed to compile host patterns: %w", err)
+	}
+
+	// Create target connection pool
+	pool, err := newTargetPool(cfg.ConnectionPool)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to compile connection pool host patterns: %w", err)
+	}
+	client.pool = pool
+	if pool != nil {
+		logger.Info("Target connection pool enabled", "client_id", cfg.ClientID, "max_idle_per_host", pool.maxIdle, "idle_timeout", pool.idleTimeout, "host_patterns", len(pool.patterns))
+	}
+
+	// Compile outbound routes
+	outbound, err := newOutboundRouter(cfg.Outbound)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to compile outbound rules: %w", err)
+	}
+	client.outbound = outbound
+	if outbound != nil {
+		logger.Info("Outbound routes configured", "client_id", cfg.ClientID, "route_count", len(outbound.routes))
+	}
+
+	// Create dial guard
+	guard, err := newDialGuard(cfg.DialGuard)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create dial guard: %w", err)
+	}
+	client.guard = guard
+	if guard != nil {
+		logger.Info("Dial guard enabled", "client_id", cfg.ClientID, "allowed_cidrs", cfg.DialGuard.AllowedCIDRs)
+	}
+
+	client.connectRate = newConnectLimiter(cfg.MaxConnectRate, cfg.ConnectBurst)
+
+	// Open outage spool
+	outageSpool, err := newSpool(cfg.Spool)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create spool: %w", err)
+	}
+	client.spool = outageSpool
+	if outageSpool != nil {
+		logger.Info("Outage spool enabled", "client_id", cfg.ClientID, "dir", cfg.Spool.Dir, "max_bytes", outageSpool.maxBytes)
+	}
+
+	// Compile QoS rules
+	classifier, err := qos.NewClassifier(cfg.QoS)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to compile qos rules: %w", err)
+	}
+	client.qos = classifier
+
+	// Create file transfer service
+	files, err := newFileService(client.actualID, cfg.FileTransfer)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create file transfer service: %w", err)
+	}
+	client.files = files
+
+	// Create remote exec service
+	execSvc, err := newExecService(client.actualID, cfg.RemoteExec)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create remote exec service: %w", err)
+	}
+	client.exec = execSvc
+	client.telemetry = newTelemetryCollector(cfg.Heartbeat.DiskPath)
+	client.telemetry.connections = client.connMgr.GetConnectionCount
+	client.telemetry.maxConnections = cfg.MaxConnections
+	client.telemetry.bandwidth = cfg.Heartbeat.Bandwidth
+	if client.telemetry.bandwidth == 0 {
+		client.telemetry.bandwidth = cfg.Egress.MaxBandwidth
+	}
+	client.checks = newCheckRunner(cfg.Checks)
+	client.telemetry.checks = client.checks.latest
+
+	if cfg.IdentityKey != "" {
+		key, err := identity.LoadOrCreateKey(cfg.IdentityKey)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to load identity key: %w", err)
+		}
+		client.identityKey = key
+		logger.Info("Client identity key loaded", "client_id", cfg.ClientID, "fingerprint", identity.Fingerprint(key.Public().(ed25519.PublicKey)))
+	}
+
+	if cfg.PolicyPublicKey != "" {
+		key, err := update.ParsePublicKey(cfg.PolicyPublicKey)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("invalid policy public key: %w", err)
+		}
+		client.policyKey = key
 	}
 
 	logger.Debug("Created client with compiled host patterns", "id", cfg.ClientID, "forbidden_patterns", len(client.forbiddenHostPatterns), "allowed_patterns", len(client.allowedHostPatterns))
@@ -126,6 +304,15 @@ func (c *Client) Start() error {
 		c.connectionLoop()
 	}()
 
+	// Open connections to prewarmed targets ahead of the first requests
+	c.startPrewarm()
+
+	// Close pooled connections nobody came back for
+	c.startIdleEviction()
+
+	// Probe internal targets for the gateway's view of their health
+	c.startChecks()
+
 	logger.Info("Client started successfully", "client_id", c.getClientID())
 
 	return nil
@@ -135,6 +322,9 @@ func (c *Client) Start() error {
 func (c *Client) Stop() error {
 	logger.Info("Initiating graceful client stop", "client_id", c.getClientID())
 
+	// Let the gateway route new connections elsewhere while in-flight ones finish
+	c.drain()
+
 	// Step 1: Cancel context
 	logger.Debug("Cancelling client context", "client_id", c.getClientID())
 	c.cancel()
@@ -155,6 +345,7 @@ func (c *Client) Stop() error {
 	// Step 3: Cleanup all resources
 	logger.Debug("Performing cleanup", "client_id", c.getClientID())
 	c.cleanup()
+	c.pool.closeIdle()
 
 	// Step 4: Wait for all goroutines to finish
 	logger.Debug("Waiting for all goroutines to finish", "client_id", c.getClientID())
@@ -207,3 +398,19 @@ func (c *Client) UpdateClientMetrics(bytesSent, bytesReceived int64, isError boo
 func (c *Client) SetWebServer(webServer interface{}) {
 	c.webServer = webServer
 }
+
+// SetTargetDialer makes the client reach targets through dial instead of the network.
+// It must be called before Start.
+func (c *Client) SetTargetDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) {
+	c.targetDialer = dial
+}
+
+// SetUpdater enables receiving client updates pushed by the gateway
+func (c *Client) SetUpdater(updater *Updater) {
+	c.updater = updater
+}
+
+// SetEgressScheduler caps the bandwidth sent to the gateway. It must be called before Start.
+func (c *Client) SetEgressScheduler(egress *qos.Scheduler) {
+	c.egress = egress
+}
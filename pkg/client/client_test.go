@@ -102,6 +102,10 @@ func (m *mockConnection) GetPassword() string {
 	return "test-password"
 }
 
+func (m *mockConnection) GetClientVersion() string {
+	return ""
+}
+
 func TestNewClient(t *testing.T) {
 	tests := []struct {
 		name          string
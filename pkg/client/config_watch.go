@@ -0,0 +1,294 @@
+package client
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// configReloadDelay coalesces the burst of events an editor produces when saving
+const configReloadDelay = 500 * time.Millisecond
+
+// ConfigWatcher reapplies the host patterns, open ports and rate limits of all replicas, and the
+// routes and domains of the TUN interface, when the config file changes
+type ConfigWatcher struct {
+	path    string
+	clients []*Client
+	current *config.ClientConfig
+	watcher *fsnotify.Watcher
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// configDiff lists the reloadable settings that changed
+type configDiff struct {
+	allowedAdded     []string
+	allowedRemoved   []string
+	forbiddenAdded   []string
+	forbiddenRemoved []string
+	portsAdded       []config.OpenPort
+	portsRemoved     []config.OpenPort
+	routesAdded      []string
+	routesRemoved    []string
+	domainsAdded     []string
+	domainsRemoved   []string
+	connectRate      string // New connect rate limit, empty when unchanged
+	egress           string // New egress bandwidth limit, empty when unchanged
+}
+
+// NewConfigWatcher watches path, current is the client config the replicas were started with
+func NewConfigWatcher(path string, current *config.ClientConfig, clients []*Client) (*ConfigWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	// Watch the directory, editors and config management replace the file rather than write it
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", filepath.Dir(path), err)
+	}
+
+	return &ConfigWatcher{
+		path:    filepath.Clean(path),
+		clients: clients,
+		current: current,
+		watcher: watcher,
+		stopCh:  make(chan struct{}),
+	}, nil
+}
+
+// Start begins watching in the background
+func (w *ConfigWatcher) Start() {
+	w.wg.Add(1)
+	go w.run()
+	logger.Info("Watching client config file", "path", w.path)
+}
+
+// Stop stops watching
+func (w *ConfigWatcher) Stop() {
+	close(w.stopCh)
+	_ = w.watcher.Close()
+	w.wg.Wait()
+}
+
+func (w *ConfigWatcher) run() {
+	defer w.wg.Done()
+
+	var timer *time.Timer
+	var reloadCh <-chan time.Time
+	for {
+		select {
+		case <-w.stopCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != w.path || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(configReloadDelay)
+			reloadCh = timer.C
+		case <-reloadCh:
+			reloadCh = nil
+			w.reload()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("Config watcher error", "path", w.path, "err", err)
+		}
+	}
+}
+
+// reload loads the config file and applies the reloadable settings to all replicas
+func (w *ConfigWatcher) reload() {
+	cfg, err := config.LoadConfig(w.path)
+	if err != nil {
+		logger.Error("Failed to reload client config, keeping current settings", "path", w.path, "err", err)
+		return
+	}
+	next := &cfg.Client
+
+	forbidden, allowed, err := compileHostPolicy(next.ForbiddenHosts, next.AllowedHosts)
+	if err != nil {
+		logger.Error("Failed to reload client config, keeping current settings", "path", w.path, "err", err)
+		return
+	}
+
+	diff := diffClientConfig(w.current, next)
+	if restartRequired(w.current, next) {
+		logger.Warn("Client config changed outside host patterns, open ports, rate limits and TUN routes, restart to apply the other changes", "path", w.path)
+	}
+	w.current = next
+	if diff.empty() {
+		logger.Debug("Client config file changed, nothing to reapply", "path", w.path)
+		return
+	}
+
+	logger.Info("Reapplying client config", append([]any{"path", w.path}, diff.logArgs()...)...)
+	portsChanged := len(diff.portsAdded) > 0 || len(diff.portsRemoved) > 0
+	for _, c := range w.clients {
+		c.applyHostPolicy(forbidden, allowed, next.OpenPorts, portsChanged)
+	}
+	// The replicas share one TUN interface
+	if len(w.clients) > 0 && len(diff.routesAdded)+len(diff.routesRemoved)+len(diff.domainsAdded)+len(diff.domainsRemoved) > 0 {
+		w.clients[0].tun.Reconfigure(next.Tun)
+	}
+	// The replicas share the connect limiter and the egress scheduler of the process
+	if len(w.clients) > 0 && diff.connectRate != "" {
+		w.clients[0].connectRate.setRate(next.MaxConnectRate, next.ConnectBurst)
+	}
+	if len(w.clients) > 0 && diff.egress != "" {
+		if egress := w.clients[0].egress; egress != nil {
+			egress.SetBandwidth(next.Egress.MaxBandwidth, next.Egress.Burst)
+		} else {
+			logger.Warn("Egress bandwidth scheduler is not running, restart to apply the egress limit", "path", w.path)
+		}
+	}
+}
+
+// applyHostPolicy replaces the host patterns and open ports, and asks the gateway for the new port set
+func (c *Client) applyHostPolicy(forbidden, allowed []*HostPattern, openPorts []config.OpenPort, portsChanged bool) {
+	c.policyMu.Lock()
+	c.forbiddenHostPatterns = forbidden
+	c.allowedHostPatterns = allowed
+	c.openPorts = openPorts
+	c.policyMu.Unlock()
+
+	// A disconnected client sends its ports when it reconnects
+	if !portsChanged || c.currentConn() == nil {
+		return
+	}
+	if err := c.writePortForwardRequest(c.currentOpenPorts()); err != nil {
+		logger.Error("Failed to send updated port forwarding request", "client_id", c.getClientID(), "err", err)
+	}
+}
+
+// diffClientConfig compares the reloadable settings
+func diffClientConfig(prev, next *config.ClientConfig) configDiff {
+	var diff configDiff
+	diff.allowedAdded, diff.allowedRemoved = diffSet(prev.AllowedHosts, next.AllowedHosts)
+	diff.forbiddenAdded, diff.forbiddenRemoved = diffSet(prev.ForbiddenHosts, next.ForbiddenHosts)
+	diff.portsAdded, diff.portsRemoved = diffSetBy(prev.OpenPorts, next.OpenPorts, formatOpenPort)
+	diff.routesAdded, diff.routesRemoved = diffSet(prev.Tun.Routes, next.Tun.Routes)
+	diff.domainsAdded, diff.domainsRemoved = diffSet(prev.Tun.Domains, next.Tun.Domains)
+	if prev.MaxConnectRate != next.MaxConnectRate || prev.ConnectBurst != next.ConnectBurst {
+		diff.connectRate = fmt.Sprintf("%g/s burst %d", next.MaxConnectRate, next.ConnectBurst)
+	}
+	if prev.Egress.MaxBandwidth != next.Egress.MaxBandwidth || prev.Egress.Burst != next.Egress.Burst {
+		diff.egress = fmt.Sprintf("%d B/s burst %d", next.Egress.MaxBandwidth, next.Egress.Burst)
+	}
+	return diff
+}
+
+// diffSet returns the entries only in next and only in prev
+func diffSet[T comparable](prev, next []T) (added, removed []T) {
+	return diffSetBy(prev, next, func(v T) T { return v })
+}
+
+// diffSetBy returns the entries only in next and only in prev, comparing them by key
+func diffSetBy[T any, K comparable](prev, next []T, key func(T) K) (added, removed []T) {
+	seen := make(map[K]bool, len(prev))
+	for _, v := range prev {
+		seen[key(v)] = true
+	}
+	for _, v := range next {
+		if !seen[key(v)] {
+			added = append(added, v)
+		}
+	}
+	seen = make(map[K]bool, len(next))
+	for _, v := range next {
+		seen[key(v)] = true
+	}
+	for _, v := range prev {
+		if !seen[key(v)] {
+			removed = append(removed, v)
+		}
+	}
+	return added, removed
+}
+
+func (d configDiff) empty() bool {
+	return len(d.allowedAdded) == 0 && len(d.allowedRemoved) == 0 &&
+		len(d.forbiddenAdded) == 0 && len(d.forbiddenRemoved) == 0 &&
+		len(d.portsAdded) == 0 && len(d.portsRemoved) == 0 &&
+		len(d.routesAdded) == 0 && len(d.routesRemoved) == 0 &&
+		len(d.domainsAdded) == 0 && len(d.domainsRemoved) == 0 &&
+		d.connectRate == "" && d.egress == ""
+}
+
+// logArgs returns the non-empty changes as logger key/value pairs
+func (d configDiff) logArgs() []any {
+	var args []any
+	add := func(key string, values []string) {
+		if len(values) > 0 {
+			args = append(args, key, values)
+		}
+	}
+	add("allowed_hosts_added", d.allowedAdded)
+	add("allowed_hosts_removed", d.allowedRemoved)
+	add("forbidden_hosts_added", d.forbiddenAdded)
+	add("forbidden_hosts_removed", d.forbiddenRemoved)
+	add("open_ports_added", formatOpenPorts(d.portsAdded))
+	add("open_ports_removed", formatOpenPorts(d.portsRemoved))
+	add("tun_routes_added", d.routesAdded)
+	add("tun_routes_removed", d.routesRemoved)
+	add("tun_domains_added", d.domainsAdded)
+	add("tun_domains_removed", d.domainsRemoved)
+	if d.connectRate != "" {
+		args = append(args, "max_connect_rate", d.connectRate)
+	}
+	if d.egress != "" {
+		args = append(args, "egress_max_bandwidth", d.egress)
+	}
+	return args
+}
+
+// formatOpenPorts renders ports as "remote_port/protocol->local_host:local_port"
+func formatOpenPorts(ports []config.OpenPort) []string {
+	formatted := make([]string, 0, len(ports))
+	for _, port := range ports {
+		formatted = append(formatted, formatOpenPort(port))
+	}
+	return formatted
+}
+
+// formatOpenPort formats a port as "remote/protocol->host:port", followed by its allowed sources
+func formatOpenPort(port config.OpenPort) string {
+	formatted := fmt.Sprintf("%d/%s->%s:%d", port.RemotePort, port.Protocol, port.LocalHost, port.LocalPort)
+	if len(port.AllowedSources) > 0 {
+		formatted += " from " + strings.Join(port.AllowedSources, ",")
+	}
+	return formatted
+}
+
+// restartRequired reports whether settings other than the reloadable ones changed
+func restartRequired(prev, next *config.ClientConfig) bool {
+	a, b := *prev, *next
+	a.AllowedHosts, b.AllowedHosts = nil, nil
+	a.ForbiddenHosts, b.ForbiddenHosts = nil, nil
+	a.OpenPorts, b.OpenPorts = nil, nil
+	a.Tun.Routes, b.Tun.Routes = nil, nil
+	a.Tun.Domains, b.Tun.Domains = nil, nil
+	a.MaxConnectRate, b.MaxConnectRate = 0, 0
+	a.ConnectBurst, b.ConnectBurst = 0, 0
+	a.Egress.MaxBandwidth, b.Egress.MaxBandwidth = 0, 0
+	a.Egress.Burst, b.Egress.Burst = 0, 0
+	return !reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/qos"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+const watchTestConfig = `client:
+  id: watch-client
+  group_id: watch-group
+  allowed_hosts:
+%s
+  open_ports:
+%s
+`
+
+func writeWatchTestConfig(t *testing.T, path, allowedHosts, openPorts string) {
+	t.Helper()
+	data := []byte(sprintfConfig(allowedHosts, openPorts))
+	// Write to a temp file and rename, like editors do
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sprintfConfig(allowedHosts, openPorts string) string {
+	if allowedHosts == "" {
+		allowedHosts = "    []"
+	}
+	if openPorts == "" {
+		openPorts = "    []"
+	}
+	return fmt.Sprintf(watchTestConfig, allowedHosts, openPorts)
+}
+
+func newWatchTestClient(t *testing.T, path string) (*Client, *config.ClientConfig) {
+	t.Helper()
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	c := &Client{config: &cfg.Client, actualID: "watch-client-0", openPorts: cfg.Client.OpenPorts}
+	if err := c.compileHostPatterns(); err != nil {
+		t.Fatal(err)
+	}
+	return c, &cfg.Client
+}
+
+func TestDiffClientConfig(t *testing.T) {
+	prev := &config.ClientConfig{
+		ClientID:       "c",
+		AllowedHosts:   []string{"a.com", "b.com"},
+		ForbiddenHosts: []string{"evil.com"},
+		OpenPorts:      []config.OpenPort{{RemotePort: 8080, LocalHost: "localhost", LocalPort: 80, Protocol: "tcp"}},
+	}
+	next := &config.ClientConfig{
+		ClientID:       "c",
+		AllowedHosts:   []string{"b.com", "c.com"},
+		ForbiddenHosts: []string{"evil.com"},
+		OpenPorts:      []config.OpenPort{{RemotePort: 8080, LocalHost: "localhost", LocalPort: 81, Protocol: "tcp"}},
+	}
+
+	diff := diffClientConfig(prev, next)
+	if len(diff.allowedAdded) != 1 || diff.allowedAdded[0] != "c.com" || len(diff.allowedRemoved) != 1 || diff.allowedRemoved[0] != "a.com" {
+		t.Errorf("Unexpected allowed hosts diff %v %v", diff.allowedAdded, diff.allowedRemoved)
+	}
+	if len(diff.forbiddenAdded) != 0 || len(diff.forbiddenRemoved) != 0 {
+		t.Errorf("Unexpected forbidden hosts diff %v %v", diff.forbiddenAdded, diff.forbiddenRemoved)
+	}
+	if got := formatOpenPorts(diff.portsAdded); len(got) != 1 || got[0] != "8080/tcp->localhost:81" {
+		t.Errorf("Unexpected added ports %v", got)
+	}
+	if len(diff.portsRemoved) != 1 || diff.empty() {
+		t.Errorf("Unexpected removed ports %v", diff.portsRemoved)
+	}
+	if restartRequired(prev, next) {
+		t.Error("Reloadable changes should not require a restart")
+	}
+
+	next.Tun.Domains = []string{"git.corp.example.com"}
+	if diff := diffClientConfig(prev, next); len(diff.domainsAdded) != 1 || restartRequired(prev, next) {
+		t.Errorf("TUN domains should be reloadable, diff %v", diff.domainsAdded)
+	}
+
+	next.Replicas = 2
+	if !restartRequired(prev, next) {
+		t.Error("Replicas change should require a restart")
+	}
+	if !diffClientConfig(prev, prev).empty() {
+		t.Error("Identical configs should have an empty diff")
+	}
+}
+
+func TestConfigWatcher_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeWatchTestConfig(t, path, "    - a.com:443", "")
+	c, current := newWatchTestClient(t, path)
+	mockConn := &mockConnForPortForward{}
+	c.conn = mockConn
+
+	w := &ConfigWatcher{path: path, clients: []*Client{c}, current: current}
+
+	// An invalid pattern keeps the current settings
+	writeWatchTestConfig(t, path, "    - \"[invalid regex\"", "")
+	w.reload()
+	if !c.isConnectionAllowed("a.com:443") {
+		t.Fatal("Invalid config should not be applied")
+	}
+
+	writeWatchTestConfig(t, path, "    - b.com:443", `    - remote_port: 18080
+      local_host: localhost
+      local_port: 8080
+      protocol: tcp`)
+	w.reload()
+	if c.isConnectionAllowed("a.com:443") || !c.isConnectionAllowed("b.com:443") {
+		t.Error("Allowed hosts were not reapplied")
+	}
+	if len(c.currentOpenPorts()) != 1 || mockConn.writeCalls != 1 {
+		t.Fatalf("Expected one port forward request, got %d ports and %d writes", len(c.currentOpenPorts()), mockConn.writeCalls)
+	}
+
+	// Removing all ports sends an empty port set
+	writeWatchTestConfig(t, path, "    - b.com:443", "")
+	w.reload()
+	if mockConn.writeCalls != 2 {
+		t.Fatalf("Expected a second port forward request, got %d writes", mockConn.writeCalls)
+	}
+	_, _, data, err := protocol.UnpackBinaryHeader(mockConn.writeMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ports, err := protocol.UnpackPortForwardMessage(data); err != nil || len(ports) != 0 {
+		t.Errorf("Expected an empty port set, got %v (err %v)", ports, err)
+	}
+
+	// Unchanged ports are not resent
+	writeWatchTestConfig(t, path, "    - c.com:443", "")
+	w.reload()
+	if mockConn.writeCalls != 2 || !c.isConnectionAllowed("c.com:443") {
+		t.Errorf("Unexpected writes %d or hosts not reapplied", mockConn.writeCalls)
+	}
+}
+
+func TestConfigWatcher_WatchesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeWatchTestConfig(t, path, "    - a.com:443", "")
+	c, current := newWatchTestClient(t, path)
+
+	w, err := NewConfigWatcher(path, current, []*Client{c})
+	if err != nil {
+		t.Fatalf("NewConfigWatcher() error = %v", err)
+	}
+	w.Start()
+	defer w.Stop()
+
+	writeWatchTestConfig(t, path, "    - b.com:443", "")
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.isConnectionAllowed("b.com:443") {
+		if time.Now().After(deadline) {
+			t.Fatal("Config change was not applied")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestConfigWatcher_ReloadRateLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeRateConfig := func(rates string) {
+		t.Helper()
+		data := []byte(sprintfConfig("", "") + rates)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRateConfig("")
+	c, current := newWatchTestClient(t, path)
+	c.connectRate = newConnectLimiter(current.MaxConnectRate, current.ConnectBurst)
+	c.egress = qos.NewAdjustableScheduler(current.Egress)
+	defer c.egress.Stop()
+	w := &ConfigWatcher{path: path, clients: []*Client{c}, current: current}
+
+	// Unlimited until the config sets a connect rate
+	for i := 0; i < 5; i++ {
+		if wait := c.connectRate.take(); wait != 0 {
+			t.Fatalf("Unlimited take() = %v, want 0", wait)
+		}
+	}
+	writeRateConfig("  max_connect_rate: 1\n  connect_burst: 2\n  egress:\n    max_bandwidth: 65536\n    burst: 32768\n")
+	w.reload()
+	for i := 0; i < 2; i++ {
+		if wait := c.connectRate.take(); wait != 0 {
+			t.Fatalf("take() %d within the new burst = %v, want 0", i, wait)
+		}
+	}
+	if wait := c.connectRate.take(); wait <= 0 {
+		t.Error("Expected the new connect rate to hold off requests above the burst")
+	}
+	if restartRequired(current, w.current) {
+		t.Error("Rate limit changes should not require a restart")
+	}
+
+	// The new egress bandwidth holds back a send above its burst
+	ctx := context.Background()
+	if err := c.egress.Wait(ctx, "conn-1", 32768); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := c.egress.Wait(ctx, "conn-1", 32768); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Send above the new egress burst waited %v, want about 500ms", elapsed)
+	}
+
+	// Removing the limits lifts them
+	writeRateConfig("")
+	w.reload()
+	if wait := c.connectRate.take(); wait != 0 {
+		t.Errorf("take() after removing the limit = %v, want 0", wait)
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// connectLimiter is a token bucket for the connect requests the client accepts from gateways.
+// A rate of zero accepts all requests, the rate can be changed while the client runs.
+type connectLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	burst  float64
+	last   time.Time
+}
+
+// newConnectLimiter returns a limiter, unlimited when the rate is zero
+func newConnectLimiter(rate float64, burst int) *connectLimiter {
+	l := &connectLimiter{last: time.Now()}
+	l.setRate(rate, burst)
+	return l
+}
+
+// setRate changes the rate and burst. Tokens above the new burst are dropped, a limiter that
+// was unlimited starts with a full bucket.
+func (l *connectLimiter) setRate(rate float64, burst int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	wasUnlimited := l.rate <= 0
+	l.rate = math.Max(rate, 0)
+	l.burst = float64(burst)
+	if l.burst <= 0 {
+		l.burst = math.Max(rate, 1)
+	}
+	if wasUnlimited || l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// limit returns the current rate, zero when unlimited
+func (l *connectLimiter) limit() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// take takes a token for a connect request, or returns how long until the next one is available
+func (l *connectLimiter) take() time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.rate <= 0 {
+		l.last = now
+		return 0
+	}
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return max(wait, time.Millisecond)
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/message"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestConnectLimiter(t *testing.T) {
+	if wait := (*connectLimiter)(nil).take(); wait != 0 {
+		t.Errorf("Unlimited take() = %v, want 0", wait)
+	}
+
+	limiter := newConnectLimiter(10, 3)
+	for i := 0; i < 3; i++ {
+		if wait := limiter.take(); wait != 0 {
+			t.Fatalf("take() %d within the burst = %v, want 0", i, wait)
+		}
+	}
+	if wait := limiter.take(); wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("take() above the burst = %v, want up to 100ms", wait)
+	}
+}
+
+func TestClient_ConnectRateLimit(t *testing.T) {
+	transportConn := &recordingConnection{messages: make(chan []byte, 4)}
+	cfg := &config.ClientConfig{ClientID: "test-client", MaxConnectRate: 0.5, ConnectBurst: 1}
+	client := &Client{
+		config:      cfg,
+		msgHandler:  message.NewClientExtendedMessageHandler(transportConn),
+		connectRate: newConnectLimiter(cfg.MaxConnectRate, cfg.ConnectBurst),
+	}
+	client.connectRate.take()
+
+	client.handleConnectMessage(map[string]interface{}{"id": "conn-1", "network": "tcp", "address": "example.com:80"})
+	_, msgType, payload, err := protocol.UnpackBinaryHeader(<-transportConn.messages)
+	if err != nil || msgType != protocol.BinaryMsgTypeConnectResponse {
+		t.Fatalf("Expected a connect response, got 0x%02x, %v", msgType, err)
+	}
+	connID, success, _, errorCode, retryAfter, err := protocol.UnpackConnectResponseMessageWithRetry(payload)
+	if err != nil || connID != "conn-1" || success || errorCode != string(utils.ErrCodeClientBusy) {
+		t.Fatalf("Expected a client_busy response for conn-1, got %s %v %q, %v", connID, success, errorCode, err)
+	}
+	if retryAfter < time.Second || retryAfter > 2*time.Second {
+		t.Errorf("Expected to hold off for up to 2s at 0.5/s, got %v", retryAfter)
+	}
+}
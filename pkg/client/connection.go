@@ -2,15 +2,21 @@ package client
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	"github.com/buhuipao/anyproxy/pkg/common/identity"
 	"github.com/buhuipao/anyproxy/pkg/common/message"
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	"github.com/buhuipao/anyproxy/pkg/transport"
 )
@@ -46,7 +52,10 @@ func (c *Client) connectionLoop() {
 				return
 			}
 
-			// Log connection failure
+			// Log connection failure, retrying with rejected credentials only helps if the gateway changes them
+			if errors.Is(err, transport.ErrAuthFailed) {
+				logger.Error("Gateway rejected the transport credentials, check gateway.auth_username and auth_password", "client_id", c.getClientID(), "gateway_addr", c.config.Gateway.Addr)
+			}
 			logger.Error("Connection attempt failed", "client_id", c.getClientID(), "err", err, "consecutive_failures", consecutiveFailures, "max_consecutive_failures", maxConsecutiveFailures, "time_elapsed", elapsedTime, "retry_delay", currentDelay, "gateway_addr", c.config.Gateway.Addr)
 
 			// Wait before retry with exponential backoff
@@ -68,11 +77,26 @@ func (c *Client) connectionLoop() {
 		currentDelay = 1 * time.Second
 		logger.Info("Connection to gateway established successfully", "client_id", c.getClientID(), "gateway_addr", c.config.Gateway.Addr)
 
+		// Upload what happened during previous outages
+		if c.spool != nil {
+			handler := c.msgHandler
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				c.uploadSpool(handler)
+			}()
+		}
+
 		// Connection successful - this will block until connection is lost
+		stopHeartbeat := c.startHeartbeat(c.msgHandler)
 		c.handleMessages()
+		stopHeartbeat()
 
 		// Connection lost - cleanup resources before retry
 		logger.Warn("Connection to gateway lost, cleaning up resources before retry", "client_id", c.getClientID(), "gateway_addr", c.config.Gateway.Addr)
+		if c.ctx.Err() == nil {
+			c.spoolOutage()
+		}
 		c.cleanup()
 	}
 }
@@ -85,6 +109,12 @@ func (c *Client) connect() error {
 	var tlsConfig *tls.Config
 	var err error
 
+	// Clients enrolling with a gateway with auto_tls fetch its CA first
+	if err := c.enrollCA(); err != nil {
+		logger.Error("Failed to enroll with the gateway", "client_id", c.actualID, "enroll_url", c.config.Gateway.EnrollURL, "err", err)
+		return fmt.Errorf("failed to enroll: %w", err)
+	}
+
 	// Auto-detect TLS requirement
 	// Check if TLS certificate is provided OR if using WSS/HTTPS scheme
 	needsTLS := c.config.Gateway.TLSCert != "" || strings.HasPrefix(c.config.Gateway.Addr, "wss://")
@@ -92,7 +122,7 @@ func (c *Client) connect() error {
 		tlsConfig, err = c.createTLSConfig()
 		if err != nil {
 			logger.Error("Failed to create TLS configuration", "client_id", c.actualID, "gateway_addr", c.config.Gateway.Addr, "err", err)
-			return fmt.Errorf("failed to create TLS configuration: %v", err)
+			return fmt.Errorf("failed to create TLS configuration: %w", err)
 		}
 		logger.Debug("TLS configuration created successfully", "client_id", c.actualID, "gateway_addr", c.config.Gateway.Addr)
 	}
@@ -104,9 +134,13 @@ func (c *Client) connect() error {
 		Username:      c.config.Gateway.AuthUsername,
 		Password:      c.config.Gateway.AuthPassword, // Gateway authentication
 		GroupPassword: c.config.GroupPassword,        // Client group password for proxy auth
+		Version:       version.Version,
 		TLSConfig:     tlsConfig,
 		SkipVerify:    false, // Use proper certificate verification by default
 	}
+	if c.identityKey != nil {
+		transportConfig.Identity = identity.NewProof(c.identityKey, c.actualID, c.config.GroupID, time.Now())
+	}
 
 	logger.Debug("Transport configuration created", "client_id", c.actualID, "group_id", c.config.GroupID, "auth_enabled", c.config.Gateway.AuthUsername != "", "tls_enabled", tlsConfig != nil)
 
@@ -114,10 +148,12 @@ func (c *Client) connect() error {
 	conn, err := c.transport.DialWithConfig(c.config.Gateway.Addr, transportConfig)
 	if err != nil {
 		logger.Error("Failed to connect via transport layer", "client_id", c.actualID, "gateway_addr", c.config.Gateway.Addr, "err", err)
-		return fmt.Errorf("failed to connect: %v", err)
+		return fmt.Errorf("failed to connect: %w", err)
 	}
 
+	c.connMu.Lock()
 	c.conn = conn
+	c.connMu.Unlock()
 	logger.Info("Transport connection established successfully", "client_id", c.actualID, "group_id", c.config.GroupID, "remote_addr", conn.RemoteAddr())
 
 	// 🆕 Initialize message handler
@@ -125,9 +161,12 @@ func (c *Client) connect() error {
 
 	// 🆕 Update connection state to connected
 
+	c.advertiseCapabilities()
+	c.announcePacketTunnel()
+
 	// Send port forwarding request
-	if len(c.config.OpenPorts) > 0 {
-		logger.Debug("Sending port forwarding request", "client_id", c.actualID, "port_count", len(c.config.OpenPorts))
+	if openPorts := c.currentOpenPorts(); len(openPorts) > 0 {
+		logger.Debug("Sending port forwarding request", "client_id", c.actualID, "port_count", len(openPorts))
 		if err := c.sendPortForwardingRequest(); err != nil {
 			logger.Error("Failed to send port forwarding request", "client_id", c.actualID, "err", err)
 			// Continue execution, port forwarding is optional
@@ -139,17 +178,27 @@ func (c *Client) connect() error {
 	return nil
 }
 
+// currentConn returns the gateway connection, nil while disconnected
+func (c *Client) currentConn() transport.Connection {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn
+}
+
 // cleanup cleans up resources after connection loss
 func (c *Client) cleanup() {
 	logger.Debug("Starting cleanup after connection loss", "client_id", c.getClientID())
 
 	// 🆕 Stop transport layer connection first to stop new message processing
-	if c.conn != nil {
+	c.connMu.Lock()
+	conn := c.conn
+	c.conn = nil // Reset connection to prevent double close
+	c.connMu.Unlock()
+	if conn != nil {
 		logger.Debug("Stopping transport connection during cleanup", "client_id", c.getClientID())
-		if err := c.conn.Close(); err != nil {
+		if err := conn.Close(); err != nil {
 			logger.Debug("Error closing client connection during stop (expected)", "err", err)
 		}
-		c.conn = nil // Reset connection to prevent double close
 		logger.Debug("Transport connection stopped", "client_id", c.getClientID())
 	}
 
@@ -162,6 +211,8 @@ func (c *Client) cleanup() {
 		c.connMgr.CloseAllConnections()
 		c.connMgr.CloseAllMessageChannels()
 	}
+	c.pool.untrackAll()
+	c.failPeerConnections()
 
 	// Don't reset msgHandler here to avoid race conditions with ongoing goroutines
 	// msgHandler will be replaced when new connection is established
@@ -180,6 +231,7 @@ func (c *Client) handleConnection(connID string) {
 		logger.Error("Connection not found in connection handler", "client_id", c.getClientID(), "conn_id", connID)
 		return
 	}
+	defer c.egress.Unregister(connID)
 
 	// Use buffered reading for better performance
 	buffer := make([]byte, protocol.DefaultBufferSize)
@@ -203,25 +255,40 @@ func (c *Client) handleConnection(connID string) {
 			logger.Warn("Failed to set read deadline", "client_id", c.getClientID(), "conn_id", connID, "err", err)
 		}
 
+		// A release flagged before the deadline reset would otherwise wait for the read timeout
+		if c.pool.isReleasing(connID) && c.finishRelease(connID, conn) {
+			logger.Debug("Connection handler released target connection to pool", "client_id", c.getClientID(), "conn_id", connID, "total_bytes", totalBytes)
+			return
+		}
+
 		// Read data from local connection
 		n, err := conn.Read(buffer)
 		readCount++
 
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// Gateway closed a reusable connection, hand it back to the pool
+				if c.finishRelease(connID, conn) {
+					logger.Debug("Connection handler released target connection to pool", "client_id", c.getClientID(), "conn_id", connID, "total_bytes", totalBytes)
+					return
+				}
 				// Read timeout, continue
 				continue
 			}
 
 			// Gracefully log connection close
-			if strings.Contains(err.Error(), "use of closed network connection") ||
-				strings.Contains(err.Error(), "connection reset by peer") ||
-				err == io.EOF {
+			if utils.IsClosedConn(err) || errors.Is(err, io.EOF) {
 				logger.Debug("Local connection closed gracefully", "client_id", c.getClientID(), "conn_id", connID, "total_bytes", totalBytes, "read_count", readCount)
 			} else {
 				logger.Error("Error reading from local connection", "client_id", c.getClientID(), "conn_id", connID, "err", err, "total_bytes", totalBytes)
 			}
 
+			// The target finished sending, it may still read what the proxy user sends
+			if err == io.EOF && c.closeGrace > 0 && !c.pool.isReleasing(connID) {
+				c.halfCloseConnection(connID)
+				return
+			}
+
 			// Send close message to gateway
 			if err := c.writeCloseMessage(connID); err != nil {
 				logger.Warn("Failed to send close message to gateway", "client_id", c.getClientID(), "conn_id", connID, "err", err)
@@ -233,6 +300,13 @@ func (c *Client) handleConnection(connID string) {
 		}
 
 		if n > 0 {
+			// Target sent data after the gateway closed the connection, it can't be reused
+			if c.pool.isReleasing(connID) {
+				logger.Debug("Pooled connection received data after close, discarding", "client_id", c.getClientID(), "conn_id", connID, "bytes", n)
+				c.cleanupConnection(connID)
+				return
+			}
+
 			totalBytes += n
 
 			// Sample logs to reduce log volume
@@ -240,6 +314,12 @@ func (c *Client) handleConnection(connID string) {
 				logger.Debug("Read data from local connection", "client_id", c.getClientID(), "conn_id", connID, "bytes", n, "total_bytes", totalBytes)
 			}
 
+			// Wait for this connection's share of the egress bandwidth
+			if err := c.egress.Wait(c.ctx, connID, n); err != nil {
+				logger.Debug("Connection handler stopping while waiting for egress bandwidth", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+				return
+			}
+
 			// Send data to gateway (using binary protocol)
 			if err := c.writeDataMessage(connID, buffer[:n]); err != nil {
 				logger.Error("Failed to send data to gateway", "client_id", c.getClientID(), "conn_id", connID, "bytes", n, "err", err)
@@ -260,8 +340,73 @@ func (c *Client) cleanupConnection(connID string) {
 	// Close connection in monitoring
 	monitoring.CloseConnection(connID)
 
+	// Connection is closed rather than pooled
+	c.pool.untrack(connID)
+	if state, ok := c.halfClosed.LoadAndDelete(connID); ok {
+		state.(*connection.HalfClose).Stop()
+	}
+
 	// Use ConnectionManager to clean up connection
 	c.connMgr.CleanupConnection(connID)
 
 	logger.Debug("Connection cleaned up", "client_id", c.getClientID(), "conn_id", connID)
 }
+
+// handleProbe checks the target socket of a connection the gateway saw idle. A dead socket,
+// or a connection the client no longer knows, is closed on both sides.
+func (c *Client) handleProbe(connID string) {
+	conn, exists := c.connMgr.GetConnection(connID)
+	if exists {
+		err := sockopt.CheckAlive(conn)
+		if err == nil {
+			return
+		}
+		logger.Info("Idle target connection is dead, closing it", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		c.cleanupConnection(connID)
+	} else if _, dialing := c.pendingDials.Load(connID); dialing {
+		return
+	} else {
+		logger.Info("Gateway probed an unknown connection, closing it", "client_id", c.getClientID(), "conn_id", connID)
+	}
+
+	if err := c.writeCloseMessage(connID); err != nil {
+		logger.Warn("Failed to send close message to gateway", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+	}
+}
+
+// halfCloseConnection forwards EOF of the target to the gateway, the proxy user can still send
+// until it closes too or the grace period ends
+func (c *Client) halfCloseConnection(connID string) {
+	// A half-closed target connection is not reused
+	c.pool.untrack(connID)
+	if err := c.writeCloseWriteMessage(connID); err != nil {
+		logger.Warn("Failed to send close_write message to gateway", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		c.cleanupConnection(connID)
+		return
+	}
+
+	logger.Debug("Target finished sending, sent close_write to gateway", "client_id", c.getClientID(), "conn_id", connID)
+	if c.halfCloseState(connID).CloseLocal(c.closeGrace, func() { c.expireHalfClose(connID) }) {
+		c.cleanupConnection(connID)
+	}
+}
+
+// halfCloseState returns the half-close state of a connection
+func (c *Client) halfCloseState(connID string) *connection.HalfClose {
+	state, _ := c.halfClosed.LoadOrStore(connID, &connection.HalfClose{})
+	return state.(*connection.HalfClose)
+}
+
+// expireHalfClose closes a connection that stayed half-closed longer than the grace period
+func (c *Client) expireHalfClose(connID string) {
+	logger.Debug("Half-closed connection exceeded the close grace period", "client_id", c.getClientID(), "conn_id", connID, "grace_period", c.closeGrace)
+	c.closeFully(connID)
+}
+
+// closeFully tells the gateway to close the connection and closes it
+func (c *Client) closeFully(connID string) {
+	if err := c.writeCloseMessage(connID); err != nil {
+		logger.Debug("Failed to send close message to gateway", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+	}
+	c.cleanupConnection(connID)
+}
@@ -128,6 +128,10 @@ func (m *mockConnectionForTest) GetPassword() string {
 	return "test-password"
 }
 
+func (m *mockConnectionForTest) GetClientVersion() string {
+	return ""
+}
+
 // Helper function to simulate sending a message
 func (m *mockConnectionForTest) simulateMessage(msg map[string]interface{}) {
 	m.mu.Lock()
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// diagCommandTimeout bounds reading the command line of a diagnostics connection
+const diagCommandTimeout = 10 * time.Second
+
+// handleDiagServiceConnect attaches a gateway connection to the tunnel diagnostics service
+func (c *Client) handleDiagServiceConnect(connID, network string) {
+	if network != protocol.ProtocolTCP {
+		if err := c.sendConnectResponse(connID, false, "diagnostics service requires tcp", utils.ErrCodeTargetForbidden); err != nil {
+			logger.Error("Failed to send connect response for diagnostics service", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+		return
+	}
+	tunnelSide, serviceSide := net.Pipe()
+	go c.serveDiagnostics(serviceSide)
+	c.attachServiceConn(connID, protocol.DiagServiceAddress, tunnelSide)
+}
+
+// serveDiagnostics runs the command the gateway starts a diagnostics connection with
+func (c *Client) serveDiagnostics(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(diagCommandTimeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	command, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	logger.Debug("Running tunnel diagnostics command", "client_id", c.getClientID(), "command", command, "arg", arg)
+
+	switch command {
+	case protocol.DiagCommandEcho:
+		_, _ = io.Copy(conn, reader)
+	case protocol.DiagCommandDiscard:
+		n, err := diagBytes(arg)
+		if err != nil {
+			return
+		}
+		read, _ := io.CopyN(io.Discard, reader, n)
+		fmt.Fprintf(conn, "%d\n", read)
+	case protocol.DiagCommandSource:
+		n, err := diagBytes(arg)
+		if err != nil {
+			return
+		}
+		_, _ = io.CopyN(conn, zeroReader{}, n)
+	case protocol.DiagCommandMTU:
+		result := protocol.DiagMTUResult{Target: gatewayHost(c.config.Gateway.Addr)}
+		if mtu, err := pathMTU(result.Target); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.PathMTU = mtu
+		}
+		data, _ := json.Marshal(result)
+		_, _ = conn.Write(append(data, '\n'))
+	default:
+		logger.Warn("Unknown tunnel diagnostics command", "client_id", c.getClientID(), "command", command)
+	}
+}
+
+// diagBytes parses the byte count of a discard or source command
+func diagBytes(arg string) (int64, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 || n > protocol.MaxDiagBytes {
+		return 0, fmt.Errorf("invalid byte count: %q", arg)
+	}
+	return n, nil
+}
+
+// gatewayHost returns the host of a gateway address, which may be a URL
+func gatewayHost(addr string) string {
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil {
+			return u.Hostname()
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Path MTU probing
+const (
+	pmtuProbeRounds = 8
+	pmtuProbeWait   = 300 * time.Millisecond // Time for "fragmentation needed" replies to arrive
+	pmtuProbePort   = "9"                    // Discard, probes need no listener
+)
+
+// pathMTU discovers the path MTU toward host like tracepath: UDP datagrams of the current path
+// MTU are sent with fragmentation prohibited, routers on a narrower path answer with the MTU the
+// kernel then lowers the path MTU to
+func pathMTU(host string) (int, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, pmtuProbePort))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open probe socket: %w", err)
+	}
+	defer conn.Close()
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	// Option names by address family, headers is the size of the IP and UDP headers
+	level, discover, prohibit, option, headers := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO, syscall.IP_MTU, 28
+	if conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		level, discover, prohibit, option, headers = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO, syscall.IPV6_MTU, 48
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, discover, prohibit)
+	}); err != nil || sockErr != nil {
+		return 0, fmt.Errorf("failed to prohibit fragmentation: %v", errors.Join(err, sockErr))
+	}
+	readMTU := func() (int, error) {
+		var mtu int
+		if err := raw.Control(func(fd uintptr) {
+			mtu, sockErr = syscall.GetsockoptInt(int(fd), level, option)
+		}); err != nil {
+			return 0, err
+		}
+		return mtu, sockErr
+	}
+
+	mtu, err := readMTU()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read path MTU: %w", err)
+	}
+	for round := 0; round < pmtuProbeRounds; round++ {
+		if _, err := conn.Write(make([]byte, mtu-headers)); err != nil && !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ECONNREFUSED) {
+			return 0, fmt.Errorf("failed to send probe: %w", err)
+		}
+		time.Sleep(pmtuProbeWait)
+		lowered, err := readMTU()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read path MTU: %w", err)
+		}
+		if lowered >= mtu {
+			return mtu, nil
+		}
+		mtu = lowered
+	}
+	return mtu, nil
+}
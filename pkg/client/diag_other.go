@@ -0,0 +1,10 @@
+//go:build !linux
+
+package client
+
+import "fmt"
+
+// pathMTU is not implemented on this platform
+func pathMTU(string) (int, error) {
+	return 0, fmt.Errorf("path MTU discovery is not supported on this platform")
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestServeDiagnostics(t *testing.T) {
+	c := &Client{config: &config.ClientConfig{Gateway: config.ClientGatewayConfig{Addr: "127.0.0.1:8443"}}}
+	open := func(command string) (net.Conn, *bufio.Reader) {
+		gatewaySide, serviceSide := net.Pipe()
+		go c.serveDiagnostics(serviceSide)
+		t.Cleanup(func() { gatewaySide.Close() })
+		if _, err := io.WriteString(gatewaySide, command+"\n"); err != nil {
+			t.Fatalf("Write(%s) error = %v", command, err)
+		}
+		return gatewaySide, bufio.NewReader(gatewaySide)
+	}
+
+	conn, r := open(protocol.DiagCommandEcho)
+	if _, err := conn.Write([]byte("ping-1")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 6)
+	if _, err := io.ReadFull(r, echo); err != nil || string(echo) != "ping-1" {
+		t.Errorf("Echo = %q, %v", echo, err)
+	}
+
+	conn, r = open(protocol.DiagCommandDiscard + " 100000")
+	go func() { _, _ = io.CopyN(conn, zeroReader{}, 100000) }()
+	if line, err := r.ReadString('\n'); err != nil || line != "100000\n" {
+		t.Errorf("Discard answer = %q, %v", line, err)
+	}
+
+	_, r = open(protocol.DiagCommandSource + " 70000")
+	if n, err := io.Copy(io.Discard, r); err != nil || n != 70000 {
+		t.Errorf("Source sent %d bytes, %v, want 70000", n, err)
+	}
+
+	_, r = open(protocol.DiagCommandSource + " 999999999999")
+	if n, _ := io.Copy(io.Discard, r); n != 0 {
+		t.Errorf("Source beyond the limit sent %d bytes", n)
+	}
+
+	_, r = open(protocol.DiagCommandMTU)
+	var mtu protocol.DiagMTUResult
+	line, err := r.ReadBytes('\n')
+	if err != nil || json.Unmarshal(line, &mtu) != nil || mtu.Target != "127.0.0.1" || (mtu.PathMTU == 0 && mtu.Error == "") {
+		t.Errorf("MTU answer = %s, %v", strings.TrimSpace(string(line)), err)
+	}
+}
+
+func TestGatewayHost(t *testing.T) {
+	tests := map[string]string{
+		"gateway.example.com:8443":          "gateway.example.com",
+		"wss://gateway.example.com:443/tun": "gateway.example.com",
+		"[2001:db8::1]:8443":                "2001:db8::1",
+		"gateway.example.com":               "gateway.example.com",
+	}
+	for addr, want := range tests {
+		if got := gatewayHost(addr); got != want {
+			t.Errorf("gatewayHost(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
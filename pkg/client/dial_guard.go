@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// nonPublicPrefixes are the non-public ranges not covered by the netip.Addr predicates
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "This" network
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // Reserved, including broadcast
+}
+
+// dialGuard rejects target addresses that are not public, see config.DialGuardConfig
+type dialGuard struct {
+	allowed []netip.Prefix
+}
+
+// newDialGuard creates the dial guard, returns nil when it is disabled
+func newDialGuard(cfg config.DialGuardConfig) (*dialGuard, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	g := &dialGuard{}
+	for _, cidr := range cfg.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dial_guard.allowed_cidrs entry %q: %w", cidr, err)
+		}
+		g.allowed = append(g.allowed, prefix.Masked())
+	}
+	return g, nil
+}
+
+// permits reports whether addr is public or in an allowed range
+func (g *dialGuard) permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range g.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return isPublicAddr(addr)
+}
+
+// isPublicAddr reports whether addr is a globally routable unicast address
+func isPublicAddr(addr netip.Addr) bool {
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// guardAddrs drops the resolved addresses of a target that the dial guard or the CIDR
+// patterns of forbidden_hosts and the policy packs forbid. CIDR patterns of allowed_hosts
+// exempt non-public addresses from the guard.
+func (c *Client) guardAddrs(address string, addrs []netip.Addr, port string) []netip.Addr {
+	c.policyMu.RLock()
+	forbidden, allowed := c.forbiddenHostPatterns, c.allowedHostPatterns
+	for _, pack := range c.policyPacks {
+		forbidden = append(forbidden[:len(forbidden):len(forbidden)], pack.forbidden...)
+	}
+	c.policyMu.RUnlock()
+
+	permitted := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		target := net.JoinHostPort(addr.String(), port)
+		if pattern := matchingCIDRPattern(forbidden, target); pattern != nil {
+			logger.Warn("Dial guard dropped target address - forbidden host", "client_id", c.getClientID(), "address", address, "target_ip", addr, "pattern", pattern.Original)
+			continue
+		}
+		if !c.guard.permits(addr) && matchingCIDRPattern(allowed, target) == nil {
+			logger.Warn("Dial guard dropped target address - not public", "client_id", c.getClientID(), "address", address, "target_ip", addr)
+			continue
+		}
+		permitted = append(permitted, addr)
+	}
+	return permitted
+}
+
+// matchingCIDRPattern returns the first CIDR pattern matching the ip:port target, nil when none does
+func matchingCIDRPattern(patterns []*HostPattern, target string) *HostPattern {
+	for _, pattern := range patterns {
+		if pattern.Type == "cidr" && matchesCIDRPattern(pattern, target) {
+			return pattern
+		}
+	}
+	return nil
+}
+
+// dialAddrs dials the addresses in order until one connects, returning the last error otherwise
+func dialAddrs(ctx context.Context, network string, addrs []netip.Addr, port string, opts *config.SocketOptions) (net.Conn, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := sockopt.DialContext(ctx, network, net.JoinHostPort(addr.String(), port), opts)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestDialGuard_Permits(t *testing.T) {
+	guard, err := newDialGuard(config.DialGuardConfig{Enabled: true, AllowedCIDRs: []string{"192.168.10.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.20.0.1", false},
+		{"192.168.1.1", false},
+		{"192.168.10.5", true}, // Allowed range
+		{"::ffff:192.168.10.5", true},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		if got := guard.permits(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("permits(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestClient_DialTargetGuard(t *testing.T) {
+	addr, accepted := startPoolTestServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+
+	guard, err := newDialGuard(config.DialGuardConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{config: &config.ClientConfig{ClientID: "test-client"}, guard: guard}
+
+	// A host name resolving to loopback is rejected like the literal address
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		_, err := c.dialTarget(context.Background(), "tcp4", net.JoinHostPort(host, port))
+		if err == nil || utils.ErrorCodeOf(err) != utils.ErrCodeTargetForbidden {
+			t.Errorf("Expected %s to be forbidden, got %v", host, err)
+		}
+	}
+
+	// CIDR patterns of allowed_hosts exempt addresses, forbidden_hosts CIDRs apply to resolved names
+	c.config.AllowedHosts = []string{"127.0.0.0/8"}
+	if err := c.compileHostPatterns(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.dialTarget(context.Background(), "tcp4", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("Expected an allowed range to be dialed, got %v", err)
+	}
+	_ = conn.Close()
+	serverConn := <-accepted
+	_ = serverConn.Close()
+
+	c.config.ForbiddenHosts = []string{"127.0.0.1/32:" + port}
+	if err := c.compileHostPatterns(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.dialTarget(context.Background(), "tcp4", net.JoinHostPort("localhost", port)); err == nil {
+		t.Error("Expected forbidden_hosts CIDRs to apply to the resolved address")
+	}
+}
@@ -0,0 +1,351 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+const (
+	defaultDiscoveryInterval = 10 * time.Second
+	defaultDockerSocket      = "/var/run/docker.sock"
+	dockerRequestTimeout     = 10 * time.Second
+)
+
+// Container labels read by Docker discovery
+const (
+	dockerLabelExpose     = "anyproxy.expose"      // "true" opens a gateway port for the container
+	dockerLabelPort       = "anyproxy.port"        // Container port, default its only exposed port
+	dockerLabelRemotePort = "anyproxy.remote_port" // Gateway port, default the port published on the host
+	dockerLabelProtocol   = "anyproxy.protocol"    // "tcp" (default) or "udp"
+)
+
+// dockerContainer is the part of a Docker API container listing used by discovery
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	Ports           []dockerPort      `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerPort is a port of a container, PublicPort is set when it is published on the host
+type dockerPort struct {
+	IP          string `json:"IP"`
+	PrivatePort int    `json:"PrivatePort"`
+	PublicPort  int    `json:"PublicPort"`
+	Type        string `json:"Type"`
+}
+
+// ServiceDiscovery opens gateway ports for local services found while the client runs, shared
+// by all replicas. Sources are checked periodically and the gateway is only updated on changes.
+type ServiceDiscovery struct {
+	cfg     config.DiscoveryConfig
+	clients []*Client
+	docker  *http.Client // Talks to the Docker daemon socket (nil when Docker discovery is disabled)
+	current []config.OpenPort
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewServiceDiscovery creates the discovery, returns nil when no source is configured
+func NewServiceDiscovery(cfg config.DiscoveryConfig, clients []*Client) *ServiceDiscovery {
+	if !cfg.Docker.Enabled && cfg.ServicesFile == "" {
+		return nil
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultDiscoveryInterval
+	}
+	d := &ServiceDiscovery{cfg: cfg, clients: clients, stopCh: make(chan struct{})}
+	if cfg.Docker.Enabled {
+		socket := cfg.Docker.Socket
+		if socket == "" {
+			socket = defaultDockerSocket
+		}
+		d.docker = &http.Client{
+			Timeout: dockerRequestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+	}
+	return d
+}
+
+// Start checks the sources right away and then periodically in the background
+func (d *ServiceDiscovery) Start() {
+	if d == nil {
+		return
+	}
+	logger.Info("Starting service discovery", "docker", d.cfg.Docker.Enabled, "services_file", d.cfg.ServicesFile, "interval", d.cfg.Interval)
+	d.wg.Add(1)
+	go d.run()
+}
+
+// Stop stops checking the sources, the opened ports stay until the client disconnects
+func (d *ServiceDiscovery) Stop() {
+	if d == nil {
+		return
+	}
+	close(d.stopCh)
+	d.wg.Wait()
+}
+
+// run refreshes the discovered ports until stopped
+func (d *ServiceDiscovery) run() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		d.refresh()
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh checks all sources and hands changed ports to the clients. A failing source keeps
+// the current ports, so a restarting Docker daemon doesn't close the forwards.
+func (d *ServiceDiscovery) refresh() {
+	ports, err := d.discover()
+	if err != nil {
+		logger.Warn("Service discovery failed, keeping the current ports", "err", err)
+		return
+	}
+	if sameOpenPorts(d.current, ports) {
+		return
+	}
+	added, removed := diffSetBy(d.current, ports, formatOpenPort)
+	logger.Info("Discovered services changed", "ports_added", formatOpenPorts(added), "ports_removed", formatOpenPorts(removed))
+	d.current = ports
+	for _, c := range d.clients {
+		c.setDiscoveredPorts(ports)
+	}
+}
+
+// discover returns the ports of all sources, sorted by remote port
+func (d *ServiceDiscovery) discover() ([]config.OpenPort, error) {
+	var ports []config.OpenPort
+	if d.cfg.ServicesFile != "" {
+		filePorts, err := loadServicesFile(d.cfg.ServicesFile)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, filePorts...)
+	}
+	if d.docker != nil {
+		dockerPorts, err := d.dockerPorts()
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, dockerPorts...)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].RemotePort != ports[j].RemotePort {
+			return ports[i].RemotePort < ports[j].RemotePort
+		}
+		return ports[i].Protocol < ports[j].Protocol
+	})
+	return ports, nil
+}
+
+// dockerPorts lists the running containers labeled for exposure and returns their ports
+func (d *ServiceDiscovery) dockerPorts() ([]config.OpenPort, error) {
+	filters, _ := json.Marshal(map[string][]string{"label": {dockerLabelExpose + "=true"}})
+	resp, err := d.docker.Get("http://docker/containers/json?filters=" + url.QueryEscape(string(filters)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list docker containers: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list docker containers: status %d", resp.StatusCode)
+	}
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to decode docker containers: %w", err)
+	}
+	ports := make([]config.OpenPort, 0, len(containers))
+	for _, container := range containers {
+		port, err := containerOpenPort(container)
+		if err != nil {
+			logger.Warn("Skipping labeled container", "container", containerName(container), "err", err)
+			continue
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// containerOpenPort maps a labeled container to the port opened for it. Ports published on the
+// host are forwarded to the host, others to the container's address.
+func containerOpenPort(container dockerContainer) (config.OpenPort, error) {
+	proto := container.Labels[dockerLabelProtocol]
+	if proto == "" {
+		proto = protocol.ProtocolTCP
+	}
+	if proto != protocol.ProtocolTCP && proto != protocol.ProtocolUDP {
+		return config.OpenPort{}, fmt.Errorf("invalid %s label: %s", dockerLabelProtocol, proto)
+	}
+
+	privatePort := 0
+	if label := container.Labels[dockerLabelPort]; label != "" {
+		port, err := strconv.Atoi(label)
+		if err != nil || port < 1 || port > 65535 {
+			return config.OpenPort{}, fmt.Errorf("invalid %s label: %s", dockerLabelPort, label)
+		}
+		privatePort = port
+	} else {
+		for _, p := range container.Ports {
+			if p.Type != proto || p.PrivatePort == privatePort {
+				continue
+			}
+			if privatePort != 0 {
+				return config.OpenPort{}, fmt.Errorf("container exposes several ports, set the %s label", dockerLabelPort)
+			}
+			privatePort = p.PrivatePort
+		}
+		if privatePort == 0 {
+			return config.OpenPort{}, fmt.Errorf("container exposes no %s port, set the %s label", proto, dockerLabelPort)
+		}
+	}
+
+	open := config.OpenPort{Protocol: proto}
+	published := false
+	for _, p := range container.Ports {
+		if p.Type == proto && p.PrivatePort == privatePort && p.PublicPort > 0 {
+			open.LocalHost, open.LocalPort, published = "127.0.0.1", p.PublicPort, true
+			if ip := net.ParseIP(p.IP); ip != nil && !ip.IsUnspecified() {
+				open.LocalHost = p.IP
+			}
+			break
+		}
+	}
+	if !published {
+		networks := make([]string, 0, len(container.NetworkSettings.Networks))
+		for name, network := range container.NetworkSettings.Networks {
+			if network.IPAddress != "" {
+				networks = append(networks, name)
+			}
+		}
+		if len(networks) == 0 {
+			return config.OpenPort{}, fmt.Errorf("port %d is not published and the container has no address", privatePort)
+		}
+		sort.Strings(networks)
+		open.LocalHost, open.LocalPort = container.NetworkSettings.Networks[networks[0]].IPAddress, privatePort
+	}
+
+	if label := container.Labels[dockerLabelRemotePort]; label != "" {
+		port, err := strconv.Atoi(label)
+		if err != nil || port < 1 || port > 65535 {
+			return config.OpenPort{}, fmt.Errorf("invalid %s label: %s", dockerLabelRemotePort, label)
+		}
+		open.RemotePort = port
+	} else if published {
+		open.RemotePort = open.LocalPort
+	} else {
+		return config.OpenPort{}, fmt.Errorf("port %d is not published, set the %s label", privatePort, dockerLabelRemotePort)
+	}
+	return open, nil
+}
+
+// containerName returns the name of a container for logs
+func containerName(container dockerContainer) string {
+	if len(container.Names) > 0 {
+		return strings.TrimPrefix(container.Names[0], "/")
+	}
+	if len(container.ID) > 12 {
+		return container.ID[:12]
+	}
+	return container.ID
+}
+
+// loadServicesFile reads a YAML list of open_ports entries
+func loadServicesFile(path string) ([]config.OpenPort, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read services file: %w", err)
+	}
+	var ports []config.OpenPort
+	if err := yaml.Unmarshal(data, &ports); err != nil {
+		return nil, fmt.Errorf("failed to parse services file %s: %w", path, err)
+	}
+	for i := range ports {
+		port := &ports[i]
+		if port.Protocol == "" {
+			port.Protocol = protocol.ProtocolTCP
+		}
+		if port.LocalHost == "" {
+			port.LocalHost = "127.0.0.1"
+		}
+		if port.RemotePort < 1 || port.RemotePort > 65535 || port.LocalPort < 1 || port.LocalPort > 65535 {
+			return nil, fmt.Errorf("services file %s: entry %d has an invalid port", path, i)
+		}
+		if port.Protocol != protocol.ProtocolTCP && port.Protocol != protocol.ProtocolUDP {
+			return nil, fmt.Errorf("services file %s: entry %d has an invalid protocol: %s", path, i, port.Protocol)
+		}
+		if err := config.ValidatePortSources(*port); err != nil {
+			return nil, fmt.Errorf("services file %s: entry %d: %w", path, i, err)
+		}
+	}
+	return ports, nil
+}
+
+// sameOpenPorts reports whether two sorted port lists are equal
+func sameOpenPorts(a, b []config.OpenPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameOpenPort(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameOpenPort reports whether two open ports are equal
+func sameOpenPort(a, b config.OpenPort) bool {
+	return a.RemotePort == b.RemotePort && a.LocalPort == b.LocalPort && a.LocalHost == b.LocalHost &&
+		a.Protocol == b.Protocol && slices.Equal(a.AllowedSources, b.AllowedSources)
+}
+
+// setDiscoveredPorts replaces the ports of discovered services and asks the gateway for the new port set
+func (c *Client) setDiscoveredPorts(ports []config.OpenPort) {
+	c.policyMu.Lock()
+	c.discoveredPorts = ports
+	c.policyMu.Unlock()
+
+	// A disconnected client sends its ports when it reconnects
+	if c.currentConn() == nil {
+		return
+	}
+	if err := c.writePortForwardRequest(c.currentOpenPorts()); err != nil {
+		logger.Error("Failed to send updated port forwarding request", "client_id", c.getClientID(), "err", err)
+	}
+}
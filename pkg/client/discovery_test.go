@@ -0,0 +1,143 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestContainerOpenPort(t *testing.T) {
+	container := func(labels map[string]string, ports ...dockerPort) dockerContainer {
+		c := dockerContainer{Names: []string{"/web"}, Labels: labels, Ports: ports}
+		c.NetworkSettings.Networks = map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		}{"bridge": {IPAddress: "172.17.0.2"}}
+		return c
+	}
+
+	tests := []struct {
+		name      string
+		container dockerContainer
+		want      config.OpenPort
+		wantErr   bool
+	}{
+		{
+			name:      "published port",
+			container: container(nil, dockerPort{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}, dockerPort{IP: "::", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}),
+			want:      config.OpenPort{RemotePort: 8080, LocalHost: "127.0.0.1", LocalPort: 8080, Protocol: "tcp"},
+		},
+		{
+			name:      "unpublished port with remote port label",
+			container: container(map[string]string{dockerLabelRemotePort: "9000"}, dockerPort{PrivatePort: 80, Type: "tcp"}),
+			want:      config.OpenPort{RemotePort: 9000, LocalHost: "172.17.0.2", LocalPort: 80, Protocol: "tcp"},
+		},
+		{
+			name:      "port label picks one of several",
+			container: container(map[string]string{dockerLabelPort: "443", dockerLabelRemotePort: "9443"}, dockerPort{PrivatePort: 80, Type: "tcp"}, dockerPort{PrivatePort: 443, Type: "tcp"}),
+			want:      config.OpenPort{RemotePort: 9443, LocalHost: "172.17.0.2", LocalPort: 443, Protocol: "tcp"},
+		},
+		{
+			name:      "udp",
+			container: container(map[string]string{dockerLabelProtocol: "udp"}, dockerPort{PrivatePort: 53, Type: "tcp"}, dockerPort{IP: "127.0.0.2", PrivatePort: 53, PublicPort: 5353, Type: "udp"}),
+			want:      config.OpenPort{RemotePort: 5353, LocalHost: "127.0.0.2", LocalPort: 5353, Protocol: "udp"},
+		},
+		{
+			name:      "several ports without label",
+			container: container(nil, dockerPort{PrivatePort: 80, Type: "tcp"}, dockerPort{PrivatePort: 443, Type: "tcp"}),
+			wantErr:   true,
+		},
+		{
+			name:      "unpublished port without remote port",
+			container: container(nil, dockerPort{PrivatePort: 80, Type: "tcp"}),
+			wantErr:   true,
+		},
+		{
+			name:      "invalid protocol",
+			container: container(map[string]string{dockerLabelProtocol: "sctp"}, dockerPort{PrivatePort: 80, Type: "tcp"}),
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := containerOpenPort(tt.container)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("containerOpenPort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !sameOpenPort(got, tt.want) {
+				t.Errorf("containerOpenPort() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets not available: %v", err)
+	}
+
+	var mu sync.Mutex
+	containers := []dockerContainer{{Names: []string{"/web"}, Ports: []dockerPort{{PrivatePort: 80, PublicPort: 8080, Type: "tcp"}}}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" || r.URL.Query().Get("filters") != `{"label":["anyproxy.expose=true"]}` {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_ = json.NewEncoder(w).Encode(containers)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	servicesFile := filepath.Join(dir, "services.yaml")
+	if err := os.WriteFile(servicesFile, []byte("- remote_port: 2222\n  local_port: 22\n- remote_port: 9000\n  local_port: 9001\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// open_ports win over discovered services on the same gateway port
+	c := &Client{actualID: "client-0", openPorts: []config.OpenPort{{RemotePort: 9000, LocalHost: "localhost", LocalPort: 9000, Protocol: "tcp"}}}
+	d := NewServiceDiscovery(config.DiscoveryConfig{Docker: config.DockerDiscoveryConfig{Enabled: true, Socket: socket}, ServicesFile: servicesFile}, []*Client{c})
+
+	d.refresh()
+	want := []config.OpenPort{
+		{RemotePort: 9000, LocalHost: "localhost", LocalPort: 9000, Protocol: "tcp"},
+		{RemotePort: 2222, LocalHost: "127.0.0.1", LocalPort: 22, Protocol: "tcp"},
+		{RemotePort: 8080, LocalHost: "127.0.0.1", LocalPort: 8080, Protocol: "tcp"},
+	}
+	if got := c.currentOpenPorts(); !sameOpenPorts(got, want) {
+		t.Fatalf("currentOpenPorts() = %+v, want %+v", got, want)
+	}
+
+	// A stopped container closes its port
+	mu.Lock()
+	containers = nil
+	mu.Unlock()
+	d.refresh()
+	if got := c.currentOpenPorts(); !sameOpenPorts(got, want[:2]) {
+		t.Fatalf("currentOpenPorts() = %+v, want %+v", got, want[:2])
+	}
+
+	// A failing source keeps the current ports
+	if err := os.WriteFile(servicesFile, []byte("- remote_port: 0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d.refresh()
+	if got := c.currentOpenPorts(); !sameOpenPorts(got, want[:2]) {
+		t.Errorf("Expected the ports to be kept, got %+v", got)
+	}
+
+	if NewServiceDiscovery(config.DiscoveryConfig{}, nil) != nil {
+		t.Error("Expected no discovery without sources")
+	}
+}
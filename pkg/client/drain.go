@@ -0,0 +1,53 @@
+package client
+
+import (
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// drainPollInterval is how often drain checks whether the in-flight connections finished
+const drainPollInterval = 100 * time.Millisecond
+
+// drainTimeout resolves the configured drain timeout, zero means the default and
+// negative values disable draining
+func drainTimeout(configured time.Duration) time.Duration {
+	switch {
+	case configured == 0:
+		return protocol.DefaultDrainTimeout
+	case configured < 0:
+		return 0
+	}
+	return configured
+}
+
+// drain tells the gateway the client is stopping, so it gets no new connections, and waits
+// up to the drain timeout for the in-flight ones to finish. Gateways predating draining
+// drop the tunnel on the unknown message, which closes the connections as before.
+func (c *Client) drain() {
+	if c.drainTimeout <= 0 || c.currentConn() == nil || c.connMgr.GetConnectionCount() == 0 {
+		return
+	}
+	if err := c.msgHandler.WriteDrainingMessage(c.drainTimeout); err != nil {
+		logger.Warn("Failed to announce draining to gateway", "client_id", c.getClientID(), "err", err)
+		return
+	}
+	logger.Info("Draining client connections", "client_id", c.getClientID(), "connection_count", c.connMgr.GetConnectionCount(), "timeout", c.drainTimeout)
+
+	deadline := time.NewTimer(c.drainTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for c.connMgr.GetConnectionCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			logger.Warn("Drain timeout reached, closing remaining connections", "client_id", c.getClientID(), "connection_count", c.connMgr.GetConnectionCount())
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+	logger.Info("All client connections drained", "client_id", c.getClientID())
+}
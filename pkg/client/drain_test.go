@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	"github.com/buhuipao/anyproxy/pkg/common/message"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestClient_Drain(t *testing.T) {
+	transportConn := &recordingConnection{messages: make(chan []byte, 16)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &Client{
+		config:       &config.ClientConfig{ClientID: "test-client"},
+		ctx:          ctx,
+		cancel:       cancel,
+		conn:         transportConn,
+		connMgr:      connection.NewManager("test-client"),
+		msgHandler:   message.NewClientExtendedMessageHandler(transportConn),
+		drainTimeout: 5 * time.Second,
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client.connMgr.AddConnection("conn-1", local)
+
+	// The in-flight connection finishes after the gateway was told
+	go func() {
+		<-transportConn.messages
+		time.Sleep(200 * time.Millisecond)
+		client.connMgr.RemoveConnection("conn-1")
+	}()
+
+	start := time.Now()
+	client.drain()
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected drain to wait for the in-flight connection, took %v", elapsed)
+	}
+
+	// Nothing to drain without connections
+	client.drain()
+	select {
+	case data := <-transportConn.messages:
+		t.Errorf("Unexpected message without connections: %x", data)
+	default:
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	if got := drainTimeout(0); got != protocol.DefaultDrainTimeout {
+		t.Errorf("Expected the default drain timeout, got %v", got)
+	}
+	if got := drainTimeout(-1); got != 0 {
+		t.Errorf("Expected draining disabled, got %v", got)
+	}
+	if got := drainTimeout(time.Minute); got != time.Minute {
+		t.Errorf("Expected the configured drain timeout, got %v", got)
+	}
+}
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Remote exec defaults
+const (
+	defaultExecTimeout         = 60 * time.Second
+	defaultExecMaxOutput int64 = 1 << 20
+	// shellKillGrace bounds how long a process may outlive its input or output
+	shellKillGrace = 5 * time.Second
+)
+
+// ExecCommands is the response of the remote exec command listing
+type ExecCommands struct {
+	Commands []string `json:"commands"`
+	Shell    bool     `json:"shell"`
+}
+
+// execService runs whitelisted commands and interactive shells on connections the gateway
+// opens to protocol.ExecServiceAddress
+type execService struct {
+	clientID  string
+	token     string
+	commands  map[string][]string
+	shell     string
+	timeout   time.Duration
+	maxOutput int64
+}
+
+// newExecService creates the remote exec service, returns nil when it is disabled
+func newExecService(clientID string, cfg config.RemoteExecConfig) (*execService, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	commands := make(map[string][]string, len(cfg.Commands))
+	for _, cmd := range cfg.Commands {
+		path, err := exec.LookPath(cmd.Command[0])
+		if err != nil {
+			// The binary may be installed later, keep the command and fail when it runs
+			logger.Warn("Remote exec command not found", "client_id", clientID, "command", cmd.Name, "program", cmd.Command[0], "err", err)
+			path = cmd.Command[0]
+		}
+		commands[cmd.Name] = append([]string{path}, cmd.Command[1:]...)
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	maxOutput := cfg.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = defaultExecMaxOutput
+	}
+
+	logger.Info("Remote exec service enabled", "client_id", clientID, "commands", len(commands), "shell", cfg.Shell != "", "timeout", timeout)
+	return &execService{
+		clientID:  clientID,
+		token:     cfg.Token,
+		commands:  commands,
+		shell:     cfg.Shell,
+		timeout:   timeout,
+		maxOutput: maxOutput,
+	}, nil
+}
+
+// open returns the tunnel side of a new in-memory connection served by the exec service
+func (s *execService) open() net.Conn {
+	return serveInProcess(s)
+}
+
+// ServeHTTP implements the remote exec API:
+// GET /exec/commands lists the commands, POST /exec/run?name=X runs one and
+// GET /exec/shell upgrades the connection to an interactive shell
+func (s *execService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		logger.Warn("Rejected unauthenticated remote exec request", "client_id", s.clientID, "path", r.URL.Path)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/exec/commands" && r.Method == http.MethodGet:
+		s.handleCommands(w)
+	case r.URL.Path == "/exec/run" && r.Method == http.MethodPost:
+		s.handleRun(w, r)
+	case r.URL.Path == "/exec/shell" && r.Method == http.MethodGet:
+		s.handleShell(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleCommands returns the whitelisted command names
+func (s *execService) handleCommands(w http.ResponseWriter) {
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ExecCommands{Commands: names, Shell: s.shell != ""})
+}
+
+// handleRun runs a whitelisted command and streams its combined output.
+// The exit code is sent in the X-Exit-Code trailer, -1 when the command could not run or timed out.
+func (s *execService) handleRun(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	argv, ok := s.commands[name]
+	if !ok {
+		logger.Warn("Rejected remote exec of unknown command", "client_id", s.clientID, "command", name)
+		http.Error(w, "Command not allowed", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+	defer cancel()
+
+	output := &execOutput{w: w, limit: s.maxOutput}
+	if flusher, ok := w.(http.Flusher); ok {
+		output.flush = flusher.Flush
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...) // nolint:gosec // argv comes from the remote_exec whitelist
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = shellKillGrace
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", protocol.ExecExitCodeTrailer+", "+protocol.ExecTruncatedTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	start := time.Now()
+	logger.Info("Remote command started", "client_id", s.clientID, "command", name, "argv", argv)
+	err := cmd.Run()
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr) && ctx.Err() == nil:
+		exitCode = exitErr.ExitCode()
+	case err != nil:
+		exitCode = -1
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = errors.New("command timed out")
+		}
+		_, _ = io.WriteString(output, "\n"+err.Error()+"\n")
+	}
+	w.Header().Set(protocol.ExecExitCodeTrailer, strconv.Itoa(exitCode))
+	w.Header().Set(protocol.ExecTruncatedTrailer, strconv.FormatBool(output.truncated))
+
+	logger.Info("Remote command finished", "client_id", s.clientID, "command", name, "exit_code", exitCode, "output_bytes", output.written, "truncated", output.truncated, "duration", time.Since(start), "err", err)
+}
+
+// execOutput streams command output to the response up to a byte limit
+type execOutput struct {
+	mu        sync.Mutex
+	w         io.Writer
+	flush     func()
+	limit     int64
+	written   int64
+	truncated bool
+}
+
+// Write forwards output until the limit, later output is discarded so the command is not blocked
+func (o *execOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n := len(p)
+	if remaining := o.limit - o.written; int64(len(p)) > remaining {
+		p = p[:remaining]
+		o.truncated = true
+	}
+	if len(p) > 0 {
+		written, err := o.w.Write(p)
+		o.written += int64(written)
+		if err != nil {
+			return written, err
+		}
+		if o.flush != nil {
+			o.flush()
+		}
+	}
+	return n, nil
+}
+
+// handleShell upgrades the connection and attaches it to an interactive shell.
+// There is no pseudo terminal, the shell is started with -i to get prompts.
+func (s *execService) handleShell(w http.ResponseWriter, r *http.Request) {
+	if s.shell == "" {
+		http.Error(w, "Interactive shells are disabled on this client", http.StatusForbidden)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), protocol.ExecShellUpgrade) {
+		http.Error(w, "Upgrade to "+protocol.ExecShellUpgrade+" required", http.StatusUpgradeRequired)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Error("Failed to hijack remote shell connection", "client_id", s.clientID, "err", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+protocol.ExecShellUpgrade+"\r\n\r\n"); err != nil {
+		return
+	}
+	s.runShell(conn, rw.Reader)
+}
+
+// runShell runs the shell with the connection as its terminal until it exits.
+// When the input is closed the shell gets shellKillGrace to exit before it is killed.
+func (s *execService) runShell(conn net.Conn, input *bufio.Reader) {
+	cmd := exec.Command(s.shell, "-i") // nolint:gosec // the shell binary comes from configuration
+	cmd.Stdout = conn
+	cmd.Stderr = conn
+	cmd.WaitDelay = shellKillGrace
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		logger.Error("Failed to create remote shell input", "client_id", s.clientID, "err", err)
+		return
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		logger.Error("Failed to start remote shell", "client_id", s.clientID, "shell", s.shell, "err", err)
+		_, _ = io.WriteString(conn, "failed to start shell: "+err.Error()+"\n")
+		return
+	}
+	logger.Info("Remote shell started", "client_id", s.clientID, "shell", s.shell, "pid", cmd.Process.Pid)
+
+	// The input is copied here rather than by exec so Wait never blocks on a connection read,
+	// the copy ends when the connection is closed after the shell exited
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(stdin, input)
+		_ = stdin.Close()
+		select {
+		case <-done:
+		case <-time.After(shellKillGrace):
+			logger.Warn("Killing remote shell after its input was closed", "client_id", s.clientID, "pid", cmd.Process.Pid)
+			_ = cmd.Process.Kill()
+		}
+	}()
+
+	err = cmd.Wait()
+	close(done)
+	logger.Info("Remote shell exited", "client_id", s.clientID, "pid", cmd.Process.Pid, "duration", time.Since(start), "err", err)
+}
+
+// handleExecServiceConnect attaches a gateway connection to the remote exec service
+func (c *Client) handleExecServiceConnect(connID, network string) {
+	if c.exec == nil || network != protocol.ProtocolTCP {
+		logger.Warn("Remote exec service requested but not enabled", "client_id", c.getClientID(), "conn_id", connID, "network", network)
+		if err := c.sendConnectResponse(connID, false, "remote exec service is disabled on this client", utils.ErrCodeTargetForbidden); err != nil {
+			logger.Error("Failed to send connect response for remote exec service", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+		return
+	}
+
+	logger.Info("Remote exec session opened", "client_id", c.getClientID(), "conn_id", connID)
+	c.attachServiceConn(connID, protocol.ExecServiceAddress, c.exec.open())
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// newExecTestService creates an exec service with a few shell-based commands
+func newExecTestService(t *testing.T) *execService {
+	t.Helper()
+
+	svc, err := newExecService("test-client", config.RemoteExecConfig{
+		Enabled: true,
+		Token:   "exec-token",
+		Commands: []config.ExecCommand{
+			{Name: "fail", Command: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}},
+			{Name: "slow", Command: []string{"sleep", "5"}},
+			{Name: "noisy", Command: []string{"sh", "-c", "printf '%0100d' 0"}},
+		},
+		Shell:     "sh",
+		Timeout:   200 * time.Millisecond,
+		MaxOutput: 64,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create exec service: %v", err)
+	}
+	return svc
+}
+
+// runRemoteCommand runs a command over an in-memory connection and returns status, output and trailers
+func runRemoteCommand(t *testing.T, svc *execService, name, token string) (int, string, http.Header) {
+	t.Helper()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return svc.open(), nil
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequest(http.MethodPost, "http://anyproxy-exec.internal/exec/run?name="+name, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data), resp.Trailer
+}
+
+func TestExecService_Run(t *testing.T) {
+	svc := newExecTestService(t)
+
+	status, output, trailer := runRemoteCommand(t, svc, "fail", "exec-token")
+	if status != http.StatusOK || !strings.Contains(output, "out") || !strings.Contains(output, "err") {
+		t.Errorf("Expected combined output, got %d: %q", status, output)
+	}
+	if code := trailer.Get(protocol.ExecExitCodeTrailer); code != "3" {
+		t.Errorf("Expected exit code 3, got %q", code)
+	}
+
+	_, output, trailer = runRemoteCommand(t, svc, "slow", "exec-token")
+	if code := trailer.Get(protocol.ExecExitCodeTrailer); code != "-1" || !strings.Contains(output, "timed out") {
+		t.Errorf("Expected timeout with exit code -1, got %q: %q", code, output)
+	}
+
+	_, output, trailer = runRemoteCommand(t, svc, "noisy", "exec-token")
+	if len(output) != 64 || trailer.Get(protocol.ExecTruncatedTrailer) != "true" {
+		t.Errorf("Expected output truncated to 64 bytes, got %d bytes (truncated=%q)", len(output), trailer.Get(protocol.ExecTruncatedTrailer))
+	}
+
+	if status, _, _ := runRemoteCommand(t, svc, "rm", "exec-token"); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for command outside the whitelist, got %d", status)
+	}
+	if status, _, _ := runRemoteCommand(t, svc, "fail", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong token, got %d", status)
+	}
+}
+
+func TestExecService_Shell(t *testing.T) {
+	svc := newExecTestService(t)
+	conn := svc.open()
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://anyproxy-exec.internal/exec/shell", nil)
+	req.Header.Set("Authorization", "Bearer exec-token")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol.ExecShellUpgrade)
+	go func() { _ = req.Write(conn) }()
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("Failed to read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+
+	go func() { _, _ = io.WriteString(conn, "echo shell-$((20+22))\nexit\n") }()
+	output, _ := io.ReadAll(reader)
+	if !strings.Contains(string(output), "shell-42") {
+		t.Errorf("Expected shell output, got %q", output)
+	}
+}
@@ -0,0 +1,395 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultMaxFileSize is used when file_transfer.max_file_size is not set
+const defaultMaxFileSize int64 = 10 << 20
+
+// FileInfo describes a directory entry returned by the file transfer service
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// fileService serves the file transfer API on connections the gateway opens to protocol.FileServiceAddress
+type fileService struct {
+	clientID    string
+	root        string
+	token       string
+	allowUpload bool
+	maxFileSize int64
+}
+
+// newFileService creates the file transfer service, returns nil when it is disabled
+func newFileService(clientID string, cfg config.FileTransferConfig) (*fileService, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	root, err := filepath.Abs(cfg.RootDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file_transfer.root_dir: %w", err)
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file_transfer.root_dir: %w", err)
+	}
+
+	maxFileSize := cfg.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = defaultMaxFileSize
+	}
+
+	logger.Info("File transfer service enabled", "client_id", clientID, "root_dir", root, "allow_upload", cfg.AllowUpload, "max_file_size", maxFileSize)
+	return &fileService{
+		clientID:    clientID,
+		root:        root,
+		token:       cfg.Token,
+		allowUpload: cfg.AllowUpload,
+		maxFileSize: maxFileSize,
+	}, nil
+}
+
+// open returns the tunnel side of a new in-memory connection served by the file service
+func (s *fileService) open() net.Conn {
+	return serveInProcess(s)
+}
+
+// serveInProcess serves HTTP on one side of an in-memory connection and returns the other side
+func serveInProcess(handler http.Handler) net.Conn {
+	tunnelSide, serviceSide := net.Pipe()
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		// Serve returns once the single connection was accepted, the connection keeps being served
+		_ = server.Serve(newSingleConnListener(serviceSide))
+	}()
+	return tunnelSide
+}
+
+// ServeHTTP implements the file transfer API: GET lists a directory or downloads a file, PUT uploads a file
+func (s *fileService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		logger.Warn("Rejected unauthenticated file transfer request", "client_id", s.clientID, "method", r.Method, "path", r.URL.Query().Get("path"))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/files" {
+		http.NotFound(w, r)
+		return
+	}
+
+	relPath := r.URL.Query().Get("path")
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGet(w, r, relPath)
+	case http.MethodPut:
+		s.handlePut(w, r, relPath)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorized checks the bearer token
+func (s *fileService) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// handleGet lists a directory or streams a file, "tail" limits a download to the last N bytes
+func (s *fileService) handleGet(w http.ResponseWriter, r *http.Request, relPath string) {
+	fullPath, err := s.resolve(relPath, false)
+	if err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+
+	if info.IsDir() {
+		s.listDir(w, fullPath, relPath)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "Not a regular file", http.StatusBadRequest)
+		return
+	}
+
+	offset := int64(0)
+	size := info.Size()
+	if tail := r.URL.Query().Get("tail"); tail != "" {
+		n, err := strconv.ParseInt(tail, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid tail", http.StatusBadRequest)
+			return
+		}
+		if n < size {
+			offset = size - n
+			size = n
+		}
+	}
+	if size > s.maxFileSize {
+		http.Error(w, fmt.Sprintf("File is %d bytes, larger than the %d byte limit (use tail)", size, s.maxFileSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	file, err := os.Open(fullPath) // nolint:gosec // path is confined to root_dir by resolve
+	if err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+	defer func() { _ = file.Close() }()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	written, err := io.CopyN(w, file, size)
+	if err != nil {
+		logger.Warn("File download interrupted", "client_id", s.clientID, "path", relPath, "bytes", written, "err", err)
+		return
+	}
+	logger.Info("File downloaded through tunnel", "client_id", s.clientID, "path", relPath, "bytes", written)
+}
+
+// listDir writes the directory entries as JSON
+func (s *fileService) listDir(w http.ResponseWriter, fullPath, relPath string) {
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, FileInfo{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			Mode:    info.Mode().String(),
+			ModTime: info.ModTime(),
+			IsDir:   entry.IsDir(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		logger.Error("Failed to encode directory listing", "client_id", s.clientID, "path", relPath, "err", err)
+	}
+}
+
+// handlePut writes the request body to a file, replacing it atomically
+func (s *fileService) handlePut(w http.ResponseWriter, r *http.Request, relPath string) {
+	if !s.allowUpload {
+		http.Error(w, "Uploads are disabled on this client", http.StatusForbidden)
+		return
+	}
+	if r.ContentLength > s.maxFileSize {
+		http.Error(w, fmt.Sprintf("Upload exceeds the %d byte limit", s.maxFileSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	fullPath, err := s.resolve(relPath, true)
+	if err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(fullPath); err == nil {
+		if !info.Mode().IsRegular() {
+			http.Error(w, "Not a regular file", http.StatusBadRequest)
+			return
+		}
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), ".anyproxy-upload-*")
+	if err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+	tmpName := tmp.Name()
+	defer func() { _ = os.Remove(tmpName) }()
+
+	written, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, s.maxFileSize))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("Upload exceeds the %d byte limit", s.maxFileSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.respondError(w, relPath, err)
+		return
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+	if err := os.Rename(tmpName, fullPath); err != nil {
+		s.respondError(w, relPath, err)
+		return
+	}
+
+	logger.Info("File uploaded through tunnel", "client_id", s.clientID, "path", relPath, "bytes", written)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"path": relPath, "size": written})
+}
+
+// errOutsideRoot is returned for paths that escape root_dir
+var errOutsideRoot = errors.New("path is outside the file transfer root")
+
+// resolve maps a request path to a file below root, following symlinks only within root.
+// For uploads the file may not exist yet, so only its directory must resolve.
+func (s *fileService) resolve(relPath string, forWrite bool) (string, error) {
+	cleaned := filepath.Join(s.root, filepath.FromSlash(filepath.Clean("/"+relPath)))
+
+	target := cleaned
+	if forWrite {
+		if cleaned == s.root {
+			return "", errOutsideRoot
+		}
+		target = filepath.Dir(cleaned)
+	}
+
+	resolved, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return "", err
+	}
+	if !s.withinRoot(resolved) {
+		return "", errOutsideRoot
+	}
+
+	if forWrite {
+		full := filepath.Join(resolved, filepath.Base(cleaned))
+		// An existing symlink must not point outside root either
+		if linked, err := filepath.EvalSymlinks(full); err == nil && !s.withinRoot(linked) {
+			return "", errOutsideRoot
+		}
+		return full, nil
+	}
+	return resolved, nil
+}
+
+// withinRoot reports whether path is root or below it
+func (s *fileService) withinRoot(path string) bool {
+	rel, err := filepath.Rel(s.root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// respondError maps file errors to HTTP status codes
+func (s *fileService) respondError(w http.ResponseWriter, relPath string, err error) {
+	switch {
+	case errors.Is(err, errOutsideRoot):
+		logger.Warn("Rejected file transfer outside root", "client_id", s.clientID, "path", relPath)
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, os.ErrPermission):
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	default:
+		logger.Error("File transfer request failed", "client_id", s.clientID, "path", relPath, "err", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
+}
+
+// handleFileServiceConnect attaches a gateway connection to the file transfer service
+func (c *Client) handleFileServiceConnect(connID, network string) {
+	if c.files == nil || network != protocol.ProtocolTCP {
+		logger.Warn("File transfer service requested but not enabled", "client_id", c.getClientID(), "conn_id", connID, "network", network)
+		if err := c.sendConnectResponse(connID, false, "file transfer service is disabled on this client", utils.ErrCodeTargetForbidden); err != nil {
+			logger.Error("Failed to send connect response for file transfer service", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+		return
+	}
+
+	logger.Info("File transfer session opened", "client_id", c.getClientID(), "conn_id", connID)
+	c.attachServiceConn(connID, protocol.FileServiceAddress, c.files.open())
+}
+
+// attachServiceConn registers an in-process service connection and starts relaying it to the gateway
+func (c *Client) attachServiceConn(connID, address string, conn net.Conn) {
+	c.connMgr.AddConnection(connID, conn)
+	monitoring.CreateConnection(connID, c.getClientID(), address)
+
+	if err := c.sendConnectResponse(connID, true, "", ""); err != nil {
+		logger.Error("Error sending connect_response to gateway", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		c.cleanupConnection(connID)
+		return
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.handleConnection(connID)
+	}()
+}
+
+// singleConnListener is a net.Listener that yields exactly one connection
+type singleConnListener struct {
+	conn net.Conn
+	addr net.Addr
+}
+
+// newSingleConnListener wraps conn in a listener
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, addr: conn.LocalAddr()}
+}
+
+// Accept returns the connection once, then io.EOF
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, io.EOF
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+// Close is a no-op, the served connection is closed by the HTTP server
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+// Addr returns the connection's local address
+func (l *singleConnListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// newFileTestService creates a file service rooted in a temp dir with an outside sibling dir
+func newFileTestService(t *testing.T, allowUpload bool) (*fileService, string, string) {
+	t.Helper()
+
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "logs"), outside} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "logs", "client.log"), []byte("line1\nline2\nline3\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	svc, err := newFileService("test-client", config.FileTransferConfig{
+		Enabled:     true,
+		RootDir:     root,
+		Token:       "file-token",
+		AllowUpload: allowUpload,
+		MaxFileSize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create file service: %v", err)
+	}
+	return svc, root, outside
+}
+
+// fileRequest sends a request to the service over an in-memory connection, like the gateway does
+func fileRequest(t *testing.T, svc *fileService, method, query, token string, body io.Reader) (int, string) {
+	t.Helper()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return svc.open(), nil
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequest(method, "http://anyproxy-files.internal/files?"+query, body)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestFileService_Disabled(t *testing.T) {
+	svc, err := newFileService("test-client", config.FileTransferConfig{})
+	if err != nil || svc != nil {
+		t.Errorf("Expected no service when disabled, got %v (err: %v)", svc, err)
+	}
+}
+
+func TestFileService_ListAndDownload(t *testing.T) {
+	svc, _, _ := newFileTestService(t, false)
+
+	if code, _ := fileRequest(t, svc, "GET", "path=logs", "wrong", nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong token, got %d", code)
+	}
+
+	code, body := fileRequest(t, svc, "GET", "path=logs", "file-token", nil)
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 listing, got %d: %s", code, body)
+	}
+	var files []FileInfo
+	if err := json.Unmarshal([]byte(body), &files); err != nil || len(files) != 1 || files[0].Name != "client.log" {
+		t.Errorf("Unexpected listing %s (err: %v)", body, err)
+	}
+
+	if code, body := fileRequest(t, svc, "GET", "path=logs/client.log", "file-token", nil); code != http.StatusOK || body != "line1\nline2\nline3\n" {
+		t.Errorf("Unexpected download %d: %q", code, body)
+	}
+	if code, body := fileRequest(t, svc, "GET", "path=logs/client.log&tail=6", "file-token", nil); code != http.StatusOK || body != "line3\n" {
+		t.Errorf("Unexpected tail download %d: %q", code, body)
+	}
+	if code, _ := fileRequest(t, svc, "GET", "path=logs/missing.log", "file-token", nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for missing file, got %d", code)
+	}
+}
+
+func TestFileService_ConfinedToRoot(t *testing.T) {
+	svc, root, outside := newFileTestService(t, true)
+
+	// Traversal is clamped to the root
+	if code, body := fileRequest(t, svc, "GET", "path=../outside/secret", "file-token", nil); code == http.StatusOK && strings.Contains(body, "secret") {
+		t.Error("Path traversal escaped the root")
+	}
+
+	// Symlinks pointing outside the root are rejected
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+	if code, _ := fileRequest(t, svc, "GET", "path=escape/secret", "file-token", nil); code != http.StatusForbidden {
+		t.Errorf("Expected 403 through outside symlink, got %d", code)
+	}
+	if code, _ := fileRequest(t, svc, "PUT", "path=escape/new.conf", "file-token", strings.NewReader("x")); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for upload through outside symlink, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.conf")); err == nil {
+		t.Error("Upload escaped the root")
+	}
+}
+
+func TestFileService_Upload(t *testing.T) {
+	readOnly, _, _ := newFileTestService(t, false)
+	if code, _ := fileRequest(t, readOnly, "PUT", "path=app.conf", "file-token", strings.NewReader("a=1")); code != http.StatusForbidden {
+		t.Errorf("Expected 403 when uploads are disabled, got %d", code)
+	}
+
+	svc, root, _ := newFileTestService(t, true)
+	if code, body := fileRequest(t, svc, "PUT", "path=app.conf", "file-token", strings.NewReader("a=1")); code != http.StatusOK {
+		t.Fatalf("Expected 200 upload, got %d: %s", code, body)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "app.conf"))
+	if err != nil || string(data) != "a=1" {
+		t.Errorf("Unexpected uploaded content %q (err: %v)", data, err)
+	}
+
+	if code, _ := fileRequest(t, svc, "PUT", "path=big.bin", "file-token", strings.NewReader(strings.Repeat("x", 2048))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for oversized upload, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "big.bin")); err == nil {
+		t.Error("Oversized upload should not be written")
+	}
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+)
+
+// maxHTTPHead bounds a message head or chunk line, longer ones make the connection unreusable
+const maxHTTPHead = 64 * 1024
+
+// httpStreamState is where an httpStream is within the current message
+type httpStreamState int
+
+const (
+	streamHead      httpStreamState = iota // reading the start line and headers
+	streamBody                             // reading a Content-Length body
+	streamChunkSize                        // reading a chunk size line
+	streamChunkData                        // reading chunk data
+	streamChunkEnd                         // reading the CRLF after chunk data
+	streamTrailer                          // reading trailer lines after the last chunk
+)
+
+// httpStream follows the message framing of one direction of an HTTP/1.1 connection
+type httpStream struct {
+	state     httpStreamState
+	line      []byte // head or line read so far
+	remaining int64  // bytes left of the body or chunk
+	messages  int    // complete messages
+}
+
+// between reports whether the stream sits between two messages
+func (s *httpStream) between() bool {
+	return s.state == streamHead && len(s.line) == 0
+}
+
+// begin starts reading the body of a message whose head was read
+func (s *httpStream) begin(length int64, chunked bool) {
+	switch {
+	case chunked:
+		s.state = streamChunkSize
+	case length > 0:
+		s.state, s.remaining = streamBody, length
+	default:
+		s.done()
+	}
+}
+
+// done completes the current message
+func (s *httpStream) done() {
+	s.state = streamHead
+	s.messages++
+}
+
+// httpConn follows the HTTP/1.1 exchanges on a target connection, so that it is only pooled for
+// a later session when it sits between requests: every request answered in full, neither side
+// asked to close and the protocol was not switched. Anything it can't frame, TLS included, makes
+// the connection unreusable.
+type httpConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	requests  httpStream
+	responses httpStream
+	methods   []string // methods of the requests waiting for a response
+	broken    bool     // the connection can't be reused
+}
+
+// newHTTPConn wraps a target connection to follow its HTTP exchanges
+func newHTTPConn(conn net.Conn) *httpConn {
+	return &httpConn{Conn: conn}
+}
+
+// Read follows the responses read from the target
+func (c *httpConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.feed(&c.responses, p[:n], c.response)
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// Write follows the requests written to the target
+func (c *httpConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mu.Lock()
+	c.feed(&c.requests, p[:n], c.request)
+	if err != nil {
+		c.broken = true
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// CloseWrite half-closes the target connection, it is not reused afterwards
+func (c *httpConn) CloseWrite() error {
+	c.mu.Lock()
+	c.broken = true
+	c.mu.Unlock()
+	return connection.CloseWrite(c.Conn)
+}
+
+// idle reports whether the connection sits between requests and may be reused
+func (c *httpConn) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.broken && c.requests.messages > 0 && c.requests.messages == c.responses.messages &&
+		len(c.methods) == 0 && c.requests.between() && c.responses.between()
+}
+
+// feed advances a stream over data, head is called with each complete message head
+func (c *httpConn) feed(s *httpStream, data []byte, head func(s *httpStream, head []byte)) {
+	for len(data) > 0 && !c.broken {
+		if s.state == streamBody || s.state == streamChunkData {
+			n := min(int64(len(data)), s.remaining)
+			data, s.remaining = data[n:], s.remaining-n
+			if s.remaining > 0 {
+				continue
+			}
+			if s.state == streamBody {
+				s.done()
+			} else {
+				s.state = streamChunkEnd
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			s.line = append(s.line, data...)
+			data = nil
+		} else {
+			s.line = append(s.line, data[:i+1]...)
+			data = data[i+1:]
+		}
+		if len(s.line) > maxHTTPHead {
+			c.broken = true
+			return
+		}
+		if i < 0 {
+			continue
+		}
+
+		line := bytes.TrimRight(s.line, "\r\n")
+		switch s.state {
+		case streamHead:
+			if len(line) == 0 && len(s.line) <= 2 {
+				// Stray line breaks between messages are ignored
+				s.line = s.line[:0]
+				continue
+			}
+			if !bytes.HasSuffix(s.line, []byte("\r\n\r\n")) {
+				continue
+			}
+			msgHead := s.line
+			s.line = nil
+			head(s, msgHead)
+		case streamChunkSize:
+			sizeField, _, _ := bytes.Cut(line, []byte(";"))
+			size, err := strconv.ParseInt(string(bytes.TrimSpace(sizeField)), 16, 64)
+			if err != nil || size < 0 {
+				c.broken = true
+				return
+			}
+			s.line = s.line[:0]
+			if size == 0 {
+				s.state = streamTrailer
+			} else {
+				s.state, s.remaining = streamChunkData, size
+			}
+		case streamChunkEnd:
+			if len(line) > 0 {
+				c.broken = true
+				return
+			}
+			s.line = s.line[:0]
+			s.state = streamChunkSize
+		case streamTrailer:
+			empty := len(line) == 0
+			s.line = s.line[:0]
+			if empty {
+				s.done()
+			}
+		}
+	}
+}
+
+// request reads the head of a request sent to the target
+func (c *httpConn) request(s *httpStream, head []byte) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil || req.Close || !req.ProtoAtLeast(1, 1) || req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+		c.broken = true
+		return
+	}
+	c.methods = append(c.methods, req.Method)
+	s.begin(req.ContentLength, len(req.TransferEncoding) > 0)
+}
+
+// response reads the head of a response from the target
+func (c *httpConn) response(s *httpStream, head []byte) {
+	if len(c.methods) == 0 {
+		// The target answered nothing we saw being asked
+		c.broken = true
+		return
+	}
+	method := c.methods[0]
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), &http.Request{Method: method})
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		c.broken = true
+		return
+	}
+	if resp.StatusCode < http.StatusOK {
+		// Informational, the final response follows
+		return
+	}
+	if resp.Close || !resp.ProtoAtLeast(1, 1) {
+		c.broken = true
+		return
+	}
+	c.methods = c.methods[1:]
+
+	if method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		s.done()
+		return
+	}
+	chunked := len(resp.TransferEncoding) > 0
+	if !chunked && resp.ContentLength < 0 {
+		// The body ends when the target closes
+		c.broken = true
+		return
+	}
+	s.begin(resp.ContentLength, chunked)
+}
@@ -0,0 +1,60 @@
+package client
+
+import "testing"
+
+func TestHTTPConn_Idle(t *testing.T) {
+	const get = "GET / HTTP/1.1\r\nHost: api.internal\r\n\r\n"
+	const ok = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	tests := []struct {
+		name      string
+		requests  string
+		responses string
+		want      bool
+	}{
+		{"content length", get, ok, true},
+		{"chunked", get, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2;x=y\r\nok\r\n0\r\nX-Sum: 1\r\n\r\n", true},
+		{"request body", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabc", ok, true},
+		{"chunked request body", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", ok, true},
+		{"head", "HEAD / HTTP/1.1\r\nHost: a\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 99\r\n\r\n", true},
+		{"not modified", get, "HTTP/1.1 304 Not Modified\r\n\r\n", true},
+		{"continue", get, "HTTP/1.1 100 Continue\r\n\r\n" + ok, true},
+		{"pipelined", get + get, ok + ok, true},
+		{"no request", "", "", false},
+		{"response pending", get, "", false},
+		{"response partly read", get, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nok", false},
+		{"second response pending", get + get, ok, false},
+		{"request close", "GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n", ok, false},
+		{"response close", get, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok", false},
+		{"close delimited", get, "HTTP/1.1 200 OK\r\n\r\nok", false},
+		{"http 1.0", "GET / HTTP/1.0\r\n\r\n", "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok", false},
+		{"upgrade", "GET / HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", "HTTP/1.1 101 Switching Protocols\r\n\r\n", false},
+		{"connect", "CONNECT db.internal:5432 HTTP/1.1\r\nHost: db.internal:5432\r\n\r\n", "HTTP/1.1 200 OK\r\n\r\n", false},
+		{"unsolicited response", "", ok, false},
+		{"not http", "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\r\n\r\n", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Whole messages and one byte at a time, as the target may split them anywhere
+			for _, step := range []int{0, 1} {
+				c := newHTTPConn(nil)
+				feedSteps(c, &c.requests, tt.requests, step, c.request)
+				feedSteps(c, &c.responses, tt.responses, step, c.response)
+				if got := c.idle(); got != tt.want {
+					t.Errorf("idle() with step %d = %v, want %v", step, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// feedSteps feeds data to a stream in pieces of step bytes, all at once for a zero step
+func feedSteps(c *httpConn, s *httpStream, data string, step int, head func(s *httpStream, head []byte)) {
+	if step == 0 {
+		step = max(len(data), 1)
+	}
+	for i := 0; i < len(data); i += step {
+		c.feed(s, []byte(data[i:min(i+step, len(data))]), head)
+	}
+}
@@ -3,12 +3,14 @@ package client
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"net"
 	"time"
 
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/qos"
 	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 )
@@ -49,9 +51,12 @@ func (c *Client) handleMessages() {
 		}
 
 		switch msgType {
-		case protocol.MsgTypeConnect, protocol.MsgTypeData, protocol.MsgTypeClose:
+		case protocol.MsgTypeConnect, protocol.MsgTypeData, protocol.MsgTypeClose, protocol.MsgTypeCloseWrite:
 			// Route all messages to each connection's channel
 			c.routeMessage(msg)
+		case protocol.MsgTypeConnectResponse:
+			// Only peer connections are opened by the client
+			c.handlePeerConnectResponse(msg)
 		case protocol.MsgTypePortForwardResp:
 			// Handle port forwarding response directly
 			logger.Debug("Received port forwarding response", "client_id", c.getClientID())
@@ -88,6 +93,27 @@ func (c *Client) routeMessage(msg map[string]interface{}) {
 
 	msgType, _ := msg["type"].(string)
 
+	// Messages of a connection are handled in order, abort a pending dial now rather than after it
+	if msgType == protocol.MsgTypeClose {
+		if cancel, ok := c.pendingDials.Load(connID); ok {
+			logger.Debug("Aborting pending target dial", "client_id", c.getClientID(), "conn_id", connID)
+			cancel.(context.CancelFunc)()
+		}
+	}
+
+	// IP packets of TUN mode share data messages under a reserved connection ID
+	if msgType == protocol.MsgTypeData && connID == protocol.PacketConnID {
+		data, _ := msg["data"].([]byte)
+		c.tun.deliver(data)
+		return
+	}
+
+	// Empty data messages are liveness probes of idle connections, answered out of band
+	if data, ok := msg["data"].([]byte); ok && msgType == protocol.MsgTypeData && len(data) == 0 {
+		c.handleProbe(connID)
+		return
+	}
+
 	// For connection messages, create channel first
 	if msgType == protocol.MsgTypeConnect {
 		logger.Debug("Creating message channel for new connection request", "client_id", c.getClientID(), "conn_id", connID)
@@ -163,6 +189,8 @@ func (c *Client) processConnectionMessages(connID string, msgChan chan map[strin
 				c.handleConnectMessage(msg)
 			case protocol.MsgTypeData:
 				c.handleDataMessage(msg)
+			case protocol.MsgTypeCloseWrite:
+				c.handleCloseWriteMessage(msg)
 			case protocol.MsgTypeClose:
 				logger.Debug("Received close message, stopping connection processor", "client_id", c.getClientID(), "conn_id", connID, "messages_processed", messagesProcessed)
 				c.handleCloseMessage(msg)
@@ -197,42 +225,113 @@ func (c *Client) handleConnectMessage(msg map[string]interface{}) {
 
 	logger.Info("Processing connect request from gateway", "client_id", c.getClientID(), "conn_id", connID, "network", network, "address", address)
 
+	// Client-side services are served in-process instead of dialing a target
+	if address == protocol.FileServiceAddress {
+		c.handleFileServiceConnect(connID, network)
+		return
+	}
+	if address == protocol.ExecServiceAddress {
+		c.handleExecServiceConnect(connID, network)
+		return
+	}
+	if address == protocol.UpdateServiceAddress {
+		c.handleUpdateServiceConnect(connID, network)
+		return
+	}
+	if address == protocol.PolicyServiceAddress {
+		c.handlePolicyServiceConnect(connID, network)
+		return
+	}
+	if address == protocol.DiagServiceAddress {
+		c.handleDiagServiceConnect(connID, network)
+		return
+	}
+
+	// The gateway only routes these here when the capabilities did not reach it
+	if !c.supportsNetwork(network) {
+		logger.Warn("Connection rejected - network not supported", "client_id", c.getClientID(), "conn_id", connID, "network", network, "address", address)
+		errorMsg := fmt.Sprintf("client does not support %s connections", network)
+		if err := c.sendConnectResponse(connID, false, errorMsg, utils.ErrCodeTargetForbidden); err != nil {
+			logger.Error("Failed to send connect response for unsupported network", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+		return
+	}
+
 	// Check if the connection is allowed
 	if !c.isConnectionAllowed(address) {
 		errorMsg := fmt.Sprintf("Connection denied - host '%s' is forbidden", address)
-		logger.Error("Connection rejected - forbidden host", "client_id", c.getClientID(), "conn_id", connID, "address", address, "reason", "Host is in forbidden list or not in allowed list", "allowed_hosts", c.config.AllowedHosts, "forbidden_hosts", c.config.ForbiddenHosts)
+		logger.Error("Connection rejected - forbidden host", "client_id", c.getClientID(), "conn_id", connID, "address", address, "reason", "Host is in forbidden list or not in allowed list")
 
-		if err := c.sendConnectResponse(connID, false, errorMsg); err != nil {
+		if err := c.sendConnectResponse(connID, false, errorMsg, utils.ErrCodeTargetForbidden); err != nil {
 			logger.Error("Failed to send connect response for forbidden host", "client_id", c.getClientID(), "conn_id", connID, "err", err)
 		}
 		return
 	}
 	logger.Debug("Connection allowed by host filtering rules", "client_id", c.getClientID(), "conn_id", connID, "address", address)
 
+	// Above the connect rate the gateway holds off connect requests until the next token
+	if wait := c.connectRate.take(); wait > 0 {
+		rate := c.connectRate.limit()
+		logger.Warn("Connection rejected - client connect rate limit reached", "client_id", c.getClientID(), "conn_id", connID, "address", address, "max_connect_rate", rate, "retry_after", wait)
+		errorMsg := fmt.Sprintf("client connect rate limit of %g/s reached", rate)
+		if err := c.writeBusyResponse(connID, errorMsg, wait); err != nil {
+			logger.Error("Failed to send connect response for connect rate limit", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+		return
+	}
+
+	// At the connection limit the gateway may still retry the dial through another client
+	if limit := c.config.MaxConnections; limit > 0 && c.connMgr.GetConnectionCount() >= limit {
+		logger.Warn("Connection rejected - client connection limit reached", "client_id", c.getClientID(), "conn_id", connID, "address", address, "max_connections", limit)
+		errorMsg := fmt.Sprintf("client connection limit of %d reached", limit)
+		if err := c.sendConnectResponse(connID, false, errorMsg, utils.ErrCodeClientOverloaded); err != nil {
+			logger.Error("Failed to send connect response for connection limit", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+		return
+	}
+
 	// Establish connection to target
 	logger.Debug("Establishing connection to target", "client_id", c.getClientID(), "conn_id", connID, "network", network, "address", address)
 
-	var d net.Dialer
-	ctx, cancel := context.WithTimeout(c.ctx, protocol.DefaultConnectTimeout)
+	// The gateway forwards how long the proxy user still waits, no point dialing past it
+	timeout := protocol.DefaultConnectTimeout
+	if t, ok := msg["timeout"].(time.Duration); ok && t > 0 && t < timeout {
+		timeout = t
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
 	defer cancel()
+	// A close from the gateway aborts the dial, see routeMessage
+	c.pendingDials.Store(connID, cancel)
+	defer c.pendingDials.Delete(connID)
 
 	connectStart := time.Now()
-	conn, err := d.DialContext(ctx, network, address)
+	var err error
+	scope, _ := msg["scope"].(string)
+	conn := c.pooledTarget(connID, network, address, scope)
+	if conn == nil {
+		conn, err = c.dialTarget(ctx, network, address)
+	}
 	connectDuration := time.Since(connectStart)
 
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) && c.ctx.Err() == nil {
+		logger.Info("Target dial aborted, gateway closed the connection", "client_id", c.getClientID(), "conn_id", connID, "network", network, "address", address, "connect_duration", connectDuration)
+		return
+	}
 	if err != nil {
-		logger.Error("Failed to establish connection to target", "client_id", c.getClientID(), "conn_id", connID, "network", network, "address", address, "connect_duration", connectDuration, "err", err)
-		if sendErr := c.sendConnectResponse(connID, false, err.Error()); sendErr != nil {
+		logger.Error("Failed to establish connection to target", "client_id", c.getClientID(), "conn_id", connID, "network", network, "address", address, "connect_duration", connectDuration, "timeout", timeout, "err", err)
+		if sendErr := c.sendConnectResponse(connID, false, err.Error(), utils.ErrorCodeOf(err)); sendErr != nil {
 			logger.Error("Failed to send connect response for connection error", "client_id", c.getClientID(), "conn_id", connID, "original_error", err, "send_error", sendErr)
 		}
 		// Update failure metrics
 		monitoring.IncrementErrors()
+		monitoring.FailConnection(connID, c.getClientID(), address, err.Error())
 		return
 	}
 
 	logger.Info("Successfully connected to target", "client_id", c.getClientID(), "conn_id", connID, "network", network, "address", address, "connect_duration", connectDuration)
 
 	// Register connection (using ConnectionManager)
+	conn = c.reusableTarget(connID, network, address, scope, conn)
 	c.connMgr.AddConnection(connID, conn)
 	connectionCount := c.connMgr.GetConnectionCount()
 
@@ -242,7 +341,7 @@ func (c *Client) handleConnectMessage(msg map[string]interface{}) {
 	logger.Debug("Connection registered", "client_id", c.getClientID(), "conn_id", connID, "total_connections", connectionCount)
 
 	// Send success response
-	if err := c.sendConnectResponse(connID, true, ""); err != nil {
+	if err := c.sendConnectResponse(connID, true, "", ""); err != nil {
 		logger.Error("Error sending connect_response to gateway", "client_id", c.getClientID(), "conn_id", connID, "err", err)
 		c.cleanupConnection(connID)
 		return
@@ -250,6 +349,15 @@ func (c *Client) handleConnectMessage(msg map[string]interface{}) {
 
 	// Start handling connection
 	logger.Debug("Starting connection handler", "client_id", c.getClientID(), "conn_id", connID)
+	// The gateway's priority wins, it knows the proxy user
+	priority := qos.PriorityUnset
+	if p, ok := msg["priority"].(uint8); ok {
+		priority = qos.Priority(p)
+	}
+	if priority == qos.PriorityUnset {
+		priority = c.qos.Classify(address)
+	}
+	c.egress.Register(connID, address, priority)
 	c.wg.Add(1)
 	go func() {
 		defer c.wg.Done()
@@ -257,11 +365,12 @@ func (c *Client) handleConnectMessage(msg map[string]interface{}) {
 	}()
 }
 
-// sendConnectResponse sends connection response to gateway (using binary format)
-func (c *Client) sendConnectResponse(connID string, success bool, errorMsg string) error {
-	logger.Debug("Sending connect response to gateway", "client_id", c.getClientID(), "conn_id", connID, "success", success, "error_message", errorMsg)
+// sendConnectResponse sends connection response to gateway (using binary format),
+// errorCode tells the proxy user why the connection failed
+func (c *Client) sendConnectResponse(connID string, success bool, errorMsg string, errorCode utils.ErrorCode) error {
+	logger.Debug("Sending connect response to gateway", "client_id", c.getClientID(), "conn_id", connID, "success", success, "error_message", errorMsg, "error_code", errorCode)
 
-	err := c.writeConnectResponse(connID, success, errorMsg)
+	err := c.writeConnectResponse(connID, success, errorMsg, errorCode)
 	if err != nil {
 		logger.Error("Failed to write connect response to transport", "client_id", c.getClientID(), "conn_id", connID, "success", success, "err", err)
 	} else {
@@ -324,6 +433,11 @@ func (c *Client) handleDataMessage(msg map[string]interface{}) {
 	if err != nil {
 		logger.Error("Failed to write data to target connection", "client_id", c.getClientID(), "conn_id", connID, "data_bytes", len(data), "written_bytes", n, "err", err, "total_connections", c.connMgr.GetConnectionCount())
 		// Do NOT update metrics for failed writes to avoid double counting
+		// The reader may have stopped after a half-close, so the gateway is told here
+		if _, halfClosed := c.halfClosed.Load(connID); halfClosed {
+			c.closeFully(connID)
+			return
+		}
 		c.cleanupConnection(connID)
 		return
 	}
@@ -346,5 +460,43 @@ func (c *Client) handleCloseMessage(msg map[string]interface{}) {
 	}
 
 	logger.Info("Received close message from gateway", "client_id", c.getClientID(), "conn_id", connID)
+
+	// Keep the target connection for the same proxy user if it sits between requests
+	if c.releaseConnection(connID) {
+		return
+	}
 	c.cleanupConnection(connID)
 }
+
+// handleCloseWriteMessage handles a half-close from the gateway: the proxy user finished sending,
+// the target reads EOF while it can still answer
+func (c *Client) handleCloseWriteMessage(msg map[string]interface{}) {
+	connID, ok := msg["id"].(string)
+	if !ok {
+		logger.Error("Invalid connection ID in close_write message", "client_id", c.getClientID(), "message_fields", utils.GetMessageFields(msg))
+		return
+	}
+
+	conn, ok := c.connMgr.GetConnection(connID)
+	if !ok {
+		return
+	}
+
+	if c.closeGrace <= 0 {
+		logger.Debug("Half-close disabled, closing connection", "client_id", c.getClientID(), "conn_id", connID)
+		c.closeFully(connID)
+		return
+	}
+	// A half-closed target connection is not reused
+	c.pool.untrack(connID)
+	if err := connection.CloseWrite(conn); err != nil {
+		logger.Debug("Failed to half-close target connection, closing it", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		c.closeFully(connID)
+		return
+	}
+
+	logger.Debug("Proxy user finished sending, half-closed target connection", "client_id", c.getClientID(), "conn_id", connID)
+	if c.halfCloseState(connID).CloseRemote(c.closeGrace, func() { c.expireHalfClose(connID) }) {
+		c.cleanupConnection(connID)
+	}
+}
@@ -1,5 +1,11 @@
 package client
 
+import (
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+)
+
 // readNextMessage reads the next message, using binary format completely
 func (c *Client) readNextMessage() (map[string]interface{}, error) {
 	// Use shared message handler
@@ -13,9 +19,15 @@ func (c *Client) writeDataMessage(connID string, data []byte) error {
 }
 
 // writeConnectResponse sends connection response using binary format
-func (c *Client) writeConnectResponse(connID string, success bool, errorMsg string) error {
+func (c *Client) writeConnectResponse(connID string, success bool, errorMsg string, errorCode utils.ErrorCode) error {
 	// Use shared message handler
-	return c.msgHandler.WriteConnectResponse(connID, success, errorMsg)
+	return c.msgHandler.WriteConnectResponse(connID, success, errorMsg, string(errorCode))
+}
+
+// writeBusyResponse refuses a connect request at the connect rate limit, the gateway holds off
+// connect requests for retryAfter
+func (c *Client) writeBusyResponse(connID, errorMsg string, retryAfter time.Duration) error {
+	return c.msgHandler.WriteBusyResponse(connID, errorMsg, string(utils.ErrCodeClientBusy), retryAfter)
 }
 
 // writeCloseMessage sends close message using binary format
@@ -23,3 +35,9 @@ func (c *Client) writeCloseMessage(connID string) error {
 	// Use shared message handler
 	return c.msgHandler.WriteCloseMessage(connID)
 }
+
+// writeCloseWriteMessage sends a half-close message using binary format
+func (c *Client) writeCloseWriteMessage(connID string) error {
+	// Use shared message handler
+	return c.msgHandler.WriteCloseWriteMessage(connID)
+}
@@ -56,6 +56,10 @@ func (m *mockConnForHandler) GetPassword() string {
 	return "test-password"
 }
 
+func (m *mockConnForHandler) GetClientVersion() string {
+	return ""
+}
+
 func TestReadNextMessage(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -327,7 +331,7 @@ func TestWriteConnectResponse(t *testing.T) {
 			client.msgHandler = message.NewClientExtendedMessageHandler(mockConn)
 
 			// Write connect response
-			err := client.writeConnectResponse(tt.connID, tt.success, tt.errorMsg)
+			err := client.writeConnectResponse(tt.connID, tt.success, tt.errorMsg, "")
 
 			// Check error
 			if (err != nil) != tt.expectErr {
@@ -421,7 +425,7 @@ func TestWriteCloseMessage(t *testing.T) {
 					t.Errorf("Expected message type %d, got %d", protocol.BinaryMsgTypeClose, msgType)
 				}
 
-				unpackedConnID, err := protocol.UnpackCloseMessage(payload)
+				unpackedConnID, _, err := protocol.UnpackCloseMessage(payload)
 				if err != nil {
 					t.Fatalf("Failed to unpack close message: %v", err)
 				}
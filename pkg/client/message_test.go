@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"io"
 	"net"
 	"sync"
 	"testing"
@@ -21,6 +22,7 @@ type mockMessageConnection struct {
 	readErr  error
 	writeErr error
 	closed   bool
+	written  [][]byte
 }
 
 func (m *mockMessageConnection) ReadMessage() ([]byte, error) {
@@ -34,6 +36,9 @@ func (m *mockMessageConnection) ReadMessage() ([]byte, error) {
 }
 
 func (m *mockMessageConnection) WriteMessage(data []byte) error {
+	if m.writeErr == nil {
+		m.written = append(m.written, data)
+	}
 	return m.writeErr
 }
 
@@ -62,6 +67,10 @@ func (m *mockMessageConnection) GetPassword() string {
 	return "test-password"
 }
 
+func (m *mockMessageConnection) GetClientVersion() string {
+	return ""
+}
+
 func TestRouteMessage(t *testing.T) {
 	tests := []struct {
 		name                 string
@@ -178,6 +187,87 @@ func TestRouteMessage(t *testing.T) {
 	}
 }
 
+func TestRouteMessage_CloseAbortsPendingDial(t *testing.T) {
+	client := &Client{
+		config:  &config.ClientConfig{ClientID: "test-client"},
+		ctx:     context.Background(),
+		connMgr: connection.NewManager("test-client"),
+	}
+	dialCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.pendingDials.Store("conn-1", cancel)
+
+	client.routeMessage(map[string]interface{}{"type": protocol.MsgTypeClose, "id": "conn-1"})
+	if dialCtx.Err() == nil {
+		t.Error("Expected close message to cancel the pending dial")
+	}
+}
+
+func TestRouteMessage_Probe(t *testing.T) {
+	transportConn := &mockMessageConnection{}
+	client := &Client{
+		config:     &config.ClientConfig{ClientID: "test-client"},
+		ctx:        context.Background(),
+		connMgr:    connection.NewManager("test-client"),
+		msgHandler: message.NewClientExtendedMessageHandler(transportConn),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialTarget := func(connID string) *net.TCPConn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		target, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.connMgr.AddConnection(connID, conn)
+		return target.(*net.TCPConn)
+	}
+	probe := func(connID string) {
+		client.routeMessage(map[string]interface{}{"type": protocol.MsgTypeData, "id": connID, "data": []byte{}})
+	}
+	closedIDs := func() []string {
+		var ids []string
+		for _, data := range transportConn.written {
+			_, msgType, payload, _ := protocol.UnpackBinaryHeader(data)
+			if connID, _, err := protocol.UnpackCloseMessage(payload); msgType == protocol.BinaryMsgTypeClose && err == nil {
+				ids = append(ids, connID)
+			}
+		}
+		return ids
+	}
+
+	// A live target is left alone
+	alive := dialTarget("conn-alive")
+	defer alive.Close()
+	probe("conn-alive")
+	if ids := closedIDs(); len(ids) != 0 {
+		t.Fatalf("Expected no close for a live connection, got %v", ids)
+	}
+
+	// A reset target and an unknown connection are closed
+	dead := dialTarget("conn-dead")
+	_ = dead.SetLinger(0)
+	_ = dead.Close()
+	time.Sleep(20 * time.Millisecond)
+	probe("conn-dead")
+	probe("conn-unknown")
+	if ids := closedIDs(); len(ids) != 2 || ids[0] != "conn-dead" || ids[1] != "conn-unknown" {
+		t.Errorf("Expected close messages for the dead and unknown connections, got %v", ids)
+	}
+	if _, exists := client.connMgr.GetConnection("conn-dead"); exists {
+		t.Error("Expected the dead connection to be cleaned up")
+	}
+	if _, exists := client.connMgr.GetConnection("conn-alive"); !exists {
+		t.Error("Expected the live connection to stay open")
+	}
+}
+
 func TestHandleDataMessage(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -353,6 +443,54 @@ func TestHandleCloseMessage(t *testing.T) {
 	}
 }
 
+func TestHandleCloseWriteMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &Client{
+		config:     &config.ClientConfig{ClientID: "test-client"},
+		connMgr:    connection.NewManager("test-client"),
+		msgHandler: message.NewClientExtendedMessageHandler(&mockMessageConnection{}),
+		closeGrace: time.Minute,
+		ctx:        ctx,
+	}
+	app, target := connection.Pipe()
+	defer app.Close()
+	client.connMgr.AddConnection("conn-1", target)
+
+	// The proxy user finished sending, the target reads EOF but stays connected
+	client.handleCloseWriteMessage(map[string]interface{}{"id": "conn-1"})
+	if data, err := io.ReadAll(app); err != nil || len(data) != 0 {
+		t.Fatalf("Expected EOF on the target, got %q, %v", data, err)
+	}
+	if _, exists := client.connMgr.GetConnection("conn-1"); !exists {
+		t.Fatal("Expected the half-closed connection to stay open")
+	}
+
+	// Once the target finished its answer both directions are closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.handleConnection("conn-1")
+	}()
+	if _, err := app.Write([]byte("answer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := connection.CloseWrite(app); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for the connection handler")
+	}
+	if _, exists := client.connMgr.GetConnection("conn-1"); exists {
+		t.Error("Expected the connection to be cleaned up once both directions closed")
+	}
+	if _, exists := client.halfClosed.Load("conn-1"); exists {
+		t.Error("Expected the half-close state to be removed")
+	}
+}
+
 func TestCreateMessageChannel(t *testing.T) {
 	// Create client
 	client := &Client{
@@ -522,7 +660,7 @@ func TestSendConnectResponse(t *testing.T) {
 			client.msgHandler = message.NewClientExtendedMessageHandler(mockConn)
 
 			// Send connect response
-			err := client.sendConnectResponse(tt.connID, tt.success, tt.errorMsg)
+			err := client.sendConnectResponse(tt.connID, tt.success, tt.errorMsg, "")
 
 			// Verify error
 			if (err != nil) != tt.expectErr {
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// NewClients creates the replicas of the client for each gateway it registers with, the primary
+// gateway and those of cfg.Gateways. Every client is bound to one gateway and has its own
+// connection, connection table and port forwards, so dials from one gateway never touch the
+// state of another. Process-wide components are shared through the setters, the connect rate
+// limit is shared by all clients of the device.
+func NewClients(cfg *config.ClientConfig) ([]*Client, error) {
+	gateways := cfg.GatewayList()
+	clients := make([]*Client, 0, len(gateways)*cfg.Replicas)
+	connectRate := newConnectLimiter(cfg.MaxConnectRate, cfg.ConnectBurst)
+	for idx, gw := range gateways {
+		gatewayCfg := *cfg
+		gatewayCfg.Gateway = gw
+		gatewayCfg.Gateways = nil
+		// Outage reports are uploaded to the gateway of the outage
+		if idx > 0 && cfg.Spool.Dir != "" {
+			gatewayCfg.Spool.Dir = filepath.Join(cfg.Spool.Dir, fmt.Sprintf("gateway-%d", idx))
+		}
+		for i := 0; i < cfg.Replicas; i++ {
+			c, err := NewClient(&gatewayCfg, gw.TransportType, i)
+			if err != nil {
+				return nil, fmt.Errorf("gateway %s replica %d: %w", gw.Addr, i, err)
+			}
+			c.connectRate = connectRate
+			clients = append(clients, c)
+		}
+	}
+	if len(gateways) > 1 {
+		logger.Info("Client registers with several gateways", "client_id", cfg.ClientID, "gateways", len(gateways), "replicas", cfg.Replicas)
+	}
+	return clients, nil
+}
+
+// GatewayAddr returns the address of the gateway the client is bound to
+func (c *Client) GatewayAddr() string {
+	return c.config.Gateway.Addr
+}
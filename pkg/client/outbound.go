@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// outboundRoute is a compiled client.outbound rule
+type outboundRoute struct {
+	prefix netip.Prefix
+	iface  string
+	source net.IP
+}
+
+// outboundRouter selects the egress interface or source IP of target dials,
+// for multi-homed hosts where traffic must leave through a particular uplink
+type outboundRouter struct {
+	routes []outboundRoute
+}
+
+// newOutboundRouter compiles the outbound rules, returns nil when none are configured
+func newOutboundRouter(rules []config.OutboundRule) (*outboundRouter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	router := &outboundRouter{}
+	for i, rule := range rules {
+		prefix, err := netip.ParsePrefix(rule.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("outbound rule %d: %w", i, err)
+		}
+		route := outboundRoute{prefix: prefix.Masked(), iface: rule.Interface}
+		if rule.SourceIP != "" {
+			if route.source = net.ParseIP(rule.SourceIP); route.source == nil {
+				return nil, fmt.Errorf("outbound rule %d: invalid source_ip %q", i, rule.SourceIP)
+			}
+		}
+		router.routes = append(router.routes, route)
+	}
+	return router, nil
+}
+
+// match returns the first route containing addr, nil when none does
+func (r *outboundRouter) match(addr netip.Addr) *outboundRoute {
+	if r == nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	for i := range r.routes {
+		if r.routes[i].prefix.Contains(addr) {
+			return &r.routes[i]
+		}
+	}
+	return nil
+}
+
+// dialTarget dials a target, through the first outbound route matching its address.
+// Host names are resolved here so that rules and the dial guard match by address, targets
+// no rule matches are dialed normally.
+func (c *Client) dialTarget(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.targetDialer != nil {
+		return c.targetDialer(ctx, network, address)
+	}
+	opts := &c.config.SocketOptions
+	if c.outbound == nil && c.guard == nil {
+		return sockopt.DialContext(ctx, network, address, opts)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if c.guard != nil {
+			return nil, err
+		}
+		return sockopt.DialContext(ctx, network, address, opts)
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		ipNetwork := "ip"
+		if strings.HasSuffix(network, "4") || strings.HasSuffix(network, "6") {
+			ipNetwork += network[len(network)-1:]
+		}
+		if addrs, err = net.DefaultResolver.LookupNetIP(ctx, ipNetwork, host); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.guard != nil {
+		if addrs = c.guardAddrs(address, addrs, port); len(addrs) == 0 {
+			return nil, utils.WithErrorCode(utils.ErrCodeTargetForbidden, fmt.Errorf("dial guard: %s resolves to no permitted address", address))
+		}
+	}
+
+	for _, addr := range addrs {
+		route := c.outbound.match(addr)
+		if route == nil {
+			continue
+		}
+		logger.Debug("Dialing target through outbound route", "client_id", c.getClientID(), "address", address, "target_ip", addr, "cidr", route.prefix, "interface", route.iface, "source_ip", route.source)
+		return sockopt.DialContextFrom(ctx, network, net.JoinHostPort(addr.Unmap().String(), port), opts, route.iface, route.source)
+	}
+	if c.guard != nil {
+		// Dial the checked addresses, resolving the name again would undo the check
+		return dialAddrs(ctx, network, addrs, port, opts)
+	}
+	return sockopt.DialContext(ctx, network, address, opts)
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestOutboundRouter_Match(t *testing.T) {
+	router, err := newOutboundRouter(nil)
+	if err != nil || router != nil {
+		t.Fatalf("Expected nil router without rules, got %v (err: %v)", router, err)
+	}
+
+	router, err = newOutboundRouter([]config.OutboundRule{
+		{CIDR: "10.1.0.0/16", Interface: "wwan0"},
+		{CIDR: "10.0.0.0/8", SourceIP: "192.168.1.10"},
+		{CIDR: "2001:db8::/32", Interface: "eth1"},
+	})
+	if err != nil {
+		t.Fatalf("newOutboundRouter() error = %v", err)
+	}
+
+	tests := []struct {
+		addr  string
+		iface string
+		cidr  string
+	}{
+		{"10.1.2.3", "wwan0", "10.1.0.0/16"},
+		{"10.2.0.1", "", "10.0.0.0/8"},
+		{"::ffff:10.2.0.1", "", "10.0.0.0/8"},
+		{"2001:db8::1", "eth1", "2001:db8::/32"},
+		{"192.0.2.1", "", ""},
+	}
+	for _, tt := range tests {
+		route := router.match(netip.MustParseAddr(tt.addr))
+		if tt.cidr == "" {
+			if route != nil {
+				t.Errorf("match(%s) = %v, want no route", tt.addr, route.prefix)
+			}
+			continue
+		}
+		if route == nil || route.prefix.String() != tt.cidr || route.iface != tt.iface {
+			t.Errorf("match(%s) = %+v, want %s via %q", tt.addr, route, tt.cidr, tt.iface)
+		}
+	}
+}
+
+func TestClient_DialTargetOutbound(t *testing.T) {
+	addr, accepted := startPoolTestServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+
+	router, err := newOutboundRouter([]config.OutboundRule{
+		{CIDR: "10.0.0.0/8", SourceIP: "10.9.9.9"}, // Must not apply to loopback targets
+		{CIDR: "127.0.0.0/8", SourceIP: "127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("newOutboundRouter() error = %v", err)
+	}
+	c := &Client{config: &config.ClientConfig{}, outbound: router}
+
+	// Host names are resolved and matched by address
+	conn, err := c.dialTarget(context.Background(), "tcp4", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("dialTarget() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("RemoteAddr() = %s, want 127.0.0.1", got)
+	}
+	if got := conn.LocalAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("LocalAddr() = %s, want 127.0.0.1", got)
+	}
+	serverConn := <-accepted
+	_ = serverConn.Close()
+}
@@ -0,0 +1,427 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+const (
+	// peerHandshakeTimeout bounds the local SOCKS5/HTTP handshake of a peer connection
+	peerHandshakeTimeout = 10 * time.Second
+	// peerReplyTimeout bounds writing the handshake reply to the local application
+	peerReplyTimeout = 5 * time.Second
+	// peerConnectMargin is added to the gateway's dial timeout before a peer connection is abandoned
+	peerConnectMargin = 5 * time.Second
+)
+
+// PeerListeners accepts local connections and has the gateway relay them to clients of other
+// groups. They are shared by all replicas of the process, each connection is sent through the
+// next replica connected to the gateway.
+type PeerListeners struct {
+	listeners []net.Listener
+	configs   []config.PeerListener
+
+	mu      sync.RWMutex
+	clients []*Client
+	next    atomic.Uint64
+
+	wg sync.WaitGroup
+}
+
+// pendingPeer is a peer connection waiting for the gateway's connect response
+type pendingPeer struct {
+	conn    net.Conn
+	address string
+	reply   func(err error) error
+	done    chan struct{}
+}
+
+// NewPeerListeners binds the configured peer listeners, it returns nil when there are none
+func NewPeerListeners(cfgs []config.PeerListener) (*PeerListeners, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	p := &PeerListeners{}
+	for _, cfg := range cfgs {
+		if cfg.Protocol == "" {
+			cfg.Protocol = config.PeerProtocolSOCKS5
+		}
+		ln, err := sockopt.Listen(context.Background(), "tcp", cfg.ListenAddr, nil)
+		if err != nil {
+			p.Stop()
+			return nil, fmt.Errorf("failed to listen on %s: %w", cfg.ListenAddr, err)
+		}
+		logger.Info("Peer listener started", "listen_addr", ln.Addr().String(), "protocol", cfg.Protocol, "group_id", cfg.GroupID)
+		p.listeners = append(p.listeners, ln)
+		p.configs = append(p.configs, cfg)
+	}
+	for i := range p.listeners {
+		p.wg.Add(1)
+		go p.serve(p.listeners[i], p.configs[i])
+	}
+	return p, nil
+}
+
+// Addrs returns the addresses the peer listeners are bound to
+func (p *PeerListeners) Addrs() []net.Addr {
+	if p == nil {
+		return nil
+	}
+	addrs := make([]net.Addr, 0, len(p.listeners))
+	for _, ln := range p.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// Stop closes the peer listeners and waits for handshakes in progress. Relayed connections
+// belong to the replicas and are closed when they stop.
+func (p *PeerListeners) Stop() {
+	if p == nil {
+		return
+	}
+	for _, ln := range p.listeners {
+		if err := ln.Close(); err != nil {
+			logger.Debug("Error closing peer listener", "listen_addr", ln.Addr().String(), "err", err)
+		}
+	}
+	p.wg.Wait()
+}
+
+// add registers a replica connections can be relayed through
+func (p *PeerListeners) add(c *Client) {
+	p.mu.Lock()
+	p.clients = append(p.clients, c)
+	p.mu.Unlock()
+}
+
+// pick returns the next replica connected to the gateway, nil when none is
+func (p *PeerListeners) pick() *Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	n := len(p.clients)
+	start := int(p.next.Add(1) % uint64(max(n, 1)))
+	for i := 0; i < n; i++ {
+		if c := p.clients[(start+i)%n]; c.currentConn() != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func (p *PeerListeners) serve(ln net.Listener, cfg config.PeerListener) {
+	defer p.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error("Failed to accept peer connection", "listen_addr", cfg.ListenAddr, "err", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.handle(conn, cfg)
+		}()
+	}
+}
+
+// handle runs the local handshake of a peer connection and relays it through a replica
+func (p *PeerListeners) handle(conn net.Conn, cfg config.PeerListener) {
+	_ = conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	local, address, reply, err := peerHandshake(conn, cfg)
+	if err != nil {
+		logger.Debug("Peer handshake failed", "listen_addr", cfg.ListenAddr, "remote_addr", conn.RemoteAddr().String(), "err", err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	c := p.pick()
+	if c == nil {
+		_ = reply(utils.WithErrorCode(utils.ErrCodeNoClientAvailable, errors.New("not connected to the gateway")))
+		_ = conn.Close()
+		return
+	}
+	c.openPeerConnection(local, cfg, address, reply)
+}
+
+// SetPeerListeners relays connections of the peer listeners through this replica
+func (c *Client) SetPeerListeners(p *PeerListeners) {
+	if p != nil {
+		p.add(c)
+	}
+}
+
+// openPeerConnection asks the gateway to connect conn to address through a client of the
+// listener's group, and waits until handlePeerConnectResponse takes the connection over
+func (c *Client) openPeerConnection(conn net.Conn, cfg config.PeerListener, address string, reply func(err error) error) {
+	connID := utils.GenerateConnID()
+	pending := &pendingPeer{conn: conn, address: address, reply: reply, done: make(chan struct{})}
+	c.peerDials.Store(connID, pending)
+
+	logger.Debug("Requesting peer connection", "client_id", c.getClientID(), "conn_id", connID, "group_id", cfg.GroupID, "address", address)
+	if err := c.msgHandler.WritePeerConnectMessage(connID, protocol.ProtocolTCP, address, cfg.GroupID, cfg.GroupPassword); err != nil {
+		if _, ok := c.peerDials.LoadAndDelete(connID); ok {
+			_ = reply(fmt.Errorf("failed to send peer connect request: %w", err))
+			_ = conn.Close()
+			c.spoolFailedConnection(connID, address, err)
+		}
+		return
+	}
+
+	timer := time.NewTimer(protocol.DefaultConnectTimeout + peerConnectMargin)
+	defer timer.Stop()
+	select {
+	case <-pending.done:
+		return
+	case <-timer.C:
+	case <-c.ctx.Done():
+	}
+	if _, ok := c.peerDials.LoadAndDelete(connID); ok {
+		logger.Warn("Peer connection timed out", "client_id", c.getClientID(), "conn_id", connID, "address", address)
+		_ = reply(utils.WithErrorCode(utils.ErrCodeDialTimeout, errors.New("peer connection timed out")))
+		_ = conn.Close()
+		// The gateway may still connect it, release the connection there
+		if err := c.writeCloseMessage(connID); err != nil {
+			logger.Debug("Failed to send close for timed out peer connection", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+	}
+}
+
+// handlePeerConnectResponse completes a peer connection with the gateway's connect response
+func (c *Client) handlePeerConnectResponse(msg map[string]interface{}) {
+	connID, _ := msg["id"].(string)
+	success, _ := msg["success"].(bool)
+
+	value, ok := c.peerDials.LoadAndDelete(connID)
+	if !ok {
+		logger.Debug("Connect response for unknown peer connection", "client_id", c.getClientID(), "conn_id", connID)
+		if success {
+			_ = c.writeCloseMessage(connID)
+		}
+		return
+	}
+	pending := value.(*pendingPeer)
+	defer close(pending.done)
+
+	if !success {
+		errorMsg, _ := msg["error"].(string)
+		errorCode, _ := msg["error_code"].(string)
+		logger.Warn("Peer connection refused by the gateway", "client_id", c.getClientID(), "conn_id", connID, "address", pending.address, "error", errorMsg, "error_code", errorCode)
+		code := utils.ErrorCode(errorCode)
+		if code == "" {
+			code = utils.ErrorCodeFromMessage(errorMsg)
+		}
+		_ = pending.reply(utils.WithErrorCode(code, &utils.TargetError{Msg: errorMsg}))
+		_ = pending.conn.Close()
+		return
+	}
+
+	if err := pending.reply(nil); err != nil {
+		logger.Debug("Peer application went away during connect", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		_ = pending.conn.Close()
+		_ = c.writeCloseMessage(connID)
+		return
+	}
+
+	logger.Info("Peer connection established", "client_id", c.getClientID(), "conn_id", connID, "address", pending.address)
+	c.connMgr.AddConnection(connID, pending.conn)
+	monitoring.CreateConnection(connID, c.getClientID(), pending.address)
+	c.createMessageChannel(connID)
+	c.egress.Register(connID, pending.address, c.qos.Classify(pending.address))
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.handleConnection(connID)
+	}()
+}
+
+// failPeerConnections fails the peer connections waiting for a connect response, which never
+// comes once the tunnel is gone
+func (c *Client) failPeerConnections() {
+	c.peerDials.Range(func(key, _ interface{}) bool {
+		if value, ok := c.peerDials.LoadAndDelete(key); ok {
+			pending := value.(*pendingPeer)
+			_ = pending.reply(utils.WithErrorCode(utils.ErrCodeNoClientAvailable, errors.New("connection to the gateway lost")))
+			_ = pending.conn.Close()
+			close(pending.done)
+		}
+		return true
+	})
+}
+
+// peerHandshake reads the target address from a local application. It returns the connection
+// to relay, which holds bytes read ahead, and the function writing the handshake's reply.
+func peerHandshake(conn net.Conn, cfg config.PeerListener) (net.Conn, string, func(err error) error, error) {
+	switch cfg.Protocol {
+	case config.PeerProtocolTCP:
+		return conn, cfg.Target, func(error) error { return nil }, nil
+	case config.PeerProtocolHTTP:
+		return httpConnectHandshake(conn)
+	default:
+		address, reply, err := socks5Handshake(conn)
+		return conn, address, reply, err
+	}
+}
+
+// socks5Handshake serves a SOCKS5 CONNECT without authentication, peer listeners are meant
+// for the local host or a trusted network
+func socks5Handshake(conn net.Conn) (string, func(err error) error, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", nil, err
+	}
+	if header[0] != 0x05 {
+		return "", nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Contains(methods, []byte{0x00}) {
+		_, _ = conn.Write([]byte{0x05, 0xFF})
+		return "", nil, errors.New("client offers no supported authentication method")
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return "", nil, err
+	}
+
+	// VER CMD RSV ATYP
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return "", nil, err
+	}
+	writeReply := func(code byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(peerReplyTimeout))
+		defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+		_, err := conn.Write([]byte{0x05, code, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+
+	var host string
+	switch request[3] {
+	case 0x01, 0x04:
+		ip := make(net.IP, 4)
+		if request[3] == 0x04 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", nil, err
+		}
+		host = ip.String()
+	case 0x03:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return "", nil, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", nil, err
+		}
+		host = string(name)
+	default:
+		_ = writeReply(0x08) // Address type not supported
+		return "", nil, fmt.Errorf("unsupported address type %d", request[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", nil, err
+	}
+	if request[1] != 0x01 {
+		_ = writeReply(0x07) // Command not supported
+		return "", nil, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	return address, func(err error) error {
+		if err == nil {
+			return writeReply(0x00)
+		}
+		return writeReply(socks5ReplyCode(err))
+	}, nil
+}
+
+// socks5ReplyCode maps a peer connection error to a SOCKS5 reply code
+func socks5ReplyCode(err error) byte {
+	switch utils.ErrorCodeOf(err) {
+	case utils.ErrCodeNoClientAvailable:
+		return 0x03 // Network unreachable
+	case utils.ErrCodeTargetForbidden:
+		return 0x02 // Connection not allowed by ruleset
+	case utils.ErrCodeDialTimeout:
+		return 0x06 // TTL expired
+	}
+	return 0x04 // Host unreachable
+}
+
+// httpConnectHandshake serves an HTTP CONNECT request
+func httpConnectHandshake(conn net.Conn) (net.Conn, string, func(err error) error, error) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if req.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		return nil, "", nil, fmt.Errorf("unsupported method %s", req.Method)
+	}
+	address := req.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+
+	local := conn
+	if reader.Buffered() > 0 {
+		local = &readAheadConn{Conn: conn, reader: reader}
+	}
+	return local, address, func(err error) error {
+		status := "200 Connection Established"
+		if err != nil {
+			switch utils.ErrorCodeOf(err) {
+			case utils.ErrCodeTargetForbidden:
+				status = "403 Forbidden"
+			case utils.ErrCodeNoClientAvailable:
+				status = "503 Service Unavailable"
+			case utils.ErrCodeDialTimeout:
+				status = "504 Gateway Timeout"
+			default:
+				status = "502 Bad Gateway"
+			}
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(peerReplyTimeout))
+		defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+		_, writeErr := io.WriteString(conn, "HTTP/1.1 "+status+"\r\n\r\n")
+		return writeErr
+	}, nil
+}
+
+// readAheadConn is a connection whose first bytes were already buffered by a handshake
+type readAheadConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *readAheadConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	"github.com/buhuipao/anyproxy/pkg/common/message"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// recordingConnection passes the messages written to the gateway to a channel
+type recordingConnection struct {
+	mockMessageConnection
+	messages chan []byte
+}
+
+func (r *recordingConnection) WriteMessage(data []byte) error {
+	r.messages <- data
+	return nil
+}
+
+func TestPeerListeners_SOCKS5(t *testing.T) {
+	transportConn := &recordingConnection{messages: make(chan []byte, 16)}
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		config:     &config.ClientConfig{ClientID: "test-client"},
+		ctx:        ctx,
+		cancel:     cancel,
+		conn:       transportConn,
+		connMgr:    connection.NewManager("test-client"),
+		msgHandler: message.NewClientExtendedMessageHandler(transportConn),
+	}
+	peers, err := NewPeerListeners([]config.PeerListener{{ListenAddr: "127.0.0.1:0", GroupID: "site-b", GroupPassword: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peers.Stop()
+	client.SetPeerListeners(peers)
+
+	nextMessage := func() (byte, []byte) {
+		select {
+		case data := <-transportConn.messages:
+			_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return msgType, payload
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a message to the gateway")
+		}
+		return 0, nil
+	}
+	// connect runs a SOCKS5 CONNECT to db.site-b:5432 and returns the gateway's connection ID
+	connect := func() (net.Conn, string) {
+		app, err := net.Dial("tcp", peers.Addrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		host := "db.site-b"
+		request := append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...)
+		if _, err := app.Write(append(request, 0x15, 0x38)); err != nil {
+			t.Fatal(err)
+		}
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(app, method); err != nil || method[1] != 0x00 {
+			t.Fatalf("Unexpected method selection %v, %v", method, err)
+		}
+
+		msgType, payload := nextMessage()
+		connID, network, address, groupID, groupPassword, err := protocol.UnpackPeerConnectMessage(payload)
+		if msgType != protocol.BinaryMsgTypePeerConnect || err != nil {
+			t.Fatalf("Expected a peer connect message, got 0x%02x, %v", msgType, err)
+		}
+		if network != "tcp" || address != "db.site-b:5432" || groupID != "site-b" || groupPassword != "secret" {
+			t.Errorf("Unexpected peer connect request %s %s %s %s", network, address, groupID, groupPassword)
+		}
+		return app, connID
+	}
+	readReply := func(app net.Conn) byte {
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(app, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply[1]
+	}
+
+	// Refused connections get the matching SOCKS5 reply
+	app, connID := connect()
+	client.handlePeerConnectResponse(map[string]interface{}{
+		"id": connID, "success": false, "error": "denied", "error_code": string(utils.ErrCodeTargetForbidden),
+	})
+	if code := readReply(app); code != 0x02 {
+		t.Errorf("Expected reply 0x02 for a forbidden target, got 0x%02x", code)
+	}
+	_ = app.Close()
+
+	// Accepted connections are relayed
+	app, connID = connect()
+	client.handlePeerConnectResponse(map[string]interface{}{"id": connID, "success": true})
+	if code := readReply(app); code != 0x00 {
+		t.Fatalf("Expected reply 0x00, got 0x%02x", code)
+	}
+	if _, err := app.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	msgType, payload := nextMessage()
+	dataID, data, err := protocol.UnpackDataMessage(payload)
+	if msgType != protocol.BinaryMsgTypeData || err != nil || dataID != connID || !bytes.Equal(data, []byte("ping")) {
+		t.Errorf("Expected the application data to be relayed, got 0x%02x %s %q %v", msgType, dataID, data, err)
+	}
+
+	_ = app.Close()
+	cancel()
+	client.wg.Wait()
+}
+
+func TestHTTPConnectHandshake(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go func() {
+		_, _ = io.WriteString(remote, "CONNECT db.site-b:5432 HTTP/1.1\r\nHost: db.site-b:5432\r\n\r\nhello")
+	}()
+	conn, address, reply, err := httpConnectHandshake(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "db.site-b:5432" {
+		t.Errorf("Expected address db.site-b:5432, got %s", address)
+	}
+
+	go func() {
+		_ = reply(utils.WithErrorCode(utils.ErrCodeNoClientAvailable, io.EOF))
+	}()
+	status := make([]byte, len("HTTP/1.1 503"))
+	if _, err := io.ReadFull(remote, status); err != nil || string(status) != "HTTP/1.1 503" {
+		t.Errorf("Expected a 503 reply, got %q, %v", status, err)
+	}
+
+	// Bytes sent right after the request are not lost
+	early := make([]byte, 5)
+	if _, err := io.ReadFull(conn, early); err != nil || string(early) != "hello" {
+		t.Errorf("Expected the early data to be readable, got %q, %v", early, err)
+	}
+}
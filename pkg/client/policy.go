@@ -0,0 +1,144 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/buhuipao/anyproxy/pkg/common/groupkey"
+	"github.com/buhuipao/anyproxy/pkg/common/policy"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// maxPolicyPacksSize bounds the policy packs document pushed by the gateway
+const maxPolicyPacksSize = 1 << 20
+
+// policyPack is a compiled policy.Pack
+type policyPack struct {
+	name      string
+	forbidden []*HostPattern
+	allowed   []*HostPattern
+}
+
+// allows reports whether the pack permits a connection to address, with the semantics of
+// forbidden_hosts and allowed_hosts
+func (p *policyPack) allows(address string) bool {
+	for _, pattern := range p.forbidden {
+		if matchesHostPattern(pattern, address) {
+			return false
+		}
+	}
+	if len(p.allowed) == 0 {
+		return true
+	}
+	for _, pattern := range p.allowed {
+		if matchesHostPattern(pattern, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePolicyPacks compiles the pushed packs, any invalid pattern rejects them all
+func compilePolicyPacks(packs []policy.Pack) ([]*policyPack, error) {
+	compiled := make([]*policyPack, 0, len(packs))
+	for _, pack := range packs {
+		forbidden, allowed, err := compileHostPolicy(pack.ForbiddenHosts, pack.AllowedHosts)
+		if err != nil {
+			return nil, fmt.Errorf("policy pack %s: %w", pack.Name, err)
+		}
+		compiled = append(compiled, &policyPack{name: pack.Name, forbidden: forbidden, allowed: allowed})
+	}
+	return compiled, nil
+}
+
+// verifyControl checks the signature of a control message from the gateway. Signed messages must
+// verify with the key of the group password, unsigned ones are rejected with signed_control.
+func (c *Client) verifyControl(body []byte, signature string) error {
+	if signature == "" {
+		if c.config.SignedControl {
+			return fmt.Errorf("unsigned control message, signed_control is enabled")
+		}
+		return nil
+	}
+	if !groupkey.VerifyHex(c.controlKey, body, signature) {
+		return fmt.Errorf("invalid control message signature")
+	}
+	return nil
+}
+
+// verifyOperator checks the operator signature of pushed packs when the client pins an operator
+// key. The gateway can only relay it, so packs changed on the gateway, e.g. from a web session,
+// are rejected until the operator signs them.
+func (c *Client) verifyOperator(body []byte, signature string) error {
+	if c.policyKey == nil {
+		return nil
+	}
+	return policy.Verify(c.policyKey, c.config.GroupID, body, signature)
+}
+
+// handlePolicyServiceConnect attaches a gateway connection to the policy service
+func (c *Client) handlePolicyServiceConnect(connID, network string) {
+	if network != protocol.ProtocolTCP {
+		if err := c.sendConnectResponse(connID, false, "policy service requires tcp", utils.ErrCodeTargetForbidden); err != nil {
+			logger.Error("Failed to send connect response for policy service", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+		return
+	}
+	c.attachServiceConn(connID, protocol.PolicyServiceAddress, serveInProcess(http.HandlerFunc(c.servePolicyPacks)))
+}
+
+// servePolicyPacks replaces the policy packs with the ones the gateway sends. The packs
+// outlive reconnects, so connections are never checked without them.
+func (c *Client) servePolicyPacks(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != policy.PacksPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPolicyPacksSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read policy packs: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := c.verifyControl(body, r.Header.Get(policy.SignatureHeader)); err != nil {
+		logger.Error("Rejected policy packs from gateway", "client_id", c.getClientID(), "err", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := c.verifyOperator(body, r.Header.Get(policy.OperatorSignatureHeader)); err != nil {
+		logger.Error("Rejected policy packs from gateway", "client_id", c.getClientID(), "err", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var doc policy.Packs
+	if err := json.Unmarshal(body, &doc); err != nil {
+		http.Error(w, fmt.Sprintf("invalid policy packs: %v", err), http.StatusBadRequest)
+		return
+	}
+	packs, err := compilePolicyPacks(doc.Packs)
+	if err != nil {
+		logger.Error("Rejected policy packs from gateway", "client_id", c.getClientID(), "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.policyMu.Lock()
+	c.policyPacks = packs
+	c.policyMu.Unlock()
+
+	names := make([]string, len(packs))
+	for i, pack := range packs {
+		names[i] = pack.name
+	}
+	logger.Info("Applied policy packs from gateway", "client_id", c.getClientID(), "packs", names)
+	w.WriteHeader(http.StatusNoContent)
+}
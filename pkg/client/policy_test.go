@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/groupkey"
+	"github.com/buhuipao/anyproxy/pkg/common/policy"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestServePolicyPacks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &Client{
+		config: &config.ClientConfig{ClientID: "test-client", ForbiddenHosts: []string{"*:25"}},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if err := client.compileHostPatterns(); err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(packs ...policy.Pack) int {
+		body, _ := json.Marshal(policy.Packs{Packs: packs})
+		rec := httptest.NewRecorder()
+		client.servePolicyPacks(rec, httptest.NewRequest(http.MethodPut, policy.PacksPath, bytes.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := push(
+		policy.Pack{Name: "no-metadata", ForbiddenHosts: []string{"169.254.0.0/16"}},
+		policy.Pack{Name: "internal", AllowedHosts: []string{"10.0.0.0/8", "*.corp.example.com:*"}},
+	); code != http.StatusNoContent {
+		t.Fatalf("Expected the packs to be applied, got %d", code)
+	}
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"10.1.2.3:443", true},
+		{"db.corp.example.com:5432", true},
+		{"10.1.2.3:25", false},        // The client's own forbidden_hosts
+		{"169.254.169.254:80", false}, // Forbidden by a pack
+		{"example.com:443", false},    // Not allowed by a pack
+	}
+	for _, tt := range tests {
+		if got := client.isConnectionAllowed(tt.address); got != tt.want {
+			t.Errorf("isConnectionAllowed(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+
+	// Invalid packs keep the previous ones, an empty document clears them
+	if code := push(policy.Pack{Name: "broken", AllowedHosts: []string{"10.0.0.0/99"}}); code != http.StatusBadRequest {
+		t.Errorf("Expected invalid packs to be rejected, got %d", code)
+	}
+	if client.isConnectionAllowed("example.com:443") {
+		t.Error("Expected the previous packs to stay in force")
+	}
+	if code := push(); code != http.StatusNoContent || !client.isConnectionAllowed("example.com:443") {
+		t.Errorf("Expected the packs to be cleared, got %d", code)
+	}
+}
+
+func TestServePolicyPacks_Signed(t *testing.T) {
+	cfg := &config.ClientConfig{ClientID: "test-client", GroupID: "office", GroupPassword: "secret", SignedControl: true}
+	client := &Client{config: cfg, controlKey: groupkey.Derive(cfg.GroupID, cfg.GroupPassword)}
+	if err := client.compileHostPatterns(); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(policy.Packs{Packs: []policy.Pack{{Name: "internal", AllowedHosts: []string{"10.0.0.0/8"}}}})
+
+	push := func(signature string) int {
+		req := httptest.NewRequest(http.MethodPut, policy.PacksPath, bytes.NewReader(body))
+		if signature != "" {
+			req.Header.Set(policy.SignatureHeader, signature)
+		}
+		rec := httptest.NewRecorder()
+		client.servePolicyPacks(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"unsigned", "", http.StatusForbidden},
+		{"signed by another password", groupkey.SignHex(groupkey.Derive("office", "other"), body), http.StatusForbidden},
+		{"signed", groupkey.SignHex(client.controlKey, body), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if got := push(tt.signature); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServePolicyPacks_OperatorKey(t *testing.T) {
+	operatorKey, operatorPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.ClientConfig{ClientID: "test-client", GroupID: "office", GroupPassword: "secret"}
+	client := &Client{config: cfg, controlKey: groupkey.Derive(cfg.GroupID, cfg.GroupPassword), policyKey: operatorKey}
+	if err := client.compileHostPatterns(); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, _ := policy.Marshal([]policy.Pack{{Name: "internal", AllowedHosts: []string{"10.0.0.0/8"}}})
+	// A web session changed the packs on the gateway, which signs the push with the group key
+	// as always but can't produce the operator signature
+	forged, _ := policy.Marshal([]policy.Pack{{Name: "internal", AllowedHosts: []string{"*"}}})
+
+	push := func(body []byte, operatorSignature string) int {
+		req := httptest.NewRequest(http.MethodPut, policy.PacksPath, bytes.NewReader(body))
+		req.Header.Set(policy.SignatureHeader, groupkey.SignHex(client.controlKey, body))
+		if operatorSignature != "" {
+			req.Header.Set(policy.OperatorSignatureHeader, operatorSignature)
+		}
+		rec := httptest.NewRecorder()
+		client.servePolicyPacks(rec, req)
+		return rec.Code
+	}
+
+	if code := push(signed, policy.Sign(operatorPrivateKey, "office", signed)); code != http.StatusNoContent {
+		t.Fatalf("Expected the operator signed packs to be applied, got %d", code)
+	}
+
+	tests := []struct {
+		name      string
+		body      []byte
+		signature string
+	}{
+		{"web session push without operator signature", forged, ""},
+		{"web session push with the old signature", forged, policy.Sign(operatorPrivateKey, "office", signed)},
+		{"signed by another key", forged, policy.Sign(otherPrivateKey, "office", forged)},
+		{"signed for another group", forged, policy.Sign(operatorPrivateKey, "lab", forged)},
+		{"clearing the packs", []byte(`{"packs":[]}`), ""},
+	}
+	for _, tt := range tests {
+		if got := push(tt.body, tt.signature); got != http.StatusForbidden {
+			t.Errorf("%s: got %d, want %d", tt.name, got, http.StatusForbidden)
+		}
+	}
+	if client.isConnectionAllowed("example.com:443") {
+		t.Error("Expected the operator signed packs to stay in force")
+	}
+}
@@ -0,0 +1,420 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+const (
+	// defaultPoolMaxIdlePerHost is the number of idle connections kept per target when not configured
+	defaultPoolMaxIdlePerHost = 4
+	// defaultPoolIdleTimeout is how long an idle target connection is kept when not configured
+	defaultPoolIdleTimeout = 90 * time.Second
+	// poolLivenessProbe is how long a pooled connection is probed for EOF before reuse
+	poolLivenessProbe = time.Millisecond
+)
+
+// idleConn is a target connection waiting in the pool
+type idleConn struct {
+	conn    net.Conn
+	idledAt time.Time
+}
+
+// targetPool keeps idle TCP connections to targets so that connect requests for the same
+// host:port can skip the handshake. Prewarmed connections never carried traffic and serve any
+// proxy user. A used connection is only pooled when the gateway scoped it to its proxy user and
+// the connection sits between HTTP/1.1 requests, and it is only handed to the same user again.
+type targetPool struct {
+	mu          sync.Mutex
+	idle        map[string][]*idleConn // pool key -> idle connections (oldest first)
+	active      map[string]string      // conn ID -> pool key for reusable connections in use
+	releasing   map[string]bool        // conn IDs being handed back to the pool
+	maxIdle     int
+	idleTimeout time.Duration
+	patterns    []*HostPattern // targets eligible for pooling (empty = all)
+
+	prewarm         []config.PrewarmTarget // targets kept topped up with idle connections
+	prewarmInterval time.Duration
+	refill          chan struct{} // wakes the prewarm loop when a prewarmed connection was taken
+}
+
+// newTargetPool creates a target pool from configuration, returns nil when pooling is disabled
+func newTargetPool(cfg config.ConnectionPoolConfig) (*targetPool, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	pool := &targetPool{
+		idle:        make(map[string][]*idleConn),
+		active:      make(map[string]string),
+		releasing:   make(map[string]bool),
+		maxIdle:     cfg.MaxIdlePerHost,
+		idleTimeout: cfg.IdleTimeout,
+
+		prewarmInterval: cfg.PrewarmInterval,
+		refill:          make(chan struct{}, 1),
+	}
+	if pool.maxIdle == 0 {
+		pool.maxIdle = defaultPoolMaxIdlePerHost
+	}
+	if pool.idleTimeout == 0 {
+		pool.idleTimeout = defaultPoolIdleTimeout
+	}
+	if pool.prewarmInterval == 0 {
+		pool.prewarmInterval = defaultPrewarmInterval
+	}
+
+	for _, pattern := range cfg.Hosts {
+		compiled, err := compileHostPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		pool.patterns = append(pool.patterns, compiled)
+	}
+
+	for _, target := range cfg.Prewarm {
+		target.Connections = min(max(target.Connections, 1), pool.maxIdle)
+		pool.prewarm = append(pool.prewarm, target)
+	}
+
+	return pool, nil
+}
+
+// poolKey returns the key of idle connections to a target, scoped ones are kept apart per proxy user
+func poolKey(scope, address string) string {
+	if scope == "" {
+		return address
+	}
+	return scope + "/" + address
+}
+
+// enabledFor reports whether connections to the target may be pooled
+func (p *targetPool) enabledFor(network, address string) bool {
+	if p == nil || network != "tcp" {
+		return false
+	}
+	if len(p.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range p.patterns {
+		if matchesHostPattern(pattern, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns a live idle connection for the pool key, or nil if none is available
+func (p *targetPool) get(key string) net.Conn {
+	for {
+		p.mu.Lock()
+		stale := p.pruneLocked(key, time.Now())
+		var candidate net.Conn
+		if conns := p.idle[key]; len(conns) > 0 {
+			// Reuse the most recently idled connection
+			candidate = conns[len(conns)-1].conn
+			p.setIdleLocked(key, conns[:len(conns)-1])
+		}
+		p.mu.Unlock()
+
+		closeConns(stale)
+
+		if candidate == nil {
+			return nil
+		}
+		if isConnAlive(candidate) {
+			return candidate
+		}
+		logger.Debug("Discarding dead pooled target connection", "key", key)
+		_ = candidate.Close()
+	}
+}
+
+// put adds an idle connection to the pool, it returns false if the pool is full
+// and the caller keeps ownership of the connection
+func (p *targetPool) put(key string, conn net.Conn) bool {
+	p.mu.Lock()
+	stale := p.pruneLocked(key, time.Now())
+	conns := p.idle[key]
+	stored := len(conns) < p.maxIdle
+	if stored {
+		p.idle[key] = append(conns, &idleConn{conn: conn, idledAt: time.Now()})
+	}
+	p.mu.Unlock()
+
+	closeConns(stale)
+	return stored
+}
+
+// track records that a reusable connection is in use
+func (p *targetPool) track(connID, key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active[connID] = key
+}
+
+// untrack forgets a connection that is being closed instead of pooled
+func (p *targetPool) untrack(connID string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.active, connID)
+	delete(p.releasing, connID)
+}
+
+// markReleasing flags an in-use connection to be handed back to the pool,
+// it returns false if the connection is not reusable
+func (p *targetPool) markReleasing(connID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.active[connID]; !ok {
+		return false
+	}
+	p.releasing[connID] = true
+	return true
+}
+
+// takeReleasing returns the pool key if the connection was flagged for release
+func (p *targetPool) takeReleasing(connID string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.releasing[connID] {
+		return "", false
+	}
+	key := p.active[connID]
+	delete(p.active, connID)
+	delete(p.releasing, connID)
+	return key, true
+}
+
+// isReleasing reports whether the connection was flagged for release
+func (p *targetPool) isReleasing(connID string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.releasing[connID]
+}
+
+// untrackAll forgets all in-use connections, used when they are closed in bulk
+func (p *targetPool) untrackAll() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = make(map[string]string)
+	p.releasing = make(map[string]bool)
+}
+
+// idleCount returns the number of idle connections kept for a pool key
+func (p *targetPool) idleCount(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle[key])
+}
+
+// evictIdle closes the idle connections of all pool keys that outlived the idle timeout
+func (p *targetPool) evictIdle() {
+	now := time.Now()
+	p.mu.Lock()
+	var stale []net.Conn
+	for key := range p.idle {
+		stale = append(stale, p.pruneLocked(key, now)...)
+	}
+	p.mu.Unlock()
+
+	closeConns(stale)
+	if len(stale) > 0 {
+		logger.Debug("Evicted idle pooled target connections", "count", len(stale))
+	}
+}
+
+// closeIdle closes all idle connections
+func (p *targetPool) closeIdle() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*idleConn)
+	p.mu.Unlock()
+
+	var conns []net.Conn
+	for _, idleConns := range idle {
+		for _, ic := range idleConns {
+			conns = append(conns, ic.conn)
+		}
+	}
+	closeConns(conns)
+	if len(conns) > 0 {
+		logger.Debug("Closed idle pooled target connections", "count", len(conns))
+	}
+}
+
+// setIdleLocked stores the idle list for a pool key, caller must hold p.mu
+func (p *targetPool) setIdleLocked(key string, conns []*idleConn) {
+	if len(conns) == 0 {
+		delete(p.idle, key)
+		return
+	}
+	p.idle[key] = conns
+}
+
+// pruneLocked removes expired idle connections for a pool key and returns them
+// for closing, caller must hold p.mu
+func (p *targetPool) pruneLocked(key string, now time.Time) []net.Conn {
+	conns := p.idle[key]
+	expired := 0
+	for expired < len(conns) && now.Sub(conns[expired].idledAt) > p.idleTimeout {
+		expired++
+	}
+	if expired == 0 {
+		return nil
+	}
+
+	stale := make([]net.Conn, 0, expired)
+	for _, ic := range conns[:expired] {
+		stale = append(stale, ic.conn)
+	}
+	p.setIdleLocked(key, conns[expired:])
+	return stale
+}
+
+// closeConns closes connections removed from the pool
+func closeConns(conns []net.Conn) {
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// isConnAlive checks that an idle connection has not been closed by the target
+// and has no unsolicited data pending
+func isConnAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(poolLivenessProbe)); err != nil {
+		return false
+	}
+	var probe [1]byte
+	n, err := conn.Read(probe[:])
+	_ = conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// pooledTarget returns an idle connection to the target when available, one left by an earlier
+// session of the same proxy user first, then a prewarmed one
+func (c *Client) pooledTarget(connID, network, address, scope string) net.Conn {
+	if !c.pool.enabledFor(network, address) {
+		return nil
+	}
+	if scope != "" {
+		if conn := c.pool.get(poolKey(scope, address)); conn != nil {
+			logger.Debug("Reusing pooled target connection", "client_id", c.getClientID(), "conn_id", connID, "address", address)
+			return conn
+		}
+	}
+	conn := c.pool.get(address)
+	if conn != nil {
+		logger.Debug("Using prewarmed target connection", "client_id", c.getClientID(), "conn_id", connID, "address", address)
+		c.pool.requestRefill(address)
+	}
+	return conn
+}
+
+// reusableTarget wraps a target connection so it can be pooled for the same proxy user once the
+// gateway closes it, connections without a scope are closed with their session
+func (c *Client) reusableTarget(connID, network, address, scope string, conn net.Conn) net.Conn {
+	if scope == "" || !c.pool.enabledFor(network, address) {
+		return conn
+	}
+	c.pool.track(connID, poolKey(scope, address))
+	return newHTTPConn(conn)
+}
+
+// releaseConnection hands a gateway-closed connection back to the pool,
+// it returns false if the connection is not reusable
+func (c *Client) releaseConnection(connID string) bool {
+	if c.pool == nil {
+		return false
+	}
+	conn, ok := c.connMgr.GetConnection(connID)
+	if !ok {
+		c.pool.untrack(connID)
+		return false
+	}
+	if hc, ok := conn.(*httpConn); !ok || !hc.idle() || !c.pool.markReleasing(connID) {
+		return false
+	}
+
+	monitoring.CloseConnection(connID)
+
+	// Interrupt the reader, it completes the release in finishRelease
+	if err := conn.SetReadDeadline(time.Now()); err != nil {
+		logger.Debug("Failed to interrupt pooled connection reader", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		c.cleanupConnection(connID)
+	}
+	return true
+}
+
+// finishRelease is called by the connection reader once it stopped reading,
+// it returns true if the reader should exit without closing the connection
+func (c *Client) finishRelease(connID string, conn net.Conn) bool {
+	if c.pool == nil {
+		return false
+	}
+	key, ok := c.pool.takeReleasing(connID)
+	if !ok {
+		return false
+	}
+
+	// Detach from connection manager without closing the target connection
+	c.connMgr.RemoveConnection(connID)
+	c.connMgr.RemoveMessageChannel(connID)
+
+	// The target may have sent more since the release was flagged
+	hc, ok := conn.(*httpConn)
+	if ok && hc.idle() && conn.SetDeadline(time.Time{}) == nil && c.pool.put(key, hc.Conn) {
+		logger.Debug("Target connection returned to pool", "client_id", c.getClientID(), "conn_id", connID, "idle_connections", c.pool.idleCount(key))
+		return true
+	}
+
+	logger.Debug("Target connection not reusable or pool full, closing it", "client_id", c.getClientID(), "conn_id", connID)
+	_ = conn.Close()
+	return true
+}
+
+// startIdleEviction closes pooled connections that outlived the idle timeout while the client runs,
+// also those of proxy users that never connect to the target again
+func (c *Client) startIdleEviction() {
+	if c.pool == nil {
+		return
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.pool.idleTimeout)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+				c.pool.evictIdle()
+			}
+		}
+	}()
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	"github.com/buhuipao/anyproxy/pkg/common/message"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// startPoolTestServer starts a TCP listener that keeps accepted connections open
+func startPoolTestServer(t *testing.T) (string, chan net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	return listener.Addr().String(), accepted
+}
+
+func TestNewTargetPool(t *testing.T) {
+	pool, err := newTargetPool(config.ConnectionPoolConfig{})
+	if err != nil || pool != nil {
+		t.Fatalf("Expected nil pool when disabled, got %v (err: %v)", pool, err)
+	}
+
+	pool, err = newTargetPool(config.ConnectionPoolConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pool.maxIdle != defaultPoolMaxIdlePerHost || pool.idleTimeout != defaultPoolIdleTimeout {
+		t.Errorf("Expected defaults, got max_idle=%d idle_timeout=%v", pool.maxIdle, pool.idleTimeout)
+	}
+
+	pool, err = newTargetPool(config.ConnectionPoolConfig{Enabled: true, Hosts: []string{"*.internal:80"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !pool.enabledFor("tcp", "api.internal:80") {
+		t.Error("Expected matching host to be eligible")
+	}
+	if pool.enabledFor("tcp", "example.com:80") {
+		t.Error("Expected non-matching host not to be eligible")
+	}
+	if pool.enabledFor("udp", "api.internal:80") {
+		t.Error("Expected UDP targets not to be pooled")
+	}
+}
+
+func TestTargetPool_GetPut(t *testing.T) {
+	addr, accepted := startPoolTestServer(t)
+
+	pool, err := newTargetPool(config.ConnectionPoolConfig{Enabled: true, MaxIdlePerHost: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer pool.closeIdle()
+
+	if conn := pool.get(addr); conn != nil {
+		t.Fatal("Expected empty pool")
+	}
+
+	conn1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn2.Close()
+
+	if !pool.put(addr, conn1) {
+		t.Fatal("Expected first connection to be pooled")
+	}
+	if pool.put(addr, conn2) {
+		t.Error("Expected pool to reject connection beyond max_idle_per_host")
+	}
+
+	if conn := pool.get(addr); conn != conn1 {
+		t.Errorf("Expected pooled connection to be reused")
+	}
+	if pool.idleCount(addr) != 0 {
+		t.Errorf("Expected no idle connections after get, got %d", pool.idleCount(addr))
+	}
+
+	// A connection closed by the target is discarded
+	if !pool.put(addr, conn1) {
+		t.Fatal("Expected connection to be pooled")
+	}
+	serverSide := <-accepted
+	_ = serverSide.Close()
+	time.Sleep(50 * time.Millisecond)
+	if conn := pool.get(addr); conn != nil {
+		t.Error("Expected dead connection to be discarded")
+	}
+}
+
+func TestTargetPool_IdleTimeout(t *testing.T) {
+	addr, _ := startPoolTestServer(t)
+
+	pool, err := newTargetPool(config.ConnectionPoolConfig{Enabled: true, IdleTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	pool.put(addr, conn)
+
+	time.Sleep(50 * time.Millisecond)
+	if got := pool.get(addr); got != nil {
+		t.Error("Expected expired connection not to be reused")
+	}
+	if pool.idleCount(addr) != 0 {
+		t.Errorf("Expected expired connection to be removed, got %d idle", pool.idleCount(addr))
+	}
+
+	// Connections of proxy users that don't come back are evicted too
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	key := poolKey("scope-a", addr)
+	pool.put(key, conn)
+	time.Sleep(50 * time.Millisecond)
+	pool.evictIdle()
+	if pool.idleCount(key) != 0 {
+		t.Errorf("Expected expired scoped connection to be evicted, got %d idle", pool.idleCount(key))
+	}
+}
+
+func TestClient_ReuseScopedConnection(t *testing.T) {
+	var dials atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	pool, err := newTargetPool(config.ConnectionPoolConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer pool.closeIdle()
+
+	transportConn := &recordingConnection{messages: make(chan []byte, 64)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Client{
+		config:     &config.ClientConfig{ClientID: "test-client"},
+		ctx:        ctx,
+		cancel:     cancel,
+		connMgr:    connection.NewManager("test-client"),
+		msgHandler: message.NewClientExtendedMessageHandler(transportConn),
+		pool:       pool,
+	}
+	if err := c.compileHostPatterns(); err != nil {
+		t.Fatal(err)
+	}
+
+	// session sends one request through a new proxy connection of the scope and closes it
+	// like the gateway does once the response arrived
+	session := func(connID, scope, request string) {
+		t.Helper()
+		c.handleConnectMessage(map[string]interface{}{"id": connID, "network": "tcp", "address": addr, "scope": scope})
+		c.handleDataMessage(map[string]interface{}{"id": connID, "data": []byte(request)})
+
+		var response []byte
+		for !bytes.HasSuffix(response, []byte("ok")) {
+			select {
+			case msg := <-transportConn.messages:
+				if _, msgType, payload, err := protocol.UnpackBinaryHeader(msg); err == nil && msgType == protocol.BinaryMsgTypeData {
+					if _, data, err := protocol.UnpackDataMessage(payload); err == nil {
+						response = append(response, data...)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("No response for %s, got %q", connID, response)
+			}
+		}
+		c.handleCloseMessage(map[string]interface{}{"id": connID})
+	}
+	waitIdle := func(key string, want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for pool.idleCount(key) != want && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if n := pool.idleCount(key); n != want {
+			t.Fatalf("Expected %d idle connections for %s, got %d", want, key, n)
+		}
+	}
+
+	const get = "GET / HTTP/1.1\r\nHost: api.internal\r\n\r\n"
+	session("conn-1", "scope-a", get)
+	waitIdle(poolKey("scope-a", addr), 1)
+
+	// The second request of the same proxy user reuses the connection
+	session("conn-2", "scope-a", get)
+	waitIdle(poolKey("scope-a", addr), 1)
+	if n := dials.Load(); n != 1 {
+		t.Errorf("Expected the second request to reuse the connection, target saw %d connections", n)
+	}
+
+	// Another proxy user never gets it
+	session("conn-3", "scope-b", get)
+	if n := dials.Load(); n != 2 {
+		t.Errorf("Expected another proxy user to get a new connection, target saw %d connections", n)
+	}
+	waitIdle(poolKey("scope-b", addr), 1)
+
+	// A connection asked to close, or without a scope, is not kept
+	session("conn-4", "scope-c", "GET / HTTP/1.1\r\nHost: api.internal\r\nConnection: close\r\n\r\n")
+	session("conn-5", "", get)
+	waitIdle(poolKey("scope-c", addr), 0)
+	waitIdle(addr, 0)
+	if n := dials.Load(); n != 4 {
+		t.Errorf("Expected new connections for the last two sessions, target saw %d connections", n)
+	}
+	if n := c.connMgr.GetConnectionCount(); n != 0 {
+		t.Errorf("Expected no connections left open, got %d", n)
+	}
+}
@@ -1,32 +1,77 @@
 package client
 
 import (
+	"fmt"
+
+	"github.com/buhuipao/anyproxy/pkg/common/groupkey"
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 )
 
 // sendPortForwardingRequest sends port forwarding request
 func (c *Client) sendPortForwardingRequest() error {
-	if len(c.config.OpenPorts) == 0 {
+	openPorts := c.currentOpenPorts()
+	if len(openPorts) == 0 {
 		return nil
 	}
+	return c.writePortForwardRequest(openPorts)
+}
 
-	logger.Debug("Preparing port forwarding request", "client_id", c.getClientID(), "port_count", len(c.config.OpenPorts))
+// writePortForwardRequest sends the complete port set, an empty set closes all ports of the client
+func (c *Client) writePortForwardRequest(openPorts []config.OpenPort) error {
+	logger.Debug("Preparing port forwarding request", "client_id", c.getClientID(), "port_count", len(openPorts))
 
 	// Build port configuration list
-	ports := make([]protocol.PortConfig, 0, len(c.config.OpenPorts))
-	for _, port := range c.config.OpenPorts {
+	ports := make([]protocol.PortConfig, 0, len(openPorts))
+	for _, port := range openPorts {
 		ports = append(ports, protocol.PortConfig{
-			RemotePort: port.RemotePort,
-			LocalPort:  port.LocalPort,
-			LocalHost:  port.LocalHost,
-			Protocol:   port.Protocol,
+			RemotePort:     port.RemotePort,
+			LocalPort:      port.LocalPort,
+			LocalHost:      port.LocalHost,
+			Protocol:       port.Protocol,
+			AllowedSources: port.AllowedSources,
 		})
 	}
 
 	// Send port forwarding request using binary format
+	conn := c.currentConn()
+	if conn == nil {
+		return fmt.Errorf("not connected to gateway")
+	}
 	binaryMsg := protocol.PackPortForwardMessage(c.getClientID(), ports)
-	return c.conn.WriteMessage(binaryMsg)
+	if c.controlKey != nil {
+		binaryMsg = protocol.PackSignedPortForwardMessage(c.getClientID(), ports, func(body []byte) []byte {
+			return groupkey.Sign(c.controlKey, body)
+		})
+	}
+	return conn.WriteMessage(binaryMsg)
+}
+
+// currentOpenPorts returns the open ports of the latest applied config and the discovered services
+func (c *Client) currentOpenPorts() []config.OpenPort {
+	c.policyMu.RLock()
+	defer c.policyMu.RUnlock()
+	if len(c.discoveredPorts) == 0 {
+		return c.openPorts
+	}
+
+	type portKey struct {
+		port     int
+		protocol string
+	}
+	taken := make(map[portKey]bool, len(c.openPorts))
+	ports := make([]config.OpenPort, 0, len(c.openPorts)+len(c.discoveredPorts))
+	for _, port := range c.openPorts {
+		taken[portKey{port.RemotePort, port.Protocol}] = true
+		ports = append(ports, port)
+	}
+	for _, port := range c.discoveredPorts {
+		if !taken[portKey{port.RemotePort, port.Protocol}] {
+			ports = append(ports, port)
+		}
+	}
+	return ports
 }
 
 // handlePortForwardResponse handles port forwarding response
@@ -76,7 +76,8 @@ func TestSendPortForwardingRequest(t *testing.T) {
 					ClientID:  "test-client",
 					OpenPorts: tt.openPorts,
 				},
-				conn: mockConn,
+				openPorts: tt.openPorts,
+				conn:      mockConn,
 			}
 
 			// Send port forwarding request
@@ -220,3 +221,7 @@ func (m *mockConnForPortForward) GetGroupID() string {
 func (m *mockConnForPortForward) GetPassword() string {
 	return "test-password"
 }
+
+func (m *mockConnForPortForward) GetClientVersion() string {
+	return ""
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultPrewarmInterval is how often prewarmed targets are topped up when not configured
+const defaultPrewarmInterval = 30 * time.Second
+
+// missing returns how many idle connections a target lacks to reach count, expired ones are closed first
+func (p *targetPool) missing(address string, count int) int {
+	p.mu.Lock()
+	stale := p.pruneLocked(address, time.Now())
+	idle := len(p.idle[address])
+	p.mu.Unlock()
+
+	closeConns(stale)
+	return max(count-idle, 0)
+}
+
+// requestRefill wakes the prewarm loop when a connection to a prewarmed target was taken
+func (p *targetPool) requestRefill(address string) {
+	for _, target := range p.prewarm {
+		if target.Address != address {
+			continue
+		}
+		select {
+		case p.refill <- struct{}{}:
+		default:
+		}
+		return
+	}
+}
+
+// startPrewarm keeps idle connections open to the prewarmed targets while the client runs
+func (c *Client) startPrewarm() {
+	targets := c.prewarmTargets()
+	if len(targets) == 0 {
+		return
+	}
+	logger.Info("Prewarming target connections", "client_id", c.getClientID(), "targets", len(targets), "interval", c.pool.prewarmInterval)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.pool.prewarmInterval)
+		defer ticker.Stop()
+		for {
+			c.prewarm(targets)
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+			case <-c.pool.refill:
+			}
+		}
+	}()
+}
+
+// prewarmTargets returns the prewarmed targets the client may pool, skipping forbidden ones
+func (c *Client) prewarmTargets() []config.PrewarmTarget {
+	if c.pool == nil {
+		return nil
+	}
+	targets := make([]config.PrewarmTarget, 0, len(c.pool.prewarm))
+	for _, target := range c.pool.prewarm {
+		if !c.isConnectionAllowed(target.Address) || !c.pool.enabledFor("tcp", target.Address) {
+			logger.Warn("Not prewarming target, it is forbidden or not eligible for pooling", "client_id", c.getClientID(), "address", target.Address)
+			continue
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// prewarm opens the idle connections missing for each target
+func (c *Client) prewarm(targets []config.PrewarmTarget) {
+	for _, target := range targets {
+		missing := c.pool.missing(target.Address, target.Connections)
+		opened := 0
+		for ; opened < missing && c.ctx.Err() == nil; opened++ {
+			ctx, cancel := context.WithTimeout(c.ctx, protocol.DefaultConnectTimeout)
+			conn, err := c.dialTarget(ctx, "tcp", target.Address)
+			cancel()
+			if err != nil {
+				logger.Warn("Failed to prewarm target connection", "client_id", c.getClientID(), "address", target.Address, "err", err)
+				break
+			}
+			if !c.pool.put(target.Address, conn) {
+				_ = conn.Close()
+				break
+			}
+		}
+		if opened > 0 {
+			logger.Debug("Prewarmed target connections", "client_id", c.getClientID(), "address", target.Address, "opened", opened, "idle_connections", c.pool.idleCount(target.Address))
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestPrewarm(t *testing.T) {
+	addr, accepted := startPoolTestServer(t)
+
+	pool, err := newTargetPool(config.ConnectionPoolConfig{
+		Enabled:        true,
+		MaxIdlePerHost: 2,
+		Prewarm:        []config.PrewarmTarget{{Address: addr, Connections: 5}, {Address: "forbidden.example.com:443"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pool.prewarm[0].Connections != 2 || pool.prewarm[1].Connections != 1 {
+		t.Fatalf("Expected connections capped at max_idle_per_host and defaulted to 1, got %+v", pool.prewarm)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Client{
+		config:  &config.ClientConfig{ForbiddenHosts: []string{"forbidden.example.com"}},
+		connMgr: connection.NewManager("test-client"),
+		pool:    pool,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if err := c.compileHostPatterns(); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := c.prewarmTargets()
+	if len(targets) != 1 || targets[0].Address != addr {
+		t.Fatalf("Expected only the allowed target, got %+v", targets)
+	}
+
+	c.prewarm(targets)
+	if n := pool.idleCount(addr); n != 2 {
+		t.Fatalf("Expected 2 prewarmed connections, got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the target to accept the prewarmed connections")
+		}
+	}
+
+	// A taken connection is reopened on the next round
+	conn := c.pooledTarget("conn-1", "tcp", addr, "")
+	if conn == nil {
+		t.Fatal("Expected a prewarmed connection")
+	}
+	select {
+	case <-pool.refill:
+	default:
+		t.Error("Expected taking a prewarmed connection to request a refill")
+	}
+	c.prewarm(targets)
+	if n := pool.idleCount(addr); n != 2 {
+		t.Errorf("Expected the pool to be topped up to 2, got %d", n)
+	}
+
+	// A connection that carried a proxy session is closed with it, never pooled again
+	c.connMgr.AddConnection("conn-1", conn)
+	c.handleCloseMessage(map[string]interface{}{"id": "conn-1"})
+	if n := pool.idleCount(addr); n != 2 {
+		t.Errorf("Expected the used connection not to be pooled, got %d idle", n)
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("Expected the used connection to be closed")
+	}
+	pool.closeIdle()
+}
@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 
+	"github.com/buhuipao/anyproxy/pkg/common/autotls"
+	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 )
 
@@ -25,27 +28,41 @@ type HostPattern struct {
 
 // compileHostPatterns pre-compiles all host patterns with enhanced support for CIDR and port matching
 func (c *Client) compileHostPatterns() error {
+	forbidden, allowed, err := compileHostPolicy(c.config.ForbiddenHosts, c.config.AllowedHosts)
+	if err != nil {
+		return err
+	}
+
+	c.policyMu.Lock()
+	c.forbiddenHostPatterns = forbidden
+	c.allowedHostPatterns = allowed
+	c.policyMu.Unlock()
+	return nil
+}
+
+// compileHostPolicy compiles forbidden and allowed host patterns
+func compileHostPolicy(forbiddenHosts, allowedHosts []string) (forbidden, allowed []*HostPattern, err error) {
 	// Compile forbidden hosts patterns
-	c.forbiddenHostPatterns = make([]*HostPattern, 0, len(c.config.ForbiddenHosts))
-	for _, pattern := range c.config.ForbiddenHosts {
+	forbidden = make([]*HostPattern, 0, len(forbiddenHosts))
+	for _, pattern := range forbiddenHosts {
 		compiled, err := compileHostPattern(pattern)
 		if err != nil {
-			return fmt.Errorf("invalid forbidden host pattern '%s': %v", pattern, err)
+			return nil, nil, fmt.Errorf("invalid forbidden host pattern '%s': %w", pattern, err)
 		}
-		c.forbiddenHostPatterns = append(c.forbiddenHostPatterns, compiled)
+		forbidden = append(forbidden, compiled)
 	}
 
 	// Compile allowed hosts patterns
-	c.allowedHostPatterns = make([]*HostPattern, 0, len(c.config.AllowedHosts))
-	for _, pattern := range c.config.AllowedHosts {
+	allowed = make([]*HostPattern, 0, len(allowedHosts))
+	for _, pattern := range allowedHosts {
 		compiled, err := compileHostPattern(pattern)
 		if err != nil {
-			return fmt.Errorf("invalid allowed host pattern '%s': %v", pattern, err)
+			return nil, nil, fmt.Errorf("invalid allowed host pattern '%s': %w", pattern, err)
 		}
-		c.allowedHostPatterns = append(c.allowedHostPatterns, compiled)
+		allowed = append(allowed, compiled)
 	}
 
-	return nil
+	return forbidden, allowed, nil
 }
 
 // compileHostPattern compiles a single host pattern with support for CIDR, port matching, and regex
@@ -83,7 +100,7 @@ func compileCIDRPattern(pattern, original string) (*HostPattern, error) {
 			// Parse CIDR
 			_, network, err := net.ParseCIDR(cidrPart)
 			if err != nil {
-				return nil, fmt.Errorf("invalid CIDR notation: %v", err)
+				return nil, fmt.Errorf("invalid CIDR notation: %w", err)
 			}
 
 			// Parse port
@@ -113,7 +130,7 @@ func compileCIDRPattern(pattern, original string) (*HostPattern, error) {
 	// Simple CIDR without port
 	_, network, err := net.ParseCIDR(pattern)
 	if err != nil {
-		return nil, fmt.Errorf("invalid CIDR notation: %v", err)
+		return nil, fmt.Errorf("invalid CIDR notation: %w", err)
 	}
 
 	return &HostPattern{
@@ -226,7 +243,7 @@ func convertWildcardToRegex(pattern string) string {
 func compileRegexPattern(pattern, original string) (*HostPattern, error) {
 	regex, err := regexp.Compile(pattern)
 	if err != nil {
-		return nil, fmt.Errorf("invalid regex pattern: %v", err)
+		return nil, fmt.Errorf("invalid regex pattern: %w", err)
 	}
 
 	return &HostPattern{
@@ -395,8 +412,21 @@ func matchesPortWildcardPattern(pattern *HostPattern, address string) bool {
 
 // isConnectionAllowed checks if connection is allowed using enhanced pattern matching
 func (c *Client) isConnectionAllowed(address string) bool {
+	c.policyMu.RLock()
+	forbiddenHostPatterns, allowedHostPatterns := c.forbiddenHostPatterns, c.allowedHostPatterns
+	packs := c.policyPacks
+	c.policyMu.RUnlock()
+
+	// Every policy pack pushed by the gateway has to allow the connection as well
+	for _, pack := range packs {
+		if !pack.allows(address) {
+			logger.Warn("🚫 CONNECTION BLOCKED - Policy pack", "client_id", c.getClientID(), "address", address, "policy_pack", pack.name, "action", "Connection rejected by a policy pack of the gateway")
+			return false
+		}
+	}
+
 	// First check if it's forbidden using new pattern system
-	for _, pattern := range c.forbiddenHostPatterns {
+	for _, pattern := range forbiddenHostPatterns {
 		if matchesHostPattern(pattern, address) {
 			logger.Warn("🚫 CONNECTION BLOCKED - Forbidden host", "client_id", c.getClientID(), "address", address, "pattern", pattern.Original, "pattern_type", pattern.Type, "action", "Connection rejected due to forbidden host policy")
 			return false
@@ -404,13 +434,13 @@ func (c *Client) isConnectionAllowed(address string) bool {
 	}
 
 	// If no allowed hosts are configured, allow all non-forbidden connections
-	if len(c.allowedHostPatterns) == 0 {
+	if len(allowedHostPatterns) == 0 {
 		logger.Debug("Connection allowed - no allowed hosts configured", "client_id", c.getClientID(), "address", address)
 		return true
 	}
 
 	// Check if it's in the allowed list using new pattern system
-	for _, pattern := range c.allowedHostPatterns {
+	for _, pattern := range allowedHostPatterns {
 		if matchesHostPattern(pattern, address) {
 			logger.Debug("Connection allowed - matches allowed pattern", "client_id", c.getClientID(), "address", address, "pattern", pattern.Original, "pattern_type", pattern.Type)
 			return true
@@ -421,6 +451,42 @@ func (c *Client) isConnectionAllowed(address string) bool {
 	return false
 }
 
+// enrollCA fetches the CA of a gateway with auto_tls into tls_cert when the file doesn't exist
+func (c *Client) enrollCA() error {
+	gw := c.config.Gateway
+	if gw.EnrollToken == "" {
+		return nil
+	}
+	if _, err := config.ReadPEMFile(gw.TLSCert); err == nil {
+		return nil
+	}
+	ca, err := autotls.FetchCA(c.ctx, gw.EnrollURL, gw.EnrollToken)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(gw.TLSCert), 0o750); err != nil {
+		return fmt.Errorf("failed to create CA directory: %w", err)
+	}
+	// Replicas enroll at the same time, none may read a partly written file
+	tmp, err := os.CreateTemp(filepath.Dir(gw.TLSCert), ".enroll-*")
+	if err != nil {
+		return fmt.Errorf("failed to store the gateway CA: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(ca); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to store the gateway CA: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to store the gateway CA: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), gw.TLSCert); err != nil {
+		return fmt.Errorf("failed to store the gateway CA: %w", err)
+	}
+	logger.Info("Enrolled with the gateway, stored its CA", "client_id", c.getClientID(), "enroll_url", gw.EnrollURL, "tls_cert", gw.TLSCert)
+	return nil
+}
+
 // createTLSConfig creates TLS configuration
 func (c *Client) createTLSConfig() (*tls.Config, error) {
 	tlsConfig := &tls.Config{
@@ -429,9 +495,9 @@ func (c *Client) createTLSConfig() (*tls.Config, error) {
 
 	// If TLS certificate is provided, load it
 	if c.config.Gateway.TLSCert != "" {
-		certPEM, err := os.ReadFile(c.config.Gateway.TLSCert)
+		certPEM, err := config.ReadPEMFile(c.config.Gateway.TLSCert)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read TLS certificate: %v", err)
+			return nil, fmt.Errorf("failed to read TLS certificate: %w", err)
 		}
 
 		certPool := x509.NewCertPool()
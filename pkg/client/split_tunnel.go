@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+const (
+	// defaultDomainRefresh is how often the domains of split tunneling are resolved again
+	defaultDomainRefresh = 5 * time.Minute
+	// domainAddrRefreshes is how many refreshes an address a domain no longer resolves to stays
+	// routed, so connections to it survive DNS rotating the addresses of the domain
+	domainAddrRefreshes = 3
+	// domainLookupTimeout bounds the resolution of one domain
+	domainLookupTimeout = 10 * time.Second
+)
+
+// routeTable installs the routes into a TUN interface
+type routeTable interface {
+	SetRoutes(prefixes []netip.Prefix) error
+}
+
+// splitTunnel routes the configured prefixes and the addresses of the configured domains into
+// the TUN interface, everything else keeps the host's routes. Domains are resolved with the
+// host's resolver, like the applications connecting to them.
+type splitTunnel struct {
+	routes routeTable
+	bypass []netip.Addr // Kept off the interface, e.g. the gateway's addresses
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	mu       sync.Mutex
+	static   []netip.Prefix
+	domains  []string
+	refresh  time.Duration
+	round    int
+	resolved map[string]map[netip.Addr]int // Addresses of each domain, with the round they were last returned
+
+	wakeCh chan struct{}
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newSplitTunnel starts resolving the domains of cfg and routing their addresses
+func newSplitTunnel(routes routeTable, bypass []netip.Addr, cfg config.ClientTunConfig) *splitTunnel {
+	s := &splitTunnel{
+		routes:   routes,
+		bypass:   bypass,
+		lookup:   lookupHost,
+		resolved: make(map[string]map[netip.Addr]int),
+		wakeCh:   make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+	s.configure(cfg)
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// lookupHost resolves a host with the host's resolver
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// configure replaces the routes and domains, addresses of removed domains are unrouted with the
+// next update
+func (s *splitTunnel) configure(cfg config.ClientTunConfig) {
+	static := make([]netip.Prefix, 0, len(cfg.Routes))
+	for _, route := range cfg.Routes {
+		// Validated with the config
+		if p, err := netip.ParsePrefix(route); err == nil {
+			static = append(static, p)
+		}
+	}
+	refresh := cfg.DomainRefresh
+	if refresh <= 0 {
+		refresh = defaultDomainRefresh
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.static = static
+	s.domains = slices.Clone(cfg.Domains)
+	s.refresh = refresh
+	for domain := range s.resolved {
+		if !slices.Contains(s.domains, domain) {
+			delete(s.resolved, domain)
+		}
+	}
+}
+
+// reconfigure applies new routes and domains right away
+func (s *splitTunnel) reconfigure(cfg config.ClientTunConfig) {
+	s.configure(cfg)
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops resolving domains, the routes go with the interface
+func (s *splitTunnel) stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+}
+
+func (s *splitTunnel) run() {
+	defer s.wg.Done()
+	for {
+		s.update()
+		s.mu.Lock()
+		refresh := s.refresh
+		s.mu.Unlock()
+
+		timer := time.NewTimer(refresh)
+		select {
+		case <-s.stopCh:
+			timer.Stop()
+			return
+		case <-s.wakeCh:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// update resolves the domains and installs the routes
+func (s *splitTunnel) update() {
+	s.mu.Lock()
+	domains := slices.Clone(s.domains)
+	s.mu.Unlock()
+
+	answers := make(map[string][]netip.Addr, len(domains))
+	for _, domain := range domains {
+		ctx, cancel := context.WithTimeout(context.Background(), domainLookupTimeout)
+		addrs, err := s.lookup(ctx, domain)
+		cancel()
+		if err != nil {
+			// The previous addresses stay routed until the domain resolves again
+			logger.Warn("Failed to resolve split tunneling domain", "domain", domain, "err", err)
+			continue
+		}
+		answers[domain] = addrs
+	}
+
+	prefixes := s.prefixes(answers)
+	if err := s.routes.SetRoutes(prefixes); err != nil {
+		logger.Error("Failed to update TUN routes", "err", err)
+		return
+	}
+	logger.Debug("TUN routes updated", "routes", len(prefixes), "domains", len(domains))
+}
+
+// prefixes records the answers of a refresh and returns the routes into the interface
+func (s *splitTunnel) prefixes(answers map[string][]netip.Addr) []netip.Prefix {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.round++
+
+	prefixes := slices.Clone(s.static)
+	seen := make(map[netip.Addr]bool)
+	for _, domain := range s.domains {
+		addrs := s.resolved[domain]
+		if addrs == nil {
+			addrs = make(map[netip.Addr]int)
+			s.resolved[domain] = addrs
+		}
+		answer, ok := answers[domain]
+		for _, addr := range answer {
+			addrs[addr.Unmap()] = s.round
+		}
+		for addr, last := range addrs {
+			if !ok {
+				addrs[addr] = s.round
+			} else if s.round-last >= domainAddrRefreshes {
+				delete(addrs, addr)
+				continue
+			}
+			if !seen[addr] && !slices.Contains(s.bypass, addr) {
+				seen[addr] = true
+				prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
+	}
+	return prefixes
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// fakeRouteTable records the routes set into an interface
+type fakeRouteTable struct {
+	mu      sync.Mutex
+	routes  []string
+	updates chan struct{}
+}
+
+func (r *fakeRouteTable) SetRoutes(prefixes []netip.Prefix) error {
+	r.mu.Lock()
+	r.routes = r.routes[:0]
+	for _, p := range prefixes {
+		r.routes = append(r.routes, p.String())
+	}
+	slices.Sort(r.routes)
+	r.mu.Unlock()
+	r.updates <- struct{}{}
+	return nil
+}
+
+func (r *fakeRouteTable) wait(t *testing.T) []string {
+	t.Helper()
+	select {
+	case <-r.updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Routes were not updated")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.routes)
+}
+
+func TestSplitTunnel(t *testing.T) {
+	gateway := netip.MustParseAddr("203.0.113.1")
+	var mu sync.Mutex
+	answers := map[string][]netip.Addr{
+		"git.corp.example.com":  {netip.MustParseAddr("198.51.100.10")},
+		"wiki.corp.example.com": {netip.MustParseAddr("198.51.100.20"), gateway},
+	}
+	lookup := func(_ context.Context, host string) ([]netip.Addr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		addrs, ok := answers[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return addrs, nil
+	}
+
+	routes := &fakeRouteTable{updates: make(chan struct{}, 8)}
+	s := &splitTunnel{
+		routes:   routes,
+		bypass:   []netip.Addr{gateway},
+		lookup:   lookup,
+		resolved: make(map[string]map[netip.Addr]int),
+		wakeCh:   make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+	cfg := config.ClientTunConfig{
+		TunConfig: config.TunConfig{Routes: []string{"10.0.0.0/8"}},
+		Domains:   []string{"git.corp.example.com", "wiki.corp.example.com"},
+	}
+	s.configure(cfg)
+	s.wg.Add(1)
+	go s.run()
+	defer s.stop()
+
+	// The gateway's address stays off the interface
+	want := []string{"10.0.0.0/8", "198.51.100.10/32", "198.51.100.20/32"}
+	if got := routes.wait(t); !slices.Equal(got, want) {
+		t.Fatalf("Routes = %v, want %v", got, want)
+	}
+
+	// A rotated address stays routed for a few refreshes
+	mu.Lock()
+	answers["git.corp.example.com"] = []netip.Addr{netip.MustParseAddr("198.51.100.11")}
+	mu.Unlock()
+	s.reconfigure(cfg)
+	want = []string{"10.0.0.0/8", "198.51.100.10/32", "198.51.100.11/32", "198.51.100.20/32"}
+	if got := routes.wait(t); !slices.Equal(got, want) {
+		t.Fatalf("Routes = %v, want %v", got, want)
+	}
+	for i := 1; i < domainAddrRefreshes; i++ {
+		s.reconfigure(cfg)
+		routes.wait(t)
+	}
+	s.reconfigure(cfg)
+	want = []string{"10.0.0.0/8", "198.51.100.11/32", "198.51.100.20/32"}
+	if got := routes.wait(t); !slices.Equal(got, want) {
+		t.Fatalf("Routes = %v, want %v", got, want)
+	}
+
+	// Removed domains and routes are unrouted right away, a domain that fails to resolve
+	// keeps nothing it never had
+	s.reconfigure(config.ClientTunConfig{
+		TunConfig: config.TunConfig{Routes: []string{"172.16.0.0/12"}},
+		Domains:   []string{"wiki.corp.example.com", "missing.corp.example.com"},
+	})
+	want = []string{"172.16.0.0/12", "198.51.100.20/32"}
+	if got := routes.wait(t); !slices.Equal(got, want) {
+		t.Fatalf("Routes = %v, want %v", got, want)
+	}
+}
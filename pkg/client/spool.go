@@ -0,0 +1,271 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/message"
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Spool defaults
+const (
+	defaultSpoolMaxBytes = 16 * 1024 * 1024
+	// spoolRecordsPerReport keeps each report well below the gateway's message size limit
+	spoolRecordsPerReport = 500
+	// spoolFileExt is the extension of spool files, one JSON report per line
+	spoolFileExt = ".jsonl"
+
+	spoolReasonOutage = "gateway connection lost"
+)
+
+// spool keeps reports of gateway outages on disk until they are uploaded. Each outage is
+// written to its own file, the oldest files are dropped when the spool is full.
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	current string // File of the ongoing outage, empty while connected
+}
+
+// newSpool creates the spool directory, it returns nil when no directory is configured
+func newSpool(cfg config.SpoolConfig) (*spool, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	maxBytes := cfg.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	return &spool{dir: cfg.Dir, maxBytes: maxBytes}, nil
+}
+
+// add appends a report to the file of the ongoing outage
+func (s *spool) add(report *monitoring.ClientReport) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == "" {
+		s.current = filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolFileExt))
+	}
+	if err := s.makeRoom(int64(len(data))); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.current, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// makeRoom drops the oldest outages until size more bytes fit, s.mu must be held
+func (s *spool) makeRoom(size int64) error {
+	files, total, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if total+size <= s.maxBytes || file.path == s.current {
+			break
+		}
+		if err := os.Remove(file.path); err != nil {
+			return err
+		}
+		total -= file.size
+		logger.Warn("Spool full, dropped the oldest outage report", "file", file.path, "bytes", file.size)
+	}
+	if total+size > s.maxBytes {
+		return fmt.Errorf("spool full: %d of %d bytes used", total, s.maxBytes)
+	}
+	return nil
+}
+
+// spoolFile is a file in the spool directory
+type spoolFile struct {
+	path string
+	size int64
+}
+
+// files returns the spool files oldest first and their total size
+func (s *spool) files() ([]spoolFile, int64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var files []spoolFile
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolFileExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, spoolFile{path: filepath.Join(s.dir, entry.Name()), size: info.Size()})
+		total += info.Size()
+	}
+	// Names are zero padded timestamps
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files, total, nil
+}
+
+// upload sends the spooled reports oldest first and removes the files sent. The ongoing
+// outage ends, later reports start a new file.
+func (s *spool) upload(send func(report []byte) error) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	s.mu.Lock()
+	s.current = ""
+	files, _, err := s.files()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file.path)
+		if err != nil {
+			return sent, err
+		}
+		for len(data) > 0 {
+			line := data
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				line = data[:i]
+			}
+			if len(line) > 0 {
+				if err := send(line); err != nil {
+					// Keep the reports not sent for the next reconnect
+					if writeErr := os.WriteFile(file.path, data, 0o600); writeErr != nil {
+						logger.Warn("Failed to rewrite spool file", "file", file.path, "err", writeErr)
+					}
+					return sent, err
+				}
+				sent++
+			}
+			data = data[min(len(line)+1, len(data)):]
+		}
+		if err := os.Remove(file.path); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// spoolOutage records the connections ended by the loss of the gateway connection
+func (c *Client) spoolOutage() {
+	if c.spool == nil {
+		return
+	}
+	now := time.Now()
+	clientID := c.getClientID()
+
+	var records []monitoring.ConnectionRecord
+	for connID, conn := range monitoring.GetAllConnectionMetrics() {
+		if conn.ClientID != clientID {
+			continue
+		}
+		records = append(records, monitoring.ConnectionRecord{
+			ConnectionID:  connID,
+			TargetHost:    conn.TargetHost,
+			StartTime:     conn.StartTime,
+			EndTime:       now,
+			BytesSent:     conn.BytesSent,
+			BytesReceived: conn.BytesReceived,
+			Reason:        spoolReasonOutage,
+		})
+	}
+	c.peerDials.Range(func(key, value interface{}) bool {
+		records = append(records, monitoring.ConnectionRecord{
+			ConnectionID: key.(string),
+			TargetHost:   value.(*pendingPeer).address,
+			EndTime:      now,
+			Reason:       spoolReasonOutage,
+		})
+		return true
+	})
+	if len(records) == 0 {
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].StartTime.Before(records[j].StartTime) })
+
+	for len(records) > 0 {
+		batch := records
+		if len(batch) > spoolRecordsPerReport {
+			batch = batch[:spoolRecordsPerReport]
+		}
+		records = records[len(batch):]
+
+		// The gateway already counted these connections and their bytes, only the failures are new
+		delta := &monitoring.MetricsDelta{Errors: int64(len(batch))}
+		c.addSpoolReport(&monitoring.ClientReport{ClientID: clientID, From: now, To: now, Records: batch, Delta: delta})
+	}
+}
+
+// spoolFailedConnection records a connection that failed because the gateway was unreachable
+func (c *Client) spoolFailedConnection(connID, address string, err error) {
+	if c.spool == nil {
+		return
+	}
+	now := time.Now()
+	c.addSpoolReport(&monitoring.ClientReport{
+		ClientID: c.getClientID(),
+		From:     now,
+		To:       now,
+		Records: []monitoring.ConnectionRecord{{
+			ConnectionID: connID,
+			TargetHost:   address,
+			StartTime:    now,
+			EndTime:      now,
+			Reason:       err.Error(),
+		}},
+		Delta: &monitoring.MetricsDelta{Connections: 1, Errors: 1},
+	})
+}
+
+// addSpoolReport writes a report to the spool, failures only lose the report
+func (c *Client) addSpoolReport(report *monitoring.ClientReport) {
+	if err := c.spool.add(report); err != nil {
+		logger.Warn("Failed to spool outage report", "client_id", c.getClientID(), "records", len(report.Records), "err", err)
+	}
+}
+
+// uploadSpool sends the reports spooled during previous outages to the gateway
+func (c *Client) uploadSpool(handler message.ExtendedMessageHandler) {
+	sent, err := c.spool.upload(handler.WriteReportMessage)
+	if err != nil {
+		logger.Warn("Failed to upload spooled outage reports, retrying after the next reconnect", "client_id", c.getClientID(), "sent", sent, "err", err)
+		return
+	}
+	if sent > 0 {
+		logger.Info("Uploaded spooled outage reports", "client_id", c.getClientID(), "reports", sent)
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestSpool(t *testing.T) {
+	s, err := newSpool(config.SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"first", "second"} {
+		if err := s.add(&monitoring.ClientReport{ClientID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A failed upload keeps the reports not sent
+	var sent []string
+	failed := false
+	send := func(report []byte) error {
+		var r monitoring.ClientReport
+		if err := json.Unmarshal(report, &r); err != nil {
+			t.Fatalf("Invalid spooled report %q: %v", report, err)
+		}
+		if r.ClientID == "second" && !failed {
+			failed = true
+			return errors.New("connection lost")
+		}
+		sent = append(sent, r.ClientID)
+		return nil
+	}
+	if n, err := s.upload(send); err == nil || n != 1 {
+		t.Fatalf("Expected the upload to stop after one report, got %d, %v", n, err)
+	}
+	if n, err := s.upload(send); err != nil || n != 1 {
+		t.Fatalf("Expected the remaining report to be uploaded, got %d, %v", n, err)
+	}
+	if len(sent) != 2 || sent[0] != "first" || sent[1] != "second" {
+		t.Errorf("Unexpected uploads: %v", sent)
+	}
+	if files, _, _ := s.files(); len(files) != 0 {
+		t.Errorf("Expected an empty spool after the upload, got %v", files)
+	}
+
+	var none *spool
+	if err := none.add(&monitoring.ClientReport{}); err != nil {
+		t.Errorf("Expected a disabled spool to ignore reports, got %v", err)
+	}
+}
+
+func TestSpool_DropsOldestOutage(t *testing.T) {
+	dir := t.TempDir()
+	report := &monitoring.ClientReport{ClientID: "client", Records: []monitoring.ConnectionRecord{{TargetHost: "example.com:443"}}}
+	data, _ := json.Marshal(report)
+	s, err := newSpool(config.SpoolConfig{Dir: dir, MaxBytes: int64(2*len(data) + 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two outages fill the spool, the third drops the first one
+	for i := 0; i < 3; i++ {
+		if err := s.add(report); err != nil {
+			t.Fatal(err)
+		}
+		s.mu.Lock()
+		s.current = ""
+		s.mu.Unlock()
+	}
+	files, total, err := s.files()
+	if err != nil || len(files) != 2 || total > s.maxBytes {
+		t.Errorf("Expected two outages within %d bytes, got %v (%d bytes), %v", s.maxBytes, files, total, err)
+	}
+
+	// A single outage can't grow beyond the limit
+	for i := 0; i < 2; i++ {
+		_ = s.add(report)
+	}
+	if err := s.add(report); err == nil {
+		t.Error("Expected an error adding to a full outage")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the ongoing outage to be kept, got %d files", len(entries))
+	}
+}
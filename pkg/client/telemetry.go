@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/message"
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Heartbeat defaults
+const (
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultTelemetryDiskPath = "/"
+)
+
+// hostStats are the platform specific host measurements, zero when unavailable
+type hostStats struct {
+	cpuBusy      uint64 // Cumulative busy CPU time in ticks
+	cpuTotal     uint64 // Cumulative total CPU time in ticks
+	load1        float64
+	load5        float64
+	load15       float64
+	memTotal     uint64
+	memAvailable uint64
+	diskTotal    uint64
+	diskFree     uint64
+}
+
+// telemetryCollector samples host and process telemetry for heartbeats
+type telemetryCollector struct {
+	diskPath  string
+	startTime time.Time
+	readHost  func(diskPath string) hostStats
+	readSent  func() int64 // Bytes sent to the gateway so far
+
+	// Load score inputs
+	connections    func() int // Active proxied connections, nil when not counted
+	maxConnections int        // Connection limit of the client, 0 when unlimited
+	bandwidth      int64      // Uplink bytes per second, 0 when unknown
+
+	checks func() []monitoring.CheckResult // Latest synthetic check results, nil when none are configured
+
+	mu        sync.Mutex
+	prevBusy  uint64
+	prevTotal uint64
+	prevSent  int64
+	prevAt    time.Time
+}
+
+// newTelemetryCollector creates a collector reporting usage of diskPath
+func newTelemetryCollector(diskPath string) *telemetryCollector {
+	if diskPath == "" {
+		diskPath = defaultTelemetryDiskPath
+	}
+	return &telemetryCollector{
+		diskPath:  diskPath,
+		startTime: time.Now(),
+		readHost:  readHostStats,
+		readSent:  transportBytesSent,
+	}
+}
+
+// transportBytesSent returns the bytes the transports of the process sent, framing included
+func transportBytesSent() int64 {
+	var sent int64
+	for _, stats := range monitoring.GetTransportStats() {
+		sent += stats.PayloadBytesSent + stats.FramingBytesSent
+	}
+	return sent
+}
+
+// collect returns the current telemetry, CPU usage and send rate are measured since the
+// previous call
+func (t *telemetryCollector) collect() *monitoring.ClientTelemetry {
+	host := t.readHost(t.diskPath)
+	sent, now := t.readSent(), time.Now()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	hostname, _ := os.Hostname()
+
+	telemetry := &monitoring.ClientTelemetry{
+		Version:       version.Version,
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Hostname:      hostname,
+		UptimeSeconds: int64(time.Since(t.startTime).Seconds()),
+		NumCPU:        runtime.NumCPU(),
+		Load1:         host.load1,
+		Load5:         host.load5,
+		Load15:        host.load15,
+		MemTotal:      host.memTotal,
+		MemAvailable:  host.memAvailable,
+		DiskPath:      t.diskPath,
+		DiskTotal:     host.diskTotal,
+		DiskFree:      host.diskFree,
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     memStats.HeapAlloc,
+	}
+
+	t.mu.Lock()
+	if t.prevTotal > 0 && host.cpuTotal > t.prevTotal && host.cpuBusy >= t.prevBusy {
+		usage := float64(host.cpuBusy-t.prevBusy) / float64(host.cpuTotal-t.prevTotal) * 100
+		telemetry.CPUPercent = float64(int(usage*10)) / 10
+	}
+	t.prevBusy, t.prevTotal = host.cpuBusy, host.cpuTotal
+	if elapsed := now.Sub(t.prevAt).Seconds(); !t.prevAt.IsZero() && elapsed > 0 && sent >= t.prevSent {
+		telemetry.SendRate = int64(float64(sent-t.prevSent) / elapsed)
+	}
+	t.prevSent, t.prevAt = sent, now
+	t.mu.Unlock()
+
+	if t.connections != nil {
+		telemetry.ActiveConnections = t.connections()
+	}
+	telemetry.Bandwidth = t.bandwidth
+	if t.checks != nil {
+		telemetry.Checks = t.checks()
+	}
+	score := loadScore(telemetry, t.maxConnections)
+	telemetry.LoadScore = &score
+	return telemetry
+}
+
+// loadScore rates how busy the client is from 0 (idle) to 1 (saturated), as the busiest of its
+// CPU, memory, connection slots and uplink bandwidth
+func loadScore(telemetry *monitoring.ClientTelemetry, maxConnections int) float64 {
+	score := telemetry.CPUPercent / 100
+	if telemetry.MemTotal > 0 && telemetry.MemAvailable <= telemetry.MemTotal {
+		score = max(score, 1-float64(telemetry.MemAvailable)/float64(telemetry.MemTotal))
+	}
+	if maxConnections > 0 {
+		score = max(score, float64(telemetry.ActiveConnections)/float64(maxConnections))
+	}
+	if telemetry.Bandwidth > 0 {
+		score = max(score, float64(telemetry.SendRate)/float64(telemetry.Bandwidth))
+	}
+	return math.Round(min(score, 1)*100) / 100
+}
+
+// startHeartbeat sends telemetry to the gateway periodically until the returned function is called
+func (c *Client) startHeartbeat(handler message.ExtendedMessageHandler) (stop func()) {
+	interval := c.config.Heartbeat.Interval
+	if interval < 0 {
+		return func() {}
+	}
+	if interval == 0 {
+		interval = defaultHeartbeatInterval
+	}
+
+	done := make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := c.sendHeartbeat(handler); err != nil {
+				logger.Warn("Failed to send heartbeat", "client_id", c.getClientID(), "err", err)
+			}
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// sendHeartbeat collects and sends one heartbeat
+func (c *Client) sendHeartbeat(handler message.ExtendedMessageHandler) error {
+	data, err := json.Marshal(c.telemetry.collect())
+	if err != nil {
+		return err
+	}
+	logger.Debug("Sending heartbeat", "client_id", c.getClientID(), "bytes", len(data))
+	return handler.WriteHeartbeatMessage(data)
+}
+
+// parseProcStat returns cumulative busy and total CPU ticks from /proc/stat content
+func parseProcStat(data string) (busy, total uint64, ok bool) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		// user nice system idle iowait irq softirq steal, guest time is already part of user
+		var idle uint64
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, 0, false
+			}
+			total += value
+			if i == 3 || i == 4 {
+				idle += value
+			}
+		}
+		return total - idle, total, true
+	}
+	return 0, 0, false
+}
+
+// parseLoadAvg returns the 1, 5 and 15 minute load averages from /proc/loadavg content
+func parseLoadAvg(data string) (load1, load5, load15 float64, ok bool) {
+	fields := strings.Fields(data)
+	if len(fields) < 3 {
+		return 0, 0, 0, false
+	}
+	var loads [3]float64
+	for i := range loads {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return 0, 0, 0, false
+		}
+		loads[i] = value
+	}
+	return loads[0], loads[1], loads[2], true
+}
+
+// parseMemInfo returns total and available memory in bytes from /proc/meminfo content
+func parseMemInfo(data string) (memTotal, memAvailable uint64) {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		// Values are reported in kB
+		switch fields[0] {
+		case "MemTotal:":
+			memTotal = value * 1024
+		case "MemAvailable:":
+			memAvailable = value * 1024
+		}
+	}
+	return memTotal, memAvailable
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// readHostStats reads CPU, load and memory from /proc and disk usage with statfs
+func readHostStats(diskPath string) hostStats {
+	var stats hostStats
+
+	if data, err := os.ReadFile("/proc/stat"); err == nil {
+		stats.cpuBusy, stats.cpuTotal, _ = parseProcStat(string(data))
+	}
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		stats.load1, stats.load5, stats.load15, _ = parseLoadAvg(string(data))
+	}
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		stats.memTotal, stats.memAvailable = parseMemInfo(string(data))
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(diskPath, &fs); err == nil {
+		stats.diskTotal = fs.Blocks * uint64(fs.Bsize) //nolint:gosec // block size is positive
+		stats.diskFree = fs.Bavail * uint64(fs.Bsize)  //nolint:gosec // block size is positive
+	}
+	return stats
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package client
+
+// readHostStats is not implemented on this platform, only process telemetry is reported
+func readHostStats(string) hostStats {
+	return hostStats{}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestParseProcStat(t *testing.T) {
+	data := "cpu  100 5 50 800 20 3 2 0 10 0\ncpu0 50 2 25 400 10 1 1 0 5 0\nintr 12345\n"
+	busy, total, ok := parseProcStat(data)
+	if !ok {
+		t.Fatal("Expected /proc/stat to parse")
+	}
+	// Guest time is excluded, idle and iowait are not busy
+	if total != 980 || busy != 160 {
+		t.Errorf("Expected busy=160 total=980, got busy=%d total=%d", busy, total)
+	}
+
+	if _, _, ok := parseProcStat("intr 12345\n"); ok {
+		t.Error("Expected missing cpu line to fail")
+	}
+}
+
+func TestParseLoadAvgAndMemInfo(t *testing.T) {
+	load1, load5, load15, ok := parseLoadAvg("0.52 0.48 0.40 2/345 6789\n")
+	if !ok || load1 != 0.52 || load5 != 0.48 || load15 != 0.40 {
+		t.Errorf("Unexpected load averages: %v %v %v (ok=%v)", load1, load5, load15, ok)
+	}
+
+	memTotal, memAvailable := parseMemInfo("MemTotal:       16384 kB\nMemFree:         1024 kB\nMemAvailable:    8192 kB\n")
+	if memTotal != 16384*1024 || memAvailable != 8192*1024 {
+		t.Errorf("Unexpected memory: total=%d available=%d", memTotal, memAvailable)
+	}
+}
+
+func TestTelemetryCollector_CPUPercent(t *testing.T) {
+	samples := []hostStats{
+		{cpuBusy: 100, cpuTotal: 1000, memTotal: 2048},
+		{cpuBusy: 125, cpuTotal: 1100, memTotal: 2048},
+	}
+	collector := newTelemetryCollector("")
+	collector.readHost = func(string) hostStats {
+		sample := samples[0]
+		samples = samples[1:]
+		return sample
+	}
+
+	// The first sample has no baseline to compare against
+	if first := collector.collect(); first.CPUPercent != 0 || first.DiskPath != defaultTelemetryDiskPath {
+		t.Errorf("Unexpected first telemetry: %+v", first)
+	}
+	if second := collector.collect(); second.CPUPercent != 25 || second.MemTotal != 2048 {
+		t.Errorf("Expected 25%% CPU, got %+v", second)
+	}
+}
+
+func TestTelemetryCollector_LoadScore(t *testing.T) {
+	collector := newTelemetryCollector("")
+	collector.readHost = func(string) hostStats {
+		return hostStats{memTotal: 1000, memAvailable: 800}
+	}
+	sent := int64(0)
+	collector.readSent = func() int64 { return sent }
+	collector.connections = func() int { return 5 }
+	collector.maxConnections = 10
+	collector.bandwidth = 1 << 30
+
+	// Half of the connection slots are used, more than memory
+	if telemetry := collector.collect(); telemetry.LoadScore == nil || *telemetry.LoadScore != 0.5 || telemetry.ActiveConnections != 5 {
+		t.Errorf("Expected a load score of 0.5, got %+v", telemetry)
+	}
+
+	// A saturated uplink caps the score at 1
+	collector.bandwidth = 1
+	sent = 1 << 20
+	if telemetry := collector.collect(); *telemetry.LoadScore != 1 || telemetry.SendRate <= 0 {
+		t.Errorf("Expected a saturated load score, got %+v", telemetry)
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/tun"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// PacketTunnel exchanges the IP packets of a TUN interface with the gateway. It is shared by
+// all replicas of the process, packets are sent through the first replica connected to the
+// gateway so the packets of a flow aren't reordered across tunnels.
+type PacketTunnel struct {
+	device io.ReadWriteCloser
+	mtu    int
+	split  *splitTunnel // Routes of the interface, nil when they can't change
+
+	mu      sync.RWMutex
+	clients []*Client
+
+	wg sync.WaitGroup
+}
+
+// NewPacketTunnel opens the TUN interface, it returns nil when TUN mode is disabled.
+// The gateway addresses keep their route when the interface's routes or domains cover them.
+func NewPacketTunnel(cfg config.ClientTunConfig, gatewayAddrs []string) (*PacketTunnel, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	opts := tun.Options{Name: cfg.Name, Address: cfg.Address, MTU: cfg.MTU, Routes: cfg.Routes}
+	if len(cfg.Routes) > 0 || len(cfg.Domains) > 0 {
+		for _, gatewayAddr := range gatewayAddrs {
+			bypass, err := resolveGateway(gatewayAddr)
+			if err != nil {
+				return nil, err
+			}
+			opts.Bypass = append(opts.Bypass, bypass...)
+		}
+	}
+	device, err := tun.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("TUN interface opened", "name", device.Name(), "address", cfg.Address, "mtu", device.MTU(), "routes", cfg.Routes, "domains", cfg.Domains)
+	t := newPacketTunnel(device, device.MTU())
+	t.split = newSplitTunnel(device, opts.Bypass, cfg)
+	return t, nil
+}
+
+func newPacketTunnel(device io.ReadWriteCloser, mtu int) *PacketTunnel {
+	t := &PacketTunnel{device: device, mtu: mtu}
+	t.wg.Add(1)
+	go t.readPackets()
+	return t
+}
+
+// resolveGateway returns the addresses of the gateway host
+func resolveGateway(gatewayAddr string) ([]netip.Addr, error) {
+	hostport := gatewayAddr
+	if strings.Contains(gatewayAddr, "://") {
+		u, err := url.Parse(gatewayAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway address %s: %w", gatewayAddr, err)
+		}
+		hostport = u.Host
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve gateway %s: %w", host, err)
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, nil
+}
+
+// Reconfigure replaces the routes and domains routed into the interface
+func (t *PacketTunnel) Reconfigure(cfg config.ClientTunConfig) {
+	if t == nil || t.split == nil {
+		return
+	}
+	t.split.reconfigure(cfg)
+}
+
+// Stop closes the TUN interface
+func (t *PacketTunnel) Stop() {
+	if t == nil {
+		return
+	}
+	if t.split != nil {
+		t.split.stop()
+	}
+	if err := t.device.Close(); err != nil {
+		logger.Debug("Error closing TUN interface", "err", err)
+	}
+	t.wg.Wait()
+}
+
+// add registers a replica packets can be sent through
+func (t *PacketTunnel) add(c *Client) {
+	t.mu.Lock()
+	t.clients = append(t.clients, c)
+	t.mu.Unlock()
+}
+
+// pick returns the first replica connected to the gateway, nil when none is
+func (t *PacketTunnel) pick() *Client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, c := range t.clients {
+		if c.currentConn() != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// readPackets sends the packets routed into the interface to the gateway. Packets are
+// dropped while no replica is connected, like a link that is down.
+func (t *PacketTunnel) readPackets() {
+	defer t.wg.Done()
+	buf := make([]byte, t.mtu)
+	for {
+		n, err := t.device.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) && !errors.Is(err, io.EOF) {
+				logger.Error("Failed to read from TUN interface", "err", err)
+			}
+			return
+		}
+		c := t.pick()
+		if c == nil || n == 0 {
+			continue
+		}
+		if err := c.writeDataMessage(protocol.PacketConnID, buf[:n]); err != nil {
+			logger.Debug("Failed to send packet to gateway", "client_id", c.getClientID(), "err", err)
+		}
+	}
+}
+
+// deliver writes a packet from the gateway to the interface
+func (t *PacketTunnel) deliver(packet []byte) {
+	if t == nil || len(packet) == 0 {
+		return
+	}
+	if _, err := t.device.Write(packet); err != nil {
+		logger.Debug("Failed to write packet to TUN interface", "bytes", len(packet), "err", err)
+	}
+}
+
+// SetPacketTunnel exchanges the packets of the TUN interface through this replica.
+// It must be called before Start.
+func (c *Client) SetPacketTunnel(t *PacketTunnel) {
+	if t != nil {
+		c.tun = t
+		t.add(c)
+	}
+}
+
+// announcePacketTunnel tells the gateway that this client exchanges packets
+func (c *Client) announcePacketTunnel() {
+	if c.tun == nil {
+		return
+	}
+	if err := c.writeDataMessage(protocol.PacketConnID, nil); err != nil {
+		logger.Error("Failed to announce TUN mode to gateway", "client_id", c.getClientID(), "err", err)
+	}
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	"github.com/buhuipao/anyproxy/pkg/common/message"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// fakeTunDevice is a TUN interface backed by channels
+type fakeTunDevice struct {
+	in     chan []byte // Packets routed into the interface
+	out    chan []byte // Packets written to the interface
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (d *fakeTunDevice) Read(p []byte) (int, error) {
+	select {
+	case packet := <-d.in:
+		return copy(p, packet), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *fakeTunDevice) Write(p []byte) (int, error) {
+	d.out <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (d *fakeTunDevice) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+func TestPacketTunnel(t *testing.T) {
+	device := &fakeTunDevice{in: make(chan []byte, 4), out: make(chan []byte, 4), closed: make(chan struct{})}
+	packets := newPacketTunnel(device, 1500)
+	defer packets.Stop()
+
+	transportConn := &recordingConnection{messages: make(chan []byte, 16)}
+	client := &Client{
+		config:     &config.ClientConfig{ClientID: "test-client"},
+		ctx:        context.Background(),
+		conn:       transportConn,
+		connMgr:    connection.NewManager("test-client"),
+		msgHandler: message.NewClientExtendedMessageHandler(transportConn),
+	}
+	client.SetPacketTunnel(packets)
+
+	nextPacket := func() []byte {
+		select {
+		case data := <-transportConn.messages:
+			_, _, payload, err := protocol.UnpackBinaryHeader(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			connID, packet, err := protocol.UnpackDataMessage(payload)
+			if err != nil || connID != protocol.PacketConnID {
+				t.Fatalf("Expected a packet message, got %s, %v", connID, err)
+			}
+			return packet
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a packet to the gateway")
+		}
+		return nil
+	}
+
+	client.announcePacketTunnel()
+	if packet := nextPacket(); len(packet) != 0 {
+		t.Errorf("Expected an empty announcement, got %v", packet)
+	}
+
+	outbound := []byte{0x45, 0x00, 0x00, 0x14}
+	device.in <- outbound
+	if packet := nextPacket(); !bytes.Equal(packet, outbound) {
+		t.Errorf("Expected the interface's packet to be sent, got %v", packet)
+	}
+
+	inbound := []byte{0x45, 0x00, 0x00, 0x15}
+	client.routeMessage(map[string]interface{}{"type": protocol.MsgTypeData, "id": protocol.PacketConnID, "data": inbound})
+	if packet := <-device.out; !bytes.Equal(packet, inbound) {
+		t.Errorf("Expected the gateway's packet to be written, got %v", packet)
+	}
+}
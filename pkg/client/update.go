@@ -0,0 +1,297 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/update"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Self-update defaults
+const (
+	defaultMaxUpdateSize = 256 << 20
+	// updateCheckInterval is how often a staged update is checked against the maintenance window
+	updateCheckInterval = time.Minute
+)
+
+// Updater receives signed client binaries pushed by the gateway and applies them during
+// the maintenance window. It is shared by all client replicas of the process.
+type Updater struct {
+	publicKey ed25519.PublicKey
+	window    *update.Window
+	maxSize   int64
+	execPath  string
+	version   string
+	platform  string
+	now       func() time.Time
+
+	mu        sync.Mutex
+	staged    *stagedUpdate
+	receiving bool // A binary is being received, replicas may be offered the same update concurrently
+	ready     chan struct{}
+	once      sync.Once
+	stopCh    chan struct{}
+	stop      sync.Once
+}
+
+// stagedUpdate is a verified binary waiting for the maintenance window
+type stagedUpdate struct {
+	version string
+	path    string
+}
+
+// NewUpdater creates an updater replacing the running executable
+func NewUpdater(cfg *config.AutoUpdateConfig) (*Updater, error) {
+	if err := checkSelfUpdateSupported(); err != nil {
+		return nil, err
+	}
+	publicKey, err := update.ParsePublicKey(cfg.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	window, err := update.ParseWindow(cfg.Window)
+	if err != nil {
+		return nil, err
+	}
+	execPath, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate executable: %w", err)
+	}
+	if execPath, err = filepath.EvalSymlinks(execPath); err != nil {
+		return nil, fmt.Errorf("failed to resolve executable: %w", err)
+	}
+
+	maxSize := cfg.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultMaxUpdateSize
+	}
+	return &Updater{
+		publicKey: publicKey,
+		window:    window,
+		maxSize:   maxSize,
+		execPath:  execPath,
+		version:   version.Version,
+		platform:  update.Platform(runtime.GOOS, runtime.GOARCH),
+		now:       time.Now,
+		ready:     make(chan struct{}),
+		stopCh:    make(chan struct{}),
+	}, nil
+}
+
+// Start checks for a staged update entering the maintenance window until Stop is called
+func (u *Updater) Start() {
+	go func() {
+		ticker := time.NewTicker(updateCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-u.stopCh:
+				return
+			case <-ticker.C:
+				u.checkWindow()
+			}
+		}
+	}()
+}
+
+// Stop stops the maintenance window check
+func (u *Updater) Stop() {
+	u.stop.Do(func() { close(u.stopCh) })
+}
+
+// Ready is closed once a staged update may be applied, the process should then
+// shut down its clients and call Apply
+func (u *Updater) Ready() <-chan struct{} {
+	return u.ready
+}
+
+// checkWindow signals Ready when an update is staged and the maintenance window is open
+func (u *Updater) checkWindow() {
+	u.mu.Lock()
+	staged := u.staged
+	u.mu.Unlock()
+	if staged == nil || !u.window.Contains(u.now()) {
+		return
+	}
+	u.once.Do(func() {
+		logger.Info("Maintenance window open, client update ready to apply", "version", staged.version)
+		close(u.ready)
+	})
+}
+
+// Apply replaces the executable with the staged binary and restarts the process.
+// It only returns on failure.
+func (u *Updater) Apply() error {
+	u.mu.Lock()
+	staged := u.staged
+	u.mu.Unlock()
+	if staged == nil {
+		return fmt.Errorf("no update staged")
+	}
+	if err := os.Rename(staged.path, u.execPath); err != nil {
+		return fmt.Errorf("failed to replace executable: %w", err)
+	}
+	logger.Info("Client binary replaced, restarting", "from_version", u.version, "to_version", staged.version, "path", u.execPath)
+	return restartProcess(u.execPath)
+}
+
+// open returns a connection served by the update service
+func (u *Updater) open() net.Conn {
+	return serveInProcess(u)
+}
+
+// ServeHTTP implements the update service: GET /update/status and PUT /update/binary
+func (u *Updater) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/update/status" && r.Method == http.MethodGet:
+		u.mu.Lock()
+		status := update.Status{Version: u.version, Platform: u.platform}
+		if u.staged != nil {
+			status.StagedVersion = u.staged.version
+		}
+		u.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	case r.URL.Path == "/update/binary" && r.Method == http.MethodPut:
+		u.handleBinary(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleBinary verifies and stages a pushed binary
+func (u *Updater) handleBinary(w http.ResponseWriter, r *http.Request) {
+	newVersion := r.Header.Get(update.HeaderVersion)
+	if err := u.reserve(newVersion, r.Header.Get(update.HeaderPlatform)); err != nil {
+		logger.Debug("Declined client update", "version", newVersion, "err", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer func() {
+		u.mu.Lock()
+		u.receiving = false
+		u.mu.Unlock()
+	}()
+
+	path, err := u.receive(r, newVersion)
+	if err != nil {
+		logger.Warn("Rejected client update", "version", newVersion, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	previous := u.staged
+	u.staged = &stagedUpdate{version: newVersion, path: path}
+	u.mu.Unlock()
+	if previous != nil {
+		_ = os.Remove(previous.path)
+	}
+
+	logger.Info("Client update staged", "version", newVersion, "current_version", u.version, "window_open", u.window.Contains(u.now()))
+	w.WriteHeader(http.StatusNoContent)
+	u.checkWindow()
+}
+
+// reserve checks that a pushed version is an upgrade for this platform and marks the updater as receiving
+func (u *Updater) reserve(newVersion, platform string) error {
+	if platform != u.platform {
+		return fmt.Errorf("platform mismatch: offered %s, running %s", platform, u.platform)
+	}
+	cmp, ok := update.CompareVersions(newVersion, u.version)
+	if !ok {
+		return fmt.Errorf("cannot compare versions %q and %q", newVersion, u.version)
+	}
+	if cmp <= 0 {
+		return fmt.Errorf("version %s is not newer than %s", newVersion, u.version)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.receiving {
+		return fmt.Errorf("another update is being received")
+	}
+	if u.staged != nil {
+		if cmp, _ := update.CompareVersions(newVersion, u.staged.version); cmp <= 0 {
+			return fmt.Errorf("version %s is already staged", u.staged.version)
+		}
+	}
+	u.receiving = true
+	return nil
+}
+
+// receive writes the request body next to the executable and verifies its signature
+func (u *Updater) receive(r *http.Request, newVersion string) (string, error) {
+	expected, err := hex.DecodeString(r.Header.Get(update.HeaderSHA256))
+	if err != nil || len(expected) != sha256.Size {
+		return "", fmt.Errorf("invalid %s header", update.HeaderSHA256)
+	}
+	// The signature covers the announced digest, the received bytes must match it
+	if err := update.Verify(u.publicKey, newVersion, u.platform, expected, r.Header.Get(update.HeaderSignature)); err != nil {
+		return "", err
+	}
+
+	// Staging next to the executable keeps the final rename on one filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(u.execPath), "."+filepath.Base(u.execPath)+".update-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging file: %w", err)
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r.Body, u.maxSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to receive binary: %w", err)
+	}
+	if n > u.maxSize {
+		return "", fmt.Errorf("binary exceeds %d bytes", u.maxSize)
+	}
+	if !bytes.Equal(h.Sum(nil), expected) {
+		return "", fmt.Errorf("binary does not match its signed digest")
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil { //nolint:gosec // the staged file is an executable
+		return "", fmt.Errorf("failed to make binary executable: %w", err)
+	}
+
+	keep = true
+	return tmp.Name(), nil
+}
+
+// handleUpdateServiceConnect attaches a gateway connection to the update service
+func (c *Client) handleUpdateServiceConnect(connID, network string) {
+	if c.updater == nil || network != protocol.ProtocolTCP {
+		logger.Debug("Update service requested but auto update is not enabled", "client_id", c.getClientID(), "conn_id", connID)
+		if err := c.sendConnectResponse(connID, false, "auto update is disabled on this client", utils.ErrCodeTargetForbidden); err != nil {
+			logger.Error("Failed to send connect response for update service", "client_id", c.getClientID(), "conn_id", connID, "err", err)
+		}
+		return
+	}
+
+	logger.Debug("Update service session opened", "client_id", c.getClientID(), "conn_id", connID)
+	c.attachServiceConn(connID, protocol.UpdateServiceAddress, c.updater.open())
+}
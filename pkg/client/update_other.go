@@ -0,0 +1,18 @@
+//go:build !unix
+
+package client
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// checkSelfUpdateSupported reports whether the running executable can be replaced and restarted
+func checkSelfUpdateSupported() error {
+	return fmt.Errorf("auto update is not supported on %s", runtime.GOOS)
+}
+
+// restartProcess is not supported on this platform
+func restartProcess(string) error {
+	return checkSelfUpdateSupported()
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/update"
+)
+
+// newTestUpdater creates an updater for a fake executable in a temporary directory
+func newTestUpdater(t *testing.T, publicKey ed25519.PublicKey, window string) *Updater {
+	t.Helper()
+
+	execPath := filepath.Join(t.TempDir(), "anyproxy-client")
+	if err := os.WriteFile(execPath, []byte("old binary"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	parsedWindow, err := update.ParseWindow(window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Updater{
+		publicKey: publicKey,
+		window:    parsedWindow,
+		maxSize:   1024,
+		execPath:  execPath,
+		version:   "v1.0.0",
+		platform:  "linux/amd64",
+		now:       func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local) },
+		ready:     make(chan struct{}),
+		stopCh:    make(chan struct{}),
+	}
+}
+
+// pushUpdate pushes a binary to the updater over an in-memory connection and returns the status code
+func pushUpdate(t *testing.T, u *Updater, key ed25519.PrivateKey, version string, body []byte) int {
+	t.Helper()
+
+	digest := sha256.Sum256(body)
+	req, err := http.NewRequest(http.MethodPut, "http://anyproxy-update.internal/update/binary", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(update.HeaderVersion, version)
+	req.Header.Set(update.HeaderPlatform, "linux/amd64")
+	req.Header.Set(update.HeaderSHA256, hex.EncodeToString(digest[:]))
+	req.Header.Set(update.HeaderSignature, update.Sign(key, version, "linux/amd64", digest[:]))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return u.open(), nil
+		},
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestUpdater_StagesSignedBinary(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	u := newTestUpdater(t, publicKey, "02:00-04:00")
+
+	if status := pushUpdate(t, u, otherKey, "v1.1.0", []byte("new binary")); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a binary signed with another key, got %d", status)
+	}
+	if status := pushUpdate(t, u, privateKey, "v0.9.0", []byte("old binary")); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a downgrade, got %d", status)
+	}
+	if status := pushUpdate(t, u, privateKey, "v1.1.0", []byte(strings.Repeat("x", 2048))); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an oversized binary, got %d", status)
+	}
+
+	if status := pushUpdate(t, u, privateKey, "v1.1.0", []byte("new binary")); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 for a signed upgrade, got %d", status)
+	}
+	if status := pushUpdate(t, u, privateKey, "v1.1.0", []byte("new binary")); status != http.StatusConflict {
+		t.Errorf("Expected 409 for an already staged version, got %d", status)
+	}
+
+	// Outside the maintenance window the update waits
+	select {
+	case <-u.Ready():
+		t.Fatal("Update must not be ready outside the maintenance window")
+	default:
+	}
+	u.now = func() time.Time { return time.Date(2024, 1, 2, 3, 0, 0, 0, time.Local) }
+	u.checkWindow()
+	select {
+	case <-u.Ready():
+	default:
+		t.Fatal("Expected update to be ready inside the maintenance window")
+	}
+
+	data, err := os.ReadFile(u.staged.path)
+	if err != nil || string(data) != "new binary" {
+		t.Errorf("Unexpected staged binary %q: %v", data, err)
+	}
+}
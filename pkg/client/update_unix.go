@@ -0,0 +1,18 @@
+//go:build unix
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// checkSelfUpdateSupported reports whether the running executable can be replaced and restarted
+func checkSelfUpdateSupported() error {
+	return nil
+}
+
+// restartProcess replaces the current process with a new instance of path
+func restartProcess(path string) error {
+	return syscall.Exec(path, os.Args, os.Environ()) //nolint:gosec // path is our own executable
+}
@@ -0,0 +1,326 @@
+// Package autotls generates the TLS material of lab and self-hosted gateways: a self-signed CA,
+// a server certificate it signs, and an enrollment token. Clients with the token fetch the CA
+// from the gateway web server and check it against the fingerprint the token carries, so they
+// need no copy of the CA and can't be handed another one.
+package autotls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Files in the auto TLS directory
+const (
+	CAFile    = "ca.pem"
+	caKeyFile = "ca-key.pem"
+	CertFile  = "server.pem"
+	KeyFile   = "server-key.pem"
+	tokenFile = "enroll-token"
+)
+
+const (
+	caValidity      = 10 * 365 * 24 * time.Hour
+	certValidity    = 365 * 24 * time.Hour
+	renewBefore     = 30 * 24 * time.Hour // Server certificates are reissued this long before they expire
+	maxCASize       = 64 << 10
+	tokenSecretSize = 16
+)
+
+// EnrollPath is the web server path serving the CA to enrolling clients
+const EnrollPath = "/api/enroll/ca"
+
+// ErrInvalidToken is returned for enrollment tokens not issued by the gateway
+var ErrInvalidToken = errors.New("invalid enrollment token")
+
+// Bundle is the TLS material of a gateway
+type Bundle struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	CAPEM    []byte
+	Token    string // "<secret>.<CA fingerprint>"
+}
+
+// Ensure loads the TLS material from dir, generating what is missing. The server certificate
+// is reissued when it doesn't cover hosts or expires soon, the CA and the token are kept.
+func Ensure(dir string, hosts []string) (*Bundle, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create auto TLS directory: %v", err)
+	}
+	caCert, caKey, caPEM, err := loadOrCreateCA(dir)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &Bundle{
+		CAFile:   filepath.Join(dir, CAFile),
+		CertFile: filepath.Join(dir, CertFile),
+		KeyFile:  filepath.Join(dir, KeyFile),
+		CAPEM:    caPEM,
+	}
+	if !certCovers(bundle.CertFile, caCert, hosts, time.Now()) {
+		if err := issueCert(bundle.CertFile, bundle.KeyFile, caCert, caKey, hosts); err != nil {
+			return nil, err
+		}
+	}
+	if bundle.Token, err = loadOrCreateToken(filepath.Join(dir, tokenFile), caCert); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// CheckToken reports whether token is the enrollment token of the bundle
+func (b *Bundle) CheckToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.Token)) == 1
+}
+
+// Fingerprint identifies a CA certificate, it is the part of enrollment tokens clients check
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// FetchCA downloads the CA from the gateway web server at baseURL and checks it against the
+// fingerprint of token. The connection itself needn't be trusted.
+func FetchCA(ctx context.Context, baseURL, token string) ([]byte, error) {
+	_, fingerprint, ok := strings.Cut(token, ".")
+	if !ok || len(fingerprint) != 2*sha256.Size {
+		return nil, ErrInvalidToken
+	}
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(baseURL, "/")+EnrollPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		// The fingerprint authenticates the CA, not the connection
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, //nolint:gosec // see above
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment request failed: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCASize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrollment response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enrollment failed: %s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	cert, err := parseCert(data)
+	if err != nil {
+		return nil, err
+	}
+	if Fingerprint(cert) != strings.ToLower(fingerprint) {
+		return nil, fmt.Errorf("the gateway's CA does not match the enrollment token")
+	}
+	return data, nil
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, []byte, error) {
+	certPath, keyPath := filepath.Join(dir, CAFile), filepath.Join(dir, caKeyFile)
+	certPEM, err := os.ReadFile(certPath) //nolint:gosec // path comes from the gateway config
+	if err == nil {
+		cert, err := parseCert(certPEM)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		key, err := loadKey(keyPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return cert, key, certPEM, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil, fmt.Errorf("failed to read CA certificate: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate CA key: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "AnyProxy Auto TLS CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return nil, nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil { //nolint:gosec // certificates are public
+		return nil, nil, nil, fmt.Errorf("failed to write CA certificate: %v", err)
+	}
+	return cert, key, certPEM, nil
+}
+
+// certCovers reports whether the server certificate at path was issued by ca for all hosts and
+// stays valid long enough
+func certCovers(path string, ca *x509.Certificate, hosts []string, now time.Time) bool {
+	data, err := os.ReadFile(path) //nolint:gosec // path comes from the gateway config
+	if err != nil {
+		return false
+	}
+	cert, err := parseCert(data)
+	if err != nil || cert.CheckSignatureFrom(ca) != nil || now.Add(renewBefore).After(cert.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+				return false
+			}
+		} else if !slices.Contains(cert.DNSNames, host) {
+			return false
+		}
+	}
+	return true
+}
+
+func issueCert(certPath, keyPath string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate server key: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: "AnyProxy Gateway"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create server certificate: %v", err)
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil { //nolint:gosec // certificates are public
+		return fmt.Errorf("failed to write server certificate: %v", err)
+	}
+	return nil
+}
+
+func loadOrCreateToken(path string, ca *x509.Certificate) (string, error) {
+	fingerprint := Fingerprint(ca)
+	data, err := os.ReadFile(path) //nolint:gosec // path comes from the gateway config
+	if err == nil {
+		// A token of a replaced CA gets the new fingerprint
+		if secret, _, ok := strings.Cut(strings.TrimSpace(string(data)), "."); ok && secret != "" {
+			token := secret + "." + fingerprint
+			if token != strings.TrimSpace(string(data)) {
+				return token, writeToken(path, token)
+			}
+			return token, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read enrollment token: %v", err)
+	}
+
+	secret := make([]byte, tokenSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate enrollment token: %v", err)
+	}
+	token := hex.EncodeToString(secret) + "." + fingerprint
+	return token, writeToken(path, token)
+}
+
+func writeToken(path, token string) error {
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to write enrollment token: %v", err)
+	}
+	return nil
+}
+
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // path comes from the gateway config
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("CA key %s is not PEM encoded", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key: %v", err)
+	}
+	return key, nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return fmt.Errorf("failed to write key: %v", err)
+	}
+	return nil
+}
+
+func parseCert(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("not a PEM encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	return cert, nil
+}
+
+func serialNumber() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
@@ -0,0 +1,88 @@
+package autotls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnsure(t *testing.T) {
+	dir := t.TempDir()
+	bundle, err := Ensure(dir, []string{"gateway.lab", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server certificate chains to the CA for every host
+	pair, err := tls.LoadX509KeyPair(bundle.CertFile, bundle.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(bundle.CAPEM)
+	for _, host := range []string{"gateway.lab", "127.0.0.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: host}); err != nil {
+			t.Errorf("Verify(%s) error = %v", host, err)
+		}
+	}
+
+	// A restart keeps the CA and token, new hosts only reissue the server certificate
+	again, err := Ensure(dir, []string{"gateway.lab", "127.0.0.1", "10.0.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again.CAPEM) != string(bundle.CAPEM) || again.Token != bundle.Token {
+		t.Error("Expected the CA and enrollment token to be kept")
+	}
+	data, _ := os.ReadFile(again.CertFile)
+	if cert, err := parseCert(data); err != nil || len(cert.IPAddresses) != 2 {
+		t.Errorf("Expected a server certificate covering the new address, got %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, caKeyFile)); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a private CA key, got %v", err)
+	}
+}
+
+func TestFetchCA(t *testing.T) {
+	bundle, err := Ensure(t.TempDir(), []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Ensure(t.TempDir(), []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := bundle
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != EnrollPath || !bundle.CheckToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write(served.CAPEM)
+	}))
+	defer server.Close()
+
+	ca, err := FetchCA(context.Background(), server.URL, bundle.Token)
+	if err != nil || string(ca) != string(bundle.CAPEM) {
+		t.Fatalf("FetchCA() = %v, want the gateway's CA", err)
+	}
+
+	// Another CA than the token names is refused
+	served = other
+	if _, err := FetchCA(context.Background(), server.URL, bundle.Token); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Expected a CA mismatch, got %v", err)
+	}
+	if _, err := FetchCA(context.Background(), server.URL, "not-a-token"); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+}
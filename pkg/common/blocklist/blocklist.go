@@ -0,0 +1,214 @@
+// Package blocklist parses domain and IP blocklists and matches dial targets against them.
+//
+// Each line is one of:
+//   - a hosts file entry ("0.0.0.0 ads.example.com"), blocking the listed names exactly
+//   - an adblock network rule ("||example.com^"), blocking the domain and its subdomains,
+//     or an exception ("@@||cdn.example.com^") unblocking a domain and its subdomains
+//   - a bare domain ("example.com" or "*.example.com"), blocking it and its subdomains
+//   - an IP address or CIDR ("192.0.2.1", "198.51.100.0/24")
+//
+// Comments start with "#" or "!". Other adblock syntax is skipped.
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// maxLineSize bounds a single blocklist line
+const maxLineSize = 64 << 10
+
+// hostsIgnored are names found in stock hosts files that must never be blocked
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// List is a parsed blocklist, safe for concurrent reads
+type List struct {
+	exact    map[string]struct{}     // Names blocked exactly (hosts entries)
+	domains  map[string]struct{}     // Domains blocked with their subdomains
+	allowed  map[string]struct{}     // Domains unblocked with their subdomains (adblock exceptions)
+	ips      map[netip.Addr]struct{} // Single addresses
+	prefixes []netip.Prefix          // Networks
+	skipped  int
+}
+
+// New returns an empty list
+func New() *List {
+	return &List{
+		exact:   make(map[string]struct{}),
+		domains: make(map[string]struct{}),
+		allowed: make(map[string]struct{}),
+		ips:     make(map[netip.Addr]struct{}),
+	}
+}
+
+// Parse reads a blocklist, lines it does not understand are counted as skipped
+func Parse(r io.Reader) (*List, error) {
+	l := New()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+	for scanner.Scan() {
+		l.AddLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %v", err)
+	}
+	return l, nil
+}
+
+// AddLine adds the entries of one blocklist line
+func (l *List) AddLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return
+	}
+
+	// Adblock network rules, only plain domain anchors are supported
+	if rule, ok := strings.CutPrefix(line, "@@||"); ok {
+		l.addAdblock(rule, l.allowed)
+		return
+	}
+	if rule, ok := strings.CutPrefix(line, "||"); ok {
+		l.addAdblock(rule, l.domains)
+		return
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+	case len(fields) == 1:
+		l.addEntry(fields[0])
+	default:
+		// hosts format: address followed by names
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			l.skipped++
+			return
+		}
+		for _, name := range fields[1:] {
+			name = normalizeHost(name)
+			if hostsIgnored[name] || !validDomain(name) {
+				continue
+			}
+			l.exact[name] = struct{}{}
+		}
+	}
+}
+
+// addAdblock adds a "||domain^" rule body to set, rules with options or paths are skipped
+func (l *List) addAdblock(rule string, set map[string]struct{}) {
+	domain, ok := strings.CutSuffix(rule, "^")
+	if !ok {
+		domain, ok = strings.CutSuffix(rule, "^|")
+	}
+	domain = normalizeHost(domain)
+	if !ok || !validDomain(domain) {
+		l.skipped++
+		return
+	}
+	set[domain] = struct{}{}
+}
+
+// addEntry adds a single address, network or domain
+func (l *List) addEntry(entry string) {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		l.prefixes = append(l.prefixes, prefix.Masked())
+		return
+	}
+	if addr, err := netip.ParseAddr(entry); err == nil {
+		l.ips[addr.Unmap()] = struct{}{}
+		return
+	}
+	domain := normalizeHost(strings.TrimPrefix(entry, "*."))
+	if !validDomain(domain) {
+		l.skipped++
+		return
+	}
+	l.domains[domain] = struct{}{}
+}
+
+// Len returns the number of entries in the list
+func (l *List) Len() int {
+	return len(l.exact) + len(l.domains) + len(l.allowed) + len(l.ips) + len(l.prefixes)
+}
+
+// Skipped returns the number of lines that could not be parsed
+func (l *List) Skipped() int {
+	return l.skipped
+}
+
+// Match reports whether a host name or IP address is blocked
+func (l *List) Match(host string) bool {
+	host = normalizeHost(strings.Trim(host, "[]"))
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if _, ok := l.ips[addr]; ok {
+			return true
+		}
+		for _, prefix := range l.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if _, ok := l.exact[host]; ok {
+		return true
+	}
+	if len(l.domains) == 0 {
+		return false
+	}
+	// Walk from the full name to the top level domain, exceptions win over blocks
+	blocked := false
+	for name := host; ; {
+		if _, ok := l.allowed[name]; ok {
+			return false
+		}
+		if _, ok := l.domains[name]; ok {
+			blocked = true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return blocked
+		}
+		name = name[i+1:]
+	}
+}
+
+// normalizeHost lowercases a host name and removes its trailing dot
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// validDomain reports whether name looks like a domain name
+func validDomain(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return !strings.HasPrefix(name, ".") && !strings.Contains(name, "..")
+}
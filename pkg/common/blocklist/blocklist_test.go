@@ -0,0 +1,70 @@
+package blocklist
+
+import (
+	"strings"
+	"testing"
+)
+
+const testList = `# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.net # inline comment
+::1 ip6-localhost
+
+! adblock-lite
+||doubleclick.net^
+@@||good.doubleclick.net^
+||example.org/path^
+||example.info^$third-party
+
+# plain entries
+malware.test.
+*.wildcard.test
+192.0.2.7
+198.51.100.0/24
+2001:db8::/32
+not a valid line here
+`
+
+func TestParseAndMatch(t *testing.T) {
+	l, err := Parse(strings.NewReader(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"ads.example.com", true},
+		{"ADS.Example.com.", true},
+		{"sub.ads.example.com", false}, // hosts entries are exact
+		{"example.com", false},
+		{"tracker.example.net", true},
+		{"localhost", false},
+		{"doubleclick.net", true},
+		{"stats.doubleclick.net", true},
+		{"good.doubleclick.net", false},
+		{"cdn.good.doubleclick.net", false},
+		{"example.org", false},  // rules with paths are skipped
+		{"example.info", false}, // rules with options are skipped
+		{"malware.test", true},
+		{"www.malware.test", true},
+		{"wildcard.test", true},
+		{"a.b.wildcard.test", true},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"198.51.100.200", true},
+		{"::ffff:198.51.100.1", true},
+		{"[2001:db8::1]", true},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		if got := l.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	if l.Skipped() != 3 {
+		t.Errorf("Expected 3 skipped lines, got %d", l.Skipped())
+	}
+}
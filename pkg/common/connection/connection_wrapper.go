@@ -109,6 +109,11 @@ func (cw *ConnWrapper) RemoteAddr() net.Addr {
 	return cw.remoteAddr
 }
 
+// CloseWrite half-closes the wrapped connection when it supports it
+func (cw *ConnWrapper) CloseWrite() error {
+	return CloseWrite(cw.Conn)
+}
+
 // GetConnID returns the connection ID
 func (cw *ConnWrapper) GetConnID() string {
 	cw.mu.RLock()
@@ -0,0 +1,199 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+)
+
+// ErrHalfCloseUnsupported is returned by CloseWrite for connections that can only be closed fully
+var ErrHalfCloseUnsupported = errors.New("connection does not support half-close")
+
+// CloseWrite shuts down the write side of conn like shutdown(SHUT_WR) on a TCP socket,
+// the peer reads EOF while it can still write back
+func CloseWrite(conn net.Conn) error {
+	if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return ErrHalfCloseUnsupported
+}
+
+// expiredDeadline wakes up pending pipe reads
+var expiredDeadline = time.Unix(1, 0)
+
+// Pipe is like net.Pipe, but either end can CloseWrite so that the other end reads io.EOF
+// while it can still write back, like a half-closed TCP connection
+func Pipe() (net.Conn, net.Conn) {
+	c1, c2 := net.Pipe()
+	state := &pipeState{}
+	p1 := &pipeConn{Conn: c1, state: state, side: 0}
+	p2 := &pipeConn{Conn: c2, state: state, side: 1}
+	p1.peer, p2.peer = p2, p1
+	return p1, p2
+}
+
+// pipeState is shared by both ends of a Pipe
+type pipeState struct {
+	mu          sync.Mutex
+	writeClosed [2]bool
+	closed      [2]bool
+}
+
+// pipeConn is one end of a Pipe. net.Pipe writes return once the peer read everything, so after
+// CloseWrite nothing is pending and an expired read deadline turns the peer's reads into EOF.
+type pipeConn struct {
+	net.Conn
+	state *pipeState
+	side  int
+	peer  *pipeConn
+}
+
+// CloseWrite makes the peer read io.EOF, writing afterwards fails
+func (p *pipeConn) CloseWrite() error {
+	p.state.mu.Lock()
+	defer p.state.mu.Unlock()
+	if p.state.writeClosed[p.side] {
+		return nil
+	}
+	p.state.writeClosed[p.side] = true
+	return p.peer.Conn.SetReadDeadline(expiredDeadline)
+}
+
+// Close closes both directions
+func (p *pipeConn) Close() error {
+	p.state.mu.Lock()
+	p.state.closed[p.side] = true
+	p.state.mu.Unlock()
+	return p.Conn.Close()
+}
+
+func (p *pipeConn) Read(b []byte) (int, error) {
+	n, err := p.Conn.Read(b)
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		p.state.mu.Lock()
+		eof := p.state.writeClosed[p.peer.side]
+		p.state.mu.Unlock()
+		if eof {
+			return n, io.EOF
+		}
+	}
+	return n, err
+}
+
+func (p *pipeConn) Write(b []byte) (int, error) {
+	p.state.mu.Lock()
+	writeClosed := p.state.writeClosed[p.side]
+	p.state.mu.Unlock()
+	if writeClosed {
+		return 0, io.ErrClosedPipe
+	}
+	return p.Conn.Write(b)
+}
+
+// SetReadDeadline keeps reads failing fast once the peer closed its write side
+func (p *pipeConn) SetReadDeadline(t time.Time) error {
+	p.state.mu.Lock()
+	defer p.state.mu.Unlock()
+	if p.state.writeClosed[p.peer.side] {
+		return nil
+	}
+	return p.Conn.SetReadDeadline(t)
+}
+
+func (p *pipeConn) SetDeadline(t time.Time) error {
+	if err := p.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.Conn.SetWriteDeadline(t)
+}
+
+// peerClosedWrite reports whether the peer closed its write side but not the whole pipe
+func (p *pipeConn) peerClosedWrite() bool {
+	p.state.mu.Lock()
+	defer p.state.mu.Unlock()
+	return p.state.writeClosed[p.peer.side] && !p.state.closed[p.peer.side]
+}
+
+// PeerClosedWrite reports whether the peer of a Pipe end only closed its write side. A read
+// returning io.EOF then leaves the other direction open, otherwise the peer is gone.
+func PeerClosedWrite(conn net.Conn) bool {
+	p, ok := conn.(*pipeConn)
+	return ok && p.peerClosedWrite()
+}
+
+// CloseGracePeriod resolves a configured close_grace_period: zero selects the default and a
+// negative value disables half-close, for which it returns zero
+func CloseGracePeriod(configured time.Duration) time.Duration {
+	switch {
+	case configured == 0:
+		return protocol.DefaultCloseGracePeriod
+	case configured < 0:
+		return 0
+	}
+	return configured
+}
+
+// HalfClose tracks the directions of a tunneled connection after one of them closed
+type HalfClose struct {
+	mu     sync.Mutex
+	local  bool // The local side reached EOF and close_write was sent
+	remote bool // close_write was received from the peer
+	timer  *time.Timer
+	closed bool
+}
+
+// CloseLocal records that the local side finished writing, see close
+func (h *HalfClose) CloseLocal(grace time.Duration, expire func()) bool {
+	return h.close(false, grace, expire)
+}
+
+// CloseRemote records that the peer finished writing, see close
+func (h *HalfClose) CloseRemote(grace time.Duration, expire func()) bool {
+	return h.close(true, grace, expire)
+}
+
+// close reports whether both directions are closed now. Otherwise expire runs unless the other
+// direction finishes within grace of the first one.
+func (h *HalfClose) close(remote bool, grace time.Duration, expire func()) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if remote {
+		h.remote = true
+	} else {
+		h.local = true
+	}
+	if h.local && h.remote {
+		h.stopLocked()
+		return true
+	}
+	if h.timer == nil && !h.closed {
+		h.timer = time.AfterFunc(grace, expire)
+	}
+	return false
+}
+
+// HalfClosed reports whether a direction closed
+func (h *HalfClose) HalfClosed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.local || h.remote
+}
+
+// Stop cancels the grace period when the connection is closed
+func (h *HalfClose) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopLocked()
+}
+
+func (h *HalfClose) stopLocked() {
+	h.closed = true
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
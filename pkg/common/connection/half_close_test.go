@@ -0,0 +1,100 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPipe_CloseWrite(t *testing.T) {
+	user, tunnel := Pipe()
+	defer user.Close()
+	defer tunnel.Close()
+
+	go func() {
+		_, _ = user.Write([]byte("request"))
+		_ = CloseWrite(user)
+	}()
+
+	// The request is delivered before EOF, and no deadline set afterwards revives the reads
+	data, err := io.ReadAll(tunnel)
+	if err != nil || string(data) != "request" {
+		t.Fatalf("Expected the request and EOF, got %q, %v", data, err)
+	}
+	if err := tunnel.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF after the deadline reset, got %v", err)
+	}
+	if !PeerClosedWrite(tunnel) {
+		t.Error("Expected the peer to have closed only its write side")
+	}
+
+	// The other direction still works
+	go func() { _, _ = tunnel.Write([]byte("answer")) }()
+	buf := make([]byte, 16)
+	n, err := user.Read(buf)
+	if err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("Expected the answer, got %q, %v", buf[:n], err)
+	}
+	if _, err := user.Write([]byte("more")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Expected writing after CloseWrite to fail, got %v", err)
+	}
+
+	if err := user.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if PeerClosedWrite(tunnel) {
+		t.Error("Expected a fully closed peer not to count as half-closed")
+	}
+}
+
+func TestCloseWrite_Unsupported(t *testing.T) {
+	if err := CloseWrite(&mockConn{}); !errors.Is(err, ErrHalfCloseUnsupported) {
+		t.Errorf("Expected ErrHalfCloseUnsupported, got %v", err)
+	}
+	if err := NewConnWrapper(&mockConn{}, "tcp", "127.0.0.1:80").CloseWrite(); !errors.Is(err, ErrHalfCloseUnsupported) {
+		t.Errorf("Expected the wrapper to report ErrHalfCloseUnsupported, got %v", err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	var expired atomic.Int32
+	expire := func() { expired.Add(1) }
+
+	var both HalfClose
+	if both.CloseLocal(time.Hour, expire) {
+		t.Error("Expected one closed direction not to close the connection")
+	}
+	if !both.CloseRemote(time.Hour, expire) {
+		t.Error("Expected both closed directions to close the connection")
+	}
+
+	var lingering HalfClose
+	lingering.CloseRemote(10*time.Millisecond, expire)
+	deadline := time.Now().Add(time.Second)
+	for expired.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if expired.Load() != 1 {
+		t.Errorf("Expected the grace period to expire once, got %d", expired.Load())
+	}
+
+	var stopped HalfClose
+	stopped.Stop()
+	stopped.CloseLocal(time.Millisecond, expire)
+	time.Sleep(20 * time.Millisecond)
+	if expired.Load() != 1 {
+		t.Error("Expected no grace period after Stop")
+	}
+
+	if got := CloseGracePeriod(0); got != 60*time.Second {
+		t.Errorf("CloseGracePeriod(0) = %v, want the default", got)
+	}
+	if got := CloseGracePeriod(-1); got != 0 {
+		t.Errorf("CloseGracePeriod(-1) = %v, want 0", got)
+	}
+}
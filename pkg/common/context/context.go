@@ -20,6 +20,9 @@ var (
 
 	// UserContextKey is the context key for user context
 	UserContextKey = &contextKey{"user"}
+
+	// PriorityKey is the context key for the QoS priority class of a connection
+	PriorityKey = &contextKey{"priority"}
 )
 
 // WithConnID adds connection ID to context
@@ -43,3 +46,14 @@ func GetUserContext(ctx context.Context) (*utils.UserContext, bool) {
 	userCtx, ok := ctx.Value(UserContextKey).(*utils.UserContext)
 	return userCtx, ok
 }
+
+// WithPriority adds the QoS priority class of a connection to context
+func WithPriority(ctx context.Context, priority uint8) context.Context {
+	return context.WithValue(ctx, PriorityKey, priority)
+}
+
+// GetPriority retrieves the QoS priority class from context, zero when unset
+func GetPriority(ctx context.Context) uint8 {
+	priority, _ := ctx.Value(PriorityKey).(uint8)
+	return priority
+}
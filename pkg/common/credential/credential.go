@@ -2,11 +2,13 @@
 package credential
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"sync"
 
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 )
 
@@ -34,6 +36,12 @@ type Store interface {
 	ValidatePassword(groupID string, password string) bool
 }
 
+// Pinger is implemented by stores depending on a backend that may become unreachable
+type Pinger interface {
+	// Ping checks that the backend can be reached
+	Ping(ctx context.Context) error
+}
+
 // Manager manages credential operations
 type Manager struct {
 	store Store
@@ -45,6 +53,8 @@ type Config struct {
 	Type     Type      `yaml:"type"`
 	FilePath string    `yaml:"file_path"` // Only used for file type
 	DB       *DBConfig `yaml:"db"`        // Only used for db type
+
+	Cipher *encryption.Cipher `yaml:"-"` // Encrypts the file and db stores at rest when set
 }
 
 // NewManager creates a new credential manager
@@ -64,20 +74,23 @@ func NewManager(config *Config) (*Manager, error) {
 		if config.FilePath == "" {
 			config.FilePath = "credentials.json"
 		}
-		store, err = NewFileStore(config.FilePath)
+		store, err = NewEncryptedFileStore(config.FilePath, config.Cipher)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create file store: %v", err)
 		}
-		logger.Info("Created file-based credential store", "file", config.FilePath)
+		logger.Info("Created file-based credential store", "file", config.FilePath, "encrypted", config.Cipher.Enabled())
 	case DB:
 		if config.DB == nil {
 			return nil, fmt.Errorf("database configuration is required for DB store type")
 		}
+		if config.DB.Cipher == nil {
+			config.DB.Cipher = config.Cipher
+		}
 		store, err = NewDBStore(config.DB)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create db store: %v", err)
 		}
-		logger.Info("Created database-based credential store", "driver", config.DB.Driver)
+		logger.Info("Created database-based credential store", "driver", config.DB.Driver, "encrypted", config.DB.Cipher.Enabled())
 	default:
 		return nil, fmt.Errorf("unsupported credential store type: %s", config.Type)
 	}
@@ -120,6 +133,14 @@ func (m *Manager) ValidateGroup(groupID, password string) bool {
 	return m.store.ValidatePassword(groupID, password)
 }
 
+// Ping checks that the credential backend can be reached, stores without a backend always can
+func (m *Manager) Ping(ctx context.Context) error {
+	if pinger, ok := m.store.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
 // RemoveGroup removes password for a group
 func (m *Manager) RemoveGroup(groupID string) error {
 	m.mu.Lock()
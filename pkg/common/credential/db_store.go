@@ -1,25 +1,31 @@
 package credential
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"regexp"
 	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
+	"github.com/buhuipao/anyproxy/pkg/logger"
 )
 
 // DBStore implements database-based credential storage
 type DBStore struct {
 	db            *sql.DB
 	tableName     string
+	cipher        *encryption.Cipher
 	mu            sync.RWMutex
 	preparedStmts map[string]*sql.Stmt
 }
 
 // DBConfig holds database configuration
 type DBConfig struct {
-	Driver     string // Database driver: mysql, postgres, sqlite3
-	DataSource string // Connection string
-	TableName  string // Table name for credentials
+	Driver     string             // Database driver: mysql, postgres, sqlite3
+	DataSource string             // Connection string
+	TableName  string             // Table name for credentials
+	Cipher     *encryption.Cipher // Encrypts stored password hashes when set
 }
 
 // tableNameRegex validates table names to prevent SQL injection
@@ -57,6 +63,7 @@ func NewDBStore(config *DBConfig) (*DBStore, error) {
 	store := &DBStore{
 		db:            db,
 		tableName:     config.TableName,
+		cipher:        config.Cipher,
 		preparedStmts: make(map[string]*sql.Stmt),
 	}
 
@@ -70,6 +77,12 @@ func NewDBStore(config *DBConfig) (*DBStore, error) {
 		return nil, fmt.Errorf("failed to prepare statements: %v", err)
 	}
 
+	if store.cipher.Enabled() {
+		if err := store.encryptPlaintextRows(); err != nil {
+			return nil, fmt.Errorf("failed to encrypt stored credentials: %v", err)
+		}
+	}
+
 	return store, nil
 }
 
@@ -79,7 +92,7 @@ func (ds *DBStore) createTable() error {
 	query := fmt.Sprintf( // #nosec G201 - table name is validated
 		`CREATE TABLE IF NOT EXISTS %s (
 			group_id VARCHAR(255) PRIMARY KEY,
-			password_hash VARCHAR(64) NOT NULL,
+			password_hash VARCHAR(255) NOT NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`, ds.tableName)
@@ -110,11 +123,51 @@ func (ds *DBStore) prepareStatements() error {
 	return nil
 }
 
+// encryptPlaintextRows encrypts the password hashes stored before encryption was enabled
+func (ds *DBStore) encryptPlaintextRows() error {
+	// Table name is validated in NewDBStore, safe to use in query
+	rows, err := ds.db.Query(fmt.Sprintf( // #nosec G201 - table name is validated
+		`SELECT group_id, password_hash FROM %s`, ds.tableName))
+	if err != nil {
+		return err
+	}
+	plaintext := make(map[string]string)
+	for rows.Next() {
+		var groupID, passwordHash string
+		if err := rows.Scan(&groupID, &passwordHash); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if !encryption.IsSealed([]byte(passwordHash)) {
+			plaintext[groupID] = passwordHash
+		}
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for groupID, passwordHash := range plaintext {
+		if err := ds.Set(groupID, passwordHash); err != nil {
+			return err
+		}
+	}
+	if len(plaintext) > 0 {
+		logger.Info("Encrypted plain text credentials", "table", ds.tableName, "count", len(plaintext))
+	}
+	return nil
+}
+
 // Set stores or updates password hash
 func (ds *DBStore) Set(groupID string, passwordHash string) error {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
 
+	passwordHash, err := ds.cipher.SealString(passwordHash)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt credentials: %v", err)
+	}
+
 	// First try to update
 	// Table name is validated in NewDBStore, safe to use in query
 	updateQuery := fmt.Sprintf( // #nosec G201 - table name is validated
@@ -162,6 +215,10 @@ func (ds *DBStore) Get(groupID string) (string, error) {
 		return "", fmt.Errorf("failed to get credentials: %v", err)
 	}
 
+	passwordHash, err = ds.cipher.OpenString(passwordHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt credentials: %v", err)
+	}
 	return passwordHash, nil
 }
 
@@ -189,6 +246,14 @@ func (ds *DBStore) ValidatePassword(groupID string, password string) bool {
 	return hash == hashPassword(password)
 }
 
+// Ping checks the database connection
+func (ds *DBStore) Ping(ctx context.Context) error {
+	if err := ds.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping database: %v", err)
+	}
+	return nil
+}
+
 // Close closes the database connection
 func (ds *DBStore) Close() error {
 	// Close prepared statements
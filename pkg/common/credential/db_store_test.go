@@ -4,8 +4,12 @@
 package credential
 
 import (
+	"bytes"
+	"path/filepath"
 	"testing"
 
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
+
 	// Import database drivers for testing
 	_ "modernc.org/sqlite" // Pure Go SQLite driver (no CGO required)
 	// _ "github.com/go-sql-driver/mysql" // MySQL driver
@@ -151,3 +155,26 @@ func TestDBStore_InvalidConnection(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestDBStore_Encrypted(t *testing.T) {
+	dataSource := filepath.Join(t.TempDir(), "credentials.db")
+	plain, err := NewDBStore(&DBConfig{Driver: "sqlite", DataSource: dataSource})
+	require.NoError(t, err)
+	require.NoError(t, plain.Set("group1", hashPassword("password1")))
+	require.NoError(t, plain.Close())
+
+	// Enabling encryption rewrites the plain text rows
+	cipher, err := encryption.New(bytes.Repeat([]byte{1}, encryption.KeySize))
+	require.NoError(t, err)
+	store, err := NewDBStore(&DBConfig{Driver: "sqlite", DataSource: dataSource, Cipher: cipher})
+	require.NoError(t, err)
+	defer store.Close()
+
+	var stored string
+	require.NoError(t, store.db.QueryRow(`SELECT password_hash FROM credentials WHERE group_id = ?`, "group1").Scan(&stored))
+	assert.True(t, encryption.IsSealed([]byte(stored)))
+	assert.True(t, store.ValidatePassword("group1", "password1"))
+
+	require.NoError(t, store.Set("group2", hashPassword("password2")))
+	assert.True(t, store.ValidatePassword("group2", "password2"))
+}
@@ -1,21 +1,32 @@
 package credential
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
+	"github.com/buhuipao/anyproxy/pkg/logger"
 )
 
 // FileStore implements file-based credential storage
 type FileStore struct {
 	filePath string
+	cipher   *encryption.Cipher // Encrypts the file when set
 	mu       sync.RWMutex
 }
 
 // NewFileStore creates a new file-based credential store
 func NewFileStore(filePath string) (*FileStore, error) {
+	return NewEncryptedFileStore(filePath, nil)
+}
+
+// NewEncryptedFileStore creates a file-based credential store whose file is encrypted with
+// cipher. A plain text file written without encryption is encrypted on creation.
+func NewEncryptedFileStore(filePath string, cipher *encryption.Cipher) (*FileStore, error) {
 	// Ensure directory exists
 	dir := filepath.Dir(filePath)
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -24,13 +35,30 @@ func NewFileStore(filePath string) (*FileStore, error) {
 
 	fs := &FileStore{
 		filePath: filePath,
+		cipher:   cipher,
 	}
 
 	// Create file if it doesn't exist
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	data, err := os.ReadFile(filePath) //nolint:gosec // path comes from the gateway config
+	switch {
+	case os.IsNotExist(err):
 		if err := fs.save(make(map[string]string)); err != nil {
 			return nil, fmt.Errorf("failed to create credential file: %v", err)
 		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to read credential file: %v", err)
+	case encryption.IsSealed(data) || cipher.Enabled():
+		// Fail on startup rather than refusing every client when the key is missing or wrong
+		passwords, err := fs.load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load credential file: %v", err)
+		}
+		if cipher.Enabled() && !encryption.IsSealed(data) {
+			if err := fs.save(passwords); err != nil {
+				return nil, fmt.Errorf("failed to encrypt credential file: %v", err)
+			}
+			logger.Info("Encrypted plain text credential file", "file", filePath)
+		}
 	}
 
 	return fs, nil
@@ -45,6 +73,9 @@ func (fs *FileStore) load() (map[string]string, error) {
 		}
 		return nil, err
 	}
+	if data, err = fs.cipher.Open(data); err != nil {
+		return nil, err
+	}
 
 	var passwords map[string]string
 	if err := json.Unmarshal(data, &passwords); err != nil {
@@ -64,6 +95,9 @@ func (fs *FileStore) save(passwords map[string]string) error {
 	if err != nil {
 		return err
 	}
+	if data, err = fs.cipher.Seal(data); err != nil {
+		return err
+	}
 
 	// Write to temporary file first
 	tmpFile := fs.filePath + ".tmp"
@@ -89,6 +123,17 @@ func (fs *FileStore) Set(groupID string, passwordHash string) error {
 	return fs.save(passwords)
 }
 
+// Ping checks that the credentials file can be read
+func (fs *FileStore) Ping(_ context.Context) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if _, err := fs.load(); err != nil {
+		return fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	return nil
+}
+
 // Get retrieves password hash
 func (fs *FileStore) Get(groupID string) (string, error) {
 	fs.mu.RLock()
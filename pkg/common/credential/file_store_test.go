@@ -1,9 +1,13 @@
 package credential
 
 import (
+	"bytes"
+	"context"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -45,6 +49,15 @@ func TestFileStore(t *testing.T) {
 		assert.False(t, valid)
 	})
 
+	// Test Ping
+	t.Run("Ping", func(t *testing.T) {
+		require.NoError(t, store.Ping(context.Background()))
+
+		require.NoError(t, os.WriteFile(filePath+".broken", []byte("{"), 0600))
+		broken := &FileStore{filePath: filePath + ".broken"}
+		assert.Error(t, broken.Ping(context.Background()))
+	})
+
 	// Test Delete
 	t.Run("Delete", func(t *testing.T) {
 		err := store.Delete("group1")
@@ -60,3 +73,35 @@ func TestFileStore(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestFileStore_Encrypted(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "credentials.json")
+	plain, err := NewFileStore(filePath)
+	require.NoError(t, err)
+	require.NoError(t, plain.Set("group1", hashPassword("password1")))
+
+	// Enabling encryption rewrites the plain text file
+	cipher, err := encryption.New(bytes.Repeat([]byte{1}, encryption.KeySize))
+	require.NoError(t, err)
+	store, err := NewEncryptedFileStore(filePath, cipher)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.True(t, encryption.IsSealed(data))
+	assert.NotContains(t, string(data), hashPassword("password1"))
+	assert.True(t, store.ValidatePassword("group1", "password1"))
+
+	require.NoError(t, store.Set("group2", hashPassword("password2")))
+	reopened, err := NewEncryptedFileStore(filePath, cipher)
+	require.NoError(t, err)
+	assert.True(t, reopened.ValidatePassword("group2", "password2"))
+
+	// A missing or wrong key fails on startup
+	_, err = NewFileStore(filePath)
+	assert.ErrorContains(t, err, encryption.ErrNoKey.Error())
+	other, err := encryption.New(bytes.Repeat([]byte{2}, encryption.KeySize))
+	require.NoError(t, err)
+	_, err = NewEncryptedFileStore(filePath, other)
+	assert.ErrorContains(t, err, encryption.ErrDecrypt.Error())
+}
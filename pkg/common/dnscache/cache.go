@@ -0,0 +1,187 @@
+// Package dnscache resolves host names for the gateway and caches the answers for their DNS TTL.
+// Failed lookups are cached too (negative caching), so targets that don't resolve don't reach the
+// DNS servers on every connect. Concurrent lookups of a host share one query.
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+)
+
+// Defaults of Options
+const (
+	DefaultMinTTL      = 5 * time.Second
+	DefaultMaxTTL      = time.Hour
+	DefaultNegativeTTL = 30 * time.Second
+	DefaultMaxEntries  = 10000
+)
+
+// lookupTimeout bounds a lookup including the queries to all servers
+const lookupTimeout = 5 * time.Second
+
+// ErrNotFound is returned for host names without addresses
+var ErrNotFound = errors.New("no such host")
+
+// Options configures a Cache, zero values select the defaults
+type Options struct {
+	Servers     []string      // DNS servers as host or host:port, the nameservers of /etc/resolv.conf when empty
+	MinTTL      time.Duration // Answers are cached at least this long
+	MaxTTL      time.Duration // and at most this long
+	NegativeTTL time.Duration // Failed lookups are cached at most this long
+	MaxEntries  int           // Cached host names, expired and then arbitrary entries are evicted beyond
+}
+
+// lookupFunc resolves a host name, returning how long the answer may be cached
+type lookupFunc func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+
+// entry is the cached answer for a host name
+type entry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+	done    chan struct{} // Closed once the lookup finished, the fields are set before
+}
+
+// Cache resolves host names and caches their addresses
+type Cache struct {
+	opts    Options
+	lookup  lookupFunc
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// New creates a Cache querying the configured servers
+func New(opts Options) *Cache {
+	servers := opts.Servers
+	if len(servers) == 0 {
+		servers = systemServers()
+	}
+	r := &resolver{servers: normalizeServers(servers)}
+	return newCache(opts, r.lookup)
+}
+
+// newCache creates a Cache on top of a lookup function
+func newCache(opts Options, lookup lookupFunc) *Cache {
+	if opts.MinTTL <= 0 {
+		opts.MinTTL = DefaultMinTTL
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = DefaultMaxTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = DefaultNegativeTTL
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	return &Cache{
+		opts:    opts,
+		lookup:  lookup,
+		now:     time.Now,
+		entries: make(map[string]*entry),
+	}
+}
+
+// LookupIPAddr returns the addresses of host, from the cache while its answer is fresh
+func (c *Cache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	c.mu.Lock()
+	if e, ok := c.entries[host]; ok {
+		select {
+		case <-e.done:
+			if c.now().Before(e.expires) {
+				c.mu.Unlock()
+				monitoring.RecordDNSCacheHit(e.err != nil)
+				return e.addrs, e.err
+			}
+		default:
+			// Another lookup of the host is running, share its answer
+			c.mu.Unlock()
+			select {
+			case <-e.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			monitoring.RecordDNSCacheHit(e.err != nil)
+			return e.addrs, e.err
+		}
+	}
+	if len(c.entries) >= c.opts.MaxEntries {
+		c.evict()
+	}
+	e := &entry{done: make(chan struct{})}
+	c.entries[host] = e
+	entries := len(c.entries)
+	c.mu.Unlock()
+	monitoring.SetDNSCacheEntries(entries)
+
+	// The answer is shared, it must not fail because the first caller gave up
+	lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lookupTimeout)
+	addrs, ttl, err := c.lookup(lookupCtx, host)
+	cancel()
+	if err == nil && len(addrs) == 0 {
+		err = ErrNotFound
+	}
+	e.addrs, e.err = addrs, err
+	e.expires = c.now().Add(c.cacheTTL(ttl, err != nil))
+	close(e.done)
+	monitoring.RecordDNSCacheMiss(err != nil)
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return addrs, err
+}
+
+// cacheTTL bounds the TTL of an answer, failures without a TTL are cached for MinTTL
+func (c *Cache) cacheTTL(ttl time.Duration, failed bool) time.Duration {
+	maxTTL := c.opts.MaxTTL
+	if failed {
+		maxTTL = c.opts.NegativeTTL
+	}
+	if ttl < c.opts.MinTTL {
+		ttl = c.opts.MinTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// evict removes expired entries, or an arbitrary finished one when none expired (caller holds mu)
+func (c *Cache) evict() {
+	now := c.now()
+	var finished string
+	for host, e := range c.entries {
+		select {
+		case <-e.done:
+			if !now.Before(e.expires) {
+				delete(c.entries, host)
+			} else {
+				finished = host
+			}
+		default:
+		}
+	}
+	if len(c.entries) >= c.opts.MaxEntries && finished != "" {
+		delete(c.entries, finished)
+	}
+}
+
+// Len returns the number of cached host names
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
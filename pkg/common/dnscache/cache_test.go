@@ -0,0 +1,122 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_LookupIPAddr(t *testing.T) {
+	var queries atomic.Int32
+	lookup := func(_ context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		queries.Add(1)
+		if host == "missing.example" {
+			return nil, 10 * time.Minute, ErrNotFound
+		}
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, time.Minute, nil
+	}
+	cache := newCache(Options{NegativeTTL: 30 * time.Second}, lookup)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		addrs, err := cache.LookupIPAddr(ctx, "Example.COM.")
+		if err != nil || len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("Unexpected answer %v %v", addrs, err)
+		}
+	}
+	if queries.Load() != 1 {
+		t.Fatalf("Expected one query for cached answers, got %d", queries.Load())
+	}
+
+	// Answers expire with their TTL
+	now = now.Add(time.Minute)
+	if _, err := cache.LookupIPAddr(ctx, "example.com"); err != nil || queries.Load() != 2 {
+		t.Fatalf("Expected an expired answer to be queried again, got %d queries, err %v", queries.Load(), err)
+	}
+
+	// Failures are cached for at most negative_ttl
+	for i := 0; i < 2; i++ {
+		if _, err := cache.LookupIPAddr(ctx, "missing.example"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected ErrNotFound, got %v", err)
+		}
+	}
+	if queries.Load() != 3 {
+		t.Fatalf("Expected the failure to be cached, got %d queries", queries.Load())
+	}
+	now = now.Add(30 * time.Second)
+	_, _ = cache.LookupIPAddr(ctx, "missing.example")
+	if queries.Load() != 4 {
+		t.Errorf("Expected the failure to expire after negative_ttl, got %d queries", queries.Load())
+	}
+
+	if addrs, err := cache.LookupIPAddr(ctx, "198.51.100.7"); err != nil || !addrs[0].IP.Equal(net.ParseIP("198.51.100.7")) || queries.Load() != 4 {
+		t.Errorf("Expected IP addresses to be returned without a query, got %v %v", addrs, err)
+	}
+}
+
+func TestCache_SharedLookup(t *testing.T) {
+	release := make(chan struct{})
+	var queries atomic.Int32
+	cache := newCache(Options{}, func(context.Context, string) ([]net.IPAddr, time.Duration, error) {
+		queries.Add(1)
+		<-release
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, time.Minute, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.LookupIPAddr(context.Background(), "example.com"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if queries.Load() != 1 {
+		t.Errorf("Expected concurrent lookups to share one query, got %d", queries.Load())
+	}
+}
+
+func TestCache_Evict(t *testing.T) {
+	cache := newCache(Options{MaxEntries: 2}, func(context.Context, string) ([]net.IPAddr, time.Duration, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, time.Minute, nil
+	})
+	for _, host := range []string{"a.example", "b.example", "c.example"} {
+		if _, err := cache.LookupIPAddr(context.Background(), host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected the cache to hold max_entries hosts, got %d", cache.Len())
+	}
+}
+
+func TestCache_CacheTTL(t *testing.T) {
+	cache := newCache(Options{MinTTL: 10 * time.Second, MaxTTL: time.Hour, NegativeTTL: time.Minute}, nil)
+	tests := []struct {
+		ttl    time.Duration
+		failed bool
+		want   time.Duration
+	}{
+		{0, false, 10 * time.Second},
+		{5 * time.Minute, false, 5 * time.Minute},
+		{24 * time.Hour, false, time.Hour},
+		{0, true, 10 * time.Second},
+		{time.Hour, true, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := cache.cacheTTL(tt.ttl, tt.failed); got != tt.want {
+			t.Errorf("cacheTTL(%v, %v) = %v, want %v", tt.ttl, tt.failed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package dnscache
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolvConf lists the system DNS servers
+const resolvConf = "/etc/resolv.conf"
+
+// maxUDPSize is the largest UDP response read, longer answers are truncated and retried over TCP
+const maxUDPSize = 1232
+
+// resolver queries DNS servers for the A and AAAA records of host names
+type resolver struct {
+	servers []string // host:port
+}
+
+// answer is the result of one query
+type answer struct {
+	addrs    []net.IPAddr
+	ttl      time.Duration // Lowest TTL of the answer records, or the negative TTL of the SOA record
+	notFound bool          // The name doesn't exist or has no records of the type
+}
+
+// lookup resolves the IPv4 and IPv6 addresses of host, returning how long they may be cached
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid host name %q: %v", host, err)
+	}
+
+	var addrs []net.IPAddr
+	var ttl, negativeTTL time.Duration
+	var lastErr error
+	notFound := 0
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ans, err := r.query(ctx, name, qtype)
+		switch {
+		case err != nil:
+			lastErr = err
+		case ans.notFound:
+			if notFound == 0 || ans.ttl < negativeTTL {
+				negativeTTL = ans.ttl
+			}
+			notFound++
+		default:
+			if len(addrs) == 0 || ans.ttl < ttl {
+				ttl = ans.ttl
+			}
+			addrs = append(addrs, ans.addrs...)
+		}
+	}
+
+	switch {
+	case len(addrs) > 0:
+		return addrs, ttl, nil
+	case lastErr != nil:
+		return nil, 0, lastErr
+	}
+	return nil, negativeTTL, fmt.Errorf("%w: %s", ErrNotFound, host)
+}
+
+// query asks the servers in turn until one answers
+func (r *resolver) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (*answer, error) {
+	var lastErr error
+	for _, server := range r.servers {
+		ans, err := exchange(ctx, server, name, qtype)
+		if err == nil {
+			return ans, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// exchange sends one query to server over UDP, and again over TCP when the answer was truncated
+func exchange(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) (*answer, error) {
+	id := uint16(rand.Uint32())
+	query := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	query.EnableCompression()
+	if err := query.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := query.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	msg, err := query.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := roundTrip(ctx, "udp", server, msg)
+	if err != nil {
+		return nil, err
+	}
+	ans, truncated, err := parseAnswer(resp, id, name, qtype)
+	if err == nil && truncated {
+		if resp, err = roundTrip(ctx, "tcp", server, msg); err != nil {
+			return nil, err
+		}
+		ans, _, err = parseAnswer(resp, id, name, qtype)
+	}
+	return ans, err
+}
+
+// roundTrip sends msg to server and reads the response, TCP messages carry a length prefix
+func roundTrip(ctx context.Context, network, server string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseAnswer reads the addresses and TTL from the response to query id
+func parseAnswer(resp []byte, id uint16, name dnsmessage.Name, qtype dnsmessage.Type) (*answer, bool, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed DNS response: %v", err)
+	}
+	if header.ID != id || !header.Response {
+		return nil, false, fmt.Errorf("unexpected DNS response")
+	}
+	if header.Truncated {
+		return nil, true, nil
+	}
+	question, err := p.Question()
+	if err != nil || !strings.EqualFold(question.Name.String(), name.String()) || question.Type != qtype {
+		return nil, false, fmt.Errorf("DNS response for another question")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, false, fmt.Errorf("malformed DNS response: %v", err)
+	}
+
+	ans := &answer{}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		ans.notFound = true
+	default:
+		return nil, false, fmt.Errorf("DNS server failure: %s", header.RCode)
+	}
+
+	first := true
+	for !ans.notFound {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("malformed DNS response: %v", err)
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, false, fmt.Errorf("malformed DNS response: %v", err)
+			}
+			ans.addrs = append(ans.addrs, net.IPAddr{IP: net.IP(r.A[:])})
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, false, fmt.Errorf("malformed DNS response: %v", err)
+			}
+			ans.addrs = append(ans.addrs, net.IPAddr{IP: net.IP(r.AAAA[:])})
+		default:
+			// CNAMEs of the chain count for the TTL
+			if err := p.SkipAnswer(); err != nil {
+				return nil, false, fmt.Errorf("malformed DNS response: %v", err)
+			}
+		}
+		if ttl := time.Duration(h.TTL) * time.Second; first || ttl < ans.ttl {
+			ans.ttl, first = ttl, false
+		}
+	}
+	if ans.notFound {
+		// Answers for a missing name are only the CNAMEs leading to it
+		if err := p.SkipAllAnswers(); err != nil {
+			return nil, false, fmt.Errorf("malformed DNS response: %v", err)
+		}
+	}
+	if len(ans.addrs) > 0 {
+		return ans, false, nil
+	}
+
+	// No addresses, the SOA record of the zone tells how long that may be cached (RFC 2308)
+	ans.notFound, ans.ttl = true, 0
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if h.Type == dnsmessage.TypeSOA {
+			if soa, err := p.SOAResource(); err == nil {
+				ans.ttl = time.Duration(min(h.TTL, soa.MinTTL)) * time.Second
+			}
+			break
+		}
+		if err := p.SkipAuthority(); err != nil {
+			break
+		}
+	}
+	return ans, false, nil
+}
+
+// systemServers returns the nameservers of /etc/resolv.conf, or the local server without any
+func systemServers() []string {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return []string{"127.0.0.1:53"}
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	if len(servers) == 0 {
+		return []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// normalizeServers adds the DNS port to servers given without one
+func normalizeServers(servers []string) []string {
+	normalized := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		normalized = append(normalized, server)
+	}
+	return normalized
+}
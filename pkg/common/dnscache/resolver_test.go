@@ -0,0 +1,123 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers queries on a local UDP socket: example.com has one address of each family,
+// v4only.example only an IPv4 address and every other name doesn't exist
+func serveDNS(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Class: dnsmessage.ClassINET, TTL: 600},
+		Body: &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."), MinTTL: 120,
+		},
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			q := query.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+			}
+			header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET}
+			switch name := q.Name.String(); {
+			case name == "example.com." && q.Type == dnsmessage.TypeA:
+				header.TTL = 300
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+			case name == "example.com." && q.Type == dnsmessage.TypeAAAA:
+				header.TTL = 60
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}})
+			case name == "v4only.example." && q.Type == dnsmessage.TypeA:
+				header.TTL = 300
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}})
+			case name == "v4only.example.":
+				resp.Authorities = append(resp.Authorities, soa)
+			default:
+				resp.RCode = dnsmessage.RCodeNameError
+				resp.Authorities = append(resp.Authorities, soa)
+			}
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestResolver_Lookup(t *testing.T) {
+	r := &resolver{servers: []string{serveDNS(t)}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, ttl, err := r.lookup(ctx, "example.com")
+	if err != nil || len(addrs) != 2 {
+		t.Fatalf("Expected both addresses, got %v %v", addrs, err)
+	}
+	if ttl != time.Minute {
+		t.Errorf("Expected the lowest TTL of the answers, got %v", ttl)
+	}
+
+	addrs, ttl, err = r.lookup(ctx, "v4only.example")
+	if err != nil || len(addrs) != 1 || ttl != 5*time.Minute {
+		t.Errorf("Expected the IPv4 address only, got %v %v %v", addrs, ttl, err)
+	}
+
+	_, ttl, err = r.lookup(ctx, "missing.example")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if ttl != 2*time.Minute {
+		t.Errorf("Expected the negative TTL of the SOA record, got %v", ttl)
+	}
+}
+
+func TestResolver_ServerFailover(t *testing.T) {
+	// Nothing listens on the first server, its queries are refused
+	unused, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := unused.LocalAddr().String()
+	_ = unused.Close()
+
+	r := &resolver{servers: []string{dead, serveDNS(t)}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if addrs, _, err := r.lookup(ctx, "example.com"); err != nil || len(addrs) != 2 {
+		t.Errorf("Expected the second server to answer, got %v %v", addrs, err)
+	}
+}
+
+func TestNormalizeServers(t *testing.T) {
+	got := normalizeServers([]string{"1.1.1.1", "8.8.8.8:5353", "2606:4700::1111", "[2001:db8::1]:53"})
+	want := []string{"1.1.1.1:53", "8.8.8.8:5353", "[2606:4700::1111]:53", "[2001:db8::1]:53"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("normalizeServers()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package encryption seals data the gateway keeps on disk, such as credential stores and rate
+// limit state, with AES-256-GCM. Sealed values carry a prefix, so stores written before
+// encryption was enabled can still be read and are re-written encrypted.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of an AES-256 key
+const KeySize = 32
+
+// sealedPrefix marks sealed values, the version allows changing the format
+const sealedPrefix = "enc:v1:"
+
+// Errors returned by Open
+var (
+	ErrNoKey     = errors.New("data is encrypted but no storage encryption key is configured")
+	ErrDecrypt   = errors.New("failed to decrypt data: wrong key or corrupted data")
+	ErrMalformed = errors.New("malformed encrypted data")
+)
+
+// Cipher seals and opens values. A nil *Cipher leaves values in plain text.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// New creates a Cipher with a 32 byte key
+func New(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("storage encryption key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Load creates a Cipher with the key in the environment variable keyEnv or the file keyFile,
+// for example one rendered by a KMS or secrets agent. It returns nil when neither is set.
+func Load(keyEnv, keyFile string) (*Cipher, error) {
+	var encoded string
+	switch {
+	case keyEnv != "" && keyFile != "":
+		return nil, fmt.Errorf("storage encryption key_env and key_file are mutually exclusive")
+	case keyEnv != "":
+		value, ok := os.LookupEnv(keyEnv)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("storage encryption key environment variable %s is not set", keyEnv)
+		}
+		encoded = value
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile) //nolint:gosec // path comes from the gateway config
+		if err != nil {
+			return nil, fmt.Errorf("failed to read storage encryption key: %v", err)
+		}
+		encoded = string(data)
+	default:
+		return nil, nil
+	}
+
+	key, err := DecodeKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return New(key)
+}
+
+// DecodeKey decodes a base64 or hex encoded 32 byte key, as generated by
+// "openssl rand -base64 32" or "openssl rand -hex 32"
+func DecodeKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if len(encoded) == hex.EncodedLen(KeySize) {
+		if key, err := hex.DecodeString(encoded); err == nil {
+			return key, nil
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("storage encryption key must be %d bytes encoded as base64 or hex", KeySize)
+	}
+	return key, nil
+}
+
+// IsSealed reports whether data was sealed by a Cipher
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealedPrefix))
+}
+
+// Seal encrypts plaintext, a nil Cipher returns it unchanged
+func (c *Cipher) Seal(plaintext []byte) ([]byte, error) {
+	if c == nil {
+		return plaintext, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, []byte(sealedPrefix))
+
+	out := make([]byte, len(sealedPrefix)+base64.RawStdEncoding.EncodedLen(len(sealed)))
+	copy(out, sealedPrefix)
+	base64.RawStdEncoding.Encode(out[len(sealedPrefix):], sealed)
+	return out, nil
+}
+
+// Open decrypts data sealed by Seal. Data without the sealed prefix is returned unchanged, so
+// plain text written before encryption was enabled stays readable.
+func (c *Cipher) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, ErrNoKey
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(string(data[len(sealedPrefix):]))
+	if err != nil || len(sealed) < c.aead.NonceSize()+c.aead.Overhead() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(sealedPrefix))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// SealString is Seal for string values such as database columns
+func (c *Cipher) SealString(plaintext string) (string, error) {
+	sealed, err := c.Seal([]byte(plaintext))
+	return string(sealed), err
+}
+
+// OpenString is Open for string values such as database columns
+func (c *Cipher) OpenString(data string) (string, error) {
+	plaintext, err := c.Open([]byte(data))
+	return string(plaintext), err
+}
+
+// Enabled reports whether values are encrypted
+func (c *Cipher) Enabled() bool {
+	return c != nil
+}
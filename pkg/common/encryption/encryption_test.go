@@ -0,0 +1,97 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestCipher_SealOpen(t *testing.T) {
+	c, err := New(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := c.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("Expected sealed data without the plain text, got %q", sealed)
+	}
+	again, _ := c.Seal([]byte("secret"))
+	if bytes.Equal(sealed, again) {
+		t.Error("Expected a fresh nonce for each seal")
+	}
+	if plaintext, err := c.Open(sealed); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Open() = %q, %v", plaintext, err)
+	}
+
+	// Plain text from before encryption was enabled passes through
+	if plaintext, err := c.OpenString(`{"group":"hash"}`); err != nil || plaintext != `{"group":"hash"}` {
+		t.Errorf("OpenString() = %q, %v", plaintext, err)
+	}
+
+	other, _ := New(testKey(2))
+	if _, err := other.Open(sealed); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected a decryption error with another key, got %v", err)
+	}
+	var disabled *Cipher
+	if _, err := disabled.Open(sealed); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Expected ErrNoKey without a key, got %v", err)
+	}
+	if plaintext, err := disabled.SealString("plain"); err != nil || plaintext != "plain" {
+		t.Errorf("Expected a nil cipher to keep plain text, got %q, %v", plaintext, err)
+	}
+	if _, err := c.Open(append([]byte(sealedPrefix), "!!"...)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed, got %v", err)
+	}
+
+	if _, err := New([]byte("short")); err == nil {
+		t.Error("Expected an error for a short key")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if c, err := Load("", ""); c != nil || err != nil {
+		t.Errorf("Expected no cipher when unconfigured, got %v, %v", c, err)
+	}
+
+	t.Setenv("ANYPROXY_TEST_STORAGE_KEY", base64.StdEncoding.EncodeToString(testKey(3)))
+	fromEnv, err := Load("ANYPROXY_TEST_STORAGE_KEY", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "storage.key")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(testKey(3))+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := Load("", keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, _ := fromEnv.Seal([]byte("secret"))
+	if plaintext, err := fromFile.Open(sealed); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Expected the base64 and hex encodings of a key to match, got %q, %v", plaintext, err)
+	}
+
+	if _, err := Load("ANYPROXY_TEST_UNSET_KEY", ""); err == nil {
+		t.Error("Expected an error for an unset environment variable")
+	}
+	if _, err := Load("ANYPROXY_TEST_STORAGE_KEY", keyFile); err == nil {
+		t.Error("Expected an error when both sources are set")
+	}
+	if _, err := DecodeKey("dG9vIHNob3J0"); err == nil {
+		t.Error("Expected an error for a short key")
+	}
+}
@@ -0,0 +1,397 @@
+// Package geoip provides country lookups backed by a MaxMind DB (GeoIP2/GeoLite2 Country or City) file.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// metadataMarker precedes the metadata section at the end of a MaxMind DB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSectionSeparator is the number of zero bytes between the search tree and the data section
+const dataSectionSeparator = 16
+
+// Data section field types
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBool     = 14
+	typeFloat    = 15
+)
+
+// ErrInvalidDatabase is returned when the file is not a valid MaxMind DB
+var ErrInvalidDatabase = errors.New("invalid MaxMind DB file")
+
+// Reader is a minimal MaxMind DB reader that only decodes what country lookups need
+type Reader struct {
+	buf          []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint
+	databaseType string
+}
+
+// Open loads a MaxMind DB file into memory
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path) // nolint:gosec // path comes from the gateway configuration
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geoip database: %v", err)
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes creates a reader from the raw contents of a MaxMind DB file
+func FromBytes(buf []byte) (*Reader, error) {
+	markerIdx := bytes.LastIndex(buf, metadataMarker)
+	if markerIdx < 0 {
+		return nil, fmt.Errorf("%w: metadata marker not found", ErrInvalidDatabase)
+	}
+
+	metaDecoder := &decoder{buf: buf[markerIdx+len(metadataMarker):]}
+	rawMeta, _, err := metaDecoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDatabase, err)
+	}
+	meta, ok := rawMeta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+
+	r := &Reader{
+		buf:        buf,
+		nodeCount:  uint(toUint64(meta["node_count"])),
+		recordSize: uint(toUint64(meta["record_size"])),
+		ipVersion:  uint(toUint64(meta["ip_version"])),
+	}
+	r.databaseType, _ = meta["database_type"].(string)
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported ip version %d", ErrInvalidDatabase, r.ipVersion)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	dataStart := treeSize + dataSectionSeparator
+	if dataStart > uint(markerIdx) {
+		return nil, fmt.Errorf("%w: search tree exceeds file size", ErrInvalidDatabase)
+	}
+	r.data = buf[dataStart:markerIdx]
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node, err = r.readNode(node, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// DatabaseType returns the database_type from the metadata (e.g. "GeoLite2-Country")
+func (r *Reader) DatabaseType() string {
+	return r.databaseType
+}
+
+// Country returns the ISO 3166-1 alpha-2 country code for an IP, or "" when unknown
+func (r *Reader) Country(ip net.IP) string {
+	record, err := r.lookup(ip)
+	if err != nil || record == nil {
+		return ""
+	}
+	if code := isoCode(record, "country"); code != "" {
+		return code
+	}
+	return isoCode(record, "registered_country")
+}
+
+// lookup returns the decoded data record for an IP
+func (r *Reader) lookup(ip net.IP) (interface{}, error) {
+	if ip == nil {
+		return nil, errors.New("invalid IP address")
+	}
+
+	bitCount := 128
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bitCount = 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, errors.New("IPv6 address in an IPv4-only database")
+	}
+
+	var err error
+	for i := 0; i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i%8))) & 1
+		node, err = r.readNode(node, bit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if node == r.nodeCount {
+		// Not found
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("%w: search tree too deep", ErrInvalidDatabase)
+	}
+
+	offset := node - r.nodeCount - dataSectionSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, fmt.Errorf("%w: data pointer out of range", ErrInvalidDatabase)
+	}
+	d := &decoder{buf: r.data}
+	value, _, err := d.decode(offset)
+	return value, err
+}
+
+// readNode reads the left (bit 0) or right (bit 1) record of a search tree node
+func (r *Reader) readNode(node, bit uint) (uint, error) {
+	offset := node * r.recordSize / 4
+	if offset+r.recordSize/4 > uint(len(r.buf)) {
+		return 0, fmt.Errorf("%w: node out of range", ErrInvalidDatabase)
+	}
+	b := r.buf[offset:]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// isoCode extracts record[key]["iso_code"]
+func isoCode(record interface{}, key string) string {
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	country, ok := fields[key].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	code, _ := country["iso_code"].(string)
+	return strings.ToUpper(code)
+}
+
+// toUint64 converts a decoded unsigned value to uint64
+func toUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n > 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+// decoder decodes the MaxMind DB data section format
+type decoder struct {
+	buf []byte
+}
+
+// decode decodes the value at offset and returns it with the offset of the next value
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	typeNum, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typeNum == typePointer {
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+
+	return d.decodeValue(typeNum, size, offset)
+}
+
+// decodeControl parses a control byte and returns the type, payload size and payload offset
+func (d *decoder) decodeControl(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidDatabase)
+	}
+	ctrl := d.buf[offset]
+	offset++
+
+	typeNum := int(ctrl >> 5)
+	if typeNum == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidDatabase)
+		}
+		typeNum = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if typeNum == typePointer {
+		return typeNum, size, offset, nil
+	}
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(d.buf)) {
+			return 0, 0, 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidDatabase)
+		}
+		n := uint(0)
+		for _, b := range d.buf[offset : offset+extra] {
+			n = n<<8 | uint(b)
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + n
+		case 2:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+	return typeNum, size, offset, nil
+}
+
+// decodePointer resolves a pointer whose control bits are in size
+func (d *decoder) decodePointer(size, offset uint) (uint, uint, error) {
+	pointerSize := ((size >> 3) & 0x3) + 1
+	if offset+pointerSize > uint(len(d.buf)) {
+		return 0, 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidDatabase)
+	}
+	b := d.buf[offset : offset+pointerSize]
+
+	prefix := uint(0)
+	if pointerSize != 4 {
+		prefix = size & 0x7
+	}
+	n := prefix
+	for _, v := range b {
+		n = n<<8 | uint(v)
+	}
+
+	switch pointerSize {
+	case 2:
+		n += 2048
+	case 3:
+		n += 526336
+	}
+	return n, offset + pointerSize, nil
+}
+
+// decodeValue decodes a non-pointer value of the given type
+func (d *decoder) decodeValue(typeNum int, size, offset uint) (interface{}, uint, error) {
+	switch typeNum {
+	case typeMap:
+		result := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key is not a string", ErrInvalidDatabase)
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			result[keyStr] = value
+			offset = next
+		}
+		return result, offset, nil
+	case typeArray:
+		result := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			result = append(result, value)
+			offset = next
+		}
+		return result, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("%w: unexpected end of data", ErrInvalidDatabase)
+	}
+	payload := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch typeNum {
+	case typeString:
+		return string(payload), next, nil
+	case typeBytes:
+		return append([]byte(nil), payload...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: invalid double size %d", ErrInvalidDatabase, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: invalid float size %d", ErrInvalidDatabase, size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), next, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: integer too large", ErrInvalidDatabase)
+		}
+		n := uint64(0)
+		for _, b := range payload {
+			n = n<<8 | uint64(b)
+		}
+		if typeNum == typeInt32 {
+			return int64(int32(uint32(n))), next, nil // nolint:gosec // int32 is stored in at most 4 bytes
+		}
+		return n, next, nil
+	case typeUint128:
+		// Not needed for country lookups, keep the raw bytes
+		return append([]byte(nil), payload...), next, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: unsupported data type %d", ErrInvalidDatabase, typeNum)
+	}
+}
@@ -0,0 +1,196 @@
+package geoip
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTrieNode is a search tree node of the test database builder
+type testTrieNode struct {
+	child [2]int // Index of the child node, 0 when absent (the root is never a child)
+	data  [2]int // Index of the data record, -1 when absent
+}
+
+// buildTestDB builds a MaxMind DB with 24-bit records mapping CIDRs to country codes
+func buildTestDB(t *testing.T, ipVersion int, networks map[string]string) []byte {
+	t.Helper()
+
+	nodes := []testTrieNode{{data: [2]int{-1, -1}}}
+	var records [][]byte
+
+	for cidr, country := range networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Invalid CIDR %s: %v", cidr, err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP
+		if ipVersion == 6 {
+			if ip4 := ip.To4(); ip4 != nil {
+				// IPv4 networks live under ::/96 in IPv6 databases
+				ip = append(make(net.IP, 12), ip4...)
+				ones += 96
+			}
+		}
+
+		records = append(records, encodeMap(map[string][]byte{
+			"country": encodeMap(map[string][]byte{"iso_code": encodeString(country)}),
+		}))
+		dataIdx := len(records) - 1
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i>>3]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node].data[bit] = dataIdx
+				break
+			}
+			if nodes[node].child[bit] == 0 {
+				nodes = append(nodes, testTrieNode{data: [2]int{-1, -1}})
+				nodes[node].child[bit] = len(nodes) - 1
+			}
+			node = nodes[node].child[bit]
+		}
+	}
+
+	var data bytes.Buffer
+	offsets := make([]int, len(records))
+	for i, record := range records {
+		offsets[i] = data.Len()
+		data.Write(record)
+	}
+
+	nodeCount := len(nodes)
+	var tree bytes.Buffer
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			value := nodeCount
+			switch {
+			case n.data[bit] >= 0:
+				value = nodeCount + dataSectionSeparator + offsets[n.data[bit]]
+			case n.child[bit] > 0:
+				value = n.child[bit]
+			}
+			tree.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(tree.Bytes())
+	buf.Write(make([]byte, dataSectionSeparator))
+	buf.Write(data.Bytes())
+	buf.Write(metadataMarker)
+	buf.Write(encodeMap(map[string][]byte{
+		"node_count":    encodeUint(typeUint32, uint64(nodeCount)),
+		"record_size":   encodeUint(typeUint16, 24),
+		"ip_version":    encodeUint(typeUint16, uint64(ipVersion)),
+		"database_type": encodeString("Test-Country"),
+	}))
+	return buf.Bytes()
+}
+
+func encodeString(s string) []byte {
+	return append([]byte{byte(typeString<<5 | len(s))}, s...)
+}
+
+func encodeUint(typeNum int, n uint64) []byte {
+	var payload []byte
+	for n > 0 {
+		payload = append([]byte{byte(n)}, payload...)
+		n >>= 8
+	}
+	if typeNum >= 8 {
+		return append([]byte{byte(len(payload)), byte(typeNum - 7)}, payload...)
+	}
+	return append([]byte{byte(typeNum<<5 | len(payload))}, payload...)
+}
+
+func encodeMap(fields map[string][]byte) []byte {
+	out := []byte{byte(typeMap<<5 | len(fields))}
+	for key, value := range fields {
+		out = append(out, encodeString(key)...)
+		out = append(out, value...)
+	}
+	return out
+}
+
+func TestReader_CountryIPv4Database(t *testing.T) {
+	db, err := FromBytes(buildTestDB(t, 4, map[string]string{
+		"1.0.0.0/8":   "au",
+		"2.16.0.0/16": "FR",
+	}))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	if db.DatabaseType() != "Test-Country" {
+		t.Errorf("Expected database type Test-Country, got %q", db.DatabaseType())
+	}
+
+	tests := map[string]string{
+		"1.2.3.4":    "AU",
+		"2.16.9.9":   "FR",
+		"2.17.0.1":   "",
+		"8.8.8.8":    "",
+		"2001:db8::": "",
+	}
+	for ip, want := range tests {
+		if got := db.Country(net.ParseIP(ip)); got != want {
+			t.Errorf("Country(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestReader_CountryIPv6Database(t *testing.T) {
+	db, err := FromBytes(buildTestDB(t, 6, map[string]string{
+		"10.0.0.0/8":    "DE",
+		"2001:db8::/32": "NL",
+	}))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+
+	if got := db.Country(net.ParseIP("10.1.2.3")); got != "DE" {
+		t.Errorf("Expected IPv4 lookup through ::/96 to return DE, got %q", got)
+	}
+	if got := db.Country(net.ParseIP("2001:db8::1")); got != "NL" {
+		t.Errorf("Expected NL, got %q", got)
+	}
+	if got := db.Country(net.ParseIP("2001:db9::1")); got != "" {
+		t.Errorf("Expected no country, got %q", got)
+	}
+}
+
+func TestReader_PointerAndRegisteredCountry(t *testing.T) {
+	d := &decoder{buf: []byte{}}
+	// "registered_country" map stored first, then a record pointing at it via a pointer
+	shared := encodeMap(map[string][]byte{"iso_code": encodeString("JP")})
+	d.buf = append(d.buf, shared...)
+	record := []byte{byte(typeMap<<5 | 1)}
+	record = append(record, encodeString("registered_country")...)
+	record = append(record, byte(typePointer<<5), 0) // Pointer to offset 0
+	d.buf = append(d.buf, record...)
+
+	value, _, err := d.decode(uint(len(shared)))
+	if err != nil {
+		t.Fatalf("Failed to decode record: %v", err)
+	}
+	if code := isoCode(value, "registered_country"); code != "JP" {
+		t.Errorf("Expected JP through pointer, got %q", code)
+	}
+}
+
+func TestOpen_InvalidDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Expected error for invalid database")
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("Expected error for missing database")
+	}
+}
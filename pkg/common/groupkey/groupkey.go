@@ -0,0 +1,57 @@
+// Package groupkey derives a signing key per group from the group password and signs control
+// messages with it. Clients know the password from their config, the gateway only while a client
+// that authenticated with it is connected, as it stores password hashes. A signature proves the
+// message comes from a client or the gateway process holding the password, not that an operator
+// approved it: the gateway signs its policy pushes automatically, including packs changed by
+// whoever controls its configuration.
+package groupkey
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Size is the size of keys and signatures
+const Size = sha256.Size
+
+// info binds derived keys to control message signing, the version allows changing the scheme
+const info = "anyproxy control signing v1"
+
+// Derive returns the key of a group, HKDF-SHA256 (RFC 5869) of the password salted with the
+// group ID. It returns nil for an empty password.
+func Derive(groupID, password string) []byte {
+	if password == "" {
+		return nil
+	}
+	extract := hmac.New(sha256.New, []byte(groupID))
+	extract.Write([]byte(password))
+	// A single expand block yields the whole key
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// Sign returns the signature of a message
+func Sign(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// Verify reports whether sig is the signature of msg, always false without a key
+func Verify(key, msg, sig []byte) bool {
+	return len(key) > 0 && hmac.Equal(Sign(key, msg), sig)
+}
+
+// SignHex returns the hex encoded signature of a message, as sent in HTTP headers
+func SignHex(key, msg []byte) string {
+	return hex.EncodeToString(Sign(key, msg))
+}
+
+// VerifyHex reports whether the hex encoded sig is the signature of msg
+func VerifyHex(key, msg []byte, sig string) bool {
+	decoded, err := hex.DecodeString(sig)
+	return err == nil && Verify(key, msg, decoded)
+}
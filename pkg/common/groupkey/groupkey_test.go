@@ -0,0 +1,43 @@
+package groupkey
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDerive(t *testing.T) {
+	key := Derive("office", "secret")
+	if len(key) != Size {
+		t.Fatalf("Expected a %d byte key, got %d", Size, len(key))
+	}
+	if !bytes.Equal(key, Derive("office", "secret")) {
+		t.Error("Expected the same key for the same group and password")
+	}
+	if bytes.Equal(key, Derive("office", "other")) || bytes.Equal(key, Derive("lab", "secret")) {
+		t.Error("Expected other keys for other passwords and groups")
+	}
+	if Derive("office", "") != nil {
+		t.Error("Expected no key without a password")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	key := Derive("office", "secret")
+	msg := []byte(`{"packs":[]}`)
+
+	if !Verify(key, msg, Sign(key, msg)) || !VerifyHex(key, msg, SignHex(key, msg)) {
+		t.Error("Expected the signature to verify")
+	}
+	if Verify(Derive("office", "other"), msg, Sign(key, msg)) {
+		t.Error("Expected a signature of another key to fail")
+	}
+	if Verify(key, []byte(`{"packs":null}`), Sign(key, msg)) {
+		t.Error("Expected a signature of another message to fail")
+	}
+	if Verify(nil, msg, Sign(nil, msg)) {
+		t.Error("Expected verifying without a key to fail")
+	}
+	if VerifyHex(key, msg, "not hex") {
+		t.Error("Expected an invalid hex signature to fail")
+	}
+}
@@ -0,0 +1,141 @@
+// Package identity lets clients prove their client ID with an ed25519 key. A client signs its
+// ID, group and the current time in the transport handshake, and the gateway pins the key that
+// first proved an ID so another client with the group password cannot take it over.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proofVersion prefixes proofs so the format can change
+const proofVersion = "v1"
+
+// Proof errors
+var (
+	ErrInvalidProof = errors.New("invalid client identity proof")
+	ErrStaleProof   = errors.New("client identity proof is outside the allowed clock skew")
+)
+
+// LoadOrCreateKey reads a PEM encoded ed25519 private key, the key is generated and written
+// with mode 0600 when the file doesn't exist
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // path comes from the client config
+	if errors.Is(err, os.ErrNotExist) {
+		return createKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("identity key %s is not PEM encoded", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity key: %v", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity key %s is not an ed25519 key", path)
+	}
+	return key, nil
+}
+
+func createKey(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode identity key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create identity key directory: %v", err)
+	}
+	// O_EXCL keeps replicas starting together from overwriting each other's key
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) //nolint:gosec // path comes from the client config
+	if errors.Is(err, os.ErrExist) {
+		return LoadOrCreateKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write identity key: %v", err)
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, fmt.Errorf("failed to write identity key: %v", err)
+	}
+	return key, nil
+}
+
+// replicaSuffix matches the "-r<replica>-<xid>" suffix clients append to their configured ID
+var replicaSuffix = regexp.MustCompile(`-r[0-9]+-[0-9a-v]{20}$`)
+
+// BaseClientID returns the configured ID of a client connection ID. Clients connect with a new
+// ID each time, so pins are kept by the configured ID.
+func BaseClientID(clientID string) string {
+	return replicaSuffix.ReplaceAllString(clientID, "")
+}
+
+// Fingerprint identifies a public key, it is what the gateway pins
+func Fingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// signedData is what a proof signs, binding it to the client ID, group and time
+func signedData(clientID, groupID string, unix int64) []byte {
+	return []byte("anyproxy-client-identity\x00" + clientID + "\x00" + groupID + "\x00" + strconv.FormatInt(unix, 10))
+}
+
+// NewProof signs clientID and groupID at now, the result is sent in the transport handshake
+func NewProof(key ed25519.PrivateKey, clientID, groupID string, now time.Time) string {
+	unix := now.Unix()
+	sig := ed25519.Sign(key, signedData(clientID, groupID, unix))
+	pub, _ := key.Public().(ed25519.PublicKey)
+	return strings.Join([]string{
+		proofVersion,
+		base64.RawURLEncoding.EncodeToString(pub),
+		strconv.FormatInt(unix, 10),
+		base64.RawURLEncoding.EncodeToString(sig),
+	}, ".")
+}
+
+// VerifyProof checks a proof for clientID and groupID and returns the fingerprint of its key
+func VerifyProof(proof, clientID, groupID string, now time.Time, maxSkew time.Duration) (string, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 4 || parts[0] != proofVersion {
+		return "", ErrInvalidProof
+	}
+	pub, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return "", ErrInvalidProof
+	}
+	unix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", ErrInvalidProof
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil || !ed25519.Verify(pub, signedData(clientID, groupID, unix), sig) {
+		return "", ErrInvalidProof
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return "", ErrStaleProof
+	}
+	return Fingerprint(pub), nil
+}
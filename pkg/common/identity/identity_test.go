@@ -0,0 +1,87 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "client.key")
+	key, err := LoadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected a 0600 key file, got %v, %v", info, err)
+	}
+
+	loaded, err := LoadOrCreateKey(path)
+	if err != nil || !loaded.Equal(key) {
+		t.Errorf("Expected the stored key to be loaded, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateKey(path); err == nil {
+		t.Error("Expected an error for an invalid key file")
+	}
+}
+
+func TestProof(t *testing.T) {
+	key, err := LoadOrCreateKey(filepath.Join(t.TempDir(), "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	proof := NewProof(key, "client-1", "group-a", now)
+
+	fingerprint, err := VerifyProof(proof, "client-1", "group-a", now.Add(time.Minute), 5*time.Minute)
+	if err != nil {
+		t.Fatalf("VerifyProof() error = %v", err)
+	}
+	if want := Fingerprint(key.Public().(ed25519.PublicKey)); fingerprint != want {
+		t.Errorf("Fingerprint = %s, want %s", fingerprint, want)
+	}
+
+	tests := []struct {
+		name     string
+		proof    string
+		clientID string
+		groupID  string
+		now      time.Time
+		want     error
+	}{
+		{"other client ID", proof, "client-2", "group-a", now, ErrInvalidProof},
+		{"other group", proof, "client-1", "group-b", now, ErrInvalidProof},
+		{"stale", proof, "client-1", "group-a", now.Add(time.Hour), ErrStaleProof},
+		{"from the future", proof, "client-1", "group-a", now.Add(-time.Hour), ErrStaleProof},
+		{"garbage", "v1.abc.1.def", "client-1", "group-a", now, ErrInvalidProof},
+		{"unknown version", "v2" + strings.TrimPrefix(proof, "v1"), "client-1", "group-a", now, ErrInvalidProof},
+	}
+	for _, tt := range tests {
+		if _, err := VerifyProof(tt.proof, tt.clientID, tt.groupID, tt.now, 5*time.Minute); !errors.Is(err, tt.want) {
+			t.Errorf("%s: VerifyProof() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestBaseClientID(t *testing.T) {
+	tests := map[string]string{
+		"edge-1-r0-cv2pq8hf2n0ctcfg7o10":  "edge-1",
+		"edge-1-r12-cv2pq8hf2n0ctcfg7o10": "edge-1",
+		"edge-1":                          "edge-1",
+		"edge-1-r0-short":                 "edge-1-r0-short",
+	}
+	for clientID, want := range tests {
+		if got := BaseClientID(clientID); got != want {
+			t.Errorf("BaseClientID(%q) = %q, want %q", clientID, got, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package krb5
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // HMAC-SHA1-96 is what the aes-cts-hmac-sha1-96 enctypes use
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Encryption types of the keys that can be used (RFC 3962)
+const (
+	ETypeAES128 = 17 // aes128-cts-hmac-sha1-96
+	ETypeAES256 = 18 // aes256-cts-hmac-sha1-96
+)
+
+// Key usage numbers (RFC 4120 section 7.5.1, RFC 4121 section 2)
+const (
+	usageTicket         = 2
+	usageAuthenticator  = 11
+	usageAPRepPart      = 12
+	usageAcceptorSeal   = 22
+	usageInitiatorSeal  = 24
+	checksumSize        = 12 // HMAC-SHA1-96
+	confounderSize      = aes.BlockSize
+	derivedKeyEncrypt   = 0xAA
+	derivedKeyIntegrity = 0x55
+	derivedKeyChecksum  = 0x99
+)
+
+// ErrIntegrity is returned for data that doesn't match its checksum, e.g. decrypted with another key
+var ErrIntegrity = errors.New("krb5: integrity check failed")
+
+// Key is a Kerberos encryption key
+type Key struct {
+	EType int32
+	Value []byte
+}
+
+// checkKey verifies the key is a supported enctype of the right size
+func checkKey(key Key) error {
+	switch {
+	case key.EType == ETypeAES128 && len(key.Value) == 16, key.EType == ETypeAES256 && len(key.Value) == 32:
+		return nil
+	case key.EType == ETypeAES128 || key.EType == ETypeAES256:
+		return fmt.Errorf("krb5: %d byte key for enctype %d", len(key.Value), key.EType)
+	}
+	return fmt.Errorf("krb5: unsupported enctype %d", key.EType)
+}
+
+// encrypt encrypts plaintext for a key usage: a random confounder and the plaintext encrypted
+// with AES-CTS, followed by an HMAC of both
+func encrypt(key Key, usage uint32, plaintext []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	data := make([]byte, confounderSize+len(plaintext))
+	if _, err := rand.Read(data[:confounderSize]); err != nil {
+		return nil, err
+	}
+	copy(data[confounderSize:], plaintext)
+
+	ciphertext, err := encryptCTS(deriveKey(key.Value, usage, derivedKeyEncrypt), data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ciphertext, hmacSHA1(deriveKey(key.Value, usage, derivedKeyIntegrity), data)...), nil
+}
+
+// decrypt reverses encrypt
+func decrypt(key Key, usage uint32, ciphertext []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < confounderSize+checksumSize {
+		return nil, fmt.Errorf("krb5: ciphertext of %d bytes is too short", len(ciphertext))
+	}
+	mac := ciphertext[len(ciphertext)-checksumSize:]
+	data, err := decryptCTS(deriveKey(key.Value, usage, derivedKeyEncrypt), ciphertext[:len(ciphertext)-checksumSize])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, hmacSHA1(deriveKey(key.Value, usage, derivedKeyIntegrity), data)) {
+		return nil, ErrIntegrity
+	}
+	return data[confounderSize:], nil
+}
+
+// checksum returns the keyed checksum of data for a key usage
+func checksum(key Key, usage uint32, data []byte) []byte {
+	return hmacSHA1(deriveKey(key.Value, usage, derivedKeyChecksum), data)
+}
+
+// hmacSHA1 returns HMAC-SHA1 truncated to 96 bits
+func hmacSHA1(key, data []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:checksumSize]
+}
+
+// deriveKey returns the key derived for a key usage and purpose, DK(key, usage | purpose)
+func deriveKey(key []byte, usage uint32, purpose byte) []byte {
+	constant := binary.BigEndian.AppendUint32(nil, usage)
+	return dk(key, append(constant, purpose))
+}
+
+// dk is the RFC 3961 DK function for AES: the n-folded constant is encrypted repeatedly until
+// there are enough bytes for a key, random-to-key is the identity
+func dk(key, constant []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		// Keys are checked before use
+		panic(err)
+	}
+	out := make([]byte, 0, len(key)+aes.BlockSize)
+	in := nfold(constant, aes.BlockSize)
+	for len(out) < len(key) {
+		next := make([]byte, aes.BlockSize)
+		block.Encrypt(next, in)
+		out = append(out, next...)
+		in = next
+	}
+	return out[:len(key)]
+}
+
+// nfold stretches or shrinks in to n bytes as in RFC 3961 section 5.1: copies of in, each rotated
+// right by 13 more bits, are added together in one's-complement arithmetic
+func nfold(in []byte, n int) []byte {
+	inLen := len(in)
+	gcd, b := n, inLen
+	for b != 0 {
+		gcd, b = b, gcd%b
+	}
+	lcm := n * inLen / gcd
+
+	out := make([]byte, n)
+	carry := 0
+	inBits := inLen * 8
+	for i := lcm - 1; i >= 0; i-- {
+		// The most significant bit of in added into this byte
+		msbit := (inBits - 1 + (inBits+13)*(i/inLen) + (inLen-i%inLen)*8) % inBits
+		hi := int(in[(inLen-1-msbit/8+inLen)%inLen])
+		lo := int(in[(inLen-msbit/8)%inLen])
+		carry += ((hi<<8 | lo) >> (msbit%8 + 1)) & 0xff
+		carry += int(out[i%n])
+		out[i%n] = byte(carry)
+		carry >>= 8
+	}
+	for i := n - 1; carry != 0 && i >= 0; i-- {
+		carry += int(out[i])
+		out[i] = byte(carry)
+		carry >>= 8
+	}
+	return out
+}
+
+// encryptCTS encrypts with AES in CBC mode with ciphertext stealing and a zero IV, the last two
+// blocks swapped as in RFC 3962
+func encryptCTS(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := len(plaintext)
+	if n < aes.BlockSize {
+		return nil, fmt.Errorf("krb5: %d bytes are too short for CTS", n)
+	}
+	padded := make([]byte, (n+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, plaintext)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(padded, padded)
+	if len(padded) == aes.BlockSize {
+		return padded, nil
+	}
+	last := len(padded) - aes.BlockSize
+	out := append([]byte{}, padded[:last-aes.BlockSize]...)
+	out = append(out, padded[last:]...)
+	out = append(out, padded[last-aes.BlockSize:last]...)
+	return out[:n], nil
+}
+
+// decryptCTS reverses encryptCTS
+func decryptCTS(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	n := len(ciphertext)
+	if n < aes.BlockSize {
+		return nil, fmt.Errorf("krb5: %d bytes are too short for CTS", n)
+	}
+	zeroIV := make([]byte, aes.BlockSize)
+	if n == aes.BlockSize {
+		out := make([]byte, n)
+		cipher.NewCBCDecrypter(block, zeroIV).CryptBlocks(out, ciphertext)
+		return out, nil
+	}
+
+	// The full block before the stolen tail is the encrypted last block. Decrypting it yields the
+	// zero padded last plaintext block XOR the previous ciphertext block, whose bytes past the
+	// tail were stolen.
+	tail := (n-1)%aes.BlockSize + 1
+	lastFull := n - tail - aes.BlockSize
+	encLast := ciphertext[lastFull : lastFull+aes.BlockSize]
+	x := make([]byte, aes.BlockSize)
+	block.Decrypt(x, encLast)
+	prev := append(append([]byte{}, ciphertext[n-tail:]...), x[tail:]...)
+
+	cbc := append([]byte{}, ciphertext[:lastFull]...)
+	cbc = append(cbc, prev...)
+	cbc = append(cbc, encLast...)
+	cipher.NewCBCDecrypter(block, zeroIV).CryptBlocks(cbc, cbc)
+	return cbc[:n], nil
+}
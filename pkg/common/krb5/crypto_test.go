@@ -0,0 +1,101 @@
+package krb5
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 3961 appendix A.1
+func TestNFold(t *testing.T) {
+	tests := []struct {
+		in   string
+		bits int
+		want string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 64, "bb6ed30870b7f0e0"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"kerberos", 64, "6b65726265726f73"},
+		{"kerberos", 128, "6b65726265726f737b9b5b2b93132b93"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(nfold([]byte(tt.in), tt.bits/8)); got != tt.want {
+			t.Errorf("%d-fold(%q) = %s, want %s", tt.bits, tt.in, got, tt.want)
+		}
+	}
+}
+
+// RFC 3962 appendix B
+func TestCTS(t *testing.T) {
+	key := []byte("chicken teriyaki")
+	tests := []struct {
+		in, want string
+	}{
+		{"4920776f756c64206c696b652074686520", "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320",
+			"fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c2047617527732043",
+			"39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+	}
+	for _, tt := range tests {
+		in := unhex(t, tt.in)
+		got, err := encryptCTS(key, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("encryptCTS(%s) = %x, want %s", tt.in, got, tt.want)
+		}
+		plain, err := decryptCTS(key, got)
+		if err != nil || !bytes.Equal(plain, in) {
+			t.Errorf("decryptCTS(%x) = %x, %v, want %s", got, plain, err, tt.in)
+		}
+	}
+}
+
+// RFC 3962 appendix B, the string-to-key of "password" with salt "ATHENA.MIT.EDUraeburn" and
+// one PBKDF2 iteration
+func TestDK(t *testing.T) {
+	tkey := unhex(t, "cdedb5281bb2f801565a1122b2563515")
+	if got := hex.EncodeToString(dk(tkey, []byte("kerberos"))); got != "42263c6e89f4fc28b8df68ee09799f15" {
+		t.Errorf("DK(tkey, kerberos) = %s", got)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	for _, key := range []Key{
+		{EType: ETypeAES128, Value: bytes.Repeat([]byte{1}, 16)},
+		{EType: ETypeAES256, Value: bytes.Repeat([]byte{2}, 32)},
+	} {
+		for _, size := range []int{0, 1, 16, 17, 100} {
+			plain := bytes.Repeat([]byte{'x'}, size)
+			ciphertext, err := encrypt(key, usageTicket, plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decrypt(key, usageTicket, ciphertext)
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Errorf("enctype %d, %d bytes: decrypt = %x, %v", key.EType, size, got, err)
+			}
+			if _, err := decrypt(key, usageAuthenticator, ciphertext); !errors.Is(err, ErrIntegrity) {
+				t.Errorf("enctype %d: expected another key usage to fail, got %v", key.EType, err)
+			}
+		}
+	}
+
+	if _, err := encrypt(Key{EType: 23, Value: make([]byte, 16)}, usageTicket, nil); err == nil {
+		t.Error("Expected rc4-hmac to be unsupported")
+	}
+}
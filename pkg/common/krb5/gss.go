@@ -0,0 +1,337 @@
+// Package krb5 accepts Kerberos 5 GSS-API security contexts (RFC 4121) with keys from a keytab,
+// enough for a service to authenticate users with Kerberos tickets, e.g. from Active Directory,
+// and protect their traffic. Only the AES enctypes of RFC 3962 are supported; the initiator side,
+// ticket requests and delegation are not.
+package krb5
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MaxClockSkew is how far the clocks of users and the service may differ
+const MaxClockSkew = 5 * time.Minute
+
+// mechOID is the Kerberos 5 GSS-API mechanism
+var mechOID = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+
+// Context token IDs (RFC 4121 section 4.1)
+var (
+	tokenAPReq = []byte{0x01, 0x00}
+	tokenAPRep = []byte{0x02, 0x00}
+)
+
+// GSS checksum of the authenticator (RFC 4121 section 4.1.1)
+const (
+	gssChecksumType = 0x8003
+	gssFlagMutual   = 2
+)
+
+// Wrap tokens (RFC 4121 section 4.2.6.2)
+const (
+	wrapHeaderSize       = 16
+	wrapFlagSentByAccept = 0x01
+	wrapFlagSealed       = 0x02
+	wrapFlagAcceptorKey  = 0x04
+)
+
+var wrapTokenID = []byte{0x05, 0x04}
+
+// Acceptor accepts security contexts for a service principal
+type Acceptor struct {
+	keytab    *Keytab
+	principal string
+	now       func() time.Time
+
+	mu     sync.Mutex
+	replay map[string]time.Time // authenticators seen, until they are too old to be accepted
+}
+
+// NewAcceptor returns an acceptor for a principal such as "socks/proxy.example.com@EXAMPLE.COM"
+func NewAcceptor(keytab *Keytab, principal string) (*Acceptor, error) {
+	if !keytab.HasPrincipal(principal) {
+		return nil, fmt.Errorf("krb5: no AES key for %s in the keytab", principal)
+	}
+	return &Acceptor{
+		keytab:    keytab,
+		principal: principal,
+		now:       time.Now,
+		replay:    make(map[string]time.Time),
+	}, nil
+}
+
+// Context is an established security context. Wrap and Unwrap may run concurrently with each
+// other, but not with themselves.
+type Context struct {
+	// Principal is the authenticated user, "name@REALM"
+	Principal string
+
+	key     Key
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// Accept validates the initial context token of an initiator. It returns the established
+// context, and the token to send back when the initiator asked for mutual authentication.
+func (a *Acceptor) Accept(token []byte) (*Context, []byte, error) {
+	inner, err := unwrapInitialToken(token, tokenAPReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	var req apReq
+	if err := unmarshalApplication(inner, tagAPReq, &req); err != nil {
+		return nil, nil, fmt.Errorf("krb5: invalid AP-REQ: %w", err)
+	}
+	if req.PVNO != pvno || req.MsgType != msgTypeAPRq {
+		return nil, nil, fmt.Errorf("krb5: unexpected message type %d", req.MsgType)
+	}
+
+	var tkt ticket
+	if err := unmarshalApplication(req.Ticket.Bytes, tagTicket, &tkt); err != nil {
+		return nil, nil, fmt.Errorf("krb5: invalid ticket: %w", err)
+	}
+	if service := tkt.SName.String() + "@" + tkt.Realm; service != a.principal {
+		return nil, nil, fmt.Errorf("krb5: ticket is for %s, not %s", service, a.principal)
+	}
+	serviceKey, err := a.keytab.key(a.principal, tkt.EncPart.EType, uint32(tkt.EncPart.KVNO))
+	if err != nil {
+		return nil, nil, err
+	}
+	var part encTicketPart
+	if err := decryptMessage(serviceKey, usageTicket, tkt.EncPart.Cipher, tagEncTicketPart, &part); err != nil {
+		return nil, nil, fmt.Errorf("krb5: ticket: %w", err)
+	}
+	sessionKey := Key{EType: part.Key.KeyType, Value: part.Key.KeyValue}
+
+	if req.Authenticator.EType != sessionKey.EType {
+		return nil, nil, fmt.Errorf("krb5: authenticator enctype %d doesn't match the session key", req.Authenticator.EType)
+	}
+	var auth authenticator
+	if err := decryptMessage(sessionKey, usageAuthenticator, req.Authenticator.Cipher, tagAuthenticator, &auth); err != nil {
+		return nil, nil, fmt.Errorf("krb5: authenticator: %w", err)
+	}
+	client := part.CName.String() + "@" + part.CRealm
+	if auth.CName.String()+"@"+auth.CRealm != client {
+		return nil, nil, errors.New("krb5: authenticator and ticket name different clients")
+	}
+
+	now := a.now()
+	if err := checkTimes(now, &part, &auth); err != nil {
+		return nil, nil, err
+	}
+	if auth.Cksum.CksumType != gssChecksumType || len(auth.Cksum.Checksum) < 24 {
+		return nil, nil, errors.New("krb5: authenticator has no GSS-API checksum")
+	}
+	if err := a.checkReplay(client, &auth, now); err != nil {
+		return nil, nil, err
+	}
+
+	ctx := &Context{
+		Principal: client,
+		key:       sessionKey,
+		recvSeq:   uint64(uint32(auth.SeqNumber)),
+	}
+	if auth.SubKey.KeyValue != nil {
+		ctx.key = Key{EType: auth.SubKey.KeyType, Value: auth.SubKey.KeyValue}
+	}
+	if err := checkKey(ctx.key); err != nil {
+		return nil, nil, err
+	}
+
+	flags := binary.LittleEndian.Uint32(auth.Cksum.Checksum[20:24])
+	if flags&gssFlagMutual == 0 && !hasBit(req.APOptions, apOptionMutualRequired) {
+		// Without an AP-REP both sides start at the initiator's sequence number
+		ctx.sendSeq = ctx.recvSeq
+		return ctx, nil, nil
+	}
+
+	var seq [4]byte
+	if _, err := rand.Read(seq[:]); err != nil {
+		return nil, nil, err
+	}
+	ctx.sendSeq = uint64(binary.BigEndian.Uint32(seq[:]) & 0x3fffffff)
+	repPart, err := marshalApplication(tagEncAPRepPart, encAPRepPart{CTime: auth.CTime, CUSec: auth.CUSec, SeqNumber: int64(ctx.sendSeq)})
+	if err != nil {
+		return nil, nil, err
+	}
+	encPart, err := encrypt(sessionKey, usageAPRepPart, repPart)
+	if err != nil {
+		return nil, nil, err
+	}
+	rep, err := marshalApplication(tagAPRep, apRep{
+		PVNO:    pvno,
+		MsgType: msgTypeAPRp,
+		EncPart: encryptedData{EType: sessionKey.EType, Cipher: encPart},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := wrapInitialToken(tokenAPRep, rep)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx, out, nil
+}
+
+// checkTimes verifies the authenticator is fresh and the ticket valid, within the clock skew
+func checkTimes(now time.Time, part *encTicketPart, auth *authenticator) error {
+	if d := now.Sub(auth.CTime); d > MaxClockSkew || d < -MaxClockSkew {
+		return fmt.Errorf("krb5: authenticator time %s is too far from ours", auth.CTime.UTC().Format(time.RFC3339))
+	}
+	start := part.StartTime
+	if start.IsZero() {
+		start = part.AuthTime
+	}
+	if now.Add(MaxClockSkew).Before(start) {
+		return errors.New("krb5: ticket not yet valid")
+	}
+	if now.Add(-MaxClockSkew).After(part.EndTime) {
+		return errors.New("krb5: ticket expired")
+	}
+	return nil
+}
+
+// checkReplay rejects an authenticator seen before, and forgets those too old to be accepted
+func (a *Acceptor) checkReplay(client string, auth *authenticator, now time.Time) error {
+	id := fmt.Sprintf("%s %d %d", client, auth.CTime.Unix(), auth.CUSec)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, expires := range a.replay {
+		if now.After(expires) {
+			delete(a.replay, k)
+		}
+	}
+	if _, ok := a.replay[id]; ok {
+		return errors.New("krb5: replayed authenticator")
+	}
+	a.replay[id] = auth.CTime.Add(MaxClockSkew)
+	return nil
+}
+
+// decryptMessage decrypts and parses an encrypted message part
+func decryptMessage(key Key, usage uint32, ciphertext []byte, tag int, v any) error {
+	plain, err := decrypt(key, usage, ciphertext)
+	if err != nil {
+		return err
+	}
+	// Some encoders pad the plaintext, trailing bytes are ignored
+	_, err = asn1.UnmarshalWithParams(plain, v, fmt.Sprintf("application,explicit,tag:%d", tag))
+	return err
+}
+
+// hasBit reports whether a bit of Kerberos flags is set
+func hasBit(flags asn1.BitString, bit int) bool {
+	return bit < flags.BitLength && flags.At(bit) == 1
+}
+
+// unwrapInitialToken returns the message inside a context token with the Kerberos mechanism
+func unwrapInitialToken(token, tokenID []byte) ([]byte, error) {
+	var outer asn1.RawValue
+	rest, err := asn1.Unmarshal(token, &outer)
+	if err != nil || len(rest) > 0 || outer.Class != asn1.ClassApplication || outer.Tag != 0 {
+		return nil, errors.New("krb5: not a GSS-API context token")
+	}
+	var oid asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(outer.Bytes, &oid)
+	if err != nil || !oid.Equal(mechOID) {
+		return nil, errors.New("krb5: context token is not for the Kerberos 5 mechanism")
+	}
+	if !bytes.HasPrefix(inner, tokenID) {
+		return nil, fmt.Errorf("krb5: unexpected context token ID %x", inner[:min(2, len(inner))])
+	}
+	return inner[len(tokenID):], nil
+}
+
+// wrapInitialToken wraps a message in a context token with the Kerberos mechanism
+func wrapInitialToken(tokenID, msg []byte) ([]byte, error) {
+	oid, err := asn1.Marshal(mechOID)
+	if err != nil {
+		return nil, err
+	}
+	inner := append(append(oid, tokenID...), msg...)
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: inner})
+}
+
+// Wrap protects a message sent to the initiator, encrypted when seal is set and only
+// integrity protected otherwise
+func (c *Context) Wrap(msg []byte, seal bool) ([]byte, error) {
+	header := make([]byte, wrapHeaderSize)
+	copy(header, wrapTokenID)
+	header[2] = wrapFlagSentByAccept
+	header[3] = 0xFF
+	binary.BigEndian.PutUint64(header[8:], c.sendSeq)
+
+	if seal {
+		header[2] |= wrapFlagSealed
+		// No filler is needed with CTS and no rotation is applied, EC and RRC stay zero
+		plain := append(append([]byte{}, msg...), header...)
+		encrypted, err := encrypt(c.key, usageAcceptorSeal, plain)
+		if err != nil {
+			return nil, err
+		}
+		c.sendSeq++
+		return append(header, encrypted...), nil
+	}
+
+	sum := checksum(c.key, usageAcceptorSeal, append(append([]byte{}, msg...), header...))
+	binary.BigEndian.PutUint16(header[4:], checksumSize)
+	c.sendSeq++
+	return append(append(header, msg...), sum...), nil
+}
+
+// Unwrap verifies a message wrapped by the initiator and returns it, with whether it was
+// encrypted. Messages must arrive in order.
+func (c *Context) Unwrap(token []byte) ([]byte, bool, error) {
+	if len(token) < wrapHeaderSize || !bytes.HasPrefix(token, wrapTokenID) || token[3] != 0xFF {
+		return nil, false, errors.New("krb5: not a wrap token")
+	}
+	flags := token[2]
+	if flags&wrapFlagSentByAccept != 0 || flags&wrapFlagAcceptorKey != 0 {
+		return nil, false, errors.New("krb5: wrap token has unexpected flags")
+	}
+	ec := int(binary.BigEndian.Uint16(token[4:]))
+	rrc := int(binary.BigEndian.Uint16(token[6:]))
+	if seq := binary.BigEndian.Uint64(token[8:]); seq != c.recvSeq {
+		return nil, false, fmt.Errorf("krb5: wrap token sequence %d, expected %d", seq, c.recvSeq)
+	}
+
+	// Undo the right rotation of the data by RRC bytes
+	data := token[wrapHeaderSize:]
+	if len(data) > 0 {
+		rrc %= len(data)
+		data = append(append([]byte{}, data[rrc:]...), data[:rrc]...)
+	}
+	header := append([]byte{}, token[:wrapHeaderSize]...)
+	binary.BigEndian.PutUint16(header[6:], 0)
+
+	if flags&wrapFlagSealed != 0 {
+		plain, err := decrypt(c.key, usageInitiatorSeal, data)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(plain) < ec+wrapHeaderSize || !bytes.Equal(plain[len(plain)-wrapHeaderSize:], header) {
+			return nil, false, errors.New("krb5: wrap token header was modified")
+		}
+		c.recvSeq++
+		return plain[:len(plain)-wrapHeaderSize-ec], true, nil
+	}
+
+	if ec != checksumSize || len(data) < checksumSize {
+		return nil, false, errors.New("krb5: wrap token has no checksum")
+	}
+	msg, sum := data[:len(data)-checksumSize], data[len(data)-checksumSize:]
+	binary.BigEndian.PutUint16(header[4:], 0)
+	if !hmac.Equal(sum, checksum(c.key, usageInitiatorSeal, append(append([]byte{}, msg...), header...))) {
+		return nil, false, ErrIntegrity
+	}
+	c.recvSeq++
+	return msg, false, nil
+}
@@ -0,0 +1,398 @@
+package krb5
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testService = "socks/proxy.example.com@EXAMPLE.COM"
+
+var (
+	testServiceKey = Key{EType: ETypeAES256, Value: bytes.Repeat([]byte{7}, 32)}
+	testSessionKey = Key{EType: ETypeAES128, Value: bytes.Repeat([]byte{9}, 16)}
+)
+
+// marshalKeytab writes a version 2 keytab with one key per principal
+func marshalKeytab(kvno uint32, keys map[string]Key) []byte {
+	out := []byte{0x05, 0x02}
+	str := func(b []byte, s string) []byte {
+		return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+	}
+	for principal, key := range keys {
+		name, realm, _ := strings.Cut(principal, "@")
+		components := strings.Split(name, "/")
+		entry := binary.BigEndian.AppendUint16(nil, uint16(len(components)))
+		entry = str(entry, realm)
+		for _, c := range components {
+			entry = str(entry, c)
+		}
+		entry = binary.BigEndian.AppendUint32(entry, 1) // name type
+		entry = binary.BigEndian.AppendUint32(entry, 0) // timestamp
+		entry = append(entry, byte(kvno))
+		entry = binary.BigEndian.AppendUint16(entry, uint16(key.EType))
+		entry = str(entry, string(key.Value))
+		entry = binary.BigEndian.AppendUint32(entry, kvno)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(entry)))
+		out = append(out, entry...)
+	}
+	// A hole of a removed entry
+	out = binary.BigEndian.AppendUint32(out, uint32(0xFFFFFFFC))
+	return append(out, 0, 0, 0, 0)
+}
+
+// testInitiator builds context tokens and wraps messages the way a Kerberos client does
+type testInitiator struct {
+	client   string    // "user@REALM"
+	service  string    // principal the ticket is for
+	key      Key       // key of the service the ticket is encrypted with
+	ctime    time.Time // authenticator time
+	endTime  time.Time // ticket end
+	subKey   Key       // initiator subkey, none when empty
+	gssFlags uint32
+	seq      uint64
+	wrapKey  Key
+	sendSeq  uint64
+	recvSeq  uint64
+	rotation uint16
+}
+
+func newTestInitiator() *testInitiator {
+	now := time.Now().UTC().Truncate(time.Second)
+	return &testInitiator{
+		client:   "alice@EXAMPLE.COM",
+		service:  testService,
+		key:      testServiceKey,
+		ctime:    now,
+		endTime:  now.Add(10 * time.Hour),
+		gssFlags: gssFlagMutual,
+		seq:      1000,
+	}
+}
+
+func principal(s string) (principalName, string) {
+	name, realm, _ := strings.Cut(s, "@")
+	return principalName{NameType: 1, NameString: strings.Split(name, "/")}, realm
+}
+
+// token returns the initial context token
+func (i *testInitiator) token(t *testing.T) []byte {
+	t.Helper()
+	cname, crealm := principal(i.client)
+	sname, srealm := principal(i.service)
+
+	part, err := marshalApplication(tagEncTicketPart, encTicketPart{
+		Flags:     asn1.BitString{Bytes: make([]byte, 4), BitLength: 32},
+		Key:       encryptionKey{KeyType: testSessionKey.EType, KeyValue: testSessionKey.Value},
+		CRealm:    crealm,
+		CName:     cname,
+		Transited: transitedEncoding{Contents: []byte{}},
+		AuthTime:  i.ctime.Add(-time.Hour),
+		EndTime:   i.endTime,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encPart, err := encrypt(i.key, usageTicket, part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkt, err := marshalApplication(tagTicket, ticket{
+		TktVNO:  pvno,
+		Realm:   srealm,
+		SName:   sname,
+		EncPart: encryptedData{EType: i.key.EType, KVNO: 3, Cipher: encPart},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(cksum, 16)
+	binary.LittleEndian.PutUint32(cksum[20:], i.gssFlags)
+	auth := authenticator{
+		AVNO:      pvno,
+		CRealm:    crealm,
+		CName:     cname,
+		Cksum:     checksumField{CksumType: gssChecksumType, Checksum: cksum},
+		CUSec:     123,
+		CTime:     i.ctime,
+		SeqNumber: int64(i.seq),
+	}
+	i.wrapKey = testSessionKey
+	if i.subKey.Value != nil {
+		auth.SubKey = encryptionKey{KeyType: i.subKey.EType, KeyValue: i.subKey.Value}
+		i.wrapKey = i.subKey
+	}
+	authBytes, err := marshalApplication(tagAuthenticator, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encAuth, err := encrypt(testSessionKey, usageAuthenticator, authBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := marshalApplication(tagAPReq, apReq{
+		PVNO:          pvno,
+		MsgType:       msgTypeAPRq,
+		APOptions:     asn1.BitString{Bytes: make([]byte, 4), BitLength: 32},
+		Ticket:        explicitTag(t, 3, tkt),
+		Authenticator: encryptedData{EType: testSessionKey.EType, Cipher: encAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := wrapInitialToken(tokenAPReq, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.sendSeq = i.seq
+	i.recvSeq = i.seq
+	return token
+}
+
+// explicitTag wraps an encoded value in a context-specific tag, which encoding/asn1 doesn't do
+// for a RawValue
+func explicitTag(t *testing.T, tag int, der []byte) asn1.RawValue {
+	t.Helper()
+	full, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: der})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return asn1.RawValue{FullBytes: full}
+}
+
+// reply reads the AP-REP of mutual authentication
+func (i *testInitiator) reply(t *testing.T, token []byte) {
+	t.Helper()
+	inner, err := unwrapInitialToken(token, tokenAPRep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rep apRep
+	if err := unmarshalApplication(inner, tagAPRep, &rep); err != nil {
+		t.Fatal(err)
+	}
+	var part encAPRepPart
+	if err := decryptMessage(testSessionKey, usageAPRepPart, rep.EncPart.Cipher, tagEncAPRepPart, &part); err != nil {
+		t.Fatal(err)
+	}
+	if !part.CTime.Equal(i.ctime) || part.CUSec != 123 {
+		t.Errorf("AP-REP has time %v.%d, want %v.123", part.CTime, part.CUSec, i.ctime)
+	}
+	i.recvSeq = uint64(part.SeqNumber)
+}
+
+// wrap wraps a message for the acceptor, rotated by the initiator's rotation count
+func (i *testInitiator) wrap(t *testing.T, msg []byte, seal bool) []byte {
+	t.Helper()
+	header := make([]byte, wrapHeaderSize)
+	copy(header, wrapTokenID)
+	header[3] = 0xFF
+	binary.BigEndian.PutUint64(header[8:], i.sendSeq)
+	i.sendSeq++
+
+	var data []byte
+	if seal {
+		header[2] = wrapFlagSealed
+		binary.BigEndian.PutUint16(header[4:], 3) // filler
+		plain := append(append(append([]byte{}, msg...), 0xFF, 0xFF, 0xFF), header...)
+		var err error
+		if data, err = encrypt(i.wrapKey, usageInitiatorSeal, plain); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		sum := checksum(i.wrapKey, usageInitiatorSeal, append(append([]byte{}, msg...), header...))
+		data = append(append([]byte{}, msg...), sum...)
+		binary.BigEndian.PutUint16(header[4:], checksumSize)
+	}
+	if r := int(i.rotation) % max(len(data), 1); r > 0 {
+		data = append(append([]byte{}, data[len(data)-r:]...), data[:len(data)-r]...)
+	}
+	binary.BigEndian.PutUint16(header[6:], i.rotation)
+	return append(header, data...)
+}
+
+// unwrap verifies a message wrapped by the acceptor
+func (i *testInitiator) unwrap(t *testing.T, token []byte) ([]byte, bool) {
+	t.Helper()
+	if token[2]&wrapFlagSentByAccept == 0 || binary.BigEndian.Uint64(token[8:16]) != i.recvSeq {
+		t.Fatalf("Unexpected wrap token header %x, want sequence %d", token[:16], i.recvSeq)
+	}
+	i.recvSeq++
+	header, data := token[:wrapHeaderSize], token[wrapHeaderSize:]
+	if token[2]&wrapFlagSealed != 0 {
+		plain, err := decrypt(i.wrapKey, usageAcceptorSeal, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain[len(plain)-wrapHeaderSize:], header) {
+			t.Fatal("Encrypted header doesn't match")
+		}
+		return plain[:len(plain)-wrapHeaderSize], true
+	}
+	msg := data[:len(data)-checksumSize]
+	zeroed := append([]byte{}, header...)
+	zeroed[4], zeroed[5] = 0, 0
+	if !bytes.Equal(data[len(data)-checksumSize:], checksum(i.wrapKey, usageAcceptorSeal, append(append([]byte{}, msg...), zeroed...))) {
+		t.Fatal("Checksum doesn't match")
+	}
+	return msg, false
+}
+
+func newTestAcceptor(t *testing.T) *Acceptor {
+	t.Helper()
+	kt, err := ParseKeytab(marshalKeytab(3, map[string]Key{
+		testService:                        testServiceKey,
+		"HTTP/www.example.com@EXAMPLE.COM": {EType: ETypeAES128, Value: make([]byte, 16)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAcceptor(kt, testService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestParseKeytab(t *testing.T) {
+	kt, err := ParseKeytab(marshalKeytab(3, map[string]Key{testService: testServiceKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := kt.key(testService, ETypeAES256, 3)
+	if err != nil || !bytes.Equal(key.Value, testServiceKey.Value) {
+		t.Errorf("key = %x, %v", key.Value, err)
+	}
+	if _, err := kt.key(testService, ETypeAES256, 4); err == nil {
+		t.Error("Expected no key of another version")
+	}
+	if kt.HasPrincipal("socks/other.example.com@EXAMPLE.COM") {
+		t.Error("Expected no key for another principal")
+	}
+
+	for _, data := range [][]byte{nil, {0x05, 0x01}, {0x05, 0x02}, {0x05, 0x02, 0, 0, 0, 9, 0}} {
+		if _, err := ParseKeytab(data); err == nil {
+			t.Errorf("Expected keytab %x to be rejected", data)
+		}
+	}
+
+	if _, err := NewAcceptor(kt, "socks/other.example.com@EXAMPLE.COM"); err == nil {
+		t.Error("Expected no acceptor for a principal without a key")
+	}
+}
+
+func TestAccept(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		mutual   bool
+		subKey   Key
+		rotation uint16
+	}{
+		{name: "mutual", mutual: true},
+		{name: "no mutual", mutual: false},
+		{name: "subkey", mutual: true, subKey: Key{EType: ETypeAES256, Value: bytes.Repeat([]byte{5}, 32)}},
+		{name: "rotated", mutual: true, rotation: 28},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAcceptor(t)
+			i := newTestInitiator()
+			i.subKey, i.rotation = tt.subKey, tt.rotation
+			if !tt.mutual {
+				i.gssFlags = 0
+			}
+
+			ctx, out, err := a.Accept(i.token(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ctx.Principal != "alice@EXAMPLE.COM" {
+				t.Errorf("Principal = %q", ctx.Principal)
+			}
+			if tt.mutual {
+				i.reply(t, out)
+			} else if out != nil {
+				t.Errorf("Expected no AP-REP without mutual authentication")
+			}
+
+			for _, seal := range []bool{true, false, true} {
+				msg, sealed, err := ctx.Unwrap(i.wrap(t, []byte("\x02"), seal))
+				if err != nil || string(msg) != "\x02" || sealed != seal {
+					t.Fatalf("Unwrap = %x, %v, %v", msg, sealed, err)
+				}
+				token, err := ctx.Wrap([]byte("reply"), seal)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg, sealed := i.unwrap(t, token); string(msg) != "reply" || sealed != seal {
+					t.Fatalf("unwrap = %q, %v", msg, sealed)
+				}
+			}
+
+			// Tokens out of order and modified tokens are rejected
+			token := i.wrap(t, []byte("data"), true)
+			if _, _, err := ctx.Unwrap(i.wrap(t, []byte("data"), true)); err == nil {
+				t.Error("Expected a token out of order to be rejected")
+			}
+			token[len(token)-1] ^= 1
+			if _, _, err := ctx.Unwrap(token); err == nil {
+				t.Error("Expected a modified token to be rejected")
+			}
+		})
+	}
+}
+
+func TestAccept_Rejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(i *testInitiator)
+		errMsg string
+	}{
+		{"other service", func(i *testInitiator) { i.service = "socks/other.example.com@EXAMPLE.COM" }, "ticket is for"},
+		{"wrong key", func(i *testInitiator) { i.key = Key{EType: ETypeAES256, Value: make([]byte, 32)} }, "integrity check failed"},
+		{"enctype not in keytab", func(i *testInitiator) { i.key = Key{EType: ETypeAES128, Value: make([]byte, 16)} }, "no key"},
+		{"clock skew", func(i *testInitiator) { i.ctime = i.ctime.Add(-10 * time.Minute) }, "too far"},
+		{"expired ticket", func(i *testInitiator) { i.endTime = i.ctime.Add(-time.Hour) }, "ticket expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newTestInitiator()
+			tt.modify(i)
+			_, _, err := newTestAcceptor(t).Accept(i.token(t))
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Accept error = %v, want %q", err, tt.errMsg)
+			}
+		})
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		a := newTestAcceptor(t)
+		token := newTestInitiator().token(t)
+		if _, _, err := a.Accept(token); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := a.Accept(token); err == nil || !strings.Contains(err.Error(), "replayed") {
+			t.Errorf("Accept error = %v, want replayed", err)
+		}
+	})
+
+	t.Run("not kerberos", func(t *testing.T) {
+		if _, _, err := newTestAcceptor(t).Accept([]byte{0x60, 0x02, 0x05, 0x00}); err == nil {
+			t.Error("Expected a token of another mechanism to be rejected")
+		}
+	})
+}
+
+// Realms and names are GeneralStrings on the wire
+func TestPrincipalName_GeneralString(t *testing.T) {
+	// SEQUENCE { [0] INTEGER 1, [1] SEQUENCE { GeneralString "alice" } }
+	der := []byte{0x30, 0x10, 0xa0, 0x03, 0x02, 0x01, 0x01, 0xa1, 0x09, 0x30, 0x07, 0x1b, 0x05, 'a', 'l', 'i', 'c', 'e'}
+	var name principalName
+	if _, err := asn1.Unmarshal(der, &name); err != nil || name.String() != "alice" {
+		t.Errorf("Unmarshal = %q, %v", name.String(), err)
+	}
+}
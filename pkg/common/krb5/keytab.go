@@ -0,0 +1,155 @@
+package krb5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keytabVersion is the MIT keytab format version 2, with big-endian fields
+const keytabVersion = 0x0502
+
+// Keytab holds the long-term keys of service principals
+type Keytab struct {
+	entries []keytabEntry
+}
+
+// keytabEntry is a key of a principal
+type keytabEntry struct {
+	principal string // "service/host@REALM"
+	kvno      uint32
+	key       Key
+}
+
+// LoadKeytab reads a keytab file
+func LoadKeytab(path string) (*Keytab, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kt, err := ParseKeytab(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return kt, nil
+}
+
+// ParseKeytab parses a keytab in the MIT format written by ktutil and kadmin
+func ParseKeytab(data []byte) (*Keytab, error) {
+	if len(data) < 2 || binary.BigEndian.Uint16(data) != keytabVersion {
+		return nil, errors.New("not a version 2 keytab")
+	}
+	kt := &Keytab{}
+	data = data[2:]
+	for len(data) >= 4 {
+		size := int32(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size < 0 {
+			// A hole left by a removed entry
+			size = -size
+			if int(size) > len(data) {
+				return nil, errors.New("truncated keytab")
+			}
+			data = data[size:]
+			continue
+		}
+		if int(size) > len(data) {
+			return nil, errors.New("truncated keytab")
+		}
+		if size == 0 {
+			break
+		}
+		entry, err := parseKeytabEntry(data[:size])
+		if err != nil {
+			return nil, err
+		}
+		kt.entries = append(kt.entries, entry)
+		data = data[size:]
+	}
+	if len(kt.entries) == 0 {
+		return nil, errors.New("keytab has no keys")
+	}
+	return kt, nil
+}
+
+// parseKeytabEntry parses one entry
+func parseKeytabEntry(data []byte) (keytabEntry, error) {
+	r := keytabReader{data: data}
+	components := int(r.uint16())
+	realm := r.string()
+	names := make([]string, components)
+	for i := range names {
+		names[i] = r.string()
+	}
+	r.uint32() // name type
+	r.uint32() // timestamp
+	kvno := uint32(r.uint8())
+	keyType := int32(r.uint16())
+	keyValue := []byte(r.string())
+	if r.err != nil {
+		return keytabEntry{}, r.err
+	}
+	// Newer writers append the full key version, zero when it didn't fit
+	if len(r.data) >= 4 {
+		if v := r.uint32(); v != 0 {
+			kvno = v
+		}
+	}
+	return keytabEntry{
+		principal: strings.Join(names, "/") + "@" + realm,
+		kvno:      kvno,
+		key:       Key{EType: keyType, Value: keyValue},
+	}, nil
+}
+
+// key returns the key of a principal for an enctype, of the given version or the newest for a
+// zero kvno
+func (kt *Keytab) key(principal string, etype int32, kvno uint32) (Key, error) {
+	var found *keytabEntry
+	for i := range kt.entries {
+		e := &kt.entries[i]
+		if e.principal != principal || e.key.EType != etype || (kvno != 0 && e.kvno != kvno) {
+			continue
+		}
+		if found == nil || e.kvno > found.kvno {
+			found = e
+		}
+	}
+	if found == nil {
+		return Key{}, fmt.Errorf("krb5: no key for %s with enctype %d and kvno %d in the keytab", principal, etype, kvno)
+	}
+	return found.key, nil
+}
+
+// HasPrincipal reports whether the keytab has a key for the principal that can be used
+func (kt *Keytab) HasPrincipal(principal string) bool {
+	for _, e := range kt.entries {
+		if e.principal == principal && checkKey(e.key) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// keytabReader reads big-endian keytab fields, remembering the first error
+type keytabReader struct {
+	data []byte
+	err  error
+}
+
+func (r *keytabReader) next(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errors.New("truncated keytab entry")
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *keytabReader) uint8() uint8   { return r.next(1)[0] }
+func (r *keytabReader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *keytabReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *keytabReader) string() string { return string(r.next(int(r.uint16()))) }
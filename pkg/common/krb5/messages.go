@@ -0,0 +1,140 @@
+package krb5
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kerberos message types and protocol version (RFC 4120 section 5)
+const (
+	pvno        = 5
+	msgTypeAPRq = 14
+	msgTypeAPRp = 15
+)
+
+// Application tags of the messages
+const (
+	tagTicket        = 1
+	tagAuthenticator = 2
+	tagEncTicketPart = 3
+	tagAPReq         = 14
+	tagAPRep         = 15
+	tagEncAPRepPart  = 27
+)
+
+// apOptionMutualRequired is the AP options bit asking the server to authenticate too
+const apOptionMutualRequired = 2
+
+// principalName is a PrincipalName
+type principalName struct {
+	NameType   int32    `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+// String returns the name joined with slashes
+func (p principalName) String() string {
+	return strings.Join(p.NameString, "/")
+}
+
+// encryptedData is EncryptedData
+type encryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int64  `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+// encryptionKey is EncryptionKey
+type encryptionKey struct {
+	KeyType  int32  `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+// checksumField is Checksum
+type checksumField struct {
+	CksumType int32  `asn1:"explicit,tag:0"`
+	Checksum  []byte `asn1:"explicit,tag:1"`
+}
+
+// ticket is Ticket, [APPLICATION 1]
+type ticket struct {
+	TktVNO  int32         `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   principalName `asn1:"explicit,tag:2"`
+	EncPart encryptedData `asn1:"explicit,tag:3"`
+}
+
+// encTicketPart is EncTicketPart, [APPLICATION 3]
+type encTicketPart struct {
+	Flags             asn1.BitString    `asn1:"explicit,tag:0"`
+	Key               encryptionKey     `asn1:"explicit,tag:1"`
+	CRealm            string            `asn1:"explicit,tag:2"`
+	CName             principalName     `asn1:"explicit,tag:3"`
+	Transited         transitedEncoding `asn1:"explicit,tag:4"`
+	AuthTime          time.Time         `asn1:"generalized,explicit,tag:5"`
+	StartTime         time.Time         `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime           time.Time         `asn1:"generalized,explicit,tag:7"`
+	RenewTill         time.Time         `asn1:"generalized,optional,explicit,tag:8"`
+	CAddr             asn1.RawValue     `asn1:"optional,explicit,tag:9"`
+	AuthorizationData asn1.RawValue     `asn1:"optional,explicit,tag:10"`
+}
+
+// transitedEncoding is TransitedEncoding
+type transitedEncoding struct {
+	TRType   int32  `asn1:"explicit,tag:0"`
+	Contents []byte `asn1:"explicit,tag:1"`
+}
+
+// apReq is AP-REQ, [APPLICATION 14]
+type apReq struct {
+	PVNO          int32          `asn1:"explicit,tag:0"`
+	MsgType       int32          `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"` // The whole [3] element, encoding/asn1 keeps explicit tags of RawValues
+	Authenticator encryptedData  `asn1:"explicit,tag:4"`
+}
+
+// authenticator is Authenticator, [APPLICATION 2]
+type authenticator struct {
+	AVNO              int32         `asn1:"explicit,tag:0"`
+	CRealm            string        `asn1:"explicit,tag:1"`
+	CName             principalName `asn1:"explicit,tag:2"`
+	Cksum             checksumField `asn1:"optional,explicit,tag:3"`
+	CUSec             int32         `asn1:"explicit,tag:4"`
+	CTime             time.Time     `asn1:"generalized,explicit,tag:5"`
+	SubKey            encryptionKey `asn1:"optional,explicit,tag:6"`
+	SeqNumber         int64         `asn1:"optional,explicit,tag:7"`
+	AuthorizationData asn1.RawValue `asn1:"optional,explicit,tag:8"`
+}
+
+// apRep is AP-REP, [APPLICATION 15]
+type apRep struct {
+	PVNO    int32         `asn1:"explicit,tag:0"`
+	MsgType int32         `asn1:"explicit,tag:1"`
+	EncPart encryptedData `asn1:"explicit,tag:2"`
+}
+
+// encAPRepPart is EncAPRepPart, [APPLICATION 27]
+type encAPRepPart struct {
+	CTime     time.Time `asn1:"generalized,explicit,tag:0"`
+	CUSec     int32     `asn1:"explicit,tag:1"`
+	SeqNumber int64     `asn1:"explicit,tag:3"`
+}
+
+// unmarshalApplication parses a message with an application tag, which must span all of data
+func unmarshalApplication(data []byte, tag int, v any) error {
+	rest, err := asn1.UnmarshalWithParams(data, v, fmt.Sprintf("application,explicit,tag:%d", tag))
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("%d trailing bytes", len(rest))
+	}
+	return nil
+}
+
+// marshalApplication encodes a message with an application tag
+func marshalApplication(tag int, v any) ([]byte, error) {
+	return asn1.MarshalWithParams(v, fmt.Sprintf("application,explicit,tag:%d", tag))
+}
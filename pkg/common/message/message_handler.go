@@ -4,6 +4,7 @@ package message
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
 )
@@ -29,6 +30,8 @@ type Handler interface {
 	WriteDataMessage(connID string, data []byte) error
 	// Send close message
 	WriteCloseMessage(connID string) error
+	// Send half-close message, the sender finished writing but still reads
+	WriteCloseWriteMessage(connID string) error
 }
 
 // BinaryMessageHandler common implementation of binary message handler
@@ -104,27 +107,34 @@ func (h *BinaryMessageHandler) parseClientMessage(msgType byte, data []byte) (ma
 
 	case protocol.BinaryMsgTypeConnect:
 		// Connection request
-		connID, network, address, err := protocol.UnpackConnectMessage(data)
+		connID, network, address, timeout, priority, scope, err := protocol.UnpackConnectMessageWithScope(data)
 		if err != nil {
 			return nil, err
 		}
 
 		return map[string]interface{}{
-			"type":    protocol.MsgTypeConnect,
-			"id":      connID,
-			"network": network,
-			"address": address,
+			"type":     protocol.MsgTypeConnect,
+			"id":       connID,
+			"network":  network,
+			"address":  address,
+			"timeout":  timeout,  // Zero when the gateway sent no dial timeout
+			"priority": priority, // QoS class, zero when the gateway sent none
+			"scope":    scope,    // Reuse scope of the proxy user, empty when the gateway sent none
 		}, nil
 
 	case protocol.BinaryMsgTypeClose:
 		// Close message
-		connID, err := protocol.UnpackCloseMessage(data)
+		connID, writeOnly, err := protocol.UnpackCloseMessage(data)
 		if err != nil {
 			return nil, err
 		}
 
+		msgType := protocol.MsgTypeClose
+		if writeOnly {
+			msgType = protocol.MsgTypeCloseWrite
+		}
 		return map[string]interface{}{
-			"type": protocol.MsgTypeClose,
+			"type": msgType,
 			"id":   connID,
 		}, nil
 
@@ -160,6 +170,21 @@ func (h *BinaryMessageHandler) parseClientMessage(msgType byte, data []byte) (ma
 			"error_message": errorMsg,
 		}, nil
 
+	case protocol.BinaryMsgTypeConnectResponse:
+		// Response to a peer connection request
+		connID, success, errorMsg, errorCode, err := protocol.UnpackConnectResponseMessageWithCode(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"type":       protocol.MsgTypeConnectResponse,
+			"id":         connID,
+			"success":    success,
+			"error":      errorMsg,
+			"error_code": errorCode,
+		}, nil
+
 	default:
 		return nil, fmt.Errorf("unknown binary message type for client: 0x%02x", msgType)
 	}
@@ -184,33 +209,39 @@ func (h *BinaryMessageHandler) parseGatewayMessage(msgType byte, data []byte) (m
 
 	case protocol.BinaryMsgTypeConnectResponse:
 		// Connection response
-		connID, success, errorMsg, err := protocol.UnpackConnectResponseMessage(data)
+		connID, success, errorMsg, errorCode, retryAfter, err := protocol.UnpackConnectResponseMessageWithRetry(data)
 		if err != nil {
 			return nil, err
 		}
 
 		return map[string]interface{}{
-			"type":    protocol.MsgTypeConnectResponse,
-			"id":      connID,
-			"success": success,
-			"error":   errorMsg,
+			"type":        protocol.MsgTypeConnectResponse,
+			"id":          connID,
+			"success":     success,
+			"error":       errorMsg,
+			"error_code":  errorCode,  // Empty when the client sent no error code
+			"retry_after": retryAfter, // Zero unless the client asks to hold off connect requests
 		}, nil
 
 	case protocol.BinaryMsgTypeClose:
 		// Close message
-		connID, err := protocol.UnpackCloseMessage(data)
+		connID, writeOnly, err := protocol.UnpackCloseMessage(data)
 		if err != nil {
 			return nil, err
 		}
 
+		msgType := protocol.MsgTypeClose
+		if writeOnly {
+			msgType = protocol.MsgTypeCloseWrite
+		}
 		return map[string]interface{}{
-			"type": protocol.MsgTypeClose,
+			"type": msgType,
 			"id":   connID,
 		}, nil
 
 	case protocol.BinaryMsgTypePortForward:
 		// Port forward request
-		clientID, ports, err := protocol.UnpackPortForwardMessage(data)
+		clientID, ports, body, signature, err := protocol.UnpackPortForwardMessageWithSignature(data)
 		if err != nil {
 			return nil, err
 		}
@@ -218,18 +249,91 @@ func (h *BinaryMessageHandler) parseGatewayMessage(msgType byte, data []byte) (m
 		// Convert to compatible format
 		openPorts := make([]interface{}, len(ports))
 		for i, port := range ports {
-			openPorts[i] = map[string]interface{}{
+			portMap := map[string]interface{}{
 				"remote_port": port.RemotePort,
 				"local_port":  port.LocalPort,
 				"local_host":  port.LocalHost,
 				"protocol":    port.Protocol,
 			}
+			if len(port.AllowedSources) > 0 {
+				portMap["allowed_sources"] = port.AllowedSources
+			}
+			openPorts[i] = portMap
 		}
 
-		return map[string]interface{}{
+		msg := map[string]interface{}{
 			"type":       protocol.MsgTypePortForwardReq,
 			"client_id":  clientID,
 			"open_ports": openPorts,
+		}
+		if signature != nil {
+			msg["signed_body"] = body
+			msg["signature"] = signature
+		}
+		return msg, nil
+
+	case protocol.BinaryMsgTypeHeartbeat:
+		// Heartbeat with client telemetry
+		telemetry, err := protocol.UnpackHeartbeatMessage(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"type":      protocol.MsgTypeHeartbeat,
+			"telemetry": telemetry,
+		}, nil
+
+	case protocol.BinaryMsgTypePeerConnect:
+		// Peer connection request
+		connID, network, address, groupID, groupPassword, err := protocol.UnpackPeerConnectMessage(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"type":           protocol.MsgTypePeerConnect,
+			"id":             connID,
+			"network":        network,
+			"address":        address,
+			"group_id":       groupID,
+			"group_password": groupPassword,
+		}, nil
+
+	case protocol.BinaryMsgTypeDraining:
+		// Client shutting down
+		timeout, err := protocol.UnpackDrainingMessage(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"type":    protocol.MsgTypeDraining,
+			"timeout": timeout,
+		}, nil
+
+	case protocol.BinaryMsgTypeReport:
+		// Activity spooled by the client while disconnected
+		report, err := protocol.UnpackReportMessage(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"type":   protocol.MsgTypeReport,
+			"report": report,
+		}, nil
+
+	case protocol.BinaryMsgTypeCapabilities:
+		// Networks and connection limit the client supports
+		caps, err := protocol.UnpackCapabilitiesMessage(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"type":         protocol.MsgTypeCapabilities,
+			"capabilities": caps,
 		}, nil
 
 	case protocol.BinaryMsgTypeError:
@@ -265,13 +369,24 @@ func (h *BinaryMessageHandler) WriteCloseMessage(connID string) error {
 	return h.conn.WriteMessage(binaryMsg)
 }
 
+// WriteCloseWriteMessage sends a half-close message using binary format
+func (h *BinaryMessageHandler) WriteCloseWriteMessage(connID string) error {
+	return h.conn.WriteMessage(protocol.PackCloseWriteMessage(connID))
+}
+
 // ExtendedMessageHandler extended message handler interface (for endpoint-specific additional functionality)
 type ExtendedMessageHandler interface {
 	Handler
 	// Client-specific methods
-	WriteConnectResponse(connID string, success bool, errorMsg string) error
+	WriteConnectResponse(connID string, success bool, errorMsg, errorCode string) error
+	WriteBusyResponse(connID, errorMsg, errorCode string, retryAfter time.Duration) error
+	WriteHeartbeatMessage(telemetry []byte) error
+	WritePeerConnectMessage(connID, network, address, groupID, groupPassword string) error
+	WriteDrainingMessage(timeout time.Duration) error
+	WriteReportMessage(report []byte) error
+	WriteCapabilitiesMessage(caps *protocol.Capabilities) error
 	// Gateway-specific methods
-	WriteConnectMessage(connID, network, address string) error
+	WriteConnectMessage(connID, network, address string, timeout time.Duration, priority uint8, scope string) error
 	// Common methods
 	WriteErrorMessage(errorMsg string) error
 }
@@ -301,18 +416,62 @@ func NewGatewayExtendedMessageHandler(conn Connection) ExtendedMessageHandler {
 	}
 }
 
-// WriteConnectResponse sends connection response using binary format (used by client)
-func (h *ExtendedBinaryMessageHandler) WriteConnectResponse(connID string, success bool, errorMsg string) error {
+// WriteConnectResponse sends connection response using binary format (used by client, and by
+// the gateway to answer peer connection requests).
+// errorCode classifies a failure for the proxy user, see utils.ErrorCode.
+func (h *ExtendedBinaryMessageHandler) WriteConnectResponse(connID string, success bool, errorMsg, errorCode string) error {
 	// Use binary format
-	binaryMsg := protocol.PackConnectResponseMessage(connID, success, errorMsg)
+	binaryMsg := protocol.PackConnectResponseMessageWithCode(connID, success, errorMsg, errorCode)
 
 	return h.conn.WriteMessage(binaryMsg)
 }
 
-// WriteConnectMessage sends connection request using binary format (used by gateway)
-func (h *ExtendedBinaryMessageHandler) WriteConnectMessage(connID, network, address string) error {
+// WriteBusyResponse refuses a connect request and asks the gateway to send no more connect
+// requests for retryAfter (used by client)
+func (h *ExtendedBinaryMessageHandler) WriteBusyResponse(connID, errorMsg, errorCode string, retryAfter time.Duration) error {
+	return h.conn.WriteMessage(protocol.PackConnectResponseMessageWithRetry(connID, false, errorMsg, errorCode, retryAfter))
+}
+
+// WriteHeartbeatMessage sends heartbeat with telemetry using binary format (used by client)
+func (h *ExtendedBinaryMessageHandler) WriteHeartbeatMessage(telemetry []byte) error {
+	// Use binary format
+	binaryMsg := protocol.PackHeartbeatMessage(telemetry)
+
+	return h.conn.WriteMessage(binaryMsg)
+}
+
+// WritePeerConnectMessage asks the gateway to relay a connection to a client of another group (used by client)
+func (h *ExtendedBinaryMessageHandler) WritePeerConnectMessage(connID, network, address, groupID, groupPassword string) error {
+	return h.conn.WriteMessage(protocol.PackPeerConnectMessage(connID, network, address, groupID, groupPassword))
+}
+
+// WriteDrainingMessage tells the gateway the client is stopping and serves its in-flight
+// connections for up to timeout (used by client)
+func (h *ExtendedBinaryMessageHandler) WriteDrainingMessage(timeout time.Duration) error {
+	return h.conn.WriteMessage(protocol.PackDrainingMessage(timeout))
+}
+
+// WriteReportMessage uploads activity spooled while disconnected (used by client)
+func (h *ExtendedBinaryMessageHandler) WriteReportMessage(report []byte) error {
+	return h.conn.WriteMessage(protocol.PackReportMessage(report))
+}
+
+// WriteCapabilitiesMessage tells the gateway which connections the client can serve (used by client)
+func (h *ExtendedBinaryMessageHandler) WriteCapabilitiesMessage(caps *protocol.Capabilities) error {
+	binaryMsg, err := protocol.PackCapabilitiesMessage(caps)
+	if err != nil {
+		return err
+	}
+	return h.conn.WriteMessage(binaryMsg)
+}
+
+// WriteConnectMessage sends connection request using binary format (used by gateway).
+// timeout is how long the proxy user still waits for the dial, zero for no limit, and
+// priority is the QoS class of the connection, zero for none, and scope lets the client reuse the
+// target connection for the same proxy user, empty for no reuse.
+func (h *ExtendedBinaryMessageHandler) WriteConnectMessage(connID, network, address string, timeout time.Duration, priority uint8, scope string) error {
 	// Use binary format
-	binaryMsg := protocol.PackConnectMessage(connID, network, address)
+	binaryMsg := protocol.PackConnectMessageWithScope(connID, network, address, timeout, priority, scope)
 
 	return h.conn.WriteMessage(binaryMsg)
 }
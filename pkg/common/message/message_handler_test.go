@@ -165,7 +165,7 @@ func TestExtendedMessageHandler(t *testing.T) {
 	clientHandler := NewClientExtendedMessageHandler(mockConn)
 
 	// 测试 WriteConnectResponse
-	err := clientHandler.WriteConnectResponse("conn-123", true, "")
+	err := clientHandler.WriteConnectResponse("conn-123", true, "", "")
 	if err != nil {
 		t.Fatalf("WriteConnectResponse failed: %v", err)
 	}
@@ -174,7 +174,7 @@ func TestExtendedMessageHandler(t *testing.T) {
 	gatewayHandler := NewGatewayExtendedMessageHandler(mockConn)
 
 	// 测试 WriteConnectMessage
-	err = gatewayHandler.WriteConnectMessage("conn-456", "tcp", "example.com:80")
+	err = gatewayHandler.WriteConnectMessage("conn-456", "tcp", "example.com:80", 0, 0, "")
 	if err != nil {
 		t.Fatalf("WriteConnectMessage failed: %v", err)
 	}
@@ -0,0 +1,386 @@
+package monitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Anomaly detection defaults
+const (
+	DefaultAnomalyInterval          = time.Minute
+	DefaultAnomalyFactor            = 5.0
+	DefaultAnomalyWarmup            = 10
+	DefaultAnomalyMinBytesPerMinute = 1024 * 1024
+	DefaultAnomalyMinNewTargets     = 10
+
+	// anomalyBaselineWeight is the weight of a new sample in the moving average baseline
+	anomalyBaselineWeight = 0.1
+	// maxKnownTargets caps the destinations remembered per client or group, the set is
+	// relearned from scratch when it is full
+	maxKnownTargets = 4096
+	// anomalyWebhookTimeout bounds the delivery of an alert to the webhook
+	anomalyWebhookTimeout = 5 * time.Second
+)
+
+// Anomaly subjects and kinds
+const (
+	AnomalySubjectClient = "client"
+	AnomalySubjectGroup  = "group"
+
+	AnomalyKindBytes      = "bytes"
+	AnomalyKindNewTargets = "new_targets"
+)
+
+// AnomalyOptions configures traffic anomaly detection, zero values use the defaults
+type AnomalyOptions struct {
+	Interval          time.Duration // Sampling period
+	Factor            float64       // A rate this many times its baseline is an anomaly
+	Warmup            int           // Samples learned before a baseline is trusted
+	MinBytesPerMinute int64         // Byte rates below this never alert
+	MinNewTargets     int64         // New destinations per minute below this never alert
+	Webhook           string        // URL receiving each alert as a JSON POST, empty logs only
+}
+
+// AnomalyAlert is raised when the traffic of a client or group deviates from its baseline
+type AnomalyAlert struct {
+	Time     time.Time `json:"time"`
+	Subject  string    `json:"subject"` // client or group
+	ID       string    `json:"id"`      // Client or group ID
+	GroupID  string    `json:"group_id,omitempty"`
+	Kind     string    `json:"kind"`     // bytes or new_targets
+	Rate     float64   `json:"rate"`     // Per minute
+	Baseline float64   `json:"baseline"` // Per minute
+	Factor   float64   `json:"factor"`
+}
+
+// anomalyMeter keeps the baseline of one rate
+type anomalyMeter struct {
+	baseline float64
+	samples  int
+	alerting bool
+}
+
+// observe adds a sample, it returns whether the sample starts or ends an anomaly
+func (m *anomalyMeter) observe(rate float64, opts *AnomalyOptions, minRate float64) (started, ended bool) {
+	anomalous := m.samples >= opts.Warmup && rate >= minRate && rate > opts.Factor*m.baseline
+	started = anomalous && !m.alerting
+	ended = !anomalous && m.alerting
+	m.alerting = anomalous
+
+	// The baseline follows lasting changes, so a new normal stops alerting after a while
+	if m.samples == 0 {
+		m.baseline = rate
+	} else {
+		m.baseline += anomalyBaselineWeight * (rate - m.baseline)
+	}
+	m.samples++
+	return started, ended
+}
+
+// anomalySubject is the state of a client or group
+type anomalySubject struct {
+	groupID    string
+	lastBytes  int64 // Cumulative bytes of a client at the previous sample
+	primed     bool  // Set after the first sample, which only records the starting point
+	bytes      anomalyMeter
+	newTargets anomalyMeter
+	known      map[string]struct{}
+	added      int64 // New destinations since the previous sample
+}
+
+// anomalyKey identifies a client or group
+type anomalyKey struct {
+	subject string
+	id      string
+}
+
+// AnomalyDetector learns per client and per group baselines of the byte rate and of the rate
+// of new destinations, and alerts when a rate exceeds its baseline by the configured factor.
+// A nil detector does nothing.
+type AnomalyDetector struct {
+	opts   AnomalyOptions
+	notify func(AnomalyAlert)
+
+	mu         sync.Mutex
+	subjects   map[anomalyKey]*anomalySubject
+	lastSample time.Time
+	alerts     int64
+}
+
+// NewAnomalyDetector creates a detector, alerts are logged and sent to the webhook
+func NewAnomalyDetector(opts AnomalyOptions) *AnomalyDetector {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultAnomalyInterval
+	}
+	if opts.Factor <= 1 {
+		opts.Factor = DefaultAnomalyFactor
+	}
+	if opts.Warmup <= 0 {
+		opts.Warmup = DefaultAnomalyWarmup
+	}
+	if opts.MinBytesPerMinute <= 0 {
+		opts.MinBytesPerMinute = DefaultAnomalyMinBytesPerMinute
+	}
+	if opts.MinNewTargets <= 0 {
+		opts.MinNewTargets = DefaultAnomalyMinNewTargets
+	}
+	d := &AnomalyDetector{opts: opts, subjects: make(map[anomalyKey]*anomalySubject)}
+	d.notify = d.sendAlert
+	return d
+}
+
+// subject returns the state of a client or group, d.mu must be held
+func (d *AnomalyDetector) subject(subject, id string) *anomalySubject {
+	key := anomalyKey{subject: subject, id: id}
+	s, ok := d.subjects[key]
+	if !ok {
+		s = &anomalySubject{known: make(map[string]struct{})}
+		d.subjects[key] = s
+	}
+	return s
+}
+
+// ObserveTarget records a connection of a client to a target, counting destinations not seen before
+func (d *AnomalyDetector) ObserveTarget(clientID, groupID, address string) {
+	if d == nil || address == "" {
+		return
+	}
+	host := targetHostKey(address)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subject(AnomalySubjectClient, clientID).learn(host)
+	if groupID != "" {
+		d.subject(AnomalySubjectGroup, groupID).learn(host)
+	}
+}
+
+// learn remembers a destination
+func (s *anomalySubject) learn(host string) {
+	if _, ok := s.known[host]; ok {
+		return
+	}
+	if len(s.known) >= maxKnownTargets {
+		// Relearning makes every destination new again, so the baseline starts over too
+		s.known = make(map[string]struct{})
+		s.newTargets = anomalyMeter{}
+		s.added = 0
+	}
+	s.known[host] = struct{}{}
+	s.added++
+}
+
+// sample compares the traffic since the previous sample with the baselines. clients holds the
+// cumulative counters of all clients.
+func (d *AnomalyDetector) sample(now time.Time, clients map[string]SnapshotCounters) {
+	if d == nil {
+		return
+	}
+
+	var alerts []AnomalyAlert
+	d.mu.Lock()
+	elapsed := now.Sub(d.lastSample)
+	if !d.lastSample.IsZero() && elapsed <= 0 {
+		d.mu.Unlock()
+		return
+	}
+	// On the first sample no subject is primed yet, so the rate is never used
+	d.lastSample = now
+	perMinute := float64(time.Minute) / float64(elapsed)
+
+	groupBytes := make(map[string]int64)
+	for clientID, counters := range clients {
+		s := d.subject(AnomalySubjectClient, clientID)
+		s.groupID = counters.GroupID
+		total := counters.BytesSent + counters.BytesReceived
+		delta := total - s.lastBytes
+		s.lastBytes = total
+		if !s.primed || delta < 0 {
+			// A new client or reset counters have no meaningful delta
+			s.primed = true
+			s.added = 0
+			continue
+		}
+		if counters.GroupID != "" {
+			groupBytes[counters.GroupID] += delta
+		}
+		alerts = d.evaluate(alerts, now, AnomalySubjectClient, clientID, s, float64(delta)*perMinute, perMinute)
+	}
+
+	for key, s := range d.subjects {
+		if key.subject != AnomalySubjectGroup {
+			continue
+		}
+		if !s.primed {
+			s.primed = true
+			s.added = 0
+			continue
+		}
+		alerts = d.evaluate(alerts, now, AnomalySubjectGroup, key.id, s, float64(groupBytes[key.id])*perMinute, perMinute)
+	}
+
+	// Clients gone from the metrics are forgotten
+	for key := range d.subjects {
+		if key.subject == AnomalySubjectClient {
+			if _, ok := clients[key.id]; !ok {
+				delete(d.subjects, key)
+			}
+		}
+	}
+	d.alerts += int64(len(alerts))
+	d.mu.Unlock()
+
+	for _, alert := range alerts {
+		d.notify(alert)
+	}
+}
+
+// evaluate feeds both rates of a subject to its meters and appends the alerts raised, d.mu must be held
+func (d *AnomalyDetector) evaluate(alerts []AnomalyAlert, now time.Time, subject, id string, s *anomalySubject, bytesRate, perMinute float64) []AnomalyAlert {
+	targetsRate := float64(s.added) * perMinute
+	s.added = 0
+
+	rates := []struct {
+		kind    string
+		meter   *anomalyMeter
+		rate    float64
+		minRate float64
+	}{
+		{AnomalyKindBytes, &s.bytes, bytesRate, float64(d.opts.MinBytesPerMinute)},
+		{AnomalyKindNewTargets, &s.newTargets, targetsRate, float64(d.opts.MinNewTargets)},
+	}
+	for _, r := range rates {
+		baseline := r.meter.baseline
+		started, ended := r.meter.observe(r.rate, &d.opts, r.minRate)
+		if ended {
+			logger.Info("Traffic back within baseline", "subject", subject, "id", id, "kind", r.kind, "rate", r.rate, "baseline", r.meter.baseline)
+		}
+		if started {
+			alerts = append(alerts, AnomalyAlert{
+				Time:     now,
+				Subject:  subject,
+				ID:       id,
+				GroupID:  s.groupID,
+				Kind:     r.kind,
+				Rate:     r.rate,
+				Baseline: baseline,
+				Factor:   r.rate / max(baseline, 1),
+			})
+		}
+	}
+	return alerts
+}
+
+// sendAlert logs an alert and posts it to the webhook
+func (d *AnomalyDetector) sendAlert(alert AnomalyAlert) {
+	logger.Warn("Traffic anomaly detected", "subject", alert.Subject, "id", alert.ID, "group_id", alert.GroupID, "kind", alert.Kind, "rate_per_minute", alert.Rate, "baseline_per_minute", alert.Baseline, "factor", fmt.Sprintf("%.1f", alert.Factor))
+	if d.opts.Webhook == "" {
+		return
+	}
+
+	go func() {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), anomalyWebhookTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.opts.Webhook, bytes.NewReader(body))
+		if err != nil {
+			logger.Error("Failed to create anomaly webhook request", "webhook", d.opts.Webhook, "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			logger.Error("Failed to send anomaly alert to webhook", "webhook", d.opts.Webhook, "err", err)
+			return
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Error("Anomaly webhook rejected alert", "webhook", d.opts.Webhook, "status", resp.StatusCode)
+		}
+	}()
+}
+
+// Alerts returns how many anomalies were detected
+func (d *AnomalyDetector) Alerts() int64 {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.alerts
+}
+
+// Anomaly detection process state
+var (
+	anomalyMu     sync.Mutex
+	anomalyCancel context.CancelFunc
+	anomalyWg     sync.WaitGroup
+)
+
+// StartAnomalyDetection starts sampling the traffic of all clients and groups
+func StartAnomalyDetection(opts AnomalyOptions) {
+	anomalyMu.Lock()
+	defer anomalyMu.Unlock()
+	if anomalyCancel != nil {
+		return
+	}
+
+	d := NewAnomalyDetector(opts)
+	globalManager.mu.Lock()
+	globalManager.anomaly = d
+	globalManager.mu.Unlock()
+	logger.Info("Traffic anomaly detection started", "interval", d.opts.Interval, "factor", d.opts.Factor, "warmup", d.opts.Warmup, "webhook", d.opts.Webhook != "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	anomalyCancel = cancel
+	anomalyWg.Add(1)
+	go func() {
+		defer anomalyWg.Done()
+		ticker := time.NewTicker(d.opts.Interval)
+		defer ticker.Stop()
+
+		d.sample(time.Now(), globalManager.Snapshot().Clients)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				d.sample(now, globalManager.Snapshot().Clients)
+			}
+		}
+	}()
+}
+
+// StopAnomalyDetection stops sampling
+func StopAnomalyDetection() {
+	anomalyMu.Lock()
+	defer anomalyMu.Unlock()
+	if anomalyCancel == nil {
+		return
+	}
+	anomalyCancel()
+	anomalyWg.Wait()
+	anomalyCancel = nil
+
+	globalManager.mu.Lock()
+	globalManager.anomaly = nil
+	globalManager.mu.Unlock()
+}
+
+// GetAnomalyAlerts returns how many anomalies were detected since detection started (public API)
+func GetAnomalyAlerts() int64 {
+	globalManager.mu.RLock()
+	d := globalManager.anomaly
+	globalManager.mu.RUnlock()
+	return d.Alerts()
+}
@@ -0,0 +1,80 @@
+package monitoring
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	d := NewAnomalyDetector(AnomalyOptions{Warmup: 3, MinBytesPerMinute: 1000, MinNewTargets: 5})
+	var alerts []AnomalyAlert
+	d.notify = func(alert AnomalyAlert) { alerts = append(alerts, alert) }
+
+	now := time.Now()
+	var total int64
+	step := func(bytesPerMinute int64, newTargets int) {
+		for i := 0; i < newTargets; i++ {
+			d.ObserveTarget("client-1", "group-1", fmt.Sprintf("host-%d-%d.example.com:443", now.UnixNano(), i))
+		}
+		total += bytesPerMinute
+		now = now.Add(time.Minute)
+		d.sample(now, map[string]SnapshotCounters{"client-1": {GroupID: "group-1", BytesSent: total}})
+	}
+
+	// Steady traffic builds the baselines without alerts
+	for i := 0; i < 5; i++ {
+		step(10000, 1)
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("Expected no alerts for steady traffic, got %+v", alerts)
+	}
+
+	// A burst alerts once for the client and once for its group
+	step(1000000, 1)
+	step(1000000, 1)
+	if len(alerts) != 2 {
+		t.Fatalf("Expected a client and a group alert, got %+v", alerts)
+	}
+	for _, alert := range alerts {
+		if alert.Kind != AnomalyKindBytes || alert.Rate != 1000000 || alert.Factor < 50 {
+			t.Errorf("Unexpected alert: %+v", alert)
+		}
+	}
+
+	// Many new destinations alert as well
+	alerts = nil
+	step(10000, 50)
+	found := false
+	for _, alert := range alerts {
+		if alert.Kind == AnomalyKindNewTargets && alert.Subject == AnomalySubjectClient && alert.Rate == 50 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a new destinations alert for the client, got %+v", alerts)
+	}
+	if d.Alerts() != int64(2+len(alerts)) {
+		t.Errorf("Expected %d alerts counted, got %d", 2+len(alerts), d.Alerts())
+	}
+
+	// Clients gone from the metrics are forgotten
+	d.sample(now.Add(time.Minute), map[string]SnapshotCounters{})
+	if _, ok := d.subjects[anomalyKey{subject: AnomalySubjectClient, id: "client-1"}]; ok {
+		t.Error("Expected the removed client to be forgotten")
+	}
+
+	var none *AnomalyDetector
+	none.ObserveTarget("client-1", "group-1", "example.com:443")
+	none.sample(now, nil)
+}
+
+func TestAnomalyDetector_IgnoresSmallRates(t *testing.T) {
+	d := NewAnomalyDetector(AnomalyOptions{Warmup: 1})
+	d.notify = func(alert AnomalyAlert) { t.Errorf("Unexpected alert: %+v", alert) }
+
+	now := time.Now()
+	for i, total := range []int64{0, 10, 20, 10000} {
+		d.sample(now.Add(time.Duration(i)*time.Minute), map[string]SnapshotCounters{"client-1": {BytesReceived: total}})
+	}
+}
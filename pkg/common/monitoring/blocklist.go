@@ -0,0 +1,73 @@
+package monitoring
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// blocklistStats counts blocked dials and entries per blocklist
+var blocklistStats = struct {
+	mu      sync.RWMutex
+	blocked map[string]*int64
+	entries map[string]int
+}{
+	blocked: make(map[string]*int64),
+	entries: make(map[string]int),
+}
+
+// BlocklistStats is a snapshot of one blocklist
+type BlocklistStats struct {
+	Name         string `json:"name"`
+	Entries      int    `json:"entries"`
+	BlockedDials int64  `json:"blocked_dials"`
+}
+
+// IncrementBlockedDials counts a dial rejected by a blocklist
+func IncrementBlockedDials(list string) {
+	atomic.AddInt64(&globalManager.global.BlockedDials, 1)
+
+	blocklistStats.mu.RLock()
+	counter, ok := blocklistStats.blocked[list]
+	blocklistStats.mu.RUnlock()
+	if !ok {
+		blocklistStats.mu.Lock()
+		if counter, ok = blocklistStats.blocked[list]; !ok {
+			counter = new(int64)
+			blocklistStats.blocked[list] = counter
+		}
+		blocklistStats.mu.Unlock()
+	}
+	atomic.AddInt64(counter, 1)
+}
+
+// SetBlocklistEntries records the number of entries of a loaded blocklist
+func SetBlocklistEntries(list string, entries int) {
+	blocklistStats.mu.Lock()
+	blocklistStats.entries[list] = entries
+	blocklistStats.mu.Unlock()
+}
+
+// GetBlocklistStats returns the stats of all blocklists, sorted by name
+func GetBlocklistStats() []BlocklistStats {
+	blocklistStats.mu.RLock()
+	defer blocklistStats.mu.RUnlock()
+
+	names := make(map[string]bool)
+	for name := range blocklistStats.entries {
+		names[name] = true
+	}
+	for name := range blocklistStats.blocked {
+		names[name] = true
+	}
+	stats := make([]BlocklistStats, 0, len(names))
+	for name := range names {
+		s := BlocklistStats{Name: name, Entries: blocklistStats.entries[name]}
+		if counter, ok := blocklistStats.blocked[name]; ok {
+			s.BlockedDials = atomic.LoadInt64(counter)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
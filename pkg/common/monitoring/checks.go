@@ -0,0 +1,79 @@
+package monitoring
+
+import (
+	"sort"
+	"time"
+)
+
+// CheckResult is the latest result of a synthetic check a client runs against a target
+type CheckResult struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`   // "tcp" or "http"
+	Target    string    `json:"target"` // host:port or URL
+	OK        bool      `json:"ok"`
+	LatencyMs float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ClientCheck is the result of a check on one client of a group
+type ClientCheck struct {
+	ClientID  string    `json:"client_id"`
+	OK        bool      `json:"ok"`
+	LatencyMs float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// GroupCheck sums up a check over the online clients of a group running it
+type GroupCheck struct {
+	GroupID string        `json:"group_id"`
+	Name    string        `json:"name"`
+	Type    string        `json:"type"`
+	Target  string        `json:"target"`
+	Passing int           `json:"passing"`
+	Failing int           `json:"failing"`
+	Clients []ClientCheck `json:"clients"`
+}
+
+// GroupChecks sums up the checks reported by the online clients, ordered by group and check
+// name. Checks are matched by group, name and target, clients configure them independently.
+func GroupChecks(clients map[string]*ClientMetrics) []*GroupCheck {
+	type key struct{ group, name, target string }
+	checks := make(map[key]*GroupCheck)
+	for clientID, client := range clients {
+		if !client.IsOnline || client.Telemetry == nil {
+			continue
+		}
+		for _, result := range client.Telemetry.Checks {
+			k := key{client.GroupID, result.Name, result.Target}
+			check, exists := checks[k]
+			if !exists {
+				check = &GroupCheck{GroupID: client.GroupID, Name: result.Name, Type: result.Type, Target: result.Target}
+				checks[k] = check
+			}
+			if result.OK {
+				check.Passing++
+			} else {
+				check.Failing++
+			}
+			check.Clients = append(check.Clients, ClientCheck{ClientID: clientID, OK: result.OK, LatencyMs: result.LatencyMs, Error: result.Error, CheckedAt: result.CheckedAt})
+		}
+	}
+
+	result := make([]*GroupCheck, 0, len(checks))
+	for _, check := range checks {
+		sort.Slice(check.Clients, func(i, j int) bool { return check.Clients[i].ClientID < check.Clients[j].ClientID })
+		result = append(result, check)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].GroupID != result[j].GroupID {
+			return result[i].GroupID < result[j].GroupID
+		}
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Target < result[j].Target
+	})
+	return result
+}
@@ -0,0 +1,25 @@
+package monitoring
+
+import "testing"
+
+func TestGroupChecks(t *testing.T) {
+	db := CheckResult{Name: "db", Type: "tcp", Target: "db.internal:5432", OK: true}
+	down := db
+	down.OK, down.Error = false, "connection refused"
+	clients := map[string]*ClientMetrics{
+		"edge-1":  {GroupID: "stores", IsOnline: true, Telemetry: &ClientTelemetry{Checks: []CheckResult{db}}},
+		"edge-2":  {GroupID: "stores", IsOnline: true, Telemetry: &ClientTelemetry{Checks: []CheckResult{down}}},
+		"edge-3":  {GroupID: "stores", IsOnline: false, Telemetry: &ClientTelemetry{Checks: []CheckResult{down}}},
+		"hq-1":    {GroupID: "hq", IsOnline: true, Telemetry: &ClientTelemetry{Checks: []CheckResult{db}}},
+		"legacy1": {GroupID: "hq", IsOnline: true},
+	}
+
+	checks := GroupChecks(clients)
+	if len(checks) != 2 || checks[0].GroupID != "hq" || checks[1].GroupID != "stores" {
+		t.Fatalf("GroupChecks() = %+v, want one check per group ordered by group", checks)
+	}
+	stores := checks[1]
+	if stores.Passing != 1 || stores.Failing != 1 || len(stores.Clients) != 2 || stores.Clients[1].Error != "connection refused" {
+		t.Errorf("Stores check = %+v, want the online clients only", stores)
+	}
+}
@@ -0,0 +1,61 @@
+package monitoring
+
+import "sync/atomic"
+
+// dnsCacheStats counts the lookups of the gateway DNS cache
+var dnsCacheStats struct {
+	enabled      atomic.Bool
+	hits         atomic.Int64
+	negativeHits atomic.Int64
+	misses       atomic.Int64
+	failures     atomic.Int64
+	entries      atomic.Int64
+}
+
+// DNSCacheStats is a snapshot of the gateway DNS cache
+type DNSCacheStats struct {
+	Hits         int64 `json:"hits"`          // Lookups answered with cached addresses
+	NegativeHits int64 `json:"negative_hits"` // Lookups answered with a cached failure
+	Misses       int64 `json:"misses"`        // Lookups sent to the DNS servers
+	Failures     int64 `json:"failures"`      // Misses the DNS servers failed or had no addresses for
+	Entries      int64 `json:"entries"`       // Cached host names
+}
+
+// RecordDNSCacheHit counts a lookup answered from the cache, negative when it was a cached failure
+func RecordDNSCacheHit(negative bool) {
+	dnsCacheStats.enabled.Store(true)
+	if negative {
+		dnsCacheStats.negativeHits.Add(1)
+		return
+	}
+	dnsCacheStats.hits.Add(1)
+}
+
+// RecordDNSCacheMiss counts a lookup sent to the DNS servers, failed when it got no addresses
+func RecordDNSCacheMiss(failed bool) {
+	dnsCacheStats.enabled.Store(true)
+	dnsCacheStats.misses.Add(1)
+	if failed {
+		dnsCacheStats.failures.Add(1)
+	}
+}
+
+// SetDNSCacheEntries records the number of cached host names
+func SetDNSCacheEntries(entries int) {
+	dnsCacheStats.enabled.Store(true)
+	dnsCacheStats.entries.Store(int64(entries))
+}
+
+// GetDNSCacheStats returns the DNS cache stats, nil when no cache recorded any
+func GetDNSCacheStats() *DNSCacheStats {
+	if !dnsCacheStats.enabled.Load() {
+		return nil
+	}
+	return &DNSCacheStats{
+		Hits:         dnsCacheStats.hits.Load(),
+		NegativeHits: dnsCacheStats.negativeHits.Load(),
+		Misses:       dnsCacheStats.misses.Load(),
+		Failures:     dnsCacheStats.failures.Load(),
+		Entries:      dnsCacheStats.entries.Load(),
+	}
+}
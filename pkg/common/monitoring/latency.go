@@ -0,0 +1,267 @@
+package monitoring
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBucketsMs are the histogram upper bounds in milliseconds, a 1-2-5 series
+// that keeps relative precision roughly constant across four orders of magnitude
+var latencyBucketsMs = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000, 60000}
+
+// Latency tracking limits
+const (
+	// maxLatencyTargets caps the number of per-target histograms, further hosts are folded into otherTarget
+	maxLatencyTargets = 1000
+	// otherTarget aggregates target hosts beyond maxLatencyTargets
+	otherTarget = "other"
+	// latencyIdleTimeout removes histograms that have not been updated for this long
+	latencyIdleTimeout = time.Hour
+)
+
+// Histogram is a fixed-bucket latency histogram safe for concurrent use
+type Histogram struct {
+	counts     []int64 // One counter per bucket plus the +Inf bucket
+	count      int64
+	sumMicros  int64
+	lastUpdate int64 // Unix nanoseconds
+}
+
+// newHistogram creates an empty histogram
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, len(latencyBucketsMs)+1)}
+}
+
+// Observe records a duration
+func (h *Histogram) Observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	idx := len(latencyBucketsMs)
+	for i, bound := range latencyBucketsMs {
+		if ms <= bound {
+			idx = i
+			break
+		}
+	}
+	atomic.AddInt64(&h.counts[idx], 1)
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sumMicros, d.Microseconds())
+	atomic.StoreInt64(&h.lastUpdate, time.Now().UnixNano())
+}
+
+// LatencyBucket is a cumulative histogram bucket
+type LatencyBucket struct {
+	LE    float64 `json:"le_ms"` // Upper bound in milliseconds, +Inf is reported as -1
+	Count int64   `json:"count"`
+}
+
+// HistogramSnapshot is a point-in-time view of a histogram
+type HistogramSnapshot struct {
+	Count   int64           `json:"count"`
+	SumMs   float64         `json:"sum_ms"`
+	AvgMs   float64         `json:"avg_ms"`
+	P50Ms   float64         `json:"p50_ms"`
+	P90Ms   float64         `json:"p90_ms"`
+	P99Ms   float64         `json:"p99_ms"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// Snapshot returns the cumulative buckets and estimated percentiles
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Count:   atomic.LoadInt64(&h.count),
+		SumMs:   float64(atomic.LoadInt64(&h.sumMicros)) / 1000,
+		Buckets: make([]LatencyBucket, 0, len(h.counts)),
+	}
+
+	cumulative := int64(0)
+	for i := range h.counts {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		bound := -1.0
+		if i < len(latencyBucketsMs) {
+			bound = latencyBucketsMs[i]
+		}
+		snap.Buckets = append(snap.Buckets, LatencyBucket{LE: bound, Count: cumulative})
+	}
+	// Buckets are read one by one, use the bucket total so percentiles stay consistent
+	if cumulative != snap.Count {
+		snap.Count = cumulative
+	}
+
+	if snap.Count > 0 {
+		snap.AvgMs = snap.SumMs / float64(snap.Count)
+		snap.P50Ms = snap.quantile(0.50)
+		snap.P90Ms = snap.quantile(0.90)
+		snap.P99Ms = snap.quantile(0.99)
+	}
+	return snap
+}
+
+// quantile estimates a quantile by linear interpolation inside the matching bucket
+func (s HistogramSnapshot) quantile(q float64) float64 {
+	rank := q * float64(s.Count)
+	prevCount := int64(0)
+	prevBound := 0.0
+	for _, b := range s.Buckets {
+		if float64(b.Count) >= rank {
+			if b.LE < 0 {
+				// Beyond the largest bound, report the largest bound
+				return prevBound
+			}
+			inBucket := b.Count - prevCount
+			if inBucket == 0 {
+				return b.LE
+			}
+			fraction := (rank - float64(prevCount)) / float64(inBucket)
+			return math.Round((prevBound+(b.LE-prevBound)*fraction)*100) / 100
+		}
+		prevCount = b.Count
+		prevBound = b.LE
+	}
+	return prevBound
+}
+
+// LatencyStats holds the latency histograms of a client or target host
+type LatencyStats struct {
+	Dial *Histogram // Time from dial request to the client's successful connect response
+	TTFB *Histogram // Time from dial request to the first byte received from the target
+}
+
+// newLatencyStats creates empty latency histograms
+func newLatencyStats() *LatencyStats {
+	return &LatencyStats{Dial: newHistogram(), TTFB: newHistogram()}
+}
+
+// lastUpdate returns the most recent observation time
+func (s *LatencyStats) lastUpdate() time.Time {
+	last := atomic.LoadInt64(&s.Dial.lastUpdate)
+	if ttfb := atomic.LoadInt64(&s.TTFB.lastUpdate); ttfb > last {
+		last = ttfb
+	}
+	return time.Unix(0, last)
+}
+
+// LatencyStatsSnapshot is the JSON view of LatencyStats
+type LatencyStatsSnapshot struct {
+	Dial HistogramSnapshot `json:"dial"`
+	TTFB HistogramSnapshot `json:"ttfb"`
+}
+
+// LatencySnapshot contains latency histograms per client and per target host
+type LatencySnapshot struct {
+	Clients map[string]LatencyStatsSnapshot `json:"clients"`
+	Targets map[string]LatencyStatsSnapshot `json:"targets"`
+}
+
+// LatencyTracker records dial and time-to-first-byte latencies per client and target host
+type LatencyTracker struct {
+	mu      sync.RWMutex
+	clients map[string]*LatencyStats
+	targets map[string]*LatencyStats
+}
+
+// NewLatencyTracker creates an empty latency tracker
+func NewLatencyTracker() *LatencyTracker {
+	return &LatencyTracker{
+		clients: make(map[string]*LatencyStats),
+		targets: make(map[string]*LatencyStats),
+	}
+}
+
+// get returns the stats for key, creating them when needed
+func (t *LatencyTracker) get(m map[string]*LatencyStats, key string, limit int) *LatencyStats {
+	t.mu.RLock()
+	stats, ok := m[key]
+	t.mu.RUnlock()
+	if ok {
+		return stats
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if stats, ok = m[key]; ok {
+		return stats
+	}
+	if limit > 0 && len(m) >= limit {
+		key = otherTarget
+		if stats, ok = m[key]; ok {
+			return stats
+		}
+	}
+	stats = newLatencyStats()
+	m[key] = stats
+	return stats
+}
+
+// RecordDial records the dial latency of a connection
+func (t *LatencyTracker) RecordDial(clientID, targetHost string, d time.Duration) {
+	t.get(t.clients, clientID, 0).Dial.Observe(d)
+	t.get(t.targets, targetHostKey(targetHost), maxLatencyTargets).Dial.Observe(d)
+}
+
+// RecordTTFB records the time-to-first-byte of a connection
+func (t *LatencyTracker) RecordTTFB(clientID, targetHost string, d time.Duration) {
+	t.get(t.clients, clientID, 0).TTFB.Observe(d)
+	t.get(t.targets, targetHostKey(targetHost), maxLatencyTargets).TTFB.Observe(d)
+}
+
+// Snapshot returns a copy of all histograms
+func (t *LatencyTracker) Snapshot() LatencySnapshot {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	snap := LatencySnapshot{
+		Clients: make(map[string]LatencyStatsSnapshot, len(t.clients)),
+		Targets: make(map[string]LatencyStatsSnapshot, len(t.targets)),
+	}
+	for id, stats := range t.clients {
+		snap.Clients[id] = LatencyStatsSnapshot{Dial: stats.Dial.Snapshot(), TTFB: stats.TTFB.Snapshot()}
+	}
+	for host, stats := range t.targets {
+		snap.Targets[host] = LatencyStatsSnapshot{Dial: stats.Dial.Snapshot(), TTFB: stats.TTFB.Snapshot()}
+	}
+	return snap
+}
+
+// Cleanup removes histograms that have not been updated within maxIdle
+func (t *LatencyTracker) Cleanup(maxIdle time.Duration) {
+	cutoff := time.Now().Add(-maxIdle)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range []map[string]*LatencyStats{t.clients, t.targets} {
+		for key, stats := range m {
+			if stats.lastUpdate().Before(cutoff) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// targetHostKey strips the port from a target address
+func targetHostKey(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// globalLatency is the process-wide latency tracker
+var globalLatency = NewLatencyTracker()
+
+// RecordDialLatency records dial latency for a client and target host (public API)
+func RecordDialLatency(clientID, targetHost string, d time.Duration) {
+	globalLatency.RecordDial(clientID, targetHost, d)
+}
+
+// RecordTimeToFirstByte records time-to-first-byte for a client and target host (public API)
+func RecordTimeToFirstByte(clientID, targetHost string, d time.Duration) {
+	globalLatency.RecordTTFB(clientID, targetHost, d)
+}
+
+// GetLatencySnapshot returns latency histograms per client and target host (public API)
+func GetLatencySnapshot() LatencySnapshot {
+	return globalLatency.Snapshot()
+}
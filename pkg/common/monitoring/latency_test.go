@@ -0,0 +1,83 @@
+package monitoring
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram_SnapshotPercentiles(t *testing.T) {
+	h := newHistogram()
+	for i := 0; i < 90; i++ {
+		h.Observe(3 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(400 * time.Millisecond)
+	}
+	h.Observe(2 * time.Minute) // Lands in the +Inf bucket
+
+	snap := h.Snapshot()
+	if snap.Count != 101 {
+		t.Fatalf("Expected 101 observations, got %d", snap.Count)
+	}
+	if last := snap.Buckets[len(snap.Buckets)-1]; last.LE != -1 || last.Count != 101 {
+		t.Errorf("Expected +Inf bucket to hold all observations, got %+v", last)
+	}
+	if snap.P50Ms <= 2 || snap.P50Ms > 5 {
+		t.Errorf("Expected p50 within the 2-5ms bucket, got %v", snap.P50Ms)
+	}
+	if snap.P99Ms <= 200 || snap.P99Ms > 500 {
+		t.Errorf("Expected p99 within the 200-500ms bucket, got %v", snap.P99Ms)
+	}
+}
+
+func TestLatencyTracker_TargetCardinalityLimit(t *testing.T) {
+	tracker := NewLatencyTracker()
+	for i := 0; i < maxLatencyTargets+10; i++ {
+		tracker.RecordDial("client-1", fmt.Sprintf("host-%d.example.com:443", i), time.Millisecond)
+	}
+
+	snap := tracker.Snapshot()
+	if len(snap.Targets) != maxLatencyTargets+1 {
+		t.Errorf("Expected %d target entries, got %d", maxLatencyTargets+1, len(snap.Targets))
+	}
+	if other := snap.Targets[otherTarget]; other.Dial.Count != 10 {
+		t.Errorf("Expected 10 observations folded into %q, got %d", otherTarget, other.Dial.Count)
+	}
+	if client := snap.Clients["client-1"]; client.Dial.Count != int64(maxLatencyTargets+10) {
+		t.Errorf("Expected all observations on the client, got %d", client.Dial.Count)
+	}
+	if _, ok := snap.Targets["host-0.example.com"]; !ok {
+		t.Error("Expected target key without port")
+	}
+
+	tracker.Cleanup(-time.Second)
+	if snap := tracker.Snapshot(); len(snap.Clients) != 0 || len(snap.Targets) != 0 {
+		t.Error("Expected cleanup to remove idle histograms")
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	RecordDialLatency("prom-client", "prom.example.com:443", 15*time.Millisecond)
+	RecordTimeToFirstByte("prom-client", "prom.example.com:443", 40*time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"# TYPE anyproxy_client_dial_duration_seconds histogram",
+		`anyproxy_client_dial_duration_seconds_bucket{client_id="prom-client",le="0.02"} 1`,
+		`anyproxy_client_dial_duration_seconds_bucket{client_id="prom-client",le="0.01"} 0`,
+		`anyproxy_target_ttfb_seconds_count{target_host="prom.example.com"} 1`,
+		"anyproxy_active_connections ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package monitoring
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// maxFailedConnections caps the kept records of failed connections, the oldest is dropped first
+const maxFailedConnections = 1000
+
+// Connection record statuses
+const (
+	StatusActive = "active"
+	StatusFailed = "failed"
+)
+
+// MetricsLimits bounds the records kept for connections and clients. Counters of the global,
+// client, target and user stats always cover every connection, only the per-connection records
+// are sampled or capped.
+type MetricsLimits struct {
+	MaxConnections int // Records of active connections, 0 for no limit
+	MaxClients     int // Client records, the least recently seen client is evicted first, 0 for no limit
+	SampleRate     int // Keep the record of 1 in N connections, 0 or 1 keeps all
+}
+
+// unrecordedConn is the accounting of a connection without a record: enough to attribute its
+// bytes to the target and its active count to the client
+type unrecordedConn struct {
+	clientID   string
+	targetHost string
+}
+
+// SetMetricsLimits configures the record limits of the global metrics
+func SetMetricsLimits(limits MetricsLimits) {
+	globalManager.mu.Lock()
+	defer globalManager.mu.Unlock()
+	globalManager.limits = limits
+	logger.Info("Metrics record limits configured", "max_connections", limits.MaxConnections, "max_clients", limits.MaxClients, "sample_rate", limits.SampleRate)
+}
+
+// recordConnection decides whether a new connection gets a record, m.mu must be held
+func (m *MetricsManager) recordConnection() bool {
+	if m.limits.MaxConnections > 0 && len(m.connections) >= m.limits.MaxConnections {
+		return false
+	}
+	if m.limits.SampleRate > 1 {
+		m.sampled++
+		return m.sampled%uint64(m.limits.SampleRate) == 1
+	}
+	return true
+}
+
+// connectionTarget returns the client and target of an active connection with or without a
+// record, m.mu must be held
+func (m *MetricsManager) connectionTarget(connID string) (clientID, targetHost string, ok bool) {
+	if conn, exists := m.connections[connID]; exists {
+		return conn.ClientID, conn.TargetHost, true
+	}
+	if conn, exists := m.unrecorded[connID]; exists {
+		return conn.clientID, conn.targetHost, true
+	}
+	return "", "", false
+}
+
+// newClient adds a client record, evicting the least recently seen client when the limit is
+// reached; offline clients go before online ones. m.mu must be held.
+func (m *MetricsManager) newClient(clientID string) *ClientMetrics {
+	if m.limits.MaxClients > 0 && len(m.clients) >= m.limits.MaxClients {
+		var oldest *ClientMetrics
+		for _, client := range m.clients {
+			if oldest == nil || (oldest.IsOnline && !client.IsOnline) ||
+				(oldest.IsOnline == client.IsOnline && client.LastSeen.Before(oldest.LastSeen)) {
+				oldest = client
+			}
+		}
+		delete(m.clients, oldest.ClientID)
+		atomic.AddInt64(&m.global.EvictedClients, 1)
+		logger.Debug("Evicted client metrics at the client limit", "client_id", oldest.ClientID, "online", oldest.IsOnline, "max_clients", m.limits.MaxClients)
+	}
+	client := &ClientMetrics{ClientID: clientID, IsOnline: true}
+	m.clients[clientID] = client
+	return client
+}
+
+// FailConnection keeps the record of a connection that failed with reason, whether or not its
+// connection was sampled. Records of failed connections are kept after the connection closes.
+func (m *MetricsManager) FailConnection(connID, clientID, targetHost, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record := &ConnectionMetrics{ConnectionID: connID, ClientID: clientID, TargetHost: targetHost, StartTime: time.Now()}
+	if conn, exists := m.connections[connID]; exists {
+		copied := *conn
+		copied.BytesSent, copied.BytesReceived = atomic.LoadInt64(&conn.BytesSent), atomic.LoadInt64(&conn.BytesReceived)
+		record = &copied
+	}
+	record.Status = StatusFailed
+	record.Error = reason
+
+	if len(m.failed) >= maxFailedConnections {
+		m.failed = append(m.failed[:0], m.failed[1:]...)
+	}
+	m.failed = append(m.failed, record)
+}
+
+// GetFailedConnections returns the records of recently failed connections, oldest first
+func (m *MetricsManager) GetFailedConnections() []*ConnectionMetrics {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*ConnectionMetrics(nil), m.failed...)
+}
+
+// FailConnection keeps the record of a failed connection (public API)
+func FailConnection(connID, clientID, targetHost, reason string) {
+	globalManager.FailConnection(connID, clientID, targetHost, reason)
+}
+
+// GetFailedConnections returns the records of recently failed connections (public API)
+func GetFailedConnections() []*ConnectionMetrics {
+	return globalManager.GetFailedConnections()
+}
@@ -0,0 +1,106 @@
+package monitoring
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMetricsLimits_Sampling(t *testing.T) {
+	m := newTestManager()
+	m.limits = MetricsLimits{SampleRate: 10}
+
+	for i := 0; i < 100; i++ {
+		connID := fmt.Sprintf("conn-%d", i)
+		m.CreateConnection(connID, "client-1", "example.com:443")
+		m.UpdateConnectionBytes(connID, "client-1", 10, 20)
+	}
+
+	if len(m.GetActiveConnections()) != 10 {
+		t.Errorf("Recorded connections = %d, want 1 in 10", len(m.GetActiveConnections()))
+	}
+	metrics := m.global
+	if metrics.ActiveConnections != 100 || metrics.TotalConnections != 100 || metrics.UnrecordedConnections != 90 {
+		t.Errorf("Active = %d, total = %d, unrecorded = %d, want every connection counted",
+			metrics.ActiveConnections, metrics.TotalConnections, metrics.UnrecordedConnections)
+	}
+	if metrics.BytesSent != 1000 {
+		t.Errorf("BytesSent = %d, want the bytes of every connection", metrics.BytesSent)
+	}
+	if client := m.GetAllClientStats()["client-1"]; client == nil || client.ActiveConnections != 100 {
+		t.Errorf("Client stats = %+v, want 100 active connections", client)
+	}
+
+	for i := 0; i < 100; i++ {
+		m.CloseConnection(fmt.Sprintf("conn-%d", i))
+	}
+	if global, actual, ok := m.ValidateConnectionCounts(); !ok || global != 0 {
+		t.Errorf("Counts after closing = %d/%d, want 0", global, actual)
+	}
+}
+
+func TestMetricsLimits_MaxConnections(t *testing.T) {
+	m := newTestManager()
+	m.limits = MetricsLimits{MaxConnections: 5}
+
+	for i := 0; i < 8; i++ {
+		m.CreateConnection(fmt.Sprintf("conn-%d", i), "client-1", "example.com:443")
+	}
+	if len(m.GetActiveConnections()) != 5 || m.global.ActiveConnections != 8 {
+		t.Errorf("Recorded %d of %d connections, want 5 of 8", len(m.GetActiveConnections()), m.global.ActiveConnections)
+	}
+
+	// A closed record makes room for the next connection
+	m.CloseConnection("conn-0")
+	m.CreateConnection("conn-8", "client-1", "example.com:443")
+	if _, exists := m.GetActiveConnections()["conn-8"]; !exists {
+		t.Error("Connection after a close should be recorded")
+	}
+}
+
+func TestMetricsLimits_MaxClients(t *testing.T) {
+	m := newTestManager()
+	m.limits = MetricsLimits{MaxClients: 2}
+
+	m.UpdateClientMetrics("client-1", "group-1", 0, 0, false)
+	m.UpdateClientMetrics("client-2", "group-1", 0, 0, false)
+	m.clients["client-1"].LastSeen = time.Now().Add(-time.Minute)
+	m.UpdateClientMetrics("client-3", "group-1", 0, 0, false)
+
+	clients := m.GetAllClientStats()
+	if _, exists := clients["client-1"]; exists || len(clients) != 2 {
+		t.Errorf("Clients = %v, want the least recently seen client evicted", clients)
+	}
+
+	// Offline clients go first
+	m.MarkClientOffline("client-3")
+	m.UpdateClientMetrics("client-4", "group-1", 0, 0, false)
+	if _, exists := m.GetAllClientStats()["client-3"]; exists {
+		t.Error("Offline client should be evicted before online ones")
+	}
+	if m.global.EvictedClients != 2 {
+		t.Errorf("EvictedClients = %d, want 2", m.global.EvictedClients)
+	}
+}
+
+func TestFailConnection(t *testing.T) {
+	m := newTestManager()
+	m.limits = MetricsLimits{SampleRate: 1000}
+
+	m.CreateConnection("conn-1", "client-1", "example.com:443")
+	m.CreateConnection("conn-2", "client-1", "blocked.example.com:443")
+	m.FailConnection("conn-2", "client-1", "blocked.example.com:443", "connection refused")
+	m.CloseConnection("conn-2")
+
+	failed := m.GetFailedConnections()
+	if len(failed) != 1 || failed[0].Status != StatusFailed || failed[0].Error != "connection refused" || failed[0].TargetHost != "blocked.example.com:443" {
+		t.Fatalf("Failed connections = %+v, want the unsampled failure", failed)
+	}
+
+	for i := 0; i < maxFailedConnections+1; i++ {
+		m.FailConnection(fmt.Sprintf("conn-x%d", i), "client-1", "example.com:443", "timeout")
+	}
+	if failed := m.GetFailedConnections(); len(failed) != maxFailedConnections || failed[0].ConnectionID != "conn-x1" {
+		t.Errorf("Kept %d failed connections starting at %s, want the latest %d", len(failed), failed[0].ConnectionID, maxFailedConnections)
+	}
+}
@@ -0,0 +1,71 @@
+package monitoring
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// listenerCounters counts what a listener turned away
+type listenerCounters struct {
+	rejected    int64 // Connections closed by the listener limits
+	tlsRejected int64 // TLS handshakes refused by client fingerprint
+}
+
+// listenerRejections holds the counters of each listener
+var listenerRejections = struct {
+	mu       sync.RWMutex
+	counters map[string]*listenerCounters
+}{
+	counters: make(map[string]*listenerCounters),
+}
+
+// ListenerStats is a snapshot of one listener
+type ListenerStats struct {
+	Listener              string `json:"listener"`
+	RejectedConnections   int64  `json:"rejected_connections"`
+	RejectedTLSHandshakes int64  `json:"rejected_tls_handshakes"`
+}
+
+// listenerCountersFor returns the counters of a listener, creating them on first use
+func listenerCountersFor(listener string) *listenerCounters {
+	listenerRejections.mu.RLock()
+	counters, ok := listenerRejections.counters[listener]
+	listenerRejections.mu.RUnlock()
+	if !ok {
+		listenerRejections.mu.Lock()
+		if counters, ok = listenerRejections.counters[listener]; !ok {
+			counters = &listenerCounters{}
+			listenerRejections.counters[listener] = counters
+		}
+		listenerRejections.mu.Unlock()
+	}
+	return counters
+}
+
+// IncrementListenerRejections counts a connection closed by the limits of a proxy listener
+func IncrementListenerRejections(listener string) {
+	atomic.AddInt64(&listenerCountersFor(listener).rejected, 1)
+}
+
+// IncrementTLSFingerprintRejections counts a TLS handshake refused by the fingerprint rules of a listener
+func IncrementTLSFingerprintRejections(listener string) {
+	atomic.AddInt64(&listenerCountersFor(listener).tlsRejected, 1)
+}
+
+// GetListenerStats returns the stats of all listeners that rejected connections, sorted by name
+func GetListenerStats() []ListenerStats {
+	listenerRejections.mu.RLock()
+	defer listenerRejections.mu.RUnlock()
+
+	stats := make([]ListenerStats, 0, len(listenerRejections.counters))
+	for name, counters := range listenerRejections.counters {
+		stats = append(stats, ListenerStats{
+			Listener:              name,
+			RejectedConnections:   atomic.LoadInt64(&counters.rejected),
+			RejectedTLSHandshakes: atomic.LoadInt64(&counters.tlsRejected),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Listener < stats[j].Listener })
+	return stats
+}
@@ -14,12 +14,20 @@ import (
 
 // Metrics represents essential system metrics (backward compatibility)
 type Metrics struct {
-	ActiveConnections int64     `json:"active_connections"`
-	TotalConnections  int64     `json:"total_connections"`
-	BytesSent         int64     `json:"bytes_sent"`
-	BytesReceived     int64     `json:"bytes_received"`
-	ErrorCount        int64     `json:"error_count"`
-	StartTime         time.Time `json:"start_time"`
+	ActiveConnections int64 `json:"active_connections"`
+	TotalConnections  int64 `json:"total_connections"`
+	BytesSent         int64 `json:"bytes_sent"`
+	BytesReceived     int64 `json:"bytes_received"`
+	ErrorCount        int64 `json:"error_count"`
+	ShedDials         int64 `json:"shed_dials"`         // Dials rejected by the gateway resource guard
+	BlockedDials      int64 `json:"blocked_dials"`      // Dials rejected by a blocklist
+	IdentityConflicts int64 `json:"identity_conflicts"` // Client connections refused for claiming a pinned client ID
+	// Connections counted without a record because of sampling or the connection limit, and
+	// client records evicted at the client limit
+	UnrecordedConnections int64     `json:"unrecorded_connections"`
+	EvictedClients        int64     `json:"evicted_clients"`
+	StartTime             time.Time `json:"start_time"`
+	CountersSince         time.Time `json:"counters_since"` // Start of the cumulative counters, kept across restarts by snapshots
 }
 
 // Uptime returns system uptime
@@ -48,6 +56,42 @@ type ClientMetrics struct {
 	ErrorCount        int64     `json:"error_count"`
 	LastSeen          time.Time `json:"last_seen"`
 	IsOnline          bool      `json:"is_online"`
+
+	Version         string           `json:"version,omitempty"`          // Client build version from the handshake
+	Telemetry       *ClientTelemetry `json:"telemetry,omitempty"`        // Latest heartbeat, nil until the client reports one
+	Draining        bool             `json:"draining"`                   // Client announced its shutdown and gets no new connections
+	OfflineActivity *OfflineActivity `json:"offline_activity,omitempty"` // Activity the client spooled during outages
+}
+
+// ClientTelemetry is the host telemetry a client reports with its heartbeat.
+// Values a platform cannot provide are left at zero.
+type ClientTelemetry struct {
+	Version       string    `json:"version"`
+	OS            string    `json:"os"`
+	Arch          string    `json:"arch"`
+	Hostname      string    `json:"hostname"`
+	UptimeSeconds int64     `json:"uptime_seconds"` // Client process uptime
+	NumCPU        int       `json:"num_cpu"`
+	CPUPercent    float64   `json:"cpu_percent"` // Host CPU usage since the previous heartbeat
+	Load1         float64   `json:"load1"`
+	Load5         float64   `json:"load5"`
+	Load15        float64   `json:"load15"`
+	MemTotal      uint64    `json:"mem_total"`
+	MemAvailable  uint64    `json:"mem_available"`
+	DiskPath      string    `json:"disk_path"`
+	DiskTotal     uint64    `json:"disk_total"`
+	DiskFree      uint64    `json:"disk_free"`
+	Goroutines    int       `json:"goroutines"`
+	HeapAlloc     uint64    `json:"heap_alloc"`
+	ReportedAt    time.Time `json:"reported_at"` // Set by the gateway when the heartbeat arrives
+
+	// Load inputs of least-loaded balancing
+	ActiveConnections int      `json:"active_connections"`   // Proxied connections of the client
+	SendRate          int64    `json:"send_rate"`            // Bytes per second sent to the gateway since the previous heartbeat
+	Bandwidth         int64    `json:"bandwidth,omitempty"`  // Uplink capacity in bytes per second, when configured
+	LoadScore         *float64 `json:"load_score,omitempty"` // Busiest of CPU, memory, connection slots and bandwidth, 0 idle to 1 saturated, nil for older clients
+
+	Checks []CheckResult `json:"checks,omitempty"` // Latest result of each synthetic check of the client
 }
 
 // ConnectionMetrics represents connection information (simplified)
@@ -59,6 +103,9 @@ type ConnectionMetrics struct {
 	BytesSent     int64     `json:"bytes_sent"`
 	BytesReceived int64     `json:"bytes_received"`
 	Status        string    `json:"status"`
+	SourceCountry string    `json:"source_country,omitempty"` // Geo-IP country of the proxy user
+	TargetCountry string    `json:"target_country,omitempty"` // Geo-IP country of the dial target
+	Error         string    `json:"error,omitempty"`          // Why a failed connection failed
 }
 
 // MetricsManager manages all metrics with minimal complexity
@@ -67,15 +114,27 @@ type MetricsManager struct {
 	global      *Metrics
 	clients     map[string]*ClientMetrics
 	connections map[string]*ConnectionMetrics
+	targets     *TargetTracker   // Traffic per group and target host, nil disables it
+	users       *UserTracker     // Traffic per proxy user, nil disables it
+	anomaly     *AnomalyDetector // Traffic baselines per client and group, nil when detection is off
+
+	limits     MetricsLimits
+	sampled    uint64                    // Connections seen by sampling
+	unrecorded map[string]unrecordedConn // Active connections without a record
+	failed     []*ConnectionMetrics      // Records of recently failed connections, oldest first
 }
 
 // Global instance
 var globalManager = &MetricsManager{
 	global: &Metrics{
-		StartTime: time.Now(),
+		StartTime:     time.Now(),
+		CountersSince: time.Now(),
 	},
 	clients:     make(map[string]*ClientMetrics),
 	connections: make(map[string]*ConnectionMetrics),
+	unrecorded:  make(map[string]unrecordedConn),
+	targets:     NewTargetTracker(maxTargetStats),
+	users:       NewUserTracker(maxUserStats),
 }
 
 // CreateConnection creates a new connection record and increments counters
@@ -84,22 +143,26 @@ func (m *MetricsManager) CreateConnection(connID, clientID, targetHost string) {
 	defer m.mu.Unlock()
 
 	// Check if connection already exists
-	if _, exists := m.connections[connID]; exists {
+	if _, _, exists := m.connectionTarget(connID); exists {
 		logger.Warn("Attempted to create duplicate connection", "conn_id", connID, "client_id", clientID)
 		return
 	}
 
 	logger.Debug("Creating new connection in metrics", "conn_id", connID, "client_id", clientID, "target_host", targetHost)
 
-	// Create connection record
-	conn := &ConnectionMetrics{
-		ConnectionID: connID,
-		ClientID:     clientID,
-		TargetHost:   targetHost,
-		StartTime:    time.Now(),
-		Status:       "active",
+	// Create connection record, or only account for the connection when it isn't sampled
+	if m.recordConnection() {
+		m.connections[connID] = &ConnectionMetrics{
+			ConnectionID: connID,
+			ClientID:     clientID,
+			TargetHost:   targetHost,
+			StartTime:    time.Now(),
+			Status:       StatusActive,
+		}
+	} else {
+		m.unrecorded[connID] = unrecordedConn{clientID: clientID, targetHost: targetHost}
+		atomic.AddInt64(&m.global.UnrecordedConnections, 1)
 	}
-	m.connections[connID] = conn
 
 	// Increment active connections
 	atomic.AddInt64(&m.global.ActiveConnections, 1)
@@ -107,6 +170,8 @@ func (m *MetricsManager) CreateConnection(connID, clientID, targetHost string) {
 
 	// Increment client's total connections
 	m.incrementClientConnections(clientID)
+	m.targets.Record(m.clients[clientID].GroupID, targetHost, 1, 0, 0)
+	m.anomaly.ObserveTarget(clientID, m.clients[clientID].GroupID, targetHost)
 }
 
 // UpdateConnectionBytes updates byte counters for existing connection
@@ -131,14 +196,18 @@ func (m *MetricsManager) UpdateConnectionBytes(connID, clientID string, bytesSen
 	}
 
 	// Update connection-specific bytes if connection exists
-	conn, exists := m.connections[connID]
-	if exists {
+	if conn, recorded := m.connections[connID]; recorded {
 		if bytesSent > 0 {
 			atomic.AddInt64(&conn.BytesSent, bytesSent)
 		}
 		if bytesReceived > 0 {
 			atomic.AddInt64(&conn.BytesReceived, bytesReceived)
 		}
+	}
+	if _, targetHost, exists := m.connectionTarget(connID); exists {
+		if client, ok := m.clients[clientID]; ok {
+			m.targets.Record(client.GroupID, targetHost, 0, bytesSent, bytesReceived)
+		}
 		logger.Debug("Updated connection metrics", "conn_id", connID, "client_id", clientID, "bytes_sent", bytesSent, "bytes_received", bytesReceived)
 	} else {
 		// Log when updating metrics for non-existent connection (this is expected in distributed setup)
@@ -146,14 +215,26 @@ func (m *MetricsManager) UpdateConnectionBytes(connID, clientID string, bytesSen
 	}
 }
 
+// SetConnectionGeo attaches Geo-IP countries to an existing connection
+func (m *MetricsManager) SetConnectionGeo(connID, sourceCountry, targetCountry string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if conn, exists := m.connections[connID]; exists {
+		conn.SourceCountry = sourceCountry
+		conn.TargetCountry = targetCountry
+	}
+}
+
 // CloseConnection removes connection and updates counters
 func (m *MetricsManager) CloseConnection(connID string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if conn, exists := m.connections[connID]; exists {
-		logger.Debug("Closing connection in metrics", "conn_id", connID, "client_id", conn.ClientID, "target_host", conn.TargetHost)
+	if clientID, targetHost, exists := m.connectionTarget(connID); exists {
+		logger.Debug("Closing connection in metrics", "conn_id", connID, "client_id", clientID, "target_host", targetHost)
 		delete(m.connections, connID)
+		delete(m.unrecorded, connID)
 		atomic.AddInt64(&m.global.ActiveConnections, -1)
 	} else {
 		logger.Debug("Attempted to close non-existent connection", "conn_id", connID)
@@ -164,14 +245,12 @@ func (m *MetricsManager) CloseConnection(connID string) {
 func (m *MetricsManager) updateClientStats(clientID, groupID string, bytesSent, bytesReceived int64, isError bool) {
 	client, exists := m.clients[clientID]
 	if !exists {
-		client = &ClientMetrics{
-			ClientID: clientID,
-			GroupID:  groupID,
-			IsOnline: true,
-		}
-		m.clients[clientID] = client
+		client = m.newClient(clientID)
 	}
 
+	if groupID != "" {
+		client.GroupID = groupID
+	}
 	client.LastSeen = time.Now()
 	client.IsOnline = true
 
@@ -191,11 +270,7 @@ func (m *MetricsManager) updateClientStats(clientID, groupID string, bytesSent,
 func (m *MetricsManager) incrementClientConnections(clientID string) {
 	client, exists := m.clients[clientID]
 	if !exists {
-		client = &ClientMetrics{
-			ClientID: clientID,
-			IsOnline: true,
-		}
-		m.clients[clientID] = client
+		client = m.newClient(clientID)
 	}
 
 	atomic.AddInt64(&client.TotalConnections, 1)
@@ -210,6 +285,33 @@ func (m *MetricsManager) UpdateClientMetrics(clientID, groupID string, bytesSent
 	m.updateClientStats(clientID, groupID, bytesSent, bytesReceived, isError)
 }
 
+// UpdateClientTelemetry stores the latest telemetry of a client, a heartbeat also marks the client as seen
+func (m *MetricsManager) UpdateClientTelemetry(clientID, groupID string, telemetry *ClientTelemetry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateClientStats(clientID, groupID, 0, 0, false)
+	// Telemetry is replaced, never modified, so copies handed out by GetAllClientStats stay consistent
+	m.clients[clientID].Telemetry = telemetry
+}
+
+// SetClientVersion records the build version a client reported in its handshake
+func (m *MetricsManager) SetClientVersion(clientID, version string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if client, exists := m.clients[clientID]; exists {
+		client.Version = version
+	}
+}
+
+// SetClientDraining records that a client announced its shutdown, cleared when it goes offline
+func (m *MetricsManager) SetClientDraining(clientID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if client, exists := m.clients[clientID]; exists {
+		client.Draining = true
+	}
+}
+
 // GetClientStats returns client statistics
 func (m *MetricsManager) GetClientStats(clientID string) *ClientMetrics {
 	m.mu.RLock()
@@ -224,18 +326,19 @@ func (m *MetricsManager) GetAllClientStats() map[string]*ClientMetrics {
 
 	result := make(map[string]*ClientMetrics)
 
-	for k, v := range m.clients {
-		// Update active connections count from actual connections
-		activeCount := int64(0)
-		for _, conn := range m.connections {
-			if conn.ClientID == k {
-				activeCount++
-			}
-		}
+	// Active connections per client from actual connections, with or without a record
+	activeCounts := make(map[string]int64)
+	for _, conn := range m.connections {
+		activeCounts[conn.ClientID]++
+	}
+	for _, conn := range m.unrecorded {
+		activeCounts[conn.clientID]++
+	}
 
+	for k, v := range m.clients {
 		// Create copy with updated active connections
 		clientCopy := *v
-		clientCopy.ActiveConnections = activeCount
+		clientCopy.ActiveConnections = activeCounts[k]
 
 		// Check if client should be marked as offline based on inactivity
 		// 🔧 IMPROVED: Mark as offline if no activity for more than 2 minutes (was 5 minutes)
@@ -265,12 +368,18 @@ func (m *MetricsManager) cleanupOfflineClientConnections(clientID string) {
 			connectionsToRemove = append(connectionsToRemove, connID)
 		}
 	}
+	for connID, conn := range m.unrecorded {
+		if conn.clientID == clientID {
+			connectionsToRemove = append(connectionsToRemove, connID)
+		}
+	}
 
 	// Remove stale connections and update global active count
 	for _, connID := range connectionsToRemove {
 		logger.Warn("Cleaning up stale connection from offline client",
 			"client_id", clientID, "conn_id", connID)
 		delete(m.connections, connID)
+		delete(m.unrecorded, connID)
 		atomic.AddInt64(&m.global.ActiveConnections, -1)
 	}
 
@@ -299,6 +408,7 @@ func (m *MetricsManager) MarkClientOffline(clientID string) {
 
 	if client, exists := m.clients[clientID]; exists {
 		client.IsOnline = false
+		client.Draining = false
 		client.LastSeen = time.Now()
 		logger.Debug("Marked client offline", "client_id", clientID)
 	}
@@ -348,7 +458,7 @@ func UpdateConnectionMetrics(connID, clientID, targetHost string, bytesSent, byt
 	} else {
 		// For backward compatibility: create connection if it doesn't exist, then update bytes
 		globalManager.mu.RLock()
-		_, exists := globalManager.connections[connID]
+		_, _, exists := globalManager.connectionTarget(connID)
 		globalManager.mu.RUnlock()
 
 		if !exists {
@@ -438,6 +548,7 @@ func StartCleanupProcess() {
 			case <-ticker.C:
 				// 🔧 More aggressive cleanup: offline timeout reduced to 2 minutes, cleanup after 3 minutes
 				globalManager.Cleanup(3 * time.Minute) // Remove clients offline for more than 3 minutes (was 5 minutes)
+				globalLatency.Cleanup(latencyIdleTimeout)
 
 				// 🔧 Also validate and fix connection count inconsistencies periodically
 				globalCount, actualCount, isConsistent := globalManager.ValidateConnectionCounts()
@@ -487,6 +598,16 @@ func StopCleanupProcess() {
 	cleanupWg.Wait()
 }
 
+// IncrementShedDials counts a dial rejected because a resource limit was exceeded
+func IncrementShedDials() {
+	atomic.AddInt64(&globalManager.global.ShedDials, 1)
+}
+
+// IncrementIdentityConflicts counts a client connection refused for claiming a pinned client ID
+func IncrementIdentityConflicts() {
+	atomic.AddInt64(&globalManager.global.IdentityConflicts, 1)
+}
+
 // Legacy compatibility functions (for tests only)
 
 // IncrementActiveConnections increments active connection count (legacy compatibility - tests only)
@@ -537,7 +658,7 @@ func (m *MetricsManager) ValidateConnectionCounts() (globalCount, actualCount in
 	defer m.mu.RUnlock()
 
 	globalCount = atomic.LoadInt64(&m.global.ActiveConnections)
-	actualCount = int64(len(m.connections))
+	actualCount = int64(len(m.connections) + len(m.unrecorded))
 	isConsistent = globalCount == actualCount
 
 	if !isConsistent {
@@ -556,7 +677,7 @@ func (m *MetricsManager) FixConnectionCountInconsistency() (oldCount, newCount i
 	defer m.mu.Unlock()
 
 	oldCount = atomic.LoadInt64(&m.global.ActiveConnections)
-	newCount = int64(len(m.connections))
+	newCount = int64(len(m.connections) + len(m.unrecorded))
 
 	if oldCount != newCount {
 		logger.Warn("Fixing connection count inconsistency",
@@ -599,3 +720,23 @@ func UpdateConnectionBytes(connID, clientID string, bytesSent, bytesReceived int
 func CloseConnection(connID string) {
 	globalManager.CloseConnection(connID)
 }
+
+// SetConnectionGeo attaches Geo-IP countries to a connection (public API)
+func SetConnectionGeo(connID, sourceCountry, targetCountry string) {
+	globalManager.SetConnectionGeo(connID, sourceCountry, targetCountry)
+}
+
+// UpdateClientTelemetry stores the latest heartbeat telemetry of a client (public API)
+func UpdateClientTelemetry(clientID, groupID string, telemetry *ClientTelemetry) {
+	globalManager.UpdateClientTelemetry(clientID, groupID, telemetry)
+}
+
+// SetClientVersion records the build version a client reported in its handshake (public API)
+func SetClientVersion(clientID, version string) {
+	globalManager.SetClientVersion(clientID, version)
+}
+
+// SetClientDraining records that a client announced its shutdown (public API)
+func SetClientDraining(clientID string) {
+	globalManager.SetClientDraining(clientID)
+}
@@ -2,6 +2,7 @@ package monitoring
 
 import (
 	"testing"
+	"time"
 )
 
 // TestDataConsistencyFix tests that the metrics fix ensures data consistency
@@ -9,6 +10,7 @@ func TestDataConsistencyFix(t *testing.T) {
 	// Reset global manager state
 	globalManager.mu.Lock()
 	globalManager.connections = make(map[string]*ConnectionMetrics)
+	globalManager.unrecorded = make(map[string]unrecordedConn)
 	globalManager.clients = make(map[string]*ClientMetrics)
 	globalManager.global.ActiveConnections = 0
 	globalManager.global.TotalConnections = 0
@@ -54,3 +56,24 @@ func TestDataConsistencyFix(t *testing.T) {
 
 	t.Log("✅ Data consistency fix verified successfully")
 }
+
+func TestUpdateClientTelemetry(t *testing.T) {
+	m := &MetricsManager{
+		global:      &Metrics{StartTime: time.Now()},
+		connections: make(map[string]*ConnectionMetrics),
+		clients:     make(map[string]*ClientMetrics),
+	}
+
+	m.UpdateClientTelemetry("client-1", "group-1", &ClientTelemetry{Version: "v1.0.0", CPUPercent: 42})
+
+	stats := m.GetAllClientStats()["client-1"]
+	if stats == nil || stats.Telemetry == nil {
+		t.Fatal("Expected telemetry to be stored for client-1")
+	}
+	if stats.Telemetry.Version != "v1.0.0" || stats.Telemetry.CPUPercent != 42 {
+		t.Errorf("Unexpected telemetry: %+v", stats.Telemetry)
+	}
+	if !stats.IsOnline || stats.LastSeen.IsZero() {
+		t.Error("Expected heartbeat to mark the client as seen")
+	}
+}
@@ -0,0 +1,130 @@
+package monitoring
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// WritePrometheus writes global counters and latency histograms in the Prometheus text format
+func WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	global := GetMetrics()
+
+	writeMetric(bw, "anyproxy_active_connections", "gauge", "Currently active proxied connections", atomic.LoadInt64(&global.ActiveConnections))
+	writeMetric(bw, "anyproxy_connections_total", "counter", "Total proxied connections", atomic.LoadInt64(&global.TotalConnections))
+	writeMetric(bw, "anyproxy_bytes_sent_total", "counter", "Total bytes sent to clients", atomic.LoadInt64(&global.BytesSent))
+	writeMetric(bw, "anyproxy_bytes_received_total", "counter", "Total bytes received from clients", atomic.LoadInt64(&global.BytesReceived))
+	writeMetric(bw, "anyproxy_errors_total", "counter", "Total connection errors", atomic.LoadInt64(&global.ErrorCount))
+	writeMetric(bw, "anyproxy_shed_dials_total", "counter", "Dials rejected by the resource guard", atomic.LoadInt64(&global.ShedDials))
+	writeMetric(bw, "anyproxy_client_identity_conflicts_total", "counter", "Client connections refused for claiming a pinned client ID", atomic.LoadInt64(&global.IdentityConflicts))
+	writeMetric(bw, "anyproxy_unrecorded_connections_total", "counter", "Connections counted without a record because of sampling or the connection limit", atomic.LoadInt64(&global.UnrecordedConnections))
+	writeMetric(bw, "anyproxy_evicted_clients_total", "counter", "Client records evicted at the client limit", atomic.LoadInt64(&global.EvictedClients))
+	writeMetric(bw, "anyproxy_anomaly_alerts_total", "counter", "Traffic anomalies detected for clients and groups", GetAnomalyAlerts())
+
+	if blocklists := GetBlocklistStats(); len(blocklists) > 0 {
+		fmt.Fprintf(bw, "# HELP anyproxy_blocked_dials_total Dials rejected by a blocklist\n# TYPE anyproxy_blocked_dials_total counter\n")
+		for _, list := range blocklists {
+			fmt.Fprintf(bw, "anyproxy_blocked_dials_total{list=\"%s\"} %d\n", escapeLabelValue(list.Name), list.BlockedDials)
+		}
+		fmt.Fprintf(bw, "# HELP anyproxy_blocklist_entries Entries of each loaded blocklist\n# TYPE anyproxy_blocklist_entries gauge\n")
+		for _, list := range blocklists {
+			fmt.Fprintf(bw, "anyproxy_blocklist_entries{list=\"%s\"} %d\n", escapeLabelValue(list.Name), list.Entries)
+		}
+	}
+
+	if listeners := GetListenerStats(); len(listeners) > 0 {
+		fmt.Fprintf(bw, "# HELP anyproxy_listener_rejected_connections_total Connections closed by the limits of a proxy listener\n# TYPE anyproxy_listener_rejected_connections_total counter\n")
+		for _, listener := range listeners {
+			fmt.Fprintf(bw, "anyproxy_listener_rejected_connections_total{listener=\"%s\"} %d\n", escapeLabelValue(listener.Listener), listener.RejectedConnections)
+		}
+		fmt.Fprintf(bw, "# HELP anyproxy_listener_rejected_tls_handshakes_total TLS handshakes refused by client fingerprint\n# TYPE anyproxy_listener_rejected_tls_handshakes_total counter\n")
+		for _, listener := range listeners {
+			fmt.Fprintf(bw, "anyproxy_listener_rejected_tls_handshakes_total{listener=\"%s\"} %d\n", escapeLabelValue(listener.Listener), listener.RejectedTLSHandshakes)
+		}
+	}
+
+	if transports := GetTransportStats(); len(transports) > 0 {
+		fmt.Fprintf(bw, "# HELP anyproxy_transport_messages_total Messages carried by each transport type\n# TYPE anyproxy_transport_messages_total counter\n")
+		for _, t := range transports {
+			fmt.Fprintf(bw, "anyproxy_transport_messages_total{transport=\"%s\",direction=\"sent\"} %d\n", escapeLabelValue(t.Transport), t.MessagesSent)
+			fmt.Fprintf(bw, "anyproxy_transport_messages_total{transport=\"%s\",direction=\"received\"} %d\n", escapeLabelValue(t.Transport), t.MessagesReceived)
+		}
+		fmt.Fprintf(bw, "# HELP anyproxy_transport_bytes_total Message payload and framing bytes of each transport type\n# TYPE anyproxy_transport_bytes_total counter\n")
+		for _, t := range transports {
+			name := escapeLabelValue(t.Transport)
+			fmt.Fprintf(bw, "anyproxy_transport_bytes_total{transport=\"%s\",direction=\"sent\",kind=\"payload\"} %d\n", name, t.PayloadBytesSent)
+			fmt.Fprintf(bw, "anyproxy_transport_bytes_total{transport=\"%s\",direction=\"sent\",kind=\"framing\"} %d\n", name, t.FramingBytesSent)
+			fmt.Fprintf(bw, "anyproxy_transport_bytes_total{transport=\"%s\",direction=\"received\",kind=\"payload\"} %d\n", name, t.PayloadBytesReceived)
+			fmt.Fprintf(bw, "anyproxy_transport_bytes_total{transport=\"%s\",direction=\"received\",kind=\"framing\"} %d\n", name, t.FramingBytesReceived)
+		}
+	}
+
+	if dns := GetDNSCacheStats(); dns != nil {
+		fmt.Fprintf(bw, "# HELP anyproxy_dns_cache_lookups_total Lookups of the gateway DNS cache by result\n# TYPE anyproxy_dns_cache_lookups_total counter\n")
+		fmt.Fprintf(bw, "anyproxy_dns_cache_lookups_total{result=\"hit\"} %d\n", dns.Hits)
+		fmt.Fprintf(bw, "anyproxy_dns_cache_lookups_total{result=\"negative_hit\"} %d\n", dns.NegativeHits)
+		fmt.Fprintf(bw, "anyproxy_dns_cache_lookups_total{result=\"miss\"} %d\n", dns.Misses)
+		writeMetric(bw, "anyproxy_dns_cache_failures_total", "counter", "DNS cache misses the servers failed or had no addresses for", dns.Failures)
+		writeMetric(bw, "anyproxy_dns_cache_entries", "gauge", "Host names in the gateway DNS cache", dns.Entries)
+	}
+
+	if checks := GroupChecks(GetAllClientMetrics()); len(checks) > 0 {
+		fmt.Fprintf(bw, "# HELP anyproxy_check_clients Online clients of a group by the result of their latest synthetic check\n# TYPE anyproxy_check_clients gauge\n")
+		for _, check := range checks {
+			labels := fmt.Sprintf("group_id=\"%s\",check=\"%s\",target=\"%s\"", escapeLabelValue(check.GroupID), escapeLabelValue(check.Name), escapeLabelValue(check.Target))
+			fmt.Fprintf(bw, "anyproxy_check_clients{%s,result=\"passing\"} %d\n", labels, check.Passing)
+			fmt.Fprintf(bw, "anyproxy_check_clients{%s,result=\"failing\"} %d\n", labels, check.Failing)
+		}
+	}
+
+	latency := GetLatencySnapshot()
+	writeHistograms(bw, "anyproxy_client_dial_duration_seconds", "Dial latency per client", "client_id", latency.Clients, func(s LatencyStatsSnapshot) HistogramSnapshot { return s.Dial })
+	writeHistograms(bw, "anyproxy_client_ttfb_seconds", "Time to first byte per client", "client_id", latency.Clients, func(s LatencyStatsSnapshot) HistogramSnapshot { return s.TTFB })
+	writeHistograms(bw, "anyproxy_target_dial_duration_seconds", "Dial latency per target host", "target_host", latency.Targets, func(s LatencyStatsSnapshot) HistogramSnapshot { return s.Dial })
+	writeHistograms(bw, "anyproxy_target_ttfb_seconds", "Time to first byte per target host", "target_host", latency.Targets, func(s LatencyStatsSnapshot) HistogramSnapshot { return s.TTFB })
+
+	return bw.Flush()
+}
+
+// writeMetric writes a single unlabeled sample
+func writeMetric(w *bufio.Writer, name, metricType, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
+
+// writeHistograms writes one histogram per label value, sorted for stable output
+func writeHistograms(w *bufio.Writer, name, help, label string, stats map[string]LatencyStatsSnapshot, pick func(LatencyStatsSnapshot) HistogramSnapshot) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := pick(stats[key])
+		if hist.Count == 0 {
+			continue
+		}
+		labelValue := escapeLabelValue(key)
+		for _, bucket := range hist.Buckets {
+			le := "+Inf"
+			if bucket.LE >= 0 {
+				le = strconv.FormatFloat(bucket.LE/1000, 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"%s\"} %d\n", name, label, labelValue, le, bucket.Count)
+		}
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %s\n", name, label, labelValue, strconv.FormatFloat(hist.SumMs/1000, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", name, label, labelValue, hist.Count)
+	}
+}
+
+// escapeLabelValue escapes a Prometheus label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,68 @@
+package monitoring
+
+import "time"
+
+// ClientReport is activity a client recorded while it was disconnected from the gateway,
+// uploaded after it reconnects
+type ClientReport struct {
+	ClientID string             `json:"client_id"` // ID the client had when it recorded the activity
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	Records  []ConnectionRecord `json:"records,omitempty"`
+	Delta    *MetricsDelta      `json:"delta,omitempty"`
+}
+
+// ConnectionRecord is the audit record of a connection ended by a tunnel outage
+type ConnectionRecord struct {
+	ConnectionID  string    `json:"connection_id"`
+	TargetHost    string    `json:"target_host"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Reason        string    `json:"reason"`
+}
+
+// MetricsDelta is the change of a client's counters over a period
+type MetricsDelta struct {
+	Connections   int64 `json:"connections"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+	Errors        int64 `json:"errors"`
+}
+
+// OfflineActivity totals the reports a client uploaded after outages
+type OfflineActivity struct {
+	Reports    int64        `json:"reports"`
+	Records    int64        `json:"records"`
+	Delta      MetricsDelta `json:"delta"`
+	LastReport time.Time    `json:"last_report"`
+}
+
+// AddClientReport adds an uploaded report to the offline activity of a client
+func (m *MetricsManager) AddClientReport(clientID, groupID string, report *ClientReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateClientStats(clientID, groupID, 0, 0, false)
+
+	// Activity is replaced, never modified, so copies handed out by GetAllClientStats stay consistent
+	activity := &OfflineActivity{}
+	if previous := m.clients[clientID].OfflineActivity; previous != nil {
+		*activity = *previous
+	}
+	activity.Reports++
+	activity.Records += int64(len(report.Records))
+	if report.Delta != nil {
+		activity.Delta.Connections += report.Delta.Connections
+		activity.Delta.BytesSent += report.Delta.BytesSent
+		activity.Delta.BytesReceived += report.Delta.BytesReceived
+		activity.Delta.Errors += report.Delta.Errors
+	}
+	activity.LastReport = time.Now()
+	m.clients[clientID].OfflineActivity = activity
+}
+
+// AddClientReport adds an uploaded report to the offline activity of a client (public API)
+func AddClientReport(clientID, groupID string, report *ClientReport) {
+	globalManager.AddClientReport(clientID, groupID, report)
+}
@@ -0,0 +1,17 @@
+package monitoring
+
+import "testing"
+
+func TestAddClientReport(t *testing.T) {
+	m := newTestManager()
+	m.AddClientReport("client-1", "group-1", &ClientReport{
+		Records: []ConnectionRecord{{ConnectionID: "conn-1"}, {ConnectionID: "conn-2"}},
+		Delta:   &MetricsDelta{Errors: 2},
+	})
+	m.AddClientReport("client-1", "group-1", &ClientReport{Delta: &MetricsDelta{Connections: 1, Errors: 1}})
+
+	activity := m.GetClientStats("client-1").OfflineActivity
+	if activity == nil || activity.Reports != 2 || activity.Records != 2 || activity.Delta.Connections != 1 || activity.Delta.Errors != 3 {
+		t.Errorf("Unexpected offline activity: %+v", activity)
+	}
+}
@@ -0,0 +1,268 @@
+package monitoring
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// DefaultSnapshotInterval is how often counters are snapshotted when no interval is configured
+const DefaultSnapshotInterval = time.Minute
+
+// Snapshot holds the cumulative counters that survive a gateway restart. Active connections
+// and online state are not included, they are rebuilt as clients reconnect.
+type Snapshot struct {
+	SavedAt       time.Time                   `json:"saved_at"`
+	CountersSince time.Time                   `json:"counters_since"`
+	Global        SnapshotCounters            `json:"global"`
+	Clients       map[string]SnapshotCounters `json:"clients"`
+}
+
+// SnapshotCounters are the persisted counters of the gateway or of a client
+type SnapshotCounters struct {
+	GroupID           string `json:"group_id,omitempty"`
+	TotalConnections  int64  `json:"total_connections"`
+	BytesSent         int64  `json:"bytes_sent"`
+	BytesReceived     int64  `json:"bytes_received"`
+	ErrorCount        int64  `json:"error_count"`
+	ShedDials         int64  `json:"shed_dials,omitempty"`
+	BlockedDials      int64  `json:"blocked_dials,omitempty"`
+	IdentityConflicts int64  `json:"identity_conflicts,omitempty"`
+}
+
+// Snapshot returns the current cumulative counters
+func (m *MetricsManager) Snapshot() *Snapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s := &Snapshot{
+		SavedAt:       time.Now(),
+		CountersSince: m.global.CountersSince,
+		Global: SnapshotCounters{
+			TotalConnections:  atomic.LoadInt64(&m.global.TotalConnections),
+			BytesSent:         atomic.LoadInt64(&m.global.BytesSent),
+			BytesReceived:     atomic.LoadInt64(&m.global.BytesReceived),
+			ErrorCount:        atomic.LoadInt64(&m.global.ErrorCount),
+			ShedDials:         atomic.LoadInt64(&m.global.ShedDials),
+			BlockedDials:      atomic.LoadInt64(&m.global.BlockedDials),
+			IdentityConflicts: atomic.LoadInt64(&m.global.IdentityConflicts),
+		},
+		Clients: make(map[string]SnapshotCounters, len(m.clients)),
+	}
+	for clientID, client := range m.clients {
+		s.Clients[clientID] = SnapshotCounters{
+			GroupID:          client.GroupID,
+			TotalConnections: atomic.LoadInt64(&client.TotalConnections),
+			BytesSent:        atomic.LoadInt64(&client.BytesSent),
+			BytesReceived:    atomic.LoadInt64(&client.BytesReceived),
+			ErrorCount:       atomic.LoadInt64(&client.ErrorCount),
+		}
+	}
+	return s
+}
+
+// Restore adds the counters of a snapshot to the current ones. Restored clients are offline
+// until they reconnect and are dropped by Cleanup like any other offline client.
+func (m *MetricsManager) Restore(s *Snapshot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !s.CountersSince.IsZero() {
+		m.global.CountersSince = s.CountersSince
+	}
+	atomic.AddInt64(&m.global.TotalConnections, s.Global.TotalConnections)
+	atomic.AddInt64(&m.global.BytesSent, s.Global.BytesSent)
+	atomic.AddInt64(&m.global.BytesReceived, s.Global.BytesReceived)
+	atomic.AddInt64(&m.global.ErrorCount, s.Global.ErrorCount)
+	atomic.AddInt64(&m.global.ShedDials, s.Global.ShedDials)
+	atomic.AddInt64(&m.global.BlockedDials, s.Global.BlockedDials)
+	atomic.AddInt64(&m.global.IdentityConflicts, s.Global.IdentityConflicts)
+
+	for clientID, counters := range s.Clients {
+		client, exists := m.clients[clientID]
+		if !exists {
+			client = &ClientMetrics{
+				ClientID: clientID,
+				GroupID:  counters.GroupID,
+				LastSeen: time.Now(),
+			}
+			m.clients[clientID] = client
+		}
+		atomic.AddInt64(&client.TotalConnections, counters.TotalConnections)
+		atomic.AddInt64(&client.BytesSent, counters.BytesSent)
+		atomic.AddInt64(&client.BytesReceived, counters.BytesReceived)
+		atomic.AddInt64(&client.ErrorCount, counters.ErrorCount)
+	}
+}
+
+// ResetCounters zeroes the cumulative counters, target and user stats, active connections and online
+// clients are kept
+func (m *MetricsManager) ResetCounters() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.global.CountersSince = time.Now()
+	m.targets.Reset()
+	m.users.Reset()
+	atomic.StoreInt64(&m.global.TotalConnections, 0)
+	atomic.StoreInt64(&m.global.BytesSent, 0)
+	atomic.StoreInt64(&m.global.BytesReceived, 0)
+	atomic.StoreInt64(&m.global.ErrorCount, 0)
+	atomic.StoreInt64(&m.global.ShedDials, 0)
+	atomic.StoreInt64(&m.global.BlockedDials, 0)
+	atomic.StoreInt64(&m.global.IdentityConflicts, 0)
+	atomic.StoreInt64(&m.global.UnrecordedConnections, 0)
+	atomic.StoreInt64(&m.global.EvictedClients, 0)
+
+	for clientID, client := range m.clients {
+		if !client.IsOnline {
+			delete(m.clients, clientID)
+			continue
+		}
+		atomic.StoreInt64(&client.TotalConnections, 0)
+		atomic.StoreInt64(&client.BytesSent, 0)
+		atomic.StoreInt64(&client.BytesReceived, 0)
+		atomic.StoreInt64(&client.ErrorCount, 0)
+	}
+}
+
+// SaveSnapshot writes the counters of m to path atomically
+func (m *MetricsManager) SaveSnapshot(path string) error {
+	data, err := json.MarshalIndent(m.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// LoadSnapshot restores the counters saved at path, a missing file is not an error
+func (m *MetricsManager) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid metrics snapshot %s: %v", path, err)
+	}
+	m.Restore(&s)
+	logger.Info("Restored metrics snapshot", "path", path, "saved_at", s.SavedAt, "clients", len(s.Clients))
+	return nil
+}
+
+// Periodic snapshots of the global manager
+var (
+	snapshotMu     sync.Mutex
+	snapshotPath   string
+	snapshotCancel context.CancelFunc
+	snapshotWg     sync.WaitGroup
+)
+
+// StartSnapshots restores the counters saved at path and snapshots them every interval
+// (0 = DefaultSnapshotInterval) until StopSnapshots
+func StartSnapshots(path string, interval time.Duration) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	if snapshotCancel != nil {
+		return fmt.Errorf("metrics snapshots already started")
+	}
+	if err := globalManager.LoadSnapshot(path); err != nil {
+		return err
+	}
+	startSnapshotsLocked(path, interval)
+	return nil
+}
+
+// ResumeSnapshots snapshots the counters every interval again after StopSnapshots, without
+// restoring the saved counters this process already holds
+func ResumeSnapshots(path string, interval time.Duration) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	if snapshotCancel != nil {
+		return fmt.Errorf("metrics snapshots already started")
+	}
+	startSnapshotsLocked(path, interval)
+	return nil
+}
+
+// startSnapshotsLocked starts the periodic snapshots, snapshotMu must be held
+func startSnapshotsLocked(path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	snapshotPath = path
+	snapshotCancel = cancel
+
+	snapshotWg.Add(1)
+	go func() {
+		defer snapshotWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// Serialized with ResetCounters, both write the same file
+				snapshotMu.Lock()
+				err := globalManager.SaveSnapshot(path)
+				snapshotMu.Unlock()
+				if err != nil {
+					logger.Warn("Failed to save metrics snapshot", "path", path, "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// StopSnapshots stops the periodic snapshots and saves a final one
+func StopSnapshots() error {
+	snapshotMu.Lock()
+	if snapshotCancel == nil {
+		snapshotMu.Unlock()
+		return nil
+	}
+	snapshotCancel()
+	snapshotCancel = nil
+	path := snapshotPath
+	snapshotPath = ""
+	snapshotMu.Unlock()
+
+	snapshotWg.Wait()
+	return globalManager.SaveSnapshot(path)
+}
+
+// ResetCounters zeroes the cumulative counters and, when snapshots are running, saves the
+// reset immediately so a restart doesn't bring the old totals back
+func ResetCounters() error {
+	globalManager.ResetCounters()
+	logger.Info("Metrics counters reset")
+
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if snapshotPath == "" {
+		return nil
+	}
+	return globalManager.SaveSnapshot(snapshotPath)
+}
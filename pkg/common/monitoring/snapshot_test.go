@@ -0,0 +1,81 @@
+package monitoring
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestManager() *MetricsManager {
+	return &MetricsManager{
+		global:      &Metrics{StartTime: time.Now(), CountersSince: time.Now()},
+		connections: make(map[string]*ConnectionMetrics),
+		unrecorded:  make(map[string]unrecordedConn),
+		clients:     make(map[string]*ClientMetrics),
+	}
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	before := newTestManager()
+	before.CreateConnection("conn-1", "client-1", "example.com:443")
+	before.UpdateConnectionBytes("conn-1", "client-1", 100, 200)
+	before.UpdateClientMetrics("client-1", "group-1", 0, 0, true)
+	since := before.global.CountersSince
+	if err := before.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted gateway continues the totals, without the active connection
+	after := newTestManager()
+	if err := after.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	after.CreateConnection("conn-2", "client-1", "example.com:443")
+	global := after.global
+	if global.TotalConnections != 2 || global.BytesSent != 100 || global.BytesReceived != 200 || global.ErrorCount != 1 {
+		t.Errorf("Unexpected restored global counters: %+v", global)
+	}
+	if global.ActiveConnections != 1 || !global.CountersSince.Equal(since) {
+		t.Errorf("Unexpected active connections %d or counters start %v", global.ActiveConnections, global.CountersSince)
+	}
+	client := after.GetClientStats("client-1")
+	if client == nil || client.TotalConnections != 2 || client.BytesSent != 100 || client.ErrorCount != 1 {
+		t.Errorf("Unexpected restored client counters: %+v", client)
+	}
+
+	if err := newTestManager().LoadSnapshot(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("Expected a missing snapshot to be ignored, got %v", err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestManager().LoadSnapshot(path); err == nil {
+		t.Error("Expected an error for a corrupt snapshot")
+	}
+}
+
+func TestMetricsResetCounters(t *testing.T) {
+	m := newTestManager()
+	m.CreateConnection("conn-1", "online", "example.com:443")
+	m.UpdateConnectionBytes("conn-1", "online", 100, 200)
+	m.UpdateClientMetrics("offline", "group-1", 10, 10, false)
+	m.MarkClientOffline("offline")
+	started := m.global.CountersSince
+
+	m.ResetCounters()
+
+	if m.global.TotalConnections != 0 || m.global.BytesSent != 0 || m.global.BytesReceived != 0 {
+		t.Errorf("Expected global counters to be reset: %+v", m.global)
+	}
+	if m.global.ActiveConnections != 1 || !m.global.CountersSince.After(started) {
+		t.Errorf("Expected active connections to be kept and the counters start to move: %+v", m.global)
+	}
+	if client := m.GetClientStats("online"); client == nil || client.BytesSent != 0 || client.TotalConnections != 0 {
+		t.Errorf("Expected the online client to be kept with reset counters: %+v", client)
+	}
+	if m.GetClientStats("offline") != nil {
+		t.Error("Expected offline clients to be dropped")
+	}
+}
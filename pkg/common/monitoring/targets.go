@@ -0,0 +1,200 @@
+package monitoring
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Target statistics limits
+const (
+	// maxTargetStats caps the tracked (group, host) pairs, the least recently used pair is evicted
+	maxTargetStats = 10000
+	// DefaultTopTargets is the number of destinations returned when no limit is given
+	DefaultTopTargets = 10
+)
+
+// Top target orderings
+const (
+	TargetSortBytes       = "bytes"
+	TargetSortConnections = "connections"
+)
+
+// TargetStats holds the traffic of a group to a target host
+type TargetStats struct {
+	Host          string    `json:"host"`
+	Connections   int64     `json:"connections"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+// targetKey identifies the stats of a target host per group
+type targetKey struct {
+	groupID string
+	host    string
+}
+
+// targetEntry is an LRU list element value
+type targetEntry struct {
+	key   targetKey
+	stats TargetStats
+}
+
+// TargetTracker aggregates connections and bytes per group and target host. A nil tracker
+// records nothing.
+type TargetTracker struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[targetKey]*list.Element
+	lru     *list.List // Most recently used first
+	evicted int64
+}
+
+// NewTargetTracker creates a tracker keeping at most limit (group, host) pairs
+func NewTargetTracker(limit int) *TargetTracker {
+	if limit <= 0 {
+		limit = maxTargetStats
+	}
+	return &TargetTracker{
+		limit:   limit,
+		entries: make(map[targetKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Record adds a connection and bytes to the stats of address' host in groupID
+func (t *TargetTracker) Record(groupID, address string, connections, bytesSent, bytesReceived int64) {
+	if t == nil || address == "" {
+		return
+	}
+	key := targetKey{groupID: groupID, host: targetHostKey(address)}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, ok := t.entries[key]
+	if ok {
+		t.lru.MoveToFront(elem)
+	} else {
+		if t.lru.Len() >= t.limit {
+			oldest := t.lru.Back()
+			delete(t.entries, oldest.Value.(*targetEntry).key)
+			t.lru.Remove(oldest)
+			t.evicted++
+		}
+		elem = t.lru.PushFront(&targetEntry{key: key, stats: TargetStats{Host: key.host}})
+		t.entries[key] = elem
+	}
+
+	stats := &elem.Value.(*targetEntry).stats
+	stats.Connections += connections
+	stats.BytesSent += bytesSent
+	stats.BytesReceived += bytesReceived
+	stats.LastSeen = time.Now()
+}
+
+// Top returns the n busiest target hosts of groupID, of all groups combined when groupID
+// is empty, ordered by total bytes or by connections
+func (t *TargetTracker) Top(groupID string, n int, sortBy string) []TargetStats {
+	if groupID == "" {
+		return t.top(nil, n, sortBy)
+	}
+	return t.TopOf([]string{groupID}, n, sortBy)
+}
+
+// TopOf returns the n busiest target hosts of the given groups combined
+func (t *TargetTracker) TopOf(groupIDs []string, n int, sortBy string) []TargetStats {
+	groups := make(map[string]bool, len(groupIDs))
+	for _, groupID := range groupIDs {
+		groups[groupID] = true
+	}
+	return t.top(groups, n, sortBy)
+}
+
+// top combines the stats of the groups, of all groups when groups is nil
+func (t *TargetTracker) top(groups map[string]bool, n int, sortBy string) []TargetStats {
+	result := make([]TargetStats, 0)
+	if t == nil {
+		return result
+	}
+
+	t.mu.Lock()
+	byHost := make(map[string]*TargetStats)
+	for elem := t.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*targetEntry)
+		if groups != nil && !groups[entry.key.groupID] {
+			continue
+		}
+		total, ok := byHost[entry.key.host]
+		if !ok {
+			// Entries are visited most recent first, so the first one has the latest LastSeen
+			copied := entry.stats
+			byHost[entry.key.host] = &copied
+			continue
+		}
+		total.Connections += entry.stats.Connections
+		total.BytesSent += entry.stats.BytesSent
+		total.BytesReceived += entry.stats.BytesReceived
+	}
+	t.mu.Unlock()
+
+	for _, stats := range byHost {
+		result = append(result, *stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if sortBy == TargetSortConnections && a.Connections != b.Connections {
+			return a.Connections > b.Connections
+		}
+		if bytesA, bytesB := a.BytesSent+a.BytesReceived, b.BytesSent+b.BytesReceived; bytesA != bytesB {
+			return bytesA > bytesB
+		}
+		return a.Host < b.Host
+	})
+	if n <= 0 {
+		n = DefaultTopTargets
+	}
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// Evicted returns how many pairs were dropped because the tracker was full
+func (t *TargetTracker) Evicted() int64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.evicted
+}
+
+// Reset drops all target stats
+func (t *TargetTracker) Reset() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = make(map[targetKey]*list.Element)
+	t.lru.Init()
+	t.evicted = 0
+}
+
+// GetTopTargets returns the busiest target hosts of a group, or of all groups (public API)
+func GetTopTargets(groupID string, n int, sortBy string) []TargetStats {
+	return globalManager.targets.Top(groupID, n, sortBy)
+}
+
+// GetTopTargetsOf returns the busiest target hosts of the given groups combined (public API)
+func GetTopTargetsOf(groupIDs []string, n int, sortBy string) []TargetStats {
+	return globalManager.targets.TopOf(groupIDs, n, sortBy)
+}
+
+// GetEvictedTargets returns how many target stats were evicted by the cardinality cap (public API)
+func GetEvictedTargets() int64 {
+	return globalManager.targets.Evicted()
+}
@@ -0,0 +1,63 @@
+package monitoring
+
+import "testing"
+
+func TestTargetTracker(t *testing.T) {
+	tracker := NewTargetTracker(3)
+	tracker.Record("group-a", "video.example.com:443", 1, 100, 5000)
+	tracker.Record("group-a", "video.example.com:80", 1, 10, 500)
+	tracker.Record("group-a", "api.example.com:443", 3, 30, 30)
+	tracker.Record("group-b", "video.example.com:443", 1, 1, 1000)
+
+	top := tracker.Top("group-a", 10, TargetSortBytes)
+	if len(top) != 2 || top[0].Host != "video.example.com" || top[0].Connections != 2 || top[0].BytesReceived != 5500 {
+		t.Fatalf("Unexpected top targets of group-a: %+v", top)
+	}
+	if top := tracker.Top("group-a", 10, TargetSortConnections); top[0].Host != "api.example.com" {
+		t.Errorf("Expected api.example.com first by connections, got %+v", top)
+	}
+
+	// Without a group the hosts of all groups are combined
+	all := tracker.Top("", 1, TargetSortBytes)
+	if len(all) != 1 || all[0].Host != "video.example.com" || all[0].BytesReceived != 6500 {
+		t.Errorf("Unexpected top target of all groups: %+v", all)
+	}
+
+	if some := tracker.TopOf([]string{"group-b", "group-c"}, 10, TargetSortBytes); len(some) != 1 || some[0].BytesReceived != 1000 {
+		t.Errorf("Unexpected top targets of group-b and group-c: %+v", some)
+	}
+
+	// The least recently used pair is evicted at the cap
+	tracker.Record("group-a", "api.example.com:443", 1, 0, 0)
+	tracker.Record("group-c", "new.example.com:443", 1, 0, 0)
+	if top := tracker.Top("group-a", 10, TargetSortBytes); len(top) != 1 || top[0].Host != "api.example.com" {
+		t.Errorf("Expected video.example.com of group-a to be evicted, got %+v", top)
+	}
+	if tracker.Evicted() != 1 {
+		t.Errorf("Expected 1 eviction, got %d", tracker.Evicted())
+	}
+
+	tracker.Reset()
+	if top := tracker.Top("", 10, TargetSortBytes); len(top) != 0 {
+		t.Errorf("Expected no targets after reset, got %+v", top)
+	}
+
+	var none *TargetTracker
+	none.Record("group-a", "example.com:443", 1, 1, 1)
+	if top := none.Top("", 10, TargetSortBytes); len(top) != 0 {
+		t.Errorf("Expected a nil tracker to report nothing, got %+v", top)
+	}
+}
+
+func TestMetricsManager_TargetStats(t *testing.T) {
+	m := newTestManager()
+	m.targets = NewTargetTracker(0)
+	m.UpdateClientMetrics("client-1", "group-1", 0, 0, false)
+	m.CreateConnection("conn-1", "client-1", "example.com:443")
+	m.UpdateConnectionBytes("conn-1", "client-1", 10, 20)
+
+	top := m.targets.Top("group-1", 10, TargetSortBytes)
+	if len(top) != 1 || top[0].Host != "example.com" || top[0].Connections != 1 || top[0].BytesSent != 10 || top[0].BytesReceived != 20 {
+		t.Errorf("Unexpected target stats: %+v", top)
+	}
+}
@@ -0,0 +1,97 @@
+package monitoring
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// transportCounters count the messages one transport type carried between gateway and clients
+type transportCounters struct {
+	messagesSent     int64
+	messagesReceived int64
+	payloadSent      int64
+	payloadReceived  int64
+	framingSent      int64 // Bytes the transport added to the sent messages
+	framingReceived  int64
+}
+
+// transportTraffic holds the counters of each transport type
+var transportTraffic = struct {
+	mu       sync.RWMutex
+	counters map[string]*transportCounters
+}{
+	counters: make(map[string]*transportCounters),
+}
+
+// TransportStats is a snapshot of one transport type. Framing is what the transport adds to each
+// message on its own layer: WebSocket frame headers, the gRPC message envelope and HTTP/2 frame
+// headers, or length prefixes. TLS records and QUIC, KCP, TCP or UDP packet headers are not counted.
+type TransportStats struct {
+	Transport            string  `json:"transport"`
+	MessagesSent         int64   `json:"messages_sent"`
+	MessagesReceived     int64   `json:"messages_received"`
+	PayloadBytesSent     int64   `json:"payload_bytes_sent"`
+	PayloadBytesReceived int64   `json:"payload_bytes_received"`
+	FramingBytesSent     int64   `json:"framing_bytes_sent"`
+	FramingBytesReceived int64   `json:"framing_bytes_received"`
+	Overhead             float64 `json:"overhead"` // Framing share of all bytes, 0.02 = 2%
+}
+
+// transportCountersFor returns the counters of a transport type, creating them on first use
+func transportCountersFor(transport string) *transportCounters {
+	transportTraffic.mu.RLock()
+	counters, ok := transportTraffic.counters[transport]
+	transportTraffic.mu.RUnlock()
+	if !ok {
+		transportTraffic.mu.Lock()
+		if counters, ok = transportTraffic.counters[transport]; !ok {
+			counters = &transportCounters{}
+			transportTraffic.counters[transport] = counters
+		}
+		transportTraffic.mu.Unlock()
+	}
+	return counters
+}
+
+// RecordTransportSent counts a message of payload bytes sent with framing bytes of the transport
+func RecordTransportSent(transport string, payload, framing int) {
+	counters := transportCountersFor(transport)
+	atomic.AddInt64(&counters.messagesSent, 1)
+	atomic.AddInt64(&counters.payloadSent, int64(payload))
+	atomic.AddInt64(&counters.framingSent, int64(framing))
+}
+
+// RecordTransportReceived counts a message of payload bytes received with framing bytes of the transport
+func RecordTransportReceived(transport string, payload, framing int) {
+	counters := transportCountersFor(transport)
+	atomic.AddInt64(&counters.messagesReceived, 1)
+	atomic.AddInt64(&counters.payloadReceived, int64(payload))
+	atomic.AddInt64(&counters.framingReceived, int64(framing))
+}
+
+// GetTransportStats returns the stats of all transport types that carried messages, sorted by name
+func GetTransportStats() []TransportStats {
+	transportTraffic.mu.RLock()
+	defer transportTraffic.mu.RUnlock()
+
+	stats := make([]TransportStats, 0, len(transportTraffic.counters))
+	for name, counters := range transportTraffic.counters {
+		s := TransportStats{
+			Transport:            name,
+			MessagesSent:         atomic.LoadInt64(&counters.messagesSent),
+			MessagesReceived:     atomic.LoadInt64(&counters.messagesReceived),
+			PayloadBytesSent:     atomic.LoadInt64(&counters.payloadSent),
+			PayloadBytesReceived: atomic.LoadInt64(&counters.payloadReceived),
+			FramingBytesSent:     atomic.LoadInt64(&counters.framingSent),
+			FramingBytesReceived: atomic.LoadInt64(&counters.framingReceived),
+		}
+		framing := s.FramingBytesSent + s.FramingBytesReceived
+		if total := framing + s.PayloadBytesSent + s.PayloadBytesReceived; total > 0 {
+			s.Overhead = float64(framing) / float64(total)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Transport < stats[j].Transport })
+	return stats
+}
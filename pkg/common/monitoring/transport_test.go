@@ -0,0 +1,41 @@
+package monitoring
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransportStats(t *testing.T) {
+	RecordTransportSent("test-transport", 96, 4)
+	RecordTransportSent("test-transport", 196, 4)
+	RecordTransportReceived("test-transport", 292, 8)
+
+	var stats *TransportStats
+	for _, s := range GetTransportStats() {
+		if s.Transport == "test-transport" {
+			stats = &s
+		}
+	}
+	if stats == nil {
+		t.Fatal("Expected stats of test-transport")
+	}
+	if stats.MessagesSent != 2 || stats.MessagesReceived != 1 || stats.PayloadBytesSent != 292 || stats.FramingBytesSent != 8 || stats.FramingBytesReceived != 8 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if stats.Overhead != 16.0/600 {
+		t.Errorf("Overhead = %v, want %v", stats.Overhead, 16.0/600)
+	}
+
+	var out strings.Builder
+	if err := WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`anyproxy_transport_messages_total{transport="test-transport",direction="sent"} 2`,
+		`anyproxy_transport_bytes_total{transport="test-transport",direction="received",kind="framing"} 8`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in the Prometheus output", want)
+		}
+	}
+}
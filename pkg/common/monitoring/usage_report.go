@@ -0,0 +1,376 @@
+package monitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Usage report periods and formats
+const (
+	UsagePeriodDaily  = "daily"
+	UsagePeriodWeekly = "weekly"
+
+	UsageFormatCSV  = "csv"
+	UsageFormatJSON = "json"
+
+	// usageSampleInterval is how often traffic is added to the report of the running period.
+	// Clients are dropped from the metrics a few minutes after they disconnect, sampling keeps
+	// their traffic.
+	usageSampleInterval = time.Minute
+	// usageDeliveryTimeout bounds the upload of a report to the webhook or to S3
+	usageDeliveryTimeout = 30 * time.Second
+)
+
+// UsageReportOptions configures scheduled usage reports
+type UsageReportOptions struct {
+	Period  string    // daily or weekly
+	Format  string    // csv (default) or json
+	Dir     string    // Directory the reports are written to, empty writes none
+	Webhook string    // URL receiving each report as a POST, empty sends none
+	S3      *S3Target // Bucket each report is uploaded to, nil uploads none
+}
+
+// UsageRecord is the traffic of a group, or of a proxy user of a group, over a period
+type UsageRecord struct {
+	GroupID       string `json:"group_id"`
+	Username      string `json:"username,omitempty"`
+	Connections   int64  `json:"connections"`
+	BytesSent     int64  `json:"bytes_sent"`     // Sent to targets
+	BytesReceived int64  `json:"bytes_received"` // Received from targets
+}
+
+// UsageReport holds the traffic of each group and proxy user over a period. Groups count all
+// traffic of their clients, including port forwards, users only their proxy connections.
+type UsageReport struct {
+	Period string        `json:"period"`
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Groups []UsageRecord `json:"groups"`
+	Users  []UsageRecord `json:"users"`
+}
+
+// usageCounters are the cumulative or accumulated counters of a client or user
+type usageCounters struct {
+	connections   int64
+	bytesSent     int64
+	bytesReceived int64
+}
+
+// since returns the counters added after prev, all of c when the counters were reset since
+func (c usageCounters) since(prev usageCounters) usageCounters {
+	if c.connections < prev.connections || c.bytesSent < prev.bytesSent || c.bytesReceived < prev.bytesReceived {
+		return c
+	}
+	return usageCounters{c.connections - prev.connections, c.bytesSent - prev.bytesSent, c.bytesReceived - prev.bytesReceived}
+}
+
+// add adds d to c
+func (c *usageCounters) add(d usageCounters) {
+	c.connections += d.connections
+	c.bytesSent += d.bytesSent
+	c.bytesReceived += d.bytesReceived
+}
+
+// usageAccumulator adds up the traffic of the running period from samples of the cumulative
+// counters of clients and users
+type usageAccumulator struct {
+	period string
+	from   time.Time
+
+	clients map[string]usageCounters // Cumulative counters at the previous sample
+	users   map[userKey]usageCounters
+	groups  map[string]*usageCounters // Traffic of the running period
+	usage   map[userKey]*usageCounters
+}
+
+// newUsageAccumulator starts a period at from, traffic counted before the first sample isn't
+// part of it
+func newUsageAccumulator(period string, from time.Time) *usageAccumulator {
+	return &usageAccumulator{
+		period:  period,
+		from:    from,
+		clients: make(map[string]usageCounters),
+		users:   make(map[userKey]usageCounters),
+		groups:  make(map[string]*usageCounters),
+		usage:   make(map[userKey]*usageCounters),
+	}
+}
+
+// baseline records the current counters without counting them
+func (a *usageAccumulator) baseline(clients map[string]SnapshotCounters, users []UserStats) {
+	for clientID, counters := range clients {
+		a.clients[clientID] = usageCounters{counters.TotalConnections, counters.BytesSent, counters.BytesReceived}
+	}
+	for _, user := range users {
+		a.users[userKey{user.GroupID, user.Username}] = usageCounters{user.TotalConnections, user.BytesSent, user.BytesReceived}
+	}
+}
+
+// sample adds the traffic since the previous sample. Clients and users seen for the first time
+// count from zero.
+func (a *usageAccumulator) sample(clients map[string]SnapshotCounters, users []UserStats) {
+	seenClients := make(map[string]usageCounters, len(clients))
+	for clientID, counters := range clients {
+		current := usageCounters{counters.TotalConnections, counters.BytesSent, counters.BytesReceived}
+		seenClients[clientID] = current
+		if counters.GroupID == "" {
+			continue
+		}
+		total, ok := a.groups[counters.GroupID]
+		if !ok {
+			total = &usageCounters{}
+			a.groups[counters.GroupID] = total
+		}
+		total.add(current.since(a.clients[clientID]))
+	}
+	a.clients = seenClients
+
+	seenUsers := make(map[userKey]usageCounters, len(users))
+	for _, user := range users {
+		key := userKey{user.GroupID, user.Username}
+		current := usageCounters{user.TotalConnections, user.BytesSent, user.BytesReceived}
+		seenUsers[key] = current
+		total, ok := a.usage[key]
+		if !ok {
+			total = &usageCounters{}
+			a.usage[key] = total
+		}
+		total.add(current.since(a.users[key]))
+	}
+	a.users = seenUsers
+}
+
+// cut returns the report of the running period and starts the next one at to
+func (a *usageAccumulator) cut(to time.Time) *UsageReport {
+	report := &UsageReport{Period: a.period, From: a.from, To: to, Groups: make([]UsageRecord, 0, len(a.groups)), Users: make([]UsageRecord, 0, len(a.usage))}
+	for groupID, c := range a.groups {
+		report.Groups = append(report.Groups, UsageRecord{GroupID: groupID, Connections: c.connections, BytesSent: c.bytesSent, BytesReceived: c.bytesReceived})
+	}
+	for key, c := range a.usage {
+		if *c == (usageCounters{}) {
+			continue
+		}
+		report.Users = append(report.Users, UsageRecord{GroupID: key.groupID, Username: key.username, Connections: c.connections, BytesSent: c.bytesSent, BytesReceived: c.bytesReceived})
+	}
+	sortUsageRecords(report.Groups)
+	sortUsageRecords(report.Users)
+
+	a.from = to
+	a.groups = make(map[string]*usageCounters)
+	a.usage = make(map[userKey]*usageCounters)
+	return report
+}
+
+// sortUsageRecords orders records by group and username
+func sortUsageRecords(records []UsageRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].GroupID != records[j].GroupID {
+			return records[i].GroupID < records[j].GroupID
+		}
+		return records[i].Username < records[j].Username
+	})
+}
+
+// nextUsageBoundary returns the end of the period containing t. Periods start at midnight UTC,
+// weekly ones on Monday.
+func nextUsageBoundary(t time.Time, period string) time.Time {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if period != UsagePeriodWeekly {
+		return midnight.AddDate(0, 0, 1)
+	}
+	daysToMonday := (8 - int(midnight.Weekday())) % 7
+	if daysToMonday == 0 {
+		daysToMonday = 7
+	}
+	return midnight.AddDate(0, 0, daysToMonday)
+}
+
+// Encode renders the report as CSV, one row per group and per user, or as JSON
+func (r *UsageReport) Encode(format string) ([]byte, error) {
+	if format == UsageFormatJSON {
+		return json.MarshalIndent(r, "", "  ")
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"period", "from", "to", "kind", "group_id", "username", "connections", "bytes_sent", "bytes_received"})
+	row := func(kind string, rec UsageRecord) {
+		_ = w.Write([]string{r.Period, r.From.Format(time.RFC3339), r.To.Format(time.RFC3339), kind, rec.GroupID, rec.Username,
+			strconv.FormatInt(rec.Connections, 10), strconv.FormatInt(rec.BytesSent, 10), strconv.FormatInt(rec.BytesReceived, 10)})
+	}
+	for _, rec := range r.Groups {
+		row("group", rec)
+	}
+	for _, rec := range r.Users {
+		row("user", rec)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// fileName names the report after its period and start, a report cut short by a restart
+// doesn't overwrite the one of the rest of the period
+func (r *UsageReport) fileName(format string) string {
+	if format != UsageFormatJSON {
+		format = UsageFormatCSV
+	}
+	return fmt.Sprintf("usage-%s-%s.%s", r.Period, r.From.UTC().Format("20060102T150405Z"), format)
+}
+
+// deliverUsageReport writes a report to each destination, failures are logged
+func deliverUsageReport(opts UsageReportOptions, report *UsageReport) {
+	data, err := report.Encode(opts.Format)
+	if err != nil {
+		logger.Error("Failed to encode usage report", "period", report.Period, "from", report.From, "err", err)
+		return
+	}
+	name := report.fileName(opts.Format)
+	contentType := "text/csv"
+	if opts.Format == UsageFormatJSON {
+		contentType = "application/json"
+	}
+
+	if opts.Dir != "" {
+		if err := writeUsageReport(filepath.Join(opts.Dir, name), data); err != nil {
+			logger.Error("Failed to write usage report", "path", filepath.Join(opts.Dir, name), "err", err)
+		} else {
+			logger.Info("Usage report written", "path", filepath.Join(opts.Dir, name), "groups", len(report.Groups), "users", len(report.Users))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), usageDeliveryTimeout)
+	defer cancel()
+	if opts.Webhook != "" {
+		if err := postUsageReport(ctx, opts.Webhook, name, contentType, data); err != nil {
+			logger.Error("Failed to send usage report to webhook", "webhook", opts.Webhook, "err", err)
+		} else {
+			logger.Info("Usage report sent to webhook", "webhook", opts.Webhook, "name", name)
+		}
+	}
+	if opts.S3 != nil {
+		if err := opts.S3.Put(ctx, opts.S3.Prefix+name, contentType, data); err != nil {
+			logger.Error("Failed to upload usage report to S3", "bucket", opts.S3.Bucket, "key", opts.S3.Prefix+name, "err", err)
+		} else {
+			logger.Info("Usage report uploaded to S3", "bucket", opts.S3.Bucket, "key", opts.S3.Prefix+name)
+		}
+	}
+}
+
+// writeUsageReport writes a report file atomically
+func writeUsageReport(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// postUsageReport posts a report to a webhook, named by the X-Report-Name header
+func postUsageReport(ctx context.Context, webhook, name, contentType string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Report-Name", name)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Usage report process state
+var (
+	usageMu     sync.Mutex
+	usageCancel context.CancelFunc
+	usageWg     sync.WaitGroup
+)
+
+// usageSample returns the cumulative counters of all clients and users
+func usageSample() (map[string]SnapshotCounters, []UserStats) {
+	return globalManager.Snapshot().Clients, globalManager.users.Users(nil, "")
+}
+
+// StartUsageReports generates a report of the traffic of each group and proxy user at the end of
+// every period until StopUsageReports. The first report covers the time since the start.
+func StartUsageReports(opts UsageReportOptions) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if usageCancel != nil {
+		return
+	}
+	if opts.Format == "" {
+		opts.Format = UsageFormatCSV
+	}
+
+	acc := newUsageAccumulator(opts.Period, time.Now().UTC())
+	acc.baseline(usageSample())
+	logger.Info("Usage reports started", "period", opts.Period, "format", opts.Format, "dir", opts.Dir, "webhook", opts.Webhook != "", "s3", opts.S3 != nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	usageCancel = cancel
+	usageWg.Add(1)
+	go func() {
+		defer usageWg.Done()
+		ticker := time.NewTicker(usageSampleInterval)
+		defer ticker.Stop()
+		boundary := nextUsageBoundary(acc.from, opts.Period)
+		timer := time.NewTimer(time.Until(boundary))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				// The traffic of the running period isn't lost with the process
+				acc.sample(usageSample())
+				deliverUsageReport(opts, acc.cut(time.Now().UTC()))
+				return
+			case <-ticker.C:
+				acc.sample(usageSample())
+			case <-timer.C:
+				acc.sample(usageSample())
+				report := acc.cut(boundary)
+				usageWg.Add(1)
+				go func() {
+					defer usageWg.Done()
+					deliverUsageReport(opts, report)
+				}()
+				boundary = nextUsageBoundary(boundary, opts.Period)
+				timer.Reset(time.Until(boundary))
+			}
+		}
+	}()
+}
+
+// StopUsageReports stops the reports, the running period is reported up to now
+func StopUsageReports() {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if usageCancel == nil {
+		return
+	}
+	usageCancel()
+	usageWg.Wait()
+	usageCancel = nil
+}
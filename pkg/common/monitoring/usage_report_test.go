@@ -0,0 +1,152 @@
+package monitoring
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageAccumulator(t *testing.T) {
+	from := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+	a := newUsageAccumulator(UsagePeriodDaily, from)
+	a.baseline(map[string]SnapshotCounters{"client-1": {GroupID: "group-1", TotalConnections: 10, BytesSent: 1000, BytesReceived: 5000}},
+		[]UserStats{{GroupID: "group-1", Username: "alice", TotalConnections: 4, BytesSent: 400, BytesReceived: 2000}})
+
+	a.sample(map[string]SnapshotCounters{
+		"client-1": {GroupID: "group-1", TotalConnections: 12, BytesSent: 1100, BytesReceived: 5500},
+		"client-2": {GroupID: "group-2", TotalConnections: 1, BytesSent: 10, BytesReceived: 20},
+	}, []UserStats{
+		{GroupID: "group-1", Username: "alice", TotalConnections: 5, BytesSent: 450, BytesReceived: 2200},
+		{GroupID: "group-1", Username: "bob", TotalConnections: 1, BytesSent: 50, BytesReceived: 300},
+	})
+	// client-2 disconnected and was dropped from the metrics, its traffic stays counted. The
+	// counters of client-1 were reset and count from zero.
+	a.sample(map[string]SnapshotCounters{
+		"client-1": {GroupID: "group-1", TotalConnections: 1, BytesSent: 7, BytesReceived: 9},
+	}, []UserStats{
+		{GroupID: "group-1", Username: "alice", TotalConnections: 5, BytesSent: 450, BytesReceived: 2200},
+		{GroupID: "group-1", Username: "bob", TotalConnections: 1, BytesSent: 50, BytesReceived: 300},
+	})
+
+	report := a.cut(from.AddDate(0, 0, 1))
+	wantGroups := []UsageRecord{
+		{GroupID: "group-1", Connections: 3, BytesSent: 107, BytesReceived: 509},
+		{GroupID: "group-2", Connections: 1, BytesSent: 10, BytesReceived: 20},
+	}
+	wantUsers := []UsageRecord{
+		{GroupID: "group-1", Username: "alice", Connections: 1, BytesSent: 50, BytesReceived: 200},
+		{GroupID: "group-1", Username: "bob", Connections: 1, BytesSent: 50, BytesReceived: 300},
+	}
+	if len(report.Groups) != len(wantGroups) || report.Groups[0] != wantGroups[0] || report.Groups[1] != wantGroups[1] {
+		t.Errorf("Groups = %+v, want %+v", report.Groups, wantGroups)
+	}
+	if len(report.Users) != len(wantUsers) || report.Users[0] != wantUsers[0] || report.Users[1] != wantUsers[1] {
+		t.Errorf("Users = %+v, want %+v", report.Users, wantUsers)
+	}
+	if !report.From.Equal(from) || !report.To.Equal(from.AddDate(0, 0, 1)) {
+		t.Errorf("Report covers %v to %v", report.From, report.To)
+	}
+
+	// The next period starts empty
+	next := a.cut(from.AddDate(0, 0, 2))
+	if len(next.Users) != 0 || !next.From.Equal(from.AddDate(0, 0, 1)) {
+		t.Errorf("Next report = %+v, want no users from the end of the previous one", next)
+	}
+}
+
+func TestNextUsageBoundary(t *testing.T) {
+	thursday := time.Date(2026, 10, 15, 13, 30, 0, 0, time.UTC)
+	monday := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		t      time.Time
+		period string
+		want   time.Time
+	}{
+		{"daily", thursday, UsagePeriodDaily, time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)},
+		{"daily at midnight", monday, UsagePeriodDaily, time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		{"weekly", thursday, UsagePeriodWeekly, monday},
+		{"weekly on monday", monday, UsagePeriodWeekly, monday.AddDate(0, 0, 7)},
+		{"weekly on sunday", monday.Add(-time.Hour), UsagePeriodWeekly, monday},
+	}
+	for _, tt := range tests {
+		if got := nextUsageBoundary(tt.t, tt.period); !got.Equal(tt.want) {
+			t.Errorf("%s: nextUsageBoundary(%v) = %v, want %v", tt.name, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestDeliverUsageReport(t *testing.T) {
+	var webhookBody, s3Body, s3Auth, s3Path string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		webhookBody = string(body)
+	}))
+	defer webhook.Close()
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s3Body, s3Auth, s3Path = string(body), r.Header.Get("Authorization"), r.URL.Path
+		if r.Method != http.MethodPut || r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer s3.Close()
+
+	dir := t.TempDir()
+	from := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	report := &UsageReport{
+		Period: UsagePeriodWeekly,
+		From:   from,
+		To:     from.AddDate(0, 0, 7),
+		Groups: []UsageRecord{{GroupID: "group-1", Connections: 3, BytesSent: 100, BytesReceived: 500}},
+		Users:  []UsageRecord{{GroupID: "group-1", Username: "alice", Connections: 3, BytesSent: 100, BytesReceived: 500}},
+	}
+	deliverUsageReport(UsageReportOptions{
+		Period:  UsagePeriodWeekly,
+		Format:  UsageFormatCSV,
+		Dir:     dir,
+		Webhook: webhook.URL,
+		S3:      &S3Target{Endpoint: s3.URL, Bucket: "reports", Prefix: "usage/", AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	}, report)
+
+	data, err := os.ReadFile(filepath.Join(dir, "usage-weekly-20261012T000000Z.csv"))
+	if err != nil {
+		t.Fatalf("Report not written: %v", err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("Expected a header and two rows, got %q (%v)", data, err)
+	}
+	if got := strings.Join(rows[2], ","); got != "weekly,2026-10-12T00:00:00Z,2026-10-19T00:00:00Z,user,group-1,alice,3,100,500" {
+		t.Errorf("User row = %s", got)
+	}
+	if webhookBody != string(data) {
+		t.Errorf("Webhook received %q, want the report", webhookBody)
+	}
+	if s3Body != string(data) || s3Path != "/reports/usage/usage-weekly-20261012T000000Z.csv" {
+		t.Errorf("S3 received %q at %s, want the report", s3Body, s3Path)
+	}
+	if !strings.HasPrefix(s3Auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(s3Auth, "/us-east-1/s3/aws4_request") {
+		t.Errorf("Authorization = %q, want a signature version 4 credential", s3Auth)
+	}
+}
+
+func TestS3Target_PutError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	target := &S3Target{Endpoint: server.URL, Bucket: "reports"}
+	err := target.Put(context.Background(), "report.csv", "text/csv", []byte("x"))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Put() error = %v, want the status", err)
+	}
+}
@@ -0,0 +1,263 @@
+package monitoring
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxUserStats caps the tracked proxy users, the least recently active user is evicted
+const maxUserStats = 10000
+
+// UserStats holds the traffic of a proxy user. Billing is per user, these are kept apart from
+// the stats of the clients that served the user's connections.
+type UserStats struct {
+	GroupID           string    `json:"group_id"`
+	Username          string    `json:"username"` // Empty for users that authenticated with the group credentials
+	ActiveConnections int64     `json:"active_connections"`
+	TotalConnections  int64     `json:"total_connections"`
+	FailedConnections int64     `json:"failed_connections"` // Dials that failed or were rejected
+	BytesSent         int64     `json:"bytes_sent"`         // Sent by the user to its targets
+	BytesReceived     int64     `json:"bytes_received"`     // Received by the user from its targets
+	LastSeen          time.Time `json:"last_seen"`
+}
+
+// userKey identifies a proxy user of a group
+type userKey struct {
+	groupID  string
+	username string
+}
+
+// targetGroup is the key of the user's destinations in the target tracker
+func (k userKey) targetGroup() string {
+	return k.groupID + "\x00" + k.username
+}
+
+// userEntry is an LRU list element value
+type userEntry struct {
+	key   userKey
+	stats UserStats
+}
+
+// UserTracker aggregates connections, failures and bytes per proxy user, and the destinations
+// of each user. A nil tracker records nothing.
+type UserTracker struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[userKey]*list.Element
+	lru     *list.List // Most recently active first
+	evicted int64
+	targets *TargetTracker // Destinations per user instead of per group
+}
+
+// NewUserTracker creates a tracker keeping at most limit users
+func NewUserTracker(limit int) *UserTracker {
+	if limit <= 0 {
+		limit = maxUserStats
+	}
+	return &UserTracker{
+		limit:   limit,
+		entries: make(map[userKey]*list.Element),
+		lru:     list.New(),
+		targets: NewTargetTracker(maxTargetStats),
+	}
+}
+
+// stats returns the stats of a user, creating them and evicting the least recently active user
+// when full (caller holds mu)
+func (t *UserTracker) stats(key userKey) *UserStats {
+	elem, ok := t.entries[key]
+	if ok {
+		t.lru.MoveToFront(elem)
+	} else {
+		if t.lru.Len() >= t.limit {
+			oldest := t.lru.Back()
+			delete(t.entries, oldest.Value.(*userEntry).key)
+			t.lru.Remove(oldest)
+			t.evicted++
+		}
+		elem = t.lru.PushFront(&userEntry{key: key, stats: UserStats{GroupID: key.groupID, Username: key.username}})
+		t.entries[key] = elem
+	}
+	stats := &elem.Value.(*userEntry).stats
+	stats.LastSeen = time.Now()
+	return stats
+}
+
+// Dial records a connection of the user to address, failed when it was not established
+func (t *UserTracker) Dial(groupID, username, address string, failed bool) {
+	if t == nil {
+		return
+	}
+	key := userKey{groupID, username}
+	t.mu.Lock()
+	stats := t.stats(key)
+	if failed {
+		stats.FailedConnections++
+	} else {
+		stats.TotalConnections++
+		stats.ActiveConnections++
+	}
+	t.mu.Unlock()
+	if !failed {
+		t.targets.Record(key.targetGroup(), address, 1, 0, 0)
+	}
+}
+
+// Transfer adds the bytes a connection of the user to address carried
+func (t *UserTracker) Transfer(groupID, username, address string, bytesSent, bytesReceived int64) {
+	if t == nil {
+		return
+	}
+	key := userKey{groupID, username}
+	t.mu.Lock()
+	stats := t.stats(key)
+	stats.BytesSent += bytesSent
+	stats.BytesReceived += bytesReceived
+	t.mu.Unlock()
+	t.targets.Record(key.targetGroup(), address, 0, bytesSent, bytesReceived)
+}
+
+// Close records that a connection of the user ended
+func (t *UserTracker) Close(groupID, username string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, ok := t.entries[userKey{groupID, username}]; ok {
+		if stats := &elem.Value.(*userEntry).stats; stats.ActiveConnections > 0 {
+			stats.ActiveConnections--
+		}
+	}
+}
+
+// Users returns the stats of the users of the given groups, of all groups when groups is nil,
+// ordered by total bytes or by connections
+func (t *UserTracker) Users(groups map[string]bool, sortBy string) []UserStats {
+	result := make([]UserStats, 0)
+	if t == nil {
+		return result
+	}
+	t.mu.Lock()
+	for elem := t.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*userEntry)
+		if groups == nil || groups[entry.key.groupID] {
+			result = append(result, entry.stats)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if sortBy == TargetSortConnections && a.TotalConnections != b.TotalConnections {
+			return a.TotalConnections > b.TotalConnections
+		}
+		if bytesA, bytesB := a.BytesSent+a.BytesReceived, b.BytesSent+b.BytesReceived; bytesA != bytesB {
+			return bytesA > bytesB
+		}
+		if a.GroupID != b.GroupID {
+			return a.GroupID < b.GroupID
+		}
+		return a.Username < b.Username
+	})
+	return result
+}
+
+// User returns the stats of one user, false when it is not tracked
+func (t *UserTracker) User(groupID, username string) (UserStats, bool) {
+	if t == nil {
+		return UserStats{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, ok := t.entries[userKey{groupID, username}]
+	if !ok {
+		return UserStats{}, false
+	}
+	return elem.Value.(*userEntry).stats, true
+}
+
+// TopTargets returns the n busiest destinations of a user
+func (t *UserTracker) TopTargets(groupID, username string, n int, sortBy string) []TargetStats {
+	if t == nil {
+		return []TargetStats{}
+	}
+	return t.targets.Top(userKey{groupID, username}.targetGroup(), n, sortBy)
+}
+
+// Evicted returns how many users were dropped because the tracker was full
+func (t *UserTracker) Evicted() int64 {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.evicted
+}
+
+// Reset zeroes the cumulative counters, users with active connections are kept
+func (t *UserTracker) Reset() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for elem := t.lru.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*userEntry)
+		if entry.stats.ActiveConnections == 0 {
+			delete(t.entries, entry.key)
+			t.lru.Remove(elem)
+		} else {
+			entry.stats = UserStats{GroupID: entry.key.groupID, Username: entry.key.username, ActiveConnections: entry.stats.ActiveConnections, LastSeen: entry.stats.LastSeen}
+		}
+		elem = next
+	}
+	t.evicted = 0
+	t.targets.Reset()
+}
+
+// RecordUserDial records a dial of a proxy user, failed when it was not established (public API)
+func RecordUserDial(groupID, username, address string, failed bool) {
+	globalManager.users.Dial(groupID, username, address, failed)
+}
+
+// RecordUserTransfer adds the bytes a connection of a proxy user carried (public API)
+func RecordUserTransfer(groupID, username, address string, bytesSent, bytesReceived int64) {
+	globalManager.users.Transfer(groupID, username, address, bytesSent, bytesReceived)
+}
+
+// RecordUserClose records that a connection of a proxy user ended (public API)
+func RecordUserClose(groupID, username string) {
+	globalManager.users.Close(groupID, username)
+}
+
+// GetUserStats returns the stats of the proxy users of the given groups, of all groups when
+// groupIDs is nil (public API)
+func GetUserStats(groupIDs []string, sortBy string) []UserStats {
+	if groupIDs == nil {
+		return globalManager.users.Users(nil, sortBy)
+	}
+	groups := make(map[string]bool, len(groupIDs))
+	for _, groupID := range groupIDs {
+		groups[groupID] = true
+	}
+	return globalManager.users.Users(groups, sortBy)
+}
+
+// GetUser returns the stats of one proxy user (public API)
+func GetUser(groupID, username string) (UserStats, bool) {
+	return globalManager.users.User(groupID, username)
+}
+
+// GetUserTopTargets returns the busiest destinations of a proxy user (public API)
+func GetUserTopTargets(groupID, username string, n int, sortBy string) []TargetStats {
+	return globalManager.users.TopTargets(groupID, username, n, sortBy)
+}
+
+// GetEvictedUsers returns how many user stats were evicted by the cardinality cap (public API)
+func GetEvictedUsers() int64 {
+	return globalManager.users.Evicted()
+}
@@ -0,0 +1,50 @@
+package monitoring
+
+import "testing"
+
+func TestUserTracker(t *testing.T) {
+	tracker := NewUserTracker(2)
+	tracker.Dial("office", "alice", "example.com:443", false)
+	tracker.Transfer("office", "alice", "example.com:443", 100, 1000)
+	tracker.Dial("office", "alice", "blocked.example:443", true)
+	tracker.Dial("lab", "bob", "example.org:80", false)
+	tracker.Transfer("lab", "bob", "example.org:80", 10, 20)
+	tracker.Close("lab", "bob")
+
+	alice, ok := tracker.User("office", "alice")
+	if !ok {
+		t.Fatal("Expected alice to be tracked")
+	}
+	if alice.TotalConnections != 1 || alice.ActiveConnections != 1 || alice.FailedConnections != 1 || alice.BytesSent != 100 || alice.BytesReceived != 1000 {
+		t.Errorf("Unexpected stats of alice: %+v", alice)
+	}
+	if top := tracker.TopTargets("office", "alice", 10, TargetSortBytes); len(top) != 1 || top[0].Host != "example.com" || top[0].BytesReceived != 1000 {
+		t.Errorf("Expected only the established destination, got %+v", top)
+	}
+
+	users := tracker.Users(nil, TargetSortBytes)
+	if len(users) != 2 || users[0].Username != "alice" || users[1].ActiveConnections != 0 {
+		t.Errorf("Expected alice first and bob's connection closed, got %+v", users)
+	}
+	if users := tracker.Users(map[string]bool{"lab": true}, TargetSortBytes); len(users) != 1 || users[0].Username != "bob" {
+		t.Errorf("Expected only the users of lab, got %+v", users)
+	}
+
+	// The least recently active user is evicted beyond the limit
+	tracker.Dial("lab", "carol", "example.net:443", false)
+	if _, ok := tracker.User("office", "alice"); ok || tracker.Evicted() != 1 {
+		t.Errorf("Expected alice to be evicted, evicted %d", tracker.Evicted())
+	}
+
+	// A reset keeps users with active connections
+	tracker.Reset()
+	if users := tracker.Users(nil, TargetSortBytes); len(users) != 1 || users[0].Username != "carol" || users[0].TotalConnections != 0 || users[0].ActiveConnections != 1 {
+		t.Errorf("Expected only carol with her active connection after a reset, got %+v", users)
+	}
+
+	var none *UserTracker
+	none.Dial("office", "alice", "example.com:443", false)
+	if len(none.Users(nil, TargetSortBytes)) != 0 {
+		t.Error("Expected a nil tracker to record nothing")
+	}
+}
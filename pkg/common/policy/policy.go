@@ -0,0 +1,90 @@
+// Package policy defines the policy packs the gateway pushes to clients.
+//
+// A policy pack is a named set of allowed and forbidden host patterns defined once on the
+// gateway. The gateway sends the packs referenced by a group to every client of the group
+// when it registers, and the client checks each pack in addition to its own host patterns.
+//
+// Operators can sign the packs of a group offline with an ed25519 key the gateway never has.
+// Clients pinned to its public key only accept packs with that signature, so whoever controls
+// the gateway's configuration can't change them.
+package policy
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// PacksPath is the path of the client policy service receiving the packs
+const PacksPath = "/policy/packs"
+
+// SignatureHeader carries the hex encoded signature of the packs with the group key, see groupkey
+const SignatureHeader = "X-Anyproxy-Signature"
+
+// OperatorSignatureHeader carries the base64 signature of the packs with the operator key
+const OperatorSignatureHeader = "X-Anyproxy-Operator-Signature"
+
+// Pack is a policy pack as sent to clients
+type Pack struct {
+	Name           string   `json:"name"`
+	AllowedHosts   []string `json:"allowed_hosts,omitempty"`
+	ForbiddenHosts []string `json:"forbidden_hosts,omitempty"`
+}
+
+// Packs is the document the gateway pushes, it replaces the packs the client had before
+type Packs struct {
+	Packs []Pack `json:"packs"`
+}
+
+// Marshal returns the document pushing packs, the body the operator signs
+func Marshal(packs []Pack) ([]byte, error) {
+	return json.Marshal(Packs{Packs: packs})
+}
+
+// SignedMessage returns the message signed by the operator for the packs document of a group.
+// The group ID is part of it, so the packs of one group can't be pushed to another.
+func SignedMessage(groupID string, body []byte) []byte {
+	msg := make([]byte, 0, 32+len(groupID)+len(body))
+	msg = append(msg, "anyproxy-policy-packs\x00"...)
+	msg = append(msg, groupID...)
+	msg = append(msg, 0)
+	return append(msg, body...)
+}
+
+// Sign signs the packs document of a group and returns the base64 signature
+func Sign(key ed25519.PrivateKey, groupID string, body []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedMessage(groupID, body)))
+}
+
+// Verify checks a base64 operator signature of the packs document of a group
+func Verify(key ed25519.PublicKey, groupID string, body []byte, signature string) error {
+	if signature == "" {
+		return fmt.Errorf("policy packs are not signed with the operator key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid operator signature encoding: %v", err)
+	}
+	if !ed25519.Verify(key, SignedMessage(groupID, body), sig) {
+		return fmt.Errorf("operator signature verification failed")
+	}
+	return nil
+}
+
+// ForGroup resolves the policy packs referenced by a group, falling back to group_defaults
+func ForGroup(cfg *config.GatewayConfig, groupID string) []Pack {
+	byName := make(map[string]config.PolicyPack, len(cfg.PolicyPacks))
+	for _, pack := range cfg.PolicyPacks {
+		byName[pack.Name] = pack
+	}
+	var packs []Pack
+	for _, name := range cfg.GetGroupConfig(groupID).PolicyPacks {
+		if pack, ok := byName[name]; ok {
+			packs = append(packs, Pack{Name: pack.Name, AllowedHosts: pack.AllowedHosts, ForbiddenHosts: pack.ForbiddenHosts})
+		}
+	}
+	return packs
+}
@@ -0,0 +1,53 @@
+package policy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestForGroup(t *testing.T) {
+	cfg := &config.GatewayConfig{
+		PolicyPacks: []config.PolicyPack{
+			{Name: "no-metadata", ForbiddenHosts: []string{"169.254.0.0/16"}},
+			{Name: "internal", AllowedHosts: []string{"10.0.0.0/8"}},
+		},
+		GroupDefaults: config.GroupConfig{PolicyPacks: []string{"no-metadata"}},
+		Groups:        map[string]config.GroupConfig{"office": {PolicyPacks: []string{"internal", "no-metadata"}}},
+	}
+
+	packs := ForGroup(cfg, "office")
+	if len(packs) != 2 || packs[0].Name != "internal" || packs[1].ForbiddenHosts[0] != "169.254.0.0/16" {
+		t.Errorf("Unexpected packs of office: %+v", packs)
+	}
+	if packs := ForGroup(cfg, "lab"); len(packs) != 1 || packs[0].Name != "no-metadata" {
+		t.Errorf("Expected the group defaults, got %+v", packs)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := Marshal([]Pack{{Name: "internal", AllowedHosts: []string{"10.0.0.0/8"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := Sign(privateKey, "office", body)
+
+	if err := Verify(publicKey, "office", body, signature); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+	if err := Verify(publicKey, "lab", body, signature); err == nil {
+		t.Error("Expected the packs of another group to be rejected")
+	}
+	if err := Verify(publicKey, "office", []byte(`{"packs":[]}`), signature); err == nil {
+		t.Error("Expected changed packs to be rejected")
+	}
+	if err := Verify(publicKey, "office", body, ""); err == nil {
+		t.Error("Expected unsigned packs to be rejected")
+	}
+}
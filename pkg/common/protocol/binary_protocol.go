@@ -4,7 +4,11 @@ package protocol
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"time"
 )
 
 // Binary protocol version
@@ -25,6 +29,11 @@ const (
 	BinaryMsgTypeAuth         byte = 0x06 // Authentication request
 	BinaryMsgTypeAuthResponse byte = 0x07 // Authentication response
 	BinaryMsgTypeError        byte = 0x08 // Error message
+	BinaryMsgTypeHeartbeat    byte = 0x09 // Client heartbeat with host telemetry
+	BinaryMsgTypePeerConnect  byte = 0x0A // Client request to relay a connection to another group's client
+	BinaryMsgTypeDraining     byte = 0x0B // Client is shutting down and takes no new connections
+	BinaryMsgTypeReport       byte = 0x0C // Activity a client spooled while disconnected
+	BinaryMsgTypeCapabilities byte = 0x0D // Networks and connection limit a client supports
 
 	// Data message types (0x10 - 0x1F)
 	BinaryMsgTypeData byte = 0x10 // Data transfer
@@ -38,6 +47,35 @@ const (
 	ConnIDSize       = 20 // xid string length
 )
 
+// MaxMessageSize bounds a protocol message. Client reports are the largest messages at 1MB, data
+// messages carry up to DefaultBufferSize. Transports refuse larger messages before buffering them.
+const MaxMessageSize = 2 * 1024 * 1024
+
+// Protocol violations, peers sending them are disconnected
+var (
+	ErrMessageTooLarge    = errors.New("message too large")
+	ErrMalformedMessage   = errors.New("malformed message")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+)
+
+// CheckMessageSize returns an ErrMessageTooLarge error for messages over MaxMessageSize bytes
+func CheckMessageSize(size int) error {
+	if size > MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, size)
+	}
+	return nil
+}
+
+// IsProtocolViolation reports whether err is caused by a message the peer must not send
+func IsProtocolViolation(err error) bool {
+	return errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrMalformedMessage) || errors.Is(err, ErrUnsupportedVersion)
+}
+
+// malformed returns an ErrMalformedMessage error describing what is wrong with the message
+func malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrMalformedMessage}, args...)...)
+}
+
 // BinaryMessage binary message base structure
 type BinaryMessage struct {
 	Version byte   // Protocol version
@@ -60,7 +98,10 @@ func PackBinaryMessage(msgType byte, data []byte) []byte {
 // UnpackBinaryHeader unpacks message header, returns version, type and data part
 func UnpackBinaryHeader(msg []byte) (version, msgType byte, data []byte, err error) {
 	if len(msg) < BinaryHeaderSize {
-		return 0, 0, nil, fmt.Errorf("message too short: %d bytes", len(msg))
+		return 0, 0, nil, malformed("message too short: %d bytes", len(msg))
+	}
+	if err := CheckMessageSize(len(msg)); err != nil {
+		return 0, 0, nil, err
 	}
 
 	version = msg[0]
@@ -68,7 +109,7 @@ func UnpackBinaryHeader(msg []byte) (version, msgType byte, data []byte, err err
 	data = msg[2:]
 
 	if version != BinaryProtocolVersion {
-		return 0, 0, nil, fmt.Errorf("unsupported version: %d", version)
+		return 0, 0, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
 	}
 
 	return version, msgType, data, nil
@@ -106,7 +147,7 @@ func PackDataMessage(connID string, data []byte) []byte {
 // UnpackDataMessage unpacks data message
 func UnpackDataMessage(data []byte) (connID string, payload []byte, err error) {
 	if len(data) < ConnIDSize {
-		return "", nil, fmt.Errorf("data message too short: %d bytes", len(data))
+		return "", nil, malformed("data message too short: %d bytes", len(data))
 	}
 
 	// Extract connID (remove trailing zero bytes)
@@ -126,19 +167,51 @@ func UnpackDataMessage(data []byte) (connID string, payload []byte, err error) {
 }
 
 // --- Connection request messages ---
-// Format: [version:1][type:1][connID:20][network_length:2][network:N][address_length:2][address:N]
+// Format: [version:1][type:1][connID:20][network_length:2][network:N][address_length:2][address:N][timeout_ms:4 (optional)][priority:1 (optional)][scope_length:1][scope:N (optional)]
 
 // PackConnectMessage packs connection request
 func PackConnectMessage(connID, network, address string) []byte {
+	return PackConnectMessageWithTimeout(connID, network, address, 0)
+}
+
+// PackConnectMessageWithTimeout packs connection request with the time the proxy user still
+// waits for the dial. A zero timeout omits the field, keeping the message readable by older clients.
+func PackConnectMessageWithTimeout(connID, network, address string, timeout time.Duration) []byte {
+	return PackConnectMessageWithPriority(connID, network, address, timeout, 0)
+}
+
+// PackConnectMessageWithPriority also packs the QoS priority class of the connection, zero omits
+// it. A priority without a timeout is sent with a zero timeout, which older clients ignore.
+func PackConnectMessageWithPriority(connID, network, address string, timeout time.Duration, priority uint8) []byte {
+	return PackConnectMessageWithScope(connID, network, address, timeout, priority, "")
+}
+
+// PackConnectMessageWithScope also packs the reuse scope of the connection, an opaque token of the
+// proxy user that lets the client hand the target connection to a later session of the same user.
+// An empty scope omits it, a scope is sent after a zero priority, which older clients ignore.
+func PackConnectMessageWithScope(connID, network, address string, timeout time.Duration, priority uint8, scope string) []byte {
 	if len(connID) > ConnIDSize {
 		connID = connID[:ConnIDSize]
 	}
 
+	if len(scope) > math.MaxUint8 {
+		scope = scope[:math.MaxUint8]
+	}
+
 	networkBytes := []byte(network)
 	addressBytes := []byte(address)
 
 	// Calculate total length
 	totalLen := ConnIDSize + 2 + len(networkBytes) + 2 + len(addressBytes)
+	if timeout > 0 || priority > 0 || scope != "" {
+		totalLen += 4
+	}
+	if priority > 0 || scope != "" {
+		totalLen++
+	}
+	if scope != "" {
+		totalLen += 1 + len(scope)
+	}
 	payload := make([]byte, totalLen)
 
 	offset := 0
@@ -161,14 +234,64 @@ func PackConnectMessage(connID, network, address string) []byte {
 
 	// address content
 	copy(payload[offset:], addressBytes)
+	offset += len(addressBytes)
+
+	// dial timeout in milliseconds (optional 4 bytes)
+	if timeout > 0 {
+		binary.BigEndian.PutUint32(payload[offset:], connectTimeoutMillis(timeout))
+	}
+	offset += 4
+
+	// QoS priority class (optional 1 byte)
+	if priority > 0 {
+		payload[offset] = priority
+	}
+	offset++
+
+	// reuse scope (optional 1 byte length and content)
+	if scope != "" {
+		payload[offset] = uint8(len(scope)) //nolint:gosec // scope is truncated above
+		copy(payload[offset+1:], scope)
+	}
 
 	return PackBinaryMessage(BinaryMsgTypeConnect, payload)
 }
 
+// connectTimeoutMillis converts a dial timeout to whole milliseconds, rounding up so short
+// timeouts are not sent as "no timeout"
+func connectTimeoutMillis(timeout time.Duration) uint32 {
+	ms := (timeout + time.Millisecond - 1) / time.Millisecond
+	if ms > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(ms) //nolint:gosec // bounded above
+}
+
 // UnpackConnectMessage unpacks connection request
 func UnpackConnectMessage(data []byte) (connID, network, address string, err error) {
+	connID, network, address, _, err = UnpackConnectMessageWithTimeout(data)
+	return connID, network, address, err
+}
+
+// UnpackConnectMessageWithTimeout unpacks connection request and its dial timeout,
+// which is zero when the gateway did not send one
+func UnpackConnectMessageWithTimeout(data []byte) (connID, network, address string, timeout time.Duration, err error) {
+	connID, network, address, timeout, _, err = UnpackConnectMessageWithPriority(data)
+	return connID, network, address, timeout, err
+}
+
+// UnpackConnectMessageWithPriority unpacks connection request, its dial timeout and its QoS
+// priority class, which are zero when the gateway did not send them
+func UnpackConnectMessageWithPriority(data []byte) (connID, network, address string, timeout time.Duration, priority uint8, err error) {
+	connID, network, address, timeout, priority, _, err = UnpackConnectMessageWithScope(data)
+	return connID, network, address, timeout, priority, err
+}
+
+// UnpackConnectMessageWithScope unpacks connection request with its dial timeout, QoS priority
+// class and reuse scope, which are zero or empty when the gateway did not send them
+func UnpackConnectMessageWithScope(data []byte) (connID, network, address string, timeout time.Duration, priority uint8, scope string, err error) {
 	if len(data) < ConnIDSize+4 {
-		return "", "", "", fmt.Errorf("connect message too short: %d bytes", len(data))
+		return "", "", "", 0, 0, "", malformed("connect message too short: %d bytes", len(data))
 	}
 
 	offset := 0
@@ -190,38 +313,79 @@ func UnpackConnectMessage(data []byte) (connID, network, address string, err err
 	networkLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(networkLen) > len(data) {
-		return "", "", "", fmt.Errorf("invalid network length")
+		return "", "", "", 0, 0, "", malformed("invalid network length")
 	}
 	network = string(data[offset : offset+int(networkLen)])
 	offset += int(networkLen)
 
 	// Extract address
 	if offset+2 > len(data) {
-		return "", "", "", fmt.Errorf("missing address length")
+		return "", "", "", 0, 0, "", malformed("missing address length")
 	}
 	addressLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(addressLen) > len(data) {
-		return "", "", "", fmt.Errorf("invalid address length")
+		return "", "", "", 0, 0, "", malformed("invalid address length")
 	}
 	address = string(data[offset : offset+int(addressLen)])
+	offset += int(addressLen)
 
-	return connID, network, address, nil
+	// Extract optional dial timeout and priority
+	if offset+4 <= len(data) {
+		timeout = time.Duration(binary.BigEndian.Uint32(data[offset:])) * time.Millisecond
+		offset += 4
+	}
+	if offset < len(data) {
+		priority = data[offset]
+		offset++
+	}
+	if offset < len(data) {
+		scopeLen := int(data[offset])
+		offset++
+		if offset+scopeLen > len(data) {
+			return "", "", "", 0, 0, "", malformed("invalid scope length")
+		}
+		scope = string(data[offset : offset+scopeLen])
+	}
+
+	return connID, network, address, timeout, priority, scope, nil
 }
 
 // --- Connection response messages ---
-// Format: [version:1][type:1][connID:20][success:1][error_length:2][error:N]
+// Format: [version:1][type:1][connID:20][success:1][error_length:2][error:N][code_length:1][code:N][retry_after_ms:4]
+// The error code is optional, older gateways ignore it and older clients don't send it. The retry
+// delay follows a code when the client asks the gateway to hold off new connect requests.
 
 // PackConnectResponseMessage packs connection response
 func PackConnectResponseMessage(connID string, success bool, errorMsg string) []byte {
+	return PackConnectResponseMessageWithCode(connID, success, errorMsg, "")
+}
+
+// PackConnectResponseMessageWithCode packs connection response with the code classifying the error
+func PackConnectResponseMessageWithCode(connID string, success bool, errorMsg, errorCode string) []byte {
+	return PackConnectResponseMessageWithRetry(connID, success, errorMsg, errorCode, 0)
+}
+
+// PackConnectResponseMessageWithRetry packs connection response with the code classifying the
+// error and how long the gateway should wait before sending the next connect request
+func PackConnectResponseMessageWithRetry(connID string, success bool, errorMsg, errorCode string, retryAfter time.Duration) []byte {
 	if len(connID) > ConnIDSize {
 		connID = connID[:ConnIDSize]
 	}
+	if len(errorCode) > math.MaxUint8 {
+		errorCode = errorCode[:math.MaxUint8]
+	}
 
 	errorBytes := []byte(errorMsg)
 
 	// Calculate total length
 	totalLen := ConnIDSize + 1 + 2 + len(errorBytes)
+	if errorCode != "" {
+		totalLen += 1 + len(errorCode)
+		if retryAfter > 0 {
+			totalLen += 4
+		}
+	}
 	payload := make([]byte, totalLen)
 
 	offset := 0
@@ -244,14 +408,39 @@ func PackConnectResponseMessage(connID string, success bool, errorMsg string) []
 
 	// error content
 	copy(payload[offset:], errorBytes)
+	offset += len(errorBytes)
+
+	// optional error code and retry delay
+	if errorCode != "" {
+		payload[offset] = byte(len(errorCode))
+		copy(payload[offset+1:], errorCode)
+		offset += 1 + len(errorCode)
+		if retryAfter > 0 {
+			binary.BigEndian.PutUint32(payload[offset:], uint32(min(retryAfter.Milliseconds(), math.MaxUint32))) //nolint:gosec // clamped above
+		}
+	}
 
 	return PackBinaryMessage(BinaryMsgTypeConnectResponse, payload)
 }
 
 // UnpackConnectResponseMessage unpacks connection response
 func UnpackConnectResponseMessage(data []byte) (connID string, success bool, errorMsg string, err error) {
+	connID, success, errorMsg, _, err = UnpackConnectResponseMessageWithCode(data)
+	return connID, success, errorMsg, err
+}
+
+// UnpackConnectResponseMessageWithCode unpacks connection response and its error code,
+// which is empty when the client did not send one
+func UnpackConnectResponseMessageWithCode(data []byte) (connID string, success bool, errorMsg, errorCode string, err error) {
+	connID, success, errorMsg, errorCode, _, err = UnpackConnectResponseMessageWithRetry(data)
+	return connID, success, errorMsg, errorCode, err
+}
+
+// UnpackConnectResponseMessageWithRetry unpacks connection response, its error code and retry
+// delay, which is zero when the client did not send one
+func UnpackConnectResponseMessageWithRetry(data []byte) (connID string, success bool, errorMsg, errorCode string, retryAfter time.Duration, err error) {
 	if len(data) < ConnIDSize+3 {
-		return "", false, "", fmt.Errorf("connect response too short: %d bytes", len(data))
+		return "", false, "", "", 0, malformed("connect response too short: %d bytes", len(data))
 	}
 
 	offset := 0
@@ -278,33 +467,72 @@ func UnpackConnectResponseMessage(data []byte) (connID string, success bool, err
 	offset += 2
 	if errorLen > 0 {
 		if offset+int(errorLen) > len(data) {
-			return "", false, "", fmt.Errorf("invalid error length")
+			return "", false, "", "", 0, malformed("invalid error length")
 		}
 		errorMsg = string(data[offset : offset+int(errorLen)])
+		offset += int(errorLen)
 	}
 
-	return connID, success, errorMsg, nil
+	// Extract optional error code
+	if offset < len(data) {
+		codeLen := int(data[offset])
+		offset++
+		if offset+codeLen > len(data) {
+			return "", false, "", "", 0, malformed("invalid error code length")
+		}
+		errorCode = string(data[offset : offset+codeLen])
+		offset += codeLen
+	}
+
+	// Extract optional retry delay
+	if offset+4 <= len(data) {
+		retryAfter = time.Duration(binary.BigEndian.Uint32(data[offset:])) * time.Millisecond
+	}
+
+	return connID, success, errorMsg, errorCode, retryAfter, nil
 }
 
 // --- Close messages ---
-// Format: [version:1][type:1][connID:20]
+// Format: [version:1][type:1][connID:20][flags:1]
+// The flags byte is optional, peers that predate it ignore it and close the connection fully
+
+// Close message flags
+const (
+	CloseFlagWrite byte = 0x01 // Only the sender's write side closed (half-close), it still reads
+)
 
 // PackCloseMessage packs close message
 func PackCloseMessage(connID string) []byte {
+	return packCloseMessage(connID, 0)
+}
+
+// PackCloseWriteMessage packs a close message telling the peer the sender finished writing
+func PackCloseWriteMessage(connID string) []byte {
+	return packCloseMessage(connID, CloseFlagWrite)
+}
+
+func packCloseMessage(connID string, flags byte) []byte {
 	if len(connID) > ConnIDSize {
 		connID = connID[:ConnIDSize]
 	}
 
-	payload := make([]byte, ConnIDSize)
+	size := ConnIDSize
+	if flags != 0 {
+		size++
+	}
+	payload := make([]byte, size)
 	copy(payload, []byte(connID))
+	if flags != 0 {
+		payload[ConnIDSize] = flags
+	}
 
 	return PackBinaryMessage(BinaryMsgTypeClose, payload)
 }
 
-// UnpackCloseMessage unpacks close message
-func UnpackCloseMessage(data []byte) (connID string, err error) {
+// UnpackCloseMessage unpacks close message, writeOnly is set for a half-close
+func UnpackCloseMessage(data []byte) (connID string, writeOnly bool, err error) {
 	if len(data) < ConnIDSize {
-		return "", fmt.Errorf("close message too short: %d bytes", len(data))
+		return "", false, malformed("close message too short: %d bytes", len(data))
 	}
 
 	// Extract connID
@@ -319,12 +547,31 @@ func UnpackCloseMessage(data []byte) (connID string, err error) {
 		connID = string(connIDBytes)
 	}
 
-	return connID, nil
+	if len(data) > ConnIDSize {
+		writeOnly = data[ConnIDSize]&CloseFlagWrite != 0
+	}
+
+	return connID, writeOnly, nil
 }
 
 // --- Port forwarding request ---
 // Format: [version:1][type:1][clientID_length:2][clientID:N][port_count:2][port_config1][port_config2]...
 // Port config format: [remotePort:2][localPort:2][localHost_length:2][localHost:N][protocol_length:1][protocol:N]
+// Signed requests end with [signature:32] over the message without header, older gateways ignore it
+// When any port has allowed sources, portSourcesFlag is set in port_count and every port config is
+// followed by [source_count:1][source_length:1][source:N]..., older gateways reject such requests
+
+// minPortConfigSize is the size of a port config with empty local host and protocol
+const minPortConfigSize = 7
+
+// portSourcesFlag marks port counts of requests whose port configs carry allowed sources
+const portSourcesFlag = 0x8000
+
+// MaxPortSources is the number of allowed sources a port config can carry
+const MaxPortSources = 255
+
+// PortForwardSignatureSize is the size of the signature ending signed port forwarding requests
+const PortForwardSignatureSize = 32
 
 // PortConfig port forwarding configuration
 type PortConfig struct {
@@ -332,6 +579,9 @@ type PortConfig struct {
 	LocalPort  int
 	LocalHost  string
 	Protocol   string
+	// CIDR ranges or IP addresses allowed to reach the port, empty allows all. At most
+	// MaxPortSources of at most 255 bytes each.
+	AllowedSources []string
 }
 
 // PackPortForwardMessage packs port forwarding request
@@ -340,8 +590,20 @@ func PackPortForwardMessage(clientID string, ports []PortConfig) []byte {
 
 	// Calculate total length
 	totalLen := 2 + len(clientIDBytes) + 2 // clientID length + clientID + port count
+	withSources := false
 	for _, port := range ports {
 		totalLen += 2 + 2 + 2 + len(port.LocalHost) + 1 + len(port.Protocol)
+		if len(port.AllowedSources) > 0 {
+			withSources = true
+		}
+	}
+	if withSources {
+		for _, port := range ports {
+			totalLen++
+			for _, source := range port.AllowedSources {
+				totalLen += 1 + len(source)
+			}
+		}
 	}
 
 	payload := make([]byte, totalLen)
@@ -357,7 +619,11 @@ func PackPortForwardMessage(clientID string, ports []PortConfig) []byte {
 	offset += len(clientIDBytes)
 
 	// port count (2 bytes)
-	binary.BigEndian.PutUint16(payload[offset:], uint16(len(ports))) //nolint:gosec // port count is limited
+	portCount := uint16(len(ports)) //nolint:gosec // port count is limited
+	if withSources {
+		portCount |= portSourcesFlag
+	}
+	binary.BigEndian.PutUint16(payload[offset:], portCount)
 	offset += 2
 
 	// port configuration list
@@ -387,15 +653,39 @@ func PackPortForwardMessage(clientID string, ports []PortConfig) []byte {
 		// protocol content
 		copy(payload[offset:], protocolBytes)
 		offset += len(protocolBytes)
+
+		if withSources {
+			payload[offset] = byte(len(port.AllowedSources)) //nolint:gosec // validated to at most MaxPortSources
+			offset++
+			for _, source := range port.AllowedSources {
+				payload[offset] = byte(len(source)) //nolint:gosec // CIDRs are always short
+				offset++
+				offset += copy(payload[offset:], source)
+			}
+		}
 	}
 
 	return PackBinaryMessage(BinaryMsgTypePortForward, payload)
 }
 
+// PackSignedPortForwardMessage packs port forwarding request ending with the signature sign
+// returns for it, which must be PortForwardSignatureSize bytes
+func PackSignedPortForwardMessage(clientID string, ports []PortConfig, sign func(body []byte) []byte) []byte {
+	msg := PackPortForwardMessage(clientID, ports)
+	return append(msg, sign(msg[BinaryHeaderSize:])...)
+}
+
 // UnpackPortForwardMessage unpacks port forwarding request
 func UnpackPortForwardMessage(data []byte) (clientID string, ports []PortConfig, err error) {
+	clientID, ports, _, _, err = UnpackPortForwardMessageWithSignature(data)
+	return clientID, ports, err
+}
+
+// UnpackPortForwardMessageWithSignature unpacks port forwarding request and, for signed requests,
+// the signed body and the signature, which are nil otherwise
+func UnpackPortForwardMessageWithSignature(data []byte) (clientID string, ports []PortConfig, body, signature []byte, err error) {
 	if len(data) < 4 {
-		return "", nil, fmt.Errorf("port forward message too short: %d bytes", len(data))
+		return "", nil, nil, nil, malformed("port forward message too short: %d bytes", len(data))
 	}
 
 	offset := 0
@@ -404,66 +694,99 @@ func UnpackPortForwardMessage(data []byte) (clientID string, ports []PortConfig,
 	clientIDLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(clientIDLen) > len(data) {
-		return "", nil, fmt.Errorf("invalid clientID length")
+		return "", nil, nil, nil, malformed("invalid clientID length")
 	}
 	clientID = string(data[offset : offset+int(clientIDLen)])
 	offset += int(clientIDLen)
 
 	// Extract port count
 	if offset+2 > len(data) {
-		return "", nil, fmt.Errorf("missing port count")
+		return "", nil, nil, nil, malformed("missing port count")
 	}
 	portCount := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
+	withSources := portCount&portSourcesFlag != 0
+	portCount &^= portSourcesFlag
+	if int(portCount)*minPortConfigSize > len(data)-offset {
+		return "", nil, nil, nil, malformed("port count %d exceeds the message", portCount)
+	}
 
 	// Extract port configuration list
 	ports = make([]PortConfig, portCount)
 	for i := 0; i < int(portCount); i++ {
 		// remotePort
 		if offset+2 > len(data) {
-			return "", nil, fmt.Errorf("missing remote port")
+			return "", nil, nil, nil, malformed("missing remote port")
 		}
 		ports[i].RemotePort = int(binary.BigEndian.Uint16(data[offset:]))
 		offset += 2
 
 		// localPort
 		if offset+2 > len(data) {
-			return "", nil, fmt.Errorf("missing local port")
+			return "", nil, nil, nil, malformed("missing local port")
 		}
 		ports[i].LocalPort = int(binary.BigEndian.Uint16(data[offset:]))
 		offset += 2
 
 		// localHost
 		if offset+2 > len(data) {
-			return "", nil, fmt.Errorf("missing local host length")
+			return "", nil, nil, nil, malformed("missing local host length")
 		}
 		localHostLen := binary.BigEndian.Uint16(data[offset:])
 		offset += 2
 		if offset+int(localHostLen) > len(data) {
-			return "", nil, fmt.Errorf("invalid local host length")
+			return "", nil, nil, nil, malformed("invalid local host length")
 		}
 		ports[i].LocalHost = string(data[offset : offset+int(localHostLen)])
 		offset += int(localHostLen)
 
 		// protocol
 		if offset+1 > len(data) {
-			return "", nil, fmt.Errorf("missing protocol length")
+			return "", nil, nil, nil, malformed("missing protocol length")
 		}
 		protocolLen := data[offset]
 		offset++
 		if offset+int(protocolLen) > len(data) {
-			return "", nil, fmt.Errorf("invalid protocol length")
+			return "", nil, nil, nil, malformed("invalid protocol length")
 		}
 		ports[i].Protocol = string(data[offset : offset+int(protocolLen)])
 		offset += int(protocolLen)
+
+		if withSources {
+			if offset+1 > len(data) {
+				return "", nil, nil, nil, malformed("missing allowed source count")
+			}
+			sourceCount := int(data[offset])
+			offset++
+			for j := 0; j < sourceCount; j++ {
+				if offset+1 > len(data) || offset+1+int(data[offset]) > len(data) {
+					return "", nil, nil, nil, malformed("invalid allowed source length")
+				}
+				sourceLen := int(data[offset])
+				offset++
+				ports[i].AllowedSources = append(ports[i].AllowedSources, string(data[offset:offset+sourceLen]))
+				offset += sourceLen
+			}
+		}
+	}
+
+	switch len(data) - offset {
+	case 0:
+	case PortForwardSignatureSize:
+		body, signature = data[:offset], data[offset:]
+	default:
+		return "", nil, nil, nil, malformed("unexpected %d bytes after the port configs", len(data)-offset)
 	}
 
-	return clientID, ports, nil
+	return clientID, ports, body, signature, nil
 }
 
 // --- Port forwarding response ---
 // Format: [version:1][type:1][success:1][error_length:2][error:N][forward_count:2][port1:2][status1:1]...
 
+// portForwardStatusSize is the size of a port status
+const portForwardStatusSize = 3
+
 // PortForwardStatus port forwarding status
 type PortForwardStatus struct {
 	Port    int
@@ -518,7 +841,7 @@ func PackPortForwardResponseMessage(success bool, errorMsg string, statuses []Po
 // UnpackPortForwardResponseMessage unpacks port forwarding response
 func UnpackPortForwardResponseMessage(data []byte) (success bool, errorMsg string, statuses []PortForwardStatus, err error) {
 	if len(data) < 5 {
-		return false, "", nil, fmt.Errorf("port forward response too short: %d bytes", len(data))
+		return false, "", nil, malformed("port forward response too short: %d bytes", len(data))
 	}
 
 	offset := 0
@@ -532,7 +855,7 @@ func UnpackPortForwardResponseMessage(data []byte) (success bool, errorMsg strin
 	offset += 2
 	if errorLen > 0 {
 		if offset+int(errorLen) > len(data) {
-			return false, "", nil, fmt.Errorf("invalid error length")
+			return false, "", nil, malformed("invalid error length")
 		}
 		errorMsg = string(data[offset : offset+int(errorLen)])
 		offset += int(errorLen)
@@ -540,16 +863,19 @@ func UnpackPortForwardResponseMessage(data []byte) (success bool, errorMsg strin
 
 	// Extract status count
 	if offset+2 > len(data) {
-		return false, "", nil, fmt.Errorf("missing status count")
+		return false, "", nil, malformed("missing status count")
 	}
 	statusCount := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
+	if int(statusCount)*portForwardStatusSize > len(data)-offset {
+		return false, "", nil, malformed("status count %d exceeds the message", statusCount)
+	}
 
 	// Extract status list
 	statuses = make([]PortForwardStatus, statusCount)
 	for i := 0; i < int(statusCount); i++ {
 		if offset+3 > len(data) {
-			return false, "", nil, fmt.Errorf("invalid status data")
+			return false, "", nil, malformed("invalid status data")
 		}
 		statuses[i].Port = int(binary.BigEndian.Uint16(data[offset:]))
 		offset += 2
@@ -561,18 +887,20 @@ func UnpackPortForwardResponseMessage(data []byte) (success bool, errorMsg strin
 }
 
 // --- Authentication request messages ---
-// Format: [version:1][type:1][clientID_length:2][clientID:N][groupID_length:2][groupID:N][username_length:2][username:N][password_length:2][password:N][groupPassword_length:2][groupPassword:N]
+// Format: [version:1][type:1][clientID_length:2][clientID:N][groupID_length:2][groupID:N][username_length:2][username:N][password_length:2][password:N][groupPassword_length:2][groupPassword:N][clientVersion_length:2][clientVersion:N][identity_length:2][identity:N]
 
 // PackAuthMessage packs authentication request
-func PackAuthMessage(clientID, groupID, username, password, groupPassword string) []byte {
+func PackAuthMessage(clientID, groupID, username, password, groupPassword, clientVersion, identity string) []byte {
 	clientIDBytes := []byte(clientID)
 	groupIDBytes := []byte(groupID)
 	usernameBytes := []byte(username)
 	passwordBytes := []byte(password)
 	groupPasswordBytes := []byte(groupPassword)
+	clientVersionBytes := []byte(clientVersion)
+	identityBytes := []byte(identity)
 
 	// Calculate total length
-	totalLen := 2 + len(clientIDBytes) + 2 + len(groupIDBytes) + 2 + len(usernameBytes) + 2 + len(passwordBytes) + 2 + len(groupPasswordBytes)
+	totalLen := 2 + len(clientIDBytes) + 2 + len(groupIDBytes) + 2 + len(usernameBytes) + 2 + len(passwordBytes) + 2 + len(groupPasswordBytes) + 2 + len(clientVersionBytes) + 2 + len(identityBytes)
 	payload := make([]byte, totalLen)
 
 	offset := 0
@@ -615,14 +943,30 @@ func PackAuthMessage(clientID, groupID, username, password, groupPassword string
 
 	// groupPassword content
 	copy(payload[offset:], groupPasswordBytes)
+	offset += len(groupPasswordBytes)
+
+	// clientVersion length (2 bytes), older gateways ignore the trailing field
+	binary.BigEndian.PutUint16(payload[offset:], uint16(len(clientVersionBytes))) //nolint:gosec // version is always short
+	offset += 2
+
+	// clientVersion content
+	copy(payload[offset:], clientVersionBytes)
+	offset += len(clientVersionBytes)
+
+	// identity length (2 bytes), older gateways ignore the trailing field
+	binary.BigEndian.PutUint16(payload[offset:], uint16(len(identityBytes))) //nolint:gosec // identity proofs are short
+	offset += 2
+
+	// identity content
+	copy(payload[offset:], identityBytes)
 
 	return PackBinaryMessage(BinaryMsgTypeAuth, payload)
 }
 
 // UnpackAuthMessage unpacks authentication request
-func UnpackAuthMessage(data []byte) (clientID, groupID, username, password, groupPassword string, err error) {
+func UnpackAuthMessage(data []byte) (clientID, groupID, username, password, groupPassword, clientVersion, identity string, err error) {
 	if len(data) < 10 {
-		return "", "", "", "", "", fmt.Errorf("auth message too short: %d bytes", len(data))
+		return "", "", "", "", "", "", "", malformed("auth message too short: %d bytes", len(data))
 	}
 
 	offset := 0
@@ -631,59 +975,81 @@ func UnpackAuthMessage(data []byte) (clientID, groupID, username, password, grou
 	clientIDLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(clientIDLen) > len(data) {
-		return "", "", "", "", "", fmt.Errorf("invalid clientID length")
+		return "", "", "", "", "", "", "", malformed("invalid clientID length")
 	}
 	clientID = string(data[offset : offset+int(clientIDLen)])
 	offset += int(clientIDLen)
 
 	// Extract groupID
 	if offset+2 > len(data) {
-		return "", "", "", "", "", fmt.Errorf("missing groupID length")
+		return "", "", "", "", "", "", "", malformed("missing groupID length")
 	}
 	groupIDLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(groupIDLen) > len(data) {
-		return "", "", "", "", "", fmt.Errorf("invalid groupID length")
+		return "", "", "", "", "", "", "", malformed("invalid groupID length")
 	}
 	groupID = string(data[offset : offset+int(groupIDLen)])
 	offset += int(groupIDLen)
 
 	// Extract username
 	if offset+2 > len(data) {
-		return "", "", "", "", "", fmt.Errorf("missing username length")
+		return "", "", "", "", "", "", "", malformed("missing username length")
 	}
 	usernameLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(usernameLen) > len(data) {
-		return "", "", "", "", "", fmt.Errorf("invalid username length")
+		return "", "", "", "", "", "", "", malformed("invalid username length")
 	}
 	username = string(data[offset : offset+int(usernameLen)])
 	offset += int(usernameLen)
 
 	// Extract password
 	if offset+2 > len(data) {
-		return "", "", "", "", "", fmt.Errorf("missing password length")
+		return "", "", "", "", "", "", "", malformed("missing password length")
 	}
 	passwordLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(passwordLen) > len(data) {
-		return "", "", "", "", "", fmt.Errorf("invalid password length")
+		return "", "", "", "", "", "", "", malformed("invalid password length")
 	}
 	password = string(data[offset : offset+int(passwordLen)])
 	offset += int(passwordLen)
 
 	// Extract groupPassword
 	if offset+2 > len(data) {
-		return "", "", "", "", "", fmt.Errorf("missing groupPassword length")
+		return "", "", "", "", "", "", "", malformed("missing groupPassword length")
 	}
 	groupPasswordLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(groupPasswordLen) > len(data) {
-		return "", "", "", "", "", fmt.Errorf("invalid groupPassword length")
+		return "", "", "", "", "", "", "", malformed("invalid groupPassword length")
 	}
 	groupPassword = string(data[offset : offset+int(groupPasswordLen)])
+	offset += int(groupPasswordLen)
+
+	// Extract optional clientVersion, older clients don't send it
+	if offset+2 <= len(data) {
+		clientVersionLen := binary.BigEndian.Uint16(data[offset:])
+		offset += 2
+		if offset+int(clientVersionLen) > len(data) {
+			return "", "", "", "", "", "", "", malformed("invalid clientVersion length")
+		}
+		clientVersion = string(data[offset : offset+int(clientVersionLen)])
+		offset += int(clientVersionLen)
+	}
 
-	return clientID, groupID, username, password, groupPassword, nil
+	// Extract optional identity proof, older clients and clients without an identity key don't send it
+	if offset+2 <= len(data) {
+		identityLen := binary.BigEndian.Uint16(data[offset:])
+		offset += 2
+		if offset+int(identityLen) > len(data) {
+			return "", "", "", "", "", "", "", malformed("invalid identity length")
+		}
+		identity = string(data[offset : offset+int(identityLen)])
+	}
+
+	return clientID, groupID, username, password, groupPassword, clientVersion, identity, nil
 }
 
 // --- Authentication response messages ---
@@ -721,7 +1087,7 @@ func PackAuthResponseMessage(status, reason string) []byte {
 // UnpackAuthResponseMessage unpacks authentication response
 func UnpackAuthResponseMessage(data []byte) (status, reason string, err error) {
 	if len(data) < 4 {
-		return "", "", fmt.Errorf("auth response too short: %d bytes", len(data))
+		return "", "", malformed("auth response too short: %d bytes", len(data))
 	}
 
 	offset := 0
@@ -730,19 +1096,19 @@ func UnpackAuthResponseMessage(data []byte) (status, reason string, err error) {
 	statusLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(statusLen) > len(data) {
-		return "", "", fmt.Errorf("invalid status length")
+		return "", "", malformed("invalid status length")
 	}
 	status = string(data[offset : offset+int(statusLen)])
 	offset += int(statusLen)
 
 	// Extract reason
 	if offset+2 > len(data) {
-		return "", "", fmt.Errorf("missing reason length")
+		return "", "", malformed("missing reason length")
 	}
 	reasonLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(reasonLen) > len(data) {
-		return "", "", fmt.Errorf("invalid reason length")
+		return "", "", malformed("invalid reason length")
 	}
 	reason = string(data[offset : offset+int(reasonLen)])
 
@@ -775,7 +1141,7 @@ func PackErrorMessage(errorMsg string) []byte {
 // UnpackErrorMessage unpacks error message
 func UnpackErrorMessage(data []byte) (errorMsg string, err error) {
 	if len(data) < 2 {
-		return "", fmt.Errorf("error message too short: %d bytes", len(data))
+		return "", malformed("error message too short: %d bytes", len(data))
 	}
 
 	offset := 0
@@ -784,9 +1150,165 @@ func UnpackErrorMessage(data []byte) (errorMsg string, err error) {
 	errorLen := binary.BigEndian.Uint16(data[offset:])
 	offset += 2
 	if offset+int(errorLen) > len(data) {
-		return "", fmt.Errorf("invalid error message length")
+		return "", malformed("invalid error message length")
 	}
 	errorMsg = string(data[offset : offset+int(errorLen)])
 
 	return errorMsg, nil
 }
+
+// --- Heartbeat messages ---
+// Format: [version:1][type:1][telemetry:N]
+// The telemetry is a JSON document so fields can be added without a protocol change
+
+// maxHeartbeatSize bounds the telemetry payload
+const maxHeartbeatSize = 64 * 1024
+
+// PackHeartbeatMessage packs heartbeat message
+func PackHeartbeatMessage(telemetry []byte) []byte {
+	return PackBinaryMessage(BinaryMsgTypeHeartbeat, telemetry)
+}
+
+// UnpackHeartbeatMessage unpacks heartbeat message
+func UnpackHeartbeatMessage(data []byte) (telemetry []byte, err error) {
+	if len(data) > maxHeartbeatSize {
+		return nil, fmt.Errorf("%w: heartbeat of %d bytes", ErrMessageTooLarge, len(data))
+	}
+	return data, nil
+}
+
+// --- Report messages ---
+// Format: [version:1][type:1][report:N]
+// The report is a JSON document of activity a client recorded while disconnected
+
+// maxReportSize bounds the report payload, clients split larger spools into several reports
+const maxReportSize = 1024 * 1024
+
+// PackReportMessage packs report message
+func PackReportMessage(report []byte) []byte {
+	return PackBinaryMessage(BinaryMsgTypeReport, report)
+}
+
+// UnpackReportMessage unpacks report message
+func UnpackReportMessage(data []byte) (report []byte, err error) {
+	if len(data) > maxReportSize {
+		return nil, fmt.Errorf("%w: report of %d bytes", ErrMessageTooLarge, len(data))
+	}
+	return data, nil
+}
+
+// --- Capabilities messages ---
+// Format: [version:1][type:1][capabilities:N]
+// The capabilities are a JSON document so fields can be added without a protocol change
+
+// maxCapabilitiesSize bounds the capabilities payload
+const maxCapabilitiesSize = 4 * 1024
+
+// PackCapabilitiesMessage packs capabilities message
+func PackCapabilitiesMessage(caps *Capabilities) ([]byte, error) {
+	payload, err := json.Marshal(caps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode capabilities: %v", err)
+	}
+	return PackBinaryMessage(BinaryMsgTypeCapabilities, payload), nil
+}
+
+// UnpackCapabilitiesMessage unpacks capabilities message
+func UnpackCapabilitiesMessage(data []byte) (*Capabilities, error) {
+	if len(data) > maxCapabilitiesSize {
+		return nil, fmt.Errorf("%w: capabilities of %d bytes", ErrMessageTooLarge, len(data))
+	}
+	caps := &Capabilities{}
+	if err := json.Unmarshal(data, caps); err != nil {
+		return nil, malformed("invalid capabilities message: %v", err)
+	}
+	return caps, nil
+}
+
+// --- Draining messages ---
+// Format: [version:1][type:1][timeout_ms:4]
+// Sent by a stopping client, timeout is how long it still serves its in-flight connections
+
+// PackDrainingMessage packs draining message
+func PackDrainingMessage(timeout time.Duration) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, connectTimeoutMillis(timeout))
+	return PackBinaryMessage(BinaryMsgTypeDraining, payload)
+}
+
+// UnpackDrainingMessage unpacks draining message
+func UnpackDrainingMessage(data []byte) (time.Duration, error) {
+	if len(data) < 4 {
+		return 0, malformed("invalid draining message: too short")
+	}
+	return time.Duration(binary.BigEndian.Uint32(data)) * time.Millisecond, nil
+}
+
+// --- Peer connection request messages ---
+// Format: [version:1][type:1][connID:20][network_length:2][network:N][address_length:2][address:N][groupID_length:2][groupID:N][groupPassword_length:2][groupPassword:N]
+// Sent by clients asking the gateway to relay a connection to a client of another group
+
+// PackPeerConnectMessage packs peer connection request
+func PackPeerConnectMessage(connID, network, address, groupID, groupPassword string) []byte {
+	if len(connID) > ConnIDSize {
+		connID = connID[:ConnIDSize]
+	}
+	fields := [][]byte{[]byte(network), []byte(address), []byte(groupID), []byte(groupPassword)}
+
+	// Calculate total length
+	totalLen := ConnIDSize
+	for _, field := range fields {
+		totalLen += 2 + len(field)
+	}
+	payload := make([]byte, totalLen)
+
+	// connID (fixed 20 bytes)
+	copy(payload, connID)
+	offset := ConnIDSize
+
+	// length-prefixed fields
+	for _, field := range fields {
+		binary.BigEndian.PutUint16(payload[offset:], uint16(len(field))) //nolint:gosec // fields are always short
+		offset += 2
+		copy(payload[offset:], field)
+		offset += len(field)
+	}
+
+	return PackBinaryMessage(BinaryMsgTypePeerConnect, payload)
+}
+
+// UnpackPeerConnectMessage unpacks peer connection request
+func UnpackPeerConnectMessage(data []byte) (connID, network, address, groupID, groupPassword string, err error) {
+	if len(data) < ConnIDSize {
+		return "", "", "", "", "", malformed("peer connect message too short: %d bytes", len(data))
+	}
+
+	// Extract connID
+	connIDBytes := data[:ConnIDSize]
+	for i, b := range connIDBytes {
+		if b == 0 {
+			connID = string(connIDBytes[:i])
+			break
+		}
+	}
+	if connID == "" {
+		connID = string(connIDBytes)
+	}
+	offset := ConnIDSize
+
+	var fields [4]string
+	for i := range fields {
+		if offset+2 > len(data) {
+			return "", "", "", "", "", malformed("peer connect message truncated")
+		}
+		length := int(binary.BigEndian.Uint16(data[offset:]))
+		offset += 2
+		if offset+length > len(data) {
+			return "", "", "", "", "", malformed("invalid peer connect field length")
+		}
+		fields[i] = string(data[offset : offset+length])
+		offset += length
+	}
+
+	return connID, fields[0], fields[1], fields[2], fields[3], nil
+}
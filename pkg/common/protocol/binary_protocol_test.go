@@ -3,8 +3,11 @@ package protocol
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 )
 
 const (
@@ -163,22 +166,92 @@ func TestConnectMessage(t *testing.T) {
 	}
 }
 
+func TestConnectMessage_Timeout(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{timeout: 0, want: 0},
+		{timeout: 1500 * time.Millisecond, want: 1500 * time.Millisecond},
+		{timeout: 100 * time.Microsecond, want: time.Millisecond}, // Rounded up, not dropped
+	}
+	for _, tt := range tests {
+		_, _, payload, _ := UnpackBinaryHeader(PackConnectMessageWithTimeout(testConnID, "tcp", "example.com:80", tt.timeout))
+		connID, network, address, timeout, err := UnpackConnectMessageWithTimeout(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connID != testConnID || network != "tcp" || address != "example.com:80" || timeout != tt.want {
+			t.Errorf("timeout %v: got %q %q %q %v", tt.timeout, connID, network, address, timeout)
+		}
+	}
+
+	// Older gateways send no timeout field
+	_, _, payload, _ := UnpackBinaryHeader(PackConnectMessage(testConnID, "tcp", "example.com:80"))
+	if _, _, _, timeout, err := UnpackConnectMessageWithTimeout(payload); err != nil || timeout != 0 {
+		t.Errorf("Expected no timeout, got %v, %v", timeout, err)
+	}
+}
+
+func TestConnectMessage_Priority(t *testing.T) {
+	_, _, payload, _ := UnpackBinaryHeader(PackConnectMessageWithPriority(testConnID, "tcp", "example.com:22", 0, 3))
+	connID, _, address, timeout, priority, err := UnpackConnectMessageWithPriority(payload)
+	if err != nil || connID != testConnID || address != "example.com:22" || timeout != 0 || priority != 3 {
+		t.Errorf("Unexpected connect message: %q %q %v %d %v", connID, address, timeout, priority, err)
+	}
+
+	// Older clients read the timeout and ignore the priority
+	if _, _, _, timeout, err := UnpackConnectMessageWithTimeout(payload); err != nil || timeout != 0 {
+		t.Errorf("Expected no timeout, got %v, %v", timeout, err)
+	}
+
+	_, _, payload, _ = UnpackBinaryHeader(PackConnectMessageWithTimeout(testConnID, "tcp", "example.com:22", time.Second))
+	if _, _, _, timeout, priority, err := UnpackConnectMessageWithPriority(payload); err != nil || timeout != time.Second || priority != 0 {
+		t.Errorf("Expected no priority, got %v %d %v", timeout, priority, err)
+	}
+}
+
+func TestConnectMessage_Scope(t *testing.T) {
+	_, _, payload, _ := UnpackBinaryHeader(PackConnectMessageWithScope(testConnID, "tcp", "example.com:80", 0, 0, "3f2a9c"))
+	connID, _, address, timeout, priority, scope, err := UnpackConnectMessageWithScope(payload)
+	if err != nil || connID != testConnID || address != "example.com:80" || timeout != 0 || priority != 0 || scope != "3f2a9c" {
+		t.Errorf("Unexpected connect message: %q %q %v %d %q %v", connID, address, timeout, priority, scope, err)
+	}
+
+	// Older clients read the priority and ignore the scope
+	if _, _, address, _, priority, err := UnpackConnectMessageWithPriority(payload); err != nil || address != "example.com:80" || priority != 0 {
+		t.Errorf("Expected no priority, got %q %d %v", address, priority, err)
+	}
+
+	_, _, payload, _ = UnpackBinaryHeader(PackConnectMessageWithPriority(testConnID, "tcp", "example.com:80", time.Second, 2))
+	if _, _, _, timeout, priority, scope, err := UnpackConnectMessageWithScope(payload); err != nil || timeout != time.Second || priority != 2 || scope != "" {
+		t.Errorf("Expected no scope, got %v %d %q %v", timeout, priority, scope, err)
+	}
+
+	// A scope length past the end is malformed
+	if _, _, _, _, _, _, err := UnpackConnectMessageWithScope(append(payload, 8)); err == nil {
+		t.Error("Expected truncated scope to be rejected")
+	}
+}
+
 func TestConnectResponseMessage(t *testing.T) {
 	tests := []struct {
-		name     string
-		connID   string
-		success  bool
-		errorMsg string
+		name      string
+		connID    string
+		success   bool
+		errorMsg  string
+		errorCode string
 	}{
-		{"success", testConnID, true, ""},
-		{"failure", "d115k314nsj2he328ae1", false, "connection refused"},
-		{"long error", "d115k314nsj2he328ae2", false, "Very long error message that describes what went wrong in detail"},
+		{"success", testConnID, true, "", ""},
+		{"failure", "d115k314nsj2he328ae1", false, "connection refused", ""},
+		{"long error", "d115k314nsj2he328ae2", false, "Very long error message that describes what went wrong in detail", ""},
+		{"error code", "d115k314nsj2he328ae3", false, "Connection denied - host 'example.com:80' is forbidden", "target_forbidden"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// 打包
-			packed := PackConnectResponseMessage(tt.connID, tt.success, tt.errorMsg)
+			packed := PackConnectResponseMessageWithCode(tt.connID, tt.success, tt.errorMsg, tt.errorCode)
 
 			// 解包
 			_, msgType, payload, _ := UnpackBinaryHeader(packed)
@@ -186,10 +259,18 @@ func TestConnectResponseMessage(t *testing.T) {
 				t.Errorf("Wrong message type: %d", msgType)
 			}
 
-			connID, success, errorMsg, err := UnpackConnectResponseMessage(payload)
+			connID, success, errorMsg, errorCode, err := UnpackConnectResponseMessageWithCode(payload)
 			if err != nil {
 				t.Fatal(err)
 			}
+			if errorCode != tt.errorCode {
+				t.Errorf("Error code mismatch: %q != %q", errorCode, tt.errorCode)
+			}
+
+			// Gateways that predate error codes ignore the trailing code
+			if _, _, legacyMsg, err := UnpackConnectResponseMessage(payload); err != nil || legacyMsg != tt.errorMsg {
+				t.Errorf("Legacy unpack returned %q, %v", legacyMsg, err)
+			}
 
 			if connID != tt.connID {
 				t.Errorf("ConnID mismatch: %q != %q", connID, tt.connID)
@@ -206,6 +287,20 @@ func TestConnectResponseMessage(t *testing.T) {
 	}
 }
 
+func TestConnectResponseRetryAfter(t *testing.T) {
+	packed := PackConnectResponseMessageWithRetry(testConnID, false, "connect rate limit reached", "client_busy", 1500*time.Millisecond)
+	_, _, payload, _ := UnpackBinaryHeader(packed)
+
+	_, _, errorMsg, errorCode, retryAfter, err := UnpackConnectResponseMessageWithRetry(payload)
+	if err != nil || errorCode != "client_busy" || retryAfter != 1500*time.Millisecond {
+		t.Errorf("Unpacked code %q and retry delay %v, %v", errorCode, retryAfter, err)
+	}
+	// Gateways that predate retry delays still get the error and its code
+	if _, _, legacyMsg, legacyCode, err := UnpackConnectResponseMessageWithCode(payload); err != nil || legacyMsg != errorMsg || legacyCode != errorCode {
+		t.Errorf("Legacy unpack returned %q, %q, %v", legacyMsg, legacyCode, err)
+	}
+}
+
 func TestCloseMessage(t *testing.T) {
 	connID := testConnID
 
@@ -223,7 +318,7 @@ func TestCloseMessage(t *testing.T) {
 		t.Errorf("Wrong message type: %d", msgType)
 	}
 
-	unpackedConnID, err := UnpackCloseMessage(payload)
+	unpackedConnID, writeOnly, err := UnpackCloseMessage(payload)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -231,6 +326,19 @@ func TestCloseMessage(t *testing.T) {
 	if unpackedConnID != connID {
 		t.Errorf("ConnID mismatch: %q != %q", unpackedConnID, connID)
 	}
+	if writeOnly {
+		t.Error("Expected a full close")
+	}
+
+	// Half-close carries a trailing flag that older peers ignore
+	_, _, payload, _ = UnpackBinaryHeader(PackCloseWriteMessage(connID))
+	unpackedConnID, writeOnly, err = UnpackCloseMessage(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpackedConnID != connID || !writeOnly {
+		t.Errorf("Expected a half-close of %q, got %q (write only: %v)", connID, unpackedConnID, writeOnly)
+	}
 }
 
 func TestPortForwardMessage(t *testing.T) {
@@ -264,6 +372,57 @@ func TestPortForwardMessage(t *testing.T) {
 	}
 }
 
+func TestSignedPortForwardMessage(t *testing.T) {
+	ports := []PortConfig{{RemotePort: 8080, LocalPort: 80, LocalHost: "localhost", Protocol: "tcp"}}
+	signature := bytes.Repeat([]byte{0xAB}, PortForwardSignatureSize)
+	var signedBody []byte
+	packed := PackSignedPortForwardMessage("client", ports, func(body []byte) []byte {
+		signedBody = append([]byte(nil), body...)
+		return signature
+	})
+
+	_, _, payload, _ := UnpackBinaryHeader(packed)
+	clientID, got, body, sig, err := UnpackPortForwardMessageWithSignature(payload)
+	if err != nil || clientID != "client" || !reflect.DeepEqual(got, ports) {
+		t.Fatalf("Unexpected request: %q %v, %v", clientID, got, err)
+	}
+	if !bytes.Equal(body, signedBody) || !bytes.Equal(sig, signature) {
+		t.Errorf("Expected the signed body and signature, got %x %x", body, sig)
+	}
+
+	// Unsigned requests have neither, and other trailing bytes are rejected
+	_, _, payload, _ = UnpackBinaryHeader(PackPortForwardMessage("client", ports))
+	if _, _, body, sig, err := UnpackPortForwardMessageWithSignature(payload); err != nil || body != nil || sig != nil {
+		t.Errorf("Expected an unsigned request, got %x %x, %v", body, sig, err)
+	}
+	if _, _, err := UnpackPortForwardMessage(append(payload, 1, 2, 3)); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected ErrMalformedMessage for trailing bytes, got %v", err)
+	}
+}
+
+func TestPortForwardMessage_AllowedSources(t *testing.T) {
+	ports := []PortConfig{
+		{RemotePort: 3389, LocalPort: 3389, LocalHost: "localhost", Protocol: "tcp", AllowedSources: []string{"203.0.113.0/24", "2001:db8::1"}},
+		{RemotePort: 8080, LocalPort: 80, LocalHost: "localhost", Protocol: "tcp"},
+	}
+	signature := bytes.Repeat([]byte{0xAB}, PortForwardSignatureSize)
+	packed := PackSignedPortForwardMessage("client", ports, func([]byte) []byte { return signature })
+
+	_, _, payload, _ := UnpackBinaryHeader(packed)
+	_, got, _, sig, err := UnpackPortForwardMessageWithSignature(payload)
+	if err != nil || !reflect.DeepEqual(got, ports) || !bytes.Equal(sig, signature) {
+		t.Fatalf("Unexpected request: %v, %x, %v", got, sig, err)
+	}
+
+	// Gateways predating allowed sources see a port count beyond the message
+	if count := binary.BigEndian.Uint16(payload[2+len("client"):]); int(count) <= len(payload) {
+		t.Errorf("Expected the sources flag to exceed the message for older gateways, port count %d", count)
+	}
+	if _, _, err := UnpackPortForwardMessage(payload[:len(payload)-PortForwardSignatureSize-3]); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected ErrMalformedMessage for a truncated request, got %v", err)
+	}
+}
+
 func TestPortForwardResponseMessage(t *testing.T) {
 	success := true
 	errorMsg := ""
@@ -559,3 +718,216 @@ func TestErrorMessageEdgeCases(t *testing.T) {
 		}
 	})
 }
+
+func TestHeartbeatMessage(t *testing.T) {
+	telemetry := []byte(`{"version":"v1.2.3","cpu_percent":12.5}`)
+
+	packed := PackHeartbeatMessage(telemetry)
+	_, msgType, payload, err := UnpackBinaryHeader(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != BinaryMsgTypeHeartbeat {
+		t.Errorf("Wrong message type: %d", msgType)
+	}
+
+	unpacked, err := UnpackHeartbeatMessage(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unpacked, telemetry) {
+		t.Errorf("Telemetry mismatch: %q != %q", unpacked, telemetry)
+	}
+
+	if _, err := UnpackHeartbeatMessage(make([]byte, maxHeartbeatSize+1)); err == nil {
+		t.Error("Expected error for oversized heartbeat")
+	}
+}
+
+func TestAuthMessageClientVersion(t *testing.T) {
+	packed := PackAuthMessage("client-1", "group-1", "user", "pass", "group-pass", "v1.2.3", "v1.proof")
+	_, _, payload, err := UnpackBinaryHeader(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID, _, _, _, groupPassword, clientVersion, identity, err := UnpackAuthMessage(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientID != "client-1" || groupPassword != "group-pass" || clientVersion != "v1.2.3" || identity != "v1.proof" {
+		t.Errorf("Unexpected auth fields: %q %q %q %q", clientID, groupPassword, clientVersion, identity)
+	}
+
+	// Clients before identity proofs end the message after the version
+	withoutIdentity := payload[:len(payload)-2-len("v1.proof")]
+	_, _, _, _, _, clientVersion, identity, err = UnpackAuthMessage(withoutIdentity)
+	if err != nil || clientVersion != "v1.2.3" || identity != "" {
+		t.Errorf("Expected auth message without identity, got %q %q: %v", clientVersion, identity, err)
+	}
+
+	// Older clients end the message after the group password
+	legacy := withoutIdentity[:len(withoutIdentity)-2-len("v1.2.3")]
+	_, _, _, _, groupPassword, clientVersion, _, err = UnpackAuthMessage(legacy)
+	if err != nil || groupPassword != "group-pass" || clientVersion != "" {
+		t.Errorf("Expected legacy auth message without version, got %q %q: %v", groupPassword, clientVersion, err)
+	}
+}
+
+func TestPeerConnectMessage(t *testing.T) {
+	msg := PackPeerConnectMessage(testConnID, "tcp", "10.1.0.5:22", "site-b", "secret")
+	_, msgType, payload, err := UnpackBinaryHeader(msg)
+	if err != nil || msgType != BinaryMsgTypePeerConnect {
+		t.Fatalf("Unexpected header: 0x%02x, %v", msgType, err)
+	}
+	connID, network, address, groupID, password, err := UnpackPeerConnectMessage(payload)
+	if err != nil || connID != testConnID || network != "tcp" || address != "10.1.0.5:22" || groupID != "site-b" || password != "secret" {
+		t.Errorf("Unexpected peer connect: %q %q %q %q %q %v", connID, network, address, groupID, password, err)
+	}
+	if _, _, _, _, _, err := UnpackPeerConnectMessage(payload[:len(payload)-1]); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+}
+
+func TestDrainingMessage(t *testing.T) {
+	_, msgType, payload, err := UnpackBinaryHeader(PackDrainingMessage(30 * time.Second))
+	if err != nil || msgType != BinaryMsgTypeDraining {
+		t.Fatalf("Unexpected header: 0x%02x, %v", msgType, err)
+	}
+	if timeout, err := UnpackDrainingMessage(payload); err != nil || timeout != 30*time.Second {
+		t.Errorf("Unexpected draining timeout: %v, %v", timeout, err)
+	}
+	if _, err := UnpackDrainingMessage(payload[:2]); err == nil {
+		t.Error("Expected an error for a truncated message")
+	}
+}
+
+func TestReportMessage(t *testing.T) {
+	report := []byte(`{"records":[]}`)
+	_, msgType, payload, err := UnpackBinaryHeader(PackReportMessage(report))
+	if err != nil || msgType != BinaryMsgTypeReport {
+		t.Fatalf("Unexpected header: 0x%02x, %v", msgType, err)
+	}
+	if got, err := UnpackReportMessage(payload); err != nil || string(got) != string(report) {
+		t.Errorf("Unexpected report: %q, %v", got, err)
+	}
+	if _, err := UnpackReportMessage(make([]byte, maxReportSize+1)); err == nil {
+		t.Error("Expected an error for an oversized report")
+	}
+}
+
+func TestCapabilitiesMessage(t *testing.T) {
+	msg, err := PackCapabilitiesMessage(&Capabilities{SupportsUnix: true, MaxConns: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, msgType, payload, err := UnpackBinaryHeader(msg)
+	if err != nil || msgType != BinaryMsgTypeCapabilities {
+		t.Fatalf("Unexpected header: 0x%02x, %v", msgType, err)
+	}
+	caps, err := UnpackCapabilitiesMessage(payload)
+	if err != nil || caps.SupportsUDP || !caps.SupportsUnix || caps.MaxConns != 50 {
+		t.Errorf("Unexpected capabilities: %+v, %v", caps, err)
+	}
+	if caps.Supports("udp") || caps.Supports("udp6") || !caps.Supports("tcp") || !caps.Supports("unix") {
+		t.Errorf("Unexpected network support of %+v", caps)
+	}
+	if !(*Capabilities)(nil).Supports("udp") {
+		t.Error("Expected clients without capabilities to support every network")
+	}
+	if _, err := UnpackCapabilitiesMessage([]byte("{")); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected ErrMalformedMessage, got %v", err)
+	}
+}
+
+func TestProtocolViolations(t *testing.T) {
+	if _, _, _, err := UnpackBinaryHeader(make([]byte, MaxMessageSize+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+	if _, _, _, err := UnpackBinaryHeader([]byte{BinaryProtocolVersion + 1, BinaryMsgTypeData}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, _, err := UnpackDataMessage([]byte("short")); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected ErrMalformedMessage, got %v", err)
+	}
+
+	// A port count far beyond the message is rejected before allocating the ports
+	msg := []byte{0, 1, 'c', 0, 0}
+	binary.BigEndian.PutUint16(msg[3:], 65535)
+	if _, _, err := UnpackPortForwardMessage(msg); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected ErrMalformedMessage for an oversized port count, got %v", err)
+	}
+	msg = []byte{1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg[3:], 65535)
+	if _, _, _, err := UnpackPortForwardResponseMessage(msg); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected ErrMalformedMessage for an oversized status count, got %v", err)
+	}
+
+	if err := CheckMessageSize(MaxMessageSize); err != nil {
+		t.Errorf("Expected a message of MaxMessageSize to be accepted, got %v", err)
+	}
+	if IsProtocolViolation(errors.New("connection reset")) {
+		t.Error("Expected transport errors not to be protocol violations")
+	}
+}
+
+// unpackAny runs the parser of the message type on the payload, like the gateway and client do
+func unpackAny(msgType byte, data []byte) error {
+	var err error
+	switch msgType {
+	case BinaryMsgTypeData:
+		_, _, err = UnpackDataMessage(data)
+	case BinaryMsgTypeConnect:
+		_, _, _, _, _, _, err = UnpackConnectMessageWithScope(data)
+	case BinaryMsgTypeConnectResponse:
+		_, _, _, _, err = UnpackConnectResponseMessageWithCode(data)
+	case BinaryMsgTypeClose:
+		_, _, err = UnpackCloseMessage(data)
+	case BinaryMsgTypePortForward:
+		_, _, err = UnpackPortForwardMessage(data)
+	case BinaryMsgTypePortForwardResp:
+		_, _, _, err = UnpackPortForwardResponseMessage(data)
+	case BinaryMsgTypeAuth:
+		_, _, _, _, _, _, _, err = UnpackAuthMessage(data)
+	case BinaryMsgTypeAuthResponse:
+		_, _, err = UnpackAuthResponseMessage(data)
+	case BinaryMsgTypeError:
+		_, err = UnpackErrorMessage(data)
+	case BinaryMsgTypeHeartbeat:
+		_, err = UnpackHeartbeatMessage(data)
+	case BinaryMsgTypeReport:
+		_, err = UnpackReportMessage(data)
+	case BinaryMsgTypeDraining:
+		_, err = UnpackDrainingMessage(data)
+	case BinaryMsgTypePeerConnect:
+		_, _, _, _, _, err = UnpackPeerConnectMessage(data)
+	}
+	return err
+}
+
+func FuzzUnpackBinaryMessage(f *testing.F) {
+	f.Add(PackDataMessage(testConnID, []byte("payload")))
+	f.Add(PackConnectMessageWithPriority(testConnID, "tcp", "example.com:443", 5*time.Second, 1))
+	f.Add(PackConnectResponseMessageWithCode(testConnID, false, "refused", "dial_failed"))
+	f.Add(PackCloseWriteMessage(testConnID))
+	f.Add(PackPortForwardMessage("client", []PortConfig{{RemotePort: 8080, LocalPort: 80, LocalHost: "localhost", Protocol: "tcp"}}))
+	f.Add(PackPortForwardResponseMessage(true, "", []PortForwardStatus{{Port: 8080, Success: true}}))
+	f.Add(PackAuthMessage("client", "group", "user", "pass", "group-pass", "v1.0.0", "identity"))
+	f.Add(PackAuthResponseMessage("ok", ""))
+	f.Add(PackErrorMessage("error"))
+	f.Add(PackHeartbeatMessage([]byte(`{}`)))
+	f.Add(PackDrainingMessage(time.Second))
+	f.Add(PackPeerConnectMessage(testConnID, "tcp", "example.com:443", "group", "group-pass"))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		_, msgType, data, err := UnpackBinaryHeader(msg)
+		if err != nil {
+			if !IsProtocolViolation(err) {
+				t.Fatalf("Header error is not a protocol violation: %v", err)
+			}
+			return
+		}
+		if err := unpackAny(msgType, data); err != nil && !IsProtocolViolation(err) {
+			t.Fatalf("Error unpacking message type 0x%02x is not a protocol violation: %v", msgType, err)
+		}
+	})
+}
@@ -1,6 +1,9 @@
 package protocol
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // Message type constants
 const (
@@ -8,9 +11,15 @@ const (
 	MsgTypeConnectResponse = "connect_response"
 	MsgTypeData            = "data"
 	MsgTypeClose           = "close"
+	MsgTypeCloseWrite      = "close_write" // Half-close, the sender finished writing but still reads
 	MsgTypePortForwardReq  = "port_forward_request"
 	MsgTypePortForwardResp = "port_forward_response"
 	MsgTypeError           = "error"
+	MsgTypeHeartbeat       = "heartbeat"
+	MsgTypePeerConnect     = "peer_connect" // Client asks the gateway to relay a connection to another group
+	MsgTypeDraining        = "draining"     // Client is shutting down, the gateway stops routing to it
+	MsgTypeReport          = "report"       // Activity a client spooled while disconnected
+	MsgTypeCapabilities    = "capabilities" // Networks and connection limit a client supports
 )
 
 // Protocol constants
@@ -19,6 +28,93 @@ const (
 	ProtocolUDP = "udp"
 )
 
+// Capabilities are advertised by clients that cannot serve every kind of connection. Gateways
+// route UDP and Unix socket connections only to clients supporting them, and none beyond
+// MaxConns. Clients that never advertised are assumed to support everything.
+type Capabilities struct {
+	SupportsUDP  bool `json:"supports_udp"`
+	SupportsUnix bool `json:"supports_unix"`
+	MaxConns     int  `json:"max_conns"` // Simultaneous connections, 0 = unlimited
+}
+
+// Supports reports whether connections of network can be dialed, nil capabilities support all
+func (c *Capabilities) Supports(network string) bool {
+	if c == nil {
+		return true
+	}
+	switch {
+	case strings.HasPrefix(network, ProtocolUDP):
+		return c.SupportsUDP
+	case strings.HasPrefix(network, "unix"):
+		return c.SupportsUnix
+	}
+	return true
+}
+
+// Reserved tunnel addresses for client-side services. Proxy users cannot dial them,
+// only the gateway admin API can.
+const (
+	// FileServiceHost is the virtual host of the client file transfer service
+	FileServiceHost = "anyproxy-files.internal"
+	// FileServiceAddress is the dial address of the client file transfer service
+	FileServiceAddress = FileServiceHost + ":80"
+	// ExecServiceHost is the virtual host of the client remote exec service
+	ExecServiceHost = "anyproxy-exec.internal"
+	// ExecServiceAddress is the dial address of the client remote exec service
+	ExecServiceAddress = ExecServiceHost + ":80"
+	// UpdateServiceHost is the virtual host of the client self-update service
+	UpdateServiceHost = "anyproxy-update.internal"
+	// UpdateServiceAddress is the dial address of the client self-update service
+	UpdateServiceAddress = UpdateServiceHost + ":80"
+	// PolicyServiceHost is the virtual host of the client service receiving policy packs
+	PolicyServiceHost = "anyproxy-policy.internal"
+	// PolicyServiceAddress is the dial address of the client policy service
+	PolicyServiceAddress = PolicyServiceHost + ":80"
+	// DiagServiceHost is the virtual host of the client tunnel diagnostics service
+	DiagServiceHost = "anyproxy-diag.internal"
+	// DiagServiceAddress is the dial address of the client tunnel diagnostics service
+	DiagServiceAddress = DiagServiceHost + ":80"
+)
+
+// PacketConnID is the connection ID of data messages carrying IP packets of TUN mode. It is
+// no valid xid, and peers without TUN mode drop data of unknown connections. An empty packet
+// announces a client in TUN mode to the gateway.
+const PacketConnID = "tun"
+
+// Remote exec service protocol
+const (
+	// ExecShellUpgrade is the HTTP Upgrade protocol used to open an interactive shell
+	ExecShellUpgrade = "anyproxy-shell"
+	// ExecExitCodeTrailer carries the exit code of a remote command
+	ExecExitCodeTrailer = "X-Exit-Code"
+	// ExecTruncatedTrailer reports whether the remote command output was truncated
+	ExecTruncatedTrailer = "X-Output-Truncated"
+)
+
+// Tunnel diagnostics service protocol. The gateway starts a connection with one command line:
+// "echo" writes every byte back, "discard <n>" reads n bytes and answers their count as a line,
+// "source <n>" writes n bytes, "mtu" answers the path MTU toward the gateway as a JSON line.
+const (
+	DiagCommandEcho    = "echo"
+	DiagCommandDiscard = "discard"
+	DiagCommandSource  = "source"
+	DiagCommandMTU     = "mtu"
+	// MaxDiagBytes caps the bytes of a discard or source command
+	MaxDiagBytes = 64 << 20
+)
+
+// DiagMTUResult answers the mtu command of the tunnel diagnostics service
+type DiagMTUResult struct {
+	PathMTU int    `json:"path_mtu,omitempty"`
+	Target  string `json:"target"` // Gateway host the path was probed to
+	Error   string `json:"error,omitempty"`
+}
+
+// IsReservedServiceHost reports whether host belongs to a client-side service
+func IsReservedServiceHost(host string) bool {
+	return host == FileServiceHost || host == ExecServiceHost || host == UpdateServiceHost || host == PolicyServiceHost || host == DiagServiceHost
+}
+
 // Scheme constants
 const (
 	SchemeHTTPS = "https"
@@ -27,10 +123,13 @@ const (
 
 // Transport type constants
 const (
-	TransportTypeGRPC      = "grpc"
-	TransportTypeWebSocket = "websocket"
-	TransportTypeQUIC      = "quic"
-	TransportTypeDefault   = TransportTypeGRPC
+	TransportTypeGRPC         = "grpc"
+	TransportTypeWebSocket    = "websocket"
+	TransportTypeQUIC         = "quic"
+	TransportTypeWebTransport = "webtransport"
+	TransportTypeKCP          = "kcp"
+	TransportTypeMemory       = "memory" // In-process, for embedding and tests
+	TransportTypeDefault      = TransportTypeGRPC
 )
 
 // Timeout configuration
@@ -44,6 +143,12 @@ var (
 	// DefaultWriteTimeout default write timeout
 	DefaultWriteTimeout = 30 * time.Second
 
+	// DefaultCloseGracePeriod is how long a half-closed connection may keep the other direction open
+	DefaultCloseGracePeriod = 60 * time.Second
+
+	// DefaultDrainTimeout is how long a stopping client serves its in-flight connections
+	DefaultDrainTimeout = 30 * time.Second
+
 	// DefaultShutdownTimeout default shutdown timeout
 	DefaultShutdownTimeout = 3 * time.Second
 
@@ -0,0 +1,139 @@
+// Package qos classifies proxied connections into priority classes and shapes the bandwidth
+// they send through the tunnel. When shaping is active, sends of higher classes go first and
+// connections of the same class share the bandwidth by weight.
+package qos
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/common/blocklist"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// Priority is the class of a connection, higher classes are scheduled first
+type Priority uint8
+
+// Priority classes. PriorityUnset is what older gateways send, the client then classifies itself.
+const (
+	PriorityUnset Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+// String returns the configuration name of the class
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return config.QoSPriorityLow
+	case PriorityNormal:
+		return config.QoSPriorityNormal
+	case PriorityHigh:
+		return config.QoSPriorityHigh
+	}
+	return "unset"
+}
+
+// ParsePriority parses a configured priority class
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case config.QoSPriorityLow:
+		return PriorityLow, nil
+	case config.QoSPriorityNormal:
+		return PriorityNormal, nil
+	case config.QoSPriorityHigh:
+		return PriorityHigh, nil
+	}
+	return PriorityUnset, fmt.Errorf("unknown qos priority %q", name)
+}
+
+// Classifier assigns priorities by the QoS rules, the first matching rule wins
+type Classifier struct {
+	rules []rule
+}
+
+// rule is a compiled config.QoSRule
+type rule struct {
+	priority Priority
+	ports    map[int]bool
+	hosts    *blocklist.List
+	users    map[string]bool
+}
+
+// NewClassifier compiles the QoS rules, it returns nil when there are none
+func NewClassifier(cfg config.QoSConfig) (*Classifier, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, nil
+	}
+	c := &Classifier{}
+	for i, r := range cfg.Rules {
+		priority, err := ParsePriority(r.Priority)
+		if err != nil {
+			return nil, fmt.Errorf("qos.rules[%d]: %v", i, err)
+		}
+		compiled := rule{priority: priority}
+		if len(r.Ports) > 0 {
+			compiled.ports = make(map[int]bool, len(r.Ports))
+			for _, port := range r.Ports {
+				compiled.ports[port] = true
+			}
+		}
+		if len(r.Hosts) > 0 {
+			compiled.hosts = blocklist.New()
+			for _, host := range r.Hosts {
+				compiled.hosts.AddLine(host)
+			}
+			if compiled.hosts.Skipped() > 0 {
+				return nil, fmt.Errorf("qos.rules[%d]: invalid host pattern", i)
+			}
+		}
+		if len(r.Users) > 0 {
+			compiled.users = make(map[string]bool, len(r.Users))
+			for _, user := range r.Users {
+				compiled.users[user] = true
+			}
+		}
+		c.rules = append(c.rules, compiled)
+	}
+	return c, nil
+}
+
+// Classify returns the priority of a connection to address by a proxy user. Rules matching
+// users only match when the user is known, i.e. on the gateway. Unmatched connections are normal.
+func (c *Classifier) Classify(address string, users ...string) Priority {
+	if c == nil {
+		return PriorityNormal
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	port, _ := strconv.Atoi(portStr)
+	host = strings.Trim(host, "[]")
+
+	for _, r := range c.rules {
+		if r.ports != nil && !r.ports[port] {
+			continue
+		}
+		if r.hosts != nil && !r.hosts.Match(host) {
+			continue
+		}
+		if r.users != nil && !matchesUser(r.users, users) {
+			continue
+		}
+		return r.priority
+	}
+	return PriorityNormal
+}
+
+func matchesUser(allowed map[string]bool, users []string) bool {
+	for _, user := range users {
+		if user != "" && allowed[user] {
+			return true
+		}
+	}
+	return false
+}
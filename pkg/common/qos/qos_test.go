@@ -0,0 +1,48 @@
+package qos
+
+import (
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestClassifier(t *testing.T) {
+	classifier, err := NewClassifier(config.QoSConfig{Rules: []config.QoSRule{
+		{Priority: config.QoSPriorityHigh, Ports: []int{22, 3389}},
+		{Priority: config.QoSPriorityLow, Hosts: []string{"backup.example.com", "10.20.0.0/16"}},
+		{Priority: config.QoSPriorityHigh, Users: []string{"ops"}},
+		{Priority: config.QoSPriorityLow, Users: []string{"batch"}, Ports: []int{443}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		users   []string
+		want    Priority
+	}{
+		{"bastion.example.com:22", nil, PriorityHigh},
+		{"backup.example.com:22", nil, PriorityHigh}, // First match wins
+		{"s3.backup.example.com:443", nil, PriorityLow},
+		{"10.20.1.5:873", nil, PriorityLow},
+		{"[2001:db8::1]:3389", nil, PriorityHigh},
+		{"example.com:443", []string{"ops", "group-a"}, PriorityHigh},
+		{"example.com:443", []string{"batch"}, PriorityLow},
+		{"example.com:80", []string{"batch"}, PriorityNormal},
+		{"example.com:443", nil, PriorityNormal},
+	}
+	for _, tt := range tests {
+		if got := classifier.Classify(tt.address, tt.users...); got != tt.want {
+			t.Errorf("Classify(%q, %v) = %v, want %v", tt.address, tt.users, got, tt.want)
+		}
+	}
+
+	var none *Classifier
+	if got := none.Classify("example.com:22"); got != PriorityNormal {
+		t.Errorf("Expected connections to be normal without rules, got %v", got)
+	}
+	if _, err := NewClassifier(config.QoSConfig{Rules: []config.QoSRule{{Priority: "urgent"}}}); err == nil {
+		t.Error("Expected an error for an unknown priority")
+	}
+}
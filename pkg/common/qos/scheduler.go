@@ -0,0 +1,322 @@
+package qos
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// ErrStopped is returned to connections waiting for bandwidth when the scheduler stops
+var ErrStopped = errors.New("egress scheduler stopped")
+
+// Scheduler caps the bandwidth sent through tunnels for proxied connections. Sends of higher
+// priority classes go first, and connections of a class share the rest by weight with
+// self-clocked fair queuing: each send gets a virtual finish tag of the connection's previous
+// tag plus bytes/weight and sends are released in tag order as the token bucket allows, so a
+// connection sending a little now and then goes ahead of bulk transfers.
+type Scheduler struct {
+	portWeights map[int]int
+
+	mu      sync.Mutex
+	rate    float64 // Bytes per second, zero when unlimited
+	burst   float64
+	tokens  float64
+	last    time.Time
+	virtual [PriorityHigh + 1]float64 // Finish tag of the last released send by class
+	seq     uint64
+	flows   map[string]*egressFlow
+	queue   egressQueue
+	wake    chan struct{}
+	stopCh  chan struct{}
+	stop    sync.Once
+}
+
+// egressFlow is a connection known to the scheduler
+type egressFlow struct {
+	weight   float64
+	priority Priority
+	finish   float64 // Finish tag of the connection's last send
+}
+
+// egressSend is a send waiting for bandwidth
+type egressSend struct {
+	priority Priority
+	finish   float64
+	seq      uint64 // Breaks ties in arrival order
+	bytes    float64
+	granted  chan struct{}
+	index    int
+}
+
+// NewScheduler creates a scheduler from configuration, returns nil when egress is unlimited
+func NewScheduler(cfg config.EgressConfig) *Scheduler {
+	if cfg.MaxBandwidth <= 0 {
+		return nil
+	}
+	return NewAdjustableScheduler(cfg)
+}
+
+// NewAdjustableScheduler creates a scheduler whose bandwidth can be changed with SetBandwidth.
+// It doesn't hold back sends while the bandwidth is unlimited.
+func NewAdjustableScheduler(cfg config.EgressConfig) *Scheduler {
+	s := &Scheduler{
+		portWeights: cfg.PortWeights,
+		last:        time.Now(),
+		flows:       make(map[string]*egressFlow),
+		wake:        make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+	s.setBandwidth(cfg.MaxBandwidth, cfg.Burst)
+	go s.run()
+
+	logger.Info("Egress bandwidth scheduler enabled", "max_bandwidth", cfg.MaxBandwidth, "burst", int64(s.burst), "port_weights", len(cfg.PortWeights))
+	return s
+}
+
+// SetBandwidth changes the bandwidth and burst in bytes per second, zero bandwidth is unlimited.
+// Waiting sends are released at the new rate.
+func (s *Scheduler) SetBandwidth(maxBandwidth, burst int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.refill(time.Now())
+	s.setBandwidth(maxBandwidth, burst)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setBandwidth sets the rate and burst, s.mu must be held unless the scheduler isn't running.
+// Tokens above the new burst are dropped, a scheduler that was unlimited starts with a full bucket.
+func (s *Scheduler) setBandwidth(maxBandwidth, burst int64) {
+	if burst == 0 {
+		burst = maxBandwidth / 10
+	}
+	if burst < int64(protocol.DefaultBufferSize) {
+		burst = int64(protocol.DefaultBufferSize)
+	}
+	wasUnlimited := s.rate <= 0
+	s.rate = float64(max(maxBandwidth, 0))
+	s.burst = float64(burst)
+	if wasUnlimited || s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+}
+
+// Stop releases waiting connections and stops the scheduler
+func (s *Scheduler) Stop() {
+	if s == nil {
+		return
+	}
+	s.stop.Do(func() { close(s.stopCh) })
+}
+
+// Register adds a connection to a target, its weight is chosen by the target port
+func (s *Scheduler) Register(connID, address string, priority Priority) {
+	if s == nil {
+		return
+	}
+	weight := 1
+	if _, portStr, err := net.SplitHostPort(address); err == nil {
+		if port, err := strconv.Atoi(portStr); err == nil && s.portWeights[port] > 0 {
+			weight = s.portWeights[port]
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if priority == PriorityUnset {
+		priority = PriorityNormal
+	}
+	s.flows[connID] = &egressFlow{weight: float64(weight), priority: priority}
+}
+
+// Unregister removes a connection once it no longer sends
+func (s *Scheduler) Unregister(connID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.flows, connID)
+}
+
+// Wait blocks until n bytes of connID may be sent
+func (s *Scheduler) Wait(ctx context.Context, connID string, n int) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.rate <= 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	send := s.newSend(connID, n)
+
+	// Nothing queued ahead, send right away if the bucket allows
+	s.refill(time.Now())
+	if len(s.queue) == 0 && s.tokens >= send.need(s.burst) {
+		s.grant(send)
+		s.mu.Unlock()
+		return nil
+	}
+	heap.Push(&s.queue, send)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-send.granted:
+		return nil
+	case <-ctx.Done():
+		s.cancel(send)
+		return ctx.Err()
+	case <-s.stopCh:
+		return ErrStopped
+	}
+}
+
+// newSend tags a send of n bytes by connID, s.mu must be held
+func (s *Scheduler) newSend(connID string, n int) *egressSend {
+	flow, ok := s.flows[connID]
+	if !ok {
+		flow = &egressFlow{weight: 1, priority: PriorityNormal}
+		s.flows[connID] = flow
+	}
+	// A connection that was idle starts at the current virtual time rather than catching up
+	start := flow.finish
+	if s.virtual[flow.priority] > start {
+		start = s.virtual[flow.priority]
+	}
+	flow.finish = start + float64(n)/flow.weight
+	s.seq++
+	return &egressSend{priority: flow.priority, finish: flow.finish, seq: s.seq, bytes: float64(n), granted: make(chan struct{})}
+}
+
+// cancel removes a send that is no longer waiting
+func (s *Scheduler) cancel(send *egressSend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if send.index >= 0 && send.index < len(s.queue) && s.queue[send.index] == send {
+		heap.Remove(&s.queue, send.index)
+	}
+}
+
+// run releases queued sends in finish tag order as tokens become available
+func (s *Scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		var delay time.Duration
+		for len(s.queue) > 0 {
+			s.refill(time.Now())
+			head := s.queue[0]
+			need := head.need(s.burst)
+			// Sends queued before the bandwidth became unlimited go right away
+			if s.rate > 0 && s.tokens < need {
+				delay = time.Duration((need - s.tokens) / s.rate * float64(time.Second))
+				break
+			}
+			heap.Pop(&s.queue)
+			s.grant(head)
+		}
+		s.mu.Unlock()
+
+		if delay <= 0 {
+			select {
+			case <-s.wake:
+			case <-s.stopCh:
+				return
+			}
+			continue
+		}
+		// A new send may go ahead of the head, e.g. of an interactive connection
+		timer.Reset(delay)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// refill adds the tokens earned since the last refill, s.mu must be held
+func (s *Scheduler) refill(now time.Time) {
+	s.tokens += now.Sub(s.last).Seconds() * s.rate
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+}
+
+// grant releases a send, s.mu must be held. Sends larger than the burst leave the bucket in debt.
+func (s *Scheduler) grant(send *egressSend) {
+	s.tokens -= send.bytes
+	s.virtual[send.priority] = send.finish
+	close(send.granted)
+}
+
+// need is the number of tokens a send waits for
+func (e *egressSend) need(burst float64) float64 {
+	if e.bytes > burst {
+		return burst
+	}
+	return e.bytes
+}
+
+// egressQueue is a heap of sends by priority class, then finish tag
+type egressQueue []*egressSend
+
+func (q egressQueue) Len() int { return len(q) }
+
+func (q egressQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	if q[i].finish != q[j].finish {
+		return q[i].finish < q[j].finish
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q egressQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *egressQueue) Push(x interface{}) {
+	send := x.(*egressSend)
+	send.index = len(*q)
+	*q = append(*q, send)
+}
+
+func (q *egressQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	send := old[n-1]
+	old[n-1] = nil
+	send.index = -1
+	*q = old[:n-1]
+	return send
+}
@@ -0,0 +1,193 @@
+package qos
+
+import (
+	"container/heap"
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// sendBulk sends chunks for connID until ctx is done and counts the bytes sent
+func sendBulk(ctx context.Context, s *Scheduler, connID string, chunk int, sent *atomic.Int64) {
+	for s.Wait(ctx, connID, chunk) == nil {
+		sent.Add(int64(chunk))
+	}
+}
+
+func TestScheduler_InteractiveAheadOfBulk(t *testing.T) {
+	// 64KB/s, a 32KB bulk chunk takes half a second
+	s := NewScheduler(config.EgressConfig{MaxBandwidth: 64 * 1024, Burst: 32 * 1024})
+	defer s.Stop()
+	s.Register("bulk", "mirror.example.com:443", PriorityNormal)
+	s.Register("ssh", "bastion.example.com:22", PriorityNormal)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var bulkSent atomic.Int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sendBulk(ctx, s, "bulk", 32*1024, &bulkSent)
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	start := time.Now()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if err := s.Wait(ctx, "ssh", 100); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Errorf("Interactive send waited %v behind bulk transfer", elapsed)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The initial burst, the earned bandwidth and the chunk in flight at most
+	if limit := int64(32*1024 + 64*1024*time.Since(start).Seconds() + 32*1024); bulkSent.Load() > limit {
+		t.Errorf("Sent %d bytes, above the cap of %d", bulkSent.Load(), limit)
+	}
+}
+
+func TestScheduler_Weights(t *testing.T) {
+	s := NewScheduler(config.EgressConfig{MaxBandwidth: 1 << 20, PortWeights: map[int]int{22: 3}})
+	s.Stop()
+	s.Register("https", "example.com:443", PriorityNormal)
+	s.Register("ssh", "example.com:22", PriorityNormal)
+
+	// Both connections queue sends faster than they are released
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	connOf := make(map[*egressSend]string)
+	for i := 0; i < 8; i++ {
+		for _, connID := range []string{"https", "ssh"} {
+			send := s.newSend(connID, 4096)
+			connOf[send] = connID
+			heap.Push(&s.queue, send)
+		}
+	}
+	granted := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		granted[connOf[heap.Pop(&s.queue).(*egressSend)]]++
+	}
+
+	if granted["ssh"] != 6 || granted["https"] != 2 {
+		t.Errorf("Expected a 3:1 share for ssh, got %v", granted)
+	}
+}
+
+func TestScheduler_Priority(t *testing.T) {
+	s := NewScheduler(config.EgressConfig{MaxBandwidth: 1 << 20})
+	s.Stop()
+	s.Register("backup", "backup.example.com:873", PriorityLow)
+	s.Register("web", "example.com:443", PriorityNormal)
+	s.Register("ssh", "example.com:22", PriorityHigh)
+
+	// Queued sends of higher classes go first whatever their arrival
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	connOf := make(map[*egressSend]string)
+	for _, connID := range []string{"backup", "web", "ssh", "backup", "web", "ssh"} {
+		send := s.newSend(connID, 1024)
+		connOf[send] = connID
+		heap.Push(&s.queue, send)
+	}
+	var order []string
+	for len(s.queue) > 0 {
+		order = append(order, connOf[heap.Pop(&s.queue).(*egressSend)])
+	}
+	if want := "ssh ssh web web backup backup"; strings.Join(order, " ") != want {
+		t.Errorf("Release order = %v, want %s", order, want)
+	}
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	var disabled *Scheduler
+	if err := disabled.Wait(context.Background(), "conn", 1<<20); err != nil {
+		t.Errorf("Expected an unlimited scheduler not to wait, got %v", err)
+	}
+	if NewScheduler(config.EgressConfig{}) != nil {
+		t.Error("Expected no scheduler without max_bandwidth")
+	}
+
+	s := NewScheduler(config.EgressConfig{MaxBandwidth: 1024})
+	defer s.Stop()
+	// The first send drains the burst, the next one waits
+	if err := s.Wait(context.Background(), "conn", 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Wait(ctx, "conn", 1024); err != context.DeadlineExceeded {
+		t.Errorf("Expected the wait to end with its context, got %v", err)
+	}
+	s.mu.Lock()
+	queued := len(s.queue)
+	s.mu.Unlock()
+	if queued != 0 {
+		t.Errorf("Expected the cancelled send to leave the queue, %d queued", queued)
+	}
+
+	s.Unregister("conn")
+	done := make(chan error, 1)
+	go func() { done <- s.Wait(context.Background(), "other", 1024) }()
+	time.Sleep(20 * time.Millisecond)
+	s.Stop()
+	if err := <-done; err != ErrStopped {
+		t.Errorf("Expected waiting sends to be released on stop, got %v", err)
+	}
+}
+
+func TestScheduler_SetBandwidth(t *testing.T) {
+	s := NewAdjustableScheduler(config.EgressConfig{})
+	defer s.Stop()
+	ctx := context.Background()
+
+	// Unlimited until a bandwidth is set
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := s.Wait(ctx, "bulk", 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Unlimited sends took %v", elapsed)
+	}
+
+	// 64KB/s with a 32KB burst, the second chunk waits half a second
+	s.SetBandwidth(64*1024, 32*1024)
+	if err := s.Wait(ctx, "bulk", 32*1024); err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan time.Time, 1)
+	go func() {
+		_ = s.Wait(ctx, "bulk", 32*1024)
+		granted <- time.Now()
+	}()
+	select {
+	case <-granted:
+		t.Fatal("Send above the new burst was not held back")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Lifting the limit releases the waiting send
+	lifted := time.Now()
+	s.SetBandwidth(0, 0)
+	select {
+	case at := <-granted:
+		if at.Sub(lifted) > 100*time.Millisecond {
+			t.Errorf("Waiting send released %v after the limit was lifted", at.Sub(lifted))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiting send was not released when the limit was lifted")
+	}
+}
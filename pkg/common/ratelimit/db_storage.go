@@ -0,0 +1,303 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Database drivers supported by DBStorage
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// DBConfig holds the database configuration of the rate limit storage
+type DBConfig struct {
+	Driver      string             // Database driver: sqlite or postgres
+	DataSource  string             // Connection string
+	TablePrefix string             // Prefix of the table names, defaults to "ratelimit"
+	Cipher      *encryption.Cipher // Encrypts stored rules and counters when set
+}
+
+// tablePrefixRegex validates table prefixes to prevent SQL injection
+var tablePrefixRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// dbMigrations create and evolve the schema, the schema table records how many were applied.
+// Never edit a released migration, append a new one.
+var dbMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS {prefix}_rules (
+		id INTEGER PRIMARY KEY,
+		rules TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS {prefix}_counters (
+		identifier VARCHAR(255) PRIMARY KEY,
+		month VARCHAR(7) NOT NULL,
+		data TEXT NOT NULL
+	)`,
+}
+
+// DBStorage persists rate limit rules and counters in a SQLite or PostgreSQL database, so
+// daily and monthly counters survive restarts and can be shared by gateways
+type DBStorage struct {
+	db       *sql.DB
+	postgres bool
+	prefix   string
+	cipher   *encryption.Cipher
+}
+
+// NewDBStorage opens the database and migrates the schema to the current version
+func NewDBStorage(config *DBConfig) (*DBStorage, error) {
+	if config.Driver != DriverSQLite && config.Driver != DriverPostgres {
+		return nil, fmt.Errorf("unsupported rate limit storage driver %q", config.Driver)
+	}
+	prefix := config.TablePrefix
+	if prefix == "" {
+		prefix = "ratelimit"
+	}
+	if !tablePrefixRegex.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid table prefix: must contain only letters, numbers, and underscores, and start with a letter or underscore")
+	}
+
+	db, err := sql.Open(config.Driver, config.DataSource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to ping database: %v", err)
+	}
+
+	ds := &DBStorage{db: db, postgres: config.Driver == DriverPostgres, prefix: prefix, cipher: config.Cipher}
+	if err := ds.migrate(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to migrate rate limit schema: %v", err)
+	}
+	if ds.cipher.Enabled() {
+		if err := ds.encryptPlaintextRows(); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to encrypt rate limit storage: %v", err)
+		}
+	}
+	return ds, nil
+}
+
+// query expands the table prefix and, for PostgreSQL, numbers the ? placeholders
+func (ds *DBStorage) query(q string) string {
+	q = strings.ReplaceAll(q, "{prefix}", ds.prefix)
+	if !ds.postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// migrate applies the migrations newer than the recorded schema version, each in a transaction
+func (ds *DBStorage) migrate() error {
+	if _, err := ds.db.Exec(ds.query(`CREATE TABLE IF NOT EXISTS {prefix}_schema (version INTEGER NOT NULL)`)); err != nil {
+		return err
+	}
+	var version int
+	if err := ds.db.QueryRow(ds.query(`SELECT COALESCE(MAX(version), 0) FROM {prefix}_schema`)).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(dbMigrations) {
+		return fmt.Errorf("schema version %d is newer than this gateway supports (%d)", version, len(dbMigrations))
+	}
+
+	for i := version; i < len(dbMigrations); i++ {
+		tx, err := ds.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ds.query(dbMigrations[i])); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(ds.query(`INSERT INTO {prefix}_schema (version) VALUES (?)`), i+1); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		logger.Info("Applied rate limit schema migration", "table_prefix", ds.prefix, "version", i+1)
+	}
+	return nil
+}
+
+// encryptPlaintextRows encrypts the rules and counters stored before encryption was enabled
+func (ds *DBStorage) encryptPlaintextRows() error {
+	var rules string
+	err := ds.db.QueryRow(ds.query(`SELECT rules FROM {prefix}_rules WHERE id = 1`)).Scan(&rules)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case !encryption.IsSealed([]byte(rules)):
+		config, err := ds.LoadRateLimitConfig()
+		if err != nil {
+			return err
+		}
+		if err := ds.SaveRateLimitConfig(config); err != nil {
+			return err
+		}
+	}
+
+	rows, err := ds.db.Query(ds.query(`SELECT data FROM {prefix}_counters`))
+	if err != nil {
+		return err
+	}
+	var plaintext []*Data
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if encryption.IsSealed([]byte(stored)) {
+			continue
+		}
+		var data Data
+		if err := json.Unmarshal([]byte(stored), &data); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		plaintext = append(plaintext, &data)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, data := range plaintext {
+		if err := ds.SaveRateLimitData(data); err != nil {
+			return err
+		}
+	}
+	if len(plaintext) > 0 {
+		logger.Info("Encrypted plain text rate limit counters", "table_prefix", ds.prefix, "count", len(plaintext))
+	}
+	return nil
+}
+
+// seal encodes v as JSON, encrypted when a cipher is set
+func (ds *DBStorage) seal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return ds.cipher.SealString(string(data))
+}
+
+// open decodes a value written by seal
+func (ds *DBStorage) open(stored string, v interface{}) error {
+	data, err := ds.cipher.OpenString(stored)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+// SaveRateLimitConfig stores the rules
+func (ds *DBStorage) SaveRateLimitConfig(config *Config) error {
+	rules, err := ds.seal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode rate limit rules: %v", err)
+	}
+	_, err = ds.db.Exec(ds.query(`INSERT INTO {prefix}_rules (id, rules) VALUES (1, ?)
+		ON CONFLICT (id) DO UPDATE SET rules = excluded.rules`), rules)
+	if err != nil {
+		return fmt.Errorf("failed to save rate limit rules: %v", err)
+	}
+	return nil
+}
+
+// LoadRateLimitConfig returns the stored rules, an empty config when none were saved
+func (ds *DBStorage) LoadRateLimitConfig() (*Config, error) {
+	var rules string
+	err := ds.db.QueryRow(ds.query(`SELECT rules FROM {prefix}_rules WHERE id = 1`)).Scan(&rules)
+	if err == sql.ErrNoRows {
+		return &Config{Rules: make([]*Rule, 0)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rate limit rules: %v", err)
+	}
+	config := &Config{}
+	if err := ds.open(rules, config); err != nil {
+		return nil, fmt.Errorf("failed to decode rate limit rules: %v", err)
+	}
+	if config.Rules == nil {
+		config.Rules = make([]*Rule, 0)
+	}
+	return config, nil
+}
+
+// SaveRateLimitData stores the counters of a limiter
+func (ds *DBStorage) SaveRateLimitData(data *Data) error {
+	stored, err := ds.seal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode rate limit data: %v", err)
+	}
+	_, err = ds.db.Exec(ds.query(`INSERT INTO {prefix}_counters (identifier, month, data) VALUES (?, ?, ?)
+		ON CONFLICT (identifier) DO UPDATE SET month = excluded.month, data = excluded.data`),
+		data.Identifier, monthKey(data.MonthStart), stored)
+	if err != nil {
+		return fmt.Errorf("failed to save rate limit data: %v", err)
+	}
+	return nil
+}
+
+// LoadRateLimitData returns the stored counters of a limiter
+func (ds *DBStorage) LoadRateLimitData(identifier string) (*Data, error) {
+	var stored string
+	err := ds.db.QueryRow(ds.query(`SELECT data FROM {prefix}_counters WHERE identifier = ?`), identifier).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no rate limit data for %s", identifier)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rate limit data: %v", err)
+	}
+	data := &Data{}
+	if err := ds.open(stored, data); err != nil {
+		return nil, fmt.Errorf("failed to decode rate limit data: %v", err)
+	}
+	return data, nil
+}
+
+// CleanupExpiredRateLimitData drops counters of past months, they are reset when loaded anyway
+func (ds *DBStorage) CleanupExpiredRateLimitData() error {
+	result, err := ds.db.Exec(ds.query(`DELETE FROM {prefix}_counters WHERE month <> ?`), monthKey(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to clean up rate limit data: %v", err)
+	}
+	if removed, err := result.RowsAffected(); err == nil && removed > 0 {
+		logger.Debug("Removed expired rate limit counters", "table_prefix", ds.prefix, "count", removed)
+	}
+	return nil
+}
+
+// Close closes the database connection
+func (ds *DBStorage) Close() error {
+	return ds.db.Close()
+}
+
+// monthKey identifies the month of t, in local time like the limiter's month windows
+func monthKey(t time.Time) string {
+	return t.Local().Format("2006-01")
+}
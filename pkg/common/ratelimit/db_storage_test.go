@@ -0,0 +1,108 @@
+//go:build dbtest
+// +build dbtest
+
+package ratelimit
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
+
+	_ "modernc.org/sqlite" // Pure Go SQLite driver (no CGO required)
+)
+
+// Run with: go test -tags=dbtest ./pkg/common/ratelimit/
+func TestDBStorage(t *testing.T) {
+	config := &DBConfig{Driver: DriverSQLite, DataSource: filepath.Join(t.TempDir(), "ratelimit.db")}
+	storage, err := NewDBStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	rule := &Rule{ID: "client-a", Type: "client", Identifier: "client-a", Enabled: true, DailyLimit: 1024}
+	if err := storage.SaveRateLimitConfig(&Config{Rules: []*Rule{rule}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveRateLimitData(&Data{Identifier: "client:client-a", DailyBytes: 256, MonthStart: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveRateLimitData(&Data{Identifier: "client:client-a", DailyBytes: 512, MonthStart: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveRateLimitData(&Data{Identifier: "client:old", MonthStart: now.AddDate(0, -2, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CleanupExpiredRateLimitData(); err != nil {
+		t.Fatal(err)
+	}
+	_ = storage.Close()
+
+	// Reopening keeps the data and doesn't reapply migrations
+	reopened, err := NewDBStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = reopened.Close() }()
+	loaded, err := reopened.LoadRateLimitConfig()
+	if err != nil || len(loaded.Rules) != 1 || loaded.Rules[0].DailyLimit != 1024 {
+		t.Errorf("Unexpected stored config: %+v, %v", loaded, err)
+	}
+	if data, err := reopened.LoadRateLimitData("client:client-a"); err != nil || data.DailyBytes != 512 {
+		t.Errorf("Unexpected stored data: %+v, %v", data, err)
+	}
+	if _, err := reopened.LoadRateLimitData("client:old"); err == nil {
+		t.Error("Expected counters of a past month to be cleaned up")
+	}
+	var version int
+	if err := reopened.db.QueryRow(`SELECT MAX(version) FROM ratelimit_schema`).Scan(&version); err != nil || version != len(dbMigrations) {
+		t.Errorf("Expected schema version %d, got %d (%v)", len(dbMigrations), version, err)
+	}
+}
+
+func TestDBStorage_Encrypted(t *testing.T) {
+	config := &DBConfig{Driver: DriverSQLite, DataSource: filepath.Join(t.TempDir(), "ratelimit.db"), TablePrefix: "limits"}
+	plain, err := NewDBStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.SaveRateLimitData(&Data{Identifier: "client:secret-client", MonthStart: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	_ = plain.Close()
+
+	// Enabling encryption rewrites the plain text rows
+	config.Cipher, err = encryption.New(bytes.Repeat([]byte{7}, encryption.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := NewDBStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = encrypted.Close() }()
+	var stored string
+	if err := encrypted.db.QueryRow(`SELECT data FROM limits_counters`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !encryption.IsSealed([]byte(stored)) {
+		t.Fatalf("Expected an encrypted row, got %q", stored)
+	}
+	if _, err := encrypted.LoadRateLimitData("client:secret-client"); err != nil {
+		t.Errorf("Expected the encrypted data to be readable, got %v", err)
+	}
+}
+
+func TestDBStorage_Query(t *testing.T) {
+	postgres := &DBStorage{prefix: "ratelimit", postgres: true}
+	if got := postgres.query(`UPDATE {prefix}_counters SET data = ? WHERE identifier = ?`); got != `UPDATE ratelimit_counters SET data = $1 WHERE identifier = $2` {
+		t.Errorf("Unexpected PostgreSQL query: %s", got)
+	}
+	sqlite := &DBStorage{prefix: "limits"}
+	if got := sqlite.query(`DELETE FROM {prefix}_counters WHERE month <> ?`); got != `DELETE FROM limits_counters WHERE month <> ?` {
+		t.Errorf("Unexpected SQLite query: %s", got)
+	}
+}
@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// FileStorage persists rate limit rules and counters in a JSON file, encrypted when a cipher is set
+type FileStorage struct {
+	filePath string
+	cipher   *encryption.Cipher
+
+	mu    sync.Mutex
+	state fileState
+}
+
+// fileState is the content of the storage file
+type fileState struct {
+	Config *Config          `json:"config"`
+	Data   map[string]*Data `json:"data"`
+}
+
+// NewFileStorage opens the storage file, it is created on the first save. A plain text file
+// is encrypted when cipher is set.
+func NewFileStorage(filePath string, cipher *encryption.Cipher) (*FileStorage, error) {
+	fs := &FileStorage{
+		filePath: filePath,
+		cipher:   cipher,
+		state:    fileState{Config: &Config{Rules: make([]*Rule, 0)}, Data: make(map[string]*Data)},
+	}
+
+	data, err := os.ReadFile(filePath) //nolint:gosec // path comes from the gateway config
+	switch {
+	case os.IsNotExist(err):
+		return fs, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read rate limit storage: %v", err)
+	}
+	plaintext, err := cipher.Open(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate limit storage: %v", err)
+	}
+	if err := json.Unmarshal(plaintext, &fs.state); err != nil {
+		return nil, fmt.Errorf("invalid rate limit storage %s: %v", filePath, err)
+	}
+	if fs.state.Config == nil {
+		fs.state.Config = &Config{Rules: make([]*Rule, 0)}
+	}
+	if fs.state.Data == nil {
+		fs.state.Data = make(map[string]*Data)
+	}
+
+	if cipher.Enabled() && !encryption.IsSealed(data) {
+		if err := fs.save(); err != nil {
+			return nil, fmt.Errorf("failed to encrypt rate limit storage: %v", err)
+		}
+		logger.Info("Encrypted plain text rate limit storage", "file", filePath)
+	}
+	return fs, nil
+}
+
+// SaveRateLimitConfig stores the rules
+func (fs *FileStorage) SaveRateLimitConfig(config *Config) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.state.Config = config
+	return fs.save()
+}
+
+// LoadRateLimitConfig returns the stored rules
+func (fs *FileStorage) LoadRateLimitConfig() (*Config, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.state.Config, nil
+}
+
+// SaveRateLimitData stores the counters of a limiter
+func (fs *FileStorage) SaveRateLimitData(data *Data) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.state.Data[data.Identifier] = data
+	return fs.save()
+}
+
+// LoadRateLimitData returns the stored counters of a limiter
+func (fs *FileStorage) LoadRateLimitData(identifier string) (*Data, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	data, ok := fs.state.Data[identifier]
+	if !ok {
+		return nil, fmt.Errorf("no rate limit data for %s", identifier)
+	}
+	return data, nil
+}
+
+// CleanupExpiredRateLimitData drops counters of past months, they are reset when loaded anyway
+func (fs *FileStorage) CleanupExpiredRateLimitData() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for identifier, data := range fs.state.Data {
+		if data.MonthStart.Year() != now.Year() || data.MonthStart.Month() != now.Month() {
+			delete(fs.state.Data, identifier)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	return fs.save()
+}
+
+// save writes the storage file atomically, fs.mu must be held
+func (fs *FileStorage) save() error {
+	data, err := json.MarshalIndent(fs.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = fs.cipher.Seal(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fs.filePath), 0o700); err != nil {
+		return err
+	}
+
+	tmpFile := fs.filePath + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, fs.filePath)
+}
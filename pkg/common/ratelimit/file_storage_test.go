@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
+)
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	storage, err := NewFileStorage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	rule := &Rule{ID: "client-a", Type: "client", Identifier: "client-a", Enabled: true, DailyLimit: 1024}
+	if err := storage.SaveRateLimitConfig(&Config{Rules: []*Rule{rule}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveRateLimitData(&Data{Identifier: "client:client-a", DailyBytes: 512, MonthStart: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveRateLimitData(&Data{Identifier: "client:old", MonthStart: now.AddDate(0, -2, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CleanupExpiredRateLimitData(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStorage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := reopened.LoadRateLimitConfig()
+	if err != nil || len(config.Rules) != 1 || config.Rules[0].ID != "client-a" {
+		t.Errorf("Unexpected stored config: %+v, %v", config, err)
+	}
+	if data, err := reopened.LoadRateLimitData("client:client-a"); err != nil || data.DailyBytes != 512 {
+		t.Errorf("Unexpected stored data: %+v, %v", data, err)
+	}
+	if _, err := reopened.LoadRateLimitData("client:old"); err == nil {
+		t.Error("Expected counters of a past month to be cleaned up")
+	}
+}
+
+func TestFileStorage_Encrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	plain, err := NewFileStorage(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.SaveRateLimitData(&Data{Identifier: "client:secret-client", MonthStart: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enabling encryption rewrites the plain text file
+	cipher, err := encryption.New(bytes.Repeat([]byte{7}, encryption.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStorage(path, cipher); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encryption.IsSealed(data) || bytes.Contains(data, []byte("secret-client")) {
+		t.Fatalf("Expected an encrypted storage file, got %q", data)
+	}
+
+	encrypted, err := NewFileStorage(path, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypted.LoadRateLimitData("client:secret-client"); err != nil {
+		t.Errorf("Expected the encrypted data to be readable, got %v", err)
+	}
+	if _, err := NewFileStorage(path, nil); err == nil {
+		t.Error("Expected an error opening encrypted storage without the key")
+	}
+}
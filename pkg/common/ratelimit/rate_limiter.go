@@ -1,10 +1,12 @@
 // Package ratelimit provides rate limiting functionality for AnyProxy.
-// It supports multiple dimensions including client, domain, and global rate limiting.
+// It supports multiple dimensions including client, domain, global, proxy user and source IP
+// rate limiting.
 package ratelimit
 
 import (
 	"fmt"
 	"math"
+	"net/netip"
 	"sync"
 	"time"
 
@@ -28,8 +30,8 @@ type Config struct {
 // Rule rate limiting rule
 type Rule struct {
 	ID         string `json:"id"`
-	Type       string `json:"type"`       // client, domain, global
-	Identifier string `json:"identifier"` // client_id, domain, or "*" for global
+	Type       string `json:"type"`       // client, domain, global, user, ip
+	Identifier string `json:"identifier"` // client_id, domain, group_id/username, IP or CIDR, or "*" for all
 	Enabled    bool   `json:"enabled"`
 
 	// Bandwidth limits
@@ -179,6 +181,61 @@ func (rl *RateLimiter) CheckRateLimit(clientID, domain string, requestSize int64
 	}
 }
 
+// CheckSession checks the user and ip rules for a new proxy session of user from sourceIP.
+// userConns and ipConns are the sessions the user and the IP have open, including this one.
+func (rl *RateLimiter) CheckSession(user, sourceIP string, userConns, ipConns int64) *LimitResult {
+	return rl.checkSession(user, sourceIP, userConns, ipConns, true)
+}
+
+// PeekSession reports what CheckSession would decide for the session, without counting it
+func (rl *RateLimiter) PeekSession(user, sourceIP string, userConns, ipConns int64) *LimitResult {
+	return rl.checkSession(user, sourceIP, userConns, ipConns, false)
+}
+
+// checkSession checks the session rules, counting the session against them when consume is set
+func (rl *RateLimiter) checkSession(user, sourceIP string, userConns, ipConns int64, consume bool) *LimitResult {
+	for _, rule := range rl.getRulesByType("user") {
+		if rule.Identifier == user || rule.Identifier == "*" {
+			limiter := rl.getLimiter("user_"+user, rule)
+			if result := limiter.limit(0, userConns, consume); !result.Allowed {
+				result.LimitType = "user"
+				return result
+			}
+		}
+	}
+
+	if sourceIP != "" {
+		for _, rule := range rl.getRulesByType("ip") {
+			if matchIP(rule.Identifier, sourceIP) {
+				limiter := rl.getLimiter("ip_"+sourceIP, rule)
+				if result := limiter.limit(0, ipConns, consume); !result.Allowed {
+					result.LimitType = "ip"
+					return result
+				}
+			}
+		}
+	}
+
+	return &LimitResult{
+		Allowed: true,
+		Action:  "allow",
+		Reason:  "within limits",
+	}
+}
+
+// matchIP reports whether ip is the identifier of an ip rule: the IP itself, a CIDR containing it or "*"
+func matchIP(identifier, ip string) bool {
+	if identifier == "*" || identifier == ip {
+		return true
+	}
+	prefix, err := netip.ParsePrefix(identifier)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && prefix.Contains(addr.Unmap())
+}
+
 // checkClientLimit checks client-specific rate limits
 func (rl *RateLimiter) checkClientLimit(clientID string, requestSize int64, connCount int64) *LimitResult {
 	rules := rl.getRulesByType("client")
@@ -352,6 +409,11 @@ func (rl *RateLimiter) cleanup() {
 
 // checkLimit checks if request should be rate limited using token bucket algorithm
 func (tbl *TokenBucketLimiter) checkLimit(requestSize int64, connCount int64) *LimitResult {
+	return tbl.limit(requestSize, connCount, true)
+}
+
+// limit checks the request against the rule, taking its tokens and counting it when consume is set
+func (tbl *TokenBucketLimiter) limit(requestSize int64, connCount int64, consume bool) *LimitResult {
 	tbl.mu.Lock()
 	defer tbl.mu.Unlock()
 
@@ -375,7 +437,9 @@ func (tbl *TokenBucketLimiter) checkLimit(requestSize int64, connCount int64) *L
 		}
 
 		// Consume tokens
-		tbl.tokens -= float64(requestSize)
+		if consume {
+			tbl.tokens -= float64(requestSize)
+		}
 	}
 
 	// Check request rate limit
@@ -395,7 +459,9 @@ func (tbl *TokenBucketLimiter) checkLimit(requestSize int64, connCount int64) *L
 			}
 		}
 
-		tbl.requestCount++
+		if consume {
+			tbl.requestCount++
+		}
 	}
 
 	// Check concurrent connection limit
@@ -440,9 +506,11 @@ func (tbl *TokenBucketLimiter) checkLimit(requestSize int64, connCount int64) *L
 	}
 
 	// Update counters
-	tbl.dailyBytes += requestSize
-	tbl.monthlyBytes += requestSize
-	tbl.concurrentConns = connCount
+	if consume {
+		tbl.dailyBytes += requestSize
+		tbl.monthlyBytes += requestSize
+		tbl.concurrentConns = connCount
+	}
 
 	return &LimitResult{
 		Allowed: true,
@@ -972,3 +972,40 @@ func BenchmarkTokenBucketLimiter_CheckLimit(b *testing.B) {
 		limiter.checkLimit(100, 1)
 	}
 }
+
+func TestRateLimiter_CheckSession(t *testing.T) {
+	rl := NewRateLimiter(nil)
+	rl.UpdateConfig(&Config{
+		Rules: []*Rule{
+			{ID: "alice", Type: "user", Identifier: "office/alice", Enabled: true, RequestLimit: 2, RequestWindow: time.Minute, Action: "throttle"},
+			{ID: "lan", Type: "ip", Identifier: "10.0.0.0/8", Enabled: true, ConcurrentLimit: 1, Action: "block"},
+		},
+	})
+
+	// Peeking doesn't count sessions against the request limit
+	for i := 0; i < 3; i++ {
+		if result := rl.PeekSession("office/alice", "192.0.2.1", 1, 1); !result.Allowed {
+			t.Fatalf("Peek %d should be allowed, got %+v", i, result)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if result := rl.CheckSession("office/alice", "192.0.2.1", 1, 1); !result.Allowed {
+			t.Fatalf("Session %d should be allowed, got %+v", i, result)
+		}
+	}
+	result := rl.CheckSession("office/alice", "192.0.2.1", 1, 1)
+	if result.Allowed || result.Action != "throttle" || result.LimitType != "user" || result.RetryAfter <= 0 {
+		t.Errorf("Expected the third session in the window to be throttled, got %+v", result)
+	}
+	if result := rl.CheckSession("office/bob", "192.0.2.1", 1, 1); !result.Allowed {
+		t.Errorf("Other users should not be limited, got %+v", result)
+	}
+
+	if result := rl.CheckSession("office/bob", "10.1.2.3", 1, 1); !result.Allowed {
+		t.Errorf("The first session of the IP should be allowed, got %+v", result)
+	}
+	result = rl.CheckSession("office/bob", "10.1.2.3", 2, 2)
+	if result.Allowed || result.Action != "block" || result.LimitType != "ip" {
+		t.Errorf("Expected a second concurrent session of the IP to be blocked, got %+v", result)
+	}
+}
@@ -0,0 +1,136 @@
+// Package schedule decides whether a time falls in the weekly access windows of a group or user.
+// A window is a set of weekdays and a daily "HH:MM-HH:MM" time range in the schedule's time zone.
+// Ranges ending before they start span midnight and belong to the day they start on.
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays maps day names to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is a set of access windows. A nil or empty Schedule allows every time.
+type Schedule struct {
+	loc     *time.Location
+	windows []window
+}
+
+// window is a daily time range on some weekdays
+type window struct {
+	days       [7]bool
+	start, end time.Duration // Offsets from midnight, equal for whole days
+}
+
+// New creates a Schedule in the IANA time zone, the local time zone when empty
+func New(timezone string) (*Schedule, error) {
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+		}
+	}
+	return &Schedule{loc: loc}, nil
+}
+
+// Add adds a window on days ("mon".."sun" or ranges like "mon-fri", empty for every day) and
+// hours ("HH:MM-HH:MM", empty for the whole day)
+func (s *Schedule) Add(days []string, hours string) error {
+	var w window
+	if len(days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range days {
+		if err := w.addDays(day); err != nil {
+			return err
+		}
+	}
+	if hours != "" {
+		from, to, found := strings.Cut(hours, "-")
+		if !found {
+			return fmt.Errorf("invalid hours %q: expected HH:MM-HH:MM", hours)
+		}
+		var err error
+		if w.start, err = parseClock(from); err != nil {
+			return fmt.Errorf("invalid hours %q: %v", hours, err)
+		}
+		if w.end, err = parseClock(to); err != nil {
+			return fmt.Errorf("invalid hours %q: %v", hours, err)
+		}
+		if w.start == w.end {
+			return fmt.Errorf("invalid hours %q: start equals end", hours)
+		}
+	}
+	s.windows = append(s.windows, w)
+	return nil
+}
+
+// addDays marks a day or a range of days, ranges may wrap around the week like "sat-mon"
+func (w *window) addDays(spec string) error {
+	from, to, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), "-")
+	first, ok := weekdays[from]
+	if !ok {
+		return fmt.Errorf("invalid day %q: expected mon, tue, wed, thu, fri, sat or sun", spec)
+	}
+	last := first
+	if isRange {
+		if last, ok = weekdays[to]; !ok {
+			return fmt.Errorf("invalid day range %q", spec)
+		}
+	}
+	for day := first; ; day = (day + 1) % 7 {
+		w.days[day] = true
+		if day == last {
+			return nil
+		}
+	}
+}
+
+// Allows reports whether t falls in a window
+func (s *Schedule) Allows(t time.Time) bool {
+	if s == nil || len(s.windows) == 0 {
+		return true
+	}
+	t = t.In(s.loc)
+	day := t.Weekday()
+	previous := (day + 6) % 7
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, w := range s.windows {
+		switch {
+		case w.start == w.end:
+			if w.days[day] {
+				return true
+			}
+		case w.start < w.end:
+			if w.days[day] && offset >= w.start && offset < w.end {
+				return true
+			}
+		default:
+			// Spans midnight, the part after midnight belongs to the previous day
+			if (w.days[day] && offset >= w.start) || (w.days[previous] && offset < w.end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseClock parses "HH:MM" into an offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,73 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule_Allows(t *testing.T) {
+	s, err := New("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add([]string{"mon-fri"}, "09:00-18:00"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add([]string{"sat"}, "22:00-02:00"); err != nil {
+		t.Fatal(err)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+
+	tests := []struct {
+		name string
+		time time.Time
+		want bool
+	}{
+		{"monday morning", time.Date(2026, 10, 12, 9, 0, 0, 0, berlin), true},
+		{"monday before work", time.Date(2026, 10, 12, 8, 59, 0, 0, berlin), false},
+		{"friday at the end", time.Date(2026, 10, 16, 18, 0, 0, 0, berlin), false},
+		{"friday in UTC", time.Date(2026, 10, 16, 15, 30, 0, 0, time.UTC), true},
+		{"saturday noon", time.Date(2026, 10, 17, 12, 0, 0, 0, berlin), false},
+		{"saturday night", time.Date(2026, 10, 17, 23, 0, 0, 0, berlin), true},
+		{"after midnight into sunday", time.Date(2026, 10, 18, 1, 0, 0, 0, berlin), true},
+		{"sunday night", time.Date(2026, 10, 18, 23, 0, 0, 0, berlin), false},
+	}
+	for _, tt := range tests {
+		if got := s.Allows(tt.time); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var none *Schedule
+	if !none.Allows(time.Now()) {
+		t.Error("Expected a nil schedule to allow every time")
+	}
+}
+
+func TestSchedule_Add(t *testing.T) {
+	s, _ := New("")
+	if err := s.Add([]string{"sat-mon"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if days := s.windows[0].days; !days[time.Saturday] || !days[time.Sunday] || !days[time.Monday] || days[time.Tuesday] {
+		t.Errorf("Unexpected days of a wrapping range: %v", days)
+	}
+
+	for _, tt := range []struct {
+		days  []string
+		hours string
+	}{
+		{[]string{"someday"}, ""},
+		{[]string{"mon-xyz"}, ""},
+		{nil, "09:00"},
+		{nil, "09:00-25:00"},
+		{nil, "09:00-09:00"},
+	} {
+		if err := s.Add(tt.days, tt.hours); err == nil {
+			t.Errorf("Expected an error for %v %q", tt.days, tt.hours)
+		}
+	}
+	if _, err := New("Mars/Olympus"); err == nil {
+		t.Error("Expected an error for an unknown time zone")
+	}
+}
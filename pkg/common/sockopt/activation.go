@@ -0,0 +1,118 @@
+package sockopt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// unixSocketMode lets the owner and group of the process connect, e.g. a reverse proxy in its group
+const unixSocketMode = 0o660
+
+// listenSocket returns the Unix or systemd socket of a listen address
+func listenSocket(ctx context.Context, address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, config.ListenUnixPrefix); ok {
+		return listenUnix(ctx, path)
+	}
+	return systemdSockets.listener(strings.TrimPrefix(address, config.ListenSystemdPrefix))
+}
+
+// listenUnix listens on a Unix socket, replacing a socket file left by a process that exited
+func listenUnix(ctx context.Context, path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("unix socket path is empty")
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("unix socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale unix socket %s: %w", path, err)
+		}
+		logger.Debug("Removed stale unix socket", "path", path)
+	}
+
+	listener, err := (&net.ListenConfig{}).Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set the mode of unix socket %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// systemdSockets are the sockets passed to the process, systemd starts them at fd 3
+var systemdSockets = &activation{firstFD: 3}
+
+// activation holds the sockets of systemd socket activation by name. The passed descriptors stay
+// open for the life of the process, each listener gets its own duplicate so it can be closed and
+// opened again.
+type activation struct {
+	firstFD int
+	once    sync.Once
+	mu      sync.Mutex
+	files   map[string][]*os.File
+}
+
+// load reads the sockets from LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES and clears them from the
+// environment, child processes such as upgrades must not take them for their own
+func (a *activation) load() {
+	pid, count, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	a.files = make(map[string][]*os.File)
+	if pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return
+	}
+	fdNames := strings.Split(names, ":")
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		a.files[name] = append(a.files[name], os.NewFile(uintptr(a.firstFD+i), name))
+	}
+	logger.Info("Received systemd sockets", "count", n, "names", names)
+}
+
+// listener returns a listener on the socket passed with name, an empty name picks the only socket
+func (a *activation) listener(name string) (net.Listener, error) {
+	a.once.Do(a.load)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	files := a.files[name]
+	if name == "" && len(a.files) == 1 {
+		for _, only := range a.files {
+			files = only
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no systemd socket named %q was passed to the process", name)
+	}
+	if len(files) > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets named %q, give each a FileDescriptorName", len(files), name)
+	}
+	listener, err := net.FileListener(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket %q is not a stream socket: %w", name, err)
+	}
+	return listener, nil
+}
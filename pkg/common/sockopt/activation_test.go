@@ -0,0 +1,99 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sockopt
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListen_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	addr := "unix:" + path
+
+	// A socket file left by a crashed process is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := Listen(context.Background(), "tcp", addr, nil)
+	if err != nil {
+		t.Fatalf("Listen(%s) error = %v", addr, err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != unixSocketMode {
+		t.Errorf("Socket mode = %v, %v, want %o", info.Mode().Perm(), err, unixSocketMode)
+	}
+	if _, err := Listen(context.Background(), "tcp", addr, nil); err == nil {
+		t.Error("Listen() on a socket in use should fail")
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("Read() = %q, %v, want ok", buf, err)
+	}
+}
+
+func TestActivation_Listener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer tcp.Close()
+	file, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File() error = %v", err)
+	}
+	defer file.Close()
+	// The activation owns its descriptor like the ones systemd passes
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("Dup() error = %v", err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+	sockets := &activation{firstFD: fd}
+
+	if _, err := sockets.listener("socks5"); err == nil {
+		t.Error("listener() of a socket not passed should fail")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("Activation variables should be cleared for child processes")
+	}
+	// Each listener is a duplicate, closing one keeps the passed socket
+	for _, name := range []string{"http", ""} {
+		listener, err := sockets.listener(name)
+		if err != nil {
+			t.Fatalf("listener(%q) error = %v", name, err)
+		}
+		if listener.Addr().String() != tcp.Addr().String() {
+			t.Errorf("listener(%q) address = %s, want %s", name, listener.Addr(), tcp.Addr())
+		}
+		_ = listener.Close()
+	}
+}
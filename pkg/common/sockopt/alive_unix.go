@@ -0,0 +1,50 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sockopt
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// CheckAlive reports a failed socket, e.g. reset by the peer or timed out by keepalive probes,
+// without consuming data. Healthy sockets, sockets the peer only finished writing to and
+// connections without a socket return nil.
+func CheckAlive(conn net.Conn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	// Control does not take the read lock, the connection handler may be blocked reading
+	err = raw.Control(func(fd uintptr) {
+		if errno, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR); err != nil {
+			sockErr = err
+			return
+		} else if errno != 0 {
+			sockErr = syscall.Errno(errno)
+			return
+		}
+		// Datagram sockets have no connection to check
+		if sockType, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE); err != nil || sockType != unix.SOCK_STREAM {
+			return
+		}
+		var buf [1]byte
+		_, _, err := unix.Recvfrom(int(fd), buf[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		if err != nil && !errors.Is(err, unix.EAGAIN) && !errors.Is(err, unix.EWOULDBLOCK) && !errors.Is(err, unix.EINTR) {
+			sockErr = err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,15 @@
+package sockopt
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice sets SO_BINDTODEVICE so traffic leaves through the interface
+func bindToDevice(fd uintptr, iface string) error {
+	if err := unix.BindToDevice(int(fd), iface); err != nil {
+		return fmt.Errorf("failed to bind to interface %s: %v", iface, err)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package sockopt
+
+// bindToDevice is a no-op, the interface is selected by binding its source address
+func bindToDevice(_ uintptr, _ string) error {
+	return nil
+}
@@ -0,0 +1,202 @@
+// Package sockopt applies configured TCP/IP socket options to listeners and dialed connections.
+package sockopt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// Listen creates a stream listener with the socket options applied, nil options keep the defaults.
+// Addresses with the unix: or systemd: prefix listen on a Unix socket or take a socket of systemd
+// socket activation instead, the network and socket options don't apply to them.
+func Listen(ctx context.Context, network, address string, opts *config.SocketOptions) (net.Listener, error) {
+	if config.IsSocketListenAddr(address) {
+		return listenSocket(ctx, address)
+	}
+	listener, err := listenConfig(opts).Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.NoDelay != nil {
+		return &noDelayListener{Listener: listener, noDelay: *opts.NoDelay}, nil
+	}
+	return listener, nil
+}
+
+// ListenPacket creates a packet listener with the socket options applied, TCP only options are ignored
+func ListenPacket(ctx context.Context, network, address string, opts *config.SocketOptions) (net.PacketConn, error) {
+	return listenConfig(opts).ListenPacket(ctx, network, address)
+}
+
+// DialContext dials address with the socket options applied
+func DialContext(ctx context.Context, network, address string, opts *config.SocketOptions) (net.Conn, error) {
+	return DialContextFrom(ctx, network, address, opts, "", nil)
+}
+
+// DialContextFrom dials address from a local interface and/or source IP with the socket options applied.
+// Without a source IP the interface's first address of the target's family is used, on Linux
+// the socket is additionally bound to the interface so it egresses there regardless of routes.
+func DialContextFrom(ctx context.Context, network, address string, opts *config.SocketOptions, iface string, source net.IP) (net.Conn, error) {
+	d := &net.Dialer{}
+	if opts != nil {
+		d.KeepAlive, d.KeepAliveConfig = keepAlive(opts)
+		d.Control = control(opts)
+	}
+	if iface != "" {
+		if source == nil {
+			ip, err := InterfaceAddr(iface, isIPv6Target(network, address))
+			if err != nil {
+				return nil, err
+			}
+			source = ip
+		}
+		d.Control = bindControl(d.Control, iface)
+	}
+	if source != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: source}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: source}
+		}
+	}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.NoDelay != nil {
+		setNoDelay(conn, *opts.NoDelay)
+	}
+	return conn, nil
+}
+
+// InterfaceAddr returns the first IPv4 or global IPv6 address of a network interface
+func InterfaceAddr(name string, ipv6 bool) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %v", name, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s addresses: %v", name, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			if !ipv6 {
+				return ip4, nil
+			}
+		} else if ipv6 && !ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP, nil
+		}
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	return nil, fmt.Errorf("interface %s has no %s address", name, family)
+}
+
+// isIPv6Target reports whether a dial goes out over IPv6, host names follow the network suffix
+func isIPv6Target(network, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.To4() == nil
+		}
+	}
+	return strings.HasSuffix(network, "6")
+}
+
+// bindControl chains binding the socket to an interface after an existing control hook
+func bindControl(next func(network, address string, c syscall.RawConn) error, iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if next != nil {
+			if err := next(network, address, c); err != nil {
+				return err
+			}
+		}
+		var bindErr error
+		if err := c.Control(func(fd uintptr) {
+			bindErr = bindToDevice(fd, iface)
+		}); err != nil {
+			return err
+		}
+		return bindErr
+	}
+}
+
+// listenConfig returns the listen config for the socket options
+func listenConfig(opts *config.SocketOptions) *net.ListenConfig {
+	lc := &net.ListenConfig{}
+	if opts != nil {
+		lc.KeepAlive, lc.KeepAliveConfig = keepAlive(opts)
+		lc.Control = control(opts)
+	}
+	return lc
+}
+
+// keepAlive maps the keepalive options onto the net package settings
+func keepAlive(opts *config.SocketOptions) (time.Duration, net.KeepAliveConfig) {
+	switch {
+	case opts.KeepAlive < 0:
+		return -1, net.KeepAliveConfig{}
+	case opts.KeepAlive > 0:
+		return opts.KeepAlive, net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     opts.KeepAlive,
+			Interval: opts.KeepAlive,
+			Count:    opts.KeepAliveCount,
+		}
+	case opts.KeepAliveCount > 0:
+		return 0, net.KeepAliveConfig{Enable: true, Count: opts.KeepAliveCount}
+	}
+	return 0, net.KeepAliveConfig{}
+}
+
+// control returns the raw socket hook setting SO_REUSEPORT and the DSCP mark, nil when neither is set
+func control(opts *config.SocketOptions) func(network, address string, c syscall.RawConn) error {
+	if !opts.ReusePort && opts.DSCP == 0 {
+		return nil
+	}
+	return func(network, _ string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = setSocketOptions(fd, network, opts)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// setNoDelay sets TCP_NODELAY on TCP connections
+func setNoDelay(conn net.Conn, noDelay bool) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetNoDelay(noDelay)
+	}
+}
+
+// noDelayListener sets TCP_NODELAY on accepted connections
+type noDelayListener struct {
+	net.Listener
+	noDelay bool
+}
+
+// Accept waits for the next connection and applies TCP_NODELAY
+func (l *noDelayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	setNoDelay(conn, l.noDelay)
+	return conn, nil
+}
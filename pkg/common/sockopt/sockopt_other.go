@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package sockopt
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// setSocketOptions reports that SO_REUSEPORT and DSCP marking are unavailable on this platform
+func setSocketOptions(_ uintptr, _ string, _ *config.SocketOptions) error {
+	return fmt.Errorf("reuse_port and dscp socket options are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,107 @@
+package sockopt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestKeepAlive(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       config.SocketOptions
+		wantPeriod time.Duration
+		want       net.KeepAliveConfig
+	}{
+		{name: "defaults", opts: config.SocketOptions{}},
+		{name: "disabled", opts: config.SocketOptions{KeepAlive: -1}, wantPeriod: -1},
+		{
+			name:       "interval",
+			opts:       config.SocketOptions{KeepAlive: 30 * time.Second, KeepAliveCount: 4},
+			wantPeriod: 30 * time.Second,
+			want:       net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 30 * time.Second, Count: 4},
+		},
+		{
+			name: "count only",
+			opts: config.SocketOptions{KeepAliveCount: 3},
+			want: net.KeepAliveConfig{Enable: true, Count: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			period, cfg := keepAlive(&tt.opts)
+			if period != tt.wantPeriod || cfg != tt.want {
+				t.Fatalf("keepAlive() = %v, %+v, want %v, %+v", period, cfg, tt.wantPeriod, tt.want)
+			}
+		})
+	}
+}
+
+func TestListen_NoDelay(t *testing.T) {
+	noDelay := false
+	listener, err := Listen(context.Background(), "tcp", "127.0.0.1:0", &config.SocketOptions{NoDelay: &noDelay})
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+	if _, ok := listener.(*noDelayListener); !ok {
+		t.Fatalf("Listen() returned %T, want *noDelayListener", listener)
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestDialContextFrom_SourceIP(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	source := net.IPv4(127, 0, 0, 1)
+	conn, err := DialContextFrom(context.Background(), "tcp4", listener.Addr().String(), nil, "", source)
+	if err != nil {
+		t.Fatalf("DialContextFrom() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if got := conn.LocalAddr().(*net.TCPAddr).IP; !got.Equal(source) {
+		t.Errorf("LocalAddr() = %v, want %v", got, source)
+	}
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		ip, err := InterfaceAddr(ifi.Name, false)
+		if err != nil {
+			t.Fatalf("InterfaceAddr(%s) error = %v", ifi.Name, err)
+		}
+		if !ip.IsLoopback() {
+			t.Errorf("InterfaceAddr(%s) = %v, want a loopback address", ifi.Name, ip)
+		}
+		if _, err := InterfaceAddr("no-such-interface0", false); err == nil {
+			t.Error("Expected error for an unknown interface")
+		}
+		return
+	}
+	t.Skip("no loopback interface")
+}
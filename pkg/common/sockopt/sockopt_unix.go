@@ -0,0 +1,38 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sockopt
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// setSocketOptions sets SO_REUSEPORT and the DSCP mark on a socket before bind or connect
+func setSocketOptions(fd uintptr, network string, opts *config.SocketOptions) error {
+	if opts.ReusePort {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fmt.Errorf("failed to set SO_REUSEPORT: %v", err)
+		}
+	}
+	if opts.DSCP == 0 {
+		return nil
+	}
+	// DSCP occupies the upper six bits of the TOS / traffic class byte
+	tos := opts.DSCP << 2
+	if strings.HasSuffix(network, "6") {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil {
+			return fmt.Errorf("failed to set IPV6_TCLASS: %v", err)
+		}
+		// Dual-stack sockets carry IPv4 traffic marked by IP_TOS, not every platform accepts it
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+		return nil
+	}
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos); err != nil {
+		return fmt.Errorf("failed to set IP_TOS: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sockopt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestListen_ReusePort(t *testing.T) {
+	opts := &config.SocketOptions{ReusePort: true}
+	first, err := Listen(context.Background(), "tcp4", "127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer func() { _ = first.Close() }()
+
+	second, err := Listen(context.Background(), "tcp4", first.Addr().String(), opts)
+	if err != nil {
+		t.Fatalf("second Listen() on %s error = %v", first.Addr(), err)
+	}
+	_ = second.Close()
+}
+
+func TestDialContext_DSCP(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	conn, err := DialContext(context.Background(), "tcp4", listener.Addr().String(), &config.SocketOptions{DSCP: 46})
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		tos, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	// Expedited Forwarding (46) in the upper six bits
+	if tos != 46<<2 {
+		t.Errorf("IP_TOS = %d, want %d", tos, 46<<2)
+	}
+}
+
+func TestCheckAlive(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	dialPair := func() (net.Conn, *net.TCPConn) {
+		conn, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, peer.(*net.TCPConn)
+	}
+
+	conn, peer := dialPair()
+	if err := CheckAlive(conn); err != nil {
+		t.Errorf("Expected an open connection to be alive, got %v", err)
+	}
+	// Pending data is not consumed
+	if _, err := peer.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := CheckAlive(conn); err != nil {
+		t.Errorf("Expected a connection with pending data to be alive, got %v", err)
+	}
+	buf := make([]byte, 1)
+	if n, err := conn.Read(buf); n != 1 || err != nil {
+		t.Errorf("Expected the pending byte to be readable, got %d, %v", n, err)
+	}
+	_ = peer.Close()
+	_ = conn.Close()
+
+	// A reset socket is dead
+	conn, peer = dialPair()
+	defer func() { _ = conn.Close() }()
+	_ = peer.SetLinger(0)
+	_ = peer.Close()
+	time.Sleep(20 * time.Millisecond)
+	if err := CheckAlive(conn); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected a reset connection to be dead, got %v", err)
+	}
+}
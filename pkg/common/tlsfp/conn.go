@@ -0,0 +1,79 @@
+package tlsfp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// maxRecordedBytes bounds the bytes kept while waiting for a complete ClientHello
+const maxRecordedBytes = 64 << 10
+
+// Conn records the first bytes read from a server-side connection until they hold the
+// ClientHello, so the tls.Config callbacks can fingerprint the client. The recording is only
+// read during the handshake, by the goroutine reading the connection.
+type Conn struct {
+	net.Conn
+	recorded  []byte
+	recording bool
+	hello     *ClientHello
+	err       error
+}
+
+// NewConn records the ClientHello read from conn
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, recording: true}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.recording && n > 0 {
+		c.recorded = append(c.recorded, b[:n]...)
+		c.hello, c.err = ParseRecords(c.recorded)
+		if !errors.Is(c.err, errIncomplete) || len(c.recorded) >= maxRecordedBytes {
+			c.recording = false
+			c.recorded = nil
+		}
+	}
+	return n, err
+}
+
+// ClientHello returns the parsed ClientHello, an error when it was malformed or is incomplete
+func (c *Conn) ClientHello() (*ClientHello, error) {
+	if c.hello == nil && c.err == nil {
+		return nil, errIncomplete
+	}
+	return c.hello, c.err
+}
+
+// listener records the ClientHello of accepted connections
+type listener struct {
+	net.Listener
+}
+
+// Listen wraps ln so the ClientHello of its connections can be fingerprinted
+func Listen(ln net.Listener) net.Listener {
+	return &listener{Listener: ln}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// FromHello fingerprints the client of a handshake. ok is false when its connection wasn't
+// recorded, such as QUIC connections, err reports a ClientHello that couldn't be parsed.
+func FromHello(info *tls.ClientHelloInfo) (fp *Fingerprint, ok bool, err error) {
+	conn, isRecorded := info.Conn.(*Conn)
+	if !isRecorded {
+		return nil, false, nil
+	}
+	hello, err := conn.ClientHello()
+	if err != nil {
+		return nil, true, err
+	}
+	return hello.Fingerprint(false), true, nil
+}
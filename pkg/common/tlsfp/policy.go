@@ -0,0 +1,99 @@
+package tlsfp
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Policy logs the fingerprints of the TLS clients of a listener and refuses handshakes by fingerprint
+type Policy struct {
+	name   string // Listener name in logs and metrics
+	config *config.TLSFingerprintConfig
+}
+
+// NewPolicy returns nil when cfg neither logs fingerprints nor has rules
+func NewPolicy(name string, cfg *config.TLSFingerprintConfig) *Policy {
+	if cfg == nil || (!cfg.Log && len(cfg.Block) == 0 && len(cfg.Allow) == 0) {
+		return nil
+	}
+	logger.Info("TLS client fingerprinting enabled", "listener", name, "log", cfg.Log, "block_rules", len(cfg.Block), "allow_rules", len(cfg.Allow))
+	return &Policy{name: name, config: cfg}
+}
+
+// Apply returns a copy of tlsConfig checking the fingerprint of every client, a nil policy
+// returns tlsConfig unchanged. Connections must be wrapped by Listen or NewConn to be fingerprinted.
+func (p *Policy) Apply(tlsConfig *tls.Config) *tls.Config {
+	if p == nil || tlsConfig == nil {
+		return tlsConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	next := tlsConfig.GetConfigForClient
+	tlsConfig.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		if err := p.Check(info); err != nil {
+			return nil, err
+		}
+		if next != nil {
+			return next(info)
+		}
+		return nil, nil
+	}
+	return tlsConfig
+}
+
+// Check logs the fingerprint of a handshake and returns an error when it must be refused
+func (p *Policy) Check(info *tls.ClientHelloInfo) error {
+	remoteAddr := ""
+	if info.Conn != nil && info.Conn.RemoteAddr() != nil {
+		remoteAddr = info.Conn.RemoteAddr().String()
+	}
+
+	fp, recorded, err := FromHello(info)
+	if !recorded {
+		logger.Debug("TLS client not fingerprinted, connection not recorded", "listener", p.name, "remote_addr", remoteAddr)
+		return nil
+	}
+	if err != nil {
+		// Without a fingerprint the client cannot be on the allow list
+		if len(p.config.Allow) > 0 {
+			monitoring.IncrementTLSFingerprintRejections(p.name)
+			logger.Warn("TLS handshake refused, ClientHello could not be fingerprinted", "listener", p.name, "remote_addr", remoteAddr, "err", err)
+			return fmt.Errorf("TLS client fingerprint unavailable: %v", err)
+		}
+		logger.Debug("TLS client could not be fingerprinted", "listener", p.name, "remote_addr", remoteAddr, "err", err)
+		return nil
+	}
+
+	if rule, blocked := p.blocked(fp); blocked {
+		monitoring.IncrementTLSFingerprintRejections(p.name)
+		logger.Warn("TLS handshake refused by client fingerprint", "listener", p.name, "remote_addr", remoteAddr, "server_name", info.ServerName,
+			"ja3", fp.JA3Hash, "ja4", fp.JA4, "rule", rule)
+		return fmt.Errorf("TLS client fingerprint %s is not allowed", fp.JA4)
+	}
+	if p.config.Log {
+		logger.Info("TLS client fingerprint", "listener", p.name, "remote_addr", remoteAddr, "server_name", info.ServerName,
+			"ja3", fp.JA3Hash, "ja4", fp.JA4, "ja3_string", fp.JA3)
+	}
+	return nil
+}
+
+// blocked matches a fingerprint against the rules, rule names the matched block rule
+func (p *Policy) blocked(fp *Fingerprint) (rule string, blocked bool) {
+	for _, rule := range p.config.Block {
+		if fp.Matches(rule) {
+			return rule, true
+		}
+	}
+	if len(p.config.Allow) == 0 {
+		return "", false
+	}
+	for _, rule := range p.config.Allow {
+		if fp.Matches(rule) {
+			return "", false
+		}
+	}
+	return "not allowed", true
+}
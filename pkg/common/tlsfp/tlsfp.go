@@ -0,0 +1,319 @@
+// Package tlsfp fingerprints TLS clients by their ClientHello.
+//
+// JA3 is "version,ciphers,extensions,curves,point_formats" with decimal values joined by
+// "-", identified by its MD5 hash. JA4 is the "a_b_c" fingerprint where a summarizes the
+// protocol, TLS version, SNI, cipher and extension counts and ALPN, b hashes the sorted
+// cipher suites and c the sorted extensions and signature algorithms. GREASE values are
+// ignored by both.
+package tlsfp
+
+import (
+	"crypto/md5" //nolint:gosec // JA3 is defined as an MD5 hash
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TLS wire constants used by the parser
+const (
+	recordTypeHandshake    = 0x16
+	handshakeClientHello   = 0x01
+	recordHeaderLength     = 5
+	handshakeHeaderLength  = 4
+	maxClientHelloLength   = 1 << 16
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+// errIncomplete reports that more bytes are needed to parse the ClientHello
+var errIncomplete = errors.New("incomplete ClientHello")
+
+// ClientHello holds the ClientHello fields that make up the fingerprints
+type ClientHello struct {
+	Version             uint16   // legacy_version of the ClientHello
+	CipherSuites        []uint16 // In the order sent, GREASE removed
+	Extensions          []uint16 // In the order sent, GREASE removed
+	SupportedGroups     []uint16 // GREASE removed
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16 // GREASE removed
+	ServerName          bool     // Whether the SNI extension is present
+	ALPN                []string
+}
+
+// Fingerprint identifies a TLS client
+type Fingerprint struct {
+	JA3     string `json:"ja3"`      // Full JA3 string
+	JA3Hash string `json:"ja3_hash"` // MD5 of the JA3 string
+	JA4     string `json:"ja4"`
+}
+
+// Matches reports whether rule names this fingerprint, as a JA3 hash or a JA4 fingerprint
+func (f *Fingerprint) Matches(rule string) bool {
+	return rule != "" && (strings.EqualFold(rule, f.JA3Hash) || strings.EqualFold(rule, f.JA4))
+}
+
+// isGREASE reports whether v is a reserved GREASE value (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ParseRecords parses the ClientHello from the first TLS records sent by a client
+func ParseRecords(data []byte) (*ClientHello, error) {
+	var msg []byte
+	for {
+		if len(data) < recordHeaderLength {
+			return nil, errIncomplete
+		}
+		if data[0] != recordTypeHandshake {
+			return nil, fmt.Errorf("not a TLS handshake record: type %d", data[0])
+		}
+		length := int(data[3])<<8 | int(data[4])
+		if len(data) < recordHeaderLength+length {
+			return nil, errIncomplete
+		}
+		msg = append(msg, data[recordHeaderLength:recordHeaderLength+length]...)
+		data = data[recordHeaderLength+length:]
+
+		// A large ClientHello spans several records
+		if len(msg) >= handshakeHeaderLength {
+			if msg[0] != handshakeClientHello {
+				return nil, fmt.Errorf("not a ClientHello: handshake type %d", msg[0])
+			}
+			msgLength := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if msgLength > maxClientHelloLength {
+				return nil, fmt.Errorf("ClientHello too large: %d bytes", msgLength)
+			}
+			if len(msg) >= handshakeHeaderLength+msgLength {
+				return ParseClientHello(msg[handshakeHeaderLength : handshakeHeaderLength+msgLength])
+			}
+		}
+	}
+}
+
+// reader reads big-endian fields of a handshake message
+type reader struct {
+	data []byte
+	err  bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err || len(r.data) < n {
+		r.err = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// vector reads a field prefixed by its length in lengthBytes bytes
+func (r *reader) vector(lengthBytes int) *reader {
+	var n int
+	if lengthBytes == 1 {
+		n = int(r.uint8())
+	} else {
+		n = int(r.uint16())
+	}
+	return &reader{data: r.bytes(n), err: r.err}
+}
+
+// uint16s reads a list of 16-bit values, skipping GREASE values when grease is false
+func (r *reader) uint16s(grease bool) []uint16 {
+	var values []uint16
+	for len(r.data) >= 2 {
+		if v := r.uint16(); grease || !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ParseClientHello parses a ClientHello handshake message body, without its handshake header
+func ParseClientHello(body []byte) (*ClientHello, error) {
+	r := &reader{data: body}
+	hello := &ClientHello{Version: r.uint16()}
+	r.bytes(32) // random
+	r.vector(1) // legacy_session_id
+	hello.CipherSuites = r.vector(2).uint16s(false)
+	r.vector(1) // legacy_compression_methods
+	if r.err {
+		return nil, errors.New("malformed ClientHello")
+	}
+
+	extensions := r.vector(2)
+	for len(extensions.data) > 0 && !extensions.err {
+		extType := extensions.uint16()
+		ext := extensions.vector(2)
+		if isGREASE(extType) {
+			continue
+		}
+		hello.Extensions = append(hello.Extensions, extType)
+		switch extType {
+		case extServerName:
+			hello.ServerName = true
+		case extSupportedGroups:
+			hello.SupportedGroups = ext.vector(2).uint16s(false)
+		case extECPointFormats:
+			hello.PointFormats = ext.vector(1).data
+		case extSignatureAlgorithms:
+			hello.SignatureAlgorithms = ext.vector(2).uint16s(true)
+		case extALPN:
+			protos := ext.vector(2)
+			for len(protos.data) > 0 && !protos.err {
+				hello.ALPN = append(hello.ALPN, string(protos.vector(1).data))
+			}
+		case extSupportedVersions:
+			hello.SupportedVersions = ext.vector(1).uint16s(false)
+		}
+	}
+	if extensions.err {
+		return nil, errors.New("malformed ClientHello extensions")
+	}
+	return hello, nil
+}
+
+// Fingerprint computes the JA3 and JA4 fingerprints, quic selects the JA4 QUIC protocol marker
+func (h *ClientHello) Fingerprint(quic bool) *Fingerprint {
+	ja3 := h.JA3()
+	sum := md5.Sum([]byte(ja3)) //nolint:gosec // JA3 is defined as an MD5 hash
+	return &Fingerprint{JA3: ja3, JA3Hash: hex.EncodeToString(sum[:]), JA4: h.JA4(quic)}
+}
+
+// JA3 returns the JA3 string of the ClientHello
+func (h *ClientHello) JA3() string {
+	points := make([]uint16, len(h.PointFormats))
+	for i, p := range h.PointFormats {
+		points[i] = uint16(p)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(h.CipherSuites),
+		joinDecimal(h.Extensions),
+		joinDecimal(h.SupportedGroups),
+		joinDecimal(points),
+	}, ",")
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello
+func (h *ClientHello) JA4(quic bool) string {
+	var a strings.Builder
+	if quic {
+		a.WriteByte('q')
+	} else {
+		a.WriteByte('t')
+	}
+	a.WriteString(ja4Version(h))
+	if h.ServerName {
+		a.WriteByte('d')
+	} else {
+		a.WriteByte('i')
+	}
+	fmt.Fprintf(&a, "%02d%02d", min(len(h.CipherSuites), 99), min(len(h.Extensions), 99))
+	a.WriteString(ja4ALPN(h.ALPN))
+
+	// SNI and ALPN are already part of a
+	var extensions []uint16
+	for _, ext := range h.Extensions {
+		if ext != extServerName && ext != extALPN {
+			extensions = append(extensions, ext)
+		}
+	}
+	c := joinHex(sorted(extensions))
+	if len(h.SignatureAlgorithms) > 0 {
+		c += "_" + joinHex(h.SignatureAlgorithms)
+	}
+	return a.String() + "_" + ja4Hash(h.CipherSuites, joinHex(sorted(h.CipherSuites))) + "_" + ja4Hash(extensions, c)
+}
+
+// ja4Version names the highest offered TLS version
+func ja4Version(h *ClientHello) string {
+	version := h.Version
+	for _, v := range h.SupportedVersions {
+		version = max(version, v)
+	}
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN protocol
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	return hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4Hash returns the truncated SHA-256 of s, or zeros when values is empty
+func ja4Hash(values []uint16, s string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func sorted(values []uint16) []uint16 {
+	values = append([]uint16(nil), values...)
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
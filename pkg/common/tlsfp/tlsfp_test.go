@@ -0,0 +1,240 @@
+package tlsfp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// testExtension is an extension of a crafted ClientHello
+type testExtension struct {
+	typ  uint16
+	data []byte
+}
+
+func u16(values ...uint16) []byte {
+	b := make([]byte, 0, 2*len(values))
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// withLength prefixes data with its length in n bytes
+func withLength(n int, data []byte) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	return append(length[4-n:], data...)
+}
+
+// buildClientHello returns the handshake message of a ClientHello
+func buildClientHello(ciphers []uint16, extensions []testExtension) []byte {
+	body := u16(0x0303)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, withLength(1, nil)...)
+	body = append(body, withLength(2, u16(ciphers...))...)
+	body = append(body, withLength(1, []byte{0})...)
+	var exts []byte
+	for _, ext := range extensions {
+		exts = append(exts, u16(ext.typ)...)
+		exts = append(exts, withLength(2, ext.data)...)
+	}
+	body = append(body, withLength(2, exts)...)
+	return append([]byte{handshakeClientHello}, withLength(3, body)...)
+}
+
+// records splits a handshake message into TLS records of at most size bytes
+func records(msg []byte, size int) []byte {
+	var out []byte
+	for len(msg) > 0 {
+		n := min(size, len(msg))
+		out = append(out, recordTypeHandshake, 0x03, 0x01)
+		out = append(out, withLength(2, msg[:n])...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+func testHello() []byte {
+	return buildClientHello(
+		[]uint16{0x1a1a, 0x1301, 0x1302, 0xc02b},
+		[]testExtension{
+			{typ: 0x2a2a},
+			{typ: extServerName, data: withLength(2, append([]byte{0}, withLength(2, []byte("example.com"))...))},
+			{typ: extSupportedGroups, data: withLength(2, u16(0x3a3a, 0x001d, 0x0017))},
+			{typ: extECPointFormats, data: withLength(1, []byte{0})},
+			{typ: extSignatureAlgorithms, data: withLength(2, u16(0x0403, 0x0804))},
+			{typ: extALPN, data: withLength(2, append(withLength(1, []byte("h2")), withLength(1, []byte("http/1.1"))...))},
+			{typ: extSupportedVersions, data: withLength(1, u16(0x4a4a, 0x0304, 0x0303))},
+		},
+	)
+}
+
+func TestParseRecords(t *testing.T) {
+	msg := testHello()
+	for _, size := range []int{len(msg), 40} {
+		hello, err := ParseRecords(records(msg, size))
+		if err != nil {
+			t.Fatalf("ParseRecords() with %d byte records error = %v", size, err)
+		}
+		fp := hello.Fingerprint(false)
+		if want := "771,4865-4866-49195,0-10-11-13-16-43,29-23,0"; fp.JA3 != want {
+			t.Errorf("JA3 = %q, want %q", fp.JA3, want)
+		}
+		if len(fp.JA3Hash) != 32 {
+			t.Errorf("JA3 hash %q is not an MD5 hash", fp.JA3Hash)
+		}
+
+		parts := strings.Split(fp.JA4, "_")
+		if len(parts) != 3 || parts[0] != "t13d0306h2" {
+			t.Fatalf("JA4 = %q, want prefix t13d0306h2", fp.JA4)
+		}
+		sum := sha256.Sum256([]byte("1301,1302,c02b"))
+		if parts[1] != hex.EncodeToString(sum[:])[:12] {
+			t.Errorf("JA4 cipher hash = %q", parts[1])
+		}
+		sum = sha256.Sum256([]byte("000a,000b,000d,002b_0403,0804"))
+		if parts[2] != hex.EncodeToString(sum[:])[:12] {
+			t.Errorf("JA4 extension hash = %q", parts[2])
+		}
+		if !fp.Matches(strings.ToUpper(fp.JA3Hash)) || !fp.Matches(fp.JA4) || fp.Matches("") {
+			t.Error("Expected the fingerprint to match its JA3 hash and JA4 only")
+		}
+	}
+
+	data := records(msg, 40)
+	if _, err := ParseRecords(data[:len(data)-1]); err != errIncomplete {
+		t.Errorf("Expected a truncated ClientHello to be incomplete, got %v", err)
+	}
+	if _, err := ParseRecords([]byte("GET / HTTP/1.1\r\n")); err == nil || err == errIncomplete {
+		t.Errorf("Expected plain HTTP to be rejected, got %v", err)
+	}
+}
+
+func TestConn_RecordsClientHello(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	conn := NewConn(serverEnd)
+	defer conn.Close()
+
+	data := records(testHello(), 40)
+	go func() {
+		// Written in small pieces, as read from a slow client
+		for len(data) > 0 {
+			n := min(17, len(data))
+			_, _ = clientEnd.Write(data[:n])
+			data = data[n:]
+		}
+	}()
+
+	buf := make([]byte, 16)
+	for {
+		if _, err := conn.ClientHello(); err == nil {
+			break
+		}
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+	}
+	if !conn.hello.ServerName || len(conn.hello.ALPN) != 2 || conn.recorded != nil {
+		t.Errorf("Unexpected recording state: %+v", conn.hello)
+	}
+}
+
+// testTLSConfig returns a server config with a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"gateway.test"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}}, MinVersion: tls.VersionTLS12}
+}
+
+// handshake runs a TLS handshake against a recorded server connection using serverConfig
+func handshake(serverConfig *tls.Config) error {
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer serverEnd.Close()
+
+	go func() {
+		client := tls.Client(clientEnd, &tls.Config{ServerName: "gateway.test", InsecureSkipVerify: true}) //nolint:gosec // test
+		_ = client.Handshake()
+		_ = clientEnd.Close()
+	}()
+	server := tls.Server(NewConn(serverEnd), serverConfig)
+	_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+	return server.Handshake()
+}
+
+func TestPolicy(t *testing.T) {
+	serverConfig := testTLSConfig(t)
+	if NewPolicy("test", &config.TLSFingerprintConfig{}) != nil {
+		t.Error("Expected no policy without logging or rules")
+	}
+
+	// Learn the fingerprint of the Go TLS client
+	var fp *Fingerprint
+	logOnly := NewPolicy("test", &config.TLSFingerprintConfig{Log: true})
+	learn := serverConfig.Clone()
+	learn.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		fp, _, _ = FromHello(info)
+		return nil, nil
+	}
+	if err := handshake(logOnly.Apply(learn)); err != nil || fp == nil {
+		t.Fatalf("Expected the logged handshake to succeed with a fingerprint, err %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		config  config.TLSFingerprintConfig
+		refused bool
+	}{
+		{"blocked by JA4", config.TLSFingerprintConfig{Block: []string{fp.JA4}}, true},
+		{"blocked by JA3", config.TLSFingerprintConfig{Block: []string{fp.JA3Hash}}, true},
+		{"other block rule", config.TLSFingerprintConfig{Block: []string{"00000000000000000000000000000000"}}, false},
+		{"allowed", config.TLSFingerprintConfig{Allow: []string{fp.JA3Hash}}, false},
+		{"not allowed", config.TLSFingerprintConfig{Allow: []string{"00000000000000000000000000000000"}}, true},
+		{"block wins over allow", config.TLSFingerprintConfig{Block: []string{fp.JA4}, Allow: []string{fp.JA4}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshake(NewPolicy("test-"+tt.name, &tt.config).Apply(serverConfig))
+			if (err != nil) != tt.refused {
+				t.Errorf("Handshake error = %v, want refused %v", err, tt.refused)
+			}
+			var rejected int64
+			for _, stats := range monitoring.GetListenerStats() {
+				if stats.Listener == "test-"+tt.name {
+					rejected = stats.RejectedTLSHandshakes
+				}
+			}
+			if tt.refused != (rejected == 1) {
+				t.Errorf("Rejected TLS handshakes = %d, want refused %v", rejected, tt.refused)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Package tun opens TUN interfaces whose IP packets are exchanged over the tunnel, making
+// anyproxy a layer-3 VPN for hosts where applications can't be configured to use a proxy.
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+)
+
+// Interface defaults
+const (
+	DefaultName = "anyproxy0"
+	DefaultMTU  = 1400 // Leaves room for the headers of the tunnel's transport
+)
+
+// Options configures a TUN interface
+type Options struct {
+	Name    string   // Interface name, default DefaultName
+	Address string   // Interface address in CIDR notation
+	MTU     int      // Default DefaultMTU
+	Routes  []string // Prefixes routed into the interface
+	// Addresses kept on their current route when routes, also those set later, cover them,
+	// e.g. the gateway's
+	Bypass []netip.Addr
+}
+
+// Device is an open TUN interface, each Read and Write carries one IP packet
+type Device struct {
+	file   *os.File
+	name   string
+	mtu    int
+	pinned []netip.Prefix
+
+	routesMu sync.Mutex
+	routes   map[netip.Prefix]bool // Routes into the interface
+}
+
+// Open creates and configures a TUN interface. It needs CAP_NET_ADMIN and the ip command,
+// and is only supported on Linux.
+func Open(opts Options) (*Device, error) {
+	if opts.Name == "" {
+		opts.Name = DefaultName
+	}
+	if opts.MTU == 0 {
+		opts.MTU = DefaultMTU
+	}
+	prefix, err := netip.ParsePrefix(opts.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface address %q: %v", opts.Address, err)
+	}
+	routes := make([]netip.Prefix, 0, len(opts.Routes))
+	for _, route := range opts.Routes {
+		p, err := netip.ParsePrefix(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %v", route, err)
+		}
+		routes = append(routes, splitDefault(p.Masked())...)
+	}
+
+	file, name, err := openDevice(opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	d := &Device{file: file, name: name, mtu: opts.MTU, routes: make(map[netip.Prefix]bool, len(routes))}
+	for _, route := range routes {
+		d.routes[route] = true
+	}
+	if len(opts.Bypass) > 0 {
+		for _, addr := range opts.Bypass {
+			pinned, err := pinRoute(addr)
+			if err != nil {
+				_ = d.Close()
+				return nil, fmt.Errorf("failed to keep route to %s: %v", addr, err)
+			}
+			d.pinned = append(d.pinned, pinned)
+		}
+	}
+	if err := configure(name, prefix, opts.MTU, routes); err != nil {
+		_ = d.Close()
+		return nil, fmt.Errorf("failed to configure interface %s: %v", name, err)
+	}
+	return d, nil
+}
+
+// Name returns the interface name
+func (d *Device) Name() string {
+	return d.name
+}
+
+// MTU returns the largest packet the interface carries
+func (d *Device) MTU() int {
+	return d.mtu
+}
+
+// SetRoutes replaces the routes into the interface, adding the missing ones before removing
+// those no longer wanted
+func (d *Device) SetRoutes(prefixes []netip.Prefix) error {
+	want := make(map[netip.Prefix]bool, len(prefixes))
+	for _, p := range prefixes {
+		for _, route := range splitDefault(p.Masked()) {
+			want[route] = true
+		}
+	}
+
+	d.routesMu.Lock()
+	defer d.routesMu.Unlock()
+	for route := range want {
+		if d.routes[route] {
+			continue
+		}
+		if err := addRoute(d.name, route); err != nil {
+			return err
+		}
+		d.routes[route] = true
+	}
+	for route := range d.routes {
+		if want[route] {
+			continue
+		}
+		if err := removeRoute(d.name, route); err != nil {
+			return err
+		}
+		delete(d.routes, route)
+	}
+	return nil
+}
+
+// Read reads the next packet sent into the interface
+func (d *Device) Read(p []byte) (int, error) {
+	return d.file.Read(p)
+}
+
+// Write delivers a packet to the host through the interface
+func (d *Device) Write(p []byte) (int, error) {
+	return d.file.Write(p)
+}
+
+// Close removes the interface, its routes go with it
+func (d *Device) Close() error {
+	for _, prefix := range d.pinned {
+		unpinRoute(prefix)
+	}
+	d.pinned = nil
+	return d.file.Close()
+}
+
+// splitDefault replaces a default route by its two halves, which take precedence over the
+// host's default route without replacing it
+func splitDefault(p netip.Prefix) []netip.Prefix {
+	if p.Bits() != 0 {
+		return []netip.Prefix{p}
+	}
+	if p.Addr().Is4() {
+		return []netip.Prefix{netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1")}
+	}
+	return []netip.Prefix{netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1")}
+}
+
+// Source returns the source address of an IPv4 or IPv6 packet
+func Source(packet []byte) (netip.Addr, bool) {
+	return address(packet, 12, 8)
+}
+
+// Destination returns the destination address of an IPv4 or IPv6 packet
+func Destination(packet []byte) (netip.Addr, bool) {
+	return address(packet, 16, 24)
+}
+
+func address(packet []byte, v4Offset, v6Offset int) (netip.Addr, bool) {
+	if len(packet) == 0 {
+		return netip.Addr{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= 20 {
+			return netip.AddrFrom4([4]byte(packet[v4Offset : v4Offset+4])), true
+		}
+	case 6:
+		if len(packet) >= 40 {
+			return netip.AddrFrom16([16]byte(packet[v6Offset : v6Offset+16])), true
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,108 @@
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// openDevice creates the TUN interface without packet information headers
+func openDevice(name string) (*os.File, string, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open /dev/net/tun: %v", err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, "", fmt.Errorf("invalid interface name %q: %v", name, err)
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		_ = unix.Close(fd)
+		return nil, "", fmt.Errorf("failed to create interface %s: %v", name, err)
+	}
+	// Non-blocking descriptors use the runtime poller, so Close interrupts a pending Read
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, "", fmt.Errorf("failed to set interface %s non-blocking: %v", name, err)
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), ifr.Name(), nil
+}
+
+// configure sets the interface address and MTU, brings it up and adds the routes
+func configure(name string, address netip.Prefix, mtu int, routes []netip.Prefix) error {
+	commands := [][]string{
+		{"link", "set", "dev", name, "mtu", strconv.Itoa(mtu)},
+		{"addr", "add", address.String(), "dev", name},
+		{"link", "set", "dev", name, "up"},
+	}
+	for _, route := range routes {
+		commands = append(commands, routeCommand("replace", name, route))
+	}
+	for _, args := range commands {
+		if _, err := ip(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRoute routes a prefix into the interface
+func addRoute(name string, route netip.Prefix) error {
+	_, err := ip(routeCommand("replace", name, route)...)
+	return err
+}
+
+// removeRoute removes a route into the interface
+func removeRoute(name string, route netip.Prefix) error {
+	_, err := ip(routeCommand("del", name, route)...)
+	return err
+}
+
+func routeCommand(action, name string, route netip.Prefix) []string {
+	return []string{"route", action, route.String(), "dev", name}
+}
+
+// pinRoute adds a host route to addr over its current next hop
+func pinRoute(addr netip.Addr) (netip.Prefix, error) {
+	out, err := ip("route", "get", addr.String())
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	// e.g. "203.0.113.7 via 192.168.1.1 dev eth0 src 192.168.1.20 uid 0"
+	fields := strings.Fields(out)
+	prefix := netip.PrefixFrom(addr, addr.BitLen())
+	args := []string{"route", "replace", prefix.String()}
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "via" || fields[i] == "dev" {
+			args = append(args, fields[i], fields[i+1])
+		}
+	}
+	if _, err := ip(args...); err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix, nil
+}
+
+// unpinRoute removes a host route added by pinRoute
+func unpinRoute(prefix netip.Prefix) {
+	if _, err := ip("route", "del", prefix.String()); err != nil {
+		logger.Warn("Failed to remove pinned route", "prefix", prefix.String(), "err", err)
+	}
+}
+
+func ip(args ...string) (string, error) {
+	out, err := exec.Command("ip", args...).CombinedOutput() // #nosec G204 - arguments are parsed addresses and the interface name
+	if err != nil {
+		return "", fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
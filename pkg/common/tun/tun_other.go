@@ -0,0 +1,33 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+)
+
+var errUnsupported = errors.New("TUN mode is only supported on Linux")
+
+func openDevice(_ string) (*os.File, string, error) {
+	return nil, "", errUnsupported
+}
+
+func configure(_ string, _ netip.Prefix, _ int, _ []netip.Prefix) error {
+	return errUnsupported
+}
+
+func addRoute(_ string, _ netip.Prefix) error {
+	return errUnsupported
+}
+
+func removeRoute(_ string, _ netip.Prefix) error {
+	return errUnsupported
+}
+
+func pinRoute(_ netip.Addr) (netip.Prefix, error) {
+	return netip.Prefix{}, errUnsupported
+}
+
+func unpinRoute(_ netip.Prefix) {}
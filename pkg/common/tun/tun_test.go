@@ -0,0 +1,50 @@
+package tun
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPacketAddresses(t *testing.T) {
+	ipv4 := make([]byte, 20)
+	ipv4[0] = 0x45
+	copy(ipv4[12:], []byte{10, 99, 0, 2})
+	copy(ipv4[16:], []byte{192, 168, 1, 10})
+	if src, ok := Source(ipv4); !ok || src != netip.MustParseAddr("10.99.0.2") {
+		t.Errorf("Unexpected IPv4 source %v", src)
+	}
+	if dst, ok := Destination(ipv4); !ok || dst != netip.MustParseAddr("192.168.1.10") {
+		t.Errorf("Unexpected IPv4 destination %v", dst)
+	}
+
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	src6, dst6 := netip.MustParseAddr("fd00::2"), netip.MustParseAddr("2001:db8::1")
+	copy(ipv6[8:], src6.AsSlice())
+	copy(ipv6[24:], dst6.AsSlice())
+	if src, ok := Source(ipv6); !ok || src != src6 {
+		t.Errorf("Unexpected IPv6 source %v", src)
+	}
+	if dst, ok := Destination(ipv6); !ok || dst != dst6 {
+		t.Errorf("Unexpected IPv6 destination %v", dst)
+	}
+
+	if _, ok := Destination(ipv4[:10]); ok {
+		t.Error("Expected truncated packets to be rejected")
+	}
+	if _, ok := Destination([]byte{0x00}); ok {
+		t.Error("Expected packets of unknown IP versions to be rejected")
+	}
+}
+
+func TestSplitDefault(t *testing.T) {
+	if got := splitDefault(netip.MustParsePrefix("0.0.0.0/0")); len(got) != 2 || got[1] != netip.MustParsePrefix("128.0.0.0/1") {
+		t.Errorf("Unexpected IPv4 default split %v", got)
+	}
+	if got := splitDefault(netip.MustParsePrefix("::/0")); len(got) != 2 || got[1] != netip.MustParsePrefix("8000::/1") {
+		t.Errorf("Unexpected IPv6 default split %v", got)
+	}
+	if got := splitDefault(netip.MustParsePrefix("10.0.0.0/8")); len(got) != 1 {
+		t.Errorf("Expected other routes to be kept, got %v", got)
+	}
+}
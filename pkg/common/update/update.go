@@ -0,0 +1,248 @@
+// Package update implements signed client binary updates pushed by the gateway.
+//
+// The gateway serves binaries described by a manifest. Every binary is signed with an
+// ed25519 key held by the operator, clients only install binaries whose signature
+// verifies against the public key pinned in their configuration.
+package update
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManifestFile is the name of the manifest in the update directory
+const ManifestFile = "manifest.json"
+
+// HTTP headers used when pushing a binary to a client
+const (
+	HeaderVersion   = "X-Update-Version"
+	HeaderPlatform  = "X-Update-Platform"
+	HeaderSHA256    = "X-Update-SHA256"
+	HeaderSignature = "X-Update-Signature"
+)
+
+// Manifest describes the client release served by the gateway
+type Manifest struct {
+	Version  string            `json:"version"`
+	Binaries map[string]Binary `json:"binaries"` // Keyed by platform, e.g. "linux/amd64"
+}
+
+// Binary is a signed client binary for one platform
+type Binary struct {
+	File      string `json:"file"`      // File name relative to the update directory
+	SHA256    string `json:"sha256"`    // Hex encoded SHA-256 of the file
+	Signature string `json:"signature"` // Base64 ed25519 signature, see SignedMessage
+}
+
+// Status is reported by the client update service
+type Status struct {
+	Version       string `json:"version"`
+	Platform      string `json:"platform"`
+	StagedVersion string `json:"staged_version,omitempty"`
+}
+
+// Platform returns the manifest key of an OS and architecture
+func Platform(goos, goarch string) string {
+	return goos + "/" + goarch
+}
+
+// SignedMessage returns the bytes covered by a binary signature. Binding the version and
+// platform prevents a signed binary from being offered as a different release.
+func SignedMessage(version, platform string, digest []byte) []byte {
+	msg := make([]byte, 0, 64+len(version)+len(platform)+len(digest))
+	msg = append(msg, "anyproxy-client-update\x00"...)
+	msg = append(msg, version...)
+	msg = append(msg, 0)
+	msg = append(msg, platform...)
+	msg = append(msg, 0)
+	return append(msg, digest...)
+}
+
+// Sign signs a binary digest and returns the base64 signature
+func Sign(key ed25519.PrivateKey, version, platform string, digest []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedMessage(version, platform, digest)))
+}
+
+// Verify checks a base64 signature of a binary digest
+func Verify(key ed25519.PublicKey, version, platform string, digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	if !ed25519.Verify(key, SignedMessage(version, platform, digest), sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64 ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size: %d bytes", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// ParsePrivateKey decodes a base64 ed25519 private key
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key encoding: %v", err)
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key size: %d bytes", len(key))
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// FileSHA256 returns the SHA-256 digest of a file
+func FileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path) //nolint:gosec // path comes from the operator
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// LoadManifest reads and validates the manifest of an update directory
+func LoadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile)) //nolint:gosec // dir comes from the gateway config
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid update manifest: %v", err)
+	}
+	if manifest.Version == "" {
+		return nil, fmt.Errorf("invalid update manifest: version is required")
+	}
+	for platform, binary := range manifest.Binaries {
+		if binary.File == "" || filepath.Base(binary.File) != binary.File {
+			return nil, fmt.Errorf("invalid update manifest: bad file name for %s", platform)
+		}
+		if _, err := hex.DecodeString(binary.SHA256); err != nil || len(binary.SHA256) != 2*sha256.Size {
+			return nil, fmt.Errorf("invalid update manifest: bad sha256 for %s", platform)
+		}
+	}
+	return &manifest, nil
+}
+
+// SaveManifest writes the manifest of an update directory
+func SaveManifest(dir string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), append(data, '\n'), 0o600)
+}
+
+// CompareVersions compares two "vMAJOR.MINOR.PATCH" versions, suffixes such as
+// "-rc1" or "-3-gabcdef" are ignored. ok is false when either version cannot be parsed.
+func CompareVersions(a, b string) (result int, ok bool) {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+// parseVersion parses the numeric part of a version
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// Window is a daily maintenance window in local time
+type Window struct {
+	start, end time.Duration // Offsets from midnight
+}
+
+// ParseWindow parses a "HH:MM-HH:MM" window, the end may be before the start to span midnight.
+// An empty string returns nil, meaning updates may be applied at any time.
+func ParseWindow(s string) (*Window, error) {
+	if s == "" {
+		return nil, nil
+	}
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid maintenance window %q: expected HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance window %q: %v", s, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance window %q: %v", s, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid maintenance window %q: start equals end", s)
+	}
+	return &Window{start: start, end: end}, nil
+}
+
+// Contains reports whether t falls inside the window, a nil window always contains t
+func (w *Window) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// parseClock parses "HH:MM" into an offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
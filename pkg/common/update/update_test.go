@@ -0,0 +1,81 @@
+package update
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("client binary"))
+	signature := Sign(privateKey, "v1.2.0", "linux/amd64", digest[:])
+
+	if err := Verify(publicKey, "v1.2.0", "linux/amd64", digest[:], signature); err != nil {
+		t.Errorf("Expected valid signature, got %v", err)
+	}
+	// The signature must not be reusable for another version or platform
+	if err := Verify(publicKey, "v1.3.0", "linux/amd64", digest[:], signature); err == nil {
+		t.Error("Expected signature to be bound to the version")
+	}
+	if err := Verify(publicKey, "v1.2.0", "linux/arm64", digest[:], signature); err == nil {
+		t.Error("Expected signature to be bound to the platform")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		result int
+		ok     bool
+	}{
+		{"v1.2.3", "v1.2.3", 0, true},
+		{"v1.10.0", "v1.9.9", 1, true},
+		{"1.2", "v1.2.1", -1, true},
+		{"v2.0.0-rc1", "v1.9.0", 1, true},
+		{"dev", "v1.0.0", 0, false},
+	}
+	for _, tt := range tests {
+		result, ok := CompareVersions(tt.a, tt.b)
+		if result != tt.result || ok != tt.ok {
+			t.Errorf("CompareVersions(%q, %q) = %d, %v; want %d, %v", tt.a, tt.b, result, ok, tt.result, tt.ok)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	window, err := ParseWindow("02:00-04:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !window.Contains(at(2, 0)) || !window.Contains(at(4, 29)) || window.Contains(at(4, 30)) || window.Contains(at(1, 59)) {
+		t.Error("Unexpected result for 02:00-04:30")
+	}
+
+	overnight, err := ParseWindow("23:00-01:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !overnight.Contains(at(23, 30)) || !overnight.Contains(at(0, 30)) || overnight.Contains(at(12, 0)) {
+		t.Error("Unexpected result for window spanning midnight")
+	}
+
+	var always *Window
+	if !always.Contains(at(12, 0)) {
+		t.Error("Expected nil window to always be open")
+	}
+	for _, bad := range []string{"02:00", "25:00-03:00", "03:00-03:00"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("Expected error for window %q", bad)
+		}
+	}
+}
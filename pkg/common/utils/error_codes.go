@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrorCode classifies why a proxied connection failed. Clients report it in connect_response
+// and the proxies return it to users as SOCKS5 reply codes and HTTP statuses.
+type ErrorCode string
+
+// Error codes of failed dials
+const (
+	ErrCodeNoClientAvailable ErrorCode = "no_client_available" // No client of the group is connected
+	ErrCodeTargetForbidden   ErrorCode = "target_forbidden"    // A gateway or client policy denies the target
+	ErrCodeDialTimeout       ErrorCode = "dial_timeout"        // The target did not answer in time
+	ErrCodeQuotaExceeded     ErrorCode = "quota_exceeded"      // The group reached its connection limit, or the connection its transfer limit
+	ErrCodeClientOverloaded  ErrorCode = "client_overloaded"   // The client is at its connection limit
+	ErrCodeClientBusy        ErrorCode = "client_busy"         // The client is at its connect rate limit and asked the gateway to hold off
+	ErrCodeGatewayOverloaded ErrorCode = "gateway_overloaded"  // The gateway sheds load
+	ErrCodeDialFailed        ErrorCode = "dial_failed"         // The client could not reach the target
+)
+
+// CodedError attaches an ErrorCode to an error
+type CodedError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *CodedError) Error() string { return e.Err.Error() }
+
+func (e *CodedError) Unwrap() error { return e.Err }
+
+// WithErrorCode attaches code to err
+func WithErrorCode(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &CodedError{Code: code, Err: err}
+}
+
+// ErrorCodeOf classifies a dial error, errors without a known cause are dial failures
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	switch {
+	case errors.Is(err, ErrGeoBlocked), errors.Is(err, ErrBlocklisted), errors.Is(err, ErrOutsideSchedule):
+		return ErrCodeTargetForbidden
+	case errors.Is(err, ErrGroupConnectionLimit), errors.Is(err, ErrTransferLimit), errors.Is(err, ErrRateLimited):
+		return ErrCodeQuotaExceeded
+	case errors.Is(err, ErrResourceLimit):
+		return ErrCodeGatewayOverloaded
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrCodeDialTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrCodeDialTimeout
+	}
+	return ErrCodeDialFailed
+}
+
+// ErrorCodeFromMessage classifies the error text of clients that don't report a code
+func ErrorCodeFromMessage(msg string) ErrorCode {
+	msg = strings.ToLower(msg)
+	switch {
+	case strings.Contains(msg, "forbidden"), strings.Contains(msg, "denied"):
+		return ErrCodeTargetForbidden
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"), strings.Contains(msg, "deadline exceeded"):
+		return ErrCodeDialTimeout
+	}
+	return ErrCodeDialFailed
+}
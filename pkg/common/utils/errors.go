@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// Limit errors shared between the gateway and the proxy protocols,
+// ErrorCodeOf maps them to the error codes returned to proxy users.
+var (
+	// ErrGroupClientLimit is returned when a group has reached its max_clients limit
+	ErrGroupClientLimit = errors.New("group client limit reached")
+
+	// ErrGroupConnectionLimit is returned when a group has reached its max_connections limit
+	ErrGroupConnectionLimit = errors.New("connection refused: group connection limit reached")
+
+	// ErrTransferLimit is returned when a connection has transferred its max_transfer_bytes
+	ErrTransferLimit = errors.New("connection closed: transfer limit reached")
+
+	// ErrRateLimited is returned when a user or ip rate limit rule blocks a new proxy session
+	ErrRateLimited = errors.New("connection refused: rate limit exceeded")
+)
+
+// ErrGeoBlocked is returned when a Geo-IP rule blocks a dial
+var ErrGeoBlocked = errors.New("connection refused: blocked by geo-ip policy")
+
+// ErrBlocklisted is returned when the dial target is on a blocklist
+var ErrBlocklisted = errors.New("connection refused: target is blocklisted")
+
+// ErrOutsideSchedule is returned when the group or user may not create connections at this time
+var ErrOutsideSchedule = errors.New("connection refused: outside the access schedule")
+
+// ErrResourceLimit is returned when the gateway sheds load because a resource limit is exceeded
+var ErrResourceLimit = errors.New("connection refused: gateway resource limit reached")
+
+// ErrRemoteExecDisabled is returned when remote exec is requested for a client whose group does not allow it
+var ErrRemoteExecDisabled = errors.New("remote exec is not enabled for the client's group")
+
+// IsClosedConn reports whether err means the connection was closed or reset by either side,
+// the normal end of a proxied connection rather than a failure. io.EOF is not included, callers
+// handle it as a half-close.
+func IsClosedConn(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// targetErrnos are the dial errors recognized in the error text clients report
+var targetErrnos = []struct {
+	errno syscall.Errno
+	text  string
+}{
+	{syscall.ECONNREFUSED, "connection refused"},
+	{syscall.ECONNRESET, "connection reset by peer"},
+	{syscall.ENETUNREACH, "network is unreachable"},
+	{syscall.EHOSTUNREACH, "no route to host"},
+	{syscall.ETIMEDOUT, "connection timed out"},
+}
+
+// TargetError is a dial error a client reported for its target. Clients only send the error
+// text, errors.Is matches the syscall error it names (e.g. syscall.ECONNREFUSED) like it does
+// for the dial errors of the gateway itself.
+type TargetError struct {
+	Msg string
+}
+
+func (e *TargetError) Error() string { return e.Msg }
+
+// Is matches the syscall errors named in the error text
+func (e *TargetError) Is(target error) bool {
+	errno, ok := target.(syscall.Errno)
+	if !ok {
+		return false
+	}
+	msg := strings.ToLower(e.Msg)
+	for _, known := range targetErrnos {
+		if known.errno == errno && strings.Contains(msg, known.text) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,13 +3,73 @@
 package utils
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/rs/xid"
 )
 
+// Options of the proxy username routing syntax
+const (
+	UsernameOptionSeparator = "!"          // Separates options from the group and client
+	UsernameClientSeparator = "."          // Separates the pinned client from the group
+	UsernameNoFallback      = "nofallback" // Dials are not retried through other clients
+)
+
 // UserContext user context
 type UserContext struct {
-	Username string
-	GroupID  string
+	Username   string
+	GroupID    string
+	SourceIP   string // IP address of the proxy user, used for source-based routing
+	ClientID   string // Client pinned by the proxy user, matches its ID or configured client_id
+	NoFallback bool   // Failed dials are not retried through other clients of the group
+}
+
+// ParseProxyUsername parses a proxy username of the form group[.client-id][!option...].
+// Group IDs may contain dots themselves, so a context is returned for every split, the
+// whole name first; the caller picks the first one whose group authenticates.
+func ParseProxyUsername(username string) ([]*UserContext, error) {
+	name, options, _ := strings.Cut(username, UsernameOptionSeparator)
+	if name == "" {
+		return nil, fmt.Errorf("empty group in proxy username")
+	}
+	noFallback := false
+	if options != "" {
+		for _, option := range strings.Split(options, UsernameOptionSeparator) {
+			if option != UsernameNoFallback {
+				return nil, fmt.Errorf("unknown proxy username option: %s", option)
+			}
+			noFallback = true
+		}
+	}
+
+	candidates := []*UserContext{{Username: name, GroupID: name, NoFallback: noFallback}}
+	for i := strings.LastIndex(name, UsernameClientSeparator); i > 0; i = strings.LastIndex(name[:i], UsernameClientSeparator) {
+		if i == len(name)-1 {
+			continue
+		}
+		candidates = append(candidates, &UserContext{Username: name[:i], GroupID: name[:i], ClientID: name[i+1:], NoFallback: noFallback})
+	}
+	return candidates, nil
+}
+
+// SourceRouter returns the group serving proxy users that connect from sourceIP without credentials
+type SourceRouter func(sourceIP string) (groupID string, ok bool)
+
+// SourceRoutedProxy is implemented by proxies that can admit users without credentials by source IP
+type SourceRoutedProxy interface {
+	// SetSourceRouter sets the source IP routing, it must be called before Start
+	SetSourceRouter(router SourceRouter)
+}
+
+// GroupSecrets returns the passwords accepted for a group: its own and those of parents it
+// delegates to. Schemes that check a digest rather than the password itself need them.
+type GroupSecrets func(groupID string) []string
+
+// DigestAuthProxy is implemented by proxies that can authenticate users with a password digest
+type DigestAuthProxy interface {
+	// SetGroupSecrets sets the lookup of group passwords, it must be called before Start
+	SetGroupSecrets(secrets GroupSecrets)
 }
 
 // GatewayProxy proxy interface (simplified version - only keeps truly used methods)
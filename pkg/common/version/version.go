@@ -0,0 +1,17 @@
+// Package version holds the build information injected by the Makefile through -ldflags.
+package version
+
+import "fmt"
+
+// Build information, overridden at build time with
+// -X github.com/buhuipao/anyproxy/pkg/common/version.Version=...
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// String returns the version with commit and build time
+func String() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", Version, Commit, BuildTime)
+}
@@ -4,10 +4,27 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/buhuipao/anyproxy/pkg/common/blocklist"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/schedule"
+	"github.com/buhuipao/anyproxy/pkg/common/update"
 )
 
 // Config represents the main configuration
@@ -29,11 +46,64 @@ type LogConfig struct {
 	Compress   bool   `yaml:"compress"`    // whether to compress rotated log files
 }
 
-// ProxyConfig represents the configuration for the proxy
+// ProxyConfig represents the configuration for the proxy. The socks5, http and tuic sections
+// each configure one listener of their type, listeners configures any number of them.
 type ProxyConfig struct {
-	SOCKS5 SOCKS5Config `yaml:"socks5"`
-	HTTP   HTTPConfig   `yaml:"http"`
-	TUIC   TUICConfig   `yaml:"tuic"`
+	SOCKS5    SOCKS5Config    `yaml:"socks5"`
+	HTTP      HTTPConfig      `yaml:"http"`
+	TUIC      TUICConfig      `yaml:"tuic"`
+	Listeners []ProxyListener `yaml:"listeners"` // Further proxy listeners, e.g. two SOCKS5 ports for different groups
+}
+
+// ProxyListener is a proxy listener of the gateway. Only the options section of its type applies.
+type ProxyListener struct {
+	Type   string       `yaml:"type"`   // "http", "socks5" or "tuic"
+	Addr   string       `yaml:"addr"`   // Listen address, overrides the listen_addr of the options
+	Groups []string     `yaml:"groups"` // Groups whose credentials the listener accepts (default all)
+	HTTP   HTTPConfig   `yaml:"http"`   // Options of http listeners
+	SOCKS5 SOCKS5Config `yaml:"socks5"` // Options of socks5 listeners
+	TUIC   TUICConfig   `yaml:"tuic"`   // Options of tuic listeners
+}
+
+// Proxy listener types
+const (
+	ProxyTypeHTTP   = "http"
+	ProxyTypeSOCKS5 = "socks5"
+	ProxyTypeTUIC   = "tuic"
+)
+
+// AllListeners returns the configured proxy listeners, those of the socks5, http and tuic
+// sections first. The listen_addr of each listener's options is set to its address.
+func (p ProxyConfig) AllListeners() []ProxyListener {
+	var listeners []ProxyListener
+	for _, section := range p.sections() {
+		l := section.listener
+		if l.Addr == "" {
+			continue
+		}
+		l.HTTP.ListenAddr, l.SOCKS5.ListenAddr, l.TUIC.ListenAddr = l.Addr, l.Addr, l.Addr
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// proxyListenerSection is a proxy listener with the config path of its options
+type proxyListenerSection struct {
+	listener ProxyListener
+	name     string // e.g. "gateway.proxy.http" or "gateway.proxy.listeners[0].http"
+}
+
+// sections returns all proxy listener sections, including the disabled fixed sections
+func (p ProxyConfig) sections() []proxyListenerSection {
+	sections := []proxyListenerSection{
+		{ProxyListener{Type: ProxyTypeHTTP, Addr: p.HTTP.ListenAddr, HTTP: p.HTTP}, "gateway.proxy.http"},
+		{ProxyListener{Type: ProxyTypeSOCKS5, Addr: p.SOCKS5.ListenAddr, SOCKS5: p.SOCKS5}, "gateway.proxy.socks5"},
+		{ProxyListener{Type: ProxyTypeTUIC, Addr: p.TUIC.ListenAddr, TUIC: p.TUIC}, "gateway.proxy.tuic"},
+	}
+	for i, l := range p.Listeners {
+		sections = append(sections, proxyListenerSection{l, fmt.Sprintf("gateway.proxy.listeners[%d].%s", i, l.Type)})
+	}
+	return sections
 }
 
 // CredentialConfig represents the credential storage configuration
@@ -52,64 +122,895 @@ type CredentialDBConfig struct {
 
 // GatewayConfig represents the configuration for the proxy gateway
 type GatewayConfig struct {
-	ListenAddr    string            `yaml:"listen_addr"`
-	TransportType string            `yaml:"transport_type"`
-	TLSCert       string            `yaml:"tls_cert"`
-	TLSKey        string            `yaml:"tls_key"`
-	AuthUsername  string            `yaml:"auth_username"`
-	AuthPassword  string            `yaml:"auth_password"`
-	Credential    *CredentialConfig `yaml:"credential"` // Add credential configuration
-	Proxy         ProxyConfig       `yaml:"proxy"`
-	Web           WebConfig         `yaml:"web"`
+	ListenAddr        string                  `yaml:"listen_addr"`
+	TransportType     string                  `yaml:"transport_type"`
+	TLSCert           string                  `yaml:"tls_cert"`
+	TLSKey            string                  `yaml:"tls_key"`
+	AuthUsername      string                  `yaml:"auth_username"`
+	AuthPassword      string                  `yaml:"auth_password"`
+	Credential        *CredentialConfig       `yaml:"credential"` // Add credential configuration
+	Proxy             ProxyConfig             `yaml:"proxy"`
+	Web               WebConfig               `yaml:"web"`
+	GroupDefaults     GroupConfig             `yaml:"group_defaults"`      // Limits applied to groups without an explicit entry
+	Groups            map[string]GroupConfig  `yaml:"groups"`              // Per-group limits keyed by group ID
+	GeoIP             GeoIPConfig             `yaml:"geoip"`               // Optional Geo-IP enrichment and country policy
+	DNSCache          DNSCacheConfig          `yaml:"dns_cache"`           // Caches the host names the gateway resolves itself
+	ResourceLimits    ResourceLimitsConfig    `yaml:"resource_limits"`     // Load shedding thresholds for the gateway process
+	ClientUpdates     ClientUpdatesConfig     `yaml:"client_updates"`      // Signed client binaries pushed to outdated clients
+	SocketOptions     SocketOptions           `yaml:"socket_options"`      // Defaults for proxy and port forwarding listeners
+	SourceRoutes      []SourceRouteRule       `yaml:"source_routes"`       // Groups for HTTP/SOCKS5 users without credentials, by source IP
+	Blocklists        BlocklistsConfig        `yaml:"blocklists"`          // Domain and IP blocklists checked before dialing
+	Mirror            MirrorConfig            `yaml:"mirror"`              // Admin-triggered traffic captures for debugging
+	KCP               KCPConfig               `yaml:"kcp"`                 // Tuning for the kcp transport
+	GRPC              GRPCConfig              `yaml:"grpc"`                // Options of the grpc transport
+	StatusPage        StatusPageConfig        `yaml:"status_page"`         // Public per-group availability page
+	SubGroups         SubGroupsConfig         `yaml:"sub_groups"`          // Hierarchical groups accepting their parent's credentials
+	TLSFingerprint    TLSFingerprintConfig    `yaml:"tls_fingerprint"`     // JA3/JA4 logging and rules for TLS clients of the transport listener
+	ClientIdentity    ClientIdentityConfig    `yaml:"client_identity"`     // Pins client IDs to the keys of the clients that first used them
+	CloseGracePeriod  time.Duration           `yaml:"close_grace_period"`  // How long a half-closed connection keeps the other direction open (default 60s, negative closes fully on EOF)
+	StorageEncryption StorageEncryptionConfig `yaml:"storage_encryption"`  // AES-GCM encryption of the credential store and rate limit storage
+	RateLimitStorage  RateLimitStorageConfig  `yaml:"rate_limit_storage"`  // Persists rate limit rules and counters across restarts
+	Egress            EgressConfig            `yaml:"egress"`              // Caps the bandwidth sent to clients and shares it among connections
+	QoS               QoSConfig               `yaml:"qos"`                 // Priority classes of connections, forwarded to clients
+	IdleProbeInterval time.Duration           `yaml:"idle_probe_interval"` // Clients check target sockets of connections idle this long and close dead ones (0 = disabled)
+	Hibernation       HibernationConfig       `yaml:"hibernation"`         // Reduces the resources of clients without connections for a long time
+	PeerRouting       bool                    `yaml:"peer_routing"`        // Relay connections of client peer_listeners to clients of other groups
+	Tun               GatewayTunConfig        `yaml:"tun"`                 // Exchange IP packets of a TUN interface with clients in TUN mode
+	PolicyPacks       []PolicyPack            `yaml:"policy_packs"`        // Named host patterns pushed to the clients of the groups referencing them
+	MetricsSnapshot   MetricsSnapshotConfig   `yaml:"metrics_snapshot"`    // Keeps dashboard counters across restarts
+	MetricsLimits     MetricsLimitsConfig     `yaml:"metrics_limits"`      // Bounds the connection and client records of the monitoring
+	AnomalyDetection  AnomalyDetectionConfig  `yaml:"anomaly_detection"`   // Alerts when client or group traffic deviates from its baseline
+	UsageReports      UsageReportsConfig      `yaml:"usage_reports"`       // Daily or weekly traffic per group and per proxy user, for chargeback and capacity planning
+	PAC               PACConfig               `yaml:"pac"`                 // Proxy auto-config file for browsers served by the web interface
+	Upgrade           UpgradeConfig           `yaml:"upgrade"`             // Zero-downtime binary upgrades on SIGUSR2
+	Ingress           []IngressMapping        `yaml:"ingress"`             // Gateway ports forwarded to fixed targets through a group, without client configuration
+	AutoTLS           AutoTLSConfig           `yaml:"auto_tls"`            // Self-signed CA and server certificate generated on first start, instead of tls_cert and tls_key
+	Startup           StartupConfig           `yaml:"startup"`             // Retries of listeners whose port is taken when the gateway starts
+	GroupGC           GroupGCConfig           `yaml:"group_gc"`            // When groups left without clients are removed with their in-memory credentials
+
+	EventBytesMilestone int64 `yaml:"event_bytes_milestone"` // Bytes a connection carries between bytes_milestone events of the embedding API (default 10MB)
+}
+
+// IngressMapping forwards the TCP connections of a gateway port to a fixed target, dialed by the
+// clients of a group like proxy connections. Unlike open_ports, the clients need no entry.
+type IngressMapping struct {
+	ListenAddr string `yaml:"listen_addr"` // Gateway address, e.g. ":9000"
+	GroupID    string `yaml:"group_id"`    // Group whose clients dial the target
+	Target     string `yaml:"target"`      // host:port dialed by the clients, e.g. "10.0.5.10:5432"
+}
+
+// StartupConfig retries binding the gateway's listeners, e.g. while the process being replaced
+// still holds a port. The transport listener must bind for the gateway to start, proxy and
+// ingress listeners can keep being retried after it started.
+type StartupConfig struct {
+	BindAttempts   int           `yaml:"bind_attempts"`    // Attempts to bind each listener at start (default 5, 1 = no retries)
+	BindBackoff    time.Duration `yaml:"bind_backoff"`     // Wait before the first retry, doubled per retry (default 200ms)
+	MaxBindBackoff time.Duration `yaml:"max_bind_backoff"` // Longest wait between attempts (default 5s)
+	KeepRetrying   bool          `yaml:"keep_retrying"`    // Start without proxy and ingress listeners that still fail, retrying them in the background
+}
+
+// GroupGCConfig delays the removal of groups whose last client disconnected. Until then the
+// group keeps its in-memory credentials, so proxy users of a client reconnecting within the grace
+// period are not refused. Credentials of file and db storage are never removed.
+type GroupGCConfig struct {
+	GracePeriod time.Duration `yaml:"grace_period"` // How long an empty group is kept (default 0 removes it right away)
+	Keep        []string      `yaml:"keep"`         // Groups never removed when empty
+}
+
+// HibernationConfig puts clients that had no connections for a while into hibernation. The
+// gateway suspends their idle probes and releases their connection tables, the next connection
+// routed to a hibernating client resumes it right away.
+type HibernationConfig struct {
+	IdleAfter time.Duration `yaml:"idle_after"` // Time without connections after which a client hibernates (0 = disabled)
+}
+
+// UpgradeConfig represents zero-downtime upgrades. On SIGUSR2 the gateway starts its binary
+// again, the new process shares the listen ports through SO_REUSEPORT, and once it serves the
+// old process hands it the clients a few at a time before exiting.
+type UpgradeConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	StateFile    string        `yaml:"state_file"`    // Sticky sessions handed to the new process (default none)
+	ReadyTimeout time.Duration `yaml:"ready_timeout"` // How long the new process may take to serve before the upgrade is aborted (default 30s)
+	DrainWindow  time.Duration `yaml:"drain_window"`  // Clients are disconnected spread over this window (default 60s)
+}
+
+// PACConfig serves a proxy auto-config file at /proxy.pac on the web interface. It is not
+// authenticated, browsers fetch it before any proxy credentials are known.
+type PACConfig struct {
+	Enabled bool       `yaml:"enabled"`
+	Proxies []PACProxy `yaml:"proxies"`
+	Rules   []PACRule  `yaml:"rules"`   // Evaluated in order, the first matching rule wins
+	Default string     `yaml:"default"` // Route of hosts no rule matches: "direct" (default) or a proxy name
+}
+
+// PACProxy is a gateway proxy listener as browsers reach it
+type PACProxy struct {
+	Name string `yaml:"name"` // Referenced by rule routes
+	Type string `yaml:"type"` // "http", "https" or "socks5"
+	Addr string `yaml:"addr"` // host:port, the host defaults to the host the PAC file was fetched from, the port to the gateway's listener of the type
+}
+
+// PACRule routes matching hosts directly or through a proxy
+type PACRule struct {
+	Hosts []string `yaml:"hosts"` // Domains including their subdomains, shell patterns such as "*.corp.*", IPv4 addresses or CIDRs
+	Route string   `yaml:"route"` // "direct" or a proxy name
+}
+
+// PAC proxy types and routes
+const (
+	PACTypeHTTP   = "http"
+	PACTypeHTTPS  = "https"
+	PACTypeSOCKS5 = "socks5"
+	PACDirect     = "direct"
+)
+
+// AnomalyDetectionConfig learns per client and per group baselines of bytes per minute and of
+// new destinations per minute, and alerts when a rate exceeds its baseline by factor
+type AnomalyDetectionConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	Interval          time.Duration `yaml:"interval"`             // Sampling period (default 1m)
+	Factor            float64       `yaml:"factor"`               // Alert when a rate is this many times its baseline (default 5)
+	Warmup            int           `yaml:"warmup"`               // Samples learned before alerting (default 10)
+	MinBytesPerMinute int64         `yaml:"min_bytes_per_minute"` // Byte rates below this never alert (default 1MB)
+	MinNewTargets     int64         `yaml:"min_new_targets"`      // New destinations per minute below this never alert (default 10)
+	Webhook           string        `yaml:"webhook"`              // URL receiving each alert as a JSON POST, alerts are always logged
+}
+
+// MetricsLimitsConfig bounds the memory of the monitoring on gateways with many connections or
+// clients. Counters always cover every connection, only the per-connection records are capped or
+// sampled; failed connections are always recorded.
+type MetricsLimitsConfig struct {
+	MaxConnections int `yaml:"max_connections"` // Records of active connections (0 = no limit)
+	MaxClients     int `yaml:"max_clients"`     // Client records, the least recently seen client is evicted first (0 = no limit)
+	SampleRate     int `yaml:"sample_rate"`     // Record 1 in N connections (0 or 1 = all)
+}
+
+// UsageReportsConfig writes the traffic of each group and proxy user at the end of every
+// period. Periods start at midnight UTC, weekly ones on Monday. The running period is also
+// reported on shutdown, the next report then covers the time since the start.
+type UsageReportsConfig struct {
+	Period  string         `yaml:"period"`  // "daily" or "weekly" (empty = disabled)
+	Format  string         `yaml:"format"`  // "csv" (default) or "json"
+	Dir     string         `yaml:"dir"`     // Directory the reports are written to
+	Webhook string         `yaml:"webhook"` // URL receiving each report as a POST
+	S3      S3UploadConfig `yaml:"s3"`      // Bucket of Amazon S3 or an S3-compatible store the reports are uploaded to
+}
+
+// S3UploadConfig addresses a bucket path-style, requests are signed with Signature Version 4
+type S3UploadConfig struct {
+	Endpoint        string `yaml:"endpoint"`          // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://minio:9000" (empty = disabled)
+	Region          string `yaml:"region"`            // Default us-east-1
+	Bucket          string `yaml:"bucket"`            // Bucket name
+	Prefix          string `yaml:"prefix"`            // Prepended to object keys, e.g. "anyproxy/usage/"
+	AccessKeyID     string `yaml:"access_key_id"`     // Empty sends unsigned requests
+	SecretAccessKey string `yaml:"secret_access_key"` // Secret of access_key_id
+}
+
+// PolicyPack is a named set of host patterns shared by many clients, in the syntax of the
+// client's allowed_hosts and forbidden_hosts. Clients enforce each pack of their group in
+// addition to their own patterns.
+type PolicyPack struct {
+	Name           string   `yaml:"name"` // Referenced by group policy_packs
+	AllowedHosts   []string `yaml:"allowed_hosts"`
+	ForbiddenHosts []string `yaml:"forbidden_hosts"`
+}
+
+// MetricsSnapshotConfig configures periodic snapshots of the monitoring counters
+type MetricsSnapshotConfig struct {
+	Path     string        `yaml:"path"`     // Snapshot file, restored on startup (empty = disabled)
+	Interval time.Duration `yaml:"interval"` // How often counters are saved (default 1m), also saved on shutdown
+}
+
+// StorageEncryptionConfig encrypts the file and db credential stores and the rate limit storage
+// with AES-256-GCM. The key is 32 bytes encoded as base64 or hex, e.g. "openssl rand -base64 32".
+// Existing plain text stores are encrypted on startup.
+type StorageEncryptionConfig struct {
+	KeyEnv  string `yaml:"key_env"`  // Environment variable holding the key
+	KeyFile string `yaml:"key_file"` // File holding the key, e.g. rendered by a KMS or secrets agent
+}
+
+// Rate limit storage types
+const (
+	RateLimitStorageMemory = "memory"
+	RateLimitStorageFile   = "file"
+	RateLimitStorageDB     = "db"
+)
+
+// RateLimitStorageConfig represents where the web rate limiter keeps its rules and counters
+type RateLimitStorageConfig struct {
+	Type     string             `yaml:"type"`      // "memory" (default), "file" or "db"
+	FilePath string             `yaml:"file_path"` // Only used for file type (default "ratelimit.json")
+	DB       *RateLimitDBConfig `yaml:"db"`        // Only used for db type
+}
+
+// RateLimitDBConfig represents the database of the rate limit storage
+type RateLimitDBConfig struct {
+	Driver      string `yaml:"driver"`       // Database driver: sqlite or postgres
+	DataSource  string `yaml:"data_source"`  // Connection string, a file path for sqlite
+	TablePrefix string `yaml:"table_prefix"` // Prefix of the table names (optional, defaults to "ratelimit")
+}
+
+// AutoTLSConfig makes a lab or self-hosted gateway generate its own CA and server certificate.
+// Clients enroll with the token the gateway logs to trust the CA.
+type AutoTLSConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Dir     string   `yaml:"dir"`   // Keeps the CA, server certificate and enrollment token (default "anyproxy-tls")
+	Hosts   []string `yaml:"hosts"` // Names and IPs clients dial the gateway by (default the listen address host, the hostname and localhost)
+}
+
+// ClientIdentityConfig pins client IDs to the ed25519 keys that clients with an identity_key prove
+// in the handshake. Replica IDs generated by clients are pinned by their configured ID.
+type ClientIdentityConfig struct {
+	Enabled      bool              `yaml:"enabled"`        // Verify identity proofs and refuse connections proving another key than the pinned one
+	Require      bool              `yaml:"require"`        // Also refuse clients without a proof, by default they are accepted while their ID is unpinned
+	PinsFile     string            `yaml:"pins_file"`      // Keeps learned pins across restarts (default in memory)
+	Pins         map[string]string `yaml:"pins"`           // Pre-provisioned pins, client ID to key fingerprint ("SHA256:<hex>")
+	MaxClockSkew time.Duration     `yaml:"max_clock_skew"` // Accepted age of a proof (default 5m)
+}
+
+// TLSFingerprintConfig logs the JA3/JA4 fingerprints of TLS clients and refuses handshakes by fingerprint.
+// Rules are JA3 hashes ("e7d705a3286e19ea42f587b344ee6865") or JA4 fingerprints ("t13d1516h2_8daaf6152771_e5627efa2ab1").
+type TLSFingerprintConfig struct {
+	Log   bool     `yaml:"log"`   // Log the fingerprints of every handshake, refused handshakes are always logged
+	Block []string `yaml:"block"` // Fingerprints refused during the handshake
+	Allow []string `yaml:"allow"` // When set, only these fingerprints complete the handshake
+}
+
+// Sub-group pattern wildcards
+const (
+	SubGroupAnySegment     = "*"  // Matches one level, also usable as a glob within a segment
+	SubGroupAnyDescendants = "**" // As the last segment, matches any number of levels
+)
+
+// SubGroupsConfig represents hierarchical groups such as "acme/team-a". Proxy users of a
+// child group may authenticate with the password of a parent that delegates to it.
+type SubGroupsConfig struct {
+	Separator   string               `yaml:"separator"`   // Separates the levels of a group ID (default "/")
+	Delegations []SubGroupDelegation `yaml:"delegations"` // Parents whose credentials grant access to their sub-groups
+}
+
+// SubGroupDelegation lets the credentials of a parent group authenticate selected sub-groups
+type SubGroupDelegation struct {
+	Parent   string   `yaml:"parent"`   // Parent group ID, e.g. "acme"
+	Children []string `yaml:"children"` // Sub-group patterns relative to the parent, e.g. "team-*" or "infra/**" (default all descendants)
+}
+
+// StatusPageConfig represents the public, unauthenticated status page served by the web interface.
+// Only the listed groups are shown, under their public names, group IDs are never exposed.
+type StatusPageConfig struct {
+	Enabled bool              `yaml:"enabled"`
+	Title   string            `yaml:"title"`  // Page heading (default "Service Status")
+	Notice  string            `yaml:"notice"` // Maintenance or incident notice shown above the groups
+	Groups  []StatusPageGroup `yaml:"groups"`
+}
+
+// StatusPageGroup is a group shown on the status page
+type StatusPageGroup struct {
+	GroupID     string `yaml:"group_id"`
+	Name        string `yaml:"name"`        // Public name, such as the tunnel region "eu-west"
+	Maintenance bool   `yaml:"maintenance"` // Reported as under maintenance instead of up or down
+}
+
+// KCP transport modes, from least to most aggressive retransmission
+const (
+	KCPModeNormal = "normal"
+	KCPModeFast   = "fast"
+	KCPModeFast2  = "fast2"
+	KCPModeFast3  = "fast3"
+)
+
+// KCPConfig tunes the kcp transport for high-latency, lossy links. The gateway and its
+// clients must use the same data_shards and parity_shards.
+type KCPConfig struct {
+	Mode          string `yaml:"mode"`           // normal, fast, fast2 or fast3 (default fast)
+	DataShards    int    `yaml:"data_shards"`    // Forward error correction data shards (0 disables FEC)
+	ParityShards  int    `yaml:"parity_shards"`  // Forward error correction parity shards, recovers this many lost packets per group
+	SendWindow    int    `yaml:"send_window"`    // Send window in packets (default 1024)
+	ReceiveWindow int    `yaml:"receive_window"` // Receive window in packets (default 1024)
+	MTU           int    `yaml:"mtu"`            // Largest UDP payload (default 1350)
+}
+
+// GRPCConfig tunes the grpc transport. With stream_per_connection each proxied connection
+// gets its own gRPC stream instead of sharing the client's stream, so a slow bulk transfer
+// holds up no other connection. It is used when both the gateway and the client enable it.
+type GRPCConfig struct {
+	StreamPerConnection bool `yaml:"stream_per_connection"`
+}
+
+// MirrorConfig represents traffic mirroring, which copies selected connections to capture files
+// downloadable from the admin API. Captures contain proxied data, enable it only where needed.
+type MirrorConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Dir      string `yaml:"dir"`       // Directory for capture files (default: <temp dir>/anyproxy-mirror)
+	MaxBytes int64  `yaml:"max_bytes"` // Largest capture an admin may request (default 64 MiB)
+}
+
+// BlocklistsConfig represents the domain and IP blocklists applied to dial targets
+type BlocklistsConfig struct {
+	RefreshInterval time.Duration     `yaml:"refresh_interval"` // How often lists are reloaded from their file or URL (default 1h)
+	Lists           []BlocklistSource `yaml:"lists"`
+}
+
+// BlocklistSource is a blocklist in hosts, adblock-lite or plain domain/IP format
+type BlocklistSource struct {
+	Name string `yaml:"name"` // Referenced by group blocklists and reported in metrics
+	Path string `yaml:"path"` // Local file, reloaded when it changes
+	URL  string `yaml:"url"`  // HTTP(S) URL, refetched every refresh_interval
+}
+
+// BlocklistsNone disables blocklists for a group when used as its only blocklist name
+const BlocklistsNone = "none"
+
+// SourceRouteRule admits proxy users from the listed source ranges without credentials and
+// routes them to a group, for devices that cannot set a proxy username
+type SourceRouteRule struct {
+	CIDRs   []string `yaml:"cidrs"`    // Source ranges such as "10.1.0.0/16", or single IPs
+	GroupID string   `yaml:"group_id"` // Group serving matching users
+}
+
+// Prefixes of stream listen addresses that are not TCP host:port addresses
+const (
+	ListenUnixPrefix    = "unix:"    // Unix socket at the path, e.g. "unix:/run/anyproxy/http.sock"
+	ListenSystemdPrefix = "systemd:" // Socket passed by systemd socket activation, by its FileDescriptorName
+)
+
+// IsSocketListenAddr reports whether a listen address is a Unix socket or a systemd socket
+func IsSocketListenAddr(addr string) bool {
+	return strings.HasPrefix(addr, ListenUnixPrefix) || strings.HasPrefix(addr, ListenSystemdPrefix)
+}
+
+// SocketOptions represents TCP/IP options applied to listeners and dialed connections.
+// Zero values keep the operating system and Go defaults.
+type SocketOptions struct {
+	NoDelay        *bool         `yaml:"no_delay"`         // TCP_NODELAY (Go enables it by default)
+	KeepAlive      time.Duration `yaml:"keep_alive"`       // TCP keepalive idle time and probe interval (default 15s, negative disables)
+	KeepAliveCount int           `yaml:"keep_alive_count"` // Unanswered probes before the connection is dropped (default 9)
+	ReusePort      bool          `yaml:"reuse_port"`       // SO_REUSEPORT, lets several processes share a listen port
+	DSCP           int           `yaml:"dscp"`             // DSCP value 0-63 written to IP_TOS / IPV6_TCLASS
+}
+
+// ClientUpdatesConfig represents the client binaries the gateway offers to clients running another version
+type ClientUpdatesConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"` // Directory with manifest.json and the signed client binaries
+}
+
+// ResourceLimitsConfig represents process-wide thresholds above which the gateway sheds new dials
+type ResourceLimitsConfig struct {
+	MaxGoroutines  int           `yaml:"max_goroutines"`  // Shed new dials above this goroutine count (0 = unlimited)
+	MaxConnections int           `yaml:"max_connections"` // Maximum simultaneous proxied connections across all groups (0 = unlimited)
+	MaxHeapMB      int           `yaml:"max_heap_mb"`     // Shed new dials while the Go heap exceeds this many MiB (0 = unlimited)
+	CheckInterval  time.Duration `yaml:"check_interval"`  // How often goroutines and heap are sampled (default 1s)
+}
+
+// GeoIPConfig represents Geo-IP enrichment and country-based policy on the gateway
+type GeoIPConfig struct {
+	Database       string      `yaml:"database"`        // Path to a MaxMind DB (GeoIP2/GeoLite2 Country or City), empty disables Geo-IP
+	ResolveTargets bool        `yaml:"resolve_targets"` // Resolve target hostnames on the gateway to find the target country
+	Rules          []GeoIPRule `yaml:"rules"`           // Evaluated in order, the first matching rule wins
+}
+
+// DNSCacheConfig resolves the host names the gateway looks up itself, such as targets with
+// geoip.resolve_targets, with an in-process cache. Answers are kept for their DNS TTL within
+// min_ttl and max_ttl, failed lookups for their SOA negative TTL up to negative_ttl.
+type DNSCacheConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Servers     []string      `yaml:"servers"`      // DNS servers as host or host:port (default the nameservers of /etc/resolv.conf)
+	MinTTL      time.Duration `yaml:"min_ttl"`      // Answers are cached at least this long (default 5s)
+	MaxTTL      time.Duration `yaml:"max_ttl"`      // Answers are cached at most this long (default 1h)
+	NegativeTTL time.Duration `yaml:"negative_ttl"` // Failed lookups are cached at most this long (default 30s)
+	MaxEntries  int           `yaml:"max_entries"`  // Cached host names (default 10000)
+}
+
+// GeoIPRule blocks or reroutes connections by source or target country
+type GeoIPRule struct {
+	Match     string   `yaml:"match"`     // "source" (proxy user IP) or "target" (dial destination)
+	Countries []string `yaml:"countries"` // ISO 3166-1 alpha-2 codes, "??" matches unknown countries
+	Action    string   `yaml:"action"`    // "block" or "route"
+	GroupID   string   `yaml:"group_id"`  // Group that serves the connection when action is "route"
+}
+
+// Geo-IP rule match targets and actions
+const (
+	GeoIPMatchSource = "source"
+	GeoIPMatchTarget = "target"
+	GeoIPActionBlock = "block"
+	GeoIPActionRoute = "route"
+)
+
+// GroupConfig represents per-group limits and routing options on the gateway
+type GroupConfig struct {
+	MaxClients     int           `yaml:"max_clients"`     // Maximum registered clients in the group (0 = unlimited)
+	MaxConnections int           `yaml:"max_connections"` // Maximum simultaneous proxied connections (0 = unlimited)
+	StickySession  string        `yaml:"sticky_session"`  // "" (round-robin), "user" or "source_ip"
+	Balancing      string        `yaml:"balancing"`       // "round_robin" (default) or "least_loaded" by the load score clients report in heartbeats
+	StickyTTL      time.Duration `yaml:"sticky_ttl"`      // Idle time before a sticky binding expires (default 10m)
+	RemoteExec     bool          `yaml:"remote_exec"`     // Allow admins to run commands/shells on the group's clients
+	DialRetries    int           `yaml:"dial_retries"`    // Other clients tried when a client cannot reach the target (0 = no retry)
+	DialBackoff    time.Duration `yaml:"dial_backoff"`    // Wait before each retry, doubled per attempt (default 0)
+	DialTimeout    time.Duration `yaml:"dial_timeout"`    // How long a retried dial waits for the client to connect (default 35s)
+	ConfirmDial    bool          `yaml:"confirm_dial"`    // Answer proxy users only after the client reached the target (implied by dial_retries)
+	Blocklists     []string      `yaml:"blocklists"`      // Names of the blocklists applied to the group (empty = all, ["none"] = none)
+	BlocklistAllow []string      `yaml:"blocklist_allow"` // Domains, IPs or CIDRs the group may dial even when blocklisted
+	PolicyPacks    []string      `yaml:"policy_packs"`    // Names of the policy packs pushed to the group's clients
+	SignedControl  bool          `yaml:"signed_control"`  // Reject port forward requests not signed with the key derived from the group password
+
+	PolicySignature string `yaml:"policy_signature"` // Operator signature of the group's policy packs, required by clients with policy_public_key
+
+	Migration MigrationConfig `yaml:"migration"` // Move connections of idempotent protocols to another client when theirs disconnects
+
+	MaxTransferBytes     int64            `yaml:"max_transfer_bytes"`      // Bytes a single connection may transfer, both directions combined (0 = unlimited)
+	UserMaxTransferBytes map[string]int64 `yaml:"user_max_transfer_bytes"` // Overrides max_transfer_bytes per proxy username (0 = unlimited)
+
+	Schedule      AccessSchedule            `yaml:"schedule"`       // When the group may create new connections (default any time)
+	UserSchedules map[string]AccessSchedule `yaml:"user_schedules"` // Overrides schedule per proxy username
+}
+
+// MigrationConfig moves TCP connections to idempotent protocols to another client of the group
+// when their client disconnects. The new client dials the target again, the bytes the proxy
+// user sent are replayed, and as much of the answer as the user already received is skipped
+// after checking it is the same. Otherwise the connection is reset like without migration.
+type MigrationConfig struct {
+	Ports          []int `yaml:"ports"`            // Target ports of idempotent, deterministic protocols, e.g. [80] (empty = disabled)
+	MaxReplayBytes int   `yaml:"max_replay_bytes"` // Bytes a proxy user may send for the connection to stay migratable (default 64KB)
+}
+
+// AccessSchedule limits when new connections may be created, established ones are kept
+type AccessSchedule struct {
+	Timezone string         `yaml:"timezone"` // IANA time zone of the windows, e.g. "Europe/Berlin" (default gateway local time)
+	Windows  []AccessWindow `yaml:"windows"`  // Connections are allowed in any window, none allows them at any time
+}
+
+// AccessWindow is a daily time range on some weekdays
+type AccessWindow struct {
+	Days  []string `yaml:"days"`  // "mon".."sun" or ranges like "mon-fri" (default every day)
+	Hours string   `yaml:"hours"` // "HH:MM-HH:MM", the end may be before the start to span midnight (default the whole day)
+}
+
+// Compile returns the schedule of the windows, nil when there are none
+func (s AccessSchedule) Compile() (*schedule.Schedule, error) {
+	if len(s.Windows) == 0 {
+		return nil, nil
+	}
+	compiled, err := schedule.New(s.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	for i, w := range s.Windows {
+		if err := compiled.Add(w.Days, w.Hours); err != nil {
+			return nil, fmt.Errorf("windows[%d]: %v", i, err)
+		}
+	}
+	return compiled, nil
+}
+
+// Sticky session modes
+const (
+	StickySessionUser     = "user"
+	StickySessionSourceIP = "source_ip"
+)
+
+// Client balancing strategies of a group
+const (
+	BalancingRoundRobin  = "round_robin"
+	BalancingLeastLoaded = "least_loaded"
+)
+
+// GetGroupConfig returns the limits for a group, falling back to group_defaults
+func (g *GatewayConfig) GetGroupConfig(groupID string) GroupConfig {
+	if groupCfg, ok := g.Groups[groupID]; ok {
+		return groupCfg
+	}
+	return g.GroupDefaults
 }
 
 // SOCKS5Config represents the configuration for the SOCKS5 proxy
 type SOCKS5Config struct {
-	ListenAddr string `yaml:"listen_addr"`
+	ListenAddr    string             `yaml:"listen_addr"`
+	SocketOptions *SocketOptions     `yaml:"socket_options"` // Overrides gateway.socket_options
+	DialTimeout   time.Duration      `yaml:"dial_timeout"`   // Time a user waits for the target dial, forwarded to the client (0 = client default)
+	AuthMethods   []string           `yaml:"auth_methods"`   // Methods offered by this listener in order of preference: "password", "none" and/or "gssapi" (default password and none)
+	NoAuth        SOCKS5NoAuthConfig `yaml:"no_auth"`        // Users admitted by the "none" method besides source_routes
+	GSSAPI        SOCKS5GSSAPIConfig `yaml:"gssapi"`         // Kerberos users admitted by the "gssapi" method
+	Limits        ListenerLimits     `yaml:"limits"`         // Concurrency and accept-rate limits of the listener
+}
+
+// SOCKS5 authentication methods
+const (
+	SOCKS5AuthPassword = "password" // Group ID and group password
+	SOCKS5AuthNone     = "none"     // No credentials, restricted by source IP
+	SOCKS5AuthGSSAPI   = "gssapi"   // Kerberos tickets (RFC 1961), e.g. of Active Directory users
+)
+
+// SOCKS5NoAuthConfig admits SOCKS5 users without credentials from listed source ranges
+type SOCKS5NoAuthConfig struct {
+	CIDRs   []string `yaml:"cidrs"`    // Allowed source ranges such as "10.1.0.0/16", or single IPs
+	GroupID string   `yaml:"group_id"` // Group serving these users
+}
+
+// SOCKS5GSSAPIConfig admits SOCKS5 users with a Kerberos ticket for the listener's service principal
+type SOCKS5GSSAPIConfig struct {
+	Keytab           string `yaml:"keytab"`            // Keytab file with the keys of the service principal
+	ServicePrincipal string `yaml:"service_principal"` // Principal users get tickets for, such as "rcmd/proxy.example.com@EXAMPLE.COM"
+	GroupID          string `yaml:"group_id"`          // Group serving these users
 }
 
 // HTTPConfig represents the configuration for the HTTP proxy
 type HTTPConfig struct {
-	ListenAddr string `yaml:"listen_addr"`
-	TLSCert    string `yaml:"tls_cert"` // Path to TLS certificate file for HTTPS proxy
-	TLSKey     string `yaml:"tls_key"`  // Path to TLS key file for HTTPS proxy
+	ListenAddr    string         `yaml:"listen_addr"`
+	TLSCert       string         `yaml:"tls_cert"`       // Path to TLS certificate file for HTTPS proxy
+	TLSKey        string         `yaml:"tls_key"`        // Path to TLS key file for HTTPS proxy
+	SocketOptions *SocketOptions `yaml:"socket_options"` // Overrides gateway.socket_options
+	DialTimeout   time.Duration  `yaml:"dial_timeout"`   // Time a user waits for the target dial, forwarded to the client (0 = client default)
+	Limits        ListenerLimits `yaml:"limits"`         // Concurrency and accept-rate limits of the listener
+
+	AuthRealm      string        `yaml:"auth_realm"`       // Realm of the Proxy-Authenticate challenge (default "Proxy")
+	AuthSchemes    []string      `yaml:"auth_schemes"`     // Schemes offered by this listener in order of preference: "digest" and/or "basic" (default basic)
+	DigestNonceTTL time.Duration `yaml:"digest_nonce_ttl"` // How long a Digest nonce is accepted before the user is challenged again (default 5m)
+
+	MaxHeaderBytes     int             `yaml:"max_header_bytes"`     // Largest request header accepted, larger ones get 431 (default 64KB)
+	ReadHeaderTimeout  time.Duration   `yaml:"read_header_timeout"`  // Time a connection has to send a request header before it is closed (default 10s)
+	MaxBodyBytes       int64           `yaml:"max_body_bytes"`       // Largest body of a plain HTTP request, larger ones get 413 (0 = unlimited)
+	MaxPendingConnects int             `yaml:"max_pending_connects"` // CONNECTs waiting for their target at once, further ones get 503 (0 = unlimited)
+	Retry              HTTPRetry       `yaml:"retry"`                // Retries of plain HTTP requests whose upstream failed (default none)
+	Correlation        HTTPCorrelation `yaml:"correlation"`          // Headers added to plain HTTP requests to match target logs with the gateway's records
+
+	TLSFingerprint *TLSFingerprintConfig `yaml:"tls_fingerprint"` // Overrides gateway.tls_fingerprint for HTTPS proxy users
+	TargetTLS      []TargetTLSRule       `yaml:"target_tls"`      // How TLS to https:// targets is verified, first matching rule wins (default system trust)
+}
+
+// HTTP proxy authentication schemes
+const (
+	HTTPAuthBasic  = "basic"  // Group ID and group password, sent in the clear
+	HTTPAuthDigest = "digest" // RFC 7616 MD5 digest of the group password, with qop=auth
+)
+
+// OffersAuthScheme reports whether the listener offers an authentication scheme
+func (c HTTPConfig) OffersAuthScheme(scheme string) bool {
+	if len(c.AuthSchemes) == 0 {
+		return scheme == HTTPAuthBasic
+	}
+	return slices.Contains(c.AuthSchemes, scheme)
+}
+
+// HTTPRetry retries plain HTTP requests over flaky client links. Failed dials are retried for
+// every method, the request never reached the target then. Requests that failed after being
+// sent are retried for GET and HEAD without a body, and GET responses cut off mid-body are
+// resumed with a range request when the target supports it.
+type HTTPRetry struct {
+	MaxAttempts int           `yaml:"max_attempts"` // Attempts per request, including the first (0 or 1 = no retries)
+	Backoff     time.Duration `yaml:"backoff"`      // Wait before the first retry, doubled per retry (default 200ms)
+	MaxBackoff  time.Duration `yaml:"max_backoff"`  // Longest wait between attempts (default 5s)
+}
+
+// HTTPCorrelation adds headers to plain HTTP requests so the logs of targets can be matched with
+// the gateway's logs, metrics and audit records. Requests tunneled with CONNECT are not changed.
+type HTTPCorrelation struct {
+	ConnID       bool `yaml:"conn_id"`       // Set X-Anyproxy-Conn-ID to the conn_id of the request
+	ForwardedFor bool `yaml:"forwarded_for"` // Append the proxy user's address to X-Forwarded-For
+}
+
+// TargetTLSRule sets how the certificates of TLS targets matching Hosts are verified
+type TargetTLSRule struct {
+	Hosts              []string `yaml:"hosts"`                // Domains (with subdomains), "*.example.com", IPs or CIDRs
+	CAFile             string   `yaml:"ca_file"`              // PEM CA bundle trusted instead of the system roots
+	PinSHA256          []string `yaml:"pin_sha256"`           // Base64 SHA-256 of accepted SubjectPublicKeyInfos, one must be in the chain
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"` // Skip chain and name verification, only pins are checked (with pins, the leaf)
 }
 
+// ListenerLimits protects a proxy listener from connection floods
+type ListenerLimits struct {
+	MaxConnections int           `yaml:"max_connections"` // Simultaneous connections of the listener (0 = unlimited)
+	AcceptRate     float64       `yaml:"accept_rate"`     // New connections per second (0 = unlimited)
+	AcceptBurst    int           `yaml:"accept_burst"`    // Connections admitted at once above the rate (default the rate, at least 1)
+	Overflow       string        `yaml:"overflow"`        // "reject" (default) closes excess connections, "queue" holds them for a slot
+	QueueTimeout   time.Duration `yaml:"queue_timeout"`   // How long a queued connection waits before it is closed (default 5s)
+}
+
+// Listener overflow behaviors
+const (
+	ListenerOverflowReject = "reject"
+	ListenerOverflowQueue  = "queue"
+)
+
 // TUICConfig represents the configuration for the TUIC proxy
 // Note: TUIC now uses group_id as UUID and password as token dynamically
 // TLS certificates are reused from Gateway configuration
 type TUICConfig struct {
-	ListenAddr string `yaml:"listen_addr"`
+	ListenAddr    string         `yaml:"listen_addr"`
+	SocketOptions *SocketOptions `yaml:"socket_options"` // Overrides gateway.socket_options (DSCP and reuse_port apply to UDP)
+	DialTimeout   time.Duration  `yaml:"dial_timeout"`   // Time a user waits for the target dial, forwarded to the client (0 = client default)
+	Limits        ListenerLimits `yaml:"limits"`         // Limits new peers, TUIC always rejects the overflow
+
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`  // Expected peer heartbeat period, expired peers and sessions are cleaned up as often (default 30s)
+	AuthTimeout       time.Duration `yaml:"auth_timeout"`        // Peers without a heartbeat for this long must authenticate again (default 5m)
+	UDPSessionTimeout time.Duration `yaml:"udp_session_timeout"` // Idle UDP relay sessions are closed (default 5m)
+	MaxUDPSessions    int           `yaml:"max_udp_sessions"`    // UDP relay sessions per peer, packets of further associations are dropped (0 = unlimited)
 }
 
 // OpenPort defines a port forwarding configuration
 type OpenPort struct {
-	RemotePort int    `yaml:"remote_port"` // Port to open on the gateway
-	LocalPort  int    `yaml:"local_port"`  // Port to forward to on the client side
-	LocalHost  string `yaml:"local_host"`  // Host to forward to on the client side
-	Protocol   string `yaml:"protocol"`    // "tcp" or "udp"
+	RemotePort     int      `yaml:"remote_port"`     // Port to open on the gateway
+	LocalPort      int      `yaml:"local_port"`      // Port to forward to on the client side
+	LocalHost      string   `yaml:"local_host"`      // Host to forward to on the client side
+	Protocol       string   `yaml:"protocol"`        // "tcp" or "udp"
+	AllowedSources []string `yaml:"allowed_sources"` // CIDR ranges or IP addresses allowed to reach the port on the gateway (empty = any)
 }
 
 // ClientConfig represents the configuration for the proxy client
 type ClientConfig struct {
-	ClientID       string              `yaml:"id"`
-	GroupID        string              `yaml:"group_id"`
-	GroupPassword  string              `yaml:"group_password"`
-	Replicas       int                 `yaml:"replicas"`
-	Gateway        ClientGatewayConfig `yaml:"gateway"`
-	ForbiddenHosts []string            `yaml:"forbidden_hosts"`
-	AllowedHosts   []string            `yaml:"allowed_hosts"`
-	OpenPorts      []OpenPort          `yaml:"open_ports"`
-	Web            WebConfig           `yaml:"web"`
+	ClientID         string                `yaml:"id"`
+	GroupID          string                `yaml:"group_id"`
+	GroupPassword    string                `yaml:"group_password"`
+	Replicas         int                   `yaml:"replicas"`
+	Gateway          ClientGatewayConfig   `yaml:"gateway"`
+	Gateways         []ClientGatewayConfig `yaml:"gateways"` // Additional gateways, e.g. regional ones, the client registers with at the same time
+	ForbiddenHosts   []string              `yaml:"forbidden_hosts"`
+	AllowedHosts     []string              `yaml:"allowed_hosts"`
+	OpenPorts        []OpenPort            `yaml:"open_ports"`
+	MaxConnections   int                   `yaml:"max_connections"`  // Simultaneous target connections, further ones fail as client_overloaded (0 = unlimited)
+	MaxConnectRate   float64               `yaml:"max_connect_rate"` // Connect requests accepted from gateways per second, further ones fail as client_busy (0 = unlimited)
+	ConnectBurst     int                   `yaml:"connect_burst"`    // Connect requests accepted at once above the rate (default the rate, at least 1)
+	DisableUDP       bool                  `yaml:"disable_udp"`      // The client relays no UDP, the gateway routes UDP connections and ports to other clients
+	DisableUnix      bool                  `yaml:"disable_unix"`     // The client dials no Unix sockets
+	Web              WebConfig             `yaml:"web"`
+	ConnectionPool   ConnectionPoolConfig  `yaml:"connection_pool"`
+	FileTransfer     FileTransferConfig    `yaml:"file_transfer"`
+	RemoteExec       RemoteExecConfig      `yaml:"remote_exec"`
+	Heartbeat        HeartbeatConfig       `yaml:"heartbeat"`
+	AutoUpdate       AutoUpdateConfig      `yaml:"auto_update"`
+	SocketOptions    SocketOptions         `yaml:"socket_options"`     // Applied to connections dialed to targets
+	Outbound         []OutboundRule        `yaml:"outbound"`           // Egress interface or source IP by target CIDR, first match wins
+	WatchConfig      bool                  `yaml:"watch_config"`       // Reapply host patterns, open ports and rate limits when the config file changes
+	IdentityKey      string                `yaml:"identity_key"`       // ed25519 key proving the client ID to gateways with client_identity, generated when missing
+	CloseGracePeriod time.Duration         `yaml:"close_grace_period"` // How long a half-closed connection keeps the other direction open (default 60s, negative closes fully on EOF)
+	Egress           EgressConfig          `yaml:"egress"`             // Caps the bandwidth sent to the gateway and shares it among connections
+	QoS              QoSConfig             `yaml:"qos"`                // Priority classes of connections, used when egress is capped
+	PeerListeners    []PeerListener        `yaml:"peer_listeners"`     // Local listeners relayed by the gateway to clients of other groups
+	Tun              ClientTunConfig       `yaml:"tun"`                // Route IP packets over the tunnel through a TUN interface
+	DrainTimeout     time.Duration         `yaml:"drain_timeout"`      // How long Stop lets in-flight connections finish after telling the gateway (default 30s, negative stops immediately)
+	DialGuard        DialGuardConfig       `yaml:"dial_guard"`         // Check the addresses targets resolve to right before dialing
+	Spool            SpoolConfig           `yaml:"spool"`              // Keep activity of gateway outages on disk and upload it after reconnecting
+	Discovery        DiscoveryConfig       `yaml:"discovery"`          // Open ports for services found at runtime, in addition to open_ports
+	SignedControl    bool                  `yaml:"signed_control"`     // Reject policy pushes not signed with the key derived from the group password
+	PolicyPublicKey  string                `yaml:"policy_public_key"`  // Base64 ed25519 operator key policy pushes must be signed with, the gateway never has its private key
+	Checks           []SyntheticCheck      `yaml:"checks"`             // Probes of internal targets, results are reported to the gateway with heartbeats
+}
+
+// DiscoveryConfig finds local services to open gateway ports for while the client runs. The
+// ports of all sources are merged with open_ports, which win on conflicts, and the gateway is
+// updated when they change.
+type DiscoveryConfig struct {
+	Docker       DockerDiscoveryConfig `yaml:"docker"`
+	ServicesFile string                `yaml:"services_file"` // YAML list of open_ports entries, reread when it changes
+	Interval     time.Duration         `yaml:"interval"`      // How often the sources are checked (default 10s)
+}
+
+// DockerDiscoveryConfig opens ports for containers labeled anyproxy.expose=true
+type DockerDiscoveryConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Socket  string `yaml:"socket"` // Docker daemon socket (default /var/run/docker.sock)
+}
+
+// SpoolConfig keeps the audit records of connections ended by a gateway outage, and the
+// client's metrics changes during it, in a bounded directory until the client reconnects
+type SpoolConfig struct {
+	Dir      string `yaml:"dir"`       // Spool directory (empty = disabled), needs a gateway that accepts reports
+	MaxBytes int64  `yaml:"max_bytes"` // Oldest reports are dropped beyond this size (default 16MB)
+}
+
+// DialGuardConfig rejects targets resolving to loopback, link-local, private and other
+// non-public addresses, and to forbidden_hosts CIDRs. Targets are resolved once and dialed
+// by the checked address, so DNS rebinding can't bypass host name based patterns.
+type DialGuardConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	AllowedCIDRs []string `yaml:"allowed_cidrs"` // Non-public ranges the client may dial anyway, e.g. its LAN
+}
+
+// TunConfig routes IP packets over the tunnel through a TUN interface, for hosts whose
+// applications can't use a proxy. Linux only, needs CAP_NET_ADMIN and the ip command.
+type TunConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Name    string   `yaml:"name"`    // Interface name (default "anyproxy0")
+	Address string   `yaml:"address"` // Interface address in CIDR notation, e.g. "10.99.0.2/24"
+	MTU     int      `yaml:"mtu"`     // Default 1400, leaves room for the tunnel's headers
+	Routes  []string `yaml:"routes"`  // Prefixes routed into the interface, "0.0.0.0/0" for a full tunnel
+}
+
+// ClientTunConfig routes the routes and the addresses of domains into the TUN interface of a
+// client, everything else goes direct (split tunneling)
+type ClientTunConfig struct {
+	TunConfig     `yaml:",inline"`
+	Domains       []string      `yaml:"domains"`        // Hosts whose addresses are routed into the interface, e.g. "git.corp.example.com"
+	DomainRefresh time.Duration `yaml:"domain_refresh"` // How often domains are resolved again (default 5m)
+}
+
+// GatewayTunConfig exchanges the packets of the gateway's TUN interface with client groups
+type GatewayTunConfig struct {
+	TunConfig `yaml:",inline"`
+	Groups    []TunGroup `yaml:"groups"` // Client groups in TUN mode, packets are routed to them by destination
+}
+
+// TunGroup is a client group the gateway exchanges packets with
+type TunGroup struct {
+	GroupID string   `yaml:"group_id"`
+	Routes  []string `yaml:"routes"` // Prefixes behind the group's clients, including their interface addresses
+}
+
+// PeerListener accepts local connections and has the gateway relay them to a client of another
+// group, e.g. to reach a service in a remote site's LAN. The gateway must enable peer_routing.
+type PeerListener struct {
+	ListenAddr    string `yaml:"listen_addr"`    // Local address, e.g. "127.0.0.1:1081"
+	Protocol      string `yaml:"protocol"`       // "socks5" (default), "http" (CONNECT only) or "tcp"
+	Target        string `yaml:"target"`         // host:port dialed by the remote client, required for "tcp"
+	GroupID       string `yaml:"group_id"`       // Group whose clients dial the targets
+	GroupPassword string `yaml:"group_password"` // Password of that group
+}
+
+// Peer listener protocols
+const (
+	PeerProtocolSOCKS5 = "socks5"
+	PeerProtocolHTTP   = "http"
+	PeerProtocolTCP    = "tcp"
+)
+
+// OutboundRule binds target connections to a local interface or source IP.
+// Host names are resolved first and matched by address.
+type OutboundRule struct {
+	CIDR      string `yaml:"cidr"`      // Target network, e.g. "10.0.0.0/8" or "0.0.0.0/0"
+	Interface string `yaml:"interface"` // Egress interface name, e.g. "wwan0"
+	SourceIP  string `yaml:"source_ip"` // Local source address (default the interface's first address)
+}
+
+// AutoUpdateConfig represents accepting signed client binaries pushed by the gateway
+type AutoUpdateConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	PublicKey string `yaml:"public_key"` // Base64 ed25519 key the binaries must be signed with
+	Window    string `yaml:"window"`     // Daily maintenance window "HH:MM-HH:MM" in local time (empty = apply immediately)
+	MaxSize   int64  `yaml:"max_size"`   // Maximum binary size in bytes (default 256MiB)
+}
+
+// EgressConfig caps the bandwidth a client process or gateway sends through tunnels for proxied
+// connections. Sends of higher QoS classes go first and connections of a class get shares by
+// weight (weighted fair queuing), so a bulk transfer doesn't starve interactive sessions.
+type EgressConfig struct {
+	MaxBandwidth int64       `yaml:"max_bandwidth"` // Bytes per second (0 = unlimited)
+	Burst        int64       `yaml:"burst"`         // Bytes sent at line rate after idle periods (default max_bandwidth/10, at least 32KiB)
+	PortWeights  map[int]int `yaml:"port_weights"`  // Weights by target port, e.g. 22: 4 (default weight 1)
+}
+
+// QoS priority classes
+const (
+	QoSPriorityLow    = "low"
+	QoSPriorityNormal = "normal"
+	QoSPriorityHigh   = "high"
+)
+
+// QoSConfig marks connections with a priority class. When egress bandwidth is capped, sends of
+// higher classes go first, so interactive traffic preempts backups. The gateway forwards the
+// class of each connection to the client, clients only classify for older gateways.
+type QoSConfig struct {
+	Rules []QoSRule `yaml:"rules"` // The first matching rule wins, unmatched connections are "normal"
+}
+
+// QoSRule matches connections by all of its set fields
+type QoSRule struct {
+	Priority string   `yaml:"priority"` // "high", "normal" or "low"
+	Ports    []int    `yaml:"ports"`    // Target ports
+	Hosts    []string `yaml:"hosts"`    // Target domains including their subdomains, IP addresses or CIDRs
+	Users    []string `yaml:"users"`    // Proxy usernames or group IDs, only known on the gateway
+}
+
+// HeartbeatConfig represents the periodic client heartbeat carrying host telemetry
+type HeartbeatConfig struct {
+	Interval  time.Duration `yaml:"interval"`  // How often telemetry is sent (default 30s, negative disables the heartbeat)
+	DiskPath  string        `yaml:"disk_path"` // Filesystem whose usage is reported (default "/")
+	Bandwidth int64         `yaml:"bandwidth"` // Uplink bytes per second counted in the load score (default egress max_bandwidth, 0 = not counted)
+}
+
+// Synthetic check types
+const (
+	CheckTypeTCP  = "tcp"
+	CheckTypeHTTP = "http"
+)
+
+// SyntheticCheck probes a target periodically from the client, dialing it like proxied
+// connections. TCP checks pass when the connection opens, HTTP checks when a GET answers.
+type SyntheticCheck struct {
+	Name         string        `yaml:"name"`
+	Type         string        `yaml:"type"`          // "tcp" or "http"
+	Target       string        `yaml:"target"`        // host:port for tcp, http(s) URL for http
+	Interval     time.Duration `yaml:"interval"`      // Time between probes (default 30s)
+	Timeout      time.Duration `yaml:"timeout"`       // Probe timeout (default 5s)
+	ExpectStatus int           `yaml:"expect_status"` // HTTP status of a passing check (default any below 400)
+}
+
+// FileTransferConfig represents the optional client file transfer service reachable through the tunnel
+type FileTransferConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	RootDir     string `yaml:"root_dir"`      // Only files below this directory can be listed, fetched or written
+	Token       string `yaml:"token"`         // Bearer token the gateway admin must present
+	AllowUpload bool   `yaml:"allow_upload"`  // Allow pushing files (read-only when false)
+	MaxFileSize int64  `yaml:"max_file_size"` // Maximum download/upload size in bytes (default 10MiB)
+}
+
+// RemoteExecConfig represents the optional remote command/shell service reachable through the tunnel.
+// The gateway additionally requires remote_exec to be enabled for the client's group.
+type RemoteExecConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Token     string        `yaml:"token"`      // Bearer token the gateway admin must present
+	Commands  []ExecCommand `yaml:"commands"`   // Whitelisted commands, run by name without extra arguments
+	Shell     string        `yaml:"shell"`      // Interactive shell binary (empty = interactive shells disabled)
+	Timeout   time.Duration `yaml:"timeout"`    // Maximum run time of a whitelisted command (default 60s)
+	MaxOutput int64         `yaml:"max_output"` // Maximum command output in bytes (default 1MiB)
+}
+
+// ExecCommand is a whitelisted command of the remote exec service
+type ExecCommand struct {
+	Name    string   `yaml:"name"`    // Name used by the admin to run the command
+	Command []string `yaml:"command"` // Program and arguments, executed without a shell
+}
+
+// ConnectionPoolConfig represents the client-side pool of prewarmed target connections
+type ConnectionPoolConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	MaxIdlePerHost int           `yaml:"max_idle_per_host"` // Maximum idle connections kept per target host:port and proxy user (default 4)
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`      // How long an idle connection is kept (default 90s)
+	Hosts          []string      `yaml:"hosts"`             // Target patterns whose connections may be pooled (empty = all)
+
+	// Targets connected ahead of the first request, kept topped up while the client runs
+	Prewarm         []PrewarmTarget `yaml:"prewarm"`
+	PrewarmInterval time.Duration   `yaml:"prewarm_interval"` // How often missing prewarmed connections are reopened (default 30s)
+}
+
+// PrewarmTarget is a target the client keeps idle connections open to
+type PrewarmTarget struct {
+	Address     string `yaml:"address"`     // Target host:port, must match hosts when set
+	Connections int    `yaml:"connections"` // Idle connections kept open (default 1, at most max_idle_per_host)
 }
 
 // ClientGatewayConfig represents the gateway connection configuration for the client
 type ClientGatewayConfig struct {
-	Addr          string `yaml:"addr"`
-	TransportType string `yaml:"transport_type"`
-	TLSCert       string `yaml:"tls_cert"`
-	AuthUsername  string `yaml:"auth_username"`
-	AuthPassword  string `yaml:"auth_password"`
+	Addr          string     `yaml:"addr"`
+	TransportType string     `yaml:"transport_type"`
+	TLSCert       string     `yaml:"tls_cert"`
+	AuthUsername  string     `yaml:"auth_username"`
+	AuthPassword  string     `yaml:"auth_password"`
+	KCP           KCPConfig  `yaml:"kcp"`  // Tuning for the kcp transport
+	GRPC          GRPCConfig `yaml:"grpc"` // Options of the grpc transport
+	// Fetch the CA of a gateway with auto_tls into tls_cert when the file doesn't exist
+	EnrollURL   string `yaml:"enroll_url"`   // Gateway web server address, e.g. "gateway.lab:8090"
+	EnrollToken string `yaml:"enroll_token"` // Token logged by the gateway, pins its CA
+}
+
+// GatewayList returns the gateways the client registers with, gateway first
+func (c *ClientConfig) GatewayList() []ClientGatewayConfig {
+	return append([]ClientGatewayConfig{c.Gateway}, c.Gateways...)
+}
+
+// validateClientGateways checks the primary and additional gateways of a client
+func validateClientGateways(c *ClientConfig) error {
+	seen := make(map[string]bool)
+	for i, gw := range c.GatewayList() {
+		name := "client gateway"
+		if i > 0 {
+			name = fmt.Sprintf("client gateways[%d]", i-1)
+			if gw.Addr == "" {
+				return fmt.Errorf("%s.addr is required", name)
+			}
+		}
+		if gw.Addr != "" && seen[gw.Addr] {
+			return fmt.Errorf("%s: gateway %s is listed twice", name, gw.Addr)
+		}
+		seen[gw.Addr] = true
+		if gw.EnrollToken != "" && (gw.EnrollURL == "" || gw.TLSCert == "") {
+			return fmt.Errorf("%s.enroll_token requires enroll_url and tls_cert, where the CA is stored", name)
+		}
+		if err := validateKCPConfig(strings.ReplaceAll(name, " ", ".")+".kcp", gw.KCP); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // WebConfig represents the configuration for the web management interface
@@ -122,6 +1023,86 @@ type WebConfig struct {
 	AuthUsername string `yaml:"auth_username"`
 	AuthPassword string `yaml:"auth_password"`
 	SessionKey   string `yaml:"session_key"`
+	// Accounts with roles besides auth_username, which is an admin (gateway only)
+	Users []WebUserConfig `yaml:"users"`
+	// Branding and localization
+	ThemeDir        string          `yaml:"theme_dir"`        // Files served in place of the built-in ones with the same path, theme.css is loaded by every page
+	I18nDir         string          `yaml:"i18n_dir"`         // Translation bundles named <lang>.json, merged over the built-in strings
+	DefaultLanguage string          `yaml:"default_language"` // Language when the browser has no saved preference (default the browser language)
+	Features        map[string]bool `yaml:"features"`         // Feature flags passed to the dashboards
+
+	// Session persistence, cookies are signed with session_key when it is set
+	SessionStore SessionStoreConfig `yaml:"session_store"`
+
+	// The admin API as a gRPC service, authenticated with the accounts above (gateway only)
+	GRPC GRPCControlConfig `yaml:"grpc"`
+
+	// Login providers besides the accounts above: LDAP and OpenID Connect single sign-on
+	Auth WebAuthConfig `yaml:"auth"`
+}
+
+// WebAuthConfig chains the providers dashboard logins are checked against
+type WebAuthConfig struct {
+	Providers []string        `yaml:"providers"` // "local", "ldap" and "oidc" in the order passwords are tried (default local, then the configured ones); leaving out local disables the accounts above
+	LDAP      *LDAPAuthConfig `yaml:"ldap"`
+	OIDC      *OIDCAuthConfig `yaml:"oidc"`
+}
+
+// LDAPAuthConfig checks dashboard passwords with an LDAP simple bind
+type LDAPAuthConfig struct {
+	URL                string            `yaml:"url"`                  // ldap://host:389 or ldaps://host:636
+	StartTLS           bool              `yaml:"start_tls"`            // Upgrade ldap:// connections with StartTLS
+	CACert             string            `yaml:"ca_cert"`              // CA of the server certificate (default system roots)
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"` // Don't verify the server certificate
+	BindDN             string            `yaml:"bind_dn"`              // DN template, %s is replaced by the escaped username, e.g. uid=%s,ou=people,dc=example,dc=com
+	Timeout            time.Duration     `yaml:"timeout"`              // Dial and bind timeout (default 5s)
+	Users              map[string]string `yaml:"users"`                // Roles of usernames
+	DefaultRole        string            `yaml:"default_role"`         // Role of users not listed in users (default none, they can't log in)
+}
+
+// OIDCAuthConfig signs dashboard users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE
+type OIDCAuthConfig struct {
+	Issuer        string            `yaml:"issuer"` // Issuer URL, its /.well-known/openid-configuration is discovered
+	ClientID      string            `yaml:"client_id"`
+	ClientSecret  string            `yaml:"client_secret"`  // Empty for public clients
+	RedirectURL   string            `yaml:"redirect_url"`   // Dashboard URL of /api/auth/oidc/callback, registered with the provider
+	Scopes        []string          `yaml:"scopes"`         // Default openid, profile and email
+	UsernameClaim string            `yaml:"username_claim"` // ID token claim of the username (default preferred_username)
+	RolesClaim    string            `yaml:"roles_claim"`    // ID token claim of the user's groups or roles (default groups)
+	RoleMapping   map[string]string `yaml:"role_mapping"`   // Roles of roles_claim values, the highest one wins
+	DefaultRole   string            `yaml:"default_role"`   // Role of users without a mapped value (default none, they can't log in)
+}
+
+// GRPCControlConfig serves the admin API as the gRPC service anyproxy.control.v1.ControlService
+type GRPCControlConfig struct {
+	ListenAddr string `yaml:"listen_addr"` // Empty disables the gRPC API
+	TLSCert    string `yaml:"tls_cert"`    // Serve TLS with this certificate and tls_key (default plain text)
+	TLSKey     string `yaml:"tls_key"`
+}
+
+// WebUserConfig represents a dashboard account and its role
+type WebUserConfig struct {
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Role     string   `yaml:"role"`   // "viewer" (metrics), "operator" (also kicks clients) or "admin" (everything)
+	Groups   []string `yaml:"groups"` // Tenant login limited to the clients, connections and quotas of these groups
+}
+
+// SessionStoreConfig represents where dashboard sessions are kept. Gateways sharing a file
+// directory or Redis and the same session_key share their sessions.
+type SessionStoreConfig struct {
+	Type  string              `yaml:"type"`  // "memory" (default), "file" or "redis"
+	Dir   string              `yaml:"dir"`   // Only used for file type
+	Redis *SessionRedisConfig `yaml:"redis"` // Only used for redis type
+}
+
+// SessionRedisConfig represents the Redis server of the redis session store
+type SessionRedisConfig struct {
+	Addr      string `yaml:"addr"` // host:port
+	Password  string `yaml:"password"`
+	DB        int    `yaml:"db"`
+	KeyPrefix string `yaml:"key_prefix"` // Prefix of session keys (default "anyproxy:session:")
 }
 
 var conf *Config
@@ -138,6 +1119,11 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 
+	// Resolve ${...} references to environment variables, files and secret stores
+	if err := resolveSecrets(&config); err != nil {
+		return nil, fmt.Errorf("failed to resolve config secrets: %w", err)
+	}
+
 	// Validate configuration
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("configuration validation failed: %v", err)
@@ -163,7 +1149,1280 @@ func (c *Config) Validate() error {
 
 		// Note: group_password is optional when using file or db credential storage
 		// In these cases, credentials are pre-configured in the storage
-	}
 
+		if c.Client.MaxConnections < 0 {
+			return fmt.Errorf("client max_connections cannot be negative")
+		}
+		if c.Client.MaxConnectRate < 0 || c.Client.ConnectBurst < 0 {
+			return fmt.Errorf("client max_connect_rate and connect_burst cannot be negative")
+		}
+		if err := validateClientGateways(&c.Client); err != nil {
+			return err
+		}
+		if c.Client.Heartbeat.Bandwidth < 0 {
+			return fmt.Errorf("client heartbeat.bandwidth cannot be negative")
+		}
+		for _, port := range c.Client.OpenPorts {
+			if err := ValidatePortSources(port); err != nil {
+				return fmt.Errorf("client open_ports: %v", err)
+			}
+		}
+		if c.Client.DisableUDP {
+			for _, port := range c.Client.OpenPorts {
+				if port.Protocol == "udp" {
+					return fmt.Errorf("client open_ports: udp port %d needs UDP, which disable_udp turns off", port.RemotePort)
+				}
+			}
+		}
+		if c.Client.ConnectionPool.MaxIdlePerHost < 0 {
+			return fmt.Errorf("client connection_pool.max_idle_per_host cannot be negative")
+		}
+		if c.Client.ConnectionPool.IdleTimeout < 0 {
+			return fmt.Errorf("client connection_pool.idle_timeout cannot be negative")
+		}
+		if err := validatePrewarm(c.Client.ConnectionPool); err != nil {
+			return err
+		}
+		if err := validateChecks(&c.Client); err != nil {
+			return err
+		}
+		if ft := c.Client.FileTransfer; ft.Enabled {
+			if ft.RootDir == "" {
+				return fmt.Errorf("client file_transfer.root_dir is required when file_transfer is enabled")
+			}
+			if ft.Token == "" {
+				return fmt.Errorf("client file_transfer.token is required when file_transfer is enabled")
+			}
+			if ft.MaxFileSize < 0 {
+				return fmt.Errorf("client file_transfer.max_file_size cannot be negative")
+			}
+		}
+		if err := validateRemoteExecConfig(c.Client.RemoteExec); err != nil {
+			return err
+		}
+		if au := c.Client.AutoUpdate; au.Enabled {
+			if _, err := update.ParsePublicKey(au.PublicKey); err != nil {
+				return fmt.Errorf("client auto_update.public_key: %v", err)
+			}
+			if _, err := update.ParseWindow(au.Window); err != nil {
+				return fmt.Errorf("client auto_update.window: %v", err)
+			}
+			if au.MaxSize < 0 {
+				return fmt.Errorf("client auto_update.max_size cannot be negative")
+			}
+		}
+		if err := validateSocketOptions("client.socket_options", &c.Client.SocketOptions); err != nil {
+			return err
+		}
+		if err := validateSessionStore("client.web.session_store", c.Client.Web.SessionStore); err != nil {
+			return err
+		}
+		if err := validateWebAuth("client.web.auth", c.Client.Web.Auth); err != nil {
+			return err
+		}
+		if c.Client.Spool.MaxBytes < 0 {
+			return fmt.Errorf("client.spool.max_bytes cannot be negative")
+		}
+		for i, cidr := range c.Client.DialGuard.AllowedCIDRs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				return fmt.Errorf("client.dial_guard.allowed_cidrs[%d]: %v", i, err)
+			}
+		}
+		for i, rule := range c.Client.Outbound {
+			if err := validateOutboundRule(fmt.Sprintf("client.outbound[%d]", i), rule); err != nil {
+				return err
+			}
+		}
+		if err := validateEgressConfig("client.egress", c.Client.Egress); err != nil {
+			return err
+		}
+		if err := validateQoSConfig("client.qos", c.Client.QoS); err != nil {
+			return err
+		}
+		for i, peer := range c.Client.PeerListeners {
+			if err := validatePeerListener(fmt.Sprintf("client.peer_listeners[%d]", i), peer); err != nil {
+				return err
+			}
+		}
+		if err := validateClientTunConfig(c.Client.Tun); err != nil {
+			return err
+		}
+		if c.Client.Discovery.Interval < 0 {
+			return fmt.Errorf("client.discovery.interval cannot be negative")
+		}
+		if c.Client.SignedControl && c.Client.GroupPassword == "" {
+			return fmt.Errorf("client.signed_control requires group_password, the signing key is derived from it")
+		}
+		if c.Client.PolicyPublicKey != "" {
+			if _, err := update.ParsePublicKey(c.Client.PolicyPublicKey); err != nil {
+				return fmt.Errorf("client.policy_public_key: %v", err)
+			}
+		}
+	}
+
+	// Validate per-group limits
+	if err := validateGroupConfig("group_defaults", c.Gateway.GroupDefaults); err != nil {
+		return err
+	}
+	for groupID, groupCfg := range c.Gateway.Groups {
+		if err := validateGroupConfig("groups."+groupID, groupCfg); err != nil {
+			return err
+		}
+	}
+
+	if err := validatePACConfig(c.Gateway.PAC); err != nil {
+		return err
+	}
+	if err := validateStatusPageConfig(c.Gateway.StatusPage); err != nil {
+		return err
+	}
+	if err := validateSubGroupsConfig(c.Gateway.SubGroups); err != nil {
+		return err
+	}
+
+	limits := c.Gateway.ResourceLimits
+	if limits.MaxGoroutines < 0 || limits.MaxConnections < 0 || limits.MaxHeapMB < 0 || limits.CheckInterval < 0 {
+		return fmt.Errorf("resource_limits values cannot be negative")
+	}
+	if c.Gateway.ClientUpdates.Enabled && c.Gateway.ClientUpdates.Dir == "" {
+		return fmt.Errorf("client_updates.dir is required when client_updates is enabled")
+	}
+	for i, rule := range c.Gateway.SourceRoutes {
+		if rule.GroupID == "" {
+			return fmt.Errorf("source_routes[%d].group_id is required", i)
+		}
+		if len(rule.CIDRs) == 0 {
+			return fmt.Errorf("source_routes[%d].cidrs cannot be empty", i)
+		}
+		for _, cidr := range rule.CIDRs {
+			if _, err := ParseSourcePrefix(cidr); err != nil {
+				return fmt.Errorf("source_routes[%d]: %v", i, err)
+			}
+		}
+	}
+	if err := validateProxyListeners(c.Gateway.Proxy); err != nil {
+		return err
+	}
+	if err := validateBlocklists(&c.Gateway); err != nil {
+		return err
+	}
+	if err := validatePolicyPacks(&c.Gateway); err != nil {
+		return err
+	}
+	if err := validateSessionStore("gateway.web.session_store", c.Gateway.Web.SessionStore); err != nil {
+		return err
+	}
+	if err := validateWebUsers(c.Gateway.Web); err != nil {
+		return err
+	}
+	if err := validateWebAuth("gateway.web.auth", c.Gateway.Web.Auth); err != nil {
+		return err
+	}
+	if grpc := c.Gateway.Web.GRPC; (grpc.TLSCert == "") != (grpc.TLSKey == "") {
+		return fmt.Errorf("gateway.web.grpc.tls_cert and tls_key must be set together")
+	}
+	if err := validateClientIdentity(c.Gateway.ClientIdentity); err != nil {
+		return err
+	}
+	if c.Gateway.AutoTLS.Enabled && (c.Gateway.TLSCert != "" || c.Gateway.TLSKey != "") {
+		return fmt.Errorf("gateway auto_tls and tls_cert/tls_key are mutually exclusive")
+	}
+	if err := validateEgressConfig("gateway.egress", c.Gateway.Egress); err != nil {
+		return err
+	}
+	if err := validateQoSConfig("gateway.qos", c.Gateway.QoS); err != nil {
+		return err
+	}
+	if enc := c.Gateway.StorageEncryption; enc.KeyEnv != "" && enc.KeyFile != "" {
+		return fmt.Errorf("gateway.storage_encryption.key_env and key_file are mutually exclusive")
+	}
+	switch c.Gateway.RateLimitStorage.Type {
+	case "", RateLimitStorageMemory, RateLimitStorageFile:
+	case RateLimitStorageDB:
+		db := c.Gateway.RateLimitStorage.DB
+		if db == nil || db.DataSource == "" {
+			return fmt.Errorf("gateway.rate_limit_storage.db.data_source is required for db storage")
+		}
+		if db.Driver != "sqlite" && db.Driver != "postgres" {
+			return fmt.Errorf("gateway.rate_limit_storage.db.driver must be one of: sqlite, postgres")
+		}
+	default:
+		return fmt.Errorf("gateway.rate_limit_storage.type must be one of: memory, file, db")
+	}
+	if c.Gateway.Mirror.MaxBytes < 0 {
+		return fmt.Errorf("mirror.max_bytes cannot be negative")
+	}
+	if err := validateKCPConfig("gateway.kcp", c.Gateway.KCP); err != nil {
+		return err
+	}
+	if err := validateSocketOptions("gateway.socket_options", &c.Gateway.SocketOptions); err != nil {
+		return err
+	}
+	if c.Gateway.IdleProbeInterval != 0 && c.Gateway.IdleProbeInterval < time.Second {
+		return fmt.Errorf("gateway.idle_probe_interval must be at least 1s or 0 to disable probes")
+	}
+	if err := validateDNSCacheConfig(&c.Gateway.DNSCache); err != nil {
+		return err
+	}
+	if c.Gateway.Hibernation.IdleAfter != 0 && c.Gateway.Hibernation.IdleAfter < time.Second {
+		return fmt.Errorf("gateway.hibernation.idle_after must be at least 1s or 0 to disable hibernation")
+	}
+	if c.Gateway.EventBytesMilestone < 0 {
+		return fmt.Errorf("gateway.event_bytes_milestone cannot be negative")
+	}
+	if startup := c.Gateway.Startup; startup.BindAttempts < 0 || startup.BindBackoff < 0 || startup.MaxBindBackoff < 0 {
+		return fmt.Errorf("gateway.startup.bind_attempts, bind_backoff and max_bind_backoff cannot be negative")
+	}
+	if c.Gateway.GroupGC.GracePeriod < 0 {
+		return fmt.Errorf("gateway.group_gc.grace_period cannot be negative")
+	}
+	if err := validateIngress(c.Gateway.Ingress, c.Gateway.Proxy); err != nil {
+		return err
+	}
+	if err := validateTunConfig("gateway.tun", c.Gateway.Tun.TunConfig); err != nil {
+		return err
+	}
+	if c.Gateway.Tun.Enabled && len(c.Gateway.Tun.Groups) == 0 {
+		return fmt.Errorf("gateway.tun.groups cannot be empty")
+	}
+	for i, group := range c.Gateway.Tun.Groups {
+		name := fmt.Sprintf("gateway.tun.groups[%d]", i)
+		if group.GroupID == "" {
+			return fmt.Errorf("%s.group_id is required", name)
+		}
+		if err := validatePrefixes(name+".routes", group.Routes); err != nil {
+			return err
+		}
+	}
+	if err := validateTLSFingerprint("gateway.tls_fingerprint", &c.Gateway.TLSFingerprint); err != nil {
+		return err
+	}
+	// QUIC carries the ClientHello inside its own packets, rules would silently accept every handshake
+	if fp := c.Gateway.TLSFingerprint; len(fp.Allow) > 0 || len(fp.Block) > 0 {
+		switch c.Gateway.TransportType {
+		case "quic", "webtransport":
+			return fmt.Errorf("gateway.tls_fingerprint: allow and block rules are not supported with the %s transport, its handshakes are not fingerprinted", c.Gateway.TransportType)
+		}
+	}
+
+	if err := validateUpgrade(c.Gateway); err != nil {
+		return err
+	}
+	if anomaly := c.Gateway.AnomalyDetection; anomaly.Factor != 0 && anomaly.Factor <= 1 {
+		return fmt.Errorf("gateway.anomaly_detection.factor must be greater than 1")
+	}
+	if limits := c.Gateway.MetricsLimits; limits.MaxConnections < 0 || limits.MaxClients < 0 || limits.SampleRate < 0 {
+		return fmt.Errorf("gateway.metrics_limits values cannot be negative")
+	}
+	if err := validateUsageReports(c.Gateway.UsageReports); err != nil {
+		return err
+	}
+
+	return validateGeoIPConfig(c.Gateway.GeoIP)
+}
+
+// validateEgressConfig validates an egress bandwidth scheduler
+func validateEgressConfig(name string, cfg EgressConfig) error {
+	if cfg.MaxBandwidth < 0 || cfg.Burst < 0 {
+		return fmt.Errorf("%s values cannot be negative", name)
+	}
+	for port, weight := range cfg.PortWeights {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("%s.port_weights: invalid port %d", name, port)
+		}
+		if weight < 1 {
+			return fmt.Errorf("%s.port_weights.%d: weight must be at least 1", name, port)
+		}
+	}
+	return nil
+}
+
+// validateQoSConfig validates the QoS rules
+func validateQoSConfig(name string, cfg QoSConfig) error {
+	for i, rule := range cfg.Rules {
+		switch rule.Priority {
+		case QoSPriorityLow, QoSPriorityNormal, QoSPriorityHigh:
+		default:
+			return fmt.Errorf("%s.rules[%d].priority must be one of: high, normal, low", name, i)
+		}
+		for _, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				return fmt.Errorf("%s.rules[%d]: invalid port %d", name, i, port)
+			}
+		}
+		for _, host := range rule.Hosts {
+			list := blocklist.New()
+			if list.AddLine(host); list.Len() == 0 {
+				return fmt.Errorf("%s.rules[%d]: invalid host %q", name, i, host)
+			}
+		}
+	}
+	return nil
+}
+
+// validateProxyListeners validates the proxy listeners and that no two share an address
+func validateProxyListeners(proxy ProxyConfig) error {
+	for i, l := range proxy.Listeners {
+		name := fmt.Sprintf("gateway.proxy.listeners[%d]", i)
+		switch l.Type {
+		case ProxyTypeHTTP, ProxyTypeSOCKS5, ProxyTypeTUIC:
+		default:
+			return fmt.Errorf("%s.type must be one of: http, socks5, tuic", name)
+		}
+		if l.Addr == "" {
+			return fmt.Errorf("%s.addr is required", name)
+		}
+		for _, group := range l.Groups {
+			if group == "" {
+				return fmt.Errorf("%s.groups cannot contain empty group IDs", name)
+			}
+		}
+	}
+
+	used := make(map[string]string) // Network and address to the section using it
+	for _, section := range proxy.sections() {
+		if err := validateProxyListener(section); err != nil {
+			return err
+		}
+		l := section.listener
+		if l.Addr == "" {
+			continue
+		}
+		key := "tcp/" + l.Addr
+		if l.Type == ProxyTypeTUIC {
+			key = "udp/" + l.Addr
+		}
+		if other, ok := used[key]; ok {
+			return fmt.Errorf("%s listens on %s, which %s already uses", section.name, l.Addr, other)
+		}
+		used[key] = section.name
+	}
+	return nil
+}
+
+// validateProxyListener validates the options of a proxy listener
+func validateProxyListener(section proxyListenerSection) error {
+	l, name := section.listener, section.name
+	var (
+		opts    *SocketOptions
+		timeout time.Duration
+		limits  ListenerLimits
+	)
+	switch l.Type {
+	case ProxyTypeHTTP:
+		opts, timeout, limits = l.HTTP.SocketOptions, l.HTTP.DialTimeout, l.HTTP.Limits
+		if l.HTTP.MaxHeaderBytes < 0 || l.HTTP.ReadHeaderTimeout < 0 || l.HTTP.MaxBodyBytes < 0 || l.HTTP.MaxPendingConnects < 0 {
+			return fmt.Errorf("%s.max_header_bytes, read_header_timeout, max_body_bytes and max_pending_connects cannot be negative", name)
+		}
+		if r := l.HTTP.Retry; r.MaxAttempts < 0 || r.Backoff < 0 || r.MaxBackoff < 0 {
+			return fmt.Errorf("%s.retry.max_attempts, backoff and max_backoff cannot be negative", name)
+		}
+		if err := validateHTTPAuth(name, l.HTTP); err != nil {
+			return err
+		}
+		if err := validateTLSFingerprint(name+".tls_fingerprint", l.HTTP.TLSFingerprint); err != nil {
+			return err
+		}
+		for i, rule := range l.HTTP.TargetTLS {
+			if err := validateTargetTLSRule(fmt.Sprintf("%s.target_tls[%d]", name, i), rule); err != nil {
+				return err
+			}
+		}
+	case ProxyTypeSOCKS5:
+		opts, timeout, limits = l.SOCKS5.SocketOptions, l.SOCKS5.DialTimeout, l.SOCKS5.Limits
+		if err := validateSOCKS5Auth(strings.TrimPrefix(name, "gateway."), l.SOCKS5); err != nil {
+			return err
+		}
+	case ProxyTypeTUIC:
+		opts, timeout, limits = l.TUIC.SocketOptions, l.TUIC.DialTimeout, l.TUIC.Limits
+		if l.TUIC.HeartbeatInterval < 0 || l.TUIC.AuthTimeout < 0 || l.TUIC.UDPSessionTimeout < 0 || l.TUIC.MaxUDPSessions < 0 {
+			return fmt.Errorf("%s.heartbeat_interval, auth_timeout, udp_session_timeout and max_udp_sessions cannot be negative", name)
+		}
+		if l.TUIC.HeartbeatInterval > 0 && l.TUIC.AuthTimeout > 0 && l.TUIC.AuthTimeout <= l.TUIC.HeartbeatInterval {
+			return fmt.Errorf("%s.auth_timeout must be longer than heartbeat_interval", name)
+		}
+	}
+	if err := validateSocketOptions(name+".socket_options", opts); err != nil {
+		return err
+	}
+	if timeout < 0 {
+		return fmt.Errorf("%s.dial_timeout cannot be negative", name)
+	}
+	return validateListenerLimits(name+".limits", limits)
+}
+
+// validateIngress validates the static ingress mappings and that their addresses are not taken
+// by other ingress mappings or TCP proxy listeners
+func validateIngress(mappings []IngressMapping, proxy ProxyConfig) error {
+	used := make(map[string]string) // Listen address to the section using it
+	for _, l := range proxy.AllListeners() {
+		if l.Type != ProxyTypeTUIC {
+			used[l.Addr] = "a " + l.Type + " proxy listener"
+		}
+	}
+	for i, mapping := range mappings {
+		name := fmt.Sprintf("gateway.ingress[%d]", i)
+		if _, _, err := net.SplitHostPort(mapping.ListenAddr); err != nil && !IsSocketListenAddr(mapping.ListenAddr) {
+			return fmt.Errorf("%s.listen_addr must be host:port: %v", name, err)
+		}
+		if mapping.GroupID == "" {
+			return fmt.Errorf("%s.group_id is required", name)
+		}
+		host, port, err := net.SplitHostPort(mapping.Target)
+		if err != nil || host == "" {
+			return fmt.Errorf("%s.target must be host:port", name)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%s.target port must be between 1 and 65535", name)
+		}
+		if other, ok := used[mapping.ListenAddr]; ok {
+			return fmt.Errorf("%s listens on %s, which %s already uses", name, mapping.ListenAddr, other)
+		}
+		used[mapping.ListenAddr] = name
+	}
+	return nil
+}
+
+// validateDNSCacheConfig validates the gateway DNS cache
+func validateDNSCacheConfig(cfg *DNSCacheConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.MinTTL < 0 || cfg.MaxTTL < 0 || cfg.NegativeTTL < 0 {
+		return fmt.Errorf("gateway.dns_cache TTLs cannot be negative")
+	}
+	if cfg.MinTTL > 0 && cfg.MaxTTL > 0 && cfg.MinTTL > cfg.MaxTTL {
+		return fmt.Errorf("gateway.dns_cache.min_ttl cannot exceed max_ttl")
+	}
+	if cfg.MaxEntries < 0 {
+		return fmt.Errorf("gateway.dns_cache.max_entries cannot be negative")
+	}
+	for i, server := range cfg.Servers {
+		host := server
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+		if net.ParseIP(strings.Trim(host, "[]")) == nil {
+			return fmt.Errorf("gateway.dns_cache.servers[%d] must be an IP address with an optional port: %q", i, server)
+		}
+	}
+	return nil
+}
+
+// validateTunConfig validates a TUN interface
+func validateTunConfig(name string, tun TunConfig) error {
+	if !tun.Enabled {
+		return nil
+	}
+	if _, err := netip.ParsePrefix(tun.Address); err != nil {
+		return fmt.Errorf("%s.address must be an address in CIDR notation, e.g. 10.99.0.2/24", name)
+	}
+	if tun.MTU != 0 && (tun.MTU < 576 || tun.MTU > 65535) {
+		return fmt.Errorf("%s.mtu must be between 576 and 65535", name)
+	}
+	return validatePrefixes(name+".routes", tun.Routes)
+}
+
+// validateClientTunConfig validates the TUN interface and split tunneling domains of a client
+func validateClientTunConfig(tun ClientTunConfig) error {
+	if err := validateTunConfig("client.tun", tun.TunConfig); err != nil {
+		return err
+	}
+	for i, domain := range tun.Domains {
+		if _, err := netip.ParseAddr(domain); err == nil || domain == "" || strings.ContainsAny(domain, "*/: ") {
+			return fmt.Errorf("client.tun.domains[%d]: %q is not a host name, addresses and CIDRs go in routes", i, domain)
+		}
+	}
+	if tun.DomainRefresh < 0 {
+		return fmt.Errorf("client.tun.domain_refresh cannot be negative")
+	}
+	return nil
+}
+
+// validatePrefixes validates a list of network prefixes
+func validatePrefixes(name string, prefixes []string) error {
+	for i, prefix := range prefixes {
+		if _, err := netip.ParsePrefix(prefix); err != nil {
+			return fmt.Errorf("%s[%d]: invalid prefix %q", name, i, prefix)
+		}
+	}
+	return nil
+}
+
+// validatePeerListener validates a client peer listener
+func validatePeerListener(name string, peer PeerListener) error {
+	if peer.ListenAddr == "" {
+		return fmt.Errorf("%s.listen_addr is required", name)
+	}
+	if peer.GroupID == "" {
+		return fmt.Errorf("%s.group_id is required", name)
+	}
+	switch peer.Protocol {
+	case "", PeerProtocolSOCKS5, PeerProtocolHTTP:
+	case PeerProtocolTCP:
+		if _, _, err := net.SplitHostPort(peer.Target); err != nil {
+			return fmt.Errorf("%s.target must be host:port for the tcp protocol", name)
+		}
+	default:
+		return fmt.Errorf("%s.protocol must be one of: socks5, http, tcp", name)
+	}
+	return nil
+}
+
+// validateTargetTLSRule validates a target TLS verification rule
+func validateTargetTLSRule(name string, rule TargetTLSRule) error {
+	if len(rule.Hosts) == 0 {
+		return fmt.Errorf("%s.hosts cannot be empty", name)
+	}
+	for _, host := range rule.Hosts {
+		list := blocklist.New()
+		if list.AddLine(host); list.Len() == 0 {
+			return fmt.Errorf("%s: invalid host %q", name, host)
+		}
+	}
+	if rule.CAFile != "" && rule.InsecureSkipVerify {
+		return fmt.Errorf("%s.ca_file and insecure_skip_verify are mutually exclusive", name)
+	}
+	for _, pin := range rule.PinSHA256 {
+		if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("%s.pin_sha256: %q is not a base64 SHA-256 hash", name, pin)
+		}
+	}
+	return nil
+}
+
+// validateListenerLimits validates the limits of a proxy listener
+func validateListenerLimits(name string, limits ListenerLimits) error {
+	if limits.MaxConnections < 0 || limits.AcceptRate < 0 || limits.AcceptBurst < 0 || limits.QueueTimeout < 0 {
+		return fmt.Errorf("%s values cannot be negative", name)
+	}
+	switch limits.Overflow {
+	case "", ListenerOverflowReject, ListenerOverflowQueue:
+	default:
+		return fmt.Errorf("%s.overflow must be one of: reject, queue", name)
+	}
+	return nil
+}
+
+// TLS fingerprint rule formats
+var (
+	ja3HashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	ja4Pattern     = regexp.MustCompile(`^[tq](13|12|11|10|s3|00)[di]\d{4}[0-9a-zA-Z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+)
+
+// validateTLSFingerprint checks that the rules are JA3 hashes or JA4 fingerprints
+func validateTLSFingerprint(name string, cfg *TLSFingerprintConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	for field, rules := range map[string][]string{"block": cfg.Block, "allow": cfg.Allow} {
+		for _, rule := range rules {
+			if !ja3HashPattern.MatchString(rule) && !ja4Pattern.MatchString(rule) {
+				return fmt.Errorf("%s.%s: %q is neither a JA3 hash nor a JA4 fingerprint", name, field, rule)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSessionStore validates the session store of a web interface
+func validateSessionStore(name string, cfg SessionStoreConfig) error {
+	switch cfg.Type {
+	case "", "memory":
+	case "file":
+		if cfg.Dir == "" {
+			return fmt.Errorf("%s.dir is required for the file store", name)
+		}
+	case "redis":
+		if cfg.Redis == nil || cfg.Redis.Addr == "" {
+			return fmt.Errorf("%s.redis.addr is required for the redis store", name)
+		}
+	default:
+		return fmt.Errorf("%s.type must be one of: memory, file, redis", name)
+	}
+	return nil
+}
+
+// validateUpgrade validates zero-downtime upgrades, which need a TCP transport: UDP sessions
+// would be spread over both processes once they share the port. Unix and systemd sockets can't
+// be shared with the new process, which would fail to listen on them.
+func validateUpgrade(gateway GatewayConfig) error {
+	cfg := gateway.Upgrade
+	if cfg.ReadyTimeout < 0 {
+		return fmt.Errorf("gateway.upgrade.ready_timeout cannot be negative")
+	}
+	if cfg.DrainWindow < 0 {
+		return fmt.Errorf("gateway.upgrade.drain_window cannot be negative")
+	}
+	if cfg.Enabled {
+		switch gateway.TransportType {
+		case "", "grpc", "websocket":
+		default:
+			return fmt.Errorf("gateway.upgrade requires the grpc or websocket transport")
+		}
+		addrs := [][2]string{
+			{"gateway.listen_addr", gateway.ListenAddr},
+			{"gateway.web.listen_addr", gateway.Web.ListenAddr},
+			{"gateway.web.grpc.listen_addr", gateway.Web.GRPC.ListenAddr},
+		}
+		for _, section := range gateway.Proxy.sections() {
+			addrs = append(addrs, [2]string{section.name + ".listen_addr", section.listener.Addr})
+		}
+		for i, mapping := range gateway.Ingress {
+			addrs = append(addrs, [2]string{fmt.Sprintf("gateway.ingress[%d].listen_addr", i), mapping.ListenAddr})
+		}
+		for _, addr := range addrs {
+			if IsSocketListenAddr(addr[1]) {
+				return fmt.Errorf("gateway.upgrade can't be used with the unix or systemd socket of %s", addr[0])
+			}
+		}
+	}
+	return nil
+}
+
+// validateUsageReports validates the scheduled usage reports
+func validateUsageReports(cfg UsageReportsConfig) error {
+	switch cfg.Period {
+	case "":
+		return nil
+	case "daily", "weekly":
+	default:
+		return fmt.Errorf("gateway.usage_reports.period must be daily or weekly")
+	}
+	switch cfg.Format {
+	case "", "csv", "json":
+	default:
+		return fmt.Errorf("gateway.usage_reports.format must be csv or json")
+	}
+	if cfg.Dir == "" && cfg.Webhook == "" && cfg.S3.Endpoint == "" {
+		return fmt.Errorf("gateway.usage_reports requires a dir, webhook or s3 endpoint")
+	}
+	if cfg.S3.Endpoint != "" && cfg.S3.Bucket == "" {
+		return fmt.Errorf("gateway.usage_reports.s3.bucket is required")
+	}
+	if (cfg.S3.AccessKeyID == "") != (cfg.S3.SecretAccessKey == "") {
+		return fmt.Errorf("gateway.usage_reports.s3 access_key_id and secret_access_key must be set together")
+	}
+	return nil
+}
+
+// validatePrewarm validates the prewarmed targets of the client connection pool
+func validatePrewarm(pool ConnectionPoolConfig) error {
+	if pool.PrewarmInterval < 0 {
+		return fmt.Errorf("client connection_pool.prewarm_interval cannot be negative")
+	}
+	if len(pool.Prewarm) > 0 && !pool.Enabled {
+		return fmt.Errorf("client connection_pool.prewarm requires connection_pool.enabled")
+	}
+	for i, target := range pool.Prewarm {
+		if _, port, err := net.SplitHostPort(target.Address); err != nil || port == "" {
+			return fmt.Errorf("client connection_pool.prewarm[%d].address must be host:port: %q", i, target.Address)
+		}
+		if target.Connections < 0 {
+			return fmt.Errorf("client connection_pool.prewarm[%d].connections cannot be negative", i)
+		}
+	}
+	return nil
+}
+
+// validateChecks validates the synthetic checks of the client
+func validateChecks(client *ClientConfig) error {
+	if len(client.Checks) > 0 && client.Heartbeat.Interval < 0 {
+		return fmt.Errorf("client checks are reported with heartbeats, which heartbeat.interval disables")
+	}
+	names := make(map[string]bool)
+	for i, check := range client.Checks {
+		if check.Name == "" {
+			return fmt.Errorf("client checks[%d].name is required", i)
+		}
+		if names[check.Name] {
+			return fmt.Errorf("client checks[%d]: duplicate name %q", i, check.Name)
+		}
+		names[check.Name] = true
+		switch check.Type {
+		case CheckTypeTCP:
+			if _, port, err := net.SplitHostPort(check.Target); err != nil || port == "" {
+				return fmt.Errorf("client checks[%d].target must be host:port: %q", i, check.Target)
+			}
+		case CheckTypeHTTP:
+			if u, err := url.Parse(check.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("client checks[%d].target must be an http or https URL: %q", i, check.Target)
+			}
+		default:
+			return fmt.Errorf("client checks[%d].type must be tcp or http: %q", i, check.Type)
+		}
+		if check.Interval < 0 || check.Timeout < 0 {
+			return fmt.Errorf("client checks[%d]: interval and timeout cannot be negative", i)
+		}
+	}
+	return nil
+}
+
+// validateWebUsers validates the dashboard accounts of the gateway
+func validateWebUsers(web WebConfig) error {
+	seen := map[string]bool{web.AuthUsername: web.AuthUsername != ""}
+	for i, user := range web.Users {
+		if user.Username == "" || user.Password == "" {
+			return fmt.Errorf("gateway.web.users[%d]: username and password are required", i)
+		}
+		if seen[user.Username] {
+			return fmt.Errorf("gateway.web.users[%d]: duplicate username %q", i, user.Username)
+		}
+		seen[user.Username] = true
+		switch user.Role {
+		case "viewer", "operator", "admin":
+		default:
+			return fmt.Errorf("gateway.web.users[%d].role must be one of: viewer, operator, admin", i)
+		}
+		if err := validateTenantGroups(user); err != nil {
+			return fmt.Errorf("gateway.web.users[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// validateWebAuth validates the login providers of a web dashboard
+func validateWebAuth(prefix string, auth WebAuthConfig) error {
+	validRole := func(role string) bool { return role == "viewer" || role == "operator" || role == "admin" }
+	seen := make(map[string]bool)
+	for i, provider := range auth.Providers {
+		switch {
+		case provider != "local" && provider != "ldap" && provider != "oidc":
+			return fmt.Errorf("%s.providers[%d] must be one of: local, ldap, oidc", prefix, i)
+		case seen[provider]:
+			return fmt.Errorf("%s.providers[%d]: duplicate provider %q", prefix, i, provider)
+		case provider == "ldap" && auth.LDAP == nil, provider == "oidc" && auth.OIDC == nil:
+			return fmt.Errorf("%s.providers[%d]: %s requires %s.%s settings", prefix, i, provider, prefix, provider)
+		}
+		seen[provider] = true
+	}
+	if ldap := auth.LDAP; ldap != nil {
+		u, err := url.Parse(ldap.URL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return fmt.Errorf("%s.ldap.url must be an ldap:// or ldaps:// URL", prefix)
+		}
+		if ldap.StartTLS && u.Scheme == "ldaps" {
+			return fmt.Errorf("%s.ldap.start_tls requires an ldap:// URL", prefix)
+		}
+		if strings.Count(ldap.BindDN, "%s") != 1 {
+			return fmt.Errorf("%s.ldap.bind_dn must contain %%s once", prefix)
+		}
+		if ldap.Timeout < 0 {
+			return fmt.Errorf("%s.ldap.timeout cannot be negative", prefix)
+		}
+		if ldap.DefaultRole != "" && !validRole(ldap.DefaultRole) {
+			return fmt.Errorf("%s.ldap.default_role must be one of: viewer, operator, admin", prefix)
+		}
+		for username, role := range ldap.Users {
+			if !validRole(role) {
+				return fmt.Errorf("%s.ldap.users.%s must be one of: viewer, operator, admin", prefix, username)
+			}
+		}
+	}
+	if oidc := auth.OIDC; oidc != nil {
+		if u, err := url.Parse(oidc.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%s.oidc.issuer must be an http(s) URL", prefix)
+		}
+		if oidc.ClientID == "" {
+			return fmt.Errorf("%s.oidc.client_id is required", prefix)
+		}
+		if u, err := url.Parse(oidc.RedirectURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%s.oidc.redirect_url must be an http(s) URL", prefix)
+		}
+		if oidc.DefaultRole != "" && !validRole(oidc.DefaultRole) {
+			return fmt.Errorf("%s.oidc.default_role must be one of: viewer, operator, admin", prefix)
+		}
+		for value, role := range oidc.RoleMapping {
+			if !validRole(role) {
+				return fmt.Errorf("%s.oidc.role_mapping.%s must be one of: viewer, operator, admin", prefix, value)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTenantGroups validates the groups a tenant dashboard account is limited to
+func validateTenantGroups(user WebUserConfig) error {
+	if len(user.Groups) == 0 {
+		return nil
+	}
+	if user.Role == "admin" {
+		return fmt.Errorf("tenant accounts limited to groups cannot be admins")
+	}
+	for _, group := range user.Groups {
+		if group == "" {
+			return fmt.Errorf("groups cannot contain empty group IDs")
+		}
+	}
+	return nil
+}
+
+// clientIdentityFingerprintPattern matches the key fingerprints of client identity pins
+var clientIdentityFingerprintPattern = regexp.MustCompile(`^SHA256:[0-9a-f]{64}$`)
+
+// validateClientIdentity validates client ID pinning
+func validateClientIdentity(cfg ClientIdentityConfig) error {
+	if cfg.MaxClockSkew < 0 {
+		return fmt.Errorf("gateway.client_identity.max_clock_skew cannot be negative")
+	}
+	for clientID, fingerprint := range cfg.Pins {
+		if !clientIdentityFingerprintPattern.MatchString(fingerprint) {
+			return fmt.Errorf("gateway.client_identity.pins.%s: %q is not a SHA256:<hex> key fingerprint", clientID, fingerprint)
+		}
+	}
+	return nil
+}
+
+// validateGeoIPConfig validates the Geo-IP rules
+func validateGeoIPConfig(geoCfg GeoIPConfig) error {
+	if len(geoCfg.Rules) > 0 && geoCfg.Database == "" {
+		return fmt.Errorf("geoip.rules require geoip.database")
+	}
+	for i, rule := range geoCfg.Rules {
+		switch rule.Match {
+		case GeoIPMatchSource, GeoIPMatchTarget:
+		default:
+			return fmt.Errorf("geoip.rules[%d].match must be one of: source, target", i)
+		}
+		if len(rule.Countries) == 0 {
+			return fmt.Errorf("geoip.rules[%d].countries cannot be empty", i)
+		}
+		switch rule.Action {
+		case GeoIPActionBlock:
+		case GeoIPActionRoute:
+			if rule.GroupID == "" {
+				return fmt.Errorf("geoip.rules[%d].group_id is required for route", i)
+			}
+		default:
+			return fmt.Errorf("geoip.rules[%d].action must be one of: block, route", i)
+		}
+	}
+	return nil
+}
+
+// ParseSourcePrefix parses a CIDR range or a single IP address
+func ParseSourcePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ValidatePortSources validates the allowed sources of an open port
+func ValidatePortSources(port OpenPort) error {
+	if len(port.AllowedSources) > protocol.MaxPortSources {
+		return fmt.Errorf("port %d allows at most %d allowed_sources", port.RemotePort, protocol.MaxPortSources)
+	}
+	for _, source := range port.AllowedSources {
+		if _, err := ParseSourcePrefix(source); err != nil {
+			return fmt.Errorf("port %d allowed_sources: %v", port.RemotePort, err)
+		}
+	}
+	return nil
+}
+
+// validateSocketOptions validates socket options, nil options are valid
+func validateSocketOptions(name string, opts *SocketOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if opts.DSCP < 0 || opts.DSCP > 63 {
+		return fmt.Errorf("%s.dscp must be between 0 and 63", name)
+	}
+	if opts.KeepAliveCount < 0 {
+		return fmt.Errorf("%s.keep_alive_count cannot be negative", name)
+	}
+	return nil
+}
+
+// validateHTTPAuth validates the authentication schemes of an HTTP proxy listener
+func validateHTTPAuth(name string, cfg HTTPConfig) error {
+	seen := make(map[string]bool, len(cfg.AuthSchemes))
+	for _, scheme := range cfg.AuthSchemes {
+		switch scheme {
+		case HTTPAuthBasic, HTTPAuthDigest:
+		default:
+			return fmt.Errorf("%s.auth_schemes: unsupported scheme %q, must be basic or digest", name, scheme)
+		}
+		if seen[scheme] {
+			return fmt.Errorf("%s.auth_schemes has duplicate scheme %q", name, scheme)
+		}
+		seen[scheme] = true
+	}
+	if strings.Contains(cfg.AuthRealm, `"`) {
+		return fmt.Errorf("%s.auth_realm cannot contain quotes", name)
+	}
+	if cfg.DigestNonceTTL < 0 {
+		return fmt.Errorf("%s.digest_nonce_ttl cannot be negative", name)
+	}
+	return nil
+}
+
+// validateSOCKS5Auth validates the authentication methods of a SOCKS5 listener
+func validateSOCKS5Auth(name string, cfg SOCKS5Config) error {
+	seen := make(map[string]bool, len(cfg.AuthMethods))
+	for _, method := range cfg.AuthMethods {
+		switch method {
+		case SOCKS5AuthPassword, SOCKS5AuthNone, SOCKS5AuthGSSAPI:
+		default:
+			return fmt.Errorf("%s.auth_methods: unsupported method %q, must be password, none or gssapi", name, method)
+		}
+		if seen[method] {
+			return fmt.Errorf("%s.auth_methods has duplicate method %q", name, method)
+		}
+		seen[method] = true
+	}
+	if err := validateSOCKS5GSSAPI(name, cfg.GSSAPI, seen[SOCKS5AuthGSSAPI]); err != nil {
+		return err
+	}
+	noAuth := cfg.NoAuth
+	if len(noAuth.CIDRs) == 0 && noAuth.GroupID == "" {
+		return nil
+	}
+	if len(cfg.AuthMethods) > 0 && !seen[SOCKS5AuthNone] {
+		return fmt.Errorf("%s.no_auth requires the none method in auth_methods", name)
+	}
+	if noAuth.GroupID == "" || len(noAuth.CIDRs) == 0 {
+		return fmt.Errorf("%s.no_auth requires cidrs and group_id", name)
+	}
+	for _, cidr := range noAuth.CIDRs {
+		if _, err := ParseSourcePrefix(cidr); err != nil {
+			return fmt.Errorf("%s.no_auth: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateSOCKS5GSSAPI validates the Kerberos settings of a SOCKS5 listener, the keytab is
+// read when the listener is created
+func validateSOCKS5GSSAPI(name string, cfg SOCKS5GSSAPIConfig, offered bool) error {
+	if cfg == (SOCKS5GSSAPIConfig{}) && !offered {
+		return nil
+	}
+	if !offered {
+		return fmt.Errorf("%s.gssapi requires the gssapi method in auth_methods", name)
+	}
+	if cfg.Keytab == "" || cfg.ServicePrincipal == "" || cfg.GroupID == "" {
+		return fmt.Errorf("%s.gssapi requires keytab, service_principal and group_id", name)
+	}
+	if service, realm, ok := strings.Cut(cfg.ServicePrincipal, "@"); !ok || service == "" || realm == "" {
+		return fmt.Errorf("%s.gssapi.service_principal: %q must include the realm, e.g. rcmd/proxy.example.com@EXAMPLE.COM", name, cfg.ServicePrincipal)
+	}
+	return nil
+}
+
+// validateSubGroupsConfig validates the sub-group delegations
+func validateSubGroupsConfig(cfg SubGroupsConfig) error {
+	separator := cfg.Separator
+	if separator == "" {
+		separator = "/"
+	}
+	for i, delegation := range cfg.Delegations {
+		name := fmt.Sprintf("sub_groups.delegations[%d]", i)
+		if delegation.Parent == "" {
+			return fmt.Errorf("%s.parent is required", name)
+		}
+		if strings.HasPrefix(delegation.Parent, separator) || strings.HasSuffix(delegation.Parent, separator) {
+			return fmt.Errorf("%s.parent cannot start or end with %q", name, separator)
+		}
+		for _, pattern := range delegation.Children {
+			segments := strings.Split(pattern, separator)
+			for j, segment := range segments {
+				if segment == "" {
+					return fmt.Errorf("%s.children has an empty level in %q", name, pattern)
+				}
+				if segment == SubGroupAnyDescendants && j != len(segments)-1 {
+					return fmt.Errorf("%s.children can only use %q as the last level: %q", name, SubGroupAnyDescendants, pattern)
+				}
+				if _, err := path.Match(segment, ""); err != nil {
+					return fmt.Errorf("%s.children has an invalid pattern %q: %v", name, pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validatePACConfig validates the proxies and rules of the PAC file
+func validatePACConfig(cfg PACConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	routes := map[string]bool{PACDirect: true}
+	for i, proxy := range cfg.Proxies {
+		name := fmt.Sprintf("pac.proxies[%d]", i)
+		if proxy.Name == "" || routes[proxy.Name] {
+			return fmt.Errorf("%s.name must be set, unique and not %q", name, PACDirect)
+		}
+		routes[proxy.Name] = true
+		switch proxy.Type {
+		case PACTypeHTTP, PACTypeHTTPS, PACTypeSOCKS5:
+		default:
+			return fmt.Errorf("%s.type must be one of: http, https, socks5", name)
+		}
+		if proxy.Addr != "" {
+			if _, _, err := net.SplitHostPort(proxy.Addr); err != nil {
+				return fmt.Errorf("%s.addr must be host:port: %v", name, err)
+			}
+		}
+	}
+	for i, rule := range cfg.Rules {
+		name := fmt.Sprintf("pac.rules[%d]", i)
+		if len(rule.Hosts) == 0 {
+			return fmt.Errorf("%s.hosts cannot be empty", name)
+		}
+		for _, host := range rule.Hosts {
+			if ip, _, err := net.ParseCIDR(host); err == nil && ip.To4() == nil {
+				return fmt.Errorf("%s.hosts: %q is not an IPv4 CIDR", name, host)
+			}
+			if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+				return fmt.Errorf("%s.hosts: %q is not an IPv4 address", name, host)
+			}
+		}
+		if !routes[rule.Route] {
+			return fmt.Errorf("%s.route must be %q or a proxy name", name, PACDirect)
+		}
+	}
+	if cfg.Default != "" && !routes[cfg.Default] {
+		return fmt.Errorf("pac.default must be %q or a proxy name", PACDirect)
+	}
+	return nil
+}
+
+// validateStatusPageConfig validates the public status page groups
+func validateStatusPageConfig(cfg StatusPageConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if len(cfg.Groups) == 0 {
+		return fmt.Errorf("status_page requires at least one group")
+	}
+	names := make(map[string]bool, len(cfg.Groups))
+	for i, group := range cfg.Groups {
+		if group.GroupID == "" || group.Name == "" {
+			return fmt.Errorf("status_page.groups[%d] requires group_id and name", i)
+		}
+		if names[group.Name] {
+			return fmt.Errorf("status_page.groups has duplicate name %q", group.Name)
+		}
+		names[group.Name] = true
+	}
+	return nil
+}
+
+// validateOutboundRule validates an egress rule of the client
+func validateOutboundRule(name string, rule OutboundRule) error {
+	prefix, err := netip.ParsePrefix(rule.CIDR)
+	if err != nil {
+		return fmt.Errorf("%s.cidr: %v", name, err)
+	}
+	if rule.Interface == "" && rule.SourceIP == "" {
+		return fmt.Errorf("%s requires interface or source_ip", name)
+	}
+	if rule.SourceIP != "" {
+		addr, err := netip.ParseAddr(rule.SourceIP)
+		if err != nil {
+			return fmt.Errorf("%s.source_ip: %v", name, err)
+		}
+		if addr.Unmap().Is4() != prefix.Addr().Unmap().Is4() {
+			return fmt.Errorf("%s.source_ip and cidr must be the same address family", name)
+		}
+	}
+	return nil
+}
+
+// validateKCPConfig validates the kcp transport tuning
+func validateKCPConfig(name string, kcpCfg KCPConfig) error {
+	switch kcpCfg.Mode {
+	case "", KCPModeNormal, KCPModeFast, KCPModeFast2, KCPModeFast3:
+	default:
+		return fmt.Errorf("%s.mode must be one of normal, fast, fast2 or fast3", name)
+	}
+	if kcpCfg.DataShards < 0 || kcpCfg.ParityShards < 0 || kcpCfg.SendWindow < 0 || kcpCfg.ReceiveWindow < 0 {
+		return fmt.Errorf("%s values cannot be negative", name)
+	}
+	if (kcpCfg.DataShards == 0) != (kcpCfg.ParityShards == 0) {
+		return fmt.Errorf("%s.data_shards and parity_shards must be set together", name)
+	}
+	if kcpCfg.DataShards+kcpCfg.ParityShards > 256 {
+		return fmt.Errorf("%s.data_shards plus parity_shards cannot exceed 256", name)
+	}
+	if kcpCfg.MTU != 0 && (kcpCfg.MTU < 576 || kcpCfg.MTU > 1500) {
+		return fmt.Errorf("%s.mtu must be between 576 and 1500", name)
+	}
+	return nil
+}
+
+// validateGroupConfig validates a single group limit configuration
+func validateGroupConfig(name string, groupCfg GroupConfig) error {
+	if groupCfg.MaxClients < 0 {
+		return fmt.Errorf("%s.max_clients cannot be negative", name)
+	}
+	if groupCfg.MaxConnections < 0 {
+		return fmt.Errorf("%s.max_connections cannot be negative", name)
+	}
+	switch groupCfg.StickySession {
+	case "", StickySessionUser, StickySessionSourceIP:
+	default:
+		return fmt.Errorf("%s.sticky_session must be one of: user, source_ip", name)
+	}
+	if groupCfg.StickyTTL < 0 {
+		return fmt.Errorf("%s.sticky_ttl cannot be negative", name)
+	}
+	switch groupCfg.Balancing {
+	case "", BalancingRoundRobin, BalancingLeastLoaded:
+	default:
+		return fmt.Errorf("%s.balancing must be one of: round_robin, least_loaded", name)
+	}
+	if groupCfg.DialRetries < 0 || groupCfg.DialBackoff < 0 || groupCfg.DialTimeout < 0 {
+		return fmt.Errorf("%s.dial_retries, dial_backoff and dial_timeout cannot be negative", name)
+	}
+	if groupCfg.MaxTransferBytes < 0 {
+		return fmt.Errorf("%s.max_transfer_bytes cannot be negative", name)
+	}
+	for i, port := range groupCfg.Migration.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("%s.migration.ports[%d]: invalid port %d", name, i, port)
+		}
+	}
+	if groupCfg.Migration.MaxReplayBytes < 0 {
+		return fmt.Errorf("%s.migration.max_replay_bytes cannot be negative", name)
+	}
+	for user, limit := range groupCfg.UserMaxTransferBytes {
+		if limit < 0 {
+			return fmt.Errorf("%s.user_max_transfer_bytes.%s cannot be negative", name, user)
+		}
+	}
+	if _, err := groupCfg.Schedule.Compile(); err != nil {
+		return fmt.Errorf("%s.schedule: %v", name, err)
+	}
+	for user, userSchedule := range groupCfg.UserSchedules {
+		if _, err := userSchedule.Compile(); err != nil {
+			return fmt.Errorf("%s.user_schedules.%s: %v", name, user, err)
+		}
+	}
+	return nil
+}
+
+// validatePolicyPacks validates the policy packs and the packs referenced by groups. The
+// patterns themselves are compiled, and rejected, by the clients.
+func validatePolicyPacks(g *GatewayConfig) error {
+	names := make(map[string]bool)
+	for i, pack := range g.PolicyPacks {
+		if pack.Name == "" {
+			return fmt.Errorf("policy_packs[%d].name is required", i)
+		}
+		if names[pack.Name] {
+			return fmt.Errorf("policy_packs[%d]: duplicate name %q", i, pack.Name)
+		}
+		names[pack.Name] = true
+		if len(pack.AllowedHosts) == 0 && len(pack.ForbiddenHosts) == 0 {
+			return fmt.Errorf("policy_packs[%d]: allowed_hosts or forbidden_hosts is required", i)
+		}
+	}
+
+	groups := map[string]GroupConfig{"group_defaults": g.GroupDefaults}
+	for groupID, groupCfg := range g.Groups {
+		groups["groups."+groupID] = groupCfg
+	}
+	for name, groupCfg := range groups {
+		for _, pack := range groupCfg.PolicyPacks {
+			if !names[pack] {
+				return fmt.Errorf("%s.policy_packs: unknown pack %q", name, pack)
+			}
+		}
+		if groupCfg.PolicySignature == "" {
+			continue
+		}
+		if name == "group_defaults" {
+			return fmt.Errorf("group_defaults.policy_signature: signatures are bound to a group, set them per group")
+		}
+		if sig, err := base64.StdEncoding.DecodeString(groupCfg.PolicySignature); err != nil || len(sig) != ed25519.SignatureSize {
+			return fmt.Errorf("%s.policy_signature: expected a base64 ed25519 signature", name)
+		}
+	}
+	return nil
+}
+
+// validateBlocklists validates the blocklist sources and the group blocklist settings
+func validateBlocklists(g *GatewayConfig) error {
+	if g.Blocklists.RefreshInterval < 0 {
+		return fmt.Errorf("blocklists.refresh_interval cannot be negative")
+	}
+	names := make(map[string]bool)
+	for i, source := range g.Blocklists.Lists {
+		if source.Name == "" || source.Name == BlocklistsNone {
+			return fmt.Errorf("blocklists.lists[%d].name is required and cannot be %q", i, BlocklistsNone)
+		}
+		if names[source.Name] {
+			return fmt.Errorf("blocklists.lists[%d]: duplicate name %q", i, source.Name)
+		}
+		names[source.Name] = true
+		if (source.Path == "") == (source.URL == "") {
+			return fmt.Errorf("blocklists.lists[%d]: exactly one of path or url is required", i)
+		}
+		if source.URL != "" && !strings.HasPrefix(source.URL, "http://") && !strings.HasPrefix(source.URL, "https://") {
+			return fmt.Errorf("blocklists.lists[%d].url must be an http or https URL", i)
+		}
+	}
+
+	groups := map[string]GroupConfig{"group_defaults": g.GroupDefaults}
+	for groupID, groupCfg := range g.Groups {
+		groups["groups."+groupID] = groupCfg
+	}
+	for name, groupCfg := range groups {
+		for _, list := range groupCfg.Blocklists {
+			if list == BlocklistsNone {
+				if len(groupCfg.Blocklists) > 1 {
+					return fmt.Errorf("%s.blocklists: %q cannot be combined with other lists", name, BlocklistsNone)
+				}
+				continue
+			}
+			if !names[list] {
+				return fmt.Errorf("%s.blocklists: unknown list %q", name, list)
+			}
+		}
+		for _, entry := range groupCfg.BlocklistAllow {
+			allow := blocklist.New()
+			if allow.AddLine(entry); allow.Len() != 1 {
+				return fmt.Errorf("%s.blocklist_allow: invalid entry %q", name, entry)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRemoteExecConfig validates the client remote exec service
+func validateRemoteExecConfig(cfg RemoteExecConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Token == "" {
+		return fmt.Errorf("client remote_exec.token is required when remote_exec is enabled")
+	}
+	if len(cfg.Commands) == 0 && cfg.Shell == "" {
+		return fmt.Errorf("client remote_exec requires at least one command or a shell")
+	}
+	if cfg.Timeout < 0 || cfg.MaxOutput < 0 {
+		return fmt.Errorf("client remote_exec.timeout and max_output cannot be negative")
+	}
+	names := make(map[string]bool, len(cfg.Commands))
+	for i, cmd := range cfg.Commands {
+		if cmd.Name == "" || len(cmd.Command) == 0 || cmd.Command[0] == "" {
+			return fmt.Errorf("client remote_exec.commands[%d] requires a name and a command", i)
+		}
+		if names[cmd.Name] {
+			return fmt.Errorf("client remote_exec.commands has duplicate name %q", cmd.Name)
+		}
+		names[cmd.Name] = true
+	}
 	return nil
 }
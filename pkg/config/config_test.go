@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -570,6 +571,31 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			wantErr: false, // Should pass since ClientID is empty
 		},
+		{
+			name: "client with udp port and disable_udp",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:   "test-client",
+					GroupID:    "test-group",
+					DisableUDP: true,
+					OpenPorts:  []OpenPort{{RemotePort: 5353, LocalPort: 53, LocalHost: "localhost", Protocol: "udp"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client open_ports: udp port 5353 needs UDP, which disable_udp turns off",
+		},
+		{
+			name: "client with invalid port allowed sources",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:  "test-client",
+					GroupID:   "test-group",
+					OpenPorts: []OpenPort{{RemotePort: 3389, LocalPort: 3389, LocalHost: "localhost", Protocol: "tcp", AllowedSources: []string{"203.0.113.0/33"}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `client open_ports: port 3389 allowed_sources: invalid CIDR "203.0.113.0/33"`,
+		},
 		{
 			name: "client with empty group ID",
 			config: Config{
@@ -605,18 +631,1005 @@ func TestConfig_Validate(t *testing.T) {
 			wantErr: true,
 			errMsg:  "client group_id cannot be empty", // Only group_id is required
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			err := tt.config.Validate()
-			if (err != nil) != tt.wantErr {
-				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if tt.wantErr && err.Error() != tt.errMsg {
-				t.Errorf("Config.Validate() error message = %v, want %v", err.Error(), tt.errMsg)
-			}
-		})
+		{
+			name: "gateway with valid group limits",
+			config: Config{
+				Gateway: GatewayConfig{
+					GroupDefaults: GroupConfig{MaxClients: 10},
+					Groups: map[string]GroupConfig{
+						"tenant-a": {MaxClients: 2, MaxConnections: 100},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "gateway with negative group connection limit",
+			config: Config{
+				Gateway: GatewayConfig{
+					Groups: map[string]GroupConfig{
+						"tenant-a": {MaxConnections: -1},
+					},
+				},
+			},
+			wantErr: true,
+			errMsg:  "groups.tenant-a.max_connections cannot be negative",
+		},
+		{
+			name: "gateway with unknown group balancing",
+			config: Config{
+				Gateway: GatewayConfig{
+					Groups: map[string]GroupConfig{
+						"tenant-a": {Balancing: "random"},
+					},
+				},
+			},
+			wantErr: true,
+			errMsg:  "groups.tenant-a.balancing must be one of: round_robin, least_loaded",
+		},
+		{
+			name: "gateway with negative user transfer limit",
+			config: Config{
+				Gateway: GatewayConfig{
+					Groups: map[string]GroupConfig{
+						"tenant-a": {MaxTransferBytes: 1 << 30, UserMaxTransferBytes: map[string]int64{"backup": -1}},
+					},
+				},
+			},
+			wantErr: true,
+			errMsg:  "groups.tenant-a.user_max_transfer_bytes.backup cannot be negative",
+		},
+		{
+			name: "gateway with invalid user schedule",
+			config: Config{
+				Gateway: GatewayConfig{
+					Groups: map[string]GroupConfig{
+						"contractors": {UserSchedules: map[string]AccessSchedule{"alice": {Windows: []AccessWindow{{Days: []string{"mon-fri"}, Hours: "9-17"}}}}},
+					},
+				},
+			},
+			wantErr: true,
+			errMsg:  `groups.contractors.user_schedules.alice: windows[0]: invalid hours "9-17": bad time "9"`,
+		},
+		{
+			name: "gateway with tls fingerprint rules",
+			config: Config{
+				Gateway: GatewayConfig{
+					TLSFingerprint: TLSFingerprintConfig{
+						Block: []string{"e7d705a3286e19ea42f587b344ee6865"},
+						Allow: []string{"t13d1516h2_8daaf6152771_e5627efa2ab1"},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "gateway with tls fingerprint rules on the quic transport",
+			config: Config{
+				Gateway: GatewayConfig{
+					TransportType:  "quic",
+					TLSFingerprint: TLSFingerprintConfig{Allow: []string{"t13d1516h2_8daaf6152771_e5627efa2ab1"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.tls_fingerprint: allow and block rules are not supported with the quic transport, its handshakes are not fingerprinted",
+		},
+		{
+			name: "gateway with tls fingerprint rules on the webtransport transport",
+			config: Config{
+				Gateway: GatewayConfig{
+					TransportType:  "webtransport",
+					TLSFingerprint: TLSFingerprintConfig{Block: []string{"e7d705a3286e19ea42f587b344ee6865"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.tls_fingerprint: allow and block rules are not supported with the webtransport transport, its handshakes are not fingerprinted",
+		},
+		{
+			name: "gateway logging tls fingerprints on the quic transport",
+			config: Config{
+				Gateway: GatewayConfig{TransportType: "quic", TLSFingerprint: TLSFingerprintConfig{Log: true}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "gateway with invalid tls fingerprint rule",
+			config: Config{
+				Gateway: GatewayConfig{
+					Proxy: ProxyConfig{HTTP: HTTPConfig{TLSFingerprint: &TLSFingerprintConfig{Block: []string{"curl"}}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `gateway.proxy.http.tls_fingerprint.block: "curl" is neither a JA3 hash nor a JA4 fingerprint`,
+		},
+		{
+			name: "gateway web file session store without dir",
+			config: Config{
+				Gateway: GatewayConfig{
+					Web: WebConfig{SessionStore: SessionStoreConfig{Type: "file"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.web.session_store.dir is required for the file store",
+		},
+		{
+			name: "gateway web user with unknown role",
+			config: Config{
+				Gateway: GatewayConfig{
+					Web: WebConfig{AuthUsername: "admin", Users: []WebUserConfig{{Username: "ops", Password: "secret", Role: "root"}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.web.users[0].role must be one of: viewer, operator, admin",
+		},
+		{
+			name: "gateway upgrade with udp transport",
+			config: Config{
+				Gateway: GatewayConfig{
+					TransportType: "quic",
+					Upgrade:       UpgradeConfig{Enabled: true},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.upgrade requires the grpc or websocket transport",
+		},
+		{
+			name: "gateway upgrade with unix socket listener",
+			config: Config{
+				Gateway: GatewayConfig{
+					TransportType: "websocket",
+					Upgrade:       UpgradeConfig{Enabled: true},
+					Web:           WebConfig{ListenAddr: "unix:/run/anyproxy/web.sock"},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.upgrade can't be used with the unix or systemd socket of gateway.web.listen_addr",
+		},
+		{
+			name: "gateway web tenant with admin role",
+			config: Config{
+				Gateway: GatewayConfig{
+					Web: WebConfig{Users: []WebUserConfig{{Username: "acme", Password: "secret", Role: "admin", Groups: []string{"acme"}}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.web.users[0]: tenant accounts limited to groups cannot be admins",
+		},
+		{
+			name: "gateway web user shadowing auth_username",
+			config: Config{
+				Gateway: GatewayConfig{
+					Web: WebConfig{AuthUsername: "admin", Users: []WebUserConfig{{Username: "admin", Password: "secret", Role: "viewer"}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `gateway.web.users[0]: duplicate username "admin"`,
+		},
+		{
+			name: "gateway with invalid client identity pin",
+			config: Config{
+				Gateway: GatewayConfig{
+					ClientIdentity: ClientIdentityConfig{Enabled: true, Pins: map[string]string{"edge-1": "abc"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `gateway.client_identity.pins.edge-1: "abc" is not a SHA256:<hex> key fingerprint`,
+		},
+		{
+			name: "client egress with zero weight",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "client-1",
+					GroupID:  "group-1",
+					Gateway:  ClientGatewayConfig{Addr: "gateway:8443"},
+					Egress:   EgressConfig{MaxBandwidth: 125000, PortWeights: map[int]int{22: 0}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client.egress.port_weights.22: weight must be at least 1",
+		},
+		{
+			name: "client tcp peer listener without target",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:      "client-1",
+					GroupID:       "group-1",
+					Gateway:       ClientGatewayConfig{Addr: "gateway:8443"},
+					PeerListeners: []PeerListener{{ListenAddr: "127.0.0.1:5432", Protocol: PeerProtocolTCP, GroupID: "site-b"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client.peer_listeners[0].target must be host:port for the tcp protocol",
+		},
+		{
+			name: "client dial guard with invalid cidr",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:  "client-1",
+					GroupID:   "group-1",
+					Gateway:   ClientGatewayConfig{Addr: "gateway:8443"},
+					DialGuard: DialGuardConfig{Enabled: true, AllowedCIDRs: []string{"192.168.1.0"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `client.dial_guard.allowed_cidrs[0]: netip.ParsePrefix("192.168.1.0"): no '/'`,
+		},
+		{
+			name: "client spool with negative max bytes",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "client-1",
+					GroupID:  "group-1",
+					Gateway:  ClientGatewayConfig{Addr: "gateway:8443"},
+					Spool:    SpoolConfig{Dir: "/var/lib/anyproxy/spool", MaxBytes: -1},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client.spool.max_bytes cannot be negative",
+		},
+		{
+			name: "negative client discovery interval",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:  "client-1",
+					GroupID:   "group-1",
+					Gateway:   ClientGatewayConfig{Addr: "gateway:8443"},
+					Discovery: DiscoveryConfig{Docker: DockerDiscoveryConfig{Enabled: true}, Interval: -time.Second},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client.discovery.interval cannot be negative",
+		},
+		{
+			name: "client signed control without group password",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:      "client-1",
+					GroupID:       "group-1",
+					Gateway:       ClientGatewayConfig{Addr: "gateway:8443"},
+					SignedControl: true,
+				},
+			},
+			wantErr: true,
+			errMsg:  "client.signed_control requires group_password, the signing key is derived from it",
+		},
+		{
+			name: "client invalid policy public key",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:        "client-1",
+					GroupID:         "group-1",
+					Gateway:         ClientGatewayConfig{Addr: "gateway:8443"},
+					PolicyPublicKey: "c2hvcnQ=",
+				},
+			},
+			wantErr: true,
+			errMsg:  "client.policy_public_key: invalid public key size: 5 bytes",
+		},
+		{
+			name: "client prewarm without connection pool",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:       "client-1",
+					GroupID:        "group-1",
+					Gateway:        ClientGatewayConfig{Addr: "gateway:8443"},
+					ConnectionPool: ConnectionPoolConfig{Prewarm: []PrewarmTarget{{Address: "api.example.com:443"}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client connection_pool.prewarm requires connection_pool.enabled",
+		},
+		{
+			name: "client with a gateway listed twice",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "client-1",
+					GroupID:  "group-1",
+					Gateway:  ClientGatewayConfig{Addr: "gw-eu:8443"},
+					Gateways: []ClientGatewayConfig{{Addr: "gw-us:8443"}, {Addr: "gw-eu:8443"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client gateways[1]: gateway gw-eu:8443 is listed twice",
+		},
+		{
+			name: "client additional gateway without address",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "client-1",
+					GroupID:  "group-1",
+					Gateway:  ClientGatewayConfig{Addr: "gw-eu:8443"},
+					Gateways: []ClientGatewayConfig{{TransportType: "quic"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client gateways[0].addr is required",
+		},
+		{
+			name: "client http check with host:port target",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "client-1",
+					GroupID:  "group-1",
+					Gateway:  ClientGatewayConfig{Addr: "gateway:8443"},
+					Checks:   []SyntheticCheck{{Name: "wiki", Type: CheckTypeHTTP, Target: "wiki.internal:80"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client checks[0].target must be an http or https URL: \"wiki.internal:80\"",
+		},
+		{
+			name: "client prewarm without port",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:       "client-1",
+					GroupID:        "group-1",
+					Gateway:        ClientGatewayConfig{Addr: "gateway:8443"},
+					ConnectionPool: ConnectionPoolConfig{Enabled: true, Prewarm: []PrewarmTarget{{Address: "api.example.com"}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `client connection_pool.prewarm[0].address must be host:port: "api.example.com"`,
+		},
+		{
+			name: "gateway tun without groups",
+			config: Config{
+				Gateway: GatewayConfig{
+					Tun: GatewayTunConfig{TunConfig: TunConfig{Enabled: true, Address: "10.99.0.1/24"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.tun.groups cannot be empty",
+		},
+		{
+			name: "client tun with invalid route",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "client-1",
+					GroupID:  "group-1",
+					Gateway:  ClientGatewayConfig{Addr: "gateway:8443"},
+					Tun:      ClientTunConfig{TunConfig: TunConfig{Enabled: true, Address: "10.99.0.2/24", Routes: []string{"10.99.0.0"}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `client.tun.routes[0]: invalid prefix "10.99.0.0"`,
+		},
+		{
+			name: "client tun with address as domain",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "client-1",
+					GroupID:  "group-1",
+					Gateway:  ClientGatewayConfig{Addr: "gateway:8443"},
+					Tun:      ClientTunConfig{TunConfig: TunConfig{Enabled: true, Address: "10.99.0.2/24"}, Domains: []string{"10.0.0.0/8"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `client.tun.domains[0]: "10.0.0.0/8" is not a host name, addresses and CIDRs go in routes`,
+		},
+		{
+			name: "gateway qos rule with unknown priority",
+			config: Config{
+				Gateway: GatewayConfig{
+					QoS: QoSConfig{Rules: []QoSRule{{Priority: "urgent", Ports: []int{22}}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.qos.rules[0].priority must be one of: high, normal, low",
+		},
+		{
+			name: "gateway idle probe interval too short",
+			config: Config{
+				Gateway: GatewayConfig{IdleProbeInterval: time.Millisecond},
+			},
+			wantErr: true,
+			errMsg:  "gateway.idle_probe_interval must be at least 1s or 0 to disable probes",
+		},
+		{
+			name: "gateway dns cache server without address",
+			config: Config{
+				Gateway: GatewayConfig{DNSCache: DNSCacheConfig{Enabled: true, Servers: []string{"1.1.1.1", "[2606:4700::1111]:53", "dns.example.com"}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.dns_cache.servers[2] must be an IP address with an optional port: \"dns.example.com\"",
+		},
+		{
+			name: "gateway hibernation idle time too short",
+			config: Config{
+				Gateway: GatewayConfig{Hibernation: HibernationConfig{IdleAfter: time.Millisecond}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.hibernation.idle_after must be at least 1s or 0 to disable hibernation",
+		},
+		{
+			name: "gateway startup negative backoff",
+			config: Config{
+				Gateway: GatewayConfig{Startup: StartupConfig{BindAttempts: 3, BindBackoff: -time.Second}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.startup.bind_attempts, bind_backoff and max_bind_backoff cannot be negative",
+		},
+		{
+			name: "gateway group gc negative grace period",
+			config: Config{
+				Gateway: GatewayConfig{GroupGC: GroupGCConfig{GracePeriod: -time.Minute}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.group_gc.grace_period cannot be negative",
+		},
+		{
+			name: "gateway anomaly detection factor too small",
+			config: Config{
+				Gateway: GatewayConfig{AnomalyDetection: AnomalyDetectionConfig{Enabled: true, Factor: 0.5}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.anomaly_detection.factor must be greater than 1",
+		},
+		{
+			name: "gateway negative metrics sample rate",
+			config: Config{
+				Gateway: GatewayConfig{MetricsLimits: MetricsLimitsConfig{SampleRate: -1}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.metrics_limits values cannot be negative",
+		},
+		{
+			name: "gateway tuic auth timeout within heartbeat interval",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{TUIC: TUICConfig{ListenAddr: ":9443", HeartbeatInterval: time.Minute, AuthTimeout: 30 * time.Second}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.tuic.auth_timeout must be longer than heartbeat_interval",
+		},
+		{
+			name: "gateway pac rule with unknown proxy",
+			config: Config{
+				Gateway: GatewayConfig{PAC: PACConfig{
+					Enabled: true,
+					Proxies: []PACProxy{{Name: "office", Type: PACTypeHTTP}},
+					Rules:   []PACRule{{Hosts: []string{"corp.example.com"}, Route: "lab"}},
+				}},
+			},
+			wantErr: true,
+			errMsg:  "pac.rules[0].route must be \"direct\" or a proxy name",
+		},
+		{
+			name: "gateway target tls with ca file and insecure",
+			config: Config{
+				Gateway: GatewayConfig{
+					Proxy: ProxyConfig{HTTP: HTTPConfig{TargetTLS: []TargetTLSRule{{Hosts: []string{"internal.example.com"}, CAFile: "ca.pem", InsecureSkipVerify: true}}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.http.target_tls[0].ca_file and insecure_skip_verify are mutually exclusive",
+		},
+		{
+			name: "gateway usage reports without destination",
+			config: Config{
+				Gateway: GatewayConfig{
+					UsageReports: UsageReportsConfig{Period: "daily"},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.usage_reports requires a dir, webhook or s3 endpoint",
+		},
+		{
+			name: "gateway grpc api with certificate only",
+			config: Config{
+				Gateway: GatewayConfig{Web: WebConfig{GRPC: GRPCControlConfig{ListenAddr: ":8092", TLSCert: "grpc.crt"}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.web.grpc.tls_cert and tls_key must be set together",
+		},
+		{
+			name: "gateway ldap provider without settings",
+			config: Config{
+				Gateway: GatewayConfig{Web: WebConfig{Auth: WebAuthConfig{Providers: []string{"local", "ldap"}}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.web.auth.providers[1]: ldap requires gateway.web.auth.ldap settings",
+		},
+		{
+			name: "gateway ldap bind dn without username",
+			config: Config{
+				Gateway: GatewayConfig{Web: WebConfig{Auth: WebAuthConfig{LDAP: &LDAPAuthConfig{URL: "ldaps://ldap.example.com", BindDN: "ou=people,dc=example,dc=com"}}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.web.auth.ldap.bind_dn must contain %s once",
+		},
+		{
+			name: "gateway oidc invalid role mapping",
+			config: Config{
+				Gateway: GatewayConfig{Web: WebConfig{Auth: WebAuthConfig{OIDC: &OIDCAuthConfig{
+					Issuer:      "https://idp.example.com",
+					ClientID:    "anyproxy",
+					RedirectURL: "https://gateway.example.com/api/auth/oidc/callback",
+					RoleMapping: map[string]string{"ops": "root"},
+				}}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.web.auth.oidc.role_mapping.ops must be one of: viewer, operator, admin",
+		},
+		{
+			name: "group migration with invalid port",
+			config: Config{
+				Gateway: GatewayConfig{
+					Groups: map[string]GroupConfig{"mirrors": {Migration: MigrationConfig{Ports: []int{80, 0}}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "groups.mirrors.migration.ports[1]: invalid port 0",
+		},
+		{
+			name: "gateway auto tls with certificate files",
+			config: Config{
+				Gateway: GatewayConfig{
+					TLSCert: "gw.crt",
+					TLSKey:  "gw.key",
+					AutoTLS: AutoTLSConfig{Enabled: true},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway auto_tls and tls_cert/tls_key are mutually exclusive",
+		},
+		{
+			name: "gateway storage encryption with two key sources",
+			config: Config{
+				Gateway: GatewayConfig{
+					StorageEncryption: StorageEncryptionConfig{KeyEnv: "ANYPROXY_STORAGE_KEY", KeyFile: "/etc/anyproxy/storage.key"},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.storage_encryption.key_env and key_file are mutually exclusive",
+		},
+		{
+			name: "gateway with unknown rate limit storage",
+			config: Config{
+				Gateway: GatewayConfig{
+					RateLimitStorage: RateLimitStorageConfig{Type: "redis"},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.rate_limit_storage.type must be one of: memory, file, db",
+		},
+		{
+			name: "gateway with rate limit db storage of unknown driver",
+			config: Config{
+				Gateway: GatewayConfig{
+					RateLimitStorage: RateLimitStorageConfig{Type: RateLimitStorageDB, DB: &RateLimitDBConfig{Driver: "mysql", DataSource: "anyproxy"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.rate_limit_storage.db.driver must be one of: sqlite, postgres",
+		},
+		{
+			name: "gateway with geoip route rule",
+			config: Config{
+				Gateway: GatewayConfig{
+					GeoIP: GeoIPConfig{
+						Database: "/etc/anyproxy/GeoLite2-Country.mmdb",
+						Rules: []GeoIPRule{
+							{Match: GeoIPMatchTarget, Countries: []string{"CN"}, Action: GeoIPActionRoute, GroupID: "cn-egress"},
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "gateway with geoip rules but no database",
+			config: Config{
+				Gateway: GatewayConfig{
+					GeoIP: GeoIPConfig{
+						Rules: []GeoIPRule{
+							{Match: GeoIPMatchSource, Countries: []string{"KP"}, Action: GeoIPActionBlock},
+						},
+					},
+				},
+			},
+			wantErr: true,
+			errMsg:  "geoip.rules require geoip.database",
+		},
+		{
+			name: "gateway with geoip route rule without group",
+			config: Config{
+				Gateway: GatewayConfig{
+					GeoIP: GeoIPConfig{
+						Database: "/etc/anyproxy/GeoLite2-Country.mmdb",
+						Rules: []GeoIPRule{
+							{Match: GeoIPMatchTarget, Countries: []string{"CN"}, Action: GeoIPActionRoute},
+						},
+					},
+				},
+			},
+			wantErr: true,
+			errMsg:  "geoip.rules[0].group_id is required for route",
+		},
+		{
+			name: "client with remote exec commands",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "test-client",
+					GroupID:  "test-group",
+					RemoteExec: RemoteExecConfig{
+						Enabled:  true,
+						Token:    "secret",
+						Commands: []ExecCommand{{Name: "uptime", Command: []string{"uptime"}}},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "client with remote exec but nothing to run",
+			config: Config{
+				Client: ClientConfig{
+					ClientID:   "test-client",
+					GroupID:    "test-group",
+					RemoteExec: RemoteExecConfig{Enabled: true, Token: "secret"},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client remote_exec requires at least one command or a shell",
+		},
+		{
+			name: "client with duplicate remote exec command",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "test-client",
+					GroupID:  "test-group",
+					RemoteExec: RemoteExecConfig{
+						Enabled: true,
+						Token:   "secret",
+						Commands: []ExecCommand{
+							{Name: "df", Command: []string{"df", "-h"}},
+							{Name: "df", Command: []string{"df"}},
+						},
+					},
+				},
+			},
+			wantErr: true,
+			errMsg:  `client remote_exec.commands has duplicate name "df"`,
+		},
+		{
+			name: "client auto update with bad maintenance window",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "test-client",
+					GroupID:  "test-group",
+					AutoUpdate: AutoUpdateConfig{
+						Enabled:   true,
+						PublicKey: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+						Window:    "02:00",
+					},
+				},
+			},
+			wantErr: true,
+			errMsg:  `client auto_update.window: invalid maintenance window "02:00": expected HH:MM-HH:MM`,
+		},
+		{
+			name: "gateway client updates without directory",
+			config: Config{
+				Gateway: GatewayConfig{ClientUpdates: ClientUpdatesConfig{Enabled: true}},
+			},
+			wantErr: true,
+			errMsg:  "client_updates.dir is required when client_updates is enabled",
+		},
+		{
+			name: "proxy socket options with invalid DSCP",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{SOCKS5: SOCKS5Config{SocketOptions: &SocketOptions{DSCP: 64}}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.socks5.socket_options.dscp must be between 0 and 63",
+		},
+		{
+			name: "negative proxy dial timeout",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{HTTP: HTTPConfig{DialTimeout: -time.Second}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.http.dial_timeout cannot be negative",
+		},
+		{
+			name: "ingress without group",
+			config: Config{
+				Gateway: GatewayConfig{Ingress: []IngressMapping{{ListenAddr: ":9000", Target: "10.0.5.10:5432"}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.ingress[0].group_id is required",
+		},
+		{
+			name: "ingress on a proxy listener address",
+			config: Config{
+				Gateway: GatewayConfig{
+					Proxy:   ProxyConfig{SOCKS5: SOCKS5Config{ListenAddr: ":1080"}},
+					Ingress: []IngressMapping{{ListenAddr: ":1080", GroupID: "db-team", Target: "10.0.5.10:5432"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "gateway.ingress[0] listens on :1080, which a socks5 proxy listener already uses",
+		},
+		{
+			name: "negative HTTP proxy header limit",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{HTTP: HTTPConfig{MaxHeaderBytes: -1}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.http.max_header_bytes, read_header_timeout, max_body_bytes and max_pending_connects cannot be negative",
+		},
+		{
+			name: "unsupported HTTP proxy auth scheme",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{HTTP: HTTPConfig{AuthSchemes: []string{"digest", "ntlm"}}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.http.auth_schemes: unsupported scheme \"ntlm\", must be basic or digest",
+		},
+		{
+			name: "negative HTTP proxy retry backoff",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{HTTP: HTTPConfig{Retry: HTTPRetry{MaxAttempts: 3, Backoff: -time.Second}}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.http.retry.max_attempts, backoff and max_backoff cannot be negative",
+		},
+		{
+			name: "group with unknown blocklist",
+			config: Config{
+				Gateway: GatewayConfig{
+					Blocklists: BlocklistsConfig{Lists: []BlocklistSource{{Name: "ads", Path: "ads.txt"}}},
+					Groups:     map[string]GroupConfig{"office": {Blocklists: []string{"malware"}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `groups.office.blocklists: unknown list "malware"`,
+		},
+		{
+			name: "group with unknown policy pack",
+			config: Config{
+				Gateway: GatewayConfig{
+					PolicyPacks: []PolicyPack{{Name: "no-metadata", ForbiddenHosts: []string{"169.254.0.0/16"}}},
+					Groups:      map[string]GroupConfig{"office": {PolicyPacks: []string{"no-smtp"}}},
+				},
+			},
+			wantErr: true,
+			errMsg:  `groups.office.policy_packs: unknown pack "no-smtp"`,
+		},
+		{
+			name: "group with invalid policy signature",
+			config: Config{
+				Gateway: GatewayConfig{
+					PolicyPacks: []PolicyPack{{Name: "no-metadata", ForbiddenHosts: []string{"169.254.0.0/16"}}},
+					Groups:      map[string]GroupConfig{"office": {PolicyPacks: []string{"no-metadata"}, PolicySignature: "c2lnbmF0dXJl"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "groups.office.policy_signature: expected a base64 ed25519 signature",
+		},
+		{
+			name: "group defaults with policy signature",
+			config: Config{
+				Gateway: GatewayConfig{
+					GroupDefaults: GroupConfig{PolicySignature: "c2lnbmF0dXJl"},
+				},
+			},
+			wantErr: true,
+			errMsg:  "group_defaults.policy_signature: signatures are bound to a group, set them per group",
+		},
+		{
+			name: "blocklist with path and url",
+			config: Config{
+				Gateway: GatewayConfig{Blocklists: BlocklistsConfig{Lists: []BlocklistSource{{Name: "ads", Path: "ads.txt", URL: "https://example.com/ads.txt"}}}},
+			},
+			wantErr: true,
+			errMsg:  "blocklists.lists[0]: exactly one of path or url is required",
+		},
+		{
+			name: "kcp parity shards without data shards",
+			config: Config{
+				Gateway: GatewayConfig{KCP: KCPConfig{ParityShards: 3}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.kcp.data_shards and parity_shards must be set together",
+		},
+		{
+			name: "client outbound rule without interface or source ip",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "test-client",
+					GroupID:  "test-group",
+					Outbound: []OutboundRule{{CIDR: "10.0.0.0/8", Interface: "eth1"}, {CIDR: "0.0.0.0/0"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client.outbound[1] requires interface or source_ip",
+		},
+		{
+			name: "client outbound source ip family mismatch",
+			config: Config{
+				Client: ClientConfig{
+					ClientID: "test-client",
+					GroupID:  "test-group",
+					Outbound: []OutboundRule{{CIDR: "2001:db8::/32", SourceIP: "192.0.2.10"}},
+				},
+			},
+			wantErr: true,
+			errMsg:  "client.outbound[0].source_ip and cidr must be the same address family",
+		},
+		{
+			name: "kcp unknown mode",
+			config: Config{
+				Gateway: GatewayConfig{KCP: KCPConfig{Mode: "turbo"}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.kcp.mode must be one of normal, fast, fast2 or fast3",
+		},
+		{
+			name: "negative mirror max bytes",
+			config: Config{
+				Gateway: GatewayConfig{Mirror: MirrorConfig{Enabled: true, MaxBytes: -1}},
+			},
+			wantErr: true,
+			errMsg:  "mirror.max_bytes cannot be negative",
+		},
+		{
+			name: "status page with duplicate group names",
+			config: Config{
+				Gateway: GatewayConfig{StatusPage: StatusPageConfig{
+					Enabled: true,
+					Groups:  []StatusPageGroup{{GroupID: "g1", Name: "eu-west"}, {GroupID: "g2", Name: "eu-west"}},
+				}},
+			},
+			wantErr: true,
+			errMsg:  `status_page.groups has duplicate name "eu-west"`,
+		},
+		{
+			name: "sub-group descendants wildcard before the last level",
+			config: Config{
+				Gateway: GatewayConfig{SubGroups: SubGroupsConfig{
+					Delegations: []SubGroupDelegation{{Parent: "acme", Children: []string{"**/prod"}}},
+				}},
+			},
+			wantErr: true,
+			errMsg:  `sub_groups.delegations[0].children can only use "**" as the last level: "**/prod"`,
+		},
+		{
+			name: "socks5 no_auth without the none method",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{SOCKS5: SOCKS5Config{
+					AuthMethods: []string{SOCKS5AuthPassword},
+					NoAuth:      SOCKS5NoAuthConfig{CIDRs: []string{"10.0.0.0/8"}, GroupID: "lab"},
+				}}},
+			},
+			wantErr: true,
+			errMsg:  "proxy.socks5.no_auth requires the none method in auth_methods",
+		},
+		{
+			name: "socks5 unsupported auth method",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{SOCKS5: SOCKS5Config{AuthMethods: []string{"chap"}}}},
+			},
+			wantErr: true,
+			errMsg:  `proxy.socks5.auth_methods: unsupported method "chap", must be password, none or gssapi`,
+		},
+		{
+			name: "socks5 gssapi auth method",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{SOCKS5: SOCKS5Config{
+					AuthMethods: []string{"gssapi", "password"},
+					GSSAPI:      SOCKS5GSSAPIConfig{Keytab: "/etc/anyproxy/socks.keytab", ServicePrincipal: "rcmd/proxy.example.com@EXAMPLE.COM", GroupID: "corp"},
+				}}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "socks5 gssapi auth method without settings",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{SOCKS5: SOCKS5Config{AuthMethods: []string{"password", "gssapi"}}}},
+			},
+			wantErr: true,
+			errMsg:  "proxy.socks5.gssapi requires keytab, service_principal and group_id",
+		},
+		{
+			name: "socks5 gssapi settings without the method",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{SOCKS5: SOCKS5Config{
+					GSSAPI: SOCKS5GSSAPIConfig{Keytab: "/etc/anyproxy/socks.keytab", ServicePrincipal: "rcmd/proxy.example.com@EXAMPLE.COM", GroupID: "corp"},
+				}}},
+			},
+			wantErr: true,
+			errMsg:  "proxy.socks5.gssapi requires the gssapi method in auth_methods",
+		},
+		{
+			name: "proxy listener socks5 gssapi principal without realm",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{Listeners: []ProxyListener{
+					{Type: ProxyTypeSOCKS5, Addr: ":1081", SOCKS5: SOCKS5Config{
+						AuthMethods: []string{"gssapi"},
+						GSSAPI:      SOCKS5GSSAPIConfig{Keytab: "/etc/anyproxy/socks.keytab", ServicePrincipal: "rcmd/proxy.example.com", GroupID: "corp"},
+					}},
+				}}},
+			},
+			wantErr: true,
+			errMsg:  `proxy.listeners[0].socks5.gssapi.service_principal: "rcmd/proxy.example.com" must include the realm, e.g. rcmd/proxy.example.com@EXAMPLE.COM`,
+		},
+		{
+			name: "proxy listeners sharing an address",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{
+					SOCKS5:    SOCKS5Config{ListenAddr: ":1080"},
+					Listeners: []ProxyListener{{Type: ProxyTypeTUIC, Addr: ":1080"}, {Type: ProxyTypeHTTP, Addr: ":1080"}},
+				}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.listeners[1].http listens on :1080, which gateway.proxy.socks5 already uses",
+		},
+		{
+			name: "proxy listener of unknown type",
+			config: Config{
+				Gateway: GatewayConfig{Proxy: ProxyConfig{Listeners: []ProxyListener{{Type: "shadowsocks", Addr: ":8388"}}}},
+			},
+			wantErr: true,
+			errMsg:  "gateway.proxy.listeners[0].type must be one of: http, socks5, tuic",
+		},
+		{
+			name: "source route with invalid CIDR",
+			config: Config{
+				Gateway: GatewayConfig{SourceRoutes: []SourceRouteRule{{CIDRs: []string{"10.1.0.0/33"}, GroupID: "office"}}},
+			},
+			wantErr: true,
+			errMsg:  `source_routes[0]: invalid CIDR "10.1.0.0/33"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr && err.Error() != tt.errMsg {
+				t.Errorf("Config.Validate() error message = %v, want %v", err.Error(), tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestProxyConfig_AllListeners(t *testing.T) {
+	proxy := ProxyConfig{
+		HTTP: HTTPConfig{ListenAddr: ":8080"},
+		Listeners: []ProxyListener{
+			{Type: ProxyTypeSOCKS5, Addr: ":1080", Groups: []string{"team-a"}},
+			{Type: ProxyTypeSOCKS5, Addr: ":1081", SOCKS5: SOCKS5Config{ListenAddr: ":9999"}},
+		},
+	}
+
+	listeners := proxy.AllListeners()
+	if len(listeners) != 3 {
+		t.Fatalf("Expected 3 listeners, got %d", len(listeners))
+	}
+	if listeners[0].Type != ProxyTypeHTTP || listeners[0].HTTP.ListenAddr != ":8080" {
+		t.Errorf("Expected the http section first, got %+v", listeners[0])
+	}
+	if listeners[1].Groups[0] != "team-a" || listeners[2].SOCKS5.ListenAddr != ":1081" {
+		t.Errorf("Expected the listeners in order with their addresses, got %+v", listeners[1:])
+	}
+}
+
+func TestGatewayConfig_GetGroupConfig(t *testing.T) {
+	cfg := GatewayConfig{
+		GroupDefaults: GroupConfig{MaxClients: 5, MaxConnections: 50},
+		Groups: map[string]GroupConfig{
+			"tenant-a": {MaxClients: 1, MaxConnections: 10},
+		},
+	}
+
+	if got := cfg.GetGroupConfig("tenant-a"); got.MaxClients != 1 || got.MaxConnections != 10 {
+		t.Errorf("Expected explicit limits for tenant-a, got %+v", got)
+	}
+	if got := cfg.GetGroupConfig("tenant-b"); got.MaxClients != 5 || got.MaxConnections != 50 {
+		t.Errorf("Expected default limits for tenant-b, got %+v", got)
 	}
 }
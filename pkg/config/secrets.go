@@ -0,0 +1,359 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretFetchTimeout bounds each request to Vault or AWS Secrets Manager
+const secretFetchTimeout = 10 * time.Second
+
+// secretRef matches ${...} references in config values, $${ is a literal ${
+var secretRef = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// pemFields are the yaml fields holding file paths of PEM files. A reference resolving to PEM
+// content is kept in memory and the field gets a secretPEMPrefix name, read by ReadPEMFile.
+var pemFields = map[string]bool{"tls_cert": true, "tls_key": true, "ca_cert": true}
+
+// secretPEMPrefix starts the names of PEM content resolved from secrets, followed by the yaml path
+const secretPEMPrefix = "secret-pem:"
+
+// secretPEMs holds the PEM content resolved from secrets by name, it never touches the disk
+var secretPEMs sync.Map
+
+// secretResolver resolves the references of a config, each secret is fetched once
+type secretResolver struct {
+	ctx    context.Context
+	client *http.Client
+	cache  map[string]string
+}
+
+// resolveSecrets replaces the references in the string values of cfg:
+//
+//	${NAME} or ${env:NAME}       environment variable, ${NAME:-default} when unset
+//	${file:/run/secrets/name}    file content without trailing newlines
+//	${vault:path#field}          field of a Vault KV secret, at VAULT_ADDR with VAULT_TOKEN
+//	${aws-sm:secret-id#field}    AWS Secrets Manager secret, a JSON field of it with #field
+func resolveSecrets(cfg *Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+	r := &secretResolver{ctx: ctx, client: &http.Client{Timeout: secretFetchTimeout}, cache: make(map[string]string)}
+	return r.walk(reflect.ValueOf(cfg).Elem(), "")
+}
+
+// walk resolves the references in the strings reachable from v, name is the yaml path of v
+func (r *secretResolver) walk(v reflect.Value, name string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return r.walk(v.Elem(), name)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if tag == "-" {
+				continue
+			}
+			if tag == "" {
+				tag = strings.ToLower(field.Name)
+			}
+			if err := r.walk(v.Field(i), joinYAMLPath(name, tag)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := r.walk(v.Index(i), fmt.Sprintf("%s[%d]", name, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// Map values aren't addressable, resolve a copy and store it back
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			if err := r.walk(value, fmt.Sprintf("%s.%v", name, key)); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	case reflect.String:
+		if !strings.Contains(v.String(), "${") {
+			return nil
+		}
+		resolved, err := r.expand(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if pemFields[name[strings.LastIndex(name, ".")+1:]] && strings.HasPrefix(resolved, "-----BEGIN ") {
+			secretPEMs.Store(secretPEMPrefix+name, []byte(resolved))
+			resolved = secretPEMPrefix + name
+		}
+		v.SetString(resolved)
+	}
+	return nil
+}
+
+// joinYAMLPath appends a field to a yaml path
+func joinYAMLPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// expand replaces the references in value
+func (r *secretResolver) expand(value string) (string, error) {
+	var err error
+	expanded := secretRef.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		if err != nil {
+			return ""
+		}
+		var secret string
+		secret, err = r.lookup(match[2 : len(match)-1])
+		return secret
+	})
+	return expanded, err
+}
+
+// lookup resolves the reference ref, cached for the other values referencing it
+func (r *secretResolver) lookup(ref string) (string, error) {
+	if secret, ok := r.cache[ref]; ok {
+		return secret, nil
+	}
+	var secret string
+	var err error
+	scheme, rest, found := strings.Cut(ref, ":")
+	switch {
+	case found && scheme == "env":
+		secret, err = lookupEnv(rest)
+	case found && scheme == "file":
+		var data []byte
+		data, err = os.ReadFile(rest) // nolint:gosec // Secret file paths come from the config file
+		secret = strings.TrimRight(string(data), "\r\n")
+	case found && scheme == "vault":
+		secret, err = r.vault(rest)
+	case found && scheme == "aws-sm":
+		secret, err = r.awsSecretsManager(rest)
+	default:
+		secret, err = lookupEnv(ref)
+	}
+	if err != nil {
+		return "", err
+	}
+	r.cache[ref] = secret
+	return secret, nil
+}
+
+// lookupEnv returns an environment variable, NAME:-default falls back to default when it is unset or empty
+func lookupEnv(ref string) (string, error) {
+	name, fallback, hasDefault := strings.Cut(ref, ":-")
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	if hasDefault {
+		return fallback, nil
+	}
+	if _, ok := os.LookupEnv(name); !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return "", nil
+}
+
+// vault reads a field of a KV secret, path#field, version 1 and 2 engines are supported
+func (r *secretResolver) vault(ref string) (string, error) {
+	path, field, found := strings.Cut(ref, "#")
+	if !found || field == "" {
+		return "", fmt.Errorf("vault reference %q needs a #field", ref)
+	}
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set for vault references")
+	}
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := r.fetchJSON(req, "vault", &secret); err != nil {
+		return "", err
+	}
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested // KV version 2
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no string field %s", path, field)
+	}
+	return value, nil
+}
+
+// awsSecretsManager reads a secret, or a field of a JSON secret with secret-id#field
+func (r *secretResolver) awsSecretsManager(ref string) (string, error) {
+	secretID, field, _ := strings.Cut(ref, "#")
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if region == "" || accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for aws-sm references")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	body, _ := json.Marshal(map[string]string{"SecretId": secretID})
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, body, region, "secretsmanager", accessKey, secretKey, time.Now())
+
+	var secret struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := r.fetchJSON(req, "AWS Secrets Manager", &secret); err != nil {
+		return "", err
+	}
+	if field == "" {
+		return secret.SecretString, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("AWS secret %s is not a JSON object: %w", secretID, err)
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("AWS secret %s has no string field %s", secretID, field)
+	}
+	return value, nil
+}
+
+// fetchJSON sends req and decodes the JSON response into v
+func (r *secretResolver) fetchJSON(req *http.Request, store string, v interface{}) error {
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch secret from %s: %w", store, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned status %d: %s", store, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", store, err)
+	}
+	return nil
+}
+
+// signAWSRequest adds the headers of AWS Signature Version 4 to a request with payload
+func signAWSRequest(req *http.Request, payload []byte, region, service, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// Sign the host and every header set on the request, sorted by name
+	headers := []string{"host"}
+	for name := range req.Header {
+		headers = append(headers, strings.ToLower(name))
+	}
+	slices.Sort(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	payloadHash := sha256Hex(payload)
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// ReadPEMFile reads the PEM file of a tls_cert, tls_key or ca_cert field, or the content of a
+// secret the field referenced
+func ReadPEMFile(path string) ([]byte, error) {
+	if strings.HasPrefix(path, secretPEMPrefix) {
+		if content, ok := secretPEMs.Load(path); ok {
+			return content.([]byte), nil
+		}
+		return nil, fmt.Errorf("%s was not resolved from a secret", path)
+	}
+	return os.ReadFile(path) //nolint:gosec // path comes from the config
+}
+
+// LoadX509KeyPair is tls.LoadX509KeyPair for tls_cert and tls_key fields, which may name
+// secrets resolved into memory
+func LoadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := ReadPEMFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ReadPEMFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// sha256Hex returns the hex encoded SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
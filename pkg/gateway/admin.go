@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// ErrClientNotFound is returned for admin actions on a client that isn't connected
+var ErrClientNotFound = errors.New("client not found")
+
+// GroupStatus is a snapshot of a client group used by the admin API
+type GroupStatus struct {
+	GroupID           string   `json:"group_id"`
+	Clients           []string `json:"clients"`
+	ActiveConnections int      `json:"active_connections"`
+	MaxClients        int      `json:"max_clients"`
+	MaxConnections    int      `json:"max_connections"`
+	StickySession     string   `json:"sticky_session,omitempty"`
+	Balancing         string   `json:"balancing,omitempty"`
+	Hibernating       []string `json:"hibernating,omitempty"` // Clients of the group in hibernation
+}
+
+// GetGroupStatus returns the status of all groups with registered clients, sorted by group ID
+func (g *Gateway) GetGroupStatus() []GroupStatus {
+	g.clientsMu.RLock()
+	g.groupsMu.RLock()
+	statuses := make([]GroupStatus, 0, len(g.groups))
+	for groupID, groupInfo := range g.groups {
+		groupCfg := g.config.GetGroupConfig(groupID)
+		var hibernating []string
+		for _, clientID := range groupInfo.Clients {
+			if client, ok := g.clients[clientID]; ok && client.Hibernating() {
+				hibernating = append(hibernating, clientID)
+			}
+		}
+		statuses = append(statuses, GroupStatus{
+			GroupID:           groupID,
+			Clients:           append([]string(nil), groupInfo.Clients...),
+			ActiveConnections: g.groupConns[groupID],
+			MaxClients:        groupCfg.MaxClients,
+			MaxConnections:    groupCfg.MaxConnections,
+			StickySession:     groupCfg.StickySession,
+			Balancing:         groupCfg.Balancing,
+			Hibernating:       hibernating,
+		})
+	}
+	g.groupsMu.RUnlock()
+	g.clientsMu.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].GroupID < statuses[j].GroupID
+	})
+	return statuses
+}
+
+// KickClient disconnects a client, its proxied connections are closed.
+// The client is removed from its group once its message loop exits.
+func (g *Gateway) KickClient(clientID string) error {
+	g.clientsMu.RLock()
+	client, exists := g.clients[clientID]
+	g.clientsMu.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrClientNotFound, clientID)
+	}
+
+	logger.Info("Kicking client by admin request", "client_id", clientID, "group_id", client.GroupID)
+	go client.Stop()
+	return nil
+}
+
+// RegisterGroup creates or updates the credentials of a group
+func (g *Gateway) RegisterGroup(groupID, password string) error {
+	if err := g.credentialMgr.RegisterGroup(groupID, password); err != nil {
+		return err
+	}
+	g.groupSecrets.set(groupID, password)
+	return nil
+}
+
+// RemoveGroup removes the credentials of a group
+func (g *Gateway) RemoveGroup(groupID string) error {
+	if groupID == "" {
+		return fmt.Errorf("group_id is required")
+	}
+	g.groupSecrets.remove(groupID)
+	return g.credentialMgr.RemoveGroup(groupID)
+}
+
+// Dial connects to addr through a client of the group, applying the same policies as proxied
+// connections. It lets programs embedding the gateway proxy without a listener.
+func (g *Gateway) Dial(ctx context.Context, groupID, network, addr string) (net.Conn, error) {
+	return g.dial(commonctx.WithUserContext(ctx, &utils.UserContext{GroupID: groupID}), network, addr)
+}
+
+// DialClientFileService opens a connection to a client's file transfer service through its tunnel
+func (g *Gateway) DialClientFileService(ctx context.Context, clientID string) (net.Conn, error) {
+	g.clientsMu.RLock()
+	client, exists := g.clients[clientID]
+	g.clientsMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrClientNotFound, clientID)
+	}
+
+	logger.Info("Opening file transfer session to client", "client_id", clientID, "group_id", client.GroupID)
+	return client.dialNetwork(ctx, protocol.ProtocolTCP, protocol.FileServiceAddress)
+}
+
+// DialClientExecService opens a connection to a client's remote exec service through its tunnel.
+// The client's group must have remote_exec enabled.
+func (g *Gateway) DialClientExecService(ctx context.Context, clientID string) (net.Conn, error) {
+	g.clientsMu.RLock()
+	client, exists := g.clients[clientID]
+	g.clientsMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrClientNotFound, clientID)
+	}
+	if !g.config.GetGroupConfig(client.GroupID).RemoteExec {
+		logger.Warn("Rejected remote exec session for group without remote_exec", "client_id", clientID, "group_id", client.GroupID)
+		return nil, fmt.Errorf("%w: group %s", utils.ErrRemoteExecDisabled, client.GroupID)
+	}
+
+	logger.Info("Opening remote exec session to client", "client_id", clientID, "group_id", client.GroupID)
+	return client.dialNetwork(ctx, protocol.ProtocolTCP, protocol.ExecServiceAddress)
+}
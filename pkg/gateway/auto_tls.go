@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"github.com/buhuipao/anyproxy/pkg/common/autotls"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultAutoTLSDir keeps the generated TLS material when auto_tls.dir is empty
+const defaultAutoTLSDir = "anyproxy-tls"
+
+// ErrEnrollmentDisabled is returned for enrollments on gateways without auto_tls
+var ErrEnrollmentDisabled = errors.New("client enrollment requires gateway.auto_tls")
+
+// prepareAutoTLS loads or generates the TLS material of gateways with auto_tls and has tls_cert
+// and tls_key point to it, nil without auto_tls
+func prepareAutoTLS(cfg *config.GatewayConfig) (*autotls.Bundle, error) {
+	if !cfg.AutoTLS.Enabled {
+		return nil, nil
+	}
+	dir := cfg.AutoTLS.Dir
+	if dir == "" {
+		dir = defaultAutoTLSDir
+	}
+	hosts := autoTLSHosts(cfg)
+	bundle, err := autotls.Ensure(dir, hosts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TLSCert, cfg.TLSKey = bundle.CertFile, bundle.KeyFile
+	logger.Info("Auto TLS ready, clients enroll with the token", "ca_file", bundle.CAFile, "hosts", hosts, "enroll_token", bundle.Token)
+	return bundle, nil
+}
+
+// autoTLSHosts returns the names and IPs the server certificate is issued for
+func autoTLSHosts(cfg *config.GatewayConfig) []string {
+	if len(cfg.AutoTLS.Hosts) > 0 {
+		return cfg.AutoTLS.Hosts
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if host, _, err := net.SplitHostPort(cfg.ListenAddr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// EnrollmentCA returns the CA of the gateway to clients presenting the enrollment token
+func (g *Gateway) EnrollmentCA(token string) ([]byte, error) {
+	if g.autoTLS == nil {
+		return nil, ErrEnrollmentDisabled
+	}
+	if !g.autoTLS.CheckToken(token) {
+		return nil, autotls.ErrInvalidToken
+	}
+	return g.autoTLS.CAPEM, nil
+}
@@ -0,0 +1,36 @@
+package gateway
+
+// unknownLoadScore is assumed for clients that reported no load score yet, or never do
+// because their version predates it
+const unknownLoadScore = 0.5
+
+// loadScoreBand is the score difference below which two clients count as equally loaded, the
+// one serving fewer connections through the gateway is preferred then
+const loadScoreBand = 0.05
+
+// LoadScore returns the load score of the client's last heartbeat, from 0 (idle) to 1
+// (saturated), or unknownLoadScore without one
+func (c *ClientConn) LoadScore() float64 {
+	if score := c.loadScore.Load(); score != nil {
+		return *score
+	}
+	return unknownLoadScore
+}
+
+// connectionCount returns how many proxied connections the client serves
+func (c *ClientConn) connectionCount() int {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return len(c.Conns)
+}
+
+// lessLoaded reports whether client a should take a new connection before client b in groups
+// balanced by load. Scores only change with heartbeats, so clients within loadScoreBand are
+// told apart by their current connections.
+func lessLoaded(a, b *ClientConn) bool {
+	scoreA, scoreB := a.LoadScore(), b.LoadScore()
+	if diff := scoreA - scoreB; diff < -loadScoreBand || diff > loadScoreBand {
+		return scoreA < scoreB
+	}
+	return a.connectionCount() < b.connectionCount()
+}
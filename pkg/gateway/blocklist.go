@@ -0,0 +1,256 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/blocklist"
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Blocklist loading limits
+const (
+	defaultBlocklistRefresh = time.Hour
+	blocklistFetchTimeout   = time.Minute
+	maxBlocklistSize        = 64 << 20
+)
+
+// loadedBlocklist is the current version of a blocklist source
+type loadedBlocklist struct {
+	list         *blocklist.List
+	modTime      time.Time // File modification time
+	etag         string    // ETag of the URL response
+	lastModified string    // Last-Modified of the URL response
+}
+
+// blocklistPolicy rejects dials to targets on the configured blocklists and keeps the lists up to date
+type blocklistPolicy struct {
+	config   *config.GatewayConfig
+	interval time.Duration
+	client   *http.Client
+	names    []string // All lists in configuration order, applied to groups without blocklists
+
+	mu           sync.RWMutex
+	lists        map[string]*loadedBlocklist
+	groupAllow   map[string]*blocklist.List // blocklist_allow of groups with an explicit entry
+	defaultAllow *blocklist.List            // blocklist_allow of group_defaults
+}
+
+// newBlocklistPolicy loads the configured blocklists, returns nil when none are configured.
+// A missing file is an error, an unreachable URL is retried on the next refresh.
+func newBlocklistPolicy(cfg *config.GatewayConfig) (*blocklistPolicy, error) {
+	if len(cfg.Blocklists.Lists) == 0 {
+		return nil, nil
+	}
+
+	interval := cfg.Blocklists.RefreshInterval
+	if interval == 0 {
+		interval = defaultBlocklistRefresh
+	}
+	p := &blocklistPolicy{
+		config:       cfg,
+		interval:     interval,
+		client:       &http.Client{Timeout: blocklistFetchTimeout},
+		lists:        make(map[string]*loadedBlocklist),
+		groupAllow:   make(map[string]*blocklist.List),
+		defaultAllow: allowList(cfg.GroupDefaults.BlocklistAllow),
+	}
+	for groupID, groupCfg := range cfg.Groups {
+		p.groupAllow[groupID] = allowList(groupCfg.BlocklistAllow)
+	}
+
+	for _, source := range cfg.Blocklists.Lists {
+		p.names = append(p.names, source.Name)
+		loaded, err := p.load(context.Background(), source, nil)
+		if err != nil {
+			if source.Path != "" {
+				return nil, fmt.Errorf("blocklist %s: %w", source.Name, err)
+			}
+			logger.Warn("Failed to fetch blocklist, retrying on next refresh", "list", source.Name, "url", source.URL, "err", err)
+			loaded = &loadedBlocklist{list: blocklist.New()}
+		}
+		p.lists[source.Name] = loaded
+		monitoring.SetBlocklistEntries(source.Name, loaded.list.Len())
+		logger.Info("Blocklist loaded", "list", source.Name, "entries", loaded.list.Len(), "skipped_lines", loaded.list.Skipped())
+	}
+	return p, nil
+}
+
+// allowList parses group blocklist_allow entries, nil when there are none
+func allowList(entries []string) *blocklist.List {
+	if len(entries) == 0 {
+		return nil
+	}
+	l := blocklist.New()
+	for _, entry := range entries {
+		l.AddLine(entry)
+	}
+	return l
+}
+
+// run reloads the blocklists every refresh interval until ctx is done
+func (p *blocklistPolicy) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.refresh(ctx)
+		}
+	}
+}
+
+// refresh reloads changed blocklists, a list that fails to load keeps its previous entries
+func (p *blocklistPolicy) refresh(ctx context.Context) {
+	for _, source := range p.config.Blocklists.Lists {
+		p.mu.RLock()
+		previous := p.lists[source.Name]
+		p.mu.RUnlock()
+
+		loaded, err := p.load(ctx, source, previous)
+		if err != nil {
+			logger.Warn("Failed to refresh blocklist, keeping previous entries", "list", source.Name, "path", source.Path, "url", source.URL, "err", err)
+			continue
+		}
+		if loaded == nil {
+			continue
+		}
+
+		p.mu.Lock()
+		p.lists[source.Name] = loaded
+		p.mu.Unlock()
+		monitoring.SetBlocklistEntries(source.Name, loaded.list.Len())
+		logger.Info("Blocklist reloaded", "list", source.Name, "entries", loaded.list.Len(), "skipped_lines", loaded.list.Skipped())
+	}
+}
+
+// load reads a blocklist source, it returns nil without error when the source is unchanged since previous
+func (p *blocklistPolicy) load(ctx context.Context, source config.BlocklistSource, previous *loadedBlocklist) (*loadedBlocklist, error) {
+	if source.Path != "" {
+		return loadBlocklistFile(source.Path, previous)
+	}
+	return p.fetchBlocklist(ctx, source.URL, previous)
+}
+
+// loadBlocklistFile reads a blocklist file unless its modification time is unchanged
+func loadBlocklistFile(path string, previous *loadedBlocklist) (*loadedBlocklist, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && info.ModTime().Equal(previous.modTime) {
+		return nil, nil
+	}
+	f, err := os.Open(path) //nolint:gosec // path comes from the gateway configuration
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	list, err := blocklist.Parse(io.LimitReader(f, maxBlocklistSize))
+	if err != nil {
+		return nil, err
+	}
+	return &loadedBlocklist{list: list, modTime: info.ModTime()}, nil
+}
+
+// fetchBlocklist downloads a blocklist, using conditional requests to skip unchanged lists
+func (p *blocklistPolicy) fetchBlocklist(ctx context.Context, url string, previous *loadedBlocklist) (*loadedBlocklist, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		if previous.etag != "" {
+			req.Header.Set("If-None-Match", previous.etag)
+		}
+		if previous.lastModified != "" {
+			req.Header.Set("If-Modified-Since", previous.lastModified)
+		}
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotModified && previous != nil {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBlocklistSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBlocklistSize {
+		return nil, fmt.Errorf("blocklist exceeds %d bytes", maxBlocklistSize)
+	}
+	list, err := blocklist.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return &loadedBlocklist{list: list, etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+// check returns the name of the first blocklist of the group that contains the target host
+func (p *blocklistPolicy) check(groupID, addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	groupCfg := p.config.GetGroupConfig(groupID)
+	if len(groupCfg.Blocklists) == 1 && groupCfg.Blocklists[0] == config.BlocklistsNone {
+		return "", false
+	}
+	allow := p.defaultAllow
+	if _, ok := p.config.Groups[groupID]; ok {
+		allow = p.groupAllow[groupID]
+	}
+	if allow != nil && allow.Match(host) {
+		return "", false
+	}
+
+	names := groupCfg.Blocklists
+	if len(names) == 0 {
+		names = p.names
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, name := range names {
+		if loaded, ok := p.lists[name]; ok && loaded.list.Match(host) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// applyBlocklists rejects the dial when the target is on a blocklist of the serving group
+func (g *Gateway) applyBlocklists(userCtx *utils.UserContext, network, addr string) error {
+	if g.blocklists == nil {
+		return nil
+	}
+	list, blocked := g.blocklists.check(userCtx.GroupID, addr)
+	if !blocked {
+		return nil
+	}
+	monitoring.IncrementBlockedDials(list)
+	logger.Warn("Blocklist rejected dial", "group_id", userCtx.GroupID, "source_ip", userCtx.SourceIP, "network", network, "address", addr, "list", list)
+	return fmt.Errorf("%w: %s", utils.ErrBlocklisted, list)
+}
@@ -0,0 +1,115 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestBlocklistPolicy_GroupOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ads.txt")
+	if err := os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n||tracker.test^\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.GatewayConfig{
+		Blocklists: config.BlocklistsConfig{Lists: []config.BlocklistSource{{Name: "ads", Path: path}}},
+		Groups: map[string]config.GroupConfig{
+			"trusted": {Blocklists: []string{config.BlocklistsNone}},
+			"partner": {BlocklistAllow: []string{"cdn.tracker.test"}},
+		},
+	}
+	policy, err := newBlocklistPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := &Gateway{config: cfg, blocklists: policy}
+
+	tests := []struct {
+		group   string
+		addr    string
+		blocked bool
+	}{
+		{"default", "ads.example.com:443", true},
+		{"default", "www.tracker.test:80", true},
+		{"default", "example.com:443", false},
+		{"trusted", "ads.example.com:443", false},
+		{"partner", "cdn.tracker.test:443", false},
+		{"partner", "www.tracker.test:443", true},
+	}
+	for _, tt := range tests {
+		err := gw.applyBlocklists(&utils.UserContext{GroupID: tt.group}, "tcp", tt.addr)
+		if blocked := errors.Is(err, utils.ErrBlocklisted); blocked != tt.blocked {
+			t.Errorf("group %s dial %s: err = %v, want blocked %v", tt.group, tt.addr, err, tt.blocked)
+		}
+	}
+}
+
+func TestBlocklistPolicy_Refresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "local.txt")
+	if err := os.WriteFile(path, []byte("blocked.test\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int32
+	body := "192.0.2.0/24\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	cfg := &config.GatewayConfig{Blocklists: config.BlocklistsConfig{Lists: []config.BlocklistSource{
+		{Name: "local", Path: path},
+		{Name: "remote", URL: server.URL},
+	}}}
+	policy, err := newBlocklistPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, blocked := policy.check("g", "192.0.2.10:53"); !blocked || list != "remote" {
+		t.Errorf("Expected remote list to block 192.0.2.10, got %q %v", list, blocked)
+	}
+
+	// An updated file is reloaded, an unchanged URL answers 304 and keeps its entries
+	if err := os.WriteFile(path, []byte("other.test\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	policy.refresh(context.Background())
+
+	if _, blocked := policy.check("g", "blocked.test:443"); blocked {
+		t.Error("Expected blocked.test to be removed after reload")
+	}
+	if list, blocked := policy.check("g", "other.test:443"); !blocked || list != "local" {
+		t.Errorf("Expected other.test to be blocked by local list, got %q %v", list, blocked)
+	}
+	if _, blocked := policy.check("g", "192.0.2.10:53"); !blocked {
+		t.Error("Expected remote list entries to survive a 304 refresh")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("Expected 2 fetches, got %d", n)
+	}
+
+	// A missing file fails at startup
+	cfg.Blocklists.Lists = []config.BlocklistSource{{Name: "missing", Path: filepath.Join(t.TempDir(), "missing.txt")}}
+	if _, err := newBlocklistPolicy(cfg); err == nil {
+		t.Error("Expected error for missing blocklist file")
+	}
+}
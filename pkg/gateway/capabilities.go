@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultBusyHoldOff is how long a client refusing a connect request as busy without a retry
+// delay gets no connect requests
+const defaultBusyHoldOff = time.Second
+
+// handleCapabilities stores what the client advertised, it is sent before the client's ports
+func (c *ClientConn) handleCapabilities(msg map[string]interface{}) {
+	caps, ok := msg["capabilities"].(*protocol.Capabilities)
+	if !ok {
+		logger.Warn("Invalid capabilities message", "client_id", c.ID, "message_fields", utils.GetMessageFields(msg))
+		return
+	}
+	c.capabilities.Store(caps)
+	logger.Info("Client advertised capabilities", "client_id", c.ID, "group_id", c.GroupID, "supports_udp", caps.SupportsUDP, "supports_unix", caps.SupportsUnix, "max_conns", caps.MaxConns)
+}
+
+// Capabilities returns what the client advertised, nil when it supports everything
+func (c *ClientConn) Capabilities() *protocol.Capabilities {
+	return c.capabilities.Load()
+}
+
+// supports reports whether connections of network may be routed to the client
+func (c *ClientConn) supports(network string) bool {
+	return c.capabilities.Load().Supports(network)
+}
+
+// atCapacity reports whether the client serves as many connections as it advertised to accept,
+// or asked to get no connect requests for now
+func (c *ClientConn) atCapacity() bool {
+	if c.busy() {
+		return true
+	}
+	caps := c.capabilities.Load()
+	if caps == nil || caps.MaxConns <= 0 {
+		return false
+	}
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return len(c.Conns) >= caps.MaxConns
+}
+
+// holdOff routes no connect requests to the client for d, it refused one at its connect rate limit
+func (c *ClientConn) holdOff(d time.Duration) {
+	if d <= 0 {
+		d = defaultBusyHoldOff
+	}
+	c.busyUntil.Store(time.Now().Add(d).UnixNano())
+}
+
+// busy reports whether the client asked to get no connect requests for now
+func (c *ClientConn) busy() bool {
+	return time.Now().UnixNano() < c.busyUntil.Load()
+}
+
+// capabilitySkips tracks the available clients of a group passed over by a client selection
+type capabilitySkips struct {
+	unsupported int         // Clients not supporting the network
+	full        *ClientConn // First client at its advertised connection limit, used when no other is left
+}
+
+// check reports whether the client can take a connection of network, recording it otherwise
+func (s *capabilitySkips) check(client *ClientConn, network string) bool {
+	switch {
+	case !client.supports(network):
+		s.unsupported++
+	case client.atCapacity():
+		if s.full == nil {
+			s.full = client
+		}
+	default:
+		return true
+	}
+	return false
+}
+
+// err explains why no client supports network, nil when none was passed over for it
+func (s *capabilitySkips) err(groupID, network string) error {
+	if s.unsupported == 0 {
+		return nil
+	}
+	return utils.WithErrorCode(utils.ErrCodeNoClientAvailable, fmt.Errorf("no client of group %s supports %s", groupID, network))
+}
@@ -3,12 +3,16 @@ package gateway
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buhuipao/anyproxy/pkg/common/connection"
@@ -16,6 +20,7 @@ import (
 	"github.com/buhuipao/anyproxy/pkg/common/message"
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/qos"
 	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
@@ -26,6 +31,7 @@ import (
 type ClientConn struct {
 	ID             string
 	GroupID        string
+	Version        string               // Client build version from the handshake, empty for older clients
 	Conn           transport.Connection // 🆕 Use transport layer connection
 	connMu         sync.RWMutex         // Fix: Use single lock to protect connection and message channels
 	Conns          map[string]*Conn
@@ -35,6 +41,23 @@ type ClientConn struct {
 	stopOnce       sync.Once
 	wg             sync.WaitGroup
 	portForwardMgr *PortForwardManager
+	closeGrace     time.Duration                         // How long half-closed connections stay open, zero closes connections fully on EOF
+	egress         *qos.Scheduler                        // Shapes the bandwidth sent to the client (nil = unlimited)
+	probeInterval  time.Duration                         // Idle time after which connections are probed, zero disables probes
+	packets        *packetRouter                         // Exchanges IP packets in TUN mode (nil = disabled)
+	draining       atomic.Bool                           // Set when the client announced its shutdown, it gets no new connections
+	policyPending  atomic.Bool                           // Set until the group's policy packs were pushed to the client
+	controlKey     []byte                                // Derived from the group password the client authenticated with, nil without one
+	signedControl  bool                                  // Reject port forward requests not signed with controlKey
+	hibernating    atomic.Bool                           // Set while the client hibernates, cleared by its next connection
+	resumed        chan struct{}                         // Wakes the suspended idle probes when the client resumes
+	lastUsed       atomic.Int64                          // Unix nanoseconds of the last opened or closed connection
+	capabilities   atomic.Pointer[protocol.Capabilities] // Advertised by the client, nil supports everything
+	loadScore      atomic.Pointer[float64]               // Reported with the client's last heartbeat, nil without one
+	busyUntil      atomic.Int64                          // Unix nanoseconds until which the client asked to get no connect requests
+
+	// Dials through a client of another group for the client's peer listeners (nil = peer routing disabled)
+	peerDial func(ctx context.Context, groupID, groupPassword, network, address string) (net.Conn, error)
 
 	// 🆕 Shared message handler
 	msgHandler message.ExtendedMessageHandler
@@ -46,6 +69,23 @@ type Conn struct {
 	LocalConn net.Conn
 	Done      chan struct{}
 	once      sync.Once
+	Address   string     // Dial target, used as the latency histogram key
+	StartTime time.Time  // When the dial was requested
+	firstByte int32      // Set once the first byte from the target was delivered
+	connected chan error // Receives the connect response when the dialer waits for it, nil otherwise
+	halfClose connection.HalfClose
+	active    atomic.Int64 // Unix nanoseconds of the last data in either direction or probe
+}
+
+// reportConnect delivers the connect response to a dialer waiting for it
+func (c *Conn) reportConnect(err error) {
+	if c.connected == nil {
+		return
+	}
+	select {
+	case c.connected <- err:
+	default:
+	}
 }
 
 // Stop stops the client connection and cleans up resources.
@@ -130,6 +170,45 @@ func (c *ClientConn) Stop() {
 }
 
 func (c *ClientConn) dialNetwork(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, _, err := c.openConnection(ctx, network, addr, nil)
+	return conn, err
+}
+
+// dialNetworkConfirmed dials like dialNetwork but waits until the client reports whether it
+// reached the target, so a failure can still be retried through another client
+func (c *ClientConn) dialNetworkConfirmed(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	connected := make(chan error, 1)
+	conn, proxyConn, err := c.openConnection(ctx, network, addr, connected)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-connected:
+	case <-proxyConn.Done:
+		// A response may have arrived right before the connection was closed
+		select {
+		case err = <-connected:
+		default:
+			err = fmt.Errorf("client %s closed the connection to %s before connecting", c.ID, addr)
+		}
+	case <-timer.C:
+		err = utils.WithErrorCode(utils.ErrCodeDialTimeout, fmt.Errorf("timeout waiting for client %s to connect to %s", c.ID, addr))
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.closeConnection(proxyConn.ID)
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// openConnection registers a connection and asks the client to dial the target
+func (c *ClientConn) openConnection(ctx context.Context, network, addr string, connected chan error) (net.Conn, *Conn, error) {
 	// Prefer connID from context, generate new one if not available
 	connID, ok := commonctx.GetConnID(ctx)
 	if !ok {
@@ -137,23 +216,41 @@ func (c *ClientConn) dialNetwork(ctx context.Context, network, addr string) (net
 		logger.Debug("Generated new connection ID", "client_id", c.ID, "conn_id", connID)
 	}
 
-	logger.Debug("Creating new network connection", "client_id", c.ID, "conn_id", connID, "network", network, "address", addr)
+	// The client refused a connect request at its rate limit, don't send it another one yet
+	if c.busy() {
+		return nil, nil, utils.WithErrorCode(utils.ErrCodeClientBusy, fmt.Errorf("client %s is busy, it is at its connect rate limit", c.ID))
+	}
 
-	// Create pipe to connect client and proxy
-	pipe1, pipe2 := net.Pipe()
+	// Forward the time the proxy user still waits, so the client abandons the target dial with it
+	var dialTimeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		if dialTimeout = time.Until(deadline); dialTimeout <= 0 {
+			return nil, nil, context.DeadlineExceeded
+		}
+	}
+
+	logger.Debug("Creating new network connection", "client_id", c.ID, "conn_id", connID, "network", network, "address", addr, "dial_timeout", dialTimeout)
+
+	// Create pipe to connect client and proxy, half-closing it is forwarded to the client
+	pipe1, pipe2 := connection.Pipe()
 
 	// Create proxy connection
 	proxyConn := &Conn{
 		ID:        connID,
 		Done:      make(chan struct{}),
 		LocalConn: pipe2,
+		Address:   addr,
+		StartTime: time.Now(),
+		connected: connected,
 	}
+	proxyConn.touch()
 
 	// Register connection
 	c.connMu.Lock()
 	c.Conns[connID] = proxyConn
 	connCount := len(c.Conns)
 	c.connMu.Unlock()
+	c.resume()
 
 	// 🆕 Update connection metrics when connection is established
 	// Register connection with monitoring
@@ -163,16 +260,18 @@ func (c *ClientConn) dialNetwork(ctx context.Context, network, addr string) (net
 
 	// 🆕 Send connection request to client (adapted to transport layer)
 	// Send connection message using binary format
-	err := c.writeConnectMessage(connID, network, addr)
+	priority := commonctx.GetPriority(ctx)
+	err := c.writeConnectMessage(connID, network, addr, dialTimeout, priority, reuseScope(ctx))
 	if err != nil {
 		logger.Error("Failed to send connect message to client", "client_id", c.ID, "conn_id", connID, "err", err)
 		c.closeConnection(connID)
-		return nil, err
+		return nil, nil, err
 	}
 
 	logger.Debug("Connect message sent to client", "client_id", c.ID, "conn_id", connID, "network", network, "address", addr)
 
 	// Start connection handling
+	c.egress.Register(connID, addr, qos.Priority(priority))
 	c.wg.Add(1)
 	go func() {
 		defer c.wg.Done()
@@ -182,7 +281,18 @@ func (c *ClientConn) dialNetwork(ctx context.Context, network, addr string) (net
 	// Return wrapped connection with important address information wrapping
 	connWrapper := connection.NewConnWrapper(pipe1, network, addr)
 	connWrapper.SetConnID(connID)
-	return connWrapper, nil
+	return connWrapper, proxyConn, nil
+}
+
+// reuseScope returns the token under which the client may pool the target connection for later
+// sessions of the same proxy user, empty when the user is unknown. Clients only see a hash.
+func reuseScope(ctx context.Context) string {
+	userCtx, ok := commonctx.GetUserContext(ctx)
+	if !ok || userCtx.GroupID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(userCtx.GroupID + "\x00" + userCtx.Username))
+	return hex.EncodeToString(sum[:16])
 }
 
 // handleMessage handles messages from client
@@ -200,6 +310,10 @@ func (c *ClientConn) handleMessage() {
 
 		// 🆕 Read message (using binary format)
 		msg, err := c.readNextMessage()
+		if protocol.IsProtocolViolation(err) {
+			logger.Warn("Closing client connection after protocol violation", "client_id", c.ID, "group_id", c.GroupID, "messages_processed", messageCount, "err", err)
+			return
+		}
 		if err != nil {
 			logger.Error("Transport read error", "client_id", c.ID, "messages_processed", messageCount, "err", err)
 			return
@@ -220,13 +334,31 @@ func (c *ClientConn) handleMessage() {
 		}
 
 		switch msgType {
-		case protocol.MsgTypeConnectResponse, protocol.MsgTypeData, protocol.MsgTypeClose:
+		case protocol.MsgTypeConnectResponse, protocol.MsgTypeData, protocol.MsgTypeClose, protocol.MsgTypeCloseWrite:
 			// Route all messages to per-connection channels
 			c.routeMessage(msg)
 		case protocol.MsgTypePortForwardReq:
 			// Handle port forwarding request directly
 			logger.Info("Received port forwarding request", "client_id", c.ID)
 			c.handlePortForwardRequest(msg)
+		case protocol.MsgTypeHeartbeat:
+			c.handleHeartbeat(msg)
+		case protocol.MsgTypeReport:
+			c.handleReport(msg)
+		case protocol.MsgTypeCapabilities:
+			c.handleCapabilities(msg)
+		case protocol.MsgTypeDraining:
+			c.draining.Store(true)
+			monitoring.SetClientDraining(c.ID)
+			timeout, _ := msg["timeout"].(time.Duration)
+			logger.Info("Client is draining, no new connections are routed to it", "client_id", c.ID, "group_id", c.GroupID, "timeout", timeout)
+		case protocol.MsgTypePeerConnect:
+			// Dialing takes a while, don't block other connections
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				c.handlePeerConnect(msg)
+			}()
 		default:
 			logger.Warn("Unknown message type received", "client_id", c.ID, "message_type", msgType, "message_count", messageCount)
 		}
@@ -245,6 +377,13 @@ func (c *ClientConn) routeMessage(msg map[string]interface{}) {
 
 	msgType, _ := msg["type"].(string)
 
+	// IP packets of TUN mode share data messages under a reserved connection ID
+	if msgType == protocol.MsgTypeData && connID == protocol.PacketConnID {
+		data, _ := msg["data"].([]byte)
+		c.packets.receive(c, data)
+		return
+	}
+
 	// For connect_response messages, create channel first if needed
 	if msgType == "connect_response" {
 		logger.Debug("Creating message channel for connect response", "client_id", c.ID, "conn_id", connID)
@@ -322,6 +461,8 @@ func (c *ClientConn) processConnectionMessages(_ string, msgChan chan map[string
 				c.handleConnectResponseMessage(msg)
 			case protocol.MsgTypeData:
 				c.handleDataMessage(msg)
+			case protocol.MsgTypeCloseWrite:
+				c.handleCloseWriteMessage(msg)
 			case protocol.MsgTypeClose:
 				c.handleCloseMessage(msg)
 				return // Connection closed, stop processing
@@ -372,6 +513,7 @@ func (c *ClientConn) handleDataMessage(msg map[string]interface{}) {
 		// Do NOT update metrics for non-existent connections to avoid phantom data
 		return
 	}
+	proxyConn.touch()
 
 	// Write data to local connection with context awareness
 	deadline := time.Now().Add(protocol.DefaultWriteTimeout)
@@ -386,12 +528,20 @@ func (c *ClientConn) handleDataMessage(msg map[string]interface{}) {
 	if err != nil {
 		logger.Error("Failed to write data to local connection", "client_id", c.ID, "conn_id", connID, "data_bytes", len(data), "written_bytes", n, "err", err)
 		// Do NOT update metrics for failed writes to avoid double counting
+		// The reader may have stopped after a half-close, so the client is told here
+		if proxyConn.halfClose.HalfClosed() {
+			c.closeFully(connID)
+			return
+		}
 		c.closeConnection(connID)
 		return
 	}
 
 	// ONLY update metrics on successful write - this is the single source of truth
 	monitoring.UpdateConnectionBytes(connID, c.ID, 0, int64(n))
+	if n > 0 && atomic.CompareAndSwapInt32(&proxyConn.firstByte, 0, 1) {
+		monitoring.RecordTimeToFirstByte(c.ID, proxyConn.Address, time.Since(proxyConn.StartTime))
+	}
 
 	// Only log larger transfers
 	if n > 10000 {
@@ -412,6 +562,68 @@ func (c *ClientConn) handleCloseMessage(msg map[string]interface{}) {
 	c.closeConnection(connID)
 }
 
+// handleCloseWriteMessage handles a half-close from the client: the target finished sending,
+// which the proxy user reads as EOF while it can still send to the target
+func (c *ClientConn) handleCloseWriteMessage(msg map[string]interface{}) {
+	connID, ok := msg["id"].(string)
+	if !ok {
+		logger.Error("Invalid connection ID in close_write message", "client_id", c.ID, "message_fields", utils.GetMessageFields(msg))
+		return
+	}
+
+	c.connMu.RLock()
+	proxyConn, exists := c.Conns[connID]
+	c.connMu.RUnlock()
+	if !exists {
+		return
+	}
+
+	if c.closeGrace <= 0 {
+		logger.Debug("Half-close disabled, closing connection", "client_id", c.ID, "conn_id", connID)
+		c.closeFully(connID)
+		return
+	}
+	if err := connection.CloseWrite(proxyConn.LocalConn); err != nil {
+		logger.Debug("Failed to half-close local connection, closing it", "client_id", c.ID, "conn_id", connID, "err", err)
+		c.closeFully(connID)
+		return
+	}
+
+	logger.Debug("Target finished sending, half-closed local connection", "client_id", c.ID, "conn_id", connID)
+	if proxyConn.halfClose.CloseRemote(c.closeGrace, func() { c.expireHalfClose(connID) }) {
+		c.closeConnection(connID)
+	}
+}
+
+// halfCloseConnection forwards EOF of the proxy user to the client, the target can still answer
+// until it closes too or the grace period ends
+func (c *ClientConn) halfCloseConnection(proxyConn *Conn) {
+	if err := c.writeCloseWriteMessage(proxyConn.ID); err != nil {
+		logger.Warn("Error sending close_write message to client", "client_id", c.ID, "conn_id", proxyConn.ID, "error", err)
+		c.closeConnection(proxyConn.ID)
+		return
+	}
+
+	logger.Debug("Proxy user finished sending, sent close_write to client", "client_id", c.ID, "conn_id", proxyConn.ID)
+	if proxyConn.halfClose.CloseLocal(c.closeGrace, func() { c.expireHalfClose(proxyConn.ID) }) {
+		c.closeConnection(proxyConn.ID)
+	}
+}
+
+// expireHalfClose closes a connection that stayed half-closed longer than the grace period
+func (c *ClientConn) expireHalfClose(connID string) {
+	logger.Debug("Half-closed connection exceeded the close grace period", "client_id", c.ID, "conn_id", connID, "grace_period", c.closeGrace)
+	c.closeFully(connID)
+}
+
+// closeFully tells the client to close the connection and closes it
+func (c *ClientConn) closeFully(connID string) {
+	if err := c.writeCloseMessage(connID); err != nil {
+		logger.Debug("Failed to send close message to client", "client_id", c.ID, "conn_id", connID, "err", err)
+	}
+	c.closeConnection(connID)
+}
+
 // closeConnection closes connection and cleans up resources
 func (c *ClientConn) closeConnection(connID string) {
 	// Fix: Use single lock to atomically operate on both maps, avoiding race conditions
@@ -436,7 +648,9 @@ func (c *ClientConn) closeConnection(connID string) {
 	}
 
 	// Close connection in monitoring
+	c.markUsed()
 	monitoring.CloseConnection(connID)
+	proxyConn.halfClose.Stop()
 
 	// Signal connection to stop (non-blocking, idempotent)
 	select {
@@ -464,6 +678,7 @@ func (c *ClientConn) closeConnectionUnsafe(connID string) {
 	}
 
 	delete(c.Conns, connID)
+	proxyConn.halfClose.Stop()
 
 	// Signal connection to stop
 	select {
@@ -495,18 +710,45 @@ func (c *ClientConn) handleConnectResponseMessage(msg map[string]interface{}) {
 		return
 	}
 
+	c.connMu.RLock()
+	proxyConn, exists := c.Conns[connID]
+	c.connMu.RUnlock()
+
 	if success {
 		logger.Debug("Client successfully connected to target", "client_id", c.ID, "conn_id", connID)
+		if exists {
+			monitoring.RecordDialLatency(c.ID, proxyConn.Address, time.Since(proxyConn.StartTime))
+			proxyConn.reportConnect(nil)
+		}
 	} else {
 		errorMsg, _ := msg["error"].(string)
+		// Clients that predate error codes only send the error text
+		errorCode, _ := msg["error_code"].(string)
+		code := utils.ErrorCode(errorCode)
+		if code == "" {
+			code = utils.ErrorCodeFromMessage(errorMsg)
+		}
+		if code == utils.ErrCodeClientBusy {
+			retryAfter, _ := msg["retry_after"].(time.Duration)
+			c.holdOff(retryAfter)
+		}
+		if exists {
+			monitoring.FailConnection(connID, c.ID, proxyConn.Address, errorMsg)
+			proxyConn.reportConnect(utils.WithErrorCode(code, fmt.Errorf("client %s failed to connect to %s: %w", c.ID, proxyConn.Address, &utils.TargetError{Msg: errorMsg})))
+		}
 
 		// Use different log levels and formats based on error type
-		if strings.Contains(strings.ToLower(errorMsg), "forbidden") || strings.Contains(strings.ToLower(errorMsg), "denied") {
-			logger.Error("Connection blocked by client security policy", "client_id", c.ID, "conn_id", connID, "error", errorMsg, "action", "Connection rejected by client due to security policy")
-		} else if strings.Contains(strings.ToLower(errorMsg), "timeout") {
-			logger.Warn("Connection timeout", "client_id", c.ID, "conn_id", connID, "error", errorMsg, "action", "Connection timed out")
-		} else {
-			logger.Error("Connection failed", "client_id", c.ID, "conn_id", connID, "error", errorMsg, "action", "Client failed to establish connection")
+		switch code {
+		case utils.ErrCodeTargetForbidden:
+			logger.Error("Connection blocked by client security policy", "client_id", c.ID, "conn_id", connID, "error", errorMsg, "error_code", code, "action", "Connection rejected by client due to security policy")
+		case utils.ErrCodeDialTimeout:
+			logger.Warn("Connection timeout", "client_id", c.ID, "conn_id", connID, "error", errorMsg, "error_code", code, "action", "Connection timed out")
+		case utils.ErrCodeClientOverloaded:
+			logger.Warn("Client at connection limit", "client_id", c.ID, "conn_id", connID, "error", errorMsg, "error_code", code, "action", "Client rejected the connection")
+		case utils.ErrCodeClientBusy:
+			logger.Warn("Client at connect rate limit", "client_id", c.ID, "conn_id", connID, "error", errorMsg, "error_code", code, "action", "No connect requests routed to the client until it accepts them again")
+		default:
+			logger.Error("Connection failed", "client_id", c.ID, "conn_id", connID, "error", errorMsg, "error_code", code, "action", "Client failed to establish connection")
 		}
 
 		c.closeConnection(connID)
@@ -527,6 +769,7 @@ func (c *ClientConn) handleConnection(proxyConn *Conn) {
 		elapsed := time.Since(startTime)
 		logger.Debug("Connection handler finished", "client_id", c.ID, "conn_id", proxyConn.ID, "total_bytes", totalBytes, "read_operations", readCount, "duration", elapsed)
 	}()
+	defer c.egress.Unregister(proxyConn.ID)
 
 	for {
 		select {
@@ -552,12 +795,20 @@ func (c *ClientConn) handleConnection(proxyConn *Conn) {
 		readCount++
 
 		if n > 0 {
+			proxyConn.touch()
 			totalBytes += n
 			// Only log larger transfers to reduce noise
 			if totalBytes%100000 == 0 || n > 10000 {
 				logger.Debug("Gateway read data from local connection", "client_id", c.ID, "conn_id", proxyConn.ID, "bytes_this_read", n, "total_bytes", totalBytes, "read_count", readCount)
 			}
 
+			// Wait for this connection's share of the egress bandwidth
+			if err := c.egress.Wait(c.ctx, proxyConn.ID, n); err != nil {
+				logger.Debug("Connection handler stopping while waiting for egress bandwidth", "client_id", c.ID, "conn_id", proxyConn.ID, "err", err)
+				c.closeConnection(proxyConn.ID)
+				return
+			}
+
 			// 🆕 Optimization: Use binary format to avoid base64 encoding
 			writeErr := c.writeDataMessage(proxyConn.ID, buffer[:n])
 			if writeErr != nil {
@@ -591,14 +842,17 @@ func (c *ClientConn) handleConnection(proxyConn *Conn) {
 			}
 
 			// Gracefully handle connection close errors
-			if strings.Contains(err.Error(), "use of closed network connection") ||
-				strings.Contains(err.Error(), "read/write on closed pipe") ||
-				strings.Contains(err.Error(), "connection reset by peer") {
+			if utils.IsClosedConn(err) {
 				logger.Debug("Local connection closed during read operation", "client_id", c.ID, "conn_id", proxyConn.ID, "total_bytes", totalBytes, "read_count", readCount)
-			} else if err != io.EOF {
+			} else if !errors.Is(err, io.EOF) {
 				logger.Error("Error reading from local connection", "client_id", c.ID, "conn_id", proxyConn.ID, "total_bytes", totalBytes, "read_count", readCount, "error", err)
 			} else {
 				logger.Debug("Local connection closed (EOF)", "client_id", c.ID, "conn_id", proxyConn.ID, "total_bytes", totalBytes, "read_count", readCount)
+				// The proxy user only closed its write side, keep delivering the target's answer
+				if c.closeGrace > 0 && connection.PeerClosedWrite(proxyConn.LocalConn) {
+					c.halfCloseConnection(proxyConn)
+					return
+				}
 			}
 
 			// 🆕 Send close message to client
@@ -615,8 +869,71 @@ func (c *ClientConn) handleConnection(proxyConn *Conn) {
 	}
 }
 
+// handleHeartbeat stores the telemetry reported by the client
+func (c *ClientConn) handleHeartbeat(msg map[string]interface{}) {
+	data, ok := msg["telemetry"].([]byte)
+	if !ok {
+		logger.Error("Invalid heartbeat message - missing telemetry", "client_id", c.ID)
+		return
+	}
+
+	var telemetry monitoring.ClientTelemetry
+	if err := json.Unmarshal(data, &telemetry); err != nil {
+		logger.Warn("Failed to decode client telemetry", "client_id", c.ID, "err", err)
+		return
+	}
+	telemetry.ReportedAt = time.Now()
+	if telemetry.LoadScore != nil {
+		score := *telemetry.LoadScore
+		c.loadScore.Store(&score)
+	}
+
+	logger.Debug("Received client heartbeat", "client_id", c.ID, "version", telemetry.Version, "cpu_percent", telemetry.CPUPercent, "load1", telemetry.Load1)
+	monitoring.UpdateClientTelemetry(c.ID, c.GroupID, &telemetry)
+}
+
+// handleReport records activity the client spooled while it was disconnected. Connection
+// records are logged as the audit trail of the outage.
+func (c *ClientConn) handleReport(msg map[string]interface{}) {
+	data, ok := msg["report"].([]byte)
+	if !ok {
+		logger.Error("Invalid report message - missing report", "client_id", c.ID)
+		return
+	}
+
+	var report monitoring.ClientReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		logger.Warn("Failed to decode client report", "client_id", c.ID, "err", err)
+		return
+	}
+
+	for _, record := range report.Records {
+		logger.Info("Client connection ended during outage", "client_id", c.ID, "group_id", c.GroupID, "recorded_by", report.ClientID, "conn_id", record.ConnectionID, "target_host", record.TargetHost, "start_time", record.StartTime, "end_time", record.EndTime, "bytes_sent", record.BytesSent, "bytes_received", record.BytesReceived, "reason", record.Reason)
+	}
+	if report.Delta != nil {
+		logger.Info("Client activity during outage", "client_id", c.ID, "group_id", c.GroupID, "recorded_by", report.ClientID, "from", report.From, "to", report.To, "connections", report.Delta.Connections, "bytes_sent", report.Delta.BytesSent, "bytes_received", report.Delta.BytesReceived, "errors", report.Delta.Errors)
+	}
+	monitoring.AddClientReport(c.ID, c.GroupID, &report)
+}
+
+// Draining reports whether the client announced its shutdown
+func (c *ClientConn) Draining() bool {
+	return c.draining.Load()
+}
+
+// available reports whether new connections may be routed to the client
+func (c *ClientConn) available() bool {
+	return !c.draining.Load() && !c.policyPending.Load()
+}
+
 // handlePortForwardRequest handles port forwarding requests
 func (c *ClientConn) handlePortForwardRequest(msg map[string]interface{}) {
+	if err := c.verifyControl(msg); err != nil {
+		logger.Warn("Rejected port forward request", "client_id", c.ID, "group_id", c.GroupID, "err", err)
+		c.sendPortForwardResponse(false, err.Error())
+		return
+	}
+
 	// Extract open ports from the message
 	openPortsInterface, ok := msg["open_ports"]
 	if !ok {
@@ -678,31 +995,63 @@ func (c *ClientConn) handlePortForwardRequest(msg map[string]interface{}) {
 		}
 
 		openPorts = append(openPorts, config.OpenPort{
-			RemotePort: remotePort,
-			LocalPort:  localPort,
-			LocalHost:  localHost,
-			Protocol:   protocol,
+			RemotePort:     remotePort,
+			LocalPort:      localPort,
+			LocalHost:      localHost,
+			Protocol:       protocol,
+			AllowedSources: stringSlice(portMap["allowed_sources"]),
 		})
 	}
 
-	if len(openPorts) == 0 {
-		logger.Info("No valid ports to open", "client_id", c.ID)
-		c.sendPortForwardResponse(true, "No ports to open")
-		return
+	for _, port := range openPorts {
+		// A port whose restriction can't be applied stays closed rather than open to everyone
+		if err := config.ValidatePortSources(port); err != nil {
+			logger.Warn("Rejected port forward request", "client_id", c.ID, "group_id", c.GroupID, "err", err)
+			c.sendPortForwardResponse(false, err.Error())
+			return
+		}
+		if !c.supports(port.Protocol) {
+			err := fmt.Errorf("client %s does not support %s, cannot open %s port %d", c.ID, port.Protocol, port.Protocol, port.RemotePort)
+			logger.Warn("Rejected port forward request", "client_id", c.ID, "group_id", c.GroupID, "err", err)
+			c.sendPortForwardResponse(false, err.Error())
+			return
+		}
 	}
 
-	// Attempt to open the ports
-	err := c.portForwardMgr.OpenPorts(c, openPorts)
+	// The request is the client's complete port set, a reloaded config may have dropped ports
+	err := c.portForwardMgr.ReplaceClientPorts(c, openPorts)
 	if err != nil {
 		logger.Error("Failed to open ports", "client_id", c.ID, "err", err)
 		c.sendPortForwardResponse(false, err.Error())
 		return
 	}
+	if len(openPorts) == 0 {
+		logger.Info("No valid ports to open", "client_id", c.ID)
+		c.sendPortForwardResponse(true, "No ports to open")
+		return
+	}
 
 	logger.Info("Successfully opened ports", "client_id", c.ID, "port_count", len(openPorts))
 	c.sendPortForwardResponse(true, "Ports opened successfully")
 }
 
+// stringSlice converts a decoded message list to strings, dropping entries of other types
+func stringSlice(v interface{}) []string {
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []interface{}:
+		values := make([]string, 0, len(list))
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
 // sendPortForwardResponse sends port forwarding response (adapted to transport layer)
 func (c *ClientConn) sendPortForwardResponse(success bool, message string) {
 	// Send response using binary format
@@ -6,12 +6,16 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
 	"github.com/buhuipao/anyproxy/pkg/common/message"
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
 )
 
 // mockNetConn implements net.Conn for testing
@@ -793,6 +797,10 @@ func (m *mockConnectionExt) GetPassword() string {
 	return "test-password" // Default test password
 }
 
+func (m *mockConnectionExt) GetClientVersion() string {
+	return ""
+}
+
 func (m *mockConnectionExt) SetDeadline(t time.Time) error {
 	return nil
 }
@@ -804,3 +812,103 @@ func (m *mockConnectionExt) SetReadDeadline(t time.Time) error {
 func (m *mockConnectionExt) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+func TestClientConn_HalfClose(t *testing.T) {
+	client, mockConn := createTestClientConn()
+	defer client.Stop()
+	client.closeGrace = time.Minute
+
+	sent := make(chan []byte, 10)
+	mockConn.writeMessageFunc = func(data []byte) error {
+		sent <- data
+		return nil
+	}
+	nextMessage := func() (byte, []byte) {
+		t.Helper()
+		select {
+		case data := <-sent:
+			_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return msgType, payload
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout waiting for a message to the client")
+		}
+		return 0, nil
+	}
+
+	conn, err := client.dialNetwork(context.Background(), "tcp", "db.internal:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msgType, payload := nextMessage()
+	if msgType != protocol.BinaryMsgTypeConnect {
+		t.Fatalf("Expected a connect message, got 0x%02x", msgType)
+	}
+	connID, _, _, _ := protocol.UnpackConnectMessage(payload)
+
+	// The proxy user sends its request and shuts down its write side
+	go func() {
+		_, _ = conn.Write([]byte("query"))
+		_ = connection.CloseWrite(conn)
+	}()
+	if msgType, _ := nextMessage(); msgType != protocol.BinaryMsgTypeData {
+		t.Fatalf("Expected a data message, got 0x%02x", msgType)
+	}
+	msgType, payload = nextMessage()
+	if _, writeOnly, _ := protocol.UnpackCloseMessage(payload); msgType != protocol.BinaryMsgTypeClose || !writeOnly {
+		t.Fatalf("Expected a close_write message, got 0x%02x (write only: %v)", msgType, writeOnly)
+	}
+
+	// The target's answer still reaches the proxy user, followed by EOF
+	go func() {
+		client.handleDataMessage(map[string]interface{}{"type": protocol.MsgTypeData, "id": connID, "data": []byte("result")})
+		client.handleCloseWriteMessage(map[string]interface{}{"type": protocol.MsgTypeCloseWrite, "id": connID})
+	}()
+	answer, err := io.ReadAll(conn)
+	if err != nil || string(answer) != "result" {
+		t.Fatalf("Expected the answer and EOF, got %q, %v", answer, err)
+	}
+
+	// Both directions closed, the connection is released without a full close message
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		client.connMu.RLock()
+		_, exists := client.Conns[connID]
+		client.connMu.RUnlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the connection to be closed once both directions closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case data := <-sent:
+		t.Errorf("Unexpected message after both directions closed: %v", data)
+	default:
+	}
+}
+
+func TestReuseScope(t *testing.T) {
+	if scope := reuseScope(context.Background()); scope != "" {
+		t.Errorf("Expected no scope without a proxy user, got %q", scope)
+	}
+
+	scopeOf := func(groupID, username string) string {
+		return reuseScope(commonctx.WithUserContext(context.Background(), &utils.UserContext{GroupID: groupID, Username: username}))
+	}
+	alice := scopeOf("eng", "alice")
+	if alice == "" || alice != scopeOf("eng", "alice") {
+		t.Fatalf("Expected a stable scope for the same proxy user, got %q", alice)
+	}
+	if alice == scopeOf("eng", "bob") || alice == scopeOf("ops", "alice") || scopeOf("eng", "") == scopeOf("", "eng") {
+		t.Error("Expected other users and groups to get other scopes")
+	}
+	if strings.Contains(alice, "alice") {
+		t.Errorf("Expected the scope not to reveal the user, got %q", alice)
+	}
+}
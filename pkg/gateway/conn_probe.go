@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// touch records activity on the connection, idle connections are probed
+func (c *Conn) touch() {
+	c.active.Store(time.Now().UnixNano())
+}
+
+// idleSince returns when data last flowed through the connection
+func (c *Conn) idleSince() time.Time {
+	return time.Unix(0, c.active.Load())
+}
+
+// probeIdleConnections periodically probes connections without traffic, so the client closes
+// those whose target socket died or that it no longer knows instead of leaving zombies
+func (c *ClientConn) probeIdleConnections() {
+	// Check at a fraction of the interval so connections are probed soon after becoming idle
+	ticker := time.NewTicker(c.probeInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if c.hibernating.Load() {
+				// A hibernating client has no connections to probe until it resumes
+				ticker.Stop()
+				if !c.waitResume() {
+					return
+				}
+				ticker.Reset(c.probeInterval / 4)
+				continue
+			}
+			c.probeIdle(now)
+		}
+	}
+}
+
+// probeIdle sends a probe for every connection idle for the probe interval at now
+func (c *ClientConn) probeIdle(now time.Time) {
+	var idle []*Conn
+	c.connMu.RLock()
+	for _, proxyConn := range c.Conns {
+		if now.Sub(proxyConn.idleSince()) >= c.probeInterval {
+			idle = append(idle, proxyConn)
+		}
+	}
+	c.connMu.RUnlock()
+
+	for _, proxyConn := range idle {
+		// Probe again only after another idle interval
+		proxyConn.touch()
+		if err := c.writeProbeMessage(proxyConn.ID); err != nil {
+			logger.Warn("Failed to send idle connection probe", "client_id", c.ID, "conn_id", proxyConn.ID, "err", err)
+			return
+		}
+		logger.Debug("Probed idle connection", "client_id", c.ID, "conn_id", proxyConn.ID, "idle_interval", c.probeInterval)
+	}
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+)
+
+func TestClientConn_ProbeIdle(t *testing.T) {
+	client, mockConn := createTestClientConn()
+	defer client.Stop()
+	client.probeInterval = time.Minute
+
+	var probed []string
+	mockConn.writeMessageFunc = func(data []byte) error {
+		_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		connID, body, err := protocol.UnpackDataMessage(payload)
+		if msgType != protocol.BinaryMsgTypeData || err != nil || len(body) != 0 {
+			t.Fatalf("Expected an empty data message, got 0x%02x %q %v", msgType, body, err)
+		}
+		probed = append(probed, connID)
+		return nil
+	}
+
+	now := time.Now()
+	idle := &Conn{ID: "idle-conn", Done: make(chan struct{})}
+	idle.active.Store(now.Add(-2 * time.Minute).UnixNano())
+	busy := &Conn{ID: "busy-conn", Done: make(chan struct{})}
+	busy.active.Store(now.Add(-time.Second).UnixNano())
+	client.Conns[idle.ID] = idle
+	client.Conns[busy.ID] = busy
+
+	client.probeIdle(now)
+	if len(probed) != 1 || probed[0] != "idle-conn" {
+		t.Fatalf("Expected only the idle connection to be probed, got %v", probed)
+	}
+
+	// A probed connection waits another interval before the next probe
+	client.probeIdle(now.Add(time.Second))
+	if len(probed) != 1 {
+		t.Errorf("Expected no probe before another idle interval, got %v", probed)
+	}
+	// Stop closes the local connections these test connections don't have
+	delete(client.Conns, idle.ID)
+	delete(client.Conns, busy.ID)
+}
@@ -0,0 +1,231 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Tunnel diagnostics defaults and limits
+const (
+	defaultDiagPings = 10
+	maxDiagPings     = 100
+	defaultDiagBytes = 4 << 20
+	diagPingSize     = 64
+	diagPingTimeout  = 5 * time.Second
+	diagDialTimeout  = 10 * time.Second
+	diagTestTimeout  = 2 * time.Minute // Bounds each throughput test and the MTU discovery
+)
+
+// DiagnosticsRequest selects the client whose tunnel is measured
+type DiagnosticsRequest struct {
+	ClientID string `json:"client_id"`
+	Pings    int    `json:"pings,omitempty"` // Round trips measured (default 10, at most 100)
+	Bytes    int64  `json:"bytes,omitempty"` // Bytes sent each way by the throughput tests (default 4MB, at most 64MB)
+}
+
+// DiagnosticsResult is the outcome of the tunnel tests of a client. A failed test reports its
+// error and doesn't stop the others.
+type DiagnosticsResult struct {
+	ClientID string           `json:"client_id"`
+	GroupID  string           `json:"group_id"`
+	RTT      RTTResult        `json:"rtt"`
+	Upload   ThroughputResult `json:"upload"`   // Gateway to client
+	Download ThroughputResult `json:"download"` // Client to gateway
+	MTU      MTUDiagnostics   `json:"mtu"`
+	Duration float64          `json:"duration_seconds"`
+}
+
+// RTTResult are the round trips of small messages through the tunnel to the client and back
+type RTTResult struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	MinMs    float64 `json:"min_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	JitterMs float64 `json:"jitter_ms"` // Mean difference of consecutive round trips
+	Error    string  `json:"error,omitempty"`
+}
+
+// ThroughputResult is a bulk transfer through the tunnel
+type ThroughputResult struct {
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	BytesPerSecond int64   `json:"bytes_per_second"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// MTUDiagnostics is the path MTU the client discovered toward the gateway
+type MTUDiagnostics = protocol.DiagMTUResult
+
+// DiagnoseClient measures the tunnel of a client, without involving any target: round trips,
+// throughput in both directions and the path MTU from the client to the gateway. Each test
+// runs on its own connection to the client's diagnostics service.
+func (g *Gateway) DiagnoseClient(ctx context.Context, req DiagnosticsRequest) (*DiagnosticsResult, error) {
+	if req.Pings < 0 || req.Pings > maxDiagPings {
+		return nil, fmt.Errorf("pings must be between 0 and %d", maxDiagPings)
+	}
+	if req.Bytes < 0 || req.Bytes > protocol.MaxDiagBytes {
+		return nil, fmt.Errorf("bytes must be between 0 and %d", protocol.MaxDiagBytes)
+	}
+	if req.Pings == 0 {
+		req.Pings = defaultDiagPings
+	}
+	if req.Bytes == 0 {
+		req.Bytes = defaultDiagBytes
+	}
+
+	g.clientsMu.RLock()
+	client, exists := g.clients[req.ClientID]
+	g.clientsMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrClientNotFound, req.ClientID)
+	}
+
+	logger.Info("Running tunnel diagnostics", "client_id", client.ID, "group_id", client.GroupID, "pings", req.Pings, "bytes", req.Bytes)
+	start := time.Now()
+	result := &DiagnosticsResult{ClientID: client.ID, GroupID: client.GroupID}
+
+	// run opens a diagnostics connection for one test and starts it with command
+	run := func(timeout time.Duration, command string, test func(net.Conn, *bufio.Reader) error) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := client.dialNetworkConfirmed(ctx, protocol.ProtocolTCP, protocol.DiagServiceAddress, diagDialTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to open diagnostics connection: %w", err)
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		if _, err := io.WriteString(conn, command+"\n"); err != nil {
+			return err
+		}
+		return test(conn, bufio.NewReader(conn))
+	}
+
+	result.RTT.Sent = req.Pings
+	if err := run(time.Duration(req.Pings)*diagPingTimeout, protocol.DiagCommandEcho, func(conn net.Conn, r *bufio.Reader) error {
+		return measureRTT(conn, r, &result.RTT)
+	}); err != nil {
+		result.RTT.Error = err.Error()
+	}
+
+	result.Upload.Bytes = req.Bytes
+	if err := run(diagTestTimeout, fmt.Sprintf("%s %d", protocol.DiagCommandDiscard, req.Bytes), func(conn net.Conn, r *bufio.Reader) error {
+		begin := time.Now()
+		if _, err := io.CopyN(conn, zeroReader{}, req.Bytes); err != nil {
+			return err
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("client did not confirm the upload: %w", err)
+		}
+		if received, _ := strconv.ParseInt(strings.TrimSpace(line), 10, 64); received != req.Bytes {
+			return fmt.Errorf("client received %s of %d bytes", strings.TrimSpace(line), req.Bytes)
+		}
+		result.Upload.measured(time.Since(begin))
+		return nil
+	}); err != nil {
+		result.Upload.Error = err.Error()
+	}
+
+	result.Download.Bytes = req.Bytes
+	if err := run(diagTestTimeout, fmt.Sprintf("%s %d", protocol.DiagCommandSource, req.Bytes), func(_ net.Conn, r *bufio.Reader) error {
+		begin := time.Now()
+		if _, err := io.CopyN(io.Discard, r, req.Bytes); err != nil {
+			return err
+		}
+		result.Download.measured(time.Since(begin))
+		return nil
+	}); err != nil {
+		result.Download.Error = err.Error()
+	}
+
+	if err := run(diagTestTimeout, protocol.DiagCommandMTU, func(_ net.Conn, r *bufio.Reader) error {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(line, &result.MTU)
+	}); err != nil {
+		result.MTU.Error = err.Error()
+	}
+
+	result.Duration = time.Since(start).Seconds()
+	logger.Info("Tunnel diagnostics finished", "client_id", client.ID, "rtt_avg_ms", result.RTT.AvgMs, "upload_bps", result.Upload.BytesPerSecond, "download_bps", result.Download.BytesPerSecond, "path_mtu", result.MTU.PathMTU)
+	return result, nil
+}
+
+// measureRTT sends numbered pings through an echo connection one after another. A lost ping
+// ends the test, a late echo would be mistaken for the next one.
+func measureRTT(conn net.Conn, r *bufio.Reader, result *RTTResult) error {
+	ping, echo := make([]byte, diagPingSize), make([]byte, diagPingSize)
+	var samples []float64
+	defer func() { result.summarize(samples) }()
+	for i := 0; i < result.Sent; i++ {
+		binary.BigEndian.PutUint64(ping, uint64(i))
+		_ = conn.SetDeadline(time.Now().Add(diagPingTimeout))
+		begin := time.Now()
+		if _, err := conn.Write(ping); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, echo); err != nil {
+			return fmt.Errorf("ping %d: %w", i, err)
+		}
+		if !bytes.Equal(ping, echo) {
+			return fmt.Errorf("ping %d: corrupted echo", i)
+		}
+		samples = append(samples, float64(time.Since(begin).Microseconds())/1000)
+	}
+	return nil
+}
+
+// summarize computes the statistics of the round trips in milliseconds
+func (r *RTTResult) summarize(samples []float64) {
+	r.Received = len(samples)
+	if len(samples) == 0 {
+		return
+	}
+	r.MinMs = math.Inf(1)
+	var sum, jitter float64
+	for i, sample := range samples {
+		sum += sample
+		r.MinMs, r.MaxMs = math.Min(r.MinMs, sample), math.Max(r.MaxMs, sample)
+		if i > 0 {
+			jitter += math.Abs(sample - samples[i-1])
+		}
+	}
+	r.AvgMs = sum / float64(len(samples))
+	if len(samples) > 1 {
+		r.JitterMs = jitter / float64(len(samples)-1)
+	}
+}
+
+// measured records the duration of a completed transfer
+func (t *ThroughputResult) measured(d time.Duration) {
+	t.Seconds = d.Seconds()
+	if d > 0 {
+		t.BytesPerSecond = int64(float64(t.Bytes) / d.Seconds())
+	}
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,114 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+)
+
+// serveFakeDiagnostics answers diagnostics commands like the client's service
+func serveFakeDiagnostics(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	command, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	n, _ := strconv.ParseInt(arg, 10, 64)
+	switch command {
+	case protocol.DiagCommandEcho:
+		_, _ = io.Copy(conn, r)
+	case protocol.DiagCommandDiscard:
+		read, _ := io.CopyN(io.Discard, r, n)
+		fmt.Fprintf(conn, "%d\n", read)
+	case protocol.DiagCommandSource:
+		_, _ = io.CopyN(conn, zeroReader{}, n)
+	case protocol.DiagCommandMTU:
+		fmt.Fprintln(conn, `{"path_mtu":1420,"target":"gateway.example.com"}`)
+	}
+}
+
+// newDiagClient returns a test client whose connections are served by serveFakeDiagnostics
+func newDiagClient(id string) *ClientConn {
+	client, mockConn := createTestClientConn()
+	client.ID = id
+	var services sync.Map
+	mockConn.writeMessageFunc = func(data []byte) error {
+		_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+		if err != nil {
+			return nil
+		}
+		switch msgType {
+		case protocol.BinaryMsgTypeConnect:
+			connID, _, _, err := protocol.UnpackConnectMessage(payload)
+			if err != nil {
+				return nil
+			}
+			tunnel, service := net.Pipe()
+			services.Store(connID, tunnel)
+			go serveFakeDiagnostics(service)
+			go func() {
+				buf := make([]byte, 32*1024)
+				for {
+					n, err := tunnel.Read(buf)
+					if err != nil {
+						return
+					}
+					client.handleDataMessage(map[string]interface{}{"type": protocol.MsgTypeData, "id": connID, "data": append([]byte(nil), buf[:n]...)})
+				}
+			}()
+			go client.handleConnectResponseMessage(map[string]interface{}{"type": protocol.MsgTypeConnectResponse, "id": connID, "success": true})
+		case protocol.BinaryMsgTypeData:
+			connID, chunk, err := protocol.UnpackDataMessage(payload)
+			if tunnel, ok := services.Load(connID); ok && err == nil {
+				_, _ = tunnel.(net.Conn).Write(chunk)
+			}
+		case protocol.BinaryMsgTypeClose:
+			connID, _, err := protocol.UnpackCloseMessage(payload)
+			if tunnel, ok := services.Load(connID); ok && err == nil {
+				_ = tunnel.(net.Conn).Close()
+			}
+		}
+		return nil
+	}
+	return client
+}
+
+func TestGateway_DiagnoseClient(t *testing.T) {
+	client := newDiagClient("client-diag")
+	defer client.Stop()
+	gw := &Gateway{clients: map[string]*ClientConn{client.ID: client}}
+
+	result, err := gw.DiagnoseClient(context.Background(), DiagnosticsRequest{ClientID: client.ID, Pings: 5, Bytes: 256 * 1024})
+	if err != nil {
+		t.Fatalf("DiagnoseClient() error = %v", err)
+	}
+	if result.RTT.Error != "" || result.RTT.Received != 5 || result.RTT.MinMs > result.RTT.AvgMs || result.RTT.AvgMs > result.RTT.MaxMs {
+		t.Errorf("RTT = %+v, want 5 round trips", result.RTT)
+	}
+	for name, transfer := range map[string]ThroughputResult{"upload": result.Upload, "download": result.Download} {
+		if transfer.Error != "" || transfer.Bytes != 256*1024 || transfer.BytesPerSecond <= 0 {
+			t.Errorf("%s = %+v, want a measured transfer", name, transfer)
+		}
+	}
+	if result.MTU.PathMTU != 1420 || result.MTU.Target != "gateway.example.com" {
+		t.Errorf("MTU = %+v, want the client's path MTU", result.MTU)
+	}
+
+	if _, err := gw.DiagnoseClient(context.Background(), DiagnosticsRequest{ClientID: "unknown"}); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("DiagnoseClient() of an unknown client error = %v, want ErrClientNotFound", err)
+	}
+	if _, err := gw.DiagnoseClient(context.Background(), DiagnosticsRequest{ClientID: client.ID, Bytes: protocol.MaxDiagBytes + 1}); err == nil {
+		t.Error("DiagnoseClient() beyond the byte limit should fail")
+	}
+}
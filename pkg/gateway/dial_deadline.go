@@ -0,0 +1,20 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// withDialTimeout bounds dials of a proxy listener. The deadline travels with the connect
+// message, so the client stops dialing the target once the proxy user has given up.
+func withDialTimeout(dialFn func(context.Context, string, string) (net.Conn, error), timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
+	if timeout <= 0 {
+		return dialFn
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dialFn(ctx, network, addr)
+	}
+}
@@ -0,0 +1,54 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+)
+
+func TestClientConn_DialForwardsDeadline(t *testing.T) {
+	client, mockConn := createTestClientConn()
+	defer client.Stop()
+	timeouts := make(chan time.Duration, 1)
+	mockConn.writeMessageFunc = func(data []byte) error {
+		_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+		if err == nil && msgType == protocol.BinaryMsgTypeConnect {
+			_, _, _, timeout, _ := protocol.UnpackConnectMessageWithTimeout(payload)
+			timeouts <- timeout
+		}
+		return nil
+	}
+
+	dialFn := withDialTimeout(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return client.dialNetwork(ctx, network, addr)
+	}, 3*time.Second)
+	conn, err := dialFn(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer conn.Close()
+	if timeout := <-timeouts; timeout <= 2*time.Second || timeout > 3*time.Second {
+		t.Errorf("Expected forwarded timeout close to 3s, got %v", timeout)
+	}
+
+	// Without a deadline no timeout is sent
+	conn2, err := client.dialNetwork(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	defer conn2.Close()
+	if timeout := <-timeouts; timeout != 0 {
+		t.Errorf("Expected no forwarded timeout, got %v", timeout)
+	}
+
+	// An expired deadline fails without asking the client
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := client.dialNetwork(ctx, "tcp", "example.com:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// dialRetryMargin is added to the client's own connect timeout when waiting for its response
+const dialRetryMargin = 5 * time.Second
+
+// dialClient dials through a client of the user's group. Groups with dial_retries or confirm_dial wait for the
+// client to reach the target and fall back to the next clients of the group when it cannot. Proxy users pinning
+// a client only fall back to its replicas, users with the nofallback option not at all.
+func (g *Gateway) dialClient(ctx context.Context, userCtx *utils.UserContext, network, addr string) (*ClientConn, net.Conn, error) {
+	client, err := g.selectClient(userCtx, network)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groupCfg := g.config.GetGroupConfig(userCtx.GroupID)
+	if groupCfg.DialRetries <= 0 && !groupCfg.ConfirmDial {
+		conn, err := client.dialNetwork(ctx, network, addr)
+		return client, conn, err
+	}
+
+	timeout := confirmTimeout(groupCfg)
+	backoff := groupCfg.DialBackoff
+	retries := groupCfg.DialRetries
+	if userCtx.NoFallback {
+		// The dial is still confirmed, so the proxy user gets the client's error
+		retries = 0
+	}
+	tried := map[string]bool{}
+	for attempt := 0; ; attempt++ {
+		tried[client.ID] = true
+		conn, err := client.dialNetworkConfirmed(ctx, network, addr, timeout)
+		if err == nil {
+			if attempt > 0 {
+				logger.Info("Dial succeeded through another client", "client_id", client.ID, "group_id", userCtx.GroupID, "address", addr, "attempt", attempt+1)
+				g.rebindSticky(userCtx, client.ID)
+			}
+			return client, conn, nil
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			return client, nil, err
+		}
+
+		next := g.nextGroupClient(userCtx.GroupID, userCtx.ClientID, network, tried)
+		if next == nil {
+			logger.Debug("No other client left to retry dial", "client_id", client.ID, "group_id", userCtx.GroupID, "address", addr, "attempt", attempt+1)
+			return client, nil, err
+		}
+		logger.Warn("Dial through client failed, retrying with next client", "client_id", client.ID, "next_client_id", next.ID, "group_id", userCtx.GroupID, "address", addr, "attempt", attempt+1, "err", err)
+
+		if backoff > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return client, nil, utils.WithErrorCode(utils.ErrorCodeOf(ctx.Err()), fmt.Errorf("dial retry cancelled: %v", ctx.Err()))
+			}
+			backoff *= 2
+		}
+		client = next
+	}
+}
+
+// confirmTimeout returns how long a confirmed dial through a client of the group waits for the
+// client to reach the target
+func confirmTimeout(groupCfg config.GroupConfig) time.Duration {
+	if groupCfg.DialTimeout > 0 {
+		return groupCfg.DialTimeout
+	}
+	return protocol.DefaultConnectTimeout + dialRetryMargin
+}
+
+// nextGroupClient returns the next client of the group in round-robin order that is not in tried,
+// matches the pinned client and can dial network
+func (g *Gateway) nextGroupClient(groupID, pinnedClient, network string, tried map[string]bool) *ClientConn {
+	g.clientsMu.Lock()
+	defer g.clientsMu.Unlock()
+
+	groupInfo, exists := g.groups[groupID]
+	if !exists || len(groupInfo.Clients) == 0 {
+		return nil
+	}
+	clients := groupInfo.Clients
+	for i := 0; i < len(clients); i++ {
+		idx := (groupInfo.Counter + i) % len(clients)
+		clientID := clients[idx]
+		if tried[clientID] || !pinnedClientMatches(clientID, pinnedClient) {
+			continue
+		}
+		if client, ok := g.clients[clientID]; ok && client.available() && client.supports(network) && !client.atCapacity() {
+			groupInfo.recordSelection(clientID, groupInfo.Counter, SelectionRetry)
+			groupInfo.Counter = (idx + 1) % len(clients)
+			return client
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// newRespondingClient returns a test client that answers every connect request with the given result
+func newRespondingClient(id string, success bool) *ClientConn {
+	client, mockConn := createTestClientConn()
+	client.ID = id
+	mockConn.writeMessageFunc = func(data []byte) error {
+		_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+		if err != nil || msgType != protocol.BinaryMsgTypeConnect {
+			return nil
+		}
+		connID, _, _, err := protocol.UnpackConnectMessage(payload)
+		if err != nil {
+			return nil
+		}
+		go client.handleConnectResponseMessage(map[string]interface{}{
+			"type":    protocol.MsgTypeConnectResponse,
+			"id":      connID,
+			"success": success,
+			"error":   "connection refused",
+		})
+		return nil
+	}
+	return client
+}
+
+func TestGateway_DialClientRetriesNextClient(t *testing.T) {
+	failing := newRespondingClient("client-a", false)
+	healthy := newRespondingClient("client-b", true)
+	defer failing.Stop()
+	defer healthy.Stop()
+
+	gw := &Gateway{
+		config: &config.GatewayConfig{Groups: map[string]config.GroupConfig{
+			"test-group": {DialRetries: 1, DialTimeout: 2 * time.Second, StickySession: config.StickySessionUser},
+		}},
+		clients: map[string]*ClientConn{failing.ID: failing, healthy.ID: healthy},
+		groups:  map[string]*GroupInfo{"test-group": {Clients: []string{failing.ID, healthy.ID}}},
+		sticky:  newStickyTable(),
+	}
+	userCtx := &utils.UserContext{Username: "alice", GroupID: "test-group"}
+
+	client, conn, err := gw.dialClient(context.Background(), userCtx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("dialClient() error = %v", err)
+	}
+	defer conn.Close()
+	if client.ID != healthy.ID {
+		t.Errorf("Expected dial through %s, got %s", healthy.ID, client.ID)
+	}
+	if clientID, _ := gw.sticky.lookup("test-group/user/alice", time.Now()); clientID != healthy.ID {
+		t.Errorf("Expected sticky binding to %s, got %q", healthy.ID, clientID)
+	}
+
+	// Proxy users opting out of the fallback only get the first client's failure
+	_, _, err = gw.dialClient(context.Background(), &utils.UserContext{GroupID: "test-group", NoFallback: true}, "tcp", "example.com:80")
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Expected connection refused error without fallback, got %v", err)
+	}
+
+	// With no other client left to try, the original failure is reported
+	gw.config.Groups["test-group"] = config.GroupConfig{DialRetries: 1, DialTimeout: 2 * time.Second}
+	gw.groups["test-group"] = &GroupInfo{Clients: []string{failing.ID}}
+	_, _, err = gw.dialClient(context.Background(), &utils.UserContext{GroupID: "test-group"}, "tcp", "example.com:80")
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Expected connection refused error, got %v", err)
+	}
+}
+
+func TestGateway_DialClientErrorCodes(t *testing.T) {
+	client, mockConn := createTestClientConn()
+	client.ID = "client-a"
+	defer client.Stop()
+
+	var response map[string]interface{}
+	mockConn.writeMessageFunc = func(data []byte) error {
+		_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+		if err != nil || msgType != protocol.BinaryMsgTypeConnect {
+			return nil
+		}
+		connID, _, _, err := protocol.UnpackConnectMessage(payload)
+		if err != nil {
+			return nil
+		}
+		msg := map[string]interface{}{"type": protocol.MsgTypeConnectResponse, "id": connID, "success": false}
+		for k, v := range response {
+			msg[k] = v
+		}
+		go client.handleConnectResponseMessage(msg)
+		return nil
+	}
+
+	gw := &Gateway{
+		config:  &config.GatewayConfig{Groups: map[string]config.GroupConfig{"test-group": {ConfirmDial: true}}},
+		clients: map[string]*ClientConn{client.ID: client},
+		groups:  map[string]*GroupInfo{"test-group": {Clients: []string{client.ID}}},
+	}
+	userCtx := &utils.UserContext{GroupID: "test-group"}
+
+	tests := []struct {
+		name     string
+		response map[string]interface{}
+		want     utils.ErrorCode
+	}{
+		{"client code", map[string]interface{}{"error": "client connection limit of 1 reached", "error_code": "client_overloaded"}, utils.ErrCodeClientOverloaded},
+		{"legacy forbidden", map[string]interface{}{"error": "Connection denied - host 'example.com:80' is forbidden"}, utils.ErrCodeTargetForbidden},
+		{"legacy failure", map[string]interface{}{"error": "connection refused", "error_code": ""}, utils.ErrCodeDialFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response = tt.response
+			_, _, err := gw.dialClient(context.Background(), userCtx, "tcp", "example.com:80")
+			if got := utils.ErrorCodeOf(err); got != tt.want {
+				t.Errorf("Expected error code %s, got %s (err: %v)", tt.want, got, err)
+			}
+		})
+	}
+
+	// A busy client gets no connect requests until its retry delay passed
+	response = map[string]interface{}{"error": "client connect rate limit of 5/s reached", "error_code": "client_busy", "retry_after": time.Minute}
+	if _, _, err := gw.dialClient(context.Background(), userCtx, "tcp", "example.com:80"); utils.ErrorCodeOf(err) != utils.ErrCodeClientBusy {
+		t.Fatalf("Expected client_busy, got %v", err)
+	}
+	response = map[string]interface{}{"error": "unexpected connect request"}
+	if _, _, err := gw.dialClient(context.Background(), userCtx, "tcp", "example.com:80"); utils.ErrorCodeOf(err) != utils.ErrCodeClientBusy {
+		t.Errorf("Expected the gateway to hold off the busy client, got %v", err)
+	}
+	client.busyUntil.Store(0)
+
+	gw.groups["test-group"] = &GroupInfo{}
+	if _, _, err := gw.dialClient(context.Background(), userCtx, "tcp", "example.com:80"); utils.ErrorCodeOf(err) != utils.ErrCodeNoClientAvailable {
+		t.Errorf("Expected no_client_available, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Results of a dry run step
+const (
+	DryRunPass     = "pass"
+	DryRunDeny     = "deny"
+	DryRunThrottle = "throttle" // Delayed, and rejected when still over the limit after the delay
+	DryRunReroute  = "reroute"  // Another group serves the dial
+	DryRunInfo     = "info"
+	DryRunSkipped  = "skipped" // Not decided by the gateway
+)
+
+// DryRunRequest describes a hypothetical dial of a proxy user
+type DryRunRequest struct {
+	Group    string `json:"group"`
+	Username string `json:"username,omitempty"`
+	Client   string `json:"client,omitempty"`    // Client pinned by the user
+	SourceIP string `json:"source_ip,omitempty"` // Address of the user, for source rules
+	Network  string `json:"network,omitempty"`   // tcp (default), udp or unix
+	Target   string `json:"target"`              // host:port
+}
+
+// DryRunStep is the outcome of one stage of the dial path
+type DryRunStep struct {
+	Stage  string `json:"stage"`
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// DryRunResult tells whether a dial would be allowed and which client would serve it
+type DryRunResult struct {
+	Allowed   bool         `json:"allowed"`
+	Group     string       `json:"group"` // Group serving the dial after reroutes
+	Target    string       `json:"target"`
+	ClientID  string       `json:"client_id,omitempty"`
+	ErrorCode string       `json:"error_code,omitempty"` // Code a proxy user would get
+	Error     string       `json:"error,omitempty"`
+	Steps     []DryRunStep `json:"steps"`
+}
+
+// step records the outcome of a stage
+func (r *DryRunResult) step(stage, result, detail string) {
+	r.Steps = append(r.Steps, DryRunStep{Stage: stage, Result: result, Detail: detail})
+}
+
+// deny records the stage that rejects the dial
+func (r *DryRunResult) deny(stage string, err error) *DryRunResult {
+	r.step(stage, DryRunDeny, err.Error())
+	r.ErrorCode = string(utils.ErrorCodeOf(err))
+	r.Error = err.Error()
+	return r
+}
+
+// DryRun evaluates the policies a dial passes, in the order of the dial path, without creating
+// a connection or counting it against quotas and rate limits. Sticky bindings and the
+// round-robin position are left as they are. Host patterns and policy packs are checked by
+// the client when it dials, and aren't evaluated.
+func (g *Gateway) DryRun(ctx context.Context, req DryRunRequest) (*DryRunResult, error) {
+	if req.Group == "" {
+		return nil, fmt.Errorf("group is required")
+	}
+	if _, _, err := net.SplitHostPort(req.Target); err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", req.Target, err)
+	}
+	network := req.Network
+	if network == "" {
+		network = protocol.ProtocolTCP
+	}
+
+	userCtx := &utils.UserContext{Username: req.Username, GroupID: req.Group, SourceIP: req.SourceIP, ClientID: req.Client}
+	addr := req.Target
+	result := &DryRunResult{Group: req.Group, Target: addr}
+	defer func() {
+		logger.Info("Dry run evaluated", "group_id", req.Group, "username", req.Username, "network", network, "address", req.Target, "allowed", result.Allowed, "client_id", result.ClientID, "error_code", result.ErrorCode)
+	}()
+
+	if g.sessions != nil {
+		limit := g.sessions.peek(userCtx)
+		switch {
+		case limit.Allowed:
+			result.step("rate_limit", DryRunPass, "")
+		case limit.Action == "throttle":
+			result.step("rate_limit", DryRunThrottle, fmt.Sprintf("%s rule: %s", limit.LimitType, limit.Reason))
+		case limit.Action == "log":
+			result.step("rate_limit", DryRunPass, fmt.Sprintf("%s rule exceeded, allowed by log action: %s", limit.LimitType, limit.Reason))
+		default:
+			return result.deny("rate_limit", fmt.Errorf("%w: %s %s", utils.ErrRateLimited, limit.LimitType, limit.Reason)), nil
+		}
+	}
+
+	if err := g.checkSchedule(userCtx); err != nil {
+		return result.deny("schedule", err), nil
+	}
+	result.step("schedule", DryRunPass, "")
+
+	if err := checkReservedTarget(addr); err != nil {
+		return result.deny("reserved_address", err), nil
+	}
+
+	if g.geo != nil {
+		routed, decision, err := g.applyGeoPolicy(ctx, userCtx, network, addr)
+		if err != nil {
+			return result.deny("geoip", err), nil
+		}
+		detail := fmt.Sprintf("source %s, target %s", countryOrUnknown(decision.SourceCountry), countryOrUnknown(decision.TargetCountry))
+		if routed.GroupID != userCtx.GroupID {
+			result.step("geoip", DryRunReroute, fmt.Sprintf("%s by rule %d (%s)", routed.GroupID, decision.Rule, detail))
+		} else {
+			result.step("geoip", DryRunPass, detail)
+		}
+		userCtx = routed
+	}
+	result.Group, result.Target = userCtx.GroupID, addr
+
+	if g.blocklists != nil {
+		if list, blocked := g.blocklists.check(userCtx.GroupID, addr); blocked {
+			return result.deny("blocklist", fmt.Errorf("%w: %s", utils.ErrBlocklisted, list)), nil
+		}
+		result.step("blocklist", DryRunPass, "")
+	}
+
+	if g.guard != nil {
+		if err := g.guard.peek(); err != nil {
+			return result.deny("resource_guard", err), nil
+		}
+		result.step("resource_guard", DryRunPass, "")
+	}
+	if err := g.peekGroupConnection(userCtx.GroupID); err != nil {
+		return result.deny("group_quota", err), nil
+	}
+	result.step("group_quota", DryRunPass, fmt.Sprintf("%d active connections", g.getGroupConnectionCount(userCtx.GroupID)))
+
+	client, err := g.peekClient(userCtx, network)
+	if err != nil {
+		return result.deny("client", err), nil
+	}
+	result.ClientID = client.ID
+	result.step("client", DryRunPass, fmt.Sprintf("%s (%s balancing, load score %.2f)", client.ID, balancingOf(g.config.GetGroupConfig(userCtx.GroupID).Balancing), client.LoadScore()))
+
+	if limit := g.transferLimit(userCtx); limit > 0 {
+		result.step("transfer_limit", DryRunInfo, fmt.Sprintf("closed after %d bytes", limit))
+	}
+	result.step("client_policy", DryRunSkipped, "host patterns and policy packs are checked by the client")
+	result.Allowed = true
+	return result, nil
+}
+
+// checkReservedTarget rejects targets addressing the client-side services of the admin API
+func checkReservedTarget(addr string) error {
+	if host, _, err := net.SplitHostPort(addr); err == nil && protocol.IsReservedServiceHost(host) {
+		return utils.WithErrorCode(utils.ErrCodeTargetForbidden, fmt.Errorf("connection refused: reserved address %s", addr))
+	}
+	return nil
+}
+
+// countryOrUnknown names a Geo-IP country for display
+func countryOrUnknown(country string) string {
+	if country == "" {
+		return unknownCountry
+	}
+	return country
+}
+
+// balancingOf names the balancing strategy of a group for display
+func balancingOf(balancing string) string {
+	if balancing == "" {
+		return config.BalancingRoundRobin
+	}
+	return balancing
+}
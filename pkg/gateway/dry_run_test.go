@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestGateway_DryRun(t *testing.T) {
+	clientA, _ := createTestClientConn()
+	clientA.ID = "client-a"
+	clientB, _ := createTestClientConn()
+	clientB.ID = "client-b"
+	defer clientA.Stop()
+	defer clientB.Stop()
+
+	rl := ratelimit.NewRateLimiter(nil)
+	_ = rl.UpdateConfig(&ratelimit.Config{Rules: []*ratelimit.Rule{
+		{ID: "alice", Type: "user", Identifier: "office/alice", Enabled: true, ConcurrentLimit: 1, Action: "block"},
+	}})
+	gw := &Gateway{
+		config: &config.GatewayConfig{Groups: map[string]config.GroupConfig{
+			"office": {MaxConnections: 1},
+		}},
+		clients:    map[string]*ClientConn{clientA.ID: clientA, clientB.ID: clientB},
+		groups:     map[string]*GroupInfo{"office": {Clients: []string{clientA.ID, clientB.ID}}},
+		groupConns: make(map[string]int),
+		sticky:     newStickyTable(),
+	}
+	gw.SetRateLimiter(rl)
+	req := DryRunRequest{Group: "office", Username: "alice", Target: "example.com:443"}
+
+	// Dry runs neither count against limits nor move the round-robin position
+	for i := 0; i < 3; i++ {
+		result, err := gw.DryRun(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.ClientID != clientA.ID {
+			t.Fatalf("Dry run %d = %+v, want allowed through %s", i, result, clientA.ID)
+		}
+	}
+	if gw.groups["office"].Counter != 0 || gw.getGroupConnectionCount("office") != 0 {
+		t.Error("Expected the dry runs to leave the group untouched")
+	}
+
+	// A full group is reported with the code a proxy user would get
+	gw.groupConns["office"] = 1
+	result, err := gw.DryRun(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := result.Steps[len(result.Steps)-1]
+	if result.Allowed || last.Stage != "group_quota" || last.Result != DryRunDeny || result.ErrorCode != string(utils.ErrorCodeOf(utils.ErrGroupConnectionLimit)) {
+		t.Errorf("Dry run of a full group = %+v, want denied by the group quota", result)
+	}
+
+	// Invalid requests are errors, not denials
+	if _, err := gw.DryRun(context.Background(), DryRunRequest{Group: "office", Target: "example.com"}); err == nil {
+		t.Error("Expected an error for a target without port")
+	}
+	if _, err := gw.DryRun(context.Background(), DryRunRequest{Target: "example.com:443"}); err == nil {
+		t.Error("Expected an error without group")
+	}
+}
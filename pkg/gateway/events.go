@@ -0,0 +1,245 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// EventType is the kind of an event published on the gateway's event bus
+type EventType string
+
+// Gateway event types
+const (
+	EventClientConnected    EventType = "client_connected"    // A client joined its group
+	EventClientDisconnected EventType = "client_disconnected" // A client left its group
+	EventDialStarted        EventType = "dial_started"        // A proxy user, ingress port or embedding application dials a target
+	EventDialFailed         EventType = "dial_failed"         // The dial was rejected or no client reached the target
+	EventConnectionOpened   EventType = "connection_opened"   // A client connected the target
+	EventBytesMilestone     EventType = "bytes_milestone"     // A connection carried another event_bytes_milestone bytes
+	EventConnectionClosed   EventType = "connection_closed"   // A connection ended
+)
+
+// defaultBytesMilestone is how many bytes a connection carries between milestone events
+const defaultBytesMilestone = 10 << 20
+
+// eventBuffer is the channel buffer of OnEvent subscribers
+const eventBuffer = 256
+
+// Event is published on the gateway's event bus, fields that don't apply to its type are empty
+type Event struct {
+	Type          EventType
+	Time          time.Time
+	ClientID      string // Client of the event, or the client serving the connection
+	GroupID       string // Group of the client, or of the proxy user
+	Username      string // Proxy user of a dial or connection
+	ConnID        string
+	Network       string
+	Address       string // Target of a dial or connection
+	BytesSent     int64  // Sent to the target so far, for milestones and closed connections
+	BytesReceived int64  // Received from the target so far
+	Err           error  // Why a dial failed
+}
+
+// eventBus delivers events to subscribers without blocking the gateway. Events for a
+// subscriber whose buffer is full are dropped. A nil bus publishes nothing.
+type eventBus struct {
+	mu        sync.RWMutex
+	subs      map[*subscription]struct{}
+	active    atomic.Int32 // Number of subscribers, checked before building events
+	milestone int64
+}
+
+// subscription is a subscriber of the event bus
+type subscription struct {
+	ch      chan Event
+	types   map[EventType]bool // nil for all types
+	dropped atomic.Int64
+}
+
+// newEventBus creates an event bus publishing a milestone every milestone bytes of a connection
+func newEventBus(milestone int64) *eventBus {
+	if milestone <= 0 {
+		milestone = defaultBytesMilestone
+	}
+	return &eventBus{subs: make(map[*subscription]struct{}), milestone: milestone}
+}
+
+// enabled reports whether anyone listens, connections are only tracked then
+func (b *eventBus) enabled() bool {
+	return b != nil && b.active.Load() > 0
+}
+
+// emit publishes ev to the subscribers of its type
+func (b *eventBus) emit(ev Event) {
+	if !b.enabled() {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// subscribe adds a subscriber, the returned function removes it and closes its channel
+func (b *eventBus) subscribe(buffer int, types []EventType) (<-chan Event, func()) {
+	sub := &subscription{ch: make(chan Event, max(buffer, 0))}
+	if len(types) > 0 {
+		sub.types = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.active.Add(1)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, sub)
+			b.active.Add(-1)
+			close(sub.ch)
+			b.mu.Unlock()
+			if dropped := sub.dropped.Load(); dropped > 0 {
+				logger.Warn("Event subscriber missed events, its buffer was full", "dropped", dropped)
+			}
+		})
+	}
+}
+
+// trackDials wraps the proxy dial function to publish dial_started and dial_failed events. The
+// connection ID is assigned here so all events of a connection carry it.
+func (b *eventBus) trackDials(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !b.enabled() {
+			return dial(ctx, network, addr)
+		}
+		connID, ok := commonctx.GetConnID(ctx)
+		if !ok {
+			connID = utils.GenerateConnID()
+			ctx = commonctx.WithConnID(ctx, connID)
+		}
+		ev := Event{Type: EventDialStarted, ConnID: connID, Network: network, Address: addr}
+		if userCtx, ok := commonctx.GetUserContext(ctx); ok {
+			ev.GroupID, ev.Username = userCtx.GroupID, userCtx.Username
+		}
+		b.emit(ev)
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			ev.Type, ev.Time, ev.Err = EventDialFailed, time.Time{}, err
+			b.emit(ev)
+		}
+		return conn, err
+	}
+}
+
+// track publishes connection_opened for a dialed connection and wraps it to publish its byte
+// milestones and its close
+func (b *eventBus) track(conn net.Conn, clientID string, userCtx *utils.UserContext, connID, network, addr string) net.Conn {
+	if !b.enabled() {
+		return conn
+	}
+	ev := Event{Type: EventConnectionOpened, ClientID: clientID, GroupID: userCtx.GroupID, Username: userCtx.Username, ConnID: connID, Network: network, Address: addr}
+	b.emit(ev)
+	return &eventConn{Conn: conn, bus: b, event: ev}
+}
+
+// eventConn publishes the byte milestones and the close of a connection. Writes carry data to
+// the target, reads the target's responses.
+type eventConn struct {
+	net.Conn
+	bus      *eventBus
+	event    Event // Fields shared by the connection's events
+	sent     atomic.Int64
+	received atomic.Int64
+	closed   sync.Once
+}
+
+// Read counts the bytes received from the target
+func (c *eventConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.count(0, int64(n))
+	}
+	return n, err
+}
+
+// Write counts the bytes sent to the target
+func (c *eventConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.count(int64(n), 0)
+	}
+	return n, err
+}
+
+// count adds transferred bytes, publishing a milestone when the total crosses one
+func (c *eventConn) count(sent, received int64) {
+	total := c.sent.Add(sent) + c.received.Add(received)
+	if milestone := c.bus.milestone; total/milestone != (total-sent-received)/milestone {
+		c.bus.emit(c.withBytes(EventBytesMilestone))
+	}
+}
+
+// withBytes returns an event of the connection with its byte counts
+func (c *eventConn) withBytes(t EventType) Event {
+	ev := c.event
+	ev.Type, ev.Time = t, time.Time{}
+	ev.BytesSent, ev.BytesReceived = c.sent.Load(), c.received.Load()
+	return ev
+}
+
+// CloseWrite keeps half-close working through the event wrapper
+func (c *eventConn) CloseWrite() error {
+	return connection.CloseWrite(c.Conn)
+}
+
+// Close publishes connection_closed once
+func (c *eventConn) Close() error {
+	err := c.Conn.Close()
+	c.closed.Do(func() {
+		c.bus.emit(c.withBytes(EventConnectionClosed))
+	})
+	return err
+}
+
+// Subscribe returns a channel receiving the gateway's events of the given types, of all types
+// when none are given. Events are dropped while the channel's buffer is full, so the buffer
+// should cover bursts. The returned function unsubscribes and closes the channel.
+func (g *Gateway) Subscribe(buffer int, types ...EventType) (<-chan Event, func()) {
+	return g.events.subscribe(buffer, types)
+}
+
+// OnEvent calls fn for each event of the given types, of all types when none are given, from a
+// goroutine of its own until the returned function is called
+func (g *Gateway) OnEvent(fn func(Event), types ...EventType) func() {
+	events, unsubscribe := g.events.subscribe(eventBuffer, types)
+	go func() {
+		for ev := range events {
+			fn(ev)
+		}
+	}()
+	return unsubscribe
+}
@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus(4)
+	events, unsubscribe := bus.subscribe(16, nil)
+
+	userCtx := &utils.UserContext{GroupID: "office", Username: "alice"}
+	var server net.Conn
+	dial := bus.trackDials(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "refused.example:443" {
+			return nil, errors.New("connection refused")
+		}
+		connID, _ := commonctx.GetConnID(ctx)
+		var client net.Conn
+		client, server = net.Pipe()
+		return bus.track(client, "edge-1", userCtx, connID, network, addr), nil
+	})
+	ctx := commonctx.WithUserContext(context.Background(), userCtx)
+
+	if _, err := dial(ctx, "tcp", "refused.example:443"); err == nil {
+		t.Fatal("Expected the dial to fail")
+	}
+	conn, err := dial(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = server.Write([]byte("hello")) }()
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	_ = conn.Close()
+	_ = server.Close()
+
+	want := []EventType{EventDialStarted, EventDialFailed, EventDialStarted, EventConnectionOpened, EventBytesMilestone, EventConnectionClosed}
+	var connID string
+	for i, typ := range want {
+		ev := <-events
+		if ev.Type != typ || ev.GroupID != "office" || ev.Username != "alice" || ev.Time.IsZero() {
+			t.Fatalf("Event %d: expected %s of alice, got %+v", i, typ, ev)
+		}
+		switch typ {
+		case EventDialFailed:
+			if ev.Err == nil {
+				t.Error("Expected the dial error on dial_failed")
+			}
+		case EventDialStarted:
+			connID = ev.ConnID
+		case EventConnectionClosed:
+			if ev.ConnID != connID || ev.ClientID != "edge-1" || ev.BytesReceived != 5 {
+				t.Errorf("Expected the closed connection's ID, client and bytes, got %+v", ev)
+			}
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("Expected no more events, got %+v", ev)
+	default:
+	}
+
+	unsubscribe()
+	if _, ok := <-events; ok || bus.enabled() {
+		t.Error("Expected the channel to be closed and the bus disabled")
+	}
+}
+
+func TestEventBus_Filter(t *testing.T) {
+	bus := newEventBus(0)
+	events, unsubscribe := bus.subscribe(1, []EventType{EventClientConnected})
+	defer unsubscribe()
+
+	bus.emit(Event{Type: EventClientDisconnected, ClientID: "edge-1"})
+	bus.emit(Event{Type: EventClientConnected, ClientID: "edge-1"})
+	bus.emit(Event{Type: EventClientConnected, ClientID: "edge-2"}) // Dropped, the buffer is full
+	if ev := <-events; ev.Type != EventClientConnected || ev.ClientID != "edge-1" {
+		t.Errorf("Expected only client_connected events, got %+v", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("Expected the event beyond the buffer to be dropped, got %+v", ev)
+	default:
+	}
+}
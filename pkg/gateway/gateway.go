@@ -6,14 +6,25 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/buhuipao/anyproxy/pkg/common/autotls"
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
 	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
 	"github.com/buhuipao/anyproxy/pkg/common/credential"
+	"github.com/buhuipao/anyproxy/pkg/common/dnscache"
+	"github.com/buhuipao/anyproxy/pkg/common/encryption"
+	"github.com/buhuipao/anyproxy/pkg/common/groupkey"
 	"github.com/buhuipao/anyproxy/pkg/common/message"
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/qos"
+	"github.com/buhuipao/anyproxy/pkg/common/tlsfp"
 	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	"github.com/buhuipao/anyproxy/pkg/protocols"
@@ -21,14 +32,21 @@ import (
 
 	// Import gRPC transport for side effects (registration)
 	_ "github.com/buhuipao/anyproxy/pkg/transport/grpc"
+	_ "github.com/buhuipao/anyproxy/pkg/transport/kcp"
+	_ "github.com/buhuipao/anyproxy/pkg/transport/memory"
 	_ "github.com/buhuipao/anyproxy/pkg/transport/quic"
 	_ "github.com/buhuipao/anyproxy/pkg/transport/websocket"
+	_ "github.com/buhuipao/anyproxy/pkg/transport/webtransport"
 )
 
 // GroupInfo holds information about a group
 type GroupInfo struct {
 	Clients []string // Ordered list of client IDs for round-robin
 	Counter int      // Round-robin counter
+
+	emptySince   time.Time        // When the last client left, zero while the group has clients
+	releaseTimer *time.Timer      // Pending removal after the grace period
+	selections   []GroupSelection // Recent client selections (protected by clientsMu like Counter)
 }
 
 // Gateway represents the proxy gateway server
@@ -40,11 +58,33 @@ type Gateway struct {
 	groupsMu       sync.RWMutex         // Mutex for groups map
 	clients        map[string]*ClientConn
 	groups         map[string]*GroupInfo // Consolidated group information
+	groupConns     map[string]int        // Active proxied connections per group (protected by groupsMu)
+	sticky         *stickyTable          // Sticky session bindings for groups that enable them
+	geo            *geoPolicy            // Geo-IP enrichment and country rules (nil when disabled)
+	autoTLS        *autotls.Bundle       // Generated CA and server certificate (nil without auto_tls)
+	blocklists     *blocklistPolicy      // Domain and IP blocklists (nil when none configured)
+	mirror         *mirrorManager        // Admin-triggered traffic captures (nil when disabled)
+	status         *statusTracker        // Public status page availability (nil when disabled)
+	subGroups      *subGroupPolicy       // Parent credentials accepted for sub-groups (nil when none delegate)
+	guard          *resourceGuard        // Process-wide load shedding (nil when no limit is set)
+	qos            *qos.Classifier       // Connection priority classes (nil when no rules are set)
+	egress         *qos.Scheduler        // Bandwidth sent to clients, shared by all of them (nil = unlimited)
+	tun            *packetRouter         // IP packets exchanged with clients in TUN mode (nil = disabled)
+	identities     *identityPins         // Client ID to key pins (nil when client_identity is disabled)
+	schedules      *accessSchedules      // When groups and users may create connections, with admin overrides
+	events         *eventBus             // Events published to applications embedding the gateway
+	sessions       *sessionLimits        // User and IP rate limit rules gating proxy sessions (nil = none)
 	credentialMgr  *credential.Manager   // Credential manager
+	groupSecrets   *groupSecrets         // Registered group passwords for Digest authentication (nil when no listener offers it)
 	portForwardMgr *PortForwardManager
+	ingress        []net.Listener                                                    // Listeners of the static ingress mappings
+	dial           func(ctx context.Context, network, addr string) (net.Conn, error) // Shared by all proxies
 	ctx            context.Context
 	cancel         context.CancelFunc
 	wg             sync.WaitGroup
+	components     componentStates // States of the transport, proxy and ingress listeners
+	listenersMu    sync.Mutex      // Serializes starting listeners with Stop closing them
+	upgrading      atomic.Bool     // Set while an upgrade starts the new process or hands clients off
 }
 
 // NewGateway creates a new proxy gateway
@@ -60,7 +100,7 @@ func NewGateway(cfg *config.Config, transportType string) (*Gateway, error) {
 		logger.Debug("Using default transport type", "transport_type", transportType)
 	}
 
-	logger.Info("Creating new gateway", "listen_addr", cfg.Gateway.ListenAddr, "http_proxy_enabled", cfg.Gateway.Proxy.HTTP.ListenAddr != "", "socks5_proxy_enabled", cfg.Gateway.Proxy.SOCKS5.ListenAddr != "", "transport_type", transportType, "auth_enabled", cfg.Gateway.AuthUsername != "")
+	logger.Info("Creating new gateway", "listen_addr", cfg.Gateway.ListenAddr, "proxy_listeners", len(cfg.Gateway.Proxy.AllListeners()), "transport_type", transportType, "auth_enabled", cfg.Gateway.AuthUsername != "")
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -75,6 +115,11 @@ func NewGateway(cfg *config.Config, transportType string) (*Gateway, error) {
 		credConfig = &credential.Config{
 			Type: credential.Type(cfg.Gateway.Credential.Type),
 		}
+		credConfig.Cipher, err = encryption.Load(cfg.Gateway.StorageEncryption.KeyEnv, cfg.Gateway.StorageEncryption.KeyFile)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
 
 		// Configure based on credential type
 		switch cfg.Gateway.Credential.Type {
@@ -104,13 +149,77 @@ func NewGateway(cfg *config.Config, transportType string) (*Gateway, error) {
 
 	if err != nil {
 		cancel()
-		return nil, fmt.Errorf("failed to create credential manager: %v", err)
+		return nil, fmt.Errorf("failed to create credential manager: %w", err)
+	}
+
+	autoTLS, err := prepareAutoTLS(&cfg.Gateway)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to prepare auto TLS: %w", err)
+	}
+
+	geo, err := newGeoPolicy(cfg.Gateway.GeoIP)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load geoip database: %w", err)
+	}
+	// Host names the gateway resolves itself go through the cache
+	if dnsCfg := cfg.Gateway.DNSCache; dnsCfg.Enabled && geo != nil {
+		geo.lookupIP = dnscache.New(dnscache.Options{
+			Servers:     dnsCfg.Servers,
+			MinTTL:      dnsCfg.MinTTL,
+			MaxTTL:      dnsCfg.MaxTTL,
+			NegativeTTL: dnsCfg.NegativeTTL,
+			MaxEntries:  dnsCfg.MaxEntries,
+		}).LookupIPAddr
+		logger.Info("Gateway DNS cache enabled", "servers", dnsCfg.Servers)
+	}
+
+	blocklists, err := newBlocklistPolicy(&cfg.Gateway)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load blocklists: %w", err)
 	}
 
+	identities, err := newIdentityPins(cfg.Gateway.ClientIdentity)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	classifier, err := qos.NewClassifier(cfg.Gateway.QoS)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to compile qos rules: %w", err)
+	}
+
+	schedules, err := newAccessSchedules(&cfg.Gateway)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid access schedules: %w", err)
+	}
+
+	packets, err := newPacketRouter(cfg.Gateway.Tun)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to open TUN interface: %w", err)
+	}
+	// Every later failure closes the TUN device and waits for its router goroutines
+	created := false
+	defer func() {
+		if !created {
+			packets.stop()
+		}
+	}()
+
 	// 🆕 Create transport layer - the only new logic
 	transportImpl := transport.CreateTransport(transportType, &transport.AuthConfig{
 		Username: cfg.Gateway.AuthUsername,
 		Password: cfg.Gateway.AuthPassword,
+		KCP:      cfg.Gateway.KCP,
+		GRPC:     cfg.Gateway.GRPC,
+		// The process replacing this one on an upgrade listens alongside it
+		ReusePort: cfg.Gateway.Upgrade.Enabled,
 	})
 	if transportImpl == nil {
 		cancel()
@@ -122,7 +231,23 @@ func NewGateway(cfg *config.Config, transportType string) (*Gateway, error) {
 		transport:      transportImpl,
 		clients:        make(map[string]*ClientConn),
 		groups:         make(map[string]*GroupInfo),
+		groupConns:     make(map[string]int),
+		sticky:         newStickyTable(),
+		geo:            geo,
+		autoTLS:        autoTLS,
+		blocklists:     blocklists,
+		mirror:         newMirrorManager(cfg.Gateway.Mirror),
+		status:         newStatusTracker(cfg.Gateway.StatusPage),
+		subGroups:      newSubGroupPolicy(cfg.Gateway.SubGroups),
+		guard:          newResourceGuard(cfg.Gateway.ResourceLimits),
+		qos:            classifier,
+		egress:         qos.NewScheduler(cfg.Gateway.Egress),
+		tun:            packets,
+		identities:     identities,
+		schedules:      schedules,
+		events:         newEventBus(cfg.Gateway.EventBytesMilestone),
 		credentialMgr:  credentialMgr,
+		groupSecrets:   newGroupSecrets(cfg.Gateway.Proxy),
 		portForwardMgr: NewPortForwardManager(),
 		ctx:            ctx,
 		cancel:         cancel,
@@ -139,71 +264,187 @@ func NewGateway(cfg *config.Config, transportType string) (*Gateway, error) {
 
 		logger.Debug("Dial function received user context", "group_id", userCtx.GroupID, "network", network, "address", addr)
 
-		// Get client
-		client, err := gateway.getClientByGroup(userCtx.GroupID)
+		// Refuse new connections outside the access schedule of the user's group or the user
+		if err := gateway.checkSchedule(userCtx); err != nil {
+			logger.Warn("Access schedule rejected dial", "group_id", userCtx.GroupID, "username", userCtx.Username, "network", network, "address", addr, "err", err)
+			return nil, err
+		}
+
+		// Client-side services are reserved for the admin API
+		if err := checkReservedTarget(addr); err != nil {
+			logger.Warn("Proxy user tried to dial a reserved client service address", "group_id", userCtx.GroupID, "address", addr)
+			return nil, err
+		}
+
+		// Apply Geo-IP rules, a route rule hands the dial to another group
+		userCtx, geoInfo, err := gateway.applyGeoPolicy(ctx, userCtx, network, addr)
 		if err != nil {
-			logger.Error("Failed to get client by group for dial", "group_id", userCtx.GroupID, "network", network, "address", addr, "err", err)
 			return nil, err
 		}
-		logger.Debug("Successfully selected client for dial", "client_id", client.ID, "group_id", userCtx.GroupID, "network", network, "address", addr)
-		return client.dialNetwork(ctx, network, addr)
-	}
 
-	// Initialize proxy protocols
-	var proxies []utils.GatewayProxy
+		// Reject blocklisted targets, using the blocklists of the group serving the dial
+		if err := gateway.applyBlocklists(userCtx, network, addr); err != nil {
+			return nil, err
+		}
+
+		// Classify the connection, without rules the client classifies it by its own
+		if gateway.qos != nil {
+			ctx = commonctx.WithPriority(ctx, uint8(gateway.qos.Classify(addr, userCtx.Username, userCtx.GroupID)))
+		}
 
-	// Create HTTP proxy
-	if cfg.Gateway.Proxy.HTTP.ListenAddr != "" {
-		logger.Info("Configuring HTTP proxy", "listen_addr", cfg.Gateway.Proxy.HTTP.ListenAddr)
-		httpProxy, err := protocols.NewHTTPProxyWithAuth(&cfg.Gateway.Proxy.HTTP, dialFn, gateway.credentialMgr.ValidateGroup)
+		// Shed load before doing any work when the gateway is over its resource limits
+		releaseGuard, err := gateway.guard.acquire()
 		if err != nil {
-			cancel()
-			logger.Error("Failed to create HTTP proxy", "listen_addr", cfg.Gateway.Proxy.HTTP.ListenAddr, "err", err)
-			return nil, fmt.Errorf("failed to create HTTP proxy: %v", err)
+			logger.Warn("Resource guard rejected dial", "group_id", userCtx.GroupID, "network", network, "address", addr, "err", err)
+			return nil, err
 		}
-		proxies = append(proxies, httpProxy)
-		logger.Info("HTTP proxy configured successfully", "listen_addr", cfg.Gateway.Proxy.HTTP.ListenAddr)
-	}
 
-	// Create SOCKS5 proxy
-	if cfg.Gateway.Proxy.SOCKS5.ListenAddr != "" {
-		logger.Info("Configuring SOCKS5 proxy", "listen_addr", cfg.Gateway.Proxy.SOCKS5.ListenAddr)
-		socks5Proxy, err := protocols.NewSOCKS5ProxyWithAuth(&cfg.Gateway.Proxy.SOCKS5, dialFn, gateway.credentialMgr.ValidateGroup)
+		// Reserve a connection slot for the group
+		releaseGroup, err := gateway.acquireGroupConnection(userCtx.GroupID)
 		if err != nil {
-			cancel()
-			logger.Error("Failed to create SOCKS5 proxy", "listen_addr", cfg.Gateway.Proxy.SOCKS5.ListenAddr, "err", err)
-			return nil, fmt.Errorf("failed to create SOCKS5 proxy: %v", err)
+			releaseGuard()
+			logger.Error("Group connection limit rejected dial", "group_id", userCtx.GroupID, "network", network, "address", addr, "err", err)
+			return nil, err
+		}
+		release := func() {
+			releaseGroup()
+			releaseGuard()
 		}
-		proxies = append(proxies, socks5Proxy)
-		logger.Info("SOCKS5 proxy configured successfully", "listen_addr", cfg.Gateway.Proxy.SOCKS5.ListenAddr)
+
+		// Make sure the connection ID is known so Geo-IP data can be attached to its metrics
+		connID, hasConnID := commonctx.GetConnID(ctx)
+		if !hasConnID {
+			connID = utils.GenerateConnID()
+			ctx = commonctx.WithConnID(ctx, connID)
+		}
+
+		// Dial through a client of the group, retrying other clients when the group allows it
+		client, conn, err := gateway.dialClient(ctx, userCtx, network, addr)
+		if err != nil {
+			release()
+			logger.Error("Failed to dial through group client", "group_id", userCtx.GroupID, "network", network, "address", addr, "err", err)
+			return nil, err
+		}
+		logger.Debug("Successfully dialed through client", "client_id", client.ID, "group_id", userCtx.GroupID, "network", network, "address", addr, "source_country", geoInfo.SourceCountry, "target_country", geoInfo.TargetCountry)
+		if gateway.geo != nil {
+			monitoring.SetConnectionGeo(connID, geoInfo.SourceCountry, geoInfo.TargetCountry)
+		}
+		// Move connections of idempotent protocols to another client when theirs disconnects
+		conn = gateway.migratable(ctx, conn, client, userCtx, network, addr)
+		// Captures may be started for the connection at any time
+		conn = gateway.mirror.tap(conn, connID, network, addr, userCtx.SourceIP)
+		// Close connections that transfer more than the group or user allows
+		conn = gateway.limitTransfer(conn, userCtx, connID, addr)
+		conn = gateway.events.track(conn, client.ID, userCtx, connID, network, addr)
+		return &limitedConn{Conn: conn, release: release}, nil
 	}
+	dialFn = gateway.events.trackDials(trackUserStats(gateway.limitSessions(dialFn)))
+
+	// Proxies without their own socket options use the gateway defaults
+	gateway.portForwardMgr.socketOptions = &cfg.Gateway.SocketOptions
 
-	// Create TUIC proxy
-	if cfg.Gateway.Proxy.TUIC.ListenAddr != "" {
-		logger.Info("Configuring TUIC proxy", "listen_addr", cfg.Gateway.Proxy.TUIC.ListenAddr)
-		tuicProxy, err := protocols.NewTUICProxyWithAuth(&cfg.Gateway.Proxy.TUIC, dialFn, gateway.credentialMgr.ValidateGroup, cfg.Gateway.TLSCert, cfg.Gateway.TLSKey)
+	// Initialize proxy protocols
+	var proxies []utils.GatewayProxy
+	for _, listener := range cfg.Gateway.Proxy.AllListeners() {
+		logger.Info("Configuring proxy", "type", listener.Type, "listen_addr", listener.Addr, "groups", listener.Groups)
+		proxy, err := gateway.newProxy(listener, dialFn)
 		if err != nil {
 			cancel()
-			logger.Error("Failed to create TUIC proxy", "listen_addr", cfg.Gateway.Proxy.TUIC.ListenAddr, "err", err)
-			return nil, fmt.Errorf("failed to create TUIC proxy: %v", err)
+			logger.Error("Failed to create proxy", "type", listener.Type, "listen_addr", listener.Addr, "err", err)
+			return nil, fmt.Errorf("failed to create %s proxy on %s: %w", listener.Type, listener.Addr, err)
 		}
-		proxies = append(proxies, tuicProxy)
-		logger.Info("TUIC proxy configured successfully", "listen_addr", cfg.Gateway.Proxy.TUIC.ListenAddr, "using_gateway_tls", true)
+		proxies = append(proxies, proxy)
+		logger.Info("Proxy configured successfully", "type", listener.Type, "listen_addr", listener.Addr)
 	}
 
-	// Ensure at least one proxy is configured
-	if len(proxies) == 0 {
+	gateway.dial = dialFn
+
+	// Ensure at least one proxy is configured, embedded in-memory gateways may be driven through Dial only
+	if len(proxies) == 0 && transportType != protocol.TransportTypeMemory {
 		cancel()
-		logger.Error("No proxy configured - at least one proxy type must be enabled", "http_addr", cfg.Gateway.Proxy.HTTP.ListenAddr, "socks5_addr", cfg.Gateway.Proxy.SOCKS5.ListenAddr, "tuic_addr", cfg.Gateway.Proxy.TUIC.ListenAddr)
+		logger.Error("No proxy configured - at least one proxy type must be enabled", "http_addr", cfg.Gateway.Proxy.HTTP.ListenAddr, "socks5_addr", cfg.Gateway.Proxy.SOCKS5.ListenAddr, "tuic_addr", cfg.Gateway.Proxy.TUIC.ListenAddr, "listeners", len(cfg.Gateway.Proxy.Listeners))
 		return nil, fmt.Errorf("no proxy configured: please configure at least one of HTTP, SOCKS5, or TUIC proxy")
 	}
 
+	// Admit users without credentials by source IP where the protocol allows it
+	if len(cfg.Gateway.SourceRoutes) > 0 {
+		routes, err := newSourceRoutes(cfg.Gateway.SourceRoutes)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("invalid source routes: %w", err)
+		}
+		for _, proxy := range proxies {
+			if routed, ok := proxy.(utils.SourceRoutedProxy); ok {
+				routed.SetSourceRouter(routes.lookup)
+			}
+		}
+		logger.Info("Source IP routing enabled", "rules", len(routes))
+	}
+
+	// Digest authentication checks responses with the registered group passwords
+	if gateway.groupSecrets != nil {
+		for _, proxy := range proxies {
+			if digest, ok := proxy.(utils.DigestAuthProxy); ok {
+				digest.SetGroupSecrets(gateway.groupPasswords)
+			}
+		}
+	}
+
 	gateway.proxies = proxies
+	gateway.loadUpgradeState()
 	logger.Info("Gateway created successfully", "proxy_count", len(proxies), "listen_addr", cfg.Gateway.ListenAddr)
 
+	created = true
 	return gateway, nil
 }
 
+// newProxy creates the proxy of a listener, options it leaves unset use the gateway defaults
+func (g *Gateway) newProxy(listener config.ProxyListener, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (utils.GatewayProxy, error) {
+	validate := g.validateGroup
+	if len(listener.Groups) > 0 {
+		allowed := make(map[string]bool, len(listener.Groups))
+		for _, groupID := range listener.Groups {
+			allowed[groupID] = true
+		}
+		validate = func(groupID, password string) bool {
+			return allowed[groupID] && g.validateGroup(groupID, password)
+		}
+	}
+
+	switch listener.Type {
+	case config.ProxyTypeHTTP:
+		opts := listener.HTTP
+		opts.SocketOptions = g.listenOptions(opts.SocketOptions)
+		if opts.TLSFingerprint == nil {
+			opts.TLSFingerprint = &g.config.TLSFingerprint
+		}
+		return protocols.NewHTTPProxyWithAuth(&opts, withDialTimeout(dial, opts.DialTimeout), validate)
+	case config.ProxyTypeSOCKS5:
+		opts := listener.SOCKS5
+		opts.SocketOptions = g.listenOptions(opts.SocketOptions)
+		return protocols.NewSOCKS5ProxyWithAuth(&opts, withDialTimeout(dial, opts.DialTimeout), validate)
+	case config.ProxyTypeTUIC:
+		opts := listener.TUIC
+		opts.SocketOptions = g.listenOptions(opts.SocketOptions)
+		return protocols.NewTUICProxyWithAuth(&opts, withDialTimeout(dial, opts.DialTimeout), validate, g.config.TLSCert, g.config.TLSKey)
+	}
+	return nil, fmt.Errorf("unknown proxy type %q", listener.Type)
+}
+
+// listenOptions returns the socket options of a proxy listener, the gateway defaults when it has
+// none. With upgrades enabled the port is shared with the process replacing this one.
+func (g *Gateway) listenOptions(opts *config.SocketOptions) *config.SocketOptions {
+	if opts == nil {
+		opts = &g.config.SocketOptions
+	}
+	if !g.config.Upgrade.Enabled || opts.ReusePort {
+		return opts
+	}
+	shared := *opts
+	shared.ReusePort = true
+	return &shared
+}
+
 // Start starts the gateway
 func (g *Gateway) Start() error {
 	logger.Info("Starting gateway server", "listen_addr", g.config.ListenAddr, "proxy_count", len(g.proxies))
@@ -211,16 +452,44 @@ func (g *Gateway) Start() error {
 	// 🆕 Start monitoring data cleanup process
 	monitoring.StartCleanupProcess()
 
+	// Start resource guard sampling
+	if g.guard != nil {
+		logger.Info("Starting resource guard", "max_goroutines", g.guard.limits.MaxGoroutines, "max_connections", g.guard.limits.MaxConnections, "max_heap_mb", g.guard.limits.MaxHeapMB)
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.guard.run(g.ctx)
+		}()
+	}
+
+	// Keep blocklists up to date
+	if g.blocklists != nil {
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.blocklists.run(g.ctx)
+		}()
+	}
+
+	// Put clients without connections into hibernation
+	if g.config.Hibernation.IdleAfter > 0 {
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.hibernateIdleClients()
+		}()
+	}
+
 	// 🆕 Check and configure TLS
 	var tlsConfig *tls.Config
 	if g.config.TLSCert != "" && g.config.TLSKey != "" {
 		logger.Debug("Loading TLS certificates", "cert_file", g.config.TLSCert, "key_file", g.config.TLSKey)
 
 		// Load TLS certificate and key
-		cert, err := tls.LoadX509KeyPair(g.config.TLSCert, g.config.TLSKey)
+		cert, err := config.LoadX509KeyPair(g.config.TLSCert, g.config.TLSKey)
 		if err != nil {
 			logger.Error("Failed to load TLS certificate", "cert_file", g.config.TLSCert, "key_file", g.config.TLSKey, "err", err)
-			return fmt.Errorf("failed to load TLS certificate: %v", err)
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
 		}
 		logger.Debug("TLS certificates loaded successfully")
 
@@ -230,44 +499,55 @@ func (g *Gateway) Start() error {
 			MinVersion:   tls.VersionTLS12,
 		}
 		logger.Debug("TLS configuration created", "min_version", "TLS 1.2")
+		tlsConfig = tlsfp.NewPolicy("transport", &g.config.TLSFingerprint).Apply(tlsConfig)
 	}
 
-	// 🆕 Start transport layer server - support TLS
+	// 🆕 Start transport layer server - support TLS. Components start in dependency order: clients
+	// connect to the transport, proxies and ingress listeners dial through the clients.
 	logger.Info("Starting transport server for client connections")
-	if tlsConfig != nil {
-		logger.Info("Starting secure transport server (HTTPS/WSS)")
-		if err := g.transport.ListenAndServeWithTLS(g.config.ListenAddr, g.handleConnection, tlsConfig); err != nil {
-			logger.Error("Failed to start secure transport server", "listen_addr", g.config.ListenAddr, "err", err)
-			return err
+	err := g.startWithRetry("transport", func() error {
+		if tlsConfig != nil {
+			logger.Info("Starting secure transport server (HTTPS/WSS)")
+			return g.transport.ListenAndServeWithTLS(g.config.ListenAddr, g.handleConnection, tlsConfig)
 		}
-		logger.Info("Secure transport server started successfully", "listen_addr", g.config.ListenAddr)
-	} else {
 		logger.Info("Starting transport server (HTTP/WS)")
-		if err := g.transport.ListenAndServe(g.config.ListenAddr, g.handleConnection); err != nil {
-			logger.Error("Failed to start transport server", "listen_addr", g.config.ListenAddr, "err", err)
-			return err
-		}
-		logger.Info("Transport server started successfully", "listen_addr", g.config.ListenAddr)
+		return g.transport.ListenAndServe(g.config.ListenAddr, g.handleConnection)
+	})
+	if err != nil {
+		logger.Error("Failed to start transport server", "listen_addr", g.config.ListenAddr, "tls", tlsConfig != nil, "err", err)
+		return err
 	}
+	logger.Info("Transport server started successfully", "listen_addr", g.config.ListenAddr, "tls", tlsConfig != nil)
 
 	// Start all proxy servers
 	logger.Info("Starting proxy servers", "count", len(g.proxies))
 	for i, proxy := range g.proxies {
-		logger.Debug("Starting proxy server", "index", i, "type", fmt.Sprintf("%T", proxy))
-		if err := proxy.Start(); err != nil {
-			logger.Error("Failed to start proxy server", "index", i, "type", fmt.Sprintf("%T", proxy), "err", err)
+		name := g.proxyComponent(i)
+		logger.Debug("Starting proxy server", "index", i, "component", name, "type", fmt.Sprintf("%T", proxy))
+		if err := g.startWithRetry(name, proxy.Start); err != nil {
+			logger.Error("Failed to start proxy server", "index", i, "component", name, "type", fmt.Sprintf("%T", proxy), "err", err)
+			if g.config.Startup.KeepRetrying {
+				g.retryInBackground(name, proxy.Start)
+				continue
+			}
 			// Stop already started proxies
 			logger.Warn("Stopping previously started proxies due to failure", "stopping_count", i)
 			for j := 0; j < i; j++ {
 				if stopErr := g.proxies[j].Stop(); stopErr != nil {
 					logger.Error("Failed to stop proxy during cleanup", "index", j, "err", stopErr)
 				}
+				g.components.set(g.proxyComponent(j), ComponentStopped, 0, nil)
 			}
-			return fmt.Errorf("failed to start proxy %d: %v", i, err)
+			return fmt.Errorf("failed to start proxy %d: %w", i, err)
 		}
 		logger.Debug("Proxy server started successfully", "index", i, "type", fmt.Sprintf("%T", proxy))
 	}
 
+	// Open the static ingress ports once the proxies serve
+	if err := g.startIngress(); err != nil {
+		return err
+	}
+
 	logger.Info("Gateway started successfully", "transport_addr", g.config.ListenAddr, "proxy_count", len(g.proxies))
 
 	return nil
@@ -277,9 +557,14 @@ func (g *Gateway) Start() error {
 func (g *Gateway) Stop() error {
 	logger.Info("Initiating graceful gateway shutdown...")
 
-	// Step 1: Cancel context
+	// Step 1: Cancel context, probes report the gateway down from now on
 	logger.Debug("Signaling all goroutines to stop")
 	g.cancel()
+	g.components.stopAll()
+	g.stopGroupReleases()
+
+	// Listeners retried in the background don't start anymore once the lock is released
+	g.listenersMu.Lock()
 
 	// Step 2: 🆕 Stop transport layer server
 	logger.Info("Shutting down transport server")
@@ -300,6 +585,8 @@ func (g *Gateway) Stop() error {
 		}
 	}
 	logger.Info("All proxy servers stopped")
+	g.stopIngress()
+	g.listenersMu.Unlock()
 
 	// Step 4: Stop port forwarding manager
 	logger.Debug("Stopping port forwarding manager")
@@ -346,6 +633,14 @@ func (g *Gateway) Stop() error {
 		logger.Warn("Timeout waiting for gateway goroutines to finish")
 	}
 
+	g.egress.Stop()
+	g.tun.stop()
+
+	// Close capture files
+	if g.mirror != nil {
+		g.mirror.stopAll()
+	}
+
 	// 🆕 Stop monitoring data cleanup process
 	monitoring.StopCleanupProcess()
 
@@ -360,8 +655,12 @@ func (g *Gateway) handleConnection(conn transport.Connection) {
 	clientID := conn.GetClientID()
 	groupID := conn.GetGroupID()
 	password := conn.GetPassword()
+	clientVersion := conn.GetClientVersion()
 
-	logger.Info("Client connected", "client_id", clientID, "group_id", groupID, "remote_addr", conn.RemoteAddr())
+	logger.Info("Client connected", "client_id", clientID, "group_id", groupID, "client_version", clientVersion, "remote_addr", conn.RemoteAddr())
+	if clientVersion != version.Version {
+		logger.Warn("Client version differs from gateway", "client_id", clientID, "client_version", clientVersion, "gateway_version", version.Version)
+	}
 
 	// Only register group credentials if password is provided
 	// For file/db credential storage, passwords are pre-configured
@@ -378,19 +677,36 @@ func (g *Gateway) handleConnection(conn transport.Connection) {
 			_ = conn.Close()
 			return
 		}
+		g.groupSecrets.set(groupID, password)
 		logger.Debug("Registered group credentials from client", "client_id", clientID, "group_id", groupID)
 	} else {
 		logger.Debug("No password provided by client, using pre-configured credentials", "client_id", clientID, "group_id", groupID)
 	}
 
+	// Refuse clients claiming an ID pinned to another key
+	if g.identities != nil {
+		if err := g.identities.check(conn); err != nil {
+			logger.Warn("Rejected client identity", "client_id", clientID, "group_id", groupID, "remote_addr", conn.RemoteAddr(), "err", err)
+			msgHandler := message.NewGatewayExtendedMessageHandler(conn)
+			if writeErr := msgHandler.WriteErrorMessage(err.Error()); writeErr != nil {
+				logger.Error("Failed to send error message to client", "client_id", clientID, "group_id", groupID, "original_error", err, "write_error", writeErr)
+			}
+			_ = conn.Close()
+			return
+		}
+	}
+
 	// Initialize group info if it doesn't exist
 	g.groupsMu.Lock()
-	if _, exists := g.groups[groupID]; !exists {
+	if groupInfo, exists := g.groups[groupID]; !exists {
 		g.groups[groupID] = &GroupInfo{
 			Clients: make([]string, 0),
 			Counter: 0,
 		}
 		logger.Debug("Initialized group info", "group_id", groupID)
+	} else {
+		// A joining client keeps an empty group from being collected
+		groupInfo.cancelRelease()
 	}
 	g.groupsMu.Unlock()
 
@@ -401,23 +717,72 @@ func (g *Gateway) handleConnection(conn transport.Connection) {
 	client := &ClientConn{
 		ID:             clientID,
 		GroupID:        groupID,
+		Version:        clientVersion,
 		Conn:           conn, // 🆕 Use transport layer connection
 		Conns:          make(map[string]*Conn),
 		msgChans:       make(map[string]chan map[string]interface{}),
 		ctx:            ctx,
 		cancel:         cancel,
 		portForwardMgr: g.portForwardMgr,
+		closeGrace:     connection.CloseGracePeriod(g.config.CloseGracePeriod),
+		egress:         g.egress,
+		probeInterval:  g.config.IdleProbeInterval,
+		packets:        g.tun,
+		controlKey:     groupkey.Derive(groupID, password),
+		signedControl:  g.config.GetGroupConfig(groupID).SignedControl,
+		resumed:        make(chan struct{}, 1),
+	}
+	client.markUsed()
+	if g.config.PeerRouting {
+		client.peerDial = g.dialPeer
 	}
 
 	// 🆕 Initialize message handler
 	client.msgHandler = message.NewGatewayExtendedMessageHandler(conn)
 
-	g.addClient(client)
+	// Route no connections to the client before it has the group's policy packs
+	pushPolicy := len(g.config.PolicyPacks) > 0
+	client.policyPending.Store(pushPolicy && len(g.config.GetGroupConfig(groupID).PolicyPacks) > 0)
+
+	if err := g.addClient(client); err != nil {
+		logger.Error("Rejected client registration", "client_id", clientID, "group_id", groupID, "err", err)
+		if writeErr := client.msgHandler.WriteErrorMessage(err.Error()); writeErr != nil {
+			logger.Error("Failed to send error message to client", "client_id", clientID, "group_id", groupID, "original_error", err, "write_error", writeErr)
+		}
+		cancel()
+		_ = conn.Close()
+		return
+	}
+
+	if client.probeInterval > 0 {
+		client.wg.Add(1)
+		go func() {
+			defer client.wg.Done()
+			client.probeIdleConnections()
+		}()
+	}
+
+	if pushPolicy {
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.pushPolicyPacks(client)
+		}()
+	}
+
+	if g.config.ClientUpdates.Enabled {
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.offerClientUpdate(client)
+		}()
+	}
 
 	// 🚨 Fix: Handle messages directly, block until connection closes
 	// This ensures BiStream method doesn't return prematurely
 	defer func() {
 		client.Stop()
+		g.tun.unregister(client)
 		g.removeClient(client.ID)
 		logger.Info("Client disconnected and cleaned up", "client_id", client.ID, "group_id", client.GroupID)
 	}()
@@ -427,14 +792,23 @@ func (g *Gateway) handleConnection(conn transport.Connection) {
 }
 
 // addClient adds a client to the gateway
-func (g *Gateway) addClient(client *ClientConn) {
+func (g *Gateway) addClient(client *ClientConn) error {
 	g.clientsMu.Lock()
 	defer g.clientsMu.Unlock()
 
 	// Validate group ID is non-empty
 	if client.GroupID == "" {
 		logger.Error("Cannot add client with empty group ID", "client_id", client.ID)
-		return
+		return fmt.Errorf("client %s has empty group ID", client.ID)
+	}
+
+	// Enforce the group's max_clients limit before touching any state
+	g.groupsMu.RLock()
+	limitErr := g.checkGroupClientLimit(client)
+	g.groupsMu.RUnlock()
+	if limitErr != nil {
+		logger.Warn("Group client limit reached", "client_id", client.ID, "group_id", client.GroupID, "err", limitErr)
+		return limitErr
 	}
 
 	// Check if client already exists
@@ -458,14 +832,21 @@ func (g *Gateway) addClient(client *ClientConn) {
 
 	// Add client to group's ordered list
 	g.groups[client.GroupID].Clients = append(g.groups[client.GroupID].Clients, client.ID)
+	g.groups[client.GroupID].cancelRelease()
 	groupSize := len(g.groups[client.GroupID].Clients)
+	if groupSize == 1 {
+		g.status.groupUp(client.GroupID, time.Now())
+	}
 	g.groupsMu.Unlock()
 
 	// 🆕 Update client metrics when client connects
 	monitoring.UpdateClientMetrics(client.ID, client.GroupID, 0, 0, false)
+	monitoring.SetClientVersion(client.ID, client.Version)
+	g.events.emit(Event{Type: EventClientConnected, ClientID: client.ID, GroupID: client.GroupID})
 
 	totalClients := len(g.clients)
 	logger.Debug("Client added successfully", "client_id", client.ID, "group_id", client.GroupID, "group_size", groupSize, "total_clients", totalClients)
+	return nil
 }
 
 // removeClient removes a client from the gateway
@@ -500,37 +881,41 @@ func (g *Gateway) removeClient(clientID string) {
 
 		// Clean up empty group
 		if len(groupInfo.Clients) == 0 {
-			delete(g.groups, client.GroupID)
-			// Only remove from credential manager if using memory storage
-			// For file/db storage, credentials are persistent
-			if g.config.Credential == nil || g.config.Credential.Type == "memory" || g.config.Credential.Type == "" {
-				if err := g.credentialMgr.RemoveGroup(client.GroupID); err != nil {
-					logger.Error("Failed to remove group from credential manager", "group_id", client.GroupID, "err", err)
-				}
-				logger.Debug("Removed group credentials from memory", "group_id", client.GroupID)
-			} else {
-				logger.Debug("Keeping persistent group credentials", "group_id", client.GroupID, "storage_type", g.config.Credential.Type)
-			}
+			g.status.groupDown(client.GroupID, time.Now())
+			g.releaseEmptyGroup(client.GroupID, groupInfo)
 		}
 	}
 	g.groupsMu.Unlock()
 
+	g.events.emit(Event{Type: EventClientDisconnected, ClientID: clientID, GroupID: client.GroupID})
+
 	remainingClients := len(g.clients)
 	logger.Info("Client removed successfully", "client_id", clientID, "group_id", client.GroupID, "remaining_clients", remainingClients)
 }
 
-// getClientByGroup gets client by group
-func (g *Gateway) getClientByGroup(groupID string) (*ClientConn, error) {
+// getClientByGroup gets a client of the group able to dial network, only considering the pinned
+// client when one is given
+func (g *Gateway) getClientByGroup(groupID, pinnedClient, network string) (*ClientConn, error) {
+	return g.pickGroupClient(groupID, pinnedClient, network, true)
+}
+
+// pickGroupClient selects a client like getClientByGroup, moving the group's round-robin
+// position past it when advance is set
+func (g *Gateway) pickGroupClient(groupID, pinnedClient, network string, advance bool) (*ClientConn, error) {
 	g.clientsMu.Lock()
 	defer g.clientsMu.Unlock()
 
 	groupInfo, exists := g.groups[groupID]
 	if !exists || len(groupInfo.Clients) == 0 {
-		return nil, fmt.Errorf("no clients available in group: %s", groupID)
+		return nil, utils.WithErrorCode(utils.ErrCodeNoClientAvailable, fmt.Errorf("no clients available in group: %s", groupID))
 	}
 
 	clients := groupInfo.Clients
 	counter := groupInfo.Counter
+	var skips capabilitySkips
+	leastLoaded := g.config.GetGroupConfig(groupID).Balancing == config.BalancingLeastLoaded
+	var best *ClientConn
+	bestIdx := 0
 
 	// Try up to len(clients) times to find a healthy client
 	for i := 0; i < len(clients); i++ {
@@ -538,14 +923,61 @@ func (g *Gateway) getClientByGroup(groupID string) (*ClientConn, error) {
 		idx := (counter + i) % len(clients)
 		clientID := clients[idx]
 
+		if !pinnedClientMatches(clientID, pinnedClient) {
+			continue
+		}
 		if client, exists := g.clients[clientID]; exists {
+			if !client.available() || !skips.check(client, network) {
+				continue
+			}
+			if leastLoaded {
+				// Equally loaded clients keep their round-robin order
+				if best == nil || lessLoaded(client, best) {
+					best, bestIdx = client, idx
+				}
+				continue
+			}
+			if !advance {
+				return client, nil
+			}
 			// Update counter to next position
 			groupInfo.Counter = (idx + 1) % len(clients)
+			groupInfo.recordSelection(clientID, counter, SelectionRoundRobin)
 			logger.Info("Round-robin client selection", "group_id", groupID, "selected_client", clientID, "counter_before", counter, "counter_after", groupInfo.Counter, "total_clients", len(clients), "available_clients", clients)
 			return client, nil
 		}
 		logger.Warn("Client not found in clients map during round-robin", "group_id", groupID, "target_client", clientID, "counter", counter, "idx", idx, "total_clients", len(clients), "available_clients", clients)
 	}
 
-	return nil, fmt.Errorf("no healthy clients available in group: %s", groupID)
+	if best != nil {
+		if !advance {
+			return best, nil
+		}
+		groupInfo.Counter = (bestIdx + 1) % len(clients)
+		groupInfo.recordSelection(best.ID, counter, SelectionLeastLoaded)
+		logger.Debug("Least-loaded client selection", "group_id", groupID, "selected_client", best.ID, "load_score", best.LoadScore())
+		return best, nil
+	}
+
+	// A client at its connection limit still answers, and may have freed a slot meanwhile
+	if skips.full != nil {
+		if advance {
+			groupInfo.recordSelection(skips.full.ID, counter, SelectionAtCapacity)
+		}
+		logger.Debug("All clients of group at their connection limit", "group_id", groupID, "selected_client", skips.full.ID)
+		return skips.full, nil
+	}
+	if err := skips.err(groupID, network); err != nil {
+		return nil, err
+	}
+	if pinnedClient != "" {
+		return nil, utils.WithErrorCode(utils.ErrCodeNoClientAvailable, fmt.Errorf("pinned client %s is not available in group: %s", pinnedClient, groupID))
+	}
+	return nil, utils.WithErrorCode(utils.ErrCodeNoClientAvailable, fmt.Errorf("no healthy clients available in group: %s", groupID))
+}
+
+// pinnedClientMatches reports whether a client ID matches the client pinned by a proxy user,
+// either exactly or as a replica of the configured client_id. Nothing pinned matches all.
+func pinnedClientMatches(clientID, pinnedClient string) bool {
+	return pinnedClient == "" || clientID == pinnedClient || strings.HasPrefix(clientID, pinnedClient+"-r")
 }
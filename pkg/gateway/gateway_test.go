@@ -5,11 +5,14 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/buhuipao/anyproxy/pkg/common/credential"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
 	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/transport"
@@ -149,6 +152,10 @@ func (m *mockConnection) GetPassword() string {
 	return m.password
 }
 
+func (m *mockConnection) GetClientVersion() string {
+	return ""
+}
+
 func (m *mockConnection) SetDeadline(t time.Time) error {
 	return nil
 }
@@ -394,7 +401,7 @@ func TestGateway_ClientManagement(t *testing.T) {
 	// Test getting client by group with round-robin
 	t.Run("get client by group with round-robin", func(t *testing.T) {
 		// First call should return client1
-		client, err := gw.getClientByGroup("group1")
+		client, err := gw.getClientByGroup("group1", "", "tcp")
 		if err != nil {
 			t.Errorf("Unexpected error: %v", err)
 		}
@@ -403,7 +410,7 @@ func TestGateway_ClientManagement(t *testing.T) {
 		}
 
 		// Second call should return client2 (round-robin)
-		client, err = gw.getClientByGroup("group1")
+		client, err = gw.getClientByGroup("group1", "", "tcp")
 		if err != nil {
 			t.Errorf("Unexpected error: %v", err)
 		}
@@ -412,7 +419,7 @@ func TestGateway_ClientManagement(t *testing.T) {
 		}
 
 		// Third call should return client1 again
-		client, err = gw.getClientByGroup("group1")
+		client, err = gw.getClientByGroup("group1", "", "tcp")
 		if err != nil {
 			t.Errorf("Unexpected error: %v", err)
 		}
@@ -421,7 +428,7 @@ func TestGateway_ClientManagement(t *testing.T) {
 		}
 
 		// Test non-existent group
-		_, err = gw.getClientByGroup("nonexistent")
+		_, err = gw.getClientByGroup("nonexistent", "", "tcp")
 		if err == nil {
 			t.Error("Expected error for non-existent group")
 		}
@@ -430,6 +437,127 @@ func TestGateway_ClientManagement(t *testing.T) {
 		}
 	})
 
+	// Test that a pinned client is the only candidate
+	t.Run("get pinned client by group", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			client, err := gw.getClientByGroup("group1", "client2", "tcp")
+			if err != nil || client.ID != "client2" {
+				t.Errorf("Expected the pinned client2, got %v, %v", client, err)
+			}
+		}
+		if client := gw.nextGroupClient("group1", "client2", "tcp", map[string]bool{"client2": true}); client != nil {
+			t.Errorf("Expected no retry candidate besides the pinned client, got %s", client.ID)
+		}
+		_, err := gw.getClientByGroup("group1", "client3", "tcp")
+		if err == nil || utils.ErrorCodeOf(err) != utils.ErrCodeNoClientAvailable {
+			t.Errorf("Expected no_client_available for an unknown pinned client, got %v", err)
+		}
+		if !pinnedClientMatches("host-1-r0-d0abc", "host-1") || pinnedClientMatches("host-10-r0-d0abc", "host-1") {
+			t.Error("Expected replicas of the configured client_id to match the pin")
+		}
+	})
+
+	// Test that draining clients get no new connections
+	t.Run("skip draining clients", func(t *testing.T) {
+		draining := gw.clients["client2"]
+		draining.draining.Store(true)
+		defer draining.draining.Store(false)
+
+		for i := 0; i < 2; i++ {
+			client, err := gw.getClientByGroup("group1", "", "tcp")
+			if err != nil || client.ID != "client1" {
+				t.Errorf("Expected client1 while client2 drains, got %v, %v", client, err)
+			}
+		}
+		if client := gw.nextGroupClient("group1", "", "tcp", map[string]bool{"client1": true}); client != nil {
+			t.Errorf("Expected no retry candidate besides the draining client, got %s", client.ID)
+		}
+		if client := gw.getGroupClient("group1", "client2", "tcp"); client != nil {
+			t.Error("Expected sticky sessions to leave the draining client")
+		}
+	})
+
+	// Test that UDP connections only go to clients supporting UDP
+	t.Run("route by capabilities", func(t *testing.T) {
+		client2 := gw.clients["client2"]
+		client2.capabilities.Store(&protocol.Capabilities{SupportsUnix: true})
+		defer client2.capabilities.Store(nil)
+
+		for i := 0; i < 2; i++ {
+			client, err := gw.getClientByGroup("group1", "", "udp")
+			if err != nil || client.ID != "client1" {
+				t.Errorf("Expected client1 for UDP, got %v, %v", client, err)
+			}
+		}
+		if client := gw.nextGroupClient("group1", "", "udp", map[string]bool{"client1": true}); client != nil {
+			t.Errorf("Expected no UDP retry candidate besides client1, got %s", client.ID)
+		}
+		if client := gw.getGroupClient("group1", "client2", "tcp"); client == nil {
+			t.Error("Expected TCP connections to still reach client2")
+		}
+
+		_, err := gw.getClientByGroup("group1", "client2", "udp")
+		if utils.ErrorCodeOf(err) != utils.ErrCodeNoClientAvailable || !containsString(err.Error(), "supports udp") {
+			t.Errorf("Expected a clear error for a pinned client without UDP, got %v", err)
+		}
+
+		// A client at its advertised limit only gets connections no other client can take
+		client2.capabilities.Store(&protocol.Capabilities{SupportsUDP: true, MaxConns: 1})
+		client2.connMu.Lock()
+		client2.Conns["busy"] = &Conn{ID: "busy"}
+		client2.connMu.Unlock()
+		defer func() {
+			client2.connMu.Lock()
+			delete(client2.Conns, "busy")
+			client2.connMu.Unlock()
+		}()
+		for i := 0; i < 2; i++ {
+			client, err := gw.getClientByGroup("group1", "", "tcp")
+			if err != nil || client.ID != "client1" {
+				t.Errorf("Expected client1 while client2 is full, got %v, %v", client, err)
+			}
+		}
+		if client := gw.getGroupClient("group1", "client2", "tcp"); client != nil {
+			t.Error("Expected sticky sessions to leave the full client")
+		}
+		if client, err := gw.getClientByGroup("group1", "client2", "tcp"); err != nil || client.ID != "client2" {
+			t.Errorf("Expected the full pinned client as last resort, got %v, %v", client, err)
+		}
+	})
+
+	// Test that least-loaded groups prefer the client reporting the lowest load
+	t.Run("least loaded balancing", func(t *testing.T) {
+		gw.config.GroupDefaults.Balancing = config.BalancingLeastLoaded
+		defer func() { gw.config.GroupDefaults.Balancing = "" }()
+		client1, client2 := gw.clients["client1"], gw.clients["client2"]
+		busy, idle := 0.9, 0.2
+		client1.loadScore.Store(&busy)
+		client2.loadScore.Store(&idle)
+		defer client1.loadScore.Store(nil)
+		defer client2.loadScore.Store(nil)
+
+		for i := 0; i < 3; i++ {
+			client, err := gw.getClientByGroup("group1", "", "tcp")
+			if err != nil || client.ID != "client2" {
+				t.Errorf("Expected the less loaded client2, got %v, %v", client, err)
+			}
+		}
+
+		// Similar scores fall back to the connections served through the gateway
+		client1.loadScore.Store(&idle)
+		client2.connMu.Lock()
+		client2.Conns["busy"] = &Conn{ID: "busy"}
+		client2.connMu.Unlock()
+		defer func() {
+			client2.connMu.Lock()
+			delete(client2.Conns, "busy")
+			client2.connMu.Unlock()
+		}()
+		if client, err := gw.getClientByGroup("group1", "", "tcp"); err != nil || client.ID != "client1" {
+			t.Errorf("Expected client1 serving fewer connections, got %v, %v", client, err)
+		}
+	})
+
 	// Test removing clients
 	t.Run("remove clients", func(t *testing.T) {
 		gw.removeClient("client1")
@@ -552,6 +680,7 @@ func TestGateway_StartStop(t *testing.T) {
 					ListenAddr: ":8081",
 				},
 			},
+			Startup: config.StartupConfig{BindBackoff: time.Millisecond},
 		},
 	}
 
@@ -1285,3 +1414,337 @@ func TestGateway_RaceConditionFix(t *testing.T) {
 		}
 	})
 }
+
+func TestGateway_GroupLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	credentialMgr, _ := credential.NewManager(&credential.Config{Type: credential.Memory})
+
+	gw := &Gateway{
+		clients:        make(map[string]*ClientConn),
+		groups:         make(map[string]*GroupInfo),
+		portForwardMgr: NewPortForwardManager(),
+		credentialMgr:  credentialMgr,
+		config: &config.GatewayConfig{
+			Groups: map[string]config.GroupConfig{
+				"limited": {MaxClients: 1, MaxConnections: 2},
+			},
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	newClient := func(id, groupID string) *ClientConn {
+		return &ClientConn{
+			ID:             id,
+			GroupID:        groupID,
+			Conn:           &mockConnection{clientID: id, groupID: groupID},
+			Conns:          make(map[string]*Conn),
+			msgChans:       make(map[string]chan map[string]interface{}),
+			ctx:            ctx,
+			cancel:         cancel,
+			portForwardMgr: gw.portForwardMgr,
+		}
+	}
+
+	t.Run("max clients", func(t *testing.T) {
+		if err := gw.addClient(newClient("client1", "limited")); err != nil {
+			t.Fatalf("First client should be accepted: %v", err)
+		}
+
+		err := gw.addClient(newClient("client2", "limited"))
+		if !errors.Is(err, utils.ErrGroupClientLimit) {
+			t.Errorf("Expected ErrGroupClientLimit, got %v", err)
+		}
+		if _, exists := gw.clients["client2"]; exists {
+			t.Error("Rejected client should not be registered")
+		}
+
+		// Reconnecting with the same client ID does not consume a new slot
+		if err := gw.addClient(newClient("client1", "limited")); err != nil {
+			t.Errorf("Reconnecting client should be accepted: %v", err)
+		}
+
+		// Groups without explicit limits are unlimited
+		for _, id := range []string{"free1", "free2", "free3"} {
+			if err := gw.addClient(newClient(id, "unlimited")); err != nil {
+				t.Errorf("Unlimited group should accept %s: %v", id, err)
+			}
+		}
+	})
+
+	t.Run("max connections", func(t *testing.T) {
+		release1, err := gw.acquireGroupConnection("limited")
+		if err != nil {
+			t.Fatalf("First connection should be accepted: %v", err)
+		}
+		release2, err := gw.acquireGroupConnection("limited")
+		if err != nil {
+			t.Fatalf("Second connection should be accepted: %v", err)
+		}
+
+		if _, err := gw.acquireGroupConnection("limited"); !errors.Is(err, utils.ErrGroupConnectionLimit) {
+			t.Errorf("Expected ErrGroupConnectionLimit, got %v", err)
+		}
+
+		// Releasing twice must only free one slot
+		release1()
+		release1()
+		if count := gw.getGroupConnectionCount("limited"); count != 1 {
+			t.Errorf("Expected 1 active connection, got %d", count)
+		}
+
+		release3, err := gw.acquireGroupConnection("limited")
+		if err != nil {
+			t.Errorf("Connection should be accepted after release: %v", err)
+		}
+		release2()
+		release3()
+		if count := gw.getGroupConnectionCount("limited"); count != 0 {
+			t.Errorf("Expected 0 active connections, got %d", count)
+		}
+	})
+}
+
+func TestGateway_StickySessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gw := &Gateway{
+		clients:        make(map[string]*ClientConn),
+		groups:         make(map[string]*GroupInfo),
+		portForwardMgr: NewPortForwardManager(),
+		sticky:         newStickyTable(),
+		config: &config.GatewayConfig{
+			Groups: map[string]config.GroupConfig{
+				"sticky": {StickySession: config.StickySessionSourceIP, StickyTTL: time.Minute},
+			},
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for _, id := range []string{"client1", "client2", "client3"} {
+		_ = gw.addClient(&ClientConn{
+			ID:       id,
+			GroupID:  "sticky",
+			Conn:     &mockConnection{clientID: id, groupID: "sticky"},
+			Conns:    make(map[string]*Conn),
+			msgChans: make(map[string]chan map[string]interface{}),
+			ctx:      ctx,
+			cancel:   cancel,
+		})
+	}
+
+	userA := &utils.UserContext{Username: "sticky", GroupID: "sticky", SourceIP: "10.0.0.1"}
+	userB := &utils.UserContext{Username: "sticky", GroupID: "sticky", SourceIP: "10.0.0.2"}
+
+	first, err := gw.selectClient(userA, "tcp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	other, err := gw.selectClient(userB, "tcp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if other.ID == first.ID {
+		t.Errorf("Different source IPs should be spread across clients, both got %s", first.ID)
+	}
+
+	for i := 0; i < 5; i++ {
+		client, err := gw.selectClient(userA, "tcp")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if client.ID != first.ID {
+			t.Errorf("Expected sticky client %s, got %s", first.ID, client.ID)
+		}
+	}
+
+	// When the bound client leaves, the user is rebound to another client
+	gw.removeClient(first.ID)
+	client, err := gw.selectClient(userA, "tcp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if client.ID == first.ID {
+		t.Error("Removed client should not be selected")
+	}
+	again, _ := gw.selectClient(userA, "tcp")
+	if again == nil || again.ID != client.ID {
+		t.Errorf("Expected new sticky client %s, got %v", client.ID, again)
+	}
+}
+
+// mockCountryLookup maps IP strings to country codes
+type mockCountryLookup map[string]string
+
+func (m mockCountryLookup) Country(ip net.IP) string {
+	return m[ip.String()]
+}
+
+func TestGateway_GeoIPPolicy(t *testing.T) {
+	policy := newGeoPolicyWithLookup(mockCountryLookup{
+		"203.0.113.7":  "KP",
+		"198.51.100.1": "US",
+		"192.0.2.10":   "CN",
+	}, config.GeoIPConfig{
+		ResolveTargets: true,
+		Rules: []config.GeoIPRule{
+			{Match: config.GeoIPMatchSource, Countries: []string{"kp"}, Action: config.GeoIPActionBlock},
+			{Match: config.GeoIPMatchTarget, Countries: []string{"CN"}, Action: config.GeoIPActionRoute, GroupID: "cn-egress"},
+			{Match: config.GeoIPMatchTarget, Countries: []string{"??"}, Action: config.GeoIPActionRoute, GroupID: "unknown-egress"},
+		},
+	})
+	policy.lookupIP = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if host == "example.cn" {
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.10")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	gw := &Gateway{geo: policy}
+
+	user := &utils.UserContext{Username: "alice", GroupID: "default", SourceIP: "198.51.100.1"}
+
+	// Blocked by source country
+	blocked := &utils.UserContext{Username: "bob", GroupID: "default", SourceIP: "203.0.113.7"}
+	if _, _, err := gw.applyGeoPolicy(context.Background(), blocked, "tcp", "198.51.100.1:443"); !errors.Is(err, utils.ErrGeoBlocked) {
+		t.Errorf("Expected ErrGeoBlocked, got %v", err)
+	}
+
+	// Routed by target country resolved from the hostname
+	routed, decision, err := gw.applyGeoPolicy(context.Background(), user, "tcp", "example.cn:443")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if routed.GroupID != "cn-egress" || user.GroupID != "default" {
+		t.Errorf("Expected routed copy in cn-egress, got %s (original %s)", routed.GroupID, user.GroupID)
+	}
+	if decision.SourceCountry != "US" || decision.TargetCountry != "CN" || decision.Rule != 1 {
+		t.Errorf("Unexpected decision: %+v", decision)
+	}
+
+	// Unknown target country matches "??"
+	routed, _, err = gw.applyGeoPolicy(context.Background(), user, "tcp", "unresolvable.example:80")
+	if err != nil || routed.GroupID != "unknown-egress" {
+		t.Errorf("Expected unknown-egress, got %v (err: %v)", routed, err)
+	}
+
+	// Known target without a matching rule keeps the user's group
+	routed, decision, err = gw.applyGeoPolicy(context.Background(), user, "tcp", "198.51.100.1:80")
+	if err != nil || routed != user || decision.Rule != -1 {
+		t.Errorf("Expected no rule to match, got %+v (err: %v)", decision, err)
+	}
+
+	// Disabled policy passes the user context through
+	disabled := &Gateway{}
+	if routed, _, err := disabled.applyGeoPolicy(context.Background(), user, "tcp", "example.cn:443"); err != nil || routed != user {
+		t.Errorf("Expected passthrough without Geo-IP, got %v (err: %v)", routed, err)
+	}
+}
+
+func TestGateway_ResourceGuard(t *testing.T) {
+	if newResourceGuard(config.ResourceLimitsConfig{}) != nil {
+		t.Error("Expected no guard without limits")
+	}
+
+	guard := newResourceGuard(config.ResourceLimitsConfig{MaxConnections: 2, MaxGoroutines: 100})
+	goroutines := 10
+	guard.readUsage = func() (int, uint64) { return goroutines, 0 }
+
+	// Open connection limit
+	release1, err := guard.acquire()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	release2, err := guard.acquire()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := guard.acquire(); !errors.Is(err, utils.ErrResourceLimit) {
+		t.Errorf("Expected ErrResourceLimit at max_connections, got %v", err)
+	}
+	release1()
+	release1() // Releasing twice must not free a second slot
+	release3, err := guard.acquire()
+	if err != nil {
+		t.Fatalf("Expected a freed slot, got %v", err)
+	}
+	if _, err := guard.acquire(); err == nil {
+		t.Error("Double release should not free an extra slot")
+	}
+	release2()
+	release3()
+
+	// Goroutine limit with hysteresis
+	goroutines = 150
+	guard.check()
+	if _, err := guard.acquire(); !errors.Is(err, utils.ErrResourceLimit) {
+		t.Errorf("Expected shedding above max_goroutines, got %v", err)
+	}
+	goroutines = 95 // Below the limit but above the recovery threshold
+	guard.check()
+	if _, err := guard.acquire(); err == nil {
+		t.Error("Expected shedding to continue until usage drops below the recovery threshold")
+	}
+	goroutines = 50
+	guard.check()
+	release, err := guard.acquire()
+	if err != nil {
+		t.Errorf("Expected dials to be accepted after recovery, got %v", err)
+	} else {
+		release()
+	}
+
+	// A nil guard admits everything
+	var disabled *resourceGuard
+	if release, err := disabled.acquire(); err != nil || release == nil {
+		t.Errorf("Expected nil guard to admit dials, got %v", err)
+	}
+}
+
+func TestGateway_NewProxyGroups(t *testing.T) {
+	credentialMgr, err := credential.NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, groupID := range []string{"team-a", "team-b"} {
+		if err := credentialMgr.RegisterGroup(groupID, groupID+"-pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gw := &Gateway{config: &config.GatewayConfig{}, credentialMgr: credentialMgr}
+
+	dial := func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("no client in test")
+	}
+	proxy, err := gw.newProxy(config.ProxyListener{Type: config.ProxyTypeHTTP, Addr: "127.0.0.1:0", Groups: []string{"team-a"}}, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, ok := proxy.(http.Handler)
+	if !ok {
+		t.Fatal("Expected the HTTP proxy to be an http.Handler")
+	}
+
+	status := func(groupID string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.SetBasicAuth(groupID, groupID+"-pass")
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := status("team-b"); code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected groups outside the listener's groups to be refused, got %d", code)
+	}
+	if code := status("team-a"); code == http.StatusProxyAuthRequired {
+		t.Error("Expected the listener's group to be admitted")
+	}
+
+	if _, err := gw.newProxy(config.ProxyListener{Type: "shadowsocks"}, dial); err == nil {
+		t.Error("Expected an error for an unknown proxy type")
+	}
+}
@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/geoip"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// unknownCountry matches addresses the database has no country for
+const unknownCountry = "??"
+
+// targetResolveTimeout bounds gateway-side DNS lookups for target countries
+const targetResolveTimeout = 2 * time.Second
+
+// countryLookup returns the ISO country code of an IP, or "" when unknown
+type countryLookup interface {
+	Country(ip net.IP) string
+}
+
+// geoPolicy enriches dials with source/target countries and applies country rules
+type geoPolicy struct {
+	db             countryLookup
+	resolveTargets bool
+	rules          []config.GeoIPRule
+	lookupIP       func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// geoDecision is the result of evaluating the Geo-IP policy for a dial
+type geoDecision struct {
+	SourceCountry string
+	TargetCountry string
+	Blocked       bool
+	RouteGroup    string // Group that should serve the dial, "" keeps the user's group
+	Rule          int    // Index of the matching rule, -1 when none matched
+}
+
+// newGeoPolicy opens the Geo-IP database, returns nil when Geo-IP is not configured
+func newGeoPolicy(cfg config.GeoIPConfig) (*geoPolicy, error) {
+	if cfg.Database == "" {
+		return nil, nil
+	}
+
+	db, err := geoip.Open(cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Geo-IP database loaded", "database", cfg.Database, "type", db.DatabaseType(), "rules", len(cfg.Rules), "resolve_targets", cfg.ResolveTargets)
+
+	return newGeoPolicyWithLookup(db, cfg), nil
+}
+
+// newGeoPolicyWithLookup creates a policy on top of an already opened database
+func newGeoPolicyWithLookup(db countryLookup, cfg config.GeoIPConfig) *geoPolicy {
+	rules := make([]config.GeoIPRule, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		rules[i] = rule
+		rules[i].Countries = make([]string, len(rule.Countries))
+		for j, country := range rule.Countries {
+			rules[i].Countries[j] = strings.ToUpper(strings.TrimSpace(country))
+		}
+	}
+
+	return &geoPolicy{
+		db:             db,
+		resolveTargets: cfg.ResolveTargets,
+		rules:          rules,
+		lookupIP:       net.DefaultResolver.LookupIPAddr,
+	}
+}
+
+// sourceCountry returns the country of the proxy user's IP
+func (p *geoPolicy) sourceCountry(sourceIP string) string {
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return ""
+	}
+	return p.db.Country(ip)
+}
+
+// targetCountry returns the country of the dial destination, resolving hostnames only when enabled
+func (p *geoPolicy) targetCountry(ctx context.Context, addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.db.Country(ip)
+	}
+	if !p.resolveTargets {
+		return ""
+	}
+
+	resolveCtx, cancel := context.WithTimeout(ctx, targetResolveTimeout)
+	defer cancel()
+	addrs, err := p.lookupIP(resolveCtx, host)
+	if err != nil || len(addrs) == 0 {
+		logger.Debug("Failed to resolve target for Geo-IP lookup", "host", host, "err", err)
+		return ""
+	}
+	return p.db.Country(addrs[0].IP)
+}
+
+// evaluate looks up both countries and returns the first matching rule's decision
+func (p *geoPolicy) evaluate(ctx context.Context, userCtx *utils.UserContext, addr string) geoDecision {
+	decision := geoDecision{
+		SourceCountry: p.sourceCountry(userCtx.SourceIP),
+		TargetCountry: p.targetCountry(ctx, addr),
+		Rule:          -1,
+	}
+
+	for i, rule := range p.rules {
+		country := decision.SourceCountry
+		if rule.Match == config.GeoIPMatchTarget {
+			country = decision.TargetCountry
+		}
+		if !matchesCountry(rule.Countries, country) {
+			continue
+		}
+
+		decision.Rule = i
+		switch rule.Action {
+		case config.GeoIPActionBlock:
+			decision.Blocked = true
+		case config.GeoIPActionRoute:
+			decision.RouteGroup = rule.GroupID
+		}
+		break
+	}
+	return decision
+}
+
+// matchesCountry reports whether country is in the list, "??" matches unknown countries
+func matchesCountry(countries []string, country string) bool {
+	if country == "" {
+		country = unknownCountry
+	}
+	for _, c := range countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+// applyGeoPolicy evaluates the Geo-IP policy and returns the user context the dial should use
+func (g *Gateway) applyGeoPolicy(ctx context.Context, userCtx *utils.UserContext, network, addr string) (*utils.UserContext, geoDecision, error) {
+	if g.geo == nil {
+		return userCtx, geoDecision{Rule: -1}, nil
+	}
+
+	decision := g.geo.evaluate(ctx, userCtx, addr)
+	if decision.Blocked {
+		logger.Warn("Geo-IP policy blocked dial", "group_id", userCtx.GroupID, "source_ip", userCtx.SourceIP, "source_country", decision.SourceCountry, "network", network, "address", addr, "target_country", decision.TargetCountry, "rule", decision.Rule)
+		return nil, decision, fmt.Errorf("%w: rule %d", utils.ErrGeoBlocked, decision.Rule)
+	}
+
+	if decision.RouteGroup != "" && decision.RouteGroup != userCtx.GroupID {
+		logger.Info("Geo-IP policy rerouted dial", "group_id", userCtx.GroupID, "route_group_id", decision.RouteGroup, "source_country", decision.SourceCountry, "network", network, "address", addr, "target_country", decision.TargetCountry, "rule", decision.Rule)
+		routed := *userCtx
+		routed.GroupID = decision.RouteGroup
+		routed.ClientID = "" // The pinned client belongs to the original group
+		return &routed, decision, nil
+	}
+
+	return userCtx, decision, nil
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"slices"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// releaseEmptyGroup handles a group that lost its last client: it is removed right away, after
+// the configured grace period, or never when it is kept. g.groupsMu must be held.
+func (g *Gateway) releaseEmptyGroup(groupID string, groupInfo *GroupInfo) {
+	gc := g.config.GroupGC
+	if slices.Contains(gc.Keep, groupID) {
+		logger.Debug("Keeping empty group", "group_id", groupID)
+		return
+	}
+	if gc.GracePeriod <= 0 {
+		g.removeEmptyGroup(groupID)
+		return
+	}
+
+	groupInfo.cancelRelease()
+	since := time.Now()
+	groupInfo.emptySince = since
+	logger.Debug("Group is empty, removing it after the grace period", "group_id", groupID, "grace_period", gc.GracePeriod)
+	groupInfo.releaseTimer = time.AfterFunc(gc.GracePeriod, func() {
+		g.collectGroup(groupID, since)
+	})
+}
+
+// cancelRelease stops the pending removal of the group. g.groupsMu must be held.
+func (gi *GroupInfo) cancelRelease() {
+	gi.emptySince = time.Time{}
+	if gi.releaseTimer != nil {
+		gi.releaseTimer.Stop()
+		gi.releaseTimer = nil
+	}
+}
+
+// stopGroupReleases stops the pending removals of empty groups when the gateway stops
+func (g *Gateway) stopGroupReleases() {
+	g.groupsMu.Lock()
+	defer g.groupsMu.Unlock()
+	for _, groupInfo := range g.groups {
+		groupInfo.cancelRelease()
+	}
+}
+
+// collectGroup removes a group at the end of its grace period unless a client joined it since.
+// A timer that fired while its release was canceled finds emptySince changed.
+func (g *Gateway) collectGroup(groupID string, since time.Time) {
+	g.clientsMu.Lock()
+	defer g.clientsMu.Unlock()
+	g.groupsMu.Lock()
+	defer g.groupsMu.Unlock()
+
+	groupInfo, ok := g.groups[groupID]
+	if !ok || len(groupInfo.Clients) > 0 || !groupInfo.emptySince.Equal(since) {
+		return
+	}
+	g.removeEmptyGroup(groupID)
+}
+
+// removeEmptyGroup deletes a group and, with memory storage, its credentials. g.groupsMu must be held.
+func (g *Gateway) removeEmptyGroup(groupID string) {
+	delete(g.groups, groupID)
+	// Only remove from credential manager if using memory storage
+	// For file/db storage, credentials are persistent
+	if g.config.Credential == nil || g.config.Credential.Type == "memory" || g.config.Credential.Type == "" {
+		g.groupSecrets.remove(groupID)
+		if err := g.credentialMgr.RemoveGroup(groupID); err != nil {
+			logger.Error("Failed to remove group from credential manager", "group_id", groupID, "err", err)
+		}
+		logger.Debug("Removed group credentials from memory", "group_id", groupID)
+	} else {
+		logger.Debug("Keeping persistent group credentials", "group_id", groupID, "storage_type", g.config.Credential.Type)
+	}
+}
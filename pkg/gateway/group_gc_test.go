@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// newGroupGCGateway returns a gateway with the group GC config and a function adding clients
+func newGroupGCGateway(t *testing.T, gc config.GroupGCConfig) (*Gateway, func(clientID, groupID string)) {
+	t.Helper()
+	gw, err := NewGateway(&config.Config{Gateway: config.GatewayConfig{
+		ListenAddr: ":8080",
+		GroupGC:    gc,
+	}}, "memory")
+	if err != nil {
+		t.Fatalf("Failed to create gateway: %v", err)
+	}
+	join := func(clientID, groupID string) {
+		t.Helper()
+		if err := gw.credentialMgr.RegisterGroup(groupID, "pass"); err != nil {
+			t.Fatalf("RegisterGroup() error = %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		gw.groupsMu.Lock()
+		if _, ok := gw.groups[groupID]; !ok {
+			gw.groups[groupID] = &GroupInfo{}
+		}
+		gw.groupsMu.Unlock()
+		if err := gw.addClient(&ClientConn{
+			ID:             clientID,
+			GroupID:        groupID,
+			Conn:           &mockConnection{clientID: clientID, groupID: groupID},
+			Conns:          make(map[string]*Conn),
+			msgChans:       make(map[string]chan map[string]interface{}),
+			ctx:            ctx,
+			cancel:         cancel,
+			portForwardMgr: gw.portForwardMgr,
+		}); err != nil {
+			t.Fatalf("addClient() error = %v", err)
+		}
+	}
+	return gw, join
+}
+
+func TestGateway_GroupGC(t *testing.T) {
+	const grace = 50 * time.Millisecond
+	gw, join := newGroupGCGateway(t, config.GroupGCConfig{GracePeriod: grace, Keep: []string{"pinned"}})
+	exists := func(groupID string) bool {
+		gw.groupsMu.RLock()
+		defer gw.groupsMu.RUnlock()
+		_, ok := gw.groups[groupID]
+		return ok && gw.credentialMgr.ValidateGroup(groupID, "pass")
+	}
+
+	// A client reconnecting within the grace period keeps the group and its credentials
+	join("c1", "g1")
+	gw.removeClient("c1")
+	if !exists("g1") {
+		t.Fatal("Empty group should be kept during the grace period")
+	}
+	join("c2", "g1")
+	time.Sleep(2 * grace)
+	if !exists("g1") {
+		t.Fatal("Group rejoined within the grace period should not be removed")
+	}
+
+	// Groups stay empty for the grace period before removal, listed groups never are removed
+	gw.removeClient("c2")
+	join("c3", "pinned")
+	gw.removeClient("c3")
+	deadline := time.Now().Add(time.Second)
+	for exists("g1") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if exists("g1") {
+		t.Error("Empty group should be removed after the grace period")
+	}
+	if !exists("pinned") {
+		t.Error("Kept group should not be removed")
+	}
+}
+
+func TestGateway_GroupGCCancel(t *testing.T) {
+	const grace = 100 * time.Millisecond
+	gw, join := newGroupGCGateway(t, config.GroupGCConfig{GracePeriod: grace})
+	releasePending := func(groupID string) bool {
+		gw.groupsMu.RLock()
+		defer gw.groupsMu.RUnlock()
+		groupInfo, ok := gw.groups[groupID]
+		return ok && groupInfo.releaseTimer != nil
+	}
+
+	// Re-adding the group within the grace period stops its pending removal
+	join("c1", "g1")
+	gw.removeClient("c1")
+	if !releasePending("g1") {
+		t.Fatal("Expected a pending removal of the empty group")
+	}
+	join("c2", "g1")
+	if releasePending("g1") {
+		t.Error("Expected the pending removal to stop when the group is re-added")
+	}
+
+	// Stopping the gateway stops pending removals, the group outlives its grace period
+	gw.removeClient("c2")
+	if !releasePending("g1") {
+		t.Fatal("Expected a pending removal of the empty group")
+	}
+	if err := gw.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if releasePending("g1") {
+		t.Error("Expected Stop to stop the pending removal")
+	}
+	time.Sleep(2 * grace)
+	gw.groupsMu.RLock()
+	_, ok := gw.groups["g1"]
+	gw.groupsMu.RUnlock()
+	if !ok {
+		t.Error("Group should not be removed after the gateway stopped")
+	}
+}
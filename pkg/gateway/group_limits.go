@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// acquireGroupConnection reserves a proxied connection slot for the group.
+// The returned release function must be called exactly once when the connection ends.
+func (g *Gateway) acquireGroupConnection(groupID string) (func(), error) {
+	maxConns := g.config.GetGroupConfig(groupID).MaxConnections
+
+	g.groupsMu.Lock()
+	defer g.groupsMu.Unlock()
+
+	if g.groupConns == nil {
+		g.groupConns = make(map[string]int)
+	}
+
+	active := g.groupConns[groupID]
+	if maxConns > 0 && active >= maxConns {
+		logger.Warn("Group connection limit reached", "group_id", groupID, "active_connections", active, "max_connections", maxConns)
+		return nil, fmt.Errorf("%w: group %s allows %d connections", utils.ErrGroupConnectionLimit, groupID, maxConns)
+	}
+	g.groupConns[groupID] = active + 1
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.groupsMu.Lock()
+			defer g.groupsMu.Unlock()
+
+			if g.groupConns[groupID] <= 1 {
+				delete(g.groupConns, groupID)
+				return
+			}
+			g.groupConns[groupID]--
+		})
+	}, nil
+}
+
+// peekGroupConnection returns the error acquireGroupConnection would return now, without
+// reserving a slot
+func (g *Gateway) peekGroupConnection(groupID string) error {
+	maxConns := g.config.GetGroupConfig(groupID).MaxConnections
+	if maxConns > 0 && g.getGroupConnectionCount(groupID) >= maxConns {
+		return fmt.Errorf("%w: group %s allows %d connections", utils.ErrGroupConnectionLimit, groupID, maxConns)
+	}
+	return nil
+}
+
+// getGroupConnectionCount returns the number of active proxied connections for a group
+func (g *Gateway) getGroupConnectionCount(groupID string) int {
+	g.groupsMu.RLock()
+	defer g.groupsMu.RUnlock()
+	return g.groupConns[groupID]
+}
+
+// checkGroupClientLimit verifies that a client may join its group (caller must hold groupsMu)
+func (g *Gateway) checkGroupClientLimit(client *ClientConn) error {
+	maxClients := g.config.GetGroupConfig(client.GroupID).MaxClients
+	if maxClients <= 0 {
+		return nil
+	}
+
+	groupInfo, ok := g.groups[client.GroupID]
+	if !ok {
+		return nil
+	}
+
+	// A reconnecting client replaces its old entry and does not take a new slot
+	registered := 0
+	for _, id := range groupInfo.Clients {
+		if id != client.ID {
+			registered++
+		}
+	}
+
+	if registered >= maxClients {
+		return fmt.Errorf("%w: group %s allows %d clients", utils.ErrGroupClientLimit, client.GroupID, maxClients)
+	}
+	return nil
+}
+
+// limitedConn releases the group connection slot when the proxy closes the connection
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+// Close closes the underlying connection and releases the group slot
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// groupSecrets keeps the passwords registered by clients and the admin API in memory, HTTP
+// listeners offering Digest authentication check responses with them. The credential store only
+// keeps hashes, so groups whose password was never registered with this process can't use Digest.
+type groupSecrets struct {
+	mu        sync.RWMutex
+	passwords map[string]string
+}
+
+// newGroupSecrets returns the secrets when a proxy listener offers Digest, nil otherwise
+func newGroupSecrets(proxy config.ProxyConfig) *groupSecrets {
+	for _, listener := range proxy.AllListeners() {
+		if listener.Type == config.ProxyTypeHTTP && listener.HTTP.OffersAuthScheme(config.HTTPAuthDigest) {
+			return &groupSecrets{passwords: make(map[string]string)}
+		}
+	}
+	return nil
+}
+
+func (s *groupSecrets) set(groupID, password string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwords[groupID] = password
+}
+
+func (s *groupSecrets) remove(groupID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.passwords, groupID)
+}
+
+func (s *groupSecrets) get(groupID string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	password, ok := s.passwords[groupID]
+	return password, ok
+}
+
+// groupPasswords returns the passwords accepted for a group, its own before those of the parents
+// it delegates to
+func (g *Gateway) groupPasswords(groupID string) []string {
+	var passwords []string
+	if password, ok := g.groupSecrets.get(groupID); ok {
+		passwords = append(passwords, password)
+	}
+	if g.subGroups != nil {
+		for _, parent := range g.subGroups.ancestors(groupID) {
+			if !g.subGroups.delegates(parent, groupID) {
+				continue
+			}
+			if password, ok := g.groupSecrets.get(parent); ok {
+				passwords = append(passwords, password)
+			}
+		}
+	}
+	return passwords
+}
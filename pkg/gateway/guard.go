@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultGuardInterval is used when resource_limits.check_interval is not set
+const defaultGuardInterval = time.Second
+
+// guardRecoveryRatio is the fraction of a limit usage must drop below before shedding stops,
+// so the gateway does not flap around the threshold
+const guardRecoveryRatio = 0.9
+
+// resourceGuard sheds new dials when goroutines, open connections or heap usage exceed their limits
+type resourceGuard struct {
+	limits      config.ResourceLimitsConfig
+	activeConns int64 // Open proxied connections across all groups
+	shedding    int32 // Set while sampled usage is above a limit
+	mu          sync.Mutex
+	reason      string // Why the guard is shedding (protected by mu)
+	readUsage   func() (goroutines int, heapBytes uint64)
+}
+
+// newResourceGuard creates a guard, returns nil when no limit is configured
+func newResourceGuard(limits config.ResourceLimitsConfig) *resourceGuard {
+	if limits.MaxGoroutines <= 0 && limits.MaxConnections <= 0 && limits.MaxHeapMB <= 0 {
+		return nil
+	}
+	return &resourceGuard{
+		limits:    limits,
+		readUsage: readRuntimeUsage,
+	}
+}
+
+// readRuntimeUsage samples the goroutine count and heap size of the process
+func readRuntimeUsage() (int, uint64) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return runtime.NumGoroutine(), stats.HeapAlloc
+}
+
+// run samples resource usage until ctx is canceled
+func (r *resourceGuard) run(ctx context.Context) {
+	interval := r.limits.CheckInterval
+	if interval <= 0 {
+		interval = defaultGuardInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.check()
+		}
+	}
+}
+
+// check samples usage once and updates the shedding state
+func (r *resourceGuard) check() {
+	goroutines, heapBytes := r.readUsage()
+	heapMB := int(heapBytes >> 20)
+	shedding := atomic.LoadInt32(&r.shedding) == 1
+
+	// While shedding, usage must drop below the recovery ratio before new dials are accepted again
+	ratio := 1.0
+	if shedding {
+		ratio = guardRecoveryRatio
+	}
+
+	reason := ""
+	switch {
+	case r.limits.MaxGoroutines > 0 && float64(goroutines) > float64(r.limits.MaxGoroutines)*ratio:
+		reason = fmt.Sprintf("goroutines %d exceed limit %d", goroutines, r.limits.MaxGoroutines)
+	case r.limits.MaxHeapMB > 0 && float64(heapMB) > float64(r.limits.MaxHeapMB)*ratio:
+		reason = fmt.Sprintf("heap %dMiB exceeds limit %dMiB", heapMB, r.limits.MaxHeapMB)
+	}
+
+	switch {
+	case reason != "" && !shedding:
+		r.setReason(reason)
+		atomic.StoreInt32(&r.shedding, 1)
+		logger.Error("ALERT: gateway resource limit exceeded, shedding new dials", "reason", reason, "goroutines", goroutines, "heap_mb", heapMB, "active_connections", atomic.LoadInt64(&r.activeConns))
+	case reason == "" && shedding:
+		atomic.StoreInt32(&r.shedding, 0)
+		r.setReason("")
+		logger.Info("Gateway resource usage recovered, accepting new dials", "goroutines", goroutines, "heap_mb", heapMB, "active_connections", atomic.LoadInt64(&r.activeConns))
+	case reason != "":
+		r.setReason(reason)
+	}
+}
+
+// setReason records why the guard is shedding
+func (r *resourceGuard) setReason(reason string) {
+	r.mu.Lock()
+	r.reason = reason
+	r.mu.Unlock()
+}
+
+// peek returns the error acquire would return now, without admitting a dial
+func (r *resourceGuard) peek() error {
+	if r == nil {
+		return nil
+	}
+	if atomic.LoadInt32(&r.shedding) == 1 {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return fmt.Errorf("%w: %s", utils.ErrResourceLimit, r.reason)
+	}
+	if r.limits.MaxConnections > 0 && atomic.LoadInt64(&r.activeConns) >= int64(r.limits.MaxConnections) {
+		return fmt.Errorf("%w: %d open connections", utils.ErrResourceLimit, r.limits.MaxConnections)
+	}
+	return nil
+}
+
+// acquire admits a new dial and returns a release func, or ErrResourceLimit when shedding
+func (r *resourceGuard) acquire() (func(), error) {
+	if r == nil {
+		return func() {}, nil
+	}
+
+	if atomic.LoadInt32(&r.shedding) == 1 {
+		r.mu.Lock()
+		reason := r.reason
+		r.mu.Unlock()
+		monitoring.IncrementShedDials()
+		return nil, fmt.Errorf("%w: %s", utils.ErrResourceLimit, reason)
+	}
+
+	active := atomic.AddInt64(&r.activeConns, 1)
+	if r.limits.MaxConnections > 0 && active > int64(r.limits.MaxConnections) {
+		atomic.AddInt64(&r.activeConns, -1)
+		monitoring.IncrementShedDials()
+		logger.Warn("Gateway connection limit reached, shedding dial", "active_connections", active-1, "max_connections", r.limits.MaxConnections)
+		return nil, fmt.Errorf("%w: %d open connections", utils.ErrResourceLimit, r.limits.MaxConnections)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&r.activeConns, -1)
+		})
+	}, nil
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Statuses of health checks
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+// healthCheckTimeout bounds the credential backend check of a readiness probe
+const healthCheckTimeout = 2 * time.Second
+
+// HealthCheck is the result of checking one gateway component
+type HealthCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	State    string `json:"state,omitempty"`    // State of a listener, e.g. ComponentRetrying
+	Attempts int    `json:"attempts,omitempty"` // Attempts to start a listener so far
+	Error    string `json:"error,omitempty"`
+}
+
+// HealthReport is the result of a liveness or readiness probe
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// OK reports whether every check of the report passed
+func (r *HealthReport) OK() bool {
+	return r.Status == HealthStatusOK
+}
+
+// add appends a check, failing the report when err is set
+func (r *HealthReport) add(name string, err error) {
+	check := HealthCheck{Name: name, Status: HealthStatusOK}
+	if err != nil {
+		check.Status = HealthStatusFail
+		check.Error = err.Error()
+		r.Status = HealthStatusFail
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// addComponent appends the check of a listener, failing the report unless it serves
+func (r *HealthReport) addComponent(name string, state componentState) {
+	var err error
+	switch {
+	case state.state == ComponentServing:
+	case state.err != nil:
+		err = fmt.Errorf("listener is %s: %w", state.state, state.err)
+	case state.state != "":
+		err = fmt.Errorf("listener is %s", state.state)
+	default:
+		err = fmt.Errorf("listener is not started")
+	}
+	r.add(name, err)
+	r.Checks[len(r.Checks)-1].State = state.state
+	r.Checks[len(r.Checks)-1].Attempts = state.attempts
+}
+
+// CheckHealth reports whether the transport, proxy and ingress listeners are serving, for liveness probes
+func (g *Gateway) CheckHealth() *HealthReport {
+	report := &HealthReport{Status: HealthStatusOK}
+	report.addComponent("transport", g.components.get("transport"))
+	for i := range g.proxies {
+		name := g.proxyComponent(i)
+		report.addComponent(name, g.components.get(name))
+	}
+	for _, mapping := range g.config.Ingress {
+		name := ingressComponent(mapping.ListenAddr)
+		report.addComponent(name, g.components.get(name))
+	}
+	return report
+}
+
+// CheckReadiness additionally checks the credential backend, for probes gating traffic
+func (g *Gateway) CheckReadiness(ctx context.Context) *HealthReport {
+	report := g.CheckHealth()
+	if g.credentialMgr != nil {
+		ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+		report.add("credentials", g.credentialMgr.Ping(ctx))
+	}
+	return report
+}
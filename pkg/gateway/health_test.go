@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/credential"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestGateway_Health(t *testing.T) {
+	credentialMgr, err := credential.NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := &Gateway{
+		config: &config.GatewayConfig{
+			ListenAddr: ":8443",
+			Proxy: config.ProxyConfig{
+				HTTP:   config.HTTPConfig{ListenAddr: ":8080"},
+				SOCKS5: config.SOCKS5Config{ListenAddr: ":1080"},
+			},
+		},
+		proxies:       make([]utils.GatewayProxy, 2),
+		credentialMgr: credentialMgr,
+	}
+
+	// Nothing serves before Start
+	report := gw.CheckHealth()
+	if report.OK() || len(report.Checks) != 3 {
+		t.Fatalf("Expected a failing report with 3 checks, got %+v", report)
+	}
+
+	gw.components.set("transport", ComponentServing, 1, nil)
+	gw.components.set("proxy_http_:8080", ComponentServing, 1, nil)
+	gw.components.set("proxy_socks5_:1080", ComponentRetrying, 3, errors.New("address already in use"))
+	report = gw.CheckHealth()
+	if report.OK() || report.Checks[1].Status != HealthStatusOK || report.Checks[2].Status != HealthStatusFail {
+		t.Errorf("Expected only the second proxy to fail, got %+v", report)
+	}
+	if check := report.Checks[2]; check.State != ComponentRetrying || check.Attempts != 3 || !strings.Contains(check.Error, "address already in use") {
+		t.Errorf("Expected the retrying proxy's state and error, got %+v", check)
+	}
+
+	gw.components.set("proxy_socks5_:1080", ComponentServing, 4, nil)
+	report = gw.CheckReadiness(context.Background())
+	if !report.OK() || len(report.Checks) != 4 || report.Checks[3].Name != "credentials" {
+		t.Errorf("Expected a ready gateway, got %+v", report)
+	}
+}
@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// markUsed records that a connection of the client was opened or closed
+func (c *ClientConn) markUsed() {
+	c.lastUsed.Store(time.Now().UnixNano())
+}
+
+// Hibernating reports whether the client hibernates
+func (c *ClientConn) Hibernating() bool {
+	return c.hibernating.Load()
+}
+
+// hibernate puts the client into hibernation when it had no connections for idleAfter at now.
+// Go maps keep their buckets after deletes, fresh ones release the memory of past connections.
+func (c *ClientConn) hibernate(now time.Time, idleAfter time.Duration) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.hibernating.Load() || len(c.Conns) > 0 || len(c.msgChans) > 0 || now.Sub(time.Unix(0, c.lastUsed.Load())) < idleAfter {
+		return false
+	}
+	c.Conns = make(map[string]*Conn)
+	c.msgChans = make(map[string]chan map[string]interface{})
+	c.hibernating.Store(true)
+	return true
+}
+
+// resume wakes the client from hibernation, called whenever it gets a new connection
+func (c *ClientConn) resume() {
+	c.markUsed()
+	if !c.hibernating.CompareAndSwap(true, false) {
+		return
+	}
+	select {
+	case c.resumed <- struct{}{}:
+	default:
+	}
+	logger.Info("Client resumed from hibernation", "client_id", c.ID, "group_id", c.GroupID)
+}
+
+// waitResume blocks until the client resumes, false when it stops first
+func (c *ClientConn) waitResume() bool {
+	select {
+	case <-c.ctx.Done():
+		return false
+	case <-c.resumed:
+		return true
+	}
+}
+
+// hibernateIdleClients periodically puts clients without connections into hibernation
+func (g *Gateway) hibernateIdleClients() {
+	idleAfter := g.config.Hibernation.IdleAfter
+	ticker := time.NewTicker(idleAfter / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.hibernateIdle(now, idleAfter)
+		}
+	}
+}
+
+// hibernateIdle puts every client without connections for idleAfter at now into hibernation
+func (g *Gateway) hibernateIdle(now time.Time, idleAfter time.Duration) {
+	g.clientsMu.RLock()
+	clients := make([]*ClientConn, 0, len(g.clients))
+	for _, client := range g.clients {
+		clients = append(clients, client)
+	}
+	g.clientsMu.RUnlock()
+
+	for _, client := range clients {
+		if client.hibernate(now, idleAfter) {
+			logger.Info("Client hibernating", "client_id", client.ID, "group_id", client.GroupID, "idle_after", idleAfter)
+		}
+	}
+}
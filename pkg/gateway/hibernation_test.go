@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestClientConn_Hibernate(t *testing.T) {
+	client, _ := createTestClientConn()
+	defer client.Stop()
+	client.resumed = make(chan struct{}, 1)
+
+	now := time.Now()
+	client.lastUsed.Store(now.Add(-time.Minute).UnixNano())
+	if client.hibernate(now, 2*time.Minute) {
+		t.Fatal("Expected a recently used client not to hibernate")
+	}
+
+	client.Conns["conn1"] = &Conn{ID: "conn1", Done: make(chan struct{})}
+	if client.hibernate(now, time.Second) {
+		t.Fatal("Expected a client with connections not to hibernate")
+	}
+	delete(client.Conns, "conn1")
+
+	if !client.hibernate(now, time.Second) || !client.Hibernating() {
+		t.Fatal("Expected an idle client to hibernate")
+	}
+	if client.hibernate(now, time.Second) {
+		t.Error("Expected a hibernating client not to hibernate again")
+	}
+
+	// A new connection resumes the client and wakes its idle probes
+	client.resume()
+	if client.Hibernating() {
+		t.Error("Expected the client to resume")
+	}
+	select {
+	case <-client.resumed:
+	default:
+		t.Error("Expected the idle probes to be woken")
+	}
+	if client.hibernate(time.Now(), time.Second) {
+		t.Error("Expected a resumed client to count as recently used")
+	}
+}
+
+func TestGateway_HibernateIdle(t *testing.T) {
+	idle, _ := createTestClientConn()
+	defer idle.Stop()
+	busy, _ := createTestClientConn()
+	defer busy.Stop()
+	busy.ID = "busy-client"
+
+	now := time.Now()
+	idle.lastUsed.Store(now.Add(-time.Hour).UnixNano())
+	busy.lastUsed.Store(now.UnixNano())
+
+	g := &Gateway{
+		config:  &config.GatewayConfig{},
+		clients: map[string]*ClientConn{idle.ID: idle, busy.ID: busy},
+		groups:  map[string]*GroupInfo{"test-group": {Clients: []string{idle.ID, busy.ID}}},
+	}
+	g.hibernateIdle(now, time.Minute)
+
+	statuses := g.GetGroupStatus()
+	if len(statuses) != 1 || len(statuses[0].Hibernating) != 1 || statuses[0].Hibernating[0] != idle.ID {
+		t.Fatalf("Expected only %s to hibernate, got %+v", idle.ID, statuses)
+	}
+}
@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/identity"
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// defaultMaxClockSkew is the accepted age of an identity proof
+const defaultMaxClockSkew = 5 * time.Minute
+
+// Client identity errors, sent to the refused client
+var (
+	errIdentityConflict = errors.New("client identity conflict: the client ID is pinned to another key")
+	errIdentityRequired = errors.New("client identity required: configure identity_key on the client")
+	errIdentityReplayed = errors.New("client identity proof was already used")
+)
+
+// identityPins binds client IDs to the key fingerprint that first proved them
+type identityPins struct {
+	require  bool
+	maxSkew  time.Duration
+	pinsFile string
+
+	mu   sync.Mutex
+	pins map[string]string    // Base client ID to key fingerprint
+	seen map[string]time.Time // Accepted proofs until they expire, refuses replays
+}
+
+// newIdentityPins loads the pins of cfg, nil when client identity pinning is disabled
+func newIdentityPins(cfg config.ClientIdentityConfig) (*identityPins, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	p := &identityPins{
+		require:  cfg.Require,
+		maxSkew:  cfg.MaxClockSkew,
+		pinsFile: cfg.PinsFile,
+		pins:     make(map[string]string),
+		seen:     make(map[string]time.Time),
+	}
+	if p.maxSkew <= 0 {
+		p.maxSkew = defaultMaxClockSkew
+	}
+
+	if p.pinsFile != "" {
+		data, err := os.ReadFile(p.pinsFile)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read client identity pins: %w", err)
+		default:
+			if err := json.Unmarshal(data, &p.pins); err != nil {
+				return nil, fmt.Errorf("invalid client identity pins file %s: %w", p.pinsFile, err)
+			}
+		}
+	}
+	// Configured pins override learned ones, e.g. to rotate a client's key
+	for clientID, fingerprint := range cfg.Pins {
+		p.pins[clientID] = fingerprint
+	}
+
+	logger.Info("Client identity pinning enabled", "pins", len(p.pins), "require", p.require, "pins_file", p.pinsFile)
+	return p, nil
+}
+
+// check verifies the identity proof of a connecting client and pins its ID on first use
+func (p *identityPins) check(conn transport.Connection) error {
+	clientID := conn.GetClientID()
+	baseID := identity.BaseClientID(clientID)
+	var proof string
+	if idConn, ok := conn.(transport.IdentityConnection); ok {
+		proof = idConn.GetClientIdentity()
+	}
+
+	now := time.Now()
+	fingerprint := ""
+	if proof != "" {
+		var err error
+		fingerprint, err = identity.VerifyProof(proof, clientID, conn.GetGroupID(), now, p.maxSkew)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pinned, isPinned := p.pins[baseID]
+	switch {
+	case isPinned && fingerprint != pinned:
+		p.alertConflict(conn, baseID, pinned, fingerprint)
+		return errIdentityConflict
+	case fingerprint == "" && p.require:
+		return errIdentityRequired
+	case fingerprint == "":
+		logger.Debug("Client connected without an identity proof", "client_id", clientID)
+		return nil
+	}
+
+	for seenProof, expires := range p.seen {
+		if now.After(expires) {
+			delete(p.seen, seenProof)
+		}
+	}
+	if _, replayed := p.seen[proof]; replayed {
+		p.alertConflict(conn, baseID, pinned, fingerprint)
+		return errIdentityReplayed
+	}
+	p.seen[proof] = now.Add(2 * p.maxSkew)
+
+	if !isPinned {
+		p.pins[baseID] = fingerprint
+		logger.Info("Pinned client identity", "client_id", baseID, "fingerprint", fingerprint, "remote_addr", conn.RemoteAddr())
+		if err := p.save(); err != nil {
+			logger.Error("Failed to save client identity pins", "pins_file", p.pinsFile, "err", err)
+		}
+	}
+	return nil
+}
+
+// alertConflict reports a client claiming a pinned ID, p.mu must be held
+func (p *identityPins) alertConflict(conn transport.Connection, baseID, pinned, presented string) {
+	monitoring.IncrementIdentityConflicts()
+	logger.Error("ALERT: client identity conflict, refusing connection", "client_id", conn.GetClientID(), "pinned_client_id", baseID, "group_id", conn.GetGroupID(),
+		"pinned_fingerprint", pinned, "presented_fingerprint", presented, "remote_addr", conn.RemoteAddr())
+}
+
+// save writes the pins file atomically, p.mu must be held
+func (p *identityPins) save() error {
+	if p.pinsFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p.pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.pinsFile), ".pins-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.pinsFile)
+}
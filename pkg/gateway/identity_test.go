@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/identity"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// identityConn is a client connection carrying an identity proof
+type identityConn struct {
+	mockConnection
+	proof string
+}
+
+func (c *identityConn) GetClientIdentity() string {
+	return c.proof
+}
+
+func newIdentityConn(t *testing.T, key ed25519.PrivateKey, clientID string) *identityConn {
+	t.Helper()
+	conn := &identityConn{mockConnection: mockConnection{clientID: clientID, groupID: "group-a"}}
+	if key != nil {
+		conn.proof = identity.NewProof(key, clientID, "group-a", time.Now())
+	}
+	return conn
+}
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	key, err := identity.LoadOrCreateKey(filepath.Join(t.TempDir(), "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestIdentityPins(t *testing.T) {
+	pinsFile := filepath.Join(t.TempDir(), "pins.json")
+	pins, err := newIdentityPins(config.ClientIdentityConfig{Enabled: true, PinsFile: pinsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, other := newTestKey(t), newTestKey(t)
+
+	// The first proof pins the configured ID, later replica IDs must prove the same key
+	if err := pins.check(newIdentityConn(t, owner, "edge-1-r0-cv2pq8hf2n0ctcfg7o10")); err != nil {
+		t.Fatalf("Expected the first connection to pin the ID, got %v", err)
+	}
+	if err := pins.check(newIdentityConn(t, owner, "edge-1-r1-cv2pq8hf2n0ctcfg7o20")); err != nil {
+		t.Errorf("Expected the pinned key to be accepted, got %v", err)
+	}
+	if err := pins.check(newIdentityConn(t, other, "edge-1-r0-cv2pq8hf2n0ctcfg7o30")); !errors.Is(err, errIdentityConflict) {
+		t.Errorf("Expected a conflict for another key, got %v", err)
+	}
+	if err := pins.check(newIdentityConn(t, nil, "edge-1")); !errors.Is(err, errIdentityConflict) {
+		t.Errorf("Expected a conflict without a proof for a pinned ID, got %v", err)
+	}
+
+	// A proof cannot be replayed or reused for another ID
+	conn := newIdentityConn(t, other, "edge-2")
+	if err := pins.check(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := pins.check(conn); !errors.Is(err, errIdentityReplayed) {
+		t.Errorf("Expected a replayed proof to be refused, got %v", err)
+	}
+	forged := newIdentityConn(t, nil, "edge-3")
+	forged.proof = conn.proof
+	if err := pins.check(forged); !errors.Is(err, identity.ErrInvalidProof) {
+		t.Errorf("Expected a proof of another ID to be invalid, got %v", err)
+	}
+
+	// Clients without a key are accepted while their ID is unpinned
+	if err := pins.check(newIdentityConn(t, nil, "legacy")); err != nil {
+		t.Errorf("Expected an unpinned client without a proof to be accepted, got %v", err)
+	}
+
+	// Pins survive a restart
+	data, err := os.ReadFile(pinsFile)
+	if err != nil || !strings.Contains(string(data), `"edge-1"`) || !strings.Contains(string(data), `"edge-2"`) {
+		t.Fatalf("Unexpected pins file: %s (err: %v)", data, err)
+	}
+	restarted, err := newIdentityPins(config.ClientIdentityConfig{Enabled: true, PinsFile: pinsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.check(newIdentityConn(t, other, "edge-1")); !errors.Is(err, errIdentityConflict) {
+		t.Errorf("Expected the reloaded pin to be enforced, got %v", err)
+	}
+}
+
+func TestIdentityPins_RequireAndConfiguredPins(t *testing.T) {
+	key := newTestKey(t)
+	fingerprint := identity.Fingerprint(key.Public().(ed25519.PublicKey))
+	pins, err := newIdentityPins(config.ClientIdentityConfig{Enabled: true, Require: true, Pins: map[string]string{"edge-1": fingerprint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pins.check(newIdentityConn(t, nil, "edge-9")); !errors.Is(err, errIdentityRequired) {
+		t.Errorf("Expected a proof to be required, got %v", err)
+	}
+	if err := pins.check(newIdentityConn(t, newTestKey(t), "edge-1")); !errors.Is(err, errIdentityConflict) {
+		t.Errorf("Expected the configured pin to refuse another key, got %v", err)
+	}
+	if err := pins.check(newIdentityConn(t, key, "edge-1")); err != nil {
+		t.Errorf("Expected the configured key to be accepted, got %v", err)
+	}
+
+	if disabled, err := newIdentityPins(config.ClientIdentityConfig{}); disabled != nil || err != nil {
+		t.Errorf("Expected no pins when disabled, got %v, %v", disabled, err)
+	}
+}
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// startIngress opens the listeners of the static ingress mappings. Their connections are dialed
+// through the mapping's group like proxy connections, the clients need no configuration.
+func (g *Gateway) startIngress() error {
+	for _, mapping := range g.config.Ingress {
+		name := ingressComponent(mapping.ListenAddr)
+		start := func() error { return g.listenIngress(mapping) }
+		if err := g.startWithRetry(name, start); err != nil {
+			logger.Error("Failed to open ingress listener", "listen_addr", mapping.ListenAddr, "group_id", mapping.GroupID, "target", mapping.Target, "err", err)
+			if g.config.Startup.KeepRetrying {
+				g.retryInBackground(name, start)
+				continue
+			}
+			g.listenersMu.Lock()
+			g.stopIngress()
+			g.listenersMu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// listenIngress opens the listener of an ingress mapping and serves it, g.listenersMu must be held
+func (g *Gateway) listenIngress(mapping config.IngressMapping) error {
+	listener, err := sockopt.Listen(g.ctx, protocol.ProtocolTCP, mapping.ListenAddr, &g.config.SocketOptions)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s for ingress to %s: %w", mapping.ListenAddr, mapping.Target, err)
+	}
+	g.ingress = append(g.ingress, listener)
+	logger.Info("Ingress listener started", "listen_addr", listener.Addr(), "group_id", mapping.GroupID, "target", mapping.Target)
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		g.serveIngress(listener, mapping)
+	}()
+	return nil
+}
+
+// stopIngress closes the ingress listeners, open connections end with their clients. g.listenersMu
+// must be held.
+func (g *Gateway) stopIngress() {
+	for _, listener := range g.ingress {
+		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Warn("Error closing ingress listener", "listen_addr", listener.Addr(), "err", err)
+		}
+	}
+	g.ingress = nil
+}
+
+// serveIngress accepts the connections of an ingress listener until it is closed
+func (g *Gateway) serveIngress(listener net.Listener, mapping config.IngressMapping) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("Error accepting ingress connection", "listen_addr", mapping.ListenAddr, "err", err)
+			}
+			return
+		}
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.handleIngress(conn, mapping)
+		}()
+	}
+}
+
+// handleIngress relays an ingress connection to the mapping's target through a client of its group
+func (g *Gateway) handleIngress(conn net.Conn, mapping config.IngressMapping) {
+	defer conn.Close()
+
+	connID := utils.GenerateConnID()
+	sourceIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	userCtx := &utils.UserContext{GroupID: mapping.GroupID, SourceIP: sourceIP}
+	ctx := commonctx.WithConnID(commonctx.WithUserContext(g.ctx, userCtx), connID)
+
+	dialCtx, cancel := context.WithTimeout(ctx, protocol.DefaultConnectTimeout)
+	target, err := g.dial(dialCtx, protocol.ProtocolTCP, mapping.Target)
+	cancel()
+	if err != nil {
+		logger.Warn("Ingress connection failed", "listen_addr", mapping.ListenAddr, "group_id", mapping.GroupID, "target", mapping.Target, "conn_id", connID, "remote_addr", conn.RemoteAddr(), "err", err)
+		return
+	}
+	defer target.Close()
+	logger.Debug("Ingress connection established", "listen_addr", mapping.ListenAddr, "group_id", mapping.GroupID, "target", mapping.Target, "conn_id", connID, "remote_addr", conn.RemoteAddr())
+
+	// A direction ending with EOF is half-closed and the other keeps going, errors end both
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(target, conn); err != nil {
+			_ = target.Close()
+			return
+		}
+		_ = connection.CloseWrite(target)
+	}()
+	if _, err := io.Copy(conn, target); err != nil {
+		_ = conn.Close()
+	} else {
+		_ = connection.CloseWrite(conn)
+	}
+	<-done
+}
@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestIngress(t *testing.T) {
+	dialed := make(chan string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g := &Gateway{
+		config: &config.GatewayConfig{Ingress: []config.IngressMapping{
+			{ListenAddr: "127.0.0.1:0", GroupID: "db-team", Target: "10.0.5.10:5432"},
+		}},
+		ctx: ctx,
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			userCtx, _ := commonctx.GetUserContext(ctx)
+			dialed <- userCtx.GroupID + " " + addr
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				_, _ = io.Copy(server, server)
+			}()
+			return client, nil
+		},
+	}
+	if err := g.startIngress(); err != nil {
+		t.Fatal(err)
+	}
+	defer g.stopIngress()
+
+	conn, err := net.Dial("tcp", g.ingress[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected the target's echo, got %q %v", buf, err)
+	}
+	if got := <-dialed; got != "db-team 10.0.5.10:5432" {
+		t.Errorf("Expected the mapping's target to be dialed through its group, got %q", got)
+	}
+}
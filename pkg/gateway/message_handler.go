@@ -1,5 +1,7 @@
 package gateway
 
+import "time"
+
 // readNextMessage reads the next message, using binary format completely
 func (c *ClientConn) readNextMessage() (map[string]interface{}, error) {
 	// Use shared message handler
@@ -12,10 +14,16 @@ func (c *ClientConn) writeDataMessage(connID string, data []byte) error {
 	return c.msgHandler.WriteDataMessage(connID, data)
 }
 
+// writeProbeMessage asks the client to check the target socket of an idle connection. Probes
+// are empty data messages, which clients that predate probes write to the target as nothing.
+func (c *ClientConn) writeProbeMessage(connID string) error {
+	return c.msgHandler.WriteDataMessage(connID, nil)
+}
+
 // writeConnectMessage sends connection request using binary format
-func (c *ClientConn) writeConnectMessage(connID, network, address string) error {
+func (c *ClientConn) writeConnectMessage(connID, network, address string, timeout time.Duration, priority uint8, scope string) error {
 	// Use shared message handler
-	return c.msgHandler.WriteConnectMessage(connID, network, address)
+	return c.msgHandler.WriteConnectMessage(connID, network, address, timeout, priority, scope)
 }
 
 // writeCloseMessage sends close message using binary format
@@ -23,3 +31,9 @@ func (c *ClientConn) writeCloseMessage(connID string) error {
 	// Use shared message handler
 	return c.msgHandler.WriteCloseMessage(connID)
 }
+
+// writeCloseWriteMessage sends a half-close message using binary format
+func (c *ClientConn) writeCloseWriteMessage(connID string) error {
+	// Use shared message handler
+	return c.msgHandler.WriteCloseWriteMessage(connID)
+}
@@ -64,6 +64,10 @@ func (m *mockTransportConn) GetPassword() string {
 	return "test-password"
 }
 
+func (m *mockTransportConn) GetClientVersion() string {
+	return ""
+}
+
 func (m *mockTransportConn) SetDeadline(t time.Time) error {
 	return nil
 }
@@ -262,7 +266,7 @@ func TestWriteMessages(t *testing.T) {
 		// Initialize msgHandler
 		client.msgHandler = message.NewGatewayExtendedMessageHandler(mockConn)
 
-		err := client.writeConnectMessage("conn1", "tcp", "example.com:80")
+		err := client.writeConnectMessage("conn1", "tcp", "example.com:80", 0, 0, "")
 		if err != nil {
 			t.Fatalf("writeConnectMessage failed: %v", err)
 		}
@@ -342,7 +346,7 @@ func parseBinaryMessageForTest(data []byte) (map[string]interface{}, error) {
 		return result, nil
 
 	case protocol.BinaryMsgTypeClose:
-		connID, err := protocol.UnpackCloseMessage(payload)
+		connID, _, err := protocol.UnpackCloseMessage(payload)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,302 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultMaxReplayBytes is how much a proxy user may send for its connection to stay
+// migratable when the group sets no limit
+const defaultMaxReplayBytes = 64 * 1024
+
+// errAnswerChanged is returned when a migrated connection's target answered differently
+var errAnswerChanged = errors.New("target answered differently than before")
+
+// migratable wraps a connection dialed through client when the group migrates connections to
+// the target's port
+func (g *Gateway) migratable(ctx context.Context, conn net.Conn, client *ClientConn, userCtx *utils.UserContext, network, addr string) net.Conn {
+	groupCfg := g.config.GetGroupConfig(userCtx.GroupID)
+	if len(groupCfg.Migration.Ports) == 0 || network != protocol.ProtocolTCP {
+		return conn
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return conn
+	}
+	if port, err := strconv.Atoi(portStr); err != nil || !slices.Contains(groupCfg.Migration.Ports, port) {
+		return conn
+	}
+	maxReplay := groupCfg.Migration.MaxReplayBytes
+	if maxReplay <= 0 {
+		maxReplay = defaultMaxReplayBytes
+	}
+
+	// Dials of later clients carry the user and priority of the original dial
+	dialCtx := commonctx.WithPriority(commonctx.WithUserContext(context.Background(), userCtx), commonctx.GetPriority(ctx))
+	return &migratingConn{
+		Conn:      conn,
+		g:         g,
+		ctx:       dialCtx,
+		userCtx:   userCtx,
+		addr:      addr,
+		timeout:   confirmTimeout(groupCfg),
+		maxReplay: maxReplay,
+		client:    client,
+		tried:     map[string]bool{client.ID: true},
+		changed:   make(chan struct{}),
+		sent:      []byte{},
+		digest:    sha256.New(),
+	}
+}
+
+// migratingConn is a proxied connection that moves to another client of the group when its
+// client disconnects. It keeps the bytes the user sent, up to maxReplay, and a digest of the
+// bytes the user received. The new client's connection gets the sent bytes again, and the
+// first received bytes of its answer must match the digest before they are skipped.
+// Migrations are done by the reading goroutine, writes failing meanwhile wait for it.
+type migratingConn struct {
+	net.Conn // The original connection, also providing the addresses
+
+	g         *Gateway
+	ctx       context.Context
+	userCtx   *utils.UserContext
+	addr      string
+	timeout   time.Duration
+	maxReplay int
+
+	// Owned by the reading goroutine
+	received int64
+	digest   hash.Hash
+
+	writeMu     sync.Mutex // Serializes writes and migrations
+	sent        []byte     // nil once more than maxReplay bytes were sent
+	writeClosed bool
+	tried       map[string]bool
+
+	mu      sync.Mutex
+	current net.Conn // Nil until the first migration, Conn is used then
+	client  *ClientConn
+	closed  bool
+	failed  bool
+	changed chan struct{} // Closed when a migration succeeded or failed
+}
+
+// state returns the connection in use and the client serving it
+func (c *migratingConn) state() (net.Conn, *ClientConn, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil {
+		return c.current, c.client, c.changed
+	}
+	return c.Conn, c.client, c.changed
+}
+
+// Read reads from the connection in use, migrating it when its client is gone
+func (c *migratingConn) Read(b []byte) (int, error) {
+	for {
+		conn, client, _ := c.state()
+		n, err := conn.Read(b)
+		if n > 0 {
+			c.received += int64(n)
+			c.digest.Write(b[:n])
+			return n, err
+		}
+		if err == nil || client.ctx.Err() == nil {
+			return n, err
+		}
+		if migrateErr := c.migrate(conn, client); migrateErr != nil {
+			logger.Warn("Connection could not be migrated to another client", "client_id", client.ID, "group_id", c.userCtx.GroupID, "address", c.addr, "err", migrateErr)
+			return n, err
+		}
+	}
+}
+
+// Write writes to the connection in use. Bytes written while the client disconnects are
+// replayed by the migration.
+func (c *migratingConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	if c.sent != nil {
+		if len(c.sent)+len(b) <= c.maxReplay {
+			c.sent = append(c.sent, b...)
+		} else {
+			c.sent = nil
+		}
+	}
+	replayable := c.sent != nil
+	conn, client, changed := c.state()
+	n, err := conn.Write(b)
+	c.writeMu.Unlock()
+	if err == nil || !replayable || client.ctx.Err() == nil {
+		return n, err
+	}
+
+	// The reading goroutine notices the client is gone too, and migrates
+	c.mu.Lock()
+	failed := c.failed || c.closed
+	c.mu.Unlock()
+	if !failed {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return n, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failed || c.closed {
+		return n, err
+	}
+	return len(b), nil
+}
+
+// SetDeadline sets the deadlines of the connection in use
+func (c *migratingConn) SetDeadline(t time.Time) error {
+	conn, _, _ := c.state()
+	return conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection in use
+func (c *migratingConn) SetReadDeadline(t time.Time) error {
+	conn, _, _ := c.state()
+	return conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection in use
+func (c *migratingConn) SetWriteDeadline(t time.Time) error {
+	conn, _, _ := c.state()
+	return conn.SetWriteDeadline(t)
+}
+
+// CloseWrite half-closes the connection in use, a migration half-closes the new one too
+func (c *migratingConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.writeClosed = true
+	conn, _, _ := c.state()
+	return connection.CloseWrite(conn)
+}
+
+// Close closes the connection in use
+func (c *migratingConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.Conn
+	if c.current != nil {
+		conn = c.current
+	}
+	c.mu.Unlock()
+	return conn.Close()
+}
+
+// migrate moves the connection to the next client of the group able to resume it
+func (c *migratingConn) migrate(old net.Conn, lost *ClientConn) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	err := c.resumeElsewhere(lost)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && c.closed {
+		err = net.ErrClosed
+	}
+	if err != nil {
+		c.failed = true
+		if c.current != nil && c.current != old {
+			_ = c.current.Close()
+		}
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+	_ = old.Close()
+	return err
+}
+
+// resumeElsewhere dials the target through the next clients of the group until one answers
+// like the lost client did, the caller holds writeMu
+func (c *migratingConn) resumeElsewhere(lost *ClientConn) error {
+	if c.sent == nil {
+		return fmt.Errorf("the user sent more than %d bytes", c.maxReplay)
+	}
+	groupID := c.userCtx.GroupID
+	for {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return net.ErrClosed
+		}
+
+		next := c.g.nextGroupClient(groupID, c.userCtx.ClientID, protocol.ProtocolTCP, c.tried)
+		if next == nil {
+			return utils.WithErrorCode(utils.ErrCodeNoClientAvailable, fmt.Errorf("no other client of group %s", groupID))
+		}
+		c.tried[next.ID] = true
+		conn, err := next.dialNetworkConfirmed(commonctx.WithConnID(c.ctx, utils.GenerateConnID()), protocol.ProtocolTCP, c.addr, c.timeout)
+		if err != nil {
+			logger.Warn("Migrating connection through client failed, trying next client", "client_id", next.ID, "group_id", groupID, "address", c.addr, "err", err)
+			continue
+		}
+		if err := c.replay(conn); err != nil {
+			_ = conn.Close()
+			if errors.Is(err, errAnswerChanged) {
+				// The target isn't deterministic, other clients would get a different answer too
+				return err
+			}
+			logger.Warn("Migrating connection through client failed, trying next client", "client_id", next.ID, "group_id", groupID, "address", c.addr, "err", err)
+			continue
+		}
+
+		c.mu.Lock()
+		c.current, c.client = conn, next
+		c.mu.Unlock()
+		c.g.rebindSticky(c.userCtx, next.ID)
+		logger.Info("Connection migrated to another client", "client_id", lost.ID, "next_client_id", next.ID, "group_id", groupID, "address", c.addr, "replayed_bytes", len(c.sent), "skipped_bytes", c.received)
+		return nil
+	}
+}
+
+// replay sends what the user sent through conn, and skips what the user received after
+// checking the target answered the same
+func (c *migratingConn) replay(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(c.sent)
+		if err == nil && c.writeClosed {
+			err = connection.CloseWrite(conn)
+		}
+		written <- err
+	}()
+
+	digest := sha256.New()
+	if _, err := io.CopyN(digest, conn, c.received); err != nil {
+		return fmt.Errorf("failed to read the answer again: %w", err)
+	}
+	if err := <-written; err != nil {
+		return fmt.Errorf("failed to replay the request: %w", err)
+	}
+	if !bytes.Equal(digest.Sum(nil), c.digest.Sum(nil)) {
+		return errAnswerChanged
+	}
+	return conn.SetDeadline(time.Time{})
+}
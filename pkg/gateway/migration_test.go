@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// newTargetClient returns a test client whose target answers each request with answer
+func newTargetClient(id string, answer func(request string) []byte) *ClientConn {
+	client, mockConn := createTestClientConn()
+	client.ID = id
+	mockConn.writeMessageFunc = func(data []byte) error {
+		_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+		if err != nil {
+			return nil
+		}
+		switch msgType {
+		case protocol.BinaryMsgTypeConnect:
+			connID, _, _, err := protocol.UnpackConnectMessage(payload)
+			if err == nil {
+				go client.handleConnectResponseMessage(map[string]interface{}{"type": protocol.MsgTypeConnectResponse, "id": connID, "success": true})
+			}
+		case protocol.BinaryMsgTypeData:
+			connID, request, err := protocol.UnpackDataMessage(payload)
+			if err == nil {
+				response := answer(string(request))
+				go client.handleDataMessage(map[string]interface{}{"type": protocol.MsgTypeData, "id": connID, "data": response})
+			}
+		}
+		return nil
+	}
+	return client
+}
+
+func TestGateway_MigratesConnection(t *testing.T) {
+	const body = "0123456789abcdefghij"
+	tests := []struct {
+		name     string
+		answerB  string
+		wantRead string
+	}{
+		{"same answer", body, body},
+		{"different answer", "9876543210abcdefghij", body[:10]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Client a dies after delivering half of the answer
+			clientA := newTargetClient("client-a", func(string) []byte { return []byte(body[:10]) })
+			clientB := newTargetClient("client-b", func(string) []byte { return []byte(tt.answerB) })
+			defer clientB.Stop()
+
+			gw := &Gateway{
+				config: &config.GatewayConfig{Groups: map[string]config.GroupConfig{
+					"test-group": {DialTimeout: 2 * time.Second, Migration: config.MigrationConfig{Ports: []int{80}}},
+				}},
+				clients: map[string]*ClientConn{clientA.ID: clientA, clientB.ID: clientB},
+				groups:  map[string]*GroupInfo{"test-group": {Clients: []string{clientA.ID, clientB.ID}}},
+			}
+			userCtx := &utils.UserContext{GroupID: "test-group"}
+			ctx := context.Background()
+			conn, err := clientA.dialNetworkConfirmed(ctx, "tcp", "example.com:80", time.Second)
+			if err != nil {
+				t.Fatalf("dialNetworkConfirmed() error = %v", err)
+			}
+			conn = gw.migratable(ctx, conn, clientA, userCtx, "tcp", "example.com:80")
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("GET /file")); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			received := make([]byte, 10)
+			if _, err := io.ReadFull(conn, received); err != nil {
+				t.Fatalf("ReadFull() error = %v", err)
+			}
+			go clientA.Stop()
+
+			rest, _ := io.ReadAll(io.LimitReader(conn, int64(len(body)-10)))
+			if got := string(received) + string(rest); got != tt.wantRead {
+				t.Errorf("Proxy user read %q, want %q", got, tt.wantRead)
+			}
+		})
+	}
+}
+
+func TestGateway_MigratableOnlyConfiguredPorts(t *testing.T) {
+	client, _ := createTestClientConn()
+	defer client.Stop()
+	gw := &Gateway{config: &config.GatewayConfig{Groups: map[string]config.GroupConfig{
+		"test-group": {Migration: config.MigrationConfig{Ports: []int{80}}},
+	}}}
+	userCtx := &utils.UserContext{GroupID: "test-group"}
+
+	conn := &mockNetConn{}
+	if got := gw.migratable(context.Background(), conn, client, userCtx, "tcp", "example.com:443"); got != conn {
+		t.Error("Connections to other ports should not be migratable")
+	}
+	if got := gw.migratable(context.Background(), conn, client, userCtx, "udp", "example.com:80"); got != conn {
+		t.Error("UDP connections should not be migratable")
+	}
+	if _, ok := gw.migratable(context.Background(), conn, client, userCtx, "tcp", "example.com:80").(*migratingConn); !ok {
+		t.Error("Connections to a configured port should be migratable")
+	}
+}
@@ -0,0 +1,455 @@
+package gateway
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Traffic mirroring defaults
+const (
+	defaultMirrorMaxBytes = 64 << 20
+	mirrorFirstUserPort   = 40000
+)
+
+// Mirror redaction options
+const (
+	MirrorRedactHeaders = "headers" // Mask credentials and cookies in HTTP headers
+	MirrorRedactPayload = "payload" // Replace all data with zero bytes, keeping sizes and timing
+)
+
+// ErrMirrorDisabled is returned when traffic mirroring is not enabled in the gateway configuration
+var ErrMirrorDisabled = errors.New("traffic mirroring is not enabled")
+
+// ErrMirrorNotFound is returned for an unknown capture ID
+var ErrMirrorNotFound = errors.New("capture not found")
+
+// sensitiveHeaderPattern matches HTTP header lines whose values are masked by the headers redaction
+var sensitiveHeaderPattern = regexp.MustCompile(`(?im)^(authorization|proxy-authorization|cookie|set-cookie|x-api-key|x-auth-token):[^\r\n]*`)
+
+// MirrorRequest selects the traffic copied to a capture
+type MirrorRequest struct {
+	ConnID     string   `json:"conn_id,omitempty"`     // A single connection
+	TargetHost string   `json:"target_host,omitempty"` // All new and existing connections to a host or host:port
+	MaxBytes   int64    `json:"max_bytes,omitempty"`   // Capture stops after this much data (default and limit: mirror.max_bytes)
+	Redact     []string `json:"redact,omitempty"`      // "headers" and/or "payload"
+}
+
+// MirrorCapture describes a capture for the admin API
+type MirrorCapture struct {
+	ID        string    `json:"id"`
+	ConnID    string    `json:"conn_id,omitempty"`
+	Target    string    `json:"target_host,omitempty"`
+	MaxBytes  int64     `json:"max_bytes"`
+	Redact    []string  `json:"redact,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Packets   int64     `json:"packets"`
+	Active    bool      `json:"active"`
+	StartTime time.Time `json:"start_time"`
+	StopTime  time.Time `json:"stop_time,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// mirrorCapture is a capture file being written
+type mirrorCapture struct {
+	info       MirrorCapture
+	path       string
+	targetHost string // Host part of the target filter
+	targetPort string // Port of the target filter, "" matches any port
+	redactHdrs bool
+	redactData bool
+
+	mu       sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	flows    map[string]*mirrorFlow
+	nextPort uint16
+}
+
+// mirrorManager keeps the captures of the gateway
+type mirrorManager struct {
+	dir      string
+	maxBytes int64
+	active   atomic.Int32 // Number of active captures, lets taps skip the lookup when zero
+
+	mu       sync.RWMutex
+	captures map[string]*mirrorCapture
+}
+
+// newMirrorManager returns nil when mirroring is disabled
+func newMirrorManager(cfg config.MirrorConfig) *mirrorManager {
+	if !cfg.Enabled {
+		return nil
+	}
+	dir := cfg.Dir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "anyproxy-mirror")
+	}
+	maxBytes := cfg.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMirrorMaxBytes
+	}
+	return &mirrorManager{dir: dir, maxBytes: maxBytes, captures: make(map[string]*mirrorCapture)}
+}
+
+// start creates a capture file and begins copying matching traffic into it
+func (m *mirrorManager) start(req MirrorRequest) (*MirrorCapture, error) {
+	if (req.ConnID == "") == (req.TargetHost == "") {
+		return nil, fmt.Errorf("exactly one of conn_id or target_host is required")
+	}
+	if req.MaxBytes < 0 || req.MaxBytes > m.maxBytes {
+		return nil, fmt.Errorf("max_bytes must be between 0 and %d", m.maxBytes)
+	}
+	c := &mirrorCapture{flows: make(map[string]*mirrorFlow), nextPort: mirrorFirstUserPort}
+	for _, option := range req.Redact {
+		switch option {
+		case MirrorRedactHeaders:
+			c.redactHdrs = true
+		case MirrorRedactPayload:
+			c.redactData = true
+		default:
+			return nil, fmt.Errorf("unknown redact option %q, expected %s or %s", option, MirrorRedactHeaders, MirrorRedactPayload)
+		}
+	}
+	if req.TargetHost != "" {
+		c.targetHost = req.TargetHost
+		if host, port, err := net.SplitHostPort(req.TargetHost); err == nil {
+			c.targetHost, c.targetPort = host, port
+		}
+	}
+	if req.MaxBytes == 0 {
+		req.MaxBytes = m.maxBytes
+	}
+
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %w", err)
+	}
+	id := utils.GenerateConnID()
+	c.path = filepath.Join(m.dir, id+".pcap")
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) //nolint:gosec // path is built from a generated ID
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+	c.file = file
+	c.w = bufio.NewWriter(file)
+	if err := writePcapHeader(c.w); err != nil {
+		_ = file.Close()
+		_ = os.Remove(c.path)
+		return nil, fmt.Errorf("failed to write capture file: %w", err)
+	}
+	c.info = MirrorCapture{
+		ID:        id,
+		ConnID:    req.ConnID,
+		Target:    req.TargetHost,
+		MaxBytes:  req.MaxBytes,
+		Redact:    req.Redact,
+		Active:    true,
+		StartTime: time.Now(),
+	}
+
+	m.mu.Lock()
+	m.captures[id] = c
+	m.mu.Unlock()
+	m.active.Add(1)
+
+	logger.Info("Traffic capture started", "capture_id", id, "conn_id", req.ConnID, "target_host", req.TargetHost, "max_bytes", req.MaxBytes, "redact", req.Redact, "path", c.path)
+	info := c.info
+	return &info, nil
+}
+
+// stop closes an active capture, the file stays available for download
+func (m *mirrorManager) stop(id string) error {
+	m.mu.RLock()
+	c, ok := m.captures[id]
+	m.mu.RUnlock()
+	if !ok {
+		return ErrMirrorNotFound
+	}
+	m.finish(c, nil)
+	return nil
+}
+
+// finish closes a capture once, recording err as the reason when it failed
+func (m *mirrorManager) finish(c *mirrorCapture, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m.finishLocked(c, err)
+}
+
+// finishLocked is finish with c.mu held
+func (m *mirrorManager) finishLocked(c *mirrorCapture, err error) {
+	if !c.info.Active {
+		return
+	}
+	c.info.Active = false
+	c.info.StopTime = time.Now()
+	if flushErr := c.w.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.info.Error = err.Error()
+	}
+	m.active.Add(-1)
+	logger.Info("Traffic capture stopped", "capture_id", c.info.ID, "bytes", c.info.Bytes, "packets", c.info.Packets, "err", err)
+}
+
+// stopAll closes all active captures
+func (m *mirrorManager) stopAll() {
+	m.mu.RLock()
+	captures := make([]*mirrorCapture, 0, len(m.captures))
+	for _, c := range m.captures {
+		captures = append(captures, c)
+	}
+	m.mu.RUnlock()
+	for _, c := range captures {
+		m.finish(c, nil)
+	}
+}
+
+// remove stops a capture and deletes its file
+func (m *mirrorManager) remove(id string) error {
+	m.mu.Lock()
+	c, ok := m.captures[id]
+	delete(m.captures, id)
+	m.mu.Unlock()
+	if !ok {
+		return ErrMirrorNotFound
+	}
+	m.finish(c, nil)
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// list returns all captures, newest first
+func (m *mirrorManager) list() []MirrorCapture {
+	m.mu.RLock()
+	captures := make([]MirrorCapture, 0, len(m.captures))
+	for _, c := range m.captures {
+		c.mu.Lock()
+		captures = append(captures, c.info)
+		c.mu.Unlock()
+	}
+	m.mu.RUnlock()
+	sort.Slice(captures, func(i, j int) bool { return captures[i].StartTime.After(captures[j].StartTime) })
+	return captures
+}
+
+// open flushes a capture and opens its file for reading
+func (m *mirrorManager) open(id string) (*os.File, error) {
+	m.mu.RLock()
+	c, ok := m.captures[id]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrMirrorNotFound
+	}
+	c.mu.Lock()
+	if c.info.Active {
+		_ = c.w.Flush()
+	}
+	c.mu.Unlock()
+	return os.Open(c.path)
+}
+
+// matching returns the active captures selecting a connection
+func (m *mirrorManager) matching(connID, host, port string) []*mirrorCapture {
+	if m.active.Load() == 0 {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var matches []*mirrorCapture
+	for _, c := range m.captures {
+		if c.info.ConnID != "" && c.info.ConnID != connID {
+			continue
+		}
+		if c.targetHost != "" && (c.targetHost != host || (c.targetPort != "" && c.targetPort != port)) {
+			continue
+		}
+		matches = append(matches, c)
+	}
+	return matches
+}
+
+// record copies data of a connection into the capture, stopping it once max_bytes is reached
+func (m *mirrorManager) record(c *mirrorCapture, conn *mirroredConn, fromUser bool, data []byte) {
+	// The limit check, packet write, counters and stop are one step, concurrent reads and
+	// writes of the connections must not append past max_bytes or to a stopped capture
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.info.Active {
+		return
+	}
+	remaining := c.info.MaxBytes - c.info.Bytes
+	full := int64(len(data)) >= remaining
+	if full {
+		data = data[:remaining]
+	}
+
+	// Redact a copy, the live connection data must not change
+	payload := append([]byte(nil), data...)
+	if c.redactData {
+		clear(payload)
+	} else if c.redactHdrs {
+		payload = redactHeaders(payload)
+	}
+
+	flow, ok := c.flows[conn.connID]
+	if !ok {
+		flow = conn.newFlow(c.nextPort)
+		c.nextPort++
+		c.flows[conn.connID] = flow
+	}
+	packets, err := flow.writePackets(c.w, time.Now(), fromUser, payload)
+	c.info.Bytes += int64(len(payload))
+	c.info.Packets += int64(packets)
+
+	if err != nil {
+		logger.Error("Failed to write traffic capture", "capture_id", c.info.ID, "conn_id", conn.connID, "err", err)
+		m.finishLocked(c, err)
+	} else if full {
+		m.finishLocked(c, nil)
+	}
+}
+
+// redactHeaders masks the values of sensitive HTTP headers, keeping the data length.
+// Headers split across reads are not recognized.
+func redactHeaders(data []byte) []byte {
+	return sensitiveHeaderPattern.ReplaceAllFunc(data, func(line []byte) []byte {
+		colon := 0
+		for line[colon] != ':' {
+			colon++
+		}
+		for i := colon + 1; i < len(line); i++ {
+			if line[i] != ' ' {
+				line[i] = '*'
+			}
+		}
+		return line
+	})
+}
+
+// mirroredConn copies the traffic of a proxied connection to the captures selecting it.
+// Write carries data from the proxy user, Read data from the target.
+type mirroredConn struct {
+	net.Conn
+	mirror   *mirrorManager
+	connID   string
+	network  string
+	host     string
+	port     string
+	sourceIP string
+}
+
+// tap wraps a proxied connection so captures can be started for it at any time
+func (m *mirrorManager) tap(conn net.Conn, connID, network, addr, sourceIP string) net.Conn {
+	if m == nil {
+		return conn
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return &mirroredConn{Conn: conn, mirror: m, connID: connID, network: network, host: host, port: port, sourceIP: sourceIP}
+}
+
+// Read reads data from the target
+func (c *mirroredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		for _, capture := range c.mirror.matching(c.connID, c.host, c.port) {
+			c.mirror.record(capture, c, false, b[:n])
+		}
+	}
+	return n, err
+}
+
+// Write sends data from the proxy user
+func (c *mirroredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		for _, capture := range c.mirror.matching(c.connID, c.host, c.port) {
+			c.mirror.record(capture, c, true, b[:n])
+		}
+	}
+	return n, err
+}
+
+// newFlow describes the connection for the capture, using placeholders for non-IPv4 endpoints
+func (c *mirroredConn) newFlow(userPort uint16) *mirrorFlow {
+	flow := &mirrorFlow{
+		udp:        strings.HasPrefix(c.network, "udp"),
+		userAddr:   mirrorUserAddr,
+		userPort:   userPort,
+		targetAddr: mirrorTargetAddr,
+	}
+	if addr, err := netip.ParseAddr(c.sourceIP); err == nil && addr.Unmap().Is4() {
+		flow.userAddr = addr.Unmap()
+	}
+	if addr, err := netip.ParseAddr(c.host); err == nil && addr.Unmap().Is4() {
+		flow.targetAddr = addr.Unmap()
+	}
+	if port, err := strconv.ParseUint(c.port, 10, 16); err == nil {
+		flow.targetPort = uint16(port)
+	}
+	return flow
+}
+
+// StartMirror starts copying the traffic of a connection or target host to a capture file
+func (g *Gateway) StartMirror(req MirrorRequest) (*MirrorCapture, error) {
+	if g.mirror == nil {
+		return nil, ErrMirrorDisabled
+	}
+	return g.mirror.start(req)
+}
+
+// StopMirror stops a capture, its file remains downloadable
+func (g *Gateway) StopMirror(id string) error {
+	if g.mirror == nil {
+		return ErrMirrorDisabled
+	}
+	return g.mirror.stop(id)
+}
+
+// DeleteMirror stops a capture and deletes its file
+func (g *Gateway) DeleteMirror(id string) error {
+	if g.mirror == nil {
+		return ErrMirrorDisabled
+	}
+	return g.mirror.remove(id)
+}
+
+// ListMirrors returns all captures, newest first
+func (g *Gateway) ListMirrors() []MirrorCapture {
+	if g.mirror == nil {
+		return []MirrorCapture{}
+	}
+	return g.mirror.list()
+}
+
+// OpenMirror opens a capture file in pcap format for download
+func (g *Gateway) OpenMirror(id string) (*os.File, error) {
+	if g.mirror == nil {
+		return nil, ErrMirrorDisabled
+	}
+	return g.mirror.open(id)
+}
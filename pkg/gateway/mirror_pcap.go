@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// pcap constants. Captured streams are written as raw IPv4 packets so Wireshark
+// can reassemble and dissect the application protocol.
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapSnapLen    = 262144
+	pcapLinkRawIP  = 101
+	ipv4HeaderSize = 20
+	tcpHeaderSize  = 20
+	udpHeaderSize  = 8
+	// maxSegmentPayload keeps synthesized packets within the IPv4 total length field
+	maxSegmentPayload = 65535 - ipv4HeaderSize - tcpHeaderSize
+)
+
+// IP protocol numbers
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+// Placeholder addresses for endpoints without an IPv4 address, e.g. targets given by host name
+var (
+	mirrorUserAddr   = netip.AddrFrom4([4]byte{10, 0, 0, 1})
+	mirrorTargetAddr = netip.AddrFrom4([4]byte{10, 0, 0, 2})
+)
+
+// mirrorFlow is one captured connection, packets of each direction carry their own TCP sequence numbers
+type mirrorFlow struct {
+	udp        bool
+	userAddr   netip.Addr
+	userPort   uint16
+	targetAddr netip.Addr
+	targetPort uint16
+	seq        [2]uint32 // Next sequence number from the user and from the target
+	ipID       uint16
+}
+
+// writePcapHeader writes the pcap global header
+func writePcapHeader(w io.Writer) error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRawIP)
+	_, err := w.Write(header)
+	return err
+}
+
+// writePackets writes data sent by the user (fromUser) or by the target as one or more packets
+// and returns the number of packets written
+func (f *mirrorFlow) writePackets(w io.Writer, ts time.Time, fromUser bool, data []byte) (int, error) {
+	if f.udp {
+		// Each read or write is one datagram, oversized ones are truncated
+		if len(data) > 65535-ipv4HeaderSize-udpHeaderSize {
+			data = data[:65535-ipv4HeaderSize-udpHeaderSize]
+		}
+		return 1, f.writePacket(w, ts, fromUser, data)
+	}
+	packets := 0
+	for len(data) > 0 {
+		n := min(len(data), maxSegmentPayload)
+		if err := f.writePacket(w, ts, fromUser, data[:n]); err != nil {
+			return packets, err
+		}
+		packets++
+		data = data[n:]
+	}
+	return packets, nil
+}
+
+// writePacket writes a single pcap record with an IPv4 and TCP or UDP header
+func (f *mirrorFlow) writePacket(w io.Writer, ts time.Time, fromUser bool, payload []byte) error {
+	src, dst := f.userAddr, f.targetAddr
+	srcPort, dstPort := f.userPort, f.targetPort
+	dir, other := 0, 1
+	if !fromUser {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		dir, other = 1, 0
+	}
+
+	transportSize, proto := tcpHeaderSize, byte(ipProtoTCP)
+	if f.udp {
+		transportSize, proto = udpHeaderSize, ipProtoUDP
+	}
+	packetLen := ipv4HeaderSize + transportSize + len(payload)
+
+	record := make([]byte, 16+ipv4HeaderSize+transportSize)
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))            //nolint:gosec // pcap timestamps are 32-bit
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000)) //nolint:gosec // always < 1e6
+	binary.LittleEndian.PutUint32(record[8:], uint32(packetLen))            //nolint:gosec // bounded by 65535
+	binary.LittleEndian.PutUint32(record[12:], uint32(packetLen))           //nolint:gosec // bounded by 65535
+
+	ip := record[16 : 16+ipv4HeaderSize]
+	f.ipID++
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(packetLen)) //nolint:gosec // bounded by 65535
+	binary.BigEndian.PutUint16(ip[4:], f.ipID)
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // Don't fragment
+	ip[8] = 64
+	ip[9] = proto
+	src4, dst4 := src.As4(), dst.As4()
+	copy(ip[12:16], src4[:])
+	copy(ip[16:20], dst4[:])
+	binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip))
+
+	transport := record[16+ipv4HeaderSize:]
+	binary.BigEndian.PutUint16(transport[0:], srcPort)
+	binary.BigEndian.PutUint16(transport[2:], dstPort)
+	if f.udp {
+		// A zero UDP checksum means none was computed
+		binary.BigEndian.PutUint16(transport[4:], uint16(udpHeaderSize+len(payload))) //nolint:gosec // bounded by 65535
+	} else {
+		// Checksums are left empty, Wireshark does not validate them by default
+		binary.BigEndian.PutUint32(transport[4:], f.seq[dir])
+		binary.BigEndian.PutUint32(transport[8:], f.seq[other])
+		transport[12] = (tcpHeaderSize / 4) << 4
+		transport[13] = 0x18 // PSH, ACK
+		binary.BigEndian.PutUint16(transport[14:], 65535)
+		f.seq[dir] += uint32(len(payload)) //nolint:gosec // sequence numbers wrap
+	}
+
+	if _, err := w.Write(record); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ipv4Checksum computes the IPv4 header checksum, the checksum field must be zero
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,178 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// readCapture returns the packet payloads of a capture, skipping the IPv4 and TCP headers
+func readCapture(t *testing.T, m *mirrorManager, id string) [][]byte {
+	t.Helper()
+	f, err := m.open(id)
+	if err != nil {
+		t.Fatalf("open capture: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != pcapMagic || binary.LittleEndian.Uint32(data[20:]) != pcapLinkRawIP {
+		t.Fatalf("invalid pcap header: %x", data[:min(len(data), 24)])
+	}
+	var payloads [][]byte
+	for data = data[24:]; len(data) > 0; {
+		size := int(binary.LittleEndian.Uint32(data[8:]))
+		packet := data[16 : 16+size]
+		if ipv4Checksum(packet[:ipv4HeaderSize]) != 0 {
+			t.Errorf("invalid IPv4 header checksum")
+		}
+		payloads = append(payloads, packet[ipv4HeaderSize+tcpHeaderSize:])
+		data = data[16+size:]
+	}
+	return payloads
+}
+
+func TestMirror_CaptureByTarget(t *testing.T) {
+	m := newMirrorManager(config.MirrorConfig{Enabled: true, Dir: t.TempDir()})
+	capture, err := m.start(MirrorRequest{TargetHost: "example.com:80", Redact: []string{MirrorRedactHeaders}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userSide, targetSide := net.Pipe()
+	defer targetSide.Close()
+	conn := m.tap(userSide, "conn-1", "tcp", "example.com:80", "192.0.2.1")
+
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\nAuthorization: Bearer secret\r\n\r\n")
+	go func() {
+		buf := make([]byte, len(request))
+		_, _ = io.ReadFull(targetSide, buf)
+		_, _ = targetSide.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	}()
+	live := append([]byte(nil), request...)
+	if _, err := conn.Write(live); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(live, request) {
+		t.Errorf("Redaction changed the live data")
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.matching("conn-2", "example.com", "443")) != 0 {
+		t.Errorf("Capture should not match other ports")
+	}
+
+	if err := m.stop(capture.ID); err != nil {
+		t.Fatal(err)
+	}
+	payloads := readCapture(t, m, capture.ID)
+	if len(payloads) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(payloads))
+	}
+	if bytes.Contains(payloads[0], []byte("secret")) || !bytes.Contains(payloads[0], []byte("Authorization: ******")) {
+		t.Errorf("Authorization header not redacted: %q", payloads[0])
+	}
+	if !bytes.Equal(payloads[1], buf[:n]) {
+		t.Errorf("Response = %q, want %q", payloads[1], buf[:n])
+	}
+	if list := m.list(); len(list) != 1 || list[0].Active || list[0].Packets != 2 {
+		t.Errorf("Unexpected capture list %+v", list)
+	}
+
+	if err := m.remove(capture.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.open(capture.ID); !errors.Is(err, ErrMirrorNotFound) {
+		t.Errorf("Expected ErrMirrorNotFound, got %v", err)
+	}
+}
+
+func TestMirror_MaxBytesAndPayloadRedaction(t *testing.T) {
+	m := newMirrorManager(config.MirrorConfig{Enabled: true, Dir: t.TempDir(), MaxBytes: 1024})
+	if _, err := m.start(MirrorRequest{ConnID: "conn-1", MaxBytes: 2048}); err == nil {
+		t.Errorf("Expected max_bytes above the configured limit to fail")
+	}
+	if _, err := m.start(MirrorRequest{}); err == nil {
+		t.Errorf("Expected a request without filter to fail")
+	}
+	capture, err := m.start(MirrorRequest{ConnID: "conn-1", MaxBytes: 10, Redact: []string{MirrorRedactPayload}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userSide, targetSide := net.Pipe()
+	defer targetSide.Close()
+	go func() { _, _ = io.Copy(io.Discard, targetSide) }()
+	conn := m.tap(userSide, "conn-1", "tcp", "[2001:db8::1]:443", "")
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write([]byte("abcdefgh")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := m.list()
+	if len(list) != 1 || list[0].Active || list[0].Bytes != 10 {
+		t.Fatalf("Expected capture stopped at 10 bytes, got %+v", list)
+	}
+	payloads := readCapture(t, m, capture.ID)
+	if len(payloads) != 2 || len(payloads[0]) != 8 || len(payloads[1]) != 2 {
+		t.Fatalf("Unexpected packets %q", payloads)
+	}
+	if !bytes.Equal(payloads[0], make([]byte, 8)) {
+		t.Errorf("Payload not redacted: %q", payloads[0])
+	}
+}
+
+func TestMirror_ConcurrentRecord(t *testing.T) {
+	m := newMirrorManager(config.MirrorConfig{Enabled: true, Dir: t.TempDir()})
+	capture, err := m.start(MirrorRequest{TargetHost: "example.com", MaxBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connections of the target record concurrently, the capture never goes past max_bytes
+	c := m.captures[capture.ID]
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		conn := &mirroredConn{mirror: m, connID: "conn-" + string(rune('a'+i)), network: "tcp", host: "example.com", port: "80"}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				m.record(c, conn, j%2 == 0, []byte("0123456789"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	list := m.list()
+	if len(list) != 1 || list[0].Active || list[0].Bytes != 1000 || list[0].Packets != 100 {
+		t.Fatalf("Expected capture stopped at 1000 bytes in 100 packets, got %+v", list)
+	}
+	if payloads := readCapture(t, m, capture.ID); len(payloads) != 100 {
+		t.Errorf("Expected 100 packets in the file, got %d", len(payloads))
+	}
+}
+
+func TestMirror_Disabled(t *testing.T) {
+	g := &Gateway{}
+	if _, err := g.StartMirror(MirrorRequest{ConnID: "conn-1"}); !errors.Is(err, ErrMirrorDisabled) {
+		t.Errorf("Expected ErrMirrorDisabled, got %v", err)
+	}
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	if tapped := g.mirror.tap(conn, "conn-1", "tcp", "example.com:80", ""); tapped != conn {
+		t.Errorf("Disabled mirroring should not wrap connections")
+	}
+}
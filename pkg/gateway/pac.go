@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// ErrPACDisabled is returned when the PAC file is not enabled in the gateway configuration
+var ErrPACDisabled = errors.New("pac file is not enabled")
+
+// GetPACFile generates the proxy auto-config file. requestHost is the host the file was
+// fetched from, used for proxies without a configured host.
+func (g *Gateway) GetPACFile(requestHost string) (string, error) {
+	cfg := g.config.PAC
+	if !cfg.Enabled {
+		return "", ErrPACDisabled
+	}
+
+	results := map[string]string{config.PACDirect: "DIRECT"}
+	for _, proxy := range cfg.Proxies {
+		addr, err := g.pacProxyAddr(proxy, requestHost)
+		if err != nil {
+			return "", err
+		}
+		switch proxy.Type {
+		case config.PACTypeHTTP:
+			results[proxy.Name] = "PROXY " + addr
+		case config.PACTypeHTTPS:
+			results[proxy.Name] = "HTTPS " + addr
+		case config.PACTypeSOCKS5:
+			// SOCKS is understood by browsers not knowing SOCKS5
+			results[proxy.Name] = "SOCKS5 " + addr + "; SOCKS " + addr
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("// Generated by anyproxy\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+	b.WriteString("  var isIP = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+	for _, rule := range cfg.Rules {
+		conditions := make([]string, 0, len(rule.Hosts))
+		for _, host := range rule.Hosts {
+			conditions = append(conditions, pacCondition(host))
+		}
+		fmt.Fprintf(&b, "  if (%s) return %s;\n", strings.Join(conditions, " || "), strconv.Quote(results[rule.Route]))
+	}
+	defaultRoute := cfg.Default
+	if defaultRoute == "" {
+		defaultRoute = config.PACDirect
+	}
+	fmt.Fprintf(&b, "  return %s;\n}\n", strconv.Quote(results[defaultRoute]))
+	return b.String(), nil
+}
+
+// pacProxyAddr returns the address browsers use for a proxy, filling in the request host
+// and the port of the gateway's listener
+func (g *Gateway) pacProxyAddr(proxy config.PACProxy, requestHost string) (string, error) {
+	host, port := "", ""
+	if proxy.Addr != "" {
+		var err error
+		if host, port, err = net.SplitHostPort(proxy.Addr); err != nil {
+			return "", fmt.Errorf("invalid address of pac proxy %s: %w", proxy.Name, err)
+		}
+	}
+	if host == "" {
+		host = requestHost
+	}
+	if port == "" {
+		listenerType := config.ProxyTypeHTTP
+		if proxy.Type == config.PACTypeSOCKS5 {
+			listenerType = config.ProxyTypeSOCKS5
+		}
+		for _, listener := range g.config.Proxy.AllListeners() {
+			if listener.Type != listenerType {
+				continue
+			}
+			if _, listenPort, err := net.SplitHostPort(listener.Addr); err == nil {
+				port = listenPort
+				break
+			}
+		}
+	}
+	if host == "" || port == "" {
+		return "", fmt.Errorf("pac proxy %s has no address: no host or %s listener", proxy.Name, proxy.Type)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// pacCondition returns the JavaScript condition matching a rule host
+func pacCondition(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if ip, ipNet, err := net.ParseCIDR(host); err == nil {
+		return fmt.Sprintf("(isIP && isInNet(host, %s, %s))", strconv.Quote(ip.Mask(ipNet.Mask).String()), strconv.Quote(net.IP(ipNet.Mask).String()))
+	}
+	if net.ParseIP(host) != nil {
+		return "host == " + strconv.Quote(host)
+	}
+	if strings.ContainsAny(host, "*?") {
+		return fmt.Sprintf("shExpMatch(host, %s)", strconv.Quote(host))
+	}
+	host = strings.TrimPrefix(host, ".")
+	return fmt.Sprintf("(host == %s || dnsDomainIs(host, %s))", strconv.Quote(host), strconv.Quote("."+host))
+}
@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestGetPACFile(t *testing.T) {
+	gw := &Gateway{config: &config.GatewayConfig{
+		Proxy: config.ProxyConfig{
+			HTTP:   config.HTTPConfig{ListenAddr: ":8080"},
+			SOCKS5: config.SOCKS5Config{ListenAddr: "0.0.0.0:1080"},
+		},
+		PAC: config.PACConfig{
+			Enabled: true,
+			Proxies: []config.PACProxy{
+				{Name: "office", Type: config.PACTypeHTTP},
+				{Name: "lab", Type: config.PACTypeSOCKS5, Addr: "lab.example.com:"},
+				{Name: "secure", Type: config.PACTypeHTTPS, Addr: "proxy.example.com:8443"},
+			},
+			Rules: []config.PACRule{
+				{Hosts: []string{"Corp.Example.com", "10.0.0.0/8"}, Route: "office"},
+				{Hosts: []string{"*.lab.*"}, Route: "lab"},
+				{Hosts: []string{"192.0.2.1"}, Route: config.PACDirect},
+			},
+			Default: "secure",
+		},
+	}}
+
+	pac, err := gw.GetPACFile("gateway.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`if ((host == "corp.example.com" || dnsDomainIs(host, ".corp.example.com")) || (isIP && isInNet(host, "10.0.0.0", "255.0.0.0"))) return "PROXY gateway.example.com:8080";`,
+		`if (shExpMatch(host, "*.lab.*")) return "SOCKS5 lab.example.com:1080; SOCKS lab.example.com:1080";`,
+		`if (host == "192.0.2.1") return "DIRECT";`,
+		`return "HTTPS proxy.example.com:8443";`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("Expected the PAC file to contain %s, got:\n%s", want, pac)
+		}
+	}
+
+	// Without a listener of the type the proxy has no port
+	gw.config.Proxy.SOCKS5.ListenAddr = ""
+	if _, err := gw.GetPACFile("gateway.example.com"); err == nil {
+		t.Error("Expected an error for a proxy without a port")
+	}
+
+	gw.config.PAC.Enabled = false
+	if _, err := gw.GetPACFile("gateway.example.com"); !errors.Is(err, ErrPACDisabled) {
+		t.Errorf("Expected ErrPACDisabled, got %v", err)
+	}
+}
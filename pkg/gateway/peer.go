@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/qos"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// dialPeer dials address through a client of groupID for a peer connection of another client,
+// which authenticates like a proxy user of that group
+func (g *Gateway) dialPeer(ctx context.Context, groupID, groupPassword, network, address string) (net.Conn, error) {
+	if !g.validateGroup(groupID, groupPassword) {
+		return nil, utils.WithErrorCode(utils.ErrCodeTargetForbidden, fmt.Errorf("invalid credentials for group %s", groupID))
+	}
+	ctx = commonctx.WithUserContext(ctx, &utils.UserContext{Username: groupID, GroupID: groupID})
+	return g.dial(ctx, network, address)
+}
+
+// handlePeerConnect relays a connection of the client's peer listener to a client of another
+// group. The dialed connection is handled like one dialed for a proxy user, with the roles of
+// the tunnel reversed: the client sends the first data and receives the connect response.
+func (c *ClientConn) handlePeerConnect(msg map[string]interface{}) {
+	connID, _ := msg["id"].(string)
+	network, _ := msg["network"].(string)
+	address, _ := msg["address"].(string)
+	groupID, _ := msg["group_id"].(string)
+	groupPassword, _ := msg["group_password"].(string)
+	if connID == "" {
+		logger.Error("Invalid peer connect message", "client_id", c.ID, "message_fields", utils.GetMessageFields(msg))
+		return
+	}
+
+	fail := func(err error) {
+		logger.Warn("Peer connection failed", "client_id", c.ID, "conn_id", connID, "target_group_id", groupID, "address", address, "err", err)
+		if writeErr := c.msgHandler.WriteConnectResponse(connID, false, err.Error(), string(utils.ErrorCodeOf(err))); writeErr != nil {
+			logger.Error("Failed to send peer connect response", "client_id", c.ID, "conn_id", connID, "err", writeErr)
+		}
+	}
+	if c.peerDial == nil {
+		fail(utils.WithErrorCode(utils.ErrCodeTargetForbidden, fmt.Errorf("peer routing is disabled on the gateway")))
+		return
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(c.ctx, protocol.DefaultConnectTimeout)
+	conn, err := c.peerDial(ctx, groupID, groupPassword, network, address)
+	cancel()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	proxyConn := &Conn{
+		ID:        connID,
+		Done:      make(chan struct{}),
+		LocalConn: conn,
+		Address:   address,
+		StartTime: start,
+	}
+	proxyConn.touch()
+	c.connMu.Lock()
+	if _, exists := c.Conns[connID]; exists {
+		c.connMu.Unlock()
+		_ = conn.Close()
+		fail(fmt.Errorf("duplicate connection ID %s", connID))
+		return
+	}
+	c.Conns[connID] = proxyConn
+	c.connMu.Unlock()
+	c.resume()
+	c.createMessageChannel(connID)
+
+	if err := c.msgHandler.WriteConnectResponse(connID, true, "", ""); err != nil {
+		logger.Error("Failed to send peer connect response", "client_id", c.ID, "conn_id", connID, "err", err)
+		c.closeConnection(connID)
+		return
+	}
+	logger.Info("Peer connection established", "client_id", c.ID, "conn_id", connID, "target_group_id", groupID, "network", network, "address", address, "connect_duration", time.Since(start))
+
+	c.egress.Register(connID, address, qos.PriorityUnset)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.handleConnection(proxyConn)
+	}()
+}
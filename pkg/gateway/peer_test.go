@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+)
+
+func TestClientConn_HandlePeerConnect(t *testing.T) {
+	client, mockConn := createTestClientConn()
+	defer client.Stop()
+
+	type response struct {
+		connID    string
+		success   bool
+		errorCode string
+	}
+	responses := make(chan response, 4)
+	mockConn.writeMessageFunc = func(data []byte) error {
+		_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+		if err != nil {
+			t.Error(err)
+			return err
+		}
+		if msgType == protocol.BinaryMsgTypeConnectResponse {
+			connID, success, _, errorCode, _ := protocol.UnpackConnectResponseMessageWithCode(payload)
+			responses <- response{connID, success, errorCode}
+		}
+		return nil
+	}
+	peerConnect := func(connID string) {
+		client.handlePeerConnect(map[string]interface{}{
+			"id": connID, "network": "tcp", "address": "db.site-b:5432", "group_id": "site-b", "group_password": "secret",
+		})
+	}
+
+	// Peer routing is opt-in on the gateway
+	peerConnect("conn-disabled")
+	if r := <-responses; r.success || r.errorCode != string(utils.ErrCodeTargetForbidden) {
+		t.Errorf("Expected a forbidden response with peer routing disabled, got %+v", r)
+	}
+
+	client.peerDial = func(_ context.Context, groupID, groupPassword, _, address string) (net.Conn, error) {
+		if groupID != "site-b" || groupPassword != "secret" || address != "db.site-b:5432" {
+			return nil, errors.New("unexpected peer dial")
+		}
+		local, remote := net.Pipe()
+		t.Cleanup(func() { _ = remote.Close() })
+		return local, nil
+	}
+	peerConnect("conn-peer")
+	if r := <-responses; !r.success || r.connID != "conn-peer" {
+		t.Fatalf("Expected a successful response, got %+v", r)
+	}
+	client.connMu.RLock()
+	_, exists := client.Conns["conn-peer"]
+	client.connMu.RUnlock()
+	if !exists {
+		t.Error("Expected the peer connection to be registered")
+	}
+
+	// Connection IDs in use are refused
+	peerConnect("conn-peer")
+	if r := <-responses; r.success {
+		t.Error("Expected a duplicate connection ID to be refused")
+	}
+}
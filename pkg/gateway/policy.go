@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/policy"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// policyPushTimeout bounds pushing the policy packs, the client gets no connections meanwhile
+const policyPushTimeout = 10 * time.Second
+
+// pushPolicyPacks sends the policy packs of the client's group to a newly registered client.
+// Groups without packs send none, which clears packs the client got from an earlier session.
+// Clients that can't take the packs, e.g. older ones, are still used, with a warning.
+func (g *Gateway) pushPolicyPacks(client *ClientConn) {
+	defer client.policyPending.Store(false)
+
+	packs := policy.ForGroup(g.config, client.GroupID)
+	if err := sendPolicyPacks(client, packs, g.config.Groups[client.GroupID].PolicySignature); err != nil {
+		if len(packs) > 0 {
+			logger.Warn("Failed to push policy packs, the client only enforces its own host patterns", "client_id", client.ID, "group_id", client.GroupID, "client_version", client.Version, "err", err)
+		} else {
+			logger.Debug("Failed to clear policy packs", "client_id", client.ID, "group_id", client.GroupID, "err", err)
+		}
+		return
+	}
+	logger.Info("Pushed policy packs to client", "client_id", client.ID, "group_id", client.GroupID, "packs", len(packs))
+}
+
+// sendPolicyPacks uploads the packs to the client policy service with the operator signature
+// of the group's packs, which the gateway only relays
+func sendPolicyPacks(client *ClientConn, packs []policy.Pack, operatorSignature string) error {
+	body, err := policy.Marshal(packs)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return client.dialNetwork(ctx, protocol.ProtocolTCP, protocol.PolicyServiceAddress)
+		},
+		DisableKeepAlives: true,
+	}}
+
+	ctx, cancel := context.WithTimeout(client.ctx, policyPushTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://"+protocol.PolicyServiceHost+policy.PacksPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature := client.signControl(body); signature != "" {
+		req.Header.Set(policy.SignatureHeader, signature)
+	}
+	if operatorSignature != "" {
+		req.Header.Set(policy.OperatorSignatureHeader, operatorSignature)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("client returned %s", resp.Status)
+	}
+	return nil
+}
@@ -2,16 +2,22 @@ package gateway
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
 	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
 	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
@@ -38,6 +44,8 @@ type PortForwardManager struct {
 	ctx        context.Context
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
+	// Socket options applied to forwarded port listeners, nil keeps the defaults
+	socketOptions *config.SocketOptions
 }
 
 // PortListener port listener
@@ -50,8 +58,30 @@ type PortListener struct {
 	Listener   net.Listener   // For TCP
 	PacketConn net.PacketConn // For UDP
 	Client     *ClientConn
-	ctx        context.Context
-	cancel     context.CancelFunc
+	// Sources allowed to reach the port, empty allows all
+	AllowedSources []string
+	sources        []netip.Prefix
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// allows reports whether a connection or packet from addr may use the port
+func (pl *PortListener) allows(addr net.Addr) bool {
+	if len(pl.sources) == 0 {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	// IPv4 peers of dual-stack listeners show up as IPv4-mapped IPv6 addresses
+	ip := addrPort.Addr().Unmap()
+	for _, prefix := range pl.sources {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // NewPortForwardManager creates a new port forward manager.
@@ -133,7 +163,7 @@ func (pm *PortForwardManager) OpenPorts(client *ClientConn, openPorts []config.O
 		portListener, err := pm.createPortListener(client, openPort)
 		if err != nil {
 			logger.Error("Failed to create port listener", "client_id", client.ID, "port_key", portKey.String(), "err", err)
-			errors = append(errors, fmt.Errorf("failed to open port %d (%s): %v", openPort.RemotePort, openPort.Protocol, err))
+			errors = append(errors, fmt.Errorf("failed to open port %d (%s): %w", openPort.RemotePort, openPort.Protocol, err))
 			continue
 		}
 
@@ -170,6 +200,56 @@ func (pm *PortForwardManager) OpenPorts(client *ClientConn, openPorts []config.O
 	return nil
 }
 
+// ReplaceClientPorts makes openPorts the complete port set of the client, closing ports
+// it no longer requests or whose local target or allowed sources changed before opening the new ones
+func (pm *PortForwardManager) ReplaceClientPorts(client *ClientConn, openPorts []config.OpenPort) error {
+	if client == nil {
+		return fmt.Errorf("client cannot be nil")
+	}
+
+	wanted := make(map[PortKey]config.OpenPort, len(openPorts))
+	for _, openPort := range openPorts {
+		wanted[PortKey{Port: openPort.RemotePort, Protocol: openPort.Protocol}] = openPort
+	}
+
+	pm.mutex.Lock()
+	closed := 0
+	for portKey, portListener := range pm.clientPorts[client.ID] {
+		if openPort, ok := wanted[portKey]; ok && openPort.LocalHost == portListener.LocalHost && openPort.LocalPort == portListener.LocalPort &&
+			slices.Equal(openPort.AllowedSources, portListener.AllowedSources) {
+			continue
+		}
+		pm.closePortListener(client.ID, portKey, portListener)
+		closed++
+	}
+	pm.mutex.Unlock()
+
+	if closed > 0 {
+		logger.Info("Closed ports no longer requested by client", "client_id", client.ID, "closed_ports", closed)
+	}
+	if len(openPorts) == 0 {
+		return nil
+	}
+	return pm.OpenPorts(client, openPorts)
+}
+
+// closePortListener stops a single port of the client and frees it immediately, caller must hold pm.mutex
+func (pm *PortForwardManager) closePortListener(clientID string, portKey PortKey, portListener *PortListener) {
+	if pm.portOwners[portKey] == clientID {
+		delete(pm.portOwners, portKey)
+	}
+	delete(pm.clientPorts[clientID], portKey)
+
+	portListener.cancel()
+	if portListener.Listener != nil {
+		_ = portListener.Listener.Close()
+	}
+	if portListener.PacketConn != nil {
+		_ = portListener.PacketConn.Close()
+	}
+	logger.Info("Port forwarding stopped for client", "client_id", clientID, "port", portListener.Port, "protocol", portListener.Protocol)
+}
+
 // createPortListener creates port listener
 func (pm *PortForwardManager) createPortListener(client *ClientConn, openPort config.OpenPort) (*PortListener, error) {
 	logger.Debug("Creating port listener", "client_id", client.ID, "port", openPort.RemotePort, "protocol", openPort.Protocol, "local_target", fmt.Sprintf("%s:%d", openPort.LocalHost, openPort.LocalPort))
@@ -180,17 +260,28 @@ func (pm *PortForwardManager) createPortListener(client *ClientConn, openPort co
 		return nil, fmt.Errorf("protocol %s not supported, only TCP and UDP are supported", openPort.Protocol)
 	}
 
+	sources := make([]netip.Prefix, 0, len(openPort.AllowedSources))
+	for _, source := range openPort.AllowedSources {
+		prefix, err := config.ParseSourcePrefix(source)
+		if err != nil {
+			return nil, fmt.Errorf("port %d allowed_sources: %w", openPort.RemotePort, err)
+		}
+		sources = append(sources, prefix)
+	}
+
 	ctx, cancel := context.WithCancel(pm.ctx)
 	addr := fmt.Sprintf(":%d", openPort.RemotePort)
 	portListener := &PortListener{
-		Port:      openPort.RemotePort,
-		Protocol:  openPort.Protocol,
-		ClientID:  client.ID,
-		LocalHost: openPort.LocalHost,
-		LocalPort: openPort.LocalPort,
-		Client:    client,
-		ctx:       ctx,
-		cancel:    cancel,
+		Port:           openPort.RemotePort,
+		Protocol:       openPort.Protocol,
+		ClientID:       client.ID,
+		LocalHost:      openPort.LocalHost,
+		LocalPort:      openPort.LocalPort,
+		Client:         client,
+		AllowedSources: openPort.AllowedSources,
+		sources:        sources,
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 
 	logger.Debug("Port listener structure created", "client_id", client.ID, "port", openPort.RemotePort, "bind_addr", addr)
@@ -199,11 +290,11 @@ func (pm *PortForwardManager) createPortListener(client *ClientConn, openPort co
 		// Create TCP listener
 		logger.Debug("Creating TCP listener", "client_id", client.ID, "port", openPort.RemotePort, "bind_addr", addr)
 
-		listener, err := net.Listen(protocol.ProtocolTCP, addr)
+		listener, err := sockopt.Listen(pm.ctx, protocol.ProtocolTCP, addr, pm.socketOptions)
 		if err != nil {
 			logger.Error("Failed to create TCP listener", "client_id", client.ID, "port", openPort.RemotePort, "bind_addr", addr, "err", err)
 			cancel()
-			return nil, fmt.Errorf("failed to listen on TCP port %d: %v", openPort.RemotePort, err)
+			return nil, fmt.Errorf("failed to listen on TCP port %d: %w", openPort.RemotePort, err)
 		}
 		portListener.Listener = listener
 
@@ -212,11 +303,11 @@ func (pm *PortForwardManager) createPortListener(client *ClientConn, openPort co
 		// Create UDP listener
 		logger.Debug("Creating UDP packet connection", "client_id", client.ID, "port", openPort.RemotePort, "bind_addr", addr)
 
-		packetConn, err := net.ListenPacket("udp", addr)
+		packetConn, err := sockopt.ListenPacket(pm.ctx, "udp", addr, pm.socketOptions)
 		if err != nil {
 			logger.Error("Failed to create UDP packet connection", "client_id", client.ID, "port", openPort.RemotePort, "bind_addr", addr, "err", err)
 			cancel()
-			return nil, fmt.Errorf("failed to listen on UDP port %d: %v", openPort.RemotePort, err)
+			return nil, fmt.Errorf("failed to listen on UDP port %d: %w", openPort.RemotePort, err)
 		}
 		portListener.PacketConn = packetConn
 
@@ -236,11 +327,11 @@ func (pm *PortForwardManager) handlePortListener(portListener *PortListener) {
 
 		// Close the appropriate connection based on protocol
 		if portListener.Protocol == protocol.ProtocolTCP && portListener.Listener != nil {
-			if err := portListener.Listener.Close(); err != nil {
+			if err := portListener.Listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 				logger.Warn("Error closing TCP listener", "port", portListener.Port, "err", err)
 			}
 		} else if portListener.PacketConn != nil {
-			if err := portListener.PacketConn.Close(); err != nil {
+			if err := portListener.PacketConn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 				logger.Warn("Error closing UDP packet connection", "port", portListener.Port, "err", err)
 			}
 		}
@@ -297,6 +388,11 @@ func (pm *PortForwardManager) handleTCPPortListener(portListener *PortListener)
 			if !ok {
 				return
 			}
+			if !portListener.allows(conn.RemoteAddr()) {
+				logger.Debug("Rejected connection from source not allowed on forwarded port", "port", portListener.Port, "client_id", portListener.ClientID, "remote_addr", conn.RemoteAddr().String())
+				_ = conn.Close()
+				continue
+			}
 			// Handle the connection asynchronously
 			pm.wg.Add(1)
 			go func(incomingConn net.Conn) {
@@ -308,7 +404,7 @@ func (pm *PortForwardManager) handleTCPPortListener(portListener *PortListener)
 				return
 			}
 			// Check if the error is due to listener being closed (normal shutdown)
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if errors.Is(err, net.ErrClosed) {
 				logger.Debug("Port listener closed", "port", portListener.Port)
 				return
 			}
@@ -365,6 +461,10 @@ func (pm *PortForwardManager) handleUDPPortListener(portListener *PortListener)
 			if !ok {
 				return
 			}
+			if !portListener.allows(packet.addr) {
+				logger.Debug("Dropped packet from source not allowed on forwarded port", "port", portListener.Port, "client_id", portListener.ClientID, "remote_addr", packet.addr.String())
+				continue
+			}
 			// Handle the UDP packet asynchronously
 			pm.wg.Add(1)
 			go func(data []byte, clientAddr net.Addr) {
@@ -376,7 +476,7 @@ func (pm *PortForwardManager) handleUDPPortListener(portListener *PortListener)
 				return
 			}
 			// Check if the error is due to connection being closed (normal shutdown)
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if errors.Is(err, net.ErrClosed) {
 				logger.Debug("UDP port listener closed", "port", portListener.Port)
 				return
 			}
@@ -598,6 +698,12 @@ func (pm *PortForwardManager) copyDataWithContext(ctx context.Context, dst, src
 			if err != net.ErrClosed {
 				logger.Debug("Port forward connection closed", "direction", direction, "port", port, "err", err, "transferred_bytes", totalBytes)
 			}
+			// Forward the half-close, the other direction keeps copying
+			if err == io.EOF {
+				if closeErr := connection.CloseWrite(dst); closeErr != nil {
+					logger.Debug("Failed to half-close port forward connection", "direction", direction, "port", port, "err", closeErr)
+				}
+			}
 			return
 		}
 	}
@@ -3,6 +3,7 @@ package gateway
 import (
 	"context"
 	"net"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -184,6 +185,54 @@ func TestPortForwardManager_CloseClientPorts(t *testing.T) {
 	}
 }
 
+func TestPortForwardManager_ReplaceClientPorts(t *testing.T) {
+	mgr := NewPortForwardManager()
+	defer mgr.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &ClientConn{ID: "test-client", GroupID: "test-group", ctx: ctx, cancel: cancel}
+
+	keep := config.OpenPort{RemotePort: 18120, LocalPort: 8120, LocalHost: "localhost", Protocol: "tcp"}
+	drop := config.OpenPort{RemotePort: 18121, LocalPort: 8121, LocalHost: "localhost", Protocol: "tcp"}
+	if err := mgr.ReplaceClientPorts(client, []config.OpenPort{keep, drop}); err != nil {
+		t.Fatalf("ReplaceClientPorts() error = %v", err)
+	}
+	kept := mgr.clientPorts[client.ID][PortKey{Port: 18120, Protocol: "tcp"}]
+
+	// Drop one port, retarget the kept one and add a new one
+	retarget := keep
+	retarget.LocalPort = 9120
+	added := config.OpenPort{RemotePort: 18122, LocalPort: 8122, LocalHost: "localhost", Protocol: "tcp"}
+	if err := mgr.ReplaceClientPorts(client, []config.OpenPort{retarget, added}); err != nil {
+		t.Fatalf("ReplaceClientPorts() error = %v", err)
+	}
+	if _, exists := mgr.portOwners[PortKey{Port: 18121, Protocol: "tcp"}]; exists {
+		t.Error("Dropped port should be closed")
+	}
+	current := mgr.clientPorts[client.ID][PortKey{Port: 18120, Protocol: "tcp"}]
+	if current == nil || current == kept || current.LocalPort != 9120 {
+		t.Errorf("Retargeted port should be reopened, got %+v", current)
+	}
+	if _, exists := mgr.portOwners[PortKey{Port: 18122, Protocol: "tcp"}]; !exists {
+		t.Error("Added port should be opened")
+	}
+
+	// The dropped port is free again
+	listener, err := net.Listen("tcp", ":18121")
+	if err != nil {
+		t.Fatalf("Dropped port still bound: %v", err)
+	}
+	_ = listener.Close()
+
+	if err := mgr.ReplaceClientPorts(client, nil); err != nil {
+		t.Fatalf("ReplaceClientPorts() error = %v", err)
+	}
+	if len(mgr.clientPorts[client.ID]) != 0 || len(mgr.portOwners) != 0 {
+		t.Errorf("All ports should be closed, got %d", len(mgr.portOwners))
+	}
+}
+
 func TestPortForwardManager_Stop(t *testing.T) {
 	mgr := NewPortForwardManager()
 	ctx, cancel := context.WithCancel(context.Background())
@@ -529,3 +578,53 @@ func TestPortForwardManager_ProtocolSpecificOperations(t *testing.T) {
 	mgr.CloseClientPorts(client1.ID)
 	mgr.CloseClientPorts(client2.ID)
 }
+
+func TestPortForwardManager_AllowedSources(t *testing.T) {
+	mgr := NewPortForwardManager()
+	defer mgr.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &ClientConn{ID: "test-client", GroupID: "test-group", ctx: ctx, cancel: cancel}
+
+	port := config.OpenPort{RemotePort: 19201, LocalPort: 3389, LocalHost: "localhost", Protocol: "tcp", AllowedSources: []string{"192.0.2.0/24", "2001:db8::1"}}
+	if err := mgr.ReplaceClientPorts(client, []config.OpenPort{port}); err != nil {
+		t.Fatal(err)
+	}
+	listener := mgr.clientPorts[client.ID][PortKey{Port: 19201, Protocol: "tcp"}]
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.55"), Port: 50000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.55"), Port: 50000}, true},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 50000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 50000}, false},
+	}
+	for _, tt := range tests {
+		if got := listener.allows(tt.addr); got != tt.want {
+			t.Errorf("allows(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// Connections from other sources are closed before reaching the client
+	conn, err := net.Dial("tcp", "127.0.0.1:19201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+
+	// Changed sources reopen the port with the new list
+	port.AllowedSources = nil
+	if err := mgr.ReplaceClientPorts(client, []config.OpenPort{port}); err != nil {
+		t.Fatal(err)
+	}
+	if l := mgr.clientPorts[client.ID][PortKey{Port: 19201, Protocol: "tcp"}]; l == listener || !l.allows(&net.TCPAddr{IP: net.ParseIP("198.51.100.1")}) {
+		t.Error("Expected the port to be reopened without source restrictions")
+	}
+}
@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/schedule"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// ErrAccessOverrideNotFound is returned when removing an override that doesn't exist
+var ErrAccessOverrideNotFound = errors.New("access override not found")
+
+// AccessOverride allows a group, or one proxy user of it, to create connections regardless of its
+// schedule, or denies them, until it expires. Overrides last until the gateway restarts.
+type AccessOverride struct {
+	GroupID  string    `json:"group_id"`
+	Username string    `json:"username,omitempty"` // Empty overrides the whole group
+	Allow    bool      `json:"allow"`              // False denies connections even inside the schedule
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// accessKey identifies the group or group user a schedule or override applies to
+type accessKey struct {
+	groupID  string
+	username string // Empty for the whole group
+}
+
+// accessSchedules decides when groups and users may create new connections
+type accessSchedules struct {
+	defaults  *schedule.Schedule               // Schedule of group_defaults
+	groups    map[string]*schedule.Schedule    // Schedules of groups with their own config, nil = any time
+	users     map[accessKey]*schedule.Schedule // Schedules of users with their own schedule
+	now       func() time.Time
+	mu        sync.Mutex
+	overrides map[accessKey]AccessOverride
+}
+
+// newAccessSchedules compiles the schedules of all groups and users
+func newAccessSchedules(cfg *config.GatewayConfig) (*accessSchedules, error) {
+	s := &accessSchedules{
+		groups:    make(map[string]*schedule.Schedule),
+		users:     make(map[accessKey]*schedule.Schedule),
+		now:       time.Now,
+		overrides: make(map[accessKey]AccessOverride),
+	}
+	var err error
+	if s.defaults, err = cfg.GroupDefaults.Schedule.Compile(); err != nil {
+		return nil, fmt.Errorf("group_defaults.schedule: %w", err)
+	}
+	for groupID, groupCfg := range cfg.Groups {
+		if s.groups[groupID], err = groupCfg.Schedule.Compile(); err != nil {
+			return nil, fmt.Errorf("groups.%s.schedule: %w", groupID, err)
+		}
+		for username, userSchedule := range groupCfg.UserSchedules {
+			if s.users[accessKey{groupID, username}], err = userSchedule.Compile(); err != nil {
+				return nil, fmt.Errorf("groups.%s.user_schedules.%s: %w", groupID, username, err)
+			}
+		}
+	}
+	for username, userSchedule := range cfg.GroupDefaults.UserSchedules {
+		key := accessKey{"", username}
+		if s.users[key], err = userSchedule.Compile(); err != nil {
+			return nil, fmt.Errorf("group_defaults.user_schedules.%s: %w", username, err)
+		}
+	}
+	return s, nil
+}
+
+// check returns ErrOutsideSchedule when the user of the group may not create connections now
+func (s *accessSchedules) check(groupID, username string) error {
+	if s == nil {
+		return nil
+	}
+	now := s.now()
+	if username != "" {
+		if override, ok := s.override(accessKey{groupID, username}, now); ok {
+			return overrideError(override)
+		}
+	}
+	if override, ok := s.override(accessKey{groupID, ""}, now); ok {
+		return overrideError(override)
+	}
+	if !s.scheduleOf(groupID, username).Allows(now) {
+		return fmt.Errorf("%w: group %s", utils.ErrOutsideSchedule, groupID)
+	}
+	return nil
+}
+
+// scheduleOf returns the schedule of a user, falling back to the schedule of the group
+func (s *accessSchedules) scheduleOf(groupID, username string) *schedule.Schedule {
+	groupSchedule, ok := s.groups[groupID]
+	if !ok {
+		// Groups without their own config use group_defaults, also for user schedules
+		groupSchedule, groupID = s.defaults, ""
+	}
+	if username != "" {
+		if userSchedule, ok := s.users[accessKey{groupID, username}]; ok {
+			return userSchedule
+		}
+	}
+	return groupSchedule
+}
+
+// override returns the unexpired override of key, removing an expired one
+func (s *accessSchedules) override(key accessKey, now time.Time) (AccessOverride, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	override, ok := s.overrides[key]
+	if ok && !now.Before(override.Until) {
+		delete(s.overrides, key)
+		return AccessOverride{}, false
+	}
+	return override, ok
+}
+
+// overrideError returns the error for connections an override decides on
+func overrideError(override AccessOverride) error {
+	if override.Allow {
+		return nil
+	}
+	return fmt.Errorf("%w: denied until %s", utils.ErrOutsideSchedule, override.Until.Format(time.RFC3339))
+}
+
+// checkSchedule rejects the dial when the user's group or the user may not create connections now
+func (g *Gateway) checkSchedule(userCtx *utils.UserContext) error {
+	return g.schedules.check(userCtx.GroupID, userCtx.Username)
+}
+
+// SetAccessOverride adds or replaces the override of a group or group user
+func (g *Gateway) SetAccessOverride(override AccessOverride) error {
+	if override.GroupID == "" {
+		return fmt.Errorf("group_id is required")
+	}
+	if !override.Until.After(g.schedules.now()) {
+		return fmt.Errorf("override must end in the future")
+	}
+	g.schedules.mu.Lock()
+	defer g.schedules.mu.Unlock()
+	g.schedules.overrides[accessKey{override.GroupID, override.Username}] = override
+	return nil
+}
+
+// RemoveAccessOverride removes the override of a group or group user
+func (g *Gateway) RemoveAccessOverride(groupID, username string) error {
+	g.schedules.mu.Lock()
+	defer g.schedules.mu.Unlock()
+	key := accessKey{groupID, username}
+	if _, ok := g.schedules.overrides[key]; !ok {
+		return ErrAccessOverrideNotFound
+	}
+	delete(g.schedules.overrides, key)
+	return nil
+}
+
+// ListAccessOverrides returns the unexpired overrides, sorted by group and user
+func (g *Gateway) ListAccessOverrides() []AccessOverride {
+	now := g.schedules.now()
+	g.schedules.mu.Lock()
+	defer g.schedules.mu.Unlock()
+	overrides := make([]AccessOverride, 0, len(g.schedules.overrides))
+	for key, override := range g.schedules.overrides {
+		if !now.Before(override.Until) {
+			delete(g.schedules.overrides, key)
+			continue
+		}
+		overrides = append(overrides, override)
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		if overrides[i].GroupID != overrides[j].GroupID {
+			return overrides[i].GroupID < overrides[j].GroupID
+		}
+		return overrides[i].Username < overrides[j].Username
+	})
+	return overrides
+}
@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestAccessSchedules(t *testing.T) {
+	businessHours := config.AccessSchedule{
+		Timezone: "UTC",
+		Windows:  []config.AccessWindow{{Days: []string{"mon-fri"}, Hours: "09:00-17:00"}},
+	}
+	schedules, err := newAccessSchedules(&config.GatewayConfig{
+		Groups: map[string]config.GroupConfig{
+			"contractors": {
+				Schedule:      businessHours,
+				UserSchedules: map[string]config.AccessSchedule{"oncall": {}},
+			},
+			"office": {},
+		},
+		GroupDefaults: config.GroupConfig{Schedule: businessHours},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Gateway{schedules: schedules}
+
+	// Saturday noon
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	schedules.now = func() time.Time { return now }
+
+	tests := []struct {
+		name     string
+		groupID  string
+		username string
+		allowed  bool
+	}{
+		{"contractor on the weekend", "contractors", "alice", false},
+		{"user with an unrestricted schedule", "contractors", "oncall", true},
+		{"group with its own config and no schedule", "office", "bob", true},
+		{"group using group_defaults", "partners", "carol", false},
+	}
+	for _, tt := range tests {
+		err := g.checkSchedule(&utils.UserContext{GroupID: tt.groupID, Username: tt.username})
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: got %v, allowed %v", tt.name, err, tt.allowed)
+		}
+		if err != nil && !errors.Is(err, utils.ErrOutsideSchedule) {
+			t.Errorf("%s: expected ErrOutsideSchedule, got %v", tt.name, err)
+		}
+	}
+
+	// A group override allows the group, a user override denies one of its users
+	if err := g.SetAccessOverride(AccessOverride{GroupID: "contractors", Allow: true, Until: now.Add(2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetAccessOverride(AccessOverride{GroupID: "contractors", Username: "mallory", Until: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.checkSchedule(&utils.UserContext{GroupID: "contractors", Username: "alice"}); err != nil {
+		t.Errorf("Expected the group override to allow alice, got %v", err)
+	}
+	if err := g.checkSchedule(&utils.UserContext{GroupID: "contractors", Username: "mallory"}); err == nil {
+		t.Error("Expected the user override to deny mallory")
+	}
+	if overrides := g.ListAccessOverrides(); len(overrides) != 2 || overrides[1].Username != "mallory" {
+		t.Errorf("Unexpected overrides: %+v", overrides)
+	}
+
+	// Overrides expire
+	now = now.Add(90 * time.Minute)
+	if err := g.checkSchedule(&utils.UserContext{GroupID: "contractors", Username: "mallory"}); err != nil {
+		t.Errorf("Expected the expired user override to fall back to the group override, got %v", err)
+	}
+	if err := g.RemoveAccessOverride("contractors", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RemoveAccessOverride("contractors", ""); !errors.Is(err, ErrAccessOverrideNotFound) {
+		t.Errorf("Expected ErrAccessOverrideNotFound, got %v", err)
+	}
+	if err := g.SetAccessOverride(AccessOverride{GroupID: "contractors", Allow: true, Until: now}); err == nil {
+		t.Error("Expected an override ending now to be rejected")
+	}
+}
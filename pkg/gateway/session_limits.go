@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// maxThrottleDelay caps how long a throttled session waits before it is checked again
+const maxThrottleDelay = 5 * time.Second
+
+// sessionLimits gates new proxy sessions with the user and ip rules of the rate limiter,
+// counting the open sessions of each user and source IP for their concurrent limits
+type sessionLimits struct {
+	limiter *ratelimit.RateLimiter
+	mu      sync.Mutex
+	users   map[string]int64
+	ips     map[string]int64
+}
+
+// SetRateLimiter makes the user and ip rules of rl gate new proxy sessions, set before Start
+func (g *Gateway) SetRateLimiter(rl *ratelimit.RateLimiter) {
+	if rl == nil {
+		g.sessions = nil
+		return
+	}
+	g.sessions = &sessionLimits{limiter: rl, users: make(map[string]int64), ips: make(map[string]int64)}
+}
+
+// limitSessions wraps the proxy dial function to check the rate limit rules of the user and
+// source IP before dialing. A session ends when its connection is closed.
+func (g *Gateway) limitSessions(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		userCtx, ok := commonctx.GetUserContext(ctx)
+		if g.sessions == nil || !ok || userCtx.GroupID == "" {
+			return dial(ctx, network, addr)
+		}
+		release, err := g.sessions.admit(ctx, userCtx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		return &limitedConn{Conn: conn, release: release}, nil
+	}
+}
+
+// sessionUser identifies a proxy user in user rules: group_id/username, or the group ID for
+// users of the group credentials
+func sessionUser(userCtx *utils.UserContext) string {
+	if userCtx.Username == "" || userCtx.Username == userCtx.GroupID {
+		return userCtx.GroupID
+	}
+	return userCtx.GroupID + "/" + userCtx.Username
+}
+
+// peek returns what the rules decide for a new session of the user, without opening it
+func (s *sessionLimits) peek(userCtx *utils.UserContext) *ratelimit.LimitResult {
+	user, ip := sessionUser(userCtx), userCtx.SourceIP
+	s.mu.Lock()
+	userConns, ipConns := s.users[user]+1, int64(0)
+	if ip != "" {
+		ipConns = s.ips[ip] + 1
+	}
+	s.mu.Unlock()
+	return s.limiter.PeekSession(user, ip, userConns, ipConns)
+}
+
+// admit opens a session of the user, applying the action of a rule it exceeds: block rejects
+// it, throttle delays it and checks again, log only logs. The returned function ends the session.
+func (s *sessionLimits) admit(ctx context.Context, userCtx *utils.UserContext) (func(), error) {
+	user, ip := sessionUser(userCtx), userCtx.SourceIP
+
+	s.mu.Lock()
+	s.users[user]++
+	userConns := s.users[user]
+	var ipConns int64
+	if ip != "" {
+		s.ips[ip]++
+		ipConns = s.ips[ip]
+	}
+	s.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.users[user]--; s.users[user] <= 0 {
+				delete(s.users, user)
+			}
+			if ip != "" {
+				if s.ips[ip]--; s.ips[ip] <= 0 {
+					delete(s.ips, ip)
+				}
+			}
+		})
+	}
+
+	result := s.limiter.CheckSession(user, ip, userConns, ipConns)
+	if !result.Allowed && result.Action == "throttle" {
+		delay := min(result.RetryAfter, maxThrottleDelay)
+		if delay <= 0 {
+			delay = time.Second
+		}
+		logger.Debug("Rate limit throttles proxy session", "user", user, "source_ip", ip, "limit_type", result.LimitType, "reason", result.Reason, "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			release()
+			return nil, ctx.Err()
+		}
+		s.mu.Lock()
+		userConns, ipConns = s.users[user], s.ips[ip]
+		s.mu.Unlock()
+		result = s.limiter.CheckSession(user, ip, userConns, ipConns)
+	}
+
+	switch {
+	case result.Allowed:
+		return release, nil
+	case result.Action == "log":
+		logger.Warn("Rate limit exceeded by proxy session, allowed by log action", "user", user, "source_ip", ip, "limit_type", result.LimitType, "reason", result.Reason)
+		return release, nil
+	}
+	release()
+	logger.Warn("Rate limit rejected proxy session", "user", user, "source_ip", ip, "limit_type", result.LimitType, "reason", result.Reason, "action", result.Action)
+	return nil, fmt.Errorf("%w: %s %s", utils.ErrRateLimited, result.LimitType, result.Reason)
+}
@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+)
+
+func TestLimitSessions(t *testing.T) {
+	rl := ratelimit.NewRateLimiter(nil)
+	_ = rl.UpdateConfig(&ratelimit.Config{Rules: []*ratelimit.Rule{
+		{ID: "alice", Type: "user", Identifier: "office/alice", Enabled: true, ConcurrentLimit: 1, Action: "block"},
+		{ID: "audit", Type: "ip", Identifier: "192.0.2.0/24", Enabled: true, ConcurrentLimit: 1, Action: "log"},
+	}})
+	g := &Gateway{}
+	g.SetRateLimiter(rl)
+	dial := g.limitSessions(func(context.Context, string, string) (net.Conn, error) {
+		client, _ := net.Pipe()
+		return client, nil
+	})
+	alice := commonctx.WithUserContext(context.Background(), &utils.UserContext{GroupID: "office", Username: "alice", SourceIP: "198.51.100.1"})
+
+	conn, err := dial(alice, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial(alice, "tcp", "example.com:443"); !errors.Is(err, utils.ErrRateLimited) || utils.ErrorCodeOf(err) != utils.ErrCodeQuotaExceeded {
+		t.Fatalf("Expected a second concurrent session to be rate limited, got %v", err)
+	}
+	_ = conn.Close()
+	conn, err = dial(alice, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Expected the session to be admitted after the first closed, got %v", err)
+	}
+	_ = conn.Close()
+
+	// The log action only logs
+	bob := commonctx.WithUserContext(context.Background(), &utils.UserContext{GroupID: "office", Username: "bob", SourceIP: "192.0.2.7"})
+	for i := 0; i < 2; i++ {
+		if _, err := dial(bob, "tcp", "example.com:443"); err != nil {
+			t.Fatalf("Expected the log action to admit session %d, got %v", i, err)
+		}
+	}
+}
+
+func TestLimitSessions_Throttle(t *testing.T) {
+	rl := ratelimit.NewRateLimiter(nil)
+	_ = rl.UpdateConfig(&ratelimit.Config{Rules: []*ratelimit.Rule{
+		{ID: "burst", Type: "user", Identifier: "*", Enabled: true, RequestLimit: 1, RequestWindow: 100 * time.Millisecond, Action: "throttle"},
+	}})
+	g := &Gateway{}
+	g.SetRateLimiter(rl)
+	dial := g.limitSessions(func(context.Context, string, string) (net.Conn, error) {
+		client, _ := net.Pipe()
+		return client, nil
+	})
+	ctx := commonctx.WithUserContext(context.Background(), &utils.UserContext{GroupID: "office", Username: "alice"})
+
+	if _, err := dial(ctx, "tcp", "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := dial(ctx, "tcp", "example.com:443"); err != nil {
+		t.Fatalf("Expected the throttled session to be admitted in the next window, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the session to be delayed, took %v", elapsed)
+	}
+}
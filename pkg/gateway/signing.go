@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"fmt"
+
+	"github.com/buhuipao/anyproxy/pkg/common/groupkey"
+)
+
+// verifyControl checks the signature of a control message from the client. Signed messages must
+// verify with the key of the client's group password, unsigned ones are rejected when the group
+// requires signed control messages.
+func (c *ClientConn) verifyControl(msg map[string]interface{}) error {
+	signature, _ := msg["signature"].([]byte)
+	if signature == nil {
+		if c.signedControl {
+			return fmt.Errorf("group requires signed control messages")
+		}
+		return nil
+	}
+	body, _ := msg["signed_body"].([]byte)
+	if !groupkey.Verify(c.controlKey, body, signature) {
+		return fmt.Errorf("invalid control message signature")
+	}
+	return nil
+}
+
+// signControl returns the hex encoded signature of a control message to the client, empty when
+// the client authenticated without a group password. Every push is signed, the signature only
+// authenticates this process.
+func (c *ClientConn) signControl(body []byte) string {
+	if c.controlKey == nil {
+		return ""
+	}
+	return groupkey.SignHex(c.controlKey, body)
+}
@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/groupkey"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+)
+
+func TestClientConn_VerifyControl(t *testing.T) {
+	key := groupkey.Derive("office", "secret")
+	ports := []protocol.PortConfig{{RemotePort: 8080, LocalPort: 80, LocalHost: "localhost", Protocol: "tcp"}}
+	request := func(signKey []byte) map[string]interface{} {
+		packed := protocol.PackPortForwardMessage("client", ports)
+		if signKey != nil {
+			packed = protocol.PackSignedPortForwardMessage("client", ports, func(body []byte) []byte {
+				return groupkey.Sign(signKey, body)
+			})
+		}
+		_, _, payload, _ := protocol.UnpackBinaryHeader(packed)
+		_, _, body, signature, err := protocol.UnpackPortForwardMessageWithSignature(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := map[string]interface{}{"type": protocol.MsgTypePortForwardReq}
+		if signature != nil {
+			msg["signed_body"], msg["signature"] = body, signature
+		}
+		return msg
+	}
+
+	tests := []struct {
+		name     string
+		client   *ClientConn
+		msg      map[string]interface{}
+		accepted bool
+	}{
+		{"signed", &ClientConn{controlKey: key, signedControl: true}, request(key), true},
+		{"unsigned", &ClientConn{controlKey: key}, request(nil), true},
+		{"unsigned with signed_control", &ClientConn{controlKey: key, signedControl: true}, request(nil), false},
+		{"signed by another password", &ClientConn{controlKey: key}, request(groupkey.Derive("office", "other")), false},
+		{"signed without a password at the gateway", &ClientConn{}, request(key), false},
+	}
+	for _, tt := range tests {
+		if err := tt.client.verifyControl(tt.msg); (err == nil) != tt.accepted {
+			t.Errorf("%s: got %v, accepted %v", tt.name, err, tt.accepted)
+		}
+	}
+	if (&ClientConn{}).signControl([]byte("body")) != "" {
+		t.Error("Expected no signature without a key")
+	}
+}
@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"net/netip"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// sourceRoute maps source ranges to the group serving users without credentials
+type sourceRoute struct {
+	prefixes []netip.Prefix
+	groupID  string
+}
+
+// sourceRoutes is an ordered source IP routing table, the first matching rule wins
+type sourceRoutes []sourceRoute
+
+// newSourceRoutes builds the routing table from validated rules
+func newSourceRoutes(rules []config.SourceRouteRule) (sourceRoutes, error) {
+	routes := make(sourceRoutes, 0, len(rules))
+	for _, rule := range rules {
+		route := sourceRoute{groupID: rule.GroupID}
+		for _, cidr := range rule.CIDRs {
+			prefix, err := config.ParseSourcePrefix(cidr)
+			if err != nil {
+				return nil, err
+			}
+			route.prefixes = append(route.prefixes, prefix)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// lookup returns the group for a source IP, it implements utils.SourceRouter
+func (r sourceRoutes) lookup(sourceIP string) (string, bool) {
+	addr, err := netip.ParseAddr(sourceIP)
+	if err != nil {
+		return "", false
+	}
+	// IPv4 clients of dual-stack listeners show up as IPv4-mapped IPv6 addresses
+	addr = addr.Unmap()
+	for _, route := range r {
+		for _, prefix := range route.prefixes {
+			if prefix.Contains(addr) {
+				logger.Debug("Source IP matched routing rule", "source_ip", sourceIP, "prefix", prefix.String(), "group_id", route.groupID)
+				return route.groupID, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestSourceRoutes_Lookup(t *testing.T) {
+	routes, err := newSourceRoutes([]config.SourceRouteRule{
+		{CIDRs: []string{"10.1.2.3"}, GroupID: "printer"},
+		{CIDRs: []string{"10.1.0.0/16", "fd00::/8"}, GroupID: "office"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sourceIP string
+		want     string
+		wantOK   bool
+	}{
+		{sourceIP: "10.1.2.3", want: "printer", wantOK: true},
+		{sourceIP: "10.1.9.9", want: "office", wantOK: true},
+		{sourceIP: "::ffff:10.1.9.9", want: "office", wantOK: true},
+		{sourceIP: "fd12::1", want: "office", wantOK: true},
+		{sourceIP: "10.2.0.1"},
+		{sourceIP: "unknown"},
+	}
+	for _, tt := range tests {
+		got, ok := routes.lookup(tt.sourceIP)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("lookup(%q) = %q, %v, want %q, %v", tt.sourceIP, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
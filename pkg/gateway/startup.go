@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Defaults of the startup retries of listeners
+const (
+	defaultBindAttempts   = 5
+	defaultBindBackoff    = 200 * time.Millisecond
+	defaultMaxBindBackoff = 5 * time.Second
+)
+
+// States of the gateway's listeners reported by the health API
+const (
+	ComponentStarting = "starting"
+	ComponentServing  = "serving"
+	ComponentRetrying = "retrying"
+	ComponentFailed   = "failed"
+	ComponentStopped  = "stopped"
+)
+
+// componentState is the state of a listener and the error of its last failed start
+type componentState struct {
+	state    string
+	attempts int
+	err      error
+}
+
+// componentStates tracks the state of each listener, the zero value is ready to use
+type componentStates struct {
+	mu     sync.Mutex
+	states map[string]componentState
+}
+
+func (c *componentStates) set(name, state string, attempts int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.states == nil {
+		c.states = make(map[string]componentState)
+	}
+	c.states[name] = componentState{state: state, attempts: attempts, err: err}
+}
+
+func (c *componentStates) get(name string) componentState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.states[name]
+}
+
+// stopAll marks every listener stopped
+func (c *componentStates) stopAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, state := range c.states {
+		c.states[name] = componentState{state: ComponentStopped, attempts: state.attempts}
+	}
+}
+
+// startupPolicy returns the attempts and backoffs of binding a listener, with defaults applied
+func (g *Gateway) startupPolicy() (attempts int, backoff, maxBackoff time.Duration) {
+	startup := g.config.Startup
+	attempts, backoff, maxBackoff = startup.BindAttempts, startup.BindBackoff, startup.MaxBindBackoff
+	if attempts == 0 {
+		attempts = defaultBindAttempts
+	}
+	if backoff == 0 {
+		backoff = defaultBindBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBindBackoff
+	}
+	return attempts, min(backoff, maxBackoff), maxBackoff
+}
+
+// startWithRetry runs start until the listener serves or the startup attempts are used up
+func (g *Gateway) startWithRetry(name string, start func() error) error {
+	attempts, backoff, maxBackoff := g.startupPolicy()
+	var err error
+	for attempt := 1; ; attempt++ {
+		g.components.set(name, ComponentStarting, attempt, nil)
+		if err = g.startListener(start); err == nil {
+			g.components.set(name, ComponentServing, attempt, nil)
+			if attempt > 1 {
+				logger.Info("Gateway listener started after retries", "component", name, "attempts", attempt)
+			}
+			return nil
+		}
+		if attempt >= attempts {
+			g.components.set(name, ComponentFailed, attempt, err)
+			return err
+		}
+
+		g.components.set(name, ComponentRetrying, attempt, err)
+		logger.Warn("Failed to start gateway listener, retrying", "component", name, "attempt", attempt, "max_attempts", attempts, "retry_in", backoff, "err", err)
+		if !g.sleep(backoff) {
+			g.components.set(name, ComponentStopped, attempt, err)
+			return err
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// retryInBackground keeps starting a listener that failed at start until it serves or the gateway stops
+func (g *Gateway) retryInBackground(name string, start func() error) {
+	_, _, maxBackoff := g.startupPolicy()
+	state := g.components.get(name)
+	g.components.set(name, ComponentRetrying, state.attempts, state.err)
+	logger.Warn("Gateway started without listener, retrying in the background", "component", name, "retry_every", maxBackoff)
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for g.sleep(maxBackoff) {
+			attempts := g.components.get(name).attempts + 1
+			err := g.startListener(start)
+			if err == nil {
+				g.components.set(name, ComponentServing, attempts, nil)
+				logger.Info("Gateway listener started after retries", "component", name, "attempts", attempts)
+				return
+			}
+			if g.ctx.Err() != nil {
+				return
+			}
+			g.components.set(name, ComponentRetrying, attempts, err)
+			logger.Debug("Gateway listener still failing", "component", name, "attempt", attempts, "err", err)
+		}
+	}()
+}
+
+// startListener runs start unless the gateway is stopping, Stop closes listeners under the same lock
+func (g *Gateway) startListener(start func() error) error {
+	g.listenersMu.Lock()
+	defer g.listenersMu.Unlock()
+	if err := g.ctx.Err(); err != nil {
+		return fmt.Errorf("gateway is stopping: %w", err)
+	}
+	return start()
+}
+
+// sleep waits for d, it returns false when the gateway stops first
+func (g *Gateway) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-g.ctx.Done():
+		return false
+	}
+}
+
+// proxyComponent names the proxy listener at index i in health reports and logs
+func (g *Gateway) proxyComponent(i int) string {
+	if listeners := g.config.Proxy.AllListeners(); i < len(listeners) {
+		return fmt.Sprintf("proxy_%s_%s", listeners[i].Type, listeners[i].Addr)
+	}
+	return fmt.Sprintf("proxy_%d", i)
+}
+
+// ingressComponent names an ingress listener in health reports and logs
+func ingressComponent(listenAddr string) string {
+	return "ingress_" + listenAddr
+}
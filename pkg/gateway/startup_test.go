@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// flakyProxy fails to start until its port is released
+type flakyProxy struct {
+	mu       sync.Mutex
+	failures int
+	starts   int
+	stopped  bool
+}
+
+func (p *flakyProxy) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starts++
+	if p.starts <= p.failures {
+		return errors.New("address already in use")
+	}
+	return nil
+}
+
+func (p *flakyProxy) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	return nil
+}
+
+func TestGateway_StartupRetries(t *testing.T) {
+	cfg := &config.Config{Gateway: config.GatewayConfig{
+		ListenAddr: ":8080",
+		Proxy: config.ProxyConfig{
+			HTTP:   config.HTTPConfig{ListenAddr: ":8081"},
+			SOCKS5: config.SOCKS5Config{ListenAddr: ":1080"},
+		},
+		Startup: config.StartupConfig{BindAttempts: 3, BindBackoff: time.Millisecond, MaxBindBackoff: 20 * time.Millisecond},
+	}}
+	newGateway := func(transportErrs int, proxies ...utils.GatewayProxy) *Gateway {
+		gw, err := NewGateway(cfg, "memory")
+		if err != nil {
+			t.Fatalf("Failed to create gateway: %v", err)
+		}
+		gw.transport = &mockTransport{}
+		if transportErrs > 0 {
+			gw.transport = &mockTransport{listenErr: errors.New("address already in use")}
+		}
+		gw.proxies = proxies
+		return gw
+	}
+
+	// A port released within the attempts delays the start
+	retried := &flakyProxy{failures: 2}
+	gw := newGateway(0, &mockProxy{}, retried)
+	if err := gw.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if report := gw.CheckHealth(); !report.OK() || report.Checks[2].Attempts != 3 {
+		t.Errorf("Expected every listener to serve after 3 attempts, got %+v", report)
+	}
+	_ = gw.Stop()
+
+	// The transport is required
+	gw = newGateway(1, &mockProxy{})
+	if err := gw.Start(); err == nil {
+		t.Error("Start() should fail without the transport listener")
+	}
+	if check := gw.CheckHealth().Checks[0]; check.State != ComponentFailed || check.Attempts != 3 {
+		t.Errorf("Expected the failed transport in the report, got %+v", check)
+	}
+	_ = gw.Stop()
+
+	// Proxies still failing are retried in the background
+	cfg.Gateway.Startup.KeepRetrying = true
+	retried = &flakyProxy{failures: 5}
+	gw = newGateway(0, &mockProxy{}, retried)
+	if err := gw.Start(); err != nil {
+		t.Fatalf("Start() with keep_retrying error = %v", err)
+	}
+	if check := gw.CheckHealth().Checks[2]; check.State != ComponentRetrying || check.Error == "" {
+		t.Errorf("Expected the proxy to be retried, got %+v", check)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !gw.CheckHealth().OK() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if report := gw.CheckHealth(); !report.OK() {
+		t.Errorf("Expected the proxy to serve after background retries, got %+v", report)
+	}
+	_ = gw.Stop()
+	if state := gw.components.get("transport").state; state != ComponentStopped || !retried.stopped {
+		t.Errorf("Expected stopped listeners, got transport %s", state)
+	}
+}
@@ -0,0 +1,185 @@
+package gateway
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultStatusPageTitle is the status page heading when none is configured
+const defaultStatusPageTitle = "Service Status"
+
+// Group statuses reported by the status page
+const (
+	ServiceStatusUp          = "up"
+	ServiceStatusDown        = "down"
+	ServiceStatusMaintenance = "maintenance"
+)
+
+// Overall statuses reported by the status page
+const (
+	ServiceStatusOperational = "operational" // Every group not under maintenance is up
+	ServiceStatusDegraded    = "degraded"    // Some groups are down
+	ServiceStatusOutage      = "outage"      // Every group not under maintenance is down
+)
+
+// ErrStatusPageDisabled is returned when the status page is not enabled in the gateway configuration
+var ErrStatusPageDisabled = errors.New("status page is not enabled")
+
+// Incident is a period in which a group had no client online
+type Incident struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"` // Unset while the group is still down
+}
+
+// GroupServiceStatus is the public status of a group, identified by its public name only
+type GroupServiceStatus struct {
+	Name          string     `json:"name"`
+	Status        string     `json:"status"`
+	ClientsOnline int        `json:"clients_online"`
+	UpSince       *time.Time `json:"up_since,omitempty"`
+	LastIncident  *Incident  `json:"last_incident,omitempty"`
+}
+
+// ServiceStatus is the content of the public status page
+type ServiceStatus struct {
+	Title     string               `json:"title"`
+	Notice    string               `json:"notice,omitempty"`
+	Status    string               `json:"status"`
+	Groups    []GroupServiceStatus `json:"groups"`
+	UpdatedAt time.Time            `json:"updated_at"`
+}
+
+// groupAvailability tracks the up/down transitions of a status page group
+type groupAvailability struct {
+	upSince      time.Time // Zero while the group has no client
+	lastIncident *Incident
+}
+
+// statusTracker records the availability of the groups shown on the status page
+type statusTracker struct {
+	cfg    config.StatusPageConfig
+	mu     sync.Mutex
+	groups map[string]*groupAvailability // By group ID, status page groups only
+}
+
+// newStatusTracker creates the tracker, returns nil when the status page is disabled
+func newStatusTracker(cfg config.StatusPageConfig) *statusTracker {
+	if !cfg.Enabled {
+		return nil
+	}
+	t := &statusTracker{cfg: cfg, groups: make(map[string]*groupAvailability, len(cfg.Groups))}
+	for _, group := range cfg.Groups {
+		t.groups[group.GroupID] = &groupAvailability{}
+	}
+	return t
+}
+
+// groupUp records a group gaining its first client, ending its open incident
+func (t *statusTracker) groupUp(groupID string, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	availability, ok := t.groups[groupID]
+	if !ok || !availability.upSince.IsZero() {
+		return
+	}
+	availability.upSince = now
+	if incident := availability.lastIncident; incident != nil && incident.End == nil {
+		incident.End = &now
+		logger.Info("Status page group recovered", "group_id", groupID, "down_for", now.Sub(incident.Start))
+	}
+}
+
+// groupDown records a group losing its last client, opening an incident
+func (t *statusTracker) groupDown(groupID string, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	availability, ok := t.groups[groupID]
+	if !ok || availability.upSince.IsZero() {
+		return
+	}
+	availability.upSince = time.Time{}
+	availability.lastIncident = &Incident{Start: now}
+	logger.Warn("Status page group is down, no client online", "group_id", groupID)
+}
+
+// snapshot builds the status page from the online client count of each group
+func (t *statusTracker) snapshot(online map[string]int, now time.Time) *ServiceStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := &ServiceStatus{
+		Title:     t.cfg.Title,
+		Notice:    t.cfg.Notice,
+		Groups:    make([]GroupServiceStatus, 0, len(t.cfg.Groups)),
+		UpdatedAt: now,
+	}
+	if status.Title == "" {
+		status.Title = defaultStatusPageTitle
+	}
+
+	up, down := 0, 0
+	for _, group := range t.cfg.Groups {
+		groupStatus := GroupServiceStatus{Name: group.Name, ClientsOnline: online[group.GroupID]}
+		availability := t.groups[group.GroupID]
+		if !availability.upSince.IsZero() {
+			upSince := availability.upSince
+			groupStatus.UpSince = &upSince
+		}
+		if incident := availability.lastIncident; incident != nil {
+			copied := *incident
+			groupStatus.LastIncident = &copied
+		}
+
+		switch {
+		case group.Maintenance:
+			groupStatus.Status = ServiceStatusMaintenance
+		case groupStatus.ClientsOnline > 0:
+			groupStatus.Status = ServiceStatusUp
+			up++
+		default:
+			groupStatus.Status = ServiceStatusDown
+			down++
+		}
+		status.Groups = append(status.Groups, groupStatus)
+	}
+
+	switch {
+	case down == 0:
+		status.Status = ServiceStatusOperational
+	case up == 0:
+		status.Status = ServiceStatusOutage
+	default:
+		status.Status = ServiceStatusDegraded
+	}
+	return status
+}
+
+// GetServiceStatus returns the public status page content
+func (g *Gateway) GetServiceStatus() (*ServiceStatus, error) {
+	if g.status == nil {
+		return nil, ErrStatusPageDisabled
+	}
+
+	online := make(map[string]int, len(g.status.cfg.Groups))
+	g.groupsMu.RLock()
+	for _, group := range g.status.cfg.Groups {
+		if groupInfo, ok := g.groups[group.GroupID]; ok {
+			online[group.GroupID] = len(groupInfo.Clients)
+		}
+	}
+	g.groupsMu.RUnlock()
+
+	return g.status.snapshot(online, time.Now()), nil
+}
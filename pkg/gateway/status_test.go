@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestStatusTracker_Incidents(t *testing.T) {
+	tracker := newStatusTracker(config.StatusPageConfig{
+		Enabled: true,
+		Notice:  "Scheduled maintenance of ap-south on Sunday",
+		Groups: []config.StatusPageGroup{
+			{GroupID: "tenant-eu", Name: "eu-west"},
+			{GroupID: "tenant-us", Name: "us-east"},
+			{GroupID: "tenant-ap", Name: "ap-south", Maintenance: true},
+		},
+	})
+	gw := &Gateway{
+		groups: map[string]*GroupInfo{"tenant-eu": {Clients: []string{"eu-1", "eu-2"}}},
+		status: tracker,
+	}
+
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker.groupUp("tenant-eu", start)
+	tracker.groupUp("tenant-us", start)
+	tracker.groupUp("unlisted", start) // Ignored, never shown
+	tracker.groupDown("tenant-us", start.Add(time.Minute))
+
+	status, err := gw.GetServiceStatus()
+	if err != nil {
+		t.Fatalf("GetServiceStatus() error = %v", err)
+	}
+	if status.Title != defaultStatusPageTitle || status.Notice == "" || status.Status != ServiceStatusDegraded || len(status.Groups) != 3 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	eu, us, ap := status.Groups[0], status.Groups[1], status.Groups[2]
+	if eu.Name != "eu-west" || eu.Status != ServiceStatusUp || eu.ClientsOnline != 2 || eu.UpSince == nil || eu.LastIncident != nil {
+		t.Errorf("Unexpected eu-west status %+v", eu)
+	}
+	if us.Status != ServiceStatusDown || us.UpSince != nil || us.LastIncident == nil || us.LastIncident.End != nil {
+		t.Errorf("Unexpected us-east status %+v", us)
+	}
+	if ap.Status != ServiceStatusMaintenance {
+		t.Errorf("Unexpected ap-south status %+v", ap)
+	}
+
+	// Recovery closes the incident
+	recovered := start.Add(5 * time.Minute)
+	tracker.groupUp("tenant-us", recovered)
+	gw.groups["tenant-us"] = &GroupInfo{Clients: []string{"us-1"}}
+	status, _ = gw.GetServiceStatus()
+	us = status.Groups[1]
+	if status.Status != ServiceStatusOperational || us.Status != ServiceStatusUp {
+		t.Errorf("Unexpected status after recovery %+v", status)
+	}
+	if us.LastIncident == nil || us.LastIncident.End == nil || !us.LastIncident.End.Equal(recovered) {
+		t.Errorf("Incident not closed: %+v", us.LastIncident)
+	}
+
+	if _, err := (&Gateway{}).GetServiceStatus(); !errors.Is(err, ErrStatusPageDisabled) {
+		t.Errorf("Expected ErrStatusPageDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultStickyTTL is used when a group enables sticky sessions without sticky_ttl
+const defaultStickyTTL = 10 * time.Minute
+
+// stickyBinding records which client last served a proxy user
+type stickyBinding struct {
+	clientID  string
+	expiresAt time.Time
+}
+
+// stickyTable maps proxy users (or source IPs) to the client that served them last
+type stickyTable struct {
+	mu        sync.Mutex
+	bindings  map[string]*stickyBinding
+	lastSweep time.Time
+}
+
+// newStickyTable creates an empty sticky table
+func newStickyTable() *stickyTable {
+	return &stickyTable{
+		bindings:  make(map[string]*stickyBinding),
+		lastSweep: time.Now(),
+	}
+}
+
+// lookup returns the client bound to key if the binding has not expired
+func (t *stickyTable) lookup(key string, now time.Time) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	binding, ok := t.bindings[key]
+	if !ok {
+		return "", false
+	}
+	if now.After(binding.expiresAt) {
+		delete(t.bindings, key)
+		return "", false
+	}
+	return binding.clientID, true
+}
+
+// bind binds key to clientID for ttl, refreshing any existing binding
+func (t *stickyTable) bind(key, clientID string, ttl time.Duration, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.bindings[key] = &stickyBinding{
+		clientID:  clientID,
+		expiresAt: now.Add(ttl),
+	}
+
+	// Sweep expired bindings at most once per TTL to keep the table bounded
+	if now.Sub(t.lastSweep) > ttl {
+		for k, b := range t.bindings {
+			if now.After(b.expiresAt) {
+				delete(t.bindings, k)
+			}
+		}
+		t.lastSweep = now
+	}
+}
+
+// stickyRecord is a binding saved for the gateway process taking over on an upgrade
+type stickyRecord struct {
+	Key       string    `json:"key"`
+	ClientID  string    `json:"client_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// export returns the bindings that have not expired
+func (t *stickyTable) export(now time.Time) []stickyRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	records := make([]stickyRecord, 0, len(t.bindings))
+	for key, binding := range t.bindings {
+		if now.Before(binding.expiresAt) {
+			records = append(records, stickyRecord{Key: key, ClientID: binding.clientID, ExpiresAt: binding.expiresAt})
+		}
+	}
+	return records
+}
+
+// restore adds exported bindings that have not expired since
+func (t *stickyTable) restore(records []stickyRecord, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, record := range records {
+		if now.Before(record.ExpiresAt) {
+			t.bindings[record.Key] = &stickyBinding{clientID: record.ClientID, expiresAt: record.ExpiresAt}
+		}
+	}
+}
+
+// stickyKey builds the binding key for a proxy user, or "" when stickiness does not apply
+func stickyKey(mode string, userCtx *utils.UserContext) string {
+	switch mode {
+	case config.StickySessionUser:
+		if userCtx.Username != "" {
+			return userCtx.GroupID + "/user/" + userCtx.Username
+		}
+	case config.StickySessionSourceIP:
+		if userCtx.SourceIP != "" {
+			return userCtx.GroupID + "/ip/" + userCtx.SourceIP
+		}
+	}
+	return ""
+}
+
+// selectClient picks a client able to dial network for a proxy user, honoring the group's sticky
+// session setting
+func (g *Gateway) selectClient(userCtx *utils.UserContext, network string) (*ClientConn, error) {
+	groupCfg := g.config.GetGroupConfig(userCtx.GroupID)
+	key := stickyKey(groupCfg.StickySession, userCtx)
+	if key == "" || g.sticky == nil || userCtx.ClientID != "" {
+		return g.getClientByGroup(userCtx.GroupID, userCtx.ClientID, network)
+	}
+
+	ttl := groupCfg.StickyTTL
+	if ttl <= 0 {
+		ttl = defaultStickyTTL
+	}
+	now := time.Now()
+
+	if clientID, ok := g.sticky.lookup(key, now); ok {
+		if client := g.getGroupClient(userCtx.GroupID, clientID, network); client != nil {
+			g.sticky.bind(key, client.ID, ttl, now)
+			logger.Debug("Sticky client selection", "group_id", userCtx.GroupID, "selected_client", client.ID, "mode", groupCfg.StickySession)
+			return client, nil
+		}
+		logger.Debug("Sticky client no longer available, selecting a new one", "group_id", userCtx.GroupID, "stale_client", clientID)
+	}
+
+	client, err := g.getClientByGroup(userCtx.GroupID, "", network)
+	if err != nil {
+		return nil, err
+	}
+	g.sticky.bind(key, client.ID, ttl, now)
+	return client, nil
+}
+
+// peekClient returns the client selectClient would pick now, without binding the user or moving
+// the group's round-robin position
+func (g *Gateway) peekClient(userCtx *utils.UserContext, network string) (*ClientConn, error) {
+	groupCfg := g.config.GetGroupConfig(userCtx.GroupID)
+	key := stickyKey(groupCfg.StickySession, userCtx)
+	if key != "" && g.sticky != nil && userCtx.ClientID == "" {
+		if clientID, ok := g.sticky.lookup(key, time.Now()); ok {
+			if client := g.getGroupClient(userCtx.GroupID, clientID, network); client != nil {
+				return client, nil
+			}
+		}
+	}
+	return g.pickGroupClient(userCtx.GroupID, userCtx.ClientID, network, false)
+}
+
+// rebindSticky binds a proxy user to the client that finally served it, used after a retried dial
+func (g *Gateway) rebindSticky(userCtx *utils.UserContext, clientID string) {
+	groupCfg := g.config.GetGroupConfig(userCtx.GroupID)
+	key := stickyKey(groupCfg.StickySession, userCtx)
+	if key == "" || g.sticky == nil || userCtx.ClientID != "" {
+		return
+	}
+	ttl := groupCfg.StickyTTL
+	if ttl <= 0 {
+		ttl = defaultStickyTTL
+	}
+	g.sticky.bind(key, clientID, ttl, time.Now())
+}
+
+// getGroupClient returns a connected client if it still belongs to the group and can dial network
+func (g *Gateway) getGroupClient(groupID, clientID, network string) *ClientConn {
+	g.clientsMu.RLock()
+	defer g.clientsMu.RUnlock()
+
+	client, ok := g.clients[clientID]
+	if !ok || client.GroupID != groupID || !client.available() || !client.supports(network) || client.atCapacity() {
+		return nil
+	}
+	return client
+}
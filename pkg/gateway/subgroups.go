@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"path"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultSubGroupSeparator separates the levels of hierarchical group IDs
+const defaultSubGroupSeparator = "/"
+
+// subGroupPolicy decides which parent group credentials authenticate a sub-group
+type subGroupPolicy struct {
+	separator   string
+	delegations map[string][][]string // Child patterns split into levels, by parent group ID
+}
+
+// newSubGroupPolicy creates the policy, returns nil when no parent delegates
+func newSubGroupPolicy(cfg config.SubGroupsConfig) *subGroupPolicy {
+	if len(cfg.Delegations) == 0 {
+		return nil
+	}
+	p := &subGroupPolicy{separator: cfg.Separator, delegations: make(map[string][][]string)}
+	if p.separator == "" {
+		p.separator = defaultSubGroupSeparator
+	}
+	for _, delegation := range cfg.Delegations {
+		children := delegation.Children
+		if len(children) == 0 {
+			children = []string{config.SubGroupAnyDescendants}
+		}
+		for _, pattern := range children {
+			p.delegations[delegation.Parent] = append(p.delegations[delegation.Parent], strings.Split(pattern, p.separator))
+		}
+	}
+	return p
+}
+
+// ancestors returns the parent group IDs of a group, nearest first
+func (p *subGroupPolicy) ancestors(groupID string) []string {
+	var parents []string
+	for i := strings.LastIndex(groupID, p.separator); i > 0; i = strings.LastIndex(groupID[:i], p.separator) {
+		parents = append(parents, groupID[:i])
+	}
+	return parents
+}
+
+// delegates reports whether the credentials of parent authenticate its descendant groupID
+func (p *subGroupPolicy) delegates(parent, groupID string) bool {
+	levels := strings.Split(strings.TrimPrefix(groupID, parent+p.separator), p.separator)
+	for _, pattern := range p.delegations[parent] {
+		if matchSubGroup(pattern, levels) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSubGroup matches the levels of a relative sub-group ID against a pattern
+func matchSubGroup(pattern, levels []string) bool {
+	for i, segment := range pattern {
+		if segment == config.SubGroupAnyDescendants {
+			return len(levels) > i
+		}
+		if i >= len(levels) {
+			return false
+		}
+		if ok, _ := path.Match(segment, levels[i]); !ok {
+			return false
+		}
+	}
+	return len(pattern) == len(levels)
+}
+
+// validateGroup checks proxy credentials of a group. Besides the group's own password,
+// the password of a parent group delegating to it is accepted.
+func (g *Gateway) validateGroup(groupID, password string) bool {
+	if g.credentialMgr.ValidateGroup(groupID, password) {
+		return true
+	}
+	if g.subGroups == nil {
+		return false
+	}
+	for _, parent := range g.subGroups.ancestors(groupID) {
+		if g.subGroups.delegates(parent, groupID) && g.credentialMgr.ValidateGroup(parent, password) {
+			logger.Debug("Sub-group authenticated with parent credentials", "group_id", groupID, "parent_group_id", parent)
+			return true
+		}
+	}
+	return false
+}
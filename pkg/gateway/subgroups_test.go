@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/credential"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestGateway_ValidateSubGroup(t *testing.T) {
+	credentialMgr, err := credential.NewManager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for groupID, password := range map[string]string{
+		"acme":             "acme-pass",
+		"acme/infra":       "infra-pass",
+		"acme/team-a":      "team-a-pass",
+		"globex":           "globex-pass",
+		"acme/finance/tax": "tax-pass",
+	} {
+		if err := credentialMgr.RegisterGroup(groupID, password); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gw := &Gateway{
+		credentialMgr: credentialMgr,
+		subGroups: newSubGroupPolicy(config.SubGroupsConfig{Delegations: []config.SubGroupDelegation{
+			{Parent: "acme", Children: []string{"team-*", "infra/**"}},
+			{Parent: "acme/infra"}, // All descendants
+		}}),
+	}
+
+	tests := []struct {
+		groupID  string
+		password string
+		want     bool
+	}{
+		{"acme/team-a", "team-a-pass", true},  // Own password
+		{"acme/team-a", "acme-pass", true},    // Delegated by "team-*"
+		{"acme/team-b", "acme-pass", true},    // Sub-group without own credentials
+		{"acme/team-a/x", "acme-pass", false}, // "team-*" matches one level only
+		{"acme/infra", "acme-pass", false},    // "infra/**" needs at least one more level
+		{"acme/infra/db", "acme-pass", true},
+		{"acme/infra/db/eu", "infra-pass", true}, // Nearest parent delegates too
+		{"acme/finance/tax", "acme-pass", false}, // Not delegated
+		{"acme/team-a", "globex-pass", false},
+		{"globex/team-a", "acme-pass", false},
+		{"acme", "team-a-pass", false}, // Children never grant access to parents
+	}
+	for _, tt := range tests {
+		if got := gw.validateGroup(tt.groupID, tt.password); got != tt.want {
+			t.Errorf("validateGroup(%q, %q) = %v, want %v", tt.groupID, tt.password, got, tt.want)
+		}
+	}
+
+	// Without delegations only the group's own password is accepted
+	gw.subGroups = newSubGroupPolicy(config.SubGroupsConfig{})
+	if gw.subGroups != nil || gw.validateGroup("acme/team-a", "acme-pass") {
+		t.Error("Parent credentials accepted without delegations")
+	}
+}
+
+func TestSubGroupPolicy_CustomSeparator(t *testing.T) {
+	policy := newSubGroupPolicy(config.SubGroupsConfig{
+		Separator:   ".",
+		Delegations: []config.SubGroupDelegation{{Parent: "acme", Children: []string{"*"}}},
+	})
+	if got := policy.ancestors("acme.team.a"); len(got) != 2 || got[0] != "acme.team" || got[1] != "acme" {
+		t.Errorf("ancestors() = %v", got)
+	}
+	if !policy.delegates("acme", "acme.team") || policy.delegates("acme", "acme.team.a") {
+		t.Error("Unexpected delegation with custom separator")
+	}
+}
@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"sort"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// selectionHistorySize is the number of client selections kept per group
+const selectionHistorySize = 50
+
+// How a client was selected for a connection
+const (
+	SelectionRoundRobin  = "round_robin"
+	SelectionLeastLoaded = "least_loaded"
+	SelectionAtCapacity  = "at_capacity" // All clients were at their connection limit
+	SelectionRetry       = "retry"       // Dial retried or connection migrated to the next client
+)
+
+// Health of a group member in the topology
+const (
+	ClientHealthy       = "healthy"
+	ClientDraining      = "draining"
+	ClientPolicyPending = "policy_pending"
+	ClientBusy          = "busy"
+	ClientAtCapacity    = "at_capacity"
+	ClientMissing       = "missing" // In the group's list but not connected
+)
+
+// GroupSelection records a client selected for a connection of a group
+type GroupSelection struct {
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id"`
+	Counter  int       `json:"counter"` // Round-robin counter before the selection
+	Strategy string    `json:"strategy"`
+}
+
+// TopologyClient is a member client of a group in the topology
+type TopologyClient struct {
+	ClientID    string  `json:"client_id"`
+	Index       int     `json:"index"` // Position in the round-robin order
+	Health      string  `json:"health"`
+	Hibernating bool    `json:"hibernating,omitempty"`
+	Connections int     `json:"connections"`
+	LoadScore   float64 `json:"load_score"`
+	Selections  int     `json:"selections"` // Selections of the client in the recent history
+}
+
+// GroupTopology shows how a group distributes its connections over its clients
+type GroupTopology struct {
+	GroupID    string           `json:"group_id"`
+	Balancing  string           `json:"balancing"`
+	Counter    int              `json:"counter"`               // Round-robin counter, the index tried first by the next selection
+	NextClient string           `json:"next_client,omitempty"` // Client at the counter
+	Clients    []TopologyClient `json:"clients"`
+	Selections []GroupSelection `json:"selections"` // Recent selections, oldest first
+}
+
+// recordSelection adds a client selection to the group's history. g.clientsMu must be held.
+func (gi *GroupInfo) recordSelection(clientID string, counter int, strategy string) {
+	if len(gi.selections) >= selectionHistorySize {
+		gi.selections = append(gi.selections[:0], gi.selections[1:]...)
+	}
+	gi.selections = append(gi.selections, GroupSelection{
+		Time:     time.Now(),
+		ClientID: clientID,
+		Counter:  counter,
+		Strategy: strategy,
+	})
+}
+
+// clientHealth tells why a client may not get new connections, ClientHealthy when it may
+func clientHealth(client *ClientConn) string {
+	switch {
+	case client.draining.Load():
+		return ClientDraining
+	case client.policyPending.Load():
+		return ClientPolicyPending
+	case client.busy():
+		return ClientBusy
+	case client.atCapacity():
+		return ClientAtCapacity
+	default:
+		return ClientHealthy
+	}
+}
+
+// GetGroupTopology returns the member clients, round-robin counter and recent selections of a
+// group, or of all groups sorted by group ID when groupID is empty
+func (g *Gateway) GetGroupTopology(groupID string) []GroupTopology {
+	g.clientsMu.RLock()
+	g.groupsMu.RLock()
+	topologies := make([]GroupTopology, 0, len(g.groups))
+	for id, groupInfo := range g.groups {
+		if groupID != "" && id != groupID {
+			continue
+		}
+		topologies = append(topologies, g.groupTopology(id, groupInfo))
+	}
+	g.groupsMu.RUnlock()
+	g.clientsMu.RUnlock()
+
+	sort.Slice(topologies, func(i, j int) bool {
+		return topologies[i].GroupID < topologies[j].GroupID
+	})
+	return topologies
+}
+
+// groupTopology builds the topology of a group. g.clientsMu and g.groupsMu must be held.
+func (g *Gateway) groupTopology(groupID string, groupInfo *GroupInfo) GroupTopology {
+	balancing := g.config.GetGroupConfig(groupID).Balancing
+	if balancing == "" {
+		balancing = config.BalancingRoundRobin
+	}
+	topology := GroupTopology{
+		GroupID:    groupID,
+		Balancing:  balancing,
+		Counter:    groupInfo.Counter,
+		Clients:    make([]TopologyClient, 0, len(groupInfo.Clients)),
+		Selections: append([]GroupSelection{}, groupInfo.selections...),
+	}
+	if len(groupInfo.Clients) > 0 {
+		topology.NextClient = groupInfo.Clients[groupInfo.Counter%len(groupInfo.Clients)]
+	}
+
+	selections := make(map[string]int)
+	for _, selection := range groupInfo.selections {
+		selections[selection.ClientID]++
+	}
+	for idx, clientID := range groupInfo.Clients {
+		member := TopologyClient{ClientID: clientID, Index: idx, Health: ClientMissing, Selections: selections[clientID]}
+		if client, ok := g.clients[clientID]; ok {
+			member.Health = clientHealth(client)
+			member.Hibernating = client.Hibernating()
+			member.Connections = client.connectionCount()
+			member.LoadScore = client.LoadScore()
+		}
+		topology.Clients = append(topology.Clients, member)
+	}
+	return topology
+}
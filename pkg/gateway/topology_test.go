@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestGateway_GetGroupTopology(t *testing.T) {
+	clientA, _ := createTestClientConn()
+	clientA.ID = "client-a"
+	clientB, _ := createTestClientConn()
+	clientB.ID = "client-b"
+	defer clientA.Stop()
+	defer clientB.Stop()
+
+	gw := &Gateway{
+		config:  &config.GatewayConfig{},
+		clients: map[string]*ClientConn{clientA.ID: clientA, clientB.ID: clientB},
+		groups: map[string]*GroupInfo{
+			"test-group": {Clients: []string{clientA.ID, clientB.ID, "client-gone"}},
+			"other":      {},
+		},
+	}
+	clientB.draining.Store(true)
+
+	for i := 0; i < 3; i++ {
+		client, err := gw.getClientByGroup("test-group", "", "tcp")
+		if err != nil {
+			t.Fatalf("getClientByGroup() error = %v", err)
+		}
+		if client.ID != clientA.ID {
+			t.Errorf("Expected %s selected, got %s", clientA.ID, client.ID)
+		}
+	}
+	// Selections that don't move the round-robin position aren't recorded
+	if _, err := gw.pickGroupClient("test-group", "", "tcp", false); err != nil {
+		t.Fatalf("pickGroupClient() error = %v", err)
+	}
+
+	topologies := gw.GetGroupTopology("")
+	if len(topologies) != 2 || topologies[0].GroupID != "other" || topologies[1].GroupID != "test-group" {
+		t.Fatalf("Expected topologies of other and test-group, got %+v", topologies)
+	}
+
+	topology := gw.GetGroupTopology("test-group")[0]
+	if topology.Balancing != config.BalancingRoundRobin || topology.Counter != 1 || topology.NextClient != clientB.ID {
+		t.Errorf("Expected round-robin counter 1 at %s, got %+v", clientB.ID, topology)
+	}
+	wantHealth := []string{ClientHealthy, ClientDraining, ClientMissing}
+	wantPicks := []int{3, 0, 0}
+	for i, member := range topology.Clients {
+		if member.Index != i || member.Health != wantHealth[i] || member.Selections != wantPicks[i] {
+			t.Errorf("Client %d: expected health %s and %d picks, got %+v", i, wantHealth[i], wantPicks[i], member)
+		}
+	}
+	if len(topology.Selections) != 3 {
+		t.Fatalf("Expected 3 recorded selections, got %d", len(topology.Selections))
+	}
+	for _, selection := range topology.Selections {
+		if selection.ClientID != clientA.ID || selection.Strategy != SelectionRoundRobin {
+			t.Errorf("Unexpected selection %+v", selection)
+		}
+	}
+	// Skipping the draining and missing clients wraps the counter around to client-a
+	if topology.Selections[1].Counter != 1 {
+		t.Errorf("Expected the second selection to start at counter 1, got %d", topology.Selections[1].Counter)
+	}
+
+	for i := 0; i < selectionHistorySize+10; i++ {
+		if _, err := gw.getClientByGroup("test-group", "", "tcp"); err != nil {
+			t.Fatalf("getClientByGroup() error = %v", err)
+		}
+	}
+	if got := len(gw.GetGroupTopology("test-group")[0].Selections); got != selectionHistorySize {
+		t.Errorf("Expected the history bounded to %d selections, got %d", selectionHistorySize, got)
+	}
+	if got := gw.GetGroupTopology("missing"); len(got) != 0 {
+		t.Errorf("Expected no topology for an unknown group, got %+v", got)
+	}
+}
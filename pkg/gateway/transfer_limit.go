@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// transferLimit returns the bytes a connection of the user may transfer, 0 when unlimited
+func (g *Gateway) transferLimit(userCtx *utils.UserContext) int64 {
+	groupCfg := g.config.GetGroupConfig(userCtx.GroupID)
+	if limit, ok := groupCfg.UserMaxTransferBytes[userCtx.Username]; ok {
+		return limit
+	}
+	return groupCfg.MaxTransferBytes
+}
+
+// limitTransfer wraps conn to close it once it transferred the user's transfer limit
+func (g *Gateway) limitTransfer(conn net.Conn, userCtx *utils.UserContext, connID, addr string) net.Conn {
+	limit := g.transferLimit(userCtx)
+	if limit <= 0 {
+		return conn
+	}
+	return &transferLimitedConn{Conn: conn, limit: limit, connID: connID, groupID: userCtx.GroupID, username: userCtx.Username, addr: addr}
+}
+
+// transferLimitedConn counts the bytes read and written through a proxied connection. When
+// the limit is reached it closes the connection, so the copy loops of both directions end
+// with ErrTransferLimit.
+type transferLimitedConn struct {
+	net.Conn
+	limit    int64
+	used     atomic.Int64
+	closed   sync.Once
+	connID   string
+	groupID  string
+	username string
+	addr     string
+}
+
+// reserve takes up to n bytes of the remaining budget and returns how many were granted
+func (c *transferLimitedConn) reserve(n int) int {
+	for {
+		used := c.used.Load()
+		granted := min(int64(n), c.limit-used)
+		if granted <= 0 {
+			return 0
+		}
+		if c.used.CompareAndSwap(used, used+granted) {
+			return int(granted)
+		}
+	}
+}
+
+// exceeded closes the connection and returns the error ending the copy loops
+func (c *transferLimitedConn) exceeded() error {
+	c.closed.Do(func() {
+		logger.Warn("Connection reached its transfer limit, closing", "conn_id", c.connID, "group_id", c.groupID, "username", c.username, "address", c.addr, "limit_bytes", c.limit)
+		_ = c.Conn.Close()
+	})
+	return fmt.Errorf("%w: %d bytes", utils.ErrTransferLimit, c.limit)
+}
+
+// Read reads at most the remaining budget
+func (c *transferLimitedConn) Read(b []byte) (int, error) {
+	remaining := c.limit - c.used.Load()
+	if remaining <= 0 {
+		return 0, c.exceeded()
+	}
+	if int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n, err := c.Conn.Read(b)
+	if granted := c.reserve(n); granted < n {
+		// The other direction used the budget concurrently, the excess is dropped
+		return granted, c.exceeded()
+	}
+	return n, err
+}
+
+// Write writes at most the remaining budget
+func (c *transferLimitedConn) Write(b []byte) (int, error) {
+	granted := c.reserve(len(b))
+	if granted == 0 && len(b) > 0 {
+		return 0, c.exceeded()
+	}
+	n, err := c.Conn.Write(b[:granted])
+	if err == nil && granted < len(b) {
+		return n, c.exceeded()
+	}
+	return n, err
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestTransferLimit(t *testing.T) {
+	gw := &Gateway{config: &config.GatewayConfig{
+		GroupDefaults: config.GroupConfig{MaxTransferBytes: 10},
+		Groups: map[string]config.GroupConfig{
+			"backup": {MaxTransferBytes: 10, UserMaxTransferBytes: map[string]int64{"nightly": 0}},
+		},
+	}}
+
+	if limit := gw.transferLimit(&utils.UserContext{GroupID: "backup", Username: "nightly"}); limit != 0 {
+		t.Errorf("Expected the user override to lift the limit, got %d", limit)
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := gw.limitTransfer(client, &utils.UserContext{GroupID: "default"}, "conn-1", "example.com:443")
+
+	go func() { _, _ = server.Write([]byte("hello")) }()
+	buf := make([]byte, 64)
+	if n, err := io.ReadFull(conn, buf[:5]); err != nil || n != 5 {
+		t.Fatalf("Expected to read 5 bytes, got %d, %v", n, err)
+	}
+
+	// 5 bytes are left, the write is cut short and the connection closed
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+	n, err := conn.Write([]byte("0123456789"))
+	if n != 5 || !errors.Is(err, utils.ErrTransferLimit) {
+		t.Fatalf("Expected a 5 byte write and the transfer limit error, got %d, %v", n, err)
+	}
+	if utils.ErrorCodeOf(err) != utils.ErrCodeQuotaExceeded {
+		t.Errorf("Expected quota_exceeded, got %s", utils.ErrorCodeOf(err))
+	}
+	if _, err := conn.Read(buf); !errors.Is(err, utils.ErrTransferLimit) {
+		t.Errorf("Expected reads to fail after the limit, got %v", err)
+	}
+	if _, err := server.Write([]byte("x")); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
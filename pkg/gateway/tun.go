@@ -0,0 +1,195 @@
+package gateway
+
+import (
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/tun"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// packetRouter exchanges the IP packets of the gateway's TUN interface with clients in TUN
+// mode, routing them to client groups by destination address
+type packetRouter struct {
+	device io.ReadWriteCloser
+	mtu    int
+	routes []packetRoute // Longest prefix first
+
+	mu      sync.RWMutex
+	clients map[string][]*ClientConn // Announced clients by group, the first one gets the packets
+
+	wg sync.WaitGroup
+}
+
+// packetRoute routes a prefix to a client group
+type packetRoute struct {
+	prefix  netip.Prefix
+	groupID string
+}
+
+// newPacketRouter opens the TUN interface, it returns nil when TUN mode is disabled.
+// The prefixes of all groups are routed into the interface.
+func newPacketRouter(cfg config.GatewayTunConfig) (*packetRouter, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	opts := tun.Options{Name: cfg.Name, Address: cfg.Address, MTU: cfg.MTU, Routes: cfg.Routes}
+	for _, group := range cfg.Groups {
+		opts.Routes = append(opts.Routes, group.Routes...)
+	}
+	device, err := tun.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("TUN interface opened", "name", device.Name(), "address", cfg.Address, "mtu", device.MTU(), "groups", len(cfg.Groups))
+	return startPacketRouter(device, device.MTU(), cfg.Groups), nil
+}
+
+func startPacketRouter(device io.ReadWriteCloser, mtu int, groups []config.TunGroup) *packetRouter {
+	r := &packetRouter{device: device, mtu: mtu, clients: make(map[string][]*ClientConn)}
+	for _, group := range groups {
+		for _, route := range group.Routes {
+			// Validated with the config
+			if prefix, err := netip.ParsePrefix(route); err == nil {
+				r.routes = append(r.routes, packetRoute{prefix: prefix.Masked(), groupID: group.GroupID})
+			}
+		}
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return r.routes[i].prefix.Bits() > r.routes[j].prefix.Bits()
+	})
+	r.wg.Add(1)
+	go r.readPackets()
+	return r
+}
+
+// stop closes the TUN interface
+func (r *packetRouter) stop() {
+	if r == nil {
+		return
+	}
+	if err := r.device.Close(); err != nil {
+		logger.Debug("Error closing TUN interface", "err", err)
+	}
+	r.wg.Wait()
+}
+
+// route returns the group the address is routed to
+func (r *packetRouter) route(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	for _, route := range r.routes {
+		if route.prefix.Contains(addr) {
+			return route.groupID, true
+		}
+	}
+	return "", false
+}
+
+// readPackets sends the packets routed into the interface to the client of their group.
+// Packets without a route or connected client are dropped.
+func (r *packetRouter) readPackets() {
+	defer r.wg.Done()
+	buf := make([]byte, r.mtu)
+	for {
+		n, err := r.device.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) && !errors.Is(err, io.EOF) {
+				logger.Error("Failed to read from TUN interface", "err", err)
+			}
+			return
+		}
+		dst, ok := tun.Destination(buf[:n])
+		if !ok {
+			continue
+		}
+		groupID, ok := r.route(dst)
+		if !ok {
+			continue
+		}
+		r.mu.RLock()
+		var client *ClientConn
+		if clients := r.clients[groupID]; len(clients) > 0 {
+			client = clients[0]
+		}
+		r.mu.RUnlock()
+		if client == nil {
+			continue
+		}
+		if err := client.msgHandler.WriteDataMessage(protocol.PacketConnID, buf[:n]); err != nil {
+			logger.Debug("Failed to send packet to client", "client_id", client.ID, "err", err)
+		}
+	}
+}
+
+// receive handles a packet message of a client. Empty packets announce the client, others are
+// written to the interface when their source is routed to the client's group.
+func (r *packetRouter) receive(c *ClientConn, packet []byte) {
+	if r == nil {
+		logger.Debug("Ignoring packet from client, TUN mode is disabled", "client_id", c.ID)
+		return
+	}
+	if len(packet) == 0 {
+		r.register(c)
+		return
+	}
+	src, ok := tun.Source(packet)
+	if !ok {
+		return
+	}
+	if groupID, ok := r.route(src); !ok || groupID != c.GroupID {
+		logger.Debug("Dropping packet with a source outside the client's routes", "client_id", c.ID, "group_id", c.GroupID, "source", src.String())
+		return
+	}
+	if _, err := r.device.Write(packet); err != nil {
+		logger.Debug("Failed to write packet to TUN interface", "client_id", c.ID, "bytes", len(packet), "err", err)
+	}
+}
+
+// register adds a client announcing TUN mode
+func (r *packetRouter) register(c *ClientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	configured := false
+	for _, route := range r.routes {
+		if route.groupID == c.GroupID {
+			configured = true
+			break
+		}
+	}
+	if !configured {
+		logger.Warn("Client announced TUN mode but its group has no TUN routes", "client_id", c.ID, "group_id", c.GroupID)
+		return
+	}
+	for _, existing := range r.clients[c.GroupID] {
+		if existing == c {
+			return
+		}
+	}
+	r.clients[c.GroupID] = append(r.clients[c.GroupID], c)
+	logger.Info("Client joined TUN mode", "client_id", c.ID, "group_id", c.GroupID)
+}
+
+// unregister removes a disconnected client
+func (r *packetRouter) unregister(c *ClientConn) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := r.clients[c.GroupID]
+	for i, existing := range clients {
+		if existing == c {
+			r.clients[c.GroupID] = append(clients[:i:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(r.clients[c.GroupID]) == 0 {
+		delete(r.clients, c.GroupID)
+	}
+}
@@ -0,0 +1,116 @@
+package gateway
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// fakeTunDevice is a TUN interface backed by channels
+type fakeTunDevice struct {
+	in     chan []byte // Packets routed into the interface
+	out    chan []byte // Packets written to the interface
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeTunDevice() *fakeTunDevice {
+	return &fakeTunDevice{in: make(chan []byte, 8), out: make(chan []byte, 8), closed: make(chan struct{})}
+}
+
+func (d *fakeTunDevice) Read(p []byte) (int, error) {
+	select {
+	case packet := <-d.in:
+		return copy(p, packet), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *fakeTunDevice) Write(p []byte) (int, error) {
+	d.out <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (d *fakeTunDevice) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+// testIPv4Packet returns an IPv4 header from src to dst
+func testIPv4Packet(src, dst string) []byte {
+	packet := make([]byte, 20)
+	packet[0] = 0x45
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(packet[12:], s[:])
+	copy(packet[16:], d[:])
+	return packet
+}
+
+func TestPacketRouter(t *testing.T) {
+	device := newFakeTunDevice()
+	router := startPacketRouter(device, 1500, []config.TunGroup{
+		{GroupID: "site-b", Routes: []string{"10.99.0.2/32", "192.168.10.0/24"}},
+	})
+	defer router.stop()
+
+	client, mockConn := createTestClientConn()
+	defer client.Stop()
+	client.GroupID = "site-b"
+	client.packets = router
+	sent := make(chan []byte, 8)
+	mockConn.writeMessageFunc = func(data []byte) error {
+		_, _, payload, err := protocol.UnpackBinaryHeader(data)
+		if err != nil {
+			t.Error(err)
+			return err
+		}
+		connID, packet, err := protocol.UnpackDataMessage(payload)
+		if err != nil || connID != protocol.PacketConnID {
+			t.Errorf("Expected a packet message, got %s, %v", connID, err)
+		}
+		sent <- packet
+		return nil
+	}
+
+	// Clients announce TUN mode with an empty packet
+	client.routeMessage(map[string]interface{}{"type": protocol.MsgTypeData, "id": protocol.PacketConnID, "data": []byte{}})
+
+	toClient := testIPv4Packet("10.99.0.1", "192.168.10.5")
+	device.in <- toClient
+	select {
+	case packet := <-sent:
+		if !bytes.Equal(packet, toClient) {
+			t.Errorf("Unexpected packet sent to client %v", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the packet to be routed to the client")
+	}
+
+	// Packets with sources outside the group's routes are dropped
+	router.receive(client, testIPv4Packet("172.16.0.1", "10.99.0.1"))
+	fromClient := testIPv4Packet("192.168.10.5", "10.99.0.1")
+	router.receive(client, fromClient)
+	if packet := <-device.out; !bytes.Equal(packet, fromClient) {
+		t.Errorf("Expected only the packet from the group's routes, got %v", packet)
+	}
+
+	// Groups without routes can't join
+	other, _ := createTestClientConn()
+	defer other.Stop()
+	other.GroupID = "site-c"
+	router.receive(other, nil)
+	router.unregister(client)
+	router.mu.RLock()
+	remaining := len(router.clients)
+	router.mu.RUnlock()
+	if remaining != 0 {
+		t.Errorf("Expected no clients in TUN mode, got %d groups", remaining)
+	}
+}
@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/update"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Client update timeouts
+const (
+	updateStatusTimeout = 30 * time.Second
+	updatePushTimeout   = 30 * time.Minute
+)
+
+// errUpdateDeclined is returned when the client already has or is receiving the update,
+// which is expected when several replicas of one process connect at once
+var errUpdateDeclined = errors.New("client declined update")
+
+// offerClientUpdate pushes the release from the update directory to a client running another
+// version. The client verifies the signature and decides when to install it.
+func (g *Gateway) offerClientUpdate(client *ClientConn) {
+	dir := g.config.ClientUpdates.Dir
+	manifest, err := update.LoadManifest(dir)
+	if err != nil {
+		logger.Error("Failed to load client update manifest", "dir", dir, "err", err)
+		return
+	}
+	// Clients that don't report a version predate self-update and cannot receive one
+	if client.Version == "" || client.Version == manifest.Version {
+		return
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return client.dialNetwork(ctx, protocol.ProtocolTCP, protocol.UpdateServiceAddress)
+		},
+		DisableKeepAlives: true,
+	}}
+
+	status, err := fetchUpdateStatus(client.ctx, httpClient)
+	if err != nil {
+		logger.Debug("Client update service unavailable", "client_id", client.ID, "client_version", client.Version, "err", err)
+		return
+	}
+	if status.StagedVersion == manifest.Version {
+		logger.Debug("Client update already staged", "client_id", client.ID, "version", manifest.Version)
+		return
+	}
+	binary, ok := manifest.Binaries[status.Platform]
+	if !ok {
+		logger.Warn("No client update binary for platform", "client_id", client.ID, "platform", status.Platform, "version", manifest.Version)
+		return
+	}
+
+	logger.Info("Offering client update", "client_id", client.ID, "group_id", client.GroupID, "from_version", status.Version, "to_version", manifest.Version, "platform", status.Platform)
+	if err := pushClientUpdate(client.ctx, httpClient, dir, manifest.Version, status.Platform, binary); err != nil {
+		if errors.Is(err, errUpdateDeclined) {
+			logger.Debug("Client update declined", "client_id", client.ID, "version", manifest.Version, "err", err)
+			return
+		}
+		logger.Warn("Client update not delivered", "client_id", client.ID, "version", manifest.Version, "err", err)
+		return
+	}
+	logger.Info("Client update delivered", "client_id", client.ID, "version", manifest.Version)
+}
+
+// fetchUpdateStatus asks the client update service for its version and platform
+func fetchUpdateStatus(ctx context.Context, httpClient *http.Client) (*update.Status, error) {
+	ctx, cancel := context.WithTimeout(ctx, updateStatusTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+protocol.UpdateServiceHost+"/update/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("client returned %s", resp.Status)
+	}
+
+	var status update.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid update status: %w", err)
+	}
+	return &status, nil
+}
+
+// pushClientUpdate uploads a signed binary to the client update service
+func pushClientUpdate(ctx context.Context, httpClient *http.Client, dir, version, platform string, binary update.Binary) error {
+	ctx, cancel := context.WithTimeout(ctx, updatePushTimeout)
+	defer cancel()
+
+	f, err := os.Open(filepath.Join(dir, binary.File)) //nolint:gosec // file name is validated by LoadManifest
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://"+protocol.UpdateServiceHost+"/update/binary", f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set(update.HeaderVersion, version)
+	req.Header.Set(update.HeaderPlatform, platform)
+	req.Header.Set(update.HeaderSHA256, binary.SHA256)
+	req.Header.Set(update.HeaderSignature, binary.Signature)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode == http.StatusConflict {
+			return fmt.Errorf("%w: %s", errUpdateDeclined, strings.TrimSpace(string(msg)))
+		}
+		return fmt.Errorf("client returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// Upgrade defaults
+const (
+	defaultUpgradeReadyTimeout = 30 * time.Second
+	defaultUpgradeDrainWindow  = 60 * time.Second
+)
+
+// upgradeReadyEnv names the file descriptor a process started by an upgrade reports serving on
+const upgradeReadyEnv = "ANYPROXY_UPGRADE_READY_FD"
+
+// ErrUpgradeDisabled is returned by Upgrade when gateway.upgrade is not enabled
+var ErrUpgradeDisabled = errors.New("gateway upgrades are disabled")
+
+// upgradeState is the state handed to the process taking over on an upgrade
+type upgradeState struct {
+	SavedAt time.Time      `json:"saved_at"`
+	Sticky  []stickyRecord `json:"sticky"`
+}
+
+// Upgrade starts the gateway binary again and, once the new process serves on the shared listen
+// ports, hands it the clients. It returns when every client was disconnected, the caller then
+// stops this process. On errors this process keeps serving.
+func (g *Gateway) Upgrade() error {
+	cfg := g.config.Upgrade
+	if !cfg.Enabled {
+		return ErrUpgradeDisabled
+	}
+	if !g.upgrading.CompareAndSwap(false, true) {
+		return fmt.Errorf("gateway upgrade already in progress")
+	}
+	readyTimeout := cfg.ReadyTimeout
+	if readyTimeout == 0 {
+		readyTimeout = defaultUpgradeReadyTimeout
+	}
+	drainWindow := cfg.DrainWindow
+	if drainWindow == 0 {
+		drainWindow = defaultUpgradeDrainWindow
+	}
+
+	if err := g.saveUpgradeState(); err != nil {
+		g.upgrading.Store(false)
+		return err
+	}
+	logger.Info("Starting new gateway process", "ready_timeout", readyTimeout)
+	if err := startUpgradeProcess(readyTimeout); err != nil {
+		g.upgrading.Store(false)
+		return err
+	}
+	logger.Info("New gateway process is serving")
+	g.handOff(drainWindow)
+	return nil
+}
+
+// saveUpgradeState writes the state for the new process to the configured state file
+func (g *Gateway) saveUpgradeState() error {
+	path := g.config.Upgrade.StateFile
+	if path == "" {
+		return nil
+	}
+	now := time.Now()
+	data, err := json.Marshal(upgradeState{SavedAt: now, Sticky: g.sticky.export(now)})
+	if err != nil {
+		return fmt.Errorf("failed to encode upgrade state: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write upgrade state: %w", err)
+	}
+	return nil
+}
+
+// loadUpgradeState restores the state left by the process this one replaces, the file is removed
+// so a later restart doesn't restore it again
+func (g *Gateway) loadUpgradeState() {
+	path := g.config.Upgrade.StateFile
+	if !g.config.Upgrade.Enabled || path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.Warn("Failed to read upgrade state", "path", path, "err", err)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		logger.Warn("Failed to remove upgrade state", "path", path, "err", err)
+	}
+
+	var state upgradeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		logger.Warn("Failed to decode upgrade state", "path", path, "err", err)
+		return
+	}
+	g.sticky.restore(state.Sticky, time.Now())
+	logger.Info("Restored upgrade state", "saved_at", state.SavedAt, "sticky_bindings", len(state.Sticky))
+}
+
+// startUpgradeProcess starts the executable with the arguments of this process and waits until
+// it reports serving. A process failing to do so in time is killed.
+func startUpgradeProcess(timeout time.Duration) error {
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create ready pipe: %w", err)
+	}
+	defer func() { _ = readyR.Close() }()
+
+	cmd := exec.Command(path, os.Args[1:]...) //nolint:gosec // path is our own executable
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{readyW} // File descriptor 3 in the new process
+	cmd.Env = append(os.Environ(), upgradeReadyEnv+"=3")
+	err = cmd.Start()
+	_ = readyW.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start new gateway process: %w", err)
+	}
+
+	// The read fails once the new process exits without reporting
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err == nil {
+			return cmd.Process.Release()
+		}
+		_ = cmd.Wait()
+		return fmt.Errorf("new gateway process exited before serving: %v", cmd.ProcessState)
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("new gateway process did not serve within %s", timeout)
+	}
+}
+
+// NotifyUpgradeReady tells the process that started this one for an upgrade that it serves.
+// It does nothing when the process was not started by an upgrade.
+func NotifyUpgradeReady() {
+	fd := os.Getenv(upgradeReadyEnv)
+	if fd == "" {
+		return
+	}
+	_ = os.Unsetenv(upgradeReadyEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		logger.Warn("Invalid upgrade ready file descriptor", "fd", fd)
+		return
+	}
+	notifyUpgradeReady(os.NewFile(uintptr(n), "upgrade-ready"))
+}
+
+// notifyUpgradeReady writes the ready byte the previous process waits for and closes f
+func notifyUpgradeReady(f *os.File) {
+	if _, err := f.Write([]byte{1}); err != nil {
+		logger.Warn("Failed to report serving to the previous gateway process", "err", err)
+	}
+	_ = f.Close()
+}
+
+// handOff stops accepting clients and disconnects the connected ones spread over window, so
+// they reconnect to the new process and not all at once
+func (g *Gateway) handOff(window time.Duration) {
+	if closer, ok := g.transport.(transport.ListenerCloser); ok {
+		if err := closer.CloseListener(); err != nil {
+			logger.Warn("Failed to close transport listener", "err", err)
+		}
+	} else {
+		logger.Warn("Transport cannot stop accepting clients, new clients may still connect to this process")
+	}
+
+	g.clientsMu.RLock()
+	clients := make([]*ClientConn, 0, len(g.clients))
+	for _, client := range g.clients {
+		clients = append(clients, client)
+	}
+	g.clientsMu.RUnlock()
+
+	logger.Info("Handing clients off to the new gateway process", "clients", len(clients), "drain_window", window)
+	if len(clients) == 0 {
+		return
+	}
+	interval := window / time.Duration(len(clients))
+	for i, client := range clients {
+		if i > 0 {
+			select {
+			case <-g.ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+		logger.Debug("Disconnecting client for the new gateway process", "client_id", client.ID, "group_id", client.GroupID)
+		go client.Stop()
+	}
+}
@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestUpgradeState(t *testing.T) {
+	upgradeCfg := config.UpgradeConfig{Enabled: true, StateFile: filepath.Join(t.TempDir(), "upgrade.json")}
+	now := time.Now()
+	old := &Gateway{config: &config.GatewayConfig{Upgrade: upgradeCfg}, sticky: newStickyTable()}
+	old.sticky.bind("group/user/alice", "client-1", time.Hour, now)
+	old.sticky.bind("group/user/bob", "client-2", time.Second, now.Add(-time.Minute))
+	if err := old.saveUpgradeState(); err != nil {
+		t.Fatalf("saveUpgradeState() error = %v", err)
+	}
+
+	replacement := &Gateway{config: &config.GatewayConfig{Upgrade: upgradeCfg}, sticky: newStickyTable()}
+	replacement.loadUpgradeState()
+	if clientID, ok := replacement.sticky.lookup("group/user/alice", now); !ok || clientID != "client-1" {
+		t.Errorf("Expected the binding to be restored, got %q", clientID)
+	}
+	if _, ok := replacement.sticky.lookup("group/user/bob", now); ok {
+		t.Error("Expected the expired binding to be dropped")
+	}
+	if _, err := os.Stat(upgradeCfg.StateFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the state file to be removed, got %v", err)
+	}
+}
+
+func TestNotifyUpgradeReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+
+	notifyUpgradeReady(w)
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Expected the ready byte, got %v", err)
+	}
+
+	// Not started by an upgrade, or with a broken variable
+	NotifyUpgradeReady()
+	t.Setenv(upgradeReadyEnv, "invalid")
+	NotifyUpgradeReady()
+	if os.Getenv(upgradeReadyEnv) != "" {
+		t.Error("Expected the ready variable to be cleared")
+	}
+}
+
+func TestUpgradeDisabled(t *testing.T) {
+	g := &Gateway{config: &config.GatewayConfig{}, sticky: newStickyTable()}
+	if err := g.Upgrade(); !errors.Is(err, ErrUpgradeDisabled) {
+		t.Errorf("Upgrade() error = %v, want %v", err, ErrUpgradeDisabled)
+	}
+}
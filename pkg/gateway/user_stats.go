@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+)
+
+// trackUserStats wraps a proxy dial function to record the connections, failures, bytes and
+// destinations of each proxy user. Dials are counted for the user's own group, also when a rule
+// hands them to another group.
+func trackUserStats(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		userCtx, ok := commonctx.GetUserContext(ctx)
+		if !ok || userCtx.GroupID == "" {
+			return dial(ctx, network, addr)
+		}
+		conn, err := dial(ctx, network, addr)
+		monitoring.RecordUserDial(userCtx.GroupID, userCtx.Username, addr, err != nil)
+		if err != nil {
+			return nil, err
+		}
+		return &userStatsConn{Conn: conn, groupID: userCtx.GroupID, username: userCtx.Username, addr: addr}, nil
+	}
+}
+
+// userStatsConn adds the bytes of a proxied connection to the stats of its proxy user. Writes
+// carry data of the user to the target, reads the target's responses.
+type userStatsConn struct {
+	net.Conn
+	groupID  string
+	username string
+	addr     string
+	closed   sync.Once
+}
+
+// Read counts the bytes the user receives
+func (c *userStatsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		monitoring.RecordUserTransfer(c.groupID, c.username, c.addr, 0, int64(n))
+	}
+	return n, err
+}
+
+// Write counts the bytes the user sends
+func (c *userStatsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		monitoring.RecordUserTransfer(c.groupID, c.username, c.addr, int64(n), 0)
+	}
+	return n, err
+}
+
+// CloseWrite keeps half-close working through the stats wrapper
+func (c *userStatsConn) CloseWrite() error {
+	return connection.CloseWrite(c.Conn)
+}
+
+// Close ends the connection in the user's stats once
+func (c *userStatsConn) Close() error {
+	c.closed.Do(func() {
+		monitoring.RecordUserClose(c.groupID, c.username)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,54 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+)
+
+func TestTrackUserStats(t *testing.T) {
+	var server net.Conn
+	dial := trackUserStats(func(_ context.Context, _, addr string) (net.Conn, error) {
+		if addr == "refused.example:443" {
+			return nil, errors.New("connection refused")
+		}
+		var client net.Conn
+		client, server = net.Pipe()
+		return client, nil
+	})
+	ctx := commonctx.WithUserContext(context.Background(), &utils.UserContext{GroupID: "stats-group", Username: "alice"})
+
+	if _, err := dial(ctx, "tcp", "refused.example:443"); err == nil {
+		t.Fatal("Expected the dial to fail")
+	}
+	conn, err := dial(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go func() { _, _ = server.Write([]byte("hello")) }()
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = io.ReadFull(server, make([]byte, 3)) }()
+	if _, err := conn.Write([]byte("hey")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	_ = conn.Close()
+
+	stats, ok := monitoring.GetUser("stats-group", "alice")
+	if !ok {
+		t.Fatal("Expected the user to be tracked")
+	}
+	if stats.TotalConnections != 1 || stats.FailedConnections != 1 || stats.ActiveConnections != 0 || stats.BytesSent != 3 || stats.BytesReceived != 5 {
+		t.Errorf("Unexpected user stats %+v", stats)
+	}
+}
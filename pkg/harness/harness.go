@@ -0,0 +1,168 @@
+// Package harness runs a gateway and its clients in one process over the in-memory transport,
+// so programs embedding AnyProxy can test proxy flows end to end without binding sockets.
+package harness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/client"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Defaults of Options
+const (
+	DefaultGroupID       = "harness"
+	DefaultGroupPassword = "harness-password"
+	DefaultReadyTimeout  = 5 * time.Second
+)
+
+// addrSeq keeps the in-memory gateway addresses of concurrent harnesses apart
+var addrSeq atomic.Uint64
+
+// Options configures a harness, the zero value runs one client
+type Options struct {
+	GroupID       string        // Group of the clients (default DefaultGroupID)
+	GroupPassword string        // Group password the clients register (default DefaultGroupPassword)
+	Clients       int           // Number of clients (default 1)
+	ReadyTimeout  time.Duration // How long Start waits for all clients to register (default DefaultReadyTimeout)
+
+	// TargetDialer reaches targets from the clients, e.g. in-process servers (default the network)
+	TargetDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Gateway and Client adjust the generated configs before the components are created. Clients
+	// also registering with the gateways of other harnesses (config.ClientConfig.Gateways) are
+	// part of Clients, Start only waits for those of its own gateway.
+	Gateway func(cfg *config.GatewayConfig)
+	Client  func(cfg *config.ClientConfig)
+}
+
+// Harness is a running gateway with its clients
+type Harness struct {
+	Gateway *gateway.Gateway
+	Clients []*client.Client
+	Addr    string // In-memory address of the gateway
+	groupID string
+}
+
+// Start creates the gateway and clients and waits until every client has registered
+func Start(opts Options) (*Harness, error) {
+	if opts.GroupID == "" {
+		opts.GroupID = DefaultGroupID
+	}
+	if opts.GroupPassword == "" {
+		opts.GroupPassword = DefaultGroupPassword
+	}
+	if opts.Clients <= 0 {
+		opts.Clients = 1
+	}
+	if opts.ReadyTimeout <= 0 {
+		opts.ReadyTimeout = DefaultReadyTimeout
+	}
+
+	h := &Harness{
+		Addr:    fmt.Sprintf("harness-%d", addrSeq.Add(1)),
+		groupID: opts.GroupID,
+	}
+
+	cfg := &config.Config{}
+	cfg.Gateway.ListenAddr = h.Addr
+	cfg.Gateway.TransportType = protocol.TransportTypeMemory
+	if opts.Gateway != nil {
+		opts.Gateway(&cfg.Gateway)
+	}
+	gw, err := gateway.NewGateway(cfg, protocol.TransportTypeMemory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gateway: %v", err)
+	}
+	if err := gw.Start(); err != nil {
+		_ = gw.Stop()
+		return nil, fmt.Errorf("failed to start gateway: %v", err)
+	}
+	h.Gateway = gw
+
+	clientCfg := &config.ClientConfig{
+		ClientID:      "harness-client",
+		GroupID:       opts.GroupID,
+		GroupPassword: opts.GroupPassword,
+		Replicas:      opts.Clients,
+		Gateway: config.ClientGatewayConfig{
+			Addr:          h.Addr,
+			TransportType: protocol.TransportTypeMemory,
+			AuthUsername:  cfg.Gateway.AuthUsername,
+			AuthPassword:  cfg.Gateway.AuthPassword,
+		},
+	}
+	if opts.Client != nil {
+		opts.Client(clientCfg)
+	}
+	clients, err := client.NewClients(clientCfg)
+	if err != nil {
+		_ = h.Close()
+		return nil, fmt.Errorf("failed to create clients: %v", err)
+	}
+	for i, c := range clients {
+		if opts.TargetDialer != nil {
+			c.SetTargetDialer(opts.TargetDialer)
+		}
+		if err := c.Start(); err != nil {
+			_ = h.Close()
+			return nil, fmt.Errorf("failed to start client %d: %v", i, err)
+		}
+		h.Clients = append(h.Clients, c)
+	}
+
+	if err := h.waitReady(opts.Clients, opts.ReadyTimeout); err != nil {
+		_ = h.Close()
+		return nil, err
+	}
+	logger.Info("Harness started", "addr", h.Addr, "group_id", h.groupID, "clients", opts.Clients)
+	return h, nil
+}
+
+// waitReady waits until the group has the expected number of clients
+func (h *Harness) waitReady(clients int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		registered := 0
+		for _, status := range h.Gateway.GetGroupStatus() {
+			if status.GroupID == h.groupID {
+				registered = len(status.Clients)
+			}
+		}
+		if registered >= clients {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("only %d of %d clients registered within %v", registered, clients, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Dial connects to addr through a client of the harness group, like a proxy user would
+func (h *Harness) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return h.Gateway.Dial(ctx, h.groupID, network, addr)
+}
+
+// Close stops the clients and the gateway
+func (h *Harness) Close() error {
+	var firstErr error
+	for _, c := range h.Clients {
+		if err := c.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if h.Gateway != nil {
+		if err := h.Gateway.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,234 @@
+package harness
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// echoDialer serves every target in process, echoing what it receives
+type echoDialer struct {
+	mu      sync.Mutex
+	targets []string
+}
+
+func (d *echoDialer) dial(_ context.Context, _, address string) (net.Conn, error) {
+	if strings.HasPrefix(address, "refused.") {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: io.ErrUnexpectedEOF}
+	}
+	d.mu.Lock()
+	d.targets = append(d.targets, address)
+	d.mu.Unlock()
+
+	clientEnd, targetEnd := net.Pipe()
+	go func() {
+		defer targetEnd.Close()
+		_, _ = io.Copy(targetEnd, targetEnd)
+	}()
+	return clientEnd, nil
+}
+
+func TestHarness_ProxyFlow(t *testing.T) {
+	dialer := &echoDialer{}
+	h, err := Start(Options{Clients: 2, TargetDialer: dialer.dial})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer h.Close()
+
+	if len(h.Clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(h.Clients))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		conn, err := h.Dial(ctx, "tcp", "echo.test:80")
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		buf := make([]byte, 5)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("Echo returned %q, err %v", buf, err)
+		}
+		conn.Close()
+	}
+
+	dialer.mu.Lock()
+	targets := len(dialer.targets)
+	dialer.mu.Unlock()
+	if targets != 3 {
+		t.Errorf("Expected 3 target dials, got %d", targets)
+	}
+
+	// Without dial retries the gateway hands out the connection before the client dialed the target,
+	// a failed target dial closes it
+	conn, err := h.Dial(ctx, "tcp", "refused.test:80")
+	if err == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("Expected the connection to a refused target to be closed")
+		}
+		conn.Close()
+	}
+}
+
+func TestHarness_MultiHoming(t *testing.T) {
+	dialer := &echoDialer{}
+	regional, err := Start(Options{TargetDialer: dialer.dial})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer regional.Close()
+	h, err := Start(Options{
+		TargetDialer: dialer.dial,
+		Client: func(cfg *config.ClientConfig) {
+			cfg.Gateways = []config.ClientGatewayConfig{{Addr: regional.Addr, TransportType: protocol.TransportTypeMemory}}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer h.Close()
+
+	if len(h.Clients) != 2 || h.Clients[1].GatewayAddr() != regional.Addr {
+		t.Fatalf("Expected a client for each gateway, got %d", len(h.Clients))
+	}
+	if err := regional.waitReady(2, DefaultReadyTimeout); err != nil {
+		t.Fatalf("Multi-homed client didn't register with the second gateway: %v", err)
+	}
+
+	// With its own client gone, the regional gateway dials through the multi-homed client
+	_ = regional.Clients[0].Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, gw := range []*Harness{h, regional} {
+		conn, err := gw.Dial(ctx, "tcp", "echo.test:80")
+		if err != nil {
+			t.Fatalf("Dial() through %s error = %v", gw.Addr, err)
+		}
+		_, _ = conn.Write([]byte("hi"))
+		buf := make([]byte, 2)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Errorf("Echo through %s error = %v", gw.Addr, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHarness_GatewayConfig(t *testing.T) {
+	h, err := Start(Options{
+		GroupID: "blocked",
+		Gateway: func(cfg *config.GatewayConfig) {
+			cfg.AuthUsername = "gw-user"
+			cfg.AuthPassword = "gw-pass"
+			cfg.GroupDefaults.MaxConnections = 1
+		},
+		TargetDialer: (&echoDialer{}).dial,
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := h.Dial(ctx, "tcp", "echo.test:80")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := h.Dial(ctx, "tcp", "echo.test:80"); err == nil {
+		t.Error("Expected the group connection limit to reject the second dial")
+	}
+}
+
+func TestHarness_ErrorCodes(t *testing.T) {
+	h, err := Start(Options{
+		Gateway: func(cfg *config.GatewayConfig) {
+			cfg.GroupDefaults.ConfirmDial = true
+		},
+		Client: func(cfg *config.ClientConfig) {
+			cfg.MaxConnections = 1
+			cfg.ForbiddenHosts = []string{"forbidden.test"}
+		},
+		TargetDialer: (&echoDialer{}).dial,
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := h.Dial(ctx, "tcp", "refused.test:80"); utils.ErrorCodeOf(err) != utils.ErrCodeDialFailed {
+		t.Errorf("Expected dial_failed, got %v", err)
+	}
+	conn, err := h.Dial(ctx, "tcp", "echo.test:80")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := h.Dial(ctx, "tcp", "forbidden.test:80"); utils.ErrorCodeOf(err) != utils.ErrCodeTargetForbidden {
+		t.Errorf("Expected target_forbidden, got %v", err)
+	}
+	if _, err := h.Dial(ctx, "tcp", "echo.test:80"); utils.ErrorCodeOf(err) != utils.ErrCodeClientOverloaded {
+		t.Errorf("Expected client_overloaded, got %v", err)
+	}
+	if _, err := h.Gateway.Dial(ctx, "unknown-group", "tcp", "echo.test:80"); utils.ErrorCodeOf(err) != utils.ErrCodeNoClientAvailable {
+		t.Errorf("Expected no_client_available, got %v", err)
+	}
+}
+
+func TestHarness_Events(t *testing.T) {
+	h, err := Start(Options{Clients: 1, TargetDialer: (&echoDialer{}).dial})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer h.Close()
+
+	events, unsubscribe := h.Gateway.Subscribe(16, gateway.EventDialStarted, gateway.EventConnectionOpened, gateway.EventConnectionClosed)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := h.Dial(ctx, "tcp", "echo.test:80")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	_ = conn.Close()
+
+	for _, want := range []gateway.EventType{gateway.EventDialStarted, gateway.EventConnectionOpened, gateway.EventConnectionClosed} {
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.Address != "echo.test:80" {
+				t.Fatalf("Expected %s for echo.test:80, got %+v", want, ev)
+			}
+			if want == gateway.EventConnectionClosed && (ev.ClientID == "" || ev.BytesSent != 5 || ev.BytesReceived != 5) {
+				t.Errorf("Expected the serving client and the bytes of the connection, got %+v", ev)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for %s", want)
+		}
+	}
+}
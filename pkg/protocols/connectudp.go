@@ -0,0 +1,292 @@
+package protocols
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// CONNECT-UDP (RFC 9298) constants
+const (
+	connectUDPProtocol = "connect-udp"
+	// connectUDPPathPrefix is the default URI template /.well-known/masque/udp/{target_host}/{target_port}/
+	connectUDPPathPrefix = "/.well-known/masque/udp/"
+	// capsuleTypeDatagram is the HTTP Datagram capsule type (RFC 9297)
+	capsuleTypeDatagram = 0x00
+	// maxCapsuleSize bounds a capsule payload: a context ID and the largest UDP payload
+	maxCapsuleSize = 8 + 65535
+	// connectUDPIdleTimeout closes sessions without datagrams in either direction
+	connectUDPIdleTimeout = 2 * time.Minute
+)
+
+// isConnectUDP reports whether r opens a CONNECT-UDP session, either as an HTTP/1.1
+// upgrade or as an extended CONNECT (":protocol" pseudo-header) over HTTP/2
+func isConnectUDP(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return r.Header.Get(":protocol") == connectUDPProtocol
+	}
+	return r.Method == http.MethodGet &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Upgrade", connectUDPProtocol)
+}
+
+// headerHasToken reports whether a comma separated header contains token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseConnectUDPTarget extracts host:port from a path following the default URI template
+func parseConnectUDPTarget(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, connectUDPPathPrefix)
+	if !ok {
+		return "", fmt.Errorf("path does not match %s{target_host}/{target_port}/", connectUDPPathPrefix)
+	}
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", fmt.Errorf("path does not match %s{target_host}/{target_port}/", connectUDPPathPrefix)
+	}
+	// IPv6 addresses arrive percent-encoded, e.g. 2001%3Adb8%3A%3A1
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid target host: %w", err)
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid target port %q", parts[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// appendVarint appends a QUIC variable-length integer (RFC 9000 section 16)
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// readVarint reads a QUIC variable-length integer
+func readVarint(r io.ByteReader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(first & 0x3f)
+	for i := 1; i < 1<<(first>>6); i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// splitVarint decodes a QUIC variable-length integer at the start of b
+func splitVarint(b []byte) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, b[n:], nil
+}
+
+// readCapsule reads one capsule (type, length, value)
+func readCapsule(r *bufio.Reader) (uint64, []byte, error) {
+	capsuleType, err := readVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := readVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxCapsuleSize {
+		return 0, nil, fmt.Errorf("capsule of %d bytes exceeds limit", length)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return capsuleType, value, nil
+}
+
+// appendDatagramCapsule appends a DATAGRAM capsule carrying a UDP payload with context ID 0
+func appendDatagramCapsule(b, payload []byte) []byte {
+	b = appendVarint(b, capsuleTypeDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = appendVarint(b, 0)
+	return append(b, payload...)
+}
+
+// handleConnectUDP proxies UDP to the target named in the request path through the client tunnel
+func (p *HTTPProxy) handleConnectUDP(w http.ResponseWriter, r *http.Request, clientAddr string) {
+	connID := utils.GenerateConnID()
+	ctx := commonctx.WithConnID(r.Context(), connID)
+
+	target, err := parseConnectUDPTarget(r.URL.Path)
+	if err != nil {
+		logger.Warn("Invalid CONNECT-UDP request", "conn_id", connID, "path", r.URL.Path, "client", clientAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Info("CONNECT-UDP request started", "conn_id", connID, "target_host", target, "client", clientAddr, "proto", r.Proto)
+
+	targetConn, err := p.dialFunc(ctx, "udp", target)
+	if err != nil {
+		logger.Error("Failed to open UDP relay to target", "conn_id", connID, "target_host", target, "err", err)
+		writeDialError(w, err)
+		return
+	}
+	defer func() {
+		if err := targetConn.Close(); err != nil {
+			logger.Debug("Error closing UDP relay", "conn_id", connID, "err", err)
+		}
+	}()
+
+	var (
+		stream      *bufio.Reader
+		write       func([]byte) error
+		closeStream func()
+	)
+	if r.ProtoMajor == 1 {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			logger.Error("Hijacking not supported by response writer", "conn_id", connID, "target_host", target)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		clientConn, clientBuf, err := hijacker.Hijack()
+		if err != nil {
+			logger.Error("Failed to hijack HTTP connection", "conn_id", connID, "target_host", target, "err", err)
+			return
+		}
+		defer func() { _ = clientConn.Close() }()
+		// Clear the server read/write timeouts, the session is bounded by its idle timeout
+		_ = clientConn.SetDeadline(time.Time{})
+
+		if _, err := clientConn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")); err != nil {
+			logger.Error("Failed to send CONNECT-UDP response to client", "conn_id", connID, "target_host", target, "err", err)
+			return
+		}
+		stream = clientBuf.Reader
+		write = func(b []byte) error {
+			_, err := clientConn.Write(b)
+			return err
+		}
+		closeStream = func() { _ = clientConn.Close() }
+	} else {
+		rc := http.NewResponseController(w)
+		_ = rc.SetReadDeadline(time.Time{})
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Capsule-Protocol", "?1")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			logger.Error("Failed to send CONNECT-UDP response to client", "conn_id", connID, "target_host", target, "err", err)
+			return
+		}
+		stream = bufio.NewReader(r.Body)
+		write = func(b []byte) error {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		closeStream = func() { _ = r.Body.Close() }
+	}
+
+	logger.Info("CONNECT-UDP session established", "conn_id", connID, "target_host", target)
+	sent, received := relayConnectUDP(connID, stream, write, closeStream, targetConn)
+	logger.Info("CONNECT-UDP session closed", "conn_id", connID, "target_host", target, "datagrams_sent", sent, "datagrams_received", received)
+}
+
+// relayConnectUDP moves datagrams between the capsule stream and the target until either side
+// closes or the session is idle. It returns the number of datagrams sent to and received from the target.
+func relayConnectUDP(connID string, stream *bufio.Reader, write func([]byte) error, closeStream func(), targetConn net.Conn) (sent, received int) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Closing the relay unblocks the target reader below
+		defer func() { _ = targetConn.Close() }()
+		for {
+			capsuleType, value, err := readCapsule(stream)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					logger.Debug("CONNECT-UDP capsule stream ended", "conn_id", connID, "err", err)
+				}
+				return
+			}
+			// Unknown capsule types must be ignored (RFC 9297 section 3.2)
+			if capsuleType != capsuleTypeDatagram {
+				continue
+			}
+			contextID, payload, err := splitVarint(value)
+			if err != nil {
+				logger.Debug("Malformed CONNECT-UDP datagram", "conn_id", connID, "err", err)
+				return
+			}
+			// Only context ID 0 (UDP payload) is defined, other contexts are dropped
+			if contextID != 0 {
+				continue
+			}
+			_ = targetConn.SetReadDeadline(time.Now().Add(connectUDPIdleTimeout))
+			if _, err := targetConn.Write(payload); err != nil {
+				logger.Debug("Failed to forward datagram to target", "conn_id", connID, "err", err)
+				return
+			}
+			sent++
+		}
+	}()
+
+	// Each read from the tunnel carries exactly one datagram
+	buffer := make([]byte, 65536)
+	capsule := make([]byte, 0, len(buffer)+16)
+	_ = targetConn.SetReadDeadline(time.Now().Add(connectUDPIdleTimeout))
+	for {
+		n, err := targetConn.Read(buffer)
+		if err != nil {
+			break
+		}
+		if err := write(appendDatagramCapsule(capsule[:0], buffer[:n])); err != nil {
+			logger.Debug("Failed to forward datagram to client", "conn_id", connID, "err", err)
+			break
+		}
+		received++
+		_ = targetConn.SetReadDeadline(time.Now().Add(connectUDPIdleTimeout))
+	}
+	_ = targetConn.Close()
+	closeStream()
+	<-done
+	return sent, received
+}
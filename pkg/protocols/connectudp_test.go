@@ -0,0 +1,138 @@
+package protocols
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1} {
+		b := appendVarint(nil, v)
+		got, err := readVarint(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || got != v {
+			t.Errorf("readVarint(appendVarint(%d)) = %d, %v", v, got, err)
+		}
+		got, rest, err := splitVarint(append(b, 0xff))
+		if err != nil || got != v || len(rest) != 1 {
+			t.Errorf("splitVarint(appendVarint(%d)) = %d, %v, %v", v, got, rest, err)
+		}
+	}
+}
+
+func TestParseConnectUDPTarget(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/.well-known/masque/udp/192.0.2.6/443/", want: "192.0.2.6:443"},
+		{path: "/.well-known/masque/udp/example.com/53", want: "example.com:53"},
+		{path: "/.well-known/masque/udp/2001%3Adb8%3A%3A42/443/", want: "[2001:db8::42]:443"},
+		{path: "/.well-known/masque/udp/example.com/0/", wantErr: true},
+		{path: "/.well-known/masque/udp/example.com/", wantErr: true},
+		{path: "/masque/example.com/443/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseConnectUDPTarget(tt.path)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseConnectUDPTarget(%q) = %q, %v", tt.path, got, err)
+		}
+	}
+}
+
+func TestIsConnectUDP(t *testing.T) {
+	upgrade := httptest.NewRequest(http.MethodGet, "/.well-known/masque/udp/example.com/443/", nil)
+	upgrade.Header.Set("Connection", "keep-alive, Upgrade")
+	upgrade.Header.Set("Upgrade", "connect-udp")
+	if !isConnectUDP(upgrade) {
+		t.Error("Expected HTTP/1.1 upgrade to be CONNECT-UDP")
+	}
+
+	extended := httptest.NewRequest(http.MethodConnect, "/.well-known/masque/udp/example.com/443/", nil)
+	extended.Header.Set(":protocol", "connect-udp")
+	if !isConnectUDP(extended) {
+		t.Error("Expected extended CONNECT to be CONNECT-UDP")
+	}
+
+	connect := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	if isConnectUDP(connect) {
+		t.Error("Expected plain CONNECT not to be CONNECT-UDP")
+	}
+}
+
+func TestHTTPProxy_ConnectUDP(t *testing.T) {
+	// UDP echo target
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	dialed := make(chan string, 1)
+	dialFn := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- network
+		return net.Dial(network, addr)
+	}
+	proxy, err := NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0"}, dialFn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(proxy.(*HTTPProxy))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	req := "GET /.well-known/masque/udp/127.0.0.1/" + port + "/ HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "connect-udp" {
+		t.Fatalf("Unexpected response: %s %v", resp.Status, resp.Header)
+	}
+	if network := <-dialed; network != "udp" {
+		t.Errorf("Expected udp dial, got %q", network)
+	}
+
+	if _, err := conn.Write(appendDatagramCapsule(nil, []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+	capsuleType, value, err := readCapsule(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextID, payload, err := splitVarint(value)
+	if err != nil || capsuleType != capsuleTypeDatagram || contextID != 0 || string(payload) != "ping" {
+		t.Errorf("Unexpected capsule type=%d context=%d payload=%q err=%v", capsuleType, contextID, payload, err)
+	}
+}
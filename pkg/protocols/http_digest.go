@@ -0,0 +1,203 @@
+package protocols
+
+import (
+	"crypto/md5" //nolint:gosec // RFC 7616 MD5 is what legacy digest clients support
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Authentication defaults of the HTTP proxy
+const (
+	defaultAuthRealm      = "Proxy"
+	defaultDigestNonceTTL = 5 * time.Minute
+	maxDigestNonces       = 10000 // Outstanding nonces, unauthenticated requests can't grow the table further
+)
+
+// digestNonce is an issued nonce and the highest nonce count used with it
+type digestNonce struct {
+	expires time.Time
+	count   uint64
+}
+
+// digestAuth issues nonces and checks RFC 7616 Digest responses with MD5 and qop=auth. A nonce
+// count is accepted once per nonce, so a captured response can't be replayed.
+type digestAuth struct {
+	realm  string
+	ttl    time.Duration
+	opaque string
+
+	mu     sync.Mutex
+	nonces map[string]*digestNonce
+}
+
+// httpAuth returns the challenge realm of a listener and its Digest state when it offers Digest
+func httpAuth(cfg *config.HTTPConfig) (string, *digestAuth) {
+	realm := cfg.AuthRealm
+	if realm == "" {
+		realm = defaultAuthRealm
+	}
+	if !cfg.OffersAuthScheme(config.HTTPAuthDigest) {
+		return realm, nil
+	}
+	return realm, newDigestAuth(realm, cfg.DigestNonceTTL)
+}
+
+func newDigestAuth(realm string, ttl time.Duration) *digestAuth {
+	if ttl == 0 {
+		ttl = defaultDigestNonceTTL
+	}
+	return &digestAuth{realm: realm, ttl: ttl, opaque: randomHex(16), nonces: make(map[string]*digestNonce)}
+}
+
+// challenge returns a Proxy-Authenticate value with a new nonce. stale tells the user agent its
+// credentials were right and it can retry with the new nonce without asking the user.
+func (d *digestAuth) challenge(stale bool) string {
+	nonce := randomHex(16)
+	now := time.Now()
+
+	d.mu.Lock()
+	if len(d.nonces) >= maxDigestNonces {
+		for n, issued := range d.nonces {
+			if now.After(issued.expires) {
+				delete(d.nonces, n)
+			}
+		}
+		// Still full of live nonces, drop any of them
+		for n := range d.nonces {
+			if len(d.nonces) < maxDigestNonces {
+				break
+			}
+			delete(d.nonces, n)
+		}
+	}
+	d.nonces[nonce] = &digestNonce{expires: now.Add(d.ttl)}
+	d.mu.Unlock()
+
+	value := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s", opaque="%s"`, d.realm, nonce, d.opaque)
+	if stale {
+		value += ", stale=true"
+	}
+	return value
+}
+
+// use records the nonce count of a verified response. It returns stale for unknown or expired
+// nonces and false for a count not above the last one used, which is a replay.
+func (d *digestAuth) use(nonce string, count uint64) (ok, stale bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	issued, exists := d.nonces[nonce]
+	if !exists || time.Now().After(issued.expires) {
+		delete(d.nonces, nonce)
+		return false, true
+	}
+	if count <= issued.count {
+		return false, false
+	}
+	issued.count = count
+	return true, false
+}
+
+// authenticate checks the Digest credentials of a request against the passwords of the groups
+// the username may name. It returns the username for logging and stale when the credentials were
+// right but the nonce has expired.
+func (d *digestAuth) authenticate(r *http.Request, credentials string, secrets utils.GroupSecrets, validate func(string, string) bool) (*utils.UserContext, string, bool) {
+	params := parseDigestParams(credentials)
+	username := params["username"]
+	if username == "" || params["realm"] != d.realm || params["nonce"] == "" || params["uri"] != r.RequestURI {
+		logger.Debug("Invalid digest credentials", "remote_addr", r.RemoteAddr, "username", username, "realm", params["realm"], "uri", params["uri"])
+		return nil, username, false
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		logger.Debug("Unsupported digest algorithm", "remote_addr", r.RemoteAddr, "username", username, "algorithm", algorithm)
+		return nil, username, false
+	}
+	count, err := strconv.ParseUint(params["nc"], 16, 64)
+	if params["qop"] != "auth" || err != nil || count == 0 || params["cnonce"] == "" {
+		logger.Debug("Digest credentials without qop=auth", "remote_addr", r.RemoteAddr, "username", username)
+		return nil, username, false
+	}
+	if secrets == nil {
+		return nil, username, false
+	}
+
+	candidates, err := utils.ParseProxyUsername(username)
+	if err != nil {
+		logger.Debug("Invalid proxy username", "username", username, "err", err)
+		return nil, username, false
+	}
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	for _, userCtx := range candidates {
+		for _, password := range secrets(userCtx.GroupID) {
+			ha1 := md5Hex(username + ":" + d.realm + ":" + password)
+			expected := md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+			if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 || !validate(userCtx.GroupID, password) {
+				continue
+			}
+			ok, stale := d.use(params["nonce"], count)
+			if !ok {
+				logger.Debug("Rejected digest nonce", "remote_addr", r.RemoteAddr, "username", username, "stale", stale, "nc", params["nc"])
+				return nil, username, stale
+			}
+			return userCtx, username, false
+		}
+	}
+	return nil, username, false
+}
+
+// parseDigestParams parses the comma separated key=value pairs of Digest credentials, values
+// may be quoted with backslash escapes
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			rest = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			rest = rest[end:]
+		}
+		params[key] = value.String()
+		s = rest
+	}
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s)) //nolint:gosec // Required by the Digest scheme
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,81 @@
+package protocols
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// digestCredentials answers a Digest challenge the way a user agent does
+func digestCredentials(r *http.Request, username, password, realm, nonce, nc string) string {
+	ha1 := md5Hex(username + ":" + realm + ":" + password)
+	ha2 := md5Hex(r.Method + ":" + r.RequestURI)
+	response := md5Hex(strings.Join([]string{ha1, nonce, nc, "c0ffee", "auth", ha2}, ":"))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", qop=auth, nc=%s, cnonce="c0ffee", response="%s"`,
+		username, realm, nonce, r.RequestURI, nc, response)
+}
+
+func TestHTTPProxy_DigestAuth(t *testing.T) {
+	validate := func(groupID, password string) bool { return groupID == "g1" && password == "secret" }
+	proxy, err := NewHTTPProxyWithAuth(&config.HTTPConfig{AuthRealm: "Corp", AuthSchemes: []string{"digest", "basic"}}, nil, validate)
+	if err != nil {
+		t.Fatalf("NewHTTPProxyWithAuth() error = %v", err)
+	}
+	p := proxy.(*HTTPProxy)
+	p.SetGroupSecrets(func(groupID string) []string {
+		if groupID == "g1" {
+			return []string{"secret"}
+		}
+		return nil
+	})
+
+	// Challenges follow the listener's order and realm
+	w := httptest.NewRecorder()
+	p.requireAuth(w, false)
+	challenges := w.Header().Values("Proxy-Authenticate")
+	if w.Code != http.StatusProxyAuthRequired || len(challenges) != 2 || !strings.HasPrefix(challenges[0], `Digest realm="Corp"`) || challenges[1] != `Basic realm="Corp"` {
+		t.Fatalf("Challenges = %d %q, want Digest then Basic for realm Corp", w.Code, challenges)
+	}
+	nonce := parseDigestParams(strings.TrimPrefix(challenges[0], "Digest "))["nonce"]
+
+	request := func(username, password, nc string) *http.Request {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Proxy-Authorization", digestCredentials(r, username, password, "Corp", nonce, nc))
+		return r
+	}
+	if userCtx, _, _ := p.authenticate(request("g1.client-a", "secret", "00000001")); userCtx == nil || userCtx.GroupID != "g1" || userCtx.ClientID != "client-a" {
+		t.Fatalf("authenticate() = %+v, want group g1 pinned to client-a", userCtx)
+	}
+	if userCtx, _, _ := p.authenticate(request("g1.client-a", "secret", "00000001")); userCtx != nil {
+		t.Error("A replayed nonce count should be rejected")
+	}
+	if userCtx, _, _ := p.authenticate(request("g1", "secret", "00000002")); userCtx == nil {
+		t.Error("The next nonce count should be accepted")
+	}
+	if userCtx, _, _ := p.authenticate(request("g1", "wrong", "00000003")); userCtx != nil {
+		t.Error("A wrong password should be rejected")
+	}
+
+	// Expired nonces ask the user agent to retry with a fresh one
+	p.digest.nonces[nonce].expires = time.Now().Add(-time.Second)
+	if userCtx, _, stale := p.authenticate(request("g1", "secret", "00000004")); userCtx != nil || !stale {
+		t.Errorf("authenticate() with an expired nonce = %+v, stale %v, want stale", userCtx, stale)
+	}
+
+	// Listeners offer Basic only by default
+	basicOnly, _ := NewHTTPProxyWithAuth(&config.HTTPConfig{}, nil, validate)
+	r := request("g1", "secret", "00000001")
+	if userCtx, _, _ := basicOnly.(*HTTPProxy).authenticate(r); userCtx != nil {
+		t.Error("Digest credentials should be rejected by a Basic listener")
+	}
+	r.SetBasicAuth("g1", "secret")
+	r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+	if userCtx, _, _ := basicOnly.(*HTTPProxy).authenticate(r); userCtx == nil {
+		t.Error("Basic credentials should be accepted")
+	}
+}
@@ -0,0 +1,219 @@
+package protocols
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Defaults of the waits between attempts of plain HTTP requests
+const (
+	defaultHTTPRetryBackoff    = 200 * time.Millisecond
+	defaultHTTPRetryMaxBackoff = 5 * time.Second
+)
+
+// errRangeIgnored is returned when the target answers a resumed request with the whole body, the
+// representation changed since the first response
+var errRangeIgnored = errors.New("target ignored the range request")
+
+// upstreamError is a failure after the target was dialed, the request may have reached it
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string { return e.err.Error() }
+
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// upstream is the target connection of a plain HTTP request and its response
+type upstream struct {
+	conn     net.Conn
+	response *http.Response
+}
+
+// close closes the response body and the target connection
+func (u *upstream) close(connID string) {
+	if err := u.response.Body.Close(); err != nil {
+		logger.Warn("Error closing response body", "conn_id", connID, "err", err)
+	}
+	if err := u.conn.Close(); err != nil {
+		logger.Warn("Error closing target connection", "conn_id", connID, "err", err)
+	}
+}
+
+// exchange dials the target, sends r and reads the response header
+func (p *HTTPProxy) exchange(ctx context.Context, r *http.Request, scheme, host, connID string) (*upstream, error) {
+	logger.Debug("Dialing target server", "conn_id", connID, "target_host", host)
+	targetConn, err := p.dialFunc(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Connected to target server successfully", "conn_id", connID, "target_host", host)
+
+	// For HTTPS, wrap with TLS
+	if scheme == protocol.SchemeHTTPS {
+		serverName := strings.Split(host, ":")[0]
+		logger.Debug("Wrapping connection with TLS", "conn_id", connID, "server_name", serverName)
+		targetConn = tls.Client(targetConn, p.targetTLS.clientConfig(serverName))
+	}
+
+	logger.Debug("Sending request to target server", "conn_id", connID)
+	if err := r.Write(targetConn); err != nil {
+		_ = targetConn.Close()
+		return nil, &upstreamError{fmt.Errorf("failed to write request to target server: %w", err)}
+	}
+
+	logger.Debug("Reading response from target server", "conn_id", connID)
+	response, err := http.ReadResponse(bufio.NewReader(targetConn), r)
+	if err != nil {
+		_ = targetConn.Close()
+		return nil, &upstreamError{fmt.Errorf("failed to read response from target server: %w", err)}
+	}
+	return &upstream{conn: targetConn, response: response}, nil
+}
+
+// maxAttempts returns how often a plain HTTP request may be tried
+func (p *HTTPProxy) maxAttempts() int {
+	return max(p.config.Retry.MaxAttempts, 1)
+}
+
+// retryable reports whether a request that failed with err may be sent again. Failed dials
+// never reached the target, requests that were sent are only repeated when idempotent.
+func retryable(r *http.Request, err error) bool {
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		return idempotentRequest(r)
+	}
+	switch utils.ErrorCodeOf(err) {
+	case utils.ErrCodeDialFailed, utils.ErrCodeDialTimeout, utils.ErrCodeNoClientAvailable, utils.ErrCodeClientOverloaded, utils.ErrCodeClientBusy:
+		return true
+	}
+	return false
+}
+
+// idempotentRequest reports whether r is a GET or HEAD without a body
+func idempotentRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0
+}
+
+// waitRetry waits before the retry following attempt, false when the user went away
+func (p *HTTPProxy) waitRetry(ctx context.Context, attempt int) bool {
+	backoff, maxBackoff := p.config.Retry.Backoff, p.config.Retry.MaxBackoff
+	if backoff <= 0 {
+		backoff = defaultHTTPRetryBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultHTTPRetryMaxBackoff
+	}
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	timer := time.NewTimer(min(backoff, maxBackoff))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// resumeValidator returns the If-Range value to resume the body of a response to r, or "" when
+// it can't be resumed: ranges are unsupported or the response has no strong validator
+func resumeValidator(r *http.Request, response *http.Response) string {
+	if r.Method != http.MethodGet || !idempotentRequest(r) || r.Header.Get("Range") != "" || response.StatusCode != http.StatusOK {
+		return ""
+	}
+	if !strings.EqualFold(response.Header.Get("Accept-Ranges"), "bytes") {
+		return ""
+	}
+	if etag := response.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return response.Header.Get("Last-Modified")
+}
+
+// upstreamReader records the errors of reading a response body, telling them apart from
+// failures to write to the proxy user
+type upstreamReader struct {
+	io.Reader
+	err error
+}
+
+func (r *upstreamReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// copyBody copies the response body of up to the user. A GET body cut off by the target is
+// resumed with range requests while attempts are left, up ends as the last target used.
+func (p *HTTPProxy) copyBody(ctx context.Context, w io.Writer, r *http.Request, up *upstream, scheme, host, connID string, attempt int) (int64, error) {
+	validator := resumeValidator(r, up.response)
+	var written int64
+	for {
+		body := &upstreamReader{Reader: up.response.Body}
+		n, err := io.Copy(w, body)
+		written += n
+		if body.err == nil || validator == "" {
+			return written, err
+		}
+
+		logger.Warn("Target server failed mid-body", "conn_id", connID, "target_host", host, "bytes_written", written, "err", body.err)
+		for {
+			if attempt >= p.maxAttempts() || !p.waitRetry(ctx, attempt) {
+				return written, err
+			}
+			attempt++
+			next, resumeErr := p.resume(ctx, r, validator, written, scheme, host, connID)
+			if resumeErr == nil {
+				up.close(connID)
+				*up = *next
+				logger.Info("Resumed HTTP response body", "conn_id", connID, "target_host", host, "offset", written, "attempt", attempt)
+				break
+			}
+			logger.Warn("Failed to resume HTTP response body", "conn_id", connID, "target_host", host, "offset", written, "attempt", attempt, "err", resumeErr)
+			if errors.Is(resumeErr, errRangeIgnored) {
+				return written, err
+			}
+		}
+	}
+}
+
+// resume requests the body of r again from offset, the target must answer with that range of
+// the same representation
+func (p *HTTPProxy) resume(ctx context.Context, r *http.Request, validator string, offset int64, scheme, host, connID string) (*upstream, error) {
+	req := r.Clone(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", validator)
+	up, err := p.exchange(ctx, req, scheme, host, connID)
+	if err != nil {
+		return nil, err
+	}
+	if up.response.StatusCode == http.StatusOK {
+		up.close(connID)
+		return nil, errRangeIgnored
+	}
+	wantRange := fmt.Sprintf("bytes %d-", offset)
+	if up.response.StatusCode != http.StatusPartialContent || !strings.HasPrefix(up.response.Header.Get("Content-Range"), wantRange) {
+		up.close(connID)
+		return nil, fmt.Errorf("target answered the range request with status %d", up.response.StatusCode)
+	}
+	return up, nil
+}
@@ -0,0 +1,130 @@
+package protocols
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// scriptedTarget answers the n-th dial with responses[n], "" fails the dial and "close" closes
+// the connection after reading the request
+type scriptedTarget struct {
+	mu        sync.Mutex
+	responses []string
+	requests  []*http.Request
+}
+
+func (s *scriptedTarget) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.requests)
+	s.requests = append(s.requests, nil)
+	if n >= len(s.responses) || s.responses[n] == "" {
+		return nil, errors.New("connection refused")
+	}
+	response := s.responses[n]
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		req, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.requests[n] = req
+		s.mu.Unlock()
+		if response != "close" {
+			_, _ = server.Write([]byte(response))
+		}
+	}()
+	return client, nil
+}
+
+func (s *scriptedTarget) dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func newRetryingProxy(t *testing.T, target *scriptedTarget, maxAttempts int) *HTTPProxy {
+	t.Helper()
+	cfg := &config.HTTPConfig{ListenAddr: "127.0.0.1:0", Retry: config.HTTPRetry{MaxAttempts: maxAttempts, Backoff: time.Millisecond}}
+	proxy, err := NewHTTPProxyWithAuth(cfg, target.dial, nil)
+	if err != nil {
+		t.Fatalf("NewHTTPProxyWithAuth() error = %v", err)
+	}
+	return proxy.(*HTTPProxy)
+}
+
+const okResponse = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+func TestHTTPProxy_RetriesUpstream(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		body        string
+		maxAttempts int
+		responses   []string
+		wantCode    int
+		wantDials   int
+	}{
+		{"dial failure retried", "GET", "", 3, []string{"", okResponse}, http.StatusOK, 2},
+		{"dial failure of POST retried", "POST", "data", 3, []string{"", okResponse}, http.StatusOK, 2},
+		{"retries disabled", "GET", "", 0, []string{"", okResponse}, http.StatusBadGateway, 1},
+		{"attempts capped", "GET", "", 2, []string{"", "", okResponse}, http.StatusBadGateway, 2},
+		{"sent GET retried", "GET", "", 3, []string{"close", okResponse}, http.StatusOK, 2},
+		{"sent POST not retried", "POST", "data", 3, []string{"close", okResponse}, http.StatusBadGateway, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &scriptedTarget{responses: tt.responses}
+			proxy := newRetryingProxy(t, target, tt.maxAttempts)
+
+			req := httptest.NewRequest(tt.method, "http://example.com/", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			proxy.handleRequest(w, req, "127.0.0.1")
+			if w.Code != tt.wantCode || target.dials() != tt.wantDials {
+				t.Errorf("Got %d after %d dials, want %d after %d", w.Code, target.dials(), tt.wantCode, tt.wantDials)
+			}
+		})
+	}
+}
+
+func TestHTTPProxy_ResumesBody(t *testing.T) {
+	const body = "0123456789abcdefghij"
+	cutOff := "HTTP/1.1 200 OK\r\nContent-Length: 20\r\nAccept-Ranges: bytes\r\nETag: \"v1\"\r\n\r\n" + body[:8]
+	rest := "HTTP/1.1 206 Partial Content\r\nContent-Length: 12\r\nContent-Range: bytes 8-19/20\r\n\r\n" + body[8:]
+	target := &scriptedTarget{responses: []string{cutOff, "", rest}}
+	proxy := newRetryingProxy(t, target, 3)
+
+	req := httptest.NewRequest("GET", "http://example.com/file", nil)
+	w := httptest.NewRecorder()
+	proxy.handleRequest(w, req, "127.0.0.1")
+	if w.Body.String() != body {
+		t.Errorf("Body = %q, want %q", w.Body.String(), body)
+	}
+	target.mu.Lock()
+	resumed := target.requests[2]
+	target.mu.Unlock()
+	if resumed.Header.Get("Range") != "bytes=8-" || resumed.Header.Get("If-Range") != "\"v1\"" {
+		t.Errorf("Resumed with Range %q and If-Range %q", resumed.Header.Get("Range"), resumed.Header.Get("If-Range"))
+	}
+
+	// Without a validator the body stays cut off
+	target = &scriptedTarget{responses: []string{strings.Replace(cutOff, "ETag: \"v1\"\r\n", "", 1), rest}}
+	proxy = newRetryingProxy(t, target, 3)
+	w = httptest.NewRecorder()
+	proxy.handleRequest(w, httptest.NewRequest("GET", "http://example.com/file", nil), "127.0.0.1")
+	if w.Body.String() != body[:8] || target.dials() != 1 {
+		t.Errorf("Got %q after %d dials, want the cut off body without a retry", w.Body.String(), target.dials())
+	}
+}
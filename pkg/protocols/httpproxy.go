@@ -2,10 +2,12 @@
 package protocols
 
 import (
-	"bufio"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -14,13 +16,29 @@ import (
 	"sync"
 	"time"
 
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
 	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/tlsfp"
 	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 )
 
+// ClientPinHeader pins the request to a client of the proxy user's group, like a
+// client ID in the username. It is not forwarded to the target.
+const ClientPinHeader = "X-Anyproxy-Client"
+
+// ConnIDHeader carries the conn_id of a plain HTTP request to the target, see config.HTTPCorrelation
+const ConnIDHeader = "X-Anyproxy-Conn-ID"
+
+// Request header defaults of the HTTP proxy, slow or oversized headers can't hold connections
+const (
+	defaultMaxHeaderBytes    = 64 << 10
+	defaultReadHeaderTimeout = 10 * time.Second
+)
+
 // Fix: Use buffer pool to reduce memory allocation
 var bufferPool = sync.Pool{
 	New: func() interface{} {
@@ -36,6 +54,12 @@ type HTTPProxy struct {
 	server         *http.Server
 	dialFunc       func(ctx context.Context, network, addr string) (net.Conn, error)
 	groupValidator func(string, string) bool // Function to validate group credentials
+	sourceRouter   utils.SourceRouter        // Groups for users without credentials, by source IP
+	groupSecrets   utils.GroupSecrets        // Group passwords for Digest authentication
+	digest         *digestAuth               // Digest nonces (nil when the listener doesn't offer Digest)
+	realm          string                    // Realm of the authentication challenges
+	targetTLS      *targetTLSPolicy          // Verification of https:// targets (nil = system trust)
+	pendingConnect chan struct{}             // Slots of CONNECTs waiting for their target (nil = unlimited)
 }
 
 // NewHTTPProxyWithAuth creates a new HTTP proxy with authentication
@@ -43,10 +67,28 @@ func NewHTTPProxyWithAuth(config *config.HTTPConfig, dialFn func(context.Context
 	tlsEnabled := config.TLSCert != "" && config.TLSKey != ""
 	logger.Info("Creating HTTP proxy", "listen_addr", config.ListenAddr, "auth_enabled", "group-based", "tls_enabled", tlsEnabled)
 
+	targetTLS, err := newTargetTLSPolicy(config.TargetTLS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load target TLS rules: %w", err)
+	}
+
 	proxy := &HTTPProxy{
 		config:         config,
 		dialFunc:       dialFn,
 		groupValidator: groupValidator,
+		targetTLS:      targetTLS,
+	}
+	proxy.realm, proxy.digest = httpAuth(config)
+	if config.MaxPendingConnects > 0 {
+		proxy.pendingConnect = make(chan struct{}, config.MaxPendingConnects)
+	}
+
+	maxHeaderBytes, readHeaderTimeout := config.MaxHeaderBytes, config.ReadHeaderTimeout
+	if maxHeaderBytes == 0 {
+		maxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = defaultReadHeaderTimeout
 	}
 
 	// 🚨 Fix: Don't use ServeMux as it can't handle CONNECT requests properly
@@ -55,9 +97,11 @@ func NewHTTPProxyWithAuth(config *config.HTTPConfig, dialFn func(context.Context
 		Addr:    config.ListenAddr,
 		Handler: proxy, // Use proxy itself directly as handler
 		// Standard timeout configuration
-		ReadTimeout:  60 * time.Second,
-		WriteTimeout: 60 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		ReadTimeout:       60 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ReadHeaderTimeout: readHeaderTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
 	}
 
 	logger.Info("HTTP proxy created successfully", "listen_addr", config.ListenAddr, "tls_enabled", tlsEnabled)
@@ -74,15 +118,36 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (p *HTTPProxy) Start() error {
 	logger.Info("Starting HTTP proxy server", "listen_addr", p.config.ListenAddr)
 
+	listener, err := sockopt.Listen(context.Background(), "tcp", p.config.ListenAddr, p.config.SocketOptions)
+	if err != nil {
+		logger.Error("Failed to create TCP listener for HTTP proxy", "listen_addr", p.config.ListenAddr, "err", err)
+		return fmt.Errorf("failed to listen on %s: %w", p.config.ListenAddr, err)
+	}
+	listener = limitListener(listener, newListenerLimiter("http", p.config.Limits))
+
+	var cert tls.Certificate
+	if p.config.TLSCert != "" && p.config.TLSKey != "" {
+		if cert, err = config.LoadX509KeyPair(p.config.TLSCert, p.config.TLSKey); err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+	}
+
 	go func() {
 		var err error
 		// Check if TLS is configured
 		if p.config.TLSCert != "" && p.config.TLSKey != "" {
 			logger.Info("Starting HTTPS proxy server with TLS", "listen_addr", p.config.ListenAddr, "cert", p.config.TLSCert, "key", p.config.TLSKey)
-			err = p.server.ListenAndServeTLS(p.config.TLSCert, p.config.TLSKey)
+			p.server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+			if policy := tlsfp.NewPolicy("http", p.config.TLSFingerprint); policy != nil {
+				p.server.TLSConfig = policy.Apply(p.server.TLSConfig)
+				listener = tlsfp.Listen(listener)
+			}
+			p.server.TLSConfig.Certificates = []tls.Certificate{cert}
+			err = p.server.ServeTLS(listener, "", "")
 		} else {
 			logger.Info("Starting HTTP proxy server without TLS", "listen_addr", p.config.ListenAddr)
-			err = p.server.ListenAndServe()
+			err = p.server.Serve(listener)
 		}
 
 		if err != nil && err != http.ErrServerClosed {
@@ -113,6 +178,16 @@ func (p *HTTPProxy) Stop() error {
 	return err
 }
 
+// SetSourceRouter admits requests without Proxy-Authorization from routed source IPs
+func (p *HTTPProxy) SetSourceRouter(router utils.SourceRouter) {
+	p.sourceRouter = router
+}
+
+// SetGroupSecrets sets the group passwords Digest responses are checked with
+func (p *HTTPProxy) SetGroupSecrets(secrets utils.GroupSecrets) {
+	p.groupSecrets = secrets
+}
+
 // GetListenAddr returns the listen address
 func (p *HTTPProxy) GetListenAddr() string {
 	return p.config.ListenAddr
@@ -124,43 +199,53 @@ func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	logger.Debug("HTTP request received", "method", r.Method, "url", r.URL.String(), "client", clientAddr, "user_agent", r.Header.Get("User-Agent"))
 
-	// Authentication check
+	// Requests without credentials may be routed by source IP
 	var userCtx *utils.UserContext
-	if p.groupValidator != nil {
-		logger.Debug("Authentication required, checking credentials", "client", clientAddr)
-
-		username, password, authenticated := p.authenticateAndExtractUser(r)
-		if !authenticated {
-			logger.Warn("HTTP proxy authentication failed", "client", clientAddr, "method", r.Method, "host", r.Host)
-			w.Header().Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
-			http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
-			return
+	if p.sourceRouter != nil && r.Header.Get("Proxy-Authorization") == "" {
+		sourceIP := remoteIP(r.RemoteAddr)
+		if groupID, ok := p.sourceRouter(sourceIP); ok {
+			userCtx = &utils.UserContext{GroupID: groupID, SourceIP: sourceIP}
+			logger.Debug("HTTP proxy request routed by source IP", "client", clientAddr, "group_id", groupID)
 		}
+	}
+
+	// Authentication check
+	if userCtx == nil && p.groupValidator != nil {
+		logger.Debug("Authentication required, checking credentials", "client", clientAddr)
 
-		// Validate group credentials
-		if !p.groupValidator(username, password) {
-			logger.Warn("HTTP proxy group authentication failed", "client", clientAddr, "group_id", username)
-			w.Header().Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
-			http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		resolved, username, stale := p.authenticate(r)
+		if resolved == nil {
+			logger.Warn("HTTP proxy authentication failed", "client", clientAddr, "username", username, "method", r.Method, "host", r.Host, "stale_nonce", stale)
+			p.requireAuth(w, stale)
 			return
 		}
 
 		// Set user context
-		userCtx = &utils.UserContext{
-			Username: username,
-			GroupID:  username,
-		}
+		userCtx = resolved
+		userCtx.SourceIP = remoteIP(r.RemoteAddr)
 
-		logger.Debug("HTTP proxy authentication successful", "username", username, "group_id", username, "client", clientAddr)
-	} else {
+		logger.Debug("HTTP proxy authentication successful", "username", username, "group_id", userCtx.GroupID, "pinned_client", userCtx.ClientID, "client", clientAddr)
+	} else if userCtx == nil {
 		logger.Debug("No authentication required")
 	}
 
-	// Set user context to request
+	// Set user context to request, the pin header takes precedence over the username
 	if userCtx != nil {
+		if clientID := strings.TrimSpace(r.Header.Get(ClientPinHeader)); clientID != "" {
+			userCtx.ClientID = clientID
+			logger.Debug("HTTP proxy request pinned to client", "client", clientAddr, "group_id", userCtx.GroupID, "pinned_client", clientID)
+		}
 		ctx := commonctx.WithUserContext(r.Context(), userCtx)
 		r = r.WithContext(ctx)
 	}
+	// The pin header is for the proxy, it's never forwarded to the target
+	r.Header.Del(ClientPinHeader)
+
+	// Handle CONNECT-UDP before CONNECT, extended CONNECT shares the method
+	if isConnectUDP(r) {
+		p.handleConnectUDP(w, r, clientAddr)
+		return
+	}
 
 	// Handle CONNECT method
 	if r.Method == http.MethodConnect {
@@ -182,6 +267,50 @@ func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	p.handleRequest(w, r, clientAddr)
 }
 
+// authenticate checks the Proxy-Authorization of a request with the schemes the listener offers.
+// It returns the username for logging and whether a Digest nonce has expired.
+func (p *HTTPProxy) authenticate(r *http.Request) (*utils.UserContext, string, bool) {
+	if scheme, credentials, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " "); strings.EqualFold(scheme, "Digest") {
+		if p.digest == nil {
+			logger.Debug("Digest authentication not offered by this listener", "remote_addr", r.RemoteAddr)
+			return nil, "", false
+		}
+		return p.digest.authenticate(r, credentials, p.groupSecrets, p.groupValidator)
+	}
+	if !p.config.OffersAuthScheme(config.HTTPAuthBasic) {
+		return nil, "", false
+	}
+
+	username, password, authenticated := p.authenticateAndExtractUser(r)
+	if !authenticated {
+		return nil, "", false
+	}
+	// Validate group credentials, the username may pin a client and carry options
+	resolved, ok := authenticateProxyUser(username, password, p.groupValidator)
+	if !ok {
+		logger.Debug("HTTP proxy group authentication failed", "remote_addr", r.RemoteAddr, "username", username)
+		return nil, username, false
+	}
+	return resolved, username, false
+}
+
+// requireAuth answers 407 with a challenge per offered scheme, in the listener's order
+func (p *HTTPProxy) requireAuth(w http.ResponseWriter, stale bool) {
+	schemes := p.config.AuthSchemes
+	if len(schemes) == 0 {
+		schemes = []string{config.HTTPAuthBasic}
+	}
+	for _, scheme := range schemes {
+		switch scheme {
+		case config.HTTPAuthDigest:
+			w.Header().Add("Proxy-Authenticate", p.digest.challenge(stale))
+		case config.HTTPAuthBasic:
+			w.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", p.realm))
+		}
+	}
+	http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+}
+
 // authenticateAndExtractUser checks proxy authentication and returns username, password, and auth status
 func (p *HTTPProxy) authenticateAndExtractUser(r *http.Request) (string, string, bool) {
 	logger.Debug("Checking proxy authentication", "remote_addr", r.RemoteAddr, "method", r.Method, "host", r.Host)
@@ -245,6 +374,15 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request, client
 
 	logger.Info("Processing CONNECT request", "conn_id", connID, "target_host", host, "client", clientAddr)
 
+	// Half-open tunnels are limited, each holds a connection until its dial completes
+	release, ok := p.reserveConnect()
+	if !ok {
+		logger.Warn("Too many pending CONNECT requests, rejecting", "conn_id", connID, "target_host", host, "client", clientAddr, "max_pending_connects", p.config.MaxPendingConnects)
+		http.Error(w, "Too many pending connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
 	// Hijack the connection first to handle raw TCP tunneling
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -271,11 +409,13 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request, client
 	// Create connection to target through the dial function
 	logger.Debug("Dialing target host", "conn_id", connID, "target_host", host)
 	targetConn, err := p.dialFunc(ctx, "tcp", host)
+	release()
 
 	if err != nil {
 		logger.Error("Failed to connect to target host", "conn_id", connID, "target_host", host, "err", err)
 		// Send error response manually since we've hijacked the connection
-		if _, writeErr := clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n")); writeErr != nil {
+		status, body := dialErrorResponse(err)
+		if _, writeErr := fmt.Fprintf(clientConn, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", status, http.StatusText(status), len(body), body); writeErr != nil {
 			logger.Warn("Failed to write error response to client", "conn_id", connID, "err", writeErr)
 		}
 		return
@@ -312,14 +452,37 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request, client
 	logger.Info("CONNECT tunnel established", "conn_id", connID, "target_host", host)
 
 	// Start bidirectional data transfer
-	go p.transfer(targetConn, clientConn, "target->client", connID)
-	p.transfer(clientConn, targetConn, "client->target", connID)
+	targetDone := make(chan struct{})
+	go func() {
+		defer close(targetDone)
+		p.transfer(targetConn, clientConn, "target->client", connID)
+	}()
+	if p.transfer(clientConn, targetConn, "client->target", connID) {
+		// The client only closed its write side, let the target finish its answer
+		<-targetDone
+	}
 
 	logger.Info("CONNECT tunnel closed", "conn_id", connID, "target_host", host)
 }
 
-// transfer copies data between two connections
-func (p *HTTPProxy) transfer(dst, src net.Conn, direction string, connID string) {
+// reserveConnect takes a slot for a CONNECT waiting for its target, false when all are taken.
+// The returned release may be called more than once.
+func (p *HTTPProxy) reserveConnect() (func(), bool) {
+	if p.pendingConnect == nil {
+		return func() {}, true
+	}
+	select {
+	case p.pendingConnect <- struct{}{}:
+	default:
+		return nil, false
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-p.pendingConnect }) }, true
+}
+
+// transfer copies data between two connections, EOF of src is forwarded by half-closing dst.
+// It returns true if dst was half-closed and the other direction should be waited for.
+func (p *HTTPProxy) transfer(dst, src net.Conn, direction string, connID string) bool {
 	logger.Debug("Starting data transfer", "conn_id", connID, "direction", direction, "src_addr", src.RemoteAddr(), "dst_addr", dst.RemoteAddr())
 
 	// Fix: Get buffer from buffer pool
@@ -351,7 +514,7 @@ func (p *HTTPProxy) transfer(dst, src net.Conn, direction string, connID string)
 			_, writeErr := dst.Write(buffer[:n])
 			if writeErr != nil {
 				logger.Error("Transfer write error", "conn_id", connID, "direction", direction, "bytes_written", n, "total_bytes", totalBytes, "err", writeErr)
-				return
+				return false
 			}
 		}
 
@@ -362,14 +525,18 @@ func (p *HTTPProxy) transfer(dst, src net.Conn, direction string, connID string)
 			}
 
 			// Log connection close gracefully
-			if strings.Contains(err.Error(), "use of closed network connection") ||
-				strings.Contains(err.Error(), "connection reset by peer") ||
-				err == io.EOF {
+			if utils.IsClosedConn(err) || errors.Is(err, io.EOF) {
 				logger.Debug("Connection closed during transfer", "conn_id", connID, "direction", direction, "total_bytes", totalBytes)
 			} else {
 				logger.Error("Transfer read error", "conn_id", connID, "direction", direction, "total_bytes", totalBytes, "err", err)
 			}
-			return
+			if err == io.EOF {
+				if closeErr := connection.CloseWrite(dst); closeErr == nil {
+					logger.Debug("Forwarded half-close", "conn_id", connID, "direction", direction)
+					return true
+				}
+			}
+			return false
 		}
 	}
 }
@@ -402,6 +569,18 @@ func (p *HTTPProxy) handleRequest(w http.ResponseWriter, r *http.Request, client
 
 	logger.Info("Processing HTTP request", "conn_id", connID, "method", r.Method, "target_url", targetURL.String(), "client", clientAddr)
 
+	// Oversized bodies are refused before dialing, chunked ones when the limit is reached
+	var body *limitedBody
+	if limit := p.config.MaxBodyBytes; limit > 0 && r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > limit {
+			logger.Warn("HTTP request body too large", "conn_id", connID, "content_length", r.ContentLength, "max_body_bytes", limit, "client", clientAddr)
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit)}
+		r.Body = body
+	}
+
 	// Create connection to target
 	host := targetURL.Host
 	if !strings.Contains(host, ":") {
@@ -413,64 +592,48 @@ func (p *HTTPProxy) handleRequest(w http.ResponseWriter, r *http.Request, client
 		logger.Debug("Added default port to host", "conn_id", connID, "original_host", targetURL.Host, "target_host", host, "scheme", targetURL.Scheme)
 	}
 
-	logger.Debug("Dialing target server", "conn_id", connID, "target_host", host)
-	targetConn, err := p.dialFunc(ctx, "tcp", host)
-
-	if err != nil {
-		logger.Error("Failed to connect to target server", "conn_id", connID, "target_host", host, "err", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
-	}
-	defer func() {
-		if err := targetConn.Close(); err != nil {
-			logger.Warn("Error closing target connection", "conn_id", connID, "err", err)
-		}
-	}()
-
-	// Connection already established, no need to get ID from ConnWrapper again since we already have it
-
-	logger.Debug("Connected to target server successfully", "conn_id", connID, "target_host", host)
-
-	// For HTTPS, wrap with TLS
-	if targetURL.Scheme == protocol.SchemeHTTPS {
-		logger.Debug("Wrapping connection with TLS", "conn_id", connID, "server_name", strings.Split(host, ":")[0])
-		tlsConn := tls.Client(targetConn, &tls.Config{
-			ServerName: strings.Split(host, ":")[0],
-			MinVersion: tls.VersionTLS12, // Enforce minimum TLS 1.2
-		})
-		targetConn = tlsConn
-	}
-
 	// Remove proxy-specific headers
 	r.Header.Del("Proxy-Authorization")
 	r.Header.Del("Proxy-Connection")
 
-	// Set Connection header for HTTP/1.1
-	r.Header.Set("Connection", "close")
-
-	// Write request to target server
-	logger.Debug("Sending request to target server", "conn_id", connID)
-	if err := r.Write(targetConn); err != nil {
-		logger.Error("Failed to write request to target server", "conn_id", connID, "target_host", host, "err", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
-	}
-
-	// Read response from target server
-	logger.Debug("Reading response from target server", "conn_id", connID)
-	targetReader := bufio.NewReader(targetConn)
-	response, err := http.ReadResponse(targetReader, r)
-
-	if err != nil {
-		logger.Error("Failed to read response from target server", "conn_id", connID, "target_host", host, "err", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	// The target may keep the connection alive, the gateway closes it after the response and a
+	// client with connection pooling keeps it for the next request of the same proxy user
+	r.Header.Del("Connection")
+	r.Close = false
+	p.addCorrelationHeaders(r, connID)
+
+	// Failed dials and idempotent requests are retried over flaky client links
+	var (
+		up      *upstream
+		err     error
+		attempt int
+	)
+	for attempt = 1; ; attempt++ {
+		up, err = p.exchange(ctx, r, targetURL.Scheme, host, connID)
+		if err == nil {
+			break
+		}
+		if body != nil && body.exceeded {
+			logger.Warn("HTTP request body too large", "conn_id", connID, "max_body_bytes", p.config.MaxBodyBytes, "client", clientAddr)
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if attempt < p.maxAttempts() && retryable(r, err) && p.waitRetry(ctx, attempt) {
+			logger.Warn("Retrying HTTP request", "conn_id", connID, "method", r.Method, "target_host", host, "attempt", attempt+1, "err", err)
+			continue
+		}
+		var upErr *upstreamError
+		if errors.As(err, &upErr) {
+			logger.Error("Failed to exchange request with target server", "conn_id", connID, "target_host", host, "attempts", attempt, "err", err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		logger.Error("Failed to connect to target server", "conn_id", connID, "target_host", host, "attempts", attempt, "err", err)
+		writeDialError(w, err)
 		return
 	}
-	defer func() {
-		if err := response.Body.Close(); err != nil {
-			logger.Warn("Error closing response body", "conn_id", connID, "err", err)
-		}
-	}()
+	defer up.close(connID)
+	response := up.response
 
 	logger.Debug("Response received from target server", "conn_id", connID, "status_code", response.StatusCode, "content_length", response.ContentLength)
 
@@ -486,7 +649,7 @@ func (p *HTTPProxy) handleRequest(w http.ResponseWriter, r *http.Request, client
 
 	// Copy response body
 	logger.Debug("Copying response body to client", "conn_id", connID)
-	bytesWritten, err := io.Copy(w, response.Body)
+	bytesWritten, err := p.copyBody(ctx, w, r, up, targetURL.Scheme, host, connID, attempt)
 
 	if err != nil {
 		logger.Error("Failed to copy response body to client", "conn_id", connID, "bytes_written", bytesWritten, "err", err)
@@ -497,6 +660,91 @@ func (p *HTTPProxy) handleRequest(w http.ResponseWriter, r *http.Request, client
 	logger.Info("HTTP request processing completed", "conn_id", connID, "method", r.Method, "target_url", targetURL.String(), "status_code", response.StatusCode, "bytes_written", bytesWritten)
 }
 
+// limitedBody is a request body cut off by http.MaxBytesReader, Request.Write hides the cause
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+// Read notes when the body limit was exceeded
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// dialErrorBody is the JSON body returned to the proxy user when a dial fails
+type dialErrorBody struct {
+	Code    utils.ErrorCode `json:"code"`
+	Message string          `json:"message"`
+}
+
+// dialErrorResponse maps a dial error to the status code and JSON body returned to the proxy user
+func dialErrorResponse(err error) (int, []byte) {
+	code := utils.ErrorCodeOf(err)
+	status, message := http.StatusBadGateway, "Bad Gateway: the client could not reach the target"
+	switch code {
+	case utils.ErrCodeNoClientAvailable:
+		status, message = http.StatusServiceUnavailable, "Service Unavailable: no client available in group"
+	case utils.ErrCodeTargetForbidden:
+		status, message = http.StatusForbidden, "Forbidden: target denied by policy"
+		if errors.Is(err, utils.ErrGeoBlocked) {
+			message = "Forbidden: blocked by geo-ip policy"
+		} else if errors.Is(err, utils.ErrBlocklisted) {
+			message = "Forbidden: target is blocklisted"
+		} else if errors.Is(err, utils.ErrOutsideSchedule) {
+			message = "Forbidden: outside the access schedule"
+		}
+	case utils.ErrCodeDialTimeout:
+		status, message = http.StatusGatewayTimeout, "Gateway Timeout: the target did not answer in time"
+	case utils.ErrCodeQuotaExceeded:
+		status, message = http.StatusTooManyRequests, "Too Many Requests: connection limit or rate limit reached"
+	case utils.ErrCodeClientOverloaded:
+		status, message = http.StatusServiceUnavailable, "Service Unavailable: client connection limit reached"
+	case utils.ErrCodeClientBusy:
+		status, message = http.StatusServiceUnavailable, "Service Unavailable: client connect rate limit reached"
+	case utils.ErrCodeGatewayOverloaded:
+		status, message = http.StatusServiceUnavailable, "Service Unavailable: gateway overloaded"
+	}
+	body, _ := json.Marshal(dialErrorBody{Code: code, Message: message})
+	return status, body
+}
+
+// writeDialError sends the response for a failed dial
+func writeDialError(w http.ResponseWriter, err error) {
+	status, body := dialErrorResponse(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// addCorrelationHeaders sets the configured headers matching a request with the gateway's records.
+// A conn ID sent by the proxy user is replaced, the user's address is appended to theirs.
+func (p *HTTPProxy) addCorrelationHeaders(r *http.Request, connID string) {
+	if p.config.Correlation.ConnID {
+		r.Header.Set(ConnIDHeader, connID)
+	}
+	if p.config.Correlation.ForwardedFor {
+		forwarded := remoteIP(r.RemoteAddr)
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			forwarded = strings.Join(prior, ", ") + ", " + forwarded
+		}
+		r.Header.Set("X-Forwarded-For", forwarded)
+	}
+}
+
+// remoteIP returns the host part of a connection's remote address
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
 // getClientIP extracts the client IP address
 func getClientIP(r *http.Request) string {
 	// Check X-Forwarded-For header
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -14,6 +16,8 @@ import (
 	"testing"
 	"time"
 
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/config"
 )
 
@@ -232,6 +236,153 @@ func TestHTTPProxy_HandleHTTP_NoAuth(t *testing.T) {
 	}
 }
 
+func TestHTTPProxy_HandleHTTP_SourceRoute(t *testing.T) {
+	groups := make(chan string, 1)
+	dialFn := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		userCtx, _ := commonctx.GetUserContext(ctx)
+		groups <- userCtx.GroupID
+		return mockDialFunc(ctx, network, addr)
+	}
+	proxy, _ := NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0"}, dialFn, mockGroupValidator)
+	httpProxy := proxy.(*HTTPProxy)
+	httpProxy.SetSourceRouter(func(sourceIP string) (string, bool) {
+		return "office", sourceIP == "10.1.0.5"
+	})
+
+	// Routed source without credentials is served by the routed group
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.RemoteAddr = "10.1.0.5:40000"
+	w := httptest.NewRecorder()
+	httpProxy.handleHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if group := <-groups; group != "office" {
+		t.Errorf("Expected group office, got %q", group)
+	}
+
+	// Other sources still need credentials
+	req = httptest.NewRequest("GET", "http://example.com", nil)
+	req.RemoteAddr = "10.2.0.5:40000"
+	w = httptest.NewRecorder()
+	httpProxy.handleHTTP(w, req)
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected status 407 for unrouted source, got %d", w.Code)
+	}
+
+	// Wrong credentials are rejected even from a routed source
+	req = httptest.NewRequest("GET", "http://example.com", nil)
+	req.RemoteAddr = "10.1.0.5:40000"
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("testgroup:wrong")))
+	w = httptest.NewRecorder()
+	httpProxy.handleHTTP(w, req)
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected status 407 for bad credentials, got %d", w.Code)
+	}
+}
+
+func TestHTTPProxy_ClientPinHeader(t *testing.T) {
+	pins := make(chan *utils.UserContext, 1)
+	dialFn := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		userCtx, _ := commonctx.GetUserContext(ctx)
+		pins <- userCtx
+		return mockDialFunc(ctx, network, addr)
+	}
+	proxy, _ := NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0"}, dialFn, mockGroupValidator)
+	httpProxy := proxy.(*HTTPProxy)
+
+	tests := []struct {
+		name     string
+		username string
+		header   string
+		want     string
+	}{
+		{"header", "testgroup", "host-1", "host-1"},
+		{"username", "testgroup.host-1", "", "host-1"},
+		{"header overrides username", "testgroup.host-1", "host-2", "host-2"},
+		{"none", "testgroup", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com", nil)
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.username+":testpass")))
+			if tt.header != "" {
+				req.Header.Set(ClientPinHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			httpProxy.handleHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			userCtx := <-pins
+			if userCtx.GroupID != "testgroup" || userCtx.ClientID != tt.want {
+				t.Errorf("Expected testgroup pinned to %q, got %+v", tt.want, userCtx)
+			}
+			if req.Header.Get(ClientPinHeader) != "" {
+				t.Error("Expected the pin header to be removed before forwarding")
+			}
+		})
+	}
+
+	// Without authentication there's no user to pin, the header still isn't forwarded
+	open, _ := NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0"}, mockDialFunc, nil)
+	req := httptest.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set(ClientPinHeader, "host-1")
+	w := httptest.NewRecorder()
+	open.(*HTTPProxy).handleHTTP(w, req)
+	if req.Header.Get(ClientPinHeader) != "" {
+		t.Error("Expected the pin header to be removed without authentication")
+	}
+}
+
+func TestHTTPProxy_CorrelationHeaders(t *testing.T) {
+	type forwarded struct {
+		connID string
+		header http.Header
+	}
+	requests := make(chan forwarded, 1)
+	dialFn := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		connID, _ := commonctx.GetConnID(ctx)
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			req, err := http.ReadRequest(bufio.NewReader(server))
+			if err != nil {
+				return
+			}
+			requests <- forwarded{connID, req.Header}
+			_, _ = io.WriteString(server, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+		}()
+		return client, nil
+	}
+
+	for _, correlation := range []config.HTTPCorrelation{{}, {ConnID: true, ForwardedFor: true}} {
+		proxy, _ := NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0", Correlation: correlation}, dialFn, nil)
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.7:40000"
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		req.Header.Set(ConnIDHeader, "spoofed")
+		w := httptest.NewRecorder()
+		proxy.(*HTTPProxy).handleRequest(w, req, "192.0.2.7")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+
+		got := <-requests
+		if got.connID == "" {
+			t.Fatal("Dial context should carry the conn_id")
+		}
+		wantConnID, wantForwarded := "spoofed", "198.51.100.1"
+		if correlation.ConnID {
+			wantConnID, wantForwarded = got.connID, "198.51.100.1, 192.0.2.7"
+		}
+		if got.header.Get(ConnIDHeader) != wantConnID || got.header.Get("X-Forwarded-For") != wantForwarded {
+			t.Errorf("Correlation %+v forwarded conn ID %q and X-Forwarded-For %q, want %q and %q", correlation,
+				got.header.Get(ConnIDHeader), got.header.Get("X-Forwarded-For"), wantConnID, wantForwarded)
+		}
+	}
+}
+
 func TestHTTPProxy_HandleHTTP_WithAuth(t *testing.T) {
 	config := &config.HTTPConfig{
 		ListenAddr: "127.0.0.1:0",
@@ -378,6 +529,40 @@ func TestHTTPProxy_HandleConnect_FailedDial(t *testing.T) {
 	if !strings.Contains(response, "HTTP/1.1 502 Bad Gateway") {
 		t.Errorf("Expected 502 Bad Gateway response, got: %s", response)
 	}
+	if !strings.HasSuffix(response, `{"code":"dial_failed","message":"Bad Gateway: the client could not reach the target"}`) {
+		t.Errorf("Expected JSON error body, got: %s", response)
+	}
+}
+
+func TestDialErrorResponse(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   utils.ErrorCode
+	}{
+		{utils.WithErrorCode(utils.ErrCodeNoClientAvailable, errors.New("no clients available in group: g")), http.StatusServiceUnavailable, utils.ErrCodeNoClientAvailable},
+		{fmt.Errorf("%w: ads", utils.ErrBlocklisted), http.StatusForbidden, utils.ErrCodeTargetForbidden},
+		{fmt.Errorf("%w: contractors", utils.ErrOutsideSchedule), http.StatusForbidden, utils.ErrCodeTargetForbidden},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, utils.ErrCodeDialTimeout},
+		{fmt.Errorf("%w: group g allows 1 connections", utils.ErrGroupConnectionLimit), http.StatusTooManyRequests, utils.ErrCodeQuotaExceeded},
+		{utils.WithErrorCode(utils.ErrCodeClientOverloaded, errors.New("client connection limit of 1 reached")), http.StatusServiceUnavailable, utils.ErrCodeClientOverloaded},
+		{fmt.Errorf("%w: heap", utils.ErrResourceLimit), http.StatusServiceUnavailable, utils.ErrCodeGatewayOverloaded},
+		{errors.New("connection refused"), http.StatusBadGateway, utils.ErrCodeDialFailed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeDialError(w, tt.err)
+		var body dialErrorBody
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Invalid JSON body %q: %v", w.Body.String(), err)
+		}
+		if w.Code != tt.status || body.Code != tt.code || body.Message == "" {
+			t.Errorf("%v: got %d %+v, want %d %s", tt.err, w.Code, body, tt.status, tt.code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected JSON content type, got %q", ct)
+		}
+	}
 }
 
 func TestHTTPProxy_Transfer(t *testing.T) {
@@ -586,3 +771,92 @@ func (m *mockHijackConn) SetReadDeadline(t time.Time) error {
 func (m *mockHijackConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+func TestHTTPProxy_HeaderLimits(t *testing.T) {
+	proxy, _ := NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0"}, mockDialFunc, nil)
+	server := proxy.(*HTTPProxy).server
+	if server.MaxHeaderBytes != defaultMaxHeaderBytes || server.ReadHeaderTimeout != defaultReadHeaderTimeout {
+		t.Errorf("Expected the default header limits, got %d bytes and %v", server.MaxHeaderBytes, server.ReadHeaderTimeout)
+	}
+
+	proxy, _ = NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0", MaxHeaderBytes: 8192, ReadHeaderTimeout: 3 * time.Second}, mockDialFunc, nil)
+	server = proxy.(*HTTPProxy).server
+	if server.MaxHeaderBytes != 8192 || server.ReadHeaderTimeout != 3*time.Second {
+		t.Errorf("Expected the configured header limits, got %d bytes and %v", server.MaxHeaderBytes, server.ReadHeaderTimeout)
+	}
+}
+
+func TestHTTPProxy_MaxBodyBytes(t *testing.T) {
+	var dials int
+	dialFn := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		client, server := net.Pipe()
+		go func() {
+			_, _ = io.Copy(io.Discard, server)
+			_ = server.Close()
+		}()
+		return client, nil
+	}
+	proxy, _ := NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0", MaxBodyBytes: 10}, dialFn, nil)
+	httpProxy := proxy.(*HTTPProxy)
+
+	// A declared length above the limit is refused without dialing
+	req := httptest.NewRequest("POST", "http://example.com/upload", strings.NewReader(strings.Repeat("x", 100)))
+	w := httptest.NewRecorder()
+	httpProxy.handleRequest(w, req, "127.0.0.1")
+	if w.Code != http.StatusRequestEntityTooLarge || dials != 0 {
+		t.Errorf("Expected 413 without a dial, got %d after %d dials", w.Code, dials)
+	}
+
+	// A chunked body is cut off at the limit
+	req = httptest.NewRequest("POST", "http://example.com/upload", io.NopCloser(strings.NewReader(strings.Repeat("x", 100))))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	httpProxy.handleRequest(w, req, "127.0.0.1")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a chunked body above the limit, got %d", w.Code)
+	}
+}
+
+func TestHTTPProxy_MaxPendingConnects(t *testing.T) {
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	dialFn := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialing <- struct{}{}
+		<-release
+		return nil, errors.New("dial failed")
+	}
+	proxy, _ := NewHTTPProxyWithAuth(&config.HTTPConfig{ListenAddr: "127.0.0.1:0", MaxPendingConnects: 1}, dialFn, nil)
+	httpProxy := proxy.(*HTTPProxy)
+
+	connect := func() *mockHijackConn {
+		conn := &mockHijackConn{readData: []byte{}, writeData: &strings.Builder{}}
+		req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+		req.Host = "example.com:443"
+		httpProxy.handleConnect(&mockHijacker{ResponseWriter: httptest.NewRecorder(), conn: conn}, req, "127.0.0.1")
+		return conn
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		connect()
+	}()
+	<-dialing
+
+	// The only slot is held by the CONNECT waiting for its dial
+	req := httptest.NewRequest("CONNECT", "example.com:443", nil)
+	req.Host = "example.com:443"
+	w := httptest.NewRecorder()
+	httpProxy.handleConnect(w, req, "127.0.0.1")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 above max_pending_connects, got %d", w.Code)
+	}
+
+	close(release)
+	<-done
+	go func() { <-dialing }()
+	if response := connect().writeData.String(); !strings.Contains(response, "502 Bad Gateway") {
+		t.Errorf("Expected the slot to be released after the dial, got %q", response)
+	}
+}
@@ -0,0 +1,181 @@
+package protocols
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/connection"
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// defaultListenerQueueTimeout is how long a queued connection waits for a slot by default
+const defaultListenerQueueTimeout = 5 * time.Second
+
+// listenerLimiter enforces the concurrency and accept-rate limits of a proxy listener
+type listenerLimiter struct {
+	name   string // Listener name in logs and metrics
+	limits config.ListenerLimits
+	slots  chan struct{} // Held by each admitted connection, nil without max_connections
+
+	mu     sync.Mutex // Protects the accept token bucket
+	tokens float64
+	burst  float64
+	last   time.Time
+}
+
+// newListenerLimiter returns nil when the listener has no limits
+func newListenerLimiter(name string, limits config.ListenerLimits) *listenerLimiter {
+	if limits.MaxConnections <= 0 && limits.AcceptRate <= 0 {
+		return nil
+	}
+	l := &listenerLimiter{name: name, limits: limits}
+	if limits.MaxConnections > 0 {
+		l.slots = make(chan struct{}, limits.MaxConnections)
+	}
+	if limits.AcceptRate > 0 {
+		l.burst = float64(limits.AcceptBurst)
+		if l.burst <= 0 {
+			l.burst = math.Max(limits.AcceptRate, 1)
+		}
+		l.tokens = l.burst
+		l.last = time.Now()
+	}
+	logger.Info("Proxy listener limits enabled", "listener", name, "max_connections", limits.MaxConnections, "accept_rate", limits.AcceptRate, "accept_burst", l.burst, "overflow", limits.Overflow)
+	return l
+}
+
+// admit admits a new connection and returns the func releasing its slot. Queueing listeners
+// wait up to queue_timeout or until done is closed, ok is false when the connection must be closed.
+func (l *listenerLimiter) admit(done <-chan struct{}) (release func(), ok bool) {
+	var deadline <-chan time.Time
+	if l.limits.Overflow == config.ListenerOverflowQueue {
+		timeout := l.limits.QueueTimeout
+		if timeout <= 0 {
+			timeout = defaultListenerQueueTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// Take the accept token first, so a connection waiting for the rate doesn't hold a slot
+	for wait := l.takeToken(); wait > 0; wait = l.takeToken() {
+		if deadline == nil {
+			return nil, false
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-deadline:
+			timer.Stop()
+			return nil, false
+		case <-done:
+			timer.Stop()
+			return nil, false
+		}
+	}
+
+	if l.slots == nil {
+		return func() {}, true
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if deadline == nil {
+			return nil, false
+		}
+		select {
+		case l.slots <- struct{}{}:
+		case <-deadline:
+			return nil, false
+		case <-done:
+			return nil, false
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-l.slots }) }, true
+}
+
+// takeToken takes an accept token, or returns how long until the next one is available
+func (l *listenerLimiter) takeToken() time.Duration {
+	if l.limits.AcceptRate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.limits.AcceptRate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.limits.AcceptRate * float64(time.Second))
+	return max(wait, time.Millisecond)
+}
+
+// rejected records a connection turned away by the limits
+func (l *listenerLimiter) rejected(remoteAddr string) {
+	monitoring.IncrementListenerRejections(l.name)
+	logger.Debug("Connection rejected by listener limits", "listener", l.name, "remote_addr", remoteAddr)
+}
+
+// limitedListener applies listener limits to the accepted connections
+type limitedListener struct {
+	net.Listener
+	limiter *listenerLimiter
+	done    chan struct{}
+	once    sync.Once
+}
+
+// limitListener wraps ln with the limiter, a nil limiter returns ln unchanged
+func limitListener(ln net.Listener, limiter *listenerLimiter) net.Listener {
+	if limiter == nil {
+		return ln
+	}
+	return &limitedListener{Listener: ln, limiter: limiter, done: make(chan struct{})}
+}
+
+// Accept returns the next admitted connection and closes the ones over the limits
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, ok := l.limiter.admit(l.done)
+		if !ok {
+			l.limiter.rejected(conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+		return &listenerConn{Conn: conn, release: release}, nil
+	}
+}
+
+// Close closes the listener and fails connections waiting in the queue
+func (l *limitedListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// listenerConn frees its listener slot when closed
+type listenerConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *listenerConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// CloseWrite keeps half-close working through the limited listener
+func (c *listenerConn) CloseWrite() error {
+	return connection.CloseWrite(c.Conn)
+}
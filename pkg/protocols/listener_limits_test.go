@@ -0,0 +1,163 @@
+package protocols
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// startLimitedListener accepts connections of a limited listener into a channel
+func startLimitedListener(t *testing.T, limits config.ListenerLimits) (net.Listener, <-chan net.Conn) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := limitListener(inner, newListenerLimiter("test", limits))
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return ln, accepted
+}
+
+// expectClosed checks that the listener closed a rejected connection
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestLimitedListener_Reject(t *testing.T) {
+	ln, accepted := startLimitedListener(t, config.ListenerLimits{MaxConnections: 1})
+	defer ln.Close()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	served := <-accepted
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	expectClosed(t, second)
+
+	// Closing the served connection frees its slot
+	_ = served.Close()
+	third, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	select {
+	case conn := <-accepted:
+		_ = conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a connection to be accepted after a slot was freed")
+	}
+}
+
+func TestLimitedListener_Queue(t *testing.T) {
+	ln, accepted := startLimitedListener(t, config.ListenerLimits{
+		MaxConnections: 1,
+		Overflow:       config.ListenerOverflowQueue,
+		QueueTimeout:   2 * time.Second,
+	})
+	defer ln.Close()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	served := <-accepted
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	time.AfterFunc(100*time.Millisecond, func() { _ = served.Close() })
+	select {
+	case conn := <-accepted:
+		_ = conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the queued connection to be accepted")
+	}
+}
+
+func TestListenerLimiter_AcceptRate(t *testing.T) {
+	limiter := newListenerLimiter("test", config.ListenerLimits{AcceptRate: 20, AcceptBurst: 1})
+	if _, ok := limiter.admit(nil); !ok {
+		t.Fatal("Expected the first connection within the burst")
+	}
+	if _, ok := limiter.admit(nil); ok {
+		t.Error("Expected a connection over the rate to be rejected")
+	}
+
+	// Queued connections wait for the next token
+	limiter = newListenerLimiter("test", config.ListenerLimits{AcceptRate: 20, AcceptBurst: 1, Overflow: config.ListenerOverflowQueue, QueueTimeout: time.Second})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, ok := limiter.admit(nil); !ok {
+			t.Fatalf("Expected queued connection %d to be admitted", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Expected the rate to delay connections, took %v", elapsed)
+	}
+
+	if newListenerLimiter("test", config.ListenerLimits{}) != nil {
+		t.Error("Expected no limiter without limits")
+	}
+}
+
+func TestTUICProxy_ListenerLimits(t *testing.T) {
+	cfg := &config.TUICConfig{
+		ListenAddr: "127.0.0.1:0",
+		Limits:     config.ListenerLimits{MaxConnections: 1, Overflow: config.ListenerOverflowQueue},
+	}
+	proxy, err := NewTUICProxyWithAuth(cfg, nil, func(string, string) bool { return true }, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuicProxy := proxy.(*TUICProxy)
+
+	cmd := &TUICCommand{Version: TUICVersion, Type: TUICCmdAuthenticate, Data: make([]byte, TUICUUIDLength+TUICTokenLength)}
+	first, _ := net.ResolveUDPAddr("udp", "127.0.0.1:10001")
+	second, _ := net.ResolveUDPAddr("udp", "127.0.0.1:10002")
+
+	tuicProxy.handleAuthenticate(first, first.String(), cmd)
+	tuicProxy.handleAuthenticate(first, first.String(), cmd) // Re-authenticating keeps the slot
+	tuicProxy.handleAuthenticate(second, second.String(), cmd)
+	if tuicProxy.getAuthenticatedClient(first.String()) == nil {
+		t.Error("Expected the first peer to be authenticated")
+	}
+	if tuicProxy.getAuthenticatedClient(second.String()) != nil {
+		t.Error("Expected the second peer to be rejected at max_connections")
+	}
+
+	// An expired peer frees its slot
+	tuicProxy.getAuthenticatedClient(first.String()).LastSeen = time.Now().Add(-time.Hour)
+	tuicProxy.cleanupExpiredSessions()
+	tuicProxy.handleAuthenticate(second, second.String(), cmd)
+	if tuicProxy.getAuthenticatedClient(second.String()) == nil {
+		t.Error("Expected the second peer to be authenticated after the first expired")
+	}
+}
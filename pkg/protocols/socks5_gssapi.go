@@ -0,0 +1,242 @@
+package protocols
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/buhuipao/anyproxy/pkg/common/krb5"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// GSS-API method messages (RFC 1961 section 3)
+const (
+	gssapiVersion        = 0x01
+	gssapiMsgContext     = 0x01 // Context establishment tokens
+	gssapiMsgProtection  = 0x02 // Protection level negotiation
+	gssapiMsgEncapsulate = 0x03 // Encapsulated request and data
+	gssapiMsgAbort       = 0xff
+)
+
+// Protection levels (RFC 1961 section 4)
+const (
+	gssapiProtectIntegrity       = 0x01
+	gssapiProtectConfidentiality = 0x02
+	gssapiProtectSelective       = 0x03
+)
+
+// gssapiMaxChunk is the most data wrapped in one message, the tokens must fit the 16 bit length
+const gssapiMaxChunk = 32 * 1024
+
+// gssapiPayloadPrincipal is the AuthContext payload key of the authenticated Kerberos principal
+const gssapiPayloadPrincipal = "principal"
+
+// gssContext protects the messages of an established security context
+type gssContext interface {
+	Wrap(msg []byte, seal bool) ([]byte, error)
+	Unwrap(token []byte) ([]byte, bool, error)
+}
+
+// gssAcceptFunc validates an initiator's context token, returning the context, the principal
+// it authenticated and the token to send back, if any
+type gssAcceptFunc func(token []byte) (gssContext, string, []byte, error)
+
+// newGSSAPIAcceptor loads the keytab of a listener and accepts contexts for its service principal
+func newGSSAPIAcceptor(cfg config.SOCKS5GSSAPIConfig) (gssAcceptFunc, error) {
+	keytab, err := krb5.LoadKeytab(cfg.Keytab)
+	if err != nil {
+		return nil, err
+	}
+	acceptor, err := krb5.NewAcceptor(keytab, cfg.ServicePrincipal)
+	if err != nil {
+		return nil, err
+	}
+	return func(token []byte) (gssContext, string, []byte, error) {
+		ctx, out, err := acceptor.Accept(token)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return ctx, ctx.Principal, out, nil
+	}, nil
+}
+
+// gssapiAuthenticator authenticates users with Kerberos tickets as in RFC 1961. The requests
+// and data that follow are encapsulated in GSS-API messages, which needs the connection to be
+// a gssapiConn from a gssapiListener.
+type gssapiAuthenticator struct {
+	accept gssAcceptFunc
+}
+
+// GetCode implements socks5.Authenticator
+func (a *gssapiAuthenticator) GetCode() uint8 { return statute.MethodGSSAPI }
+
+// Authenticate implements socks5.Authenticator
+func (a *gssapiAuthenticator) Authenticate(reader io.Reader, writer io.Writer, userAddr string) (*socks5.AuthContext, error) {
+	conn, ok := writer.(*gssapiConn)
+	if !ok {
+		_, _ = writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable})
+		return nil, errors.New("GSSAPI authentication needs an encapsulating connection")
+	}
+	if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodGSSAPI}); err != nil {
+		return nil, err
+	}
+
+	token, err := readGSSAPIMessage(reader, gssapiMsgContext)
+	if err != nil {
+		return nil, err
+	}
+	ctx, principal, out, err := a.accept(token)
+	if err != nil {
+		logger.Warn("SOCKS5 GSSAPI authentication failed", "client", userAddr, "err", err)
+		_, _ = writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+		return nil, fmt.Errorf("GSSAPI authentication failed: %w", err)
+	}
+	if len(out) > 0 {
+		if err := writeGSSAPIMessage(writer, gssapiMsgContext, out); err != nil {
+			return nil, err
+		}
+	}
+
+	// The client proposes a protection level, per-message protection is served as confidentiality
+	token, err = readGSSAPIMessage(reader, gssapiMsgProtection)
+	if err != nil {
+		return nil, err
+	}
+	level, _, err := ctx.Unwrap(token)
+	if err != nil || len(level) != 1 || level[0] < gssapiProtectIntegrity || level[0] > gssapiProtectSelective {
+		_, _ = writer.Write([]byte{gssapiVersion, gssapiMsgAbort})
+		return nil, fmt.Errorf("invalid GSSAPI protection level from %s", principal)
+	}
+	seal := level[0] != gssapiProtectIntegrity
+	chosen := byte(gssapiProtectIntegrity)
+	if seal {
+		chosen = gssapiProtectConfidentiality
+	}
+	if token, err = ctx.Wrap([]byte{chosen}, false); err != nil {
+		return nil, err
+	}
+	if err := writeGSSAPIMessage(writer, gssapiMsgProtection, token); err != nil {
+		return nil, err
+	}
+
+	conn.encapsulate(ctx, seal)
+	logger.Debug("SOCKS5 GSSAPI authentication successful", "principal", principal, "protection", chosen, "client", userAddr)
+	return &socks5.AuthContext{Method: statute.MethodGSSAPI, Payload: map[string]string{gssapiPayloadPrincipal: principal}}, nil
+}
+
+// readGSSAPIMessage reads a GSS-API method message of a type and returns its token
+func readGSSAPIMessage(r io.Reader, msgType byte) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != gssapiVersion {
+		return nil, fmt.Errorf("unsupported GSSAPI message version %d", header[0])
+	}
+	if header[1] == gssapiMsgAbort {
+		return nil, errors.New("GSSAPI authentication aborted by the client")
+	}
+	if header[1] != msgType {
+		return nil, fmt.Errorf("unexpected GSSAPI message type %d, expected %d", header[1], msgType)
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// writeGSSAPIMessage writes a GSS-API method message
+func writeGSSAPIMessage(w io.Writer, msgType byte, token []byte) error {
+	if len(token) > 0xffff {
+		return fmt.Errorf("GSSAPI token of %d bytes is too long", len(token))
+	}
+	msg := make([]byte, 4, 4+len(token))
+	msg[0], msg[1] = gssapiVersion, msgType
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	_, err := w.Write(append(msg, token...))
+	return err
+}
+
+// gssapiListener accepts connections that can be switched to GSS-API encapsulation
+type gssapiListener struct {
+	net.Listener
+}
+
+// Accept implements net.Listener
+func (l *gssapiListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &gssapiConn{Conn: conn}, nil
+}
+
+// gssapiConn passes data through until a GSS-API context is established, then wraps what is
+// written and unwraps what is read in encapsulation messages. The SOCKS5 server reads from one
+// goroutine and writes from another.
+type gssapiConn struct {
+	net.Conn
+
+	ctx     gssContext
+	seal    bool
+	pending []byte // unwrapped data not read yet
+}
+
+// encapsulate switches the connection to encapsulation, called before the request is read
+func (c *gssapiConn) encapsulate(ctx gssContext, seal bool) {
+	c.ctx, c.seal = ctx, seal
+}
+
+// Read implements net.Conn
+func (c *gssapiConn) Read(p []byte) (int, error) {
+	if c.ctx == nil {
+		return c.Conn.Read(p)
+	}
+	for len(c.pending) == 0 {
+		token, err := readGSSAPIMessage(c.Conn, gssapiMsgEncapsulate)
+		if err != nil {
+			return 0, err
+		}
+		msg, sealed, err := c.ctx.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+		if c.seal && !sealed {
+			return 0, errors.New("GSSAPI message without the negotiated confidentiality")
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write implements net.Conn
+func (c *gssapiConn) Write(p []byte) (int, error) {
+	if c.ctx == nil {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+gssapiMaxChunk)]
+		token, err := c.ctx.Wrap(chunk, c.seal)
+		if err != nil {
+			return written, err
+		}
+		if err := writeGSSAPIMessage(c.Conn, gssapiMsgEncapsulate, token); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
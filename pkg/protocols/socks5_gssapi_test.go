@@ -0,0 +1,201 @@
+package protocols
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/things-go/go-socks5"
+)
+
+// fakeGSSContext marks wrapped messages with whether they are sealed
+type fakeGSSContext struct{}
+
+func (fakeGSSContext) Wrap(msg []byte, seal bool) ([]byte, error) {
+	flag := byte(0)
+	if seal {
+		flag = 1
+	}
+	return append([]byte{flag}, msg...), nil
+}
+
+func (fakeGSSContext) Unwrap(token []byte) ([]byte, bool, error) {
+	if len(token) == 0 {
+		return nil, false, errors.New("empty token")
+	}
+	return token[1:], token[0] == 1, nil
+}
+
+func fakeGSSAccept(token []byte) (gssContext, string, []byte, error) {
+	if string(token) != "ticket" {
+		return nil, "", nil, errors.New("bad ticket")
+	}
+	return fakeGSSContext{}, "alice@EXAMPLE.COM", []byte("ap-rep"), nil
+}
+
+// startGSSAPIServer serves SOCKS5 with the GSSAPI method, dialing an echo server for every
+// request and reporting the principal of the requests
+func startGSSAPIServer(t *testing.T) (string, chan string) {
+	t.Helper()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn); _ = conn.Close() }()
+		}
+	}()
+
+	principals := make(chan string, 1)
+	server := socks5.NewServer(
+		socks5.WithAuthMethods([]socks5.Authenticator{&gssapiAuthenticator{accept: fakeGSSAccept}}),
+		socks5.WithDialAndRequest(func(ctx context.Context, network, _ string, request *socks5.Request) (net.Conn, error) {
+			principals <- request.AuthContext.Payload[gssapiPayloadPrincipal]
+			return (&net.Dialer{}).DialContext(ctx, network, echo.Addr().String())
+		}),
+	)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() { _ = server.Serve(&gssapiListener{Listener: ln}) }()
+	return ln.Addr().String(), principals
+}
+
+// gssapiHandshake negotiates the method and a context, and returns the protection level the
+// server chose
+func gssapiHandshake(t *testing.T, conn net.Conn, level byte) byte {
+	t.Helper()
+	reply := make([]byte, 2)
+	_, _ = conn.Write([]byte{0x05, 0x02, 0x02, 0x01})
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x01 {
+		t.Fatalf("Expected the GSSAPI method, got %v (err: %v)", reply, err)
+	}
+	if err := writeGSSAPIMessage(conn, gssapiMsgContext, []byte("ticket")); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := readGSSAPIMessage(conn, gssapiMsgContext); err != nil || string(token) != "ap-rep" {
+		t.Fatalf("Expected the AP-REP token, got %q (err: %v)", token, err)
+	}
+	wrapped, _ := fakeGSSContext{}.Wrap([]byte{level}, false)
+	if err := writeGSSAPIMessage(conn, gssapiMsgProtection, wrapped); err != nil {
+		t.Fatal(err)
+	}
+	token, err := readGSSAPIMessage(conn, gssapiMsgProtection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chosen, sealed, _ := fakeGSSContext{}.Unwrap(token)
+	if sealed || len(chosen) != 1 {
+		t.Fatalf("Expected an integrity protected protection level, got %v", token)
+	}
+	return chosen[0]
+}
+
+func TestSOCKS5GSSAPI(t *testing.T) {
+	tests := []struct {
+		name  string
+		level byte
+		want  byte
+	}{
+		{"integrity", gssapiProtectIntegrity, gssapiProtectIntegrity},
+		{"confidentiality", gssapiProtectConfidentiality, gssapiProtectConfidentiality},
+		{"selective", gssapiProtectSelective, gssapiProtectConfidentiality},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, principals := startGSSAPIServer(t)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+
+			if got := gssapiHandshake(t, conn, tt.level); got != tt.want {
+				t.Fatalf("Expected protection level %d, got %d", tt.want, got)
+			}
+			seal := tt.want == gssapiProtectConfidentiality
+			client := &gssapiConn{Conn: conn}
+			client.encapsulate(fakeGSSContext{}, seal)
+
+			// The request, reply and data are encapsulated
+			if _, err := client.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50}); err != nil {
+				t.Fatal(err)
+			}
+			if principal := <-principals; principal != "alice@EXAMPLE.COM" {
+				t.Errorf("Expected the principal in the auth context, got %q", principal)
+			}
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0x00 {
+				t.Fatalf("Expected a successful reply, got %v (err: %v)", reply, err)
+			}
+			data := bytes.Repeat([]byte("ping"), gssapiMaxChunk/2) // spans several messages
+			go func() { _, _ = client.Write(data) }()
+			echoed := make([]byte, len(data))
+			if _, err := io.ReadFull(client, echoed); err != nil || !bytes.Equal(echoed, data) {
+				t.Errorf("Expected the data echoed, got %d bytes (err: %v)", len(echoed), err)
+			}
+		})
+	}
+
+	t.Run("unsealed data after confidentiality", func(t *testing.T) {
+		addr, _ := startGSSAPIServer(t)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		gssapiHandshake(t, conn, gssapiProtectConfidentiality)
+		client := &gssapiConn{Conn: conn}
+		client.encapsulate(fakeGSSContext{}, false)
+		_, _ = client.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50})
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err == nil {
+			t.Error("Expected the server to close the connection")
+		}
+	})
+
+	t.Run("rejected ticket", func(t *testing.T) {
+		addr, _ := startGSSAPIServer(t)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		reply := make([]byte, 2)
+		_, _ = conn.Write([]byte{0x05, 0x01, 0x01})
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x01 {
+			t.Fatalf("Expected the GSSAPI method, got %v (err: %v)", reply, err)
+		}
+		_ = writeGSSAPIMessage(conn, gssapiMsgContext, []byte("forged"))
+		if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, []byte{gssapiVersion, gssapiMsgAbort}) {
+			t.Errorf("Expected an abort message, got %v (err: %v)", reply, err)
+		}
+	})
+}
+
+func TestNewSOCKS5ProxyWithAuth_GSSAPIKeytab(t *testing.T) {
+	cfg := &config.SOCKS5Config{
+		ListenAddr:  ":1080",
+		AuthMethods: []string{config.SOCKS5AuthGSSAPI},
+		GSSAPI: config.SOCKS5GSSAPIConfig{
+			Keytab:           filepath.Join(t.TempDir(), "missing.keytab"),
+			ServicePrincipal: "rcmd/proxy.example.com@EXAMPLE.COM",
+			GroupID:          "corp",
+		},
+	}
+	if _, err := NewSOCKS5ProxyWithAuth(cfg, mockDialFunc, mockGroupValidator); err == nil {
+		t.Error("Expected an error for a missing keytab")
+	}
+}
@@ -3,16 +3,21 @@ package protocols
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"strings"
+	"net/netip"
+	"syscall"
 
 	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
 	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
 )
 
 // SOCKS5Proxy SOCKS5 proxy implementation
@@ -21,6 +26,10 @@ type SOCKS5Proxy struct {
 	server         *socks5.Server
 	dialFunc       func(ctx context.Context, network, addr string) (net.Conn, error)
 	groupValidator func(string, string) bool // Function to validate group credentials
+	sourceRouter   utils.SourceRouter        // Groups for users without credentials, by source IP
+	noAuthPrefixes []netip.Prefix            // Source ranges admitted without credentials to config.NoAuth.GroupID
+	gssapi         bool                      // GSSAPI is offered, connections are accepted through a gssapiListener
+	dialRequest    func(ctx context.Context, network, addr string, request *socks5.Request) (net.Conn, error)
 	listener       net.Listener
 }
 
@@ -34,19 +43,47 @@ func NewSOCKS5ProxyWithAuth(cfg *config.SOCKS5Config, dialFn func(context.Contex
 		groupValidator: groupValidator,
 	}
 
+	for _, cidr := range cfg.NoAuth.CIDRs {
+		prefix, err := config.ParseSourcePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOCKS5 no_auth range: %w", err)
+		}
+		proxy.noAuthPrefixes = append(proxy.noAuthPrefixes, prefix)
+	}
+
 	// Configure authentication methods
 	socks5Auths := []socks5.Authenticator{}
 
 	if groupValidator != nil {
-		logger.Debug("Configuring SOCKS5 group-based authentication")
-
-		// Use built-in UserPassAuthenticator with custom credential store
-		credStore := &GroupBasedCredentialStore{
-			GroupValidator: groupValidator,
+		methods := cfg.AuthMethods
+		if len(methods) == 0 {
+			methods = []string{config.SOCKS5AuthPassword, config.SOCKS5AuthNone}
+		}
+		logger.Debug("Configuring SOCKS5 group-based authentication", "methods", methods)
+
+		for _, method := range methods {
+			switch method {
+			case config.SOCKS5AuthPassword:
+				// Use built-in UserPassAuthenticator with custom credential store
+				credStore := &GroupBasedCredentialStore{
+					GroupValidator: groupValidator,
+				}
+				socks5Auths = append(socks5Auths, socks5.UserPassAuthenticator{
+					Credentials: credStore,
+				})
+			case config.SOCKS5AuthNone:
+				socks5Auths = append(socks5Auths, &sourceRouteAuthenticator{proxy: proxy})
+			case config.SOCKS5AuthGSSAPI:
+				accept, err := newGSSAPIAcceptor(cfg.GSSAPI)
+				if err != nil {
+					return nil, fmt.Errorf("invalid SOCKS5 gssapi settings: %w", err)
+				}
+				socks5Auths = append(socks5Auths, &gssapiAuthenticator{accept: accept})
+				proxy.gssapi = true
+			default:
+				return nil, fmt.Errorf("unsupported SOCKS5 authentication method: %s", method)
+			}
 		}
-		socks5Auths = append(socks5Auths, socks5.UserPassAuthenticator{
-			Credentials: credStore,
-		})
 		logger.Debug("SOCKS5 group-based authentication configured")
 	} else {
 		logger.Debug("No authentication configured for SOCKS5 proxy")
@@ -71,16 +108,40 @@ func NewSOCKS5ProxyWithAuth(cfg *config.SOCKS5Config, dialFn func(context.Contex
 		// Extract user information from request's AuthContext
 		if request.AuthContext != nil && request.AuthContext.Payload != nil {
 			if username, exists := request.AuthContext.Payload["username"]; exists {
-				userCtx = &utils.UserContext{
-					Username: username,
-					GroupID:  username,
+				// The username was authenticated, this resolves the group it routes to
+				resolved, ok := authenticateProxyUser(username, request.AuthContext.Payload["password"], proxy.groupValidator)
+				if !ok {
+					logger.Error("SOCKS5 username no longer authenticates", "conn_id", connID, "username", username, "target_addr", addr)
+					return nil, fmt.Errorf("authentication failed")
 				}
-				logger.Info("SOCKS5 user context extracted from authentication", "conn_id", connID, "username", username, "group_id", username, "target_addr", addr)
+				userCtx = resolved
+				if request.RemoteAddr != nil {
+					userCtx.SourceIP = remoteIP(request.RemoteAddr.String())
+				}
+				logger.Info("SOCKS5 user context extracted from authentication", "conn_id", connID, "username", username, "group_id", userCtx.GroupID, "pinned_client", userCtx.ClientID, "no_fallback", userCtx.NoFallback, "target_addr", addr)
+			} else if principal, exists := request.AuthContext.Payload[gssapiPayloadPrincipal]; exists {
+				// Kerberos users are served by the listener's group
+				userCtx = &utils.UserContext{Username: principal, GroupID: cfg.GSSAPI.GroupID}
+				if request.RemoteAddr != nil {
+					userCtx.SourceIP = remoteIP(request.RemoteAddr.String())
+				}
+				logger.Info("SOCKS5 user context extracted from Kerberos authentication", "conn_id", connID, "principal", principal, "group_id", userCtx.GroupID, "target_addr", addr)
 			} else {
 				logger.Debug("No username found in SOCKS5 authentication context", "conn_id", connID)
 			}
 		}
 
+		// Users without credentials may be admitted by source IP
+		if userCtx == nil && request != nil && request.RemoteAddr != nil {
+			if groupID, ok := proxy.noAuthGroup(request.RemoteAddr.String()); ok {
+				userCtx = &utils.UserContext{
+					GroupID:  groupID,
+					SourceIP: remoteIP(request.RemoteAddr.String()),
+				}
+				logger.Info("SOCKS5 request routed by source IP", "conn_id", connID, "group_id", groupID, "target_addr", addr, "client", clientAddr)
+			}
+		}
+
 		// Require authentication - no default group allowed
 		if userCtx == nil {
 			logger.Error("SOCKS5 request requires authentication", "conn_id", connID, "target_addr", addr, "client", clientAddr)
@@ -112,10 +173,12 @@ func NewSOCKS5ProxyWithAuth(cfg *config.SOCKS5Config, dialFn func(context.Contex
 
 	logger.Debug("Configuring SOCKS5 server", "listen_addr", cfg.ListenAddr, "auth_methods_count", len(socks5Auths))
 
-	// Create SOCKS5 server
+	// Create SOCKS5 server, CONNECT is served by the proxy to reply with the reason of a failed dial
+	proxy.dialRequest = wrappedDialFunc
 	server := socks5.NewServer(
 		socks5.WithAuthMethods(socks5Auths),
 		socks5.WithDialAndRequest(wrappedDialFunc),
+		socks5.WithConnectHandle(proxy.handleConnect),
 		socks5.WithLogger(socks5.NewLogger(log.Default())),
 	)
 
@@ -124,16 +187,72 @@ func NewSOCKS5ProxyWithAuth(cfg *config.SOCKS5Config, dialFn func(context.Contex
 	return proxy, nil
 }
 
+// handleConnect serves a CONNECT command like the library does, but replies with the code
+// matching why the dial failed
+func (p *SOCKS5Proxy) handleConnect(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	target, err := p.dialRequest(ctx, "tcp", request.DestAddr.String(), request)
+	if err != nil {
+		if err := socks5.SendReply(writer, socks5Reply(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply, %w", err)
+		}
+		return fmt.Errorf("connect to %v failed, %w", request.RawDestAddr, err)
+	}
+	defer func() { _ = target.Close() }()
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, target.LocalAddr()); err != nil {
+		return fmt.Errorf("failed to send reply, %w", err)
+	}
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- p.server.Proxy(target, request.Reader) }()
+	go func() { errCh <- p.server.Proxy(writer, target) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// socks5Reply maps a dial error to a SOCKS5 reply code. SOCKS5 has fewer codes than
+// utils.ErrorCode, so the overload codes share "general failure".
+func socks5Reply(err error) uint8 {
+	switch utils.ErrorCodeOf(err) {
+	case utils.ErrCodeNoClientAvailable:
+		return statute.RepNetworkUnreachable
+	case utils.ErrCodeTargetForbidden:
+		return statute.RepRuleFailure
+	case utils.ErrCodeDialTimeout:
+		return statute.RepTTLExpired
+	case utils.ErrCodeQuotaExceeded:
+		return statute.RepConnectionRefused
+	case utils.ErrCodeClientOverloaded, utils.ErrCodeClientBusy, utils.ErrCodeGatewayOverloaded:
+		return statute.RepServerFailure
+	}
+	// Other target errors, of the gateway's own dials or reported by clients (utils.TargetError)
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return statute.RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return statute.RepNetworkUnreachable
+	}
+	return statute.RepHostUnreachable
+}
+
 // Start starts the SOCKS5 proxy server
 func (p *SOCKS5Proxy) Start() error {
 	logger.Info("Starting SOCKS5 proxy server", "listen_addr", p.config.ListenAddr)
 
 	// Create listener
 	logger.Debug("Creating TCP listener for SOCKS5", "address", p.config.ListenAddr)
-	listener, err := net.Listen("tcp", p.config.ListenAddr)
+	listener, err := sockopt.Listen(context.Background(), "tcp", p.config.ListenAddr, p.config.SocketOptions)
 	if err != nil {
 		logger.Error("Failed to create TCP listener for SOCKS5 proxy", "listen_addr", p.config.ListenAddr, "err", err)
-		return fmt.Errorf("failed to listen on %s: %v", p.config.ListenAddr, err)
+		return fmt.Errorf("failed to listen on %s: %w", p.config.ListenAddr, err)
+	}
+	listener = limitListener(listener, newListenerLimiter("socks5", p.config.Limits))
+	if p.gssapi {
+		listener = &gssapiListener{Listener: listener}
 	}
 	p.listener = listener
 	logger.Debug("TCP listener created successfully for SOCKS5", "listen_addr", p.config.ListenAddr)
@@ -143,7 +262,7 @@ func (p *SOCKS5Proxy) Start() error {
 		logger.Info("SOCKS5 server starting to serve requests", "listen_addr", p.config.ListenAddr)
 		if err := p.server.Serve(listener); err != nil {
 			// Check if the error is due to listener being closed (normal shutdown)
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if errors.Is(err, net.ErrClosed) {
 				logger.Info("SOCKS5 server stopped normally", "listen_addr", p.config.ListenAddr)
 			} else {
 				logger.Error("SOCKS5 server terminated unexpectedly", "listen_addr", p.config.ListenAddr, "err", err)
@@ -184,23 +303,75 @@ func (p *SOCKS5Proxy) GetListenAddr() string {
 	return p.config.ListenAddr
 }
 
+// SetSourceRouter admits users without credentials from routed source IPs
+func (p *SOCKS5Proxy) SetSourceRouter(router utils.SourceRouter) {
+	p.sourceRouter = router
+}
+
+// routeSource returns the group routed for a client address
+func (p *SOCKS5Proxy) routeSource(clientAddr string) (string, bool) {
+	if p.sourceRouter == nil {
+		return "", false
+	}
+	return p.sourceRouter(remoteIP(clientAddr))
+}
+
+// noAuthGroup returns the group of a client without credentials, from the listener's
+// no_auth ranges first and the gateway source routes second
+func (p *SOCKS5Proxy) noAuthGroup(clientAddr string) (string, bool) {
+	if len(p.noAuthPrefixes) > 0 {
+		if addr, err := netip.ParseAddr(remoteIP(clientAddr)); err == nil {
+			addr = addr.Unmap()
+			for _, prefix := range p.noAuthPrefixes {
+				if prefix.Contains(addr) {
+					return p.config.NoAuth.GroupID, true
+				}
+			}
+		}
+	}
+	return p.routeSource(clientAddr)
+}
+
+// sourceRouteAuthenticator accepts "no authentication" only from source IPs in the listener's
+// no_auth ranges or with a routing rule. Clients offering credentials are asked for them when
+// password is listed first.
+type sourceRouteAuthenticator struct {
+	proxy *SOCKS5Proxy
+}
+
+// GetCode implements socks5.Authenticator
+func (a *sourceRouteAuthenticator) GetCode() uint8 { return statute.MethodNoAuth }
+
+// Authenticate implements socks5.Authenticator
+func (a *sourceRouteAuthenticator) Authenticate(_ io.Reader, writer io.Writer, userAddr string) (*socks5.AuthContext, error) {
+	if _, ok := a.proxy.noAuthGroup(userAddr); !ok {
+		logger.Warn("SOCKS5 client without credentials rejected, source IP not allowed", "client", userAddr)
+		_, _ = writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable})
+		return nil, statute.ErrNoSupportedAuth
+	}
+	if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAuth}); err != nil {
+		return nil, err
+	}
+	return &socks5.AuthContext{Method: statute.MethodNoAuth, Payload: make(map[string]string)}, nil
+}
+
 // GroupBasedCredentialStore implements CredentialStore interface with support for group-based usernames
 type GroupBasedCredentialStore struct {
 	GroupValidator func(string, string) bool
 }
 
 // Valid implements the CredentialStore interface
-// Supports usernames in format "username.group_id" by extracting the group for authentication
+// Supports usernames in format "group_id[.client_id][!option...]" by extracting the group for authentication
 func (g *GroupBasedCredentialStore) Valid(user, password, userAddr string) bool {
 	logger.Debug("SOCKS5 authentication attempt", "username", user, "client", userAddr)
 
 	// Verify credentials using group validator
-	isValid := g.GroupValidator != nil && g.GroupValidator(user, password)
+	userCtx, isValid := authenticateProxyUser(user, password, g.GroupValidator)
 
 	if isValid {
-		logger.Debug("SOCKS5 authentication successful", "username", user, "group_id", user, "client", userAddr)
+		logger.Debug("SOCKS5 authentication successful", "username", user, "group_id", userCtx.GroupID, "pinned_client", userCtx.ClientID, "client", userAddr)
 	} else {
-		logger.Warn("SOCKS5 authentication failed", "username", user, "group_id", user, "client", userAddr)
+		logger.Warn("SOCKS5 authentication failed", "username", user, "client", userAddr)
 	}
 
 	return isValid
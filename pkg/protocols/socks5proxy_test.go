@@ -1,13 +1,21 @@
 package protocols
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 
 	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/things-go/go-socks5/statute"
 )
 
 func TestNewSOCKS5ProxyWithAuth(t *testing.T) {
@@ -112,6 +120,18 @@ func TestGroupBasedCredentialStore_Valid(t *testing.T) {
 			password: "wrongpass",
 			expected: false,
 		},
+		{
+			name:     "pinned client and options",
+			username: "testgroup.host-1!nofallback",
+			password: "testpass",
+			expected: true,
+		},
+		{
+			name:     "unknown username option",
+			username: "testgroup!fast",
+			password: "testpass",
+			expected: false,
+		},
 		{
 			name:     "empty credentials",
 			username: "",
@@ -227,3 +247,153 @@ func TestSOCKS5Proxy_ListenerError(t *testing.T) {
 		t.Error("Expected non-empty error message")
 	}
 }
+
+func TestSourceRouteAuthenticator(t *testing.T) {
+	proxy, err := NewSOCKS5ProxyWithAuth(&config.SOCKS5Config{ListenAddr: ":1080"}, mockDialFunc, mockGroupValidator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socks5Proxy := proxy.(*SOCKS5Proxy)
+	auth := &sourceRouteAuthenticator{proxy: socks5Proxy}
+
+	// No router configured: "no authentication" is refused
+	var reply bytes.Buffer
+	if _, err := auth.Authenticate(nil, &reply, "10.1.0.5:40000"); err == nil {
+		t.Error("Expected rejection without source router")
+	}
+	if !bytes.Equal(reply.Bytes(), []byte{0x05, 0xff}) {
+		t.Errorf("Expected no acceptable methods reply, got %v", reply.Bytes())
+	}
+
+	socks5Proxy.SetSourceRouter(func(sourceIP string) (string, bool) {
+		return "office", sourceIP == "10.1.0.5"
+	})
+	reply.Reset()
+	if _, err := auth.Authenticate(nil, &reply, "10.1.0.5:40000"); err != nil {
+		t.Errorf("Expected routed source to be accepted, got %v", err)
+	}
+	if !bytes.Equal(reply.Bytes(), []byte{0x05, 0x00}) {
+		t.Errorf("Expected no authentication reply, got %v", reply.Bytes())
+	}
+	if _, err := auth.Authenticate(nil, &bytes.Buffer{}, "10.2.0.5:40000"); err == nil {
+		t.Error("Expected unrouted source to be rejected")
+	}
+}
+
+func TestSOCKS5Proxy_NoAuthACL(t *testing.T) {
+	groups := make(chan string, 1)
+	dialFn := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		if userCtx, ok := commonctx.GetUserContext(ctx); ok {
+			groups <- userCtx.GroupID
+		}
+		return nil, errors.New("dial not needed")
+	}
+	cfg := &config.SOCKS5Config{
+		ListenAddr:  "127.0.0.1:0",
+		AuthMethods: []string{config.SOCKS5AuthNone},
+		NoAuth:      config.SOCKS5NoAuthConfig{CIDRs: []string{"127.0.0.0/8"}, GroupID: "lab"},
+	}
+	proxy, err := NewSOCKS5ProxyWithAuth(cfg, dialFn, mockGroupValidator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proxy.Stop() }()
+	addr := proxy.(*SOCKS5Proxy).listener.Addr().String()
+
+	// Offering only username/password fails, the listener accepts "none" only
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x02})
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0xff {
+		t.Errorf("Expected no acceptable methods, got %v (err: %v)", reply, err)
+	}
+	_ = conn.Close()
+
+	// A client in the ACL is served by the configured group
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x00 {
+		t.Fatalf("Expected no authentication method, got %v (err: %v)", reply, err)
+	}
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50}) // CONNECT 10.0.0.1:80
+	select {
+	case groupID := <-groups:
+		if groupID != "lab" {
+			t.Errorf("Expected group lab, got %q", groupID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dial function not called")
+	}
+}
+
+func TestSOCKS5Proxy_ReplyCodes(t *testing.T) {
+	// The target port selects the dial error
+	dialErrors := map[string]error{
+		"10.0.0.1:1": utils.WithErrorCode(utils.ErrCodeNoClientAvailable, errors.New("no clients available in group: lab")),
+		"10.0.0.1:2": fmt.Errorf("%w: rule 1", utils.ErrGeoBlocked),
+		"10.0.0.1:3": context.DeadlineExceeded,
+		"10.0.0.1:4": fmt.Errorf("%w: group lab allows 1 connections", utils.ErrGroupConnectionLimit),
+		"10.0.0.1:5": utils.WithErrorCode(utils.ErrCodeClientOverloaded, errors.New("client connection limit of 1 reached")),
+		"10.0.0.1:6": &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+		"10.0.0.1:7": &utils.TargetError{Msg: "dial tcp 10.0.0.7:7: connect: no route to host"},
+		"10.0.0.1:8": fmt.Errorf("client c1 failed to connect to 10.0.0.1:8: %w", &utils.TargetError{Msg: "dial tcp: connect: connection refused"}),
+	}
+	dialFn := func(_ context.Context, _, addr string) (net.Conn, error) {
+		return nil, dialErrors[addr]
+	}
+	cfg := &config.SOCKS5Config{
+		ListenAddr:  "127.0.0.1:0",
+		AuthMethods: []string{config.SOCKS5AuthNone},
+		NoAuth:      config.SOCKS5NoAuthConfig{CIDRs: []string{"127.0.0.0/8"}, GroupID: "lab"},
+	}
+	proxy, err := NewSOCKS5ProxyWithAuth(cfg, dialFn, mockGroupValidator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proxy.Stop() }()
+	addr := proxy.(*SOCKS5Proxy).listener.Addr().String()
+
+	tests := []struct {
+		port byte
+		want uint8
+	}{
+		{1, statute.RepNetworkUnreachable},
+		{2, statute.RepRuleFailure},
+		{3, statute.RepTTLExpired},
+		{4, statute.RepConnectionRefused},
+		{5, statute.RepServerFailure},
+		{6, statute.RepConnectionRefused},
+		{7, statute.RepHostUnreachable},
+		{8, statute.RepConnectionRefused},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn.Write([]byte{0x05, 0x01, 0x00})
+		_, _ = conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, tt.port})
+		reply := make([]byte, 12) // Method selection and a reply with an IPv4 address
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("Port %d: failed to read reply: %v", tt.port, err)
+		}
+		if reply[3] != tt.want {
+			t.Errorf("Port %d: expected reply code %d, got %d", tt.port, tt.want, reply[3])
+		}
+		_ = conn.Close()
+	}
+}
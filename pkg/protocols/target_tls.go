@@ -0,0 +1,123 @@
+package protocols
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/buhuipao/anyproxy/pkg/common/blocklist"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// errTargetPinMismatch is returned by handshakes with targets presenting none of the pinned keys
+var errTargetPinMismatch = errors.New("target certificate matches no pinned public key")
+
+// targetTLSPolicy selects how the certificates of https:// targets are verified
+type targetTLSPolicy struct {
+	rules []targetTLSRule
+}
+
+// targetTLSRule is a compiled config.TargetTLSRule
+type targetTLSRule struct {
+	hosts    *blocklist.List
+	roots    *x509.CertPool    // nil = system roots
+	pins     map[[32]byte]bool // nil = no pinning
+	insecure bool
+}
+
+// newTargetTLSPolicy compiles the target TLS rules, returns nil when none are configured
+func newTargetTLSPolicy(rules []config.TargetTLSRule) (*targetTLSPolicy, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	p := &targetTLSPolicy{}
+	for i, r := range rules {
+		compiled := targetTLSRule{hosts: blocklist.New(), insecure: r.InsecureSkipVerify}
+		for _, host := range r.Hosts {
+			compiled.hosts.AddLine(host)
+		}
+		if r.CAFile != "" {
+			pem, err := os.ReadFile(r.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("target_tls[%d]: failed to read CA bundle: %w", i, err)
+			}
+			compiled.roots = x509.NewCertPool()
+			if !compiled.roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("target_tls[%d]: no certificates found in %s", i, r.CAFile)
+			}
+		}
+		if len(r.PinSHA256) > 0 {
+			compiled.pins = make(map[[32]byte]bool, len(r.PinSHA256))
+			for _, pin := range r.PinSHA256 {
+				sum, err := base64.StdEncoding.DecodeString(pin)
+				if err != nil || len(sum) != sha256.Size {
+					return nil, fmt.Errorf("target_tls[%d]: invalid pin %q", i, pin)
+				}
+				compiled.pins[[32]byte(sum)] = true
+			}
+		}
+		if compiled.insecure && compiled.pins == nil {
+			logger.Warn("Target TLS verification disabled", "hosts", r.Hosts)
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, nil
+}
+
+// clientConfig returns the TLS config for a handshake with serverName. Targets matching no
+// rule, and all targets with a nil policy, are verified against the system roots.
+func (p *targetTLSPolicy) clientConfig(serverName string) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12, // Enforce minimum TLS 1.2
+	}
+	if p == nil {
+		return tlsConfig
+	}
+	host := serverName
+	if h, _, err := net.SplitHostPort(serverName); err == nil {
+		host = h
+	}
+	for _, r := range p.rules {
+		if !r.hosts.Match(host) {
+			continue
+		}
+		tlsConfig.RootCAs = r.roots
+		tlsConfig.InsecureSkipVerify = r.insecure // #nosec G402 - explicitly configured per target
+		if r.pins != nil {
+			rule := r
+			tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+				return rule.checkPins(cs)
+			}
+		}
+		break
+	}
+	return tlsConfig
+}
+
+// checkPins accepts a handshake when a pinned key is in the verified chain. Without
+// verification anyone can send any chain, so only the leaf is checked.
+func (r *targetTLSRule) checkPins(cs tls.ConnectionState) error {
+	var certs []*x509.Certificate
+	if r.insecure {
+		if len(cs.PeerCertificates) > 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+	} else {
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+	for _, cert := range certs {
+		if r.pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+			return nil
+		}
+	}
+	return errTargetPinMismatch
+}
@@ -0,0 +1,64 @@
+package protocols
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestTargetTLSPolicy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		rules   []config.TargetTLSRule
+		wantErr bool
+	}{
+		{"system trust", nil, true},
+		{"other hosts", []config.TargetTLSRule{{Hosts: []string{"example.com"}, InsecureSkipVerify: true}}, true},
+		{"ca file", []config.TargetTLSRule{{Hosts: []string{"127.0.0.0/8"}, CAFile: caFile}}, false},
+		{"ca file and pin", []config.TargetTLSRule{{Hosts: []string{"127.0.0.1"}, CAFile: caFile, PinSHA256: []string{pin}}}, false},
+		{"ca file and wrong pin", []config.TargetTLSRule{{Hosts: []string{"127.0.0.1"}, CAFile: caFile, PinSHA256: []string{wrongPin}}}, true},
+		{"pin only", []config.TargetTLSRule{{Hosts: []string{"127.0.0.1"}, InsecureSkipVerify: true, PinSHA256: []string{wrongPin, pin}}}, false},
+		{"insecure", []config.TargetTLSRule{{Hosts: []string{"127.0.0.1"}, InsecureSkipVerify: true}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newTargetTLSPolicy(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConn := tls.Client(conn, policy.clientConfig("127.0.0.1"))
+			defer tlsConn.Close()
+			if err := tlsConn.Handshake(); (err != nil) != tt.wantErr {
+				t.Errorf("Handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := newTargetTLSPolicy([]config.TargetTLSRule{{Hosts: []string{"example.com"}, CAFile: filepath.Join(t.TempDir(), "missing.pem")}}); err == nil {
+		t.Error("Expected an error for a missing CA bundle")
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"sync"
 	"time"
 
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
 	"github.com/buhuipao/anyproxy/pkg/common/utils"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
@@ -38,6 +40,18 @@ const (
 	TUICTokenLength = 32 // Token length in bytes
 )
 
+// maxQueuedUDPPackets bounds the packets of a target queued while its relay is dialed
+const maxQueuedUDPPackets = 64
+
+// TUIC listener defaults
+const (
+	defaultTUICHeartbeatInterval = 30 * time.Second
+	defaultTUICAuthTimeout       = 5 * time.Minute
+	defaultTUICUDPSessionTimeout = 5 * time.Minute
+	// tuicAssemblerTimeout drops the fragments of UDP packets never completed
+	tuicAssemblerTimeout = 2 * time.Minute
+)
+
 // TUICProxy implements the TUIC proxy protocol
 type TUICProxy struct {
 	config         *config.TUICConfig
@@ -54,6 +68,12 @@ type TUICProxy struct {
 	// Authentication - using group-based validation
 	authenticatedClients map[string]*TUICClient
 	clientsMu            sync.RWMutex
+	limiter              *listenerLimiter // Limits new peers, nil when unlimited
+
+	heartbeatInterval time.Duration // Cleanup period
+	authTimeout       time.Duration // Peers without a heartbeat for this long are dropped
+	udpSessionTimeout time.Duration // Idle UDP sessions are closed
+	maxUDPSessions    int           // UDP sessions per peer, 0 = unlimited
 
 	// UDP sessions management
 	udpSessions   map[string]map[uint16]*TUICUDPSession
@@ -67,21 +87,45 @@ type TUICProxy struct {
 // TUICClient represents an authenticated TUIC client
 type TUICClient struct {
 	ID            string
+	GroupID       string
 	UUID          []byte
 	Token         []byte
 	RemoteAddr    net.Addr
 	Authenticated bool
 	LastSeen      time.Time
+	release       func() // Frees the peer's listener slot
 	mu            sync.Mutex
 }
 
 // TUICUDPSession represents a UDP relay session
+// Each target of the association gets its own UDP relay through the client tunnel,
+// so packets egress from the client's network like TCP relays do
 type TUICUDPSession struct {
-	AssocID    uint16
-	Client     *TUICClient
-	TargetConn net.PacketConn
-	LastUsed   time.Time
-	mu         sync.Mutex
+	AssocID  uint16
+	Client   *TUICClient
+	Targets  map[string]net.Conn // Target address -> tunneled UDP relay
+	LastUsed time.Time
+	closed   bool
+	dialing  map[string][][]byte // Target address -> packets queued while its relay is dialed
+	mu       sync.Mutex
+}
+
+// closeTargets closes all UDP relays of the session and returns how many were closed
+func (s *TUICUDPSession) closeTargets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.dialing = nil
+	closed := 0
+	for target, conn := range s.Targets {
+		if err := conn.Close(); err != nil {
+			logger.Debug("Failed to close UDP relay", "assoc_id", s.AssocID, "target", target, "err", err)
+		}
+		delete(s.Targets, target)
+		closed++
+	}
+	return closed
 }
 
 // TUICPacketAssembler handles UDP packet fragmentation and reassembly
@@ -136,8 +180,26 @@ func NewTUICProxyWithAuth(cfg *config.TUICConfig, dialFn func(context.Context, s
 		udpSessions:          make(map[string]map[uint16]*TUICUDPSession),
 		packetAssemblers:     make(map[string]map[uint16]*TUICPacketAssembler),
 		stopCh:               make(chan struct{}),
+		heartbeatInterval:    cfg.HeartbeatInterval,
+		authTimeout:          cfg.AuthTimeout,
+		udpSessionTimeout:    cfg.UDPSessionTimeout,
+		maxUDPSessions:       cfg.MaxUDPSessions,
+	}
+	if proxy.heartbeatInterval <= 0 {
+		proxy.heartbeatInterval = defaultTUICHeartbeatInterval
+	}
+	if proxy.authTimeout <= 0 {
+		proxy.authTimeout = defaultTUICAuthTimeout
+	}
+	if proxy.udpSessionTimeout <= 0 {
+		proxy.udpSessionTimeout = defaultTUICUDPSessionTimeout
 	}
 
+	// Peers share the packet loop, so excess peers are always rejected rather than queued
+	limits := cfg.Limits
+	limits.Overflow = config.ListenerOverflowReject
+	proxy.limiter = newListenerLimiter("tuic", limits)
+
 	return proxy, nil
 }
 
@@ -151,12 +213,7 @@ func (p *TUICProxy) Start() error {
 	}
 
 	// Create UDP listener
-	udpAddr, err := net.ResolveUDPAddr("udp", p.config.ListenAddr)
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %w", err)
-	}
-
-	listener, err := net.ListenUDP("udp", udpAddr)
+	listener, err := sockopt.ListenPacket(context.Background(), "udp", p.config.ListenAddr, p.config.SocketOptions)
 	if err != nil {
 		return fmt.Errorf("failed to listen on UDP: %w", err)
 	}
@@ -207,16 +264,9 @@ func (p *TUICProxy) Stop() error {
 	sessionCount := 0
 	for _, clientSessions := range p.udpSessions {
 		for _, session := range clientSessions {
-			if session.TargetConn != nil {
-				sessionCount++
-				// Set read deadline to immediately unblock any pending ReadFrom calls
-				if err := session.TargetConn.SetReadDeadline(time.Now()); err != nil {
-					logger.Error("Failed to set read deadline during UDP session shutdown", "err", err)
-				}
-				if err := session.TargetConn.Close(); err != nil {
-					logger.Error("Failed to close UDP session", "err", err)
-				}
-			}
+			sessionCount++
+			// Closing the relays unblocks any pending reads
+			session.closeTargets()
 		}
 	}
 	p.udpSessionsMu.Unlock()
@@ -368,15 +418,28 @@ func (p *TUICProxy) handleAuthenticate(clientAddr net.Addr, clientID string, cmd
 		return
 	}
 
-	// Create/update client
+	// Create/update client, a new peer takes a listener slot
 	p.clientsMu.Lock()
+	release := func() {}
+	if existing, ok := p.authenticatedClients[clientID]; ok {
+		release = existing.release
+	} else if p.limiter != nil {
+		var admitted bool
+		if release, admitted = p.limiter.admit(nil); !admitted {
+			p.clientsMu.Unlock()
+			p.limiter.rejected(clientAddr.String())
+			return
+		}
+	}
 	client := &TUICClient{
 		ID:            clientID,
+		GroupID:       groupID,
 		UUID:          uuid,
 		Token:         token,
 		RemoteAddr:    clientAddr,
 		Authenticated: true,
 		LastSeen:      time.Now(),
+		release:       release,
 	}
 	p.authenticatedClients[clientID] = client
 	p.clientsMu.Unlock()
@@ -406,7 +469,7 @@ func (p *TUICProxy) handleConnect(clientAddr net.Addr, clientID string, cmd *TUI
 	logger.Debug("Handling TUIC Connect", "client", clientAddr, "target", target)
 
 	// Create TCP connection to target
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(p.dialContext(client), 30*time.Second)
 	defer cancel()
 
 	targetConn, err := p.dialFunc(ctx, "tcp", target)
@@ -427,6 +490,19 @@ func (p *TUICProxy) handleConnect(clientAddr net.Addr, clientID string, cmd *TUI
 	}()
 }
 
+// dialContext creates a context carrying the authenticated group for the gateway dial function
+func (p *TUICProxy) dialContext(client *TUICClient) context.Context {
+	ctx := commonctx.WithConnID(context.Background(), utils.GenerateConnID())
+	userCtx := &utils.UserContext{
+		Username: client.GroupID,
+		GroupID:  client.GroupID,
+	}
+	if client.RemoteAddr != nil {
+		userCtx.SourceIP = remoteIP(client.RemoteAddr.String())
+	}
+	return commonctx.WithUserContext(ctx, userCtx)
+}
+
 // getAuthenticatedClient gets an authenticated client by ID
 func (p *TUICProxy) getAuthenticatedClient(clientID string) *TUICClient {
 	p.clientsMu.RLock()
@@ -543,16 +619,19 @@ func (p *TUICProxy) handlePacket(clientAddr net.Addr, clientID string, cmd *TUIC
 	target := p.formatAddress(completePacket.Address)
 	logger.Debug("Forwarding UDP packet", "client", clientAddr, "target", target, "size", len(completePacket.Payload))
 
-	// For UDP relay, we need to resolve the target address
-	udpAddr, err := net.ResolveUDPAddr("udp", target)
-	if err != nil {
-		logger.Error("Failed to resolve target UDP address", "target", target, "err", err)
+	// Target is resolved on the client side, so internal names work as for TCP relays
+	targetConn := p.udpTargetOrQueue(clientID, session, target, completePacket.Payload)
+	if targetConn == nil {
 		return
 	}
+	p.writeUDPPacket(session, target, targetConn, completePacket.Payload)
+}
 
-	_, err = session.TargetConn.WriteTo(completePacket.Payload, udpAddr)
-	if err != nil {
-		logger.Error("Failed to forward UDP packet", "client", clientAddr, "target", target, "err", err)
+// writeUDPPacket forwards a packet through the relay of a target
+func (p *TUICProxy) writeUDPPacket(session *TUICUDPSession, target string, conn net.Conn, payload []byte) {
+	if _, err := conn.Write(payload); err != nil {
+		logger.Error("Failed to forward UDP packet", "client", session.Client.RemoteAddr, "target", target, "err", err)
+		p.removeUDPTarget(session, target, conn)
 		return
 	}
 
@@ -560,7 +639,7 @@ func (p *TUICProxy) handlePacket(clientAddr net.Addr, clientID string, cmd *TUIC
 	session.LastUsed = time.Now()
 	session.mu.Unlock()
 
-	logger.Debug("UDP packet forwarded successfully", "client", clientAddr, "target", target, "bytes", len(completePacket.Payload))
+	logger.Debug("UDP packet forwarded successfully", "client", session.Client.RemoteAddr, "target", target, "bytes", len(payload))
 }
 
 // parsePacketData parses Packet command data
@@ -703,50 +782,142 @@ func (p *TUICProxy) getOrCreateUDPSession(clientID string, assocID uint16, clien
 
 	session, exists := p.udpSessions[clientID][assocID]
 	if !exists {
-		// Create UDP connection for relay
-		udpConn, err := net.ListenPacket("udp", ":0")
-		if err != nil {
-			logger.Error("Failed to create UDP connection", "client", client.RemoteAddr, "assoc_id", assocID, "err", err)
+		if p.maxUDPSessions > 0 && len(p.udpSessions[clientID]) >= p.maxUDPSessions {
+			logger.Warn("UDP session limit reached, dropping packet of new association", "client", client.RemoteAddr, "assoc_id", assocID, "max_udp_sessions", p.maxUDPSessions)
 			return nil
 		}
-
 		session = &TUICUDPSession{
-			AssocID:    assocID,
-			Client:     client,
-			TargetConn: udpConn,
-			LastUsed:   time.Now(),
+			AssocID:  assocID,
+			Client:   client,
+			Targets:  make(map[string]net.Conn),
+			LastUsed: time.Now(),
 		}
 		p.udpSessions[clientID][assocID] = session
 
 		logger.Info("UDP session created", "client", client.RemoteAddr, "assoc_id", assocID)
-
-		// Start relay back to client
-		p.wg.Add(1)
-		go p.relayUDPBack(clientID, session)
 	}
 
 	return session
 }
 
-// relayUDPBack relays UDP packets back to client
-func (p *TUICProxy) relayUDPBack(clientID string, session *TUICUDPSession) {
-	defer p.wg.Done()
-	defer func() {
-		// Cleanup session
-		p.udpSessionsMu.Lock()
-		if clientSessions, exists := p.udpSessions[clientID]; exists {
-			delete(clientSessions, session.AssocID)
+// udpTargetOrQueue returns the session's UDP relay for a target. Without one the packet is queued
+// and the relay dialed in the background, packets must not wait for a dial in the packet loop
+// shared by all sessions of the listener.
+func (p *TUICProxy) udpTargetOrQueue(clientID string, session *TUICUDPSession, target string, payload []byte) net.Conn {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.closed {
+		return nil
+	}
+	if conn, exists := session.Targets[target]; exists {
+		return conn
+	}
+
+	// The payload shares the read buffer of the packet loop
+	packet := append([]byte(nil), payload...)
+	if queued, dialing := session.dialing[target]; dialing {
+		if len(queued) >= maxQueuedUDPPackets {
+			logger.Debug("UDP relay still dialing, dropping packet", "client", session.Client.RemoteAddr, "assoc_id", session.AssocID, "target", target)
+			return nil
 		}
-		p.udpSessionsMu.Unlock()
+		session.dialing[target] = append(queued, packet)
+		return nil
+	}
+	if session.dialing == nil {
+		session.dialing = make(map[string][][]byte)
+	}
+	session.dialing[target] = [][]byte{packet}
+
+	p.wg.Add(1)
+	go p.dialUDPTarget(clientID, session, target)
+	return nil
+}
+
+// dialUDPTarget dials the UDP relay of a target through the client tunnel, forwards the packets
+// queued meanwhile and relays the responses back to the client
+func (p *TUICProxy) dialUDPTarget(clientID string, session *TUICUDPSession, target string) {
+	defer p.wg.Done()
 
-		if session.TargetConn != nil {
-			if err := session.TargetConn.Close(); err != nil {
-				logger.Error("Failed to close UDP session", "err", err)
+	ctx, cancel := context.WithTimeout(p.dialContext(session.Client), 30*time.Second)
+	defer cancel()
+	conn, err := p.dialFunc(ctx, "udp", target)
+	if err != nil {
+		session.mu.Lock()
+		dropped := len(session.dialing[target])
+		delete(session.dialing, target)
+		session.mu.Unlock()
+		logger.Error("Failed to create UDP relay through client tunnel", "client", session.Client.RemoteAddr, "assoc_id", session.AssocID, "target", target, "dropped_packets", dropped, "err", err)
+		return
+	}
+
+	// Queued packets go out first, packets arriving meanwhile keep queuing until the relay is
+	// published, so the target gets them in order
+	for {
+		session.mu.Lock()
+		if session.closed {
+			session.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		queued := session.dialing[target]
+		if len(queued) == 0 {
+			delete(session.dialing, target)
+			session.Targets[target] = conn
+			session.mu.Unlock()
+			break
+		}
+		session.dialing[target] = [][]byte{}
+		session.mu.Unlock()
+
+		for _, packet := range queued {
+			if _, err := conn.Write(packet); err != nil {
+				logger.Error("Failed to forward UDP packet", "client", session.Client.RemoteAddr, "target", target, "err", err)
+				session.mu.Lock()
+				delete(session.dialing, target)
+				session.mu.Unlock()
+				_ = conn.Close()
+				return
 			}
 		}
-	}()
+	}
+	logger.Debug("UDP relay established through client tunnel", "client", session.Client.RemoteAddr, "assoc_id", session.AssocID, "target", target)
 
-	buffer := make([]byte, 4096)
+	session.mu.Lock()
+	session.LastUsed = time.Now()
+	session.mu.Unlock()
+
+	// Start relay back to client
+	p.wg.Add(1)
+	go p.relayUDPBack(clientID, session, target, conn)
+}
+
+// removeUDPTarget removes and closes a UDP relay of the session
+func (p *TUICProxy) removeUDPTarget(session *TUICUDPSession, target string, conn net.Conn) {
+	session.mu.Lock()
+	if current, exists := session.Targets[target]; exists && current == conn {
+		delete(session.Targets, target)
+	}
+	session.mu.Unlock()
+
+	if err := conn.Close(); err != nil {
+		logger.Debug("Failed to close UDP relay", "assoc_id", session.AssocID, "target", target, "err", err)
+	}
+}
+
+// relayUDPBack relays UDP packets from a target back to client
+func (p *TUICProxy) relayUDPBack(clientID string, session *TUICUDPSession, target string, conn net.Conn) {
+	defer p.wg.Done()
+	defer p.removeUDPTarget(session, target, conn)
+
+	// Responses are reported with the target as source address
+	srcAddr := p.buildAddressFromTarget(target)
+	if srcAddr == nil {
+		logger.Error("Failed to build source address for UDP relay", "client", clientID, "target", target)
+		return
+	}
+
+	// Each read from the tunnel carries exactly one datagram
+	buffer := make([]byte, 65536)
 	for {
 		select {
 		case <-p.stopCh:
@@ -755,18 +926,18 @@ func (p *TUICProxy) relayUDPBack(clientID string, session *TUICUDPSession) {
 		}
 
 		// Use shorter timeout to be more responsive to shutdown signals
-		if err := session.TargetConn.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
+		if err := conn.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
 			logger.Error("Failed to set read deadline", "err", err)
 			return
 		}
 
-		n, srcAddr, err := session.TargetConn.ReadFrom(buffer)
+		n, err := conn.Read(buffer)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				// Check stop signal again after timeout
 				continue
 			}
-			logger.Debug("UDP relay read error", "assoc_id", session.AssocID, "err", err)
+			logger.Debug("UDP relay read error", "client", clientID, "assoc_id", session.AssocID, "target", target, "err", err)
 			return
 		}
 
@@ -782,14 +953,7 @@ func (p *TUICProxy) relayUDPBack(clientID string, session *TUICUDPSession) {
 }
 
 // sendUDPPacketToClient sends a UDP packet back to the client
-func (p *TUICProxy) sendUDPPacketToClient(session *TUICUDPSession, srcAddr net.Addr, data []byte) {
-	// Build address from source
-	addr := p.buildAddressFromNetAddr(srcAddr)
-	if addr == nil {
-		logger.Error("Failed to build address from net.Addr", "addr", srcAddr)
-		return
-	}
-
+func (p *TUICProxy) sendUDPPacketToClient(session *TUICUDPSession, addr *TUICAddress, data []byte) {
 	// Build packet data
 	packetData := &TUICPacketData{
 		AssocID:   session.AssocID,
@@ -813,6 +977,26 @@ func (p *TUICProxy) sendUDPPacketToClient(session *TUICUDPSession, srcAddr net.A
 	}
 }
 
+// buildAddressFromTarget builds a TUIC address from a "host:port" target without resolving it
+func (p *TUICProxy) buildAddressFromTarget(target string) *TUICAddress {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil
+	}
+	portNum, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.buildAddressFromNetAddr(&net.UDPAddr{IP: ip, Port: portNum})
+	}
+	return &TUICAddress{
+		Type: TUICAddrDomain,
+		Host: host,
+		Port: p.safeUint16(portNum),
+	}
+}
+
 // buildAddressFromNetAddr builds a TUIC address from net.Addr
 func (p *TUICProxy) buildAddressFromNetAddr(addr net.Addr) *TUICAddress {
 	switch a := addr.(type) {
@@ -936,11 +1120,7 @@ func (p *TUICProxy) handleDissociate(clientAddr net.Addr, clientID string, cmd *
 	p.udpSessionsMu.Lock()
 	if clientSessions, exists := p.udpSessions[clientID]; exists {
 		if session, exists := clientSessions[assocID]; exists {
-			if session.TargetConn != nil {
-				if err := session.TargetConn.Close(); err != nil {
-					logger.Error("Failed to close UDP session", "err", err)
-				}
-			}
+			session.closeTargets()
 			delete(clientSessions, assocID)
 			logger.Info("UDP session dissociated", "client", clientAddr, "assoc_id", assocID)
 		}
@@ -976,7 +1156,7 @@ func (p *TUICProxy) handleHeartbeat(clientAddr net.Addr, clientID string, _ *TUI
 func (p *TUICProxy) cleanupRoutine() {
 	defer p.wg.Done()
 
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(p.heartbeatInterval)
 	defer ticker.Stop()
 
 	for {
@@ -993,14 +1173,16 @@ func (p *TUICProxy) cleanupRoutine() {
 // cleanupExpiredSessions cleans up expired sessions
 func (p *TUICProxy) cleanupExpiredSessions() {
 	now := time.Now()
-	timeout := 5 * time.Minute
 
 	// Cleanup clients
 	p.clientsMu.Lock()
 	for id, client := range p.authenticatedClients {
 		client.mu.Lock()
-		if now.Sub(client.LastSeen) > timeout {
+		if now.Sub(client.LastSeen) > p.authTimeout {
 			delete(p.authenticatedClients, id)
+			if client.release != nil {
+				client.release()
+			}
 			logger.Debug("Cleaned up expired client", "client", client.RemoteAddr)
 		}
 		client.mu.Unlock()
@@ -1012,16 +1194,13 @@ func (p *TUICProxy) cleanupExpiredSessions() {
 	for clientID, clientSessions := range p.udpSessions {
 		for assocID, session := range clientSessions {
 			session.mu.Lock()
-			if now.Sub(session.LastUsed) > timeout {
-				if session.TargetConn != nil {
-					if err := session.TargetConn.Close(); err != nil {
-						logger.Error("Failed to close expired UDP session", "err", err)
-					}
-				}
+			expired := now.Sub(session.LastUsed) > p.udpSessionTimeout
+			session.mu.Unlock()
+			if expired {
+				session.closeTargets()
 				delete(clientSessions, assocID)
 				logger.Debug("Cleaned up expired UDP session", "client", clientID, "assoc_id", assocID)
 			}
-			session.mu.Unlock()
 		}
 		if len(clientSessions) == 0 {
 			delete(p.udpSessions, clientID)
@@ -1033,7 +1212,7 @@ func (p *TUICProxy) cleanupExpiredSessions() {
 // cleanupExpiredAssemblers cleans up expired packet assemblers
 func (p *TUICProxy) cleanupExpiredAssemblers() {
 	now := time.Now()
-	timeout := 2 * time.Minute
+	timeout := tuicAssemblerTimeout
 
 	p.assemblersMu.Lock()
 	for clientID, clientAssemblers := range p.packetAssemblers {
@@ -3,8 +3,11 @@ package protocols
 import (
 	"context"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
+	commonctx "github.com/buhuipao/anyproxy/pkg/common/context"
 	"github.com/buhuipao/anyproxy/pkg/config"
 )
 
@@ -413,3 +416,217 @@ func TestTUICProxy_BuildTUICCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestTUICProxy_UDPRelayThroughClientTunnel(t *testing.T) {
+	cfg := &config.TUICConfig{
+		ListenAddr: "127.0.0.1:0",
+	}
+
+	type dialRequest struct {
+		network string
+		addr    string
+		groupID string
+	}
+	dialed := make(chan dialRequest, 1)
+	tunnelSide := make(chan net.Conn, 1)
+
+	dialFunc := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		userCtx, _ := commonctx.GetUserContext(ctx)
+		req := dialRequest{network: network, addr: addr}
+		if userCtx != nil {
+			req.groupID = userCtx.GroupID
+		}
+		dialed <- req
+
+		proxySide, clientSide := net.Pipe()
+		tunnelSide <- clientSide
+		return proxySide, nil
+	}
+
+	proxy, err := NewTUICProxyWithAuth(cfg, dialFunc, nil, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create TUIC proxy: %v", err)
+	}
+	tuicProxy := proxy.(*TUICProxy)
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	tuicProxy.listener = listener
+	tuicProxy.running = true
+	defer func() { _ = tuicProxy.Stop() }()
+
+	userConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer userConn.Close()
+
+	clientID := userConn.LocalAddr().String()
+	tuicProxy.authenticatedClients[clientID] = &TUICClient{
+		ID:            clientID,
+		GroupID:       "testgroup",
+		RemoteAddr:    userConn.LocalAddr(),
+		Authenticated: true,
+		LastSeen:      time.Now(),
+	}
+
+	// Send a UDP packet to an internal name that only the client can resolve
+	payload := []byte("query")
+	packet := tuicProxy.buildTUICCommand(TUICCmdPacket, tuicProxy.buildPacketCommandData(&TUICPacketData{
+		AssocID:   7,
+		FragTotal: 1,
+		Size:      uint16(len(payload)),
+		Address:   &TUICAddress{Type: TUICAddrDomain, Host: "dns.internal", Port: 53},
+		Payload:   payload,
+	}))
+	go tuicProxy.handleTUICPacket(userConn.LocalAddr(), packet)
+
+	req := <-dialed
+	if req.network != "udp" || req.addr != "dns.internal:53" || req.groupID != "testgroup" {
+		t.Fatalf("Unexpected dial request: %+v", req)
+	}
+
+	tunnel := <-tunnelSide
+	defer tunnel.Close()
+
+	buffer := make([]byte, 1024)
+	n, err := tunnel.Read(buffer)
+	if err != nil || string(buffer[:n]) != "query" {
+		t.Fatalf("Expected payload through tunnel, got %q (err: %v)", buffer[:n], err)
+	}
+
+	// Reply from the client side is relayed back to the user
+	if _, err := tunnel.Write([]byte("answer")); err != nil {
+		t.Fatalf("Failed to write response: %v", err)
+	}
+
+	if err := userConn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	n, _, err = userConn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("Failed to read relayed response: %v", err)
+	}
+
+	cmd, err := tuicProxy.parseTUICCommand(buffer[:n])
+	if err != nil || cmd.Type != TUICCmdPacket {
+		t.Fatalf("Expected packet command, got %+v (err: %v)", cmd, err)
+	}
+	response, err := tuicProxy.parsePacketData(cmd.Data)
+	if err != nil {
+		t.Fatalf("Failed to parse packet data: %v", err)
+	}
+	if response.AssocID != 7 || string(response.Payload) != "answer" {
+		t.Errorf("Unexpected response packet: assoc_id=%d payload=%q", response.AssocID, response.Payload)
+	}
+	if response.Address.Host != "dns.internal" || response.Address.Port != 53 {
+		t.Errorf("Expected source address dns.internal:53, got %s", tuicProxy.formatAddress(response.Address))
+	}
+}
+
+func TestTUICProxy_Timeouts(t *testing.T) {
+	proxy, err := NewTUICProxyWithAuth(&config.TUICConfig{ListenAddr: ":9443"}, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := proxy.(*TUICProxy)
+	if defaults.heartbeatInterval != defaultTUICHeartbeatInterval || defaults.authTimeout != defaultTUICAuthTimeout || defaults.udpSessionTimeout != defaultTUICUDPSessionTimeout {
+		t.Errorf("Unexpected defaults: %v, %v, %v", defaults.heartbeatInterval, defaults.authTimeout, defaults.udpSessionTimeout)
+	}
+
+	proxy, err = NewTUICProxyWithAuth(&config.TUICConfig{ListenAddr: ":9443", AuthTimeout: time.Minute, UDPSessionTimeout: time.Hour, MaxUDPSessions: 1}, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := proxy.(*TUICProxy)
+	client := &TUICClient{ID: "peer", Authenticated: true, LastSeen: time.Now().Add(-2 * time.Minute)}
+	p.authenticatedClients["peer"] = client
+
+	// A second association is refused
+	if p.getOrCreateUDPSession("peer", 1, client) == nil {
+		t.Fatal("Expected the first UDP session to be created")
+	}
+	if p.getOrCreateUDPSession("peer", 2, client) != nil {
+		t.Error("Expected max_udp_sessions to refuse a second association")
+	}
+
+	// The peer missed its heartbeats, its idle session is kept until udp_session_timeout
+	p.cleanupExpiredSessions()
+	if p.getAuthenticatedClient("peer") != nil {
+		t.Error("Expected the peer to be dropped after auth_timeout")
+	}
+	if len(p.udpSessions["peer"]) != 1 {
+		t.Error("Expected the UDP session to be kept until udp_session_timeout")
+	}
+}
+
+func TestTUICProxy_UDPDialDoesNotBlockPackets(t *testing.T) {
+	release := make(chan struct{})
+	targets := make(map[string]net.Conn)
+	var mu sync.Mutex
+	dialFunc := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "slow.example.com:53" {
+			<-release
+		}
+		gatewaySide, targetSide := net.Pipe()
+		mu.Lock()
+		targets[addr] = targetSide
+		mu.Unlock()
+		return gatewaySide, nil
+	}
+	proxy, err := NewTUICProxyWithAuth(&config.TUICConfig{ListenAddr: ":9443"}, dialFunc, nil, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create TUIC proxy: %v", err)
+	}
+	p := proxy.(*TUICProxy)
+	session := &TUICUDPSession{AssocID: 1, Client: &TUICClient{ID: "peer", GroupID: "g"}, Targets: make(map[string]net.Conn)}
+	target := func(addr string) net.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+		return targets[addr]
+	}
+	read := func(conn net.Conn) string {
+		buf := make([]byte, 16)
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Target read error = %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	// Packets to a target still dialing are queued, the caller doesn't wait for the dial
+	for _, payload := range []string{"one", "two"} {
+		if conn := p.udpTargetOrQueue("peer", session, "slow.example.com:53", []byte(payload)); conn != nil {
+			t.Fatal("Expected packets to be queued while dialing")
+		}
+	}
+
+	// Other targets are relayed meanwhile
+	p.udpTargetOrQueue("peer", session, "fast.example.com:53", []byte("fast"))
+	deadline := time.Now().Add(2 * time.Second)
+	for target("fast.example.com:53") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fast := target("fast.example.com:53"); fast == nil || read(fast) != "fast" {
+		t.Fatal("Expected the fast target to get its packet while the slow one dials")
+	}
+
+	close(release)
+	deadline = time.Now().Add(2 * time.Second)
+	for target("slow.example.com:53") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	slow := target("slow.example.com:53")
+	if slow == nil {
+		t.Fatal("Expected the slow target to be dialed")
+	}
+	if got := read(slow) + read(slow); got != "onetwo" {
+		t.Errorf("Expected the queued packets in order, got %q", got)
+	}
+
+	session.closeTargets()
+	p.wg.Wait()
+}
@@ -0,0 +1,25 @@
+package protocols
+
+import (
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// authenticateProxyUser validates the credentials of a proxy username, which may pin a
+// client and carry options after the group ID, and returns the user context of its dials
+func authenticateProxyUser(username, password string, validate func(string, string) bool) (*utils.UserContext, bool) {
+	if validate == nil {
+		return nil, false
+	}
+	candidates, err := utils.ParseProxyUsername(username)
+	if err != nil {
+		logger.Debug("Invalid proxy username", "username", username, "err", err)
+		return nil, false
+	}
+	for _, userCtx := range candidates {
+		if validate(userCtx.GroupID, password) {
+			return userCtx, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,49 @@
+package protocols
+
+import (
+	"testing"
+)
+
+func TestAuthenticateProxyUser(t *testing.T) {
+	validate := func(groupID, password string) bool {
+		return (groupID == "prod" || groupID == "team.dev") && password == "secret"
+	}
+
+	tests := []struct {
+		username   string
+		ok         bool
+		groupID    string
+		clientID   string
+		noFallback bool
+	}{
+		{username: "prod", ok: true, groupID: "prod"},
+		{username: "prod.host-1", ok: true, groupID: "prod", clientID: "host-1"},
+		{username: "prod.host-1.example.com", ok: true, groupID: "prod", clientID: "host-1.example.com"},
+		{username: "prod!nofallback", ok: true, groupID: "prod", noFallback: true},
+		{username: "team.dev", ok: true, groupID: "team.dev"},
+		{username: "team.dev.host-2!nofallback", ok: true, groupID: "team.dev", clientID: "host-2", noFallback: true},
+		{username: "prod.", ok: false},
+		{username: "prod!retry", ok: false},
+		{username: "!nofallback", ok: false},
+		{username: "staging.host-1", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			userCtx, ok := authenticateProxyUser(tt.username, "secret", validate)
+			if ok != tt.ok {
+				t.Fatalf("Expected ok=%v, got %v", tt.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			if userCtx.GroupID != tt.groupID || userCtx.Username != tt.groupID || userCtx.ClientID != tt.clientID || userCtx.NoFallback != tt.noFallback {
+				t.Errorf("Unexpected user context: %+v", userCtx)
+			}
+		})
+	}
+
+	if _, ok := authenticateProxyUser("prod", "secret", nil); ok {
+		t.Error("Expected no validator to reject the user")
+	}
+}
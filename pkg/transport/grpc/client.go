@@ -30,6 +30,9 @@ func (t *grpcTransport) dialGRPCWithConfig(addr string, config *transport.Client
 		PermitWithoutStream: true,             // Allow keepalive when no active streams
 	}))
 
+	// Refuse oversized messages from the gateway
+	opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxStreamMessageSize)))
+
 	// Configure TLS
 	if config.TLSConfig != nil {
 		creds := credentials.NewTLS(config.TLSConfig)
@@ -46,7 +49,7 @@ func (t *grpcTransport) dialGRPCWithConfig(addr string, config *transport.Client
 	conn, err := grpc.NewClient(addr, opts...)
 	if err != nil {
 		logger.Error("Failed to create gRPC client", "client_id", config.ClientID, "addr", addr, "err", err)
-		return nil, fmt.Errorf("failed to create gRPC client: %v", err)
+		return nil, fmt.Errorf("failed to create gRPC client: %w", err)
 	}
 
 	logger.Debug("gRPC connection established", "client_id", config.ClientID)
@@ -56,12 +59,20 @@ func (t *grpcTransport) dialGRPCWithConfig(addr string, config *transport.Client
 
 	// Set up metadata with client info and authentication
 	md := metadata.New(map[string]string{
-		"client-id":      config.ClientID,
-		"group-id":       config.GroupID,
-		"group-password": config.GroupPassword,
-		"username":       config.Username, // Gateway transport auth username
-		"password":       config.Password, // Gateway transport auth password
+		"client-id":       config.ClientID,
+		"group-id":        config.GroupID,
+		"group-password":  config.GroupPassword,
+		"client-version":  config.Version,
+		"client-identity": config.Identity,
+		"username":        config.Username, // Gateway transport auth username
+		"password":        config.Password, // Gateway transport auth password
 	})
+	perConn := t.authConfig != nil && t.authConfig.GRPC.StreamPerConnection
+	if perConn {
+		// The gateway agrees in its response header, older gateways ignore the request
+		md.Set(mdStreamPerConnection, "1")
+		md.Set(mdSessionID, newSessionID())
+	}
 
 	// Create context with metadata
 	streamCtx := metadata.NewOutgoingContext(context.Background(), md)
@@ -73,12 +84,17 @@ func (t *grpcTransport) dialGRPCWithConfig(addr string, config *transport.Client
 			logger.Warn("Error closing gRPC connection after stream failure", "err", closeErr)
 		}
 		logger.Error("Failed to create gRPC stream", "client_id", config.ClientID, "err", err)
-		return nil, fmt.Errorf("failed to create gRPC stream: %v", err)
+		return nil, fmt.Errorf("failed to create gRPC stream: %w", err)
 	}
 
 	logger.Info("gRPC stream established successfully", "client_id", config.ClientID)
 
 	// Create and return connection wrapper
-	grpcConn := newGRPCConnection(stream, conn, config.ClientID, config.GroupID, config.GroupPassword)
+	var streamClient TransportServiceClient
+	if perConn {
+		streamClient = client
+	}
+	grpcConn := newGRPCConnection(stream, conn, config.ClientID, config.GroupID, config.GroupPassword, streamClient, md)
+	grpcConn.clientVersion = config.Version
 	return grpcConn, nil
 }
@@ -6,16 +6,31 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	"github.com/buhuipao/anyproxy/pkg/transport"
 )
 
+// Framing gRPC adds to each stream message besides its protobuf envelope
+const (
+	grpcMessagePrefix = 5     // Compression flag and length
+	http2FrameHeader  = 9     // Per HTTP/2 DATA frame
+	http2MaxFrameSize = 16384 // Default SETTINGS_MAX_FRAME_SIZE
+)
+
+// maxStreamMessageSize bounds received stream messages, a protocol message plus room for the envelope
+const maxStreamMessageSize = protocol.MaxMessageSize + 64*1024
+
 // 🆕 Write message type
 type writeRequest struct {
 	msgType StreamMessage_MessageType
@@ -37,20 +52,38 @@ type grpcConnection struct {
 	clientID      string
 	groupID       string
 	groupPassword string // Client password for group credential management
+	clientVersion string // Client build version from the handshake, set before the connection is handed out
+	identity      string // Client identity proof from the handshake, set like clientVersion
 	// 🆕 Remove mutex, use async writes instead
-	writeChan chan *writeRequest // 🆕 Async write queue
-	closed    bool
-	ctx       context.Context
-	cancel    context.CancelFunc
-	readChan  chan []byte
-	errorChan chan error
-	closeOnce sync.Once
+	writeChan   chan *writeRequest // 🆕 Async write queue
+	controlChan chan *writeRequest // Control messages, written before queued data
+	closed      bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	readChan    chan []byte
+	errorChan   chan error
+	closeOnce   sync.Once
+
+	// Delivery of read messages, per-connection streams deliver until the main stream ends
+	readMu     sync.RWMutex // Held shared while delivering, exclusively to close readChan
+	readClosed bool
+	recvDone   chan struct{} // Closed when the main stream ends
+
+	// Per-connection streams, see streams.go
+	perConn   atomic.Bool                 // Negotiated with the peer
+	negotiate sync.Once                   // Client connections check the gateway's answer once
+	header    func() (metadata.MD, error) // Response header of the main stream, nil unless the client asked
+	client    TransportServiceClient      // Opens the streams of client connections
+	md        metadata.MD                 // Handshake metadata of client connections, sent again on their streams
+	streamsMu sync.Mutex
+	streams   map[string]*connStream // By connection ID
 }
 
 var _ transport.Connection = (*grpcConnection)(nil)
 
-// newGRPCConnection creates a client gRPC connection
-func newGRPCConnection(stream TransportService_BiStreamClient, conn *grpc.ClientConn, clientID, groupID, groupPassword string) *grpcConnection {
+// newGRPCConnection creates a client gRPC connection. With a non-nil client it opens a
+// stream per proxied connection once the gateway agreed, md is the handshake metadata.
+func newGRPCConnection(stream TransportService_BiStreamClient, conn *grpc.ClientConn, clientID, groupID, groupPassword string, client TransportServiceClient, md metadata.MD) *grpcConnection {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	c := &grpcConnection{
@@ -60,10 +93,19 @@ func newGRPCConnection(stream TransportService_BiStreamClient, conn *grpc.Client
 		groupID:       groupID,
 		groupPassword: groupPassword,
 		writeChan:     make(chan *writeRequest, 1000), // 🆕 Async write queue
+		controlChan:   make(chan *writeRequest, transport.ControlQueueSize),
 		ctx:           ctx,
 		cancel:        cancel,
 		readChan:      make(chan []byte, 100),
 		errorChan:     make(chan error, 1),
+		recvDone:      make(chan struct{}),
+		streams:       make(map[string]*connStream),
+	}
+	if client != nil {
+		c.client = client
+		c.md = md
+		c.header = stream.Header
+		go c.negotiated()
 	}
 
 	// 🆕 Start read/write goroutines
@@ -83,10 +125,13 @@ func newGRPCServerConnection(stream TransportService_BiStreamServer, clientID, g
 		groupID:       groupID,
 		groupPassword: groupPassword,
 		writeChan:     make(chan *writeRequest, 1000), // 🆕 Async write queue
+		controlChan:   make(chan *writeRequest, transport.ControlQueueSize),
 		ctx:           ctx,
 		cancel:        cancel,
 		readChan:      make(chan []byte, 100),
 		errorChan:     make(chan error, 1),
+		recvDone:      make(chan struct{}),
+		streams:       make(map[string]*connStream),
 	}
 
 	// 🆕 Start read/write goroutines
@@ -98,53 +143,107 @@ func newGRPCServerConnection(stream TransportService_BiStreamServer, clientID, g
 // 🆕 Async write goroutine, avoiding lock contention
 func (c *grpcConnection) writeLoop() {
 	defer func() {
-		// Clear error channels in the queue
-		for req := range c.writeChan {
-			if req.errChan != nil {
-				req.errChan <- fmt.Errorf("connection closed")
-				close(req.errChan)
+		// Clear error channels in the queues
+		for _, queue := range []chan *writeRequest{c.controlChan, c.writeChan} {
+			for req := range queue {
+				if req.errChan != nil {
+					req.errChan <- fmt.Errorf("connection closed")
+					close(req.errChan)
+				}
 			}
 		}
 	}()
 
 	for {
+		// Control messages go before queued data
 		select {
-		case <-c.ctx.Done():
-			return
-		case req := <-c.writeChan:
-			if c.closed {
-				if req.errChan != nil {
-					req.errChan <- fmt.Errorf("connection closed")
-					close(req.errChan)
-				}
-				continue
+		case req, ok := <-c.controlChan:
+			if !ok {
+				return
 			}
+			c.send(req)
+			continue
+		default:
+		}
 
-			msg := &StreamMessage{
-				Type:     req.msgType,
-				Data:     req.data,
-				ClientId: c.clientID,
-				GroupId:  c.groupID,
+		select {
+		case <-c.ctx.Done():
+			return
+		case req, ok := <-c.controlChan:
+			if !ok {
+				return
 			}
-
-			err := c.stream.Send(msg)
-			if err != nil && isGRPCError(err) {
-				c.closed = true
+			c.send(req)
+		case req, ok := <-c.writeChan:
+			if !ok {
+				return
 			}
+			c.send(req)
+		}
+	}
+}
 
-			if req.errChan != nil {
-				req.errChan <- err
-				close(req.errChan)
-			}
+// send writes a queued message on the main stream, only used in writeLoop
+func (c *grpcConnection) send(req *writeRequest) {
+	if c.closed {
+		if req.errChan != nil {
+			req.errChan <- fmt.Errorf("connection closed")
+			close(req.errChan)
 		}
+		return
+	}
+
+	msg := &StreamMessage{
+		Type:     req.msgType,
+		Data:     req.data,
+		ClientId: c.clientID,
+		GroupId:  c.groupID,
+	}
+
+	err := c.stream.Send(msg)
+	if err != nil && isGRPCError(err) {
+		c.closed = true
+	}
+	if err == nil {
+		monitoring.RecordTransportSent(protocol.TransportTypeGRPC, len(msg.Data), messageFraming(msg))
+	}
+
+	if req.errChan != nil {
+		req.errChan <- err
+		close(req.errChan)
 	}
 }
 
 // WriteMessage implements transport.Connection
 func (c *grpcConnection) WriteMessage(data []byte) error {
+	if c.perConn.Load() {
+		if s, closing := c.writeStream(data); s != nil {
+			// A broken stream leaves the main stream, the connection ends anyway
+			if err := s.send(data, closing); err == nil {
+				return nil
+			}
+		}
+	}
 	return c.writeMessageAsync(StreamMessage_DATA, data)
 }
 
+// deliver hands a read message to ReadMessage, false once the connection stopped reading
+func (c *grpcConnection) deliver(data []byte) bool {
+	c.readMu.RLock()
+	defer c.readMu.RUnlock()
+	if c.readClosed {
+		return false
+	}
+	select {
+	case c.readChan <- data:
+		return true
+	case <-c.ctx.Done():
+		return false
+	case <-c.recvDone:
+		return false
+	}
+}
+
 // 🆕 Async write method, lock-free design
 func (c *grpcConnection) writeMessageAsync(msgType StreamMessage_MessageType, data []byte) error {
 	if c.closed {
@@ -158,8 +257,13 @@ func (c *grpcConnection) writeMessageAsync(msgType StreamMessage_MessageType, da
 		errChan: errChan,
 	}
 
+	queue := c.writeChan
+	if transport.IsControlMessage(data) {
+		queue = c.controlChan
+	}
+
 	select {
-	case c.writeChan <- req:
+	case queue <- req:
 		// Wait for write result
 		select {
 		case err := <-errChan:
@@ -209,6 +313,7 @@ func (c *grpcConnection) Close() error {
 
 		// 🆕 Close write queue
 		close(c.writeChan)
+		close(c.controlChan)
 
 		// Only client connections close the gRPC connection
 		if c.conn != nil {
@@ -246,11 +351,25 @@ func (c *grpcConnection) GetPassword() string {
 	return c.groupPassword
 }
 
+// GetClientVersion returns the client build version
+func (c *grpcConnection) GetClientVersion() string {
+	return c.clientVersion
+}
+
+// GetClientIdentity returns the client identity proof
+func (c *grpcConnection) GetClientIdentity() string {
+	return c.identity
+}
+
 // receiveLoop handles receiving messages
 func (c *grpcConnection) receiveLoop() {
 	defer func() {
+		close(c.recvDone)
+		c.readMu.Lock()
+		c.readClosed = true
 		close(c.readChan)
 		close(c.errorChan)
+		c.readMu.Unlock()
 	}()
 
 	for {
@@ -259,6 +378,12 @@ func (c *grpcConnection) receiveLoop() {
 			return
 		default:
 			msg, err := c.stream.Recv()
+			switch status.Code(err) {
+			case codes.ResourceExhausted:
+				err = fmt.Errorf("%w: %w", protocol.ErrMessageTooLarge, err)
+			case codes.Unauthenticated:
+				err = fmt.Errorf("%w: %w", transport.ErrAuthFailed, err)
+			}
 			if err != nil {
 				if err == io.EOF || isGRPCError(err) {
 					return
@@ -271,15 +396,22 @@ func (c *grpcConnection) receiveLoop() {
 				continue
 			}
 
-			select {
-			case c.readChan <- msg.Data:
-			case <-c.ctx.Done():
+			monitoring.RecordTransportReceived(protocol.TransportTypeGRPC, len(msg.Data), messageFraming(msg))
+			if !c.receive(msg.Data) {
 				return
 			}
 		}
 	}
 }
 
+// messageFraming returns the bytes a stream message adds to its data: the protobuf envelope with
+// the client and group IDs, the gRPC message prefix and the HTTP/2 DATA frame headers
+func messageFraming(msg *StreamMessage) int {
+	size := proto.Size(msg) + grpcMessagePrefix
+	frames := (size + http2MaxFrameSize - 1) / http2MaxFrameSize
+	return size - len(msg.Data) + frames*http2FrameHeader
+}
+
 // isGRPCError checks if the error is a connection error
 func isGRPCError(err error) bool {
 	if err == nil {
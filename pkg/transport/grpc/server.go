@@ -1,18 +1,25 @@
 package grpc
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/tlsfp"
+	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	"github.com/buhuipao/anyproxy/pkg/transport"
 )
@@ -25,6 +32,9 @@ type grpcTransport struct {
 	mu         sync.Mutex
 	running    bool
 	authConfig *transport.AuthConfig
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*grpcConnection // Clients using a stream per connection, by session ID
 }
 
 var _ transport.Transport = (*grpcTransport)(nil)
@@ -69,10 +79,14 @@ func (t *grpcTransport) listenAndServe(addr string, handler func(transport.Conne
 	logger.Info("Starting gRPC server", "listen_addr", addr, "protocol", protocol)
 
 	// Create TCP listener
-	listener, err := net.Listen("tcp", addr)
+	listener, err := sockopt.Listen(context.Background(), "tcp", addr, &config.SocketOptions{ReusePort: t.authConfig != nil && t.authConfig.ReusePort})
 	if err != nil {
 		logger.Error("Failed to create TCP listener", "addr", addr, "err", err)
-		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if tlsConfig != nil {
+		// Record the ClientHello for fingerprinting
+		listener = tlsfp.Listen(listener)
 	}
 	t.listener = listener
 
@@ -94,6 +108,9 @@ func (t *grpcTransport) listenAndServe(addr string, handler func(transport.Conne
 		PermitWithoutStream: true,             // Allow keepalive when no active streams
 	}))
 
+	// Refuse oversized messages from clients
+	opts = append(opts, grpc.MaxRecvMsgSize(maxStreamMessageSize))
+
 	// Configure TLS if provided
 	if tlsConfig != nil {
 		creds := credentials.NewTLS(tlsConfig)
@@ -114,7 +131,7 @@ func (t *grpcTransport) listenAndServe(addr string, handler func(transport.Conne
 	// Start serving in a goroutine
 	go func() {
 		logger.Info("Starting gRPC server", "addr", addr, "protocol", protocol)
-		if err := t.server.Serve(listener); err != nil {
+		if err := t.server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
 			logger.Error("gRPC server error", "protocol", protocol, "err", err)
 		} else {
 			logger.Info("gRPC server stopped", "protocol", protocol)
@@ -177,6 +194,18 @@ func (t *grpcTransport) Close() error {
 	return nil
 }
 
+// CloseListener implements transport.ListenerCloser, connected clients are kept
+func (t *grpcTransport) CloseListener() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.running {
+		return nil
+	}
+	logger.Info("gRPC server no longer accepting clients")
+	return t.listener.Close()
+}
+
 // transportServer implements the gRPC service
 type transportServer struct {
 	UnimplementedTransportServiceServer
@@ -198,6 +227,7 @@ func (s *transportServer) BiStream(stream TransportService_BiStreamServer) error
 	groupPassword := getMetadataValue(md, "group-password")
 	username := getMetadataValue(md, "username")
 	password := getMetadataValue(md, "password")
+	clientVersion := getMetadataValue(md, "client-version")
 
 	if clientID == "" {
 		logger.Warn("gRPC connection rejected: missing client ID")
@@ -210,15 +240,33 @@ func (s *transportServer) BiStream(stream TransportService_BiStreamServer) error
 	if s.transport.authConfig != nil && s.transport.authConfig.Username != "" {
 		if username != s.transport.authConfig.Username || password != s.transport.authConfig.Password {
 			logger.Warn("gRPC connection rejected: invalid credentials", "client_id", clientID, "username", username)
-			return fmt.Errorf("unauthorized")
+			return status.Error(codes.Unauthenticated, "unauthorized")
 		}
 		logger.Debug("Client authentication successful", "client_id", clientID)
 	}
 
-	logger.Info("Client connected via gRPC", "client_id", clientID, "group_id", groupID)
+	sessionID := getMetadataValue(md, mdSessionID)
+	if connID := getMetadataValue(md, mdConnID); connID != "" {
+		return s.transport.serveConnStream(stream, sessionID, clientID, connID)
+	}
+
+	logger.Info("Client connected via gRPC", "client_id", clientID, "group_id", groupID, "client_version", clientVersion)
 
 	// Create connection wrapper
 	conn := newGRPCServerConnection(stream, clientID, groupID, groupPassword)
+	conn.clientVersion = clientVersion
+	conn.identity = getMetadataValue(md, "client-identity")
+
+	if getMetadataValue(md, mdStreamPerConnection) == "1" && sessionID != "" && s.transport.streamPerConnection() {
+		if err := stream.SendHeader(metadata.Pairs(mdStreamPerConnection, "1")); err != nil {
+			logger.Warn("Failed to agree on gRPC stream per connection", "client_id", clientID, "err", err)
+		} else {
+			conn.perConn.Store(true)
+			s.transport.addSession(sessionID, conn)
+			defer s.transport.removeSession(sessionID, conn)
+			logger.Debug("gRPC stream per connection enabled", "client_id", clientID)
+		}
+	}
 
 	// Call handler, let any issues surface
 	// If bugs cause panic, fix the bug rather than hide it
@@ -247,6 +295,47 @@ func (s *transportServer) BiStream(stream TransportService_BiStreamServer) error
 	return stream.Context().Err()
 }
 
+// streamPerConnection reports whether clients may use a stream per proxied connection
+func (t *grpcTransport) streamPerConnection() bool {
+	return t.authConfig != nil && t.authConfig.GRPC.StreamPerConnection
+}
+
+// addSession registers the main stream of a client using a stream per connection
+func (t *grpcTransport) addSession(sessionID string, conn *grpcConnection) {
+	t.sessionsMu.Lock()
+	defer t.sessionsMu.Unlock()
+	if t.sessions == nil {
+		t.sessions = make(map[string]*grpcConnection)
+	}
+	t.sessions[sessionID] = conn
+}
+
+// removeSession forgets a client's main stream when it ends
+func (t *grpcTransport) removeSession(sessionID string, conn *grpcConnection) {
+	t.sessionsMu.Lock()
+	defer t.sessionsMu.Unlock()
+	if t.sessions[sessionID] == conn {
+		delete(t.sessions, sessionID)
+	}
+}
+
+// serveConnStream hands the stream a client opened for a proxied connection to the client's
+// main stream, which must belong to the same client
+func (t *grpcTransport) serveConnStream(stream TransportService_BiStreamServer, sessionID, clientID, connID string) error {
+	t.sessionsMu.Lock()
+	conn := t.sessions[sessionID]
+	t.sessionsMu.Unlock()
+	if conn == nil || conn.clientID != clientID {
+		logger.Warn("gRPC connection stream rejected: unknown session", "client_id", clientID, "conn_id", connID)
+		return status.Error(codes.NotFound, "unknown session")
+	}
+	if err := conn.serveStream(connID, stream); err != nil {
+		logger.Warn("gRPC connection stream rejected", "client_id", clientID, "conn_id", connID, "err", err)
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return nil
+}
+
 // getMetadataValue extracts a single value from gRPC metadata
 func getMetadataValue(md metadata.MD, key string) string {
 	values := md.Get(key)
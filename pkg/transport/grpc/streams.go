@@ -0,0 +1,332 @@
+package grpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Metadata of the stream per connection mode. A client asks for it in the handshake of its
+// main stream, a gateway with the mode enabled agrees in the response header. The client
+// then opens a stream per proxied connection, naming the session and the connection.
+const (
+	mdStreamPerConnection = "stream-per-connection"
+	mdSessionID           = "session-id"
+	mdConnID              = "conn-id"
+)
+
+// streamAttachTimeout is how long the gateway holds messages of a connection it asked a
+// client to dial until the client opened the connection's stream
+const streamAttachTimeout = 5 * time.Second
+
+// errStreamClosed is returned for sends on a stream that was closed, the message takes the
+// main stream instead
+var errStreamClosed = errors.New("connection stream closed")
+
+// connStream is the stream of one proxied connection. Connect requests of the gateway take
+// the main stream, every other message of the connection takes its stream, so the messages
+// of a connection keep their order while a connection waiting for flow control holds up no
+// other one.
+type connStream struct {
+	mu         sync.Mutex // Serializes sends
+	stream     grpcStream // Nil until a gateway side stream is attached
+	sendClosed bool
+	closeSend  func() error       // Half-closes client streams, nil on the gateway
+	cancel     context.CancelFunc // Ends client streams, nil on the gateway
+	attached   chan struct{}      // Closed once stream is set
+}
+
+// send writes a message of the connection, closing the sending side after its last one
+func (s *connStream) send(data []byte, closing bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendClosed {
+		return errStreamClosed
+	}
+	msg := &StreamMessage{Type: StreamMessage_DATA, Data: data}
+	if err := s.stream.Send(msg); err != nil {
+		s.sendClosed = true
+		return err
+	}
+	monitoring.RecordTransportSent(protocol.TransportTypeGRPC, len(msg.Data), messageFraming(msg))
+	if closing {
+		s.closeSendLocked()
+	}
+	return nil
+}
+
+// closeSendLocked stops sending on the stream, the caller holds mu
+func (s *connStream) closeSendLocked() {
+	if s.sendClosed {
+		return
+	}
+	s.sendClosed = true
+	if s.closeSend != nil {
+		_ = s.closeSend()
+	}
+}
+
+// messageConnID returns the proxied connection a message belongs to, empty for messages of
+// the whole tunnel, and whether the message ends the connection
+func messageConnID(data []byte) (connID string, msgType byte, closing bool) {
+	_, msgType, payload, err := protocol.UnpackBinaryHeader(data)
+	if err != nil || len(payload) < protocol.ConnIDSize {
+		return "", msgType, false
+	}
+	switch msgType {
+	case protocol.BinaryMsgTypeConnect, protocol.BinaryMsgTypeConnectResponse, protocol.BinaryMsgTypeClose,
+		protocol.BinaryMsgTypeData, protocol.BinaryMsgTypePeerConnect:
+	default:
+		return "", msgType, false
+	}
+	connID = strings.TrimRight(string(payload[:protocol.ConnIDSize]), "\x00")
+	if connID == protocol.PacketConnID {
+		return "", msgType, false
+	}
+
+	switch msgType {
+	case protocol.BinaryMsgTypeClose:
+		_, writeOnly, err := protocol.UnpackCloseMessage(payload)
+		closing = err == nil && !writeOnly
+	case protocol.BinaryMsgTypeConnectResponse:
+		// A failed dial ends the connection without a close
+		closing = len(payload) > protocol.ConnIDSize && payload[protocol.ConnIDSize] == 0
+	}
+	return connID, msgType, closing
+}
+
+// newSessionID returns a random ID tying the streams of a client to its main stream
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// negotiated reports whether the connection uses a stream per proxied connection. Client
+// connections learn it from the gateway's response header, which precedes its first message.
+func (c *grpcConnection) negotiated() bool {
+	c.negotiate.Do(func() {
+		if c.header == nil {
+			return
+		}
+		if md, err := c.header(); err == nil && getMetadataValue(md, mdStreamPerConnection) == "1" {
+			c.perConn.Store(true)
+			logger.Debug("gRPC stream per connection enabled", "client_id", c.clientID)
+		}
+	})
+	return c.perConn.Load()
+}
+
+// receive delivers a message read from the main stream. Clients open the stream of a
+// connection before delivering the gateway's connect request, and read from it after.
+func (c *grpcConnection) receive(data []byte) bool {
+	if c.client == nil || !c.negotiated() {
+		return c.deliver(data)
+	}
+	connID, msgType, closing := messageConnID(data)
+	if connID == "" {
+		return c.deliver(data)
+	}
+	if msgType == protocol.BinaryMsgTypeConnect {
+		s := c.openStream(connID)
+		ok := c.deliver(data)
+		if s != nil {
+			go c.readStream(connID, s)
+		}
+		return ok
+	}
+	ok := c.deliver(data)
+	if closing {
+		c.closeStreamSend(connID)
+	}
+	return ok
+}
+
+// writeStream returns the stream a message is sent on, nil for the main stream
+func (c *grpcConnection) writeStream(data []byte) (*connStream, bool) {
+	connID, msgType, closing := messageConnID(data)
+	if connID == "" {
+		return nil, false
+	}
+
+	if c.client != nil {
+		s := c.lookupStream(connID)
+		if s == nil && msgType == protocol.BinaryMsgTypePeerConnect {
+			// Connections the client asks for start on their own stream
+			if s = c.openStream(connID); s != nil {
+				go c.readStream(connID, s)
+			}
+		}
+		return s, closing
+	}
+
+	if msgType == protocol.BinaryMsgTypeConnect {
+		c.expectStream(connID)
+		return nil, false
+	}
+	return c.awaitStream(connID), closing
+}
+
+// lookupStream returns the stream of a connection, nil when it has none
+func (c *grpcConnection) lookupStream(connID string) *connStream {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	return c.streams[connID]
+}
+
+// removeStream forgets the stream of a connection, unless it was replaced meanwhile
+func (c *grpcConnection) removeStream(connID string, s *connStream) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if c.streams[connID] == s {
+		delete(c.streams, connID)
+	}
+}
+
+// openStream opens the stream of a connection on a client, nil when that fails and the
+// connection stays on the main stream
+func (c *grpcConnection) openStream(connID string) *connStream {
+	ctx, cancel := context.WithCancel(c.ctx)
+	md := c.md.Copy()
+	md.Set(mdConnID, connID)
+	stream, err := c.client.BiStream(metadata.NewOutgoingContext(ctx, md))
+	if err != nil {
+		cancel()
+		logger.Warn("Failed to open gRPC stream for connection, using the main stream", "client_id", c.clientID, "conn_id", connID, "err", err)
+		return nil
+	}
+
+	attached := make(chan struct{})
+	close(attached)
+	s := &connStream{stream: stream, closeSend: stream.CloseSend, cancel: cancel, attached: attached}
+	c.streamsMu.Lock()
+	c.streams[connID] = s
+	c.streamsMu.Unlock()
+	return s
+}
+
+// readStream delivers the messages of a client's connection stream until the gateway ends it
+func (c *grpcConnection) readStream(connID string, s *connStream) {
+	defer func() {
+		c.removeStream(connID, s)
+		s.cancel()
+	}()
+	for {
+		msg, err := s.stream.Recv()
+		if err != nil {
+			return
+		}
+		monitoring.RecordTransportReceived(protocol.TransportTypeGRPC, len(msg.Data), messageFraming(msg))
+		if !c.deliver(msg.Data) {
+			return
+		}
+		if _, _, closing := messageConnID(msg.Data); closing {
+			c.closeStreamSend(connID)
+		}
+	}
+}
+
+// closeStreamSend half-closes the stream of an ended connection, the gateway then ends it
+func (c *grpcConnection) closeStreamSend(connID string) {
+	if s := c.lookupStream(connID); s != nil {
+		s.mu.Lock()
+		s.closeSendLocked()
+		s.mu.Unlock()
+	}
+}
+
+// expectStream notes on the gateway that the client opens a stream for the connection
+func (c *grpcConnection) expectStream(connID string) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if _, ok := c.streams[connID]; !ok {
+		c.streams[connID] = &connStream{attached: make(chan struct{})}
+	}
+}
+
+// awaitStream returns the stream of a connection on the gateway, waiting for the client to
+// open an expected one. Nil when the connection has none, or the client didn't open it.
+func (c *grpcConnection) awaitStream(connID string) *connStream {
+	s := c.lookupStream(connID)
+	if s == nil {
+		return nil
+	}
+	timer := time.NewTimer(streamAttachTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.attached:
+		return s
+	case <-timer.C:
+		logger.Warn("Client did not open gRPC stream for connection, using the main stream", "client_id", c.clientID, "conn_id", connID)
+	case <-c.ctx.Done():
+	}
+
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	select {
+	case <-s.attached:
+		return s
+	default:
+		if c.streams[connID] == s {
+			delete(c.streams, connID)
+		}
+		return nil
+	}
+}
+
+// serveStream serves the stream a client opened for a connection on the gateway, until the
+// client half-closes it or the main stream ends
+func (c *grpcConnection) serveStream(connID string, stream grpcStream) error {
+	c.streamsMu.Lock()
+	s, ok := c.streams[connID]
+	if ok && s.stream != nil {
+		c.streamsMu.Unlock()
+		return errors.New("connection stream already open")
+	}
+	if !ok {
+		// Connections the client asked for have no expected stream
+		s = &connStream{attached: make(chan struct{})}
+		c.streams[connID] = s
+	}
+	s.mu.Lock()
+	s.stream = stream
+	s.mu.Unlock()
+	close(s.attached)
+	c.streamsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			monitoring.RecordTransportReceived(protocol.TransportTypeGRPC, len(msg.Data), messageFraming(msg))
+			if !c.deliver(msg.Data) {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-c.ctx.Done():
+	}
+
+	// Sends fail once the handler returned, later messages take the main stream
+	s.mu.Lock()
+	s.sendClosed = true
+	s.mu.Unlock()
+	c.removeStream(connID, s)
+	return nil
+}
@@ -0,0 +1,144 @@
+package grpc
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// startStreamPair connects a client to a gateway, both with stream_per_connection as given
+func startStreamPair(t *testing.T, gatewayPerConn, clientPerConn bool) (gatewayConn, clientConn *grpcConnection) {
+	server := NewGRPCTransportWithAuth(&transport.AuthConfig{GRPC: config.GRPCConfig{StreamPerConnection: gatewayPerConn}})
+	accepted := make(chan transport.Connection, 1)
+	if err := server.ListenAndServe("127.0.0.1:0", func(conn transport.Connection) {
+		accepted <- conn
+		<-conn.(*grpcConnection).ctx.Done()
+	}); err != nil {
+		t.Fatalf("ListenAndServe() error = %v", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	client := NewGRPCTransportWithAuth(&transport.AuthConfig{GRPC: config.GRPCConfig{StreamPerConnection: clientPerConn}})
+	conn, err := client.DialWithConfig(server.(*grpcTransport).listener.Addr().String(), &transport.ClientConfig{ClientID: "test-client", GroupID: "test-group"})
+	if err != nil {
+		t.Fatalf("DialWithConfig() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	select {
+	case gw := <-accepted:
+		return gw.(*grpcConnection), conn.(*grpcConnection)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Gateway did not accept the client")
+	}
+	return nil, nil
+}
+
+// expectMessage reads the next message and compares it
+func expectMessage(t *testing.T, conn transport.Connection, want []byte) {
+	t.Helper()
+	got, err := conn.ReadMessage()
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("ReadMessage() = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestStreamPerConnection(t *testing.T) {
+	gateway, client := startStreamPair(t, true, true)
+	const connID = "cn0123456789abcdefgh"
+
+	// The first message makes the client check the gateway's answer
+	connect := protocol.PackConnectMessage(connID, "tcp", "example.com:80")
+	if err := gateway.WriteMessage(connect); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, client, connect)
+	if !client.perConn.Load() || !gateway.perConn.Load() {
+		t.Fatal("Expected both sides to use a stream per connection")
+	}
+	if client.lookupStream(connID) == nil {
+		t.Fatal("Expected the client to open the connection's stream")
+	}
+
+	response := protocol.PackConnectResponseMessage(connID, true, "")
+	data := protocol.PackDataMessage(connID, []byte("request"))
+	for _, msg := range [][]byte{response, data} {
+		if err := client.WriteMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+		expectMessage(t, gateway, msg)
+	}
+	if s := gateway.lookupStream(connID); s == nil || s.stream == nil {
+		t.Fatal("Expected the gateway to receive on the connection's stream")
+	}
+
+	reply := protocol.PackDataMessage(connID, []byte("response"))
+	if err := gateway.WriteMessage(reply); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, client, reply)
+
+	// A close ends the stream on both sides, tunnel messages keep the main stream
+	closeMsg := protocol.PackCloseMessage(connID)
+	if err := client.WriteMessage(closeMsg); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, gateway, closeMsg)
+	deadline := time.Now().Add(5 * time.Second)
+	for gateway.lookupStream(connID) != nil || client.lookupStream(connID) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the connection's stream to end after the close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	heartbeat := protocol.PackHeartbeatMessage([]byte(`{}`))
+	if err := client.WriteMessage(heartbeat); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, gateway, heartbeat)
+}
+
+func TestStreamPerConnection_GatewayDisabled(t *testing.T) {
+	gateway, client := startStreamPair(t, false, true)
+	const connID = "cn0123456789abcdefgh"
+
+	connect := protocol.PackConnectMessage(connID, "tcp", "example.com:80")
+	if err := gateway.WriteMessage(connect); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, client, connect)
+	if client.perConn.Load() || client.lookupStream(connID) != nil {
+		t.Fatal("Expected the client to keep the main stream")
+	}
+	data := protocol.PackDataMessage(connID, []byte("request"))
+	if err := client.WriteMessage(data); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, gateway, data)
+}
+
+func TestMessageConnID(t *testing.T) {
+	const connID = "cn0123456789abcdefgh"
+	tests := []struct {
+		name    string
+		msg     []byte
+		connID  string
+		closing bool
+	}{
+		{"data", protocol.PackDataMessage(connID, []byte("x")), connID, false},
+		{"close", protocol.PackCloseMessage(connID), connID, true},
+		{"half-close", protocol.PackCloseWriteMessage(connID), connID, false},
+		{"failed dial", protocol.PackConnectResponseMessage(connID, false, "refused"), connID, true},
+		{"tun packets", protocol.PackDataMessage(protocol.PacketConnID, []byte("x")), "", false},
+		{"heartbeat", protocol.PackHeartbeatMessage([]byte(`{}`)), "", false},
+	}
+	for _, tt := range tests {
+		if got, _, closing := messageConnID(tt.msg); got != tt.connID || closing != tt.closing {
+			t.Errorf("%s: messageConnID() = %q, %v, want %q, %v", tt.name, got, closing, tt.connID, tt.closing)
+		}
+	}
+}
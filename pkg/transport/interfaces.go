@@ -3,13 +3,23 @@ package transport
 
 import (
 	"crypto/tls"
+	"errors"
 	"net"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
 )
 
-// AuthConfig authentication configuration
+// ErrAuthFailed is returned by DialWithConfig when the gateway rejects the transport credentials
+var ErrAuthFailed = errors.New("authentication failed")
+
+// AuthConfig authentication configuration, plus tuning for transports that need it
 type AuthConfig struct {
 	Username string
 	Password string
+	KCP      config.KCPConfig  // Used by the kcp transport
+	GRPC     config.GRPCConfig // Used by the grpc transport
+	// Binds the server listener with SO_REUSEPORT so another gateway process can share it (TCP transports)
+	ReusePort bool
 }
 
 // Transport interface - minimalist design to support multiple transport protocols
@@ -23,6 +33,12 @@ type Transport interface {
 	Close() error
 }
 
+// ListenerCloser is implemented by transports that can stop accepting clients while the
+// connected ones keep being served
+type ListenerCloser interface {
+	CloseListener() error
+}
+
 // Connection interface - simplified connection abstraction
 type Connection interface {
 	// Write message (binary data)
@@ -36,7 +52,13 @@ type Connection interface {
 	// Client information - must be implemented by all transport layers
 	GetClientID() string
 	GetGroupID() string
-	GetPassword() string // Get the client password for group credential management
+	GetPassword() string      // Get the client password for group credential management
+	GetClientVersion() string // Client build version sent in the handshake, empty for older clients
+}
+
+// IdentityConnection is implemented by server side connections that carry a client identity proof
+type IdentityConnection interface {
+	GetClientIdentity() string // Identity proof sent in the handshake, empty when the client has no identity key
 }
 
 // ClientConfig client configuration
@@ -46,6 +68,8 @@ type ClientConfig struct {
 	Password      string // Gateway authentication password
 	GroupID       string
 	GroupPassword string // Client group password for proxy authentication
+	Version       string // Client build version sent in the handshake
+	Identity      string // Client identity proof sent in the handshake, see pkg/common/identity
 	TLSCert       string
 	TLSConfig     *tls.Config
 	SkipVerify    bool
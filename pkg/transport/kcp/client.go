@@ -0,0 +1,134 @@
+// Package kcp provides a KCP (reliable UDP) transport implementation for AnyProxy,
+// for clients on high-latency, lossy links where TCP throughput collapses.
+package kcp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// Tuning defaults
+const (
+	defaultWindow = 1024
+	defaultMTU    = 1350
+)
+
+// noDelaySettings are the kcp nodelay, interval (ms), resend and no-congestion parameters of each mode
+var noDelaySettings = map[string][4]int{
+	config.KCPModeNormal: {0, 40, 2, 1},
+	config.KCPModeFast:   {0, 30, 2, 1},
+	config.KCPModeFast2:  {1, 20, 2, 1},
+	config.KCPModeFast3:  {1, 10, 2, 1},
+}
+
+// resolveTuning fills in defaults for unset values
+func resolveTuning(tuning config.KCPConfig) config.KCPConfig {
+	if tuning.Mode == "" {
+		tuning.Mode = config.KCPModeFast
+	}
+	if tuning.SendWindow == 0 {
+		tuning.SendWindow = defaultWindow
+	}
+	if tuning.ReceiveWindow == 0 {
+		tuning.ReceiveWindow = defaultWindow
+	}
+	if tuning.MTU == 0 {
+		tuning.MTU = defaultMTU
+	}
+	return tuning
+}
+
+// applyTuning configures a session, tuning must be resolved
+func applyTuning(session *kcp.UDPSession, tuning config.KCPConfig) {
+	nd := noDelaySettings[tuning.Mode]
+	session.SetStreamMode(true)
+	session.SetWriteDelay(false)
+	session.SetNoDelay(nd[0], nd[1], nd[2], nd[3])
+	session.SetWindowSize(tuning.SendWindow, tuning.ReceiveWindow)
+	session.SetMtu(tuning.MTU)
+}
+
+// dialKCPWithConfig connects to the gateway, secures the session with TLS when configured and authenticates
+func (t *kcpTransport) dialKCPWithConfig(addr string, config *transport.ClientConfig) (transport.Connection, error) {
+	tuning := resolveTuning(t.tuning)
+	logger.Info("Connecting to KCP endpoint", "client_id", config.ClientID, "addr", addr, "mode", tuning.Mode, "data_shards", tuning.DataShards, "parity_shards", tuning.ParityShards)
+
+	session, err := kcp.DialWithOptions(addr, nil, tuning.DataShards, tuning.ParityShards)
+	if err != nil {
+		logger.Error("Failed to connect to KCP server", "client_id", config.ClientID, "addr", addr, "err", err)
+		return nil, fmt.Errorf("failed to connect to KCP server: %w", err)
+	}
+	applyTuning(session, tuning)
+
+	var conn net.Conn = session
+	if config.TLSConfig != nil {
+		tlsConfig := config.TLSConfig
+		if tlsConfig.ServerName == "" {
+			// Verify the gateway host like HTTP-based transports do
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(session, tlsConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			_ = session.Close()
+			logger.Error("KCP TLS handshake failed", "client_id", config.ClientID, "addr", addr, "err", err)
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	if err := authenticateClient(conn, config); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	logger.Info("KCP connection established successfully", "client_id", config.ClientID, "group_id", config.GroupID)
+	return newKCPConnection(conn, config.ClientID, config.GroupID, config.GroupPassword, config.Version, 0), nil
+}
+
+// authenticateClient sends the auth message and waits for the gateway's response
+func authenticateClient(conn net.Conn, config *transport.ClientConfig) error {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	authData := protocol.PackAuthMessage(config.ClientID, config.GroupID, config.Username, config.Password, config.GroupPassword, config.Version, config.Identity)
+	if err := writeFrame(conn, authData); err != nil {
+		return fmt.Errorf("failed to send auth message: %w", err)
+	}
+
+	responseData, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read auth response: %w", err)
+	}
+	if !protocol.IsBinaryMessage(responseData) {
+		return fmt.Errorf("received non-binary auth response")
+	}
+	_, msgType, data, err := protocol.UnpackBinaryHeader(responseData)
+	if err != nil {
+		return fmt.Errorf("failed to unpack auth response: %w", err)
+	}
+	if msgType != protocol.BinaryMsgTypeAuthResponse {
+		return fmt.Errorf("unexpected message type: 0x%02x", msgType)
+	}
+	status, reason, err := protocol.UnpackAuthResponseMessage(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse auth response: %w", err)
+	}
+	if status != authStatusSuccess {
+		if reason == "" {
+			reason = "unknown"
+		}
+		return fmt.Errorf("%w: %s", transport.ErrAuthFailed, reason)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// maxMessageSize limits a single length-prefixed message
+const maxMessageSize = protocol.MaxMessageSize
+
+// kcpConnection implements transport.Connection over a KCP session, optionally wrapped in TLS
+type kcpConnection struct {
+	conn          net.Conn
+	clientID      string
+	groupID       string
+	groupPassword string
+	clientVersion string
+	identity      string        // Client identity proof, only set on the server side
+	idleTimeout   time.Duration // Read deadline per message, 0 waits forever
+
+	writeMu   transport.LaneMutex // Control messages before data
+	closeOnce sync.Once
+}
+
+var _ transport.Connection = (*kcpConnection)(nil)
+
+// newKCPConnection wraps an authenticated connection
+func newKCPConnection(conn net.Conn, clientID, groupID, groupPassword, clientVersion string, idleTimeout time.Duration) *kcpConnection {
+	return &kcpConnection{
+		conn:          conn,
+		clientID:      clientID,
+		groupID:       groupID,
+		groupPassword: groupPassword,
+		clientVersion: clientVersion,
+		idleTimeout:   idleTimeout,
+	}
+}
+
+// writeFrame writes data with a 4-byte length prefix in a single write
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("message too large: %d bytes", len(data))
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data))) //nolint:gosec // bounded by maxMessageSize
+	copy(frame[4:], data)
+	if _, err := w.Write(frame); err != nil {
+		return err
+	}
+	monitoring.RecordTransportSent(protocol.TransportTypeKCP, len(data), 4)
+	return nil
+}
+
+// readFrame reads one length-prefixed message
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if err := protocol.CheckMessageSize(int(length)); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("read data: %w", err)
+	}
+	monitoring.RecordTransportReceived(protocol.TransportTypeKCP, len(data), 4)
+	return data, nil
+}
+
+// WriteMessage implements transport.Connection
+func (c *kcpConnection) WriteMessage(data []byte) error {
+	c.writeMu.Lock(transport.IsControlMessage(data))
+	defer c.writeMu.Unlock()
+	if err := writeFrame(c.conn, data); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	return nil
+}
+
+// ReadMessage implements transport.Connection
+func (c *kcpConnection) ReadMessage() ([]byte, error) {
+	if c.idleTimeout > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+	return readFrame(c.conn)
+}
+
+// Close implements transport.Connection
+func (c *kcpConnection) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// RemoteAddr implements transport.Connection
+func (c *kcpConnection) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// LocalAddr implements transport.Connection
+func (c *kcpConnection) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// GetClientID gets client ID - for upper layer code to extract client information
+func (c *kcpConnection) GetClientID() string {
+	return c.clientID
+}
+
+// GetGroupID gets group ID - for upper layer code to extract client information
+func (c *kcpConnection) GetGroupID() string {
+	return c.groupID
+}
+
+// GetPassword gets password - for upper layer code to extract client information
+func (c *kcpConnection) GetPassword() string {
+	return c.groupPassword
+}
+
+// GetClientVersion returns the client build version
+func (c *kcpConnection) GetClientVersion() string {
+	return c.clientVersion
+}
+
+// GetClientIdentity returns the client identity proof
+func (c *kcpConnection) GetClientIdentity() string {
+	return c.identity
+}
@@ -0,0 +1,171 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// generateTestTLS returns a server config with a self-signed certificate for 127.0.0.1 and a client config trusting it
+func generateTestTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Test"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return serverConfig, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+}
+
+func TestResolveTuning(t *testing.T) {
+	tuning := resolveTuning(config.KCPConfig{DataShards: 10, ParityShards: 3})
+	if tuning.Mode != config.KCPModeFast || tuning.SendWindow != defaultWindow || tuning.ReceiveWindow != defaultWindow || tuning.MTU != defaultMTU {
+		t.Errorf("Unexpected defaults %+v", tuning)
+	}
+	if tuning.DataShards != 10 || tuning.ParityShards != 3 {
+		t.Errorf("FEC settings changed: %+v", tuning)
+	}
+	for _, mode := range []string{config.KCPModeNormal, config.KCPModeFast, config.KCPModeFast2, config.KCPModeFast3} {
+		if _, ok := noDelaySettings[mode]; !ok {
+			t.Errorf("Missing nodelay settings for mode %s", mode)
+		}
+	}
+}
+
+func TestKCPTransport_RoundTrip(t *testing.T) {
+	serverTLS, clientTLS := generateTestTLS(t)
+
+	tests := []struct {
+		name      string
+		serverTLS *tls.Config
+		clientTLS *tls.Config
+	}{
+		{"plain", nil, nil},
+		{"tls", serverTLS, clientTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authConfig := &transport.AuthConfig{
+				Username: "user",
+				Password: "pass",
+				KCP:      config.KCPConfig{Mode: config.KCPModeFast3, DataShards: 10, ParityShards: 3},
+			}
+			server := NewKCPTransportWithAuth(authConfig)
+			accepted := make(chan transport.Connection, 1)
+			handler := func(conn transport.Connection) {
+				accepted <- conn
+				for {
+					data, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					if err := conn.WriteMessage(data); err != nil {
+						return
+					}
+				}
+			}
+			var err error
+			if tt.serverTLS != nil {
+				err = server.ListenAndServeWithTLS("127.0.0.1:0", handler, tt.serverTLS)
+			} else {
+				err = server.ListenAndServe("127.0.0.1:0", handler)
+			}
+			if err != nil {
+				t.Fatalf("listen error = %v", err)
+			}
+			defer server.Close()
+			addr := server.(*kcpTransport).listener.Addr().String()
+
+			client := NewKCPTransportWithAuth(authConfig)
+			clientConfig := &transport.ClientConfig{
+				ClientID:      "client-1",
+				GroupID:       "group-1",
+				GroupPassword: "secret",
+				Version:       "v1.2.3",
+				Username:      "user",
+				Password:      "wrong",
+				TLSConfig:     tt.clientTLS,
+			}
+			if _, err := client.DialWithConfig(addr, clientConfig); err == nil || !strings.Contains(err.Error(), "invalid credentials") {
+				t.Fatalf("Expected invalid credentials, got %v", err)
+			}
+
+			clientConfig.Password = "pass"
+			conn, err := client.DialWithConfig(addr, clientConfig)
+			if err != nil {
+				t.Fatalf("DialWithConfig() error = %v", err)
+			}
+			defer conn.Close()
+
+			var serverConn transport.Connection
+			select {
+			case serverConn = <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Server did not accept the connection")
+			}
+			if serverConn.GetClientID() != "client-1" || serverConn.GetGroupID() != "group-1" ||
+				serverConn.GetPassword() != "secret" || serverConn.GetClientVersion() != "v1.2.3" {
+				t.Errorf("Unexpected client info %q %q %q %q", serverConn.GetClientID(), serverConn.GetGroupID(), serverConn.GetPassword(), serverConn.GetClientVersion())
+			}
+
+			for _, msg := range [][]byte{[]byte("hello"), {}, make([]byte, 256*1024)} {
+				if err := conn.WriteMessage(msg); err != nil {
+					t.Fatalf("WriteMessage() error = %v", err)
+				}
+				got, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage() error = %v", err)
+				}
+				if string(got) != string(msg) {
+					t.Errorf("Echo returned %d bytes, want %d", len(got), len(msg))
+				}
+			}
+		})
+	}
+}
+
+func TestReadFrame_TooLarge(t *testing.T) {
+	// Only the length prefix is sent, the frame must be refused before its buffer is allocated
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, protocol.MaxMessageSize+1)
+	if _, err := readFrame(bytes.NewReader(header)); !errors.Is(err, protocol.ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
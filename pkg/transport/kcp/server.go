@@ -0,0 +1,226 @@
+package kcp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/tlsfp"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+const (
+	authStatusSuccess = "success"
+	authStatusFailed  = "failed"
+	// handshakeTimeout bounds the TLS handshake and authentication exchange
+	handshakeTimeout = 10 * time.Second
+	// serverIdleTimeout closes gateway connections that receive nothing, KCP has no keepalive of its own
+	serverIdleTimeout = 5 * time.Minute
+	// socketBufferSize is the UDP socket buffer size of the listener
+	socketBufferSize = 4 * 1024 * 1024
+)
+
+// kcpTransport implements the Transport interface for KCP over UDP
+type kcpTransport struct {
+	listener   *kcp.Listener
+	handler    func(transport.Connection)
+	tlsConfig  *tls.Config
+	mu         sync.Mutex
+	running    bool
+	authConfig *transport.AuthConfig
+	tuning     config.KCPConfig
+}
+
+var _ transport.Transport = (*kcpTransport)(nil)
+
+// NewKCPTransport creates a new KCP transport with default tuning
+func NewKCPTransport() transport.Transport {
+	return &kcpTransport{}
+}
+
+// NewKCPTransportWithAuth creates a new KCP transport with authentication and the configured tuning
+func NewKCPTransportWithAuth(authConfig *transport.AuthConfig) transport.Transport {
+	t := &kcpTransport{authConfig: authConfig}
+	if authConfig != nil {
+		t.tuning = authConfig.KCP
+	}
+	return t
+}
+
+// ListenAndServe implements Transport interface - serves KCP without TLS
+func (t *kcpTransport) ListenAndServe(addr string, handler func(transport.Connection)) error {
+	return t.listenAndServe(addr, handler, nil)
+}
+
+// ListenAndServeWithTLS implements Transport interface - serves KCP with TLS on every session
+func (t *kcpTransport) ListenAndServeWithTLS(addr string, handler func(transport.Connection), tlsConfig *tls.Config) error {
+	return t.listenAndServe(addr, handler, tlsConfig)
+}
+
+// listenAndServe unified server startup logic
+func (t *kcpTransport) listenAndServe(addr string, handler func(transport.Connection), tlsConfig *tls.Config) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.running {
+		return nil
+	}
+
+	t.handler = handler
+	t.tlsConfig = tlsConfig
+
+	tuning := resolveTuning(t.tuning)
+	logger.Info("Starting KCP server", "listen_addr", addr, "tls", tlsConfig != nil, "mode", tuning.Mode,
+		"data_shards", tuning.DataShards, "parity_shards", tuning.ParityShards, "send_window", tuning.SendWindow, "receive_window", tuning.ReceiveWindow, "mtu", tuning.MTU)
+
+	listener, err := kcp.ListenWithOptions(addr, nil, tuning.DataShards, tuning.ParityShards)
+	if err != nil {
+		logger.Error("Failed to create KCP listener", "addr", addr, "err", err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if err := listener.SetReadBuffer(socketBufferSize); err != nil {
+		logger.Warn("Failed to set KCP read buffer", "err", err)
+	}
+	if err := listener.SetWriteBuffer(socketBufferSize); err != nil {
+		logger.Warn("Failed to set KCP write buffer", "err", err)
+	}
+	t.listener = listener
+
+	go func() {
+		for {
+			session, err := listener.AcceptKCP()
+			if err != nil {
+				logger.Debug("KCP server accept loop stopped", "err", err)
+				return
+			}
+			applyTuning(session, tuning)
+			go t.handleConnection(session)
+		}
+	}()
+
+	t.running = true
+	logger.Info("KCP server started successfully", "addr", listener.Addr())
+	return nil
+}
+
+// handleConnection secures and authenticates a new KCP session, then serves it
+func (t *kcpTransport) handleConnection(session *kcp.UDPSession) {
+	logger.Debug("New KCP session accepted", "remote_addr", session.RemoteAddr())
+
+	var conn net.Conn = session
+	if t.tlsConfig != nil {
+		tlsConn := tls.Server(tlsfp.NewConn(session), t.tlsConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warn("KCP TLS handshake failed", "remote_addr", session.RemoteAddr(), "err", err)
+			_ = session.Close()
+			return
+		}
+		conn = tlsConn
+	}
+
+	clientID, groupID, groupPassword, clientVersion, identity, err := t.authenticateConnection(conn)
+	if err != nil {
+		logger.Warn("KCP connection rejected during authentication", "remote_addr", session.RemoteAddr(), "err", err)
+		_ = conn.Close()
+		return
+	}
+
+	logger.Info("Client connected via KCP", "client_id", clientID, "group_id", groupID, "client_version", clientVersion, "remote_addr", session.RemoteAddr())
+
+	kcpConn := newKCPConnection(conn, clientID, groupID, groupPassword, clientVersion, serverIdleTimeout)
+	kcpConn.identity = identity
+
+	defer func() {
+		if err := kcpConn.Close(); err != nil {
+			logger.Warn("Error closing KCP connection", "err", err)
+		}
+		logger.Info("Client disconnected from KCP", "client_id", clientID, "group_id", groupID)
+	}()
+
+	t.handler(kcpConn)
+}
+
+// authenticateConnection reads the client's auth message and answers it
+func (t *kcpTransport) authenticateConnection(conn net.Conn) (clientID, groupID, password, clientVersion, identity string, err error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	authData, err := readFrame(conn)
+	if err != nil {
+		return "", "", "", "", "", fmt.Errorf("failed to read auth message: %w", err)
+	}
+	if !protocol.IsBinaryMessage(authData) {
+		return "", "", "", "", "", fmt.Errorf("received non-binary auth message")
+	}
+	_, msgType, data, err := protocol.UnpackBinaryHeader(authData)
+	if err != nil {
+		return "", "", "", "", "", fmt.Errorf("failed to unpack auth message: %w", err)
+	}
+	if msgType != protocol.BinaryMsgTypeAuth {
+		return "", "", "", "", "", fmt.Errorf("expected auth message, got: 0x%02x", msgType)
+	}
+
+	clientID, groupID, username, password, groupPassword, clientVersion, identity, err := protocol.UnpackAuthMessage(data)
+	if err != nil {
+		return "", "", "", "", "", fmt.Errorf("failed to parse auth message: %w", err)
+	}
+	if clientID == "" {
+		return "", "", "", "", "", fmt.Errorf("missing client_id")
+	}
+
+	// Gateway transport layer auth
+	responseStatus, responseReason := authStatusSuccess, ""
+	if t.authConfig != nil && t.authConfig.Username != "" &&
+		(username != t.authConfig.Username || password != t.authConfig.Password) {
+		responseStatus, responseReason = authStatusFailed, "invalid credentials"
+	}
+	if err := writeFrame(conn, protocol.PackAuthResponseMessage(responseStatus, responseReason)); err != nil {
+		return "", "", "", "", "", fmt.Errorf("failed to send auth response: %w", err)
+	}
+	if responseStatus != authStatusSuccess {
+		return "", "", "", "", "", errors.New(responseReason)
+	}
+
+	logger.Debug("KCP authentication completed successfully", "client_id", clientID, "group_id", groupID)
+	return clientID, groupID, groupPassword, clientVersion, identity, nil
+}
+
+// DialWithConfig implements Transport interface - client connection
+func (t *kcpTransport) DialWithConfig(addr string, config *transport.ClientConfig) (transport.Connection, error) {
+	logger.Debug("KCP transport dialing with config", "addr", addr, "client_id", config.ClientID, "group_id", config.GroupID, "tls_enabled", config.TLSConfig != nil)
+
+	return t.dialKCPWithConfig(addr, config)
+}
+
+// Close implements Transport interface
+func (t *kcpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.running {
+		return nil
+	}
+
+	logger.Info("Stopping KCP server")
+	err := t.listener.Close()
+	if err != nil {
+		logger.Warn("Error closing KCP listener", "err", err)
+	}
+
+	t.running = false
+	logger.Info("KCP server stopped successfully")
+	return err
+}
+
+func init() {
+	transport.RegisterTransportCreator(protocol.TransportTypeKCP, NewKCPTransportWithAuth)
+}
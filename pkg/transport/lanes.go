@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+)
+
+// Messages of a connection are written on two lanes. Control messages (connects, closes,
+// heartbeats, port forwards) go ahead of queued data messages, so they never wait behind
+// megabytes of data of other proxied connections. WriteMessage returns once its message is
+// written, the messages of one writer keep their order across lanes.
+
+// ControlQueueSize is the length of the control lane queue of queued transports
+const ControlQueueSize = 100
+
+// IsControlMessage reports whether a binary message takes the control lane, every message but
+// data does
+func IsControlMessage(data []byte) bool {
+	return len(data) < 2 || data[1] != protocol.BinaryMsgTypeData
+}
+
+// LaneMutex serializes writes like a sync.Mutex, letting waiting control writers in before
+// waiting data writers. The zero value is unlocked.
+type LaneMutex struct {
+	mu             sync.Mutex
+	cond           *sync.Cond
+	held           bool
+	controlWaiting int
+}
+
+// Lock acquires the lock, control writers before data writers
+func (l *LaneMutex) Lock(control bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+	if control {
+		l.controlWaiting++
+		for l.held {
+			l.cond.Wait()
+		}
+		l.controlWaiting--
+	} else {
+		for l.held || l.controlWaiting > 0 {
+			l.cond.Wait()
+		}
+	}
+	l.held = true
+}
+
+// Unlock releases the lock
+func (l *LaneMutex) Unlock() {
+	l.mu.Lock()
+	l.held = false
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+)
+
+func TestIsControlMessage(t *testing.T) {
+	const connID = "cn0123456789abcdefgh"
+	tests := []struct {
+		name string
+		msg  []byte
+		want bool
+	}{
+		{"data", protocol.PackDataMessage(connID, []byte("x")), false},
+		{"tun packets", protocol.PackDataMessage(protocol.PacketConnID, []byte("x")), false},
+		{"connect", protocol.PackConnectMessage(connID, "tcp", "example.com:80"), true},
+		{"close", protocol.PackCloseMessage(connID), true},
+		{"heartbeat", protocol.PackHeartbeatMessage([]byte(`{}`)), true},
+		{"short", []byte{protocol.BinaryProtocolVersion}, true},
+	}
+	for _, tt := range tests {
+		if got := IsControlMessage(tt.msg); got != tt.want {
+			t.Errorf("%s: IsControlMessage() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLaneMutex_ControlFirst(t *testing.T) {
+	var l LaneMutex
+	l.Lock(false)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	acquire := func(name string, control bool) {
+		defer wg.Done()
+		l.Lock(control)
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+		l.Unlock()
+	}
+
+	wg.Add(1)
+	go acquire("data", false)
+	time.Sleep(20 * time.Millisecond)
+	wg.Add(1)
+	go acquire("control", true)
+	time.Sleep(20 * time.Millisecond)
+
+	l.Unlock()
+	wg.Wait()
+	if len(order) != 2 || order[0] != "control" {
+		t.Fatalf("Lock order = %v, want the control writer first", order)
+	}
+}
@@ -0,0 +1,148 @@
+package memory
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// queueSize is the number of messages buffered per direction, like a socket buffer
+const queueSize = 1024
+
+// memoryAddr is the address of an in-memory endpoint
+type memoryAddr string
+
+// Network implements net.Addr
+func (a memoryAddr) Network() string { return "memory" }
+
+// String implements net.Addr
+func (a memoryAddr) String() string { return string(a) }
+
+// memoryConnection implements transport.Connection over channels shared with the peer
+type memoryConnection struct {
+	readCh        <-chan []byte
+	writeCh       chan<- []byte
+	closed        chan struct{} // Shared by both ends
+	closeOnce     *sync.Once
+	localAddr     net.Addr
+	remoteAddr    net.Addr
+	clientID      string
+	groupID       string
+	groupPassword string
+	clientVersion string
+	identity      string
+}
+
+var _ transport.Connection = (*memoryConnection)(nil)
+
+// newPipe returns the client and gateway ends of a connection
+func newPipe(addr string, config *transport.ClientConfig) (client, server *memoryConnection) {
+	toServer := make(chan []byte, queueSize)
+	toClient := make(chan []byte, queueSize)
+	closed := make(chan struct{})
+	closeOnce := &sync.Once{}
+	clientAddr := memoryAddr(config.ClientID)
+
+	client = &memoryConnection{
+		readCh:     toClient,
+		writeCh:    toServer,
+		closed:     closed,
+		closeOnce:  closeOnce,
+		localAddr:  clientAddr,
+		remoteAddr: memoryAddr(addr),
+	}
+	server = &memoryConnection{
+		readCh:     toServer,
+		writeCh:    toClient,
+		closed:     closed,
+		closeOnce:  closeOnce,
+		localAddr:  memoryAddr(addr),
+		remoteAddr: clientAddr,
+	}
+	for _, conn := range []*memoryConnection{client, server} {
+		conn.clientID = config.ClientID
+		conn.groupID = config.GroupID
+		conn.groupPassword = config.GroupPassword
+		conn.clientVersion = config.Version
+		conn.identity = config.Identity
+	}
+	return client, server
+}
+
+// WriteMessage implements transport.Connection
+func (c *memoryConnection) WriteMessage(data []byte) error {
+	// The caller may reuse data once the write returns
+	msg := make([]byte, len(data))
+	copy(msg, data)
+
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case c.writeCh <- msg:
+		monitoring.RecordTransportSent(protocol.TransportTypeMemory, len(msg), 0)
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// ReadMessage implements transport.Connection
+func (c *memoryConnection) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-c.readCh:
+		monitoring.RecordTransportReceived(protocol.TransportTypeMemory, len(msg), 0)
+		return msg, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+// Close implements transport.Connection, closing both ends
+func (c *memoryConnection) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// RemoteAddr implements transport.Connection
+func (c *memoryConnection) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// LocalAddr implements transport.Connection
+func (c *memoryConnection) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// GetClientID gets client ID - for upper layer code to extract client information
+func (c *memoryConnection) GetClientID() string {
+	return c.clientID
+}
+
+// GetGroupID gets group ID - for upper layer code to extract client information
+func (c *memoryConnection) GetGroupID() string {
+	return c.groupID
+}
+
+// GetPassword gets password - for upper layer code to extract client information
+func (c *memoryConnection) GetPassword() string {
+	return c.groupPassword
+}
+
+// GetClientVersion returns the client build version
+func (c *memoryConnection) GetClientVersion() string {
+	return c.clientVersion
+}
+
+// GetClientIdentity returns the client identity proof
+func (c *memoryConnection) GetClientIdentity() string {
+	return c.identity
+}
@@ -0,0 +1,99 @@
+package memory
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+func TestMemoryTransport_RoundTrip(t *testing.T) {
+	server := NewMemoryTransportWithAuth(&transport.AuthConfig{Username: "user", Password: "pass"})
+	accepted := make(chan transport.Connection, 1)
+	err := server.ListenAndServe("test-roundtrip", func(conn transport.Connection) {
+		accepted <- conn
+		for {
+			data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(data); err != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("ListenAndServe() error = %v", err)
+	}
+	defer server.Close()
+
+	if err := NewMemoryTransport().ListenAndServe("test-roundtrip", func(transport.Connection) {}); err == nil {
+		t.Error("Expected address already in use")
+	}
+
+	client := NewMemoryTransport()
+	clientConfig := &transport.ClientConfig{
+		ClientID:      "client-1",
+		GroupID:       "group-1",
+		GroupPassword: "secret",
+		Version:       "v1.2.3",
+		Username:      "user",
+		Password:      "wrong",
+	}
+	if _, err := client.DialWithConfig("test-roundtrip", clientConfig); err == nil || !strings.Contains(err.Error(), "invalid credentials") {
+		t.Fatalf("Expected invalid credentials, got %v", err)
+	}
+	if _, err := client.DialWithConfig("test-unknown", clientConfig); err == nil {
+		t.Fatal("Expected connection refused for an unknown address")
+	}
+
+	clientConfig.Password = "pass"
+	conn, err := client.DialWithConfig("test-roundtrip", clientConfig)
+	if err != nil {
+		t.Fatalf("DialWithConfig() error = %v", err)
+	}
+
+	serverConn := <-accepted
+	if serverConn.GetClientID() != "client-1" || serverConn.GetGroupID() != "group-1" ||
+		serverConn.GetPassword() != "secret" || serverConn.GetClientVersion() != "v1.2.3" {
+		t.Errorf("Unexpected client info %q %q %q %q", serverConn.GetClientID(), serverConn.GetGroupID(), serverConn.GetPassword(), serverConn.GetClientVersion())
+	}
+	if conn.RemoteAddr().String() != "test-roundtrip" || serverConn.RemoteAddr().String() != "client-1" {
+		t.Errorf("Unexpected addresses %v %v", conn.RemoteAddr(), serverConn.RemoteAddr())
+	}
+
+	msg := []byte("hello")
+	if err := conn.WriteMessage(msg); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	msg[0] = 'j' // Writes copy the message
+	got, err := conn.ReadMessage()
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("ReadMessage() = %q, %v", got, err)
+	}
+
+	// Closing the transport closes its connections
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected read error after close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read did not return after close")
+	}
+	if err := conn.WriteMessage(msg); err == nil {
+		t.Error("Expected write error after close")
+	}
+	if _, err := client.DialWithConfig("test-roundtrip", clientConfig); err == nil {
+		t.Error("Expected connection refused after close")
+	}
+}
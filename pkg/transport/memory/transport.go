@@ -0,0 +1,149 @@
+// Package memory provides an in-process transport for AnyProxy. Gateways and clients of the
+// same process connect over channels instead of sockets, which makes end-to-end tests cheap.
+// Addresses are arbitrary names that are unique within the process.
+package memory
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+var (
+	listenersMu sync.RWMutex
+	listeners   = map[string]*memoryTransport{}
+)
+
+// memoryTransport implements the Transport interface for in-process connections
+type memoryTransport struct {
+	mu         sync.Mutex
+	addr       string
+	handler    func(transport.Connection)
+	running    bool
+	conns      map[*memoryConnection]struct{} // Gateway ends, closed with the transport
+	authConfig *transport.AuthConfig
+	wg         sync.WaitGroup
+}
+
+var _ transport.Transport = (*memoryTransport)(nil)
+
+// NewMemoryTransport creates a new in-memory transport
+func NewMemoryTransport() transport.Transport {
+	return &memoryTransport{}
+}
+
+// NewMemoryTransportWithAuth creates a new in-memory transport with authentication
+func NewMemoryTransportWithAuth(authConfig *transport.AuthConfig) transport.Transport {
+	return &memoryTransport{authConfig: authConfig}
+}
+
+// ListenAndServe implements Transport interface - registers addr in the process
+func (t *memoryTransport) ListenAndServe(addr string, handler func(transport.Connection)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.running {
+		return nil
+	}
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if _, exists := listeners[addr]; exists {
+		return fmt.Errorf("failed to listen on %s: address already in use", addr)
+	}
+	listeners[addr] = t
+
+	t.addr = addr
+	t.handler = handler
+	t.conns = make(map[*memoryConnection]struct{})
+	t.running = true
+	logger.Info("In-memory transport server started", "addr", addr)
+	return nil
+}
+
+// ListenAndServeWithTLS implements Transport interface - connections never leave the process, so TLS is not applied
+func (t *memoryTransport) ListenAndServeWithTLS(addr string, handler func(transport.Connection), _ *tls.Config) error {
+	logger.Debug("TLS is not applied to in-memory connections", "addr", addr)
+	return t.ListenAndServe(addr, handler)
+}
+
+// DialWithConfig implements Transport interface - connects to a server of the same process
+func (t *memoryTransport) DialWithConfig(addr string, config *transport.ClientConfig) (transport.Connection, error) {
+	logger.Debug("In-memory transport dialing with config", "addr", addr, "client_id", config.ClientID, "group_id", config.GroupID)
+
+	listenersMu.RLock()
+	server := listeners[addr]
+	listenersMu.RUnlock()
+	if server == nil {
+		return nil, fmt.Errorf("failed to connect to %s: connection refused", addr)
+	}
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("%w: missing client_id", transport.ErrAuthFailed)
+	}
+	if server.authConfig != nil && server.authConfig.Username != "" &&
+		(config.Username != server.authConfig.Username || config.Password != server.authConfig.Password) {
+		return nil, fmt.Errorf("%w: invalid credentials", transport.ErrAuthFailed)
+	}
+
+	client, conn := newPipe(addr, config)
+	if err := server.serve(conn); err != nil {
+		return nil, err
+	}
+
+	logger.Debug("In-memory connection established", "client_id", config.ClientID, "group_id", config.GroupID)
+	return client, nil
+}
+
+// serve hands the gateway end of a new connection to the handler
+func (t *memoryTransport) serve(conn *memoryConnection) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.running {
+		return fmt.Errorf("failed to connect to %s: connection refused", t.addr)
+	}
+	t.conns[conn] = struct{}{}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer func() {
+			_ = conn.Close()
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+		t.handler(conn)
+	}()
+	return nil
+}
+
+// Close implements Transport interface
+func (t *memoryTransport) Close() error {
+	t.mu.Lock()
+	if !t.running {
+		t.mu.Unlock()
+		return nil
+	}
+	t.running = false
+
+	listenersMu.Lock()
+	delete(listeners, t.addr)
+	listenersMu.Unlock()
+
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+	logger.Info("In-memory transport server stopped", "addr", t.addr)
+	return nil
+}
+
+func init() {
+	transport.RegisterTransportCreator(protocol.TransportTypeMemory, NewMemoryTransportWithAuth)
+}
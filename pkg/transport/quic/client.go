@@ -50,7 +50,7 @@ func (t *quicTransport) dialQUICWithConfig(addr string, config *transport.Client
 	conn, err := quic.DialAddr(ctx, addr, tlsConfig, quicConfig)
 	if err != nil {
 		logger.Error("Failed to connect to QUIC server", "client_id", config.ClientID, "addr", addr, "err", err)
-		return nil, fmt.Errorf("failed to connect to QUIC server: %v", err)
+		return nil, fmt.Errorf("failed to connect to QUIC server: %w", err)
 	}
 
 	logger.Debug("QUIC connection established", "client_id", config.ClientID)
@@ -62,7 +62,7 @@ func (t *quicTransport) dialQUICWithConfig(addr string, config *transport.Client
 		if closeErr := conn.CloseWithError(0, "failed to open stream"); closeErr != nil {
 			logger.Warn("Error closing QUIC connection after stream failure", "err", closeErr)
 		}
-		return nil, fmt.Errorf("failed to open stream: %v", err)
+		return nil, fmt.Errorf("failed to open stream: %w", err)
 	}
 
 	logger.Debug("QUIC stream opened", "client_id", config.ClientID)
@@ -72,11 +72,12 @@ func (t *quicTransport) dialQUICWithConfig(addr string, config *transport.Client
 		if closeErr := conn.CloseWithError(1, "authentication failed"); closeErr != nil {
 			logger.Warn("Error closing QUIC connection after auth failure", "err", closeErr)
 		}
-		return nil, fmt.Errorf("authentication failed: %v", err)
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
 	}
 
 	// Create client connection
 	quicConn := newQUICConnection(stream, conn, config.ClientID, config.GroupID, config.GroupPassword)
+	quicConn.clientVersion = config.Version
 
 	logger.Info("QUIC connection established successfully", "client_id", config.ClientID)
 
@@ -88,7 +89,7 @@ func (t *quicTransport) authenticateClient(stream quic.Stream, config *transport
 	logger.Debug("Starting QUIC client authentication", "client_id", config.ClientID, "group_id", config.GroupID)
 
 	// Create authentication message using binary protocol
-	authData := protocol.PackAuthMessage(config.ClientID, config.GroupID, config.Username, config.Password, config.GroupPassword)
+	authData := protocol.PackAuthMessage(config.ClientID, config.GroupID, config.Username, config.Password, config.GroupPassword, config.Version, config.Identity)
 
 	// Create temporary connection to send authentication message
 	ctx, cancel := context.WithCancel(context.Background())
@@ -111,7 +112,7 @@ func (t *quicTransport) authenticateClient(stream quic.Stream, config *transport
 
 	// Send authentication message
 	if err := tempConn.writeData(authData); err != nil {
-		return fmt.Errorf("failed to send auth message: %v", err)
+		return fmt.Errorf("failed to send auth message: %w", err)
 	}
 
 	logger.Debug("Auth message sent, waiting for response", "client_id", config.ClientID)
@@ -140,7 +141,7 @@ func (t *quicTransport) authenticateClient(stream quic.Stream, config *transport
 	case responseData = <-tempConn.readChan:
 		// Successfully received response
 	case err := <-tempConn.errorChan:
-		return fmt.Errorf("failed to read auth response: %v", err)
+		return fmt.Errorf("failed to read auth response: %w", err)
 	case <-timeout:
 		return fmt.Errorf("authentication response timeout")
 	}
@@ -153,7 +154,7 @@ func (t *quicTransport) authenticateClient(stream quic.Stream, config *transport
 	// Parse binary authentication response
 	version, msgType, data, err := protocol.UnpackBinaryHeader(responseData)
 	if err != nil {
-		return fmt.Errorf("failed to unpack auth response: %v", err)
+		return fmt.Errorf("failed to unpack auth response: %w", err)
 	}
 
 	_ = version // Version not used for now
@@ -164,14 +165,14 @@ func (t *quicTransport) authenticateClient(stream quic.Stream, config *transport
 
 	status, reason, err := protocol.UnpackAuthResponseMessage(data)
 	if err != nil {
-		return fmt.Errorf("failed to parse auth response: %v", err)
+		return fmt.Errorf("failed to parse auth response: %w", err)
 	}
 
 	if status != "success" {
 		if reason == "" {
 			reason = "unknown"
 		}
-		return fmt.Errorf("authentication failed: %s", reason)
+		return fmt.Errorf("%w: %s", transport.ErrAuthFailed, reason)
 	}
 
 	logger.Debug("QUIC client authentication successful", "client_id", config.ClientID, "group_id", config.GroupID)
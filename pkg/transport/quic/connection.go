@@ -11,6 +11,8 @@ import (
 
 	"github.com/quic-go/quic-go"
 
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	"github.com/buhuipao/anyproxy/pkg/transport"
 )
@@ -28,15 +30,18 @@ type quicConnection struct {
 	clientID      string
 	groupID       string
 	groupPassword string // Client password for group credential management
+	clientVersion string // Client build version from the handshake, set before the connection is handed out
+	identity      string // Client identity proof from the handshake, set like clientVersion
 	// 🆕 Remove mutex, use async writes instead
-	writeChan chan *writeRequest // 🆕 Async write queue
-	closed    bool
-	ctx       context.Context
-	cancel    context.CancelFunc
-	readChan  chan []byte
-	errorChan chan error
-	closeOnce sync.Once
-	isClient  bool // Whether this is a client connection
+	writeChan   chan *writeRequest // 🆕 Async write queue
+	controlChan chan *writeRequest // Control messages, written before queued data
+	closed      bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	readChan    chan []byte
+	errorChan   chan error
+	closeOnce   sync.Once
+	isClient    bool // Whether this is a client connection
 }
 
 var _ transport.Connection = (*quicConnection)(nil)
@@ -52,6 +57,7 @@ func newQUICConnection(stream quic.Stream, conn quic.Connection, clientID, group
 		groupID:       groupID,
 		groupPassword: groupPassword,
 		writeChan:     make(chan *writeRequest, 1000), // 🆕 Async write queue
+		controlChan:   make(chan *writeRequest, transport.ControlQueueSize),
 		ctx:           ctx,
 		cancel:        cancel,
 		readChan:      make(chan []byte, 100),
@@ -76,6 +82,7 @@ func newQUICServerConnection(stream quic.Stream, conn quic.Connection, clientID,
 		groupID:       groupID,
 		groupPassword: groupPassword,
 		writeChan:     make(chan *writeRequest, 1000), // 🆕 Async write queue
+		controlChan:   make(chan *writeRequest, transport.ControlQueueSize),
 		ctx:           ctx,
 		cancel:        cancel,
 		readChan:      make(chan []byte, 100),
@@ -93,61 +100,88 @@ func newQUICServerConnection(stream quic.Stream, conn quic.Connection, clientID,
 func (c *quicConnection) writeLoop() {
 	defer func() {
 		// Fix: Ensure all pending requests are cleared to avoid goroutine leaks
-		// Process requests already in the queue first
-		for {
-			select {
-			case req, ok := <-c.writeChan:
-				if !ok {
-					// Channel is closed, exit
-					return
-				}
-				if req != nil && req.errChan != nil {
-					select {
-					case req.errChan <- fmt.Errorf("connection closed"):
-						// Successfully sent error
-					default:
-						// If no one is waiting, skip directly
-					}
-					close(req.errChan)
-				}
-			default:
-				// Queue is empty, exit
-				return
-			}
+		// Process requests already in the queues first
+		for _, queue := range []chan *writeRequest{c.controlChan, c.writeChan} {
+			drainQueue(queue)
 		}
 	}()
 
 	for {
+		// Control messages go before queued data
+		select {
+		case req, ok := <-c.controlChan:
+			if !ok {
+				return
+			}
+			c.write(req)
+			continue
+		default:
+		}
+
 		select {
 		case <-c.ctx.Done():
 			return
+		case req, ok := <-c.controlChan:
+			if !ok {
+				return
+			}
+			c.write(req)
 		case req, ok := <-c.writeChan:
 			if !ok {
 				// writeChan is closed
 				return
 			}
+			c.write(req)
+		}
+	}
+}
 
-			if c.closed {
-				if req.errChan != nil {
-					req.errChan <- fmt.Errorf("connection closed")
-					close(req.errChan)
-				}
-				continue
-			}
-
-			err := c.writeDataDirect(req.data)
-			if err != nil && isQUICError(err) {
-				c.closed = true
+// drainQueue fails the requests left in a write queue
+func drainQueue(queue chan *writeRequest) {
+	for {
+		select {
+		case req, ok := <-queue:
+			if !ok {
+				// Channel is closed, exit
+				return
 			}
-
-			if req.errChan != nil {
-				req.errChan <- err
+			if req != nil && req.errChan != nil {
+				select {
+				case req.errChan <- fmt.Errorf("connection closed"):
+					// Successfully sent error
+				default:
+					// If no one is waiting, skip directly
+				}
 				close(req.errChan)
 			}
+		default:
+			// Queue is empty, exit
+			return
 		}
 	}
 }
 
+// write writes a queued message, only used in writeLoop
+func (c *quicConnection) write(req *writeRequest) {
+	if c.closed {
+		if req.errChan != nil {
+			req.errChan <- fmt.Errorf("connection closed")
+			close(req.errChan)
+		}
+		return
+	}
+
+	err := c.writeDataDirect(req.data)
+	if err != nil && isQUICError(err) {
+		c.closed = true
+	}
+
+	if req.errChan != nil {
+		req.errChan <- err
+		close(req.errChan)
+	}
+}
+
 // WriteMessage implements transport.Connection
 func (c *quicConnection) WriteMessage(data []byte) error {
 	return c.writeDataAsync(data)
@@ -165,8 +199,13 @@ func (c *quicConnection) writeDataAsync(data []byte) error {
 		errChan: errChan,
 	}
 
+	queue := c.writeChan
+	if transport.IsControlMessage(data) {
+		queue = c.controlChan
+	}
+
 	select {
-	case c.writeChan <- req:
+	case queue <- req:
 		// Wait for write result
 		select {
 		case err := <-errChan:
@@ -203,14 +242,15 @@ func (c *quicConnection) writeDataDirect(data []byte) error {
 	}
 	length := uint32(dataLen) // Safe conversion after bounds check
 	if err := binary.Write(c.stream, binary.BigEndian, length); err != nil {
-		return fmt.Errorf("write length: %v", err)
+		return fmt.Errorf("write length: %w", err)
 	}
 
 	// Write data
 	if _, err := c.stream.Write(data); err != nil {
-		return fmt.Errorf("write data: %v", err)
+		return fmt.Errorf("write data: %w", err)
 	}
 
+	monitoring.RecordTransportSent(protocol.TransportTypeQUIC, dataLen, 4)
 	return nil
 }
 
@@ -244,6 +284,7 @@ func (c *quicConnection) Close() error {
 
 		// 🆕 Close write queue
 		close(c.writeChan)
+		close(c.controlChan)
 
 		// Close stream
 		if c.stream != nil {
@@ -291,6 +332,16 @@ func (c *quicConnection) GetPassword() string {
 	return c.groupPassword
 }
 
+// GetClientVersion returns the client build version
+func (c *quicConnection) GetClientVersion() string {
+	return c.clientVersion
+}
+
+// GetClientIdentity returns the client identity proof
+func (c *quicConnection) GetClientIdentity() string {
+	return c.identity
+}
+
 // receiveLoop handles incoming messages
 func (c *quicConnection) receiveLoop() {
 	defer func() {
@@ -313,6 +364,10 @@ func (c *quicConnection) receiveLoop() {
 				case <-c.ctx.Done():
 					return
 				}
+				// The stream is out of sync after a refused message
+				if protocol.IsProtocolViolation(err) {
+					return
+				}
 				continue
 			}
 
@@ -330,20 +385,21 @@ func (c *quicConnection) readData() ([]byte, error) {
 	// Read length prefix (4 bytes)
 	var length uint32
 	if err := binary.Read(c.stream, binary.BigEndian, &length); err != nil {
-		return nil, fmt.Errorf("read length: %v", err)
+		return nil, fmt.Errorf("read length: %w", err)
 	}
 
-	// Check length reasonableness (max 10MB)
-	if length > 10*1024*1024 {
-		return nil, fmt.Errorf("message too large: %d bytes", length)
+	// Refuse oversized messages before allocating them
+	if err := protocol.CheckMessageSize(int(length)); err != nil {
+		return nil, err
 	}
 
 	// Read data
 	data := make([]byte, length)
 	if _, err := io.ReadFull(c.stream, data); err != nil {
-		return nil, fmt.Errorf("read data: %v", err)
+		return nil, fmt.Errorf("read data: %w", err)
 	}
 
+	monitoring.RecordTransportReceived(protocol.TransportTypeQUIC, len(data), 4)
 	return data, nil
 }
 
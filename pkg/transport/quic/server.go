@@ -57,7 +57,7 @@ func (t *quicTransport) ListenAndServe(addr string, handler func(transport.Conne
 	// QUIC always requires TLS, so we'll use a self-signed certificate
 	cert, err := generateSelfSignedCert()
 	if err != nil {
-		return fmt.Errorf("failed to generate self-signed certificate: %v", err)
+		return fmt.Errorf("failed to generate self-signed certificate: %w", err)
 	}
 
 	tlsConfig := &tls.Config{
@@ -107,7 +107,7 @@ func (t *quicTransport) listenAndServe(addr string, handler func(transport.Conne
 	listener, err := quic.ListenAddr(addr, tlsConfig, quicConfig)
 	if err != nil {
 		logger.Error("Failed to create QUIC listener", "addr", addr, "err", err)
-		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 	t.listener = listener
 
@@ -160,7 +160,7 @@ func (t *quicTransport) handleConnection(conn quic.Connection) {
 	logger.Debug("QUIC stream accepted")
 
 	// 🚨 Fix: Wait for and validate authentication message
-	clientID, groupID, groupPassword, err := t.authenticateConnection(stream)
+	clientID, groupID, groupPassword, clientVersion, identity, err := t.authenticateConnection(stream)
 	if err != nil {
 		logger.Warn("QUIC connection rejected during authentication", "remote_addr", conn.RemoteAddr(), "err", err)
 		if err := conn.CloseWithError(1, "authentication failed"); err != nil {
@@ -169,10 +169,12 @@ func (t *quicTransport) handleConnection(conn quic.Connection) {
 		return
 	}
 
-	logger.Info("Client connected via QUIC", "client_id", clientID, "group_id", groupID, "remote_addr", conn.RemoteAddr())
+	logger.Info("Client connected via QUIC", "client_id", clientID, "group_id", groupID, "client_version", clientVersion, "remote_addr", conn.RemoteAddr())
 
 	// Create server connection
 	quicConn := newQUICServerConnection(stream, conn, clientID, groupID, groupPassword)
+	quicConn.clientVersion = clientVersion
+	quicConn.identity = identity
 
 	// Call connection handler, don't use recover to hide issues
 	defer func() {
@@ -186,7 +188,7 @@ func (t *quicTransport) handleConnection(conn quic.Connection) {
 }
 
 // authenticateConnection authenticates QUIC connection and extracts client information
-func (t *quicTransport) authenticateConnection(stream quic.Stream) (clientID, groupID, password string, err error) {
+func (t *quicTransport) authenticateConnection(stream quic.Stream) (clientID, groupID, password, clientVersion, identity string, err error) {
 	// Create temporary connection to read authentication message
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -230,36 +232,36 @@ func (t *quicTransport) authenticateConnection(stream quic.Stream) (clientID, gr
 	case authData = <-tempConn.readChan:
 		// Successfully received authentication data
 	case err = <-tempConn.errorChan:
-		return "", "", "", fmt.Errorf("failed to read auth message: %v", err)
+		return "", "", "", "", "", fmt.Errorf("failed to read auth message: %w", err)
 	case <-timeout:
-		return "", "", "", fmt.Errorf("authentication timeout")
+		return "", "", "", "", "", fmt.Errorf("authentication timeout")
 	}
 
 	// Verify if it's a binary protocol message
 	if !protocol.IsBinaryMessage(authData) {
-		return "", "", "", fmt.Errorf("received non-binary auth message")
+		return "", "", "", "", "", fmt.Errorf("received non-binary auth message")
 	}
 
 	// Parse binary message header
 	version, msgType, data, err := protocol.UnpackBinaryHeader(authData)
 	if err != nil {
-		return "", "", "", fmt.Errorf("failed to unpack auth message: %v", err)
+		return "", "", "", "", "", fmt.Errorf("failed to unpack auth message: %w", err)
 	}
 
 	_ = version // Version not used for now
 
 	if msgType != protocol.BinaryMsgTypeAuth {
-		return "", "", "", fmt.Errorf("expected auth message, got: 0x%02x", msgType)
+		return "", "", "", "", "", fmt.Errorf("expected auth message, got: 0x%02x", msgType)
 	}
 
 	// Parse authentication message
-	clientID, groupID, username, password, groupPassword, err := protocol.UnpackAuthMessage(data)
+	clientID, groupID, username, password, groupPassword, clientVersion, identity, err := protocol.UnpackAuthMessage(data)
 	if err != nil {
-		return "", "", "", fmt.Errorf("failed to parse auth message: %v", err)
+		return "", "", "", "", "", fmt.Errorf("failed to parse auth message: %w", err)
 	}
 
 	if clientID == "" {
-		return "", "", "", fmt.Errorf("missing client_id")
+		return "", "", "", "", "", fmt.Errorf("missing client_id")
 	}
 
 	// Verify authentication information (Gateway transport layer auth)
@@ -279,16 +281,16 @@ func (t *quicTransport) authenticateConnection(stream quic.Stream) (clientID, gr
 	// Build response message
 	authResponse := protocol.PackAuthResponseMessage(responseStatus, responseReason)
 	if writeErr := tempConn.writeData(authResponse); writeErr != nil {
-		return "", "", "", fmt.Errorf("failed to send auth response: %v", writeErr)
+		return "", "", "", "", "", fmt.Errorf("failed to send auth response: %v", writeErr)
 	}
 
 	if responseStatus != authStatusSuccess {
-		return "", "", "", errors.New(responseReason)
+		return "", "", "", "", "", errors.New(responseReason)
 	}
 
 	logger.Debug("QUIC authentication completed successfully", "client_id", clientID, "group_id", groupID)
 
-	return clientID, groupID, groupPassword, nil
+	return clientID, groupID, groupPassword, clientVersion, identity, nil
 }
 
 // DialWithConfig implements Transport interface - client connection
@@ -36,6 +36,10 @@ func (t *webSocketTransport) dialWebSocketWithConfig(addr string, config *transp
 	headers := http.Header{}
 	headers.Set("X-Client-ID", config.ClientID)
 	headers.Set("X-Group-ID", config.GroupID)
+	headers.Set("X-Client-Version", config.Version)
+	if config.Identity != "" {
+		headers.Set("X-Client-Identity", config.Identity)
+	}
 	headers.Set("X-Group-Password", config.GroupPassword)
 	logger.Debug("WebSocket headers prepared", "client_id", config.ClientID, "group_id", config.GroupID)
 
@@ -63,7 +67,10 @@ func (t *webSocketTransport) dialWebSocketWithConfig(addr string, config *transp
 			statusCode = resp.StatusCode
 		}
 		logger.Error("Failed to connect to WebSocket", "client_id", config.ClientID, "url", gatewayURL.String(), "status_code", statusCode, "err", err)
-		return nil, fmt.Errorf("failed to connect to WebSocket: %v", err)
+		if statusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("failed to connect to WebSocket: %w: %v", transport.ErrAuthFailed, err)
+		}
+		return nil, fmt.Errorf("failed to connect to WebSocket: %w", err)
 	}
 
 	if resp != nil {
@@ -71,7 +78,8 @@ func (t *webSocketTransport) dialWebSocketWithConfig(addr string, config *transp
 	}
 
 	// Create high-performance connection with integrated Writer, pass client information
-	wsConn := NewWebSocketConnectionWithInfo(conn, config.ClientID, config.GroupID, config.GroupPassword)
+	wsConn := newWebSocketConnection(conn, config.ClientID, config.GroupID, config.GroupPassword, config.Version)
+	wsConn.client = true
 
 	logger.Info("WebSocket connection established successfully", "client_id", config.ClientID, "group_id", config.GroupID)
 
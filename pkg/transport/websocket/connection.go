@@ -1,11 +1,15 @@
 package websocket
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
 	"github.com/buhuipao/anyproxy/pkg/transport"
 )
 
@@ -19,6 +23,9 @@ type webSocketConnectionWithInfo struct {
 	clientID  string
 	groupID   string
 	password  string           // Client password for group credential management
+	version   string           // Client build version from the handshake
+	identity  string           // Client identity proof from the handshake
+	client    bool             // Set on the client side, which masks the frames it sends
 	writer    *Writer          // 🆕 Integrated high-performance writer
 	writeBuf  chan interface{} // 🆕 Async write queue
 	closeOnce sync.Once        // Ensure Close() is only executed once
@@ -28,6 +35,14 @@ var _ transport.Connection = (*webSocketConnectionWithInfo)(nil)
 
 // NewWebSocketConnectionWithInfo creates WebSocket connection wrapper with client information and high-performance writing
 func NewWebSocketConnectionWithInfo(conn *websocket.Conn, clientID, groupID, password string) transport.Connection {
+	return newWebSocketConnection(conn, clientID, groupID, password, "")
+}
+
+// newWebSocketConnection creates WebSocket connection wrapper that also carries the client build version
+func newWebSocketConnection(conn *websocket.Conn, clientID, groupID, password, version string) *webSocketConnectionWithInfo {
+	// Oversized messages fail the read before they are buffered
+	conn.SetReadLimit(protocol.MaxMessageSize)
+
 	// 🆕 Create write buffer
 	writeBuf := make(chan interface{}, writeBufSize)
 
@@ -40,6 +55,7 @@ func NewWebSocketConnectionWithInfo(conn *websocket.Conn, clientID, groupID, pas
 		clientID: clientID,
 		groupID:  groupID,
 		password: password,
+		version:  version,
 		writer:   writer,   // 🆕 High-performance writer
 		writeBuf: writeBuf, // 🆕 Async queue
 	}
@@ -47,15 +63,40 @@ func NewWebSocketConnectionWithInfo(conn *websocket.Conn, clientID, groupID, pas
 
 // WriteMessage implements transport.Connection
 func (c *webSocketConnectionWithInfo) WriteMessage(data []byte) error {
-	return c.writer.WriteMessage(data)
+	err := c.writer.WriteMessage(data)
+	if err == nil {
+		monitoring.RecordTransportSent(protocol.TransportTypeWebSocket, len(data), frameOverhead(len(data), c.client))
+	}
+	return err
 }
 
 // ReadMessage implements transport.Connection
 func (c *webSocketConnectionWithInfo) ReadMessage() ([]byte, error) {
 	_, data, err := c.conn.ReadMessage()
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return nil, fmt.Errorf("%w: over %d bytes", protocol.ErrMessageTooLarge, protocol.MaxMessageSize)
+	}
+	if err == nil {
+		monitoring.RecordTransportReceived(protocol.TransportTypeWebSocket, len(data), frameOverhead(len(data), !c.client))
+	}
 	return data, err
 }
 
+// frameOverhead returns the header size of a single-frame binary message of length bytes
+func frameOverhead(length int, masked bool) int {
+	size := 2
+	switch {
+	case length > 65535:
+		size += 8
+	case length > 125:
+		size += 2
+	}
+	if masked {
+		size += 4
+	}
+	return size
+}
+
 // Close gracefully closes connection (🆕 using high-performance writer's graceful stop)
 func (c *webSocketConnectionWithInfo) Close() error {
 	var err error
@@ -98,3 +139,13 @@ func (c *webSocketConnectionWithInfo) GetGroupID() string {
 func (c *webSocketConnectionWithInfo) GetPassword() string {
 	return c.password
 }
+
+// GetClientVersion gets client build version
+func (c *webSocketConnectionWithInfo) GetClientVersion() string {
+	return c.version
+}
+
+// GetClientIdentity gets the client identity proof
+func (c *webSocketConnectionWithInfo) GetClientIdentity() string {
+	return c.identity
+}
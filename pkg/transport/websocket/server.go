@@ -1,12 +1,19 @@
 package websocket
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/tlsfp"
+	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
 	"github.com/buhuipao/anyproxy/pkg/transport"
 	"github.com/gorilla/websocket"
@@ -15,6 +22,7 @@ import (
 // webSocketTransport WebSocket transport layer implementation
 type webSocketTransport struct {
 	server     *http.Server
+	listener   net.Listener
 	handler    func(transport.Connection)
 	upgrader   websocket.Upgrader
 	mu         sync.Mutex
@@ -89,19 +97,26 @@ func (s *webSocketTransport) listenAndServe(addr string, handler func(transport.
 		ReadHeaderTimeout: 10 * time.Second, // Prevent Slowloris attacks
 	}
 
+	listener, err := sockopt.Listen(context.Background(), "tcp", addr, &config.SocketOptions{ReusePort: s.authConfig != nil && s.authConfig.ReusePort})
+	if err != nil {
+		logger.Error("Failed to create TCP listener", "addr", addr, "err", err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	s.listener = listener
+
 	// Start server
 	go func() {
 		var err error
 		if tlsConfig != nil {
 			logger.Info("Starting HTTPS WebSocket server (WSS)", "addr", addr)
-			// 🆕 Start server with TLS
-			err = s.server.ListenAndServeTLS("", "")
+			// 🆕 Start server with TLS, recording the ClientHello for fingerprinting
+			err = s.server.ServeTLS(tlsfp.Listen(listener), "", "")
 		} else {
 			logger.Info("Starting HTTP WebSocket server (WS)", "addr", addr)
-			err = s.server.ListenAndServe()
+			err = s.server.Serve(listener)
 		}
 
-		if err != nil && err != http.ErrServerClosed {
+		if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
 			logger.Error("WebSocket server error", "protocol", protocol, "err", err)
 		} else {
 			logger.Info("WebSocket server stopped", "protocol", protocol)
@@ -143,6 +158,18 @@ func (s *webSocketTransport) Close() error {
 	return err
 }
 
+// CloseListener implements transport.ListenerCloser, connected clients are kept
+func (s *webSocketTransport) CloseListener() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return nil
+	}
+	logger.Info("WebSocket server no longer accepting clients")
+	return s.listener.Close()
+}
+
 // handleWebSocket handles WebSocket connection upgrade
 func (s *webSocketTransport) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Get client ID
@@ -156,7 +183,8 @@ func (s *webSocketTransport) handleWebSocket(w http.ResponseWriter, r *http.Requ
 	// Get group ID and group password
 	groupID := r.Header.Get("X-Group-ID")
 	groupPassword := r.Header.Get("X-Group-Password") // Get group password from header
-	logger.Debug("WebSocket connection attempt", "client_id", clientID, "group_id", groupID, "remote_addr", r.RemoteAddr)
+	clientVersion := r.Header.Get("X-Client-Version")
+	logger.Debug("WebSocket connection attempt", "client_id", clientID, "group_id", groupID, "client_version", clientVersion, "remote_addr", r.RemoteAddr)
 
 	// Authentication check (Gateway transport layer auth)
 	if s.authConfig != nil && s.authConfig.Username != "" {
@@ -186,7 +214,8 @@ func (s *webSocketTransport) handleWebSocket(w http.ResponseWriter, r *http.Requ
 	logger.Debug("WebSocket connection upgraded successfully", "client_id", clientID)
 
 	// Create connection wrapper with client information
-	wsConn := NewWebSocketConnectionWithInfo(conn, clientID, groupID, groupPassword)
+	wsConn := newWebSocketConnection(conn, clientID, groupID, groupPassword, clientVersion)
+	wsConn.identity = r.Header.Get("X-Client-Identity")
 
 	logger.Info("Client connected", "client_id", clientID, "group_id", groupID, "remote_addr", r.RemoteAddr)
 
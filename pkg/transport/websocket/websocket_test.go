@@ -321,6 +321,25 @@ func TestWebSocketConnection_ClientInfo(t *testing.T) {
 	}
 }
 
+func TestFrameOverhead(t *testing.T) {
+	tests := []struct {
+		length int
+		masked bool
+		want   int
+	}{
+		{125, false, 2},
+		{126, false, 4},
+		{65535, true, 8},
+		{65536, false, 10},
+		{65536, true, 14},
+	}
+	for _, tt := range tests {
+		if got := frameOverhead(tt.length, tt.masked); got != tt.want {
+			t.Errorf("frameOverhead(%d, %v) = %d, want %d", tt.length, tt.masked, got, tt.want)
+		}
+	}
+}
+
 func TestWebSocketTransport_Close(t *testing.T) {
 	trans := NewWebSocketTransport()
 
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/pkg/transport"
 	"github.com/gorilla/websocket"
 )
 
@@ -54,6 +55,7 @@ type Writer struct {
 	stopCh       chan struct{}
 	ch           chan *writeMsg
 	backupCh     chan *writeMsg
+	controlCh    chan *writeMsg // Control messages, written before queued data
 	queueTimeout time.Duration
 	writeTimeout time.Duration
 }
@@ -71,6 +73,7 @@ func NewWriterWithID(conn *websocket.Conn, _ chan interface{}, connID string) *W
 		stopCh:       make(chan struct{}),
 		ch:           make(chan *writeMsg, 100),
 		backupCh:     make(chan *writeMsg, 100),
+		controlCh:    make(chan *writeMsg, transport.ControlQueueSize),
 		queueTimeout: 5 * time.Second,
 		writeTimeout: 10 * time.Second,
 	}
@@ -124,16 +127,24 @@ func (w *Writer) WriteMessage(data []byte) error {
 		callback: make(chan error, 1),
 	}
 
-	select {
-	case w.ch <- msg:
-		// Successfully queued
-	default:
-		// Queue is full, use backup channel
+	if transport.IsControlMessage(data) {
 		select {
-		case w.backupCh <- msg:
+		case w.controlCh <- msg:
 		case <-time.After(w.queueTimeout):
 			return ErrQueueFull
 		}
+	} else {
+		select {
+		case w.ch <- msg:
+			// Successfully queued
+		default:
+			// Queue is full, use backup channel
+			select {
+			case w.backupCh <- msg:
+			case <-time.After(w.queueTimeout):
+				return ErrQueueFull
+			}
+		}
 	}
 
 	// Wait for write completion with timeout
@@ -156,12 +167,27 @@ func (w *Writer) run() {
 	defer ticker.Stop()
 
 	for {
+		// Control messages go before queued data
+		select {
+		case msg := <-w.controlCh:
+			if err := w.handleWrite(msg); err != nil {
+				logger.Warn("Write error from control queue", "err", err)
+			}
+			continue
+		default:
+		}
+
 		select {
 		case <-w.stopCh:
 			// Graceful shutdown
 			w.handleShutdown()
 			return
 
+		case msg := <-w.controlCh:
+			if err := w.handleWrite(msg); err != nil {
+				logger.Warn("Write error from control queue", "err", err)
+			}
+
 		case msg := <-w.ch:
 			if err := w.handleWrite(msg); err != nil {
 				logger.Warn("Write error", "err", err)
@@ -215,6 +241,21 @@ func (w *Writer) handleShutdown() {
 
 	drainedCount := 0
 
+	// Drain control channel
+	for {
+		select {
+		case msg := <-w.controlCh:
+			if err := w.handleWrite(msg); err != nil {
+				logger.Warn("Error writing message during drain", "err", err)
+			} else {
+				drainedCount++
+			}
+		default:
+			goto drainMain
+		}
+	}
+
+drainMain:
 	// Drain main channel
 	for {
 		select {
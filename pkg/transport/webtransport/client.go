@@ -0,0 +1,93 @@
+// Package webtransport provides a WebTransport (HTTP/3) transport implementation for AnyProxy,
+// for clients on networks that only allow HTTP/3 egress.
+package webtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// dialTimeout bounds the QUIC handshake, session request and stream setup
+const dialTimeout = 10 * time.Second
+
+// dialWebTransportWithConfig establishes a WebTransport session to the gateway and opens its stream
+func (t *webTransportTransport) dialWebTransportWithConfig(addr string, config *transport.ClientConfig) (transport.Connection, error) {
+	logger.Debug("Establishing WebTransport connection to gateway", "client_id", config.ClientID, "gateway_addr", addr)
+
+	// HTTP/3 always uses TLS, fall back to system roots when no certificate is configured
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.SkipVerify, // nolint:gosec // User-configurable for development environments
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+
+	sessionURL := url.URL{Scheme: "https", Host: addr, Path: sessionPath}
+
+	headers := http.Header{}
+	headers.Set("X-Client-ID", config.ClientID)
+	headers.Set("X-Group-ID", config.GroupID)
+	headers.Set("X-Client-Version", config.Version)
+	if config.Identity != "" {
+		headers.Set("X-Client-Identity", config.Identity)
+	}
+	headers.Set("X-Group-Password", config.GroupPassword)
+	headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(config.Username+":"+config.Password)))
+
+	dialer := &webtransport.Dialer{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			KeepAlivePeriod: 30 * time.Second,
+			MaxIdleTimeout:  5 * time.Minute,
+			EnableDatagrams: true,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	logger.Info("Connecting to WebTransport endpoint", "client_id", config.ClientID, "url", sessionURL.String())
+	resp, session, err := dialer.Dial(ctx, sessionURL.String(), headers)
+	if err != nil {
+		var statusCode int
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		_ = dialer.Close()
+		logger.Error("Failed to connect to WebTransport", "client_id", config.ClientID, "url", sessionURL.String(), "status_code", statusCode, "err", err)
+		if statusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("failed to connect to WebTransport: %w: %v", transport.ErrAuthFailed, err)
+		}
+		return nil, fmt.Errorf("failed to connect to WebTransport: %w", err)
+	}
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err == nil {
+		// The gateway only sees the stream once its header is sent
+		_, err = stream.Write(nil)
+	}
+	if err != nil {
+		_ = session.CloseWithError(0, "failed to open stream")
+		_ = dialer.Close()
+		logger.Error("Failed to open WebTransport stream", "client_id", config.ClientID, "err", err)
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+
+	wtConn := newWebTransportConnection(stream, session, dialer, config.ClientID, config.GroupID, config.GroupPassword, config.Version)
+
+	logger.Info("WebTransport connection established successfully", "client_id", config.ClientID, "group_id", config.GroupID)
+
+	return wtConn, nil
+}
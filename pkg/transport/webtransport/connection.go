@@ -0,0 +1,132 @@
+package webtransport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/quic-go/webtransport-go"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// maxMessageSize limits a single length-prefixed message
+const maxMessageSize = protocol.MaxMessageSize
+
+// webTransportConnection implements transport.Connection over one bidirectional WebTransport stream
+type webTransportConnection struct {
+	stream        webtransport.Stream
+	session       *webtransport.Session
+	dialer        *webtransport.Dialer // Set on the client side, owns the QUIC connection
+	clientID      string
+	groupID       string
+	groupPassword string
+	clientVersion string
+	identity      string // Client identity proof, only set on the server side
+
+	writeMu   transport.LaneMutex // Control messages before data
+	closeOnce sync.Once
+}
+
+var _ transport.Connection = (*webTransportConnection)(nil)
+
+// newWebTransportConnection wraps an established session stream
+func newWebTransportConnection(stream webtransport.Stream, session *webtransport.Session, dialer *webtransport.Dialer, clientID, groupID, groupPassword, clientVersion string) *webTransportConnection {
+	return &webTransportConnection{
+		stream:        stream,
+		session:       session,
+		dialer:        dialer,
+		clientID:      clientID,
+		groupID:       groupID,
+		groupPassword: groupPassword,
+		clientVersion: clientVersion,
+	}
+}
+
+// WriteMessage implements transport.Connection, each message is sent with a 4-byte length prefix
+func (c *webTransportConnection) WriteMessage(data []byte) error {
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("message too large: %d bytes", len(data))
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data))) //nolint:gosec // bounded by maxMessageSize
+	copy(frame[4:], data)
+
+	c.writeMu.Lock(transport.IsControlMessage(data))
+	defer c.writeMu.Unlock()
+	if _, err := c.stream.Write(frame); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	monitoring.RecordTransportSent(protocol.TransportTypeWebTransport, len(data), 4)
+	return nil
+}
+
+// ReadMessage implements transport.Connection
+func (c *webTransportConnection) ReadMessage() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.stream, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if err := protocol.CheckMessageSize(int(length)); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.stream, data); err != nil {
+		return nil, fmt.Errorf("read message: %w", err)
+	}
+	monitoring.RecordTransportReceived(protocol.TransportTypeWebTransport, len(data), 4)
+	return data, nil
+}
+
+// Close implements transport.Connection, closing the session and on the client its QUIC connection
+func (c *webTransportConnection) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		_ = c.stream.Close()
+		err = c.session.CloseWithError(0, "connection closed")
+		if c.dialer != nil {
+			_ = c.dialer.Close()
+		}
+	})
+	return err
+}
+
+// RemoteAddr implements transport.Connection
+func (c *webTransportConnection) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
+
+// LocalAddr implements transport.Connection
+func (c *webTransportConnection) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+// GetClientID gets client ID - for upper layer code to extract client information
+func (c *webTransportConnection) GetClientID() string {
+	return c.clientID
+}
+
+// GetGroupID gets group ID - for upper layer code to extract client information
+func (c *webTransportConnection) GetGroupID() string {
+	return c.groupID
+}
+
+// GetPassword gets password - for upper layer code to extract client information
+func (c *webTransportConnection) GetPassword() string {
+	return c.groupPassword
+}
+
+// GetClientVersion returns the client build version
+func (c *webTransportConnection) GetClientVersion() string {
+	return c.clientVersion
+}
+
+// GetClientIdentity returns the client identity proof
+func (c *webTransportConnection) GetClientIdentity() string {
+	return c.identity
+}
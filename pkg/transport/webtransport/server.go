@@ -0,0 +1,201 @@
+package webtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+const (
+	// sessionPath is the URL path of the WebTransport endpoint
+	sessionPath = "/wt"
+	// streamAcceptTimeout bounds the wait for the client to open its stream after the session is established
+	streamAcceptTimeout = 10 * time.Second
+)
+
+// webTransportTransport implements the Transport interface for WebTransport over HTTP/3
+type webTransportTransport struct {
+	server     *webtransport.Server
+	packetConn net.PacketConn
+	handler    func(transport.Connection)
+	mu         sync.Mutex
+	running    bool
+	authConfig *transport.AuthConfig
+}
+
+var _ transport.Transport = (*webTransportTransport)(nil)
+
+// NewWebTransportTransport creates a new WebTransport transport
+func NewWebTransportTransport() transport.Transport {
+	return &webTransportTransport{}
+}
+
+// NewWebTransportTransportWithAuth creates a new WebTransport transport with authentication
+func NewWebTransportTransportWithAuth(authConfig *transport.AuthConfig) transport.Transport {
+	return &webTransportTransport{authConfig: authConfig}
+}
+
+// ListenAndServe implements Transport interface, HTTP/3 always requires TLS
+func (t *webTransportTransport) ListenAndServe(_ string, _ func(transport.Connection)) error {
+	return fmt.Errorf("TLS configuration is required for WebTransport")
+}
+
+// ListenAndServeWithTLS implements Transport interface - serves WebTransport over HTTP/3
+func (t *webTransportTransport) ListenAndServeWithTLS(addr string, handler func(transport.Connection), tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return fmt.Errorf("TLS configuration is required for WebTransport")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.running {
+		return nil
+	}
+
+	t.handler = handler
+
+	logger.Info("Starting WebTransport server", "listen_addr", addr)
+
+	// Bind before serving so address errors are reported to the caller
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		logger.Error("Failed to create WebTransport listener", "addr", addr, "err", err)
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(sessionPath, t.handleSession)
+
+	t.server = &webtransport.Server{
+		H3: http3.Server{
+			Addr:      addr,
+			Handler:   mux,
+			TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+			QUICConfig: &quic.Config{
+				KeepAlivePeriod: 30 * time.Second,
+				MaxIdleTimeout:  5 * time.Minute,
+				EnableDatagrams: true,
+			},
+		},
+		CheckOrigin: func(_ *http.Request) bool {
+			return true // Clients are not browsers, they authenticate with credentials
+		},
+	}
+	t.packetConn = packetConn
+
+	go func() {
+		if err := t.server.Serve(packetConn); err != nil && err != http.ErrServerClosed && err != quic.ErrServerClosed {
+			logger.Error("WebTransport server error", "err", err)
+		} else {
+			logger.Info("WebTransport server stopped")
+		}
+	}()
+
+	t.running = true
+	logger.Info("WebTransport server started successfully", "addr", packetConn.LocalAddr())
+	return nil
+}
+
+// handleSession authenticates a session request and serves the client over its first stream
+func (t *webTransportTransport) handleSession(w http.ResponseWriter, r *http.Request) {
+	clientID := r.Header.Get("X-Client-ID")
+	if clientID == "" {
+		logger.Warn("WebTransport session rejected: missing client ID", "remote_addr", r.RemoteAddr)
+		http.Error(w, "Client ID is required", http.StatusBadRequest)
+		return
+	}
+
+	groupID := r.Header.Get("X-Group-ID")
+	groupPassword := r.Header.Get("X-Group-Password")
+	clientVersion := r.Header.Get("X-Client-Version")
+	logger.Debug("WebTransport session attempt", "client_id", clientID, "group_id", groupID, "client_version", clientVersion, "remote_addr", r.RemoteAddr)
+
+	// Authentication check (Gateway transport layer auth)
+	if t.authConfig != nil && t.authConfig.Username != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != t.authConfig.Username || password != t.authConfig.Password {
+			logger.Warn("WebTransport session rejected: invalid credentials", "client_id", clientID, "remote_addr", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		logger.Debug("Client authentication successful", "client_id", clientID)
+	}
+
+	session, err := t.server.Upgrade(w, r)
+	if err != nil {
+		logger.Error("Failed to upgrade WebTransport session", "client_id", clientID, "remote_addr", r.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(session.Context(), streamAcceptTimeout)
+	stream, err := session.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to accept WebTransport stream", "client_id", clientID, "err", err)
+		_ = session.CloseWithError(0, "failed to accept stream")
+		return
+	}
+
+	wtConn := newWebTransportConnection(stream, session, nil, clientID, groupID, groupPassword, clientVersion)
+	wtConn.identity = r.Header.Get("X-Client-Identity")
+
+	logger.Info("Client connected via WebTransport", "client_id", clientID, "group_id", groupID, "client_version", clientVersion, "remote_addr", r.RemoteAddr)
+
+	defer func() {
+		if err := wtConn.Close(); err != nil {
+			logger.Warn("Error closing WebTransport connection", "err", err)
+		}
+		logger.Info("Client disconnected from WebTransport", "client_id", clientID, "group_id", groupID)
+	}()
+
+	t.handler(wtConn)
+}
+
+// DialWithConfig implements Transport interface - client connection
+func (t *webTransportTransport) DialWithConfig(addr string, config *transport.ClientConfig) (transport.Connection, error) {
+	logger.Debug("WebTransport transport dialing with config", "addr", addr, "client_id", config.ClientID, "group_id", config.GroupID, "tls_enabled", config.TLSConfig != nil)
+
+	return t.dialWebTransportWithConfig(addr, config)
+}
+
+// Close implements Transport interface
+func (t *webTransportTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.running {
+		return nil
+	}
+
+	logger.Info("Stopping WebTransport server")
+
+	err := t.server.Close()
+	if err != nil {
+		logger.Warn("Error closing WebTransport server", "err", err)
+	}
+	if closeErr := t.packetConn.Close(); closeErr != nil {
+		logger.Debug("Error closing WebTransport packet conn", "err", closeErr)
+	}
+
+	t.running = false
+	logger.Info("WebTransport server stopped successfully")
+	return err
+}
+
+func init() {
+	transport.RegisterTransportCreator(protocol.TransportTypeWebTransport, NewWebTransportTransportWithAuth)
+}
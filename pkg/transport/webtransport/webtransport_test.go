@@ -0,0 +1,127 @@
+package webtransport
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/transport"
+)
+
+// generateTestTLS returns a server config with a self-signed certificate for 127.0.0.1 and a client config trusting it
+func generateTestTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Test"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return serverConfig, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+}
+
+func TestWebTransport_ListenAndServeRequiresTLS(t *testing.T) {
+	trans := NewWebTransportTransport()
+	if err := trans.ListenAndServe("127.0.0.1:0", func(transport.Connection) {}); err == nil {
+		t.Error("Expected error when starting WebTransport without TLS")
+	}
+}
+
+func TestWebTransport_RoundTrip(t *testing.T) {
+	serverTLS, clientTLS := generateTestTLS(t)
+	server := NewWebTransportTransportWithAuth(&transport.AuthConfig{Username: "user", Password: "pass"})
+
+	accepted := make(chan transport.Connection, 1)
+	err := server.ListenAndServeWithTLS("127.0.0.1:0", func(conn transport.Connection) {
+		accepted <- conn
+		// Echo until the client goes away
+		for {
+			data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(data); err != nil {
+				return
+			}
+		}
+	}, serverTLS)
+	if err != nil {
+		t.Fatalf("ListenAndServeWithTLS() error = %v", err)
+	}
+	defer server.Close()
+	addr := server.(*webTransportTransport).packetConn.LocalAddr().String()
+
+	client := NewWebTransportTransport()
+	clientConfig := &transport.ClientConfig{
+		ClientID:      "client-1",
+		GroupID:       "group-1",
+		GroupPassword: "secret",
+		Version:       "v1.2.3",
+		Username:      "user",
+		Password:      "wrong",
+		TLSConfig:     clientTLS,
+	}
+	if _, err := client.DialWithConfig(addr, clientConfig); !errors.Is(err, transport.ErrAuthFailed) {
+		t.Fatalf("Expected ErrAuthFailed with invalid credentials, got %v", err)
+	}
+
+	clientConfig.Password = "pass"
+	conn, err := client.DialWithConfig(addr, clientConfig)
+	if err != nil {
+		t.Fatalf("DialWithConfig() error = %v", err)
+	}
+	defer conn.Close()
+
+	var serverConn transport.Connection
+	select {
+	case serverConn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not accept the connection")
+	}
+	if serverConn.GetClientID() != "client-1" || serverConn.GetGroupID() != "group-1" ||
+		serverConn.GetPassword() != "secret" || serverConn.GetClientVersion() != "v1.2.3" {
+		t.Errorf("Unexpected client info %q %q %q %q", serverConn.GetClientID(), serverConn.GetGroupID(), serverConn.GetPassword(), serverConn.GetClientVersion())
+	}
+
+	for _, msg := range [][]byte{[]byte("hello"), {}, make([]byte, 256*1024)} {
+		if err := conn.WriteMessage(msg); err != nil {
+			t.Fatalf("WriteMessage() error = %v", err)
+		}
+		got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+		if len(got) != len(msg) || string(got) != string(msg) {
+			t.Errorf("Echo returned %d bytes, want %d", len(got), len(msg))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package auth chains the providers web dashboard logins are checked against: the local
+// accounts of the config, LDAP binds and OpenID Connect single sign-on.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Provider names
+const (
+	ProviderLocal = "local"
+	ProviderLDAP  = "ldap"
+	ProviderOIDC  = "oidc"
+)
+
+// Dashboard roles, from the least to the most privileged
+var roles = []string{"viewer", "operator", "admin"}
+
+var (
+	// ErrInvalidCredentials is returned when no provider accepts a username and password
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrNoRole is returned for users a provider knows but has no dashboard role for
+	ErrNoRole = errors.New("no dashboard role assigned")
+)
+
+// Identity is a user authenticated by a provider
+type Identity struct {
+	Username string
+	Role     string
+	Groups   []string // Groups a tenant account is limited to, empty for all groups
+	Provider string
+}
+
+// Provider authenticates dashboard users
+type Provider interface {
+	Name() string
+}
+
+// PasswordProvider checks usernames and passwords, it returns ErrInvalidCredentials when they
+// are wrong
+type PasswordProvider interface {
+	Provider
+	Authenticate(ctx context.Context, username, password string) (*Identity, error)
+}
+
+// Chain is the ordered list of enabled providers
+type Chain struct {
+	providers []Provider
+}
+
+// NewChain returns a chain of providers
+func NewChain(providers ...Provider) *Chain {
+	return &Chain{providers: providers}
+}
+
+// New returns the chain of a web config, local checks the accounts of the config
+func New(cfg config.WebAuthConfig, local *Local) (*Chain, error) {
+	names := cfg.Providers
+	if len(names) == 0 {
+		names = []string{ProviderLocal}
+		if cfg.LDAP != nil {
+			names = append(names, ProviderLDAP)
+		}
+		if cfg.OIDC != nil {
+			names = append(names, ProviderOIDC)
+		}
+	}
+
+	chain := &Chain{}
+	for _, name := range names {
+		switch {
+		case name == ProviderLocal:
+			chain.providers = append(chain.providers, local)
+		case name == ProviderLDAP && cfg.LDAP != nil:
+			ldap, err := NewLDAP(*cfg.LDAP)
+			if err != nil {
+				return nil, fmt.Errorf("ldap: %v", err)
+			}
+			chain.providers = append(chain.providers, ldap)
+		case name == ProviderOIDC && cfg.OIDC != nil:
+			chain.providers = append(chain.providers, NewOIDC(*cfg.OIDC))
+		default:
+			return nil, fmt.Errorf("unsupported or unconfigured provider: %s", name)
+		}
+	}
+	return chain, nil
+}
+
+// Enabled reports whether the provider name is in the chain, sessions of removed providers are
+// no longer valid
+func (c *Chain) Enabled(name string) bool {
+	for _, provider := range c.providers {
+		if provider.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OIDC returns the single sign-on provider, nil when it isn't enabled
+func (c *Chain) OIDC() *OIDC {
+	for _, provider := range c.providers {
+		if oidc, ok := provider.(*OIDC); ok {
+			return oidc
+		}
+	}
+	return nil
+}
+
+// Authenticate tries the password providers in order and returns the identity of the first one
+// accepting the credentials
+func (c *Chain) Authenticate(ctx context.Context, username, password string) (*Identity, error) {
+	for _, provider := range c.providers {
+		passwords, ok := provider.(PasswordProvider)
+		if !ok {
+			continue
+		}
+		identity, err := passwords.Authenticate(ctx, username, password)
+		if err == nil {
+			return identity, nil
+		}
+		if !errors.Is(err, ErrInvalidCredentials) {
+			logger.Warn("Authentication provider failed", "provider", provider.Name(), "username", username, "err", err)
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Account is a local dashboard account
+type Account struct {
+	Username string
+	Password string
+	Role     string
+	Groups   []string
+}
+
+// Local checks the accounts of the config, which may change while the server runs
+type Local struct {
+	accounts func() []Account
+}
+
+// NewLocal returns the provider of the accounts returned by accounts
+func NewLocal(accounts func() []Account) *Local {
+	return &Local{accounts: accounts}
+}
+
+// Name implements Provider
+func (l *Local) Name() string { return ProviderLocal }
+
+// Authenticate compares the credentials with every account in constant time
+func (l *Local) Authenticate(_ context.Context, username, password string) (*Identity, error) {
+	var identity *Identity
+	for _, account := range l.accounts() {
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(account.Username))
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(account.Password))
+		if userOK&passOK == 1 && identity == nil {
+			identity = &Identity{Username: account.Username, Role: account.Role, Groups: account.Groups, Provider: ProviderLocal}
+		}
+	}
+	if identity == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return identity, nil
+}
+
+// highestRole returns the most privileged of the roles, "" when none is a dashboard role
+func highestRole(candidates []string) string {
+	best := ""
+	for i, role := range roles {
+		for _, candidate := range candidates {
+			if candidate == role {
+				best = roles[i]
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func TestChain_Authenticate(t *testing.T) {
+	url := fakeLDAP(t, map[string]string{"uid=bob,dc=example,dc=com": "ldap-pass"})
+	local := NewLocal(func() []Account {
+		return []Account{{Username: "admin", Password: "local-pass", Role: "admin"}, {Username: "acme", Password: "p", Role: "viewer", Groups: []string{"acme"}}}
+	})
+	chain, err := New(config.WebAuthConfig{LDAP: &config.LDAPAuthConfig{URL: url, BindDN: "uid=%s,dc=example,dc=com", DefaultRole: "viewer"}}, local)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		username, password string
+		wantProvider       string
+	}{
+		{"admin", "local-pass", ProviderLocal},
+		{"bob", "ldap-pass", ProviderLDAP},
+		{"bob", "wrong", ""},
+		{"admin", "ldap-pass", ""},
+	}
+	for _, tt := range tests {
+		identity, err := chain.Authenticate(context.Background(), tt.username, tt.password)
+		if tt.wantProvider == "" {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Authenticate(%s, %s) error = %v, want ErrInvalidCredentials", tt.username, tt.password, err)
+			}
+			continue
+		}
+		if err != nil || identity.Provider != tt.wantProvider {
+			t.Errorf("Authenticate(%s, %s) = %+v, %v, want provider %s", tt.username, tt.password, identity, err, tt.wantProvider)
+		}
+	}
+
+	identity, _ := chain.Authenticate(context.Background(), "acme", "p")
+	if identity == nil || len(identity.Groups) != 1 {
+		t.Errorf("Tenant identity = %+v, want its groups", identity)
+	}
+}
+
+func TestNew_Providers(t *testing.T) {
+	local := NewLocal(func() []Account { return []Account{{Username: "admin", Password: "pass", Role: "admin"}} })
+	oidc := &config.OIDCAuthConfig{Issuer: "https://idp.example.com", ClientID: "anyproxy", RedirectURL: "https://gw.example.com" + OIDCCallbackPath}
+
+	chain, err := New(config.WebAuthConfig{OIDC: oidc}, local)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if !chain.Enabled(ProviderLocal) || chain.OIDC() == nil || chain.Enabled(ProviderLDAP) {
+		t.Error("Default chain should have the local accounts and the configured providers")
+	}
+
+	// Single sign-on only
+	chain, err = New(config.WebAuthConfig{Providers: []string{ProviderOIDC}, OIDC: oidc}, local)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if chain.Enabled(ProviderLocal) {
+		t.Error("Local accounts should be disabled when not listed")
+	}
+	if _, err := chain.Authenticate(context.Background(), "admin", "pass"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Password login error = %v, want ErrInvalidCredentials", err)
+	}
+
+	if _, err := New(config.WebAuthConfig{Providers: []string{ProviderLDAP}}, local); err == nil {
+		t.Error("New() should fail for an unconfigured provider")
+	}
+}
@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+const defaultLDAPTimeout = 5 * time.Second
+
+// LDAP result codes
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// BER tags of the LDAP messages used by a simple bind
+const (
+	berInteger         = 0x02
+	berOctetString     = 0x04
+	berEnumerated      = 0x0a
+	berSequence        = 0x30
+	ldapBindRequest    = 0x60 // [APPLICATION 0]
+	ldapBindResponse   = 0x61 // [APPLICATION 1]
+	ldapExtendedReq    = 0x77 // [APPLICATION 23]
+	ldapExtendedResp   = 0x78 // [APPLICATION 24]
+	ldapSimpleAuth     = 0x80 // [0] of the bind authentication choice
+	ldapExtendedName   = 0x80 // [0] requestName of an extended request
+	ldapStartTLSOID    = "1.3.6.1.4.1.1466.20037"
+	ldapMaxMessageSize = 1 << 20
+)
+
+// LDAP checks passwords by binding as the user's DN
+type LDAP struct {
+	cfg     config.LDAPAuthConfig
+	address string
+	ldaps   bool
+	tls     *tls.Config
+}
+
+// NewLDAP returns the LDAP provider of cfg
+func NewLDAP(cfg config.LDAPAuthConfig) (*LDAP, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	l := &LDAP{cfg: cfg, address: u.Host, ldaps: u.Scheme == "ldaps"}
+	if u.Port() == "" {
+		port := "389"
+		if l.ldaps {
+			port = "636"
+		}
+		l.address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if cfg.Timeout <= 0 {
+		l.cfg.Timeout = defaultLDAPTimeout
+	}
+
+	l.tls = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: cfg.InsecureSkipVerify, MinVersion: tls.VersionTLS12} // #nosec G402 -- opt-in for test directories
+	if cfg.CACert != "" {
+		pem, err := config.ReadPEMFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		l.tls.RootCAs = x509.NewCertPool()
+		if !l.tls.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CACert)
+		}
+	}
+	return l, nil
+}
+
+// Name implements Provider
+func (l *LDAP) Name() string { return ProviderLDAP }
+
+// Authenticate binds as the DN of username and maps the user to a role
+func (l *LDAP) Authenticate(ctx context.Context, username, password string) (*Identity, error) {
+	// Binds without a password are anonymous and succeed on most servers
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.cfg.Timeout)
+	defer cancel()
+	conn, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	dn := strings.Replace(l.cfg.BindDN, "%s", escapeDN(username), 1)
+	if err := bind(conn, 2, dn, password); err != nil {
+		return nil, err
+	}
+
+	role := l.cfg.Users[username]
+	if role == "" {
+		role = l.cfg.DefaultRole
+	}
+	if role == "" {
+		return nil, fmt.Errorf("%s: %w", username, ErrNoRole)
+	}
+	return &Identity{Username: username, Role: role, Provider: ProviderLDAP}, nil
+}
+
+// dial connects to the server and secures the connection with TLS or StartTLS
+func (l *LDAP) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", l.address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if l.cfg.StartTLS {
+		if err := startTLS(conn, 1); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if l.ldaps || l.cfg.StartTLS {
+		tlsConn := tls.Client(conn, l.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return conn, nil
+}
+
+// bind sends a simple bind request and checks its result
+func bind(conn io.ReadWriter, messageID int, dn, password string) error {
+	request := berTLV(ldapBindRequest, berInt(berInteger, 3), berTLV(berOctetString, []byte(dn)), berTLV(ldapSimpleAuth, []byte(password)))
+	code, message, err := exchange(conn, messageID, request, ldapBindResponse)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return ErrInvalidCredentials
+	}
+	return fmt.Errorf("bind failed with result %d: %s", code, message)
+}
+
+// startTLS asks the server to upgrade the connection with the StartTLS extended operation
+func startTLS(conn io.ReadWriter, messageID int) error {
+	request := berTLV(ldapExtendedReq, berTLV(ldapExtendedName, []byte(ldapStartTLSOID)))
+	code, message, err := exchange(conn, messageID, request, ldapExtendedResp)
+	if err != nil {
+		return err
+	}
+	if code != ldapSuccess {
+		return fmt.Errorf("StartTLS failed with result %d: %s", code, message)
+	}
+	return nil
+}
+
+// exchange sends an LDAP message and returns the result code and diagnostic message of the
+// response of type responseTag
+func exchange(conn io.ReadWriter, messageID int, op []byte, responseTag byte) (int, string, error) {
+	if _, err := conn.Write(berTLV(berSequence, berInt(berInteger, messageID), op)); err != nil {
+		return 0, "", err
+	}
+	tag, message, err := readTLV(conn)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != berSequence {
+		return 0, "", fmt.Errorf("unexpected LDAP message tag 0x%02x", tag)
+	}
+
+	var id, code, response, diagnostic []byte
+	if tag, id, message, err = parseTLV(message); err != nil || tag != berInteger || decodeInt(id) != messageID {
+		return 0, "", errors.New("malformed LDAP message id")
+	}
+	if tag, response, _, err = parseTLV(message); err != nil || tag != responseTag {
+		return 0, "", fmt.Errorf("unexpected LDAP response tag 0x%02x", tag)
+	}
+	if tag, code, response, err = parseTLV(response); err != nil || tag != berEnumerated {
+		return 0, "", errors.New("malformed LDAP result code")
+	}
+	// The matched DN is followed by the diagnostic message
+	if _, _, response, err = parseTLV(response); err == nil {
+		_, diagnostic, _, _ = parseTLV(response)
+	}
+	return decodeInt(code), string(diagnostic), nil
+}
+
+// berTLV encodes a BER element of the contents
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var value []byte
+	for _, content := range contents {
+		value = append(value, content...)
+	}
+	out := []byte{tag}
+	switch n := len(value); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
+
+// berInt encodes a non-negative integer
+func berInt(tag byte, v int) []byte {
+	value := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		value = append([]byte{byte(v)}, value...)
+	}
+	if value[0]&0x80 != 0 {
+		value = append([]byte{0}, value...)
+	}
+	return berTLV(tag, value)
+}
+
+// decodeInt decodes a small big-endian integer
+func decodeInt(b []byte) int {
+	v := 0
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// readTLV reads one BER element, lengths may use more bytes than needed as some servers do
+func readTLV(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		lengthBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return 0, nil, err
+		}
+		length = decodeInt(lengthBytes)
+	}
+	if length > ldapMaxMessageSize {
+		return 0, nil, errors.New("LDAP message too large")
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return header[0], value, nil
+}
+
+// parseTLV splits the first BER element off b
+func parseTLV(b []byte) (tag byte, value, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, length, offset := b[0], int(b[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(b) < 2+n {
+			return 0, nil, nil, errors.New("unsupported BER length")
+		}
+		length, offset = decodeInt(b[2:2+n]), 2+n
+	}
+	if len(b)-offset < length {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, b[offset : offset+length], b[offset+length:], nil
+}
+
+// escapeDN escapes an attribute value of a distinguished name (RFC 4514)
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
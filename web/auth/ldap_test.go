@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// fakeLDAP answers simple binds, passwords maps DNs to their password
+func fakeLDAP(t *testing.T, passwords map[string]string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, message, err := readTLV(conn)
+				if err != nil {
+					return
+				}
+				_, id, message, _ := parseTLV(message)
+				_, request, _, _ := parseTLV(message)
+				_, _, request, _ = parseTLV(request) // version
+				_, dn, request, _ := parseTLV(request)
+				_, password, _, _ := parseTLV(request)
+
+				code := ldapInvalidCredentials
+				if want, ok := passwords[string(dn)]; ok && want == string(password) {
+					code = ldapSuccess
+				}
+				response := berTLV(ldapBindResponse, berInt(berEnumerated, code), berTLV(berOctetString), berTLV(berOctetString))
+				_, _ = conn.Write(berTLV(berSequence, berInt(berInteger, decodeInt(id)), response))
+			}()
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func TestLDAP_Authenticate(t *testing.T) {
+	url := fakeLDAP(t, map[string]string{
+		"uid=alice,ou=people,dc=example,dc=com": "secret",
+		"uid=bob,ou=people,dc=example,dc=com":   "hunter2",
+	})
+	ldap, err := NewLDAP(config.LDAPAuthConfig{
+		URL:    url,
+		BindDN: "uid=%s,ou=people,dc=example,dc=com",
+		Users:  map[string]string{"alice": "admin"},
+	})
+	if err != nil {
+		t.Fatalf("NewLDAP() error = %v", err)
+	}
+
+	identity, err := ldap.Authenticate(context.Background(), "alice", "secret")
+	if err != nil || identity.Role != "admin" || identity.Provider != ProviderLDAP {
+		t.Fatalf("Authenticate(alice) = %+v, %v", identity, err)
+	}
+	if _, err := ldap.Authenticate(context.Background(), "alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Wrong password error = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := ldap.Authenticate(context.Background(), "alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Empty password error = %v, want ErrInvalidCredentials", err)
+	}
+	// Bob binds but has no role without a default role
+	if _, err := ldap.Authenticate(context.Background(), "bob", "hunter2"); !errors.Is(err, ErrNoRole) {
+		t.Errorf("Unmapped user error = %v, want ErrNoRole", err)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := map[string]string{
+		"alice":         "alice",
+		"a,ou=admins":   `a\,ou\=admins`,
+		"#x":            `\#x`,
+		" padded ":      `\ padded\ `,
+		"nul\x00":       `nul\00`,
+		`back\slash"q"`: `back\\slash\"q\"`,
+	}
+	for value, want := range tests {
+		if got := escapeDN(value); got != want {
+			t.Errorf("escapeDN(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
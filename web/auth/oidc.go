@@ -0,0 +1,426 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// OIDC routes of the dashboards, the callback is the registered redirect URL
+const (
+	OIDCLoginPath    = "/api/auth/oidc/login"
+	OIDCCallbackPath = "/api/auth/oidc/callback"
+)
+
+const (
+	oidcStateCookie    = "oidc_state"
+	oidcStateTimeout   = 10 * time.Minute
+	oidcClockSkew      = time.Minute
+	oidcKeysMinRefresh = time.Minute
+	oidcMaxResponse    = 1 << 20
+)
+
+// OIDC signs users in with an OpenID Connect provider using the authorization code flow with
+// PKCE. The provider's endpoints are discovered on first use so servers start while it is down.
+type OIDC struct {
+	cfg    config.OIDCAuthConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oidcDiscovery is the part of the provider metadata the flow uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDC returns the OpenID Connect provider of cfg
+func NewOIDC(cfg config.OIDCAuthConfig) *OIDC {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "groups"
+	}
+	return &OIDC{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name implements Provider
+func (o *OIDC) Name() string { return ProviderOIDC }
+
+// HandleLogin redirects the browser to the provider, the state, nonce and PKCE verifier of the
+// request are kept in a short-lived cookie until the callback
+func (o *OIDC) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	discovery, err := o.discover(r.Context())
+	if err != nil {
+		logger.Error("OIDC discovery failed", "issuer", o.cfg.Issuer, "err", err)
+		http.Error(w, "Single sign-on unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Unguessable state, nonce and PKCE verifier
+	var secrets [3]string
+	for i := range secrets {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			logger.Error("Failed to generate OIDC state", "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		secrets[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     OIDCCallbackPath,
+		MaxAge:   int(oidcStateTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(o.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode, // Sent on the provider's redirect back
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientID},
+		"redirect_uri":          {o.cfg.RedirectURL},
+		"scope":                 {strings.Join(o.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	target := discovery.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// Callback completes a sign-in: it checks the state of the provider's redirect, exchanges the
+// code for an ID token and returns the identity of its claims
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) (*Identity, error) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: OIDCCallbackPath, MaxAge: -1, HttpOnly: true})
+	if err != nil {
+		return nil, errors.New("missing sign-in state, it expired or the browser blocked the cookie")
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed sign-in state")
+	}
+	state, nonce, verifier := parts[0], parts[1], parts[2]
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+		return nil, errors.New("sign-in state mismatch")
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		return nil, fmt.Errorf("provider error %s: %s", providerErr, query.Get("error_description"))
+	}
+	if query.Get("code") == "" {
+		return nil, errors.New("missing authorization code")
+	}
+
+	rawToken, err := o.exchangeCode(r.Context(), query.Get("code"), verifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := o.verify(r.Context(), rawToken, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	return o.identity(claims)
+}
+
+// discover fetches the provider metadata once
+func (o *OIDC) discover(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	var discovery oidcDiscovery
+	if err := o.getJSON(ctx, strings.TrimSuffix(o.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != o.cfg.Issuer {
+		return nil, fmt.Errorf("discovered issuer %q doesn't match %q", discovery.Issuer, o.cfg.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("provider metadata lacks the authorization, token or JWKS endpoint")
+	}
+	o.discovery = &discovery
+	return o.discovery, nil
+}
+
+// exchangeCode redeems the authorization code for an ID token
+func (o *OIDC) exchangeCode(ctx context.Context, code, verifier string) (string, error) {
+	discovery, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"client_id":     {o.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(&token); err != nil {
+		return "", fmt.Errorf("token endpoint returned status %d: %v", resp.StatusCode, err)
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("token endpoint error %s: %s", token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned status %d without an ID token", resp.StatusCode)
+	}
+	return token.IDToken, nil
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of an ID token and returns
+// its claims
+func (o *OIDC) verify(ctx context.Context, rawToken, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unsupported algorithm %s for an RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("unsupported algorithm %s for an EC key", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, errors.New("bad signature")
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != o.cfg.Issuer {
+		return nil, fmt.Errorf("issuer %q doesn't match", iss)
+	}
+	if !audienceContains(claims["aud"], o.cfg.ClientID) {
+		return nil, errors.New("token was issued for another client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Unix(int64(exp), 0).Add(oidcClockSkew).Before(time.Now()) {
+		return nil, errors.New("token expired")
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// key returns the signing key kid, the key set is fetched again for unknown keys as providers
+// rotate them
+func (o *OIDC) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	discovery, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(o.keysFetched) < oidcKeysMinRefresh && o.keys != nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN == nil && errE == nil && len(e) <= 4 {
+				keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if jwk.Crv == "P-256" && errX == nil && errY == nil {
+				keys[jwk.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			}
+		}
+	}
+	o.keys, o.keysFetched = keys, time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// identity maps the claims of an ID token to a dashboard user
+func (o *OIDC) identity(claims map[string]interface{}) (*Identity, error) {
+	username, _ := claims[o.cfg.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("ID token has no %s claim", o.cfg.UsernameClaim)
+	}
+
+	var values []string
+	switch v := claims[o.cfg.RolesClaim].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	var mapped []string
+	for _, value := range values {
+		if role, ok := o.cfg.RoleMapping[value]; ok {
+			mapped = append(mapped, role)
+		}
+	}
+	role := highestRole(mapped)
+	if role == "" {
+		role = o.cfg.DefaultRole
+	}
+	if role == "" {
+		return nil, fmt.Errorf("%s: %w", username, ErrNoRole)
+	}
+	return &Identity{Username: username, Role: role, Provider: ProviderOIDC}, nil
+}
+
+// getJSON fetches a JSON document of the provider
+func (o *OIDC) getJSON(ctx context.Context, target string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(v)
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains reports whether the aud claim, a string or a list, contains clientID
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, item := range v {
+			if item == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
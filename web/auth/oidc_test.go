@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// fakeIdP is an OpenID Connect provider issuing ID tokens with groups for one code
+type fakeIdP struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	groups    []string
+	nonce     string
+	challenge string
+}
+
+func newFakeIdP(t *testing.T, groups []string) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	idp := &fakeIdP{key: key, groups: groups}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code-1" || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, map[string]interface{}{
+			"iss":                idp.URL,
+			"aud":                "anyproxy",
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"nonce":              idp.nonce,
+			"preferred_username": "alice",
+			"groups":             idp.groups,
+		})})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// sign returns an RS256 JWT of claims
+func (idp *fakeIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15() error = %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// signIn runs the authorization code flow, the provider redirects back with state
+func signIn(t *testing.T, idp *fakeIdP, oidc *OIDC, state func(string) string) (*Identity, error) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	oidc.HandleLogin(w, httptest.NewRequest("GET", OIDCLoginPath, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("Login status = %d, want a redirect", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect: %v", err)
+	}
+	query := location.Query()
+	idp.nonce, idp.challenge = query.Get("nonce"), query.Get("code_challenge")
+
+	callback := httptest.NewRequest("GET", OIDCCallbackPath+"?code=code-1&state="+url.QueryEscape(state(query.Get("state"))), nil)
+	for _, cookie := range w.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	return oidc.Callback(httptest.NewRecorder(), callback)
+}
+
+func TestOIDC_SignIn(t *testing.T) {
+	sameState := func(state string) string { return state }
+	idp := newFakeIdP(t, []string{"staff", "ops", "sre"})
+	oidc := NewOIDC(config.OIDCAuthConfig{
+		Issuer:      idp.URL,
+		ClientID:    "anyproxy",
+		RedirectURL: "https://dashboard.example.com" + OIDCCallbackPath,
+		RoleMapping: map[string]string{"staff": "viewer", "sre": "operator"},
+	})
+
+	identity, err := signIn(t, idp, oidc, sameState)
+	if err != nil {
+		t.Fatalf("Callback() error = %v", err)
+	}
+	if identity.Username != "alice" || identity.Role != "operator" || identity.Provider != ProviderOIDC {
+		t.Errorf("Identity = %+v, want alice as an operator", identity)
+	}
+
+	if _, err := signIn(t, idp, oidc, func(string) string { return "forged" }); err == nil {
+		t.Error("Callback() with a forged state should fail")
+	}
+
+	idp.groups = []string{"contractors"}
+	if _, err := signIn(t, idp, oidc, sameState); !errors.Is(err, ErrNoRole) {
+		t.Errorf("Unmapped groups error = %v, want ErrNoRole", err)
+	}
+}
+
+func TestOIDC_RejectsForeignTokens(t *testing.T) {
+	idp := newFakeIdP(t, nil)
+	oidc := NewOIDC(config.OIDCAuthConfig{Issuer: idp.URL, ClientID: "anyproxy", DefaultRole: "viewer"})
+	valid := map[string]interface{}{"iss": idp.URL, "aud": "anyproxy", "exp": time.Now().Add(time.Hour).Unix(), "nonce": "n1"}
+
+	tests := []struct {
+		name   string
+		change func(map[string]interface{})
+	}{
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "other-app" }},
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"replayed nonce", func(c map[string]interface{}) { c["nonce"] = "n0" }},
+	}
+	if _, err := oidc.verify(context.Background(), idp.sign(t, valid), "n1"); err != nil {
+		t.Fatalf("verify() of a valid token error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := make(map[string]interface{})
+			for k, v := range valid {
+				claims[k] = v
+			}
+			tt.change(claims)
+			if _, err := oidc.verify(context.Background(), idp.sign(t, claims), "n1"); err == nil {
+				t.Error("verify() should fail")
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@
 package client
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -14,32 +15,37 @@ import (
 
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
 	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/web/auth"
+	"github.com/buhuipao/anyproxy/web/sessions"
+	"github.com/buhuipao/anyproxy/web/ui"
 	"gopkg.in/yaml.v2"
 )
 
 // Session represents a user session
-type Session struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	CreatedAt time.Time `json:"created_at"`
-	LastSeen  time.Time `json:"last_seen"`
-	ExpiresAt time.Time `json:"expires_at"`
-}
+type Session = sessions.Session
 
 // SessionManager manages user sessions
 type SessionManager struct {
-	mu       sync.RWMutex
-	sessions map[string]*Session
-	timeout  time.Duration
+	store   sessions.Store
+	signer  *sessions.Signer // Signs session cookies, nil leaves them unsigned
+	timeout time.Duration
 }
 
-// NewSessionManager creates a new session manager
+// NewSessionManager creates a new session manager keeping sessions in memory
 func NewSessionManager(timeout time.Duration) *SessionManager {
+	return NewSessionManagerWithStore(timeout, sessions.NewMemoryStore(), "")
+}
+
+// NewSessionManagerWithStore creates a session manager keeping sessions in store and signing
+// session cookies with key, an empty key leaves cookies unsigned
+func NewSessionManagerWithStore(timeout time.Duration, store sessions.Store, key string) *SessionManager {
 	sm := &SessionManager{
-		sessions: make(map[string]*Session),
-		timeout:  timeout,
+		store:   store,
+		signer:  sessions.NewSigner(key),
+		timeout: timeout,
 	}
 
 	// Start cleanup goroutine
@@ -50,31 +56,38 @@ func NewSessionManager(timeout time.Duration) *SessionManager {
 
 // CreateSession creates a new session for the user
 func (sm *SessionManager) CreateSession(username string) *Session {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	return sm.CreateIdentitySession(&auth.Identity{Username: username})
+}
 
+// CreateIdentitySession creates a new session for a user authenticated by a login provider
+func (sm *SessionManager) CreateIdentitySession(identity *auth.Identity) *Session {
 	sessionID := sm.generateSessionID()
 	now := time.Now()
 
 	session := &Session{
 		ID:        sessionID,
-		Username:  username,
+		Username:  identity.Username,
 		CreatedAt: now,
 		LastSeen:  now,
 		ExpiresAt: now.Add(sm.timeout),
+		Provider:  identity.Provider,
+		Role:      identity.Role,
 	}
 
-	sm.sessions[sessionID] = session
+	if err := sm.store.Save(session); err != nil {
+		logger.Error("Failed to save session", "username", identity.Username, "err", err)
+	}
 	return session
 }
 
 // GetSession retrieves a session by ID
 func (sm *SessionManager) GetSession(sessionID string) *Session {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
-	session, exists := sm.sessions[sessionID]
-	if !exists || session.ExpiresAt.Before(time.Now()) {
+	session, err := sm.store.Load(sessionID)
+	if err != nil {
+		logger.Error("Failed to load session", "err", err)
+		return nil
+	}
+	if session == nil || session.ExpiresAt.Before(time.Now()) {
 		return nil
 	}
 
@@ -83,21 +96,41 @@ func (sm *SessionManager) GetSession(sessionID string) *Session {
 
 // UpdateSession updates the last seen time for a session
 func (sm *SessionManager) UpdateSession(sessionID string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	if session, exists := sm.sessions[sessionID]; exists {
-		session.LastSeen = time.Now()
-		session.ExpiresAt = time.Now().Add(sm.timeout)
+	session, err := sm.store.Load(sessionID)
+	if err != nil || session == nil {
+		return
+	}
+	session.LastSeen = time.Now()
+	session.ExpiresAt = time.Now().Add(sm.timeout)
+	if err := sm.store.Save(session); err != nil {
+		logger.Error("Failed to save session", "username", session.Username, "err", err)
 	}
 }
 
 // DeleteSession deletes a session
 func (sm *SessionManager) DeleteSession(sessionID string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	if err := sm.store.Delete(sessionID); err != nil {
+		logger.Error("Failed to delete session", "err", err)
+	}
+}
+
+// CookieValue returns the session cookie value of a session
+func (sm *SessionManager) CookieValue(session *Session) string {
+	return sm.signer.Sign(session.ID)
+}
+
+// SessionID returns the session ID of a cookie value, ok is false when its signature is invalid
+func (sm *SessionManager) SessionID(cookieValue string) (string, bool) {
+	return sm.signer.Verify(cookieValue)
+}
 
-	delete(sm.sessions, sessionID)
+// SessionFromCookie returns the valid session of a cookie value
+func (sm *SessionManager) SessionFromCookie(cookieValue string) *Session {
+	sessionID, ok := sm.SessionID(cookieValue)
+	if !ok {
+		return nil
+	}
+	return sm.GetSession(sessionID)
 }
 
 // cleanupExpiredSessions removes expired sessions
@@ -106,15 +139,9 @@ func (sm *SessionManager) cleanupExpiredSessions() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		sm.mu.Lock()
-		now := time.Now()
-
-		for sessionID, session := range sm.sessions {
-			if session.ExpiresAt.Before(now) {
-				delete(sm.sessions, sessionID)
-			}
+		if err := sm.store.DeleteExpired(time.Now()); err != nil {
+			logger.Warn("Failed to remove expired sessions", "err", err)
 		}
-		sm.mu.Unlock()
 	}
 }
 
@@ -240,21 +267,37 @@ type WebServer struct {
 	authUsername   string
 	authPassword   string
 	sessionManager *SessionManager
+	authChain      *auth.Chain // Login providers, the auth_username account by default
 
 	// Configuration for clash profile generation
 	config *config.Config
+
+	ui *ui.UI // Theme and translation bundles
 }
 
 // NewClientWebServer creates a new Client web server
 func NewClientWebServer(addr, staticDir, clientID string, rateLimiter *ratelimit.RateLimiter) *WebServer {
-	return &WebServer{
+	cws := &WebServer{
 		addr:           addr,
 		staticDir:      staticDir,
 		clientID:       clientID,
 		rateLimiter:    rateLimiter,
 		startTime:      time.Now(),
 		sessionManager: NewSessionManager(24 * time.Hour), // 24 hour sessions
+		ui:             ui.New(config.WebConfig{}),
 	}
+	cws.authChain = auth.NewChain(cws.localProvider())
+	return cws
+}
+
+// SetUI configures the theme directory, translation bundles and feature flags of the dashboard
+func (cws *WebServer) SetUI(u *ui.UI) {
+	cws.ui = u
+}
+
+// SetSessionStore keeps dashboard sessions in store and signs session cookies with key
+func (cws *WebServer) SetSessionStore(store sessions.Store, key string) {
+	cws.sessionManager = NewSessionManagerWithStore(24*time.Hour, store, key)
 }
 
 // SetAuth configures authentication for the web server
@@ -264,6 +307,26 @@ func (cws *WebServer) SetAuth(enabled bool, username, password string) {
 	cws.authPassword = password
 }
 
+// SetAuthProviders configures the login providers tried for web credentials
+func (cws *WebServer) SetAuthProviders(cfg config.WebAuthConfig) error {
+	chain, err := auth.New(cfg, cws.localProvider())
+	if err != nil {
+		return err
+	}
+	cws.authChain = chain
+	return nil
+}
+
+// localProvider returns the login provider of the auth_username account
+func (cws *WebServer) localProvider() *auth.Local {
+	return auth.NewLocal(func() []auth.Account {
+		if cws.authUsername == "" {
+			return nil
+		}
+		return []auth.Account{{Username: cws.authUsername, Password: cws.authPassword, Role: "admin"}}
+	})
+}
+
 // SetConfigurations sets all necessary configurations for clash profile generation
 func (cws *WebServer) SetConfigurations(cfg *config.Config) {
 	cws.config = cfg
@@ -331,7 +394,7 @@ func (cws *WebServer) Start() error {
 	mux := http.NewServeMux()
 
 	// Static files (with auth protection if enabled)
-	staticHandler := http.FileServer(http.Dir(cws.getStaticDir()))
+	staticHandler := http.FileServer(cws.ui.FileSystem(cws.getStaticDir()))
 	if cws.authEnabled {
 		mux.Handle("/", cws.authMiddleware(staticHandler))
 	} else {
@@ -343,8 +406,16 @@ func (cws *WebServer) Start() error {
 		mux.HandleFunc("/api/auth/login", cws.handleLogin)
 		mux.HandleFunc("/api/auth/logout", cws.handleLogout)
 		mux.HandleFunc("/api/auth/check", cws.handleAuthCheck)
+		mux.HandleFunc("/api/auth/providers", cws.handleAuthProviders)
+		if oidc := cws.authChain.OIDC(); oidc != nil {
+			mux.HandleFunc(auth.OIDCLoginPath, oidc.HandleLogin)
+			mux.HandleFunc(auth.OIDCCallbackPath, cws.handleOIDCCallback)
+		}
 	}
 
+	// Translations and feature flags, public for the login page
+	mux.HandleFunc("/api/ui/config", cws.ui.HandleConfig)
+
 	// Protected API routes
 	protectedHandler := cws.getProtectedHandler()
 
@@ -361,7 +432,11 @@ func (cws *WebServer) Start() error {
 	}
 
 	logger.Info("Starting Client Web server", "addr", cws.addr, "client_id", cws.clientID, "auth_enabled", cws.authEnabled)
-	return cws.server.ListenAndServe()
+	listener, err := sockopt.Listen(context.Background(), "tcp", cws.addr, nil)
+	if err != nil {
+		return err
+	}
+	return cws.server.Serve(listener)
 }
 
 // Stop stops the web server gracefully
@@ -389,8 +464,8 @@ func (cws *WebServer) authMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Validate session
-		session := cws.sessionManager.GetSession(cookie.Value)
-		if session == nil {
+		session := cws.sessionManager.SessionFromCookie(cookie.Value)
+		if session == nil || !cws.sessionValid(session) {
 			cws.requireAuth(w, r)
 			return
 		}
@@ -409,9 +484,13 @@ func (cws *WebServer) isPublicPath(path string) bool {
 	publicPaths := []string{
 		"/login.html",
 		"/js/i18n.js",
+		"/api/ui/config",
 		"/api/auth/login",
 		"/api/auth/logout",
 		"/api/auth/check",
+		"/api/auth/providers",
+		auth.OIDCLoginPath,
+		auth.OIDCCallbackPath,
 	}
 
 	for _, publicPath := range publicPaths {
@@ -467,19 +546,31 @@ func (cws *WebServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate credentials
-	if loginReq.Username != cws.authUsername || loginReq.Password != cws.authPassword {
+	identity, err := cws.authChain.Authenticate(r.Context(), loginReq.Username, loginReq.Password)
+	if err != nil {
 		logger.Warn("Failed login attempt", "username", loginReq.Username, "remote_addr", r.RemoteAddr)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	// Create session
-	session := cws.sessionManager.CreateSession(loginReq.Username)
+	session := cws.startSession(w, r, identity)
+	response := LoginResponse{
+		Status:    "success",
+		Message:   "Login successful",
+		Username:  session.Username,
+		ExpiresAt: session.ExpiresAt,
+	}
+	cws.respondJSON(w, response)
+}
+
+// startSession creates the session of a logged in user and sets its cookie
+func (cws *WebServer) startSession(w http.ResponseWriter, r *http.Request, identity *auth.Identity) *Session {
+	session := cws.sessionManager.CreateIdentitySession(identity)
 
 	// Set session cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:     "client_session_id",
-		Value:    session.ID,
+		Value:    cws.sessionManager.CookieValue(session),
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
@@ -487,15 +578,17 @@ func (cws *WebServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 		Expires:  session.ExpiresAt,
 	})
 
-	logger.Info("User logged in", "username", loginReq.Username, "remote_addr", r.RemoteAddr)
+	logger.Info("User logged in", "username", identity.Username, "provider", identity.Provider, "remote_addr", r.RemoteAddr)
+	return session
+}
 
-	response := LoginResponse{
-		Status:    "success",
-		Message:   "Login successful",
-		Username:  session.Username,
-		ExpiresAt: session.ExpiresAt,
+// sessionValid reports whether the provider a session was created by is still enabled
+func (cws *WebServer) sessionValid(session *Session) bool {
+	provider := session.Provider
+	if provider == "" {
+		provider = auth.ProviderLocal
 	}
-	cws.respondJSON(w, response)
+	return cws.authChain.Enabled(provider)
 }
 
 // handleLogout handles user logout requests
@@ -508,7 +601,9 @@ func (cws *WebServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 	// Get session from cookie
 	cookie, err := r.Cookie("client_session_id")
 	if err == nil {
-		cws.sessionManager.DeleteSession(cookie.Value)
+		if sessionID, ok := cws.sessionManager.SessionID(cookie.Value); ok {
+			cws.sessionManager.DeleteSession(sessionID)
+		}
 	}
 
 	// Clear session cookie
@@ -533,8 +628,8 @@ func (cws *WebServer) handleAuthCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session := cws.sessionManager.GetSession(cookie.Value)
-	if session == nil {
+	session := cws.sessionManager.SessionFromCookie(cookie.Value)
+	if session == nil || !cws.sessionValid(session) {
 		response := AuthCheckResponse{Authenticated: false}
 		cws.respondJSON(w, response)
 		return
@@ -898,52 +993,40 @@ func (cws *WebServer) handleClashProfile(w http.ResponseWriter, r *http.Request)
 		Rules:              []string{},
 	}
 
-	// Add HTTP proxy if configured
-	if cws.config.Gateway.Proxy.HTTP.ListenAddr != "" {
-		httpPort, err := cws.parsePortFromAddress(cws.config.Gateway.Proxy.HTTP.ListenAddr, 8080)
-		if err != nil {
-			logger.Warn("Failed to parse HTTP proxy port, using default", "addr", cws.config.Gateway.Proxy.HTTP.ListenAddr, "err", err)
-			httpPort = 8080
-		}
-
-		httpProxy := ClashProxy{
-			Name:   "anyproxy-http",
-			Type:   "http",
-			Server: host,
-			Port:   httpPort,
-		}
-
-		// Add client group credentials for proxy auth
-		if cws.config.Client.GroupID != "" && cws.config.Client.GroupPassword != "" {
-			httpProxy.Username = cws.config.Client.GroupID
-			httpProxy.Password = cws.config.Client.GroupPassword
+	// Add the HTTP and SOCKS5 listeners the client's group may use
+	defaultPorts := map[string]int{config.ProxyTypeHTTP: 8080, config.ProxyTypeSOCKS5: 1080}
+	counts := make(map[string]int)
+	for _, listener := range cws.config.Gateway.Proxy.AllListeners() {
+		defaultPort, ok := defaultPorts[listener.Type]
+		if !ok || !listenerAdmits(listener, cws.config.Client.GroupID) {
+			continue
 		}
-
-		profile.Proxies = append(profile.Proxies, httpProxy)
-	}
-
-	// Add SOCKS5 proxy if configured
-	if cws.config.Gateway.Proxy.SOCKS5.ListenAddr != "" {
-		socks5Port, err := cws.parsePortFromAddress(cws.config.Gateway.Proxy.SOCKS5.ListenAddr, 1080)
+		port, err := cws.parsePortFromAddress(listener.Addr, defaultPort)
 		if err != nil {
-			logger.Warn("Failed to parse SOCKS5 proxy port, using default", "addr", cws.config.Gateway.Proxy.SOCKS5.ListenAddr, "err", err)
-			socks5Port = 1080
+			logger.Warn("Failed to parse proxy port, using default", "type", listener.Type, "addr", listener.Addr, "err", err)
+			port = defaultPort
 		}
 
-		socks5Proxy := ClashProxy{
-			Name:   "anyproxy-socks5",
-			Type:   "socks5",
+		// Proxy names must be unique, further listeners of a type are numbered
+		counts[listener.Type]++
+		name := "anyproxy-" + listener.Type
+		if counts[listener.Type] > 1 {
+			name = fmt.Sprintf("%s-%d", name, counts[listener.Type])
+		}
+		proxy := ClashProxy{
+			Name:   name,
+			Type:   listener.Type,
 			Server: host,
-			Port:   socks5Port,
+			Port:   port,
 		}
 
 		// Add client group credentials for proxy auth
 		if cws.config.Client.GroupID != "" && cws.config.Client.GroupPassword != "" {
-			socks5Proxy.Username = cws.config.Client.GroupID
-			socks5Proxy.Password = cws.config.Client.GroupPassword
+			proxy.Username = cws.config.Client.GroupID
+			proxy.Password = cws.config.Client.GroupPassword
 		}
 
-		profile.Proxies = append(profile.Proxies, socks5Proxy)
+		profile.Proxies = append(profile.Proxies, proxy)
 	}
 
 	// Check if we have any proxies configured
@@ -994,6 +1077,19 @@ func (cws *WebServer) handleClashProfile(w http.ResponseWriter, r *http.Request)
 	logger.Debug("Generated clash profile", "host", host, "proxies_count", len(profile.Proxies))
 }
 
+// listenerAdmits reports whether a proxy listener accepts the credentials of groupID
+func listenerAdmits(listener config.ProxyListener, groupID string) bool {
+	if len(listener.Groups) == 0 {
+		return true
+	}
+	for _, allowed := range listener.Groups {
+		if allowed == groupID {
+			return true
+		}
+	}
+	return false
+}
+
 // Removed unnecessary config, rate limiting, health and diagnostics handlers to minimize code
 
 // respondJSON returns JSON response
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/web/auth"
+)
+
+// ssoRedirectPage sends the browser to the dashboard after a single sign-on. The session cookie
+// is SameSite=Strict, a redirect on the navigation from the provider's site wouldn't send it.
+const ssoRedirectPage = `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=/"></head><body></body></html>`
+
+// AuthProvidersResponse tells the login page how users can log in
+type AuthProvidersResponse struct {
+	Password bool `json:"password"` // The username and password form
+	OIDC     bool `json:"oidc"`     // Single sign-on at auth.OIDCLoginPath
+}
+
+// handleAuthProviders lists the login methods for the login page
+func (cws *WebServer) handleAuthProviders(w http.ResponseWriter, _ *http.Request) {
+	cws.respondJSON(w, AuthProvidersResponse{
+		Password: cws.authChain.Enabled(auth.ProviderLocal) || cws.authChain.Enabled(auth.ProviderLDAP),
+		OIDC:     cws.authChain.OIDC() != nil,
+	})
+}
+
+// handleOIDCCallback completes a single sign-on and starts the user's session
+func (cws *WebServer) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	identity, err := cws.authChain.OIDC().Callback(w, r)
+	if err != nil {
+		logger.Warn("Failed single sign-on", "remote_addr", r.RemoteAddr, "err", err)
+		http.Redirect(w, r, "/login.html?error=sso", http.StatusFound)
+		return
+	}
+
+	cws.startSession(w, r, identity)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, ssoRedirectPage)
+}
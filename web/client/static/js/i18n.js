@@ -90,6 +90,8 @@ class I18n {
                 'login.logging_in': 'Logging in...',
                 'login.error.invalid': 'Invalid username or password',
                 'login.error.network': 'Network error, please try again later',
+                'login.error.sso': 'Single sign-on failed, please try again',
+                'login.sso': 'Sign in with SSO',
                 'login.footer': '© 2025 AnyProxy. Authentication required to access client interface.',
 
                 // API Errors
@@ -186,6 +188,8 @@ class I18n {
                 'login.logging_in': '登录中...',
                 'login.error.invalid': '用户名或密码错误',
                 'login.error.network': '网络错误，请稍后重试',
+                'login.error.sso': '单点登录失败，请重试',
+                'login.sso': '使用 SSO 登录',
                 'login.footer': '© 2025 AnyProxy. 访问客户端界面需要认证。',
 
                 // API Errors
@@ -197,8 +201,59 @@ class I18n {
             }
         };
 
-        // Apply translations when page loads
+        this.languages = Object.keys(this.translations);
+        this.features = {};
+
+        // Apply translations when page loads, then merge the operator bundles from the backend
         this.applyTranslations();
+        this.loadBackendConfig();
+    }
+
+    // Load operator translations, feature flags and theme stylesheet from the backend
+    async loadBackendConfig(lang = this.currentLanguage) {
+        let config;
+        try {
+            const response = await fetch(`/api/ui/config?lang=${encodeURIComponent(lang)}`);
+            if (!response.ok) {
+                return;
+            }
+            config = await response.json();
+        } catch (e) {
+            console.warn('Failed to load UI config:', e);
+            return;
+        }
+
+        // The operator default applies until the user picks a language
+        if (!localStorage.getItem('preferred-language') && config.default_language && config.default_language !== lang) {
+            this.currentLanguage = config.default_language;
+            return this.loadBackendConfig(config.default_language);
+        }
+
+        this.features = config.features || {};
+        (config.languages || []).forEach(language => {
+            if (!this.languages.includes(language)) {
+                this.languages.push(language);
+            }
+        });
+        this.translations[lang] = Object.assign({}, this.translations[lang] || this.translations['en'], config.translations);
+
+        if (config.theme_stylesheet && !document.getElementById('theme-stylesheet')) {
+            const link = document.createElement('link');
+            link.id = 'theme-stylesheet';
+            link.rel = 'stylesheet';
+            link.href = config.theme_stylesheet;
+            document.head.appendChild(link);
+        }
+
+        if (lang === this.currentLanguage) {
+            this.applyTranslations();
+        }
+        document.dispatchEvent(new CustomEvent('i18n:config', { detail: config }));
+    }
+
+    // hasFeature reports whether the operator enabled a feature flag
+    hasFeature(name) {
+        return this.features[name] === true;
     }
 
     detectLanguage() {
@@ -217,7 +272,8 @@ class I18n {
     }
 
     t(key, params = {}) {
-        const translation = this.translations[this.currentLanguage][key] || key;
+        const bundle = this.translations[this.currentLanguage] || this.translations['en'];
+        const translation = bundle[key] || key;
         
         // Simple parameter substitution
         let result = translation;
@@ -270,9 +326,11 @@ class I18n {
     }
 
     toggleLanguage() {
-        this.currentLanguage = this.currentLanguage === 'en' ? 'zh' : 'en';
+        const index = this.languages.indexOf(this.currentLanguage);
+        this.currentLanguage = this.languages[(index + 1) % this.languages.length];
         localStorage.setItem('preferred-language', this.currentLanguage);
         this.applyTranslations();
+        this.loadBackendConfig();
         
         // Update clash button tooltip specifically
         const clashBtn = document.querySelector('.btn-clash');
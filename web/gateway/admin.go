@@ -0,0 +1,335 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+const (
+	methodPUT    = "PUT"
+	methodDELETE = "DELETE"
+
+	// defaultAuditLogSize is the number of audit entries kept in memory
+	defaultAuditLogSize = 1000
+)
+
+// AdminBackend exposes gateway operations to the admin API
+type AdminBackend interface {
+	GetGroupStatus() []gw.GroupStatus
+	KickClient(clientID string) error
+	RegisterGroup(groupID, password string) error
+	RemoveGroup(groupID string) error
+}
+
+// AuditEntry records a single administrative action
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target,omitempty"`
+	Success    bool      `json:"success"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// AuditLog keeps the most recent administrative actions in memory
+type AuditLog struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+	nextID  int64
+	size    int
+}
+
+// NewAuditLog creates an audit log keeping at most size entries
+func NewAuditLog(size int) *AuditLog {
+	if size <= 0 {
+		size = defaultAuditLogSize
+	}
+	return &AuditLog{
+		entries: make([]AuditEntry, 0, size),
+		nextID:  1,
+		size:    size,
+	}
+}
+
+// Record appends an entry to the audit log
+func (al *AuditLog) Record(entry AuditEntry) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	entry.ID = al.nextID
+	al.nextID++
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	if len(al.entries) >= al.size {
+		al.entries = append(al.entries[:0], al.entries[1:]...)
+	}
+	al.entries = append(al.entries, entry)
+
+	logger.Info("Admin audit", "user", entry.User, "action", entry.Action, "target", entry.Target, "success", entry.Success, "remote_addr", entry.RemoteAddr)
+}
+
+// Since returns entries with an ID greater than sinceID, at most limit entries (0 = all)
+func (al *AuditLog) Since(sinceID int64, limit int) []AuditEntry {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+
+	result := make([]AuditEntry, 0)
+	for _, entry := range al.entries {
+		if entry.ID > sinceID {
+			result = append(result, entry)
+		}
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+// SetAdminBackend enables the gateway admin APIs (groups, clients, credentials)
+func (gws *WebServer) SetAdminBackend(backend AdminBackend) {
+	gws.admin = backend
+}
+
+// GetAuditLog returns the audit log of the web server
+func (gws *WebServer) GetAuditLog() *AuditLog {
+	return gws.auditLog
+}
+
+// registerAdminRoutes registers the admin API used by anyproxyctl
+func (gws *WebServer) registerAdminRoutes(mux *http.ServeMux, protectedHandler func(http.HandlerFunc) http.HandlerFunc) {
+	// Routes are protected by the role they need for reading and for changes, tenant
+	// accounts only get the routes limiting them to their groups
+	route := func(path string, read, write Role, handler http.HandlerFunc) {
+		mux.HandleFunc(path, protectedHandler(gws.requireRole(read, write, gws.denyTenants(handler))))
+	}
+	tenantRoute := func(path string, read, write Role, handler http.HandlerFunc) {
+		mux.HandleFunc(path, protectedHandler(gws.requireRole(read, write, handler)))
+	}
+
+	route("/api/admin/audit", RoleOperator, RoleOperator, gws.handleAudit)
+	route("/api/admin/ratelimit", RoleViewer, RoleAdmin, gws.handleRateLimit)
+	route("/api/admin/metrics/reset", RoleAdmin, RoleAdmin, gws.handleMetricsReset)
+	route("/api/admin/tenants", RoleAdmin, RoleAdmin, gws.handleTenants)
+
+	if gws.admin == nil {
+		return
+	}
+	tenantRoute("/api/admin/groups", RoleViewer, RoleViewer, gws.handleGroups)
+	if _, ok := gws.admin.(TopologyBackend); ok {
+		tenantRoute("/api/admin/groups/topology", RoleViewer, RoleViewer, gws.handleGroupTopology)
+	}
+	tenantRoute("/api/admin/clients/kick", RoleOperator, RoleOperator, gws.handleKickClient)
+	route("/api/admin/credentials", RoleAdmin, RoleAdmin, gws.handleCredentials)
+	if _, ok := gws.admin.(FileTransferBackend); ok {
+		route("/api/admin/files", RoleAdmin, RoleAdmin, gws.handleFiles)
+	}
+	if _, ok := gws.admin.(RemoteExecBackend); ok {
+		route("/api/admin/exec", RoleAdmin, RoleAdmin, gws.handleExec)
+		route("/api/admin/exec/shell", RoleAdmin, RoleAdmin, gws.handleExecShell)
+	}
+	if _, ok := gws.admin.(ScheduleBackend); ok {
+		route("/api/admin/schedule/overrides", RoleViewer, RoleOperator, gws.handleAccessOverrides)
+	}
+	if _, ok := gws.admin.(DryRunBackend); ok {
+		route("/api/admin/dryrun", RoleOperator, RoleOperator, gws.handleDryRun)
+	}
+	if _, ok := gws.admin.(DiagnosticsBackend); ok {
+		route("/api/admin/diagnostics", RoleOperator, RoleOperator, gws.handleDiagnostics)
+	}
+	if _, ok := gws.admin.(MirrorBackend); ok {
+		route("/api/admin/mirror", RoleAdmin, RoleAdmin, gws.handleMirror)
+		route("/api/admin/mirror/stop", RoleAdmin, RoleAdmin, gws.handleMirrorStop)
+		route("/api/admin/mirror/download", RoleAdmin, RoleAdmin, gws.handleMirrorDownload)
+	}
+}
+
+// audit records an admin action performed by the request's user
+func (gws *WebServer) audit(r *http.Request, action, target string, err error) {
+	entry := AuditEntry{
+		User:       gws.auditUser(r),
+		RemoteAddr: r.RemoteAddr,
+		Action:     action,
+		Target:     target,
+		Success:    err == nil,
+	}
+	if err != nil {
+		entry.Detail = err.Error()
+	}
+	gws.auditLog.Record(entry)
+}
+
+// auditUser returns the authenticated user of a request
+func (gws *WebServer) auditUser(r *http.Request) string {
+	// X-User is only trustworthy when set by authMiddleware
+	if gws.authEnabled && r.Header.Get("X-User") != "" {
+		return r.Header.Get("X-User")
+	}
+	return "anonymous"
+}
+
+// handleGroups returns the status of all groups
+func (gws *WebServer) handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupID := r.URL.Query().Get("group_id")
+	statuses := gws.requestTenant(r).groupStatuses(gws.admin.GetGroupStatus())
+	if groupID == "" {
+		gws.respondJSON(w, statuses)
+		return
+	}
+
+	for _, status := range statuses {
+		if status.GroupID == groupID {
+			gws.respondJSON(w, status)
+			return
+		}
+	}
+	http.Error(w, "Group not found", http.StatusNotFound)
+}
+
+// handleKickClient disconnects a client
+func (gws *WebServer) handleKickClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodPOST {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ClientID string `json:"client_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ClientID == "" {
+		http.Error(w, "Invalid request: client_id is required", http.StatusBadRequest)
+		return
+	}
+
+	// Clients outside a tenant's groups are reported like unknown clients
+	var err error
+	if !gws.requestTenant(r).allowsGroupClient(gws.admin.GetGroupStatus(), req.ClientID) {
+		err = fmt.Errorf("%w: %s", gw.ErrClientNotFound, req.ClientID)
+	} else {
+		err = gws.admin.KickClient(req.ClientID)
+	}
+	gws.audit(r, "client.kick", req.ClientID, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	gws.respondJSON(w, AdminResponse{Status: "success", Message: "Client disconnected"})
+}
+
+// handleCredentials sets (POST) or removes (DELETE) group credentials
+func (gws *WebServer) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case methodPOST:
+		var req struct {
+			GroupID  string `json:"group_id"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		err := gws.admin.RegisterGroup(req.GroupID, req.Password)
+		gws.audit(r, "credential.set", req.GroupID, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gws.respondJSON(w, AdminResponse{Status: "success", Message: "Credentials updated"})
+	case methodDELETE:
+		groupID := r.URL.Query().Get("group_id")
+		err := gws.admin.RemoveGroup(groupID)
+		gws.audit(r, "credential.delete", groupID, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gws.respondJSON(w, AdminResponse{Status: "success", Message: "Credentials removed"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRateLimit returns (GET) or replaces (PUT) the rate limit rules
+func (gws *WebServer) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	if gws.rateLimiter == nil {
+		http.Error(w, "Rate limiting not configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case methodGET:
+		gws.respondJSON(w, gws.rateLimiter.GetConfig())
+	case methodPUT:
+		var cfg ratelimit.Config
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if cfg.Rules == nil {
+			cfg.Rules = make([]*ratelimit.Rule, 0)
+		}
+
+		err := gws.rateLimiter.UpdateConfig(&cfg)
+		gws.audit(r, "ratelimit.update", strconv.Itoa(len(cfg.Rules))+" rules", err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		gws.respondJSON(w, AdminResponse{Status: "success", Message: "Rate limit rules updated"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAudit returns audit entries newer than the since query parameter
+func (gws *WebServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sinceID int64
+	if since := r.URL.Query().Get("since"); since != "" {
+		parsed, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		sinceID = parsed
+	}
+
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	gws.respondJSON(w, gws.auditLog.Since(sinceID, limit))
+}
+
+// AdminResponse represents the result of an admin action
+type AdminResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
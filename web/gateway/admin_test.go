@@ -0,0 +1,336 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// mockAdminBackend implements AdminBackend for testing
+type mockAdminBackend struct {
+	groups      []gw.GroupStatus
+	kicked      []string
+	credentials map[string]string
+}
+
+func (m *mockAdminBackend) GetGroupStatus() []gw.GroupStatus {
+	return m.groups
+}
+
+func (m *mockAdminBackend) KickClient(clientID string) error {
+	for _, group := range m.groups {
+		for _, id := range group.Clients {
+			if id == clientID {
+				m.kicked = append(m.kicked, clientID)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client not found: %s", clientID)
+}
+
+func (m *mockAdminBackend) RegisterGroup(groupID, password string) error {
+	m.credentials[groupID] = password
+	return nil
+}
+
+func (m *mockAdminBackend) RemoveGroup(groupID string) error {
+	delete(m.credentials, groupID)
+	return nil
+}
+
+// DialClientFileService serves a fake file transfer service over an in-memory connection
+func (m *mockAdminBackend) DialClientFileService(_ context.Context, clientID string) (net.Conn, error) {
+	if clientID != "client-1" {
+		return nil, fmt.Errorf("client not found: %s", clientID)
+	}
+	gatewaySide, clientSide := net.Pipe()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer file-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "%s %s", r.Method, r.URL.Query().Get("path"))
+	}), ReadHeaderTimeout: time.Second}
+	go func() { _ = server.Serve(&oneConnListener{conn: clientSide}) }()
+	return gatewaySide, nil
+}
+
+// DialClientExecService serves a fake remote exec service, client-2's group has remote exec disabled
+func (m *mockAdminBackend) DialClientExecService(_ context.Context, clientID string) (net.Conn, error) {
+	if clientID == "client-2" {
+		return nil, fmt.Errorf("%w: group tenant-a", utils.ErrRemoteExecDisabled)
+	}
+	gatewaySide, clientSide := net.Pipe()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/exec/commands" {
+			_, _ = io.WriteString(w, `{"commands":["uptime"],"shell":false}`)
+			return
+		}
+		w.Header().Set("Trailer", protocol.ExecExitCodeTrailer)
+		_, _ = fmt.Fprintf(w, "ran %s", r.URL.Query().Get("name"))
+		w.Header().Set(protocol.ExecExitCodeTrailer, "3")
+	}), ReadHeaderTimeout: time.Second}
+	go func() { _ = server.Serve(&oneConnListener{conn: clientSide}) }()
+	return gatewaySide, nil
+}
+
+// oneConnListener yields a single connection
+type oneConnListener struct {
+	conn net.Conn
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, io.EOF
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *oneConnListener) Close() error   { return nil }
+func (l *oneConnListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func newAdminTestServer() (*WebServer, *mockAdminBackend, *http.ServeMux) {
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	backend := &mockAdminBackend{
+		groups: []gw.GroupStatus{
+			{GroupID: "tenant-a", Clients: []string{"client-1", "client-2"}, ActiveConnections: 3, MaxConnections: 10},
+		},
+		credentials: make(map[string]string),
+	}
+	server.SetAdminBackend(backend)
+
+	mux := http.NewServeMux()
+	server.registerAdminRoutes(mux, server.getProtectedHandler())
+	return server, backend, mux
+}
+
+func TestAuditLog_Since(t *testing.T) {
+	auditLog := NewAuditLog(3)
+	for i := 0; i < 5; i++ {
+		auditLog.Record(AuditEntry{Action: fmt.Sprintf("action-%d", i), Success: true})
+	}
+
+	entries := auditLog.Since(0, 0)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 retained entries, got %d", len(entries))
+	}
+	if entries[0].ID != 3 || entries[2].ID != 5 {
+		t.Errorf("Expected IDs 3..5, got %d..%d", entries[0].ID, entries[2].ID)
+	}
+
+	if entries := auditLog.Since(4, 0); len(entries) != 1 || entries[0].Action != "action-4" {
+		t.Errorf("Expected only the newest entry, got %+v", entries)
+	}
+	if entries := auditLog.Since(0, 2); len(entries) != 2 || entries[1].ID != 5 {
+		t.Errorf("Expected the 2 newest entries, got %+v", entries)
+	}
+}
+
+func TestWebServer_AdminGroups(t *testing.T) {
+	_, _, mux := newAdminTestServer()
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/groups", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	var groups []gw.GroupStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(groups) != 1 || groups[0].GroupID != "tenant-a" || groups[0].ActiveConnections != 3 {
+		t.Errorf("Unexpected groups response: %+v", groups)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/groups?group_id=missing", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown group, got %d", rr.Code)
+	}
+}
+
+func TestWebServer_AdminKickClient(t *testing.T) {
+	server, backend, mux := newAdminTestServer()
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/admin/clients/kick", strings.NewReader(`{"client_id":"client-1"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(backend.kicked) != 1 || backend.kicked[0] != "client-1" {
+		t.Errorf("Expected client-1 to be kicked, got %v", backend.kicked)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/admin/clients/kick", strings.NewReader(`{"client_id":"unknown"}`)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown client, got %d", rr.Code)
+	}
+
+	entries := server.GetAuditLog().Since(0, 0)
+	if len(entries) != 2 || !entries[0].Success || entries[1].Success || entries[0].Action != "client.kick" {
+		t.Errorf("Expected successful and failed kick audit entries, got %+v", entries)
+	}
+}
+
+func TestWebServer_AdminCredentials(t *testing.T) {
+	_, backend, mux := newAdminTestServer()
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/admin/credentials", strings.NewReader(`{"group_id":"tenant-b","password":"secret"}`)))
+	if rr.Code != http.StatusOK || backend.credentials["tenant-b"] != "secret" {
+		t.Fatalf("Expected credentials to be set, got status %d and %v", rr.Code, backend.credentials)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/admin/credentials?group_id=tenant-b", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	if _, exists := backend.credentials["tenant-b"]; exists {
+		t.Error("Expected credentials to be removed")
+	}
+}
+
+func TestWebServer_AdminRateLimit(t *testing.T) {
+	server, _, mux := newAdminTestServer()
+
+	body := `{"rules":[{"id":"r1","type":"client","identifier":"client-1","enabled":true,"bandwidth_limit":1024}]}`
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/admin/ratelimit", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rules := server.rateLimiter.GetConfig().Rules
+	if len(rules) != 1 || rules[0].ID != "r1" || rules[0].BandwidthLimit != 1024 {
+		t.Errorf("Expected rule r1 to be stored, got %+v", rules)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/admin/ratelimit", nil))
+	var cfg ratelimit.Config
+	if err := json.Unmarshal(rr.Body.Bytes(), &cfg); err != nil || len(cfg.Rules) != 1 {
+		t.Errorf("Expected 1 rule from GET, got %+v (err: %v)", cfg, err)
+	}
+}
+
+func TestWebServer_PrometheusScrapeAuth(t *testing.T) {
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	server.SetAuth(true, "admin", "secret")
+	handler := server.scrapeHandler(server.handlePrometheusMetrics)
+
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with basic auth challenge, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("admin", "wrong")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong password, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("admin", "secret")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "anyproxy_connections_total") {
+		t.Errorf("Expected metrics with valid basic auth, got %d", rr.Code)
+	}
+}
+
+func TestWebServer_AdminFiles(t *testing.T) {
+	server, _, mux := newAdminTestServer()
+
+	req := httptest.NewRequest("GET", "/api/admin/files?client_id=client-1&path=logs/client.log", nil)
+	req.Header.Set("X-File-Token", "file-token")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "GET logs/client.log" {
+		t.Fatalf("Expected proxied download, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("PUT", "/api/admin/files?client_id=client-1&path=app.conf", strings.NewReader("a=1"))
+	req.Header.Set("X-File-Token", "wrong")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected client 401 to be passed through, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/admin/files?client_id=unknown&path=x", nil)
+	req.Header.Set("X-File-Token", "file-token")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for unknown client, got %d", rr.Code)
+	}
+
+	entries := server.GetAuditLog().Since(0, 0)
+	if len(entries) != 3 || entries[0].Action != "files.get" || !entries[0].Success || entries[1].Action != "files.put" || entries[1].Success {
+		t.Errorf("Unexpected audit entries: %+v", entries)
+	}
+}
+
+func TestWebServer_AdminExec(t *testing.T) {
+	server, _, mux := newAdminTestServer()
+
+	req := httptest.NewRequest("GET", "/api/admin/exec?client_id=client-1", nil)
+	req.Header.Set("X-Exec-Token", "exec-token")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "uptime") {
+		t.Fatalf("Expected command listing, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/api/admin/exec?client_id=client-1&command=uptime", nil)
+	req.Header.Set("X-Exec-Token", "exec-token")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "ran uptime" {
+		t.Fatalf("Expected command output, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if code := rr.Result().Trailer.Get(protocol.ExecExitCodeTrailer); code != "3" {
+		t.Errorf("Expected exit code trailer 3, got %q", code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/admin/exec?client_id=client-2&command=uptime", nil)
+	req.Header.Set("X-Exec-Token", "exec-token")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for group without remote exec, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/admin/exec/shell?client_id=client-1", nil)
+	req.Header.Set("X-Exec-Token", "exec-token")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUpgradeRequired {
+		t.Errorf("Expected 426 for shell request without upgrade, got %d", rr.Code)
+	}
+
+	entries := server.GetAuditLog().Since(0, 0)
+	if len(entries) != 2 || entries[0].Action != "exec.run" || entries[0].Success || entries[0].Detail != "exit code 3" || entries[1].Success {
+		t.Errorf("Unexpected audit entries: %+v", entries)
+	}
+}
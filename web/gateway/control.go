@@ -0,0 +1,269 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	controlv1 "github.com/buhuipao/anyproxy/pkg/control/v1"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// controlRoles are the roles the methods of the gRPC control API require, like the REST routes
+var controlRoles = map[string]Role{
+	controlv1.ControlService_GetVersion_FullMethodName:            RoleViewer,
+	controlv1.ControlService_ListGroups_FullMethodName:            RoleViewer,
+	controlv1.ControlService_KickClient_FullMethodName:            RoleOperator,
+	controlv1.ControlService_SetGroupCredential_FullMethodName:    RoleAdmin,
+	controlv1.ControlService_DeleteGroupCredential_FullMethodName: RoleAdmin,
+	controlv1.ControlService_ListAuditEntries_FullMethodName:      RoleOperator,
+}
+
+// controlTenantMethods are the methods open to tenant accounts, limited to their groups
+var controlTenantMethods = map[string]bool{
+	controlv1.ControlService_GetVersion_FullMethodName: true,
+	controlv1.ControlService_ListGroups_FullMethodName: true,
+	controlv1.ControlService_KickClient_FullMethodName: true,
+}
+
+// controlCaller is the authenticated account of a gRPC call
+type controlCaller struct {
+	user       string
+	remoteAddr string
+	tenant     tenant
+}
+
+type controlCallerKey struct{}
+
+// callerOf returns the caller of a gRPC call, set by authorizeControl
+func callerOf(ctx context.Context) controlCaller {
+	caller, _ := ctx.Value(controlCallerKey{}).(controlCaller)
+	return caller
+}
+
+// StartControl serves the gRPC control API, blocking like Start
+func (gws *WebServer) StartControl(cfg config.GRPCControlConfig) error {
+	var opts []grpc.ServerOption
+	if cfg.TLSCert != "" {
+		cert, err := config.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})))
+	}
+	server := gws.newControlServer(opts...)
+	listener, err := sockopt.Listen(context.Background(), "tcp", cfg.ListenAddr, &config.SocketOptions{ReusePort: gws.reusePort})
+	if err != nil {
+		return err
+	}
+	gws.controlMu.Lock()
+	gws.control = server
+	gws.controlMu.Unlock()
+
+	logger.Info("Starting gateway gRPC control API", "addr", cfg.ListenAddr, "tls_enabled", cfg.TLSCert != "", "auth_enabled", gws.authEnabled)
+	return server.Serve(listener)
+}
+
+// newControlServer returns a gRPC server of the control API
+func (gws *WebServer) newControlServer(opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(append(opts, grpc.UnaryInterceptor(gws.authorizeControl))...)
+	controlv1.RegisterControlServiceServer(server, &controlServer{gws: gws})
+	return server
+}
+
+// stopControl stops the gRPC control API, open calls are cancelled
+func (gws *WebServer) stopControl() {
+	gws.controlMu.Lock()
+	defer gws.controlMu.Unlock()
+	if gws.control != nil {
+		gws.control.Stop()
+		gws.control = nil
+	}
+}
+
+// authorizeControl authenticates gRPC calls with the dashboard accounts and checks their role
+func (gws *WebServer) authorizeControl(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	caller := controlCaller{user: "anonymous"}
+	if p, ok := peer.FromContext(ctx); ok {
+		caller.remoteAddr = p.Addr.String()
+	}
+
+	role := RoleAdmin
+	if gws.authEnabled {
+		// Basic credentials are parsed like HTTP's Authorization header
+		md, _ := metadata.FromIncomingContext(ctx)
+		username, password, ok := (&http.Request{Header: http.Header{"Authorization": md.Get("authorization")}}).BasicAuth()
+		account, valid := gws.authenticate(ctx, username, password)
+		if !ok || !valid {
+			logger.Warn("gRPC control call with invalid credentials", "user", username, "method", info.FullMethod, "remote_addr", caller.remoteAddr)
+			return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+		}
+		caller.user, role = account.username, account.role
+		if len(account.groups) > 0 {
+			caller.tenant = make(tenant)
+			for _, group := range account.groups {
+				caller.tenant[group] = true
+			}
+		}
+	}
+
+	required, known := controlRoles[info.FullMethod]
+	var denied error
+	switch {
+	case !known:
+		denied = status.Error(codes.Unimplemented, "unknown method")
+	case !role.Allows(required):
+		denied = status.Errorf(codes.PermissionDenied, "requires the %s role", required)
+	case caller.tenant != nil && !controlTenantMethods[info.FullMethod]:
+		denied = status.Error(codes.PermissionDenied, "not available to tenant accounts")
+	}
+	if denied != nil {
+		logger.Warn("gRPC control call denied", "user", caller.user, "role", role, "method", info.FullMethod)
+		gws.auditControl(caller, "authz.denied", info.FullMethod, errors.New(status.Convert(denied).Message()))
+		return nil, denied
+	}
+	return handler(context.WithValue(ctx, controlCallerKey{}, caller), req)
+}
+
+// auditControl records an admin action of a gRPC caller
+func (gws *WebServer) auditControl(caller controlCaller, action, target string, err error) {
+	entry := AuditEntry{
+		User:       caller.user,
+		RemoteAddr: caller.remoteAddr,
+		Action:     action,
+		Target:     target,
+		Success:    err == nil,
+	}
+	if err != nil {
+		entry.Detail = err.Error()
+	}
+	gws.auditLog.Record(entry)
+}
+
+// controlServer implements the gRPC control API with the admin backend of the web server
+type controlServer struct {
+	controlv1.UnimplementedControlServiceServer
+	gws *WebServer
+}
+
+// backend returns the admin backend, group and client methods are unavailable without one
+func (s *controlServer) backend() (AdminBackend, error) {
+	if s.gws.admin == nil {
+		return nil, status.Error(codes.Unimplemented, "gateway admin API not enabled")
+	}
+	return s.gws.admin, nil
+}
+
+func (s *controlServer) GetVersion(context.Context, *controlv1.GetVersionRequest) (*controlv1.GetVersionResponse, error) {
+	return &controlv1.GetVersionResponse{Version: version.Version, Commit: version.Commit, BuildTime: version.BuildTime}, nil
+}
+
+func (s *controlServer) ListGroups(ctx context.Context, req *controlv1.ListGroupsRequest) (*controlv1.ListGroupsResponse, error) {
+	admin, err := s.backend()
+	if err != nil {
+		return nil, err
+	}
+	resp := &controlv1.ListGroupsResponse{}
+	for _, group := range callerOf(ctx).tenant.groupStatuses(admin.GetGroupStatus()) {
+		if req.GroupId != "" && group.GroupID != req.GroupId {
+			continue
+		}
+		resp.Groups = append(resp.Groups, &controlv1.Group{
+			GroupId:           group.GroupID,
+			Clients:           group.Clients,
+			ActiveConnections: int32(group.ActiveConnections),
+			MaxClients:        int32(group.MaxClients),
+			MaxConnections:    int32(group.MaxConnections),
+			StickySession:     group.StickySession,
+			Balancing:         group.Balancing,
+			Hibernating:       group.Hibernating,
+		})
+	}
+	if req.GroupId != "" && len(resp.Groups) == 0 {
+		return nil, status.Error(codes.NotFound, "group not found")
+	}
+	return resp, nil
+}
+
+func (s *controlServer) KickClient(ctx context.Context, req *controlv1.KickClientRequest) (*controlv1.KickClientResponse, error) {
+	admin, err := s.backend()
+	if err != nil {
+		return nil, err
+	}
+	if req.ClientId == "" {
+		return nil, status.Error(codes.InvalidArgument, "client_id is required")
+	}
+
+	// Clients outside a tenant's groups are reported like unknown clients
+	caller := callerOf(ctx)
+	if !caller.tenant.allowsGroupClient(admin.GetGroupStatus(), req.ClientId) {
+		err = fmt.Errorf("%w: %s", gw.ErrClientNotFound, req.ClientId)
+	} else {
+		err = admin.KickClient(req.ClientId)
+	}
+	s.gws.auditControl(caller, "client.kick", req.ClientId, err)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &controlv1.KickClientResponse{}, nil
+}
+
+func (s *controlServer) SetGroupCredential(ctx context.Context, req *controlv1.SetGroupCredentialRequest) (*controlv1.SetGroupCredentialResponse, error) {
+	admin, err := s.backend()
+	if err != nil {
+		return nil, err
+	}
+	err = admin.RegisterGroup(req.GroupId, req.Password)
+	s.gws.auditControl(callerOf(ctx), "credential.set", req.GroupId, err)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &controlv1.SetGroupCredentialResponse{}, nil
+}
+
+func (s *controlServer) DeleteGroupCredential(ctx context.Context, req *controlv1.DeleteGroupCredentialRequest) (*controlv1.DeleteGroupCredentialResponse, error) {
+	admin, err := s.backend()
+	if err != nil {
+		return nil, err
+	}
+	err = admin.RemoveGroup(req.GroupId)
+	s.gws.auditControl(callerOf(ctx), "credential.delete", req.GroupId, err)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &controlv1.DeleteGroupCredentialResponse{}, nil
+}
+
+func (s *controlServer) ListAuditEntries(_ context.Context, req *controlv1.ListAuditEntriesRequest) (*controlv1.ListAuditEntriesResponse, error) {
+	if req.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit cannot be negative")
+	}
+	resp := &controlv1.ListAuditEntriesResponse{}
+	for _, entry := range s.gws.auditLog.Since(req.SinceId, int(req.Limit)) {
+		resp.Entries = append(resp.Entries, &controlv1.AuditEntry{
+			Id:         entry.ID,
+			Time:       timestamppb.New(entry.Time),
+			User:       entry.User,
+			RemoteAddr: entry.RemoteAddr,
+			Action:     entry.Action,
+			Target:     entry.Target,
+			Success:    entry.Success,
+			Detail:     entry.Detail,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	controlv1 "github.com/buhuipao/anyproxy/pkg/control/v1"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// newControlClient serves the control API of gws in memory
+func newControlClient(t *testing.T, gws *WebServer) controlv1.ControlServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := gws.newControlServer()
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return controlv1.NewControlServiceClient(conn)
+}
+
+// asUser returns a context calling with the credentials of a dashboard account
+func asUser(username, password string) context.Context {
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", auth)
+}
+
+func TestControlAPI(t *testing.T) {
+	backend := &mockAdminBackend{
+		groups: []gw.GroupStatus{
+			{GroupID: "acme", Clients: []string{"client-1"}, ActiveConnections: 3},
+			{GroupID: "globex", Clients: []string{"client-2"}},
+		},
+		credentials: make(map[string]string),
+	}
+	gws := NewGatewayWebServer(":0", "", nil)
+	gws.SetAdminBackend(backend)
+	gws.SetAuth(true, "admin", "secret")
+	gws.SetUsers([]config.WebUserConfig{
+		{Username: "noc", Password: "noc-pw", Role: "viewer"},
+		{Username: "acme", Password: "acme-pw", Role: "operator", Groups: []string{"acme"}},
+	})
+	client := newControlClient(t, gws)
+
+	if _, err := client.ListGroups(context.Background(), &controlv1.ListGroupsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("ListGroups() without credentials error = %v, want Unauthenticated", err)
+	}
+	if _, err := client.ListGroups(asUser("admin", "wrong"), &controlv1.ListGroupsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("ListGroups() with a wrong password error = %v, want Unauthenticated", err)
+	}
+
+	groups, err := client.ListGroups(asUser("noc", "noc-pw"), &controlv1.ListGroupsRequest{})
+	if err != nil || len(groups.Groups) != 2 || groups.Groups[0].ActiveConnections != 3 {
+		t.Errorf("ListGroups() = %v, %v, want both groups", groups, err)
+	}
+	if _, err := client.KickClient(asUser("noc", "noc-pw"), &controlv1.KickClientRequest{ClientId: "client-1"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("KickClient() as viewer error = %v, want PermissionDenied", err)
+	}
+
+	// Tenants only see and kick the clients of their groups
+	groups, err = client.ListGroups(asUser("acme", "acme-pw"), &controlv1.ListGroupsRequest{})
+	if err != nil || len(groups.Groups) != 1 || groups.Groups[0].GroupId != "acme" {
+		t.Errorf("ListGroups() as tenant = %v, %v, want only acme", groups, err)
+	}
+	if _, err := client.KickClient(asUser("acme", "acme-pw"), &controlv1.KickClientRequest{ClientId: "client-2"}); status.Code(err) != codes.NotFound {
+		t.Errorf("KickClient() of another tenant's client error = %v, want NotFound", err)
+	}
+	if _, err := client.KickClient(asUser("acme", "acme-pw"), &controlv1.KickClientRequest{ClientId: "client-1"}); err != nil {
+		t.Errorf("KickClient() error = %v", err)
+	}
+	if _, err := client.ListAuditEntries(asUser("acme", "acme-pw"), &controlv1.ListAuditEntriesRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ListAuditEntries() as tenant error = %v, want PermissionDenied", err)
+	}
+
+	if _, err := client.SetGroupCredential(asUser("admin", "secret"), &controlv1.SetGroupCredentialRequest{GroupId: "initech", Password: "pw"}); err != nil || backend.credentials["initech"] != "pw" {
+		t.Errorf("SetGroupCredential() error = %v, credentials = %v", err, backend.credentials)
+	}
+
+	// Calls are audited like REST requests
+	audit, err := client.ListAuditEntries(asUser("admin", "secret"), &controlv1.ListAuditEntriesRequest{Limit: 2})
+	if err != nil || len(audit.Entries) != 2 {
+		t.Fatalf("ListAuditEntries() = %v, %v, want 2 entries", audit, err)
+	}
+	if kick := audit.Entries[0]; kick.Action != "authz.denied" || kick.User != "acme" {
+		t.Errorf("Entry = %v, want the denied audit read of acme", kick)
+	}
+	if set := audit.Entries[1]; set.Action != "credential.set" || set.User != "admin" || !set.Success || set.Time.AsTime().IsZero() {
+		t.Errorf("Entry = %v, want the credential change of admin", set)
+	}
+}
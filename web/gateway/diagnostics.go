@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// DiagnosticsBackend is implemented by gateways measuring client tunnels
+type DiagnosticsBackend interface {
+	DiagnoseClient(ctx context.Context, req gw.DiagnosticsRequest) (*gw.DiagnosticsResult, error)
+}
+
+// handleDiagnostics measures the tunnel of a client (POST ?client_id=&pings=&bytes=): round
+// trips, throughput both ways and the path MTU. It takes as long as the tests, up to minutes
+// on slow links.
+func (gws *WebServer) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodPOST {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	req := gw.DiagnosticsRequest{ClientID: query.Get("client_id")}
+	if req.ClientID == "" {
+		http.Error(w, "Invalid request: client_id is required", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if v := query.Get("pings"); v != "" {
+		if req.Pings, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid pings", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("bytes"); v != "" {
+		if req.Bytes, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid bytes", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Clients outside a tenant's groups are reported like unknown clients
+	if !gws.requestTenant(r).allowsGroupClient(gws.admin.GetGroupStatus(), req.ClientID) {
+		err := fmt.Errorf("%w: %s", gw.ErrClientNotFound, req.ClientID)
+		gws.audit(r, "client.diagnose", req.ClientID, err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	result, err := gws.admin.(DiagnosticsBackend).DiagnoseClient(r.Context(), req)
+	gws.audit(r, "client.diagnose", req.ClientID, err)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, gw.ErrClientNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	gws.respondJSON(w, result)
+}
@@ -0,0 +1,33 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// DryRunBackend is implemented by gateways evaluating hypothetical dials
+type DryRunBackend interface {
+	DryRun(ctx context.Context, req gw.DryRunRequest) (*gw.DryRunResult, error)
+}
+
+// handleDryRun evaluates the policies a dial would pass (POST), without connecting
+func (gws *WebServer) handleDryRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodPOST {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req gw.DryRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	result, err := gws.admin.(DryRunBackend).DryRun(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gws.respondJSON(w, result)
+}
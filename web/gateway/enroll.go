@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/common/autotls"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// EnrollmentBackend hands the gateway CA to enrolling clients
+type EnrollmentBackend interface {
+	EnrollmentCA(token string) ([]byte, error)
+}
+
+// registerEnrollRoutes registers the client enrollment endpoint, authenticated by the
+// enrollment token instead of a web login
+func (gws *WebServer) registerEnrollRoutes(mux *http.ServeMux) {
+	if _, ok := gws.admin.(EnrollmentBackend); ok {
+		mux.HandleFunc(autotls.EnrollPath, gws.handleEnrollCA)
+	}
+}
+
+// handleEnrollCA serves the gateway CA to clients presenting the enrollment token
+func (gws *WebServer) handleEnrollCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	ca, err := gws.admin.(EnrollmentBackend).EnrollmentCA(token)
+	switch {
+	case errors.Is(err, gw.ErrEnrollmentDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		logger.Warn("Rejected client enrollment", "remote_addr", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	logger.Info("Client enrolled, sent the gateway CA", "remote_addr", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	_, _ = w.Write(ca)
+}
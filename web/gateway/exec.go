@@ -0,0 +1,294 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	"github.com/buhuipao/anyproxy/pkg/common/utils"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// Remote exec limits
+const (
+	// execRequestTimeout bounds a remote command, the client enforces its own shorter timeout
+	execRequestTimeout = 10 * time.Minute
+	// shellDialTimeout bounds opening a remote shell, the session itself has no timeout
+	shellDialTimeout = 30 * time.Second
+	// maxShellAuditLine truncates logged shell input lines
+	maxShellAuditLine = 1024
+)
+
+// RemoteExecBackend opens connections to client remote exec services
+type RemoteExecBackend interface {
+	DialClientExecService(ctx context.Context, clientID string) (net.Conn, error)
+}
+
+// execParams validates the common remote exec parameters.
+// The client's remote exec token is passed in the X-Exec-Token header.
+func (gws *WebServer) execParams(w http.ResponseWriter, r *http.Request) (RemoteExecBackend, string, string, bool) {
+	clientID := r.URL.Query().Get("client_id")
+	token := r.Header.Get("X-Exec-Token")
+	if clientID == "" || token == "" {
+		http.Error(w, "Invalid request: client_id and X-Exec-Token are required", http.StatusBadRequest)
+		return nil, "", "", false
+	}
+	backend, ok := gws.admin.(RemoteExecBackend)
+	if !ok {
+		http.Error(w, "Remote exec is not supported", http.StatusNotImplemented)
+		return nil, "", "", false
+	}
+	return backend, clientID, token, true
+}
+
+// respondExecError writes the error of a failed remote exec request
+func respondExecError(w http.ResponseWriter, err error) {
+	if errors.Is(err, utils.ErrRemoteExecDisabled) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, gw.ErrClientNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Remote exec unavailable: "+err.Error(), http.StatusBadGateway)
+}
+
+// handleExec lists a client's commands (GET) or runs one of them (POST ?command=name).
+// Command output is streamed, the exit code is returned in the X-Exit-Code trailer.
+func (gws *WebServer) handleExec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET && r.Method != methodPOST {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	backend, clientID, token, ok := gws.execParams(w, r)
+	if !ok {
+		return
+	}
+
+	command := r.URL.Query().Get("command")
+	targetURL := "http://" + protocol.ExecServiceHost + "/exec/commands"
+	if r.Method == methodPOST {
+		if command == "" {
+			http.Error(w, "Invalid request: command is required", http.StatusBadRequest)
+			return
+		}
+		targetURL = "http://" + protocol.ExecServiceHost + "/exec/run?" + url.Values{"name": {command}}.Encode()
+	}
+
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return backend.DialClientExecService(ctx, clientID)
+	}
+	resp, err := clientServiceRequest(r, dial, r.Method, targetURL, nil, token, execRequestTimeout, "remote exec", clientID)
+	if err != nil {
+		if r.Method == methodPOST {
+			gws.audit(r, "exec.run", clientID+":"+command, err)
+		}
+		logger.Error("Remote exec through tunnel failed", "client_id", clientID, "command", command, "err", err)
+		respondExecError(w, err)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if r.Method == methodGET {
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	if resp.StatusCode == http.StatusOK {
+		w.Header().Set("Trailer", protocol.ExecExitCodeTrailer+", "+protocol.ExecTruncatedTrailer)
+	}
+	w.WriteHeader(resp.StatusCode)
+	copyErr := copyFlush(w, resp.Body)
+
+	// Trailers are only populated once the body has been read to the end
+	exitCode := resp.Trailer.Get(protocol.ExecExitCodeTrailer)
+	if resp.StatusCode == http.StatusOK {
+		w.Header().Set(protocol.ExecExitCodeTrailer, exitCode)
+		w.Header().Set(protocol.ExecTruncatedTrailer, resp.Trailer.Get(protocol.ExecTruncatedTrailer))
+	}
+
+	var auditErr error
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		auditErr = fmt.Errorf("client returned %s", resp.Status)
+	case copyErr != nil:
+		auditErr = fmt.Errorf("output interrupted: %v", copyErr)
+	case exitCode != "0":
+		auditErr = fmt.Errorf("exit code %s", exitCode)
+	}
+	gws.audit(r, "exec.run", clientID+":"+command, auditErr)
+}
+
+// copyFlush copies src to w, flushing after every read so output appears as it is produced
+func copyFlush(w http.ResponseWriter, src io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleExecShell opens an interactive shell on a client. The request must ask for
+// "Upgrade: anyproxy-shell", the connection then carries the raw shell stream.
+// Every input line is written to the gateway log as an audit transcript.
+func (gws *WebServer) handleExecShell(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), protocol.ExecShellUpgrade) {
+		http.Error(w, "Upgrade to "+protocol.ExecShellUpgrade+" required", http.StatusUpgradeRequired)
+		return
+	}
+	backend, clientID, token, ok := gws.execParams(w, r)
+	if !ok {
+		return
+	}
+
+	tunnel, tunnelReader, err := openClientShell(r.Context(), backend, clientID, token)
+	if err != nil {
+		gws.audit(r, "exec.shell", clientID, err)
+		logger.Error("Failed to open remote shell", "client_id", clientID, "err", err)
+		respondExecError(w, err)
+		return
+	}
+	defer func() { _ = tunnel.Close() }()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Error("Failed to hijack admin shell connection", "client_id", clientID, "err", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+protocol.ExecShellUpgrade+"\r\n\r\n"); err != nil {
+		return
+	}
+
+	gws.audit(r, "exec.shell", clientID, nil)
+	user := gws.auditUser(r)
+	start := time.Now()
+	logger.Info("Remote shell session started", "user", user, "client_id", clientID, "remote_addr", r.RemoteAddr)
+
+	transcript := &shellTranscript{user: user, clientID: clientID}
+	var bytesOut int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bytesOut, _ = io.Copy(conn, tunnelReader)
+		_ = conn.Close()
+	}()
+	bytesIn, _ := io.Copy(io.MultiWriter(tunnel, transcript), rw.Reader)
+	transcript.flush()
+	_ = tunnel.Close()
+	<-done
+
+	logger.Info("Remote shell session ended", "user", user, "client_id", clientID, "duration", time.Since(start), "bytes_in", bytesIn, "bytes_out", bytesOut)
+}
+
+// openClientShell opens a tunnel connection to the client's exec service and upgrades it to a shell
+func openClientShell(ctx context.Context, backend RemoteExecBackend, clientID, token string) (net.Conn, *bufio.Reader, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, shellDialTimeout)
+	defer cancel()
+
+	tunnel, err := backend.DialClientExecService(dialCtx, clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+protocol.ExecServiceHost+"/exec/shell", nil)
+	if err != nil {
+		_ = tunnel.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol.ExecShellUpgrade)
+
+	_ = tunnel.SetDeadline(time.Now().Add(shellDialTimeout))
+	reader := bufio.NewReader(tunnel)
+	if err := req.Write(tunnel); err != nil {
+		_ = tunnel.Close()
+		return nil, nil, err
+	}
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = tunnel.Close()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, fmt.Errorf("remote exec service is not enabled on client %s", clientID)
+		}
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		_ = tunnel.Close()
+		return nil, nil, fmt.Errorf("client returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_ = tunnel.SetDeadline(time.Time{})
+	return tunnel, reader, nil
+}
+
+// shellTranscript logs shell input line by line
+type shellTranscript struct {
+	user     string
+	clientID string
+	line     []byte
+}
+
+// Write buffers input and logs every complete line
+func (t *shellTranscript) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			t.flush()
+			continue
+		}
+		if len(t.line) < maxShellAuditLine {
+			t.line = append(t.line, b)
+		}
+	}
+	return len(p), nil
+}
+
+// flush logs the buffered partial line
+func (t *shellTranscript) flush() {
+	if len(t.line) == 0 {
+		return
+	}
+	logger.Info("Remote shell input", "user", t.user, "client_id", t.clientID, "input", string(bytes.TrimRight(t.line, "\r")))
+	t.line = t.line[:0]
+}
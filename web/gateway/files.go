@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/common/protocol"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// fileTransferTimeout bounds a single file transfer through the tunnel
+const fileTransferTimeout = 5 * time.Minute
+
+// FileTransferBackend opens connections to client file transfer services
+type FileTransferBackend interface {
+	DialClientFileService(ctx context.Context, clientID string) (net.Conn, error)
+}
+
+// handleFiles proxies file listing/download (GET) and upload (PUT) to a client's file transfer service.
+// The client's file transfer token is passed in the X-File-Token header.
+func (gws *WebServer) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET && r.Method != methodPUT {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	clientID := query.Get("client_id")
+	filePath := query.Get("path")
+	token := r.Header.Get("X-File-Token")
+	if clientID == "" || token == "" {
+		http.Error(w, "Invalid request: client_id and X-File-Token are required", http.StatusBadRequest)
+		return
+	}
+	backend, ok := gws.admin.(FileTransferBackend)
+	if !ok {
+		http.Error(w, "File transfer is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	action := "files.get"
+	if r.Method == methodPUT {
+		action = "files.put"
+	}
+	target := clientID + ":" + filePath
+
+	resp, err := gws.forwardFileRequest(r, backend, clientID, token)
+	if err != nil {
+		gws.audit(r, action, target, err)
+		logger.Error("File transfer through tunnel failed", "client_id", clientID, "path", filePath, "err", err)
+		status := http.StatusBadGateway
+		if errors.Is(err, gw.ErrClientNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, "File transfer unavailable: "+err.Error(), status)
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		gws.audit(r, action, target, fmt.Errorf("client returned %s", resp.Status))
+	} else {
+		gws.audit(r, action, target, nil)
+	}
+
+	for _, header := range []string{"Content-Type", "Content-Length"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	if query.Get("download") == "1" && resp.StatusCode == http.StatusOK {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(filePath)))
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.Warn("File transfer response interrupted", "client_id", clientID, "path", filePath, "err", err)
+	}
+}
+
+// forwardFileRequest sends the request to the client's file transfer service over a tunnel connection
+func (gws *WebServer) forwardFileRequest(r *http.Request, backend FileTransferBackend, clientID, token string) (*http.Response, error) {
+	params := url.Values{}
+	params.Set("path", r.URL.Query().Get("path"))
+	if tail := r.URL.Query().Get("tail"); tail != "" {
+		params.Set("tail", tail)
+	}
+	targetURL := "http://" + protocol.FileServiceHost + "/files?" + params.Encode()
+
+	var body io.Reader
+	if r.Method == methodPUT {
+		body = r.Body
+	}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return backend.DialClientFileService(ctx, clientID)
+	}
+	return clientServiceRequest(r, dial, r.Method, targetURL, body, token, fileTransferTimeout, "file transfer", clientID)
+}
+
+// clientServiceRequest sends a request to a client-side service over a tunnel connection.
+// The returned body releases the request context when closed.
+func clientServiceRequest(r *http.Request, dial func(ctx context.Context) (net.Conn, error), method, targetURL string, body io.Reader, token string, timeout time.Duration, service, clientID string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	req, err := http.NewRequestWithContext(ctx, method, targetURL, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = r.ContentLength
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+		DisableKeepAlives: true,
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		cancel()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%s service is not enabled on client %s", service, clientID)
+		}
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the request context when the response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the request context
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// HealthBackend reports the gateway's liveness and readiness
+type HealthBackend interface {
+	CheckHealth() *gw.HealthReport
+	CheckReadiness(ctx context.Context) *gw.HealthReport
+}
+
+// registerHealthRoutes registers the probe endpoints, they never require authentication
+func (gws *WebServer) registerHealthRoutes(mux *http.ServeMux) {
+	if _, ok := gws.admin.(HealthBackend); ok {
+		mux.HandleFunc("/healthz", gws.handleHealth)
+		mux.HandleFunc("/readyz", gws.handleReady)
+	}
+}
+
+// handleHealth answers liveness probes, 503 while a listener is not serving
+func (gws *WebServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	gws.respondHealth(w, r, func() *gw.HealthReport {
+		return gws.admin.(HealthBackend).CheckHealth()
+	})
+}
+
+// handleReady answers readiness probes, 503 while a listener or the credential backend is down
+func (gws *WebServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	gws.respondHealth(w, r, func() *gw.HealthReport {
+		return gws.admin.(HealthBackend).CheckReadiness(r.Context())
+	})
+}
+
+// respondHealth writes a health report with the status code probes act on
+func (gws *WebServer) respondHealth(w http.ResponseWriter, r *http.Request, check func() *gw.HealthReport) {
+	if r.Method != methodGET && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := check()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error("Failed to encode health report", "err", err)
+	}
+}
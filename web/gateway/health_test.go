@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// mockHealthBackend adds the probes to the admin mock
+type mockHealthBackend struct {
+	mockAdminBackend
+	listening      bool
+	credentialsErr error
+}
+
+func (m *mockHealthBackend) CheckHealth() *gw.HealthReport {
+	report := &gw.HealthReport{Status: gw.HealthStatusOK, Checks: []gw.HealthCheck{{Name: "transport", Status: gw.HealthStatusOK}}}
+	if !m.listening {
+		report.Status = gw.HealthStatusFail
+		report.Checks[0].Status = gw.HealthStatusFail
+	}
+	return report
+}
+
+func (m *mockHealthBackend) CheckReadiness(_ context.Context) *gw.HealthReport {
+	report := m.CheckHealth()
+	check := gw.HealthCheck{Name: "credentials", Status: gw.HealthStatusOK}
+	if m.credentialsErr != nil {
+		report.Status = gw.HealthStatusFail
+		check.Status = gw.HealthStatusFail
+		check.Error = m.credentialsErr.Error()
+	}
+	report.Checks = append(report.Checks, check)
+	return report
+}
+
+func TestWebServer_Health(t *testing.T) {
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	server.SetAuth(true, "admin", "secret")
+	backend := &mockHealthBackend{listening: true, credentialsErr: errors.New("failed to ping database")}
+	server.SetAdminBackend(backend)
+
+	mux := http.NewServeMux()
+	server.registerHealthRoutes(mux)
+	handler := server.authMiddleware(mux)
+
+	probe := func(path string) (int, gw.HealthReport) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		var report gw.HealthReport
+		if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+			t.Fatalf("Failed to decode %s: %v", path, err)
+		}
+		return rr.Code, report
+	}
+
+	// Probes need no session, an unreachable credential backend only fails readiness
+	if code, _ := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected /healthz 200, got %d", code)
+	}
+	code, report := probe("/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != gw.HealthStatusFail || len(report.Checks) != 2 || report.Checks[1].Error == "" {
+		t.Errorf("Expected /readyz 503 with the credentials failure, got %d %+v", code, report)
+	}
+
+	backend.credentialsErr = nil
+	if code, _ := probe("/readyz"); code != http.StatusOK {
+		t.Errorf("Expected /readyz 200, got %d", code)
+	}
+
+	backend.listening = false
+	if code, _ := probe("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /healthz 503 while not listening, got %d", code)
+	}
+}
@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// handleLatencyMetrics returns dial and time-to-first-byte histograms per client and target host
+func (gws *WebServer) handleLatencyMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshot := monitoring.GetLatencySnapshot()
+	if t := gws.requestTenant(r); t != nil {
+		// Target hosts are shared by all groups
+		clients := t.clientMetrics()
+		for clientID := range snapshot.Clients {
+			if clients[clientID] == nil {
+				delete(snapshot.Clients, clientID)
+			}
+		}
+		snapshot.Targets = map[string]monitoring.LatencyStatsSnapshot{}
+	}
+	if clientID := r.URL.Query().Get("client_id"); clientID != "" {
+		stats, ok := snapshot.Clients[clientID]
+		if !ok {
+			http.Error(w, "Client not found", http.StatusNotFound)
+			return
+		}
+		gws.respondJSON(w, stats)
+		return
+	}
+	gws.respondJSON(w, snapshot)
+}
+
+// TargetsResponse lists the busiest target hosts
+type TargetsResponse struct {
+	Targets []monitoring.TargetStats `json:"targets"`
+	Evicted int64                    `json:"evicted"` // Stats dropped by the cardinality cap, totals may be incomplete
+}
+
+// handleTargetMetrics returns the top destinations of a group (group_id) or of all groups,
+// limited by limit and ordered by sort ("bytes" or "connections")
+func (gws *WebServer) handleTargetMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := monitoring.DefaultTopTargets
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = monitoring.TargetSortBytes
+	}
+	if sortBy != monitoring.TargetSortBytes && sortBy != monitoring.TargetSortConnections {
+		http.Error(w, "Invalid sort: must be bytes or connections", http.StatusBadRequest)
+		return
+	}
+
+	// Tenants see the targets of their own groups
+	var targets []monitoring.TargetStats
+	groupID, t := query.Get("group_id"), gws.requestTenant(r)
+	switch {
+	case t != nil && groupID == "":
+		targets = monitoring.GetTopTargetsOf(t.groups(), limit, sortBy)
+	case t.allows(groupID):
+		targets = monitoring.GetTopTargets(groupID, limit, sortBy)
+	default:
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	gws.respondJSON(w, TargetsResponse{
+		Targets: targets,
+		Evicted: monitoring.GetEvictedTargets(),
+	})
+}
+
+// UsersResponse lists the stats of proxy users
+type UsersResponse struct {
+	Users   []monitoring.UserStats `json:"users"`
+	Evicted int64                  `json:"evicted"` // Users dropped by the cardinality cap
+}
+
+// UserResponse is the stats of one proxy user with its busiest destinations
+type UserResponse struct {
+	monitoring.UserStats
+	TopTargets []monitoring.TargetStats `json:"top_targets"`
+}
+
+// handleUserMetrics returns the stats of the proxy users of a group (group_id) or of all groups,
+// ordered by sort ("bytes" or "connections"). With username it returns that user of the group
+// and its top destinations, limited by limit.
+func (gws *WebServer) handleUserMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := monitoring.DefaultTopTargets
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = monitoring.TargetSortBytes
+	}
+	if sortBy != monitoring.TargetSortBytes && sortBy != monitoring.TargetSortConnections {
+		http.Error(w, "Invalid sort: must be bytes or connections", http.StatusBadRequest)
+		return
+	}
+
+	groupID, t := query.Get("group_id"), gws.requestTenant(r)
+	if groupID != "" && !t.allows(groupID) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	if query.Has("username") {
+		username := query.Get("username")
+		stats, ok := monitoring.GetUser(groupID, username)
+		if groupID == "" || !ok {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		gws.respondJSON(w, UserResponse{
+			UserStats:  stats,
+			TopTargets: monitoring.GetUserTopTargets(groupID, username, limit, sortBy),
+		})
+		return
+	}
+
+	// Tenants see the users of their own groups
+	var groups []string
+	switch {
+	case groupID != "":
+		groups = []string{groupID}
+	case t != nil:
+		groups = t.groups()
+	}
+	gws.respondJSON(w, UsersResponse{
+		Users:   monitoring.GetUserStats(groups, sortBy),
+		Evicted: monitoring.GetEvictedUsers(),
+	})
+}
+
+// handleTransportMetrics returns the messages, payload and framing bytes of each transport type
+func (gws *WebServer) handleTransportMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gws.respondJSON(w, monitoring.GetTransportStats())
+}
+
+// handleMetricsReset zeroes the cumulative dashboard counters
+func (gws *WebServer) handleMetricsReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodPOST {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := monitoring.ResetCounters()
+	gws.audit(r, "metrics.reset", "", err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gws.respondJSON(w, AdminResponse{Status: "success", Message: "Metrics counters reset"})
+}
+
+// handlePrometheusMetrics serves metrics in the Prometheus text exposition format
+func (gws *WebServer) handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := monitoring.WritePrometheus(w); err != nil {
+		logger.Error("Failed to write Prometheus metrics", "err", err)
+	}
+}
+
+// scrapeHandler protects the Prometheus endpoint, accepting HTTP basic auth with
+// the web credentials in addition to a session cookie so scrapers can authenticate
+func (gws *WebServer) scrapeHandler(next http.HandlerFunc) http.HandlerFunc {
+	if !gws.authEnabled {
+		return next
+	}
+	protected := gws.getProtectedHandler()(gws.denyTenants(next))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			if _, err := r.Cookie("gateway_session_id"); err == nil {
+				protected(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="anyproxy"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		account, ok := gws.authenticate(r.Context(), username, password)
+		if !ok {
+			logger.Warn("Failed metrics scrape authentication", "username", username, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="anyproxy"`)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		// The exposition covers every group
+		if len(account.groups) > 0 {
+			http.Error(w, "Forbidden: not available to tenant accounts", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ChecksResponse lists the synthetic checks reported by the online clients, per group
+type ChecksResponse struct {
+	Checks []*monitoring.GroupCheck `json:"checks"`
+}
+
+// handleCheckMetrics returns the synthetic checks of a group (group_id) or of all groups
+func (gws *WebServer) handleCheckMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupID, t := r.URL.Query().Get("group_id"), gws.requestTenant(r)
+	if groupID != "" && !t.allows(groupID) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	checks := monitoring.GroupChecks(t.clientMetrics())
+	if groupID != "" {
+		filtered := checks[:0]
+		for _, check := range checks {
+			if check.GroupID == groupID {
+				filtered = append(filtered, check)
+			}
+		}
+		checks = filtered
+	}
+	gws.respondJSON(w, ChecksResponse{Checks: checks})
+}
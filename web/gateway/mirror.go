@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// MirrorBackend starts and serves traffic captures
+type MirrorBackend interface {
+	StartMirror(req gw.MirrorRequest) (*gw.MirrorCapture, error)
+	StopMirror(id string) error
+	DeleteMirror(id string) error
+	ListMirrors() []gw.MirrorCapture
+	OpenMirror(id string) (*os.File, error)
+}
+
+// handleMirror lists (GET), starts (POST) or deletes (DELETE) traffic captures
+func (gws *WebServer) handleMirror(w http.ResponseWriter, r *http.Request) {
+	backend := gws.admin.(MirrorBackend)
+	switch r.Method {
+	case methodGET:
+		gws.respondJSON(w, backend.ListMirrors())
+	case methodPOST:
+		var req gw.MirrorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		capture, err := backend.StartMirror(req)
+		gws.audit(r, "mirror.start", req.ConnID+req.TargetHost, err)
+		if err != nil {
+			http.Error(w, err.Error(), mirrorErrorStatus(err))
+			return
+		}
+		gws.respondJSON(w, capture)
+	case methodDELETE:
+		id := r.URL.Query().Get("id")
+		err := backend.DeleteMirror(id)
+		gws.audit(r, "mirror.delete", id, err)
+		if err != nil {
+			http.Error(w, err.Error(), mirrorErrorStatus(err))
+			return
+		}
+		gws.respondJSON(w, AdminResponse{Status: "success", Message: "Capture deleted"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMirrorStop stops a capture, keeping its file
+func (gws *WebServer) handleMirrorStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodPOST {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	err := gws.admin.(MirrorBackend).StopMirror(id)
+	gws.audit(r, "mirror.stop", id, err)
+	if err != nil {
+		http.Error(w, err.Error(), mirrorErrorStatus(err))
+		return
+	}
+	gws.respondJSON(w, AdminResponse{Status: "success", Message: "Capture stopped"})
+}
+
+// handleMirrorDownload sends a capture file in pcap format
+func (gws *WebServer) handleMirrorDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	f, err := gws.admin.(MirrorBackend).OpenMirror(id)
+	gws.audit(r, "mirror.download", id, err)
+	if err != nil {
+		http.Error(w, err.Error(), mirrorErrorStatus(err))
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "anyproxy-"+id+".pcap"))
+	if _, err := io.Copy(w, f); err != nil {
+		logger.Warn("Capture download interrupted", "capture_id", id, "err", err)
+	}
+}
+
+// mirrorErrorStatus maps a mirror backend error to an HTTP status
+func mirrorErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gw.ErrMirrorDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, gw.ErrMirrorNotFound), errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,47 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// PACBackend generates the proxy auto-config file
+type PACBackend interface {
+	GetPACFile(requestHost string) (string, error)
+}
+
+// registerPACRoutes registers the PAC file, it never requires authentication
+func (gws *WebServer) registerPACRoutes(mux *http.ServeMux) {
+	if _, ok := gws.admin.(PACBackend); ok {
+		mux.HandleFunc("/proxy.pac", gws.handlePAC)
+	}
+}
+
+// handlePAC serves the proxy auto-config file for browsers
+func (gws *WebServer) handlePAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	pac, err := gws.admin.(PACBackend).GetPACFile(host)
+	if errors.Is(err, gw.ErrPACDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to generate PAC file", "host", host, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_, _ = w.Write([]byte(pac))
+}
@@ -0,0 +1,57 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// mockPACBackend adds the PAC file to the admin mock
+type mockPACBackend struct {
+	mockAdminBackend
+	enabled     bool
+	requestHost string
+}
+
+func (m *mockPACBackend) GetPACFile(requestHost string) (string, error) {
+	if !m.enabled {
+		return "", gw.ErrPACDisabled
+	}
+	m.requestHost = requestHost
+	return "function FindProxyForURL(url, host) { return \"DIRECT\"; }\n", nil
+}
+
+func TestWebServer_PAC(t *testing.T) {
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	server.SetAuth(true, "admin", "secret")
+	backend := &mockPACBackend{enabled: true}
+	server.SetAdminBackend(backend)
+
+	mux := http.NewServeMux()
+	server.registerPACRoutes(mux)
+	handler := server.authMiddleware(mux)
+
+	// Browsers fetch the file without a session
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://gateway.example.com:8090/proxy.pac", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "FindProxyForURL") {
+		t.Fatalf("Expected the PAC file, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	if backend.requestHost != "gateway.example.com" {
+		t.Errorf("Expected the request host without port, got %q", backend.requestHost)
+	}
+
+	backend.enabled = false
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy.pac", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when the PAC file is disabled, got %d", rr.Code)
+	}
+}
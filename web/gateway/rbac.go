@@ -0,0 +1,159 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/web/auth"
+)
+
+// Role is the access level of a dashboard user, each role has the permissions of the roles below it
+type Role string
+
+// Dashboard roles
+const (
+	RoleViewer   Role = "viewer"   // Metrics, group status and rate limit rules
+	RoleOperator Role = "operator" // Kicking clients and reading the audit log
+	RoleAdmin    Role = "admin"    // Credentials, rate limits, files, remote exec and traffic mirroring
+)
+
+// roleHeader carries the role of the authenticated user, set by authMiddleware like X-User
+const roleHeader = "X-User-Role"
+
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Allows reports whether the role has the permissions of required
+func (r Role) Allows(required Role) bool {
+	return r.rank() >= required.rank()
+}
+
+// webUser is a dashboard account
+type webUser struct {
+	username string
+	password string
+	role     Role
+	groups   []string // Groups a tenant account is limited to, empty for all groups
+	provider string   // Login provider, "local" for the accounts of the config
+}
+
+// SetUsers configures dashboard accounts in addition to the auth_username admin
+func (gws *WebServer) SetUsers(users []config.WebUserConfig) {
+	accounts := make([]webUser, 0, len(users))
+	for _, user := range users {
+		accounts = append(accounts, webUser{username: user.Username, password: user.Password, role: Role(user.Role), groups: user.Groups})
+	}
+	gws.usersMu.Lock()
+	gws.users = accounts
+	gws.usersMu.Unlock()
+}
+
+// accounts returns the configured users, the auth_username account is an admin
+func (gws *WebServer) accounts() []webUser {
+	gws.usersMu.RLock()
+	accounts := append([]webUser(nil), gws.users...)
+	gws.usersMu.RUnlock()
+	if gws.authUsername != "" {
+		accounts = append([]webUser{{username: gws.authUsername, password: gws.authPassword, role: RoleAdmin}}, accounts...)
+	}
+	return accounts
+}
+
+// SetAuthProviders configures the login providers tried for web credentials
+func (gws *WebServer) SetAuthProviders(cfg config.WebAuthConfig) error {
+	chain, err := auth.New(cfg, gws.localProvider())
+	if err != nil {
+		return err
+	}
+	gws.authChain = chain
+	return nil
+}
+
+// localProvider returns the login provider of the configured accounts
+func (gws *WebServer) localProvider() *auth.Local {
+	return auth.NewLocal(func() []auth.Account {
+		var accounts []auth.Account
+		for _, user := range gws.accounts() {
+			accounts = append(accounts, auth.Account{Username: user.username, Password: user.password, Role: string(user.role), Groups: user.groups})
+		}
+		return accounts
+	})
+}
+
+// authenticate validates web credentials with the login providers and returns the user's account
+func (gws *WebServer) authenticate(ctx context.Context, username, password string) (webUser, bool) {
+	identity, err := gws.authChain.Authenticate(ctx, username, password)
+	if err != nil {
+		return webUser{}, false
+	}
+	return identityAccount(identity), true
+}
+
+// identityAccount returns the account of a user authenticated by a login provider
+func identityAccount(identity *auth.Identity) webUser {
+	return webUser{username: identity.Username, role: Role(identity.Role), groups: identity.Groups, provider: identity.Provider}
+}
+
+// userAccount returns the account of a logged in user, ok is false when it no longer exists
+func (gws *WebServer) userAccount(username string) (webUser, bool) {
+	for _, user := range gws.accounts() {
+		if user.username == username {
+			user.provider = auth.ProviderLocal
+			return user, true
+		}
+	}
+	return webUser{}, false
+}
+
+// sessionAccount returns the account of a session. Local accounts are looked up again so
+// config changes apply, other users keep the role they logged in with until the session ends.
+func (gws *WebServer) sessionAccount(session *Session) (webUser, bool) {
+	provider := session.Provider
+	if provider == "" {
+		provider = auth.ProviderLocal
+	}
+	if !gws.authChain.Enabled(provider) {
+		return webUser{}, false
+	}
+	if provider == auth.ProviderLocal {
+		return gws.userAccount(session.Username)
+	}
+	return webUser{username: session.Username, role: Role(session.Role), groups: session.Groups, provider: provider}, true
+}
+
+// requestRole returns the role of the request's user, everyone is an admin without authentication
+func (gws *WebServer) requestRole(r *http.Request) Role {
+	if !gws.authEnabled {
+		return RoleAdmin
+	}
+	return Role(r.Header.Get(roleHeader))
+}
+
+// requireRole allows GET requests to users with the read role and other methods to users with the write role
+func (gws *WebServer) requireRole(read, write Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		required := write
+		if r.Method == methodGET || r.Method == http.MethodHead {
+			required = read
+		}
+		if role := gws.requestRole(r); !role.Allows(required) {
+			logger.Warn("Admin request denied by role", "user", gws.auditUser(r), "role", role, "required", required, "method", r.Method, "path", r.URL.Path)
+			gws.audit(r, "authz.denied", r.Method+" "+r.URL.Path, fmt.Errorf("requires the %s role", required))
+			http.Error(w, fmt.Sprintf("Forbidden: requires the %s role", required), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+	"github.com/buhuipao/anyproxy/web/auth"
+)
+
+func TestRole_Allows(t *testing.T) {
+	tests := []struct {
+		role     Role
+		required Role
+		want     bool
+	}{
+		{RoleAdmin, RoleOperator, true},
+		{RoleOperator, RoleOperator, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleViewer, RoleOperator, false},
+		{Role(""), RoleViewer, false},
+		{Role("root"), RoleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Allows(tt.required); got != tt.want {
+			t.Errorf("%q.Allows(%q) = %v, want %v", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestWebServer_RoleBasedAccess(t *testing.T) {
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	server.SetAuth(true, "admin", "secret")
+	server.SetUsers([]config.WebUserConfig{
+		{Username: "alice", Password: "viewer-pass", Role: "viewer"},
+		{Username: "bob", Password: "operator-pass", Role: "operator"},
+	})
+	server.SetAdminBackend(&mockAdminBackend{
+		groups:      []gw.GroupStatus{{GroupID: "tenant-a", Clients: []string{"client-1", "client-2", "client-3"}}},
+		credentials: make(map[string]string),
+	})
+	mux := http.NewServeMux()
+	server.registerAdminRoutes(mux, server.getProtectedHandler())
+
+	login := func(username, password string) *http.Cookie {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		server.handleLogin(rr, httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(`{"username":"`+username+`","password":"`+password+`"}`)))
+		var resp LoginResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || len(rr.Result().Cookies()) == 0 {
+			t.Fatalf("Login of %s failed: %d %s", username, rr.Code, rr.Body.String())
+		}
+		return rr.Result().Cookies()[0]
+	}
+	do := func(cookie *http.Cookie, method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	viewer, operator, admin := login("alice", "viewer-pass"), login("bob", "operator-pass"), login("admin", "secret")
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"viewer reads groups", viewer, "GET", "/api/admin/groups", "", http.StatusOK},
+		{"viewer reads rate limits", viewer, "GET", "/api/admin/ratelimit", "", http.StatusOK},
+		{"viewer cannot kick", viewer, "POST", "/api/admin/clients/kick", `{"client_id":"client-1"}`, http.StatusForbidden},
+		{"viewer cannot read audit", viewer, "GET", "/api/admin/audit", "", http.StatusForbidden},
+		{"operator kicks", operator, "POST", "/api/admin/clients/kick", `{"client_id":"client-2"}`, http.StatusOK},
+		{"operator cannot set credentials", operator, "POST", "/api/admin/credentials", `{"group_id":"g","password":"p"}`, http.StatusForbidden},
+		{"operator cannot update rate limits", operator, "PUT", "/api/admin/ratelimit", `{"rules":[]}`, http.StatusForbidden},
+		{"admin sets credentials", admin, "POST", "/api/admin/credentials", `{"group_id":"g","password":"p"}`, http.StatusOK},
+		{"admin updates rate limits", admin, "PUT", "/api/admin/ratelimit", `{"rules":[]}`, http.StatusOK},
+		{"admin kicks", admin, "POST", "/api/admin/clients/kick", `{"client_id":"client-3"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cookie, tt.method, tt.path, tt.body); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Denials are audited
+	var denied int
+	for _, entry := range server.GetAuditLog().Since(0, 0) {
+		if entry.Action == "authz.denied" {
+			denied++
+		}
+	}
+	if denied != 4 {
+		t.Errorf("Expected 4 audited denials, got %d", denied)
+	}
+
+	// Removing an account ends its sessions
+	server.SetUsers(nil)
+	if got := do(viewer, "GET", "/api/admin/groups", ""); got != http.StatusUnauthorized {
+		t.Errorf("Expected the removed user's session to be rejected, got %d", got)
+	}
+}
+
+func TestWebServer_ProviderSessions(t *testing.T) {
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	server.SetAuth(true, "admin", "secret")
+	oidc := &config.OIDCAuthConfig{Issuer: "https://idp.example.com", ClientID: "anyproxy", RedirectURL: "https://gw.example.com/api/auth/oidc/callback"}
+	if err := server.SetAuthProviders(config.WebAuthConfig{OIDC: oidc}); err != nil {
+		t.Fatalf("SetAuthProviders() error = %v", err)
+	}
+
+	// Single sign-on users keep the role they logged in with
+	session := server.sessionManager.CreateIdentitySession(&auth.Identity{Username: "carol", Role: "operator", Provider: auth.ProviderOIDC})
+	account, ok := server.sessionAccount(session)
+	if !ok || account.role != RoleOperator {
+		t.Fatalf("sessionAccount() = %+v, %v, want carol as an operator", account, ok)
+	}
+
+	// Sessions of providers taken out of the chain end
+	if err := server.SetAuthProviders(config.WebAuthConfig{Providers: []string{"local"}, OIDC: oidc}); err != nil {
+		t.Fatalf("SetAuthProviders() error = %v", err)
+	}
+	if _, ok := server.sessionAccount(session); ok {
+		t.Error("Sessions of a disabled provider should be invalid")
+	}
+	if _, ok := server.sessionAccount(server.sessionManager.CreateSession("admin")); !ok {
+		t.Error("Sessions of local accounts should stay valid")
+	}
+}
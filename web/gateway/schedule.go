@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// ScheduleBackend is implemented by gateways with access schedules
+type ScheduleBackend interface {
+	SetAccessOverride(override gw.AccessOverride) error
+	RemoveAccessOverride(groupID, username string) error
+	ListAccessOverrides() []gw.AccessOverride
+}
+
+// accessOverrideRequest creates an override lasting duration, e.g. "2h"
+type accessOverrideRequest struct {
+	GroupID  string `json:"group_id"`
+	Username string `json:"username"`
+	Allow    bool   `json:"allow"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// handleAccessOverrides lists (GET), sets (POST) and removes (DELETE) access schedule overrides
+func (gws *WebServer) handleAccessOverrides(w http.ResponseWriter, r *http.Request) {
+	backend := gws.admin.(ScheduleBackend)
+	switch r.Method {
+	case methodGET:
+		gws.respondJSON(w, backend.ListAccessOverrides())
+	case methodPOST:
+		var req accessOverrideRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			http.Error(w, "duration must be a positive duration such as 2h", http.StatusBadRequest)
+			return
+		}
+		override := gw.AccessOverride{
+			GroupID:  req.GroupID,
+			Username: req.Username,
+			Allow:    req.Allow,
+			Until:    time.Now().Add(duration),
+			Reason:   req.Reason,
+		}
+		err = backend.SetAccessOverride(override)
+		gws.audit(r, "schedule.override", overrideTarget(req.GroupID, req.Username), err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gws.respondJSON(w, override)
+	case methodDELETE:
+		groupID, username := r.URL.Query().Get("group_id"), r.URL.Query().Get("username")
+		err := backend.RemoveAccessOverride(groupID, username)
+		gws.audit(r, "schedule.override.delete", overrideTarget(groupID, username), err)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, gw.ErrAccessOverrideNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		gws.respondJSON(w, AdminResponse{Status: "success", Message: "Override removed"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// overrideTarget names the group or group user of an override in the audit log
+func overrideTarget(groupID, username string) string {
+	if username == "" {
+		return groupID
+	}
+	return groupID + "/" + username
+}
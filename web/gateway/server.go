@@ -2,6 +2,7 @@
 package gateway
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -9,9 +10,17 @@ import (
 	"sync"
 	"time"
 
+	"google.golang.org/grpc"
+
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/common/sockopt"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
+	"github.com/buhuipao/anyproxy/pkg/config"
 	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/web/auth"
+	"github.com/buhuipao/anyproxy/web/sessions"
+	"github.com/buhuipao/anyproxy/web/ui"
 )
 
 // HTTP methods and status constants
@@ -22,26 +31,27 @@ const (
 )
 
 // Session represents a user session
-type Session struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	CreatedAt time.Time `json:"created_at"`
-	LastSeen  time.Time `json:"last_seen"`
-	ExpiresAt time.Time `json:"expires_at"`
-}
+type Session = sessions.Session
 
 // SessionManager manages user sessions
 type SessionManager struct {
-	mu       sync.RWMutex
-	sessions map[string]*Session
-	timeout  time.Duration
+	store   sessions.Store
+	signer  *sessions.Signer // Signs session cookies, nil leaves them unsigned
+	timeout time.Duration
 }
 
-// NewSessionManager creates a new session manager
+// NewSessionManager creates a new session manager keeping sessions in memory
 func NewSessionManager(timeout time.Duration) *SessionManager {
+	return NewSessionManagerWithStore(timeout, sessions.NewMemoryStore(), "")
+}
+
+// NewSessionManagerWithStore creates a session manager keeping sessions in store and signing
+// session cookies with key, an empty key leaves cookies unsigned
+func NewSessionManagerWithStore(timeout time.Duration, store sessions.Store, key string) *SessionManager {
 	sm := &SessionManager{
-		sessions: make(map[string]*Session),
-		timeout:  timeout,
+		store:   store,
+		signer:  sessions.NewSigner(key),
+		timeout: timeout,
 	}
 
 	// Start cleanup goroutine
@@ -52,31 +62,39 @@ func NewSessionManager(timeout time.Duration) *SessionManager {
 
 // CreateSession creates a new session for the user
 func (sm *SessionManager) CreateSession(username string) *Session {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	return sm.CreateIdentitySession(&auth.Identity{Username: username})
+}
 
+// CreateIdentitySession creates a new session for a user authenticated by a login provider
+func (sm *SessionManager) CreateIdentitySession(identity *auth.Identity) *Session {
 	sessionID := sm.generateSessionID()
 	now := time.Now()
 
 	session := &Session{
 		ID:        sessionID,
-		Username:  username,
+		Username:  identity.Username,
 		CreatedAt: now,
 		LastSeen:  now,
 		ExpiresAt: now.Add(sm.timeout),
+		Provider:  identity.Provider,
+		Role:      identity.Role,
+		Groups:    identity.Groups,
 	}
 
-	sm.sessions[sessionID] = session
+	if err := sm.store.Save(session); err != nil {
+		logger.Error("Failed to save session", "username", identity.Username, "err", err)
+	}
 	return session
 }
 
 // GetSession retrieves a session by ID
 func (sm *SessionManager) GetSession(sessionID string) *Session {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
-	session, exists := sm.sessions[sessionID]
-	if !exists || session.ExpiresAt.Before(time.Now()) {
+	session, err := sm.store.Load(sessionID)
+	if err != nil {
+		logger.Error("Failed to load session", "err", err)
+		return nil
+	}
+	if session == nil || session.ExpiresAt.Before(time.Now()) {
 		return nil
 	}
 
@@ -85,21 +103,41 @@ func (sm *SessionManager) GetSession(sessionID string) *Session {
 
 // UpdateSession updates the last seen time for a session
 func (sm *SessionManager) UpdateSession(sessionID string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	if session, exists := sm.sessions[sessionID]; exists {
-		session.LastSeen = time.Now()
-		session.ExpiresAt = time.Now().Add(sm.timeout)
+	session, err := sm.store.Load(sessionID)
+	if err != nil || session == nil {
+		return
+	}
+	session.LastSeen = time.Now()
+	session.ExpiresAt = time.Now().Add(sm.timeout)
+	if err := sm.store.Save(session); err != nil {
+		logger.Error("Failed to save session", "username", session.Username, "err", err)
 	}
 }
 
 // DeleteSession deletes a session
 func (sm *SessionManager) DeleteSession(sessionID string) {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	if err := sm.store.Delete(sessionID); err != nil {
+		logger.Error("Failed to delete session", "err", err)
+	}
+}
 
-	delete(sm.sessions, sessionID)
+// CookieValue returns the session cookie value of a session
+func (sm *SessionManager) CookieValue(session *Session) string {
+	return sm.signer.Sign(session.ID)
+}
+
+// SessionID returns the session ID of a cookie value, ok is false when its signature is invalid
+func (sm *SessionManager) SessionID(cookieValue string) (string, bool) {
+	return sm.signer.Verify(cookieValue)
+}
+
+// SessionFromCookie returns the valid session of a cookie value
+func (sm *SessionManager) SessionFromCookie(cookieValue string) *Session {
+	sessionID, ok := sm.SessionID(cookieValue)
+	if !ok {
+		return nil
+	}
+	return sm.GetSession(sessionID)
 }
 
 // cleanupExpiredSessions removes expired sessions
@@ -108,15 +146,9 @@ func (sm *SessionManager) cleanupExpiredSessions() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		sm.mu.Lock()
-		now := time.Now()
-
-		for sessionID, session := range sm.sessions {
-			if session.ExpiresAt.Before(now) {
-				delete(sm.sessions, sessionID)
-			}
+		if err := sm.store.DeleteExpired(time.Now()); err != nil {
+			logger.Warn("Failed to remove expired sessions", "err", err)
 		}
-		sm.mu.Unlock()
 	}
 }
 
@@ -141,17 +173,50 @@ type WebServer struct {
 	authEnabled    bool
 	authUsername   string
 	authPassword   string
+	users          []webUser // Accounts with roles besides the auth_username admin
+	usersMu        sync.RWMutex
 	sessionManager *SessionManager
+	authChain      *auth.Chain // Login providers, the local accounts by default
+
+	// Admin API
+	admin    AdminBackend // Gateway operations, nil disables group/client/credential APIs
+	auditLog *AuditLog
+
+	ui *ui.UI // Theme and translation bundles
+
+	reusePort bool // Share the listen port with the gateway process replacing this one on an upgrade
+
+	control   *grpc.Server // The gRPC control API, nil until StartControl
+	controlMu sync.Mutex
 }
 
 // NewGatewayWebServer creates a new Gateway web server
 func NewGatewayWebServer(addr, staticDir string, rateLimiter *ratelimit.RateLimiter) *WebServer {
-	return &WebServer{
+	gws := &WebServer{
 		addr:           addr,
 		staticDir:      staticDir,
 		rateLimiter:    rateLimiter,
 		sessionManager: NewSessionManager(24 * time.Hour), // 24 hour sessions
+		auditLog:       NewAuditLog(defaultAuditLogSize),
+		ui:             ui.New(config.WebConfig{}),
 	}
+	gws.authChain = auth.NewChain(gws.localProvider())
+	return gws
+}
+
+// SetReusePort lets the process started by a gateway upgrade listen on the same address
+func (gws *WebServer) SetReusePort(reusePort bool) {
+	gws.reusePort = reusePort
+}
+
+// SetUI configures the theme directory, translation bundles and feature flags of the dashboard
+func (gws *WebServer) SetUI(u *ui.UI) {
+	gws.ui = u
+}
+
+// SetSessionStore keeps dashboard sessions in store and signs session cookies with key
+func (gws *WebServer) SetSessionStore(store sessions.Store, key string) {
+	gws.sessionManager = NewSessionManagerWithStore(24*time.Hour, store, key)
 }
 
 // SetAuth configures authentication for the web server
@@ -166,7 +231,7 @@ func (gws *WebServer) Start() error {
 	mux := http.NewServeMux()
 
 	// Static files (with auth protection if enabled)
-	staticHandler := http.FileServer(http.Dir(gws.getStaticDir()))
+	staticHandler := http.FileServer(gws.ui.FileSystem(gws.getStaticDir()))
 	if gws.authEnabled {
 		mux.Handle("/", gws.authMiddleware(staticHandler))
 	} else {
@@ -178,14 +243,43 @@ func (gws *WebServer) Start() error {
 		mux.HandleFunc("/api/auth/login", gws.handleLogin)
 		mux.HandleFunc("/api/auth/logout", gws.handleLogout)
 		mux.HandleFunc("/api/auth/check", gws.handleAuthCheck)
+		mux.HandleFunc("/api/auth/providers", gws.handleAuthProviders)
+		if oidc := gws.authChain.OIDC(); oidc != nil {
+			mux.HandleFunc(auth.OIDCLoginPath, oidc.HandleLogin)
+			mux.HandleFunc(auth.OIDCCallbackPath, gws.handleOIDCCallback)
+		}
 	}
 
+	// Translations and feature flags, public for the login page
+	mux.HandleFunc("/api/ui/config", gws.ui.HandleConfig)
+
 	// Protected API routes
 	protectedHandler := gws.getProtectedHandler()
 
 	mux.HandleFunc("/api/metrics/global", protectedHandler(gws.handleGlobalMetrics))
 	mux.HandleFunc("/api/metrics/clients", protectedHandler(gws.handleClientMetrics))
 	mux.HandleFunc("/api/metrics/connections", protectedHandler(gws.handleConnectionMetrics))
+	mux.HandleFunc("/api/metrics/latency", protectedHandler(gws.handleLatencyMetrics))
+	mux.HandleFunc("/api/metrics/targets", protectedHandler(gws.handleTargetMetrics))
+	mux.HandleFunc("/api/metrics/users", protectedHandler(gws.handleUserMetrics))
+	mux.HandleFunc("/api/metrics/checks", protectedHandler(gws.handleCheckMetrics))
+	mux.HandleFunc("/api/metrics/transports", protectedHandler(gws.denyTenants(gws.handleTransportMetrics)))
+	mux.HandleFunc("/metrics", gws.scrapeHandler(gws.handlePrometheusMetrics))
+
+	// Admin APIs (used by anyproxyctl)
+	gws.registerAdminRoutes(mux, protectedHandler)
+
+	// Public status page API
+	gws.registerStatusRoutes(mux)
+
+	// Public proxy auto-config file
+	gws.registerPACRoutes(mux)
+
+	// Public liveness and readiness probes
+	gws.registerHealthRoutes(mux)
+
+	// Client enrollment, authenticated by the enrollment token
+	gws.registerEnrollRoutes(mux)
 
 	// Core APIs only - removed unnecessary rate limiting and stats APIs
 
@@ -196,7 +290,11 @@ func (gws *WebServer) Start() error {
 	}
 
 	logger.Info("Starting Gateway Web server", "addr", gws.addr, "auth_enabled", gws.authEnabled)
-	return gws.server.ListenAndServe()
+	listener, err := sockopt.Listen(context.Background(), "tcp", gws.addr, &config.SocketOptions{ReusePort: gws.reusePort})
+	if err != nil {
+		return err
+	}
+	return gws.server.Serve(listener)
 }
 
 // getStaticDir returns the static directory path
@@ -238,17 +336,27 @@ func (gws *WebServer) authMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Validate session
-		session := gws.sessionManager.GetSession(cookie.Value)
+		session := gws.sessionManager.SessionFromCookie(cookie.Value)
 		if session == nil {
 			gws.requireAuth(w, r)
 			return
 		}
 
+		// Accounts removed from the config lose their sessions
+		account, ok := gws.sessionAccount(session)
+		if !ok {
+			gws.sessionManager.DeleteSession(session.ID)
+			gws.requireAuth(w, r)
+			return
+		}
+
 		// Update session activity
 		gws.sessionManager.UpdateSession(session.ID)
 
 		// Add user info to request context
 		r.Header.Set("X-User", session.Username)
+		r.Header.Set(roleHeader, string(account.role))
+		setTenantHeader(r, account.groups)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -257,10 +365,19 @@ func (gws *WebServer) authMiddleware(next http.Handler) http.Handler {
 func (gws *WebServer) isPublicPath(path string) bool {
 	publicPaths := []string{
 		"/login.html",
+		"/status.html",
+		"/api/status",
+		"/proxy.pac",
+		"/healthz",
+		"/readyz",
 		"/js/i18n.js",
+		"/api/ui/config",
 		"/api/auth/login",
 		"/api/auth/logout",
 		"/api/auth/check",
+		"/api/auth/providers",
+		auth.OIDCLoginPath,
+		auth.OIDCCallbackPath,
 	}
 
 	for _, publicPath := range publicPaths {
@@ -316,19 +433,39 @@ func (gws *WebServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate credentials
-	if loginReq.Username != gws.authUsername || loginReq.Password != gws.authPassword {
+	account, ok := gws.authenticate(r.Context(), loginReq.Username, loginReq.Password)
+	if !ok {
 		logger.Warn("Failed login attempt", "username", loginReq.Username, "remote_addr", r.RemoteAddr)
+		gws.auditLog.Record(AuditEntry{User: loginReq.Username, RemoteAddr: r.RemoteAddr, Action: "auth.login", Success: false, Detail: "invalid credentials"})
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	// Create session
-	session := gws.sessionManager.CreateSession(loginReq.Username)
+	session := gws.startSession(w, r, account)
+	response := LoginResponse{
+		Status:    "success",
+		Message:   "Login successful",
+		Username:  session.Username,
+		Role:      account.role,
+		Groups:    account.groups,
+		ExpiresAt: session.ExpiresAt,
+	}
+	gws.respondJSON(w, response)
+}
+
+// startSession creates the session of a logged in account and sets its cookie
+func (gws *WebServer) startSession(w http.ResponseWriter, r *http.Request, account webUser) *Session {
+	session := gws.sessionManager.CreateIdentitySession(&auth.Identity{
+		Username: account.username,
+		Role:     string(account.role),
+		Groups:   account.groups,
+		Provider: account.provider,
+	})
 
 	// Set session cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:     "gateway_session_id",
-		Value:    session.ID,
+		Value:    gws.sessionManager.CookieValue(session),
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   false, // Set to true in production with HTTPS
@@ -336,15 +473,9 @@ func (gws *WebServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 		Expires:  session.ExpiresAt,
 	})
 
-	logger.Info("User logged in", "username", loginReq.Username, "remote_addr", r.RemoteAddr)
-
-	response := LoginResponse{
-		Status:    "success",
-		Message:   "Login successful",
-		Username:  session.Username,
-		ExpiresAt: session.ExpiresAt,
-	}
-	gws.respondJSON(w, response)
+	logger.Info("User logged in", "username", account.username, "provider", account.provider, "role", account.role, "groups", account.groups, "remote_addr", r.RemoteAddr)
+	gws.auditLog.Record(AuditEntry{User: account.username, RemoteAddr: r.RemoteAddr, Action: "auth.login", Success: true, Detail: account.provider})
+	return session
 }
 
 // handleLogout handles user logout requests
@@ -357,7 +488,9 @@ func (gws *WebServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 	// Get session from cookie
 	cookie, err := r.Cookie("gateway_session_id")
 	if err == nil {
-		gws.sessionManager.DeleteSession(cookie.Value)
+		if sessionID, ok := gws.sessionManager.SessionID(cookie.Value); ok {
+			gws.sessionManager.DeleteSession(sessionID)
+		}
 	}
 
 	// Clear session cookie
@@ -382,16 +515,24 @@ func (gws *WebServer) handleAuthCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session := gws.sessionManager.GetSession(cookie.Value)
+	session := gws.sessionManager.SessionFromCookie(cookie.Value)
 	if session == nil {
 		response := AuthCheckResponse{Authenticated: false}
 		gws.respondJSON(w, response)
 		return
 	}
+	account, ok := gws.sessionAccount(session)
+	if !ok {
+		response := AuthCheckResponse{Authenticated: false}
+		gws.respondJSON(w, response)
+		return
+	}
 
 	response := AuthCheckResponse{
 		Authenticated: true,
 		Username:      session.Username,
+		Role:          account.role,
+		Groups:        account.groups,
 		ExpiresAt:     session.ExpiresAt,
 	}
 	gws.respondJSON(w, response)
@@ -399,6 +540,7 @@ func (gws *WebServer) handleAuthCheck(w http.ResponseWriter, r *http.Request) {
 
 // Stop stops the web server gracefully
 func (gws *WebServer) Stop() error {
+	gws.stopControl()
 	if gws.server != nil {
 		return gws.server.Close()
 	}
@@ -422,7 +564,12 @@ func (gws *WebServer) corsMiddleware(next http.Handler) http.Handler {
 }
 
 // handleGlobalMetrics handles global metrics requests
-func (gws *WebServer) handleGlobalMetrics(w http.ResponseWriter, _ *http.Request) {
+func (gws *WebServer) handleGlobalMetrics(w http.ResponseWriter, r *http.Request) {
+	if t := gws.requestTenant(r); t != nil {
+		gws.respondJSON(w, t.globalMetrics())
+		return
+	}
+
 	global := monitoring.GetMetrics()
 
 	// Get real-time active connections count from actual connection data
@@ -451,6 +598,8 @@ func (gws *WebServer) handleGlobalMetrics(w http.ResponseWriter, _ *http.Request
 		ErrorCount:        global.ErrorCount,
 		SuccessRate:       global.SuccessRate(),
 		Uptime:            global.Uptime().String(),
+		GatewayVersion:    version.Version,
+		CountersSince:     global.CountersSince,
 	}
 	gws.respondJSON(w, response)
 }
@@ -462,6 +611,8 @@ type LoginResponse struct {
 	Status    string    `json:"status"`
 	Message   string    `json:"message"`
 	Username  string    `json:"username"`
+	Role      Role      `json:"role"`
+	Groups    []string  `json:"groups,omitempty"` // Set for tenant accounts limited to these groups
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
@@ -474,18 +625,22 @@ type LogoutResponse struct {
 type AuthCheckResponse struct {
 	Authenticated bool      `json:"authenticated"`
 	Username      string    `json:"username,omitempty"`
+	Role          Role      `json:"role,omitempty"`
+	Groups        []string  `json:"groups,omitempty"` // Set for tenant accounts limited to these groups
 	ExpiresAt     time.Time `json:"expires_at,omitempty"`
 }
 
 // GlobalMetricsResponse represents global metrics API response
 type GlobalMetricsResponse struct {
-	ActiveConnections int64   `json:"active_connections"`
-	TotalConnections  int64   `json:"total_connections"`
-	BytesSent         int64   `json:"bytes_sent"`
-	BytesReceived     int64   `json:"bytes_received"`
-	ErrorCount        int64   `json:"error_count"`
-	SuccessRate       float64 `json:"success_rate"`
-	Uptime            string  `json:"uptime"`
+	ActiveConnections int64     `json:"active_connections"`
+	TotalConnections  int64     `json:"total_connections"`
+	BytesSent         int64     `json:"bytes_sent"`
+	BytesReceived     int64     `json:"bytes_received"`
+	ErrorCount        int64     `json:"error_count"`
+	SuccessRate       float64   `json:"success_rate"`
+	Uptime            string    `json:"uptime"`
+	GatewayVersion    string    `json:"gateway_version"`
+	CountersSince     time.Time `json:"counters_since"` // Start of the totals, survives restarts with metrics snapshots
 }
 
 // MetricsResponse represents client metrics response for API (excludes GroupID)
@@ -498,17 +653,25 @@ type MetricsResponse struct {
 	ErrorCount        int64     `json:"error_count"`
 	LastSeen          time.Time `json:"last_seen"`
 	IsOnline          bool      `json:"is_online"`
+
+	Version     string                      `json:"version,omitempty"` // Client build version, empty for clients predating version reporting
+	VersionSkew bool                        `json:"version_skew"`      // Client version differs from the gateway's
+	Telemetry   *monitoring.ClientTelemetry `json:"telemetry,omitempty"`
+	Draining    bool                        `json:"draining"` // Client is shutting down and gets no new connections
+
+	OfflineActivity *monitoring.OfflineActivity `json:"offline_activity,omitempty"` // Reports the client spooled during outages
 }
 
 // handleClientMetrics handles client metrics requests
 func (gws *WebServer) handleClientMetrics(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case methodGET:
+		t := gws.requestTenant(r)
 		clientID := r.URL.Query().Get("client_id")
 		if clientID != "" {
 			// Get specific client metrics
 			clientMetrics := monitoring.GetClientMetrics(clientID)
-			if clientMetrics == nil {
+			if clientMetrics == nil || !t.allowsClient(clientID) {
 				http.Error(w, "Client not found", http.StatusNotFound)
 				return
 			}
@@ -517,7 +680,7 @@ func (gws *WebServer) handleClientMetrics(w http.ResponseWriter, r *http.Request
 			gws.respondJSON(w, response)
 		} else {
 			// Get all client metrics
-			allMetrics := monitoring.GetAllClientMetrics()
+			allMetrics := t.clientMetrics()
 
 			// Show empty result if no client data available
 			if len(allMetrics) == 0 {
@@ -543,42 +706,31 @@ func (gws *WebServer) handleClientMetrics(w http.ResponseWriter, r *http.Request
 func (gws *WebServer) handleConnectionMetrics(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case methodGET:
+		t := gws.requestTenant(r)
 		connID := r.URL.Query().Get("conn_id")
-		if connID != "" {
+		if r.URL.Query().Get("status") == monitoring.StatusFailed {
+			// Recently failed connections, oldest first, kept whether or not they were sampled
+			failed := t.failedConnections()
+			response := make([]map[string]interface{}, 0, len(failed))
+			for _, conn := range failed {
+				response = append(response, connectionResponse(conn))
+			}
+			gws.respondJSON(w, response)
+		} else if connID != "" {
 			// Get specific connection metrics
-			allConnections := monitoring.GetAllConnectionMetrics()
+			allConnections := t.connectionMetrics()
 			if conn, exists := allConnections[connID]; exists {
-				// Create enhanced response with computed duration
-				response := map[string]interface{}{
-					"connection_id":  conn.ConnectionID,
-					"client_id":      conn.ClientID,
-					"target_host":    conn.TargetHost,
-					"start_time":     conn.StartTime,
-					"bytes_sent":     conn.BytesSent,
-					"bytes_received": conn.BytesReceived,
-					"status":         conn.Status,
-					"duration":       time.Since(conn.StartTime).Nanoseconds(),
-				}
-				gws.respondJSON(w, response)
+				gws.respondJSON(w, connectionResponse(conn))
 			} else {
 				http.Error(w, "Connection not found", http.StatusNotFound)
 			}
 		} else {
 			// Get all connection metrics with computed duration
-			allMetrics := monitoring.GetAllConnectionMetrics()
+			allMetrics := t.connectionMetrics()
 			response := make(map[string]interface{})
 
 			for id, conn := range allMetrics {
-				response[id] = map[string]interface{}{
-					"connection_id":  conn.ConnectionID,
-					"client_id":      conn.ClientID,
-					"target_host":    conn.TargetHost,
-					"start_time":     conn.StartTime,
-					"bytes_sent":     conn.BytesSent,
-					"bytes_received": conn.BytesReceived,
-					"status":         conn.Status,
-					"duration":       time.Since(conn.StartTime).Nanoseconds(),
-				}
+				response[id] = connectionResponse(conn)
 			}
 
 			gws.respondJSON(w, response)
@@ -588,6 +740,26 @@ func (gws *WebServer) handleConnectionMetrics(w http.ResponseWriter, r *http.Req
 	}
 }
 
+// connectionResponse is a connection record with its computed duration
+func connectionResponse(conn *monitoring.ConnectionMetrics) map[string]interface{} {
+	response := map[string]interface{}{
+		"connection_id":  conn.ConnectionID,
+		"client_id":      conn.ClientID,
+		"target_host":    conn.TargetHost,
+		"start_time":     conn.StartTime,
+		"bytes_sent":     conn.BytesSent,
+		"bytes_received": conn.BytesReceived,
+		"status":         conn.Status,
+		"duration":       time.Since(conn.StartTime).Nanoseconds(),
+		"source_country": conn.SourceCountry,
+		"target_country": conn.TargetCountry,
+	}
+	if conn.Error != "" {
+		response["error"] = conn.Error
+	}
+	return response
+}
+
 // Removed unnecessary rate limiting and stats handlers to minimize code
 
 // countActiveDomains was removed (domain metrics not supported in simplified version)
@@ -614,5 +786,10 @@ func toClientMetricsResponse(metrics *monitoring.ClientMetrics) *MetricsResponse
 		ErrorCount:        metrics.ErrorCount,
 		LastSeen:          metrics.LastSeen,
 		IsOnline:          metrics.IsOnline,
+		Version:           metrics.Version,
+		VersionSkew:       metrics.Version != version.Version,
+		Telemetry:         metrics.Telemetry,
+		Draining:          metrics.Draining,
+		OfflineActivity:   metrics.OfflineActivity,
 	}
 }
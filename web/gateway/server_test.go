@@ -10,6 +10,7 @@ import (
 
 	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
 	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/web/sessions"
 )
 
 func TestNewSessionManager(t *testing.T) {
@@ -24,8 +25,8 @@ func TestNewSessionManager(t *testing.T) {
 		t.Errorf("Expected timeout %v, got %v", timeout, sm.timeout)
 	}
 
-	if sm.sessions == nil {
-		t.Error("Sessions map should be initialized")
+	if sm.store == nil {
+		t.Error("Session store should be initialized")
 	}
 }
 
@@ -242,7 +243,10 @@ func TestWebServer_IsPublicPath(t *testing.T) {
 		expected bool
 	}{
 		{"/login.html", true},
+		{"/status.html", true},
+		{"/api/status", true},
 		{"/js/i18n.js", true},
+		{"/api/ui/config", true},
 		{"/api/auth/login", true},
 		{"/api/auth/logout", true},
 		{"/api/auth/check", true},
@@ -497,6 +501,50 @@ func TestWebServer_HandleGlobalMetrics(t *testing.T) {
 	}
 }
 
+func TestWebServer_PersistentSessions(t *testing.T) {
+	store, err := sessions.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func() *WebServer {
+		server := NewGatewayWebServer(":8080", "", ratelimit.NewRateLimiter(nil))
+		server.SetAuth(true, "admin", "password")
+		server.SetSessionStore(store, "session-key")
+		return server
+	}
+
+	rr := httptest.NewRecorder()
+	newServer().handleLogin(rr, httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(`{"username":"admin","password":"password"}`)))
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == "gateway_session_id" {
+			cookie = c
+		}
+	}
+	if cookie == nil || !strings.Contains(cookie.Value, ".") {
+		t.Fatalf("Expected a signed session cookie, got %v", cookie)
+	}
+
+	// A restarted gateway on the same store accepts the cookie
+	restarted := newServer()
+	check := func(value string) bool {
+		req := httptest.NewRequest("GET", "/api/auth/check", nil)
+		req.AddCookie(&http.Cookie{Name: "gateway_session_id", Value: value})
+		rr := httptest.NewRecorder()
+		restarted.handleAuthCheck(rr, req)
+		var response AuthCheckResponse
+		_ = json.NewDecoder(rr.Body).Decode(&response)
+		return response.Authenticated
+	}
+	if !check(cookie.Value) {
+		t.Error("Expected the session to survive a restart")
+	}
+	sessionID, _, _ := strings.Cut(cookie.Value, ".")
+	if check(sessionID) {
+		t.Error("Expected an unsigned session ID to be rejected")
+	}
+}
+
 func TestWebServer_CorsMiddleware(t *testing.T) {
 	server := NewGatewayWebServer(":8080", "", nil)
 
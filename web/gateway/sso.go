@@ -0,0 +1,42 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/buhuipao/anyproxy/pkg/logger"
+	"github.com/buhuipao/anyproxy/web/auth"
+)
+
+// ssoRedirectPage sends the browser to the dashboard after a single sign-on. The session cookie
+// is SameSite=Strict, a redirect on the navigation from the provider's site wouldn't send it.
+const ssoRedirectPage = `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=/"></head><body></body></html>`
+
+// AuthProvidersResponse tells the login page how users can log in
+type AuthProvidersResponse struct {
+	Password bool `json:"password"` // The username and password form
+	OIDC     bool `json:"oidc"`     // Single sign-on at auth.OIDCLoginPath
+}
+
+// handleAuthProviders lists the login methods for the login page
+func (gws *WebServer) handleAuthProviders(w http.ResponseWriter, _ *http.Request) {
+	gws.respondJSON(w, AuthProvidersResponse{
+		Password: gws.authChain.Enabled(auth.ProviderLocal) || gws.authChain.Enabled(auth.ProviderLDAP),
+		OIDC:     gws.authChain.OIDC() != nil,
+	})
+}
+
+// handleOIDCCallback completes a single sign-on and starts the user's session
+func (gws *WebServer) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	identity, err := gws.authChain.OIDC().Callback(w, r)
+	if err != nil {
+		logger.Warn("Failed single sign-on", "remote_addr", r.RemoteAddr, "err", err)
+		gws.auditLog.Record(AuditEntry{RemoteAddr: r.RemoteAddr, Action: "auth.login", Success: false, Detail: auth.ProviderOIDC + ": " + err.Error()})
+		http.Redirect(w, r, "/login.html?error=sso", http.StatusFound)
+		return
+	}
+
+	gws.startSession(w, r, identityAccount(identity))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, ssoRedirectPage)
+}
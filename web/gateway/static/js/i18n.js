@@ -22,6 +22,7 @@ class I18n {
                 'dashboard.subtitle': 'Gateway Management Interface - Real-time Monitoring & Configuration',
                 'dashboard.welcome': 'Welcome, ',
                 'dashboard.logout': 'Logout',
+                'dashboard.mirror': 'Mirror',
 
                 // Metrics
                 'metrics.active_connections': 'Active Connections',
@@ -42,6 +43,14 @@ class I18n {
                 'clients.no_clients': 'No connected clients',
                 'clients.no_online_clients': 'No online clients',
                 'clients.show_offline': 'Show Offline Clients',
+                'clients.host': 'Host',
+                'clients.memory': 'Mem',
+                'clients.load': 'Load',
+                'clients.version': 'Version',
+                'clients.version_skew': 'Differs from the gateway version',
+                'clients.uptime': 'Uptime',
+                'clients.loadScore': 'Load score',
+                'clients.disk': 'Disk',
 
                 // Login
                 'login.title': 'AnyProxy Gateway - Login',
@@ -53,6 +62,8 @@ class I18n {
                 'login.logging_in': 'Logging in...',
                 'login.error.invalid': 'Invalid username or password',
                 'login.error.network': 'Network error, please try again later',
+                'login.error.sso': 'Single sign-on failed, please try again',
+                'login.sso': 'Sign in with SSO',
                 'login.footer': '© 2025 AnyProxy. Authentication required to access management interface.',
 
                 // Navigation
@@ -93,6 +104,7 @@ class I18n {
                 'dashboard.subtitle': '网关管理界面 - 实时监控与配置',
                 'dashboard.welcome': '欢迎，',
                 'dashboard.logout': '登出',
+                'dashboard.mirror': '流量镜像',
 
                 // Metrics
                 'metrics.active_connections': '活跃连接',
@@ -113,6 +125,14 @@ class I18n {
                 'clients.no_clients': '没有客户端连接',
                 'clients.no_online_clients': '没有在线客户端',
                 'clients.show_offline': '显示离线客户端',
+                'clients.host': '主机',
+                'clients.memory': '内存',
+                'clients.load': '负载',
+                'clients.version': '版本',
+                'clients.version_skew': '与网关版本不一致',
+                'clients.uptime': '运行时间',
+                'clients.loadScore': '负载评分',
+                'clients.disk': '磁盘',
 
                 // Login
                 'login.title': 'AnyProxy 网关 - 登录',
@@ -124,6 +144,8 @@ class I18n {
                 'login.logging_in': '登录中...',
                 'login.error.invalid': '用户名或密码错误',
                 'login.error.network': '网络错误，请稍后重试',
+                'login.error.sso': '单点登录失败，请重试',
+                'login.sso': '使用 SSO 登录',
                 'login.footer': '© 2025 AnyProxy. 访问管理界面需要认证。',
 
                 // Navigation
@@ -147,8 +169,59 @@ class I18n {
             }
         };
 
-        // Apply translations when page loads
+        this.languages = Object.keys(this.translations);
+        this.features = {};
+
+        // Apply translations when page loads, then merge the operator bundles from the backend
         this.applyTranslations();
+        this.loadBackendConfig();
+    }
+
+    // Load operator translations, feature flags and theme stylesheet from the backend
+    async loadBackendConfig(lang = this.currentLanguage) {
+        let config;
+        try {
+            const response = await fetch(`/api/ui/config?lang=${encodeURIComponent(lang)}`);
+            if (!response.ok) {
+                return;
+            }
+            config = await response.json();
+        } catch (e) {
+            console.warn('Failed to load UI config:', e);
+            return;
+        }
+
+        // The operator default applies until the user picks a language
+        if (!localStorage.getItem('preferred-language') && config.default_language && config.default_language !== lang) {
+            this.currentLanguage = config.default_language;
+            return this.loadBackendConfig(config.default_language);
+        }
+
+        this.features = config.features || {};
+        (config.languages || []).forEach(language => {
+            if (!this.languages.includes(language)) {
+                this.languages.push(language);
+            }
+        });
+        this.translations[lang] = Object.assign({}, this.translations[lang] || this.translations['en'], config.translations);
+
+        if (config.theme_stylesheet && !document.getElementById('theme-stylesheet')) {
+            const link = document.createElement('link');
+            link.id = 'theme-stylesheet';
+            link.rel = 'stylesheet';
+            link.href = config.theme_stylesheet;
+            document.head.appendChild(link);
+        }
+
+        if (lang === this.currentLanguage) {
+            this.applyTranslations();
+        }
+        document.dispatchEvent(new CustomEvent('i18n:config', { detail: config }));
+    }
+
+    // hasFeature reports whether the operator enabled a feature flag
+    hasFeature(name) {
+        return this.features[name] === true;
     }
 
     detectLanguage() {
@@ -167,7 +240,8 @@ class I18n {
     }
 
     t(key, params = {}) {
-        const translation = this.translations[this.currentLanguage][key] || key;
+        const bundle = this.translations[this.currentLanguage] || this.translations['en'];
+        const translation = bundle[key] || key;
         
         // Simple parameter substitution
         let result = translation;
@@ -214,9 +288,11 @@ class I18n {
     }
 
     toggleLanguage() {
-        this.currentLanguage = this.currentLanguage === 'en' ? 'zh' : 'en';
+        const index = this.languages.indexOf(this.currentLanguage);
+        this.currentLanguage = this.languages[(index + 1) % this.languages.length];
         localStorage.setItem('preferred-language', this.currentLanguage);
         this.applyTranslations();
+        this.loadBackendConfig();
     }
 
     formatBytes(bytes) {
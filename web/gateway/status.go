@@ -0,0 +1,40 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// StatusBackend provides the public status page content
+type StatusBackend interface {
+	GetServiceStatus() (*gw.ServiceStatus, error)
+}
+
+// registerStatusRoutes registers the public status API, it never requires authentication
+func (gws *WebServer) registerStatusRoutes(mux *http.ServeMux) {
+	if _, ok := gws.admin.(StatusBackend); ok {
+		mux.HandleFunc("/api/status", gws.handleStatus)
+	}
+}
+
+// handleStatus returns per-group availability for the public status page
+func (gws *WebServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := gws.admin.(StatusBackend).GetServiceStatus()
+	if errors.Is(err, gw.ErrStatusPageDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Public and polled by embedding pages, let caches absorb bursts
+	w.Header().Set("Cache-Control", "public, max-age=10")
+	gws.respondJSON(w, status)
+}
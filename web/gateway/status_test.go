@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// mockStatusBackend adds the status page to the admin mock
+type mockStatusBackend struct {
+	mockAdminBackend
+	status *gw.ServiceStatus
+}
+
+func (m *mockStatusBackend) GetServiceStatus() (*gw.ServiceStatus, error) {
+	if m.status == nil {
+		return nil, gw.ErrStatusPageDisabled
+	}
+	return m.status, nil
+}
+
+func TestWebServer_Status(t *testing.T) {
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	server.SetAuth(true, "admin", "secret")
+	backend := &mockStatusBackend{status: &gw.ServiceStatus{
+		Title:  "Service Status",
+		Status: gw.ServiceStatusOperational,
+		Groups: []gw.GroupServiceStatus{{Name: "eu-west", Status: gw.ServiceStatusUp, ClientsOnline: 2}},
+	}}
+	server.SetAdminBackend(backend)
+
+	mux := http.NewServeMux()
+	server.registerStatusRoutes(mux)
+	handler := server.authMiddleware(mux)
+
+	// Reachable without a session even though the dashboard requires login
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/status", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var status gw.ServiceStatus
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Groups) != 1 || status.Groups[0].Name != "eu-west" || status.Groups[0].ClientsOnline != 2 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	backend.status = nil
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/status", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when the status page is disabled, got %d", rr.Code)
+	}
+}
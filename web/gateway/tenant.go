@@ -0,0 +1,280 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/version"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// groupsHeader carries the groups of a tenant account, set by authMiddleware like X-User
+const groupsHeader = "X-User-Groups"
+
+// tenant is the set of groups a tenant account is limited to, nil for accounts seeing every group
+type tenant map[string]bool
+
+// setTenantHeader replaces a groups header sent by the browser with the account's groups
+func setTenantHeader(r *http.Request, groups []string) {
+	r.Header.Del(groupsHeader)
+	if len(groups) == 0 {
+		return
+	}
+	escaped := make([]string, len(groups))
+	for i, group := range groups {
+		escaped[i] = url.QueryEscape(group)
+	}
+	r.Header.Set(groupsHeader, strings.Join(escaped, ","))
+}
+
+// requestTenant returns the groups the request's user is limited to, nil when the user sees every group
+func (gws *WebServer) requestTenant(r *http.Request) tenant {
+	header := r.Header.Get(groupsHeader)
+	if !gws.authEnabled || header == "" {
+		return nil
+	}
+	t := make(tenant)
+	for _, escaped := range strings.Split(header, ",") {
+		if group, err := url.QueryUnescape(escaped); err == nil {
+			t[group] = true
+		}
+	}
+	return t
+}
+
+// denyTenants rejects tenant accounts from routes covering every group
+func (gws *WebServer) denyTenants(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if gws.requestTenant(r) != nil {
+			gws.audit(r, "authz.denied", r.Method+" "+r.URL.Path, fmt.Errorf("not available to tenant accounts"))
+			http.Error(w, "Forbidden: not available to tenant accounts", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allows reports whether the tenant may see a group
+func (t tenant) allows(groupID string) bool {
+	return t == nil || t[groupID]
+}
+
+// groups returns the tenant's group IDs, sorted
+func (t tenant) groups() []string {
+	groups := make([]string, 0, len(t))
+	for group := range t {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// clientMetrics returns the metrics of the clients the tenant may see
+func (t tenant) clientMetrics() map[string]*monitoring.ClientMetrics {
+	clients := monitoring.GetAllClientMetrics()
+	if t == nil {
+		return clients
+	}
+	for clientID, metrics := range clients {
+		if !t[metrics.GroupID] {
+			delete(clients, clientID)
+		}
+	}
+	return clients
+}
+
+// allowsClient reports whether the tenant may see a client, by the group the client registered with
+func (t tenant) allowsClient(clientID string) bool {
+	return t == nil || t.clientMetrics()[clientID] != nil
+}
+
+// connectionMetrics returns the connections of the clients the tenant may see
+func (t tenant) connectionMetrics() map[string]*monitoring.ConnectionMetrics {
+	connections := monitoring.GetAllConnectionMetrics()
+	if t == nil {
+		return connections
+	}
+	clients := t.clientMetrics()
+	for connID, conn := range connections {
+		if clients[conn.ClientID] == nil {
+			delete(connections, connID)
+		}
+	}
+	return connections
+}
+
+// failedConnections returns the recently failed connections of the tenant's clients
+func (t tenant) failedConnections() []*monitoring.ConnectionMetrics {
+	failed := monitoring.GetFailedConnections()
+	if t == nil {
+		return failed
+	}
+	clients := t.clientMetrics()
+	kept := failed[:0]
+	for _, conn := range failed {
+		if clients[conn.ClientID] != nil {
+			kept = append(kept, conn)
+		}
+	}
+	return kept
+}
+
+// globalMetrics sums the metrics of the tenant's clients in place of the gateway totals
+func (t tenant) globalMetrics() GlobalMetricsResponse {
+	global := monitoring.GetMetrics()
+	response := GlobalMetricsResponse{
+		SuccessRate:    100,
+		Uptime:         global.Uptime().String(),
+		GatewayVersion: version.Version,
+		CountersSince:  global.CountersSince,
+	}
+	for _, client := range t.clientMetrics() {
+		response.TotalConnections += client.TotalConnections
+		response.BytesSent += client.BytesSent
+		response.BytesReceived += client.BytesReceived
+		response.ErrorCount += client.ErrorCount
+	}
+	for _, conn := range t.connectionMetrics() {
+		if conn.Status == statusActive {
+			response.ActiveConnections++
+		}
+	}
+	if response.TotalConnections > 0 {
+		response.SuccessRate = float64(response.TotalConnections-response.ErrorCount) / float64(response.TotalConnections) * 100
+	}
+	return response
+}
+
+// groupStatuses filters group statuses to the tenant's groups
+func (t tenant) groupStatuses(statuses []gw.GroupStatus) []gw.GroupStatus {
+	if t == nil {
+		return statuses
+	}
+	filtered := make([]gw.GroupStatus, 0, len(t))
+	for _, status := range statuses {
+		if t[status.GroupID] {
+			filtered = append(filtered, status)
+		}
+	}
+	return filtered
+}
+
+// allowsGroupClient reports whether a client is registered in one of the tenant's groups
+func (t tenant) allowsGroupClient(statuses []gw.GroupStatus, clientID string) bool {
+	if t == nil {
+		return true
+	}
+	for _, status := range t.groupStatuses(statuses) {
+		for _, id := range status.Clients {
+			if id == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TenantAccount is a dashboard account limited to groups, the password is only set in requests
+type TenantAccount struct {
+	Username string   `json:"username"`
+	Password string   `json:"password,omitempty"`
+	Role     Role     `json:"role"` // viewer (default) or operator
+	Groups   []string `json:"groups"`
+}
+
+// handleTenants lists (GET), creates or replaces (POST) and removes (DELETE) tenant accounts.
+// Changes last until the gateway restarts, accounts to keep belong in gateway.web.users.
+func (gws *WebServer) handleTenants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case methodGET:
+		tenants := make([]TenantAccount, 0)
+		for _, user := range gws.accounts() {
+			if len(user.groups) > 0 {
+				tenants = append(tenants, TenantAccount{Username: user.username, Role: user.role, Groups: user.groups})
+			}
+		}
+		gws.respondJSON(w, tenants)
+	case methodPOST:
+		var req TenantAccount
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = RoleViewer
+		}
+
+		err := gws.setTenant(req)
+		gws.audit(r, "tenant.set", req.Username, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gws.respondJSON(w, AdminResponse{Status: "success", Message: "Tenant updated"})
+	case methodDELETE:
+		username := r.URL.Query().Get("username")
+		err := gws.removeTenant(username)
+		gws.audit(r, "tenant.delete", username, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		gws.respondJSON(w, AdminResponse{Status: "success", Message: "Tenant removed"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// setTenant creates or replaces a tenant account, accounts without groups cannot be replaced
+func (gws *WebServer) setTenant(req TenantAccount) error {
+	if req.Username == "" || req.Password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+	if req.Role != RoleViewer && req.Role != RoleOperator {
+		return fmt.Errorf("role must be one of: viewer, operator")
+	}
+	if len(req.Groups) == 0 {
+		return fmt.Errorf("groups are required")
+	}
+	for _, group := range req.Groups {
+		if group == "" {
+			return fmt.Errorf("groups cannot contain empty group IDs")
+		}
+	}
+	if req.Username == gws.authUsername {
+		return fmt.Errorf("account %s is not a tenant", req.Username)
+	}
+
+	account := webUser{username: req.Username, password: req.Password, role: req.Role, groups: req.Groups}
+	gws.usersMu.Lock()
+	defer gws.usersMu.Unlock()
+	for i, user := range gws.users {
+		if user.username == req.Username {
+			if len(user.groups) == 0 {
+				return fmt.Errorf("account %s is not a tenant", req.Username)
+			}
+			gws.users[i] = account
+			return nil
+		}
+	}
+	gws.users = append(gws.users, account)
+	return nil
+}
+
+// removeTenant removes a tenant account, ending its sessions
+func (gws *WebServer) removeTenant(username string) error {
+	gws.usersMu.Lock()
+	defer gws.usersMu.Unlock()
+	for i, user := range gws.users {
+		if user.username == username && len(user.groups) > 0 {
+			gws.users = append(gws.users[:i:i], gws.users[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("tenant not found: %s", username)
+}
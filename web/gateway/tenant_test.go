@@ -0,0 +1,218 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/common/monitoring"
+	"github.com/buhuipao/anyproxy/pkg/common/ratelimit"
+	"github.com/buhuipao/anyproxy/pkg/config"
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+func TestWebServer_TenantAccess(t *testing.T) {
+	monitoring.UpdateClientMetrics("tenant-acme-1", "acme", 100, 200, false)
+	monitoring.UpdateClientMetrics("tenant-other-1", "other", 1000, 2000, true)
+	monitoring.CreateConnection("tenant-conn-acme", "tenant-acme-1", "acme.example.com:443")
+	monitoring.CreateConnection("tenant-conn-other", "tenant-other-1", "other.example.com:443")
+	defer monitoring.CloseConnection("tenant-conn-acme")
+	defer monitoring.CloseConnection("tenant-conn-other")
+	monitoring.RecordUserDial("acme", "alice", "acme.example.com:443", false)
+	monitoring.RecordUserDial("other", "bob", "other.example.com:443", false)
+	monitoring.UpdateClientTelemetry("tenant-acme-1", "acme", &monitoring.ClientTelemetry{Checks: []monitoring.CheckResult{{Name: "wiki", OK: true}}})
+	monitoring.UpdateClientTelemetry("tenant-other-1", "other", &monitoring.ClientTelemetry{Checks: []monitoring.CheckResult{{Name: "db", OK: false}}})
+
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	server.SetAuth(true, "admin", "secret")
+	server.SetUsers([]config.WebUserConfig{{Username: "acme", Password: "acme-pass", Role: "operator", Groups: []string{"acme"}}})
+	backend := &mockAdminBackend{
+		groups: []gw.GroupStatus{
+			{GroupID: "acme", Clients: []string{"tenant-acme-1"}},
+			{GroupID: "other", Clients: []string{"tenant-other-1"}},
+		},
+		credentials: make(map[string]string),
+	}
+	server.SetAdminBackend(backend)
+	protected := server.getProtectedHandler()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/metrics/global", protected(server.handleGlobalMetrics))
+	mux.HandleFunc("/api/metrics/clients", protected(server.handleClientMetrics))
+	mux.HandleFunc("/api/metrics/connections", protected(server.handleConnectionMetrics))
+	mux.HandleFunc("/api/metrics/targets", protected(server.handleTargetMetrics))
+	mux.HandleFunc("/api/metrics/users", protected(server.handleUserMetrics))
+	mux.HandleFunc("/api/metrics/checks", protected(server.handleCheckMetrics))
+	mux.HandleFunc("/metrics", server.scrapeHandler(server.handlePrometheusMetrics))
+	server.registerAdminRoutes(mux, protected)
+
+	login := func(username, password string) *http.Cookie {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		server.handleLogin(rr, httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(`{"username":"`+username+`","password":"`+password+`"}`)))
+		if len(rr.Result().Cookies()) == 0 {
+			t.Fatalf("Login of %s failed: %d %s", username, rr.Code, rr.Body.String())
+		}
+		return rr.Result().Cookies()[0]
+	}
+	do := func(cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		// A spoofed header must not widen the tenant's groups
+		req.Header.Set(groupsHeader, "other")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tenant, admin := login("acme", "acme-pass"), login("admin", "secret")
+
+	var clients map[string]*MetricsResponse
+	if err := json.Unmarshal(do(tenant, "GET", "/api/metrics/clients", "").Body.Bytes(), &clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients["tenant-acme-1"] == nil {
+		t.Errorf("Expected only the tenant's client, got %v", clients)
+	}
+	if rr := do(tenant, "GET", "/api/metrics/clients?client_id=tenant-other-1", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected another group's client to be hidden, got %d", rr.Code)
+	}
+
+	var connections map[string]interface{}
+	if err := json.Unmarshal(do(tenant, "GET", "/api/metrics/connections", "").Body.Bytes(), &connections); err != nil {
+		t.Fatal(err)
+	}
+	if len(connections) != 1 || connections["tenant-conn-acme"] == nil {
+		t.Errorf("Expected only the tenant's connection, got %v", connections)
+	}
+
+	var global GlobalMetricsResponse
+	if err := json.Unmarshal(do(tenant, "GET", "/api/metrics/global", "").Body.Bytes(), &global); err != nil {
+		t.Fatal(err)
+	}
+	if global.BytesSent != 100 || global.ErrorCount != 0 || global.ActiveConnections != 1 {
+		t.Errorf("Expected the tenant's totals, got %+v", global)
+	}
+
+	var checks ChecksResponse
+	if err := json.Unmarshal(do(tenant, "GET", "/api/metrics/checks", "").Body.Bytes(), &checks); err != nil {
+		t.Fatal(err)
+	}
+	if len(checks.Checks) != 1 || checks.Checks[0].GroupID != "acme" || checks.Checks[0].Passing != 1 {
+		t.Errorf("Expected only the checks of the tenant's group, got %+v", checks.Checks)
+	}
+	if rr := do(tenant, "GET", "/api/metrics/checks?group_id=other", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected another group's checks to be hidden, got %d", rr.Code)
+	}
+
+	var users UsersResponse
+	if err := json.Unmarshal(do(tenant, "GET", "/api/metrics/users", "").Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users.Users {
+		if user.GroupID != "acme" {
+			t.Errorf("Expected only the tenant's users, got %+v", user)
+		}
+	}
+	var alice UserResponse
+	if err := json.Unmarshal(do(tenant, "GET", "/api/metrics/users?group_id=acme&username=alice", "").Body.Bytes(), &alice); err != nil {
+		t.Fatal(err)
+	}
+	if alice.TotalConnections != 1 || len(alice.TopTargets) != 1 || alice.TopTargets[0].Host != "acme.example.com" {
+		t.Errorf("Expected alice's connection and destination, got %+v", alice)
+	}
+
+	var groups []gw.GroupStatus
+	if err := json.Unmarshal(do(tenant, "GET", "/api/admin/groups", "").Body.Bytes(), &groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].GroupID != "acme" {
+		t.Errorf("Expected only the tenant's group, got %+v", groups)
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"tenant reads another group's targets", tenant, "GET", "/api/metrics/targets?group_id=other", "", http.StatusNotFound},
+		{"tenant reads its targets", tenant, "GET", "/api/metrics/targets", "", http.StatusOK},
+		{"tenant reads another group's user", tenant, "GET", "/api/metrics/users?group_id=other&username=bob", "", http.StatusNotFound},
+		{"admin reads an unknown user", admin, "GET", "/api/metrics/users?group_id=acme&username=nobody", "", http.StatusNotFound},
+		{"tenant kicks another group's client", tenant, "POST", "/api/admin/clients/kick", `{"client_id":"tenant-other-1"}`, http.StatusNotFound},
+		{"tenant kicks its client", tenant, "POST", "/api/admin/clients/kick", `{"client_id":"tenant-acme-1"}`, http.StatusOK},
+		{"tenant reads the audit log", tenant, "GET", "/api/admin/audit", "", http.StatusForbidden},
+		{"tenant reads rate limits", tenant, "GET", "/api/admin/ratelimit", "", http.StatusForbidden},
+		{"tenant scrapes metrics", tenant, "GET", "/metrics", "", http.StatusForbidden},
+		{"admin reads another group's targets", admin, "GET", "/api/metrics/targets?group_id=other", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := do(tt.cookie, tt.method, tt.path, tt.body).Code; got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if len(backend.kicked) != 1 || backend.kicked[0] != "tenant-acme-1" {
+		t.Errorf("Expected only the tenant's client to be kicked, got %v", backend.kicked)
+	}
+
+	// The spoofed header is ignored for accounts seeing every group
+	if err := json.Unmarshal(do(admin, "GET", "/api/admin/groups", "").Body.Bytes(), &groups); err != nil || len(groups) != 2 {
+		t.Errorf("Expected the admin to see every group, got %+v, %v", groups, err)
+	}
+}
+
+func TestWebServer_TenantManagement(t *testing.T) {
+	server := NewGatewayWebServer(":0", "", ratelimit.NewRateLimiter(nil))
+	server.SetAuth(true, "admin", "secret")
+	server.SetUsers([]config.WebUserConfig{{Username: "noc", Password: "noc-pass", Role: "viewer"}})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.handleTenants(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"create", `{"username":"acme","password":"p","groups":["acme"]}`, http.StatusOK},
+		{"replace", `{"username":"acme","password":"p2","role":"operator","groups":["acme","acme-eu"]}`, http.StatusOK},
+		{"without groups", `{"username":"beta","password":"p"}`, http.StatusBadRequest},
+		{"admin role", `{"username":"beta","password":"p","role":"admin","groups":["beta"]}`, http.StatusBadRequest},
+		{"replacing a non-tenant account", `{"username":"noc","password":"p","groups":["acme"]}`, http.StatusBadRequest},
+		{"replacing auth_username", `{"username":"admin","password":"p","groups":["acme"]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := do("POST", "/api/admin/tenants", tt.body).Code; got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	var tenants []TenantAccount
+	if err := json.Unmarshal(do("GET", "/api/admin/tenants", "").Body.Bytes(), &tenants); err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 1 || tenants[0].Role != RoleOperator || len(tenants[0].Groups) != 2 || tenants[0].Password != "" {
+		t.Errorf("Unexpected tenants: %+v", tenants)
+	}
+	if _, ok := server.authenticate(context.Background(), "acme", "p2"); !ok {
+		t.Error("Expected the tenant to log in with the new password")
+	}
+
+	if rr := do("DELETE", "/api/admin/tenants?username=noc", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected non-tenant accounts to be kept, got %d", rr.Code)
+	}
+	if rr := do("DELETE", "/api/admin/tenants?username=acme", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the tenant to be removed, got %d", rr.Code)
+	}
+	if _, ok := server.userAccount("acme"); ok {
+		t.Error("Expected the removed tenant to be gone")
+	}
+}
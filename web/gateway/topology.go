@@ -0,0 +1,39 @@
+package gateway
+
+import (
+	"net/http"
+
+	gw "github.com/buhuipao/anyproxy/pkg/gateway"
+)
+
+// TopologyBackend is implemented by gateways exposing how groups select their clients
+type TopologyBackend interface {
+	GetGroupTopology(groupID string) []gw.GroupTopology
+}
+
+// handleGroupTopology returns the member clients, round-robin counter and recent client
+// selections of all groups, or of the group_id one
+func (gws *WebServer) handleGroupTopology(w http.ResponseWriter, r *http.Request) {
+	if r.Method != methodGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupID := r.URL.Query().Get("group_id")
+	t := gws.requestTenant(r)
+	topologies := make([]gw.GroupTopology, 0)
+	for _, topology := range gws.admin.(TopologyBackend).GetGroupTopology(groupID) {
+		if t == nil || t[topology.GroupID] {
+			topologies = append(topologies, topology)
+		}
+	}
+	if groupID == "" {
+		gws.respondJSON(w, topologies)
+		return
+	}
+	if len(topologies) == 0 {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	gws.respondJSON(w, topologies[0])
+}
@@ -0,0 +1,204 @@
+package sessions
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// Redis store defaults
+const (
+	defaultRedisKeyPrefix = "anyproxy:session:"
+	redisTimeout          = 5 * time.Second
+)
+
+// errRedisNil is the reply to GET of a missing key
+var errRedisNil = errors.New("redis: nil")
+
+// RedisStore keeps sessions in Redis with a TTL, so Redis expires them. It speaks the few RESP
+// commands it needs over one connection, redialed after errors.
+type RedisStore struct {
+	cfg    config.SessionRedisConfig
+	prefix string
+
+	mu   sync.Mutex // Serializes commands on the connection
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewRedisStore creates a store for the Redis server of cfg, it connects on first use
+func NewRedisStore(cfg config.SessionRedisConfig) *RedisStore {
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+	return &RedisStore{cfg: cfg, prefix: prefix}
+}
+
+// Save implements Store
+func (s *RedisStore) Save(session *Session) error {
+	ttl := time.Until(session.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		return s.Delete(session.ID)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if _, err := s.do("SET", s.prefix+session.ID, string(data), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		return fmt.Errorf("failed to save session: %v", err)
+	}
+	return nil
+}
+
+// Load implements Store
+func (s *RedisStore) Load(id string) (*Session, error) {
+	reply, err := s.do("GET", s.prefix+id)
+	if errors.Is(err, errRedisNil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session: %v", err)
+	}
+	var session Session
+	if err := json.Unmarshal([]byte(reply), &session); err != nil {
+		return nil, fmt.Errorf("invalid session in redis: %v", err)
+	}
+	return &session, nil
+}
+
+// Delete implements Store
+func (s *RedisStore) Delete(id string) error {
+	if _, err := s.do("DEL", s.prefix+id); err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+	return nil
+}
+
+// DeleteExpired implements Store, Redis expires sessions by their TTL
+func (s *RedisStore) DeleteExpired(time.Time) error {
+	return nil
+}
+
+// Close closes the connection
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// do runs a command, retrying once on a new connection when the current one failed
+func (s *RedisStore) do(args ...string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				return "", err
+			}
+		}
+		var reply string
+		reply, err = s.roundTrip(args...)
+		var replyErr redisError
+		if err == nil || errors.Is(err, errRedisNil) || errors.As(err, &replyErr) {
+			return reply, err
+		}
+		// Connection error, the connection state is unknown
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return "", err
+}
+
+// connect dials Redis and authenticates, s.mu must be held
+func (s *RedisStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.cfg.Addr, redisTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis %s: %v", s.cfg.Addr, err)
+	}
+	s.conn, s.rd = conn, bufio.NewReader(conn)
+	if s.cfg.Password != "" {
+		if _, err := s.roundTrip("AUTH", s.cfg.Password); err != nil {
+			_ = s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("redis authentication failed: %v", err)
+		}
+	}
+	if s.cfg.DB != 0 {
+		if _, err := s.roundTrip("SELECT", strconv.Itoa(s.cfg.DB)); err != nil {
+			_ = s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("failed to select redis db %d: %v", s.cfg.DB, err)
+		}
+	}
+	return nil
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// roundTrip writes a command and reads its reply, s.mu must be held
+func (s *RedisStore) roundTrip(args ...string) (string, error) {
+	_ = s.conn.SetDeadline(time.Now().Add(redisTimeout))
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		return "", err
+	}
+
+	line, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid redis reply: %q", line)
+		}
+		if n < 0 {
+			return "", errRedisNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(s.rd, data); err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	}
+	return "", fmt.Errorf("unexpected redis reply: %q", line)
+}
+
+// readLine reads a CRLF terminated reply line
+func (s *RedisStore) readLine() (string, error) {
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("invalid redis reply: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,169 @@
+package sessions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// fakeRedis serves the commands used by RedisStore from memory
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[string]string
+	expiries map[string]time.Time
+	conns    []net.Conn
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{listener: listener, password: password, data: map[string]string{}, expiries: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns = append(r.conns, conn)
+			r.mu.Unlock()
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close(); r.dropConnections() })
+	return r
+}
+
+// dropConnections closes the client connections, as a Redis restart would
+func (r *fakeRedis) dropConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conn := range r.conns {
+		_ = conn.Close()
+	}
+	r.conns = nil
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		reply := r.handle(args, &authed)
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err = rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) handle(args []string, authed *bool) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch cmd := strings.ToUpper(args[0]); {
+	case cmd == "AUTH":
+		if args[1] != r.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	case !*authed:
+		return "-NOAUTH Authentication required\r\n"
+	case cmd == "SELECT":
+		return "+OK\r\n"
+	case cmd == "SET":
+		r.data[args[1]] = args[2]
+		ms, _ := strconv.Atoi(args[4])
+		r.expiries[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case cmd == "GET":
+		value, ok := r.data[args[1]]
+		if !ok || time.Now().After(r.expiries[args[1]]) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case cmd == "DEL":
+		_, ok := r.data[args[1]]
+		delete(r.data, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisStore(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+	store := NewRedisStore(config.SessionRedisConfig{Addr: server.listener.Addr().String(), Password: "secret", DB: 2})
+	defer store.Close()
+
+	testStore(t, store)
+
+	// Sessions are stored under the key prefix with a TTL
+	session := &Session{ID: "abc", Username: "admin", ExpiresAt: time.Now().Add(time.Minute)}
+	if err := store.Save(session); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	ttl := time.Until(server.expiries["anyproxy:session:abc"])
+	server.mu.Unlock()
+	if ttl <= 50*time.Second || ttl > time.Minute {
+		t.Errorf("Expected a TTL of about a minute, got %v", ttl)
+	}
+
+	// A dropped connection is redialed
+	server.dropConnections()
+	if loaded, err := store.Load("abc"); err != nil || loaded == nil {
+		t.Errorf("Expected the store to reconnect, got %v, %v", loaded, err)
+	}
+}
+
+func TestRedisStore_AuthFailure(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+	store := NewRedisStore(config.SessionRedisConfig{Addr: server.listener.Addr().String(), Password: "wrong"})
+	defer store.Close()
+
+	if _, err := store.Load("abc"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Expected an authentication error, got %v", err)
+	}
+}
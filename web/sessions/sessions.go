@@ -0,0 +1,161 @@
+// Package sessions keeps web dashboard sessions in memory, in a directory or in Redis, and
+// signs session cookies. Persistent stores let sessions survive restarts and be shared by
+// gateways behind a load balancer when they use the same store and session key.
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// Session store types
+const (
+	StoreMemory = "memory"
+	StoreFile   = "file"
+	StoreRedis  = "redis"
+)
+
+// Session represents a user session
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// The login provider and, for providers other than the local accounts, the user's role
+	Provider string   `json:"provider,omitempty"`
+	Role     string   `json:"role,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// Store keeps sessions until they expire
+type Store interface {
+	// Save stores or replaces a session
+	Save(session *Session) error
+	// Load returns a session, nil when it doesn't exist
+	Load(id string) (*Session, error)
+	// Delete removes a session
+	Delete(id string) error
+	// DeleteExpired removes the sessions that expired before now
+	DeleteExpired(now time.Time) error
+}
+
+// NewStore creates the session store of a web config
+func NewStore(cfg config.SessionStoreConfig) (Store, error) {
+	switch cfg.Type {
+	case "", StoreMemory:
+		return NewMemoryStore(), nil
+	case StoreFile:
+		return NewFileStore(cfg.Dir)
+	case StoreRedis:
+		if cfg.Redis == nil {
+			return nil, fmt.Errorf("redis session store requires redis settings")
+		}
+		return NewRedisStore(*cfg.Redis), nil
+	}
+	return nil, fmt.Errorf("unsupported session store type: %s", cfg.Type)
+}
+
+// MemoryStore keeps sessions in process, they are lost on restart
+type MemoryStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]Session)}
+}
+
+// Save implements Store
+func (s *MemoryStore) Save(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = *session
+	return nil
+}
+
+// Load implements Store
+func (s *MemoryStore) Load(id string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// Delete implements Store
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// DeleteExpired implements Store
+func (s *MemoryStore) DeleteExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.ExpiresAt.Before(now) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of stored sessions
+func (s *MemoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions)
+}
+
+// Signer signs session cookies, so only IDs issued with the same key are looked up
+type Signer struct {
+	key []byte
+}
+
+// NewSigner returns nil without a key, cookies then carry the bare session ID
+func NewSigner(key string) *Signer {
+	if key == "" {
+		return nil
+	}
+	return &Signer{key: []byte(key)}
+}
+
+// Sign returns the cookie value of a session ID
+func (s *Signer) Sign(id string) string {
+	if s == nil {
+		return id
+	}
+	return id + "." + s.mac(id)
+}
+
+// Verify returns the session ID of a cookie value, ok is false when its signature is invalid
+func (s *Signer) Verify(value string) (id string, ok bool) {
+	if s == nil {
+		return value, value != ""
+	}
+	id, sig, found := strings.Cut(value, ".")
+	if !found || id == "" {
+		return "", false
+	}
+	return id, subtle.ConstantTimeCompare([]byte(sig), []byte(s.mac(id))) == 1
+}
+
+func (s *Signer) mac(id string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,116 @@
+package sessions
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+// testStore runs the Store contract against a store
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	now := time.Now()
+	live := &Session{ID: "live", Username: "admin", CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(time.Hour)}
+	expired := &Session{ID: "expired", Username: "admin", CreatedAt: now, LastSeen: now, ExpiresAt: now.Add(-time.Minute)}
+	for _, session := range []*Session{live, expired} {
+		if err := store.Save(session); err != nil {
+			t.Fatalf("Save(%s) error = %v", session.ID, err)
+		}
+	}
+
+	loaded, err := store.Load("live")
+	if err != nil || loaded == nil {
+		t.Fatalf("Load() = %v, %v", loaded, err)
+	}
+	if loaded.Username != "admin" || !loaded.ExpiresAt.Equal(live.ExpiresAt) {
+		t.Errorf("Loaded session %+v, want %+v", loaded, live)
+	}
+	if missing, err := store.Load("missing"); missing != nil || err != nil {
+		t.Errorf("Load(missing) = %v, %v, want nil, nil", missing, err)
+	}
+
+	if err := store.DeleteExpired(now); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := store.Load("expired"); session != nil {
+		t.Error("Expected the expired session to be removed")
+	}
+	if err := store.Delete("live"); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := store.Load("live"); session != nil {
+		t.Error("Expected the deleted session to be gone")
+	}
+	if err := store.Delete("live"); err != nil {
+		t.Errorf("Deleting a missing session error = %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+
+	// Files don't reveal session IDs, and a second store on the directory sees the sessions
+	session := &Session{ID: "shared-id", Username: "admin", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.Save(session); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || strings.Contains(entries[0].Name(), "shared-id") {
+		t.Errorf("Unexpected session files: %v", entries)
+	}
+	other, _ := NewFileStore(dir)
+	if loaded, err := other.Load("shared-id"); err != nil || loaded == nil {
+		t.Errorf("Expected the shared directory to hold the session, got %v, %v", loaded, err)
+	}
+
+	if _, err := NewFileStore(""); err == nil {
+		t.Error("Expected an error without a directory")
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	if store, err := NewStore(config.SessionStoreConfig{}); err != nil || store == nil {
+		t.Errorf("Expected a memory store by default, got %v, %v", store, err)
+	}
+	if _, err := NewStore(config.SessionStoreConfig{Type: StoreRedis}); err == nil {
+		t.Error("Expected an error without redis settings")
+	}
+	if _, err := NewStore(config.SessionStoreConfig{Type: "etcd"}); err == nil {
+		t.Error("Expected an error for an unknown store type")
+	}
+}
+
+func TestSigner(t *testing.T) {
+	signer := NewSigner("secret")
+	value := signer.Sign("abc123")
+	if id, ok := signer.Verify(value); !ok || id != "abc123" {
+		t.Errorf("Verify(%q) = %q, %v", value, id, ok)
+	}
+	for _, forged := range []string{"abc123", "abc123.", "other." + strings.SplitN(value, ".", 2)[1], NewSigner("other-key").Sign("abc123"), ""} {
+		if _, ok := signer.Verify(forged); ok {
+			t.Errorf("Expected %q to be rejected", forged)
+		}
+	}
+
+	// Without a key cookies carry the bare session ID
+	var unsigned *Signer
+	if unsigned.Sign("abc123") != "abc123" {
+		t.Error("Expected unsigned cookies without a key")
+	}
+	if id, ok := unsigned.Verify("abc123"); !ok || id != "abc123" {
+		t.Errorf("Verify() = %q, %v", id, ok)
+	}
+}
@@ -0,0 +1,197 @@
+// Package ui serves the operator customizations shared by the gateway and client dashboards:
+// a theme directory overriding the built-in static files and translation bundles with
+// feature flags supplied by the backend.
+package ui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+	"github.com/buhuipao/anyproxy/pkg/logger"
+)
+
+// themeStylesheet is loaded by every page when the theme directory provides it
+const themeStylesheet = "theme.css"
+
+// maxBundleSize bounds a translation bundle file
+const maxBundleSize = 1 << 20
+
+// errInvalidLanguage rejects language tags that can't name a bundle
+var errInvalidLanguage = errors.New("invalid language")
+
+// languagePattern matches language tags such as "en", "zh" or "pt-BR", and keeps bundle names inside the directory
+var languagePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})?$`)
+
+// UI holds the branding and localization settings of a dashboard
+type UI struct {
+	themeDir        string
+	i18nDir         string
+	defaultLanguage string
+	features        map[string]bool
+}
+
+// Config is the response of the UI config API
+type Config struct {
+	Language        string            `json:"language"`                   // Language of Translations
+	DefaultLanguage string            `json:"default_language,omitempty"` // Operator default for browsers without a saved preference
+	Languages       []string          `json:"languages"`                  // Languages with a bundle on the backend
+	Translations    map[string]string `json:"translations"`               // Strings overriding the built-in ones
+	Features        map[string]bool   `json:"features"`
+	ThemeStylesheet string            `json:"theme_stylesheet,omitempty"` // Path of the operator stylesheet
+}
+
+// New returns the UI settings of a web config
+func New(cfg config.WebConfig) *UI {
+	if cfg.ThemeDir != "" || cfg.I18nDir != "" {
+		logger.Info("Web interface customizations enabled", "theme_dir", cfg.ThemeDir, "i18n_dir", cfg.I18nDir, "default_language", cfg.DefaultLanguage)
+	}
+	return &UI{
+		themeDir:        cfg.ThemeDir,
+		i18nDir:         cfg.I18nDir,
+		defaultLanguage: cfg.DefaultLanguage,
+		features:        cfg.Features,
+	}
+}
+
+// FileSystem serves files of the theme directory in place of the static files with the same path
+func (u *UI) FileSystem(staticDir string) http.FileSystem {
+	static := http.Dir(staticDir)
+	if u == nil || u.themeDir == "" {
+		return static
+	}
+	return &overlayFS{theme: http.Dir(u.themeDir), static: static}
+}
+
+// overlayFS looks files up in the theme before the static files
+type overlayFS struct {
+	theme  http.FileSystem
+	static http.FileSystem
+}
+
+func (o *overlayFS) Open(name string) (http.File, error) {
+	f, err := o.theme.Open(name)
+	if err == nil {
+		// Directories come from the static files, so their index.html can still be overridden
+		if stat, statErr := f.Stat(); statErr == nil && !stat.IsDir() {
+			return f, nil
+		}
+		_ = f.Close()
+	}
+	return o.static.Open(name)
+}
+
+// Translations reads the bundle of a language, nil when there is none
+func (u *UI) Translations(lang string) (map[string]string, error) {
+	if u.i18nDir == "" {
+		return nil, nil
+	}
+	if !languagePattern.MatchString(lang) {
+		return nil, fmt.Errorf("%w: %q", errInvalidLanguage, lang)
+	}
+	path := filepath.Join(u.i18nDir, lang+".json")
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxBundleSize {
+		return nil, fmt.Errorf("translation bundle %s exceeds %d bytes", path, maxBundleSize)
+	}
+	data, err := os.ReadFile(path) //nolint:gosec // language is validated against languagePattern
+	if err != nil {
+		return nil, err
+	}
+	var translations map[string]string
+	if err := json.Unmarshal(data, &translations); err != nil {
+		return nil, fmt.Errorf("invalid translation bundle %s: %v", path, err)
+	}
+	return translations, nil
+}
+
+// Languages lists the languages with a bundle, sorted
+func (u *UI) Languages() []string {
+	languages := []string{}
+	if u.i18nDir == "" {
+		return languages
+	}
+	entries, err := os.ReadDir(u.i18nDir)
+	if err != nil {
+		logger.Warn("Failed to list translation bundles", "i18n_dir", u.i18nDir, "err", err)
+		return languages
+	}
+	for _, entry := range entries {
+		lang, ok := strings.CutSuffix(entry.Name(), ".json")
+		if ok && !entry.IsDir() && languagePattern.MatchString(lang) {
+			languages = append(languages, lang)
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Config returns the UI config for a language, the default language when lang is empty
+func (u *UI) Config(lang string) (*Config, error) {
+	if lang == "" {
+		lang = u.defaultLanguage
+	}
+	cfg := &Config{
+		Language:        lang,
+		DefaultLanguage: u.defaultLanguage,
+		Languages:       u.Languages(),
+		Translations:    map[string]string{},
+		Features:        map[string]bool{},
+	}
+	for name, enabled := range u.features {
+		cfg.Features[name] = enabled
+	}
+	if lang != "" {
+		translations, err := u.Translations(lang)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range translations {
+			cfg.Translations[key] = value
+		}
+	}
+	if u.themeDir != "" {
+		if _, err := os.Stat(filepath.Join(u.themeDir, themeStylesheet)); err == nil {
+			cfg.ThemeStylesheet = "/" + themeStylesheet
+		}
+	}
+	return cfg, nil
+}
+
+// HandleConfig serves the UI config, the language is taken from the "lang" query parameter.
+// It is public, the login page is localized too.
+func (u *UI) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, err := u.Config(r.URL.Query().Get("lang"))
+	if errors.Is(err, errInvalidLanguage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to load translation bundle", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		logger.Error("Failed to encode UI config", "err", err)
+	}
+}
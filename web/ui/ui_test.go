@@ -0,0 +1,103 @@
+package ui
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buhuipao/anyproxy/pkg/config"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUI_FileSystem(t *testing.T) {
+	staticDir, themeDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(staticDir, "index.html"), "built-in index")
+	writeFile(t, filepath.Join(staticDir, "login.html"), "built-in login")
+	writeFile(t, filepath.Join(themeDir, "login.html"), "branded login")
+	writeFile(t, filepath.Join(themeDir, "theme.css"), "body {}")
+
+	server := httptest.NewServer(http.FileServer(New(config.WebConfig{ThemeDir: themeDir}).FileSystem(staticDir)))
+	defer server.Close()
+
+	for path, want := range map[string]string{
+		"/index.html": "built-in index",
+		"/login.html": "branded login",
+		"/theme.css":  "body {}",
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("GET %s = %q, want %q", path, body, want)
+		}
+	}
+}
+
+func TestUI_HandleConfig(t *testing.T) {
+	i18nDir, themeDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(i18nDir, "de.json"), `{"dashboard.title": "AnyProxy Gateway Übersicht"}`)
+	writeFile(t, filepath.Join(i18nDir, "zh.json"), `{"dashboard.title": "企业网关"}`)
+	writeFile(t, filepath.Join(i18nDir, "broken.txt"), "ignored")
+	writeFile(t, filepath.Join(themeDir, "theme.css"), "body {}")
+
+	u := New(config.WebConfig{
+		ThemeDir:        themeDir,
+		I18nDir:         i18nDir,
+		DefaultLanguage: "de",
+		Features:        map[string]bool{"clash_profile": false, "mirror": true},
+	})
+
+	get := func(query string) (*httptest.ResponseRecorder, *Config) {
+		rec := httptest.NewRecorder()
+		u.HandleConfig(rec, httptest.NewRequest(http.MethodGet, "/api/ui/config"+query, nil))
+		var cfg Config
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec, &cfg
+	}
+
+	rec, cfg := get("")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if cfg.Language != "de" || cfg.Translations["dashboard.title"] != "AnyProxy Gateway Übersicht" {
+		t.Errorf("Expected the default language bundle, got %+v", cfg)
+	}
+	if len(cfg.Languages) != 2 || cfg.Languages[0] != "de" || cfg.Languages[1] != "zh" {
+		t.Errorf("Expected languages [de zh], got %v", cfg.Languages)
+	}
+	if !cfg.Features["mirror"] || cfg.Features["clash_profile"] || cfg.ThemeStylesheet != "/theme.css" {
+		t.Errorf("Unexpected features or theme: %+v", cfg)
+	}
+
+	if _, cfg = get("?lang=fr"); cfg.Language != "fr" || len(cfg.Translations) != 0 {
+		t.Errorf("Expected no translations for a language without a bundle, got %+v", cfg)
+	}
+	if rec, _ = get("?lang=../secrets"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a path in the language, got %d", rec.Code)
+	}
+
+	writeFile(t, filepath.Join(i18nDir, "es.json"), "not json")
+	if rec, _ = get("?lang=es"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for an invalid bundle, got %d", rec.Code)
+	}
+}